@@ -0,0 +1,228 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/mutate/index"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var annotateCommand = uxForce(uxTag(uxPlatform(cli.Command{
+	Name:  "annotate",
+	Usage: "modifies the annotations of an OCI image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] <options>...
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image whose annotations will be modified (if not specified, it
+defaults to "latest"). "<new-tag>" is the new reference name to save the image
+as, if this is not specified then umoci will replace the old image.
+
+--manifest modifies the annotations of the image manifest. --descriptor
+modifies the annotations of the descriptor of the image manifest in the
+manifest list "<tag>" refers to (and so requires "<tag>" to refer to a
+manifest list). Unlike umoci-config(1), no history entry is added. The
+annotations of a manifest list itself can be modified with "umoci index
+annotate".`,
+
+	// annotate modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "manifest",
+			Usage: "set an annotation of the image manifest (of the form key=value)",
+		},
+		cli.StringSliceFlag{
+			Name:  "remove-manifest",
+			Usage: "remove the annotation with the given key from the image manifest",
+		},
+		cli.StringSliceFlag{
+			Name:  "descriptor",
+			Usage: "set an annotation of the descriptor of the image manifest in the manifest list (of the form key=value)",
+		},
+		cli.StringSliceFlag{
+			Name:  "remove-descriptor",
+			Usage: "remove the annotation with the given key from the descriptor of the image manifest in the manifest list",
+		},
+	},
+
+	Action: annotate,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		modified := false
+		for _, flag := range []string{"manifest", "descriptor"} {
+			for _, annotation := range ctx.StringSlice(flag) {
+				if !strings.Contains(annotation, "=") || strings.HasPrefix(annotation, "=") {
+					return errors.Errorf("invalid --%s %q: must be of the form key=value", flag, annotation)
+				}
+				modified = true
+			}
+			for _, key := range ctx.StringSlice("remove-" + flag) {
+				if key == "" {
+					return errors.Errorf("invalid --remove-%s: key cannot be empty", flag)
+				}
+				modified = true
+			}
+		}
+		if !modified {
+			return errors.Errorf("nothing to do: at least one of --manifest, --remove-manifest, --descriptor or --remove-descriptor must be specified")
+		}
+		return nil
+	},
+})))
+
+// annotateManifest applies the --manifest and --remove-manifest options to
+// the given image manifest, returning the descriptor of the new manifest.
+func annotateManifest(ctx *cli.Context, engine casext.Engine, descriptor ispec.Descriptor) (ispec.Descriptor, error) {
+	mutator, err := mutate.New(engine, descriptor)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "create mutator for manifest")
+	}
+	for _, annotation := range ctx.StringSlice("manifest") {
+		parts := strings.SplitN(annotation, "=", 2)
+		if err := mutator.SetAnnotation(context.Background(), mutate.AnnotationManifest, parts[0], parts[1]); err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "set annotation %s", parts[0])
+		}
+	}
+	for _, key := range ctx.StringSlice("remove-manifest") {
+		if err := mutator.DeleteAnnotation(context.Background(), mutate.AnnotationManifest, key); err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "remove annotation %s", key)
+		}
+	}
+	return mutator.Commit(context.Background())
+}
+
+// annotateManifestList replaces the entry of the manifest list for the given
+// platform with newManifest (keeping the annotations of its descriptor), and
+// then applies the --descriptor and --remove-descriptor options to it,
+// returning the descriptor of the new manifest list.
+func annotateManifestList(ctx *cli.Context, engine casext.Engine, list, newManifest ispec.Descriptor, platform ispec.Platform) (ispec.Descriptor, error) {
+	mutator, err := index.New(engine, list)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "create mutator for manifest list")
+	}
+
+	annotations, err := mutator.DescriptorAnnotations(context.Background(), platform)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get descriptor annotations")
+	}
+	manifests, err := mutator.Manifests(context.Background())
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get manifests")
+	}
+	for _, entry := range manifests {
+		if !casext.PlatformMatches(platform, entry.Platform) || entry.Digest == newManifest.Digest {
+			continue
+		}
+		// Replacing the entry drops the annotations of its descriptor, so
+		// they have to be restored.
+		if err := mutator.Add(context.Background(), newManifest, entry.Platform); err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "replace manifest")
+		}
+		for key, value := range annotations {
+			if err := mutator.SetDescriptorAnnotation(context.Background(), platform, key, value); err != nil {
+				return ispec.Descriptor{}, errors.Wrapf(err, "restore annotation %s", key)
+			}
+		}
+	}
+
+	for _, annotation := range ctx.StringSlice("descriptor") {
+		parts := strings.SplitN(annotation, "=", 2)
+		if err := mutator.SetDescriptorAnnotation(context.Background(), platform, parts[0], parts[1]); err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "set annotation %s", parts[0])
+		}
+	}
+	for _, key := range ctx.StringSlice("remove-descriptor") {
+		if err := mutator.DeleteDescriptorAnnotation(context.Background(), platform, key); err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "remove annotation %s", key)
+		}
+	}
+	return mutator.Commit(context.Background())
+}
+
+func annotate(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	fromDescriptor, err := engineExt.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	isList := fromDescriptor.MediaType == ispec.MediaTypeImageManifestList
+	if !isList && (ctx.IsSet("descriptor") || ctx.IsSet("remove-descriptor")) {
+		return errors.Errorf("--descriptor and --remove-descriptor require %s to refer to a manifest list", fromName)
+	}
+
+	platform := requestedPlatform(ctx)
+	manifestDescriptor, err := engineExt.ResolveManifest(context.Background(), fromDescriptor, platform)
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
+
+	newDescriptor := manifestDescriptor
+	if ctx.IsSet("manifest") || ctx.IsSet("remove-manifest") {
+		newDescriptor, err = annotateManifest(ctx, engineExt, manifestDescriptor)
+		if err != nil {
+			return errors.Wrap(err, "annotate manifest")
+		}
+		log.Infof("new image manifest created: %s", newDescriptor.Digest)
+	}
+	if isList {
+		newDescriptor, err = annotateManifestList(ctx, engineExt, fromDescriptor, newDescriptor, platform)
+		if err != nil {
+			return errors.Wrap(err, "annotate manifest list")
+		}
+		log.Infof("new manifest list created: %s", newDescriptor.Digest)
+	}
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	if err := putTag(context.Background(), engine, tagName, newDescriptor, &fromDescriptor, force); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image: %s", tagName)
+	return nil
+}
@@ -0,0 +1,362 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var artifactCommand = cli.Command{
+	Name:  "artifact",
+	Usage: "stores and retrieves OCI artifacts in an OCI image",
+	ArgsUsage: `<command> [<args>]
+
+An artifact is an image manifest whose configuration and blobs can have any
+media type, which allows for arbitrary content (such as Helm charts, WASM
+modules or policy bundles) to be stored in an OCI image. Unlike the artifacts
+created by umoci-attach(1), these artifacts are tagged like any other image.`,
+
+	Subcommands: []cli.Command{
+		artifactPushCommand,
+		artifactPullCommand,
+	},
+}
+
+var artifactPushCommand = uxForce(cli.Command{
+	Name:  "push",
+	Usage: "stores files as a tagged artifact",
+	ArgsUsage: `--image <image-path>[:<tag>] [--type <type>] [--config <config>] [<file>...]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag to create for the artifact (if not specified, it defaults to "latest"), and
+"<type>" is the media type of the artifact. Each "<file>" is stored as a blob
+of the artifact, named after the final component of its path.
+
+If "<config>" is specified, it is stored as the configuration of the artifact
+(with the media type given by --config-type), otherwise the empty JSON blob is
+used and --type must be specified.`,
+
+	// artifact push modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "type",
+			Usage: "media type of the artifact",
+		},
+		cli.StringFlag{
+			Name:  "media-type",
+			Usage: "media type of the artifact blobs",
+			Value: "application/octet-stream",
+		},
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "file to store as the configuration of the artifact",
+		},
+		cli.StringFlag{
+			Name:  "config-type",
+			Usage: "media type of the configuration of the artifact",
+		},
+		cli.StringSliceFlag{
+			Name:  "annotation",
+			Usage: "set an annotation of the artifact (of the form key=value)",
+		},
+	},
+
+	Action: artifactPush,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.String("type") == "" && ctx.String("config") == "" {
+			return errors.Errorf("missing mandatory argument: --type (required without --config)")
+		}
+		if (ctx.String("config") == "") != (ctx.String("config-type") == "") {
+			return errors.Errorf("--config and --config-type must be specified together")
+		}
+		for _, annotation := range ctx.StringSlice("annotation") {
+			if !strings.Contains(annotation, "=") {
+				return errors.Errorf("--annotation must be of the form key=value: %s", annotation)
+			}
+		}
+		names := map[string]string{}
+		for _, arg := range ctx.Args() {
+			if arg == "" {
+				return errors.Errorf("file path cannot be empty")
+			}
+			name := filepath.Base(arg)
+			if other, ok := names[name]; ok {
+				return errors.Errorf("files %s and %s have the same name", other, arg)
+			}
+			names[name] = arg
+		}
+		return nil
+	},
+})
+
+var artifactPullCommand = cli.Command{
+	Name:  "pull",
+	Usage: "retrieves the files of a tagged artifact",
+	ArgsUsage: `--image <image-path>[:<tag>] [--output <dir>] [--type <type>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged artifact (if not specified, it defaults to "latest"), and "<dir>" is the
+directory the blobs of the artifact are written to (if not specified, it
+defaults to the current directory). If "<type>" is specified, the artifact must
+have that media type.
+
+Each blob is written to a file named after its
+"org.opencontainers.image.title" annotation (or its digest, if it has no such
+annotation). The digest of each blob is verified as it is written.`,
+
+	// artifact pull only reads from an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "directory to write the blobs of the artifact to",
+			Value: ".",
+		},
+		cli.StringFlag{
+			Name:  "type",
+			Usage: "expected media type of the artifact",
+		},
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "also write the configuration of the artifact to the given file",
+		},
+	},
+
+	Action: artifactPull,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.String("output") == "" {
+			return errors.Errorf("--output cannot be empty")
+		}
+		return nil
+	},
+}
+
+// putArtifactFile stores the file at the given path as a blob with the given
+// media type, returning its descriptor.
+func putArtifactFile(engine casext.Engine, path, mediaType string) (ispec.Descriptor, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "open artifact blob")
+	}
+	defer fh.Close()
+
+	blobDigest, blobSize, err := engine.PutBlob(context.Background(), fh)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "put artifact blob %s", path)
+	}
+	return ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    blobDigest,
+		Size:      blobSize,
+	}, nil
+}
+
+func artifactPush(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	annotations := map[string]string{}
+	for _, annotation := range ctx.StringSlice("annotation") {
+		parts := strings.SplitN(annotation, "=", 2)
+		annotations[parts[0]] = parts[1]
+	}
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	var config *ispec.Descriptor
+	if path := ctx.String("config"); path != "" {
+		descriptor, err := putArtifactFile(engineExt, path, ctx.String("config-type"))
+		if err != nil {
+			return errors.Wrap(err, "put artifact config")
+		}
+		config = &descriptor
+	}
+
+	var blobs []casext.ArtifactBlob
+	for _, path := range ctx.Args() {
+		descriptor, err := putArtifactFile(engineExt, path, ctx.String("media-type"))
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, casext.ArtifactBlob{
+			Descriptor: descriptor,
+			Annotations: map[string]string{
+				casext.AnnotationTitle: filepath.Base(path),
+			},
+		})
+	}
+
+	descriptor, err := engineExt.PutArtifact(context.Background(), ctx.String("type"), config, blobs, annotations)
+	if err != nil {
+		return errors.Wrap(err, "put artifact")
+	}
+
+	log.Infof("new artifact manifest created: %s", descriptor.Digest)
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	if err := putTag(context.Background(), engine, tagName, descriptor, nil, force); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for artifact manifest: %s", tagName)
+	return nil
+}
+
+// artifactFileName returns the name of the file that the given blob of an
+// artifact is written to. Titles which are not plain file names are rejected,
+// so that an artifact cannot write outside of the output directory.
+func artifactFileName(blob casext.ArtifactBlob) (string, error) {
+	title, ok := blob.Annotations[casext.AnnotationTitle]
+	if !ok {
+		return blob.Digest.Algorithm().String() + "-" + blob.Digest.Hex(), nil
+	}
+	if title == "" || title == "." || title == ".." || strings.ContainsAny(title, `/\`) {
+		return "", errors.Errorf("blob %s has an invalid title: %q", blob.Digest, title)
+	}
+	return title, nil
+}
+
+// writeArtifactFile writes the given blob to the file at the given path,
+// verifying its digest and size. If verification fails, the file is removed.
+func writeArtifactFile(engine casext.Engine, descriptor ispec.Descriptor, path string) (err error) {
+	reader, err := engine.GetBlob(context.Background(), descriptor.Digest)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "create file")
+	}
+	defer func() {
+		if closeErr := fh.Close(); err == nil {
+			err = errors.Wrap(closeErr, "close file")
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	verifier := descriptor.Digest.Verifier()
+	size, err := io.Copy(io.MultiWriter(fh, verifier), reader)
+	if err != nil {
+		return errors.Wrap(err, "copy blob")
+	}
+	if size != descriptor.Size {
+		return errors.Errorf("blob %s has size %d rather than %d", descriptor.Digest, size, descriptor.Size)
+	}
+	if !verifier.Verified() {
+		return errors.Wrapf(cas.ErrDigestMismatch, "blob %s", descriptor.Digest)
+	}
+	return nil
+}
+
+func artifactPull(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	outputDir := ctx.String("output")
+
+	// Get a reference to the CAS.
+	engine, err := openReadOnlyImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	descriptor, err := engineExt.GetReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	manifest, blobs, err := engineExt.GetArtifact(context.Background(), casext.ConvertDescriptor(descriptor))
+	if err != nil {
+		return errors.Wrap(err, "get artifact")
+	}
+	if expected := ctx.String("type"); expected != "" && manifest.ArtifactType != expected {
+		return errors.Errorf("artifact has type %q rather than %q", manifest.ArtifactType, expected)
+	}
+
+	// Make sure that all of the blobs have usable names before writing
+	// anything.
+	names := map[string]bool{}
+	var paths []string
+	for _, blob := range blobs {
+		name, err := artifactFileName(blob)
+		if err != nil {
+			return err
+		}
+		if names[name] {
+			return errors.Errorf("artifact has several blobs named %s", name)
+		}
+		names[name] = true
+		paths = append(paths, filepath.Join(outputDir, name))
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return errors.Wrap(err, "create output directory")
+	}
+	for idx, blob := range blobs {
+		if err := writeArtifactFile(engineExt, blob.Descriptor, paths[idx]); err != nil {
+			return errors.Wrapf(err, "write %s", paths[idx])
+		}
+		log.WithFields(log.Fields{
+			"digest": blob.Digest,
+			"size":   blob.Size,
+		}).Infof("wrote %s", paths[idx])
+	}
+
+	if path := ctx.String("config"); path != "" {
+		if err := writeArtifactFile(engineExt, manifest.Config, path); err != nil {
+			return errors.Wrapf(err, "write config %s", path)
+		}
+		log.Infof("wrote config (%s) to %s", manifest.Config.MediaType, path)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var assembleCommand = uxForce(cli.Command{
+	Name:  "assemble",
+	Usage: "assembles and verifies an image from a lockfile",
+	ArgsUsage: `--image <image-path>[:<tag>] [--from <source-path>] <lockfile>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag to create for the assembled image, "<lockfile>" is the path to a lockfile
+generated by umoci-lock(1) (or "-" to read it from stdin) and "<source-path>"
+is the path to an OCI image that missing blobs are copied from.
+
+Every blob described by the lockfile is verified, and assembly fails if the
+resulting manifest is not identical to the locked manifest.`,
+
+	// assemble creates a new manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "from",
+			Usage: "path of an OCI image to copy missing blobs from",
+		},
+	},
+
+	Action: assemble,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <lockfile>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("lockfile path cannot be empty")
+		}
+		ctx.App.Metadata["lockfile"] = ctx.Args().First()
+		return nil
+	},
+})
+
+// readLock reads the lockfile at the given path ("-" meaning stdin).
+func readLock(path string) (casext.ImageLock, error) {
+	var imageLock casext.ImageLock
+
+	var reader io.Reader = os.Stdin
+	if path != "-" {
+		fh, err := os.Open(path)
+		if err != nil {
+			return imageLock, errors.Wrap(err, "open lockfile")
+		}
+		defer fh.Close()
+		reader = fh
+	}
+
+	err := json.NewDecoder(reader).Decode(&imageLock)
+	return imageLock, errors.Wrap(err, "parse lockfile")
+}
+
+func assemble(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	lockPath := ctx.App.Metadata["lockfile"].(string)
+
+	imageLock, err := readLock(lockPath)
+	if err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	var opt casext.AssembleOptions
+	if ctx.IsSet("from") {
+		source, err := openReadOnlyImage(ctx, ctx.String("from"))
+		if err != nil {
+			return errors.Wrap(err, "open source CAS")
+		}
+		defer source.Close()
+		opt.Source = source
+	}
+
+	descriptor, err := engineExt.AssembleWithOptions(context.Background(), imageLock, opt)
+	if err != nil {
+		return errors.Wrap(err, "assemble")
+	}
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	if err := putTag(context.Background(), engine, tagName, descriptor, nil, force); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.WithFields(log.Fields{
+		"layers": len(imageLock.Layers),
+	}).Infof("assembled %s: %s", tagName, descriptor.Digest)
+	return nil
+}
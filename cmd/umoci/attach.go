@@ -0,0 +1,216 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var attachCommand = cli.Command{
+	Name:  "attach",
+	Usage: "attaches an artifact to an image",
+	ArgsUsage: `--image <image-path>[:<tag>] --artifact-type <type> [<file>...]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to attach the artifact to (if not specified, it defaults to
+"latest"), and "<type>" is the media type of the artifact. Each "<file>" is
+stored as a blob of the artifact.
+
+The artifact (such as an SBOM, signature or attestation) refers to the image
+as its subject, and is added to the referrers index of the image (a tag named
+"<alg>-<digest>" after the digest of the image). Artifacts are removed by
+umoci-gc(1) once the image is no longer reachable.`,
+
+	// attach modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "artifact-type",
+			Usage: "media type of the artifact",
+		},
+		cli.StringFlag{
+			Name:  "media-type",
+			Usage: "media type of the artifact blobs",
+			Value: "application/octet-stream",
+		},
+		cli.StringSliceFlag{
+			Name:  "annotation",
+			Usage: "set an annotation of the artifact (of the form key=value)",
+		},
+	},
+
+	Action: attach,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.String("artifact-type") == "" {
+			return errors.Errorf("missing mandatory argument: --artifact-type")
+		}
+		for _, annotation := range ctx.StringSlice("annotation") {
+			if !strings.Contains(annotation, "=") {
+				return errors.Errorf("--annotation must be of the form key=value: %s", annotation)
+			}
+		}
+		for _, arg := range ctx.Args() {
+			if arg == "" {
+				return errors.Errorf("file path cannot be empty")
+			}
+		}
+		return nil
+	},
+}
+
+var referrersCommand = cli.Command{
+	Name:  "referrers",
+	Usage: "lists the artifacts attached to an image",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image whose artifacts (added with umoci-attach(1)) are listed.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// referrers gives information about a manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "artifact-type",
+			Usage: "only list artifacts of the given media type",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the artifacts as a JSON encoded blob",
+		},
+	},
+
+	Action: referrers,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+}
+
+func attach(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	annotations := map[string]string{}
+	for _, annotation := range ctx.StringSlice("annotation") {
+		parts := strings.SplitN(annotation, "=", 2)
+		annotations[parts[0]] = parts[1]
+	}
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	subject, err := engineExt.GetReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+
+	var blobs []ispec.Descriptor
+	for _, path := range ctx.Args() {
+		fh, err := os.Open(path)
+		if err != nil {
+			return errors.Wrap(err, "open artifact blob")
+		}
+		blobDigest, blobSize, err := engineExt.PutBlob(context.Background(), fh)
+		fh.Close()
+		if err != nil {
+			return errors.Wrapf(err, "put artifact blob %s", path)
+		}
+		blobs = append(blobs, ispec.Descriptor{
+			MediaType: ctx.String("media-type"),
+			Digest:    blobDigest,
+			Size:      blobSize,
+		})
+	}
+
+	artifact, err := engineExt.Attach(context.Background(), subject, ctx.String("artifact-type"), blobs, annotations)
+	if err != nil {
+		return errors.Wrap(err, "attach artifact")
+	}
+
+	log.Infof("attached artifact to %s: %s", subject.Digest, artifact.Digest)
+	return nil
+}
+
+func referrers(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openReadOnlyImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	subject, err := engineExt.GetReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+
+	artifacts, err := engineExt.Artifacts(context.Background(), subject.Digest, ctx.String("artifact-type"))
+	if err != nil {
+		return errors.Wrap(err, "get artifacts")
+	}
+
+	if ctx.Bool("json") {
+		if artifacts == nil {
+			artifacts = []casext.Artifact{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(artifacts); err != nil {
+			return errors.Wrap(err, "encoding artifacts")
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "DIGEST\tARTIFACT TYPE\n")
+	for _, artifact := range artifacts {
+		fmt.Fprintf(tw, "%s\t%s\n", artifact.Descriptor.Digest, artifact.ArtifactType)
+	}
+	return tw.Flush()
+}
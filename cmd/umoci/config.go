@@ -18,13 +18,19 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/mutate"
 	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/pkg/envfile"
+	"github.com/openSUSE/umoci/pkg/jsonpatch"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -33,7 +39,7 @@ import (
 
 // FIXME: We should also implement a raw mode that just does modifications of
 //        JSON blobs (allowing this all to be used outside of our build setup).
-var configCommand = uxHistory(uxTag(cli.Command{
+var configCommand = uxForce(uxHistory(uxSourceDateEpoch(uxTag(uxPlatform(cli.Command{
 	Name:  "config",
 	Usage: "modifies the image configuration of an OCI image",
 	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>]
@@ -42,7 +48,19 @@ Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
 the tagged image from which the config modifications will be based (if not
 specified, it defaults to "latest"). "<new-tag>" is the new reference name to
 save the new image as, if this is not specified then umoci will replace the old
-image.`,
+image.
+
+With --patch, the given JSON patch (RFC 6902) is applied to the image
+configuration after all other modifications, which allows for arbitrary
+modifications (including of fields umoci doesn't otherwise know about).
+
+With --env-file and --config.labels-file, environment variables and labels are
+set in bulk from files (see umoci-config(1) for the format). Files are applied
+in order before the --config.env and --config.label flags.
+
+With --show, the image configuration and manifest that would be produced are
+printed (as a JSON object with "config" and "manifest" keys) and the image is
+not modified.`,
 
 	// config modifies a particular image manifest.
 	Category: "image",
@@ -62,21 +80,43 @@ image.`,
 		cli.StringFlag{Name: "config.user"},
 		cli.StringSliceFlag{Name: "config.exposedports"},
 		cli.StringSliceFlag{Name: "config.env"},
+		cli.StringSliceFlag{
+			Name:  "env-file",
+			Usage: "file (dotenv or JSON) of environment variables to set (or unset with KEY-)",
+		},
 		cli.StringSliceFlag{Name: "config.entrypoint"}, // FIXME: This interface is weird.
 		cli.StringSliceFlag{Name: "config.cmd"},        // FIXME: This interface is weird.
 		cli.StringSliceFlag{Name: "config.volume"},
 		cli.StringSliceFlag{Name: "config.label"},
+		cli.StringSliceFlag{
+			Name:  "config.labels-file",
+			Usage: "file (dotenv or JSON) of labels to set (or unset with KEY-)",
+		},
 		cli.StringFlag{Name: "config.workingdir"},
+		cli.StringFlag{Name: "config.stopsignal"},
+		cli.StringSliceFlag{Name: "config.healthcheck.test"},
+		cli.StringFlag{Name: "config.healthcheck.interval"},
+		cli.StringFlag{Name: "config.healthcheck.timeout"},
+		cli.StringFlag{Name: "config.healthcheck.start-period"},
+		cli.IntFlag{Name: "config.healthcheck.retries"},
 		cli.StringFlag{Name: "created"}, // FIXME: Implement TimeFlag.
 		cli.StringFlag{Name: "author"},
 		cli.StringFlag{Name: "architecture"},
 		cli.StringFlag{Name: "os"},
 		cli.StringSliceFlag{Name: "manifest.annotation"},
 		cli.StringSliceFlag{Name: "clear"},
+		cli.StringFlag{
+			Name:  "patch",
+			Usage: "JSON patch (RFC 6902) file to apply to the image configuration",
+		},
+		cli.BoolFlag{
+			Name:  "show",
+			Usage: "print the resulting config and manifest without modifying the image",
+		},
 	},
 
 	Action: config,
-}))
+})))))
 
 func toImage(config ispec.ImageConfig, meta mutate.Meta) ispec.Image {
 	return ispec.Image{
@@ -113,6 +153,57 @@ func parseEnv(env string) (string, string, error) {
 	return name, value, nil
 }
 
+// parseHealthcheck constructs a healthcheck from the --config.healthcheck.*
+// flags. The returned boolean is false if none of the flags were set. As with
+// Docker's HEALTHCHECK, the healthcheck is replaced as a whole and so
+// --config.healthcheck.test must always be specified. If the first element of
+// the test is not one of NONE, CMD or CMD-SHELL, it is treated as a command
+// (as though it was prefixed with CMD).
+func parseHealthcheck(ctx *cli.Context) (igen.Healthcheck, bool, error) {
+	var healthcheck igen.Healthcheck
+
+	if !ctx.IsSet("config.healthcheck.test") {
+		for _, flag := range []string{"interval", "timeout", "start-period", "retries"} {
+			if ctx.IsSet("config.healthcheck." + flag) {
+				return healthcheck, false, errors.Errorf("--config.healthcheck.%s requires --config.healthcheck.test", flag)
+			}
+		}
+		return healthcheck, false, nil
+	}
+
+	healthcheck.Test = ctx.StringSlice("config.healthcheck.test")
+	if len(healthcheck.Test) > 0 {
+		switch healthcheck.Test[0] {
+		case "NONE", "CMD", "CMD-SHELL":
+		default:
+			healthcheck.Test = append([]string{"CMD"}, healthcheck.Test...)
+		}
+	}
+	for _, dur := range []struct {
+		flag  string
+		value *time.Duration
+	}{
+		{"interval", &healthcheck.Interval},
+		{"timeout", &healthcheck.Timeout},
+		{"start-period", &healthcheck.StartPeriod},
+	} {
+		if !ctx.IsSet("config.healthcheck." + dur.flag) {
+			continue
+		}
+		value, err := time.ParseDuration(ctx.String("config.healthcheck." + dur.flag))
+		if err != nil {
+			return healthcheck, false, errors.Wrapf(err, "parse --config.healthcheck.%s", dur.flag)
+		}
+		*dur.value = value
+	}
+	healthcheck.Retries = ctx.Int("config.healthcheck.retries")
+
+	if err := healthcheck.Validate(); err != nil {
+		return healthcheck, false, errors.Wrap(err, "invalid healthcheck")
+	}
+	return healthcheck, true, nil
+}
+
 func config(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	fromName := ctx.App.Metadata["--image-tag"].(string)
@@ -123,8 +214,17 @@ func config(ctx *cli.Context) error {
 		tagName = val.(string)
 	}
 
-	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	// Get a reference to the CAS. With --show we don't write anything, so
+	// there's no need to validate references.
+	var (
+		engine cas.Engine
+		err    error
+	)
+	if ctx.Bool("show") {
+		engine, err = openReadOnlyImage(ctx, imagePath)
+	} else {
+		engine, err = openEngine(ctx, imagePath)
+	}
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -134,11 +234,16 @@ func config(ctx *cli.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "get from reference")
 	}
+	fromDescriptor, err = casext.Engine{engine}.ResolveManifest(context.Background(), fromDescriptor, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
 
 	mutator, err := mutate.New(engine, fromDescriptor)
 	if err != nil {
 		return errors.Wrap(err, "create mutator for manifest")
 	}
+	mutator.SetNoHistory(ctx.Bool("no-history"))
 
 	imageConfig, err := mutator.Config(context.Background())
 	if err != nil {
@@ -173,6 +278,10 @@ func config(ctx *cli.Context) error {
 				g.ClearConfigEnv()
 			case "config.volume":
 				g.ClearConfigVolumes()
+			case "config.healthcheck":
+				g.ClearConfigHealthcheck()
+			case "config.stopsignal":
+				g.ClearConfigStopSignal()
 			case "rootfs.diffids":
 				//g.ClearRootfsDiffIDs()
 				return errors.Errorf("--clear=rootfs.diffids is not safe")
@@ -192,6 +301,11 @@ func config(ctx *cli.Context) error {
 		}
 	}
 
+	// The creation date of a reproducible image is the source date epoch.
+	sourceDateEpoch, hasSourceDateEpoch := ctx.App.Metadata["--source-date-epoch"].(time.Time)
+	if hasSourceDateEpoch {
+		g.SetCreated(sourceDateEpoch)
+	}
 	if ctx.IsSet("created") {
 		// How do we handle other formats?
 		created, err := time.Parse(igen.ISO8601, ctx.String("created"))
@@ -217,9 +331,27 @@ func config(ctx *cli.Context) error {
 	}
 	if ctx.IsSet("config.exposedports") {
 		for _, port := range ctx.StringSlice("config.exposedports") {
+			if err := igen.ValidateExposedPort(port); err != nil {
+				return errors.Wrap(err, "parse --config.exposedports")
+			}
 			g.AddConfigExposedPort(port)
 		}
 	}
+	if ctx.IsSet("env-file") {
+		for _, path := range ctx.StringSlice("env-file") {
+			entries, err := envfile.ReadFile(path)
+			if err != nil {
+				return errors.Wrap(err, "parse --env-file")
+			}
+			for _, entry := range entries {
+				if entry.Remove {
+					g.RemoveConfigEnv(entry.Name)
+				} else {
+					g.AddConfigEnv(entry.Name, entry.Value)
+				}
+			}
+		}
+	}
 	if ctx.IsSet("config.env") {
 		for _, env := range ctx.StringSlice("config.env") {
 			name, value, err := parseEnv(env)
@@ -242,12 +374,35 @@ func config(ctx *cli.Context) error {
 			g.AddConfigVolume(volume)
 		}
 	}
+	if ctx.IsSet("config.labels-file") {
+		for _, path := range ctx.StringSlice("config.labels-file") {
+			entries, err := envfile.ReadFile(path)
+			if err != nil {
+				return errors.Wrap(err, "parse --config.labels-file")
+			}
+			for _, entry := range entries {
+				if entry.Remove {
+					g.RemoveConfigLabel(entry.Name)
+				} else {
+					g.AddConfigLabel(entry.Name, entry.Value)
+				}
+			}
+		}
+	}
 	if ctx.IsSet("config.label") {
 		for _, label := range ctx.StringSlice("config.label") {
 			parts := strings.SplitN(label, "=", 2)
 			g.AddConfigLabel(parts[0], parts[1])
 		}
 	}
+	if ctx.IsSet("config.stopsignal") {
+		g.SetConfigStopSignal(ctx.String("config.stopsignal"))
+	}
+	if healthcheck, ok, err := parseHealthcheck(ctx); err != nil {
+		return err
+	} else if ok {
+		g.SetConfigHealthcheck(healthcheck)
+	}
 	if ctx.IsSet("manifest.annotation") {
 		if annotations == nil {
 			annotations = map[string]string{}
@@ -265,27 +420,65 @@ func config(ctx *cli.Context) error {
 		CreatedBy:  "umoci config",
 		EmptyLayer: true,
 	}
+	if hasSourceDateEpoch {
+		history.Created = sourceDateEpoch
+	}
 
-	if val, ok := ctx.App.Metadata["--history.author"]; ok {
-		history.Author = val.(string)
+	history, err = historyFromContext(ctx, history, map[string]string{
+		"image": imagePath,
+		"tag":   tagName,
+	})
+	if err != nil {
+		return err
 	}
-	if val, ok := ctx.App.Metadata["--history.comment"]; ok {
-		history.Comment = val.(string)
+
+	newConfig, newMeta := fromImage(g.Image())
+	if err := mutator.Set(context.Background(), newConfig, newMeta, annotations, history); err != nil {
+		return errors.Wrap(err, "set modified configuration")
 	}
-	if val, ok := ctx.App.Metadata["--history.created"]; ok {
-		created, err := time.Parse(igen.ISO8601, val.(string))
-		if err != nil {
-			return errors.Wrap(err, "parsing --history.created")
+
+	// Fields which aren't part of ispec.Image are applied as a patch, so that
+	// they are preserved in the configuration blob.
+	extPatch, err := g.ExtensionPatch()
+	if err != nil {
+		return errors.Wrap(err, "generate extension patch")
+	}
+	if len(extPatch) > 0 {
+		if err := mutator.PatchConfig(context.Background(), extPatch); err != nil {
+			return errors.Wrap(err, "set extension fields")
 		}
-		history.Created = created
 	}
-	if val, ok := ctx.App.Metadata["--history.created_by"]; ok {
-		history.CreatedBy = val.(string)
+
+	// The patch is applied after all other modifications, so that it can
+	// modify anything (including the history entry we just added).
+	if ctx.IsSet("patch") {
+		data, err := ioutil.ReadFile(ctx.String("patch"))
+		if err != nil {
+			return errors.Wrap(err, "read --patch")
+		}
+		patch, err := jsonpatch.Parse(data)
+		if err != nil {
+			return errors.Wrap(err, "parse --patch")
+		}
+		if err := mutator.PatchConfig(context.Background(), patch); err != nil {
+			return errors.Wrap(err, "apply --patch")
+		}
 	}
 
-	newConfig, newMeta := fromImage(g.Image())
-	if err := mutator.Set(context.Background(), newConfig, newMeta, annotations, history); err != nil {
-		return errors.Wrap(err, "set modified configuration")
+	if ctx.Bool("show") {
+		newConfig, newManifest, err := mutator.PreviewBlobs(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "preview mutated image")
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(struct {
+			Config   json.RawMessage `json:"config"`
+			Manifest json.RawMessage `json:"manifest"`
+		}{newConfig, newManifest}); err != nil {
+			return errors.Wrap(err, "encoding preview")
+		}
+		return nil
 	}
 
 	newDescriptor, err := mutator.Commit(context.Background())
@@ -295,18 +488,15 @@ func config(ctx *cli.Context) error {
 
 	log.Infof("new image manifest created: %s", newDescriptor.Digest)
 
-	err = engine.PutReference(context.Background(), tagName, newDescriptor)
-	if err == cas.ErrClobber {
-		// We have to clobber a tag.
-		log.Warnf("clobbering existing tag: %s", tagName)
-
-		// Delete the old tag.
-		if err := engine.DeleteReference(context.Background(), tagName); err != nil {
-			return errors.Wrap(err, "delete old tag")
-		}
-		err = engine.PutReference(context.Background(), tagName, newDescriptor)
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
 	}
-	if err != nil {
+	platform := ispec.Platform{
+		OS:           newMeta.OS,
+		Architecture: newMeta.Architecture,
+	}
+	if err := putManifestTag(context.Background(), engine, tagName, newDescriptor, platform, &fromDescriptor, force); err != nil {
 		return errors.Wrap(err, "add new tag")
 	}
 
@@ -0,0 +1,114 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/drivers/chunked"
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var convertCommand = cli.Command{
+	Name:  "convert",
+	Usage: "converts an OCI image between storage formats",
+	ArgsUsage: `--from <image-path> --to <image-path> [--format <format>]
+
+Where "<image-path>" is the path to an OCI image and "<format>" is the storage
+format of the destination image ("dir" or "chunked"), if it doesn't exist yet.
+
+Every blob and reference of the source image is copied to the destination
+image. The chunked format is EXPERIMENTAL.`,
+
+	// convert operates on two images, so we can't use the "image" category
+	// (which would add an --image flag).
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "from",
+			Usage: "source OCI image path",
+		},
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "destination OCI image path",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "storage format of the destination image if it is created (dir or [chunked])",
+			Value: "chunked",
+		},
+	},
+
+	Action: convert,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		for _, flag := range []string{"from", "to"} {
+			if ctx.String(flag) == "" {
+				return errors.Errorf("missing mandatory argument: --%s", flag)
+			}
+		}
+		switch ctx.String("format") {
+		case "dir", "chunked":
+		default:
+			return errors.Errorf("invalid --format %q: must be dir or chunked", ctx.String("format"))
+		}
+		return nil
+	},
+}
+
+func convert(ctx *cli.Context) error {
+	fromPath := ctx.String("from")
+	toPath := ctx.String("to")
+
+	srcEngine, err := openReadOnlyImage(ctx, fromPath)
+	if err != nil {
+		return errors.Wrap(err, "open source CAS")
+	}
+	defer srcEngine.Close()
+
+	if _, err := os.Stat(toPath); os.IsNotExist(err) {
+		create := dir.Create
+		if ctx.String("format") == "chunked" {
+			create = chunked.Create
+		}
+		if err := create(toPath); err != nil {
+			return errors.Wrap(err, "create destination image")
+		}
+		log.Infof("created new %s image: %s", ctx.String("format"), toPath)
+	} else if err != nil {
+		return errors.Wrap(err, "check destination image")
+	}
+
+	dstEngine, err := openEngine(ctx, toPath)
+	if err != nil {
+		return errors.Wrap(err, "open destination CAS")
+	}
+	defer dstEngine.Close()
+
+	if err := chunked.Convert(context.Background(), dstEngine, srcEngine); err != nil {
+		return errors.Wrap(err, "convert image")
+	}
+	log.Infof("converted %s to %s", fromPath, toPath)
+	return nil
+}
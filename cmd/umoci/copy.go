@@ -0,0 +1,196 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var copyCommand = uxForce(cli.Command{
+	Name:    "copy",
+	Aliases: []string{"cp"},
+	Usage:   "copies a tagged image between OCI images",
+	ArgsUsage: `--from <image-path>[:<tag>] --to <image-path>[:<new-tag>]
+
+Where "<image-path>" is the path to an OCI image, "<tag>" is the name of the
+tag to copy and "<new-tag>" is the name of the tag to create in the destination
+image.
+
+Only blobs which are not already present in the destination image are copied.`,
+
+	// copy operates on two images, so we can't use the "image" category (which
+	// would add an --image flag).
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "from",
+			Usage: "source OCI image URI of the form 'path[:tag]'",
+		},
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "destination OCI image URI of the form 'path[:tag]'",
+		},
+		cli.StringSliceFlag{
+			Name:  "strip-annotation",
+			Usage: "remove annotations with keys matching the given glob while copying",
+		},
+		cli.StringSliceFlag{
+			Name:  "replace-annotation",
+			Usage: "replace the value of an annotation (of the form 'key=value') while copying",
+		},
+		cli.StringFlag{
+			Name:  "blob-pool",
+			Usage: "link blobs from (and add blobs to) a shared blob pool directory rather than copying them",
+		},
+		cli.StringFlag{
+			Name:  "link-mode",
+			Usage: "how blobs are linked from the --blob-pool ([hardlink] or reflink)",
+			Value: string(dir.LinkHardlink),
+		},
+	},
+
+	Action: copyImage,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		for _, flag := range []string{"from", "to"} {
+			if !ctx.IsSet(flag) {
+				return errors.Errorf("missing mandatory argument: --%s", flag)
+			}
+			dir, tag, err := parseImage(ctx.String(flag))
+			if err != nil {
+				return errors.Wrapf(err, "invalid --%s", flag)
+			}
+			ctx.App.Metadata["--"+flag+"-path"] = dir
+			ctx.App.Metadata["--"+flag+"-tag"] = tag
+		}
+		for _, pattern := range ctx.StringSlice("strip-annotation") {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "invalid --strip-annotation %s", pattern)
+			}
+		}
+		for _, replacement := range ctx.StringSlice("replace-annotation") {
+			if !strings.Contains(replacement, "=") {
+				return errors.Errorf("invalid --replace-annotation %s: must contain '='", replacement)
+			}
+		}
+		if ctx.IsSet("link-mode") && !ctx.IsSet("blob-pool") {
+			return errors.Errorf("--link-mode is only supported with --blob-pool")
+		}
+		return validateLinkMode(ctx.String("link-mode"))
+	},
+})
+
+func copyImage(ctx *cli.Context) error {
+	fromPath := ctx.App.Metadata["--from-path"].(string)
+	fromName := ctx.App.Metadata["--from-tag"].(string)
+	toPath := ctx.App.Metadata["--to-path"].(string)
+	toName := ctx.App.Metadata["--to-tag"].(string)
+
+	// Get a reference to both CAS engines.
+	srcEngine, err := openReadOnlyImage(ctx, fromPath)
+	if err != nil {
+		return errors.Wrap(err, "open source CAS")
+	}
+	srcEngineExt := casext.Engine{srcEngine}
+	defer srcEngine.Close()
+
+	var dstEngine cas.Engine
+	if pool := ctx.String("blob-pool"); pool != "" {
+		// Only directory-backed images can share blobs with a pool.
+		options := dirOptions(ctx)
+		options.BlobPool = pool
+		options.LinkMode = dir.LinkMode(ctx.String("link-mode"))
+		dstEngine, err = dir.OpenWithOptions(toPath, options)
+		if err == nil {
+			engine := hookEngine(ctx, strictEngine(ctx, limitEngine(ctx, retryEngine(ctx, dstEngine))))
+			if dstEngine, err = auditEngine(ctx, toPath, engine); err != nil {
+				engine.Close()
+			}
+		}
+	} else {
+		dstEngine, err = openEngine(ctx, toPath)
+	}
+	if err != nil {
+		return errors.Wrap(err, "open destination CAS")
+	}
+	defer dstEngine.Close()
+
+	descriptor, err := srcEngine.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get reference")
+	}
+
+	newDescriptor, n, err := srcEngineExt.CopyToFiltered(context.Background(), dstEngine, descriptor, annotationFilter(ctx))
+	if err != nil {
+		return errors.Wrap(err, "copy blobs")
+	}
+	if newDescriptor.Digest != descriptor.Digest {
+		log.Infof("annotations modified, new image manifest created: %s", newDescriptor.Digest)
+	}
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	if err := putTag(context.Background(), dstEngine, toName, newDescriptor, nil, force); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.WithFields(log.Fields{
+		"blobs": n,
+	}).Infof("copied %s:%s -> %s:%s", fromPath, fromName, toPath, toName)
+	return nil
+}
+
+// annotationFilter returns the casext.AnnotationFilter corresponding to the
+// --strip-annotation and --replace-annotation flags, or nil if neither flag
+// was specified. The flags are assumed to have been validated already.
+func annotationFilter(ctx *cli.Context) casext.AnnotationFilter {
+	patterns := ctx.StringSlice("strip-annotation")
+	replacements := map[string]string{}
+	for _, replacement := range ctx.StringSlice("replace-annotation") {
+		parts := strings.SplitN(replacement, "=", 2)
+		replacements[parts[0]] = parts[1]
+	}
+	if len(patterns) == 0 && len(replacements) == 0 {
+		return nil
+	}
+
+	return func(key, value string) (string, bool) {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, key); matched {
+				return "", false
+			}
+		}
+		if newValue, ok := replacements[key]; ok {
+			return newValue, true
+		}
+		return value, true
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var dedupCommand = cli.Command{
+	Name:  "dedup",
+	Usage: "deduplicates the blobs of OCI images using a shared blob pool",
+	ArgsUsage: `--blob-pool <pool-path> <image-path>...
+
+Where "<pool-path>" is the path to a directory of blobs shared between images,
+and each "<image-path>" is the path to an OCI image on the same filesystem.
+
+Every blob in the images which is also in the pool is replaced with a link to
+the pool's copy of the blob, and every other blob is added to the pool. Once a
+set of images has been deduplicated against the same pool, each blob is only
+stored once.`,
+
+	// dedup operates on several images, so we can't use the "layout"
+	// category (which would add a --layout flag).
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "blob-pool",
+			Usage: "path to the shared blob pool directory",
+		},
+		cli.StringFlag{
+			Name:  "link-mode",
+			Usage: "how blobs are linked from the --blob-pool ([hardlink] or reflink)",
+			Value: string(dir.LinkHardlink),
+		},
+	},
+
+	Action: dedup,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.String("blob-pool") == "" {
+			return errors.Errorf("missing mandatory argument: --blob-pool")
+		}
+		if ctx.NArg() < 1 {
+			return errors.Errorf("invalid number of positional arguments: expected at least one <image-path>")
+		}
+		for _, arg := range ctx.Args() {
+			if arg == "" {
+				return errors.Errorf("image path cannot be empty")
+			}
+		}
+		return validateLinkMode(ctx.String("link-mode"))
+	},
+}
+
+// validateLinkMode returns an error if mode is not a valid --link-mode.
+func validateLinkMode(mode string) error {
+	switch dir.LinkMode(mode) {
+	case dir.LinkHardlink, dir.LinkReflink:
+		return nil
+	}
+	return errors.Errorf("invalid --link-mode: unknown link mode %q", mode)
+}
+
+func dedup(ctx *cli.Context) error {
+	options := dirOptions(ctx)
+	options.BlobPool = ctx.String("blob-pool")
+	options.LinkMode = dir.LinkMode(ctx.String("link-mode"))
+
+	var total dir.DedupStats
+	for _, imagePath := range ctx.Args() {
+		stats, err := dir.Dedup(context.Background(), imagePath, options)
+		if err != nil {
+			return errors.Wrapf(err, "dedup %s", imagePath)
+		}
+		log.WithFields(log.Fields{
+			"blobs":  stats.Blobs,
+			"linked": stats.Linked,
+		}).Infof("deduplicated %s: %s saved", imagePath, units.HumanSize(float64(stats.Size)))
+
+		total.Blobs += stats.Blobs
+		total.Linked += stats.Linked
+		total.Size += stats.Size
+	}
+
+	log.WithFields(log.Fields{
+		"blobs":  total.Blobs,
+		"linked": total.Linked,
+	}).Infof("deduplicated %d images: %s saved", len(ctx.Args()), units.HumanSize(float64(total.Size)))
+	return nil
+}
@@ -0,0 +1,207 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/delta"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+// deltaCommand creates a delta artifact. Like tagAddCommand, it doesn't have
+// a category (and so isn't monkey-patched), because the mandatory --layout
+// check would otherwise also apply to its subcommands.
+var deltaCommand = uxForce(uxTag(uxLayout(cli.Command{
+	Name:  "delta",
+	Usage: "creates and applies delta artifacts between two images",
+	ArgsUsage: `--layout <image-path> --from <old-tag> --to <new-tag> [--tag <delta-tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<old-tag>" and
+"<new-tag>" are the names of the tagged images the delta updates from and to.
+The delta artifact is tagged as "<delta-tag>" (if not specified, it defaults to
+"delta-<old-tag>-<new-tag>"), and can be copied to another image containing
+"<old-tag>" with umoci-copy(1), where it is applied with "umoci delta apply".
+
+The delta artifact contains every blob of "<new-tag>" which isn't part of
+"<old-tag>". New layers are stored as binary deltas against the layers of
+"<old-tag>" where possible.`,
+
+	Subcommands: []cli.Command{
+		deltaApplyCommand,
+	},
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "from",
+			Usage: "tag of the image to update from",
+		},
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "tag of the image to update to",
+		},
+	},
+
+	Action: deltaCreate,
+})))
+
+var deltaApplyCommand = uxForce(cli.Command{
+	Name:  "apply",
+	Usage: "reconstructs an image from a delta artifact",
+	ArgsUsage: `--image <image-path>[:<delta-tag>] <new-tag>
+
+Where "<image-path>" is the path to the OCI image, "<delta-tag>" is the name of
+the delta artifact (created by umoci-delta(1)) and "<new-tag>" is the name of
+the reconstructed image. The image must contain the image the delta updates
+from.`,
+
+	// delta apply modifies an image layout.
+	Category: "image",
+
+	Action: deltaApply,
+})
+
+func deltaCreate(ctx *cli.Context) error {
+	// urfave/cli only checks for --help in the parent context of commands
+	// with subcommands, so we have to handle it ourselves.
+	if ctx.Bool("help") {
+		return cli.ShowSubcommandHelp(ctx)
+	}
+	if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+		return errors.Errorf("missing mandatory argument: --layout")
+	}
+	if ctx.NArg() != 0 {
+		return errors.Errorf("invalid number of positional arguments: expected none")
+	}
+	fromName, toName := ctx.String("from"), ctx.String("to")
+	if fromName == "" {
+		return errors.Errorf("missing mandatory argument: --from")
+	}
+	if toName == "" {
+		return errors.Errorf("missing mandatory argument: --to")
+	}
+
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	deltaName := "delta-" + fromName + "-" + toName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		deltaName = val.(string)
+	}
+	if !refRegexp.MatchString(deltaName) {
+		return errors.Errorf("delta tag is an invalid reference: %s", deltaName)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	from, err := engineExt.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get --from descriptor")
+	}
+	to, err := engineExt.GetReference(context.Background(), toName)
+	if err != nil {
+		return errors.Wrap(err, "get --to descriptor")
+	}
+
+	artifact, err := delta.Create(context.Background(), engineExt, from, to, deltaOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "create delta")
+	}
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	if err := putTag(context.Background(), engine, deltaName, artifact, nil, force); err != nil {
+		return errors.Wrap(err, "add delta tag")
+	}
+
+	// Let the user know how much has to be transferred.
+	blob, err := engineExt.FromDescriptor(context.Background(), artifact)
+	if err != nil {
+		return errors.Wrap(err, "get delta artifact")
+	}
+	defer blob.Close()
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown delta artifact blob type: %s", blob.MediaType)
+	}
+	size := artifact.Size + manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+
+	log.Infof("created delta %s: %s (%d blobs, %s)", deltaName, artifact.Digest, len(manifest.Layers), units.HumanSize(float64(size)))
+	return nil
+}
+
+func deltaApply(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	deltaName := ctx.App.Metadata["--image-tag"].(string)
+	newName, err := newTagArg(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	artifact, err := engineExt.GetReference(context.Background(), deltaName)
+	if err != nil {
+		return errors.Wrap(err, "get delta descriptor")
+	}
+
+	descriptor, err := delta.Apply(context.Background(), engineExt, artifact, deltaOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "apply delta")
+	}
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	if err := putTag(context.Background(), engine, newName, descriptor, nil, force); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("applied delta %s: %s", deltaName, descriptor.Digest)
+	return nil
+}
+
+// deltaOptions returns the delta.Options for the global flags.
+func deltaOptions(ctx *cli.Context) *delta.Options {
+	var options delta.Options
+	if tempDir, ok := ctx.App.Metadata["--temp-dir"]; ok {
+		options.TempDir = tempDir.(string)
+	}
+	return &options
+}
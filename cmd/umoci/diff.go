@@ -0,0 +1,141 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var diffCommand = uxWhiteout(cli.Command{
+	Name:  "diff",
+	Usage: "generates a layer from the difference between two root filesystems",
+	ArgsUsage: `<old-rootfs> <new-rootfs>
+
+Where "<old-rootfs>" and "<new-rootfs>" are paths to two directory trees. The
+generated layer contains the changes required to turn "<old-rootfs>" into
+"<new-rootfs>" (including whiteouts for removed paths), and is written to
+stdout unless --output is specified.
+
+Unlike umoci-repack(1), this does not require the trees to have been created
+with umoci-unpack(1).`,
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "write the layer to the given file rather than stdout",
+		},
+		cli.BoolFlag{
+			Name:  "compress",
+			Usage: "gzip-compress the generated layer",
+		},
+		cli.BoolFlag{
+			Name:  "rootless",
+			Usage: "enable rootless diff support",
+		},
+	},
+
+	Action: diff,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 2 {
+			return errors.Errorf("invalid number of positional arguments: expected <old-rootfs> <new-rootfs>")
+		}
+		for _, arg := range ctx.Args() {
+			if arg == "" {
+				return errors.Errorf("rootfs path cannot be empty")
+			}
+		}
+		ctx.App.Metadata["old-rootfs"] = ctx.Args().Get(0)
+		ctx.App.Metadata["new-rootfs"] = ctx.Args().Get(1)
+		return nil
+	},
+})
+
+func diff(ctx *cli.Context) error {
+	oldRootfs := ctx.App.Metadata["old-rootfs"].(string)
+	newRootfs := ctx.App.Metadata["new-rootfs"].(string)
+
+	// In rootless mode we map ourselves to the root user, as with
+	// umoci-unpack(1).
+	var repackOptions layer.RepackOptions
+	repackOptions.Rootless = ctx.Bool("rootless")
+	if repackOptions.Rootless {
+		uidMap, err := idtools.ParseMapping(fmt.Sprintf("%d:0:1", os.Geteuid()))
+		if err != nil {
+			return errors.Wrap(err, "create rootless uid mapping")
+		}
+		gidMap, err := idtools.ParseMapping(fmt.Sprintf("%d:0:1", os.Getegid()))
+		if err != nil {
+			return errors.Wrap(err, "create rootless gid mapping")
+		}
+		repackOptions.UIDMappings = append(repackOptions.UIDMappings, uidMap)
+		repackOptions.GIDMappings = append(repackOptions.GIDMappings, gidMap)
+	}
+
+	if val, ok := ctx.App.Metadata["--whiteout-format"]; ok {
+		repackOptions.WhiteoutMode = val.(layer.WhiteoutMode)
+	}
+
+	var output io.Writer = os.Stdout
+	if path := ctx.String("output"); path != "" {
+		fh, err := os.Create(path)
+		if err != nil {
+			return errors.Wrap(err, "create output")
+		}
+		defer fh.Close()
+		output = fh
+	}
+
+	log.WithFields(log.Fields{
+		"old": oldRootfs,
+		"new": newRootfs,
+	}).Debugf("umoci: generating diff layer")
+
+	reader, err := layer.GenerateDiff(context.Background(), oldRootfs, newRootfs, &repackOptions)
+	if err != nil {
+		return errors.Wrap(err, "generate diff layer")
+	}
+	defer reader.Close()
+
+	if ctx.Bool("compress") {
+		gzw := gzip.NewWriter(output)
+		defer gzw.Close()
+		output = gzw
+	}
+
+	if _, err := io.Copy(output, reader); err != nil {
+		return errors.Wrap(err, "write diff layer")
+	}
+	// Make sure everything has been flushed before we return.
+	if gzw, ok := output.(*gzip.Writer); ok {
+		if err := gzw.Close(); err != nil {
+			return errors.Wrap(err, "flush compressed layer")
+		}
+	}
+	return nil
+}
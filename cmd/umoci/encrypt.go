@@ -0,0 +1,408 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var encryptCommand = uxForce(uxTag(uxPlatform(cli.Command{
+	Name:  "encrypt",
+	Usage: "encrypts the layers of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] --recipient <recipient>...
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to encrypt (if not specified, it defaults to "latest").
+"<new-tag>" is the new reference name to save the image as, if this is not
+specified then umoci will replace the old image.
+
+Each "<recipient>" is either "jwe:<public-key>" (the path to an RSA or ECDSA
+public key) or "pkcs7:<certificate>" (the path to an x509 certificate with an
+RSA public key). Layers are encrypted in the format used by ocicrypt, and can
+be decrypted with the private key of any of the recipients.`,
+
+	// encrypt modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "recipient",
+			Usage: "recipient who can decrypt the layers (jwe:<public-key> or pkcs7:<certificate>)",
+		},
+		cli.StringSliceFlag{
+			Name:  "layer",
+			Usage: "index or digest of a layer to encrypt (all layers if unspecified)",
+		},
+	},
+
+	Action: encrypt,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if len(ctx.StringSlice("recipient")) == 0 {
+			return errors.Errorf("missing mandatory argument: --recipient")
+		}
+		return nil
+	},
+})))
+
+var decryptCommand = uxForce(uxTag(uxPlatform(cli.Command{
+	Name:  "decrypt",
+	Usage: "decrypts the encrypted layers of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] --key <private-key>...
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to decrypt (if not specified, it defaults to "latest").
+"<new-tag>" is the new reference name to save the image as, if this is not
+specified then umoci will replace the old image.
+
+Each "<private-key>" is the path to an RSA or ECDSA private key. Layers whose
+keys were wrapped with PKCS#7 can only be decrypted if the certificate of the
+private key is also given with --cert.`,
+
+	// decrypt modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "key",
+			Usage: "private key used to decrypt the layers",
+		},
+		cli.StringSliceFlag{
+			Name:  "cert",
+			Usage: "certificate of a private key (for PKCS#7 wrapped keys)",
+		},
+		cli.StringSliceFlag{
+			Name:  "layer",
+			Usage: "index or digest of a layer to decrypt (all encrypted layers if unspecified)",
+		},
+	},
+
+	Action: decrypt,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if len(ctx.StringSlice("key")) == 0 {
+			return errors.Errorf("missing mandatory argument: --key")
+		}
+		return nil
+	},
+})))
+
+// readEncryptConfig reads the public keys and certificates of the given
+// --recipient values.
+func readEncryptConfig(recipients []string) (layer.EncryptConfig, error) {
+	var config layer.EncryptConfig
+	for _, recipient := range recipients {
+		parts := strings.SplitN(recipient, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return layer.EncryptConfig{}, errors.Errorf("invalid recipient %q: must be jwe:<public-key> or pkcs7:<certificate>", recipient)
+		}
+		data, err := ioutil.ReadFile(parts[1])
+		if err != nil {
+			return layer.EncryptConfig{}, errors.Wrapf(err, "read recipient %q", recipient)
+		}
+		switch parts[0] {
+		case "jwe":
+			key, err := layer.ParsePublicKey(data)
+			if err != nil {
+				return layer.EncryptConfig{}, errors.Wrapf(err, "parse recipient %q", recipient)
+			}
+			config.PublicKeys = append(config.PublicKeys, key)
+		case "pkcs7":
+			certificate, err := layer.ParseCertificate(data)
+			if err != nil {
+				return layer.EncryptConfig{}, errors.Wrapf(err, "parse recipient %q", recipient)
+			}
+			config.Certificates = append(config.Certificates, certificate)
+		default:
+			return layer.EncryptConfig{}, errors.Errorf("invalid recipient %q: unknown scheme %q", recipient, parts[0])
+		}
+	}
+	return config, nil
+}
+
+// readDecryptConfig reads the given private keys and certificates. If no
+// private keys are given, nil is returned.
+func readDecryptConfig(keyPaths, certPaths []string) (*layer.DecryptConfig, error) {
+	if len(keyPaths) == 0 {
+		if len(certPaths) > 0 {
+			return nil, errors.Errorf("certificates can only be used with a private key")
+		}
+		return nil, nil
+	}
+	config := &layer.DecryptConfig{}
+	for _, path := range keyPaths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "read private key")
+		}
+		key, err := layer.ParsePrivateKey(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse private key %s", path)
+		}
+		config.PrivateKeys = append(config.PrivateKeys, key)
+	}
+	for _, path := range certPaths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "read certificate")
+		}
+		certificate, err := layer.ParseCertificate(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse certificate %s", path)
+		}
+		config.Certificates = append(config.Certificates, certificate)
+	}
+	return config, nil
+}
+
+// selectedLayers returns the set of indices of the layers given with --layer,
+// or nil if no layers were given (in which case all layers are selected).
+func selectedLayers(ctx context.Context, mutator *mutate.Mutator, values []string) (map[int]bool, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	indices := map[int]bool{}
+	for _, value := range values {
+		index, err := layerIndex(ctx, mutator, value)
+		if err != nil {
+			return nil, errors.Wrap(err, "resolve --layer")
+		}
+		indices[index] = true
+	}
+	return indices, nil
+}
+
+// transformLayerFunc returns a reader of the new blob of the given layer (read
+// from blob), along with a function which returns the descriptor and
+// annotations of the new layer blob once the reader has been read to EOF.
+type transformLayerFunc func(blob io.Reader, descriptor ispec.Descriptor, annotations map[string]string) (io.Reader, func(ispec.Descriptor) (ispec.Descriptor, map[string]string, error), error)
+
+// transformLayers replaces the blobs of the layers of the image selected by
+// match (and --layer) with the blobs produced by transform, and updates the
+// tag of the image. It is used by both umoci-encrypt(1) and umoci-decrypt(1).
+func transformLayers(ctx *cli.Context, verb string, match func(ispec.Descriptor) bool, transform transformLayerFunc) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	fromDescriptor, err := engineExt.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	fromDescriptor, err = engineExt.ResolveManifest(context.Background(), fromDescriptor, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for base image")
+	}
+
+	selected, err := selectedLayers(context.Background(), mutator, ctx.StringSlice("layer"))
+	if err != nil {
+		return err
+	}
+	_, manifest, err := mutator.Preview(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image manifest")
+	}
+	layerAnnotations, err := mutator.LayerAnnotations(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get layer annotations")
+	}
+	// The blobs of chunked layers have to be reassembled from their chunks.
+	blobCtx, err := casext.WithManifestLayerChunks(context.Background(), manifest)
+	if err != nil {
+		return errors.Wrap(err, "get chunked layers")
+	}
+
+	changed := 0
+	for idx, descriptor := range manifest.Layers {
+		if selected != nil && !selected[idx] {
+			continue
+		}
+		if !match(descriptor) {
+			if selected != nil {
+				return errors.Errorf("cannot %s layer %d: layer has mediatype %s", verb, idx, descriptor.MediaType)
+			}
+			log.Infof("skipping layer %d (%s): layer has mediatype %s", idx, descriptor.Digest, descriptor.MediaType)
+			continue
+		}
+
+		newDescriptor, annotations, err := transformLayer(blobCtx, engineExt, descriptor, layerAnnotations[idx], transform)
+		if err != nil {
+			return errors.Wrapf(err, "%s layer %d", verb, idx)
+		}
+		if err := mutator.ReplaceLayerBlob(context.Background(), idx, newDescriptor, annotations); err != nil {
+			return errors.Wrapf(err, "replace layer %d", idx)
+		}
+		log.Infof("%sed layer %d: %s", verb, idx, newDescriptor.Digest)
+		changed++
+	}
+	if changed == 0 {
+		log.Warnf("no layers were %sed", verb)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s", newDescriptor.Digest)
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	platform := ispec.Platform{
+		OS:           imageMeta.OS,
+		Architecture: imageMeta.Architecture,
+	}
+	if err := putManifestTag(context.Background(), engine, tagName, newDescriptor, platform, &fromDescriptor, force); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
+
+// transformLayer writes the new blob of the given layer produced by
+// transform, returning its descriptor and annotations.
+func transformLayer(ctx context.Context, engine casext.Engine, descriptor ispec.Descriptor, annotations map[string]string, transform transformLayerFunc) (ispec.Descriptor, map[string]string, error) {
+	blob, err := engine.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return ispec.Descriptor{}, nil, errors.Wrap(err, "get layer blob")
+	}
+	defer blob.Close()
+	reader, ok := blob.Data.(io.ReadCloser)
+	if !ok {
+		// Should _never_ be reached.
+		return ispec.Descriptor{}, nil, errors.Errorf("[internal error] unknown layer blob type: %s", blob.MediaType)
+	}
+
+	newReader, finalize, err := transform(reader, descriptor, annotations)
+	if err != nil {
+		return ispec.Descriptor{}, nil, err
+	}
+	newDigest, newSize, err := engine.PutBlob(ctx, newReader)
+	if err != nil {
+		return ispec.Descriptor{}, nil, errors.Wrap(err, "put layer blob")
+	}
+	return finalize(ispec.Descriptor{
+		Digest: newDigest,
+		Size:   newSize,
+	})
+}
+
+func encrypt(ctx *cli.Context) error {
+	config, err := readEncryptConfig(ctx.StringSlice("recipient"))
+	if err != nil {
+		return errors.Wrap(err, "read --recipient")
+	}
+
+	// Foreign layers are usually not included in the image, and chunked
+	// layers are reassembled from their chunks.
+	isPlainLayer := func(descriptor ispec.Descriptor) bool {
+		switch descriptor.MediaType {
+		case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerGzip:
+			return true
+		}
+		return false
+	}
+	return transformLayers(ctx, "encrypt", isPlainLayer, func(blob io.Reader, descriptor ispec.Descriptor, annotations map[string]string) (io.Reader, func(ispec.Descriptor) (ispec.Descriptor, map[string]string, error), error) {
+		reader, finalize, err := layer.EncryptLayer(blob, descriptor, config)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, func(newDescriptor ispec.Descriptor) (ispec.Descriptor, map[string]string, error) {
+			encAnnotations, err := finalize()
+			if err != nil {
+				return ispec.Descriptor{}, nil, err
+			}
+			// Any existing annotations of the layer are kept.
+			newAnnotations := map[string]string{}
+			for key, value := range annotations {
+				newAnnotations[key] = value
+			}
+			for key, value := range encAnnotations {
+				newAnnotations[key] = value
+			}
+			newDescriptor.MediaType = layer.EncryptedLayerType(descriptor.MediaType)
+			return newDescriptor, newAnnotations, nil
+		}, nil
+	})
+}
+
+func decrypt(ctx *cli.Context) error {
+	config, err := readDecryptConfig(ctx.StringSlice("key"), ctx.StringSlice("cert"))
+	if err != nil {
+		return errors.Wrap(err, "read decryption keys")
+	}
+
+	isEncryptedLayer := func(descriptor ispec.Descriptor) bool {
+		return layer.IsEncryptedLayerType(descriptor.MediaType)
+	}
+	return transformLayers(ctx, "decrypt", isEncryptedLayer, func(blob io.Reader, descriptor ispec.Descriptor, annotations map[string]string) (io.Reader, func(ispec.Descriptor) (ispec.Descriptor, map[string]string, error), error) {
+		// The reader returns an error if the layer has been modified, so the
+		// decrypted layer is never written.
+		reader, err := layer.DecryptLayer(blob, annotations, *config)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, func(newDescriptor ispec.Descriptor) (ispec.Descriptor, map[string]string, error) {
+			newDescriptor.MediaType = layer.DecryptedLayerType(descriptor.MediaType)
+			return newDescriptor, layer.DecryptedLayerAnnotations(annotations), nil
+		}, nil
+	})
+}
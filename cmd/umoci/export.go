@@ -0,0 +1,120 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/dockerarchive"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var exportCommand = uxPlatform(cli.Command{
+	Name:  "export",
+	Usage: "exports an OCI image into another format",
+	ArgsUsage: `--image <image-path>[:<tag>] <output>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to export (if not specified, it defaults to "latest"), and
+"<output>" is the path the exported image is written to (or - for stdout).
+
+With --format=docker-archive (the default and only supported format), the
+image is written as a tarball which can be loaded with docker-load(1). The
+tags given to the image when it is loaded are set with --repo-tag.`,
+
+	// export reads a manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "format of the exported image ([docker-archive])",
+			Value: formatDockerArchive,
+		},
+		cli.StringSliceFlag{
+			Name:  "repo-tag",
+			Usage: "tag (of the form name[:tag]) given to the image in the docker-archive",
+		},
+	},
+
+	Action: exportImage,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <output>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("output path cannot be empty")
+		}
+		if ctx.String("format") != formatDockerArchive {
+			return errors.Errorf("unknown --format: %s", ctx.String("format"))
+		}
+		return nil
+	},
+})
+
+func exportImage(ctx *cli.Context) (err error) {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	outputPath := ctx.Args().First()
+
+	// Get a reference to the CAS.
+	engine, err := openReadOnlyImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	manifestDescriptor, err := engineExt.GetReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get reference")
+	}
+	manifestDescriptor, err = engineExt.ResolveManifest(context.Background(), manifestDescriptor, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
+
+	var output io.Writer = os.Stdout
+	if outputPath != "-" {
+		fh, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return errors.Wrap(err, "create output")
+		}
+		defer fh.Close()
+		// Don't leave a truncated archive around.
+		defer func() {
+			if err != nil {
+				os.Remove(outputPath)
+			}
+		}()
+		output = fh
+	}
+
+	if err := dockerarchive.Export(context.Background(), engineExt, manifestDescriptor, ctx.StringSlice("repo-tag"), output); err != nil {
+		return errors.Wrap(err, "export docker-archive")
+	}
+
+	log.Infof("exported image manifest %s to %s", manifestDescriptor.Digest, outputPath)
+	return nil
+}
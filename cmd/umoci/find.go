@@ -0,0 +1,203 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var findCommand = uxIndexCache(uxPlatform(cli.Command{
+	Name:  "find",
+	Usage: "searches the layers of an image for paths",
+	ArgsUsage: `--image <image-path>[:<tag>] [--name <glob>] [--regex <regex>] [--layer all|effective]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to search (if not specified, it defaults to "latest").
+
+Paths match if their final component matches the shell pattern "<glob>" (as
+with find(1) -name) and the whole (absolute) path matches the regular
+expression "<regex>". At least one of --name or --regex must be specified.
+
+With --layer all (the default), every change to a matching path made by a
+layer is listed (from the bottom layer up), along with the layer which made
+it. Changes are one of "added", "modified" (the path was added by a lower
+layer), "deleted" (by a whiteout, or by replacing a parent directory with a
+non-directory) or "opaque" (an opaque whiteout of the directory). With --layer
+effective, only the matching paths in the root filesystem of the image (as it
+would be unpacked) are listed, along with the layer which last changed them.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// find only reads from an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "name",
+			Usage: "shell pattern matched against the final component of paths",
+		},
+		cli.StringFlag{
+			Name:  "regex",
+			Usage: "regular expression matched against the full path",
+		},
+		cli.StringFlag{
+			Name:  "layer",
+			Usage: "which changes to list (all or effective)",
+			Value: "all",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the matching paths as a JSON array",
+		},
+	},
+
+	Action: find,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if !ctx.IsSet("name") && !ctx.IsSet("regex") {
+			return errors.Errorf("missing mandatory argument: at least one of --name or --regex must be specified")
+		}
+		if _, err := filepath.Match(ctx.String("name"), ""); err != nil {
+			return errors.Wrap(err, "invalid --name")
+		}
+		regex, err := regexp.Compile(ctx.String("regex"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --regex")
+		}
+		ctx.App.Metadata["--regex"] = regex
+		switch ctx.String("layer") {
+		case "all", "effective":
+		default:
+			return errors.Errorf("invalid --layer %q: must be all or effective", ctx.String("layer"))
+		}
+		return nil
+	},
+}))
+
+// formatFindResult formats the given result as a line of the text output of
+// umoci-find(1).
+func formatFindResult(result layer.FindResult) string {
+	line := fmt.Sprintf("%-8s %3d %s %s", result.Change, result.Layer, result.LayerDigest, result.Path)
+	if entry := result.Entry; entry != nil {
+		switch entry.Type {
+		case "dir":
+			line += "/"
+		case "symlink":
+			line += " -> " + entry.Linkname
+		case "hardlink":
+			line += " link to " + entry.Linkname
+		}
+	}
+	return line
+}
+
+func find(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	name := ctx.String("name")
+	regex := ctx.App.Metadata["--regex"].(*regexp.Regexp)
+
+	// Get a reference to the CAS.
+	engine, err := openReadOnlyImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	manifestDescriptor, err := resolveManifest(ctx, engineExt, tagName)
+	if err != nil {
+		return err
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), manifestDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		return errors.Wrap(errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.MediaType), "invalid manifest descriptor")
+	}
+
+	match := func(path string) bool {
+		if name != "" {
+			// The pattern has already been validated.
+			if matched, _ := filepath.Match(name, filepath.Base(path)); !matched {
+				return false
+			}
+		}
+		return regex.MatchString(path)
+	}
+
+	layerCtx := indexCacheContext(ctx, imagePath, context.Background())
+
+	var results []layer.FindResult
+	output := bufio.NewWriter(os.Stdout)
+	defer output.Flush()
+
+	if ctx.String("layer") == "effective" {
+		results, err = layer.FindEffective(layerCtx, engineExt, manifest, match)
+	} else if ctx.Bool("json") {
+		results = []layer.FindResult{}
+		err = layer.FindChanges(layerCtx, engineExt, manifest, match, func(result layer.FindResult) error {
+			results = append(results, result)
+			return nil
+		})
+	} else {
+		// Without --json, changes are printed as soon as they are found.
+		err = layer.FindChanges(layerCtx, engineExt, manifest, match, func(result layer.FindResult) error {
+			_, err := fmt.Fprintln(output, formatFindResult(result))
+			return err
+		})
+	}
+	if err != nil {
+		return errors.Wrap(err, "find paths")
+	}
+
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(output).Encode(results); err != nil {
+			return errors.Wrap(err, "encoding results")
+		}
+		return nil
+	}
+	for _, result := range results {
+		if _, err := fmt.Fprintln(output, formatFindResult(result)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
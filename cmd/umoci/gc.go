@@ -18,6 +18,16 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/pkg/errors"
@@ -34,15 +44,79 @@ Where "<image-path>" is the path to the OCI image.
 
 This command will do a mark-and-sweep garbage collection of the provided OCI
 image, only retaining blobs which can be reached by a descriptor path from the
-root set of references. All other blobs will be removed.`,
+root set of references. All other blobs will be removed, unless they are
+retained by one of the policies below.
+
+If --keep-tagged is specified, no reference is removed (by default, referrers
+indexes whose subject is not reachable are removed along with their
+artifacts). If --keep-younger-than is specified, blobs which were modified
+less than the given duration ago (such as "12h" or "7d") are retained, along
+with every blob reachable from them. If --dry-run is specified, nothing is
+removed and the blobs which would have been removed are reported instead.
+With --json, the removed (or, with --dry-run, to be removed) blobs are printed
+as a JSON object, including their size, media type and the removed references
+and blobs which referred to them, along with the total size reclaimed.
+
+If --state is specified, the set of blobs to be removed (and the references
+used as the root set) are recorded in the given file before any blobs are
+removed. An interrupted garbage collection can then be completed with --resume,
+provided that the references have not been modified in the meantime.
+
+Other umoci processes cannot write to the image while it is being garbage
+collected (they wait until the garbage collection has finished). If other
+processes are still writing to the image after --lock-timeout, the garbage
+collection is aborted.`,
 
 	// create modifies an image layout.
 	Category: "layout",
 
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "state",
+			Usage: "path of file to record garbage collection state in",
+		},
+		cli.BoolFlag{
+			Name:  "resume",
+			Usage: "complete the interrupted garbage collection recorded in --state",
+		},
+		cli.BoolFlag{
+			Name:  "keep-tagged",
+			Usage: "retain every reference, including orphaned referrers indexes",
+		},
+		cli.StringFlag{
+			Name:  "keep-younger-than",
+			Usage: "retain blobs modified less than this duration ago (such as 12h or 7d)",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only report what would be removed, without removing anything",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output a report of the garbage collection as a JSON encoded blob",
+		},
+		cli.DurationFlag{
+			Name:  "lock-timeout",
+			Usage: "how long to wait for concurrent writers of the image to finish (negative to not wait)",
+			Value: casext.DefaultGCLockTimeout,
+		},
+	},
+
 	Before: func(ctx *cli.Context) error {
 		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
 			return errors.Errorf("missing mandatory argument: --layout")
 		}
+		if ctx.Bool("resume") && ctx.String("state") == "" {
+			return errors.Errorf("--resume requires --state")
+		}
+		if ctx.Bool("dry-run") && ctx.String("state") != "" {
+			return errors.Errorf("--dry-run cannot be used with --state")
+		}
+		if age := ctx.String("keep-younger-than"); age != "" {
+			if _, err := parseAge(age); err != nil {
+				return errors.Wrap(err, "invalid --keep-younger-than")
+			}
+		}
 		return nil
 	},
 
@@ -53,13 +127,134 @@ func gc(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := openImage(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
 	engineExt := casext.Engine{engine}
 	defer engine.Close()
 
+	var policies []casext.GCPolicy
+	if ctx.Bool("keep-tagged") {
+		policies = append(policies, casext.GCKeepTagged{})
+	}
+	if age := ctx.String("keep-younger-than"); age != "" {
+		// Already validated in Before.
+		duration, _ := parseAge(age)
+		policies = append(policies, casext.GCKeepYoungerThan{Age: duration})
+	}
+
 	// Run the GC.
-	return errors.Wrap(engineExt.GC(context.Background()), "gc")
+	dryRun := ctx.Bool("dry-run")
+	state, err := engineExt.GCWithOptions(context.Background(), casext.GCOptions{
+		StatePath:   ctx.String("state"),
+		Resume:      ctx.Bool("resume"),
+		Policies:    policies,
+		DryRun:      dryRun,
+		LockTimeout: ctx.Duration("lock-timeout"),
+	})
+	if errors.Cause(err) == cas.ErrBusy {
+		return errors.Wrap(err, "gc (try again later or increase --lock-timeout)")
+	}
+	if err != nil {
+		return errors.Wrap(err, "gc")
+	}
+
+	if ctx.Bool("json") {
+		return printGCReportJSON(state, dryRun)
+	}
+	if dryRun {
+		return printGCReport(state)
+	}
+	log.WithFields(log.Fields{
+		"references": len(state.OrphanReferences),
+		"retained":   len(state.Retained),
+	}).Infof("garbage collected %d blobs: %s reclaimed", len(state.Deletions), units.HumanSize(float64(state.Size)))
+	return nil
+}
+
+// printGCReport prints the blobs and references that a --dry-run garbage
+// collection would remove or retain.
+func printGCReport(state casext.GCState) error {
+	tw := tabwriter.NewWriter(os.Stdout, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "ACTION\tNAME\tSIZE\tMEDIA TYPE\tREASON\n")
+	for _, deletion := range state.Deletions {
+		mediaType := deletion.MediaType
+		if mediaType == "" {
+			mediaType = "-"
+		}
+		fmt.Fprintf(tw, "remove\t%s\t%s\t%s\t%s\n", deletion.Digest, units.HumanSize(float64(deletion.Size)), mediaType, deletion.Reason)
+	}
+	for _, name := range state.OrphanReferences {
+		fmt.Fprintf(tw, "remove\t%s\t-\t-\treferrers index whose subject is not reachable\n", name)
+	}
+	for _, retention := range state.Retained {
+		name := retention.Reference
+		if name == "" {
+			name = retention.Digest.String()
+		}
+		fmt.Fprintf(tw, "retain\t%s\t%s\t-\t%s\n", name, units.HumanSize(float64(retention.Size)), retention.Reason)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("would garbage collect %d blobs: %s would be reclaimed\n", len(state.Deletions), units.HumanSize(float64(state.Size)))
+	return nil
+}
+
+// gcReport is the JSON encoded report printed by gc --json.
+type gcReport struct {
+	DryRun           bool                 `json:"dry_run"`
+	Deletions        []casext.GCDeletion  `json:"deletions"`
+	OrphanReferences []string             `json:"orphan_references"`
+	Retained         []casext.GCRetention `json:"retained"`
+	Size             int64                `json:"size"`
+}
+
+// printGCReportJSON prints the blobs and references that the garbage
+// collection removed (or would remove) or retained as a JSON object.
+func printGCReportJSON(state casext.GCState, dryRun bool) error {
+	report := gcReport{
+		DryRun:           dryRun,
+		Deletions:        state.Deletions,
+		OrphanReferences: state.OrphanReferences,
+		Retained:         state.Retained,
+		Size:             state.Size,
+	}
+	if report.Deletions == nil {
+		report.Deletions = []casext.GCDeletion{}
+	}
+	if report.OrphanReferences == nil {
+		report.OrphanReferences = []string{}
+	}
+	if report.Retained == nil {
+		report.Retained = []casext.GCRetention{}
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+		return errors.Wrap(err, "encoding gc report")
+	}
+	return nil
+}
+
+// parseAge parses a --keep-younger-than duration. In addition to the units
+// supported by time.ParseDuration, a whole number of days ("7d") is accepted.
+func parseAge(age string) (time.Duration, error) {
+	var (
+		duration time.Duration
+		err      error
+	)
+	if days := strings.TrimSuffix(age, "d"); days != age {
+		var n uint64
+		n, err = strconv.ParseUint(days, 10, 32)
+		duration = time.Duration(n) * 24 * time.Hour
+	} else {
+		duration, err = time.ParseDuration(age)
+	}
+	if err != nil {
+		return 0, errors.Errorf("invalid duration: %q", age)
+	}
+	if duration < 0 {
+		return 0, errors.Errorf("duration must not be negative: %q", age)
+	}
+	return duration, nil
 }
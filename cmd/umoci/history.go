@@ -0,0 +1,318 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+// historyCommand lists the history of an image. It doesn't have a category
+// (and so isn't monkey-patched), because the mandatory --image check would
+// otherwise also apply to its subcommands.
+var historyCommand = uxPlatform(uxImage(cli.Command{
+	Name:  "history",
+	Usage: "lists or modifies the history of an OCI image",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image whose history will be listed (if not specified, it defaults
+to "latest").
+
+Each history entry is listed along with its index (as used by "umoci history
+edit") and the layer it corresponds to. Entries which don't correspond to a
+layer (such as those added by umoci-config(1)) have no layer.`,
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the history as a JSON encoded blob",
+		},
+	},
+
+	Subcommands: []cli.Command{
+		historyEditCommand,
+	},
+
+	Action: historyList,
+}))
+
+var historyEditCommand = uxForce(uxTag(uxPlatform(cli.Command{
+	Name:  "edit",
+	Usage: "modifies the history entries of an OCI image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] [--index <index> <options>...] [--drop-empty]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image whose history will be modified (if not specified, it defaults
+to "latest"). "<new-tag>" is the new reference name to save the image as, if
+this is not specified then umoci will replace the old image.
+
+With --index, the fields of the history entry with the given index (as listed
+by "umoci history") are replaced with the given values. With --drop-empty, all
+history entries which don't correspond to a layer are removed. The layers of
+the image are never modified, and no new history entry is added.`,
+
+	// history edit modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "index",
+			Usage: "index of the history entry to modify",
+		},
+		cli.StringFlag{
+			Name:  "comment",
+			Usage: "new comment of the history entry",
+		},
+		cli.StringFlag{
+			Name:  "created-by",
+			Usage: "new created_by of the history entry",
+		},
+		cli.StringFlag{
+			Name:  "author",
+			Usage: "new author of the history entry",
+		},
+		cli.StringFlag{
+			Name:  "created",
+			Usage: "new creation date (ISO8601) of the history entry",
+		},
+		cli.BoolFlag{
+			Name:  "drop-empty",
+			Usage: "remove all history entries which don't correspond to a layer",
+		},
+	},
+
+	Action: historyEdit,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		edits := false
+		for _, flag := range []string{"comment", "created-by", "author", "created"} {
+			if ctx.IsSet(flag) {
+				if !ctx.IsSet("index") {
+					return errors.Errorf("--%s requires --index", flag)
+				}
+				edits = true
+			}
+		}
+		if ctx.IsSet("index") && !edits {
+			return errors.Errorf("--index requires at least one of --comment, --created-by, --author or --created")
+		}
+		if !edits && !ctx.Bool("drop-empty") {
+			return errors.Errorf("nothing to do: either --index or --drop-empty must be specified")
+		}
+		if ctx.IsSet("created") {
+			if _, err := time.Parse(igen.ISO8601, ctx.String("created")); err != nil {
+				return errors.Wrap(err, "invalid --created")
+			}
+		}
+		return nil
+	},
+})))
+
+// formatHistory writes the given history entries of an image to the given
+// writer as a table.
+func formatHistory(w io.Writer, history []historyStat) error {
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "INDEX\tLAYER\tCREATED\tCREATED BY\tCOMMENT\n")
+	for idx, histEntry := range history {
+		var (
+			created   = strings.Replace(histEntry.Created.Format(igen.ISO8601), "\t", " ", -1)
+			createdBy = strings.Replace(histEntry.CreatedBy, "\t", " ", -1)
+			comment   = strings.Replace(histEntry.Comment, "\t", " ", -1)
+			layerID   = "<none>"
+		)
+
+		if histEntry.Layer != nil {
+			layerID = histEntry.Layer.Digest.String()
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", idx, layerID, created, createdBy, comment)
+	}
+	return tw.Flush()
+}
+
+func historyList(ctx *cli.Context) error {
+	// urfave/cli only checks for --help in the parent context of commands
+	// with subcommands, so we have to handle it ourselves.
+	if ctx.Bool("help") {
+		return cli.ShowSubcommandHelp(ctx)
+	}
+	if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+		return errors.Errorf("missing mandatory argument: --image")
+	}
+	if ctx.NArg() != 0 {
+		return errors.Errorf("unknown subcommand: %s", ctx.Args().First())
+	}
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openReadOnlyImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	manifestDescriptor, err := engine.GetReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get reference")
+	}
+	manifestDescriptor, err = engineExt.ResolveManifest(context.Background(), manifestDescriptor, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
+
+	ms, err := Stat(context.Background(), engineExt, manifestDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "stat")
+	}
+
+	if ctx.Bool("json") {
+		history := ms.History
+		if history == nil {
+			history = []historyStat{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(history); err != nil {
+			return errors.Wrap(err, "encoding history")
+		}
+		return nil
+	}
+	if err := formatHistory(os.Stdout, ms.History); err != nil {
+		return errors.Wrap(err, "format history")
+	}
+	return nil
+}
+
+func historyEdit(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	fromDescriptor, err := engineExt.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	fromDescriptor, err = engineExt.ResolveManifest(context.Background(), fromDescriptor, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for base image")
+	}
+
+	image, err := mutator.Image(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image configuration")
+	}
+	// Don't modify the cached configuration of the mutator.
+	history := append([]ispec.History(nil), image.History...)
+
+	if ctx.IsSet("index") {
+		index := ctx.Int("index")
+		if index < 0 || index >= len(history) {
+			return errors.Errorf("history index %d out of range: image has %d history entries", index, len(history))
+		}
+		entry := &history[index]
+		if ctx.IsSet("comment") {
+			entry.Comment = ctx.String("comment")
+		}
+		if ctx.IsSet("created-by") {
+			entry.CreatedBy = ctx.String("created-by")
+		}
+		if ctx.IsSet("author") {
+			entry.Author = ctx.String("author")
+		}
+		if ctx.IsSet("created") {
+			// Already validated in Before.
+			created, _ := time.Parse(igen.ISO8601, ctx.String("created"))
+			entry.Created = created
+		}
+		log.Infof("modified history entry %d", index)
+	}
+
+	if ctx.Bool("drop-empty") {
+		var kept []ispec.History
+		for _, entry := range history {
+			if !entry.EmptyLayer {
+				kept = append(kept, entry)
+			}
+		}
+		log.Infof("removed %d empty history entries", len(history)-len(kept))
+		history = kept
+	}
+
+	image.History = history
+	if err := mutator.SetConfig(context.Background(), image); err != nil {
+		return errors.Wrap(err, "set modified configuration")
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s", newDescriptor.Digest)
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	platform := ispec.Platform{
+		OS:           image.OS,
+		Architecture: image.Architecture,
+	}
+	if err := putManifestTag(context.Background(), engine, tagName, newDescriptor, platform, &fromDescriptor, force); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os/exec"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+// referenceHookInput is the JSON object passed to the --reference-hook
+// executable on stdin.
+type referenceHookInput struct {
+	Name       string           `json:"name"`
+	Descriptor ispec.Descriptor `json:"descriptor"`
+	Manifest   ispec.Manifest   `json:"manifest"`
+	Config     ispec.Image      `json:"config"`
+}
+
+// execReferenceHook returns a casext.ReferenceValidator that executes the
+// given hook with the reference name as its only argument, and a
+// referenceHookInput on stdin. If the hook exits with a non-zero status, the
+// reference write is rejected.
+func execReferenceHook(hook string) casext.ReferenceValidator {
+	return func(ctx context.Context, name string, descriptor ispec.Descriptor, manifest ispec.Manifest, config ispec.Image) error {
+		input, err := json.Marshal(referenceHookInput{
+			Name:       name,
+			Descriptor: descriptor,
+			Manifest:   manifest,
+			Config:     config,
+		})
+		if err != nil {
+			return errors.Wrap(err, "encode hook input")
+		}
+
+		log.WithFields(log.Fields{
+			"hook":   hook,
+			"name":   name,
+			"digest": descriptor.Digest,
+		}).Debugf("running reference hook")
+
+		var stderr bytes.Buffer
+		cmd := exec.Command(hook, name)
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return errors.Wrapf(err, "reference hook rejected %s: %s", descriptor.Digest, msg)
+			}
+			return errors.Wrapf(err, "reference hook rejected %s", descriptor.Digest)
+		}
+		return nil
+	}
+}
+
+// openEngine opens the image at the given path, for operations that may
+// write references. If --reference-hook was specified, the returned engine
+// runs the hook before any reference is written. If the image has a history
+// log, every change to a reference is recorded in it.
+func openEngine(ctx *cli.Context, path string) (cas.Engine, error) {
+	engine, err := openImage(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	audited, err := auditEngine(ctx, path, hookEngine(ctx, engine))
+	if err != nil {
+		engine.Close()
+		return nil, err
+	}
+	return audited, nil
+}
+
+// hookEngine wraps an already opened engine such that --reference-hook (if
+// specified) is run before any reference is written.
+func hookEngine(ctx *cli.Context, engine cas.Engine) cas.Engine {
+	if hook, ok := ctx.App.Metadata["--reference-hook"]; ok {
+		engine = casext.NewValidatingEngine(engine, execReferenceHook(hook.(string)))
+	}
+	return engine
+}
@@ -0,0 +1,112 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/dockerarchive"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+// formatDockerArchive is the transport (for import) and format (for export)
+// of docker-save(1) tarballs.
+const formatDockerArchive = "docker-archive"
+
+var importCommand = uxForce(cli.Command{
+	Name:  "import",
+	Usage: "imports an image from another format into an OCI image",
+	ArgsUsage: `--image <image-path>[:<new-tag>] docker-archive:<file>[:<reference>]
+
+Where "<image-path>" is the path to the OCI image, "<new-tag>" is the name of
+the tag that the imported image will be given (if not specified, it defaults
+to "latest"), "<file>" is the path to a tarball created by docker-save(1), and
+"<reference>" is the name of the image in the tarball (of the form
+"name[:tag]"), which can be omitted if the tarball only contains one image.
+
+The layers are stored gzip-compressed, and the image configuration is
+converted to an OCI image configuration (which drops any docker-specific
+fields).`,
+
+	// import modifies an image layout.
+	Category: "image",
+
+	Action: importImage,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected docker-archive:<file>[:<reference>]")
+		}
+		source := ctx.Args().First()
+		if !strings.HasPrefix(source, formatDockerArchive+":") {
+			return errors.Errorf("unsupported source %q: only %s:<file>[:<reference>] is supported", source, formatDockerArchive)
+		}
+		file := strings.SplitN(strings.TrimPrefix(source, formatDockerArchive+":"), ":", 2)[0]
+		if file == "" {
+			return errors.Errorf("docker-archive path cannot be empty")
+		}
+		return nil
+	},
+})
+
+func importImage(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// The reference can contain ':' (registry ports and tags), so the file is
+	// only the part before the first ':'.
+	source := strings.SplitN(strings.TrimPrefix(ctx.Args().First(), formatDockerArchive+":"), ":", 2)
+	file, ref := source[0], ""
+	if len(source) > 1 {
+		ref = source[1]
+	}
+
+	archive, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err, "open docker-archive")
+	}
+	defer archive.Close()
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	descriptor, err := dockerarchive.Import(context.Background(), engine, archive, ref)
+	if err != nil {
+		return errors.Wrap(err, "import docker-archive")
+	}
+	log.Infof("imported image manifest: %s", descriptor.Digest)
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	if err := putTag(context.Background(), engine, tagName, descriptor, nil, force); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
@@ -0,0 +1,187 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/idtools"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+// defaultPath is the PATH set in the configuration of images created by
+// umoci-import-rootfs(1).
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+var importRootfsCommand = uxCompression(uxForce(uxHistory(uxSourceDateEpoch(cli.Command{
+	Name:  "import-rootfs",
+	Usage: "creates a new single-layer image from a root filesystem",
+	ArgsUsage: `--image <image-path>[:<new-tag>] <rootfs>
+
+Where "<image-path>" is the path to the OCI image, "<new-tag>" is the name of
+the tag for the new image (if not specified, it defaults to "latest") and
+"<rootfs>" is either a directory or a (optionally gzip-compressed) tar archive
+containing the root filesystem of the new image.
+
+The new image has a single layer containing the whole root filesystem, and a
+configuration containing the platform of the host and a default PATH (which
+can be modified with umoci-config(1)).`,
+
+	// import-rootfs creates a new manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "rootless",
+			Usage: "map the owner of a <rootfs> directory to the root user of the image",
+		},
+	},
+
+	Action: importRootfs,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <rootfs>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("rootfs path cannot be empty")
+		}
+		ctx.App.Metadata["rootfs"] = ctx.Args().First()
+		return nil
+	},
+}))))
+
+func importRootfs(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	rootfsPath := ctx.App.Metadata["rootfs"].(string)
+
+	fi, err := os.Stat(rootfsPath)
+	if err != nil {
+		return errors.Wrap(err, "stat rootfs")
+	}
+
+	// In rootless mode the owner of the rootfs is mapped to the root user, as
+	// with umoci-insert(1). The ownership of tar archives is never mapped.
+	var mapOptions layer.MapOptions
+	mapOptions.Rootless = ctx.Bool("rootless")
+	if mapOptions.Rootless {
+		if !fi.IsDir() {
+			return errors.Errorf("--rootless can only be used with rootfs directories")
+		}
+		uidMap, err := idtools.ParseMapping(fmt.Sprintf("%d:0:1", os.Geteuid()))
+		if err != nil {
+			return errors.Wrap(err, "create rootless uid mapping")
+		}
+		gidMap, err := idtools.ParseMapping(fmt.Sprintf("%d:0:1", os.Getegid()))
+		if err != nil {
+			return errors.Wrap(err, "create rootless gid mapping")
+		}
+		mapOptions.UIDMappings = append(mapOptions.UIDMappings, uidMap)
+		mapOptions.GIDMappings = append(mapOptions.GIDMappings, gidMap)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	created := time.Now()
+	sourceDateEpoch, hasSourceDateEpoch := ctx.App.Metadata["--source-date-epoch"].(time.Time)
+	if hasSourceDateEpoch {
+		created = sourceDateEpoch
+	}
+
+	// Create an empty image with the default configuration, and add the
+	// rootfs to it.
+	g := igen.New()
+	g.SetCreated(created)
+	g.SetOS(runtime.GOOS)
+	g.SetArchitecture(runtime.GOARCH)
+	g.AddConfigEnv("PATH", defaultPath)
+	g.ClearHistory()
+	if val, ok := ctx.App.Metadata["--history.author"]; ok {
+		g.SetAuthor(val.(string))
+	}
+	emptyDescriptor, err := putEmptyManifest(context.Background(), engine, g)
+	if err != nil {
+		return err
+	}
+
+	mutator, err := mutate.New(engine, emptyDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for new image")
+	}
+	mutator.SetNoHistory(ctx.Bool("no-history"))
+
+	repackOptions := layer.RepackOptions{MapOptions: mapOptions}
+	// umoci-import-rootfs(1) has no --reproducible, so a source date epoch
+	// makes the whole layer reproducible.
+	if hasSourceDateEpoch {
+		repackOptions.Reproducible = true
+		repackOptions.SourceDateEpoch = &sourceDateEpoch
+	}
+	compressionOptions(ctx, &repackOptions)
+	mutator.SetCompressor(repackOptions.NewCompressor)
+	mutator.SetMaxBlobSize(maxBlobSize(ctx))
+
+	reader, err := layer.PackRootfs(context.Background(), rootfsPath, &repackOptions)
+	if err != nil {
+		return errors.Wrap(err, "generate rootfs layer")
+	}
+	defer reader.Close()
+
+	history := ispec.History{
+		Created:    created,
+		CreatedBy:  "umoci import-rootfs",
+		EmptyLayer: false,
+	}
+	history, err = historyFromContext(ctx, history, map[string]string{
+		"image": imagePath,
+		"tag":   tagName,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("packing rootfs ...")
+	if err := mutator.Add(context.Background(), reader, history); err != nil {
+		return errors.Wrap(err, "add rootfs layer")
+	}
+	log.Info("... done")
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s", newDescriptor.Digest)
+	return putNewTag(ctx, engine, tagName, newDescriptor)
+}
@@ -0,0 +1,359 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate/index"
+	"github.com/openSUSE/umoci/oci/cas"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var indexCommand = cli.Command{
+	Name:  "index",
+	Usage: "manipulates image indexes (manifest lists) in an OCI image",
+	ArgsUsage: `<command> [<args>]
+
+An image index (or manifest list) refers to several image manifests, one for
+each platform the image supports. These commands allow for an image index to
+be assembled from several tagged single-platform images.`,
+
+	Subcommands: []cli.Command{
+		indexCreateCommand,
+		indexAddCommand,
+		indexRemoveCommand,
+		indexAnnotateCommand,
+	},
+}
+
+var indexCreateCommand = uxForce(cli.Command{
+	Name:  "create",
+	Usage: "creates a new image index",
+	ArgsUsage: `--image <image-path>[:<index-tag>] [<tag>...]
+
+Where "<image-path>" is the path to the OCI image, "<index-tag>" is the name of
+the tag to create for the new image index, and each "<tag>" is the name of a
+tagged image manifest in the same OCI image to include in the index. The
+platform of each manifest is taken from its image configuration.`,
+
+	// index create modifies an image layout.
+	Category: "image",
+
+	Action: indexCreate,
+
+	Before: func(ctx *cli.Context) error {
+		for _, arg := range ctx.Args() {
+			if arg == "" {
+				return errors.Errorf("tag cannot be empty")
+			}
+		}
+		return nil
+	},
+})
+
+var indexAddCommand = uxForce(cli.Command{
+	Name:  "add",
+	Usage: "adds an image manifest to an image index",
+	ArgsUsage: `--image <image-path>[:<index-tag>] [--platform <platform>] <tag>
+
+Where "<image-path>" is the path to the OCI image, "<index-tag>" is the name of
+the tagged image index to modify, and "<tag>" is the name of the tagged image
+manifest in the same OCI image to add. If "<platform>" is not specified, it is
+taken from the image configuration. Any existing entry for the same platform
+is replaced.`,
+
+	// index add modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform (of the form os[(version)]/arch[/variant]) of the manifest",
+		},
+	},
+
+	Action: indexAdd,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <tag>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("tag cannot be empty")
+		}
+		if ctx.IsSet("platform") {
+			if _, err := parsePlatform(ctx.String("platform")); err != nil {
+				return errors.Wrap(err, "invalid --platform")
+			}
+		}
+		return nil
+	},
+})
+
+var indexRemoveCommand = uxForce(cli.Command{
+	Name:  "remove",
+	Usage: "removes an image manifest from an image index",
+	ArgsUsage: `--image <image-path>[:<index-tag>] --platform <platform>
+
+Where "<image-path>" is the path to the OCI image, "<index-tag>" is the name of
+the tagged image index to modify, and "<platform>" is the platform of the
+entries to remove.`,
+
+	// index remove modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform (of the form os[(version)]/arch[/variant]) of the entries to remove",
+		},
+	},
+
+	Action: indexRemove,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if !ctx.IsSet("platform") {
+			return errors.Errorf("missing mandatory argument: --platform")
+		}
+		if _, err := parsePlatform(ctx.String("platform")); err != nil {
+			return errors.Wrap(err, "invalid --platform")
+		}
+		return nil
+	},
+})
+
+var indexAnnotateCommand = uxForce(cli.Command{
+	Name:  "annotate",
+	Usage: "modifies the annotations of an image index",
+	ArgsUsage: `--image <image-path>[:<index-tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<index-tag>" is the
+name of the tagged image index to modify.`,
+
+	// index annotate modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "annotation",
+			Usage: "set an annotation (of the form key=value)",
+		},
+		cli.StringSliceFlag{
+			Name:  "remove-annotation",
+			Usage: "remove the annotation with the given key",
+		},
+	},
+
+	Action: indexAnnotate,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		for _, annotation := range ctx.StringSlice("annotation") {
+			if !strings.Contains(annotation, "=") {
+				return errors.Errorf("--annotation must be of the form key=value: %s", annotation)
+			}
+		}
+		return nil
+	},
+})
+
+// getManifestTag returns the descriptor of the given tag, which must refer to
+// an image manifest.
+func getManifestTag(ctx context.Context, engine cas.Engine, name string) (ispec.Descriptor, error) {
+	descriptor, err := engine.GetReference(ctx, name)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "get reference %s", name)
+	}
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return ispec.Descriptor{}, errors.Errorf("tag %s does not refer to an image manifest: %s", name, descriptor.MediaType)
+	}
+	return descriptor, nil
+}
+
+// commitIndex commits the changes made by the mutator and stores the new image
+// index in the given tag. base is the descriptor the tag referred to before
+// the changes were made (or nil if the image index is new).
+func commitIndex(ctx *cli.Context, engine cas.Engine, name string, mutator *index.Mutator, base *ispec.Descriptor) error {
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit image index")
+	}
+
+	log.Infof("new image index created: %s", newDescriptor.Digest)
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	if err := putTag(context.Background(), engine, name, newDescriptor, base, force); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image index: %s", name)
+	return nil
+}
+
+// openIndex opens the image index referred to by the given tag.
+func openIndex(ctx context.Context, engine cas.Engine, name string) (*index.Mutator, ispec.Descriptor, error) {
+	descriptor, err := engine.GetReference(ctx, name)
+	if err != nil {
+		return nil, ispec.Descriptor{}, errors.Wrap(err, "get descriptor")
+	}
+
+	mutator, err := index.New(engine, descriptor)
+	if err != nil {
+		return nil, ispec.Descriptor{}, errors.Wrap(err, "create mutator for image index")
+	}
+	return mutator, descriptor, nil
+}
+
+func indexCreate(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	mutator := index.NewEmpty(engine)
+	for _, name := range ctx.Args() {
+		descriptor, err := getManifestTag(context.Background(), engine, name)
+		if err != nil {
+			return err
+		}
+		if err := mutator.Add(context.Background(), descriptor, ispec.Platform{}); err != nil {
+			return errors.Wrapf(err, "add %s to image index", name)
+		}
+	}
+
+	return commitIndex(ctx, engine, tagName, mutator, nil)
+}
+
+func indexAdd(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	manifestName := ctx.Args().First()
+
+	var platform ispec.Platform
+	if ctx.IsSet("platform") {
+		// Already validated in Before.
+		platform, _ = parsePlatform(ctx.String("platform"))
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	mutator, oldDescriptor, err := openIndex(context.Background(), engine, tagName)
+	if err != nil {
+		return err
+	}
+
+	descriptor, err := getManifestTag(context.Background(), engine, manifestName)
+	if err != nil {
+		return err
+	}
+	if err := mutator.Add(context.Background(), descriptor, platform); err != nil {
+		return errors.Wrapf(err, "add %s to image index", manifestName)
+	}
+
+	return commitIndex(ctx, engine, tagName, mutator, &oldDescriptor)
+}
+
+func indexRemove(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Already validated in Before.
+	platform, _ := parsePlatform(ctx.String("platform"))
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	mutator, oldDescriptor, err := openIndex(context.Background(), engine, tagName)
+	if err != nil {
+		return err
+	}
+
+	if err := mutator.Remove(context.Background(), platform); err != nil {
+		return errors.Wrap(err, "remove from image index")
+	}
+
+	return commitIndex(ctx, engine, tagName, mutator, &oldDescriptor)
+}
+
+func indexAnnotate(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	mutator, oldDescriptor, err := openIndex(context.Background(), engine, tagName)
+	if err != nil {
+		return err
+	}
+
+	annotations, err := mutator.Annotations(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get base annotations")
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	for _, key := range ctx.StringSlice("remove-annotation") {
+		delete(annotations, key)
+	}
+	for _, annotation := range ctx.StringSlice("annotation") {
+		parts := strings.SplitN(annotation, "=", 2)
+		annotations[parts[0]] = parts[1]
+	}
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+
+	if err := mutator.SetAnnotations(context.Background(), annotations); err != nil {
+		return errors.Wrap(err, "set annotations")
+	}
+
+	return commitIndex(ctx, engine, tagName, mutator, &oldDescriptor)
+}
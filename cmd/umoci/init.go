@@ -23,6 +23,7 @@ import (
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/auditlog"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -36,11 +37,21 @@ Where "<image-path>" is the path to the OCI image to be created.
 
 The new OCI image does not contain any references or blobs, but those can be
 created through the use of umoci-new(1), umoci-tag(1) and other similar
-commands.`,
+commands.
+
+If --history-log is specified, the image is created with an empty history log
+in which every change to its references is recorded (see umoci-log(1)).`,
 
 	// create modifies an image layout.
 	Category: "layout",
 
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "history-log",
+			Usage: "record every change to the references of the image in a history log",
+		},
+	},
+
 	Action: initLayout,
 }
 
@@ -58,6 +69,12 @@ func initLayout(ctx *cli.Context) error {
 		return errors.Wrap(err, "image layout creation")
 	}
 
+	if ctx.Bool("history-log") {
+		if err := auditlog.Create(historyLogPath(imagePath)); err != nil {
+			return errors.Wrap(err, "image layout creation")
+		}
+	}
+
 	log.Infof("created new OCI image: %s", imagePath)
 	return nil
 }
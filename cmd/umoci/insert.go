@@ -0,0 +1,245 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var insertCommand = uxCompression(uxForce(uxHistory(uxSourceDateEpoch(uxTag(uxPlatform(cli.Command{
+	Name:  "insert",
+	Usage: "adds a directory to an image as a new layer",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] [--at <index> | --before-digest <digest>] <source>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to modify (if not specified, it defaults to "latest") and
+"<source>" is a directory whose contents are added to the root filesystem of
+the image. "<new-tag>" is the new reference name to save the image as, if this
+is not specified then umoci will replace the old image.
+
+By default the new layer is added above all of the existing layers. --at
+places it at the given index (with 0 being the lowest layer) and
+--before-digest places it directly below the layer with the given digest
+(either the digest of the layer blob or its DiffID).`,
+
+	// insert modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "at",
+			Usage: "index at which the new layer is inserted (0 is the lowest layer)",
+			Value: -1,
+		},
+		cli.StringFlag{
+			Name:  "before-digest",
+			Usage: "insert the new layer directly below the layer with this digest",
+		},
+		cli.BoolFlag{
+			Name:  "rootless",
+			Usage: "map the owner of <source> to the root user of the image",
+		},
+	},
+
+	Action: insert,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <source>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("source path cannot be empty")
+		}
+		ctx.App.Metadata["source"] = ctx.Args().First()
+
+		if ctx.IsSet("at") && ctx.IsSet("before-digest") {
+			return errors.Errorf("--at and --before-digest are mutually exclusive")
+		}
+		if ctx.IsSet("at") && ctx.Int("at") < 0 {
+			return errors.Errorf("--at must not be negative")
+		}
+		if ctx.IsSet("before-digest") {
+			if _, err := digest.Parse(ctx.String("before-digest")); err != nil {
+				return errors.Wrap(err, "parse --before-digest")
+			}
+		}
+		return nil
+	},
+}))))))
+
+func insert(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	sourcePath := ctx.App.Metadata["source"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	if fi, err := os.Stat(sourcePath); err != nil {
+		return errors.Wrap(err, "stat source")
+	} else if !fi.IsDir() {
+		return errors.Errorf("source %s is not a directory", sourcePath)
+	}
+
+	// In rootless mode the owner of the source is mapped to the root user, as
+	// with umoci-repack(1).
+	var mapOptions layer.MapOptions
+	mapOptions.Rootless = ctx.Bool("rootless")
+	if mapOptions.Rootless {
+		uidMap, err := idtools.ParseMapping(fmt.Sprintf("%d:0:1", os.Geteuid()))
+		if err != nil {
+			return errors.Wrap(err, "create rootless uid mapping")
+		}
+		gidMap, err := idtools.ParseMapping(fmt.Sprintf("%d:0:1", os.Getegid()))
+		if err != nil {
+			return errors.Wrap(err, "create rootless gid mapping")
+		}
+		mapOptions.UIDMappings = append(mapOptions.UIDMappings, uidMap)
+		mapOptions.GIDMappings = append(mapOptions.GIDMappings, gidMap)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	fromDescriptor, err := engineExt.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	fromDescriptor, err = engineExt.ResolveManifest(context.Background(), fromDescriptor, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for base image")
+	}
+	mutator.SetNoHistory(ctx.Bool("no-history"))
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+	if err := layer.CheckPlatform(ispec.Platform{OS: imageMeta.OS, Architecture: imageMeta.Architecture}); err != nil {
+		return errors.Wrap(err, "insert layer")
+	}
+
+	_, manifest, err := mutator.Preview(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image manifest")
+	}
+	index := len(manifest.Layers)
+	if ctx.IsSet("at") {
+		index = ctx.Int("at")
+		if index > len(manifest.Layers) {
+			return errors.Errorf("--at %d out of range: image has %d layers", index, len(manifest.Layers))
+		}
+	}
+	if ctx.IsSet("before-digest") {
+		index, err = mutator.LayerIndex(context.Background(), digest.Digest(ctx.String("before-digest")))
+		if err != nil {
+			return errors.Wrap(err, "resolve --before-digest")
+		}
+	}
+
+	repackOptions := layer.RepackOptions{MapOptions: mapOptions}
+	// umoci-insert(1) has no --reproducible, so a source date epoch makes the
+	// whole layer reproducible.
+	sourceDateEpoch, hasSourceDateEpoch := ctx.App.Metadata["--source-date-epoch"].(time.Time)
+	if hasSourceDateEpoch {
+		repackOptions.Reproducible = true
+		repackOptions.SourceDateEpoch = &sourceDateEpoch
+	}
+	compressionOptions(ctx, &repackOptions)
+	mutator.SetCompressor(repackOptions.NewCompressor)
+	mutator.SetMaxBlobSize(maxBlobSize(ctx))
+
+	reader, err := layer.GenerateInsertLayer(context.Background(), sourcePath, &repackOptions)
+	if err != nil {
+		return errors.Wrap(err, "generate inserted layer")
+	}
+	defer reader.Close()
+
+	history := ispec.History{
+		Author:     imageMeta.Author,
+		Comment:    "",
+		Created:    time.Now(),
+		CreatedBy:  "umoci insert",
+		EmptyLayer: false,
+	}
+	if hasSourceDateEpoch {
+		history.Created = sourceDateEpoch
+	}
+
+	history, err = historyFromContext(ctx, history, map[string]string{
+		"image": imagePath,
+		"tag":   tagName,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("inserting layer at index %d ...", index)
+	if err := mutator.Insert(context.Background(), index, reader, history); err != nil {
+		return errors.Wrap(err, "insert layer")
+	}
+	log.Info("... done")
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s", newDescriptor.Digest)
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	platform := ispec.Platform{
+		OS:           imageMeta.OS,
+		Architecture: imageMeta.Architecture,
+	}
+	if err := putManifestTag(context.Background(), engine, tagName, newDescriptor, platform, &fromDescriptor, force); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
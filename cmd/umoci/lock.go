@@ -0,0 +1,117 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var lockCommand = uxPlatform(cli.Command{
+	Name:  "lock",
+	Usage: "outputs a lockfile describing the exact composition of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--base <base-tag>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to lock and "<base-tag>" is the name of the tagged image that the
+image was built on top of.
+
+The lockfile is written to stdout, and can be used with umoci-assemble(1) to
+rebuild and verify an identical image.`,
+
+	// lock gives information about a manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "base",
+			Usage: "tag of the base image to record in the lockfile",
+		},
+	},
+
+	Action: lock,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.IsSet("base") && ctx.String("base") == "" {
+			return errors.Errorf("--base cannot be empty")
+		}
+		return nil
+	},
+})
+
+// resolveManifest returns the descriptor of the manifest referenced by the
+// given tag, for the requested platform.
+func resolveManifest(ctx *cli.Context, engineExt casext.Engine, name string) (ispec.Descriptor, error) {
+	descriptor, err := engineExt.GetReference(context.Background(), name)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get reference")
+	}
+	descriptor, err = engineExt.ResolveManifest(context.Background(), descriptor, requestedPlatform(ctx))
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "select manifest")
+	}
+	return descriptor, nil
+}
+
+func lock(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openReadOnlyImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	manifestDescriptor, err := resolveManifest(ctx, engineExt, tagName)
+	if err != nil {
+		return err
+	}
+
+	var base *ispec.Descriptor
+	if ctx.IsSet("base") {
+		baseDescriptor, err := resolveManifest(ctx, engineExt, ctx.String("base"))
+		if err != nil {
+			return errors.Wrap(err, "resolve base")
+		}
+		base = &baseDescriptor
+	}
+
+	imageLock, err := engineExt.Lock(context.Background(), manifestDescriptor, base)
+	if err != nil {
+		return errors.Wrap(err, "lock")
+	}
+
+	data, err := json.MarshalIndent(imageLock, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "encode lock")
+	}
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return errors.Wrap(err, "write lock")
+}
@@ -0,0 +1,200 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/auditlog"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var logCommand = cli.Command{
+	Name:  "log",
+	Usage: "shows the history of the references of an OCI image",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+If the image has a history log (created with --init, or with umoci-init(1)
+--history-log), every change that umoci makes to the references of the image
+is recorded in it, along with the user and command that made the change. Each
+entry contains the hash of the previous entry, so that modified, removed or
+reordered entries are detected. If --audit-key is specified, entries are also
+signed with the given key so that the log cannot be regenerated without it.
+
+The log is verified before it is shown, and an error is returned if it has
+been tampered with. If --ref is specified, only the changes to the given
+reference are shown.`,
+
+	// log reads an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "init",
+			Usage: "create an empty history log in the image, so that changes are recorded",
+		},
+		cli.StringFlag{
+			Name:  "ref",
+			Usage: "only show the changes to the given reference",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the history log as a JSON encoded blob",
+		},
+	},
+
+	Action: auditLog,
+}
+
+// historyLogPath returns the path of the history log of the image at the
+// given path.
+func historyLogPath(imagePath string) string {
+	return filepath.Join(imagePath, dir.HistoryLogFile)
+}
+
+func auditLog(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	logPath := historyLogPath(imagePath)
+
+	if ctx.Bool("init") {
+		if !dir.Driver.Supported(imagePath) {
+			return errors.Errorf("history logs are only supported by directory-backed images")
+		}
+		if err := auditlog.Create(logPath); err != nil {
+			return errors.Wrap(err, "create history log")
+		}
+		log.Infof("created history log: %s", logPath)
+		return nil
+	}
+
+	entries, err := auditlog.ReadFile(logPath)
+	if os.IsNotExist(errors.Cause(err)) {
+		return errors.Errorf("image has no history log (create one with --init)")
+	}
+	if err != nil {
+		return errors.Wrap(err, "read history log")
+	}
+	key, _ := ctx.App.Metadata["--audit-key"].([]byte)
+	if err := auditlog.Verify(entries, key); err != nil {
+		return errors.Wrap(err, "verify history log")
+	}
+
+	if ref := ctx.String("ref"); ref != "" {
+		var filtered []auditlog.Entry
+		for _, entry := range entries {
+			if entry.Reference == ref {
+				filtered = append(filtered, entry)
+			}
+		}
+		entries = filtered
+	}
+
+	if ctx.Bool("json") {
+		if entries == nil {
+			entries = []auditlog.Entry{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(entries); err != nil {
+			return errors.Wrap(err, "encoding history log")
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "SEQ\tTIME\tUSER\tREFERENCE\tOLD\tNEW\tCOMMAND\n")
+	for _, entry := range entries {
+		oldDigest, newDigest := entry.Old.String(), entry.New.String()
+		if oldDigest == "" {
+			oldDigest = "-"
+		}
+		if newDigest == "" {
+			newDigest = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.Sequence, entry.Time.Format(time.RFC3339), entry.User, entry.Reference, oldDigest, newDigest, strings.Join(entry.Command, " "))
+	}
+	return tw.Flush()
+}
+
+// currentUser returns the name of the user running umoci, for the history
+// log. If the name cannot be resolved, the uid is used instead.
+func currentUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return strconv.Itoa(os.Getuid())
+}
+
+// recordReference returns a casext.ReferenceRecorder which appends an entry
+// for every change to the history log at the given path.
+func recordReference(logPath string, key []byte) casext.ReferenceRecorder {
+	username := currentUser()
+	return func(ctx context.Context, name string, oldDescriptor, newDescriptor *ispec.Descriptor) error {
+		entry := auditlog.Entry{
+			User:      username,
+			Command:   os.Args,
+			Reference: name,
+		}
+		if oldDescriptor != nil {
+			entry.Old = oldDescriptor.Digest
+		}
+		if newDescriptor != nil {
+			entry.New = newDescriptor.Digest
+		}
+		entry, err := auditlog.Append(logPath, entry, key)
+		if err != nil {
+			return errors.Wrap(err, "append to history log")
+		}
+		log.WithFields(log.Fields{
+			"seq":       entry.Sequence,
+			"reference": name,
+		}).Debugf("recorded change in history log")
+		return nil
+	}
+}
+
+// auditEngine wraps an already opened engine such that every change to a
+// reference is recorded in the history log of the image at the given path
+// (if it has one). It must be the outermost wrapper, so that only changes
+// which were actually made are recorded.
+func auditEngine(ctx *cli.Context, path string, engine cas.Engine) (cas.Engine, error) {
+	logPath := historyLogPath(path)
+	if _, err := os.Stat(logPath); err != nil {
+		if os.IsNotExist(err) {
+			return engine, nil
+		}
+		return nil, errors.Wrap(err, "stat history log")
+	}
+	key, _ := ctx.App.Metadata["--audit-key"].([]byte)
+	return casext.NewRecordingEngine(engine, recordReference(logPath, key)), nil
+}
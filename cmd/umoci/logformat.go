@@ -0,0 +1,136 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	logcli "github.com/apex/log/handlers/cli"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/pkg/errors"
+)
+
+// newLogHandler returns the log.Handler for the given --log-format, which
+// writes to the given writer.
+func newLogHandler(format string, writer io.Writer) (log.Handler, error) {
+	switch format {
+	case "text":
+		return logcli.New(writer), nil
+	case "json":
+		return &jsonLogHandler{writer: writer}, nil
+	}
+	return nil, errors.Errorf("unknown --log-format: %s", format)
+}
+
+// jsonLogHandler is a log.Handler which writes each entry as a single line
+// JSON object, with the keys "time", "level", "msg" and "fields" (which is
+// omitted if the entry has no fields).
+type jsonLogHandler struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+type jsonLogEntry struct {
+	Time    string                 `json:"time"`
+	Level   string                 `json:"level"`
+	Message string                 `json:"msg"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+// HandleLog implements log.Handler.
+func (h *jsonLogHandler) HandleLog(entry *log.Entry) error {
+	out := jsonLogEntry{
+		Time:    entry.Timestamp.UTC().Format(time.RFC3339Nano),
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+	}
+	if len(entry.Fields) > 0 {
+		out.Fields = map[string]interface{}{}
+		for key, value := range entry.Fields {
+			// Errors don't (usefully) marshal to JSON.
+			if err, ok := value.(error); ok {
+				value = err.Error()
+			}
+			out.Fields[key] = value
+		}
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return errors.Wrap(err, "encode log entry")
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	_, err = h.writer.Write(append(data, '\n'))
+	return err
+}
+
+// logEvent is the event.Hook used by umoci, which logs each event (at the
+// debug level) with its contents as fields. With --log-format=json, this
+// makes it possible to follow the operations performed by umoci.
+func logEvent(ev event.Event) {
+	// Progress events are far too frequent to be logged, and are rendered
+	// separately (see --progress).
+	if ev.Type == event.Progress {
+		return
+	}
+
+	fields := log.Fields{"event": ev.Type}
+	for key, value := range ev.Fields {
+		fields[key] = value
+	}
+	if ev.Op != "" {
+		fields["op"] = ev.Op
+	}
+	if ev.Name != "" {
+		fields["name"] = ev.Name
+	}
+	if ev.SpanID != "" {
+		fields["span_id"] = ev.SpanID
+	}
+	if ev.ParentID != "" {
+		fields["parent_id"] = ev.ParentID
+	}
+	if ev.Digest != "" {
+		fields["digest"] = ev.Digest
+	}
+	if ev.Size != 0 || ev.Type == event.BlobDone {
+		fields["size"] = ev.Size
+	}
+	if ev.UncompressedSize != 0 {
+		fields["uncompressed_size"] = ev.UncompressedSize
+	}
+	if ev.Duration != 0 {
+		fields["duration"] = ev.Duration.Seconds()
+	}
+	if ev.Reference != "" {
+		fields["reference"] = ev.Reference
+	}
+	if ev.Descriptor != nil {
+		fields["descriptor"] = ev.Descriptor.Digest
+	}
+	if ev.Err != nil {
+		fields["error"] = ev.Err
+	}
+	log.WithFields(fields).Debugf("event: %s", ev.Type)
+}
@@ -18,11 +18,17 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 
 	"github.com/apex/log"
-	logcli "github.com/apex/log/handlers/cli"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/cas/drivers/retry"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/openSUSE/umoci/pkg/stats"
+	"github.com/openSUSE/umoci/pkg/userns"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 
@@ -47,6 +53,10 @@ const (
 )
 
 func main() {
+	// If we were re-executed inside a user namespace, this has to be done
+	// before anything else.
+	userns.Init()
+
 	app := cli.NewApp()
 	app.Name = "umoci"
 	app.Usage = usage
@@ -77,10 +87,83 @@ func main() {
 			Usage: "set the log level (debug, info, [warn], error, fatal)",
 			Value: "warn",
 		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Usage: "format of log messages ([text] or json)",
+			Value: "text",
+		},
+		cli.StringFlag{
+			Name:   "reference-hook",
+			Usage:  "executable run to validate an image before any reference to it is written",
+			EnvVar: "UMOCI_REFERENCE_HOOK",
+		},
+		cli.StringFlag{
+			Name:  "progress",
+			Usage: "how to show the progress of long-running operations ([auto], plain or none)",
+			Value: "auto",
+		},
+		cli.IntFlag{
+			Name:   "retries",
+			Usage:  "number of times to retry image operations which fail with a transient error",
+			EnvVar: "UMOCI_RETRIES",
+		},
+		cli.DurationFlag{
+			Name:   "retry-delay",
+			Usage:  "delay before the first retry, which is doubled for every subsequent retry",
+			Value:  retry.DefaultDelay,
+			EnvVar: "UMOCI_RETRY_DELAY",
+		},
+		cli.BoolFlag{
+			Name:   "no-sync",
+			Usage:  "do not flush written blobs and references to stable storage (faster, but not crash-safe)",
+			EnvVar: "UMOCI_NO_SYNC",
+		},
+		cli.StringFlag{
+			Name:   "temp-dir",
+			Usage:  "directory in which temporary files are written before being moved into an image layout",
+			EnvVar: "UMOCI_TEMP_DIR",
+		},
+		cli.BoolFlag{
+			Name:   "compress-blobs",
+			Usage:  "store uncompressed layers written to an image layout compressed with zstd",
+			EnvVar: "UMOCI_COMPRESS_BLOBS",
+		},
+		cli.BoolFlag{
+			Name:   "strict",
+			Usage:  "reject blobs whose contents do not match their media type",
+			EnvVar: "UMOCI_STRICT",
+		},
+		cli.StringFlag{
+			Name:   "max-metadata-size",
+			Usage:  "maximum size of manifests, indexes and configurations read from images (such as 4M, or 0 for no limit)",
+			EnvVar: "UMOCI_MAX_METADATA_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "audit-key",
+			Usage:  "file containing the key used to sign and verify history log entries",
+			EnvVar: "UMOCI_AUDIT_KEY",
+		},
+		cli.BoolFlag{
+			Name:  "stats",
+			Usage: "print a summary of the resources used when exiting",
+		},
+		cli.StringFlag{
+			Name:  "stats-format",
+			Usage: "format of the --stats and --metrics summaries ([text] or json)",
+			Value: "text",
+		},
+		cli.BoolFlag{
+			Name:  "metrics",
+			Usage: "print the blobs read and written and the layers unpacked and packed when exiting",
+		},
 	}
 
 	app.Before = func(ctx *cli.Context) error {
-		log.SetHandler(logcli.New(os.Stderr))
+		handler, err := newLogHandler(ctx.GlobalString("log-format"), os.Stderr)
+		if err != nil {
+			return err
+		}
+		log.SetHandler(handler)
 
 		if ctx.GlobalBool("verbose") {
 			if ctx.GlobalIsSet("log") {
@@ -99,20 +182,141 @@ func main() {
 		if level == log.DebugLevel {
 			errors.Debug(true)
 		}
+
+		// urfave/cli's IsSet ignores EnvVar, so check the value directly.
+		if hook := ctx.GlobalString("reference-hook"); hook != "" {
+			ctx.App.Metadata["--reference-hook"] = hook
+		}
+
+		if ctx.GlobalBool("no-sync") {
+			ctx.App.Metadata["--no-sync"] = true
+		}
+
+		if tempDir := ctx.GlobalString("temp-dir"); tempDir != "" {
+			ctx.App.Metadata["--temp-dir"] = tempDir
+		}
+
+		if ctx.GlobalBool("compress-blobs") {
+			ctx.App.Metadata["--compress-blobs"] = true
+		}
+
+		if ctx.GlobalBool("strict") {
+			ctx.App.Metadata["--strict"] = true
+		}
+
+		if value := ctx.GlobalString("max-metadata-size"); value != "" {
+			maxSize, err := units.RAMInBytes(value)
+			if err != nil {
+				return errors.Wrap(err, "invalid --max-metadata-size")
+			}
+			if maxSize < 0 {
+				return errors.Errorf("invalid --max-metadata-size: must not be negative")
+			}
+			ctx.App.Metadata["--max-metadata-size"] = maxSize
+		}
+
+		if keyPath := ctx.GlobalString("audit-key"); keyPath != "" {
+			key, err := ioutil.ReadFile(keyPath)
+			if err != nil {
+				return errors.Wrap(err, "read audit key")
+			}
+			key = bytes.TrimSpace(key)
+			if len(key) == 0 {
+				return errors.Errorf("audit key %s is empty", keyPath)
+			}
+			ctx.App.Metadata["--audit-key"] = key
+		}
+
+		if err := parseRetryOptions(ctx); err != nil {
+			return err
+		}
+
+		// All of the events emitted by the library are logged, recorded for
+		// --metrics and --stats, and rendered as progress.
+		renderProgress, err := newProgressHook(ctx.GlobalString("progress"), os.Stderr)
+		if err != nil {
+			return err
+		}
+		recorder := stats.NewRecorder()
+		ctx.App.Metadata["--recorder"] = recorder
+		event.SetHook(func(ev event.Event) {
+			logEvent(ev)
+			recorder.Hook(ev)
+			if renderProgress != nil {
+				renderProgress(ev)
+			}
+		})
+
+		if err := validateStatsFormat(ctx.GlobalString("stats-format")); err != nil {
+			return err
+		}
 		return nil
 	}
 
+	// The summary is printed even if the command failed, as the resources
+	// used by a failed operation are still useful to know about.
+	app.After = func(ctx *cli.Context) error {
+		recorder, ok := ctx.App.Metadata["--recorder"].(*stats.Recorder)
+		if !ok {
+			return nil
+		}
+		if ctx.GlobalBool("metrics") {
+			if err := printMetrics(ctx.GlobalString("stats-format"), recorder, os.Stderr); err != nil {
+				return err
+			}
+		}
+		if !ctx.GlobalBool("stats") {
+			return nil
+		}
+		return printStats(ctx.GlobalString("stats-format"), recorder, os.Stderr)
+	}
+
 	app.Commands = []cli.Command{
 		configCommand,
+		annotateCommand,
 		unpackCommand,
+		runCommand,
 		repackCommand,
+		verifyBundleCommand,
+		watchCommand,
+		squashCommand,
+		insertCommand,
+		removeLayerCommand,
+		encryptCommand,
+		decryptCommand,
+		scrubCommand,
+		rebaseCommand,
+		diffCommand,
+		findCommand,
 		gcCommand,
+		whichCommand,
 		initCommand,
 		newCommand,
 		tagAddCommand,
 		tagRemoveCommand,
 		tagListCommand,
+		tagFreezeCommand,
 		statCommand,
+		lockCommand,
+		assembleCommand,
+		scanImportCommand,
+		copyCommand,
+		convertCommand,
+		indexCommand,
+		historyCommand,
+		logCommand,
+		serveCommand,
+		refsCommand,
+		rawCommand,
+		attachCommand,
+		referrersCommand,
+		artifactCommand,
+		sbomCommand,
+		dedupCommand,
+		importCommand,
+		importRootfsCommand,
+		exportCommand,
+		deltaCommand,
 	}
 
 	app.Metadata = map[string]interface{}{}
@@ -121,36 +325,7 @@ func main() {
 	// add them to images with categories set to categoryImage or
 	// categoryLayout. Monkey patching was never this neat.
 	for idx, cmd := range app.Commands {
-		switch cmd.Category {
-		case categoryImage:
-			oldBefore := cmd.Before
-			cmd.Before = func(ctx *cli.Context) error {
-				if _, ok := ctx.App.Metadata["--image-path"]; !ok {
-					return errors.Errorf("missing mandatory argument: --image")
-				}
-				if _, ok := ctx.App.Metadata["--image-tag"]; !ok {
-					return errors.Errorf("missing mandatory argument: --image")
-				}
-				if oldBefore != nil {
-					return oldBefore(ctx)
-				}
-				return nil
-			}
-			cmd = uxImage(cmd)
-		case categoryLayout:
-			oldBefore := cmd.Before
-			cmd.Before = func(ctx *cli.Context) error {
-				if _, ok := ctx.App.Metadata["--image-path"]; !ok {
-					return errors.Errorf("missing mandatory argument: --layout")
-				}
-				if oldBefore != nil {
-					return oldBefore(ctx)
-				}
-				return nil
-			}
-			cmd = uxLayout(cmd)
-		}
-		app.Commands[idx] = cmd
+		app.Commands[idx] = monkeyPatch(cmd)
 	}
 
 	// Actually run umoci.
@@ -164,3 +339,42 @@ func main() {
 		log.Fatalf("%v", err)
 	}
 }
+
+// monkeyPatch adds the uxXyz wrappers to the given command (and any of its
+// subcommands) based on its category.
+func monkeyPatch(cmd cli.Command) cli.Command {
+	switch cmd.Category {
+	case categoryImage:
+		oldBefore := cmd.Before
+		cmd.Before = func(ctx *cli.Context) error {
+			if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+				return errors.Errorf("missing mandatory argument: --image")
+			}
+			if _, ok := ctx.App.Metadata["--image-tag"]; !ok {
+				return errors.Errorf("missing mandatory argument: --image")
+			}
+			if oldBefore != nil {
+				return oldBefore(ctx)
+			}
+			return nil
+		}
+		cmd = uxImage(cmd)
+	case categoryLayout:
+		oldBefore := cmd.Before
+		cmd.Before = func(ctx *cli.Context) error {
+			if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+				return errors.Errorf("missing mandatory argument: --layout")
+			}
+			if oldBefore != nil {
+				return oldBefore(ctx)
+			}
+			return nil
+		}
+		cmd = uxLayout(cmd)
+	}
+
+	for idx, subcmd := range cmd.Subcommands {
+		cmd.Subcommands[idx] = monkeyPatch(subcmd)
+	}
+	return cmd
+}
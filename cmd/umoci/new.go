@@ -18,12 +18,16 @@
 package main
 
 import (
+	"encoding/json"
+	"os"
 	"runtime"
 	"time"
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/opencontainers/go-digest"
 	imeta "github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
@@ -31,7 +35,19 @@ import (
 	"golang.org/x/net/context"
 )
 
-var newCommand = cli.Command{
+const (
+	// annotationBaseDigest is the manifest annotation which records the
+	// digest of the manifest an image created with "umoci new --from" was
+	// derived from.
+	annotationBaseDigest = "org.opencontainers.image.base.digest"
+
+	// annotationBaseName is the manifest annotation which records the tag an
+	// image created with "umoci new --from" was derived from (if it was
+	// derived from a tag).
+	annotationBaseName = "org.opencontainers.image.base.name"
+)
+
+var newCommand = uxPlatform(uxForce(cli.Command{
 	Name:  "new",
 	Usage: "creates a blank tagged OCI image",
 	ArgsUsage: `--image <image-path>:<new-tag>
@@ -42,12 +58,111 @@ of the tag for the empty manifest.
 Once you create a new image with umoci-new(1) you can directly use the image
 with umoci-unpack(1), umoci-repack(1), and umoci-config(1) to modify the new
 manifest as you see fit. This allows you to create entirely new images without
-needing a base image to start from.`,
+needing a base image to start from.
+
+With --scratch, the configuration of the new image only contains the platform
+and the (empty) list of layers, so the same image is created every time.
+
+With --from, the new image is instead a child of the given image in the same
+layout (either a tag or a, possibly abbreviated, digest of a manifest or
+manifest list). The new image has the same configuration and layers as its
+parent, and its manifest records the parent with the
+"org.opencontainers.image.base.digest" (and, if --from is a tag,
+"org.opencontainers.image.base.name") annotations.`,
 
 	// new modifies an image layout.
 	Category: "image",
 
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "scratch",
+			Usage: "create a reproducible image with a minimal configuration",
+		},
+		cli.StringFlag{
+			Name:  "from",
+			Usage: "tag or digest of the image to derive the new image from",
+		},
+	},
+
 	Action: newImage,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.IsSet("from") {
+			if ctx.String("from") == "" {
+				return errors.Errorf("--from cannot be empty")
+			}
+			if ctx.Bool("scratch") {
+				return errors.Errorf("--from and --scratch are mutually exclusive")
+			}
+		}
+		return nil
+	},
+}))
+
+// resolveParent returns the descriptor of the manifest referenced by from,
+// which is either a tag or a (possibly abbreviated) digest of a manifest or
+// manifest list. If from is a tag, it is also returned as the name of the
+// parent.
+func resolveParent(ctx context.Context, engine casext.Engine, from string, platform ispec.Platform) (ispec.Descriptor, string, error) {
+	var name string
+	descriptor, err := engine.GetReference(ctx, from)
+	if err == nil {
+		name = from
+	} else if os.IsNotExist(errors.Cause(err)) {
+		blobDigest, err := engine.ResolveDigest(ctx, from)
+		if err != nil {
+			return ispec.Descriptor{}, "", errors.Wrapf(err, "%s is neither a tag nor a digest", from)
+		}
+		descriptor, err = blobDescriptor(ctx, engine, blobDigest)
+		if err != nil {
+			return ispec.Descriptor{}, "", errors.Wrap(err, "get parent descriptor")
+		}
+	} else {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "get reference")
+	}
+
+	descriptor, err = engine.ResolveManifest(ctx, descriptor, platform)
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "select manifest")
+	}
+	return descriptor, name, nil
+}
+
+// blobDescriptor returns a descriptor for the manifest (or manifest list)
+// blob with the given digest.
+func blobDescriptor(ctx context.Context, engine cas.Engine, blobDigest digest.Digest) (ispec.Descriptor, error) {
+	data, err := casext.Engine{engine}.ReadMetadataBlob(ctx, ispec.Descriptor{Digest: blobDigest})
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	var blob struct {
+		MediaType string             `json:"mediaType"`
+		Config    *ispec.Descriptor  `json:"config"`
+		Layers    []ispec.Descriptor `json:"layers"`
+		Manifests []ispec.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "blob %s is not a manifest", blobDigest)
+	}
+
+	descriptor := ispec.Descriptor{
+		MediaType: blob.MediaType,
+		Digest:    blobDigest,
+		Size:      int64(len(data)),
+	}
+	if descriptor.MediaType == "" {
+		switch {
+		// Image configurations also have a "config" field.
+		case blob.Config != nil && blob.Layers != nil:
+			descriptor.MediaType = ispec.MediaTypeImageManifest
+		case blob.Manifests != nil:
+			descriptor.MediaType = ispec.MediaTypeImageManifestList
+		default:
+			return ispec.Descriptor{}, errors.Errorf("blob %s is neither a manifest nor a manifest list", blobDigest)
+		}
+	}
+	return descriptor, nil
 }
 
 func newImage(ctx *cli.Context) error {
@@ -55,7 +170,7 @@ func newImage(ctx *cli.Context) error {
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -66,25 +181,44 @@ func newImage(ctx *cli.Context) error {
 		"tag": tagName,
 	}).Debugf("creating new manifest")
 
+	if ctx.IsSet("from") {
+		return newChildImage(ctx, engine, tagName, ctx.String("from"))
+	}
+
 	// Create a new image config.
 	g := igen.New()
-	createTime := time.Now()
 
-	// Set all of the defaults we need.
-	g.SetCreated(createTime)
+	// Set all of the defaults we need. A scratch image has no creation time,
+	// so that its digest only depends on the platform.
+	if !ctx.Bool("scratch") {
+		g.SetCreated(time.Now())
+	}
 	g.SetOS(runtime.GOOS)
 	g.SetArchitecture(runtime.GOARCH)
 	g.ClearHistory()
 
+	descriptor, err := putEmptyManifest(context.Background(), engine, g)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("new image manifest created: %s", descriptor.Digest)
+	return putNewTag(ctx, engine, tagName, descriptor)
+}
+
+// putEmptyManifest adds a new image manifest with no layers to the image,
+// with the configuration of the given generator (whose list of layers is
+// cleared).
+func putEmptyManifest(ctx context.Context, engine cas.Engine, g *igen.Generator) (ispec.Descriptor, error) {
 	// Make sure we have no diffids.
 	g.SetRootfsType("layers")
 	g.ClearRootfsDiffIDs()
 
 	// Update config and create a new blob for it.
 	config := g.Image()
-	configDigest, configSize, err := engine.PutBlobJSON(context.Background(), config)
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, config)
 	if err != nil {
-		return errors.Wrap(err, "put config blob")
+		return ispec.Descriptor{}, errors.Wrap(err, "put config blob")
 	}
 
 	log.WithFields(log.Fields{
@@ -106,9 +240,9 @@ func newImage(ctx *cli.Context) error {
 		Layers: []ispec.Descriptor{},
 	}
 
-	manifestDigest, manifestSize, err := engine.PutBlobJSON(context.Background(), manifest)
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(ctx, manifest)
 	if err != nil {
-		return errors.Wrap(err, "put manifest blob")
+		return ispec.Descriptor{}, errors.Wrap(err, "put manifest blob")
 	}
 
 	log.WithFields(log.Fields{
@@ -116,34 +250,80 @@ func newImage(ctx *cli.Context) error {
 		"size":   manifestSize,
 	}).Debugf("umoci: added new manifest")
 
-	// Now create a new reference, and either add it to the engine or spew it
-	// to stdout.
-
-	descriptor := ispec.Descriptor{
+	return ispec.Descriptor{
 		// FIXME: Support manifest lists.
 		MediaType: ispec.MediaTypeImageManifest,
 		Digest:    manifestDigest,
 		Size:      manifestSize,
+	}, nil
+}
+
+// putNewTag points tagName at the new image descriptor.
+func putNewTag(ctx *cli.Context, engine cas.Engine, tagName string, descriptor ispec.Descriptor) error {
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	if err := putTag(context.Background(), engine, tagName, descriptor, nil, force); err != nil {
+		return errors.Wrap(err, "add new tag")
 	}
 
-	log.Infof("new image manifest created: %s", descriptor.Digest)
+	log.Infof("created new tag for image manifest: %s", tagName)
 
-	err = engine.PutReference(context.Background(), tagName, descriptor)
-	if err == cas.ErrClobber {
-		// We have to clobber a tag.
-		log.Warnf("clobbering existing tag: %s", tagName)
+	return nil
+}
+
+// newChildImage creates a new image which is a child of the image referenced
+// by from, and points tagName at it.
+func newChildImage(ctx *cli.Context, engine cas.Engine, tagName, from string) error {
+	engineExt := casext.Engine{engine}
+
+	parentDescriptor, parentName, err := resolveParent(context.Background(), engineExt, from, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "resolve --from")
+	}
 
-		// Delete the old tag.
-		if err := engine.DeleteReference(context.Background(), tagName); err != nil {
-			return errors.Wrap(err, "delete old tag")
+	parentBlob, err := engineExt.FromDescriptor(context.Background(), parentDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "get parent manifest")
+	}
+	defer parentBlob.Close()
+	parent, ok := parentBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", parentBlob.MediaType)
+	}
+
+	// The child shares the configuration and layers of its parent, and only
+	// differs in its annotations.
+	manifest := parent
+	manifest.Annotations = map[string]string{}
+	for key, value := range parent.Annotations {
+		switch key {
+		case annotationBaseDigest, annotationBaseName:
+			// These describe the parent, not the child.
+		default:
+			manifest.Annotations[key] = value
 		}
-		err = engine.PutReference(context.Background(), tagName, descriptor)
 	}
+	manifest.Annotations[annotationBaseDigest] = parentDescriptor.Digest.String()
+	if parentName != "" {
+		manifest.Annotations[annotationBaseName] = parentName
+	}
+
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(context.Background(), manifest)
 	if err != nil {
-		return errors.Wrap(err, "add new tag")
+		return errors.Wrap(err, "put manifest blob")
 	}
 
-	log.Infof("created new tag for image manifest: %s", tagName)
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
 
-	return nil
+	log.WithFields(log.Fields{
+		"parent": parentDescriptor.Digest,
+	}).Infof("new child image manifest created: %s", descriptor.Digest)
+	return putNewTag(ctx, engine, tagName, descriptor)
 }
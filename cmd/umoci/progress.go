@@ -0,0 +1,152 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/pkg/errors"
+)
+
+const (
+	// progressDelay is how long a blob operation has to run before its
+	// progress is shown. Layer operations are always shown.
+	progressDelay = 500 * time.Millisecond
+
+	// ttyProgressInterval and plainProgressInterval are how often the
+	// progress of an operation is updated on a terminal, and printed in
+	// --progress=plain mode.
+	ttyProgressInterval   = 100 * time.Millisecond
+	plainProgressInterval = time.Second
+)
+
+// progressOp is the state of an operation being rendered.
+type progressOp struct {
+	start    time.Time
+	rendered time.Time
+}
+
+// progressRenderer renders event.Progress events to a writer, either as a
+// single updating line (on a terminal) or as plain lines.
+type progressRenderer struct {
+	lock     sync.Mutex
+	writer   io.Writer
+	tty      bool
+	interval time.Duration
+	ops      map[string]*progressOp
+}
+
+// newProgressHook returns the event.Hook rendering the progress of operations
+// for the given --progress mode ("auto", "plain" or "none") to the given file.
+// Events other than event.Progress are ignored. nil is returned if no progress
+// should be rendered.
+func newProgressHook(mode string, file *os.File) (event.Hook, error) {
+	renderer := &progressRenderer{
+		writer: file,
+		ops:    map[string]*progressOp{},
+	}
+	switch mode {
+	case "none":
+		return nil, nil
+	case "plain":
+		renderer.interval = plainProgressInterval
+	case "auto":
+		// Only render progress on a terminal, so that the output of umoci
+		// isn't cluttered when it is being logged.
+		fi, err := file.Stat()
+		if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return nil, nil
+		}
+		renderer.tty = true
+		renderer.interval = ttyProgressInterval
+	default:
+		return nil, errors.Errorf("unknown --progress mode: %s", mode)
+	}
+	return renderer.render, nil
+}
+
+// progressLine formats the progress of an operation.
+func progressLine(ev event.Event) string {
+	line := ev.Op
+	if ev.Digest != "" {
+		line += " " + ev.Digest.String()
+	}
+	line += ": " + units.HumanSize(float64(ev.Current))
+	if ev.Total > 0 {
+		line += fmt.Sprintf(" / %s (%d%%)", units.HumanSize(float64(ev.Total)), ev.Current*100/ev.Total)
+	}
+	if ev.Done {
+		line += " done"
+	}
+	return line
+}
+
+func (r *progressRenderer) render(ev event.Event) {
+	if ev.Type != event.Progress {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// Blobs being written (and layers being packed) don't have a digest
+	// until they're done, so we can only key them by their operation.
+	key := ev.Op
+	if ev.Op == event.OpGet || ev.Op == event.OpUnpack {
+		key += " " + ev.Digest.String()
+	}
+
+	now := time.Now()
+	op, ok := r.ops[key]
+	if !ok {
+		op = &progressOp{start: now}
+		r.ops[key] = op
+	}
+	if ev.Done {
+		delete(r.ops, key)
+	}
+
+	// Small blob operations (such as reading a manifest) are very common, so
+	// we only show them if they take a while.
+	isLayerOp := ev.Op == event.OpUnpack || ev.Op == event.OpPack
+	if !isLayerOp && now.Sub(op.start) < progressDelay {
+		return
+	}
+	if !ev.Done && now.Sub(op.rendered) < r.interval {
+		return
+	}
+	op.rendered = now
+
+	if r.tty {
+		// Overwrite the current line, and only move onto the next one once
+		// the operation is done.
+		end := ""
+		if ev.Done {
+			end = "\n"
+		}
+		fmt.Fprintf(r.writer, "\r\x1b[K%s%s", progressLine(ev), end)
+	} else {
+		fmt.Fprintln(r.writer, progressLine(ev))
+	}
+}
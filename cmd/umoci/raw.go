@@ -0,0 +1,287 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var rawCommand = cli.Command{
+	Name:  "raw",
+	Usage: "advanced internal image tooling",
+	ArgsUsage: `<command> [<args>]
+
+These commands operate directly on the contents of an OCI image, and are
+intended for use by inspection tooling.`,
+
+	Subcommands: []cli.Command{
+		rawExtractFileCommand,
+		rawListLayerCommand,
+	},
+}
+
+var rawExtractFileCommand = uxIndexCache(uxPlatform(cli.Command{
+	Name:  "extract-file",
+	Usage: "reads a single file from an image without unpacking it",
+	ArgsUsage: `--image <image-path>[:<tag>] <path>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to read the file from (if not specified, it defaults to "latest")
+and "<path>" is the path of the file in the root filesystem of the image.
+
+The file is found by searching the layers of the image from the topmost layer
+down (respecting whiteouts), and its contents are streamed directly from the
+layer without the image being unpacked. Symlinks are resolved within the root
+filesystem of the image.`,
+
+	// extract-file only reads from an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "path to write the file to (or - for stdout)",
+			Value: "-",
+		},
+	},
+
+	Action: rawExtractFile,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <path>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("path cannot be empty")
+		}
+		if ctx.String("output") == "" {
+			return errors.Errorf("--output path cannot be empty")
+		}
+		ctx.App.Metadata["path"] = ctx.Args().First()
+		return nil
+	},
+}))
+
+func rawExtractFile(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	path := ctx.App.Metadata["path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openReadOnlyImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	manifestDescriptor, err := resolveManifest(ctx, engineExt, tagName)
+	if err != nil {
+		return err
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), manifestDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	if manifestBlob.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Wrap(errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.MediaType), "invalid manifest descriptor")
+	}
+
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+
+	reader, err := layer.OpenFile(indexCacheContext(ctx, imagePath, context.Background()), engine, manifest, path)
+	if err != nil {
+		return errors.Wrap(err, "extract file")
+	}
+	defer reader.Close()
+
+	var output io.Writer = os.Stdout
+	if outputPath := ctx.String("output"); outputPath != "-" {
+		fh, err := os.Create(outputPath)
+		if err != nil {
+			return errors.Wrap(err, "create output")
+		}
+		defer fh.Close()
+		output = fh
+	}
+	_, err = io.Copy(output, reader)
+	return errors.Wrap(err, "write file")
+}
+
+var rawListLayerCommand = uxIndexCache(uxPlatform(cli.Command{
+	Name:  "list-layer",
+	Usage: "lists the entries of a layer without unpacking it",
+	ArgsUsage: `--image <image-path>[:<tag>] --layer <digest>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image containing the layer (if not specified, it defaults to "latest")
+and "<digest>" is the digest of one of the layers of the image.
+
+Each entry of the layer is printed (as it is read from the layer) with its
+type, mode, owner, size and path. Whiteouts have the type "whiteout" and are
+printed with the path they remove (opaque whiteouts are printed with their
+directory, followed by "(opaque)"). With --json, the entries are printed as a
+JSON array of objects instead.`,
+
+	// list-layer only reads from an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "layer",
+			Usage: "digest of the layer to list",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the entries as a JSON array",
+		},
+	},
+
+	Action: rawListLayer,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if !ctx.IsSet("layer") {
+			return errors.Errorf("missing mandatory argument: --layer")
+		}
+		if err := digest.Digest(ctx.String("layer")).Validate(); err != nil {
+			return errors.Wrap(err, "invalid --layer")
+		}
+		return nil
+	},
+}))
+
+// formatLayerEntry formats the given entry as a line of the text output of
+// umoci-raw-list-layer(1).
+func formatLayerEntry(entry layer.LayerEntry) string {
+	line := fmt.Sprintf("%-8s %04o %5d:%-5d %10d %s", entry.Type, entry.Mode, entry.UID, entry.GID, entry.Size, entry.Path)
+	switch {
+	case entry.Opaque:
+		line += " (opaque)"
+	case entry.Type == "symlink":
+		line += " -> " + entry.Linkname
+	case entry.Type == "hardlink":
+		line += " link to " + entry.Linkname
+	}
+	return line
+}
+
+func rawListLayer(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	layerDigest := digest.Digest(ctx.String("layer"))
+
+	// Get a reference to the CAS.
+	engine, err := openReadOnlyImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	manifestDescriptor, err := resolveManifest(ctx, engineExt, tagName)
+	if err != nil {
+		return err
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), manifestDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		return errors.Wrap(errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.MediaType), "invalid manifest descriptor")
+	}
+
+	// We need the descriptor of the layer (rather than just its digest) to
+	// know how it is compressed.
+	var layerDescriptor *ispec.Descriptor
+	for idx := range manifest.Layers {
+		if manifest.Layers[idx].Digest == layerDigest {
+			layerDescriptor = &manifest.Layers[idx]
+			break
+		}
+	}
+	if layerDescriptor == nil {
+		return errors.Errorf("layer %s is not part of image %s", layerDigest, tagName)
+	}
+	layerCtx, err := casext.WithManifestLayerChunks(indexCacheContext(ctx, imagePath, context.Background()), manifest)
+	if err != nil {
+		return errors.Wrap(err, "get chunked layers")
+	}
+
+	output := bufio.NewWriter(os.Stdout)
+	defer output.Flush()
+
+	if !ctx.Bool("json") {
+		err := layer.ListLayer(layerCtx, engineExt, *layerDescriptor, func(entry layer.LayerEntry) error {
+			_, err := fmt.Fprintln(output, formatLayerEntry(entry))
+			return err
+		})
+		return errors.Wrap(err, "list layer")
+	}
+
+	// The entries are written as they are read, so we can't just encode a
+	// slice of them.
+	first := true
+	if _, err := io.WriteString(output, "["); err != nil {
+		return err
+	}
+	err = layer.ListLayer(layerCtx, engineExt, *layerDescriptor, func(entry layer.LayerEntry) error {
+		if !first {
+			if _, err := io.WriteString(output, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return errors.Wrap(err, "encode entry")
+		}
+		_, err = output.Write(data)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "list layer")
+	}
+	_, err = io.WriteString(output, "]\n")
+	return err
+}
@@ -0,0 +1,194 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var rebaseCommand = uxForce(uxTag(uxPlatform(cli.Command{
+	Name:  "rebase",
+	Usage: "replaces the base image of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] --old-base <base-path>[:<old-tag>] --new-base <base-path>[:<new-base-tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to rebase (if not specified, it defaults to "latest").
+"<new-tag>" is the new reference name to save the rebased image as, if this is
+not specified then umoci will replace the old image. "<base-path>" is the path
+to the OCI image containing the base images (which may be "<image-path>"),
+"<old-tag>" is the name of the base image that the image is currently based on
+and "<new-base-tag>" is the name of the base image to rebase onto.
+
+The layers of the old base image (which must be the lowest layers of the image)
+are replaced with the layers of the new base image, and the history of the old
+base image is replaced with the history of the new base image. The layers added
+on top of the old base image and the rest of the configuration of the image are
+not modified.`,
+
+	// rebase modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "old-base",
+			Usage: "OCI image URI of the current base image of the form 'path[:tag]'",
+		},
+		cli.StringFlag{
+			Name:  "new-base",
+			Usage: "OCI image URI of the new base image of the form 'path[:tag]'",
+		},
+	},
+
+	Action: rebase,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		for _, flag := range []string{"old-base", "new-base"} {
+			if !ctx.IsSet(flag) {
+				return errors.Errorf("missing mandatory argument: --%s", flag)
+			}
+			dir, tag, err := parseImage(ctx.String(flag))
+			if err != nil {
+				return errors.Wrapf(err, "invalid --%s", flag)
+			}
+			ctx.App.Metadata["--"+flag+"-path"] = dir
+			ctx.App.Metadata["--"+flag+"-tag"] = tag
+		}
+		return nil
+	},
+})))
+
+// resolveBase returns the descriptor of the manifest of the base image given
+// with --<flag>. If the base image is not in the image being rebased, its blobs
+// are copied into engine first (blobs which are already present are not
+// copied).
+func resolveBase(ctx *cli.Context, engine cas.Engine, imagePath, flag string) (ispec.Descriptor, error) {
+	basePath := ctx.App.Metadata["--"+flag+"-path"].(string)
+	baseName := ctx.App.Metadata["--"+flag+"-tag"].(string)
+
+	baseEngine := engine
+	if basePath != imagePath {
+		var err error
+		baseEngine, err = openReadOnlyImage(ctx, basePath)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "open base CAS")
+		}
+		defer baseEngine.Close()
+	}
+	baseEngineExt := casext.Engine{baseEngine}
+
+	descriptor, err := baseEngineExt.GetReference(context.Background(), baseName)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get descriptor")
+	}
+	descriptor, err = baseEngineExt.ResolveManifest(context.Background(), descriptor, requestedPlatform(ctx))
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "select manifest")
+	}
+
+	if basePath != imagePath {
+		n, err := baseEngineExt.CopyTo(context.Background(), engine, descriptor)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "copy base image blobs")
+		}
+		log.WithFields(log.Fields{
+			"blobs": n,
+		}).Debugf("copied base image %s:%s", basePath, baseName)
+	}
+	return descriptor, nil
+}
+
+func rebase(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	fromDescriptor, err := engineExt.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	fromDescriptor, err = engineExt.ResolveManifest(context.Background(), fromDescriptor, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
+
+	oldBase, err := resolveBase(ctx, engine, imagePath, "old-base")
+	if err != nil {
+		return errors.Wrap(err, "resolve --old-base")
+	}
+	newBase, err := resolveBase(ctx, engine, imagePath, "new-base")
+	if err != nil {
+		return errors.Wrap(err, "resolve --new-base")
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for base image")
+	}
+	if err := mutator.Rebase(context.Background(), oldBase, newBase); err != nil {
+		return errors.Wrap(err, "rebase image")
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s", newDescriptor.Digest)
+
+	image, err := mutator.Image(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image configuration")
+	}
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	platform := ispec.Platform{
+		OS:           image.OS,
+		Architecture: image.Architecture,
+	}
+	if err := putManifestTag(context.Background(), engine, tagName, newDescriptor, platform, &fromDescriptor, force); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
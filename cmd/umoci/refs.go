@@ -0,0 +1,199 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var refsCommand = cli.Command{
+	Name:  "refs",
+	Usage: "exports and imports the references of an OCI image",
+	ArgsUsage: `<command> [<args>]
+
+The references of an OCI image (the name and descriptor of every tag) can be
+exported to a file without any of the blobs, so that they can be backed up (or
+kept in version control) separately from the blobs. The references can then
+be imported into an image whose blobs were restored by other means.`,
+
+	Subcommands: []cli.Command{
+		refsExportCommand,
+		refsImportCommand,
+	},
+}
+
+var refsExportCommand = cli.Command{
+	Name:  "export",
+	Usage: "exports every reference in an OCI image",
+	ArgsUsage: `--layout <image-path> <file>
+
+Where "<image-path>" is the path to the OCI image, and "<file>" is the path of
+the file to write the references to (or "-" to write them to stdout).`,
+
+	// refs export only reads an image layout.
+	Category: "layout",
+
+	Action: refsExport,
+
+	Before: func(ctx *cli.Context) error {
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <file>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("file path cannot be empty")
+		}
+		ctx.App.Metadata["refs-file"] = ctx.Args().First()
+		return nil
+	},
+}
+
+var refsImportCommand = uxForce(cli.Command{
+	Name:  "import",
+	Usage: "imports references into an OCI image",
+	ArgsUsage: `--layout <image-path> <file>
+
+Where "<image-path>" is the path to the OCI image, and "<file>" is the path of
+a file generated by "umoci refs export" (or "-" to read it from stdin).
+
+Existing references which differ from the imported references are only
+replaced if --force is specified. References to blobs which are missing from
+the image are still imported, but a warning is output for each of them.`,
+
+	// refs import modifies an image layout.
+	Category: "layout",
+
+	Action: refsImport,
+
+	Before: func(ctx *cli.Context) error {
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <file>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("file path cannot be empty")
+		}
+		ctx.App.Metadata["refs-file"] = ctx.Args().First()
+		return nil
+	},
+})
+
+func refsExport(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	refsPath := ctx.App.Metadata["refs-file"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openReadOnlyImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	refs, err := engineExt.ExportReferences(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "export references")
+	}
+
+	data, err := json.MarshalIndent(refs, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "encode references")
+	}
+	data = append(data, '\n')
+
+	if refsPath == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = ioutil.WriteFile(refsPath, data, 0644)
+	}
+	if err != nil {
+		return errors.Wrap(err, "write references")
+	}
+
+	log.Infof("exported %d references", len(refs.References))
+	return nil
+}
+
+// readRefs reads the exported references at the given path ("-" meaning
+// stdin).
+func readRefs(path string) (casext.References, error) {
+	var refs casext.References
+
+	var reader io.Reader = os.Stdin
+	if path != "-" {
+		fh, err := os.Open(path)
+		if err != nil {
+			return refs, errors.Wrap(err, "open references")
+		}
+		defer fh.Close()
+		reader = fh
+	}
+
+	err := json.NewDecoder(reader).Decode(&refs)
+	return refs, errors.Wrap(err, "parse references")
+}
+
+func refsImport(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	refsPath := ctx.App.Metadata["refs-file"].(string)
+
+	refs, err := readRefs(refsPath)
+	if err != nil {
+		return err
+	}
+	for name := range refs.References {
+		if !refRegexp.MatchString(name) {
+			return errors.Errorf("invalid reference name: %q", name)
+		}
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	if err := engineExt.ImportReferences(context.Background(), refs, func(name string, descriptor ispec.Descriptor) error {
+		return putTag(context.Background(), engine, name, descriptor, nil, force)
+	}); err != nil {
+		return errors.Wrap(err, "import references")
+	}
+
+	log.Infof("imported %d references", len(refs.References))
+	return nil
+}
@@ -0,0 +1,166 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var removeLayerCommand = uxForce(uxTag(uxPlatform(cli.Command{
+	Name:  "remove-layer",
+	Usage: "removes a layer from an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] --layer <layer>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to modify (if not specified, it defaults to "latest") and
+"<layer>" is either the index of the layer to remove (with 0 being the lowest
+layer) or its digest (either the digest of the layer blob or its DiffID).
+"<new-tag>" is the new reference name to save the image as, if this is not
+specified then umoci will replace the old image.
+
+The DiffID and history entry of the layer are removed from the image
+configuration. The layer blob is only removed by umoci-gc(1), once no other
+image references it.`,
+
+	// remove-layer modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "layer",
+			Usage: "index or digest of the layer to remove",
+		},
+	},
+
+	Action: removeLayer,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.String("layer") == "" {
+			return errors.Errorf("missing mandatory argument: --layer")
+		}
+		return nil
+	},
+})))
+
+// layerIndex returns the index of the layer in the image described by value,
+// which is either a layer index or a layer digest (see mutate.LayerIndex).
+func layerIndex(ctx context.Context, mutator *mutate.Mutator, value string) (int, error) {
+	if index, err := strconv.Atoi(value); err == nil {
+		_, manifest, err := mutator.Preview(ctx)
+		if err != nil {
+			return -1, errors.Wrap(err, "get image manifest")
+		}
+		if index < 0 || index >= len(manifest.Layers) {
+			return -1, errors.Errorf("layer index %d out of range: image has %d layers", index, len(manifest.Layers))
+		}
+		return index, nil
+	}
+
+	layerDigest, err := digest.Parse(value)
+	if err != nil {
+		return -1, errors.Errorf("invalid layer %q: must be an index or a digest", value)
+	}
+	return mutator.LayerIndex(ctx, layerDigest)
+}
+
+func removeLayer(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	fromDescriptor, err := engineExt.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	fromDescriptor, err = engineExt.ResolveManifest(context.Background(), fromDescriptor, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for base image")
+	}
+
+	index, err := layerIndex(context.Background(), mutator, ctx.String("layer"))
+	if err != nil {
+		return errors.Wrap(err, "resolve --layer")
+	}
+	_, manifest, err := mutator.Preview(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image manifest")
+	}
+	layerDigest := manifest.Layers[index].Digest
+
+	if err := mutator.RemoveLayer(context.Background(), index); err != nil {
+		return errors.Wrap(err, "remove layer")
+	}
+	log.Infof("removed layer %d: %s", index, layerDigest)
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s", newDescriptor.Digest)
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	platform := ispec.Platform{
+		OS:           imageMeta.OS,
+		Architecture: imageMeta.Architecture,
+	}
+	if err := putManifestTag(context.Background(), engine, tagName, newDescriptor, platform, &fromDescriptor, force); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
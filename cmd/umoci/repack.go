@@ -19,17 +19,21 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/apex/log"
-	"github.com/openSUSE/umoci"
 	"github.com/openSUSE/umoci/mutate"
-	"github.com/openSUSE/umoci/oci/cas"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/journal"
+	"github.com/openSUSE/umoci/pkg/userns"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -37,7 +41,7 @@ import (
 	"golang.org/x/net/context"
 )
 
-var repackCommand = uxHistory(cli.Command{
+var repackCommand = uxTarFilter(uxRefresh(uxXattrPolicy(uxCompression(uxWhiteout(uxForce(uxHistory(uxSourceDateEpoch(cli.Command{
 	Name:  "repack",
 	Usage: "repacks an OCI runtime bundle into a reference",
 	ArgsUsage: `--image <image-path>[:<new-tag>] <bundle>
@@ -64,6 +68,37 @@ manifest and configuration information uses the new diff atop the old manifest.`
 	// repack creates a new image, with a given tag.
 	Category: "image",
 
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "reproducible",
+			Usage: "generate a reproducible layer that only depends on the rootfs",
+		},
+		cli.StringFlag{
+			Name:  "clamp-mtime",
+			Usage: "clamp file modification times in the layer to this timestamp (unix or ISO-8601)",
+		},
+		cli.StringFlag{
+			Name:  "watch-state",
+			Usage: "only check the paths recorded in this umoci-watch(1) journal for changes",
+		},
+		cli.BoolFlag{
+			Name:  "metadata-only",
+			Usage: "assume file contents are unchanged, and copy the contents of modified files from the image",
+		},
+		cli.IntFlag{
+			Name:  "jobs",
+			Usage: "number of files to checksum in parallel when checking the rootfs (0 uses the number of CPUs)",
+		},
+		cli.BoolFlag{
+			Name:  "no-sparse",
+			Usage: "do not store files with holes as sparse files in the layer",
+		},
+		cli.StringFlag{
+			Name:  "owner-names",
+			Usage: "set the owner names of layer entries from the rootfs /etc/passwd and /etc/group (\"image\") or a JSON mapping file",
+		},
+	},
+
 	Action: repack,
 
 	Before: func(ctx *cli.Context) error {
@@ -74,11 +109,55 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			return errors.Errorf("bundle path cannot be empty")
 		}
 		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		if ctx.Int("jobs") < 0 {
+			return errors.Errorf("invalid --jobs: must not be negative")
+		}
+		if ctx.IsSet("clamp-mtime") {
+			clampMtime, err := parseTimestamp(ctx.String("clamp-mtime"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --clamp-mtime")
+			}
+			ctx.App.Metadata["--clamp-mtime"] = clampMtime
+		}
+		if ctx.IsSet("owner-names") && ctx.String("owner-names") == "" {
+			return errors.Errorf("--owner-names cannot be empty")
+		}
 		return nil
 	},
-})
+}))))))))
 
-func repack(ctx *cli.Context) error {
+// readJournal reads a journal created by umoci-watch(1) for the given bundle.
+func readJournal(path string, meta UmociMeta) (*journal.Journal, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open journal")
+	}
+	defer fh.Close()
+
+	changes, err := journal.Read(fh)
+	if err != nil {
+		return nil, err
+	}
+	if changes.From != meta.From.Digest {
+		return nil, errors.Errorf("journal was recorded for a bundle unpacked from %s, not %s", changes.From, meta.From.Digest)
+	}
+	return changes, nil
+}
+
+// parseTimestamp parses a timestamp given either as a unix timestamp (in
+// seconds) or in ISO-8601 format.
+func parseTimestamp(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	timestamp, err := time.Parse(igen.ISO8601, value)
+	if err != nil {
+		return time.Time{}, errors.Errorf("timestamp must be a unix timestamp or in ISO-8601 format: %s", value)
+	}
+	return timestamp, nil
+}
+
+func repack(ctx *cli.Context) (err error) {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 	bundlePath := ctx.App.Metadata["bundle"].(string)
@@ -95,13 +174,33 @@ func repack(ctx *cli.Context) error {
 		"map_options": meta.MapOptions,
 	}).Debugf("umoci: loaded UmociMeta metadata")
 
+	if meta.Mode != "" {
+		return errors.Errorf("cannot repack bundle unpacked with --mode=%s", meta.Mode)
+	}
+
+	// Bundles unpacked with --userns can only be read inside a user
+	// namespace with the same mappings.
+	if meta.MapOptions.UserNamespace && !userns.Enabled() {
+		return runInUserNamespace(meta.MapOptions)
+	}
+	if len(meta.Includes) > 0 {
+		// The new layer is still correct (the mtree manifest only contains
+		// the unpacked paths), but new files outside of those paths may
+		// shadow parts of the image that were never unpacked.
+		log.Warnf("bundle only contains the paths included when it was unpacked: %s", strings.Join(meta.Includes, ", "))
+	}
+
 	// FIXME: Implement support for manifest lists.
 	if meta.From.MediaType != ispec.MediaTypeImageManifest {
 		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", meta.From.MediaType), "invalid saved from descriptor")
 	}
 
+	spanCtx, span := event.StartSpan(context.Background(), "umoci.repack")
+	defer func() { span.End(err) }()
+	span.SetAttribute("bundle", bundlePath)
+
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -112,56 +211,145 @@ func repack(ctx *cli.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "create mutator for base image")
 	}
+	mutator.SetNoHistory(ctx.Bool("no-history"))
 
-	mtreeName := strings.Replace(meta.From.Digest.String(), "sha256:", "sha256_", 1)
-	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
 	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
 
 	log.WithFields(log.Fields{
 		"image":  imagePath,
 		"bundle": bundlePath,
 		"rootfs": layer.RootfsName,
-		"mtree":  mtreePath,
 	}).Debugf("umoci: repacking OCI image")
 
-	mfh, err := os.Open(mtreePath)
-	if err != nil {
-		return errors.Wrap(err, "open mtree")
-	}
-	defer mfh.Close()
-
-	spec, err := mtree.ParseSpec(mfh)
+	spec, keywords, err := readBundleState(bundlePath, meta)
 	if err != nil {
-		return errors.Wrap(err, "parse mtree")
+		return errors.Wrap(err, "read bundle state")
 	}
 
 	log.WithFields(log.Fields{
-		"keywords": MtreeKeywords,
-	}).Debugf("umoci: parsed mtree spec")
+		"keywords": keywords,
+	}).Debugf("umoci: parsed bundle state")
 
-	fsEval := umoci.DefaultFsEval
+	fsEval := fseval.DefaultFsEval
 	if meta.MapOptions.Rootless {
-		fsEval = umoci.RootlessFsEval
+		fsEval = fseval.RootlessFsEval
+	}
+
+	var changes *journal.Journal
+	if journalPath := ctx.String("watch-state"); journalPath != "" {
+		changes, err = readJournal(journalPath, meta)
+		if err != nil {
+			return errors.Wrap(err, "read --watch-state journal")
+		}
+		if !changes.Complete {
+			log.Warnf("journal %s is incomplete: checking the whole rootfs", journalPath)
+			changes = nil
+		}
+	}
+
+	// With --metadata-only the contents of files are not read, so only
+	// changes to their size (rather than their digest) are noticed.
+	metadataOnly := ctx.Bool("metadata-only")
+	if metadataOnly {
+		keywords = layer.StatKeywords(keywords)
 	}
+	keywords = ctx.App.Metadata["--refresh-mode"].(layer.RefreshMode).Keywords(keywords)
+	tolerances, _ := ctx.App.Metadata["--refresh-tolerance"].([]layer.KeywordTolerance)
 
 	log.Info("computing filesystem diff ...")
-	diffs, err := mtree.Check(fullRootfsPath, spec, MtreeKeywords, fsEval)
+	var diffs []mtree.InodeDelta
+	if changes != nil {
+		diffs, err = layer.CheckPaths(fullRootfsPath, spec, changes.Paths, keywords, fsEval)
+		diffs = layer.FilterTolerated(diffs, tolerances)
+	} else {
+		diffs, err = layer.CheckParallelTolerant(fullRootfsPath, spec, keywords, tolerances, fsEval, ctx.Int("jobs"))
+	}
 	if err != nil {
 		return errors.Wrap(err, "check mtree")
 	}
 	log.Info("... done")
 
+	// Ignore any runtime stubs created by umoci-unpack(1), which were never
+	// part of the image.
+	diffs = filterRuntimeStubs(diffs, meta.RuntimeStubs)
+
 	log.WithFields(log.Fields{
 		"ndiff": len(diffs),
 	}).Debugf("umoci: checked mtree spec")
+	span.SetAttribute("ndiff", len(diffs))
 
-	reader, err := layer.GenerateLayer(fullRootfsPath, diffs, &meta.MapOptions)
+	repackOptions := layer.RepackOptions{
+		MapOptions:   meta.MapOptions,
+		Reproducible: ctx.Bool("reproducible"),
+		NoSparse:     ctx.Bool("no-sparse"),
+
+		// Xattrs which couldn't be set by a rootless unpack are still part
+		// of the image.
+		DroppedXattrs: meta.DroppedXattrs,
+	}
+	if source := ctx.String("owner-names"); source != "" {
+		names, err := readOwnerNames(source, func() (layer.OwnerNames, error) {
+			return layer.ReadOwnerNames(fullRootfsPath)
+		})
+		if err != nil {
+			return errors.Wrap(err, "read --owner-names")
+		}
+		repackOptions.OwnerNames = &names
+	}
+	var sourceDateEpoch *time.Time
+	if val, ok := ctx.App.Metadata["--source-date-epoch"]; ok {
+		epoch := val.(time.Time)
+		sourceDateEpoch = &epoch
+	}
+	if repackOptions.Reproducible {
+		repackOptions.SourceDateEpoch = sourceDateEpoch
+	} else {
+		repackOptions.ClampMtime = sourceDateEpoch
+	}
+	if val, ok := ctx.App.Metadata["--clamp-mtime"]; ok {
+		clampMtime := val.(time.Time)
+		repackOptions.ClampMtime = &clampMtime
+	}
+	if val, ok := ctx.App.Metadata["--whiteout-format"]; ok {
+		repackOptions.WhiteoutMode = val.(layer.WhiteoutMode)
+	}
+	// Remapped xattrs have to be mapped back to be correct in the image.
+	repackOptions.XattrPolicies = layer.XattrPolicies{}
+	for name, policy := range meta.XattrPolicies {
+		if policy == layer.XattrRemap {
+			repackOptions.XattrPolicies[name] = policy
+		}
+	}
+	if val, ok := ctx.App.Metadata["--xattr-policy"]; ok {
+		for name, policy := range val.(layer.XattrPolicies) {
+			repackOptions.XattrPolicies[name] = policy
+		}
+	}
+	if val, ok := ctx.App.Metadata["--filter"]; ok {
+		repackOptions.Filters = val.([]layer.TarFilter)
+	}
+	compressionOptions(ctx, &repackOptions)
+	mutator.SetCompressor(repackOptions.NewCompressor)
+	mutator.SetMaxBlobSize(maxBlobSize(ctx))
+
+	var reader io.ReadCloser
+	if metadataOnly {
+		// The contents of unchanged files are copied from the layers of
+		// the image the bundle was unpacked from.
+		_, manifest, err := mutator.Preview(spanCtx)
+		if err != nil {
+			return errors.Wrap(err, "get base image manifest")
+		}
+		reader, err = layer.GenerateMetadataLayer(spanCtx, engine, manifest, fullRootfsPath, diffs, &repackOptions)
+	} else {
+		reader, err = layer.GenerateLayer(spanCtx, fullRootfsPath, diffs, &repackOptions)
+	}
 	if err != nil {
 		return errors.Wrap(err, "generate diff layer")
 	}
 	defer reader.Close()
 
-	imageMeta, err := mutator.Meta(context.Background())
+	imageMeta, err := mutator.Meta(spanCtx)
 	if err != nil {
 		return errors.Wrap(err, "get image metadata")
 	}
@@ -173,49 +361,41 @@ func repack(ctx *cli.Context) error {
 		CreatedBy:  "umoci config", // XXX: Should we append argv to this?
 		EmptyLayer: false,
 	}
-
-	if val, ok := ctx.App.Metadata["--history.author"]; ok {
-		history.Author = val.(string)
-	}
-	if val, ok := ctx.App.Metadata["--history.comment"]; ok {
-		history.Comment = val.(string)
-	}
-	if val, ok := ctx.App.Metadata["--history.created"]; ok {
-		created, err := time.Parse(igen.ISO8601, val.(string))
-		if err != nil {
-			return errors.Wrap(err, "parsing --history.created")
-		}
-		history.Created = created
+	if sourceDateEpoch != nil {
+		history.Created = *sourceDateEpoch
 	}
-	if val, ok := ctx.App.Metadata["--history.created_by"]; ok {
-		history.CreatedBy = val.(string)
+
+	history, err = historyFromContext(ctx, history, map[string]string{
+		"bundle": bundlePath,
+		"image":  imagePath,
+		"tag":    tagName,
+	})
+	if err != nil {
+		return err
 	}
 
 	// TODO: We should add a flag to allow for a new layer to be made
 	//       non-distributable.
-	if err := mutator.Add(context.Background(), reader, history); err != nil {
+	if err := mutator.Add(spanCtx, reader, history); err != nil {
 		return errors.Wrap(err, "add diff layer")
 	}
 
-	newDescriptor, err := mutator.Commit(context.Background())
+	newDescriptor, err := mutator.Commit(spanCtx)
 	if err != nil {
 		return errors.Wrap(err, "commit mutated image")
 	}
 
 	log.Infof("new image manifest created: %s", newDescriptor.Digest)
 
-	err = engine.PutReference(context.Background(), tagName, newDescriptor)
-	if err == cas.ErrClobber {
-		// We have to clobber a tag.
-		log.Warnf("clobbering existing tag: %s", tagName)
-
-		// Delete the old tag.
-		if err := engine.DeleteReference(context.Background(), tagName); err != nil {
-			return errors.Wrap(err, "delete old tag")
-		}
-		err = engine.PutReference(context.Background(), tagName, newDescriptor)
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
 	}
-	if err != nil {
+	platform := ispec.Platform{
+		OS:           imageMeta.OS,
+		Architecture: imageMeta.Architecture,
+	}
+	if err := putManifestTag(spanCtx, engine, tagName, newDescriptor, platform, &meta.From, force); err != nil {
 		return errors.Wrap(err, "add new tag")
 	}
 
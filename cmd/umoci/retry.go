@@ -0,0 +1,126 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/chunked"
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/openSUSE/umoci/oci/cas/drivers/retry"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// parseRetryOptions parses --retries and --retry-delay, and stores the
+// resulting options in the app metadata if retrying is enabled.
+func parseRetryOptions(ctx *cli.Context) error {
+	retries := ctx.GlobalInt("retries")
+	if retries < 0 {
+		return errors.Errorf("--retries must not be negative: %d", retries)
+	}
+	delay := ctx.GlobalDuration("retry-delay")
+	if delay < 0 {
+		return errors.Errorf("--retry-delay must not be negative: %s", delay)
+	}
+	if retries > 0 {
+		ctx.App.Metadata["--retries"] = &retry.Options{
+			Attempts: retries + 1,
+			Delay:    delay,
+		}
+	}
+	return nil
+}
+
+// dirOptions returns the options for opening a directory-backed image, as
+// specified by the global flags.
+func dirOptions(ctx *cli.Context) dir.Options {
+	var options dir.Options
+	if _, ok := ctx.App.Metadata["--no-sync"]; ok {
+		options.NoSync = true
+	}
+	if _, ok := ctx.App.Metadata["--compress-blobs"]; ok {
+		options.CompressBlobs = true
+	}
+	if tempDir, ok := ctx.App.Metadata["--temp-dir"]; ok {
+		options.TempDir = tempDir.(string)
+	}
+	return options
+}
+
+// openImage opens the image at the given path. If --retries was specified, operations on the image which fail
+// with a transient error are retried. If --strict was specified, the contents of blobs are validated against
+// their media type. Metadata blobs are limited to --max-metadata-size.
+func openImage(ctx *cli.Context, path string) (cas.Engine, error) {
+	var (
+		engine cas.Engine
+		err    error
+	)
+	// Only directory-backed images have options that can be set globally.
+	// Existing chunked images are also "supported" by the dir driver, so
+	// they have to be excluded explicitly.
+	if options := dirOptions(ctx); options != (dir.Options{}) && dir.Driver.Supported(path) && !chunked.Driver.Supported(path) {
+		engine, err = dir.OpenWithOptions(path, options)
+	} else {
+		engine, err = cas.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strictEngine(ctx, limitEngine(ctx, retryEngine(ctx, engine))), nil
+}
+
+// openReadOnlyImage is like openImage, except that the image is opened
+// read-only (see cas.OpenReadOnly), for operations which only inspect the
+// image. This allows images on read-only storage to be used.
+func openReadOnlyImage(ctx *cli.Context, path string) (cas.Engine, error) {
+	engine, err := cas.OpenReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	return strictEngine(ctx, limitEngine(ctx, retryEngine(ctx, engine))), nil
+}
+
+// retryEngine wraps an already opened engine such that operations which fail
+// with a transient error are retried (if --retries was specified).
+func retryEngine(ctx *cli.Context, engine cas.Engine) cas.Engine {
+	if options, ok := ctx.App.Metadata["--retries"]; ok {
+		engine = retry.New(engine, options.(*retry.Options))
+	}
+	return engine
+}
+
+// limitEngine wraps an already opened engine such that metadata blobs larger
+// than --max-metadata-size (if specified) are rejected. Otherwise the default
+// limit of casext.DefaultMaxMetadataSize is used.
+func limitEngine(ctx *cli.Context, engine cas.Engine) cas.Engine {
+	if maxSize, ok := ctx.App.Metadata["--max-metadata-size"]; ok {
+		engine = casext.NewLimitingEngine(engine, maxSize.(int64))
+	}
+	return engine
+}
+
+// strictEngine wraps an already opened engine such that the contents of blobs
+// are validated against their media type (if --strict was specified). It must
+// be the outermost wrapper, other than hookEngine and auditEngine.
+func strictEngine(ctx *cli.Context, engine cas.Engine) cas.Engine {
+	if _, ok := ctx.App.Metadata["--strict"]; ok {
+		engine = casext.NewStrictEngine(engine)
+	}
+	return engine
+}
@@ -0,0 +1,375 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	iconv "github.com/openSUSE/umoci/oci/config/convert"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/idtools"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rgen "github.com/opencontainers/runtime-tools/generate"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var runCommand = uxPlatform(cli.Command{
+	Name:  "run",
+	Usage: "runs a command in a temporary container of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [-- <command> [<args>...]]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to run (if not specified, defaults to "latest") and "<command>"
+is the command to run in the container (if not specified, the entrypoint and
+command of the image are used).
+
+The image is unpacked into a temporary bundle, which is run with an OCI
+runtime (runc(8) by default) and removed once the container exits. The exit
+status of umoci-run(1) is the exit status of the container. With --keep, the
+bundle is not removed.`,
+
+	// run reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "runtime",
+			Usage: "OCI runtime used to run the container (such as runc or crun)",
+			Value: "runc",
+		},
+		cli.StringFlag{
+			Name:  "mode",
+			Usage: "how the bundle is created ([flat] or overlay)",
+			Value: "flat",
+		},
+		cli.BoolFlag{
+			Name:  "tmpfs",
+			Usage: "create the bundle on a newly-mounted tmpfs",
+		},
+		cli.BoolFlag{
+			Name:  "keep",
+			Usage: "do not remove the bundle after the container exits",
+		},
+		cli.BoolFlag{
+			Name:  "rootless",
+			Usage: "enable rootless unpacking support",
+		},
+		cli.BoolFlag{
+			Name:  "tty, t",
+			Usage: "allocate a terminal for the container (the default if stdin is a terminal)",
+		},
+		cli.StringFlag{
+			Name:  "runtime-profile",
+			Usage: "profile used to generate the runtime configuration ([default], minimal, systemd or rootless-podman)",
+			Value: "default",
+		},
+	},
+
+	Action: run,
+
+	Before: func(ctx *cli.Context) error {
+		switch ctx.String("mode") {
+		case "flat":
+		case "overlay":
+			if ctx.Bool("rootless") {
+				return errors.Errorf("--mode=overlay is not supported with --rootless")
+			}
+		default:
+			return errors.Errorf("invalid --mode: unknown mode %q", ctx.String("mode"))
+		}
+		if ctx.Bool("tmpfs") && ctx.Bool("rootless") {
+			return errors.Errorf("--tmpfs is not supported with --rootless")
+		}
+		if ctx.String("runtime") == "" {
+			return errors.Errorf("invalid --runtime: runtime cannot be empty")
+		}
+		if err := iconv.RuntimeProfile(ctx.String("runtime-profile")).Validate(); err != nil {
+			return errors.Wrap(err, "invalid --runtime-profile")
+		}
+		return nil
+	},
+})
+
+// isTerminal returns whether the given file is a terminal.
+func isTerminal(fh *os.File) bool {
+	fi, err := fh.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// randomContainerID returns a new random container ID.
+func randomContainerID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "umoci-run-" + hex.EncodeToString(buf), nil
+}
+
+// mountOverlayRootfs mounts the layers of an overlay-mode bundle at the rootfs
+// of the bundle, with a writable upper directory inside the bundle. The
+// returned boolean is false if nothing was mounted (because the image has no
+// layers, in which case the empty rootfs can be used as-is).
+func mountOverlayRootfs(bundle string) (bool, error) {
+	fh, err := os.Open(filepath.Join(bundle, layer.OverlayMetaName))
+	if err != nil {
+		return false, errors.Wrap(err, "open overlay metadata")
+	}
+	defer fh.Close()
+
+	var meta layer.OverlayMeta
+	if err := json.NewDecoder(fh).Decode(&meta); err != nil {
+		return false, errors.Wrap(err, "parse overlay metadata")
+	}
+	options := meta.MountOptions(bundle)
+	if options == "" {
+		return false, nil
+	}
+
+	upperDir := filepath.Join(bundle, "upper")
+	workDir := filepath.Join(bundle, "work")
+	for _, dir := range []string{upperDir, workDir} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return false, errors.Wrap(err, "create overlay directory")
+		}
+	}
+	options += fmt.Sprintf(",upperdir=%s,workdir=%s", upperDir, workDir)
+
+	if err := syscall.Mount("overlay", filepath.Join(bundle, layer.RootfsName), "overlay", 0, options); err != nil {
+		return false, errors.Wrap(err, "mount overlay rootfs")
+	}
+	return true, nil
+}
+
+// setRunProcess modifies the process of the runtime configuration of the
+// bundle, setting the arguments (if non-empty) and whether a terminal is
+// allocated.
+func setRunProcess(bundle string, args []string, terminal bool) error {
+	configPath := filepath.Join(bundle, "config.json")
+	g, err := rgen.NewFromFile(configPath)
+	if err != nil {
+		return errors.Wrap(err, "read config.json")
+	}
+	if len(args) > 0 {
+		g.SetProcessArgs(args)
+	}
+	g.SetProcessTerminal(terminal)
+	if err := g.SaveToFile(configPath, rgen.ExportOptions{}); err != nil {
+		return errors.Wrap(err, "write config.json")
+	}
+	return nil
+}
+
+// runRuntime runs the container in the given bundle with the given OCI
+// runtime, and returns the exit status of the container. Signals sent to umoci
+// are forwarded to the runtime.
+func runRuntime(runtime, stateDir, bundle, id string) (int, error) {
+	cmd := exec.Command(runtime, "--root", stateDir, "run", "--bundle", bundle, id)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return -1, errors.Wrapf(err, "start %s", runtime)
+	}
+
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err := cmd.Wait()
+	signal.Stop(signals)
+	close(signals)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal()), nil
+			}
+			return status.ExitStatus(), nil
+		}
+	}
+	if err != nil {
+		return -1, errors.Wrapf(err, "run %s", runtime)
+	}
+	return 0, nil
+}
+
+func run(ctx *cli.Context) (err error) {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	runtime, err := exec.LookPath(ctx.String("runtime"))
+	if err != nil {
+		return errors.Wrap(err, "find --runtime")
+	}
+
+	var mapOptions layer.MapOptions
+	mapOptions.Rootless = ctx.Bool("rootless")
+	if mapOptions.Rootless {
+		uidMap, err := idtools.ParseMapping(fmt.Sprintf("%d:0:1", os.Geteuid()))
+		if err != nil {
+			return errors.Wrap(err, "parse rootless uid mapping")
+		}
+		gidMap, err := idtools.ParseMapping(fmt.Sprintf("%d:0:1", os.Getegid()))
+		if err != nil {
+			return errors.Wrap(err, "parse rootless gid mapping")
+		}
+		mapOptions.UIDMappings = append(mapOptions.UIDMappings, uidMap)
+		mapOptions.GIDMappings = append(mapOptions.GIDMappings, gidMap)
+	}
+
+	runtimeOptions, err := parseRuntimeOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openReadOnlyImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	fromDescriptor, err := engineExt.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	fromDescriptor, err = engineExt.ResolveManifest(context.Background(), fromDescriptor, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		return errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.MediaType)
+	}
+
+	// Create the ephemeral bundle. The state directory of the runtime is kept
+	// separate from the bundle, so that it is always removed.
+	tmpDir, err := ioutil.TempDir("", "umoci-run-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary directory")
+	}
+	bundlePath := filepath.Join(tmpDir, "bundle")
+	stateDir := filepath.Join(tmpDir, "state")
+	for _, dir := range []string{bundlePath, stateDir} {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			os.RemoveAll(tmpDir)
+			return errors.Wrap(err, "create temporary directory")
+		}
+	}
+
+	// The cleanup is done in reverse order of the setup.
+	var mounts []string
+	defer func() {
+		for idx := len(mounts) - 1; idx >= 0; idx-- {
+			if ctx.Bool("keep") && mounts[idx] == bundlePath {
+				// Keep the tmpfs mounted so the bundle can be inspected.
+				continue
+			}
+			if err := syscall.Unmount(mounts[idx], syscall.MNT_DETACH); err != nil {
+				log.Warnf("failed to unmount %s: %v", mounts[idx], err)
+			}
+		}
+		if ctx.Bool("keep") {
+			os.RemoveAll(stateDir)
+			log.Infof("kept bundle: %s", bundlePath)
+			return
+		}
+		if rmErr := os.RemoveAll(tmpDir); rmErr != nil {
+			log.Warnf("failed to remove bundle %s: %v", tmpDir, rmErr)
+			if err == nil {
+				err = errors.Wrap(rmErr, "remove bundle")
+			}
+		}
+	}()
+
+	if ctx.Bool("tmpfs") {
+		if err := syscall.Mount("tmpfs", bundlePath, "tmpfs", 0, "mode=0700"); err != nil {
+			return errors.Wrap(err, "mount tmpfs bundle")
+		}
+		mounts = append(mounts, bundlePath)
+	}
+
+	log.WithFields(log.Fields{
+		"image":  imagePath,
+		"bundle": bundlePath,
+		"ref":    fromName,
+	}).Debugf("umoci: unpacking OCI image for run")
+
+	overlay := ctx.String("mode") == "overlay"
+	if err := layer.UnpackManifestWithOptions(context.Background(), engineExt, bundlePath, manifest, layer.UnpackOptions{
+		MapOptions:     mapOptions,
+		Overlay:        overlay,
+		RuntimeOptions: runtimeOptions,
+	}); err != nil {
+		return errors.Wrap(err, "create runtime bundle")
+	}
+	if overlay {
+		mounted, err := mountOverlayRootfs(bundlePath)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			mounts = append(mounts, filepath.Join(bundlePath, layer.RootfsName))
+		}
+	}
+
+	terminal := ctx.Bool("tty") || isTerminal(os.Stdin)
+	if err := setRunProcess(bundlePath, ctx.Args(), terminal); err != nil {
+		return errors.Wrap(err, "set container process")
+	}
+
+	id, err := randomContainerID()
+	if err != nil {
+		return errors.Wrap(err, "generate container id")
+	}
+	log.Infof("running container %s with %s", id, runtime)
+
+	status, err := runRuntime(runtime, stateDir, bundlePath, id)
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return cli.NewExitError("", status)
+	}
+	return nil
+}
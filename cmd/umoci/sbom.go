@@ -0,0 +1,185 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/sbom"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var sbomCommand = uxPlatform(cli.Command{
+	Name:  "sbom",
+	Usage: "generates a software bill of materials for an image",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to generate the software bill of materials for (if not
+specified, it defaults to "latest").
+
+The installed packages are detected from the rpm, dpkg and apk package
+databases in the root filesystem of the image, which are read directly from
+the image layers (the image is not unpacked). Reading an rpm database requires
+rpm(8) to be installed. The document is written to stdout (or the path given
+with --output), and can also be attached to the image as an artifact (see
+umoci-attach(1)) with --attach.`,
+
+	// sbom gives information about a manifest (and optionally modifies the
+	// image layout if --attach is used).
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "format of the document (spdx or cyclonedx)",
+			Value: sbom.FormatSPDX,
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "path to write the document to (or - for stdout)",
+			Value: "-",
+		},
+		cli.BoolFlag{
+			Name:  "attach",
+			Usage: "attach the document to the image as an artifact",
+		},
+	},
+
+	Action: generateSBOM,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if _, err := sbom.MediaType(ctx.String("format")); err != nil {
+			return errors.Errorf("unknown --format: %s", ctx.String("format"))
+		}
+		if ctx.String("output") == "" {
+			return errors.Errorf("--output path cannot be empty")
+		}
+		return nil
+	},
+})
+
+func generateSBOM(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	format := ctx.String("format")
+
+	// Get a reference to the CAS. We only need to write to the image if the
+	// document is being attached.
+	var (
+		engine cas.Engine
+		err    error
+	)
+	if ctx.Bool("attach") {
+		engine, err = openEngine(ctx, imagePath)
+	} else {
+		engine, err = openReadOnlyImage(ctx, imagePath)
+	}
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	manifestDescriptor, err := engine.GetReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get reference")
+	}
+	manifestDescriptor, err = engineExt.ResolveManifest(context.Background(), manifestDescriptor, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), manifestDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	if manifestBlob.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Wrap(errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.MediaType), "invalid manifest descriptor")
+	}
+
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+
+	files, err := layer.ReadFiles(context.Background(), engine, manifest, sbom.Match)
+	if err != nil {
+		return errors.Wrap(err, "read package databases")
+	}
+	inventory, err := sbom.Detect(files)
+	if err != nil {
+		return errors.Wrap(err, "detect packages")
+	}
+	log.Debugf("sbom: detected %d packages", len(inventory.Packages))
+
+	var doc bytes.Buffer
+	if err := sbom.Write(&doc, format, inventory, sbom.Metadata{
+		Name:        imagePath + ":" + tagName,
+		Digest:      manifestDescriptor.Digest,
+		Created:     time.Now(),
+		ToolVersion: ctx.App.Version,
+	}); err != nil {
+		return errors.Wrap(err, "generate sbom")
+	}
+
+	if ctx.Bool("attach") {
+		mediaType, _ := sbom.MediaType(format)
+		blobDigest, blobSize, err := engineExt.PutBlob(context.Background(), bytes.NewReader(doc.Bytes()))
+		if err != nil {
+			return errors.Wrap(err, "put sbom blob")
+		}
+		artifact, err := engineExt.Attach(context.Background(), manifestDescriptor, mediaType, []ispec.Descriptor{{
+			MediaType: mediaType,
+			Digest:    blobDigest,
+			Size:      blobSize,
+		}}, nil)
+		if err != nil {
+			return errors.Wrap(err, "attach sbom")
+		}
+		log.Infof("attached sbom to %s: %s", manifestDescriptor.Digest, artifact.Digest)
+	}
+
+	var output io.Writer = os.Stdout
+	if path := ctx.String("output"); path != "-" {
+		fh, err := os.Create(path)
+		if err != nil {
+			return errors.Wrap(err, "create output")
+		}
+		defer fh.Close()
+		output = fh
+	}
+	_, err = io.Copy(output, &doc)
+	return errors.Wrap(err, "write sbom")
+}
@@ -0,0 +1,248 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/vulnscan"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var scanImportCommand = uxForce(uxTag(uxPlatform(cli.Command{
+	Name:  "scan-import",
+	Usage: "imports the results of a vulnerability scan into an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] <report>
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image that was scanned (if not specified, it defaults to "latest").
+"<report>" is the path to the JSON report generated by the scanner (or "-" to
+read it from stdin). "<new-tag>" is the new reference name to save the image
+as, if this is not specified then umoci will replace the old image.
+
+A summary of the vulnerabilities found in the image, and in each of its layers,
+is stored as a set of manifest annotations which can be displayed with
+umoci-stat(1). Any summary from a previous import is replaced.`,
+
+	// scan-import modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "format of the report (auto, trivy or grype)",
+			Value: "auto",
+		},
+	},
+
+	Action: scanImport,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <report>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("report path cannot be empty")
+		}
+		switch ctx.String("format") {
+		case "auto", "trivy", "grype":
+		default:
+			return errors.Errorf("unknown --format: %s", ctx.String("format"))
+		}
+		return nil
+	},
+})))
+
+// parseReport parses the vulnerability report at the given path (or stdin if
+// the path is "-") in the given format.
+func parseReport(path, format string) (*vulnscan.Report, error) {
+	var reader io.Reader = os.Stdin
+	if path != "-" {
+		fh, err := os.Open(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "open report")
+		}
+		defer fh.Close()
+		reader = fh
+	}
+
+	switch format {
+	case "trivy":
+		return vulnscan.ParseTrivy(reader)
+	case "grype":
+		return vulnscan.ParseGrype(reader)
+	default:
+		return vulnscan.Parse(reader)
+	}
+}
+
+func scanImport(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	reportPath := ctx.Args().First()
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	report, err := parseReport(reportPath, ctx.String("format"))
+	if err != nil {
+		return errors.Wrap(err, "parse report")
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	fromDescriptor, err := engineExt.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	fromDescriptor, err = engineExt.ResolveManifest(context.Background(), fromDescriptor, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", fromDescriptor.MediaType), "invalid --image tag")
+	}
+
+	configBlob, err := engineExt.FromDescriptor(context.Background(), manifest.Config)
+	if err != nil {
+		return errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return errors.Errorf("image has %d layers but %d diff_ids", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	// Scanners usually identify layers by DiffID, but some use the digest of
+	// the (compressed) layer blob. Accept both.
+	diffIDs := map[string]string{}
+	for idx, diffID := range config.RootFS.DiffIDs {
+		diffIDs[diffID] = diffID
+		diffIDs[manifest.Layers[idx].Digest.String()] = diffID
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for manifest")
+	}
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get base metadata")
+	}
+
+	annotations, err := mutator.Annotations(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get base annotations")
+	}
+
+	// Remove the results of any previous import.
+	for key := range annotations {
+		if key == vulnscan.AnnotationSummary || strings.HasPrefix(key, vulnscan.AnnotationLayerPrefix) {
+			if err := mutator.DeleteAnnotation(context.Background(), mutate.AnnotationManifest, key); err != nil {
+				return errors.Wrapf(err, "remove annotation %s", key)
+			}
+		}
+	}
+
+	// Every layer was scanned, so layers without any vulnerabilities get an
+	// empty summary rather than no summary at all.
+	layerSummaries := map[string]vulnscan.Summary{}
+	for _, diffID := range config.RootFS.DiffIDs {
+		layerSummaries[diffID] = vulnscan.Summary{}
+	}
+	for _, layer := range report.SortedLayers() {
+		diffID, ok := diffIDs[layer.String()]
+		if !ok {
+			log.Warnf("scan-import: report refers to unknown layer %s -- ignoring", layer)
+			continue
+		}
+		for severity, n := range report.Layers[layer] {
+			layerSummaries[diffID][severity] += n
+		}
+	}
+
+	// Only the manifest annotations are modified, so no history entry is
+	// added (the configuration of the image is unchanged).
+	summaries := map[string]string{
+		vulnscan.AnnotationSummary: report.Total.String(),
+	}
+	for diffID, summary := range layerSummaries {
+		summaries[vulnscan.LayerAnnotation(diffID)] = summary.String()
+	}
+	for key, value := range summaries {
+		if err := mutator.SetAnnotation(context.Background(), mutate.AnnotationManifest, key, value); err != nil {
+			return errors.Wrapf(err, "set annotation %s", key)
+		}
+	}
+
+	log.Infof("vulnerabilities: %s", report.Total)
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s", newDescriptor.Digest)
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	platform := ispec.Platform{
+		OS:           imageMeta.OS,
+		Architecture: imageMeta.Architecture,
+	}
+	if err := putManifestTag(context.Background(), engine, tagName, newDescriptor, platform, &fromDescriptor, force); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
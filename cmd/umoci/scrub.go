@@ -0,0 +1,290 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var scrubCommand = uxCompression(uxForce(uxTag(uxPlatform(cli.Command{
+	Name:  "scrub",
+	Usage: "removes sensitive content from an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] [--env <pattern>]... [--label <pattern>]... [--history <regex>]... [--path <pattern>]...
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to scrub (if not specified, it defaults to "latest").
+"<new-tag>" is the new reference name to save the scrubbed image as, if this
+is not specified then umoci will replace the old image.
+
+Environment variables and labels whose names match one of the shell patterns
+given with --env and --label are removed from the configuration. Every match
+of the regular expressions given with --history in the history of the image
+is replaced with --history-replacement. Files matching one of the shell
+patterns given with --path (matched against the final component of the path
+of the file, or against the whole path if the pattern contains a '/') are
+removed from every layer, and the affected layers are regenerated.
+
+The blobs of the original image are only removed by umoci-gc(1), once no
+other image references them. No history entry is added.`,
+
+	// scrub modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "env",
+			Usage: "shell pattern of environment variable names to remove",
+		},
+		cli.StringSliceFlag{
+			Name:  "label",
+			Usage: "shell pattern of label names to remove",
+		},
+		cli.StringSliceFlag{
+			Name:  "history",
+			Usage: "regular expression to replace in history entries",
+		},
+		cli.StringFlag{
+			Name:  "history-replacement",
+			Usage: "replacement for the matches of --history",
+			Value: "[scrubbed]",
+		},
+		cli.StringSliceFlag{
+			Name:  "path",
+			Usage: "shell pattern of paths to remove from layers",
+		},
+	},
+
+	Action: scrub,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if len(ctx.StringSlice("env")) == 0 && len(ctx.StringSlice("label")) == 0 &&
+			len(ctx.StringSlice("history")) == 0 && len(ctx.StringSlice("path")) == 0 {
+			return errors.Errorf("nothing to do: at least one of --env, --label, --history or --path must be specified")
+		}
+		for _, flag := range []string{"env", "label"} {
+			for _, pattern := range ctx.StringSlice(flag) {
+				if _, err := filepath.Match(pattern, ""); err != nil {
+					return errors.Wrapf(err, "invalid --%s %q", flag, pattern)
+				}
+			}
+		}
+		for _, expr := range ctx.StringSlice("history") {
+			if _, err := regexp.Compile(expr); err != nil {
+				return errors.Wrapf(err, "invalid --history %q", expr)
+			}
+		}
+		if _, err := layer.ScrubPattern(ctx.StringSlice("path")); err != nil {
+			return errors.Wrap(err, "invalid --path")
+		}
+		return nil
+	},
+}))))
+
+// matchesAny returns whether name matches any of the given shell patterns.
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// scrubConfig removes the environment variables and labels matching the
+// given patterns from the given configuration, and replaces the matches of
+// the given regular expressions in its history. It returns the number of
+// fields which were modified.
+func scrubConfig(image *ispec.Image, envPatterns, labelPatterns []string, historyRegexps []*regexp.Regexp, replacement string) int {
+	modified := 0
+
+	var env []string
+	for _, kv := range image.Config.Env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if matchesAny(envPatterns, name) {
+			log.Infof("removing environment variable %s", name)
+			modified++
+			continue
+		}
+		env = append(env, kv)
+	}
+	image.Config.Env = env
+
+	labels := map[string]string{}
+	for name, value := range image.Config.Labels {
+		if matchesAny(labelPatterns, name) {
+			log.Infof("removing label %s", name)
+			modified++
+			continue
+		}
+		labels[name] = value
+	}
+	if len(labels) == 0 {
+		labels = nil
+	}
+	image.Config.Labels = labels
+
+	// Don't modify the history of the cached configuration of the mutator.
+	history := append([]ispec.History(nil), image.History...)
+	for idx := range history {
+		entry := &history[idx]
+		for _, field := range []*string{&entry.CreatedBy, &entry.Comment, &entry.Author} {
+			value := *field
+			for _, re := range historyRegexps {
+				value = re.ReplaceAllLiteralString(value, replacement)
+			}
+			if value != *field {
+				log.Infof("scrubbing history entry %d", idx)
+				*field = value
+				modified++
+			}
+		}
+	}
+	image.History = history
+	return modified
+}
+
+func scrub(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Already validated in Before.
+	var historyRegexps []*regexp.Regexp
+	for _, expr := range ctx.StringSlice("history") {
+		historyRegexps = append(historyRegexps, regexp.MustCompile(expr))
+	}
+	match, _ := layer.ScrubPattern(ctx.StringSlice("path"))
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	fromDescriptor, err := engineExt.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	fromDescriptor, err = engineExt.ResolveManifest(context.Background(), fromDescriptor, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for base image")
+	}
+	repackOptions := layer.RepackOptions{}
+	compressionOptions(ctx, &repackOptions)
+	mutator.SetCompressor(repackOptions.NewCompressor)
+	mutator.SetMaxBlobSize(maxBlobSize(ctx))
+
+	// The configuration has to be modified before any layers are replaced,
+	// as SetConfig cannot modify the DiffIDs.
+	image, err := mutator.Image(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image configuration")
+	}
+	modified := scrubConfig(&image, ctx.StringSlice("env"), ctx.StringSlice("label"), historyRegexps, ctx.String("history-replacement"))
+	if err := mutator.SetConfig(context.Background(), image); err != nil {
+		return errors.Wrap(err, "set scrubbed configuration")
+	}
+
+	if len(ctx.StringSlice("path")) > 0 {
+		_, manifest, err := mutator.Preview(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "get image manifest")
+		}
+		scrubCtx, err := casext.WithManifestLayerChunks(context.Background(), manifest)
+		if err != nil {
+			return errors.Wrap(err, "get chunked layers")
+		}
+		for idx, layerDescriptor := range manifest.Layers {
+			// Only regenerate the layers which contain matching paths.
+			paths, err := layer.ScrubsLayer(scrubCtx, engineExt, layerDescriptor, match)
+			if err != nil {
+				return errors.Wrapf(err, "check layer %d", idx)
+			}
+			if len(paths) == 0 {
+				continue
+			}
+			for _, path := range paths {
+				log.Infof("removing %s from layer %d", path, idx)
+			}
+
+			reader, err := layer.ScrubLayer(scrubCtx, engineExt, layerDescriptor, match)
+			if err != nil {
+				return errors.Wrapf(err, "scrub layer %d", idx)
+			}
+			err = mutator.ReplaceLayer(context.Background(), idx, reader)
+			reader.Close()
+			if err != nil {
+				return errors.Wrapf(err, "replace layer %d", idx)
+			}
+			modified += len(paths)
+		}
+	}
+
+	if modified == 0 {
+		log.Info("nothing matched: image is unchanged")
+		return nil
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s", newDescriptor.Digest)
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	platform := ispec.Platform{
+		OS:           image.OS,
+		Architecture: image.Architecture,
+	}
+	if err := putManifestTag(context.Background(), engine, tagName, newDescriptor, platform, &fromDescriptor, force); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
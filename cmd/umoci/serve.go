@@ -0,0 +1,129 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/registry"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var serveCommand = cli.Command{
+	Name:  "serve",
+	Usage: "serves an OCI image as a read-only registry",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+The image is served over HTTP as a single repository of a read-only registry
+(implementing the pull subset of the OCI distribution-spec), so that container
+runtimes and other hosts can pull its tags directly. The repository is named
+after the image directory, unless --name is specified. umoci-serve(1) runs
+until it is interrupted (with SIGINT or SIGTERM).
+
+No authentication or TLS is provided, so by default the image is only served
+on the loopback interface. To serve it to other hosts on a trusted network,
+pass their interface (or ":5000" for all interfaces) to --listen.`,
+
+	// serve reads an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "listen",
+			Usage: "address to listen on (of the form [host]:port)",
+			Value: "127.0.0.1:5000",
+		},
+		cli.StringFlag{
+			Name:  "name",
+			Usage: "name of the repository the image is served as (defaults to the name of the image directory)",
+		},
+	},
+
+	Action: serve,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.String("listen") == "" {
+			return errors.Errorf("--listen cannot be empty")
+		}
+		return nil
+	},
+}
+
+func serve(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	name := ctx.String("name")
+	if name == "" {
+		fullPath, err := filepath.Abs(imagePath)
+		if err != nil {
+			return errors.Wrap(err, "get image path")
+		}
+		name = filepath.Base(fullPath)
+		if err := registry.ValidateName(name); err != nil {
+			return errors.Wrap(err, "image directory is not a valid repository name (use --name)")
+		}
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openReadOnlyImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	handler, err := registry.NewHandler(engineExt, name)
+	if err != nil {
+		return errors.Wrap(err, "invalid --name")
+	}
+
+	listener, err := net.Listen("tcp", ctx.String("listen"))
+	if err != nil {
+		return errors.Wrap(err, "listen")
+	}
+	server := &http.Server{Handler: handler}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		sig := <-signals
+		log.Infof("received %s: stopping", sig)
+		server.Shutdown(context.Background())
+	}()
+
+	log.Infof("serving %s as %s on %s", imagePath, name, listener.Addr())
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return errors.Wrap(err, "serve")
+	}
+	return nil
+}
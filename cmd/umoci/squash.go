@@ -0,0 +1,211 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/idtools"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var squashCommand = uxCompression(uxForce(uxHistory(uxTag(uxPlatform(cli.Command{
+	Name:  "squash",
+	Usage: "flattens all layers of an image into a single layer",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to squash (if not specified, it defaults to "latest").
+"<new-tag>" is the new reference name to save the squashed image as, if this is
+not specified then umoci will replace the old image.
+
+The image is unpacked into a temporary directory, from which a single layer
+containing the entire root filesystem is generated.`,
+
+	// squash modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "rootless",
+			Usage: "enable rootless squashing support",
+		},
+	},
+
+	Action: squash,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+})))))
+
+func squash(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// In rootless mode we map ourselves to the root user, as with
+	// umoci-unpack(1). The mapping is only used for the temporary rootfs, and
+	// is reversed when generating the squashed layer.
+	var mapOptions layer.MapOptions
+	mapOptions.Rootless = ctx.Bool("rootless")
+	if mapOptions.Rootless {
+		uidMap, err := idtools.ParseMapping(fmt.Sprintf("%d:0:1", os.Geteuid()))
+		if err != nil {
+			return errors.Wrap(err, "create rootless uid mapping")
+		}
+		gidMap, err := idtools.ParseMapping(fmt.Sprintf("%d:0:1", os.Getegid()))
+		if err != nil {
+			return errors.Wrap(err, "create rootless gid mapping")
+		}
+		mapOptions.UIDMappings = append(mapOptions.UIDMappings, uidMap)
+		mapOptions.GIDMappings = append(mapOptions.GIDMappings, gidMap)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	fromDescriptor, err := engineExt.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	fromDescriptor, err = engineExt.ResolveManifest(context.Background(), fromDescriptor, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", fromDescriptor.MediaType), "invalid --image tag")
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for base image")
+	}
+	mutator.SetNoHistory(ctx.Bool("no-history"))
+
+	// Unpack the image into a temporary bundle.
+	bundlePath, err := ioutil.TempDir("", "umoci-squash")
+	if err != nil {
+		return errors.Wrap(err, "create temporary bundle")
+	}
+	fsEval := fseval.DefaultFsEval
+	if mapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+	defer fsEval.RemoveAll(bundlePath)
+
+	log.Info("unpacking image ...")
+	if err := layer.UnpackManifest(context.Background(), engineExt, bundlePath, manifest, &mapOptions); err != nil {
+		return errors.Wrap(err, "unpack image")
+	}
+	log.Info("... done")
+
+	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+	repackOptions := layer.RepackOptions{MapOptions: mapOptions}
+	compressionOptions(ctx, &repackOptions)
+	mutator.SetCompressor(repackOptions.NewCompressor)
+	mutator.SetMaxBlobSize(maxBlobSize(ctx))
+
+	reader, err := layer.GenerateFullLayer(context.Background(), fullRootfsPath, &repackOptions)
+	if err != nil {
+		return errors.Wrap(err, "generate squashed layer")
+	}
+	defer reader.Close()
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+
+	history := ispec.History{
+		Author:     imageMeta.Author,
+		Comment:    "",
+		Created:    time.Now(),
+		CreatedBy:  "umoci squash",
+		EmptyLayer: false,
+	}
+
+	history, err = historyFromContext(ctx, history, map[string]string{
+		"image": imagePath,
+		"tag":   tagName,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("squashing layers ...")
+	if err := mutator.Squash(context.Background(), reader, history); err != nil {
+		return errors.Wrap(err, "squash layers")
+	}
+	log.Info("... done")
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s", newDescriptor.Digest)
+
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	platform := ispec.Platform{
+		OS:           imageMeta.OS,
+		Architecture: imageMeta.Architecture,
+	}
+	if err := putManifestTag(context.Background(), engine, tagName, newDescriptor, platform, &fromDescriptor, force); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
@@ -18,11 +18,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
+	"text/template"
 
-	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/docker/go-units"
 	"github.com/openSUSE/umoci/oci/casext"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
@@ -30,7 +33,7 @@ import (
 	"golang.org/x/net/context"
 )
 
-var statCommand = cli.Command{
+var statCommand = uxPlatform(cli.Command{
 	Name:  "stat",
 	Usage: "displays status information of an image manifest",
 	ArgsUsage: `--image <image-path>[:<tag>]
@@ -38,9 +41,20 @@ var statCommand = cli.Command{
 Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
 the tagged image to stat.
 
-WARNING: Do not depend on the output of this tool unless you're using --json.
-The intention of the default formatting of this tool is that it is easy for
-humans to read, and might change in future versions.`,
+If --size-breakdown is specified, the compressed and uncompressed size of each
+layer, the layers shared with other tags in the image, the largest files in
+each layer and the sizes of the image's blobs by media type are also output,
+to help find what makes the image large.
+
+If --resolve-digest is specified, only the pinned reference "<tag>@<digest>"
+(where "<digest>" is the digest of the manifest or manifest list that the tag
+refers to) is printed, which can be passed to umoci-tag(1) --digest. With
+--json, the pinned reference is printed along with the descriptor.
+
+WARNING: Do not depend on the output of this tool unless you're using --json,
+--format or --resolve-digest. The intention of the default formatting of this
+tool is that it is easy for humans to read, and might change in future
+versions.`,
 
 	// stat gives information about a manifest.
 	Category: "image",
@@ -50,9 +64,67 @@ humans to read, and might change in future versions.`,
 			Name:  "json",
 			Usage: "output the stat information as a JSON encoded blob",
 		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "output the stat information using the given Go template",
+		},
+		cli.BoolFlag{
+			Name:  "resolve-digest",
+			Usage: "only output the reference pinned to the digest the tag refers to",
+		},
+		cli.BoolFlag{
+			Name:  "size-breakdown",
+			Usage: "also output the breakdown of the size of the image (per-layer sizes, shared bytes, largest files and media types)",
+		},
+		cli.IntFlag{
+			Name:  "top-files",
+			Usage: "number of the largest files of each layer to output with --size-breakdown",
+			Value: 10,
+		},
 	},
 
 	Action: stat,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.Bool("json") && ctx.IsSet("format") {
+			return errors.Errorf("--json and --format are mutually exclusive")
+		}
+		if ctx.Bool("resolve-digest") && ctx.IsSet("format") {
+			return errors.Errorf("--resolve-digest and --format are mutually exclusive")
+		}
+		if ctx.Bool("resolve-digest") && ctx.Bool("size-breakdown") {
+			return errors.Errorf("--resolve-digest and --size-breakdown are mutually exclusive")
+		}
+		if ctx.IsSet("top-files") && !ctx.Bool("size-breakdown") {
+			return errors.Errorf("--top-files can only be used with --size-breakdown")
+		}
+		if ctx.Int("top-files") < 0 {
+			return errors.Errorf("--top-files must not be negative")
+		}
+		if ctx.IsSet("format") {
+			tmpl, err := parseStatFormat(ctx.String("format"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --format")
+			}
+			ctx.App.Metadata["--format"] = tmpl
+		}
+		return nil
+	},
+})
+
+// statFuncs are the extra functions available to --format templates.
+var statFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join":      strings.Join,
+	"humanSize": func(size int64) string { return units.HumanSize(float64(size)) },
+}
+
+// parseStatFormat parses a --format template.
+func parseStatFormat(format string) (*template.Template, error) {
+	return template.New("format").Funcs(statFuncs).Parse(format)
 }
 
 func stat(ctx *cli.Context) error {
@@ -60,7 +132,7 @@ func stat(ctx *cli.Context) error {
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := openReadOnlyImage(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -71,8 +143,14 @@ func stat(ctx *cli.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "get reference")
 	}
+	if ctx.Bool("resolve-digest") {
+		return printPinnedReference(ctx.Bool("json"), tagName, manifestDescriptor)
+	}
+	manifestDescriptor, err = engineExt.ResolveManifest(context.Background(), manifestDescriptor, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
 
-	// FIXME: Implement support for manifest lists.
 	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
 		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType), "invalid saved from descriptor")
 	}
@@ -83,8 +161,30 @@ func stat(ctx *cli.Context) error {
 		return errors.Wrap(err, "stat")
 	}
 
+	// The uncompressed sizes are only computed for machine-readable output
+	// (or the size breakdown), as every layer has to be decompressed.
+	tmpl, useTemplate := ctx.App.Metadata["--format"].(*template.Template)
+	if ctx.Bool("size-breakdown") {
+		if err := StatSizeBreakdown(context.Background(), engineExt, &ms, tagName, ctx.Int("top-files")); err != nil {
+			return errors.Wrap(err, "stat size breakdown")
+		}
+	} else if ctx.Bool("json") || useTemplate {
+		if err := StatUncompressed(context.Background(), engineExt, &ms); err != nil {
+			return errors.Wrap(err, "stat uncompressed sizes")
+		}
+	}
+
 	// Output the stat information.
-	if ctx.Bool("json") {
+	if useTemplate {
+		var buffer bytes.Buffer
+		if err := tmpl.Execute(&buffer, ms); err != nil {
+			return errors.Wrap(err, "execute --format template")
+		}
+		buffer.WriteByte('\n')
+		if _, err := buffer.WriteTo(os.Stdout); err != nil {
+			return errors.Wrap(err, "write stat")
+		}
+	} else if ctx.Bool("json") {
 		// Use JSON.
 		if err := json.NewEncoder(os.Stdout).Encode(ms); err != nil {
 			return errors.Wrap(err, "encoding stat")
@@ -97,3 +197,26 @@ func stat(ctx *cli.Context) error {
 
 	return nil
 }
+
+// pinnedReference is the JSON encoded output of stat --resolve-digest.
+type pinnedReference struct {
+	Reference  string           `json:"reference"`
+	Descriptor ispec.Descriptor `json:"descriptor"`
+}
+
+// printPinnedReference prints the reference pinned to the digest of the
+// descriptor the tag refers to, as "<tag>@<digest>".
+func printPinnedReference(useJSON bool, tagName string, descriptor ispec.Descriptor) error {
+	pinned := pinnedReference{
+		Reference:  tagName + "@" + descriptor.Digest.String(),
+		Descriptor: descriptor,
+	}
+	if useJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(pinned); err != nil {
+			return errors.Wrap(err, "encoding pinned reference")
+		}
+		return nil
+	}
+	fmt.Println(pinned.Reference)
+	return nil
+}
@@ -18,78 +18,247 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/apex/log"
+	"github.com/docker/go-units"
 	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"golang.org/x/net/context"
 )
 
-var tagAddCommand = cli.Command{
+// tagAddCommand adds a tag to an image. It doesn't have a category (and so
+// isn't monkey-patched), because the mandatory --image check would otherwise
+// also apply to its subcommands.
+var tagAddCommand = uxForce(uxImage(cli.Command{
 	Name:  "tag",
-	Usage: "creates a new tag in an OCI image",
+	Usage: "creates, copies, moves and removes tags in an OCI image",
 	ArgsUsage: `--image <image-path>[:<tag>] <new-tag>
 
 Where "<image-path>" is the path to the OCI image, "<tag>" is the old name of
-the tag and "<new-tag>" is the new name of the tag.`,
+the tag and "<new-tag>" is the new name of the tag.
+
+If --digest is specified (in which case "<tag>" must not be), the new tag
+refers to the manifest or manifest list with the given (possibly abbreviated)
+digest instead, which must already be in the image. A pinned reference of the
+form "<name>@<digest>" (as printed by umoci-stat(1) --resolve-digest) is also
+accepted.
+
+The "cp", "mv" and "rm" subcommands copy, rename and remove tags.`,
+
+	Subcommands: []cli.Command{
+		tagCopyCommand,
+		tagMoveCommand,
+		tagRemoveSubcommand,
+	},
+
+	Flags: tagCopyFlags,
+
+	Action: tagAdd,
+}))
+
+var tagCopyCommand = uxForce(cli.Command{
+	Name:    "cp",
+	Aliases: []string{"copy"},
+	Usage:   "copies a tag in an OCI image (like umoci-tag(1))",
+	ArgsUsage: `--image <image-path>[:<tag>] <new-tag>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag to copy and "<new-tag>" is the name of the copy.`,
 
 	// tag modifies an image layout.
 	Category: "image",
 
-	Action: tagAdd,
+	Flags: tagCopyFlags,
 
-	Before: func(ctx *cli.Context) error {
-		if ctx.NArg() != 1 {
-			return errors.Errorf("invalid number of positional arguments: expected <new-tag>")
-		}
-		if ctx.Args().First() == "" {
-			return errors.Errorf("new tag cannot be empty")
-		}
-		if !refRegexp.MatchString(ctx.Args().First()) {
-			return errors.Errorf("new tag is an invalid reference")
-		}
-		ctx.App.Metadata["new-tag"] = ctx.Args().First()
-		return nil
+	Action: tagCopy,
+})
+
+var tagMoveCommand = uxForce(cli.Command{
+	Name:    "mv",
+	Aliases: []string{"move"},
+	Usage:   "renames a tag in an OCI image",
+	ArgsUsage: `--image <image-path>[:<tag>] <new-tag>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag to rename and "<new-tag>" is its new name.`,
+
+	// tag modifies an image layout.
+	Category: "image",
+
+	Action: tagMove,
+})
+
+var tagRemoveSubcommand = cli.Command{
+	Name:    "rm",
+	Aliases: []string{"remove"},
+	Usage:   "removes a tag from an OCI image (like umoci-remove(1))",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag to remove.`,
+
+	// tag modifies an image layout.
+	Category: "image",
+
+	Flags: tagRemoveFlags,
+
+	Action: tagRemove,
+}
+
+// tagCopyFlags are the flags of "umoci tag" and "umoci tag cp".
+var tagCopyFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "digest",
+		Usage: "digest of the manifest (or manifest list) to tag, rather than an existing tag",
 	},
 }
 
+// pinnedDigest returns the digest of a --digest argument, which is either a
+// (possibly abbreviated) digest or a pinned reference of the form
+// "<name>@<digest>".
+func pinnedDigest(value string) string {
+	if idx := strings.LastIndex(value, "@"); idx >= 0 {
+		return value[idx+1:]
+	}
+	return value
+}
+
+// newTagArg returns the <new-tag> positional argument of the tag commands.
+func newTagArg(ctx *cli.Context) (string, error) {
+	if ctx.NArg() != 1 {
+		return "", errors.Errorf("invalid number of positional arguments: expected <new-tag>")
+	}
+	newTag := ctx.Args().First()
+	if newTag == "" {
+		return "", errors.Errorf("new tag cannot be empty")
+	}
+	if !refRegexp.MatchString(newTag) {
+		return "", errors.Errorf("new tag is an invalid reference")
+	}
+	return newTag, nil
+}
+
 func tagAdd(ctx *cli.Context) error {
+	// urfave/cli only checks for --help in the parent context of commands
+	// with subcommands, so we have to handle it ourselves.
+	if ctx.Bool("help") {
+		return cli.ShowSubcommandHelp(ctx)
+	}
+	if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+		return errors.Errorf("missing mandatory argument: --image")
+	}
+	return tagCopy(ctx)
+}
+
+func tagCopy(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	fromName := ctx.App.Metadata["--image-tag"].(string)
-	tagName := ctx.App.Metadata["new-tag"].(string)
+	tagName, err := newTagArg(ctx)
+	if err != nil {
+		return err
+	}
 
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
 	defer engine.Close()
 
 	// Get original descriptor.
+	var descriptor ispec.Descriptor
+	if ctx.IsSet("digest") {
+		// The tag defaults to "latest", so we have to check whether it was
+		// actually specified.
+		if strings.Contains(ctx.String("image"), ":") {
+			return errors.Errorf("--digest cannot be used with a source tag")
+		}
+		engineExt := casext.Engine{engine}
+		blobDigest, err := engineExt.ResolveDigest(context.Background(), pinnedDigest(ctx.String("digest")))
+		if err != nil {
+			return errors.Wrap(err, "resolve digest")
+		}
+		descriptor, err = blobDescriptor(context.Background(), engine, blobDigest)
+		if err != nil {
+			return errors.Wrap(err, "get descriptor")
+		}
+		fromName = descriptor.Digest.String()
+	} else {
+		descriptor, err = engine.GetReference(context.Background(), fromName)
+		if err != nil {
+			return errors.Wrap(err, "get reference")
+		}
+	}
+
+	// Add it.
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
+	}
+	if err := putTag(context.Background(), engine, tagName, descriptor, nil, force); err != nil {
+		return errors.Wrap(err, "put reference")
+	}
+
+	log.Infof("created new tag: %q -> %q", tagName, fromName)
+	return nil
+}
+
+func tagMove(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	tagName, err := newTagArg(ctx)
+	if err != nil {
+		return err
+	}
+	if tagName == fromName {
+		return errors.Errorf("cannot move tag %s to itself", fromName)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
 	descriptor, err := engine.GetReference(context.Background(), fromName)
 	if err != nil {
 		return errors.Wrap(err, "get reference")
 	}
 
-	// Add it.
-	err = engine.PutReference(context.Background(), tagName, descriptor)
-	if err == cas.ErrClobber {
-		// We have to clobber a tag.
-		log.Warnf("clobbering existing tag: %s", tagName)
+	// Only a tag that we created can be removed if the move fails.
+	_, err = engine.GetReference(context.Background(), tagName)
+	existed := err == nil
 
-		// Delete the old tag.
-		if err := engine.DeleteReference(context.Background(), tagName); err != nil {
-			return errors.Wrap(err, "delete old tag")
-		}
-		err = engine.PutReference(context.Background(), tagName, descriptor)
+	force := false
+	if val, ok := ctx.App.Metadata["--force"]; ok {
+		force = val.(bool)
 	}
-	if err != nil {
+	if err := putTag(context.Background(), engine, tagName, descriptor, nil, force); err != nil {
 		return errors.Wrap(err, "put reference")
 	}
+	// If the old tag can't be removed (because it is frozen for instance),
+	// don't leave behind a copy of it.
+	if err := engine.DeleteReference(context.Background(), fromName); err != nil {
+		if !existed {
+			if rmErr := engine.DeleteReference(context.Background(), tagName); rmErr != nil {
+				log.Warnf("failed to remove new tag %s: %v", tagName, rmErr)
+			}
+		}
+		return errors.Wrap(err, "delete old reference")
+	}
 
-	log.Infof("created new tag: %q -> %q", tagName, fromName)
+	log.Infof("moved tag: %q -> %q", fromName, tagName)
 	return nil
 }
 
@@ -101,25 +270,57 @@ var tagRemoveCommand = cli.Command{
 
 
 Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
-tag to remove.`,
+tag to remove.
+
+If --prune is specified, the blobs which are not used by any other tag in the
+image are removed along with the tag (rather than waiting for umoci-gc(1)).`,
 
 	// tag modifies an image layout.
 	Category: "image",
 
+	Flags: tagRemoveFlags,
+
 	Action: tagRemove,
 }
 
+// tagRemoveFlags are the flags of "umoci remove" and "umoci tag rm".
+var tagRemoveFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "prune",
+		Usage: "also remove the blobs which are not used by any other tag",
+	},
+}
+
 func tagRemove(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
 	defer engine.Close()
 
+	if ctx.Bool("prune") {
+		engineExt := casext.Engine{engine}
+		pool, err := engineExt.BlobPool(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "count blob references")
+		}
+		deletions, err := pool.DeleteReference(context.Background(), tagName)
+		if err != nil {
+			return errors.Wrap(err, "delete reference")
+		}
+
+		var size int64
+		for _, deletion := range deletions {
+			size += deletion.Size
+		}
+		log.Infof("removed tag: %s (pruned %d blobs: %s reclaimed)", tagName, len(deletions), units.HumanSize(float64(size)))
+		return nil
+	}
+
 	// Add it.
 	if err := engine.DeleteReference(context.Background(), tagName); err != nil {
 		return errors.Wrap(err, "delete reference")
@@ -129,40 +330,230 @@ func tagRemove(ctx *cli.Context) error {
 	return nil
 }
 
+var tagFreezeCommand = cli.Command{
+	Name:  "freeze",
+	Usage: "prevents a tag in an OCI image from being modified or removed",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag to freeze (or unfreeze if --unfreeze is specified).`,
+
+	// tag modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "unfreeze",
+			Usage: "remove the freeze from the tag rather than adding it",
+		},
+	},
+
+	Action: tagFreeze,
+}
+
+func tagFreeze(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	freezer, ok := engine.(cas.FreezingEngine)
+	if !ok {
+		return errors.Wrap(cas.ErrNotImplemented, "freeze reference")
+	}
+
+	if ctx.Bool("unfreeze") {
+		if err := freezer.UnfreezeReference(context.Background(), tagName); err != nil {
+			return errors.Wrap(err, "unfreeze reference")
+		}
+		log.Infof("unfroze tag: %s", tagName)
+		return nil
+	}
+
+	if err := freezer.FreezeReference(context.Background(), tagName); err != nil {
+		return errors.Wrap(err, "freeze reference")
+	}
+	log.Infof("froze tag: %s", tagName)
+	return nil
+}
+
 var tagListCommand = cli.Command{
 	Name:    "list",
 	Aliases: []string{"ls"},
 	Usage:   "lists the set of tags in an OCI image",
-	ArgsUsage: `--layout <image-path>
+	ArgsUsage: `--layout <image-path> [<pattern>...]
 
-Where "<image-path>" is the path to the OCI image.
+Where "<image-path>" is the path to the OCI image, and "<pattern>" is a glob
+pattern (as used by path.Match, for instance "release-*"). If any patterns are
+given, only the tags matching at least one of them are listed.
 
 Gives the full list of tags in an OCI image, with each tag name on a single
-line. See umoci-stat(1) to get more information about each tagged image.`,
+line. With --long (or --json), the digest, platforms, total (compressed) size
+and creation date of each tagged image are listed as well. See umoci-stat(1)
+to get more information about each tagged image.`,
 
 	// tag modifies an image layout.
 	Category: "layout",
 
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "long, l",
+			Usage: "list the digest, platforms, size and creation date of each tag",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the list of tags (like --long) as a JSON encoded blob",
+		},
+	},
+
 	Action: tagList,
+
+	Before: func(ctx *cli.Context) error {
+		for _, pattern := range ctx.Args() {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "invalid pattern %q", pattern)
+			}
+		}
+		return nil
+	},
+}
+
+// tagSummary is the summary of a tag listed by "umoci ls --long".
+type tagSummary struct {
+	// Name is the name of the tag.
+	Name string `json:"name"`
+
+	// Descriptor is the descriptor the tag refers to.
+	Descriptor ispec.Descriptor `json:"descriptor"`
+
+	// Platforms are the platforms (of the form os[(version)]/arch[/variant])
+	// of the images the tag refers to.
+	Platforms []string `json:"platforms"`
+
+	// Size is the total size of the blobs reachable from the tag, with each
+	// blob only being counted once.
+	Size int64 `json:"size"`
+
+	// Created is the latest creation date of the images the tag refers to.
+	Created *time.Time `json:"created,omitempty"`
+}
+
+// summarizeTag returns the summary of the given tag.
+func summarizeTag(ctx context.Context, engine casext.Engine, name string) (tagSummary, error) {
+	summary := tagSummary{Name: name, Platforms: []string{}}
+
+	descriptor, err := engine.GetReference(ctx, name)
+	if err != nil {
+		return summary, errors.Wrap(err, "get reference")
+	}
+	summary.Descriptor = descriptor
+
+	addSize := func(path []ispec.Descriptor, blob *casext.Blob) error {
+		summary.Size += path[len(path)-1].Size
+		return nil
+	}
+	err = engine.Visit(ctx, descriptor, casext.Visitor{
+		MediaTypes: map[string]casext.VisitFunc{
+			ispec.MediaTypeImageConfig: func(path []ispec.Descriptor, blob *casext.Blob) error {
+				config, ok := blob.Data.(ispec.Image)
+				if !ok {
+					// Should _never_ be reached.
+					return errors.Errorf("[internal error] unknown config blob type: %s", blob.MediaType)
+				}
+				configPlatform, err := casext.ConfigPlatform(blob)
+				if err != nil {
+					return errors.Wrap(err, "get platform")
+				}
+				platform := formatPlatform(configPlatform)
+				found := false
+				for _, other := range summary.Platforms {
+					found = found || other == platform
+				}
+				if !found {
+					summary.Platforms = append(summary.Platforms, platform)
+				}
+				if !config.Created.IsZero() && (summary.Created == nil || config.Created.After(*summary.Created)) {
+					created := config.Created
+					summary.Created = &created
+				}
+				return addSize(path, blob)
+			},
+		},
+		Default: addSize,
+	})
+	return summary, errors.Wrap(err, "walk image")
 }
 
 func tagList(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := openReadOnlyImage(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
+	engineExt := casext.Engine{engine}
 	defer engine.Close()
 
-	names, err := engine.ListReferences(context.Background())
+	allNames, err := engine.ListReferences(context.Background())
 	if err != nil {
 		return errors.Wrap(err, "list references")
 	}
 
+	var names []string
+	for _, name := range allNames {
+		matched := ctx.NArg() == 0
+		for _, pattern := range ctx.Args() {
+			// The patterns were validated in Before.
+			if ok, _ := path.Match(pattern, name); ok {
+				matched = true
+			}
+		}
+		if matched {
+			names = append(names, name)
+		}
+	}
+
+	if !ctx.Bool("long") && !ctx.Bool("json") {
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	}
+
+	summaries := []tagSummary{}
 	for _, name := range names {
-		fmt.Println(name)
+		summary, err := summarizeTag(context.Background(), engineExt, name)
+		if err != nil {
+			return errors.Wrapf(err, "summarize tag %s", name)
+		}
+		summaries = append(summaries, summary)
 	}
-	return nil
+
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(summaries); err != nil {
+			return errors.Wrap(err, "encoding tags")
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "NAME\tDIGEST\tPLATFORM\tSIZE\tCREATED\n")
+	for _, summary := range summaries {
+		created := "<none>"
+		if summary.Created != nil {
+			created = summary.Created.Format(time.RFC3339)
+		}
+		platforms := "<none>"
+		if len(summary.Platforms) > 0 {
+			platforms = strings.Join(summary.Platforms, ",")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", summary.Name, summary.Descriptor.Digest, platforms, units.HumanSize(float64(summary.Size)), created)
+	}
+	return tw.Flush()
 }
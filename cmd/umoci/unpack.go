@@ -18,36 +18,55 @@
 package main
 
 import (
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/apex/log"
-	"github.com/openSUSE/umoci"
-	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/klauspost/compress/zstd"
 	"github.com/openSUSE/umoci/oci/casext"
+	iconv "github.com/openSUSE/umoci/oci/config/convert"
 	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/fseval"
 	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/openSUSE/umoci/pkg/userns"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"github.com/vbatts/go-mtree"
 	"golang.org/x/net/context"
 )
 
-var unpackCommand = cli.Command{
+var unpackCommand = uxXattrPolicy(uxPlatform(cli.Command{
 	Name:  "unpack",
 	Usage: "unpacks a reference into an OCI runtime bundle",
-	ArgsUsage: `--image <image-path>[:<tag>] <bundle>
+	ArgsUsage: `--image <image-path>[:<tag>] [--to-tar <path>] <bundle>
 
 Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
 tagged image to unpack (if not specified, defaults to "latest") and "<bundle>"
-is the destination to unpack the image to.
+is the destination to unpack the image to. With --format=cpio, "<bundle>" is
+instead the path of the cpio archive to create (or "-" for stdout). With
+--format=squashfs or --format=erofs, "<bundle>" is instead the path of the
+read-only filesystem image to create, using mksquashfs(1) or mkfs.erofs(1)
+respectively. With --to-tar, the root filesystem is instead written as a single flattened tar
+archive to "<path>" (or stdout if "<path>" is "-"), and "<bundle>" must not be
+specified.
 
 It should be noted that this is not the same as oci-create-runtime-bundle,
 because this command also will create an mtree specification to allow for layer
-creation with umoci-repack(1).`,
+creation with umoci-repack(1).
+
+If an unpack is interrupted, the layers which have been completely extracted
+are recorded in "<bundle>", and --resume can be used to continue the unpack
+from the last such layer (the same image and options must be used).`,
 
 	// unpack reads manifest information.
 	Category: "image",
@@ -65,20 +84,257 @@ creation with umoci-repack(1).`,
 			Name:  "rootless",
 			Usage: "enable rootless unpacking support",
 		},
+		cli.BoolFlag{
+			Name:  "userns",
+			Usage: "unpack inside a user namespace set up with newuidmap(1) and newgidmap(1), preserving ownership",
+		},
+		cli.StringSliceFlag{
+			Name:  "uname-map",
+			Usage: "specifies the uid to use for layer entries owned only by the given user name (of the form name:uid)",
+		},
+		cli.StringSliceFlag{
+			Name:  "gname-map",
+			Usage: "specifies the gid to use for layer entries owned only by the given group name (of the form name:gid)",
+		},
+		cli.StringFlag{
+			Name:  "owner-names",
+			Usage: "resolve the owner of layer entries by name using the image /etc/passwd and /etc/group (\"image\") or a JSON mapping file",
+		},
+		cli.StringFlag{
+			Name:  "fallback-owner",
+			Usage: "specifies the owner to use for layer entries with out-of-range ids (of the form uid:gid)",
+		},
+		cli.BoolFlag{
+			Name:  "runtime-stubs",
+			Usage: "create stubs for runtime-managed files and mount-points in the rootfs",
+		},
+		cli.BoolFlag{
+			Name:  "compress-mtree",
+			Usage: "store the mtree manifest of the bundle zstd-compressed",
+		},
+		cli.StringSliceFlag{
+			Name:  "mtree-keyword",
+			Usage: "add a keyword to (or with a \"-\" prefix, remove a keyword from) the mtree keywords recorded for the bundle",
+		},
+		cli.StringFlag{
+			Name:  "state-format",
+			Usage: "format of the recorded state of the bundle ([mtree] or json)",
+			Value: "mtree",
+		},
+		cli.StringFlag{
+			Name:  "mode",
+			Usage: "how layers are extracted ([flat] or overlay)",
+			Value: "flat",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "what to unpack the image into ([bundle], cpio, squashfs or erofs)",
+			Value: "bundle",
+		},
+		cli.StringFlag{
+			Name:  "to-tar",
+			Usage: "write the flattened root filesystem as a tar archive to the given path (or \"-\" for stdout)",
+		},
+		cli.StringFlag{
+			Name:  "compress",
+			Usage: "compression of the archive with --format=cpio or --to-tar ([none], gzip or zstd)",
+			Value: "none",
+		},
+		cli.StringSliceFlag{
+			Name:  "include",
+			Usage: "only unpack the given path (and everything inside it) from the image",
+		},
+		cli.BoolFlag{
+			Name:  "verify-layers",
+			Usage: "verify every layer against the image configuration before extracting anything",
+		},
+		cli.IntFlag{
+			Name:  "verify-jobs",
+			Usage: "number of layers to verify in parallel with --verify-layers (0 uses the number of CPUs)",
+		},
+		cli.StringSliceFlag{
+			Name:  "decryption-key",
+			Usage: "private key used to decrypt encrypted layers",
+		},
+		cli.StringSliceFlag{
+			Name:  "decryption-cert",
+			Usage: "certificate of a --decryption-key (for PKCS#7 wrapped layer keys)",
+		},
+		cli.StringFlag{
+			Name:  "selinux-label",
+			Usage: "apply the given SELinux label to every path in the rootfs",
+		},
+		cli.BoolFlag{
+			Name:  "no-sparse",
+			Usage: "fill holes in sparse files with zeroes rather than recreating them",
+		},
+		cli.BoolFlag{
+			Name:  "insecure-extraction",
+			Usage: "do not verify that every path is inside the rootfs before it is written (only for trusted images)",
+		},
+		cli.StringFlag{
+			Name:  "hardlink-mode",
+			Usage: "how hardlinks to paths in lower layers are extracted ([follow], copy or reject)",
+			Value: "follow",
+		},
+		cli.StringFlag{
+			Name:  "foreign-layers",
+			Usage: "how non-distributable layers missing from the image are handled ([error], skip or fetch)",
+			Value: "error",
+		},
+		cli.StringFlag{
+			Name:  "runtime-profile",
+			Usage: "profile used to generate the runtime configuration ([default], minimal, systemd or rootless-podman)",
+			Value: "default",
+		},
+		cli.StringSliceFlag{
+			Name:  "runtime-hook",
+			Usage: "add a hook to the runtime configuration (of the form stage=path[,arg...])",
+		},
+		cli.StringFlag{
+			Name:  "runtime-seccomp",
+			Usage: "path to a JSON seccomp configuration to use in the runtime configuration (or \"unconfined\")",
+		},
+		cli.StringSliceFlag{
+			Name:  "runtime-mount",
+			Usage: "add a bind mount to the runtime configuration (of the form source:destination[:option,...])",
+		},
+		cli.BoolFlag{
+			Name:  "resume",
+			Usage: "continue an interrupted unpack into <bundle> from the last completely extracted layer",
+		},
 	},
 
 	Action: unpack,
 
 	Before: func(ctx *cli.Context) error {
-		if ctx.NArg() != 1 {
-			return errors.Errorf("invalid number of positional arguments: expected <bundle>")
+		if ctx.IsSet("to-tar") {
+			if ctx.NArg() != 0 {
+				return errors.Errorf("invalid number of positional arguments: <bundle> is not supported with --to-tar")
+			}
+			if ctx.String("to-tar") == "" {
+				return errors.Errorf("--to-tar path cannot be empty")
+			}
+			// As with --format=cpio, the archive takes the place of the bundle.
+			ctx.App.Metadata["bundle"] = ctx.String("to-tar")
+		} else {
+			if ctx.NArg() != 1 {
+				return errors.Errorf("invalid number of positional arguments: expected <bundle>")
+			}
+			if ctx.Args().First() == "" {
+				return errors.Errorf("bundle path cannot be empty")
+			}
+			ctx.App.Metadata["bundle"] = ctx.Args().First()
+		}
+		switch ctx.String("mode") {
+		case "flat", "overlay":
+		default:
+			return errors.Errorf("invalid --mode: unknown mode %q", ctx.String("mode"))
+		}
+		if ctx.Bool("userns") {
+			if ctx.Bool("rootless") {
+				return errors.Errorf("--userns and --rootless are mutually exclusive")
+			}
+			if ctx.String("mode") != "flat" {
+				return errors.Errorf("--userns is only supported with --mode=flat")
+			}
+		}
+		if ctx.Bool("runtime-stubs") && ctx.String("mode") != "flat" {
+			return errors.Errorf("--runtime-stubs is only supported with --mode=flat")
+		}
+		if err := layer.HardlinkMode(ctx.String("hardlink-mode")).Validate(); err != nil {
+			return errors.Wrap(err, "invalid --hardlink-mode")
+		}
+		if err := layer.ForeignLayerPolicy(ctx.String("foreign-layers")).Validate(); err != nil {
+			return errors.Wrap(err, "invalid --foreign-layers")
 		}
-		if ctx.Args().First() == "" {
-			return errors.Errorf("bundle path cannot be empty")
+		if err := iconv.RuntimeProfile(ctx.String("runtime-profile")).Validate(); err != nil {
+			return errors.Wrap(err, "invalid --runtime-profile")
+		}
+		if ctx.Int("verify-jobs") < 0 {
+			return errors.Errorf("invalid --verify-jobs: must not be negative")
+		}
+		if ctx.IsSet("verify-jobs") && !ctx.Bool("verify-layers") {
+			return errors.Errorf("--verify-jobs is only supported with --verify-layers")
+		}
+		for _, path := range ctx.StringSlice("include") {
+			if path == "" {
+				return errors.Errorf("invalid --include: path cannot be empty")
+			}
+		}
+		keywords, err := parseMtreeKeywords(ctx.StringSlice("mtree-keyword"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --mtree-keyword")
+		}
+		ctx.App.Metadata["--mtree-keywords"] = keywords
+		if ctx.IsSet("owner-names") && ctx.String("owner-names") == "" {
+			return errors.Errorf("--owner-names cannot be empty")
+		}
+		switch ctx.String("state-format") {
+		case "mtree":
+		case "json":
+			if ctx.Bool("compress-mtree") {
+				return errors.Errorf("--compress-mtree is only supported with --state-format=mtree")
+			}
+		default:
+			return errors.Errorf("invalid --state-format: unknown format %q", ctx.String("state-format"))
+		}
+		if ctx.IsSet("to-tar") {
+			// A flattened tar archive contains the image ownership as-is, and
+			// is not a bundle.
+			for _, flag := range append([]string{"format"}, archiveIncompatibleFlags...) {
+				if ctx.IsSet(flag) {
+					return errors.Errorf("--%s is not supported with --to-tar", flag)
+				}
+			}
+			return validateCompress(ctx.String("compress"))
+		}
+		switch ctx.String("format") {
+		case "bundle":
+			if ctx.IsSet("compress") {
+				return errors.Errorf("--compress is only supported with --format=cpio or --to-tar")
+			}
+		case "cpio":
+			// A cpio archive contains the image ownership as-is, and is not
+			// a bundle.
+			for _, flag := range archiveIncompatibleFlags {
+				if ctx.IsSet(flag) {
+					return errors.Errorf("--%s is not supported with --format=cpio", flag)
+				}
+			}
+			if err := validateCompress(ctx.String("compress")); err != nil {
+				return err
+			}
+		case "squashfs", "erofs":
+			// As with cpio archives, filesystem images contain the image
+			// ownership as-is. They are compressed by the filesystem itself.
+			format := ctx.String("format")
+			for _, flag := range append([]string{"compress"}, archiveIncompatibleFlags...) {
+				if ctx.IsSet(flag) {
+					return errors.Errorf("--%s is not supported with --format=%s", flag, format)
+				}
+			}
+			if ctx.App.Metadata["bundle"].(string) == "-" {
+				return errors.Errorf("--format=%s cannot be written to stdout", format)
+			}
+		default:
+			return errors.Errorf("invalid --format: unknown format %q", ctx.String("format"))
 		}
-		ctx.App.Metadata["bundle"] = ctx.Args().First()
 		return nil
 	},
+}))
+
+// archiveIncompatibleFlags are the flags of umoci-unpack(1) which only apply
+// to bundles, and so cannot be used with --format=cpio or --to-tar.
+var archiveIncompatibleFlags = []string{"mode", "uid-map", "gid-map", "rootless", "userns", "uname-map", "gname-map", "owner-names", "fallback-owner", "runtime-stubs", "compress-mtree", "mtree-keyword", "state-format", "verify-layers", "verify-jobs", "include", "decryption-key", "decryption-cert", "xattr-policy", "selinux-label", "hardlink-mode", "insecure-extraction", "foreign-layers", "no-sparse", "runtime-profile", "runtime-hook", "runtime-seccomp", "runtime-mount", "resume"}
+
+// validateCompress returns an error if the given --compress value is unknown.
+func validateCompress(compress string) error {
+	switch compress {
+	case "none", "gzip", "zstd":
+		return nil
+	}
+	return errors.Errorf("invalid --compress: unknown compression %q", compress)
 }
 
 func unpack(ctx *cli.Context) error {
@@ -88,6 +344,13 @@ func unpack(ctx *cli.Context) error {
 
 	var meta UmociMeta
 	meta.Version = ctx.App.Version
+	if mode := ctx.String("mode"); mode != "flat" {
+		meta.Mode = mode
+	}
+	meta.Includes = ctx.StringSlice("include")
+	if val, ok := ctx.App.Metadata["--xattr-policy"]; ok {
+		meta.XattrPolicies = val.(layer.XattrPolicies)
+	}
 
 	// Parse map options.
 	// We need to set mappings if we're in rootless mode.
@@ -115,14 +378,69 @@ func unpack(ctx *cli.Context) error {
 		}
 		meta.MapOptions.GIDMappings = append(meta.MapOptions.GIDMappings, idMap)
 	}
+	meta.MapOptions.UserNamespace = ctx.Bool("userns")
+	if meta.MapOptions.UserNamespace {
+		if err := setupUserNamespace(&meta.MapOptions); err != nil {
+			return errors.Wrap(err, "set up --userns mappings")
+		}
+	}
+
+	// Parse the options for layer entries with uncommon ownership.
+	if names := ctx.StringSlice("uname-map"); len(names) > 0 {
+		meta.MapOptions.UserNames = map[string]int{}
+		for _, spec := range names {
+			name, id, err := parseNameMapping(spec)
+			if err != nil {
+				return errors.Wrapf(err, "failure parsing --uname-map %s", spec)
+			}
+			meta.MapOptions.UserNames[name] = id
+		}
+	}
+	if names := ctx.StringSlice("gname-map"); len(names) > 0 {
+		meta.MapOptions.GroupNames = map[string]int{}
+		for _, spec := range names {
+			name, id, err := parseNameMapping(spec)
+			if err != nil {
+				return errors.Wrapf(err, "failure parsing --gname-map %s", spec)
+			}
+			meta.MapOptions.GroupNames[name] = id
+		}
+	}
+	if ctx.IsSet("fallback-owner") {
+		owner := strings.Split(ctx.String("fallback-owner"), ":")
+		if len(owner) != 2 {
+			return errors.Errorf("invalid --fallback-owner %s: must be of the form uid:gid", ctx.String("fallback-owner"))
+		}
+		uid, err := strconv.Atoi(owner[0])
+		if err != nil || uid < 0 {
+			return errors.Errorf("invalid --fallback-owner %s: invalid uid", ctx.String("fallback-owner"))
+		}
+		gid, err := strconv.Atoi(owner[1])
+		if err != nil || gid < 0 {
+			return errors.Errorf("invalid --fallback-owner %s: invalid gid", ctx.String("fallback-owner"))
+		}
+		meta.MapOptions.FallbackUID = &uid
+		meta.MapOptions.FallbackGID = &gid
+	}
 
 	log.WithFields(log.Fields{
 		"map.uid": meta.MapOptions.UIDMappings,
 		"map.gid": meta.MapOptions.GIDMappings,
 	}).Debugf("parsed mappings")
 
+	runtimeOptions, err := parseRuntimeOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	// With --userns, the unpacking is done by a copy of umoci running inside
+	// a user namespace with the mappings.
+	if meta.MapOptions.UserNamespace && !userns.Enabled() {
+		return runInUserNamespace(meta.MapOptions)
+	}
+
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := openReadOnlyImage(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -133,6 +451,10 @@ func unpack(ctx *cli.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "get descriptor")
 	}
+	fromDescriptor, err = engineExt.ResolveManifest(context.Background(), fromDescriptor, requestedPlatform(ctx))
+	if err != nil {
+		return errors.Wrap(err, "select manifest")
+	}
 	meta.From = fromDescriptor
 
 	manifestBlob, err := engineExt.FromDescriptor(context.Background(), meta.From)
@@ -141,13 +463,27 @@ func unpack(ctx *cli.Context) error {
 	}
 	defer manifestBlob.Close()
 
-	// FIXME: Implement support for manifest lists.
 	if manifestBlob.MediaType != ispec.MediaTypeImageManifest {
 		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", meta.From.MediaType), "invalid --image tag")
 	}
 
-	mtreeName := strings.Replace(meta.From.Digest.String(), "sha256:", "sha256_", 1)
-	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
+	// Windows images can be inspected and modified, but not unpacked. Check
+	// before verifying the layers, which might not even be present.
+	platform, err := engineExt.ManifestPlatform(context.Background(), meta.From)
+	if err != nil {
+		return errors.Wrap(err, "get image platform")
+	}
+	if err := layer.CheckPlatform(platform); err != nil {
+		return errors.Wrap(err, "unpack image")
+	}
+
+	keywords := ctx.App.Metadata["--mtree-keywords"].([]mtree.Keyword)
+	mtreePath := bundleMtreePath(bundlePath, meta.From)
+	if ctx.String("state-format") == "json" {
+		mtreePath = bundleStatePath(bundlePath, meta.From)
+	} else if ctx.Bool("compress-mtree") {
+		mtreePath += compressedMtreeSuffix
+	}
 	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
 
 	log.WithFields(log.Fields{
@@ -164,33 +500,132 @@ func unpack(ctx *cli.Context) error {
 		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
 	}
 
+	if len(manifest.Layers) == 0 {
+		log.Infof("image has no layers: the root filesystem will be empty")
+	}
+
+	// Encrypted layers are decrypted with the keys wrapped in the annotations
+	// of their descriptors.
+	decryption, err := readDecryptConfig(ctx.StringSlice("decryption-key"), ctx.StringSlice("decryption-cert"))
+	if err != nil {
+		return errors.Wrap(err, "read decryption keys")
+	}
+	layerAnnotations, err := casext.ManifestLayerAnnotations(manifestBlob.Raw)
+	if err != nil {
+		return errors.Wrap(err, "get layer annotations")
+	}
+
+	// Names given with --uname-map and --gname-map take precedence over
+	// those given with --owner-names.
+	if source := ctx.String("owner-names"); source != "" {
+		names, err := readOwnerNames(source, func() (layer.OwnerNames, error) {
+			return layer.ReadImageOwnerNames(context.Background(), engineExt, manifest)
+		})
+		if err != nil {
+			return errors.Wrap(err, "read --owner-names")
+		}
+		meta.MapOptions.UserNames = mergeNames(names.Users, meta.MapOptions.UserNames)
+		meta.MapOptions.GroupNames = mergeNames(names.Groups, meta.MapOptions.GroupNames)
+		meta.MapOptions.PreferNames = true
+	}
+
+	if ctx.IsSet("to-tar") {
+		return unpackArchive(engineExt, manifest, bundlePath, "tar", ctx.String("compress"))
+	}
+	switch format := ctx.String("format"); format {
+	case "cpio":
+		return unpackArchive(engineExt, manifest, bundlePath, "cpio", ctx.String("compress"))
+	case "squashfs", "erofs":
+		return unpackFilesystemImage(engineExt, manifest, bundlePath, format)
+	}
+
 	// Unpack the runtime bundle.
 	if err := os.MkdirAll(bundlePath, 0755); err != nil {
 		return errors.Wrap(err, "create bundle path")
 	}
 	// XXX: We should probably defer os.RemoveAll(bundlePath).
 
+	// The DiffID of every layer is verified while it is extracted, but by
+	// then the earlier layers are already in the rootfs. --verify-layers
+	// checks all of the layers up-front (at the cost of reading them twice).
+	if ctx.Bool("verify-layers") {
+		log.Info("verifying layers ...")
+		if err := layer.VerifyDiffIDsWithOptions(context.Background(), engineExt, manifest, layer.VerifyOptions{
+			Jobs:             ctx.Int("verify-jobs"),
+			ForeignLayers:    layer.ForeignLayerPolicy(ctx.String("foreign-layers")),
+			Decryption:       decryption,
+			LayerAnnotations: layerAnnotations,
+		}); err != nil {
+			return errors.Wrap(err, "verify layers")
+		}
+		log.Info("... done")
+	}
+
+	var dropped layer.DroppedXattrs
+	if meta.MapOptions.Rootless {
+		dropped = layer.DroppedXattrs{}
+	}
+
+	extractionMode := layer.SecureExtraction
+	if ctx.Bool("insecure-extraction") {
+		log.Warn("not verifying that the paths of the image are inside the rootfs (--insecure-extraction)")
+		extractionMode = layer.InsecureExtraction
+	}
+
 	// FIXME: Currently we only support OCI layouts, not tar archives. This
 	//        should be fixed once the CAS engine PR is merged into
 	//        image-tools. https://github.com/opencontainers/image-tools/pull/5
 	log.Info("unpacking bundle ...")
-	if err := layer.UnpackManifest(context.Background(), engineExt, bundlePath, manifest, &meta.MapOptions); err != nil {
+	if err := layer.UnpackManifestWithOptions(context.Background(), engineExt, bundlePath, manifest, layer.UnpackOptions{
+		MapOptions:       meta.MapOptions,
+		Overlay:          meta.Mode == "overlay",
+		PathFilters:      meta.Includes,
+		XattrPolicies:    meta.XattrPolicies,
+		SELinuxLabel:     ctx.String("selinux-label"),
+		HardlinkMode:     layer.HardlinkMode(ctx.String("hardlink-mode")),
+		NoSparse:         ctx.Bool("no-sparse"),
+		ForeignLayers:    layer.ForeignLayerPolicy(ctx.String("foreign-layers")),
+		DroppedXattrs:    dropped,
+		Decryption:       decryption,
+		LayerAnnotations: layerAnnotations,
+		Resume:           ctx.Bool("resume"),
+
+		ExtractionMode: extractionMode,
+		RuntimeOptions: runtimeOptions,
+	}); err != nil {
 		return errors.Wrap(err, "create runtime bundle")
 	}
 	log.Info("... done")
 
+	if len(dropped) > 0 {
+		log.Warnf("rootless unpack could not set xattrs on %d paths: they will be restored by umoci-repack", len(dropped))
+		meta.DroppedXattrs = dropped
+	}
+
+	if meta.Mode == "overlay" {
+		// There is no single rootfs to generate an mtree manifest for, so
+		// the bundle cannot be repacked.
+		if err := WriteBundleMeta(bundlePath, meta); err != nil {
+			return errors.Wrap(err, "write umoci.json metadata")
+		}
+		log.Infof("unpacked image bundle (overlay): %s", bundlePath)
+		return nil
+	}
+
+	meta.MtreeKeywords = keywords
+
 	log.WithFields(log.Fields{
-		"keywords": MtreeKeywords,
+		"keywords": keywords,
 		"mtree":    mtreePath,
 	}).Debugf("umoci: generating mtree manifest")
 
-	fsEval := umoci.DefaultFsEval
+	fsEval := fseval.DefaultFsEval
 	if meta.MapOptions.Rootless {
-		fsEval = umoci.RootlessFsEval
+		fsEval = fseval.RootlessFsEval
 	}
 
 	log.Info("computing filesystem manifest ...")
-	dh, err := mtree.Walk(fullRootfsPath, nil, MtreeKeywords, fsEval)
+	dh, err := mtree.Walk(fullRootfsPath, nil, keywords, fsEval)
 	if err != nil {
 		return errors.Wrap(err, "generate mtree spec")
 	}
@@ -204,9 +639,38 @@ func unpack(ctx *cli.Context) error {
 
 	log.Debugf("umoci: saving mtree manifest")
 
-	if _, err := dh.WriteTo(fh); err != nil {
+	var mtreeWriter io.Writer = fh
+	if ctx.Bool("compress-mtree") {
+		zw, err := zstd.NewWriter(fh)
+		if err != nil {
+			return errors.Wrap(err, "create zstd writer")
+		}
+		defer zw.Close()
+		mtreeWriter = zw
+	}
+	if ctx.String("state-format") == "json" {
+		if _, err := layer.NewState(dh, keywords, meta.MapOptions).WriteTo(mtreeWriter); err != nil {
+			return errors.Wrap(err, "write state")
+		}
+	} else if _, err := dh.WriteTo(mtreeWriter); err != nil {
 		return errors.Wrap(err, "write mtree")
 	}
+	// Make sure everything has been flushed.
+	if zw, ok := mtreeWriter.(*zstd.Encoder); ok {
+		if err := zw.Close(); err != nil {
+			return errors.Wrap(err, "flush compressed mtree")
+		}
+	}
+
+	// The stubs are created after the mtree manifest has been generated, so
+	// that they aren't treated as part of the image.
+	if ctx.Bool("runtime-stubs") {
+		stubs, err := layer.CreateRuntimeStubs(fullRootfsPath, &meta.MapOptions)
+		if err != nil {
+			return errors.Wrap(err, "create runtime stubs")
+		}
+		meta.RuntimeStubs = stubs
+	}
 
 	log.WithFields(log.Fields{
 		"version":     meta.Version,
@@ -221,3 +685,236 @@ func unpack(ctx *cli.Context) error {
 	log.Infof("unpacked image bundle: %s", bundlePath)
 	return nil
 }
+
+// unpackArchive writes the root filesystem of the given manifest to the path
+// (or stdout if the path is "-") as an archive of the given format (either
+// "cpio" or "tar"), with the given compression.
+func unpackArchive(engine casext.Engine, manifest ispec.Manifest, path, format, compress string) (err error) {
+	var output io.Writer = os.Stdout
+	if path != "-" {
+		fh, err := os.OpenFile(path, os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return errors.Wrapf(err, "create %s archive", format)
+		}
+		defer fh.Close()
+		// Don't leave a partial archive behind.
+		defer func() {
+			if err != nil {
+				os.Remove(path)
+			}
+		}()
+		output = fh
+	}
+
+	var closer io.Closer
+	switch compress {
+	case "gzip":
+		gzw := gzip.NewWriter(output)
+		output, closer = gzw, gzw
+	case "zstd":
+		zw, err := zstd.NewWriter(output)
+		if err != nil {
+			return errors.Wrap(err, "create zstd writer")
+		}
+		output, closer = zw, zw
+	}
+
+	unpackFunc := layer.UnpackManifestCpio
+	if format == "tar" {
+		unpackFunc = layer.UnpackToTar
+	}
+
+	log.Infof("unpacking %s archive ...", format)
+	if err := unpackFunc(context.Background(), engine, output, manifest); err != nil {
+		if closer != nil {
+			closer.Close()
+		}
+		return errors.Wrapf(err, "create %s archive", format)
+	}
+	if closer != nil {
+		if err := closer.Close(); err != nil {
+			return errors.Wrapf(err, "flush %s compressed archive", compress)
+		}
+	}
+	log.Info("... done")
+
+	log.Infof("unpacked image %s archive: %s", format, path)
+	return nil
+}
+
+// filesystemImageCommands are the commands used to create the read-only
+// filesystem images supported by --format, which read a flattened tar archive
+// of the root filesystem from stdin and write the image to the path appended
+// to (or, for mksquashfs, inserted into) their arguments.
+var filesystemImageCommands = map[string][]string{
+	// mksquashfs has been able to read tar archives since squashfs-tools 4.6.
+	"squashfs": {"mksquashfs", "-", "", "-tar", "-noappend", "-quiet", "-no-progress"},
+	// mkfs.erofs has been able to read tar archives since erofs-utils 1.7.
+	"erofs": {"mkfs.erofs", "--quiet", "--tar=f", ""},
+}
+
+// unpackFilesystemImage writes the root filesystem of the given manifest to
+// the path as a read-only filesystem image of the given format (either
+// "squashfs" or "erofs"). The layers are flattened into a tar archive which is
+// piped into the tool that creates the image, so the ownership of the files
+// in the image is preserved as-is (without requiring root privileges).
+func unpackFilesystemImage(engine casext.Engine, manifest ispec.Manifest, path, format string) (err error) {
+	// The tools would otherwise happily overwrite an existing file.
+	if _, err := os.Lstat(path); err == nil {
+		return errors.Wrapf(os.ErrExist, "create %s image %s", format, path)
+	} else if !os.IsNotExist(err) {
+		return errors.Wrapf(err, "create %s image", format)
+	}
+
+	args := append([]string{}, filesystemImageCommands[format]...)
+	for idx, arg := range args {
+		if arg == "" {
+			args[idx] = path
+		}
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return errors.Wrapf(err, "--format=%s requires %s", format, args[0])
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return errors.Wrapf(err, "create %s pipe", args[0])
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "start %s", args[0])
+	}
+	// Don't leave a partial image behind.
+	defer func() {
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	closer := cmdCloser{stdin, cmd}
+
+	log.Infof("unpacking %s image ...", format)
+	if err := layer.UnpackToTar(context.Background(), engine, stdin, manifest); err != nil {
+		cmd.Process.Kill()
+		closer.Close()
+		return errors.Wrapf(err, "create %s image", format)
+	}
+	if err := closer.Close(); err != nil {
+		return errors.Wrapf(err, "create %s image: %s", format, args[0])
+	}
+	log.Info("... done")
+
+	log.Infof("unpacked image %s image: %s", format, path)
+	return nil
+}
+
+// cmdCloser closes the stdin of a command, and waits for it to exit.
+type cmdCloser struct {
+	stdin io.Closer
+	cmd   *exec.Cmd
+}
+
+func (c cmdCloser) Close() error {
+	if err := c.stdin.Close(); err != nil {
+		return err
+	}
+	return c.cmd.Wait()
+}
+
+// parseNameMapping parses a --uname-map or --gname-map argument of the form
+// "name:id".
+func parseNameMapping(spec string) (string, int, error) {
+	idx := strings.LastIndex(spec, ":")
+	if idx <= 0 {
+		return "", -1, errors.Errorf("mapping must be of the form name:id")
+	}
+	id, err := strconv.Atoi(spec[idx+1:])
+	if err != nil || id < 0 {
+		return "", -1, errors.Errorf("invalid id in mapping: %s", spec[idx+1:])
+	}
+	return spec[:idx], id, nil
+}
+
+// mergeNames returns the names in base, with the names in overrides taking
+// precedence.
+func mergeNames(base, overrides map[string]int) map[string]int {
+	merged := map[string]int{}
+	for name, id := range base {
+		merged[name] = id
+	}
+	for name, id := range overrides {
+		merged[name] = id
+	}
+	return merged
+}
+
+// parseRuntimeOptions parses the --runtime-* flags.
+func parseRuntimeOptions(ctx *cli.Context) (iconv.RuntimeOptions, error) {
+	opt := iconv.RuntimeOptions{
+		Profile: iconv.RuntimeProfile(ctx.String("runtime-profile")),
+	}
+
+	for _, spec := range ctx.StringSlice("runtime-hook") {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return opt, errors.Errorf("invalid --runtime-hook %s: must be of the form stage=path[,arg...]", spec)
+		}
+		args := strings.Split(parts[1], ",")
+		hook := rspec.Hook{
+			Path: args[0],
+			Args: args,
+		}
+		if !filepath.IsAbs(hook.Path) {
+			return opt, errors.Errorf("invalid --runtime-hook %s: path must be absolute", spec)
+		}
+		switch parts[0] {
+		case "prestart":
+			opt.Hooks.Prestart = append(opt.Hooks.Prestart, hook)
+		case "poststart":
+			opt.Hooks.Poststart = append(opt.Hooks.Poststart, hook)
+		case "poststop":
+			opt.Hooks.Poststop = append(opt.Hooks.Poststop, hook)
+		default:
+			return opt, errors.Errorf("invalid --runtime-hook %s: unknown stage %q", spec, parts[0])
+		}
+	}
+
+	for _, spec := range ctx.StringSlice("runtime-mount") {
+		parts := strings.SplitN(spec, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return opt, errors.Errorf("invalid --runtime-mount %s: must be of the form source:destination[:option,...]", spec)
+		}
+		mount := rspec.Mount{
+			Source:      parts[0],
+			Destination: parts[1],
+			Type:        "bind",
+			Options:     []string{"rbind"},
+		}
+		if len(parts) == 3 {
+			mount.Options = append(mount.Options, strings.Split(parts[2], ",")...)
+		}
+		if !filepath.IsAbs(mount.Destination) {
+			return opt, errors.Errorf("invalid --runtime-mount %s: destination must be absolute", spec)
+		}
+		opt.Mounts = append(opt.Mounts, mount)
+	}
+
+	if ctx.IsSet("runtime-seccomp") {
+		path := ctx.String("runtime-seccomp")
+		if path == "unconfined" {
+			opt.SeccompUnconfined = true
+		} else {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return opt, errors.Wrap(err, "read --runtime-seccomp")
+			}
+			var seccomp rspec.Seccomp
+			if err := json.Unmarshal(data, &seccomp); err != nil {
+				return opt, errors.Wrap(err, "parse --runtime-seccomp")
+			}
+			opt.Seccomp = &seccomp
+		}
+	}
+	return opt, nil
+}
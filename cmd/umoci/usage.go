@@ -0,0 +1,104 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/pkg/stats"
+	"github.com/pkg/errors"
+)
+
+// validateStatsFormat returns an error if the given --stats-format is not
+// supported.
+func validateStatsFormat(format string) error {
+	switch format {
+	case "text", "json":
+		return nil
+	}
+	return errors.Errorf("unknown --stats-format: %s", format)
+}
+
+// printStats prints a summary of the resources used by umoci (see pkg/stats),
+// including the blob cache usage recorded by recorder, to the writer in the
+// given --stats-format.
+func printStats(format string, recorder *stats.Recorder, writer io.Writer) error {
+	usage, err := recorder.Collect()
+	if err != nil {
+		return errors.Wrap(err, "collect stats")
+	}
+
+	if format == "json" {
+		data, err := json.Marshal(usage)
+		if err != nil {
+			return errors.Wrap(err, "encode stats")
+		}
+		_, err = fmt.Fprintf(writer, "%s\n", data)
+		return errors.Wrap(err, "write stats")
+	}
+
+	size := func(n int64) string {
+		if n < 0 {
+			return "unknown"
+		}
+		return units.HumanSize(float64(n))
+	}
+
+	tw := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "wall time:\t%s\n", usage.WallTime)
+	fmt.Fprintf(tw, "cpu time:\t%s (user %s, system %s)\n", usage.CPUTime(), usage.UserTime, usage.SystemTime)
+	fmt.Fprintf(tw, "peak rss:\t%s\n", size(usage.PeakRSS))
+	fmt.Fprintf(tw, "read:\t%s\n", size(usage.ReadBytes))
+	fmt.Fprintf(tw, "written:\t%s\n", size(usage.WrittenBytes))
+	if usage.Cache != nil {
+		fmt.Fprintf(tw, "blob cache:\t%d hits, %d misses (%.1f%% hit rate)\n", usage.Cache.Hits, usage.Cache.Misses, usage.Cache.HitRate*100)
+	}
+	return errors.Wrap(tw.Flush(), "write stats")
+}
+
+// printMetrics prints the metrics collected by the --metrics recorder to the
+// writer, in the given --stats-format.
+func printMetrics(format string, recorder *stats.Recorder, writer io.Writer) error {
+	metrics := recorder.Stats()
+
+	if format == "json" {
+		data, err := json.Marshal(metrics)
+		if err != nil {
+			return errors.Wrap(err, "encode metrics")
+		}
+		_, err = fmt.Fprintf(writer, "%s\n", data)
+		return errors.Wrap(err, "write metrics")
+	}
+
+	tw := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "blobs read:\t%d (%s)\n", metrics.BlobsRead, units.HumanSize(float64(metrics.BytesRead)))
+	fmt.Fprintf(tw, "blobs written:\t%d (%s)\n", metrics.BlobsWritten, units.HumanSize(float64(metrics.BytesWritten)))
+	for _, layer := range metrics.Layers {
+		fmt.Fprintf(tw, "%s layer:\t%s %s -> %s (%.2fx) in %s\n", layer.Op, layer.Digest,
+			units.HumanSize(float64(layer.Size)), units.HumanSize(float64(layer.UncompressedSize)),
+			layer.CompressionRatio(), layer.Duration)
+	}
+	if metrics.Cache != nil {
+		fmt.Fprintf(tw, "blob cache:\t%d hits, %d misses (%.1f%% hit rate)\n", metrics.Cache.Hits, metrics.Cache.Misses, metrics.Cache.HitRate*100)
+	}
+	return errors.Wrap(tw.Flush(), "write metrics")
+}
@@ -0,0 +1,108 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/openSUSE/umoci/pkg/userns"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// subIDMappings returns the mappings of the root user to the given host ID
+// and every other ID to the subordinate IDs allocated to the user with the
+// given UID in the given subuid(5) or subgid(5) file.
+func subIDMappings(path string, uid, rootID int) ([]rspec.IDMapping, error) {
+	// The subid files can refer to users by name or by UID.
+	var name string
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		name = u.Username
+	} else {
+		log.Debugf("userns: cannot find name of uid %d: %v", uid, err)
+	}
+
+	ranges, err := idtools.ReadSubIDs(path, name, uid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", path)
+	}
+	if len(ranges) == 0 {
+		return nil, errors.Errorf("no subordinate ids allocated to uid %d in %s", uid, path)
+	}
+	return idtools.SubIDMappings(rootID, ranges), nil
+}
+
+// setupUserNamespace fills in the mappings of the given options for
+// --userns. Inside the user namespace the mappings are those of the
+// namespace, otherwise (if they weren't explicitly specified) they are
+// generated from the subordinate ids of the current user.
+func setupUserNamespace(opt *layer.MapOptions) error {
+	if userns.Enabled() {
+		uidMappings, gidMappings, err := userns.Mappings()
+		if err != nil {
+			return errors.Wrap(err, "get user namespace mappings")
+		}
+		opt.UIDMappings = uidMappings
+		opt.GIDMappings = gidMappings
+		return nil
+	}
+
+	if len(opt.UIDMappings) == 0 {
+		uidMappings, err := subIDMappings("/etc/subuid", os.Geteuid(), os.Geteuid())
+		if err != nil {
+			return errors.Wrap(err, "generate uid mappings")
+		}
+		opt.UIDMappings = uidMappings
+	}
+	if len(opt.GIDMappings) == 0 {
+		gidMappings, err := subIDMappings("/etc/subgid", os.Geteuid(), os.Getegid())
+		if err != nil {
+			return errors.Wrap(err, "generate gid mappings")
+		}
+		opt.GIDMappings = gidMappings
+	}
+	return nil
+}
+
+// runInUserNamespace re-executes umoci inside a new user namespace with the
+// given mappings (using newuidmap(1) and newgidmap(1)), where the command is
+// actually run. If the re-executed umoci fails, it has already reported the
+// error and so we just exit with the same status.
+func runInUserNamespace(opt layer.MapOptions) error {
+	log.WithFields(log.Fields{
+		"map.uid": opt.UIDMappings,
+		"map.gid": opt.GIDMappings,
+	}).Debugf("umoci: re-executing in user namespace")
+
+	err := userns.Run(opt.UIDMappings, opt.GIDMappings)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status, ok := exitErr.Sys().(syscall.WaitStatus)
+		if !ok || status.ExitStatus() <= 0 {
+			os.Exit(1)
+		}
+		os.Exit(status.ExitStatus())
+	}
+	return errors.Wrap(err, "run in user namespace")
+}
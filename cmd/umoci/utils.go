@@ -18,21 +18,33 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"text/tabwriter"
+	"time"
 
+	"github.com/apex/log"
 	"github.com/docker/go-units"
+	"github.com/klauspost/compress/zstd"
+	"github.com/openSUSE/umoci/mutate/index"
+	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/vulnscan"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"github.com/urfave/cli"
 	"github.com/vbatts/go-mtree"
 	"golang.org/x/net/context"
 )
@@ -59,6 +71,175 @@ var MtreeKeywords = []mtree.Keyword{
 	"xattr",
 }
 
+// parseMtreeKeywords returns the set of mtree keywords to use for a bundle,
+// after applying the given --mtree-keyword changes to MtreeKeywords. Each
+// change is either a keyword to add (optionally prefixed with "+"), or a
+// keyword prefixed with "-" to remove. Since umoci records modification times
+// with "tar_time", removing "time" also removes "tar_time".
+func parseMtreeKeywords(changes []string) ([]mtree.Keyword, error) {
+	keywords := append([]mtree.Keyword{}, MtreeKeywords...)
+	for _, change := range changes {
+		remove := strings.HasPrefix(change, "-")
+		name := strings.TrimPrefix(strings.TrimPrefix(change, "-"), "+")
+		keyword := mtree.KeywordSynonym(name)
+		if _, ok := mtree.KeywordFuncs[keyword]; !ok || name == "" {
+			return nil, errors.Errorf("unknown keyword %q", name)
+		}
+
+		if !remove {
+			if !mtree.InKeywordSlice(keyword, keywords) {
+				keywords = append(keywords, keyword)
+			}
+			continue
+		}
+
+		// The type of each inode is needed to generate layers.
+		if keyword == "type" {
+			return nil, errors.Errorf("keyword %q cannot be removed", name)
+		}
+		removed := []mtree.Keyword{keyword}
+		if keyword == "time" {
+			removed = append(removed, "tar_time")
+		}
+		var filtered []mtree.Keyword
+		for _, kw := range keywords {
+			if !mtree.InKeywordSlice(kw, removed) {
+				filtered = append(filtered, kw)
+			}
+		}
+		keywords = filtered
+	}
+	return keywords, nil
+}
+
+// compressedMtreeSuffix is the suffix of the path of a compressed mtree
+// manifest (see umoci-unpack --compress-mtree), relative to the path of the
+// uncompressed manifest.
+const compressedMtreeSuffix = ".zst"
+
+// bundleMtreePath returns the path of the (uncompressed) mtree manifest of the given
+// base image within a bundle. If the manifest was compressed, it is stored at
+// the same path with a compressedMtreeSuffix suffix.
+func bundleMtreePath(bundle string, from ispec.Descriptor) string {
+	mtreeName := strings.Replace(from.Digest.String(), "sha256:", "sha256_", 1)
+	return filepath.Join(bundle, mtreeName+".mtree")
+}
+
+// zstdReadCloser is a zstd.Decoder which also closes the underlying file.
+type zstdReadCloser struct {
+	*zstd.Decoder
+	fh *os.File
+}
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return r.fh.Close()
+}
+
+// openMtree opens the mtree manifest of the given base image within a
+// bundle, transparently decompressing it if it was compressed by
+// umoci-unpack(1). The contents are streamed from disk.
+func openMtree(bundle string, from ispec.Descriptor) (io.ReadCloser, error) {
+	path := bundleMtreePath(bundle, from)
+	fh, err := os.Open(path)
+	if err == nil {
+		return fh, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "open mtree")
+	}
+
+	fh, err = os.Open(path + compressedMtreeSuffix)
+	if err != nil {
+		return nil, errors.Wrap(err, "open compressed mtree")
+	}
+	zr, err := zstd.NewReader(fh, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		fh.Close()
+		return nil, errors.Wrap(err, "decompress mtree")
+	}
+	return zstdReadCloser{Decoder: zr, fh: fh}, nil
+}
+
+// bundleStatePath returns the path of the JSON state file (the alternative to
+// the mtree manifest) of the given base image within a bundle.
+func bundleStatePath(bundle string, from ispec.Descriptor) string {
+	stateName := strings.Replace(from.Digest.String(), "sha256:", "sha256_", 1)
+	return filepath.Join(bundle, stateName+".state.json")
+}
+
+// readBundleState reads the recorded state of the rootfs of a bundle, and
+// returns it along with the mtree keywords it was generated with. The format
+// used by the bundle (an mtree manifest or a JSON state file) is detected
+// automatically.
+func readBundleState(bundle string, meta UmociMeta) (*mtree.DirectoryHierarchy, []mtree.Keyword, error) {
+	fh, err := os.Open(bundleStatePath(bundle, meta.From))
+	if err == nil {
+		defer fh.Close()
+		state, err := layer.ReadState(fh)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "read state")
+		}
+		// The ownership in the state depends on whether it was generated
+		// in rootless mode, so it cannot be compared against a rootfs
+		// being repacked in a different mode.
+		if state.MapOptions.Rootless != meta.MapOptions.Rootless {
+			return nil, nil, errors.Errorf("state was generated with rootless=%t but bundle has rootless=%t", state.MapOptions.Rootless, meta.MapOptions.Rootless)
+		}
+		return state.Hierarchy(), state.Keywords, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, nil, errors.Wrap(err, "open state")
+	}
+
+	mfh, err := openMtree(bundle, meta.From)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer mfh.Close()
+
+	spec, err := mtree.ParseSpec(mfh)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parse mtree")
+	}
+	keywords := meta.MtreeKeywords
+	if len(keywords) == 0 {
+		keywords = MtreeKeywords
+	}
+	return spec, keywords, nil
+}
+
+// filterRuntimeStubs removes the runtime stubs created by umoci-unpack(1)
+// (which were never part of the image) from the given set of changes to the
+// rootfs of a bundle.
+func filterRuntimeStubs(diffs []mtree.InodeDelta, runtimeStubs []string) []mtree.InodeDelta {
+	if len(runtimeStubs) == 0 {
+		return diffs
+	}
+	stubs := map[string]struct{}{}
+	for _, stub := range runtimeStubs {
+		stubs[filepath.Join("/", stub)] = struct{}{}
+	}
+	var filtered []mtree.InodeDelta
+	for _, diff := range diffs {
+		if _, ok := stubs[filepath.Join("/", diff.Path())]; ok && diff.Type() == mtree.Extra {
+			continue
+		}
+		filtered = append(filtered, diff)
+	}
+	return filtered
+}
+
+// readOwnerNames returns the owner names given with --owner-names, which is
+// either "image" (in which case they are read with fromImage) or the path of a
+// JSON mapping file (see layer.LoadOwnerNames).
+func readOwnerNames(source string, fromImage func() (layer.OwnerNames, error)) (layer.OwnerNames, error) {
+	if source == "image" {
+		return fromImage()
+	}
+	return layer.LoadOwnerNames(source)
+}
+
 // UmociMetaName is the name of umoci's metadata file that is stored in all
 // bundles extracted by umoci.
 const UmociMetaName = "umoci.json"
@@ -82,6 +263,35 @@ type UmociMeta struct {
 	// umoci-repack(1) calls, changing them is not recommended and so the
 	// default should be that they are the same.
 	MapOptions layer.MapOptions `json:"map_options"`
+
+	// Mode is the --mode argument to umoci-unpack(1). Bundles unpacked in
+	// "overlay" mode cannot be repacked with umoci-repack(1).
+	Mode string `json:"unpack_mode,omitempty"`
+
+	// RuntimeStubs is the set of paths (inside the rootfs) created by
+	// --runtime-stubs in umoci-unpack(1). They are not included in the mtree
+	// manifest, and are ignored by umoci-repack(1) if they still exist.
+	RuntimeStubs []string `json:"runtime_stubs,omitempty"`
+
+	// Includes is the set of --include paths given to umoci-unpack(1). If it
+	// is non-empty, only those paths were unpacked and so the rootfs (and its
+	// mtree manifest) only contains part of the image.
+	Includes []string `json:"includes,omitempty"`
+
+	// MtreeKeywords is the set of mtree keywords (after applying any
+	// --mtree-keyword changes) used for the mtree manifest generated by
+	// umoci-unpack(1). If it is empty, MtreeKeywords was used.
+	MtreeKeywords []mtree.Keyword `json:"mtree_keywords,omitempty"`
+
+	// XattrPolicies is the set of --xattr-policy options given to
+	// umoci-unpack(1). Remapped xattrs are remapped back by umoci-repack(1)
+	// unless it is given a different policy.
+	XattrPolicies layer.XattrPolicies `json:"xattr_policies,omitempty"`
+
+	// DroppedXattrs is the set of xattrs (such as security.capability) which
+	// umoci-unpack(1) could not set in the rootfs because of --rootless. They
+	// are re-added to the corresponding entries by umoci-repack(1).
+	DroppedXattrs layer.DroppedXattrs `json:"dropped_xattrs,omitempty"`
 }
 
 // WriteTo writes a JSON-serialised version of UmociMeta to the given io.Writer.
@@ -117,16 +327,221 @@ func ReadBundleMeta(bundle string) (UmociMeta, error) {
 	return meta, errors.Wrap(err, "decode metadata")
 }
 
-// ManifestStat has information about a given OCI manifest.
+// historyFromContext applies the --history.* values set by uxHistory to the
+// given default history entry, and then expands the placeholders in its
+// CreatedBy. The "date" placeholder is always available, while any others
+// are given by vars.
+func historyFromContext(ctx *cli.Context, history ispec.History, vars map[string]string) (ispec.History, error) {
+	if val, ok := ctx.App.Metadata["--history.author"]; ok {
+		history.Author = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.comment"]; ok {
+		history.Comment = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.created"]; ok {
+		created, err := time.Parse(igen.ISO8601, val.(string))
+		if err != nil {
+			return history, errors.Wrap(err, "parsing --history.created")
+		}
+		history.Created = created
+	}
+	if val, ok := ctx.App.Metadata["--history.created_by"]; ok {
+		history.CreatedBy = val.(string)
+	}
+
+	allVars := map[string]string{
+		"date": history.Created.Format(igen.ISO8601),
+	}
+	for name, value := range vars {
+		allVars[name] = value
+	}
+	history.CreatedBy = expandHistoryTemplate(history.CreatedBy, allVars)
+	return history, nil
+}
+
+// putTag stores the descriptor in the given tag. If the tag already points to
+// a different descriptor, the differences are logged and the tag is only
+// clobbered if force is set or if the tag still points to base (meaning that
+// the caller is updating the image that the tag referred to). base may be
+// nil if the operation was not based on an existing tag.
+func putTag(ctx context.Context, engine cas.Engine, name string, descriptor ispec.Descriptor, base *ispec.Descriptor, force bool) error {
+	err := engine.PutReference(ctx, name, descriptor)
+	if errors.Cause(err) != cas.ErrClobber {
+		return err
+	}
+
+	clobber, ok := err.(*cas.ClobberError)
+	if !ok {
+		// Should _never_ be reached, but we can still get the old descriptor.
+		old, getErr := engine.GetReference(ctx, name)
+		if getErr != nil {
+			return errors.Wrap(getErr, "get clobbered reference")
+		}
+		clobber = &cas.ClobberError{Name: name, Old: old, New: descriptor}
+	}
+
+	// base may have had its media type translated (see casext.ResolveManifest).
+	fastForward := base != nil && reflect.DeepEqual(casext.ConvertDescriptor(clobber.Old), casext.ConvertDescriptor(*base))
+	if !force && !fastForward {
+		log.Errorf("tag %q already exists and would be changed:", name)
+		for _, line := range clobber.Diff() {
+			log.Errorf("  %s", line)
+		}
+		return errors.Wrap(clobber, "refusing to clobber existing tag without --force")
+	}
+
+	// We have to clobber a tag.
+	log.Warnf("clobbering existing tag: %s", name)
+	for _, line := range clobber.Diff() {
+		log.Infof("  %s", line)
+	}
+
+	// Replace the old tag atomically if possible, so that if the tag was
+	// modified after we looked at it (by a concurrent umoci for instance)
+	// we don't silently overwrite it.
+	if updater, ok := engine.(cas.UpdatingEngine); ok {
+		err := updater.UpdateReference(ctx, name, &clobber.Old, descriptor)
+		if errors.Cause(err) != cas.ErrNotImplemented {
+			return errors.Wrap(err, "update tag")
+		}
+	}
+
+	// Delete the old tag.
+	if err := engine.DeleteReference(ctx, name); err != nil {
+		return errors.Wrap(err, "delete old tag")
+	}
+	return engine.PutReference(ctx, name, descriptor)
+}
+
+// putManifestTag stores the manifest descriptor in the given tag, like
+// putTag. However, if the tag currently refers to a manifest list, then the
+// manifest list is updated such that its entry for the given platform refers
+// to the manifest (adding a new entry if necessary), rather than replacing the
+// manifest list with the manifest. If base is the manifest of an entry of the
+// manifest list for the platform (as selected by casext.ResolveManifest), that
+// entry is the one which is updated, so that entries which only differ in
+// their os.version, os.features or variant (such as those for different
+// versions of Windows) are kept apart. As with putTag, updating the manifest
+// list requires force unless the entry that is replaced is base.
+func putManifestTag(ctx context.Context, engine cas.Engine, name string, descriptor ispec.Descriptor, platform ispec.Platform, base *ispec.Descriptor, force bool) error {
+	old, err := engine.GetReference(ctx, name)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return errors.Wrap(err, "get existing reference")
+	}
+	if err != nil || casext.ConvertMediaType(old.MediaType) != ispec.MediaTypeImageManifestList {
+		return putTag(ctx, engine, name, descriptor, base, force)
+	}
+
+	mutator, err := index.New(engine, old)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for manifest list")
+	}
+	entries, err := mutator.Manifests(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get manifests")
+	}
+	if base != nil {
+		// base was resolved with casext.ResolveManifest, so its entry may
+		// only match the platform through a variant fallback.
+		matcher := casext.NewPlatformMatcher(platform)
+		for _, entry := range entries {
+			if _, ok := matcher.Match(entry.Platform); ok && entry.Digest == base.Digest {
+				platform = entry.Platform
+				break
+			}
+		}
+	}
+
+	// Updating the manifest list is only a fast-forward if the entry which
+	// is replaced is the manifest that descriptor is based on (or if there
+	// is no entry for the platform, so the new manifest list contains all of
+	// the old one). Otherwise another image would be dropped from the list.
+	listBase := &old
+	for _, entry := range entries {
+		if casext.PlatformMatches(platform, entry.Platform) {
+			if entry.Digest != descriptor.Digest && (base == nil || entry.Digest != base.Digest) {
+				log.Warnf("manifest list entry for %s refers to %s, which the new manifest is not based on", formatPlatform(entry.Platform), entry.Digest)
+				listBase = nil
+			}
+			break
+		}
+	}
+
+	newList, err := casext.Engine{engine}.UpdateManifestList(ctx, old, descriptor, platform)
+	if err != nil {
+		return errors.Wrap(err, "update manifest list")
+	}
+	log.WithFields(log.Fields{
+		"platform": formatPlatform(platform),
+	}).Infof("updated manifest list: %s", newList.Digest)
+
+	return putTag(ctx, engine, name, newList, listBase, force)
+}
+
+// ManifestStat has information about a given OCI manifest. It is the
+// structure that umoci-stat(1) outputs with --json (and that --format
+// templates are executed against), so the existing fields must not be
+// changed or removed.
 // TODO: Implement support for manifest lists, this should also be able to
 //       contain stat information for a list of manifests.
 type ManifestStat struct {
-	// TODO: Flesh this out. Currently it's only really being used to get an
-	//       equivalent of docker-history(1). We really need to add more
-	//       information about it.
+	// Manifest is the descriptor of the manifest.
+	Manifest ispec.Descriptor `json:"manifest"`
+
+	// Annotations are the annotations of the manifest.
+	Annotations map[string]string `json:"annotations"`
+
+	// Config is the configuration of the image.
+	Config configStat `json:"config"`
+
+	// Layers stores the information about each layer of the manifest, in
+	// order.
+	Layers []layerStat `json:"layers"`
+
+	// Size is the total (compressed) size of the layers.
+	Size int64 `json:"size"`
+
+	// UncompressedSize is the total uncompressed size of the layers. It is nil
+	// if the uncompressed size of any layer is unknown.
+	UncompressedSize *int64 `json:"uncompressed_size"`
 
 	// History stores the history information for the manifest.
 	History []historyStat `json:"history"`
+
+	// Vulnerabilities is the summary of the vulnerabilities in the image, as
+	// imported by umoci-scan-import(1). It is "" if no scan results have
+	// been imported.
+	Vulnerabilities string `json:"vulnerabilities,omitempty"`
+
+	// SizeBreakdown is the breakdown of the size of the image, as computed by
+	// StatSizeBreakdown. It is nil unless umoci-stat(1) --size-breakdown was
+	// used.
+	SizeBreakdown *sizeBreakdown `json:"size_breakdown,omitempty"`
+}
+
+// configStat contains the configuration of an image, along with the
+// descriptor it was loaded from.
+type configStat struct {
+	// Descriptor is the descriptor of the configuration blob.
+	Descriptor ispec.Descriptor `json:"descriptor"`
+
+	// Image is embedded in the stat information.
+	ispec.Image
+}
+
+// layerStat contains information about a single layer of a manifest.
+type layerStat struct {
+	// Descriptor is embedded in the stat information. Its Size is the
+	// compressed size of the layer.
+	ispec.Descriptor
+
+	// DiffID is the DiffID of the layer, or "" if the configuration doesn't
+	// have a corresponding DiffID.
+	DiffID string `json:"diff_id"`
+
+	// UncompressedSize is the size of the uncompressed layer. It is nil if
+	// the size isn't known (such as for encrypted layers).
+	UncompressedSize *int64 `json:"uncompressed_size"`
 }
 
 // Format formats a ManifestStat using the default formatting, and writes the
@@ -137,7 +552,11 @@ type ManifestStat struct {
 func (ms ManifestStat) Format(w io.Writer) error {
 	// Output history information.
 	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
-	fmt.Fprintf(tw, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT\n")
+	if ms.Vulnerabilities != "" {
+		fmt.Fprintf(tw, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT\tVULNERABILITIES\n")
+	} else {
+		fmt.Fprintf(tw, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT\n")
+	}
 	for _, histEntry := range ms.History {
 		var (
 			created   = strings.Replace(histEntry.Created.Format(igen.ISO8601), "\t", " ", -1)
@@ -145,6 +564,7 @@ func (ms ManifestStat) Format(w io.Writer) error {
 			comment   = strings.Replace(histEntry.Comment, "\t", " ", -1)
 			layerID   = "<none>"
 			size      = "<none>"
+			vulns     = "<none>"
 		)
 
 		if !histEntry.EmptyLayer {
@@ -152,11 +572,27 @@ func (ms ManifestStat) Format(w io.Writer) error {
 			size = units.HumanSize(float64(histEntry.Layer.Size))
 		}
 
+		if histEntry.Vulnerabilities != "" {
+			vulns = histEntry.Vulnerabilities
+		}
+
 		// TODO: We need to truncate some of the fields.
 
-		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", layerID, created, createdBy, size, comment)
+		if ms.Vulnerabilities != "" {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", layerID, created, createdBy, size, comment, vulns)
+		} else {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", layerID, created, createdBy, size, comment)
+		}
 	}
 	tw.Flush()
+
+	if ms.Vulnerabilities != "" {
+		fmt.Fprintf(w, "\nVULNERABILITIES: %s\n", ms.Vulnerabilities)
+	}
+	if ms.SizeBreakdown != nil {
+		fmt.Fprintf(w, "\n")
+		ms.SizeBreakdown.format(w)
+	}
 	return nil
 }
 
@@ -174,6 +610,11 @@ type historyStat struct {
 	// is "", then this entry is an empty_layer.
 	DiffID string `json:"diff_id"`
 
+	// Vulnerabilities is the summary of the vulnerabilities introduced by
+	// this layer, as imported by umoci-scan-import(1). It is "" if this
+	// entry is an empty_layer or no scan results have been imported.
+	Vulnerabilities string `json:"vulnerabilities,omitempty"`
+
 	// History is embedded in the stat information.
 	ispec.History
 }
@@ -209,6 +650,25 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 		return stat, errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
 	}
 
+	stat.Manifest = manifestDescriptor
+	stat.Annotations = manifest.Annotations
+	if stat.Annotations == nil {
+		stat.Annotations = map[string]string{}
+	}
+	stat.Config = configStat{
+		Descriptor: manifest.Config,
+		Image:      config,
+	}
+	stat.Layers = []layerStat{}
+	for idx, layerDescriptor := range manifest.Layers {
+		info := layerStat{Descriptor: layerDescriptor}
+		if idx < len(config.RootFS.DiffIDs) {
+			info.DiffID = config.RootFS.DiffIDs[idx]
+		}
+		stat.Layers = append(stat.Layers, info)
+		stat.Size += layerDescriptor.Size
+	}
+
 	// TODO: This should probably be moved into separate functions.
 
 	// Generate the history of the image. Because the config.History entries
@@ -224,15 +684,329 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 		}
 
 		// Only fill the other information and increment layerIdx if it's a
-		// non-empty layer.
+		// non-empty layer. Images without layers (or built by sloppy tools)
+		// can have history entries which claim a layer that doesn't exist.
 		if !histEntry.EmptyLayer {
-			info.DiffID = config.RootFS.DiffIDs[layerIdx]
-			info.Layer = &manifest.Layers[layerIdx]
-			layerIdx++
+			if layerIdx >= len(config.RootFS.DiffIDs) || layerIdx >= len(manifest.Layers) {
+				log.Warnf("history entry %q has no corresponding layer", histEntry.CreatedBy)
+			} else {
+				info.DiffID = config.RootFS.DiffIDs[layerIdx]
+				info.Layer = &manifest.Layers[layerIdx]
+				info.Vulnerabilities = manifest.Annotations[vulnscan.LayerAnnotation(info.DiffID)]
+				layerIdx++
+			}
 		}
 
 		stat.History = append(stat.History, info)
 	}
 
+	stat.Vulnerabilities = manifest.Annotations[vulnscan.AnnotationSummary]
 	return stat, nil
 }
+
+// StatUncompressed fills the uncompressed sizes of the layers in the given
+// ManifestStat. This requires decompressing every layer, which is why it is
+// not done by Stat.
+func StatUncompressed(ctx context.Context, engine casext.Engine, stat *ManifestStat) error {
+	manifest := ispec.Manifest{Annotations: stat.Annotations}
+	for _, info := range stat.Layers {
+		manifest.Layers = append(manifest.Layers, info.Descriptor)
+	}
+	ctx, err := casext.WithManifestLayerChunks(ctx, manifest)
+	if err != nil {
+		return errors.Wrap(err, "get chunked layers")
+	}
+
+	var total int64
+	for idx := range stat.Layers {
+		info := &stat.Layers[idx]
+		reader, err := layer.OpenLayer(ctx, engine, info.Descriptor)
+		if errors.Cause(err) == layer.ErrEncryptedLayer {
+			log.Debugf("stat: cannot compute uncompressed size of encrypted layer %s", info.Digest)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "open layer %s", info.Digest)
+		}
+		size, err := io.Copy(ioutil.Discard, reader)
+		reader.Close()
+		if err != nil {
+			return errors.Wrapf(err, "read layer %s", info.Digest)
+		}
+		info.UncompressedSize = &size
+		total += size
+	}
+
+	stat.UncompressedSize = nil
+	for _, info := range stat.Layers {
+		if info.UncompressedSize == nil {
+			return nil
+		}
+	}
+	stat.UncompressedSize = &total
+	return nil
+}
+
+// sizeBreakdown is the breakdown of the size of an image, showing what makes
+// it large.
+type sizeBreakdown struct {
+	// SharedSize is the total (compressed) size of the layers which are also
+	// used by other tags in the image, and UniqueSize is the total size of the
+	// layers which are only used by this image.
+	SharedSize int64 `json:"shared_size"`
+	UniqueSize int64 `json:"unique_size"`
+
+	// MediaTypes are the number and total size of the blobs of the image
+	// (the manifest, configuration and layers) of each media type, sorted by
+	// media type.
+	MediaTypes []mediaTypeStat `json:"media_types"`
+
+	// Layers stores the breakdown of each layer of the manifest, in order.
+	Layers []layerBreakdown `json:"layers"`
+}
+
+// mediaTypeStat contains the number and total size of the blobs of a media
+// type.
+type mediaTypeStat struct {
+	MediaType string `json:"media_type"`
+	Blobs     int    `json:"blobs"`
+	Size      int64  `json:"size"`
+}
+
+// layerBreakdown contains the breakdown of the size of a single layer.
+type layerBreakdown struct {
+	// Digest is the digest of the layer.
+	Digest digest.Digest `json:"digest"`
+
+	// Size and UncompressedSize are the same as in layerStat.
+	Size             int64  `json:"size"`
+	UncompressedSize *int64 `json:"uncompressed_size"`
+
+	// SharedWith is the (sorted) set of other tags in the image which use the
+	// layer.
+	SharedWith []string `json:"shared_with"`
+
+	// Files is the number of regular files in the layer, and LargestFiles are
+	// the largest of them (largest first).
+	Files        int        `json:"files"`
+	LargestFiles []fileStat `json:"largest_files"`
+}
+
+// fileStat contains the size of a file in a layer.
+type fileStat struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// format writes the sizeBreakdown in the default formatting of umoci-stat(1).
+func (sb sizeBreakdown) format(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "LAYER\tSIZE\tUNCOMPRESSED\tFILES\tSHARED WITH\n")
+	for _, info := range sb.Layers {
+		var (
+			uncompressed = "<unknown>"
+			sharedWith   = "<none>"
+		)
+		if info.UncompressedSize != nil {
+			uncompressed = units.HumanSize(float64(*info.UncompressedSize))
+		}
+		if len(info.SharedWith) > 0 {
+			sharedWith = strings.Join(info.SharedWith, ", ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", info.Digest, units.HumanSize(float64(info.Size)), uncompressed, info.Files, sharedWith)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nSHARED: %s, UNIQUE: %s\n\n", units.HumanSize(float64(sb.SharedSize)), units.HumanSize(float64(sb.UniqueSize)))
+
+	tw = tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "MEDIA TYPE\tBLOBS\tSIZE\n")
+	for _, mediaType := range sb.MediaTypes {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", mediaType.MediaType, mediaType.Blobs, units.HumanSize(float64(mediaType.Size)))
+	}
+	tw.Flush()
+
+	for _, info := range sb.Layers {
+		if len(info.LargestFiles) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\nLARGEST FILES IN %s:\n", info.Digest)
+		tw = tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+		fmt.Fprintf(tw, "SIZE\tPATH\n")
+		for _, file := range info.LargestFiles {
+			fmt.Fprintf(tw, "%s\t%s\n", units.HumanSize(float64(file.Size)), file.Path)
+		}
+		tw.Flush()
+	}
+}
+
+// addLargestFile inserts file into files (which is sorted by size, largest
+// first), keeping at most n of the largest files. Files of the same size are
+// sorted by path.
+func addLargestFile(files []fileStat, file fileStat, n int) []fileStat {
+	idx := sort.Search(len(files), func(i int) bool {
+		return files[i].Size < file.Size || (files[i].Size == file.Size && files[i].Path > file.Path)
+	})
+	if idx >= n {
+		return files
+	}
+	files = append(files, fileStat{})
+	copy(files[idx+1:], files[idx:])
+	files[idx] = file
+	if len(files) > n {
+		files = files[:n]
+	}
+	return files
+}
+
+// countingReader is an io.Reader which counts the number of bytes read.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// StatSizeBreakdown fills the SizeBreakdown (and the uncompressed sizes) of
+// the given ManifestStat, which is the stat of the image tagged as tagName.
+// The topFiles largest files of each layer are recorded. Like
+// StatUncompressed, this requires decompressing every layer, and it also
+// requires walking every other tag in the image.
+func StatSizeBreakdown(ctx context.Context, engine casext.Engine, stat *ManifestStat, tagName string, topFiles int) error {
+	breakdown := &sizeBreakdown{
+		MediaTypes: []mediaTypeStat{},
+		Layers:     []layerBreakdown{},
+	}
+
+	// Find the blobs used by the other tags.
+	names, err := engine.ListReferences(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list references")
+	}
+	sort.Strings(names)
+	sharedWith := map[digest.Digest][]string{}
+	for _, name := range names {
+		if name == tagName {
+			continue
+		}
+		descriptor, err := engine.GetReference(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "get reference %s", name)
+		}
+		reachable, err := engine.Reachable(ctx, descriptor)
+		if err != nil {
+			return errors.Wrapf(err, "get blobs reachable from %s", name)
+		}
+		for _, blobDigest := range reachable {
+			sharedWith[blobDigest] = append(sharedWith[blobDigest], name)
+		}
+	}
+
+	mediaTypes := map[string]*mediaTypeStat{}
+	descriptors := []ispec.Descriptor{stat.Manifest, stat.Config.Descriptor}
+	for _, info := range stat.Layers {
+		descriptors = append(descriptors, info.Descriptor)
+	}
+	for _, descriptor := range descriptors {
+		mediaType, ok := mediaTypes[descriptor.MediaType]
+		if !ok {
+			mediaType = &mediaTypeStat{MediaType: descriptor.MediaType}
+			mediaTypes[descriptor.MediaType] = mediaType
+		}
+		mediaType.Blobs++
+		mediaType.Size += descriptor.Size
+	}
+	for _, mediaType := range mediaTypes {
+		breakdown.MediaTypes = append(breakdown.MediaTypes, *mediaType)
+	}
+	sort.Slice(breakdown.MediaTypes, func(i, j int) bool {
+		return breakdown.MediaTypes[i].MediaType < breakdown.MediaTypes[j].MediaType
+	})
+
+	manifest := ispec.Manifest{Annotations: stat.Annotations}
+	for _, info := range stat.Layers {
+		manifest.Layers = append(manifest.Layers, info.Descriptor)
+	}
+	ctx, err = casext.WithManifestLayerChunks(ctx, manifest)
+	if err != nil {
+		return errors.Wrap(err, "get chunked layers")
+	}
+
+	var total int64
+	stat.UncompressedSize = nil
+	for idx := range stat.Layers {
+		info := &stat.Layers[idx]
+		layerInfo := layerBreakdown{
+			Digest:       info.Digest,
+			Size:         info.Size,
+			SharedWith:   sharedWith[info.Digest],
+			LargestFiles: []fileStat{},
+		}
+		if layerInfo.SharedWith == nil {
+			layerInfo.SharedWith = []string{}
+		}
+		if len(layerInfo.SharedWith) > 0 {
+			breakdown.SharedSize += info.Size
+		} else {
+			breakdown.UniqueSize += info.Size
+		}
+
+		reader, err := layer.OpenLayer(ctx, engine, info.Descriptor)
+		if errors.Cause(err) == layer.ErrEncryptedLayer {
+			log.Debugf("stat: cannot compute size breakdown of encrypted layer %s", info.Digest)
+			breakdown.Layers = append(breakdown.Layers, layerInfo)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "open layer %s", info.Digest)
+		}
+		counter := &countingReader{Reader: reader}
+		tr := tar.NewReader(counter)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				reader.Close()
+				return errors.Wrapf(err, "read layer %s", info.Digest)
+			}
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA && hdr.Typeflag != tar.TypeGNUSparse {
+				continue
+			}
+			// Whiteouts (".wh.<name>") are not files.
+			if strings.HasPrefix(filepath.Base(hdr.Name), ".wh.") {
+				continue
+			}
+			layerInfo.Files++
+			layerInfo.LargestFiles = addLargestFile(layerInfo.LargestFiles, fileStat{
+				Path: filepath.Join("/", layer.CleanPath(hdr.Name)),
+				Size: hdr.Size,
+			}, topFiles)
+		}
+		// Include the padding at the end of the archive.
+		_, err = io.Copy(ioutil.Discard, counter)
+		reader.Close()
+		if err != nil {
+			return errors.Wrapf(err, "read layer %s", info.Digest)
+		}
+
+		size := counter.n
+		info.UncompressedSize = &size
+		layerInfo.UncompressedSize = &size
+		total += size
+		breakdown.Layers = append(breakdown.Layers, layerInfo)
+	}
+
+	stat.SizeBreakdown = breakdown
+	for _, info := range stat.Layers {
+		if info.UncompressedSize == nil {
+			return nil
+		}
+	}
+	stat.UncompressedSize = &total
+	return nil
+}
@@ -18,22 +18,58 @@
 package main
 
 import (
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
+	"time"
 
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/cas/drivers/chunked"
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
+	"golang.org/x/net/context"
 )
 
-// refRegexp defines the regexp that a given OCI tag must obey.
-var refRegexp = regexp.MustCompile(`^([A-Za-z0-9._-]+)+$`)
+// refRegexp defines the regexp that a given OCI tag must obey. In addition to
+// plain tags, registry-style names (such as "library/ubuntu:latest" or
+// "example.com/foo/bar@v1+build") are permitted, as described for the
+// org.opencontainers.image.ref.name annotation.
+var refRegexp = regexp.MustCompile(`^[A-Za-z0-9._:@+-]+(/[A-Za-z0-9._:@+-]+)*$`)
+
+// historyConfig is the format of the file given to --history.config, which
+// provides default values for the --history.* flags.
+type historyConfig struct {
+	Author    string `json:"author,omitempty"`
+	Comment   string `json:"comment,omitempty"`
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
+// expandHistoryTemplate replaces all "{name}" placeholders in tmpl with the
+// corresponding value in vars. Unknown placeholders are left untouched.
+func expandHistoryTemplate(tmpl string, vars map[string]string) string {
+	var oldnew []string
+	for name, value := range vars {
+		oldnew = append(oldnew, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(oldnew...).Replace(tmpl)
+}
 
 // uxHistory adds the full set of --history.* flags to the given cli.Command as
 // well as adding relevant validation logic to the .Before of the command. The
 // values will be stored in ctx.Metadata with the keys "--history.author",
 // "--history.created", "--history.created_by", "--history.comment", with
-// string values. If they are not set the value will be nil.
+// string values. If they are not set the value will be nil. Any values not
+// set with flags are taken from the --history.config file (if specified). The
+// --no-history flag (which conflicts with the others) should be passed to
+// mutate.Mutator.SetNoHistory.
 func uxHistory(cmd cli.Command) cli.Command {
 	cmd.Flags = append(cmd.Flags, []cli.Flag{
 		cli.StringFlag{
@@ -50,12 +86,29 @@ func uxHistory(cmd cli.Command) cli.Command {
 		},
 		cli.StringFlag{
 			Name:  "history.created_by",
-			Usage: "created_by value for the history entry",
+			Usage: "created_by value (or template) for the history entry",
+		},
+		cli.StringFlag{
+			Name:   "history.config",
+			Usage:  "JSON file containing default --history.* values",
+			EnvVar: "UMOCI_HISTORY_CONFIG",
+		},
+		cli.BoolFlag{
+			Name:  "no-history",
+			Usage: "do not add a history entry to the image",
 		},
 	}...)
 
 	oldBefore := cmd.Before
 	cmd.Before = func(ctx *cli.Context) error {
+		// --no-history makes the other flags meaningless.
+		if ctx.Bool("no-history") {
+			for _, flag := range []string{"history.author", "history.comment", "history.created", "history.created_by"} {
+				if ctx.IsSet(flag) {
+					return errors.Errorf("--no-history cannot be used with --%s", flag)
+				}
+			}
+		}
 		// Verify --history.author.
 		if ctx.IsSet("history.author") {
 			ctx.App.Metadata["--history.author"] = ctx.String("history.author")
@@ -72,6 +125,83 @@ func uxHistory(cmd cli.Command) cli.Command {
 		if ctx.IsSet("history.created_by") {
 			ctx.App.Metadata["--history.created_by"] = ctx.String("history.created_by")
 		}
+		// Fill any unset values from --history.config.
+		if path := ctx.String("history.config"); path != "" {
+			fh, err := os.Open(path)
+			if err != nil {
+				return errors.Wrap(err, "open --history.config")
+			}
+			defer fh.Close()
+
+			var config historyConfig
+			if err := json.NewDecoder(fh).Decode(&config); err != nil {
+				return errors.Wrap(err, "parse --history.config")
+			}
+			for key, value := range map[string]string{
+				"--history.author":     config.Author,
+				"--history.comment":    config.Comment,
+				"--history.created_by": config.CreatedBy,
+			} {
+				if _, ok := ctx.App.Metadata[key]; !ok && value != "" {
+					ctx.App.Metadata[key] = value
+				}
+			}
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxForce adds a --force flag to the given cli.Command, which permits the
+// command to clobber existing tags. The value will be stored in
+// ctx.App.Metadata["--force"] as a bool (or nil if --force was not specified).
+func uxForce(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.BoolFlag{
+		Name:  "force",
+		Usage: "clobber existing tags that would otherwise be left untouched",
+	})
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		if ctx.IsSet("force") {
+			ctx.App.Metadata["--force"] = ctx.Bool("force")
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxSourceDateEpoch adds a --source-date-epoch flag to the given cli.Command,
+// which (like the SOURCE_DATE_EPOCH environment variable it defaults to) is
+// the UNIX timestamp used in place of the current time, so that the output of
+// the command is reproducible. The value will be stored in
+// ctx.App.Metadata["--source-date-epoch"] as a time.Time (or nil if neither
+// the flag nor the environment variable was set).
+func uxSourceDateEpoch(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.Int64Flag{
+		Name:   "source-date-epoch",
+		Usage:  "unix timestamp used instead of the current time (and to clamp timestamps in layers)",
+		EnvVar: "SOURCE_DATE_EPOCH",
+	})
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		// ctx.IsSet doesn't consider values set through the environment.
+		if env, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ctx.IsSet("source-date-epoch") || (ok && env != "") {
+			ctx.App.Metadata["--source-date-epoch"] = time.Unix(ctx.Int64("source-date-epoch"), 0).UTC()
+		}
 
 		// Include any old befores set.
 		if oldBefore != nil {
@@ -116,6 +246,435 @@ func uxTag(cmd cli.Command) cli.Command {
 	return cmd
 }
 
+// uxWhiteout adds a --whiteout-format flag to the given cli.Command, which
+// selects how removed paths are represented in generated layers. The value
+// will be stored in ctx.App.Metadata["--whiteout-format"] as a
+// layer.WhiteoutMode (or nil if --whiteout-format was not specified, in which
+// case the default of layer.RepackOptions should be used).
+func uxWhiteout(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.StringFlag{
+		Name:  "whiteout-format",
+		Usage: "format of whiteouts for removed paths (aufs, overlayfs or reject)",
+	})
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		if ctx.IsSet("whiteout-format") {
+			mode := layer.WhiteoutMode(ctx.String("whiteout-format"))
+			switch mode {
+			case layer.WhiteoutAUFS, layer.WhiteoutOverlay, layer.WhiteoutReject:
+			default:
+				return errors.Errorf("invalid --whiteout-format: unknown format %q", mode)
+			}
+			ctx.App.Metadata["--whiteout-format"] = mode
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxXattrPolicy adds a --xattr-policy flag to the given cli.Command, which
+// configures how security xattrs are handled. The value will be stored in
+// ctx.App.Metadata["--xattr-policy"] as a layer.XattrPolicies (or nil if
+// --xattr-policy was not specified).
+func uxXattrPolicy(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.StringSliceFlag{
+		Name:  "xattr-policy",
+		Usage: "how the given security xattr is handled (of the form name=policy, with policy preserve, strip or remap)",
+	})
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		if values := ctx.StringSlice("xattr-policy"); len(values) > 0 {
+			policies := layer.XattrPolicies{}
+			for _, value := range values {
+				if err := policies.ParseXattrPolicy(value); err != nil {
+					return errors.Wrap(err, "invalid --xattr-policy")
+				}
+			}
+			ctx.App.Metadata["--xattr-policy"] = policies
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxTarFilter adds a --filter flag to the given cli.Command, which configures
+// the filters applied to the entries of generated layers. The value will be
+// stored in ctx.App.Metadata["--filter"] as a []layer.TarFilter (or nil if
+// --filter was not specified).
+func uxTarFilter(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.StringSliceFlag{
+		Name:  "filter",
+		Usage: "filter applied to every entry of the new layer (exclude:<pattern>, strip-xattr:<pattern> or reset-owner[:<uid>:<gid>])",
+	})
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		if values := ctx.StringSlice("filter"); len(values) > 0 {
+			var filters []layer.TarFilter
+			for _, value := range values {
+				filter, err := layer.ParseTarFilter(value)
+				if err != nil {
+					return errors.Wrap(err, "invalid --filter")
+				}
+				filters = append(filters, filter)
+			}
+			ctx.App.Metadata["--filter"] = filters
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxRefresh adds --refresh-mode and --refresh-tolerance flags to the given
+// cli.Command, which configure which differences between a bundle's rootfs
+// and its mtree manifest are treated as changes. The values will be stored in
+// ctx.App.Metadata["--refresh-mode"] as a layer.RefreshMode (defaulting to
+// layer.RefreshFull) and ctx.App.Metadata["--refresh-tolerance"] as a
+// []layer.KeywordTolerance (or nil if --refresh-tolerance was not specified).
+// The command must have a --metadata-only flag, as --refresh-mode=content
+// cannot be combined with it.
+func uxRefresh(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:  "refresh-mode",
+			Usage: "which differences are treated as changes (full, or content to only compare file contents)",
+			Value: string(layer.RefreshFull),
+		},
+		cli.StringSliceFlag{
+			Name:  "refresh-tolerance",
+			Usage: "ignore differences in the given mtree keyword (of the form keyword, or time=skew to ignore small time differences)",
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		mode := layer.RefreshMode(ctx.String("refresh-mode"))
+		switch mode {
+		case layer.RefreshFull:
+		case layer.RefreshContent:
+			if ctx.Bool("metadata-only") {
+				return errors.Errorf("--refresh-mode=content cannot be used with --metadata-only")
+			}
+		default:
+			return errors.Errorf("invalid --refresh-mode: unknown mode %q", mode)
+		}
+		ctx.App.Metadata["--refresh-mode"] = mode
+
+		if values := ctx.StringSlice("refresh-tolerance"); len(values) > 0 {
+			var tolerances []layer.KeywordTolerance
+			for _, value := range values {
+				tolerance, err := layer.ParseKeywordTolerance(value)
+				if err != nil {
+					return errors.Wrap(err, "invalid --refresh-tolerance")
+				}
+				tolerances = append(tolerances, tolerance)
+			}
+			ctx.App.Metadata["--refresh-tolerance"] = tolerances
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxCompression adds --compression-level and --compression-jobs flags to the
+// given cli.Command, which configure how generated layers are compressed. The
+// values will be stored in ctx.App.Metadata["--compression-level"] and
+// ctx.App.Metadata["--compression-jobs"] as ints (or nil if the flags were not
+// specified, in which case the defaults of layer.RepackOptions should be
+// used). A --compression-jobs of 0 is replaced with the number of CPUs. The
+// --format flag selects the layer.LayerFormat of generated layers, which is
+// stored in ctx.App.Metadata["--format"].
+func uxCompression(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.IntFlag{
+			Name:  "compression-level",
+			Usage: "gzip compression level of generated layers (1-9)",
+			Value: 6,
+		},
+		cli.IntFlag{
+			Name:  "compression-jobs",
+			Usage: "number of blocks of generated layers to compress in parallel (0 for the number of CPUs)",
+			Value: 1,
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "format of generated layers ([gzip] or estargz)",
+		},
+		cli.StringFlag{
+			Name:  "max-blob-size",
+			Usage: "maximum size of generated layer blobs, with larger layers split into chunks (such as 512M)",
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		if ctx.IsSet("compression-level") {
+			level := ctx.Int("compression-level")
+			if level < gzip.BestSpeed || level > gzip.BestCompression {
+				return errors.Errorf("invalid --compression-level: must be between %d and %d", gzip.BestSpeed, gzip.BestCompression)
+			}
+			ctx.App.Metadata["--compression-level"] = level
+		}
+		if ctx.IsSet("compression-jobs") {
+			jobs := ctx.Int("compression-jobs")
+			if jobs < 0 {
+				return errors.Errorf("invalid --compression-jobs: must not be negative")
+			}
+			if jobs == 0 {
+				jobs = runtime.NumCPU()
+			}
+			ctx.App.Metadata["--compression-jobs"] = jobs
+		}
+		format := layer.LayerFormat(ctx.String("format"))
+		if err := format.Validate(); err != nil {
+			return errors.Wrap(err, "invalid --format")
+		}
+		ctx.App.Metadata["--format"] = format
+		if ctx.IsSet("max-blob-size") {
+			size, err := units.RAMInBytes(ctx.String("max-blob-size"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --max-blob-size")
+			}
+			if size <= 0 {
+				return errors.Errorf("invalid --max-blob-size: must be positive")
+			}
+			ctx.App.Metadata["--max-blob-size"] = size
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// compressionOptions sets the compression options of the given
+// layer.RepackOptions from the flags added by uxCompression.
+func compressionOptions(ctx *cli.Context, opt *layer.RepackOptions) {
+	if val, ok := ctx.App.Metadata["--compression-level"]; ok {
+		opt.CompressionLevel = val.(int)
+	}
+	if val, ok := ctx.App.Metadata["--compression-jobs"]; ok {
+		opt.CompressionJobs = val.(int)
+	}
+	if val, ok := ctx.App.Metadata["--format"]; ok {
+		opt.LayerFormat = val.(layer.LayerFormat)
+	}
+}
+
+// maxBlobSize returns the --max-blob-size added by uxCompression, or 0 if
+// layers should not be split into chunks.
+func maxBlobSize(ctx *cli.Context) int64 {
+	if val, ok := ctx.App.Metadata["--max-blob-size"]; ok {
+		return val.(int64)
+	}
+	return 0
+}
+
+// parsePlatform parses a platform of the form "os[(version)]/arch[/variant]",
+// where version is the os.version of the platform (as used by Windows images,
+// such as "windows(10.0.17763)/amd64").
+func parsePlatform(platform string) (ispec.Platform, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return ispec.Platform{}, errors.Errorf("platform must be of the form os[(version)]/arch[/variant]: %s", platform)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return ispec.Platform{}, errors.Errorf("platform contains empty component: %s", platform)
+		}
+	}
+
+	p := ispec.Platform{
+		OS:           parts[0],
+		Architecture: parts[1],
+	}
+	if sep := strings.Index(p.OS, "("); sep >= 0 {
+		if !strings.HasSuffix(p.OS, ")") || sep == 0 || sep == len(p.OS)-2 {
+			return ispec.Platform{}, errors.Errorf("platform must be of the form os[(version)]/arch[/variant]: %s", platform)
+		}
+		p.OS, p.OSVersion = p.OS[:sep], p.OS[sep+1:len(p.OS)-1]
+	}
+	if strings.ContainsAny(p.OS+p.OSVersion+p.Architecture, "()") {
+		return ispec.Platform{}, errors.Errorf("platform must be of the form os[(version)]/arch[/variant]: %s", platform)
+	}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// formatPlatform formats the given platform in the form accepted by
+// parsePlatform.
+func formatPlatform(p ispec.Platform) string {
+	platform := p.OS
+	if p.OSVersion != "" {
+		platform += "(" + p.OSVersion + ")"
+	}
+	platform += "/" + p.Architecture
+	if p.Variant != "" {
+		platform += "/" + p.Variant
+	}
+	return platform
+}
+
+// uxPlatform adds a --platform flag to the given cli.Command, which selects
+// the manifest used when the image refers to a manifest list. The value will
+// be stored in ctx.App.Metadata["--platform"] as an ispec.Platform (or nil if
+// --platform was not specified, in which case the platform umoci is running
+// on should be used).
+func uxPlatform(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.StringFlag{
+		Name:  "platform",
+		Usage: "platform (of the form os[(version)]/arch[/variant]) to select from a manifest list",
+	})
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		if ctx.IsSet("platform") {
+			platform, err := parsePlatform(ctx.String("platform"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --platform")
+			}
+			ctx.App.Metadata["--platform"] = platform
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxIndexCache adds the --index-cache and --no-index-cache flags to the given
+// cli.Command, which control where the indexes of the layers read by the
+// command are cached (see layer.IndexCache). The context for reading layers
+// should be wrapped with indexCacheContext.
+func uxIndexCache(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:  "index-cache",
+			Usage: "directory to cache layer indexes in (defaults to inside the image layout)",
+		},
+		cli.BoolFlag{
+			Name:  "no-index-cache",
+			Usage: "do not use or build cached layer indexes",
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		if ctx.IsSet("index-cache") {
+			if ctx.Bool("no-index-cache") {
+				return errors.Errorf("--index-cache and --no-index-cache cannot be used together")
+			}
+			if ctx.String("index-cache") == "" {
+				return errors.Errorf("--index-cache cannot be empty")
+			}
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// indexCacheContext returns a copy of the given context with the
+// layer.IndexCache requested with --index-cache attached. By default, the
+// cache is inside the image layout (if the image is a directory).
+func indexCacheContext(ctx *cli.Context, imagePath string, layerCtx context.Context) context.Context {
+	if ctx.Bool("no-index-cache") {
+		return layerCtx
+	}
+	path := ctx.String("index-cache")
+	if path == "" {
+		if !dir.Driver.Supported(imagePath) || chunked.Driver.Supported(imagePath) {
+			return layerCtx
+		}
+		path = filepath.Join(imagePath, dir.IndexCacheDirectory)
+	}
+	return layer.WithIndexCache(layerCtx, layer.NewIndexCache(path))
+}
+
+// requestedPlatform returns the platform specified with --platform, or the
+// platform umoci is running on if --platform was not specified.
+func requestedPlatform(ctx *cli.Context) ispec.Platform {
+	if val, ok := ctx.App.Metadata["--platform"]; ok {
+		return val.(ispec.Platform)
+	}
+	return ispec.Platform{
+		OS:           runtime.GOOS,
+		Architecture: runtime.GOARCH,
+	}
+}
+
+// parseImage parses and verifies an image argument of the form "path[:tag]",
+// returning the path and tag. If no tag is specified, it defaults to
+// "latest". The path cannot contain ':', so the tag is everything after the
+// first ':' (and may itself contain ':', such as "library/ubuntu:latest").
+func parseImage(image string) (string, string, error) {
+	var dir, tag string
+	sep := strings.Index(image, ":")
+	if sep == -1 {
+		dir = image
+		tag = "latest"
+	} else {
+		dir = image[:sep]
+		tag = image[sep+1:]
+	}
+
+	// Verify directory value.
+	if dir == "" {
+		return "", "", fmt.Errorf("path is empty")
+	}
+
+	// Verify tag value.
+	if !refRegexp.MatchString(tag) {
+		return "", "", fmt.Errorf("tag contains invalid characters: '%s'", tag)
+	}
+	if tag == "" {
+		return "", "", fmt.Errorf("tag is empty")
+	}
+
+	return dir, tag, nil
+}
+
 // uxImage adds an --image flag to the given cli.Command as well as adding
 // relevant validation logic to the .Before of the command. The values (image,
 // tag) will be stored in ctx.Metadata["--image-path"] and
@@ -131,32 +690,9 @@ func uxImage(cmd cli.Command) cli.Command {
 	cmd.Before = func(ctx *cli.Context) error {
 		// Verify and parse --image.
 		if ctx.IsSet("image") {
-			image := ctx.String("image")
-
-			var dir, tag string
-			sep := strings.LastIndex(image, ":")
-			if sep == -1 {
-				dir = image
-				tag = "latest"
-			} else {
-				dir = image[:sep]
-				tag = image[sep+1:]
-			}
-
-			// Verify directory value.
-			if strings.Contains(dir, ":") {
-				return errors.Wrap(fmt.Errorf("path contains ':' character: '%s'", dir), "invalid --image")
-			}
-			if dir == "" {
-				return errors.Wrap(fmt.Errorf("path is empty"), "invalid --image")
-			}
-
-			// Verify tag value.
-			if !refRegexp.MatchString(tag) {
-				return errors.Wrap(fmt.Errorf("tag contains invalid characters: '%s'", tag), "invalid --image")
-			}
-			if tag == "" {
-				return errors.Wrap(fmt.Errorf("tag is empty"), "invalid --image")
+			dir, tag, err := parseImage(ctx.String("image"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --image")
 			}
 
 			ctx.App.Metadata["--image-path"] = dir
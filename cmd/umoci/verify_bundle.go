@@ -0,0 +1,235 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/userns"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+var verifyBundleCommand = uxRefresh(uxImage(cli.Command{
+	Name:  "verify-bundle",
+	Usage: "checks whether a bundle has been modified since it was unpacked",
+	ArgsUsage: `--bundle <bundle> [--image <image-path>[:<tag>]]
+
+Where "<bundle>" is the path to a bundle unpacked with umoci-unpack(1). If
+"<image-path>" is given, the tag "<tag>" must still refer to the image the
+bundle was unpacked from.
+
+The bundle is not modified. The exit status is 0 if the bundle is unmodified,
+and 1 if it has been modified (or if an error occurred).`,
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "bundle",
+			Usage: "path to the bundle to verify",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the result as a JSON encoded blob",
+		},
+		cli.IntFlag{
+			Name:  "jobs",
+			Usage: "number of files to compute the digests of in parallel (0 means the number of CPUs)",
+		},
+		cli.BoolFlag{
+			Name:  "metadata-only",
+			Usage: "only compare metadata (file contents are only compared by size)",
+		},
+	},
+
+	Action: verifyBundle,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.String("bundle") == "" {
+			return errors.Errorf("missing mandatory argument: --bundle")
+		}
+		if ctx.Int("jobs") < 0 {
+			return errors.Errorf("invalid --jobs: must not be negative")
+		}
+		return nil
+	},
+}))
+
+// bundleChange is a path in the rootfs of a bundle which was modified, added
+// or removed since it was unpacked.
+type bundleChange struct {
+	// Type is the type of change ("modified", "added" or "removed").
+	Type string `json:"type"`
+
+	// Path is the path of the changed file, relative to the rootfs.
+	Path string `json:"path"`
+
+	// Keywords is the set of mtree keywords which differ, for modified
+	// paths.
+	Keywords []mtree.Keyword `json:"keywords,omitempty"`
+}
+
+// bundleVerification is the result of umoci-verify-bundle(1).
+type bundleVerification struct {
+	// Bundle is the path to the bundle.
+	Bundle string `json:"bundle"`
+
+	// From is the descriptor of the image manifest the bundle was unpacked
+	// from.
+	From ispec.Descriptor `json:"from_descriptor"`
+
+	// Image is the descriptor the --image tag currently refers to, if --image
+	// was given.
+	Image *ispec.Descriptor `json:"image_descriptor,omitempty"`
+
+	// Modified is whether the rootfs was changed, or the --image tag no longer
+	// refers to the image the bundle was unpacked from.
+	Modified bool `json:"modified"`
+
+	// Changes is the set of paths in the rootfs which were changed.
+	Changes []bundleChange `json:"changes"`
+}
+
+// bundleChanges converts the given mtree deltas into a sorted set of
+// bundleChanges.
+func bundleChanges(diffs []mtree.InodeDelta) []bundleChange {
+	changes := []bundleChange{}
+	for _, diff := range diffs {
+		change := bundleChange{Path: filepath.Join("/", diff.Path())}
+		switch diff.Type() {
+		case mtree.Modified:
+			change.Type = "modified"
+			for _, key := range diff.Diff() {
+				change.Keywords = append(change.Keywords, key.Name())
+			}
+		case mtree.Extra:
+			change.Type = "added"
+		case mtree.Missing:
+			change.Type = "removed"
+		default:
+			change.Type = string(diff.Type())
+		}
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+func verifyBundle(ctx *cli.Context) error {
+	bundlePath := ctx.String("bundle")
+
+	meta, err := ReadBundleMeta(bundlePath)
+	if err != nil {
+		return errors.Wrap(err, "read umoci.json metadata")
+	}
+	if meta.Mode != "" {
+		return errors.Errorf("cannot verify bundle unpacked with --mode=%s", meta.Mode)
+	}
+
+	// Bundles unpacked with --userns can only be read inside a user
+	// namespace with the same mappings.
+	if meta.MapOptions.UserNamespace && !userns.Enabled() {
+		return runInUserNamespace(meta.MapOptions)
+	}
+
+	result := bundleVerification{
+		Bundle: bundlePath,
+		From:   meta.From,
+	}
+
+	if imagePath, ok := ctx.App.Metadata["--image-path"]; ok {
+		tagName := ctx.App.Metadata["--image-tag"].(string)
+		engine, err := openReadOnlyImage(ctx, imagePath.(string))
+		if err != nil {
+			return errors.Wrap(err, "open CAS")
+		}
+		descriptor, err := engine.GetReference(context.Background(), tagName)
+		engine.Close()
+		if err != nil {
+			return errors.Wrap(err, "get reference")
+		}
+		result.Image = &descriptor
+		if descriptor.Digest != meta.From.Digest {
+			result.Modified = true
+		}
+	}
+
+	spec, keywords, err := readBundleState(bundlePath, meta)
+	if err != nil {
+		return errors.Wrap(err, "read bundle state")
+	}
+	if ctx.Bool("metadata-only") {
+		keywords = layer.StatKeywords(keywords)
+	}
+	keywords = ctx.App.Metadata["--refresh-mode"].(layer.RefreshMode).Keywords(keywords)
+	tolerances, _ := ctx.App.Metadata["--refresh-tolerance"].([]layer.KeywordTolerance)
+
+	fsEval := fseval.DefaultFsEval
+	if meta.MapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+	diffs, err := layer.CheckParallelTolerant(filepath.Join(bundlePath, layer.RootfsName), spec, keywords, tolerances, fsEval, ctx.Int("jobs"))
+	if err != nil {
+		return errors.Wrap(err, "check mtree")
+	}
+	result.Changes = bundleChanges(filterRuntimeStubs(diffs, meta.RuntimeStubs))
+	if len(result.Changes) > 0 {
+		result.Modified = true
+	}
+
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+			return errors.Wrap(err, "encoding verification")
+		}
+	} else {
+		if result.Image != nil && result.Image.Digest != meta.From.Digest {
+			log.Warnf("--image refers to %s, but the bundle was unpacked from %s", result.Image.Digest, meta.From.Digest)
+		}
+		for _, change := range result.Changes {
+			line := fmt.Sprintf("%s %s", change.Type, change.Path)
+			if len(change.Keywords) > 0 {
+				var names []string
+				for _, keyword := range change.Keywords {
+					names = append(names, string(keyword))
+				}
+				line += " (" + strings.Join(names, ", ") + ")"
+			}
+			fmt.Println(line)
+		}
+	}
+
+	if result.Modified {
+		return cli.NewExitError("", 1)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/journal"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var watchCommand = cli.Command{
+	Name:  "watch",
+	Usage: "records the changes made to an OCI runtime bundle for umoci-repack(1)",
+	ArgsUsage: `--watch-state <journal> <bundle>
+
+Where "<bundle>" is a bundle unpacked with umoci-unpack(1), and "<journal>" is
+the path (outside of the bundle's rootfs) of the journal to create.
+
+Every change made to the rootfs of the bundle is recorded in the journal until
+umoci-watch(1) is interrupted (with SIGINT or SIGTERM). The journal can then be
+passed to umoci-repack(1) with --watch-state, so that only the changed paths
+have to be checked instead of the whole rootfs.
+
+umoci-watch(1) MUST be started before the rootfs is modified, as changes made
+before it started watching (or after it stopped) are not recorded.`,
+
+	// watch only operates on a bundle, not on an image.
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "watch-state",
+			Usage: "path of the journal to create",
+		},
+	},
+
+	Action: watch,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <bundle>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("bundle path cannot be empty")
+		}
+		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		if ctx.String("watch-state") == "" {
+			return errors.Errorf("--watch-state must be specified")
+		}
+		return nil
+	},
+}
+
+func watch(ctx *cli.Context) error {
+	bundlePath := ctx.App.Metadata["bundle"].(string)
+	journalPath := ctx.String("watch-state")
+
+	meta, err := ReadBundleMeta(bundlePath)
+	if err != nil {
+		return errors.Wrap(err, "read umoci.json metadata")
+	}
+	if meta.Mode != "" {
+		return errors.Errorf("cannot watch bundle unpacked with --mode=%s", meta.Mode)
+	}
+
+	// The journal must not be inside the rootfs, otherwise recording a
+	// change would itself be a change.
+	fullRootfsPath, err := filepath.Abs(filepath.Join(bundlePath, layer.RootfsName))
+	if err != nil {
+		return errors.Wrap(err, "get rootfs path")
+	}
+	fullJournalPath, err := filepath.Abs(journalPath)
+	if err != nil {
+		return errors.Wrap(err, "get journal path")
+	}
+	if rel, err := filepath.Rel(fullRootfsPath, fullJournalPath); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+		return errors.Errorf("journal %s cannot be inside the rootfs of the bundle", journalPath)
+	}
+
+	writer, err := journal.Create(journalPath, meta.From.Digest)
+	if err != nil {
+		return errors.Wrap(err, "create journal")
+	}
+	defer writer.Close()
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		sig := <-signals
+		log.Infof("received %s: stopping", sig)
+		close(stop)
+	}()
+
+	if err := journal.Watch(fullRootfsPath, writer, stop); err != nil {
+		return errors.Wrap(err, "watch rootfs")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var whichCommand = cli.Command{
+	Name:  "which",
+	Usage: "lists the tags which refer to a blob",
+	ArgsUsage: `--layout <image-path> <digest>
+
+Where "<image-path>" is the path to the OCI image, and "<digest>" is the digest
+of a blob in the image. The digest may be abbreviated to an unambiguous prefix
+of at least 4 characters (with or without the "sha256:" algorithm prefix).
+
+Every tag from which the blob can be reached is listed, along with the path of
+descriptors from the tag to the blob. If no tags are listed, the blob is not
+referenced and would be removed by umoci-gc(1).
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// which reads an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the referrers as a JSON encoded blob",
+		},
+	},
+
+	Action: which,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <digest>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("digest cannot be empty")
+		}
+		ctx.App.Metadata["digest"] = ctx.Args().First()
+		return nil
+	},
+}
+
+func which(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	shortDigest := ctx.App.Metadata["digest"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openReadOnlyImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	blobDigest, err := engineExt.ResolveDigest(context.Background(), shortDigest)
+	if err != nil {
+		return errors.Wrap(err, "resolve digest")
+	}
+
+	referrers, err := engineExt.Referrers(context.Background(), blobDigest)
+	if err != nil {
+		return errors.Wrap(err, "get referrers")
+	}
+
+	if ctx.Bool("json") {
+		if referrers == nil {
+			referrers = []casext.Referrer{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(referrers); err != nil {
+			return errors.Wrap(err, "encoding referrers")
+		}
+		return nil
+	}
+
+	for _, referrer := range referrers {
+		var path []string
+		for _, descriptor := range referrer.Path {
+			path = append(path, fmt.Sprintf("%s (%s)", descriptor.Digest, descriptor.MediaType))
+		}
+		fmt.Printf("%s: %s\n", referrer.Name, strings.Join(path, " -> "))
+	}
+	return nil
+}
@@ -31,3 +31,4 @@ patch() {
 # project is, so I'm just going to backport it here until I see that there's
 # upstream activity.
 patch github.com/pkg/errors errors-0001-errors-add-Debug-function.patch
+patch github.com/pkg/errors errors-0002-errors-add-Go-1.13-error-chain-support.patch
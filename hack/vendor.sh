@@ -83,7 +83,7 @@ clean() {
 	# Remove any extra files that we know we don't care about.
 	echo -n "pruning unused files, "
 	find vendor -type f -name '*_test.go' -exec rm -v '{}' ';'
-	find vendor -regextype posix-extended -type f -not '(' -regex '.*\.(c|h|go)' -or '(' "${importantfiles[@]}" ')' ')' -exec rm -v '{}' ';'
+	find vendor -regextype posix-extended -type f -not '(' -regex '.*\.(c|h|s|go)' -or '(' "${importantfiles[@]}" ')' ')' -exec rm -v '{}' ';'
 
 	# Remove self from vendor.
 	echo -n "pruning self from vendor, "
@@ -122,14 +122,17 @@ clone github.com/opencontainers/runtime-spec v1.0.0-rc2
 clone github.com/opencontainers/image-tools 421458f7e467ac86175408693a07da6d29817bf7
 clone github.com/opencontainers/runtime-tools b61b44a71dafb8472bbc1e5eb0d68ed9ce8ba6ac
 clone github.com/syndtr/gocapability 2c00daeb6c3b45114c80ac44119e7b8801fdd852
-clone golang.org/x/crypto b8a2a83acfe6e6770b75de42d5ff4c67596675c0 https://github.com/golang/crypto
-clone golang.org/x/sys d75a52659825e75fff6158388dddc6a5b04f9ba5 https://github.com/golang/sys
+clone golang.org/x/crypto v0.25.0 https://github.com/golang/crypto
+clone golang.org/x/sys v0.15.0 https://github.com/golang/sys
 clone github.com/docker/go-units v0.3.1
 clone github.com/pkg/errors v0.8.0
 clone github.com/apex/log afb2e76037a5f36542c77e88ef8aef9f469b09f8
 clone github.com/urfave/cli v1.18.1
 clone github.com/vbatts/go-mtree 711a89aa4c4a8f148d87eb915456eba8ee7c6a0b
 clone golang.org/x/net 45e771701b814666a7eb299e6c7a57d0b1799e91 https://github.com/golang/net
+clone github.com/klauspost/compress v1.18.0
+clone github.com/go-jose/go-jose/v4 v4.0.4 https://github.com/go-jose/go-jose
+clone github.com/smallstep/pkcs7 v0.1.1
 
 # Clean up the vendor directory.
 clean
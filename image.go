@@ -0,0 +1,344 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package umoci provides a high-level interface to OCI images (see Image),
+// which ties together the lower-level oci/cas, oci/casext, mutate and
+// oci/layer packages in the same way as the umoci command-line tool.
+package umoci
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+
+	// Register the official cas drivers for OpenImage.
+	_ "github.com/openSUSE/umoci/oci/cas/drivers"
+)
+
+// BundleStateName is the name of the file in a bundle created by
+// Image.Unpack which records the state of its rootfs, so that the changes
+// made to the rootfs can be found by Image.Repack.
+const BundleStateName = "umoci.state.json"
+
+// StateKeywords is the set of mtree keywords recorded in the state of bundles
+// created by Image.Unpack. It is the same as the default set of keywords used
+// by umoci-unpack(1).
+var StateKeywords = []mtree.Keyword{
+	"size",
+	"type",
+	"uid",
+	"gid",
+	"mode",
+	"link",
+	"nlink",
+	"tar_time",
+	"sha256digest",
+	"xattr",
+}
+
+// Image is a tagged image manifest in an OCI image. It provides the common
+// operations on images (unpacking and repacking bundles, and reading and
+// modifying the configuration), without having to use the cas, casext,
+// mutate and layer packages directly. Every modification of the image writes
+// a new image manifest and updates the tag to refer to it, failing with a
+// *cas.ClobberError if the tag was changed by someone else in the meantime.
+type Image struct {
+	engine casext.Engine
+	name   string
+
+	// descriptor is the image manifest currently referred to by name.
+	descriptor ispec.Descriptor
+
+	// owned is set if the engine was opened by OpenImage, in which case it is
+	// closed by Close.
+	owned bool
+}
+
+// OpenImage opens the image with the given tag in the OCI image at the given
+// path (or any other URI supported by cas.Open).
+func OpenImage(path, name string) (*Image, error) {
+	engine, err := cas.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open CAS")
+	}
+	image, err := NewImage(context.Background(), engine, name)
+	if err != nil {
+		engine.Close()
+		return nil, err
+	}
+	image.owned = true
+	return image, nil
+}
+
+// NewImage returns the image with the given tag in an already opened
+// cas.Engine. The engine is not closed by Close.
+func NewImage(ctx context.Context, engine cas.Engine, name string) (*Image, error) {
+	image := &Image{
+		engine: casext.Engine{engine},
+		name:   name,
+	}
+	if err := image.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// refresh updates the descriptor of the image from its tag.
+func (img *Image) refresh(ctx context.Context) error {
+	descriptor, err := img.engine.GetReference(ctx, img.name)
+	if err != nil {
+		return errors.Wrapf(err, "get reference %s", img.name)
+	}
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Errorf("%s does not refer to an image manifest: %s", img.name, descriptor.MediaType)
+	}
+	img.descriptor = descriptor
+	return nil
+}
+
+// Close releases the image, closing the engine if it was opened by
+// OpenImage.
+func (img *Image) Close() error {
+	if img.owned {
+		return img.engine.Close()
+	}
+	return nil
+}
+
+// Engine returns the engine of the image, for operations not provided by
+// Image.
+func (img *Image) Engine() casext.Engine {
+	return img.engine
+}
+
+// Name returns the tag of the image.
+func (img *Image) Name() string {
+	return img.name
+}
+
+// Descriptor returns the descriptor of the image manifest.
+func (img *Image) Descriptor() ispec.Descriptor {
+	return img.descriptor
+}
+
+// Manifest returns the image manifest.
+func (img *Image) Manifest(ctx context.Context) (ispec.Manifest, error) {
+	blob, err := img.engine.FromDescriptor(ctx, img.descriptor)
+	if err != nil {
+		return ispec.Manifest{}, errors.Wrap(err, "get manifest")
+	}
+	defer blob.Close()
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return ispec.Manifest{}, errors.Errorf("[internal error] unknown manifest blob type: %s", blob.MediaType)
+	}
+	return manifest, nil
+}
+
+// Config returns the image configuration.
+func (img *Image) Config(ctx context.Context) (ispec.Image, error) {
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return ispec.Image{}, err
+	}
+	blob, err := img.engine.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return ispec.Image{}, errors.Wrap(err, "get config")
+	}
+	defer blob.Close()
+	config, ok := blob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return ispec.Image{}, errors.Errorf("[internal error] unknown config blob type: %s", blob.MediaType)
+	}
+	return config, nil
+}
+
+// Layers returns the descriptors of the layers of the image, from the lowest
+// layer to the topmost layer.
+func (img *Image) Layers(ctx context.Context) ([]ispec.Descriptor, error) {
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Layers, nil
+}
+
+// Mutate calls fn with a mutate.Mutator of the image, and (if fn succeeds)
+// writes the modified image and updates the tag. If history is nil, no
+// history entries are added by the Mutator (see mutate.Mutator.SetNoHistory).
+func (img *Image) Mutate(ctx context.Context, history *ispec.History, fn func(*mutate.Mutator) error) error {
+	tx, err := mutate.Begin(ctx, img.engine, img.name)
+	if err != nil {
+		return errors.Wrap(err, "begin mutation")
+	}
+	defer tx.Abort(ctx)
+
+	if tx.Base().Digest != img.descriptor.Digest {
+		return errors.Wrapf(&cas.ClobberError{Name: img.name, Old: img.descriptor, New: tx.Base()}, "image modified")
+	}
+	mutator := tx.Mutator()
+	mutator.SetNoHistory(history == nil)
+	if err := fn(mutator); err != nil {
+		return err
+	}
+
+	descriptor, err := tx.Commit(ctx)
+	if err != nil {
+		return errors.Wrap(err, "commit mutation")
+	}
+	img.descriptor = descriptor
+	return nil
+}
+
+// SetConfig replaces the configuration of the image (the runtime options,
+// rather than the metadata such as the platform or author), adding the given
+// history entry (if non-nil).
+func (img *Image) SetConfig(ctx context.Context, config ispec.ImageConfig, history *ispec.History) error {
+	return img.Mutate(ctx, history, func(mutator *mutate.Mutator) error {
+		meta, err := mutator.Meta(ctx)
+		if err != nil {
+			return errors.Wrap(err, "get image metadata")
+		}
+		annotations, err := mutator.Annotations(ctx)
+		if err != nil {
+			return errors.Wrap(err, "get image annotations")
+		}
+		var entry ispec.History
+		if history != nil {
+			entry = *history
+		}
+		return errors.Wrap(mutator.Set(ctx, config, meta, annotations, entry), "set config")
+	})
+}
+
+// stateFsEval returns the FsEval for the given mapping options.
+func stateFsEval(opt layer.MapOptions) fseval.FsEval {
+	if opt.Rootless {
+		return fseval.RootlessFsEval
+	}
+	return fseval.DefaultFsEval
+}
+
+// writeState records the state of the rootfs of the given bundle.
+func writeState(bundle string, opt layer.MapOptions) error {
+	dh, err := mtree.Walk(filepath.Join(bundle, layer.RootfsName), nil, StateKeywords, stateFsEval(opt))
+	if err != nil {
+		return errors.Wrap(err, "generate mtree spec")
+	}
+	fh, err := os.Create(filepath.Join(bundle, BundleStateName))
+	if err != nil {
+		return errors.Wrap(err, "create state")
+	}
+	defer fh.Close()
+	if _, err := layer.NewState(dh, StateKeywords, opt).WriteTo(fh); err != nil {
+		return errors.Wrap(err, "write state")
+	}
+	return fh.Close()
+}
+
+// Unpack extracts the image into a runtime bundle at the given path (see
+// layer.UnpackManifestWithOptions), and records the state of its rootfs in
+// BundleStateName so that changes to the rootfs can be repacked with Repack.
+// The state isn't recorded for overlay unpacks, which cannot be repacked.
+func (img *Image) Unpack(ctx context.Context, bundle string, opt *layer.UnpackOptions) error {
+	var unpackOptions layer.UnpackOptions
+	if opt != nil {
+		unpackOptions = *opt
+	}
+
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(bundle, 0755); err != nil {
+		return errors.Wrap(err, "create bundle")
+	}
+	if err := layer.UnpackManifestWithOptions(ctx, img.engine, bundle, manifest, unpackOptions); err != nil {
+		return errors.Wrap(err, "unpack manifest")
+	}
+	if unpackOptions.Overlay {
+		return nil
+	}
+	return errors.Wrap(writeState(bundle, unpackOptions.MapOptions), "record bundle state")
+}
+
+// Repack adds a layer containing the changes made to the rootfs of a bundle
+// created by Unpack to the image, along with the given history entry (if
+// non-nil). If the history entry has no creation date, the current time is
+// used. The state of the bundle is updated, so the bundle can be repacked
+// again after further changes. The mapping options of the layer are those
+// the bundle was unpacked with.
+func (img *Image) Repack(ctx context.Context, bundle string, opt *layer.RepackOptions, history *ispec.History) error {
+	fh, err := os.Open(filepath.Join(bundle, BundleStateName))
+	if err != nil {
+		return errors.Wrap(err, "open bundle state")
+	}
+	state, err := layer.ReadState(fh)
+	fh.Close()
+	if err != nil {
+		return errors.Wrap(err, "read bundle state")
+	}
+
+	var repackOptions layer.RepackOptions
+	if opt != nil {
+		repackOptions = *opt
+	}
+	repackOptions.MapOptions = state.MapOptions
+
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	diffs, err := layer.CheckParallel(rootfs, state.Hierarchy(), state.Keywords, stateFsEval(state.MapOptions), 0)
+	if err != nil {
+		return errors.Wrap(err, "check bundle state")
+	}
+
+	if history != nil && history.Created.IsZero() {
+		entry := *history
+		entry.Created = time.Now()
+		history = &entry
+	}
+	err = img.Mutate(ctx, history, func(mutator *mutate.Mutator) error {
+		mutator.SetCompressor(repackOptions.NewCompressor)
+
+		reader, err := layer.GenerateLayer(ctx, rootfs, diffs, &repackOptions)
+		if err != nil {
+			return errors.Wrap(err, "generate diff layer")
+		}
+		defer reader.Close()
+
+		var entry ispec.History
+		if history != nil {
+			entry = *history
+		}
+		return errors.Wrap(mutator.Add(ctx, reader, entry), "add diff layer")
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(writeState(bundle, state.MapOptions), "update bundle state")
+}
@@ -0,0 +1,170 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/layer"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// createEmptyImage creates an image layout at the given path containing an
+// image with no layers, tagged with the given name.
+func createEmptyImage(t *testing.T, path, name string) {
+	ctx := context.Background()
+	if err := cas.Create(path); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := cas.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	config := ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		RootFS:       ispec.RootFS{Type: "layers"},
+	}
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{},
+	}
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.PutReference(ctx, name, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImage(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "umoci-TestImage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	imagePath := filepath.Join(dir, "image")
+	createEmptyImage(t, imagePath, "latest")
+
+	if _, err := OpenImage(imagePath, "nonexistent"); err == nil {
+		t.Errorf("expected error opening nonexistent tag")
+	}
+	image, err := OpenImage(imagePath, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer image.Close()
+
+	// Unpack, modify and repack the image twice.
+	bundle := filepath.Join(dir, "bundle")
+	mapOptions := layer.MapOptions{Rootless: os.Geteuid() != 0}
+	if err := image.Unpack(ctx, bundle, &layer.UnpackOptions{MapOptions: mapOptions}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	for i, name := range []string{"first", "second"} {
+		if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := image.Repack(ctx, bundle, nil, &ispec.History{CreatedBy: "repack " + name}); err != nil {
+			t.Fatalf("unexpected error repacking image: %+v", err)
+		}
+		layers, err := image.Layers(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(layers) != i+1 {
+			t.Errorf("expected %d layers after repack, got %d", i+1, len(layers))
+		}
+	}
+
+	// Repacking an unmodified bundle adds an empty layer.
+	if err := image.Repack(ctx, bundle, nil, nil); err != nil {
+		t.Fatalf("unexpected error repacking unmodified bundle: %+v", err)
+	}
+
+	if err := image.SetConfig(ctx, ispec.ImageConfig{User: "1000:100"}, nil); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+	config, err := image.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Config.User != "1000:100" {
+		t.Errorf("config not updated: user is %q", config.Config.User)
+	}
+	if len(config.RootFS.DiffIDs) != 3 {
+		t.Errorf("expected 3 diff ids, got %d", len(config.RootFS.DiffIDs))
+	}
+	// Only the repacks with a history entry were recorded.
+	if len(config.History) != 2 || config.History[1].CreatedBy != "repack second" || config.History[1].Created.IsZero() {
+		t.Errorf("unexpected history: %v", config.History)
+	}
+
+	// The repacked image unpacks to the same rootfs.
+	other := filepath.Join(dir, "other")
+	if err := image.Unpack(ctx, other, &layer.UnpackOptions{MapOptions: mapOptions}); err != nil {
+		t.Fatalf("unexpected error unpacking repacked image: %+v", err)
+	}
+	for _, name := range []string{"first", "second"} {
+		data, err := ioutil.ReadFile(filepath.Join(other, layer.RootfsName, name))
+		if err != nil {
+			t.Fatalf("repacked file missing: %+v", err)
+		}
+		if string(data) != name {
+			t.Errorf("unexpected contents of %s: %q", name, data)
+		}
+	}
+
+	// Modifications of the tag by someone else are detected.
+	stale, err := OpenImage(imagePath, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stale.Close()
+	if err := image.SetConfig(ctx, ispec.ImageConfig{User: "new:user"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.SetConfig(ctx, ispec.ImageConfig{User: "stale:user"}, nil); errors.Cause(err) != cas.ErrClobber {
+		t.Errorf("expected clobber error modifying stale image, got %+v", err)
+	}
+}
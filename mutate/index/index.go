@@ -0,0 +1,399 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package index implements the construction and modification of OCI image
+// indexes (manifest lists), in the same high-level fashion as
+// github.com/openSUSE/umoci/mutate does for image manifests. This allows for
+// multi-platform images to be assembled from several single-platform images.
+package index
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/jsonmerge"
+	"github.com/openSUSE/umoci/pkg/jsonpatch"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Mutator is a wrapper around a cas.Engine instance, and is used to modify a
+// given manifest list (or create a new one). In order for changes to be
+// comitted you must call .Commit().
+type Mutator struct {
+	// These are the arguments we got in New(). source is nil if the Mutator
+	// was created with NewEmpty().
+	engine casext.Engine
+	source *ispec.Descriptor
+
+	// Cached value of the manifest list, and its original JSON (used to
+	// preserve any fields unknown to ispec when committing).
+	list    *ispec.ManifestList
+	listRaw []byte
+}
+
+// cache ensures that the cached version of the manifest list has been loaded.
+// Calling this function more than once will do nothing.
+func (m *Mutator) cache(ctx context.Context) error {
+	if m.list != nil {
+		return nil
+	}
+
+	blob, err := m.engine.FromDescriptor(ctx, *m.source)
+	if err != nil {
+		return errors.Wrap(err, "cache source manifest list")
+	}
+	defer blob.Close()
+
+	list, ok := blob.Data.(ispec.ManifestList)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest list blob type: %s", blob.MediaType)
+	}
+
+	// Make a copy of the manifest list.
+	list.Manifests = append([]ispec.ManifestDescriptor{}, list.Manifests...)
+	list.Annotations = copyAnnotations(list.Annotations)
+	m.list = &list
+	m.listRaw = blob.Raw
+	return nil
+}
+
+// New creates a new Mutator for the given descriptor (which _must_ have a
+// MediaType of ispec.MediaTypeImageManifestList).
+func New(engine cas.Engine, src ispec.Descriptor) (*Mutator, error) {
+	src = casext.ConvertDescriptor(src)
+	if src.MediaType != ispec.MediaTypeImageManifestList {
+		return nil, errors.Errorf("unsupported source type: %s", src.MediaType)
+	}
+
+	return &Mutator{
+		engine: casext.Engine{engine},
+		source: &src,
+	}, nil
+}
+
+// NewEmpty creates a new Mutator for a new, empty manifest list.
+func NewEmpty(engine cas.Engine) *Mutator {
+	return &Mutator{
+		engine: casext.Engine{engine},
+		list: &ispec.ManifestList{
+			Versioned: imeta.Versioned{
+				SchemaVersion: 2,
+			},
+			Manifests: []ispec.ManifestDescriptor{},
+		},
+	}
+}
+
+// Manifests returns the current (cached) set of manifests in the manifest
+// list.
+func (m *Mutator) Manifests(ctx context.Context) ([]ispec.ManifestDescriptor, error) {
+	if err := m.cache(ctx); err != nil {
+		return nil, errors.Wrap(err, "getting cache failed")
+	}
+
+	return append([]ispec.ManifestDescriptor{}, m.list.Manifests...), nil
+}
+
+// Annotations returns the current (cached) set of annotations of the manifest
+// list, which should be used as the source for any modifications using
+// SetAnnotations.
+func (m *Mutator) Annotations(ctx context.Context) (map[string]string, error) {
+	if err := m.cache(ctx); err != nil {
+		return nil, errors.Wrap(err, "getting cache failed")
+	}
+
+	return copyAnnotations(m.list.Annotations), nil
+}
+
+// SetAnnotations replaces the annotations of the manifest list.
+func (m *Mutator) SetAnnotations(ctx context.Context, annotations map[string]string) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	m.list.Annotations = copyAnnotations(annotations)
+	return nil
+}
+
+// entryIndex returns the index of the single entry of the manifest list which
+// matches the given platform (as defined by casext.PlatformMatches).
+func (m *Mutator) entryIndex(platform ispec.Platform) (int, error) {
+	found := -1
+	for idx, entry := range m.list.Manifests {
+		if !casext.PlatformMatches(platform, entry.Platform) {
+			continue
+		}
+		if found >= 0 {
+			return -1, errors.Errorf("more than one manifest for platform %s/%s in manifest list", platform.OS, platform.Architecture)
+		}
+		found = idx
+	}
+	if found < 0 {
+		return -1, errors.Errorf("no manifest for platform %s/%s in manifest list", platform.OS, platform.Architecture)
+	}
+	return found, nil
+}
+
+// document returns the JSON of the (cached) manifest list, including any
+// fields unknown to ispec.
+func (m *Mutator) document() ([]byte, error) {
+	list, err := jsonmerge.Preserve(m.listRaw, m.list)
+	if err != nil {
+		return nil, errors.Wrap(err, "preserve unknown manifest list fields")
+	}
+	return json.Marshal(list)
+}
+
+// patch applies the given JSON Patch to the (cached) manifest list. This is
+// used to modify fields unknown to ispec, such as the annotations of the
+// descriptors in the manifest list.
+func (m *Mutator) patch(patch jsonpatch.Patch) error {
+	original, err := m.document()
+	if err != nil {
+		return err
+	}
+	patched, err := patch.Apply(original)
+	if err != nil {
+		return errors.Wrap(err, "apply patch to manifest list")
+	}
+
+	var list ispec.ManifestList
+	if err := json.Unmarshal(patched, &list); err != nil {
+		return errors.Wrap(err, "parse patched manifest list")
+	}
+	m.list = &list
+	m.listRaw = patched
+	return nil
+}
+
+// DescriptorAnnotations returns the annotations of the descriptor of the
+// manifest for the given platform in the manifest list. Exactly one entry of
+// the manifest list must match the platform.
+func (m *Mutator) DescriptorAnnotations(ctx context.Context, platform ispec.Platform) (map[string]string, error) {
+	if err := m.cache(ctx); err != nil {
+		return nil, errors.Wrap(err, "getting cache failed")
+	}
+	idx, err := m.entryIndex(platform)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := m.document()
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Manifests []struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, errors.Wrap(err, "parse manifest list")
+	}
+	annotations := map[string]string{}
+	for key, value := range list.Manifests[idx].Annotations {
+		annotations[key] = value
+	}
+	return annotations, nil
+}
+
+// SetDescriptorAnnotation sets the annotation with the given key to value, in
+// the descriptor of the manifest for the given platform in the manifest list.
+// Exactly one entry of the manifest list must match the platform. Note that
+// the annotations of an entry are lost if it is replaced with Add.
+func (m *Mutator) SetDescriptorAnnotation(ctx context.Context, platform ispec.Platform, key, value string) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if key == "" {
+		return errors.Errorf("annotation key cannot be empty")
+	}
+	idx, err := m.entryIndex(platform)
+	if err != nil {
+		return err
+	}
+
+	annotations, err := m.DescriptorAnnotations(ctx, platform)
+	if err != nil {
+		return err
+	}
+	annotations[key] = value
+	return m.setDescriptorAnnotations(idx, annotations)
+}
+
+// DeleteDescriptorAnnotation removes the annotation with the given key from
+// the descriptor of the manifest for the given platform in the manifest list.
+// Exactly one entry of the manifest list must match the platform. It is not
+// an error if the annotation doesn't exist.
+func (m *Mutator) DeleteDescriptorAnnotation(ctx context.Context, platform ispec.Platform, key string) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	idx, err := m.entryIndex(platform)
+	if err != nil {
+		return err
+	}
+
+	annotations, err := m.DescriptorAnnotations(ctx, platform)
+	if err != nil {
+		return err
+	}
+	if _, ok := annotations[key]; !ok {
+		return nil
+	}
+	delete(annotations, key)
+	return m.setDescriptorAnnotations(idx, annotations)
+}
+
+// setDescriptorAnnotations replaces the annotations of the idx-th descriptor
+// in the manifest list (removing them entirely if there are none).
+func (m *Mutator) setDescriptorAnnotations(idx int, annotations map[string]string) error {
+	path := jsonpatch.Pointer("manifests", strconv.Itoa(idx), "annotations")
+
+	// "add" replaces existing values, and so adding a value before removing
+	// it ensures the removal succeeds even if it didn't exist.
+	value, err := json.Marshal(annotations)
+	if err != nil {
+		return errors.Wrap(err, "encode annotations")
+	}
+	patch := jsonpatch.Patch{{Op: "add", Path: path, Value: value}}
+	if len(annotations) == 0 {
+		patch = append(patch, jsonpatch.Operation{Op: "remove", Path: path})
+	}
+	return m.patch(patch)
+}
+
+// Add adds the given image manifest to the manifest list, for the given
+// platform. If the manifest list already has an entry with the same
+// operating system, architecture, variant and operating system version, it is
+// replaced. If platform has no operating system or architecture set, the
+// platform is taken from the image configuration of the manifest (see
+// casext.Engine.ManifestPlatform).
+func (m *Mutator) Add(ctx context.Context, manifest ispec.Descriptor, platform ispec.Platform) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	manifest = casext.ConvertDescriptor(manifest)
+	if manifest.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Errorf("unsupported manifest type: %s", manifest.MediaType)
+	}
+
+	if platform.OS == "" || platform.Architecture == "" {
+		config, err := m.engine.ManifestPlatform(ctx, manifest)
+		if err != nil {
+			return errors.Wrap(err, "get manifest platform")
+		}
+		if platform.OS == "" {
+			platform.OS = config.OS
+		}
+		if platform.Architecture == "" {
+			platform.Architecture = config.Architecture
+		}
+		if platform.Variant == "" {
+			platform.Variant = config.Variant
+		}
+		if platform.OSVersion == "" {
+			platform.OSVersion = config.OSVersion
+		}
+		if platform.OSFeatures == nil {
+			platform.OSFeatures = config.OSFeatures
+		}
+	}
+
+	entry := ispec.ManifestDescriptor{
+		Descriptor: manifest,
+		Platform:   platform,
+	}
+	for idx, old := range m.list.Manifests {
+		if samePlatform(old.Platform, platform) {
+			m.list.Manifests[idx] = entry
+			return nil
+		}
+	}
+	m.list.Manifests = append(m.list.Manifests, entry)
+	return nil
+}
+
+// Remove removes all entries from the manifest list which match the given
+// platform (as defined by casext.PlatformMatches). An error is returned if no
+// entries match.
+func (m *Mutator) Remove(ctx context.Context, platform ispec.Platform) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	var manifests []ispec.ManifestDescriptor
+	for _, entry := range m.list.Manifests {
+		if !casext.PlatformMatches(platform, entry.Platform) {
+			manifests = append(manifests, entry)
+		}
+	}
+	if len(manifests) == len(m.list.Manifests) {
+		return errors.Errorf("no manifest for platform %s/%s in manifest list", platform.OS, platform.Architecture)
+	}
+
+	m.list.Manifests = append([]ispec.ManifestDescriptor{}, manifests...)
+	return nil
+}
+
+// Commit writes the modified manifest list to the engine. It then returns a
+// new manifest list descriptor (which can be used in place of the source
+// descriptor provided to New).
+func (m *Mutator) Commit(ctx context.Context) (ispec.Descriptor, error) {
+	if err := m.cache(ctx); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "getting cache failed")
+	}
+
+	list, err := jsonmerge.Preserve(m.listRaw, m.list)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "preserve unknown manifest list fields")
+	}
+	listDigest, listSize, err := m.engine.PutBlobJSON(ctx, list)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "commit manifest list blob")
+	}
+
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifestList,
+		Digest:    listDigest,
+		Size:      listSize,
+	}, nil
+}
+
+// samePlatform returns whether the two platforms have the same operating
+// system, architecture, variant and operating system version.
+func samePlatform(a, b ispec.Platform) bool {
+	return a.OS == b.OS && a.Architecture == b.Architecture && a.Variant == b.Variant && a.OSVersion == b.OSVersion
+}
+
+func copyAnnotations(annotations map[string]string) map[string]string {
+	if annotations == nil {
+		return nil
+	}
+	copied := map[string]string{}
+	for k, v := range annotations {
+		copied[k] = v
+	}
+	return copied
+}
@@ -0,0 +1,401 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package index
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+
+	// Include all known drivers.
+	_ "github.com/openSUSE/umoci/oci/cas/drivers"
+)
+
+func setup(t *testing.T, dir string) cas.Engine {
+	dir = filepath.Join(dir, "image")
+	if err := cas.Create(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := cas.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine
+}
+
+// putManifest creates a new (empty) image manifest for the given platform.
+func putManifest(t *testing.T, engine cas.Engine, osName, arch string) ispec.Descriptor {
+	engineExt := casext.Engine{engine}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Image{
+		OS:           osName,
+		Architecture: arch,
+		RootFS: ispec.RootFS{
+			Type: "layers",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+}
+
+func TestIndexAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestIndexAdd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine := setup(t, dir)
+	defer engine.Close()
+
+	amd64 := putManifest(t, engine, "linux", "amd64")
+	arm64 := putManifest(t, engine, "linux", "arm64")
+	// Explicit platforms take precedence over the configuration.
+	arm64v8 := putManifest(t, engine, "linux", "aarch64")
+
+	mutator := NewEmpty(engine)
+
+	// The platform should be taken from the configuration.
+	if err := mutator.Add(context.Background(), amd64, ispec.Platform{}); err != nil {
+		t.Fatalf("unexpected error adding manifest: %+v", err)
+	}
+	if err := mutator.Add(context.Background(), arm64, ispec.Platform{}); err != nil {
+		t.Fatalf("unexpected error adding manifest: %+v", err)
+	}
+	// Adding the same platform again should replace the entry.
+	if err := mutator.Add(context.Background(), arm64v8, ispec.Platform{OS: "linux", Architecture: "arm64"}); err != nil {
+		t.Fatalf("unexpected error adding manifest: %+v", err)
+	}
+
+	// Only manifests can be added.
+	list, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing: %+v", err)
+	}
+	if err := mutator.Add(context.Background(), list, ispec.Platform{OS: "linux", Architecture: "s390x"}); err == nil {
+		t.Errorf("expected error adding manifest list to manifest list")
+	}
+
+	mutator, err = New(engine, list)
+	if err != nil {
+		t.Fatalf("unexpected error creating mutator: %+v", err)
+	}
+	manifests, err := mutator.Manifests(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting manifests: %+v", err)
+	}
+
+	if len(manifests) != 2 {
+		t.Fatalf("expected 2 manifests, got %d", len(manifests))
+	}
+	if manifests[0].Digest != amd64.Digest || manifests[0].Platform.Architecture != "amd64" {
+		t.Errorf("unexpected first entry: %#v", manifests[0])
+	}
+	if manifests[1].Digest != arm64v8.Digest || manifests[1].Platform.Architecture != "arm64" {
+		t.Errorf("unexpected second entry: %#v", manifests[1])
+	}
+}
+
+func TestIndexRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestIndexRemove")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine := setup(t, dir)
+	defer engine.Close()
+
+	mutator := NewEmpty(engine)
+	for _, arch := range []string{"amd64", "arm64", "ppc64le"} {
+		if err := mutator.Add(context.Background(), putManifest(t, engine, "linux", arch), ispec.Platform{}); err != nil {
+			t.Fatalf("unexpected error adding manifest: %+v", err)
+		}
+	}
+
+	if err := mutator.Remove(context.Background(), ispec.Platform{OS: "linux", Architecture: "arm64"}); err != nil {
+		t.Fatalf("unexpected error removing manifest: %+v", err)
+	}
+	if err := mutator.Remove(context.Background(), ispec.Platform{OS: "linux", Architecture: "arm64"}); err == nil {
+		t.Errorf("expected error removing missing platform")
+	}
+
+	manifests, err := mutator.Manifests(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting manifests: %+v", err)
+	}
+	if len(manifests) != 2 {
+		t.Fatalf("expected 2 manifests, got %d", len(manifests))
+	}
+	for _, entry := range manifests {
+		if entry.Platform.Architecture == "arm64" {
+			t.Errorf("removed entry still present: %#v", entry)
+		}
+	}
+}
+
+// putWindowsManifest creates a new (empty) image manifest for Windows, with
+// the given os.version and os.features in its configuration.
+func putWindowsManifest(t *testing.T, engine cas.Engine, osVersion string, osFeatures []string) ispec.Descriptor {
+	engineExt := casext.Engine{engine}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), map[string]interface{}{
+		"os":           "windows",
+		"architecture": "amd64",
+		"os.version":   osVersion,
+		"os.features":  osFeatures,
+		"rootfs": ispec.RootFS{
+			Type: "layers",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+}
+
+func TestIndexWindows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestIndexWindows")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine := setup(t, dir)
+	defer engine.Close()
+
+	ltsc2019 := putWindowsManifest(t, engine, "10.0.17763.1", nil)
+	ltsc2022 := putWindowsManifest(t, engine, "10.0.20348.1", []string{"win32k"})
+
+	// Entries which differ only in their os.version are kept apart, and the
+	// os.version and os.features are taken from the configuration.
+	mutator := NewEmpty(engine)
+	for _, manifest := range []ispec.Descriptor{ltsc2019, ltsc2022, putManifest(t, engine, "linux", "amd64")} {
+		if err := mutator.Add(context.Background(), manifest, ispec.Platform{}); err != nil {
+			t.Fatalf("unexpected error adding manifest: %+v", err)
+		}
+	}
+	manifests, err := mutator.Manifests(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting manifests: %+v", err)
+	}
+	if len(manifests) != 3 {
+		t.Fatalf("expected 3 manifests, got %d", len(manifests))
+	}
+	expected := ispec.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.1", OSFeatures: []string{"win32k"}}
+	if manifests[1].Digest != ltsc2022.Digest || !reflect.DeepEqual(manifests[1].Platform, expected) {
+		t.Errorf("unexpected second entry: %#v", manifests[1])
+	}
+
+	// A platform without an os.version matches both entries.
+	if _, err := mutator.DescriptorAnnotations(context.Background(), ispec.Platform{OS: "windows", Architecture: "amd64"}); err == nil {
+		t.Errorf("expected error getting annotations of ambiguous platform")
+	}
+	if err := mutator.Remove(context.Background(), ispec.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1"}); err != nil {
+		t.Fatalf("unexpected error removing manifest: %+v", err)
+	}
+	manifests, err = mutator.Manifests(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting manifests: %+v", err)
+	}
+	if len(manifests) != 2 || manifests[0].Digest != ltsc2022.Digest {
+		t.Errorf("unexpected manifests after removal: %#v", manifests)
+	}
+}
+
+func TestIndexAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestIndexAnnotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine := setup(t, dir)
+	defer engine.Close()
+
+	mutator := NewEmpty(engine)
+	if err := mutator.SetAnnotations(context.Background(), map[string]string{"a": "b"}); err != nil {
+		t.Fatalf("unexpected error setting annotations: %+v", err)
+	}
+	list, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing: %+v", err)
+	}
+
+	blob, err := casext.Engine{engine}.FromDescriptor(context.Background(), list)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest list: %+v", err)
+	}
+	defer blob.Close()
+
+	manifestList, ok := blob.Data.(ispec.ManifestList)
+	if !ok {
+		t.Fatalf("manifest list blob has unexpected type: %T", blob.Data)
+	}
+	if manifestList.Annotations["a"] != "b" {
+		t.Errorf("unexpected annotations: %v", manifestList.Annotations)
+	}
+
+	// Modifying the returned annotations must not modify the mutator.
+	mutator, err = New(engine, list)
+	if err != nil {
+		t.Fatalf("unexpected error creating mutator: %+v", err)
+	}
+	annotations, err := mutator.Annotations(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting annotations: %+v", err)
+	}
+	annotations["a"] = "c"
+	if annotations, _ := mutator.Annotations(context.Background()); annotations["a"] != "b" {
+		t.Errorf("mutator annotations were modified: %v", annotations)
+	}
+}
+
+func TestIndexDescriptorAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestIndexDescriptorAnnotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine := setup(t, dir)
+	defer engine.Close()
+
+	amd64 := ispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := ispec.Platform{OS: "linux", Architecture: "arm64"}
+
+	mutator := NewEmpty(engine)
+	if err := mutator.Add(context.Background(), putManifest(t, engine, "linux", "amd64"), ispec.Platform{}); err != nil {
+		t.Fatalf("unexpected error adding manifest: %+v", err)
+	}
+	if err := mutator.Add(context.Background(), putManifest(t, engine, "linux", "arm64"), ispec.Platform{}); err != nil {
+		t.Fatalf("unexpected error adding manifest: %+v", err)
+	}
+
+	if err := mutator.SetDescriptorAnnotation(context.Background(), amd64, "a", "b"); err != nil {
+		t.Fatalf("unexpected error setting annotation: %+v", err)
+	}
+	if err := mutator.SetDescriptorAnnotation(context.Background(), amd64, "c", "d"); err != nil {
+		t.Fatalf("unexpected error setting annotation: %+v", err)
+	}
+	if err := mutator.DeleteDescriptorAnnotation(context.Background(), amd64, "c"); err != nil {
+		t.Fatalf("unexpected error deleting annotation: %+v", err)
+	}
+	if err := mutator.SetDescriptorAnnotation(context.Background(), ispec.Platform{OS: "linux", Architecture: "s390x"}, "a", "b"); err == nil {
+		t.Errorf("expected error setting annotation for missing platform")
+	}
+
+	list, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing: %+v", err)
+	}
+
+	// The annotations are stored in the manifest list.
+	reader, err := engine.GetBlob(context.Background(), list.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest list: %+v", err)
+	}
+	defer reader.Close()
+	var raw struct {
+		Manifests []struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"manifests"`
+	}
+	if err := json.NewDecoder(reader).Decode(&raw); err != nil {
+		t.Fatalf("unexpected error parsing manifest list: %+v", err)
+	}
+	if len(raw.Manifests) != 2 {
+		t.Fatalf("expected 2 manifests, got %d", len(raw.Manifests))
+	}
+	if !reflect.DeepEqual(raw.Manifests[0].Annotations, map[string]string{"a": "b"}) {
+		t.Errorf("unexpected amd64 annotations: %v", raw.Manifests[0].Annotations)
+	}
+	if raw.Manifests[1].Annotations != nil {
+		t.Errorf("unexpected arm64 annotations: %v", raw.Manifests[1].Annotations)
+	}
+
+	// They are preserved by unrelated modifications.
+	mutator, err = New(engine, list)
+	if err != nil {
+		t.Fatalf("unexpected error creating mutator: %+v", err)
+	}
+	if err := mutator.SetAnnotations(context.Background(), map[string]string{"x": "y"}); err != nil {
+		t.Fatalf("unexpected error setting annotations: %+v", err)
+	}
+	if err := mutator.DeleteDescriptorAnnotation(context.Background(), arm64, "a"); err != nil {
+		t.Fatalf("unexpected error deleting missing annotation: %+v", err)
+	}
+	annotations, err := mutator.DescriptorAnnotations(context.Background(), amd64)
+	if err != nil {
+		t.Fatalf("unexpected error getting annotations: %+v", err)
+	}
+	if !reflect.DeepEqual(annotations, map[string]string{"a": "b"}) {
+		t.Errorf("unexpected amd64 annotations: %v", annotations)
+	}
+}
@@ -18,18 +18,41 @@
 package mutate
 
 import (
+	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"io"
+	"os"
+	"reflect"
 	"time"
 
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/openSUSE/umoci/pkg/jsonmerge"
+	"github.com/openSUSE/umoci/pkg/jsonpatch"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
+// Errors returned by Mutator. They are usually wrapped with more information,
+// so use errors.Is to check for them.
+var (
+	// ErrIncompatibleMediaType is returned when an image (or base image) is
+	// not a manifest which can be modified.
+	ErrIncompatibleMediaType = errors.New("incompatible media type")
+
+	// ErrLayerOutOfRange is returned when a layer index is outside of the
+	// layers of the image.
+	ErrLayerOutOfRange = errors.New("layer index out of range")
+
+	// ErrNotBasedOn is returned by Rebase when the image is not based on the
+	// old base image.
+	ErrNotBasedOn = errors.New("image is not based on the old base image")
+)
+
 func configPtr(c ispec.Image) *ispec.Image         { return &c }
 func manifestPtr(m ispec.Manifest) *ispec.Manifest { return &m }
 
@@ -47,6 +70,38 @@ type Mutator struct {
 	// Cached values of the configuration and manifest.
 	manifest *ispec.Manifest
 	config   *ispec.Image
+
+	// The original JSON of the cached configuration and manifest, used to
+	// preserve any fields unknown to ispec when committing.
+	manifestRaw []byte
+	configRaw   []byte
+
+	// compressor is used to compress added layers (see SetCompressor).
+	compressor Compressor
+
+	// maxBlobSize is the maximum size of added layer blobs (see
+	// SetMaxBlobSize), and chunks are the chunked layers of the image.
+	maxBlobSize int64
+	chunks      casext.LayerChunks
+
+	// noHistory specifies whether history entries are added (see
+	// SetNoHistory).
+	noHistory bool
+}
+
+// Compressor returns a writer which compresses the data written to it (using
+// gzip) and writes it to w. Closing the returned writer must not close w.
+type Compressor func(w io.Writer) (io.WriteCloser, error)
+
+// LayerWriter is implemented by the writers returned by a Compressor which
+// also rewrite the layer they compress (such as to produce an eStargz layer),
+// so that the uncompressed layer blob is not the layer written to them. Once
+// the writer has been closed, DiffID returns the digest of the uncompressed
+// layer blob and Annotations returns the annotations of its descriptor.
+type LayerWriter interface {
+	io.WriteCloser
+	DiffID() digest.Digest
+	Annotations() map[string]string
 }
 
 // Meta is a wrapper around the "safe" fields in ispec.Image, which can be
@@ -88,8 +143,15 @@ func (m *Mutator) cache(ctx context.Context) error {
 			return errors.Errorf("[internal error] unknown manifest blob type: %s", blob.MediaType)
 		}
 
+		chunks, err := casext.ManifestLayerChunks(manifest)
+		if err != nil {
+			return errors.Wrap(err, "cache source manifest")
+		}
+
 		// Make a copy of the manifest.
 		m.manifest = manifestPtr(manifest)
+		m.manifestRaw = blob.Raw
+		m.chunks = chunks
 	}
 
 	if m.config == nil {
@@ -107,6 +169,7 @@ func (m *Mutator) cache(ctx context.Context) error {
 
 		// Make a copy of the config and configDescriptor.
 		m.config = configPtr(config)
+		m.configRaw = blob.Raw
 	}
 
 	return nil
@@ -115,9 +178,12 @@ func (m *Mutator) cache(ctx context.Context) error {
 // New creates a new Mutator for the given descriptor (which _must_ have a
 // MediaType of ispec.MediaTypeImageManifest.
 func New(engine cas.Engine, src ispec.Descriptor) (*Mutator, error) {
+	// Foreign manifests (such as Docker manifests) are translated by casext.
+	src = casext.ConvertDescriptor(src)
+
 	// TODO: Implement manifest list support.
 	if src.MediaType != ispec.MediaTypeImageManifest {
-		return nil, errors.Errorf("unsupported source type: %s", src.MediaType)
+		return nil, errors.Wrapf(ErrIncompatibleMediaType, "unsupported source type %s", src.MediaType)
 	}
 
 	return &Mutator{
@@ -126,6 +192,30 @@ func New(engine cas.Engine, src ispec.Descriptor) (*Mutator, error) {
 	}, nil
 }
 
+// SetCompressor sets the Compressor used to compress layers added to the
+// image. By default, layers are compressed with gzip.NewWriter. The layers
+// must still be gzip-compressed, as they are added with a gzip media type.
+func (m *Mutator) SetCompressor(compressor Compressor) {
+	m.compressor = compressor
+}
+
+// SetMaxBlobSize sets the maximum size of the blobs of layers added to the
+// image. Larger layers are split into chunks (see casext.PutBlobChunks) which
+// are described by the casext.LayerChunksAnnotation of the manifest. A size of
+// 0 (the default) means that layers are never split.
+func (m *Mutator) SetMaxBlobSize(size int64) {
+	m.maxBlobSize = size
+}
+
+// SetNoHistory sets whether the history entries given to Set, Add,
+// AddNonDistributable, Insert and Squash are ignored rather than being added
+// to the image's history. This is intended for build pipelines which manage
+// the history themselves. Note that layers added without a history entry mean
+// that the history of the image no longer describes its layers.
+func (m *Mutator) SetNoHistory(noHistory bool) {
+	m.noHistory = noHistory
+}
+
 // Config returns the current (cached) image configuration, which should be
 // used as the source for any modifications of the configuration using
 // Set.
@@ -168,6 +258,73 @@ func (m *Mutator) Annotations(ctx context.Context) (map[string]string, error) {
 	return annotations, nil
 }
 
+// AnnotationTarget identifies the set of annotations of an image modified by
+// SetAnnotation and DeleteAnnotation.
+type AnnotationTarget string
+
+const (
+	// AnnotationManifest refers to the annotations of the image manifest.
+	AnnotationManifest AnnotationTarget = "manifest"
+
+	// AnnotationConfig refers to the labels of the image configuration
+	// (ispec.ImageConfig.Labels), which are the image configuration's
+	// equivalent of annotations.
+	AnnotationConfig AnnotationTarget = "config"
+)
+
+// annotations returns the (cached) set of annotations referred to by target,
+// creating it if necessary.
+func (m *Mutator) annotations(target AnnotationTarget) (map[string]string, error) {
+	switch target {
+	case AnnotationManifest:
+		if m.manifest.Annotations == nil {
+			m.manifest.Annotations = map[string]string{}
+		}
+		return m.manifest.Annotations, nil
+	case AnnotationConfig:
+		if m.config.Config.Labels == nil {
+			m.config.Config.Labels = map[string]string{}
+		}
+		return m.config.Config.Labels, nil
+	}
+	return nil, errors.Errorf("unknown annotation target: %s", target)
+}
+
+// SetAnnotation sets the annotation with the given key to value, in the set
+// of annotations referred to by target. Unlike Set, no history entry is
+// added.
+func (m *Mutator) SetAnnotation(ctx context.Context, target AnnotationTarget, key, value string) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if key == "" {
+		return errors.Errorf("annotation key cannot be empty")
+	}
+
+	annotations, err := m.annotations(target)
+	if err != nil {
+		return err
+	}
+	annotations[key] = value
+	return nil
+}
+
+// DeleteAnnotation removes the annotation with the given key from the set of
+// annotations referred to by target. It is not an error if the annotation
+// doesn't exist. Unlike Set, no history entry is added.
+func (m *Mutator) DeleteAnnotation(ctx context.Context, target AnnotationTarget, key string) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	annotations, err := m.annotations(target)
+	if err != nil {
+		return err
+	}
+	delete(annotations, key)
+	return nil
+}
+
 // Set sets the image configuration and metadata to the given values. The
 // provided ispec.History entry is appended to the image's history and should
 // correspond to what operations were made to the configuration.
@@ -189,55 +346,226 @@ func (m *Mutator) Set(ctx context.Context, config ispec.ImageConfig, meta Meta,
 	m.config.OS = meta.OS
 
 	// Append history.
-	history.EmptyLayer = true
-	m.config.History = append(m.config.History, history)
+	if !m.noHistory {
+		history.EmptyLayer = true
+		m.config.History = append(m.config.History, history)
+	}
 
 	return nil
 }
 
+// Image returns the current (cached) image configuration in full, which
+// should be used as the source for any modifications of the configuration
+// using SetConfig.
+func (m *Mutator) Image(ctx context.Context) (ispec.Image, error) {
+	if err := m.cache(ctx); err != nil {
+		return ispec.Image{}, errors.Wrap(err, "getting cache failed")
+	}
+
+	return *m.config, nil
+}
+
+// checkRootFS returns an error if the layers described by the given image
+// configuration don't match the layers of the image.
+func (m *Mutator) checkRootFS(config ispec.Image) error {
+	if !reflect.DeepEqual(config.RootFS, m.config.RootFS) {
+		return errors.Errorf("rootfs of the image configuration cannot be modified")
+	}
+	return nil
+}
+
+// SetConfig replaces the entire image configuration with the given value. No
+// history entry is added (the caller may modify the history of the image as
+// part of config). Fields of the original configuration which are unknown to
+// ispec.Image are preserved. Because the layers of the image are not
+// modified, config.RootFS must be identical to the current value.
+func (m *Mutator) SetConfig(ctx context.Context, config ispec.Image) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if err := m.checkRootFS(config); err != nil {
+		return err
+	}
+
+	m.config = configPtr(config)
+	return nil
+}
+
+// PatchConfig applies the given JSON Patch (RFC 6902) to the image
+// configuration. Unlike SetConfig, the patch is applied to the entire JSON
+// document and so may also modify fields unknown to ispec.Image. As with
+// SetConfig, the patch may not modify the rootfs of the configuration and no
+// history entry is added.
+func (m *Mutator) PatchConfig(ctx context.Context, patch jsonpatch.Patch) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	original, err := jsonmerge.Preserve(m.configRaw, m.config)
+	if err != nil {
+		return errors.Wrap(err, "preserve unknown config fields")
+	}
+	originalRaw, err := json.Marshal(original)
+	if err != nil {
+		return errors.Wrap(err, "encode config")
+	}
+	patchedRaw, err := patch.Apply(originalRaw)
+	if err != nil {
+		return errors.Wrap(err, "apply patch to config")
+	}
+
+	var config ispec.Image
+	if err := json.Unmarshal(patchedRaw, &config); err != nil {
+		return errors.Wrap(err, "parse patched config")
+	}
+	if err := m.checkRootFS(config); err != nil {
+		return err
+	}
+
+	m.config = configPtr(config)
+	m.configRaw = patchedRaw
+	return nil
+}
+
 //
 
 // add adds the given layer to the CAS, and mutates the configuration to
-// include the diffID. The returned string is the digest of the *compressed*
-// layer (which is compressed by us).
-func (m *Mutator) add(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+// include the diffID. The returned descriptor (which has no media type) is of
+// the *compressed* layer (which is compressed by us), and any returned
+// annotations (from a LayerWriter) should be set with annotateLayer.
+func (m *Mutator) add(ctx context.Context, reader io.Reader) (ispec.Descriptor, map[string]string, error) {
 	if err := m.cache(ctx); err != nil {
-		return "", -1, errors.Wrap(err, "getting cache failed")
+		return ispec.Descriptor{}, nil, errors.Wrap(err, "getting cache failed")
 	}
 
 	// XXX: We should not have to do this check here.
 	if cas.BlobAlgorithm != "sha256" {
-		return "", -1, errors.Errorf("unknown blob algorithm: %s", cas.BlobAlgorithm)
+		return ispec.Descriptor{}, nil, errors.Errorf("unknown blob algorithm: %s", cas.BlobAlgorithm)
 	}
 
+	start := time.Now()
+
+	// We report the progress of generating the layer (rather than the
+	// progress of writing the compressed blob).
+	tracker := event.StartLayer(ctx, event.OpPack, "", -1)
+	defer tracker.Done("", nil)
+	progressReader := tracker.Reader(reader)
+
 	diffidDigester := cas.BlobAlgorithm.Digester()
-	hashReader := io.TeeReader(reader, diffidDigester.Hash())
+	hashReader := io.TeeReader(progressReader, diffidDigester.Hash())
 
 	pipeReader, pipeWriter := io.Pipe()
 	defer pipeReader.Close()
 
-	gzw := gzip.NewWriter(pipeWriter)
-	defer gzw.Close()
+	var gzw io.WriteCloser = gzip.NewWriter(pipeWriter)
+	if m.compressor != nil {
+		var err error
+		gzw, err = m.compressor(pipeWriter)
+		if err != nil {
+			return ispec.Descriptor{}, nil, errors.Wrap(err, "create compressor")
+		}
+	}
+	// uncompressedSize is only read once the compressed layer has been read
+	// to the end, by which point the goroutine has finished writing it.
+	var uncompressedSize int64
 	go func() {
-		_, err := io.Copy(gzw, hashReader)
+		n, err := io.Copy(gzw, hashReader)
+		uncompressedSize = n
+		// The compressor must always be closed, so that any goroutines it
+		// started are stopped.
+		if closeErr := gzw.Close(); err == nil {
+			err = closeErr
+		}
 		if err != nil {
 			pipeWriter.CloseWithError(errors.Wrap(err, "compressing layer"))
 			return
 		}
-		gzw.Close()
 		pipeWriter.Close()
 	}()
 
-	layerDigest, layerSize, err := m.engine.PutBlob(ctx, pipeReader)
+	var (
+		layerDigest digest.Digest
+		layerSize   int64
+		layerChunks []ispec.Descriptor
+		err         error
+	)
+	if m.maxBlobSize > 0 {
+		layerDigest, layerSize, layerChunks, err = m.engine.PutBlobChunks(event.WithoutProgress(ctx), pipeReader, m.maxBlobSize)
+	} else {
+		layerDigest, layerSize, err = m.engine.PutBlob(event.WithoutProgress(ctx), pipeReader)
+	}
 	if err != nil {
-		return "", -1, errors.Wrap(err, "put layer blob")
+		return ispec.Descriptor{}, nil, errors.Wrap(err, "put layer blob")
+	}
+	if layerChunks != nil {
+		if m.chunks == nil {
+			m.chunks = casext.LayerChunks{}
+		}
+		m.chunks[layerDigest] = layerChunks
 	}
+	tracker.Done(layerDigest, nil)
 
-	// Add DiffID to configuration.
+	// Add DiffID to configuration. If the compressor rewrote the layer, the
+	// DiffID is of the rewritten layer rather than what we read.
 	layerDiffID := diffidDigester.Digest()
+	var annotations map[string]string
+	if lw, ok := gzw.(LayerWriter); ok {
+		layerDiffID = lw.DiffID()
+		annotations = lw.Annotations()
+	}
 	m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs, layerDiffID.String())
 
-	return layerDigest, layerSize, nil
+	event.Emit(ctx, event.Event{
+		Type:             event.LayerAdded,
+		Digest:           layerDigest,
+		Size:             layerSize,
+		UncompressedSize: uncompressedSize,
+		Duration:         time.Since(start),
+		Fields: event.Fields{
+			"diff_id": layerDiffID,
+		},
+	})
+
+	return ispec.Descriptor{
+		Digest: layerDigest,
+		Size:   layerSize,
+	}, annotations, nil
+}
+
+// annotateLayer sets the annotations of the given layer descriptor. Since
+// ispec.Descriptor has no annotations, they are added to the original JSON of
+// the manifest (in a copy of the descriptor), so that Commit preserves them as
+// unknown fields of the descriptor.
+func (m *Mutator) annotateLayer(descriptor ispec.Descriptor, annotations map[string]string) error {
+	if len(annotations) == 0 {
+		return nil
+	}
+
+	value, err := json.Marshal(struct {
+		ispec.Descriptor
+		Annotations map[string]string `json:"annotations"`
+	}{descriptor, annotations})
+	if err != nil {
+		return errors.Wrap(err, "encode layer descriptor")
+	}
+
+	// "layers" may be null, in which case it is replaced.
+	var manifest struct {
+		Layers []json.RawMessage `json:"layers"`
+	}
+	if err := json.Unmarshal(m.manifestRaw, &manifest); err != nil {
+		return errors.Wrap(err, "parse manifest")
+	}
+	op := jsonpatch.Operation{Op: "add", Path: jsonpatch.Pointer("layers", "-"), Value: value}
+	if manifest.Layers == nil {
+		op = jsonpatch.Operation{Op: "add", Path: jsonpatch.Pointer("layers"), Value: append(append([]byte("["), value...), ']')}
+	}
+	patched, err := jsonpatch.Patch{op}.Apply(m.manifestRaw)
+	if err != nil {
+		return errors.Wrap(err, "annotate layer")
+	}
+	m.manifestRaw = patched
+	return nil
 }
 
 // Add adds a layer to the image, by reading the layer changeset blob from the
@@ -245,27 +573,34 @@ func (m *Mutator) add(ctx context.Context, reader io.Reader) (digest.Digest, int
 // generate the DiffIDs for the image metatadata. The provided history entry is
 // appended to the image's history and should correspond to what operations
 // were made to the configuration.
-func (m *Mutator) Add(ctx context.Context, r io.Reader, history ispec.History) error {
+func (m *Mutator) Add(ctx context.Context, r io.Reader, history ispec.History) (err error) {
+	ctx, span := event.StartSpan(ctx, "mutate.Add")
+	defer func() { span.End(err) }()
+
 	if err := m.cache(ctx); err != nil {
 		return errors.Wrap(err, "getting cache failed")
 	}
 
-	digest, size, err := m.add(ctx, r)
+	descriptor, annotations, err := m.add(ctx, r)
 	if err != nil {
 		return errors.Wrap(err, "add layer")
 	}
+	span.SetAttribute("digest", descriptor.Digest)
+	span.SetAttribute("size", descriptor.Size)
 
 	// Append to layers.
-	m.manifest.Layers = append(m.manifest.Layers, ispec.Descriptor{
-		// TODO: Detect whether the layer is gzip'd or not...
-		MediaType: ispec.MediaTypeImageLayerGzip,
-		Digest:    digest,
-		Size:      size,
-	})
+	// TODO: Detect whether the layer is gzip'd or not...
+	descriptor.MediaType = ispec.MediaTypeImageLayerGzip
+	if err := m.annotateLayer(descriptor, annotations); err != nil {
+		return err
+	}
+	m.manifest.Layers = append(m.manifest.Layers, descriptor)
 
 	// Append history.
-	history.EmptyLayer = false
-	m.config.History = append(m.config.History, history)
+	if !m.noHistory {
+		history.EmptyLayer = false
+		m.config.History = append(m.config.History, history)
+	}
 	return nil
 }
 
@@ -276,22 +611,454 @@ func (m *Mutator) AddNonDistributable(ctx context.Context, r io.Reader, history
 		return errors.Wrap(err, "getting cache failed")
 	}
 
-	digest, size, err := m.add(ctx, r)
+	descriptor, annotations, err := m.add(ctx, r)
 	if err != nil {
 		return errors.Wrap(err, "add non-distributable layer")
 	}
 
 	// Append to layers.
-	m.manifest.Layers = append(m.manifest.Layers, ispec.Descriptor{
-		// TODO: Detect whether the layer is gzip'd or not...
-		MediaType: ispec.MediaTypeImageLayerNonDistributableGzip,
-		Digest:    digest,
-		Size:      size,
-	})
+	// TODO: Detect whether the layer is gzip'd or not...
+	descriptor.MediaType = ispec.MediaTypeImageLayerNonDistributableGzip
+	if err := m.annotateLayer(descriptor, annotations); err != nil {
+		return err
+	}
+	m.manifest.Layers = append(m.manifest.Layers, descriptor)
 
 	// Append history.
+	if !m.noHistory {
+		history.EmptyLayer = false
+		m.config.History = append(m.config.History, history)
+	}
+	return nil
+}
+
+// layerHistory returns, for each layer of the image, the index of the history
+// entry which created it. If the history of the image doesn't describe its
+// layers (such as when the image has no history), nil is returned.
+func (m *Mutator) layerHistory() []int {
+	var indices []int
+	for idx, entry := range m.config.History {
+		if !entry.EmptyLayer {
+			indices = append(indices, idx)
+		}
+	}
+	if len(indices) != len(m.manifest.Layers) {
+		return nil
+	}
+	return indices
+}
+
+// LayerIndex returns the index of the layer of the image with the given
+// digest, which may be either the digest of the layer blob or its DiffID.
+// Returns os.ErrNotExist if no layer matches the digest.
+func (m *Mutator) LayerIndex(ctx context.Context, layerDigest digest.Digest) (int, error) {
+	if err := m.cache(ctx); err != nil {
+		return -1, errors.Wrap(err, "getting cache failed")
+	}
+
+	for idx, descriptor := range m.manifest.Layers {
+		if descriptor.Digest == layerDigest {
+			return idx, nil
+		}
+	}
+	for idx, diffID := range m.config.RootFS.DiffIDs {
+		if diffID == layerDigest.String() {
+			return idx, nil
+		}
+	}
+	return -1, errors.Wrapf(os.ErrNotExist, "find layer %s", layerDigest)
+}
+
+// Insert is the same as Add, except that the layer is inserted into the
+// image so that it becomes the layer with the given index (an index of 0
+// inserts the layer below all of the existing layers, and an index equal to
+// the number of layers is the same as Add). The DiffID and history entry of
+// the layer are inserted at the corresponding positions. If the history of
+// the image doesn't describe its layers, the history entry is appended.
+func (m *Mutator) Insert(ctx context.Context, index int, r io.Reader, history ispec.History) (err error) {
+	ctx, span := event.StartSpan(ctx, "mutate.Insert")
+	defer func() { span.End(err) }()
+
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if index < 0 || index > len(m.manifest.Layers) {
+		return errors.Wrapf(ErrLayerOutOfRange, "layer index %d (image has %d layers)", index, len(m.manifest.Layers))
+	}
+	if len(m.config.RootFS.DiffIDs) != len(m.manifest.Layers) {
+		return errors.Errorf("image has %d layers but %d diff_ids", len(m.manifest.Layers), len(m.config.RootFS.DiffIDs))
+	}
+	span.SetAttribute("index", index)
+	historyIndices := m.layerHistory()
+
+	descriptor, annotations, err := m.add(ctx, r)
+	if err != nil {
+		return errors.Wrap(err, "add layer")
+	}
+	span.SetAttribute("digest", descriptor.Digest)
+	span.SetAttribute("size", descriptor.Size)
+
+	// TODO: Detect whether the layer is gzip'd or not...
+	descriptor.MediaType = ispec.MediaTypeImageLayerGzip
+	if err := m.annotateLayer(descriptor, annotations); err != nil {
+		return err
+	}
+
+	// add() appends the DiffID, so move it to the right position.
+	diffIDs := m.config.RootFS.DiffIDs
+	diffID := diffIDs[len(diffIDs)-1]
+	copy(diffIDs[index+1:], diffIDs[index:len(diffIDs)-1])
+	diffIDs[index] = diffID
+
+	// Insert into layers.
+	m.manifest.Layers = append(m.manifest.Layers, ispec.Descriptor{})
+	copy(m.manifest.Layers[index+1:], m.manifest.Layers[index:])
+	m.manifest.Layers[index] = descriptor
+
+	// Insert history before the entry of the layer we were inserted before.
+	if m.noHistory {
+		return nil
+	}
 	history.EmptyLayer = false
-	m.config.History = append(m.config.History, history)
+	historyIndex := len(m.config.History)
+	if historyIndices != nil && index < len(historyIndices) {
+		historyIndex = historyIndices[index]
+	}
+	m.config.History = append(m.config.History, ispec.History{})
+	copy(m.config.History[historyIndex+1:], m.config.History[historyIndex:])
+	m.config.History[historyIndex] = history
+	return nil
+}
+
+// RemoveLayer removes the layer with the given index from the image, along
+// with its DiffID and the history entry which created it (if the history of
+// the image describes its layers). The layer blob itself is not removed from
+// the image, as it may be referenced by other images -- see casext.GC. Note
+// that any changes made by the layer will also no longer be present in the
+// image, and later layers may depend on them (for instance, whiteouts or
+// modifications of files added by the layer).
+func (m *Mutator) RemoveLayer(ctx context.Context, index int) (err error) {
+	ctx, span := event.StartSpan(ctx, "mutate.RemoveLayer")
+	defer func() { span.End(err) }()
+
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if index < 0 || index >= len(m.manifest.Layers) {
+		return errors.Wrapf(ErrLayerOutOfRange, "layer index %d (image has %d layers)", index, len(m.manifest.Layers))
+	}
+	if len(m.config.RootFS.DiffIDs) != len(m.manifest.Layers) {
+		return errors.Errorf("image has %d layers but %d diff_ids", len(m.manifest.Layers), len(m.config.RootFS.DiffIDs))
+	}
+	span.SetAttribute("index", index)
+	span.SetAttribute("digest", m.manifest.Layers[index].Digest)
+
+	if historyIndices := m.layerHistory(); historyIndices != nil {
+		historyIndex := historyIndices[index]
+		m.config.History = append(m.config.History[:historyIndex], m.config.History[historyIndex+1:]...)
+	}
+	m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs[:index], m.config.RootFS.DiffIDs[index+1:]...)
+	m.manifest.Layers = append(m.manifest.Layers[:index], m.manifest.Layers[index+1:]...)
+	return nil
+}
+
+// ReplaceLayer replaces the layer with the given index with a new layer, by
+// reading the layer changeset blob from the provided reader (which must not
+// be compressed, as with Add). The DiffID of the layer is replaced, but its
+// history entry is left unchanged. The old layer blob itself is not removed
+// from the image, as it may be referenced by other images -- see casext.GC.
+// Non-distributable layers remain non-distributable.
+func (m *Mutator) ReplaceLayer(ctx context.Context, index int, r io.Reader) (err error) {
+	ctx, span := event.StartSpan(ctx, "mutate.ReplaceLayer")
+	defer func() { span.End(err) }()
+
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if index < 0 || index >= len(m.manifest.Layers) {
+		return errors.Wrapf(ErrLayerOutOfRange, "layer index %d (image has %d layers)", index, len(m.manifest.Layers))
+	}
+	if len(m.config.RootFS.DiffIDs) != len(m.manifest.Layers) {
+		return errors.Errorf("image has %d layers but %d diff_ids", len(m.manifest.Layers), len(m.config.RootFS.DiffIDs))
+	}
+	span.SetAttribute("index", index)
+	span.SetAttribute("old_digest", m.manifest.Layers[index].Digest)
+
+	descriptor, annotations, err := m.add(ctx, r)
+	if err != nil {
+		return errors.Wrap(err, "add layer")
+	}
+	span.SetAttribute("digest", descriptor.Digest)
+	span.SetAttribute("size", descriptor.Size)
+
+	// TODO: Detect whether the layer is gzip'd or not...
+	descriptor.MediaType = ispec.MediaTypeImageLayerGzip
+	switch m.manifest.Layers[index].MediaType {
+	case ispec.MediaTypeImageLayerNonDistributable, ispec.MediaTypeImageLayerNonDistributableGzip:
+		descriptor.MediaType = ispec.MediaTypeImageLayerNonDistributableGzip
+	}
+	if err := m.annotateLayer(descriptor, annotations); err != nil {
+		return err
+	}
+
+	// add() appends the DiffID, so move it to the right position.
+	diffIDs := m.config.RootFS.DiffIDs
+	diffIDs[index] = diffIDs[len(diffIDs)-1]
+	m.config.RootFS.DiffIDs = diffIDs[:len(diffIDs)-1]
+	m.manifest.Layers[index] = descriptor
+	return nil
+}
+
+// LayerAnnotations returns the annotations of the layer descriptors of the
+// manifest that would be written by Commit (which are not part of
+// ispec.Descriptor), in the same order as its layers.
+func (m *Mutator) LayerAnnotations(ctx context.Context) ([]map[string]string, error) {
+	_, manifest, manifestBlob, err := m.encode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rawAnnotations, err := casext.ManifestLayerAnnotations(manifestBlob)
+	if err != nil {
+		return nil, err
+	}
+	annotations := make([]map[string]string, len(manifest.Layers))
+	copy(annotations, rawAnnotations)
+	return annotations, nil
+}
+
+// ReplaceLayerBlob replaces the descriptor of the layer with the given index
+// with the given descriptor (and its annotations), which must describe a blob
+// in the image containing the same layer -- such as the layer after it has
+// been encrypted or decrypted. Since the layer itself is unchanged, neither
+// its DiffID nor its history entry are modified.
+func (m *Mutator) ReplaceLayerBlob(ctx context.Context, index int, descriptor ispec.Descriptor, annotations map[string]string) (err error) {
+	ctx, span := event.StartSpan(ctx, "mutate.ReplaceLayerBlob")
+	defer func() { span.End(err) }()
+
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if index < 0 || index >= len(m.manifest.Layers) {
+		return errors.Wrapf(ErrLayerOutOfRange, "layer index %d (image has %d layers)", index, len(m.manifest.Layers))
+	}
+	span.SetAttribute("index", index)
+	span.SetAttribute("old_digest", m.manifest.Layers[index].Digest)
+	span.SetAttribute("digest", descriptor.Digest)
+
+	if err := m.annotateLayer(descriptor, annotations); err != nil {
+		return err
+	}
+	m.manifest.Layers[index] = descriptor
+	return nil
+}
+
+// baseImage is the manifest and configuration of a base image given to
+// Rebase, along with the annotations of its layers (which are not part of
+// ispec.Descriptor).
+type baseImage struct {
+	manifest         ispec.Manifest
+	config           ispec.Image
+	chunks           casext.LayerChunks
+	layerAnnotations []map[string]string
+}
+
+// loadBase loads the base image with the given manifest descriptor.
+func (m *Mutator) loadBase(ctx context.Context, descriptor ispec.Descriptor) (baseImage, error) {
+	descriptor = casext.ConvertDescriptor(descriptor)
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return baseImage{}, errors.Wrapf(ErrIncompatibleMediaType, "unsupported base type %s", descriptor.MediaType)
+	}
+
+	manifestBlob, err := m.engine.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return baseImage{}, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return baseImage{}, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+	chunks, err := casext.ManifestLayerChunks(manifest)
+	if err != nil {
+		return baseImage{}, errors.Wrap(err, "get chunked layers")
+	}
+	rawAnnotations, err := casext.ManifestLayerAnnotations(manifestBlob.Raw)
+	if err != nil {
+		return baseImage{}, errors.Wrap(err, "parse manifest")
+	}
+	layerAnnotations := make([]map[string]string, len(manifest.Layers))
+	copy(layerAnnotations, rawAnnotations)
+
+	configBlob, err := m.engine.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return baseImage{}, errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return baseImage{}, errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return baseImage{}, errors.Errorf("base image has %d layers but %d diff_ids", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	return baseImage{
+		manifest:         manifest,
+		config:           config,
+		chunks:           chunks,
+		layerAnnotations: layerAnnotations,
+	}, nil
+}
+
+// baseHistoryLength returns the number of history entries of the image which
+// belong to the given base image, whose layers have already been checked to be
+// the lowest layers of the image. Usually the history of the base image is a
+// prefix of the history of the image, but otherwise the history entries up to
+// (and including) the entry which created the topmost layer of the base image
+// are used, if the history of the image describes its layers.
+func (m *Mutator) baseHistoryLength(base baseImage) (int, error) {
+	baseHistory := base.config.History
+	if len(baseHistory) <= len(m.config.History) && reflect.DeepEqual(baseHistory, m.config.History[:len(baseHistory)]) {
+		return len(baseHistory), nil
+	}
+	numLayers := len(base.manifest.Layers)
+	if numLayers == 0 {
+		return 0, nil
+	}
+	if historyIndices := m.layerHistory(); historyIndices != nil {
+		return historyIndices[numLayers-1] + 1, nil
+	}
+	return -1, errors.Errorf("cannot determine which history entries belong to the old base image")
+}
+
+// Rebase replaces the layers of the image which come from the given old base
+// image (that is, the lowest layers of the image, which must be identical to
+// the layers of the old base image) with the layers of the given new base
+// image, keeping the layers which were added on top of the old base image. The
+// DiffIDs of the image are updated, and the history entries of the old base
+// image are replaced with the history of the new base image. Both descriptors
+// must refer to manifests in the same engine as the image. The rest of the
+// configuration of the image is not modified, so changes to the configuration
+// of the base image (such as new environment variables) are not applied. Note
+// that the layers added on top of the old base image are not regenerated, so
+// they may depend on the contents of the old base image (for instance, they
+// may modify or delete files which are no longer present).
+func (m *Mutator) Rebase(ctx context.Context, oldBase, newBase ispec.Descriptor) (err error) {
+	ctx, span := event.StartSpan(ctx, "mutate.Rebase")
+	defer func() { span.End(err) }()
+
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if len(m.config.RootFS.DiffIDs) != len(m.manifest.Layers) {
+		return errors.Errorf("image has %d layers but %d diff_ids", len(m.manifest.Layers), len(m.config.RootFS.DiffIDs))
+	}
+	span.SetAttribute("old_base", oldBase.Digest)
+	span.SetAttribute("new_base", newBase.Digest)
+
+	oldImage, err := m.loadBase(ctx, oldBase)
+	if err != nil {
+		return errors.Wrap(err, "load old base image")
+	}
+	newImage, err := m.loadBase(ctx, newBase)
+	if err != nil {
+		return errors.Wrap(err, "load new base image")
+	}
+
+	// The image must actually be based on the old base image.
+	numBaseLayers := len(oldImage.manifest.Layers)
+	if numBaseLayers > len(m.manifest.Layers) {
+		return errors.Wrapf(ErrNotBasedOn, "image has %d layers but the old base image has %d", len(m.manifest.Layers), numBaseLayers)
+	}
+	for idx, diffID := range oldImage.config.RootFS.DiffIDs {
+		if m.config.RootFS.DiffIDs[idx] != diffID {
+			return errors.Wrapf(ErrNotBasedOn, "layer %d has diff_id %s rather than %s", idx, m.config.RootFS.DiffIDs[idx], diffID)
+		}
+	}
+	if newImage.config.OS != m.config.OS || newImage.config.Architecture != m.config.Architecture {
+		return errors.Errorf("new base image is for %s/%s but the image is for %s/%s", newImage.config.OS, newImage.config.Architecture, m.config.OS, m.config.Architecture)
+	}
+	numBaseHistory, err := m.baseHistoryLength(oldImage)
+	if err != nil {
+		return err
+	}
+
+	// Layers of the new base image keep their annotations.
+	for idx, descriptor := range newImage.manifest.Layers {
+		if err := m.annotateLayer(descriptor, newImage.layerAnnotations[idx]); err != nil {
+			return err
+		}
+	}
+	if len(newImage.chunks) > 0 {
+		if m.chunks == nil {
+			m.chunks = casext.LayerChunks{}
+		}
+		for layerDigest, layerChunks := range newImage.chunks {
+			m.chunks[layerDigest] = layerChunks
+		}
+	}
+
+	layers := append([]ispec.Descriptor{}, newImage.manifest.Layers...)
+	m.manifest.Layers = append(layers, m.manifest.Layers[numBaseLayers:]...)
+
+	diffIDs := append([]string{}, newImage.config.RootFS.DiffIDs...)
+	m.config.RootFS.DiffIDs = append(diffIDs, m.config.RootFS.DiffIDs[numBaseLayers:]...)
+
+	var history []ispec.History
+	history = append(history, newImage.config.History...)
+	history = append(history, m.config.History[numBaseHistory:]...)
+	m.config.History = history
+	return nil
+}
+
+// Squash replaces all of the layers of the image with a single layer, by
+// reading the layer changeset blob from the provided reader. The stream must
+// not be compressed, and must contain the entire root filesystem of the image
+// (as all of the existing layers are removed). The DiffIDs of the image are
+// replaced with the DiffID of the new layer, and any history entries which
+// created a layer are removed (history entries which only modified the
+// configuration are retained). The provided history entry is then appended to
+// the image's history.
+func (m *Mutator) Squash(ctx context.Context, r io.Reader, history ispec.History) (err error) {
+	ctx, span := event.StartSpan(ctx, "mutate.Squash")
+	defer func() { span.End(err) }()
+
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	span.SetAttribute("layers", len(m.manifest.Layers))
+
+	// Remove all of the old layers. Because add() only appends to the
+	// configuration, we have to make sure it starts with an empty set of
+	// DiffIDs.
+	m.manifest.Layers = []ispec.Descriptor{}
+	m.config.RootFS.DiffIDs = []string{}
+
+	descriptor, annotations, err := m.add(ctx, r)
+	if err != nil {
+		return errors.Wrap(err, "add squashed layer")
+	}
+
+	descriptor.MediaType = ispec.MediaTypeImageLayerGzip
+	if err := m.annotateLayer(descriptor, annotations); err != nil {
+		return err
+	}
+	m.manifest.Layers = append(m.manifest.Layers, descriptor)
+
+	// Rewrite the history, since none of the old layers exist anymore.
+	var newHistory []ispec.History
+	for _, entry := range m.config.History {
+		if entry.EmptyLayer {
+			newHistory = append(newHistory, entry)
+		}
+	}
+	if !m.noHistory {
+		history.EmptyLayer = false
+		newHistory = append(newHistory, history)
+	}
+	m.config.History = newHistory
 	return nil
 }
 
@@ -300,27 +1067,27 @@ func (m *Mutator) AddNonDistributable(ctx context.Context, r io.Reader, history
 // descriptor (which can be used in place of the source descriptor provided to
 // New).
 func (m *Mutator) Commit(ctx context.Context) (ispec.Descriptor, error) {
-	if err := m.cache(ctx); err != nil {
-		return ispec.Descriptor{}, errors.Wrap(err, "getting cache failed")
+	configBlob, manifest, manifestBlob, err := m.encode(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, err
 	}
 
 	// We first have to commit the configuration blob.
-	configDigest, configSize, err := m.engine.PutBlobJSON(ctx, m.config)
+	configDigest, _, err := m.engine.PutBlob(ctx, bytes.NewReader(configBlob))
 	if err != nil {
 		return ispec.Descriptor{}, errors.Wrap(err, "commit mutated config blob")
 	}
-
-	m.manifest.Config = ispec.Descriptor{
-		MediaType: m.manifest.Config.MediaType,
-		Digest:    configDigest,
-		Size:      configSize,
+	if configDigest != manifest.Config.Digest {
+		// Should _never_ be reached.
+		return ispec.Descriptor{}, errors.Wrap(&cas.DigestMismatchError{Expected: manifest.Config.Digest, Actual: configDigest}, "[internal error] config blob")
 	}
 
 	// Now commit the manifest.
-	manifestDigest, manifestSize, err := m.engine.PutBlobJSON(ctx, m.manifest)
+	manifestDigest, manifestSize, err := m.engine.PutBlob(ctx, bytes.NewReader(manifestBlob))
 	if err != nil {
 		return ispec.Descriptor{}, errors.Wrap(err, "commit mutated manifest blob")
 	}
+	*m.manifest = manifest
 
 	// Generate a new descriptor.
 	return ispec.Descriptor{
@@ -329,3 +1096,71 @@ func (m *Mutator) Commit(ctx context.Context) (ispec.Descriptor, error) {
 		Size:      manifestSize,
 	}, nil
 }
+
+// encode returns the image configuration and manifest blobs that Commit
+// writes (preserving any fields of the original blobs unknown to umoci), as
+// well as the manifest (referencing the configuration blob). m.manifest is
+// not modified.
+func (m *Mutator) encode(ctx context.Context) ([]byte, ispec.Manifest, []byte, error) {
+	if err := m.cache(ctx); err != nil {
+		return nil, ispec.Manifest{}, nil, errors.Wrap(err, "getting cache failed")
+	}
+
+	config, err := jsonmerge.Preserve(m.configRaw, m.config)
+	if err != nil {
+		return nil, ispec.Manifest{}, nil, errors.Wrap(err, "preserve unknown config fields")
+	}
+	var configBlob bytes.Buffer
+	if err := json.NewEncoder(&configBlob).Encode(config); err != nil {
+		return nil, ispec.Manifest{}, nil, errors.Wrap(err, "encode mutated config")
+	}
+
+	// Work on a copy of the manifest, so that a failed Commit (or a Preview)
+	// leaves the mutator unchanged.
+	manifest := *m.manifest
+	manifest.Layers = append([]ispec.Descriptor(nil), m.manifest.Layers...)
+	if m.manifest.Annotations != nil {
+		manifest.Annotations = map[string]string{}
+		for k, v := range m.manifest.Annotations {
+			manifest.Annotations[k] = v
+		}
+	}
+	manifest.Config = ispec.Descriptor{
+		MediaType: m.manifest.Config.MediaType,
+		Digest:    cas.BlobAlgorithm.FromBytes(configBlob.Bytes()),
+		Size:      int64(configBlob.Len()),
+	}
+	if err := casext.SetManifestLayerChunks(&manifest, m.chunks); err != nil {
+		return nil, ispec.Manifest{}, nil, errors.Wrap(err, "describe chunked layers")
+	}
+
+	preserved, err := jsonmerge.Preserve(m.manifestRaw, &manifest)
+	if err != nil {
+		return nil, ispec.Manifest{}, nil, errors.Wrap(err, "preserve unknown manifest fields")
+	}
+	var manifestBlob bytes.Buffer
+	if err := json.NewEncoder(&manifestBlob).Encode(preserved); err != nil {
+		return nil, ispec.Manifest{}, nil, errors.Wrap(err, "encode mutated manifest")
+	}
+	return configBlob.Bytes(), manifest, manifestBlob.Bytes(), nil
+}
+
+// Preview returns the image configuration and manifest that would be written
+// by Commit (with the manifest referencing the new configuration), without
+// writing anything to the image. Note that layers added with Add (or
+// similar) have already been written to the image.
+func (m *Mutator) Preview(ctx context.Context) (ispec.Image, ispec.Manifest, error) {
+	_, manifest, _, err := m.encode(ctx)
+	if err != nil {
+		return ispec.Image{}, ispec.Manifest{}, err
+	}
+	return *m.config, manifest, nil
+}
+
+// PreviewBlobs is like Preview, but returns the exact image configuration
+// and manifest blobs that would be written by Commit (including any fields
+// of the original blobs unknown to umoci).
+func (m *Mutator) PreviewBlobs(ctx context.Context) ([]byte, []byte, error) {
+	configBlob, _, manifestBlob, err := m.encode(ctx)
+	return configBlob, manifestBlob, err
+}
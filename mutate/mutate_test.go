@@ -20,15 +20,23 @@ package mutate
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/jsonpatch"
+	"github.com/opencontainers/go-digest"
 	imeta "github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
 	// Include all known drivers.
@@ -192,6 +200,22 @@ func TestMutateCache(t *testing.T) {
 	}
 }
 
+func TestMutateIncompatibleMediaType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateIncompatibleMediaType")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	fromDescriptor.MediaType = ispec.MediaTypeImageManifestList
+	if _, err := New(engine, fromDescriptor); !errors.Is(err, ErrIncompatibleMediaType) {
+		t.Errorf("expected ErrIncompatibleMediaType for a manifest list, got %+v", err)
+	}
+}
+
 func TestMutateAdd(t *testing.T) {
 	dir, err := ioutil.TempDir("", "umoci-TestMutateAdd")
 	if err != nil {
@@ -272,6 +296,385 @@ func TestMutateAdd(t *testing.T) {
 	}
 }
 
+func TestMutateInsert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateInsert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add a configuration-only history entry, which must stay in place.
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	mutator.config.History = append(mutator.config.History, ispec.History{
+		Comment:    "config change",
+		EmptyLayer: true,
+	})
+	originalLayer := mutator.manifest.Layers[0].Digest
+
+	if err := mutator.Insert(context.Background(), 2, bytes.NewBufferString("contents"), ispec.History{}); !errors.Is(err, ErrLayerOutOfRange) {
+		t.Errorf("expected ErrLayerOutOfRange inserting layer out of range, got %+v", err)
+	}
+
+	// Insert a layer below the existing layer, and another at the top.
+	if err := mutator.Insert(context.Background(), 0, bytes.NewBufferString("bottom"), ispec.History{
+		Comment: "bottom layer",
+	}); err != nil {
+		t.Fatalf("unexpected error inserting layer: %+v", err)
+	}
+	if err := mutator.Insert(context.Background(), 2, bytes.NewBufferString("top"), ispec.History{
+		Comment: "top layer",
+	}); err != nil {
+		t.Fatalf("unexpected error inserting layer: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	// Check the layers are in the right order.
+	if len(mutator.manifest.Layers) != 3 {
+		t.Fatalf("manifest.Layers has the wrong length: %d", len(mutator.manifest.Layers))
+	}
+	if mutator.manifest.Layers[1].Digest != originalLayer {
+		t.Errorf("manifest.Layers[1] is not the original layer: %s", mutator.manifest.Layers[1].Digest)
+	}
+	for idx, contents := range map[int]string{0: "bottom", 2: "top"} {
+		diffID := cas.BlobAlgorithm.FromString(contents).String()
+		if mutator.config.RootFS.DiffIDs[idx] != diffID {
+			t.Errorf("config.RootFS.DiffIDs[%d] is wrong: expected %s got %s", idx, diffID, mutator.config.RootFS.DiffIDs[idx])
+		}
+		if got, err := mutator.LayerIndex(context.Background(), digest.Digest(diffID)); err != nil || got != idx {
+			t.Errorf("LayerIndex(%s) returned the wrong index: expected %d got %d (%+v)", diffID, idx, got, err)
+		}
+	}
+	if got, err := mutator.LayerIndex(context.Background(), originalLayer); err != nil || got != 1 {
+		t.Errorf("LayerIndex(%s) returned the wrong index: expected 1 got %d (%+v)", originalLayer, got, err)
+	}
+
+	// Check the history is in the right order.
+	var comments []string
+	for _, entry := range mutator.config.History {
+		comments = append(comments, entry.Comment)
+	}
+	if expected := []string{"bottom layer", "", "config change", "top layer"}; !reflect.DeepEqual(comments, expected) {
+		t.Errorf("config.History is in the wrong order: expected %v got %v", expected, comments)
+	}
+}
+
+func TestMutateRemoveLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRemoveLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("contents"), ispec.History{
+		Comment: "new layer",
+	}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	if err := mutator.RemoveLayer(context.Background(), 2); !errors.Is(err, ErrLayerOutOfRange) {
+		t.Errorf("expected ErrLayerOutOfRange removing layer out of range, got %+v", err)
+	}
+	if _, err := mutator.LayerIndex(context.Background(), cas.BlobAlgorithm.FromString("missing")); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("expected os.ErrNotExist for missing layer, got %+v", err)
+	}
+
+	// Remove the original layer.
+	if err := mutator.RemoveLayer(context.Background(), 0); err != nil {
+		t.Fatalf("unexpected error removing layer: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	if len(mutator.manifest.Layers) != 1 {
+		t.Fatalf("manifest.Layers has the wrong length: %d", len(mutator.manifest.Layers))
+	}
+	if mutator.manifest.Layers[0].Digest == expectedLayerDigest {
+		t.Errorf("manifest.Layers[0] is still the original layer")
+	}
+	if diffID := cas.BlobAlgorithm.FromString("contents").String(); !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, []string{diffID}) {
+		t.Errorf("config.RootFS.DiffIDs is wrong: expected [%s] got %v", diffID, mutator.config.RootFS.DiffIDs)
+	}
+	if len(mutator.config.History) != 1 || mutator.config.History[0].Comment != "new layer" {
+		t.Errorf("config.History was not updated: %+v", mutator.config.History)
+	}
+}
+
+func TestMutateReplaceLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateReplaceLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("contents"), ispec.History{
+		Comment: "new layer",
+	}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	if err := mutator.ReplaceLayer(context.Background(), 2, bytes.NewBufferString("replaced")); !errors.Is(err, ErrLayerOutOfRange) {
+		t.Errorf("expected ErrLayerOutOfRange replacing layer out of range, got %+v", err)
+	}
+
+	// Replace the original layer.
+	if err := mutator.ReplaceLayer(context.Background(), 0, bytes.NewBufferString("replaced")); err != nil {
+		t.Fatalf("unexpected error replacing layer: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	if len(mutator.manifest.Layers) != 2 {
+		t.Fatalf("manifest.Layers has the wrong length: %d", len(mutator.manifest.Layers))
+	}
+	if mutator.manifest.Layers[0].Digest == expectedLayerDigest {
+		t.Errorf("manifest.Layers[0] is still the original layer")
+	}
+	if mutator.manifest.Layers[0].MediaType != ispec.MediaTypeImageLayerGzip {
+		t.Errorf("manifest.Layers[0] has the wrong media type: %s", mutator.manifest.Layers[0].MediaType)
+	}
+	expectedDiffIDs := []string{
+		cas.BlobAlgorithm.FromString("replaced").String(),
+		cas.BlobAlgorithm.FromString("contents").String(),
+	}
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, expectedDiffIDs) {
+		t.Errorf("config.RootFS.DiffIDs is wrong: expected %v got %v", expectedDiffIDs, mutator.config.RootFS.DiffIDs)
+	}
+	if len(mutator.config.History) != 2 || mutator.config.History[1].Comment != "new layer" {
+		t.Errorf("config.History was modified: %+v", mutator.config.History)
+	}
+}
+
+func TestMutateRebase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, oldBase := setup(t, dir)
+	defer engine.Close()
+
+	addLayers := func(from ispec.Descriptor, contents ...string) ispec.Descriptor {
+		mutator, err := New(engine, from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, content := range contents {
+			if err := mutator.Add(context.Background(), bytes.NewBufferString(content), ispec.History{
+				Comment: content,
+			}); err != nil {
+				t.Fatalf("unexpected error adding layer: %+v", err)
+			}
+		}
+		descriptor, err := mutator.Commit(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error committing changes: %+v", err)
+		}
+		return descriptor
+	}
+
+	// The new base has an extra layer, and the application has two layers on
+	// top of the old base.
+	newBase := addLayers(oldBase, "base update")
+	app := addLayers(oldBase, "app 1", "app 2")
+
+	mutator, err := New(engine, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The application isn't based on the new base.
+	if err := mutator.Rebase(context.Background(), newBase, oldBase); !errors.Is(err, ErrNotBasedOn) {
+		t.Errorf("expected ErrNotBasedOn rebasing from the wrong base, got %+v", err)
+	}
+
+	if err := mutator.Rebase(context.Background(), oldBase, newBase); err != nil {
+		t.Fatalf("unexpected error rebasing: %+v", err)
+	}
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	if len(mutator.manifest.Layers) != 4 {
+		t.Fatalf("manifest.Layers has the wrong length: %d", len(mutator.manifest.Layers))
+	}
+	baseMutator, err := New(engine, newBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := baseMutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers[:2], baseMutator.manifest.Layers) {
+		t.Errorf("manifest.Layers doesn't start with the new base layers: %v", mutator.manifest.Layers)
+	}
+	expectedDiffIDs := append(baseMutator.config.RootFS.DiffIDs,
+		cas.BlobAlgorithm.FromString("app 1").String(),
+		cas.BlobAlgorithm.FromString("app 2").String(),
+	)
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, expectedDiffIDs) {
+		t.Errorf("config.RootFS.DiffIDs is wrong: expected %v got %v", expectedDiffIDs, mutator.config.RootFS.DiffIDs)
+	}
+	var comments []string
+	for _, entry := range mutator.config.History {
+		comments = append(comments, entry.Comment)
+	}
+	expectedComments := []string{"", "base update", "app 1", "app 2"}
+	if !reflect.DeepEqual(comments, expectedComments) {
+		t.Errorf("config.History is wrong: expected %v got %v", expectedComments, comments)
+	}
+}
+
+func TestMutateSquash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSquash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add a configuration-only history entry, as well as another layer.
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Set(context.Background(), config, meta, nil, ispec.History{
+		Comment: "config change",
+	}); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("contents"), ispec.History{
+		Comment: "new layer",
+	}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	// This isn't a valid image, but whatever.
+	if err := mutator.Squash(context.Background(), bytes.NewBufferString("squashed contents"), ispec.History{
+		Comment: "squashed layer",
+	}); err != nil {
+		t.Fatalf("unexpected error squashing layers: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the data to check it.
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	// Check there is only one layer.
+	if len(mutator.manifest.Layers) != 1 {
+		t.Fatalf("manifest.Layers was not squashed: %v", mutator.manifest.Layers)
+	}
+	if mutator.manifest.Layers[0].Digest == expectedLayerDigest {
+		t.Errorf("manifest.Layers[0].Digest was not replaced")
+	}
+	if mutator.manifest.Layers[0].MediaType != ispec.MediaTypeImageLayerGzip {
+		t.Errorf("manifest.Layers[0].MediaType is the wrong value: %s", mutator.manifest.Layers[0].MediaType)
+	}
+	if len(mutator.config.RootFS.DiffIDs) != 1 {
+		t.Errorf("config.RootFS.DiffIDs was not squashed: %v", mutator.config.RootFS.DiffIDs)
+	}
+
+	// Check history. Only the configuration change should be retained.
+	if len(mutator.config.History) != 2 {
+		t.Fatalf("config.History was not rewritten: %v", mutator.config.History)
+	}
+	if mutator.config.History[0].Comment != "config change" || !mutator.config.History[0].EmptyLayer {
+		t.Errorf("config.History[0] is not the configuration change: %v", mutator.config.History[0])
+	}
+	if mutator.config.History[1].Comment != "squashed layer" || mutator.config.History[1].EmptyLayer {
+		t.Errorf("config.History[1] is not the squashed layer: %v", mutator.config.History[1])
+	}
+}
+
 func TestMutateAddNonDistributable(t *testing.T) {
 	dir, err := ioutil.TempDir("", "umoci-TestMutateAddNonDistributable")
 	if err != nil {
@@ -424,3 +827,679 @@ func TestMutateSet(t *testing.T) {
 		t.Errorf("config.History[1].Comment was not set")
 	}
 }
+
+func TestMutatePreview(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutatePreview")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mutator.Set(context.Background(), ispec.ImageConfig{
+		User: "changed:user",
+	}, Meta{}, nil, ispec.History{
+		Comment: "another layer",
+	}); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+
+	blobsBefore, err := engine.ListBlobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, manifest, err := mutator.Preview(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error previewing changes: %+v", err)
+	}
+	if config.Config.User != "changed:user" {
+		t.Errorf("config.Config.User was not updated! expected changed:user, got %s", config.Config.User)
+	}
+
+	// Nothing should have been written.
+	blobsAfter, err := engine.ListBlobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobsBefore) != len(blobsAfter) {
+		t.Errorf("preview wrote blobs: before=%v after=%v", blobsBefore, blobsAfter)
+	}
+
+	// The preview must match what is committed.
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	blob, err := casext.Engine{engine}.FromDescriptor(context.Background(), newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	if committed := blob.Data.(ispec.Manifest); committed.Config.Digest != manifest.Config.Digest {
+		t.Errorf("preview config digest doesn't match: got %s, expected %s", manifest.Config.Digest, committed.Config.Digest)
+	}
+}
+
+func TestMutateScratch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateScratch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dir = filepath.Join(dir, "image")
+	if err := cas.Create(dir); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := cas.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	// A scratch image has no layers, diff_ids or history.
+	configDigest, configSize, err := engine.PutBlobJSON(context.Background(), ispec.Image{
+		RootFS: ispec.RootFS{
+			Type: "layers",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(context.Background(), ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromDescriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+
+	mutator, err := New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting config: %+v", err)
+	}
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting meta: %+v", err)
+	}
+	config.Cmd = []string{"/hello"}
+	if err := mutator.Set(context.Background(), config, meta, nil, ispec.History{
+		Comment: "set cmd",
+	}); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("contents"), ispec.History{
+		Comment: "first layer",
+	}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	if len(mutator.manifest.Layers) != 1 {
+		t.Errorf("manifest.Layers was not updated: %v", mutator.manifest.Layers)
+	}
+	if len(mutator.config.RootFS.DiffIDs) != 1 {
+		t.Errorf("config.RootFS.DiffIDs was not updated: %v", mutator.config.RootFS.DiffIDs)
+	}
+	if len(mutator.config.History) != 2 {
+		t.Fatalf("config.History was not updated: %v", mutator.config.History)
+	}
+	if !mutator.config.History[0].EmptyLayer || mutator.config.History[1].EmptyLayer {
+		t.Errorf("config.History has the wrong empty_layer values: %v", mutator.config.History)
+	}
+	if len(mutator.config.Config.Cmd) != 1 || mutator.config.Config.Cmd[0] != "/hello" {
+		t.Errorf("config.Config.Cmd was not set: %v", mutator.config.Config.Cmd)
+	}
+}
+
+// addUnknownFields rewrites the JSON blob referenced by the descriptor, with
+// the given fields added to the top-level object.
+func addUnknownFields(t *testing.T, engine cas.Engine, descriptor ispec.Descriptor, fields map[string]interface{}) ispec.Descriptor {
+	reader, err := engine.GetBlob(context.Background(), descriptor.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var data map[string]interface{}
+	if err := json.NewDecoder(reader).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range fields {
+		data[key] = value
+	}
+
+	digest, size, err := engine.PutBlobJSON(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor.Digest = digest
+	descriptor.Size = size
+	return descriptor
+}
+
+// getBlobJSON parses the JSON blob with the given digest.
+func getBlobJSON(t *testing.T, engine cas.Engine, digest digest.Digest) map[string]interface{} {
+	reader, err := engine.GetBlob(context.Background(), digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var data map[string]interface{}
+	if err := json.NewDecoder(reader).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMutateUnknownFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateUnknownFields")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	// Add extension fields to the configuration and manifest.
+	mutator, err := New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	configDescriptor := addUnknownFields(t, engine, mutator.manifest.Config, map[string]interface{}{
+		"com.example.config": "some value",
+	})
+	manifest := *mutator.manifest
+	manifest.Config = configDescriptor
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(context.Background(), manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromDescriptor = addUnknownFields(t, engine, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}, map[string]interface{}{
+		"com.example.manifest": []interface{}{"a", "b"},
+	})
+
+	mutator, err = New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Set(context.Background(), ispec.ImageConfig{
+		User: "changed:user",
+	}, Meta{}, nil, ispec.History{
+		Comment: "another layer",
+	}); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+
+	previewConfig, _, err := mutator.Preview(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error previewing changes: %+v", err)
+	}
+	_, previewManifest, err := mutator.Preview(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error previewing changes: %+v", err)
+	}
+	if mutator.manifest.Config.Digest == previewManifest.Config.Digest {
+		t.Errorf("Preview modified the manifest of the mutator")
+	}
+	previewConfigBlob, previewManifestBlob, err := mutator.PreviewBlobs(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error previewing blobs: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	if digest := cas.BlobAlgorithm.FromBytes(previewManifestBlob); digest != newDescriptor.Digest {
+		t.Errorf("committed manifest doesn't match preview: expected %s, got %s", digest, newDescriptor.Digest)
+	}
+	if digest := cas.BlobAlgorithm.FromBytes(previewConfigBlob); digest != previewManifest.Config.Digest {
+		t.Errorf("previewed config blob doesn't match preview manifest: expected %s, got %s", previewManifest.Config.Digest, digest)
+	}
+
+	newManifest := getBlobJSON(t, engine, newDescriptor.Digest)
+	if value, ok := newManifest["com.example.manifest"].([]interface{}); !ok || len(value) != 2 {
+		t.Errorf("unknown manifest field was not preserved: got %v", newManifest["com.example.manifest"])
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	if mutator.manifest.Config.Digest != previewManifest.Config.Digest {
+		t.Errorf("committed config digest doesn't match preview: expected %s, got %s", previewManifest.Config.Digest, mutator.manifest.Config.Digest)
+	}
+	if mutator.config.Config.User != previewConfig.Config.User {
+		t.Errorf("config.Config.User was not updated! expected %s, got %s", previewConfig.Config.User, mutator.config.Config.User)
+	}
+
+	newConfig := getBlobJSON(t, engine, mutator.manifest.Config.Digest)
+	if value := newConfig["com.example.config"]; value != "some value" {
+		t.Errorf("unknown config field was not preserved: got %v", value)
+	}
+}
+
+// testLayerWriter is a LayerWriter which compresses the layer unmodified, but
+// claims to have rewritten it.
+type testLayerWriter struct {
+	*gzip.Writer
+}
+
+func (testLayerWriter) DiffID() digest.Digest {
+	return digest.FromString("rewritten layer")
+}
+
+func (testLayerWriter) Annotations() map[string]string {
+	return map[string]string{"com.example.layer": "rewritten"}
+}
+
+func TestMutateLayerWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateLayerWriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	baseLayer := mutator.manifest.Layers[0]
+	mutator.SetCompressor(func(w io.Writer) (io.WriteCloser, error) {
+		return testLayerWriter{gzip.NewWriter(w)}, nil
+	})
+
+	// The annotations must end up on the right descriptor, even if the layer
+	// is not appended.
+	if err := mutator.Insert(context.Background(), 0, bytes.NewBufferString("contents"), ispec.History{
+		Comment: "new layer",
+	}); err != nil {
+		t.Fatalf("unexpected error inserting layer: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	var manifest struct {
+		Layers []struct {
+			Digest      digest.Digest     `json:"digest"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"layers"`
+	}
+	data, err := json.Marshal(getBlobJSON(t, engine, newDescriptor.Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(manifest.Layers))
+	}
+	if value := manifest.Layers[0].Annotations["com.example.layer"]; value != "rewritten" {
+		t.Errorf("layer annotation was not set: got %v", manifest.Layers[0].Annotations)
+	}
+	if manifest.Layers[1].Digest != baseLayer.Digest || manifest.Layers[1].Annotations != nil {
+		t.Errorf("unexpected original layer: %+v", manifest.Layers[1])
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	if diffID := mutator.config.RootFS.DiffIDs[0]; diffID != digest.FromString("rewritten layer").String() {
+		t.Errorf("diffid was not taken from the LayerWriter: got %s", diffID)
+	}
+}
+
+func TestMutateMaxBlobSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateMaxBlobSize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.Engine{engine}
+
+	mutator, err := New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator.SetMaxBlobSize(1024)
+
+	// Use incompressible contents so that the layer is split.
+	contents := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(contents)
+	if err := mutator.Add(context.Background(), bytes.NewReader(contents), ispec.History{
+		Comment: "chunked layer",
+	}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	blob, err := engineExt.FromDescriptor(context.Background(), newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := blob.Data.(ispec.Manifest)
+	blob.Close()
+
+	chunks, err := casext.ManifestLayerChunks(manifest)
+	if err != nil {
+		t.Fatalf("unexpected error getting chunked layers: %+v", err)
+	}
+	newLayer := manifest.Layers[len(manifest.Layers)-1]
+	if len(chunks) != 1 || len(chunks[newLayer.Digest]) < 2 {
+		t.Fatalf("expected only the new layer to be chunked: got %+v", chunks)
+	}
+	for _, chunk := range chunks[newLayer.Digest] {
+		if chunk.Size > 1024 {
+			t.Errorf("chunk %s is larger than the maximum blob size: %d", chunk.Digest, chunk.Size)
+		}
+	}
+
+	// The chunked layer can be read back.
+	ctx, err := casext.WithManifestLayerChunks(context.Background(), manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerBlob, err := engineExt.FromDescriptor(ctx, newLayer)
+	if err != nil {
+		t.Fatalf("unexpected error getting chunked layer: %+v", err)
+	}
+	gzr, err := gzip.NewReader(layerBlob.Data.(io.Reader))
+	if err != nil {
+		t.Fatalf("unexpected error decompressing chunked layer: %+v", err)
+	}
+	got, err := ioutil.ReadAll(gzr)
+	layerBlob.Close()
+	if err != nil {
+		t.Fatalf("unexpected error reading chunked layer: %+v", err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Errorf("chunked layer has unexpected contents")
+	}
+
+	// Chunks of removed layers are dropped from the manifest.
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.RemoveLayer(context.Background(), len(manifest.Layers)-1); err != nil {
+		t.Fatalf("unexpected error removing layer: %+v", err)
+	}
+	newDescriptor, err = mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	annotations, _ := getBlobJSON(t, engine, newDescriptor.Digest)["annotations"].(map[string]interface{})
+	if _, ok := annotations[casext.LayerChunksAnnotation]; ok {
+		t.Errorf("chunks of removed layer were not dropped: %v", annotations)
+	}
+}
+
+func TestMutateSetConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSetConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := mutator.Image(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting image: %+v", err)
+	}
+	image.Config.User = "changed:user"
+	image.Author = "Someone"
+	image.History = nil
+	if err := mutator.SetConfig(context.Background(), image); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+
+	// The rootfs cannot be changed.
+	badImage := image
+	badImage.RootFS.DiffIDs = []string{}
+	if err := mutator.SetConfig(context.Background(), badImage); err == nil {
+		t.Errorf("expected error when modifying rootfs")
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	if mutator.config.Config.User != "changed:user" || mutator.config.Author != "Someone" {
+		t.Errorf("config was not replaced: %+v", mutator.config)
+	}
+	if len(mutator.config.History) != 0 {
+		t.Errorf("config.History was not replaced: %+v", mutator.config.History)
+	}
+}
+
+func TestMutatePatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutatePatchConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	// Add an extension field to the configuration.
+	mutator, err := New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	manifest := *mutator.manifest
+	manifest.Config = addUnknownFields(t, engine, mutator.manifest.Config, map[string]interface{}{
+		"com.example.removed": "some value",
+	})
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(context.Background(), manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator, err = New(engine, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch, err := jsonpatch.Parse([]byte(`[
+		{"op": "replace", "path": "/config/User", "value": "patched:user"},
+		{"op": "add", "path": "/config/StopSignal", "value": "SIGTERM"},
+		{"op": "remove", "path": "/com.example.removed"}
+	]`))
+	if err != nil {
+		t.Fatalf("unexpected error parsing patch: %+v", err)
+	}
+	if err := mutator.PatchConfig(context.Background(), patch); err != nil {
+		t.Fatalf("unexpected error patching config: %+v", err)
+	}
+
+	// Patches which modify the rootfs must fail.
+	badPatch, err := jsonpatch.Parse([]byte(`[{"op": "add", "path": "/rootfs/diff_ids/-", "value": "sha256:1234"}]`))
+	if err != nil {
+		t.Fatalf("unexpected error parsing patch: %+v", err)
+	}
+	if err := mutator.PatchConfig(context.Background(), badPatch); err == nil {
+		t.Errorf("expected error when patching rootfs")
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	if mutator.config.Config.User != "patched:user" {
+		t.Errorf("config.Config.User was not patched: %q", mutator.config.Config.User)
+	}
+
+	config := getBlobJSON(t, engine, mutator.manifest.Config.Digest)
+	if _, ok := config["com.example.removed"]; ok {
+		t.Errorf("unknown field was not removed by patch: %v", config)
+	}
+	if signal := config["config"].(map[string]interface{})["StopSignal"]; signal != "SIGTERM" {
+		t.Errorf("unknown field was not added by patch: %v", config)
+	}
+}
+
+func TestMutateAnnotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAnnotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []AnnotationTarget{AnnotationManifest, AnnotationConfig} {
+		if err := mutator.SetAnnotation(context.Background(), target, "org.example.keep", "value"); err != nil {
+			t.Fatalf("unexpected error setting %s annotation: %+v", target, err)
+		}
+		if err := mutator.SetAnnotation(context.Background(), target, "org.example.delete", "value"); err != nil {
+			t.Fatalf("unexpected error setting %s annotation: %+v", target, err)
+		}
+		if err := mutator.DeleteAnnotation(context.Background(), target, "org.example.delete"); err != nil {
+			t.Fatalf("unexpected error deleting %s annotation: %+v", target, err)
+		}
+		// Deleting a missing annotation is not an error.
+		if err := mutator.DeleteAnnotation(context.Background(), target, "org.example.missing"); err != nil {
+			t.Errorf("unexpected error deleting missing %s annotation: %+v", target, err)
+		}
+		if err := mutator.SetAnnotation(context.Background(), target, "", "value"); err == nil {
+			t.Errorf("expected error setting %s annotation with empty key", target)
+		}
+	}
+	if err := mutator.SetAnnotation(context.Background(), "invalid", "key", "value"); err == nil {
+		t.Errorf("expected error setting annotation with unknown target")
+	}
+
+	historyLength := len(mutator.config.History)
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	for target, annotations := range map[AnnotationTarget]map[string]string{
+		AnnotationManifest: mutator.manifest.Annotations,
+		AnnotationConfig:   mutator.config.Config.Labels,
+	} {
+		if annotations["org.example.keep"] != "value" {
+			t.Errorf("%s annotation was not set: %v", target, annotations)
+		}
+		if _, ok := annotations["org.example.delete"]; ok {
+			t.Errorf("%s annotation was not deleted: %v", target, annotations)
+		}
+	}
+	if len(mutator.config.History) != historyLength {
+		t.Errorf("history was modified: %+v", mutator.config.History)
+	}
+}
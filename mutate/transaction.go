@@ -0,0 +1,224 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Transaction batches several modifications of a tagged image (adding layers,
+// changing the configuration, updating annotations and so on -- anything
+// supported by Mutator), so that only a single new manifest is written and
+// the tag is only updated once. The tag is updated by Commit, which fails if
+// the tag was changed since the transaction began. Abort removes every blob
+// written by the transaction, leaving the image as it was.
+//
+// The usual pattern is:
+//
+//	tx, err := mutate.Begin(ctx, engine, "latest")
+//	if err != nil { ... }
+//	defer tx.Abort(ctx)
+//	... modify the image using tx.Mutator() ...
+//	newDescriptor, err := tx.Commit(ctx)
+type Transaction struct {
+	engine   *recordingEngine
+	name     string
+	base     ispec.Descriptor
+	mutator  *Mutator
+	existing map[digest.Digest]struct{}
+
+	// done is set once the transaction has been committed or aborted.
+	done bool
+}
+
+// recordingEngine is a cas.Engine which records the blobs written to it.
+type recordingEngine struct {
+	cas.Engine
+
+	lock    sync.Mutex
+	written []digest.Digest
+}
+
+func (e *recordingEngine) record(blobDigest digest.Digest) {
+	e.lock.Lock()
+	e.written = append(e.written, blobDigest)
+	e.lock.Unlock()
+}
+
+// PutBlob adds a new blob to the image, recording its digest.
+func (e *recordingEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	blobDigest, size, err := e.Engine.PutBlob(ctx, reader)
+	if err == nil {
+		e.record(blobDigest)
+	}
+	return blobDigest, size, err
+}
+
+// PutBlobJSON adds a new JSON blob to the image, recording its digest.
+func (e *recordingEngine) PutBlobJSON(ctx context.Context, data interface{}) (digest.Digest, int64, error) {
+	blobDigest, size, err := e.Engine.PutBlobJSON(ctx, data)
+	if err == nil {
+		e.record(blobDigest)
+	}
+	return blobDigest, size, err
+}
+
+// Begin starts a transaction modifying the image manifest referenced by the
+// given tag.
+func Begin(ctx context.Context, engine cas.Engine, name string) (*Transaction, error) {
+	base, err := engine.GetReference(ctx, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get reference %s", name)
+	}
+
+	// Blobs which already exist must never be removed by Abort, even if the
+	// transaction writes them again.
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list blobs")
+	}
+	existing := map[digest.Digest]struct{}{}
+	for _, blob := range blobs {
+		existing[blob] = struct{}{}
+	}
+
+	recorder := &recordingEngine{Engine: engine}
+	mutator, err := New(recorder, base)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create mutator for %s", name)
+	}
+	return &Transaction{
+		engine:   recorder,
+		name:     name,
+		base:     base,
+		mutator:  mutator,
+		existing: existing,
+	}, nil
+}
+
+// Mutator returns the Mutator used to modify the image. Commit must be used
+// rather than Mutator.Commit, so that the tag is updated.
+func (tx *Transaction) Mutator() *Mutator {
+	return tx.mutator
+}
+
+// Base returns the descriptor of the image manifest the transaction began
+// with.
+func (tx *Transaction) Base() ispec.Descriptor {
+	return tx.base
+}
+
+// Commit writes the new image manifest and updates the tag to refer to it,
+// returning the new descriptor. If the tag no longer refers to the manifest
+// the transaction began with, the tag is not modified and a *cas.ClobberError
+// is returned (the transaction can still be aborted). If the engine
+// implements cas.UpdatingEngine, the tag is updated atomically.
+func (tx *Transaction) Commit(ctx context.Context) (ispec.Descriptor, error) {
+	if tx.done {
+		return ispec.Descriptor{}, errors.Errorf("transaction for %s already finished", tx.name)
+	}
+
+	descriptor, err := tx.mutator.Commit(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "commit image")
+	}
+	if err := tx.updateReference(ctx, descriptor); err != nil {
+		return ispec.Descriptor{}, err
+	}
+	tx.done = true
+
+	event.Log(ctx).WithFields(event.Fields{
+		"name":       tx.name,
+		"descriptor": descriptor.Digest,
+	}).Debugf("mutate: committed transaction")
+	return descriptor, nil
+}
+
+// updateReference replaces the base descriptor stored in the tag with the
+// given descriptor.
+func (tx *Transaction) updateReference(ctx context.Context, descriptor ispec.Descriptor) error {
+	engine := tx.engine.Engine
+	if updater, ok := engine.(cas.UpdatingEngine); ok {
+		err := updater.UpdateReference(ctx, tx.name, &tx.base, descriptor)
+		if errors.Cause(err) != cas.ErrNotImplemented {
+			return errors.Wrapf(err, "update reference %s", tx.name)
+		}
+	}
+
+	// Fall back to checking the tag ourselves, which is racy but still
+	// catches most conflicting modifications.
+	current, err := engine.GetReference(ctx, tx.name)
+	if err != nil {
+		return errors.Wrapf(err, "get reference %s", tx.name)
+	}
+	if !reflect.DeepEqual(current, tx.base) {
+		return errors.Wrapf(&cas.ClobberError{Name: tx.name, Old: current, New: descriptor}, "update reference %s", tx.name)
+	}
+	if err := engine.DeleteReference(ctx, tx.name); err != nil {
+		return errors.Wrapf(err, "delete reference %s", tx.name)
+	}
+	return errors.Wrapf(engine.PutReference(ctx, tx.name, descriptor), "put reference %s", tx.name)
+}
+
+// Abort discards the transaction, removing every blob written by it which
+// didn't exist when the transaction began. Calling Abort after Commit has
+// succeeded (or after a previous Abort) does nothing, so it is safe to defer.
+// Like casext.GC, this assumes that nothing else is writing to the image
+// while the transaction is in progress.
+func (tx *Transaction) Abort(ctx context.Context) error {
+	if tx.done {
+		return nil
+	}
+	tx.done = true
+
+	tx.engine.lock.Lock()
+	written := append([]digest.Digest{}, tx.engine.written...)
+	tx.engine.lock.Unlock()
+	sort.Slice(written, func(i, j int) bool { return written[i] < written[j] })
+
+	var removed int
+	for idx, blob := range written {
+		if idx > 0 && written[idx-1] == blob {
+			continue
+		}
+		if _, ok := tx.existing[blob]; ok {
+			continue
+		}
+		if err := tx.engine.Engine.DeleteBlob(ctx, blob); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return errors.Wrapf(err, "remove blob %s", blob)
+		}
+		removed++
+	}
+
+	event.Log(ctx).WithFields(event.Fields{
+		"name":  tx.name,
+		"blobs": removed,
+	}).Debugf("mutate: aborted transaction")
+	return nil
+}
@@ -0,0 +1,156 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func listBlobs(t *testing.T, engine cas.Engine) map[digest.Digest]struct{} {
+	blobs, err := engine.ListBlobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := map[digest.Digest]struct{}{}
+	for _, blob := range blobs {
+		set[blob] = struct{}{}
+	}
+	return set
+}
+
+func TestMutateTransaction(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "umoci-TestMutateTransaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	if err := engine.PutReference(ctx, "latest", fromDescriptor); err != nil {
+		t.Fatal(err)
+	}
+	before := listBlobs(t, engine)
+
+	// An aborted transaction leaves no trace.
+	tx, err := Begin(ctx, engine, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error beginning transaction: %+v", err)
+	}
+	if err := tx.Mutator().Add(ctx, bytes.NewBufferString("aborted"), ispec.History{}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if err := tx.Abort(ctx); err != nil {
+		t.Fatalf("unexpected error aborting transaction: %+v", err)
+	}
+	if after := listBlobs(t, engine); !reflect.DeepEqual(after, before) {
+		t.Errorf("aborted transaction left blobs behind: %d blobs before, %d after", len(before), len(after))
+	}
+	if _, err := tx.Commit(ctx); err == nil {
+		t.Errorf("expected error committing aborted transaction")
+	}
+
+	// Several operations result in a single new manifest.
+	tx, err = Begin(ctx, engine, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error beginning transaction: %+v", err)
+	}
+	defer tx.Abort(ctx)
+	mutator := tx.Mutator()
+	config, err := mutator.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := mutator.Meta(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.User = "transaction:user"
+	if err := mutator.Set(ctx, config, meta, nil, ispec.History{Comment: "config"}); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+	if err := mutator.Add(ctx, bytes.NewBufferString("layer"), ispec.History{Comment: "layer"}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if err := mutator.SetAnnotation(ctx, AnnotationManifest, "org.opencontainers.image.title", "transaction"); err != nil {
+		t.Fatalf("unexpected error setting annotation: %+v", err)
+	}
+	newDescriptor, err := tx.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing transaction: %+v", err)
+	}
+	// Abort after Commit is a no-op.
+	if err := tx.Abort(ctx); err != nil {
+		t.Fatalf("unexpected error aborting committed transaction: %+v", err)
+	}
+
+	current, err := engine.GetReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(current, newDescriptor) {
+		t.Errorf("reference not updated: got %v, expected %v", current, newDescriptor)
+	}
+	// The layer, configuration and manifest.
+	if after := listBlobs(t, engine); len(after) != len(before)+3 {
+		t.Errorf("expected transaction to add 3 blobs, got %d", len(after)-len(before))
+	}
+
+	// Conflicting modifications of the tag are detected.
+	tx, err = Begin(ctx, engine, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error beginning transaction: %+v", err)
+	}
+	if err := tx.Mutator().SetAnnotation(ctx, AnnotationManifest, "conflict", "yes"); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.DeleteReference(ctx, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.PutReference(ctx, "latest", fromDescriptor); err != nil {
+		t.Fatal(err)
+	}
+	beforeConflict := listBlobs(t, engine)
+	if _, err := tx.Commit(ctx); errors.Cause(err) != cas.ErrClobber {
+		t.Errorf("expected clobber error committing conflicting transaction, got %+v", err)
+	}
+	if err := tx.Abort(ctx); err != nil {
+		t.Fatalf("unexpected error aborting transaction: %+v", err)
+	}
+	if after := listBlobs(t, engine); !reflect.DeepEqual(after, beforeConflict) {
+		t.Errorf("aborted transaction left blobs behind: %d blobs before, %d after", len(beforeConflict), len(after))
+	}
+	current, err = engine.GetReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(current, fromDescriptor) {
+		t.Errorf("conflicting reference was modified: got %v", current)
+	}
+}
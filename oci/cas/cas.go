@@ -18,8 +18,14 @@
 package cas
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"os"
+	"reflect"
+	"sort"
+	"time"
 
 	// We need to include sha256 in order for go-digest to properly handle such
 	// hashes, since Go's crypto library like to lazy-load cryptographic
@@ -37,8 +43,21 @@ const (
 	BlobAlgorithm = digest.SHA256
 )
 
-// Exposed errors.
+// Exposed errors. The errors returned by engines (and the other packages of
+// umoci) wrap these errors where appropriate, so callers can check for them
+// with errors.Is (or by comparing against errors.Cause) rather than matching
+// error strings.
 var (
+	// ErrNotExist is returned when a requested blob or reference does not
+	// exist. It is os.ErrNotExist, so os.IsNotExist(errors.Cause(err)) also
+	// works.
+	ErrNotExist = os.ErrNotExist
+
+	// ErrDigestMismatch is returned when the contents of a blob do not match
+	// the digest they were expected to have. It is the cause of a
+	// *DigestMismatchError.
+	ErrDigestMismatch = fmt.Errorf("digest mismatch")
+
 	// ErrInvalid is returned when an image was detected as being invalid.
 	ErrInvalid = fmt.Errorf("invalid image detected")
 
@@ -47,16 +66,173 @@ var (
 	ErrNotImplemented = fmt.Errorf("operation not implemented")
 
 	// ErrClobber is returned when a requested operation would require clobbering a
-	// reference or blob which already exists.
+	// reference or blob which already exists. Note that PutReference returns a
+	// *ClobberError, so callers should use errors.Is (or compare against
+	// errors.Cause(err)).
 	ErrClobber = fmt.Errorf("operation would clobber existing object")
+
+	// ErrFrozen is returned when a requested operation would modify or remove
+	// a reference which has been frozen (see FreezingEngine).
+	ErrFrozen = fmt.Errorf("reference is frozen")
+
+	// ErrReadOnly is returned when a requested operation would modify an
+	// image which was opened read-only (see OpenReadOnly).
+	ErrReadOnly = fmt.Errorf("image is opened read-only")
+
+	// ErrBusy is returned when an engine could not exclude the other users
+	// of an image in time (see ExclusiveEngine).
+	ErrBusy = fmt.Errorf("image is busy")
 )
 
+// ClobberError is returned by PutReference when the reference already exists
+// but does not match the descriptor requested to be stored. It contains both
+// the old and new descriptors so that callers can report what would have been
+// overwritten. errors.Cause() of a ClobberError is ErrClobber.
+type ClobberError struct {
+	// Name is the name of the reference that would have been clobbered.
+	Name string
+
+	// Old is the descriptor currently stored at Name.
+	Old ispec.Descriptor
+
+	// New is the descriptor that was requested to be stored at Name.
+	New ispec.Descriptor
+}
+
+// Error returns a human-readable description of the conflict.
+func (e *ClobberError) Error() string {
+	return fmt.Sprintf("%s: reference %q (%s -> %s)", ErrClobber, e.Name, e.Old.Digest, e.New.Digest)
+}
+
+// Cause returns ErrClobber, so that errors.Cause() works on ClobberError.
+func (e *ClobberError) Cause() error {
+	return ErrClobber
+}
+
+// Unwrap returns ErrClobber, so that errors.Is(err, ErrClobber) works on
+// ClobberError.
+func (e *ClobberError) Unwrap() error {
+	return ErrClobber
+}
+
+// Diff returns a list of the fields that differ between the old and new
+// descriptors, in the form "field: old -> new". The descriptors are compared
+// as they are serialised, so that every field (including any annotations) is
+// reported. Object fields such as annotations are compared key by key, in the
+// form "annotations.key: old -> new", and missing fields are shown as
+// "<none>".
+func (e *ClobberError) Diff() []string {
+	return diffFields("", descriptorFields(e.Old), descriptorFields(e.New))
+}
+
+// descriptorFields returns the serialised fields of a descriptor.
+func descriptorFields(descriptor ispec.Descriptor) map[string]interface{} {
+	var fields map[string]interface{}
+	data, err := json.Marshal(descriptor)
+	if err == nil {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&fields)
+	}
+	if err != nil {
+		// Should _never_ be reached.
+		return map[string]interface{}{"digest": descriptor.Digest.String()}
+	}
+	return fields
+}
+
+// diffFields returns the differences between two sets of serialised fields,
+// sorted by field name. Object fields are compared recursively.
+func diffFields(prefix string, old, new map[string]interface{}) []string {
+	var keys []string
+	for key := range old {
+		keys = append(keys, key)
+	}
+	for key := range new {
+		if _, ok := old[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var diff []string
+	for _, key := range keys {
+		oldValue, hasOld := old[key]
+		newValue, hasNew := new[key]
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		oldObject, oldIsObject := oldValue.(map[string]interface{})
+		newObject, newIsObject := newValue.(map[string]interface{})
+		if (oldIsObject || !hasOld) && (newIsObject || !hasNew) {
+			diff = append(diff, diffFields(prefix+key+".", oldObject, newObject)...)
+			continue
+		}
+		diff = append(diff, fmt.Sprintf("%s%s: %s -> %s", prefix, key, formatField(oldValue, hasOld), formatField(newValue, hasNew)))
+	}
+	return diff
+}
+
+// formatField formats a serialised field for Diff.
+func formatField(value interface{}, ok bool) string {
+	if !ok {
+		return "<none>"
+	}
+	if str, isString := value.(string); isString {
+		return str
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
+
+// DigestMismatchError is returned when the contents of a blob do not match the
+// digest they were expected to have. errors.Cause() of a DigestMismatchError
+// is ErrDigestMismatch.
+type DigestMismatchError struct {
+	// Expected is the digest the blob was expected to have.
+	Expected digest.Digest
+
+	// Actual is the digest of the contents of the blob.
+	Actual digest.Digest
+}
+
+// Error returns a human-readable description of the mismatch.
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("%s: expected %s got %s", ErrDigestMismatch, e.Expected, e.Actual)
+}
+
+// Cause returns ErrDigestMismatch, so that errors.Cause() works on
+// DigestMismatchError.
+func (e *DigestMismatchError) Cause() error {
+	return ErrDigestMismatch
+}
+
+// Unwrap returns ErrDigestMismatch, so that errors.Is(err, ErrDigestMismatch)
+// works on DigestMismatchError.
+func (e *DigestMismatchError) Unwrap() error {
+	return ErrDigestMismatch
+}
+
 // Engine is an interface that provides methods for accessing and modifying an
 // OCI image, namely allowing access to reference descriptors and blobs.
+//
+// Writes are atomic: once PutBlob, PutReference (or DeleteReference) returns,
+// other users of the image either see the complete blob or descriptor or
+// nothing at all (never a partially written one), even if the writer crashes.
+// Whether a successful write is also durable (survives a crash of the whole
+// system) depends on the engine; the dir engine flushes every write to stable
+// storage unless it was opened with dir.Options.NoSync, so as long as blobs
+// are written before the references to them a crash never leaves references
+// to missing or truncated blobs.
 type Engine interface {
 	// PutBlob adds a new blob to the image. This is idempotent; a nil error
 	// means that "the content is stored at DIGEST" without implying "because
-	// of this PutBlob() call".
+	// of this PutBlob() call". event.BlobStart and event.BlobDone events are
+	// emitted, along with event.Progress events as reader is read (see
+	// event.StartBlob).
 	PutBlob(ctx context.Context, reader io.Reader) (digest digest.Digest, size int64, err error)
 
 	// PutBlobJSON adds a new JSON blob to the image (marshalled from the given
@@ -75,11 +251,14 @@ type Engine interface {
 	// idempotent; a nil error means that "the descriptor is stored at NAME"
 	// without implying "because of this PutReference() call". ErrClobber is
 	// returned if there is already a descriptor stored at NAME, but does not
-	// match the descriptor requested to be stored.
+	// match the descriptor requested to be stored (the returned error is a
+	// *ClobberError describing the conflict).
 	PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) (err error)
 
 	// GetBlob returns a reader for retrieving a blob from the image, which the
 	// caller must Close(). Returns os.ErrNotExist if the digest is not found.
+	// event.BlobStart and event.BlobDone events are emitted, along with
+	// event.Progress events as the blob is read (see event.NewBlobReader).
 	GetBlob(ctx context.Context, digest digest.Digest) (reader io.ReadCloser, err error)
 
 	// GetReference returns a reference from the image. Returns os.ErrNotExist
@@ -112,3 +291,146 @@ type Engine interface {
 	// may fail.
 	Close() (err error)
 }
+
+// ResumableEngine is implemented by engines which can persist partially
+// written blobs, so that writing a large blob can be resumed after being
+// interrupted (rather than starting from scratch). Each partial blob is
+// identified by a session ID chosen by the caller, which must only contain
+// letters, digits, ".", "_" and "-" (and must not start with "." or "-").
+// Engines which wrap another engine may return ErrNotImplemented if the
+// wrapped engine doesn't support resumable writes.
+type ResumableEngine interface {
+	Engine
+
+	// BlobUploadOffset returns the number of bytes already written to the
+	// blob with the given session ID, which is zero if no such session
+	// exists.
+	BlobUploadOffset(ctx context.Context, session string) (offset int64, err error)
+
+	// PutBlobResumable appends the contents of reader to the blob with the
+	// given session ID, which must start at the offset returned by
+	// BlobUploadOffset. If reading from reader fails, the data written so
+	// far is kept so that it can be resumed. Once reader is exhausted, the
+	// blob is added to the image if its digest matches the expected digest
+	// (otherwise the session is discarded and an error is returned).
+	PutBlobResumable(ctx context.Context, session string, expected digest.Digest, reader io.Reader) (digest digest.Digest, size int64, err error)
+
+	// AbortBlobUpload discards the blob with the given session ID. This is
+	// idempotent; a nil error means "the session does not exist".
+	AbortBlobUpload(ctx context.Context, session string) (err error)
+}
+
+// LinkingEngine is implemented by engines which can add a blob to the image
+// by linking it from a store shared with other images (such as a pool of
+// blobs on the same filesystem), rather than storing a separate copy of the
+// blob. Engines which can't (such as those without a shared store configured)
+// may return ErrNotImplemented.
+type LinkingEngine interface {
+	Engine
+
+	// LinkBlob adds the blob with the given digest to the image from the
+	// shared store. Returns os.ErrNotExist if the blob is not in the shared
+	// store.
+	LinkBlob(ctx context.Context, digest digest.Digest) (size int64, err error)
+}
+
+// UpdatingEngine is implemented by engines which can atomically replace the
+// descriptor stored at a reference (a compare-and-swap), so that concurrent
+// writers cannot silently overwrite each other's references. Engines which
+// wrap another engine may return ErrNotImplemented if the wrapped engine
+// doesn't support atomic updates.
+type UpdatingEngine interface {
+	Engine
+
+	// UpdateReference replaces the descriptor stored at NAME with
+	// newDescriptor, but only if the descriptor currently stored at NAME is
+	// oldDescriptor (if oldDescriptor is nil, NAME must not exist). If NAME
+	// doesn't match oldDescriptor, a *ClobberError containing the current
+	// descriptor is returned (or os.ErrNotExist if NAME doesn't exist). This
+	// is idempotent; a nil error means that "the descriptor is stored at
+	// NAME" without implying "because of this UpdateReference() call".
+	UpdateReference(ctx context.Context, name string, oldDescriptor *ispec.Descriptor, newDescriptor ispec.Descriptor) (err error)
+}
+
+// FreezingEngine is implemented by engines which can mark references as
+// frozen. A frozen reference cannot be changed or removed -- PutReference,
+// UpdateReference and DeleteReference return ErrFrozen if they would modify
+// it -- until it has been unfrozen. This is intended as a safety net against
+// accidentally clobbering important references, not as access control.
+// Engines which wrap another engine may return ErrNotImplemented if the
+// wrapped engine doesn't support freezing.
+type FreezingEngine interface {
+	Engine
+
+	// FreezeReference marks NAME as frozen. Returns os.ErrNotExist if NAME
+	// doesn't exist. This is idempotent.
+	FreezeReference(ctx context.Context, name string) (err error)
+
+	// UnfreezeReference removes the frozen mark from NAME, if present. This
+	// is idempotent.
+	UnfreezeReference(ctx context.Context, name string) (err error)
+
+	// ReferenceFrozen returns whether NAME is frozen.
+	ReferenceFrozen(ctx context.Context, name string) (frozen bool, err error)
+}
+
+// BlobInfo describes a blob stored in an image.
+type BlobInfo struct {
+	// Size is the size of the blob in bytes.
+	Size int64
+
+	// ModTime is the time at which the blob was last written to the image.
+	ModTime time.Time
+}
+
+// StatingEngine is implemented by engines which can return information about
+// a blob without reading its contents. Engines which wrap another engine may
+// return ErrNotImplemented if the wrapped engine doesn't support this.
+type StatingEngine interface {
+	Engine
+
+	// StatBlob returns information about the blob with the given digest.
+	// Returns os.ErrNotExist if the digest is not found.
+	StatBlob(ctx context.Context, digest digest.Digest) (info BlobInfo, err error)
+}
+
+// BlobReaderAt provides random access to the contents of a blob, which the
+// caller must Close(). The contents are not verified against the digest of
+// the blob.
+type BlobReaderAt interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// RandomAccessEngine is implemented by engines which can open a blob for
+// random access, so that ranged reads of large blobs (such as reading the
+// table of contents at the end of an eStargz layer) don't require reading the
+// whole blob. Engines which store blobs as files may return an *os.File, which
+// callers can use to mmap(2) the blob. Engines which wrap another engine (or
+// which can't provide random access to a particular blob, such as a blob
+// stored compressed) may return ErrNotImplemented.
+type RandomAccessEngine interface {
+	Engine
+
+	// GetBlobAt opens the blob with the given digest for random access,
+	// returning the opened blob and its size. Returns os.ErrNotExist if the
+	// digest is not found.
+	GetBlobAt(ctx context.Context, digest digest.Digest) (reader BlobReaderAt, size int64, err error)
+}
+
+// ExclusiveEngine is implemented by engines which can exclude other engines
+// from writing to an image, which is necessary for operations that would
+// otherwise race with concurrent writers (such as a garbage collection, which
+// could remove the blobs written by a concurrent writer before they are
+// referenced). Readers are not excluded. Engines which wrap another engine
+// may return ErrNotImplemented if the wrapped engine doesn't support this.
+type ExclusiveEngine interface {
+	Engine
+
+	// LockExclusive waits until no other engine is writing to the image and
+	// prevents other engines from starting to write to it until the returned
+	// function is called. If other engines are still writing after timeout
+	// (or immediately, if timeout is zero), ErrBusy is returned rather than
+	// waiting indefinitely.
+	LockExclusive(ctx context.Context, timeout time.Duration) (unlock func() error, err error)
+}
@@ -0,0 +1,84 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"reflect"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestClobberErrorDiff(t *testing.T) {
+	clobber := &ClobberError{
+		Name: "latest",
+		Old: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			Size:      1234567890,
+		},
+		New: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+			Size:      1234567890,
+			URLs:      []string{"https://example.com/blob"},
+		},
+	}
+	expected := []string{
+		"digest: sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa -> sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+		`urls: <none> -> ["https://example.com/blob"]`,
+	}
+	if diff := clobber.Diff(); !reflect.DeepEqual(diff, expected) {
+		t.Errorf("unexpected diff: expected %q, got %q", expected, diff)
+	}
+}
+
+func TestDiffFieldsAnnotations(t *testing.T) {
+	old := map[string]interface{}{
+		"digest": "sha256:aaaa",
+		"annotations": map[string]interface{}{
+			"org.opencontainers.image.ref.name": "v1",
+			"removed":                           "value",
+			"unchanged":                         "value",
+		},
+	}
+	new := map[string]interface{}{
+		"digest": "sha256:aaaa",
+		"annotations": map[string]interface{}{
+			"org.opencontainers.image.ref.name": "v2",
+			"unchanged":                         "value",
+		},
+	}
+	expected := []string{
+		"annotations.org.opencontainers.image.ref.name: v1 -> v2",
+		"annotations.removed: value -> <none>",
+	}
+	if diff := diffFields("", old, new); !reflect.DeepEqual(diff, expected) {
+		t.Errorf("unexpected diff: expected %q, got %q", expected, diff)
+	}
+
+	delete(new, "annotations")
+	expected = []string{
+		"annotations.org.opencontainers.image.ref.name: v1 -> <none>",
+		"annotations.removed: value -> <none>",
+		"annotations.unchanged: value -> <none>",
+	}
+	if diff := diffFields("", old, new); !reflect.DeepEqual(diff, expected) {
+		t.Errorf("unexpected diff without annotations: expected %q, got %q", expected, diff)
+	}
+}
@@ -48,6 +48,19 @@ type Driver interface {
 	Create(uri string) error
 }
 
+// ReadOnlyDriver is implemented by drivers which can open an image such that
+// the engine is guaranteed not to modify the image in any way (not even
+// through temporary files or locks requiring write access), so that images
+// on read-only storage can still be inspected. All operations of such an
+// engine which would modify the image return ErrReadOnly.
+type ReadOnlyDriver interface {
+	Driver
+
+	// OpenReadOnly "opens" a new read-only CAS engine accessor for the given
+	// URI.
+	OpenReadOnly(uri string) (Engine, error)
+}
+
 var (
 	dm      sync.RWMutex
 	drivers []Driver
@@ -87,6 +100,22 @@ func Open(uri string) (Engine, error) {
 	return driver.Open(uri)
 }
 
+// OpenReadOnly is like Open, except that if the chosen driver implements
+// ReadOnlyDriver the image is opened read-only. Drivers which don't implement
+// ReadOnlyDriver never write to the image unless asked to, so the image is
+// opened with Open.
+func OpenReadOnly(uri string) (Engine, error) {
+	driver := findSupported(uri)
+	if driver == nil {
+		return nil, errors.Errorf("drivers: unsupported uri: %s", uri)
+	}
+
+	if roDriver, ok := driver.(ReadOnlyDriver); ok {
+		return roDriver.OpenReadOnly(uri)
+	}
+	return driver.Open(uri)
+}
+
 // Create creates a new image by one of the registered drivers that support the
 // provided URI (if no such driver exists, an error is returned). If more than
 // one driver supports the provided URI, the first of the candidate drivers to
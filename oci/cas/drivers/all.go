@@ -22,6 +22,16 @@ package drivers
 
 // Import all official OCI drivers.
 import (
+	// Implements chunked (deduplicating) images. This must be registered
+	// before dir, because existing chunked images are also directories.
+	_ "github.com/openSUSE/umoci/oci/cas/drivers/chunked"
+
 	// Implements directory-backed OCI layouts.
 	_ "github.com/openSUSE/umoci/oci/cas/drivers/dir"
+
+	// Implements in-memory OCI images.
+	_ "github.com/openSUSE/umoci/oci/cas/drivers/mem"
+
+	// Implements images stored in S3-compatible buckets.
+	_ "github.com/openSUSE/umoci/oci/cas/drivers/s3"
 )
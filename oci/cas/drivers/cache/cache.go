@@ -0,0 +1,441 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package cache implements a cas.Engine which composes two other engines: a
+// (slow) backend which is the source of truth, and a (fast) cache into which
+// blobs fetched from the backend are transparently copied. Because blobs are
+// content-addressed, a blob in the cache can never be stale. References are
+// mutable and are thus never cached.
+//
+// Unlike the other packages in drivers, this package does not register a
+// cas.Driver because there is no sensible URI form for a pair of engines.
+package cache
+
+import (
+	"container/list"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Options specifies how the cache should be managed.
+type Options struct {
+	// MaxSize is the maximum total size (in bytes) of the blobs stored in the
+	// cache engine. Once exceeded, the least recently used blobs are evicted
+	// from the cache. If MaxSize <= 0 then the cache is unbounded.
+	MaxSize int64
+}
+
+// entry is an element of the LRU list.
+type entry struct {
+	digest digest.Digest
+	size   int64
+}
+
+type cacheEngine struct {
+	backend cas.Engine
+	cache   cas.Engine
+	options Options
+
+	// lock protects all of the LRU state below.
+	lock    sync.Mutex
+	lru     *list.List
+	entries map[digest.Digest]*list.Element
+	size    int64
+}
+
+// touch marks the given digest as having been used most recently. If size is
+// negative and the digest is not already known, the size is recorded as zero
+// until it is learned.
+func (e *cacheEngine) touch(digest digest.Digest, size int64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if elem, ok := e.entries[digest]; ok {
+		e.lru.MoveToFront(elem)
+		ent := elem.Value.(*entry)
+		if size >= 0 && ent.size != size {
+			e.size += size - ent.size
+			ent.size = size
+		}
+		return
+	}
+
+	if size < 0 {
+		size = 0
+	}
+	e.entries[digest] = e.lru.PushFront(&entry{digest: digest, size: size})
+	e.size += size
+}
+
+// forget removes the given digest from the LRU state.
+func (e *cacheEngine) forget(digest digest.Digest) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if elem, ok := e.entries[digest]; ok {
+		e.size -= elem.Value.(*entry).size
+		e.lru.Remove(elem)
+		delete(e.entries, digest)
+	}
+}
+
+// evict removes the least recently used blobs from the cache engine until the
+// cache fits within Options.MaxSize. The blob with the given digest is never
+// evicted (it is the blob currently being used).
+func (e *cacheEngine) evict(ctx context.Context, keep digest.Digest) error {
+	if e.options.MaxSize <= 0 {
+		return nil
+	}
+
+	for {
+		e.lock.Lock()
+		if e.size <= e.options.MaxSize {
+			e.lock.Unlock()
+			return nil
+		}
+		elem := e.lru.Back()
+		for elem != nil && elem.Value.(*entry).digest == keep {
+			elem = elem.Prev()
+		}
+		if elem == nil {
+			e.lock.Unlock()
+			return nil
+		}
+		victim := elem.Value.(*entry)
+		e.size -= victim.size
+		e.lru.Remove(elem)
+		delete(e.entries, victim.digest)
+		e.lock.Unlock()
+
+		event.Log(ctx).WithFields(event.Fields{
+			"digest": victim.digest,
+			"size":   victim.size,
+		}).Debugf("cache: evicting blob")
+
+		if err := e.cache.DeleteBlob(ctx, victim.digest); err != nil {
+			return errors.Wrap(err, "evict cached blob")
+		}
+	}
+}
+
+// fill copies the blob with the given digest from the backend into the cache,
+// verifying that the digest of the copied blob matches.
+func (e *cacheEngine) fill(ctx context.Context, blobDigest digest.Digest) error {
+	reader, err := e.backend.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return errors.Wrap(err, "get backend blob")
+	}
+	defer reader.Close()
+
+	gotDigest, size, err := e.cache.PutBlob(ctx, reader)
+	if err != nil {
+		return errors.Wrap(err, "put cached blob")
+	}
+	if gotDigest != blobDigest {
+		// Don't leave a bogus blob in the cache.
+		e.cache.DeleteBlob(ctx, gotDigest)
+		return errors.Wrap(&cas.DigestMismatchError{Expected: blobDigest, Actual: gotDigest}, "cache: backend blob")
+	}
+
+	e.touch(blobDigest, size)
+	return e.evict(ctx, blobDigest)
+}
+
+// countingReader is a wrapper around an io.ReadCloser that records the size
+// of a cached blob in the LRU state once it has been read completely.
+type countingReader struct {
+	io.ReadCloser
+	engine *cacheEngine
+	digest digest.Digest
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	if err == io.EOF {
+		r.engine.touch(r.digest, r.n)
+	}
+	return n, err
+}
+
+// PutBlob adds a new blob to the backend. The blob is only added to the cache
+// once it has been fetched with GetBlob.
+func (e *cacheEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	return e.backend.PutBlob(ctx, reader)
+}
+
+// PutBlobJSON adds a new JSON blob to the backend.
+func (e *cacheEngine) PutBlobJSON(ctx context.Context, data interface{}) (digest.Digest, int64, error) {
+	return e.backend.PutBlobJSON(ctx, data)
+}
+
+// PutReference adds a new reference descriptor to the backend.
+func (e *cacheEngine) PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	return e.backend.PutReference(ctx, name, descriptor)
+}
+
+// UpdateReference atomically updates a reference in the backend, if it is a
+// cas.UpdatingEngine.
+func (e *cacheEngine) UpdateReference(ctx context.Context, name string, oldDescriptor *ispec.Descriptor, newDescriptor ispec.Descriptor) error {
+	backend, ok := e.backend.(cas.UpdatingEngine)
+	if !ok {
+		return cas.ErrNotImplemented
+	}
+	return backend.UpdateReference(ctx, name, oldDescriptor, newDescriptor)
+}
+
+// FreezeReference marks a reference in the backend as frozen, if it is a
+// cas.FreezingEngine.
+func (e *cacheEngine) FreezeReference(ctx context.Context, name string) error {
+	backend, ok := e.backend.(cas.FreezingEngine)
+	if !ok {
+		return cas.ErrNotImplemented
+	}
+	return backend.FreezeReference(ctx, name)
+}
+
+// UnfreezeReference removes the frozen mark from a reference in the backend,
+// if it is a cas.FreezingEngine.
+func (e *cacheEngine) UnfreezeReference(ctx context.Context, name string) error {
+	backend, ok := e.backend.(cas.FreezingEngine)
+	if !ok {
+		return cas.ErrNotImplemented
+	}
+	return backend.UnfreezeReference(ctx, name)
+}
+
+// ReferenceFrozen returns whether a reference in the backend is frozen, if it
+// is a cas.FreezingEngine.
+func (e *cacheEngine) ReferenceFrozen(ctx context.Context, name string) (bool, error) {
+	backend, ok := e.backend.(cas.FreezingEngine)
+	if !ok {
+		return false, cas.ErrNotImplemented
+	}
+	return backend.ReferenceFrozen(ctx, name)
+}
+
+// LockExclusive excludes the other writers of the backend, if it is a
+// cas.ExclusiveEngine. The cache is not locked.
+func (e *cacheEngine) LockExclusive(ctx context.Context, timeout time.Duration) (func() error, error) {
+	backend, ok := e.backend.(cas.ExclusiveEngine)
+	if !ok {
+		return nil, cas.ErrNotImplemented
+	}
+	return backend.LockExclusive(ctx, timeout)
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). If the blob is not present in the cache, it is first
+// copied from the backend into the cache. Returns os.ErrNotExist if the digest
+// is not found in either engine.
+func (e *cacheEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	reader, err := e.cache.GetBlob(ctx, digest)
+	if err == nil {
+		event.Log(ctx).WithFields(event.Fields{
+			"digest": digest,
+		}).Debugf("cache: hit")
+		event.Emit(ctx, event.Event{Type: event.CacheHit, Digest: digest})
+		e.touch(digest, -1)
+		return &countingReader{ReadCloser: reader, engine: e, digest: digest}, nil
+	}
+	if !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Wrap(err, "get cached blob")
+	}
+
+	event.Log(ctx).WithFields(event.Fields{
+		"digest": digest,
+	}).Debugf("cache: miss")
+	event.Emit(ctx, event.Event{Type: event.CacheMiss, Digest: digest})
+	if err := e.fill(ctx, digest); err != nil {
+		return nil, errors.Wrap(err, "fill cache")
+	}
+
+	reader, err = e.cache.GetBlob(ctx, digest)
+	return reader, errors.Wrap(err, "get cached blob")
+}
+
+// GetBlobAt opens a blob in the cache for random access, if the cache is a
+// cas.RandomAccessEngine. As with GetBlob, if the blob is not present in the
+// cache it is first copied from the backend into the cache.
+func (e *cacheEngine) GetBlobAt(ctx context.Context, digest digest.Digest) (cas.BlobReaderAt, int64, error) {
+	cache, ok := e.cache.(cas.RandomAccessEngine)
+	if !ok {
+		return nil, -1, cas.ErrNotImplemented
+	}
+	reader, size, err := cache.GetBlobAt(ctx, digest)
+	if err == nil {
+		event.Emit(ctx, event.Event{Type: event.CacheHit, Digest: digest})
+		e.touch(digest, -1)
+		return reader, size, nil
+	}
+	if !os.IsNotExist(errors.Cause(err)) {
+		return nil, -1, errors.Wrap(err, "get cached blob")
+	}
+
+	event.Emit(ctx, event.Event{Type: event.CacheMiss, Digest: digest})
+	if err := e.fill(ctx, digest); err != nil {
+		return nil, -1, errors.Wrap(err, "fill cache")
+	}
+
+	reader, size, err = cache.GetBlobAt(ctx, digest)
+	return reader, size, errors.Wrap(err, "get cached blob")
+}
+
+// StatBlob returns information about a blob in the backend, if it is a
+// cas.StatingEngine.
+func (e *cacheEngine) StatBlob(ctx context.Context, digest digest.Digest) (cas.BlobInfo, error) {
+	backend, ok := e.backend.(cas.StatingEngine)
+	if !ok {
+		return cas.BlobInfo{}, cas.ErrNotImplemented
+	}
+	return backend.StatBlob(ctx, digest)
+}
+
+// GetReference returns a reference from the backend.
+func (e *cacheEngine) GetReference(ctx context.Context, name string) (ispec.Descriptor, error) {
+	return e.backend.GetReference(ctx, name)
+}
+
+// DeleteBlob removes a blob from both the backend and the cache.
+func (e *cacheEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	if err := e.backend.DeleteBlob(ctx, digest); err != nil {
+		return errors.Wrap(err, "delete backend blob")
+	}
+	e.forget(digest)
+	return errors.Wrap(e.cache.DeleteBlob(ctx, digest), "delete cached blob")
+}
+
+// DeleteReference removes a reference from the backend.
+func (e *cacheEngine) DeleteReference(ctx context.Context, name string) error {
+	return e.backend.DeleteReference(ctx, name)
+}
+
+// ListBlobs returns the set of blob digests stored in the backend.
+func (e *cacheEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	return e.backend.ListBlobs(ctx)
+}
+
+// ListReferences returns the set of reference names stored in the backend.
+func (e *cacheEngine) ListReferences(ctx context.Context) ([]string, error) {
+	return e.backend.ListReferences(ctx)
+}
+
+// Clean executes a garbage collection of any non-blob garbage in both the
+// backend and the cache.
+func (e *cacheEngine) Clean(ctx context.Context) error {
+	if err := e.backend.Clean(ctx); err != nil {
+		return errors.Wrap(err, "clean backend")
+	}
+	return errors.Wrap(e.cache.Clean(ctx), "clean cache")
+}
+
+// Close releases all references held by the engine. Both of the wrapped
+// engines are closed.
+func (e *cacheEngine) Close() error {
+	if err := e.cache.Close(); err != nil {
+		return errors.Wrap(err, "close cache")
+	}
+	return errors.Wrap(e.backend.Close(), "close backend")
+}
+
+// New returns a new cas.Engine that reads through cache, fetching any blobs
+// not present in cache from backend. All writes are made to the backend. The
+// returned engine takes ownership of both engines, and will close them when
+// it is closed.
+func New(backend, cache cas.Engine, opt *Options) (cas.Engine, error) {
+	var options Options
+	if opt != nil {
+		options = *opt
+	}
+
+	engine := &cacheEngine{
+		backend: backend,
+		cache:   cache,
+		options: options,
+		lru:     list.New(),
+		entries: map[digest.Digest]*list.Element{},
+	}
+
+	// Blobs already in the cache are tracked as least-recently-used (oldest
+	// first, if the cache knows when they were written), and their sizes are
+	// counted so that MaxSize is enforced across restarts.
+	ctx := context.Background()
+	digests, err := cache.ListBlobs(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list cached blobs")
+	}
+	var cached []cachedBlob
+	for _, digest := range digests {
+		info, err := statBlob(ctx, cache, digest)
+		if os.IsNotExist(errors.Cause(err)) {
+			// Removed since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "stat cached blob %s", digest)
+		}
+		cached = append(cached, cachedBlob{digest: digest, info: info})
+	}
+	sort.SliceStable(cached, func(i, j int) bool {
+		return cached[i].info.ModTime.After(cached[j].info.ModTime)
+	})
+	for _, blob := range cached {
+		engine.entries[blob.digest] = engine.lru.PushBack(&entry{digest: blob.digest, size: blob.info.Size})
+		engine.size += blob.info.Size
+	}
+	if err := engine.evict(ctx, ""); err != nil {
+		return nil, errors.Wrap(err, "evict cached blobs")
+	}
+	return engine, nil
+}
+
+// cachedBlob is a blob which was already in the cache when it was opened.
+type cachedBlob struct {
+	digest digest.Digest
+	info   cas.BlobInfo
+}
+
+// statBlob returns information about the blob with the given digest in the
+// given engine. If the engine is not a cas.StatingEngine, the blob is read in
+// order to find its size (and its ModTime is left unset).
+func statBlob(ctx context.Context, engine cas.Engine, digest digest.Digest) (cas.BlobInfo, error) {
+	if stater, ok := engine.(cas.StatingEngine); ok {
+		info, err := stater.StatBlob(ctx, digest)
+		if errors.Cause(err) != cas.ErrNotImplemented {
+			return info, err
+		}
+	}
+	reader, err := engine.GetBlob(ctx, digest)
+	if err != nil {
+		return cas.BlobInfo{}, err
+	}
+	defer reader.Close()
+	size, err := io.Copy(ioutil.Discard, reader)
+	return cas.BlobInfo{Size: size}, err
+}
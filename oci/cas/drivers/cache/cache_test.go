@@ -0,0 +1,159 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/net/context"
+)
+
+func TestReadThrough(t *testing.T) {
+	ctx := context.Background()
+
+	backend := mem.New()
+	cache := mem.New()
+	engine, err := New(backend, cache, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating cache engine: %+v", err)
+	}
+	defer engine.Close()
+
+	data := []byte("some blob")
+	blobDigest, _, err := engine.PutBlob(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+
+	// The blob should only be in the backend.
+	if blobs, _ := cache.ListBlobs(ctx); len(blobs) != 0 {
+		t.Errorf("blob was cached before being read: %v", blobs)
+	}
+
+	reader, err := engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	gotBytes, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("GetBlob: failed to ReadAll: %+v", err)
+	}
+	if !bytes.Equal(data, gotBytes) {
+		t.Errorf("GetBlob: bytes did not match: expected=%s got=%s", string(data), string(gotBytes))
+	}
+
+	// Now it should be cached, and should still be readable after removing it
+	// from the backend behind the cache's back.
+	if blobs, _ := cache.ListBlobs(ctx); len(blobs) != 1 || blobs[0] != blobDigest {
+		t.Errorf("blob was not cached after being read: %v", blobs)
+	}
+	if err := backend.DeleteBlob(ctx, blobDigest); err != nil {
+		t.Fatalf("DeleteBlob: unexpected error: %+v", err)
+	}
+	reader, err = engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error on cached blob: %+v", err)
+	}
+	reader.Close()
+}
+
+func TestEviction(t *testing.T) {
+	ctx := context.Background()
+
+	backend := mem.New()
+	cache := mem.New()
+	engine, err := New(backend, cache, &Options{MaxSize: 10})
+	if err != nil {
+		t.Fatalf("unexpected error creating cache engine: %+v", err)
+	}
+	defer engine.Close()
+
+	var digests []digest.Digest
+	for _, data := range []string{"aaaaaa", "bbbbbb", "cccccc"} {
+		blobDigest, _, err := engine.PutBlob(ctx, bytes.NewBufferString(data))
+		if err != nil {
+			t.Fatalf("PutBlob: unexpected error: %+v", err)
+		}
+		digests = append(digests, blobDigest)
+
+		reader, err := engine.GetBlob(ctx, blobDigest)
+		if err != nil {
+			t.Fatalf("GetBlob: unexpected error: %+v", err)
+		}
+		reader.Close()
+	}
+
+	// Only the most recently used blob fits.
+	blobs, err := cache.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	}
+	if len(blobs) != 1 || blobs[0] != digests[2] {
+		t.Errorf("unexpected cache contents after eviction: %v", blobs)
+	}
+}
+
+func TestEvictionExisting(t *testing.T) {
+	ctx := context.Background()
+
+	backend := mem.New()
+	cache := mem.New()
+	for _, data := range []string{"aaaaaa", "bbbbbb", "cccccc"} {
+		if _, _, err := cache.PutBlob(ctx, bytes.NewBufferString(data)); err != nil {
+			t.Fatalf("PutBlob: unexpected error: %+v", err)
+		}
+	}
+
+	// Blobs already in the cache count towards MaxSize.
+	engine, err := New(backend, cache, &Options{MaxSize: 10})
+	if err != nil {
+		t.Fatalf("unexpected error creating cache engine: %+v", err)
+	}
+	defer engine.Close()
+
+	blobs, err := cache.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	}
+	if len(blobs) != 1 {
+		t.Errorf("existing blobs were not evicted: %v", blobs)
+	}
+
+	blobDigest, _, err := engine.PutBlob(ctx, bytes.NewBufferString("dddddd"))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	reader, err := engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	reader.Close()
+
+	blobs, err = cache.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	}
+	if len(blobs) != 1 || blobs[0] != blobDigest {
+		t.Errorf("unexpected cache contents after eviction: %v", blobs)
+	}
+}
@@ -0,0 +1,697 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package chunked implements an EXPERIMENTAL cas.Engine which stores images
+// in a content-defined chunking deduplication store (in the style of restic
+// and casync). Every blob is split into chunks at content-defined boundaries,
+// and each distinct chunk is only stored once. Blobs are stored as a "recipe"
+// listing their chunks, and are reconstructed when read. Many similar images
+// (such as the images of a build server, which differ only in a few files of
+// their layers) can thus share most of their storage.
+//
+// The on-disk format is not an OCI image layout, and may change in future
+// versions of umoci. Use Convert to convert images to (and from) the dir
+// layout.
+package chunked
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/ctxio"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// LayoutVersion is the version of the chunked layout we support.
+	LayoutVersion = "1.0.0"
+
+	// layoutFile is the file inside a chunked image which identifies it as
+	// such, and records the parameters used to chunk its blobs.
+	layoutFile = "chunked-layout"
+
+	// blobDirectory is the directory inside a chunked image that contains the
+	// recipes of blobs.
+	blobDirectory = "blobs"
+
+	// chunkDirectory is the directory inside a chunked image that contains
+	// chunks.
+	chunkDirectory = "chunks"
+
+	// refDirectory is the directory inside a chunked image that contains
+	// references.
+	refDirectory = "refs"
+
+	// tempDirectory is the directory inside a chunked image in which chunks,
+	// recipes and references are written before being renamed into place.
+	tempDirectory = "tmp"
+
+	// lockFile is the file inside a chunked image which is locked (shared)
+	// by engines writing blobs, and locked (exclusive) by Clean so that it
+	// never removes chunks which are about to be referenced by a recipe.
+	lockFile = "lock"
+
+	// lockInterval is how often an engine retries taking a lock while another
+	// engine holds it.
+	lockInterval = 10 * time.Millisecond
+)
+
+// layout is the content of the layoutFile of a chunked image.
+type layout struct {
+	Version    string     `json:"version"`
+	ChunkSizes ChunkSizes `json:"chunkSizes"`
+}
+
+// chunk is an entry in a recipe.
+type chunk struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+}
+
+// recipe describes how a blob is reconstructed from its chunks.
+type recipe struct {
+	Size   int64   `json:"size"`
+	Chunks []chunk `json:"chunks"`
+}
+
+// digestPath returns the path to the blob or chunk with the given digest in
+// the given directory, relative to the root of the image.
+func digestPath(directory string, digest digest.Digest) (string, error) {
+	if err := digest.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+	if digest.Algorithm() != cas.BlobAlgorithm {
+		return "", errors.Errorf("unsupported algorithm: %q", digest.Algorithm())
+	}
+	return filepath.Join(directory, digest.Algorithm().String(), digest.Hex()), nil
+}
+
+// refPath returns the path to a reference given its name, relative to the
+// root of the image. The name is escaped, so that names containing slashes
+// are stored as a single file.
+func refPath(name string) (string, error) {
+	switch name {
+	case "", ".", "..":
+		return "", errors.Errorf("invalid reference name: %q", name)
+	}
+	return filepath.Join(refDirectory, url.PathEscape(name)), nil
+}
+
+type chunkedEngine struct {
+	path  string
+	sizes ChunkSizes
+}
+
+// lock takes a lock on the given file in the image, waiting until the lock is
+// available or ctx is cancelled. The returned function releases the lock.
+func (e *chunkedEngine) lock(ctx context.Context, name string, exclusive bool) (func(), error) {
+	fh, err := os.Open(filepath.Join(e.path, name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %s for lock", name)
+	}
+	for {
+		err := system.Flock(fh.Fd(), exclusive)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			fh.Close()
+			return nil, errors.Wrapf(err, "lock %s", name)
+		}
+		select {
+		case <-ctx.Done():
+			fh.Close()
+			return nil, errors.Wrapf(ctx.Err(), "lock %s", name)
+		case <-time.After(lockInterval):
+		}
+	}
+	return func() {
+		system.Unflock(fh.Fd())
+		fh.Close()
+	}, nil
+}
+
+// writeFile atomically writes the given data to the given path (relative to
+// the root of the image), by writing it to a temporary file first.
+func (e *chunkedEngine) writeFile(path string, data []byte) error {
+	fh, err := ioutil.TempFile(filepath.Join(e.path, tempDirectory), filepath.Base(path)+"-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary file")
+	}
+	tempPath := fh.Name()
+	defer os.Remove(tempPath)
+	defer fh.Close()
+
+	if _, err := fh.Write(data); err != nil {
+		return errors.Wrap(err, "write temporary file")
+	}
+	if err := fh.Sync(); err != nil {
+		return errors.Wrap(err, "sync temporary file")
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close temporary file")
+	}
+	return errors.Wrap(os.Rename(tempPath, filepath.Join(e.path, path)), "rename temporary file")
+}
+
+// putChunk stores the given chunk, unless it is already stored.
+func (e *chunkedEngine) putChunk(data []byte) (chunk, error) {
+	c := chunk{
+		Digest: cas.BlobAlgorithm.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+	path, err := digestPath(chunkDirectory, c.Digest)
+	if err != nil {
+		return chunk{}, errors.Wrap(err, "compute chunk path")
+	}
+	if _, err := os.Stat(filepath.Join(e.path, path)); err == nil {
+		return c, nil
+	}
+	return c, errors.Wrap(e.writeFile(path, data), "write chunk")
+}
+
+// readRecipe returns the recipe of the given blob. Returns os.ErrNotExist if
+// the digest is not found.
+func (e *chunkedEngine) readRecipe(digest digest.Digest) (recipe, os.FileInfo, error) {
+	path, err := digestPath(blobDirectory, digest)
+	if err != nil {
+		return recipe{}, nil, errors.Wrap(err, "compute blob path")
+	}
+	fh, err := os.Open(filepath.Join(e.path, path))
+	if err != nil {
+		return recipe{}, nil, errors.Wrap(err, "open recipe")
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return recipe{}, nil, errors.Wrap(err, "stat recipe")
+	}
+	var r recipe
+	if err := json.NewDecoder(fh).Decode(&r); err != nil {
+		return recipe{}, nil, errors.Wrap(err, "parse recipe")
+	}
+	return r, fi, nil
+}
+
+// PutBlob adds a new blob to the image. This is idempotent; a nil error
+// means that "the content is stored at DIGEST" without implying "because
+// of this PutBlob() call".
+func (e *chunkedEngine) PutBlob(ctx context.Context, reader io.Reader) (blobDigest digest.Digest, blobSize int64, err error) {
+	blob := event.StartBlob(ctx, event.OpPut, "", -1)
+	defer func() { blob.Done(blobDigest, err) }()
+
+	unlock, err := e.lock(ctx, lockFile, false)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "lock image")
+	}
+	defer unlock()
+
+	progressReader := blob.Reader(ctxio.NewReader(ctx, reader))
+
+	digester := cas.BlobAlgorithm.Digester()
+	chunker := newChunker(io.TeeReader(progressReader, digester.Hash()), e.sizes)
+	r := recipe{Chunks: []chunk{}}
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", -1, errors.Wrap(err, "read blob")
+		}
+		c, err := e.putChunk(data)
+		if err != nil {
+			return "", -1, err
+		}
+		r.Chunks = append(r.Chunks, c)
+		r.Size += c.Size
+	}
+
+	path, err := digestPath(blobDirectory, digester.Digest())
+	if err != nil {
+		return "", -1, errors.Wrap(err, "compute blob path")
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "encode recipe")
+	}
+	if err := e.writeFile(path, data); err != nil {
+		return "", -1, errors.Wrap(err, "write recipe")
+	}
+
+	return digester.Digest(), r.Size, nil
+}
+
+// PutBlobJSON adds a new JSON blob to the image (marshalled from the given
+// interface). This is equivalent to calling PutBlob() with a JSON payload
+// as the reader.
+func (e *chunkedEngine) PutBlobJSON(ctx context.Context, data interface{}) (digest.Digest, int64, error) {
+	var buffer bytes.Buffer
+	if err := json.NewEncoder(&buffer).Encode(data); err != nil {
+		return "", -1, errors.Wrap(err, "encode JSON")
+	}
+	return e.PutBlob(ctx, &buffer)
+}
+
+// PutReference adds a new reference descriptor blob to the image. This is
+// idempotent; a nil error means that "the descriptor is stored at NAME"
+// without implying "because of this PutReference() call". ErrClobber is
+// returned if there is already a descriptor stored at NAME, but does not
+// match the descriptor requested to be stored.
+func (e *chunkedEngine) PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	oldDescriptor, err := e.GetReference(ctx, name)
+	if err == nil {
+		if !reflect.DeepEqual(oldDescriptor, descriptor) {
+			return &cas.ClobberError{
+				Name: name,
+				Old:  oldDescriptor,
+				New:  descriptor,
+			}
+		}
+		return nil
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		return errors.Wrap(err, "get old reference")
+	}
+	return e.UpdateReference(ctx, name, nil, descriptor)
+}
+
+// UpdateReference replaces the descriptor stored at NAME with newDescriptor,
+// but only if the descriptor currently stored at NAME is oldDescriptor (if
+// oldDescriptor is nil, NAME must not exist).
+func (e *chunkedEngine) UpdateReference(ctx context.Context, name string, oldDescriptor *ispec.Descriptor, newDescriptor ispec.Descriptor) error {
+	// The reference is written to the tempdir, which is cleaned by Clean.
+	unlockImage, err := e.lock(ctx, lockFile, false)
+	if err != nil {
+		return errors.Wrap(err, "lock image")
+	}
+	defer unlockImage()
+
+	unlock, err := e.lock(ctx, refDirectory, true)
+	if err != nil {
+		return errors.Wrap(err, "lock references")
+	}
+	defer unlock()
+
+	current, err := e.GetReference(ctx, name)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return errors.Wrap(err, "get old reference")
+	}
+	exists := err == nil
+	if exists && reflect.DeepEqual(current, newDescriptor) {
+		return nil
+	}
+	if oldDescriptor != nil && !exists {
+		return errors.Wrap(os.ErrNotExist, "get old reference")
+	}
+	if exists && (oldDescriptor == nil || !reflect.DeepEqual(current, *oldDescriptor)) {
+		return &cas.ClobberError{
+			Name: name,
+			Old:  current,
+			New:  newDescriptor,
+		}
+	}
+
+	path, err := refPath(name)
+	if err != nil {
+		return errors.Wrap(err, "compute ref path")
+	}
+	data, err := json.Marshal(newDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "encode reference")
+	}
+	if err := e.writeFile(path, data); err != nil {
+		return errors.Wrap(err, "write reference")
+	}
+	event.Emit(ctx, event.Event{Type: event.RefUpdated, Reference: name, Descriptor: &newDescriptor})
+	return nil
+}
+
+// chunkReader reconstructs a blob from its chunks, verifying each chunk as it
+// is read.
+type chunkReader struct {
+	engine   *chunkedEngine
+	chunks   []chunk
+	current  io.ReadCloser
+	expected chunk
+	verifier digest.Verifier
+}
+
+// Read implements io.Reader.
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			r.expected, r.chunks = r.chunks[0], r.chunks[1:]
+			path, err := digestPath(chunkDirectory, r.expected.Digest)
+			if err != nil {
+				return 0, errors.Wrap(err, "compute chunk path")
+			}
+			fh, err := os.Open(filepath.Join(r.engine.path, path))
+			if err != nil {
+				return 0, errors.Wrap(err, "open chunk")
+			}
+			r.current = fh
+			r.verifier = r.expected.Digest.Verifier()
+		}
+
+		n, err := r.current.Read(p)
+		r.verifier.Write(p[:n])
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if !r.verifier.Verified() {
+				return n, errors.Errorf("chunk %s is corrupt", r.expected.Digest)
+			}
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close implements io.Closer.
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). Returns os.ErrNotExist if the digest is not found.
+func (e *chunkedEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	r, _, err := e.readRecipe(digest)
+	if err != nil {
+		return nil, err
+	}
+	reader := &chunkReader{
+		engine: e,
+		chunks: r.Chunks,
+	}
+	return event.NewBlobReader(ctx, digest, r.Size, ctxio.NewReadCloser(ctx, reader)), nil
+}
+
+// StatBlob returns the size and modification time of a blob. Returns
+// os.ErrNotExist if the digest is not found.
+func (e *chunkedEngine) StatBlob(ctx context.Context, digest digest.Digest) (cas.BlobInfo, error) {
+	r, fi, err := e.readRecipe(digest)
+	if err != nil {
+		return cas.BlobInfo{}, err
+	}
+	return cas.BlobInfo{
+		Size:    r.Size,
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+// GetReference returns a reference from the image. Returns os.ErrNotExist
+// if the name was not found.
+func (e *chunkedEngine) GetReference(ctx context.Context, name string) (ispec.Descriptor, error) {
+	path, err := refPath(name)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "compute ref path")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(e.path, path))
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "read ref")
+	}
+	var descriptor ispec.Descriptor
+	if err := json.Unmarshal(content, &descriptor); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "parse ref")
+	}
+	return descriptor, nil
+}
+
+// DeleteBlob removes a blob from the image. This is idempotent; a nil
+// error means "the content is not in the store" without implying "because
+// of this DeleteBlob() call". Only the recipe of the blob is removed, the
+// chunks which are no longer used are removed by Clean.
+func (e *chunkedEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	path, err := digestPath(blobDirectory, digest)
+	if err != nil {
+		return errors.Wrap(err, "compute blob path")
+	}
+	if err := os.Remove(filepath.Join(e.path, path)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove recipe")
+	}
+	return nil
+}
+
+// DeleteReference removes a reference from the image. This is idempotent;
+// a nil error means "the content is not in the store" without implying
+// "because of this DeleteReference() call".
+func (e *chunkedEngine) DeleteReference(ctx context.Context, name string) error {
+	path, err := refPath(name)
+	if err != nil {
+		return errors.Wrap(err, "compute ref path")
+	}
+	unlock, err := e.lock(ctx, refDirectory, true)
+	if err != nil {
+		return errors.Wrap(err, "lock references")
+	}
+	defer unlock()
+
+	if err := os.Remove(filepath.Join(e.path, path)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove ref")
+	}
+	event.Emit(ctx, event.Event{Type: event.RefUpdated, Reference: name})
+	return nil
+}
+
+// listDigests returns the digests of the files in the given directory.
+func (e *chunkedEngine) listDigests(directory string) ([]digest.Digest, error) {
+	names, err := readDirNames(filepath.Join(e.path, directory, cas.BlobAlgorithm.String()))
+	if err != nil {
+		return nil, err
+	}
+	digests := []digest.Digest{}
+	for _, name := range names {
+		digests = append(digests, digest.NewDigestFromHex(cas.BlobAlgorithm.String(), name))
+	}
+	return digests, nil
+}
+
+// readDirNames returns the sorted names of the children of a directory.
+func readDirNames(path string) ([]string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open dir")
+	}
+	names, err := fh.Readdirnames(-1)
+	fh.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "readdir")
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ListBlobs returns the set of blob digests stored in the image.
+func (e *chunkedEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	digests, err := e.listDigests(blobDirectory)
+	return digests, errors.Wrap(err, "list blobs")
+}
+
+// ListReferences returns the set of reference names stored in the image.
+func (e *chunkedEngine) ListReferences(ctx context.Context) ([]string, error) {
+	files, err := readDirNames(filepath.Join(e.path, refDirectory))
+	if err != nil {
+		return nil, errors.Wrap(err, "list references")
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		name, err := url.PathUnescape(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid reference file %q", file)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Clean executes a garbage collection of any non-blob garbage in the store,
+// which includes temporary files and the chunks which are not used by any
+// blob (such as the chunks of deleted blobs). This MUST NOT remove any blobs
+// or references in the store.
+func (e *chunkedEngine) Clean(ctx context.Context) error {
+	unlock, err := e.lock(ctx, lockFile, true)
+	if err != nil {
+		return errors.Wrap(err, "lock image")
+	}
+	defer unlock()
+
+	// Nobody else is writing blobs, so any temporary file is garbage.
+	tempDir := filepath.Join(e.path, tempDirectory)
+	names, err := readDirNames(tempDir)
+	if err != nil {
+		return errors.Wrap(err, "clean tempdir")
+	}
+	for _, name := range names {
+		if err := os.RemoveAll(filepath.Join(tempDir, name)); err != nil {
+			return errors.Wrap(err, "clean tempdir")
+		}
+	}
+
+	blobs, err := e.listDigests(blobDirectory)
+	if err != nil {
+		return errors.Wrap(err, "list blobs")
+	}
+	used := map[digest.Digest]struct{}{}
+	for _, blob := range blobs {
+		r, _, err := e.readRecipe(blob)
+		if err != nil {
+			// The blob was deleted underneath us.
+			if os.IsNotExist(errors.Cause(err)) {
+				continue
+			}
+			return errors.Wrapf(err, "read recipe %s", blob)
+		}
+		for _, c := range r.Chunks {
+			used[c.Digest] = struct{}{}
+		}
+	}
+
+	chunks, err := e.listDigests(chunkDirectory)
+	if err != nil {
+		return errors.Wrap(err, "list chunks")
+	}
+	removed := 0
+	for _, c := range chunks {
+		if _, ok := used[c]; ok {
+			continue
+		}
+		path, err := digestPath(chunkDirectory, c)
+		if err != nil {
+			return errors.Wrap(err, "compute chunk path")
+		}
+		if err := os.Remove(filepath.Join(e.path, path)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove chunk")
+		}
+		removed++
+	}
+	event.Log(ctx).Debugf("chunked: removed %d unused chunks", removed)
+	return nil
+}
+
+// Close releases all references held by the engine. Subsequent operations
+// may fail.
+func (e *chunkedEngine) Close() error {
+	return nil
+}
+
+// Open opens a new reference to the chunked image at the given path.
+func Open(path string) (cas.Engine, error) {
+	content, err := ioutil.ReadFile(filepath.Join(path, layoutFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = cas.ErrInvalid
+		}
+		return nil, errors.Wrap(err, "read chunked-layout")
+	}
+	var l layout
+	if err := json.Unmarshal(content, &l); err != nil {
+		return nil, errors.Wrap(err, "parse chunked-layout")
+	}
+	if l.Version != LayoutVersion {
+		return nil, errors.Wrapf(cas.ErrInvalid, "unsupported chunked layout version %q", l.Version)
+	}
+	if err := l.ChunkSizes.Validate(); err != nil {
+		return nil, errors.Wrap(cas.ErrInvalid, err.Error())
+	}
+	for _, dir := range []string{blobDirectory, chunkDirectory, refDirectory, tempDirectory} {
+		if fi, err := os.Stat(filepath.Join(path, dir)); err != nil {
+			if os.IsNotExist(err) {
+				err = cas.ErrInvalid
+			}
+			return nil, errors.Wrapf(err, "check %s", dir)
+		} else if !fi.IsDir() {
+			return nil, errors.Wrapf(cas.ErrInvalid, "%s is not a directory", dir)
+		}
+	}
+	return &chunkedEngine{
+		path:  path,
+		sizes: l.ChunkSizes,
+	}, nil
+}
+
+// Create creates a new chunked image at the given path, using
+// DefaultChunkSizes. If the path already exists, os.ErrExist is returned.
+// However, all of the parent components of the path will be created if
+// necessary.
+func Create(path string) error {
+	return CreateWithChunkSizes(path, DefaultChunkSizes)
+}
+
+// CreateWithChunkSizes is like Create, except that the blobs of the image are
+// chunked using the given ChunkSizes. Note that only blobs chunked using the
+// same ChunkSizes share chunks, so the ChunkSizes are fixed for the lifetime
+// of the image.
+func CreateWithChunkSizes(path string, sizes ChunkSizes) error {
+	if err := sizes.Validate(); err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrap(err, "mkdir parent")
+		}
+	}
+	if err := os.Mkdir(path, 0755); err != nil {
+		return errors.Wrap(err, "mkdir")
+	}
+
+	for _, dir := range []string{
+		filepath.Join(blobDirectory, cas.BlobAlgorithm.String()),
+		filepath.Join(chunkDirectory, cas.BlobAlgorithm.String()),
+		refDirectory,
+		tempDirectory,
+	} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0755); err != nil {
+			return errors.Wrapf(err, "mkdir %s", dir)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, lockFile), nil, 0644); err != nil {
+		return errors.Wrap(err, "create lock")
+	}
+
+	content, err := json.Marshal(layout{
+		Version:    LayoutVersion,
+		ChunkSizes: sizes,
+	})
+	if err != nil {
+		return errors.Wrap(err, "encode chunked-layout")
+	}
+	return errors.Wrap(ioutil.WriteFile(filepath.Join(path, layoutFile), content, 0644), "write chunked-layout")
+}
@@ -0,0 +1,289 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunked
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// testChunkSizes are small chunk sizes, so that small blobs are split into
+// many chunks.
+var testChunkSizes = ChunkSizes{Min: 256, Avg: 1024, Max: 4096}
+
+func createTestImage(t *testing.T, path string) cas.Engine {
+	if err := CreateWithChunkSizes(path, testChunkSizes); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	return engine
+}
+
+func countChunks(t *testing.T, path string) int {
+	names, err := readDirNames(filepath.Join(path, chunkDirectory, cas.BlobAlgorithm.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(names)
+}
+
+func getBlob(t *testing.T, engine cas.Engine, digest digest.Digest) []byte {
+	reader, err := engine.GetBlob(context.Background(), digest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("GetBlob: failed to ReadAll: %+v", err)
+	}
+	return data
+}
+
+func TestChunkedBlobs(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "umoci-TestChunkedBlobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	engine := createTestImage(t, image)
+	defer engine.Close()
+
+	// Two similar blobs, the second of which has some data inserted in the
+	// middle of the first.
+	first := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(first)
+	second := append(append(append([]byte{}, first[:30000]...), []byte("inserted data")...), first[30000:]...)
+
+	var digests []digest.Digest
+	for _, data := range [][]byte{first, second, []byte("")} {
+		digest, size, err := engine.PutBlob(ctx, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("PutBlob: unexpected error: %+v", err)
+		}
+		if digest != cas.BlobAlgorithm.FromBytes(data) || size != int64(len(data)) {
+			t.Errorf("PutBlob: unexpected digest or size: %s %d", digest, size)
+		}
+		if got := getBlob(t, engine, digest); !bytes.Equal(got, data) {
+			t.Errorf("GetBlob: blob %s was not reconstructed correctly", digest)
+		}
+		info, err := engine.(cas.StatingEngine).StatBlob(ctx, digest)
+		if err != nil || info.Size != size {
+			t.Errorf("StatBlob: unexpected info: %+v %+v", info, err)
+		}
+		digests = append(digests, digest)
+	}
+
+	// Most of the chunks of the blobs are shared.
+	firstChunks, _, _ := engine.(*chunkedEngine).readRecipe(digests[0])
+	secondChunks, _, _ := engine.(*chunkedEngine).readRecipe(digests[1])
+	total := len(firstChunks.Chunks) + len(secondChunks.Chunks)
+	if stored := countChunks(t, image); stored > total/2+3 {
+		t.Errorf("expected most chunks to be shared: %d chunks stored for %d chunks", stored, total)
+	}
+
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 3 {
+		t.Errorf("ListBlobs: expected 3 blobs, got %v", blobs)
+	}
+
+	// Clean only removes the chunks which are no longer used.
+	if err := engine.DeleteBlob(ctx, digests[1]); err != nil {
+		t.Fatalf("DeleteBlob: unexpected error: %+v", err)
+	}
+	if _, err := engine.GetBlob(ctx, digests[1]); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("GetBlob: expected deleted blob to be missing: %+v", err)
+	}
+	if err := engine.Clean(ctx); err != nil {
+		t.Fatalf("Clean: unexpected error: %+v", err)
+	}
+	if stored := countChunks(t, image); stored != len(firstChunks.Chunks) {
+		t.Errorf("Clean: expected %d chunks, got %d", len(firstChunks.Chunks), stored)
+	}
+	if got := getBlob(t, engine, digests[0]); !bytes.Equal(got, first) {
+		t.Errorf("GetBlob: blob was corrupted by Clean")
+	}
+
+	// Corrupt chunks are detected.
+	path, _ := digestPath(chunkDirectory, firstChunks.Chunks[0].Digest)
+	if err := ioutil.WriteFile(filepath.Join(image, path), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := engine.GetBlob(ctx, digests[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(reader); err == nil {
+		t.Errorf("GetBlob: expected error reading corrupt chunk")
+	}
+	reader.Close()
+}
+
+func TestChunkedReferences(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "umoci-TestChunkedReferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine := createTestImage(t, filepath.Join(root, "image"))
+	defer engine.Close()
+
+	descriptor := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: cas.BlobAlgorithm.FromString("manifest"), Size: 8}
+	other := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: cas.BlobAlgorithm.FromString("other"), Size: 5}
+
+	if err := engine.PutReference(ctx, "latest", descriptor); err != nil {
+		t.Fatalf("PutReference: unexpected error: %+v", err)
+	}
+	if err := engine.PutReference(ctx, "latest", descriptor); err != nil {
+		t.Errorf("PutReference: expected idempotent put: %+v", err)
+	}
+	if err := engine.PutReference(ctx, "latest", other); errors.Cause(err) != cas.ErrClobber {
+		t.Errorf("PutReference: expected clobber error: %+v", err)
+	}
+	if err := engine.(cas.UpdatingEngine).UpdateReference(ctx, "latest", &descriptor, other); err != nil {
+		t.Errorf("UpdateReference: unexpected error: %+v", err)
+	}
+	if got, err := engine.GetReference(ctx, "latest"); err != nil || !reflect.DeepEqual(got, other) {
+		t.Errorf("GetReference: unexpected descriptor: %v %+v", got, err)
+	}
+	if names, err := engine.ListReferences(ctx); err != nil || !reflect.DeepEqual(names, []string{"latest"}) {
+		t.Errorf("ListReferences: unexpected names: %v %+v", names, err)
+	}
+	if err := engine.DeleteReference(ctx, "latest"); err != nil {
+		t.Errorf("DeleteReference: unexpected error: %+v", err)
+	}
+	if _, err := engine.GetReference(ctx, "latest"); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("GetReference: expected deleted reference to be missing: %+v", err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "umoci-TestConvert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// dir -> chunked -> dir
+	dirPath := filepath.Join(root, "dir")
+	if err := dir.Create(dirPath); err != nil {
+		t.Fatal(err)
+	}
+	dirEngine, err := dir.Open(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dirEngine.Close()
+
+	data := make([]byte, 32*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+	digest, size, err := dirEngine.PutBlob(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor := ispec.Descriptor{MediaType: ispec.MediaTypeImageLayer, Digest: digest, Size: size}
+	if err := dirEngine.PutReference(ctx, "latest", descriptor); err != nil {
+		t.Fatal(err)
+	}
+
+	chunkedEngine := createTestImage(t, filepath.Join(root, "chunked"))
+	defer chunkedEngine.Close()
+	if err := Convert(ctx, chunkedEngine, dirEngine); err != nil {
+		t.Fatalf("Convert: unexpected error converting to chunked: %+v", err)
+	}
+	// Converting again is a no-op.
+	if err := Convert(ctx, chunkedEngine, dirEngine); err != nil {
+		t.Fatalf("Convert: unexpected error converting to chunked again: %+v", err)
+	}
+
+	otherPath := filepath.Join(root, "other")
+	if err := dir.Create(otherPath); err != nil {
+		t.Fatal(err)
+	}
+	otherEngine, err := dir.Open(otherPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherEngine.Close()
+	if err := Convert(ctx, otherEngine, chunkedEngine); err != nil {
+		t.Fatalf("Convert: unexpected error converting from chunked: %+v", err)
+	}
+
+	if got, err := otherEngine.GetReference(ctx, "latest"); err != nil || !reflect.DeepEqual(got, descriptor) {
+		t.Errorf("Convert: reference not converted: %v %+v", got, err)
+	}
+	if got := getBlob(t, otherEngine, digest); !bytes.Equal(got, data) {
+		t.Errorf("Convert: blob not converted")
+	}
+}
+
+func TestDriverSupported(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestDriverSupported")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	chunkedPath := filepath.Join(root, "chunked")
+	if err := Create(chunkedPath); err != nil {
+		t.Fatal(err)
+	}
+	dirPath := filepath.Join(root, "dir")
+	if err := dir.Create(dirPath); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		uri       string
+		supported bool
+	}{
+		{chunkedPath, true},
+		{URIPrefix + filepath.Join(root, "new"), true},
+		{dirPath, false},
+		{filepath.Join(root, "new"), false},
+		{"s3://bucket/image", false},
+	} {
+		if supported := Driver.Supported(test.uri); supported != test.supported {
+			t.Errorf("Supported(%q): expected %v, got %v", test.uri, test.supported, supported)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunked
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// gearTable is the table of random values used by the gear rolling hash. It
+// is generated from a fixed seed (with splitmix64), because the chunk
+// boundaries of a blob (and thus which chunks are shared with other blobs)
+// must never change between versions of umoci.
+var gearTable [256]uint64
+
+func init() {
+	seed := uint64(0x756d6f6369636463) // "umocicdc"
+	for i := range gearTable {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// ChunkSizes are the parameters of the content-defined chunking of blobs.
+// Chunk boundaries are placed where the gear hash of the preceding bytes has
+// its top bits clear, so that inserting or removing data in a blob only
+// changes the chunks around the modification.
+type ChunkSizes struct {
+	// Min is the minimum size of a chunk (other than the last chunk of a
+	// blob).
+	Min int `json:"min"`
+
+	// Avg is the average size of a chunk. It must be a power of two.
+	Avg int `json:"avg"`
+
+	// Max is the maximum size of a chunk.
+	Max int `json:"max"`
+}
+
+// DefaultChunkSizes are the ChunkSizes used for new images if none are
+// specified.
+var DefaultChunkSizes = ChunkSizes{
+	Min: 64 * 1024,
+	Avg: 256 * 1024,
+	Max: 1024 * 1024,
+}
+
+// Validate returns an error if the ChunkSizes are invalid.
+func (s ChunkSizes) Validate() error {
+	if s.Min <= 0 || s.Avg <= s.Min || s.Max <= s.Avg {
+		return errors.Errorf("chunk sizes must satisfy 0 < min < avg < max: %d, %d, %d", s.Min, s.Avg, s.Max)
+	}
+	if s.Avg&(s.Avg-1) != 0 {
+		return errors.Errorf("average chunk size must be a power of two: %d", s.Avg)
+	}
+	return nil
+}
+
+// mask returns the mask of the top bits of the gear hash which must be clear
+// for a chunk boundary, such that chunks are Avg bytes long on average.
+func (s ChunkSizes) mask() uint64 {
+	var bits uint
+	for avg := s.Avg; avg > 1; avg >>= 1 {
+		bits++
+	}
+	return ^uint64(0) << (64 - bits)
+}
+
+// chunker splits a stream into content-defined chunks.
+type chunker struct {
+	reader *bufio.Reader
+	sizes  ChunkSizes
+	mask   uint64
+	buffer []byte
+}
+
+func newChunker(reader io.Reader, sizes ChunkSizes) *chunker {
+	return &chunker{
+		reader: bufio.NewReaderSize(reader, sizes.Max),
+		sizes:  sizes,
+		mask:   sizes.mask(),
+		buffer: make([]byte, 0, sizes.Max),
+	}
+}
+
+// Next returns the next chunk of the stream, which is only valid until the
+// next call to Next. io.EOF is returned once the stream is exhausted.
+func (c *chunker) Next() ([]byte, error) {
+	c.buffer = c.buffer[:0]
+	var hash uint64
+	for len(c.buffer) < c.sizes.Max {
+		b, err := c.reader.ReadByte()
+		if err == io.EOF {
+			if len(c.buffer) == 0 {
+				return nil, io.EOF
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		c.buffer = append(c.buffer, b)
+		hash = (hash << 1) + gearTable[b]
+		if len(c.buffer) >= c.sizes.Min && hash&c.mask == 0 {
+			break
+		}
+	}
+	return c.buffer, nil
+}
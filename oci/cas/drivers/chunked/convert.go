@@ -0,0 +1,79 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunked
+
+import (
+	"os"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Convert copies every blob and reference of the src image to the dst image,
+// which is how images are converted between the chunked layout and the dir
+// layout (in either direction). Blobs which already exist in dst are skipped,
+// and the digest of every copied blob is verified. References which already
+// exist in dst must refer to the same descriptor as in src.
+func Convert(ctx context.Context, dst, src cas.Engine) error {
+	blobs, err := src.ListBlobs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list source blobs")
+	}
+	copied := 0
+	for _, blob := range blobs {
+		if statter, ok := dst.(cas.StatingEngine); ok {
+			if _, err := statter.StatBlob(ctx, blob); err == nil {
+				continue
+			} else if !os.IsNotExist(errors.Cause(err)) {
+				return errors.Wrapf(err, "stat blob %s", blob)
+			}
+		}
+
+		reader, err := src.GetBlob(ctx, blob)
+		if err != nil {
+			return errors.Wrapf(err, "get blob %s", blob)
+		}
+		digest, _, err := dst.PutBlob(ctx, reader)
+		reader.Close()
+		if err != nil {
+			return errors.Wrapf(err, "put blob %s", blob)
+		}
+		if digest != blob {
+			return errors.Errorf("blob %s has unexpected digest %s", blob, digest)
+		}
+		copied++
+	}
+	event.Log(ctx).Debugf("chunked: copied %d of %d blobs", copied, len(blobs))
+
+	names, err := src.ListReferences(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list source references")
+	}
+	for _, name := range names {
+		descriptor, err := src.GetReference(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "get reference %s", name)
+		}
+		if err := dst.PutReference(ctx, name, descriptor); err != nil {
+			return errors.Wrapf(err, "put reference %s", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunked
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+)
+
+// URIPrefix is the prefix which selects the chunked driver for an image
+// which doesn't exist yet (existing chunked images are detected by their
+// chunked-layout file). URIs are of the form "chunked://<path>".
+const URIPrefix = "chunked://"
+
+// Driver is an implementation of drivers.Driver for chunked images.
+var Driver cas.Driver = chunkedDriver{}
+
+type chunkedDriver struct{}
+
+// uriPath returns the path of the image at the given URI.
+func uriPath(uri string) string {
+	return strings.TrimPrefix(uri, URIPrefix)
+}
+
+// Supported returns whether the resource at the given URI is supported by the
+// driver (used for auto-detection). URIs starting with URIPrefix, and paths
+// of existing chunked images, are supported.
+func (d chunkedDriver) Supported(uri string) bool {
+	if strings.HasPrefix(uri, URIPrefix) {
+		return true
+	}
+	if strings.Contains(uri, "://") {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(uri, layoutFile))
+	return err == nil
+}
+
+// Open "opens" a new CAS engine accessor for the given URI.
+func (d chunkedDriver) Open(uri string) (cas.Engine, error) {
+	return Open(uriPath(uri))
+}
+
+// Create creates a new image at the provided URI.
+func (d chunkedDriver) Create(uri string) error {
+	return Create(uriPath(uri))
+}
+
+func init() {
+	cas.Register(Driver)
+}
@@ -25,6 +25,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/openSUSE/umoci/oci/cas"
@@ -133,10 +134,41 @@ func TestEngineBlob(t *testing.T) {
 			t.Errorf("GetBlob: bytes did not match: expected=%s got=%s", string(test.bytes), string(gotBytes))
 		}
 
+		info, err := engine.(cas.StatingEngine).StatBlob(ctx, digest)
+		if err != nil {
+			t.Errorf("StatBlob: unexpected error: %+v", err)
+		}
+		if info.Size != int64(len(test.bytes)) || info.ModTime.IsZero() {
+			t.Errorf("StatBlob: unexpected info: %+v", info)
+		}
+
+		blobAt, blobSize, err := engine.(cas.RandomAccessEngine).GetBlobAt(ctx, digest)
+		if err != nil {
+			t.Fatalf("GetBlobAt: unexpected error: %+v", err)
+		}
+		if _, ok := blobAt.(*os.File); !ok {
+			t.Errorf("GetBlobAt: expected an *os.File, got %T", blobAt)
+		}
+		if blobSize != int64(len(test.bytes)) {
+			t.Errorf("GetBlobAt: unexpected size: expected=%d got=%d", len(test.bytes), blobSize)
+		}
+		gotBytes = make([]byte, blobSize/2)
+		if _, err := blobAt.ReadAt(gotBytes, blobSize-int64(len(gotBytes))); err != nil {
+			t.Errorf("GetBlobAt: failed to ReadAt: %+v", err)
+		}
+		if expected := test.bytes[len(test.bytes)-len(gotBytes):]; !bytes.Equal(expected, gotBytes) {
+			t.Errorf("GetBlobAt: bytes did not match: expected=%s got=%s", string(expected), string(gotBytes))
+		}
+		blobAt.Close()
+
 		if err := engine.DeleteBlob(ctx, digest); err != nil {
 			t.Errorf("DeleteBlob: unexpected error: %+v", err)
 		}
 
+		if _, _, err := engine.(cas.RandomAccessEngine).GetBlobAt(ctx, digest); !os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("GetBlobAt: expected os.ErrNotExist after DeleteBlob, got %v", err)
+		}
+
 		if br, err := engine.GetBlob(ctx, digest); !os.IsNotExist(errors.Cause(err)) {
 			if err == nil {
 				br.Close()
@@ -446,3 +478,121 @@ func TestEngineValidate(t *testing.T) {
 		engine.Close()
 	}
 }
+
+func TestEngineUpdateReference(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineUpdateReference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+	updater := engine.(cas.UpdatingEngine)
+
+	descriptorA := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", Size: 1}
+	descriptorB := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", Size: 2}
+
+	if err := updater.UpdateReference(ctx, "ref", &descriptorA, descriptorB); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("UpdateReference: expected os.ErrNotExist for missing reference, got %+v", err)
+	} else if !errors.Is(err, cas.ErrNotExist) {
+		t.Errorf("UpdateReference: expected errors.Is(err, cas.ErrNotExist) for missing reference, got %+v", err)
+	}
+	if err := updater.UpdateReference(ctx, "ref", nil, descriptorA); err != nil {
+		t.Fatalf("UpdateReference: unexpected error creating reference: %+v", err)
+	}
+	if err := updater.UpdateReference(ctx, "ref", nil, descriptorB); errors.Cause(err) != cas.ErrClobber {
+		t.Errorf("UpdateReference: expected ErrClobber creating existing reference, got %+v", err)
+	}
+	if err := updater.UpdateReference(ctx, "ref", &descriptorB, descriptorA); err != nil {
+		t.Errorf("UpdateReference: unexpected error with identical descriptor: %+v", err)
+	}
+	if err := updater.UpdateReference(ctx, "ref", &descriptorB, ispec.Descriptor{}); errors.Cause(err) != cas.ErrClobber {
+		t.Errorf("UpdateReference: expected ErrClobber with stale old descriptor, got %+v", err)
+	} else if clobberErr := (*cas.ClobberError)(nil); !errors.As(err, &clobberErr) || clobberErr.Name != "ref" {
+		t.Errorf("UpdateReference: expected *cas.ClobberError for ref with stale old descriptor, got %+v", err)
+	}
+	if err := updater.UpdateReference(ctx, "ref", &descriptorA, descriptorB); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if got, err := engine.GetReference(ctx, "ref"); err != nil {
+		t.Errorf("GetReference: unexpected error: %+v", err)
+	} else if !reflect.DeepEqual(got, descriptorB) {
+		t.Errorf("GetReference: reference was not updated: expected=%+v got=%+v", descriptorB, got)
+	}
+}
+
+// TestEngineUpdateReferenceConcurrent checks that concurrent updates of a
+// reference through separate engines are never lost.
+func TestEngineUpdateReferenceConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineUpdateReferenceConcurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	const workers, updates = 8, 16
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			engine, err := Open(image)
+			if err != nil {
+				t.Errorf("unexpected error opening image: %+v", err)
+				return
+			}
+			defer engine.Close()
+
+			for n := 0; n < updates; {
+				var old *ispec.Descriptor
+				current, err := engine.GetReference(ctx, "counter")
+				if err == nil {
+					old = &current
+				} else if !os.IsNotExist(errors.Cause(err)) {
+					t.Errorf("GetReference: unexpected error: %+v", err)
+					return
+				}
+				next := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", Size: current.Size + 1}
+				err = engine.(cas.UpdatingEngine).UpdateReference(ctx, "counter", old, next)
+				switch {
+				case err == nil:
+					n++
+				case errors.Cause(err) == cas.ErrClobber || os.IsNotExist(errors.Cause(err)):
+					// Lost the race, try again.
+				default:
+					t.Errorf("UpdateReference: unexpected error: %+v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+	if got, err := engine.GetReference(ctx, "counter"); err != nil {
+		t.Errorf("GetReference: unexpected error: %+v", err)
+	} else if got.Size != workers*updates {
+		t.Errorf("UpdateReference: updates were lost: expected %d got %d", workers*updates, got.Size)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// DefaultCleanAge is the age after which an unlocked temporary directory is
+// considered stale, if Options.CleanAge is zero.
+const DefaultCleanAge = 24 * time.Hour
+
+const (
+	// tempPrefix is the prefix of the temporary directories created by an
+	// engine (see ensureTempDir).
+	tempPrefix = "tmp-"
+
+	// cleanBatch is the maximum number of stale temporary directories removed
+	// by a single background clean, so that the background clean never
+	// competes with the foreground work (or holds up Close) for long.
+	cleanBatch = 8
+)
+
+// removeUnlocked removes the given path from the image, unless it is locked
+// by another engine (or has already been removed). It returns whether the
+// path was removed.
+func removeUnlocked(path string) (bool, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		// Ignore errors because it might've been deleted underneath us.
+		return false, nil
+	}
+	defer fh.Close()
+
+	if err := system.Flock(fh.Fd(), true); err != nil {
+		// If we fail to get a flock(2) then it's probably already locked,
+		// so we shouldn't touch it.
+		return false, nil
+	}
+	defer system.Unflock(fh.Fd())
+
+	if err := os.RemoveAll(path); err != nil {
+		return false, errors.Wrap(err, "remove garbage path")
+	}
+	return true, nil
+}
+
+// cleanDir removes every child of the given directory for which garbage
+// returns true, unless it is locked by another engine.
+func cleanDir(dir string, garbage func(name string) bool) error {
+	fh, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "open dir")
+	}
+	names, err := fh.Readdirnames(-1)
+	fh.Close()
+	if err != nil {
+		return errors.Wrap(err, "readdir")
+	}
+
+	for _, name := range names {
+		if !garbage(name) {
+			continue
+		}
+		if _, err := removeUnlocked(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanIndexCache removes the entries of IndexCacheDirectory which were
+// derived from blobs that are no longer in the image.
+func (e *dirEngine) cleanIndexCache() error {
+	root := filepath.Join(e.path, IndexCacheDirectory)
+	algorithms, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "readdir")
+	}
+
+	for _, algorithm := range algorithms {
+		if !algorithm.IsDir() {
+			continue
+		}
+		if err := cleanDir(filepath.Join(root, algorithm.Name()), func(name string) bool {
+			// Temporary files (being written by another engine) are left
+			// alone.
+			if strings.HasPrefix(name, ".") {
+				return false
+			}
+			blob := digest.NewDigestFromHex(algorithm.Name(), strings.TrimSuffix(name, filepath.Ext(name)))
+			path, err := blobPath(blob)
+			if err != nil {
+				return true
+			}
+			path = filepath.Join(e.path, path)
+			for _, candidate := range []string{path, path + compressedSuffix} {
+				if _, err := os.Lstat(candidate); err == nil {
+					return false
+				}
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanStale removes (at most cleanBatch) unlocked temporary directories
+// which have not been modified for the given age, such as the ones left
+// behind by a crashed umoci. Unlike Clean, only temporary directories are
+// considered. The number of directories removed is returned.
+func (e *dirEngine) cleanStale(age time.Duration) (int, error) {
+	root := e.tempRoot()
+	fh, err := os.Open(root)
+	if err != nil {
+		return 0, errors.Wrap(err, "open tempdir root")
+	}
+	children, err := fh.Readdir(-1)
+	fh.Close()
+	if err != nil {
+		return 0, errors.Wrap(err, "readdir tempdir root")
+	}
+
+	removed := 0
+	cutoff := time.Now().Add(-age)
+	for _, child := range children {
+		if removed >= cleanBatch {
+			break
+		}
+
+		path := filepath.Join(root, child.Name())
+		if !child.IsDir() || !strings.HasPrefix(child.Name(), tempPrefix) || path == e.temp {
+			continue
+		}
+		if !child.ModTime().Before(cutoff) {
+			continue
+		}
+
+		ok, err := removeUnlocked(path)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// startClean starts removing stale temporary directories in the background
+// (see cleanStale), unless this has been disabled with Options.CleanAge.
+// Close waits for the background clean to finish.
+func (e *dirEngine) startClean() {
+	age := e.options.CleanAge
+	if age < 0 {
+		return
+	}
+	if age == 0 {
+		age = DefaultCleanAge
+	}
+
+	e.cleanDone = make(chan struct{})
+	go func() {
+		defer close(e.cleanDone)
+		removed, err := e.cleanStale(age)
+		if err != nil {
+			// This is only opportunistic, so don't fail the engine.
+			event.Default().Debugf("dir: background clean of %s failed: %v", e.path, err)
+			return
+		}
+		if removed > 0 {
+			event.Default().Debugf("dir: removed %d stale temporary directories from %s", removed, e.path)
+		}
+	}()
+}
+
+// waitClean waits for the background clean started by startClean (if any) to
+// finish.
+func (e *dirEngine) waitClean() {
+	if e.cleanDone != nil {
+		<-e.cleanDone
+		e.cleanDone = nil
+	}
+}
@@ -0,0 +1,238 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// compressedSuffix is the suffix of the path of a blob which is stored
+// compressed (see Options.CompressBlobs), relative to the path the blob
+// would have if it were stored as-is.
+const compressedSuffix = ".zst"
+
+var (
+	// zstdMagic is the magic number at the start of every zstd frame.
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+	// tarMagic is the magic at offset 257 of the first header of a POSIX
+	// (or GNU) tar archive.
+	tarMagic       = []byte("ustar")
+	tarMagicOffset = 257
+)
+
+// isTarFile returns whether the file at the given path looks like an
+// uncompressed tar archive.
+func isTarFile(path string) (bool, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fh.Close()
+
+	header := make([]byte, tarMagicOffset+len(tarMagic))
+	if _, err := io.ReadFull(fh, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(header[tarMagicOffset:], tarMagic), nil
+}
+
+// shouldCompress returns whether the blob which was written to tempPath (and
+// will be stored at path) should be stored compressed.
+func (e *dirEngine) shouldCompress(tempPath, path string) (bool, error) {
+	if !e.options.CompressBlobs {
+		return false, nil
+	}
+	// Don't store a second copy of a blob which is already stored as-is.
+	if _, err := os.Lstat(path); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, errors.Wrap(err, "stat blob")
+	}
+	return isTarFile(tempPath)
+}
+
+// compressFile compresses the temporary file at the given path into a new
+// temporary file (which is flushed to stable storage unless Options.NoSync),
+// removing the original. The path of the new temporary file is returned.
+func (e *dirEngine) compressFile(path string) (_ string, err error) {
+	fh, err := ioutil.TempFile(e.temp, "blob-compressed-")
+	if err != nil {
+		return "", errors.Wrap(err, "create temporary compressed blob")
+	}
+	defer fh.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(fh.Name())
+		}
+	}()
+
+	src, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "open blob")
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return "", errors.Wrap(err, "stat blob")
+	}
+
+	zw, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return "", errors.Wrap(err, "create zstd writer")
+	}
+	// Record the size of the blob in the frame header, which is used by
+	// StatBlob.
+	zw.ResetContentSize(fh, fi.Size())
+	if _, err := io.Copy(zw, src); err != nil {
+		zw.Close()
+		return "", errors.Wrap(err, "compress blob")
+	}
+	if err := zw.Close(); err != nil {
+		return "", errors.Wrap(err, "compress blob")
+	}
+	if err := e.syncFile(fh); err != nil {
+		return "", errors.Wrap(err, "sync temporary compressed blob")
+	}
+	os.Remove(path)
+	return fh.Name(), nil
+}
+
+// zstdReader is an io.ReadCloser which decompresses a compressed blob.
+type zstdReader struct {
+	fh *os.File
+	zr *zstd.Decoder
+}
+
+// newZstdReader returns a reader which decompresses the given file, which is
+// closed once the reader is closed.
+func newZstdReader(fh *os.File) (*zstdReader, error) {
+	// Blobs are read as a stream, so there's no point in decoding ahead.
+	zr, err := zstd.NewReader(fh, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, errors.Wrap(err, "create zstd reader")
+	}
+	return &zstdReader{fh: fh, zr: zr}, nil
+}
+
+// Read reads decompressed data from the blob.
+func (r *zstdReader) Read(p []byte) (int, error) {
+	n, err := r.zr.Read(p)
+	if err != nil && err != io.EOF {
+		err = errors.Wrap(err, "decompress blob")
+	}
+	return n, err
+}
+
+// Close closes the compressed blob.
+func (r *zstdReader) Close() error {
+	r.zr.Close()
+	return r.fh.Close()
+}
+
+// zstdContentSize returns the decompressed size recorded in the header of the
+// first frame of the given zstd-compressed file, or -1 if it wasn't recorded.
+func zstdContentSize(fh *os.File) (int64, error) {
+	// The frame header is at most 18 bytes (magic, descriptor, window
+	// descriptor, 4 byte dictionary ID and 8 byte content size).
+	header := make([]byte, 18)
+	n, err := fh.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return -1, err
+	}
+	header = header[:n]
+	if len(header) < len(zstdMagic)+1 || !bytes.Equal(header[:len(zstdMagic)], zstdMagic) {
+		return -1, errors.Errorf("invalid zstd frame")
+	}
+
+	descriptor := header[len(zstdMagic)]
+	var (
+		sizeFlag      = descriptor >> 6
+		singleSegment = descriptor&(1<<5) != 0
+		dictFlag      = descriptor & 0x3
+	)
+
+	offset := len(zstdMagic) + 1
+	if !singleSegment {
+		// Window descriptor.
+		offset++
+	}
+	offset += []int{0, 1, 2, 4}[dictFlag]
+
+	var sizeLen int
+	switch sizeFlag {
+	case 0:
+		if !singleSegment {
+			return -1, nil
+		}
+		sizeLen = 1
+	case 1:
+		sizeLen = 2
+	case 2:
+		sizeLen = 4
+	case 3:
+		sizeLen = 8
+	}
+	if len(header) < offset+sizeLen {
+		return -1, errors.Errorf("truncated zstd frame header")
+	}
+
+	field := header[offset : offset+sizeLen]
+	switch sizeLen {
+	case 1:
+		return int64(field[0]), nil
+	case 2:
+		// The two byte field has an offset of 256.
+		return int64(binary.LittleEndian.Uint16(field)) + 256, nil
+	case 4:
+		return int64(binary.LittleEndian.Uint32(field)), nil
+	default:
+		return int64(binary.LittleEndian.Uint64(field)), nil
+	}
+}
+
+// compressedSize returns the decompressed size of the given compressed blob.
+// If the size isn't recorded in the blob, it is decompressed to find out.
+func compressedSize(path string) (int64, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return -1, err
+	}
+	size, err := zstdContentSize(fh)
+	if err != nil || size >= 0 {
+		fh.Close()
+		return size, err
+	}
+
+	r, err := newZstdReader(fh)
+	if err != nil {
+		fh.Close()
+		return -1, err
+	}
+	defer r.Close()
+	return io.Copy(ioutil.Discard, r)
+}
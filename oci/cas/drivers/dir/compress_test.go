@@ -0,0 +1,214 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// makeTar returns an uncompressed tar archive containing a single file with
+// the given contents.
+func makeTar(t *testing.T, contents []byte) []byte {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestEngineCompressBlobs(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineCompressBlobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := OpenWithOptions(image, Options{CompressBlobs: true})
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	layer := makeTar(t, bytes.Repeat([]byte("compressible "), 4096))
+	other := []byte(`{"not": "a tar archive"}`)
+
+	for _, test := range []struct {
+		name       string
+		content    []byte
+		compressed bool
+	}{
+		{"tar", layer, true},
+		{"json", other, false},
+	} {
+		digest, size, err := engine.PutBlob(ctx, bytes.NewReader(test.content))
+		if err != nil {
+			t.Fatalf("%s: PutBlob: unexpected error: %+v", test.name, err)
+		}
+		if size != int64(len(test.content)) {
+			t.Errorf("%s: PutBlob: unexpected size: expected %d got %d", test.name, len(test.content), size)
+		}
+
+		path, _ := blobPath(digest)
+		path = filepath.Join(image, path)
+		_, plainErr := os.Lstat(path)
+		compressedFi, compressedErr := os.Lstat(path + compressedSuffix)
+		if test.compressed {
+			if !os.IsNotExist(plainErr) || compressedErr != nil {
+				t.Fatalf("%s: expected blob to be stored compressed: plain=%v compressed=%v", test.name, plainErr, compressedErr)
+			}
+			if compressedFi.Size() >= size {
+				t.Errorf("%s: compressed blob is not smaller: %d >= %d", test.name, compressedFi.Size(), size)
+			}
+		} else if plainErr != nil || !os.IsNotExist(compressedErr) {
+			t.Fatalf("%s: expected blob to be stored as-is: plain=%v compressed=%v", test.name, plainErr, compressedErr)
+		}
+
+		// Every engine must be able to read the blob.
+		roEngine, err := OpenReadOnly(image)
+		if err != nil {
+			t.Fatalf("unexpected error opening image read-only: %+v", err)
+		}
+		reader, err := roEngine.GetBlob(ctx, digest)
+		if err != nil {
+			t.Fatalf("%s: GetBlob: unexpected error: %+v", test.name, err)
+		}
+		got, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("%s: GetBlob: unexpected error reading blob: %+v", test.name, err)
+		}
+		if !bytes.Equal(got, test.content) {
+			t.Errorf("%s: GetBlob: got different content", test.name)
+		}
+
+		info, err := roEngine.(cas.StatingEngine).StatBlob(ctx, digest)
+		if err != nil {
+			t.Fatalf("%s: StatBlob: unexpected error: %+v", test.name, err)
+		}
+		if info.Size != size {
+			t.Errorf("%s: StatBlob: unexpected size: expected %d got %d", test.name, size, info.Size)
+		}
+		// Compressed blobs cannot be read at arbitrary offsets.
+		blob, blobSize, err := roEngine.(cas.RandomAccessEngine).GetBlobAt(ctx, digest)
+		if test.compressed {
+			if errors.Cause(err) != cas.ErrNotImplemented {
+				t.Errorf("%s: GetBlobAt: expected cas.ErrNotImplemented, got %v", test.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: GetBlobAt: unexpected error: %+v", test.name, err)
+		} else {
+			if blobSize != size {
+				t.Errorf("%s: GetBlobAt: unexpected size: expected %d got %d", test.name, size, blobSize)
+			}
+			blob.Close()
+		}
+		roEngine.Close()
+
+		digests, err := engine.ListBlobs(ctx)
+		if err != nil {
+			t.Fatalf("%s: ListBlobs: unexpected error: %+v", test.name, err)
+		}
+		found := false
+		for _, listed := range digests {
+			found = found || listed == digest
+		}
+		if !found {
+			t.Errorf("%s: ListBlobs: blob %s not listed: %v", test.name, digest, digests)
+		}
+
+		if err := engine.DeleteBlob(ctx, digest); err != nil {
+			t.Fatalf("%s: DeleteBlob: unexpected error: %+v", test.name, err)
+		}
+		if _, err := engine.GetBlob(ctx, digest); !os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("%s: GetBlob: expected deleted blob to not exist: %+v", test.name, err)
+		}
+	}
+}
+
+func TestEngineCompressBlobsPool(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestEngineCompressBlobsPool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	if _, err := OpenWithOptions(image, Options{CompressBlobs: true, BlobPool: root}); err == nil {
+		t.Errorf("expected compressed blobs with a blob pool to fail")
+	}
+}
+
+func TestZstdContentSize(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		header []byte
+		size   int64
+	}{
+		// Single segment, 1 byte content size.
+		{"single-1", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x20, 0x2a}, 42},
+		// Window descriptor, 2 byte content size (offset by 256).
+		{"window-2", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x40, 0x58, 0x00, 0x01}, 512},
+		// Window descriptor, 1 byte dictionary ID, 4 byte content size.
+		{"dict-4", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x81, 0x58, 0x07, 0x00, 0x00, 0x10, 0x00}, 1 << 20},
+		// No content size.
+		{"none", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x58}, -1},
+	} {
+		fh, err := ioutil.TempFile("", "umoci-TestZstdContentSize")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+		if _, err := fh.Write(test.header); err != nil {
+			t.Fatal(err)
+		}
+
+		size, err := zstdContentSize(fh)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+		} else if size != test.size {
+			t.Errorf("%s: unexpected size: expected %d got %d", test.name, test.size, size)
+		}
+	}
+}
@@ -22,11 +22,16 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"syscall"
 
 	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/ctxio"
+	"github.com/openSUSE/umoci/pkg/event"
 	"github.com/openSUSE/umoci/pkg/system"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -50,6 +55,20 @@ const (
 	// layoutFile is the file in side an OCI image the indicates what version
 	// of the OCI spec the image is.
 	layoutFile = "oci-layout"
+
+	// IndexCacheDirectory is the directory inside an OCI image used to cache
+	// data derived from blobs (such as the indexes of layers, see
+	// layer.IndexCache). It is not part of the image layout, but is preserved
+	// by Clean. Entries must be named after the blob they were derived from
+	// (as <algorithm>/<hex>.<ext>), so that Clean can remove the entries of
+	// blobs which are no longer in the image.
+	IndexCacheDirectory = ".umoci-index"
+
+	// HistoryLogFile is the file inside an OCI image used to record the
+	// changes made to its references (see auditlog). It is not part of the
+	// image layout, and is only written to if it already exists, but is
+	// preserved by Clean.
+	HistoryLogFile = "history.log"
 )
 
 // blobPath returns the path to a blob given its digest, relative to the root
@@ -69,21 +88,77 @@ func blobPath(digest digest.Digest) (string, error) {
 	return filepath.Join(blobDirectory, algo.String(), hash), nil
 }
 
-// refPath returns the path to a reference given its name, relative to the r
-// oot of the OCI image.
+// refFile returns the escaped file name under which a reference with the
+// given name is stored, so that names containing slashes (such as
+// "library/ubuntu:latest") are stored as a single file rather than nested
+// directories. Names which only use the characters permitted by older
+// versions of umoci are unchanged by escaping.
+func refFile(name string) (string, error) {
+	switch name {
+	case "", ".", "..":
+		return "", errors.Errorf("invalid reference name: %q", name)
+	}
+	return url.PathEscape(name), nil
+}
+
+// refName returns the name of the reference stored in the given file (the
+// inverse of refFile).
+func refName(file string) (string, error) {
+	return url.PathUnescape(file)
+}
+
+// refPath returns the path to a reference given its name, relative to the
+// root of the OCI image.
 func refPath(name string) (string, error) {
-	return filepath.Join(refDirectory, name), nil
+	file, err := refFile(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(refDirectory, file), nil
 }
 
 type dirEngine struct {
 	path     string
 	temp     string
 	tempFile *os.File
+	options  Options
+
+	// cleanDone is closed once the background clean of stale temporary
+	// directories (see startClean) has finished.
+	cleanDone chan struct{}
+
+	// writersFile holds the shared lock on the writers lock file, once the
+	// engine has started writing (see acquireWriters).
+	writersFile *os.File
+
+	// exclusiveFile holds the exclusive lock on the writers lock file while
+	// the engine holds the lock returned by LockExclusive.
+	exclusiveFile *os.File
+}
+
+// tempRoot returns the directory in which the temporary directory of the
+// engine is created.
+func (e *dirEngine) tempRoot() string {
+	if e.options.TempDir != "" {
+		return e.options.TempDir
+	}
+	return e.path
+}
+
+// checkWritable returns cas.ErrReadOnly if the engine was opened read-only.
+func (e *dirEngine) checkWritable() error {
+	if e.options.ReadOnly {
+		return cas.ErrReadOnly
+	}
+	return nil
 }
 
-func (e *dirEngine) ensureTempDir() error {
-	if e.temp == "" {
-		tempDir, err := ioutil.TempDir(e.path, "tmp-")
+func (e *dirEngine) ensureTempDir(ctx context.Context) error {
+	if err := e.acquireWriters(ctx); err != nil {
+		return errors.Wrap(err, "acquire writers lock")
+	}
+	for e.temp == "" {
+		tempDir, err := ioutil.TempDir(e.tempRoot(), tempPrefix)
 		if err != nil {
 			return errors.Wrap(err, "create tempdir")
 		}
@@ -91,20 +166,88 @@ func (e *dirEngine) ensureTempDir() error {
 		// We get an advisory lock to ensure that GC() won't delete our
 		// temporary directory here. Once we get the lock we know it won't do
 		// anything until we unlock it or exit.
-
-		e.tempFile, err = os.Open(tempDir)
+		tempFile, err := os.Open(tempDir)
 		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
 			return errors.Wrap(err, "open tempdir for lock")
 		}
-		if err := system.Flock(e.tempFile.Fd(), true); err != nil {
+		if err := system.Flock(tempFile.Fd(), true); err != nil {
+			tempFile.Close()
+			// A concurrent Clean() has locked the directory in order to
+			// remove it, so just try again with a new directory.
+			if err == syscall.EWOULDBLOCK {
+				event.Default().Debugf("dir: tempdir %s is being removed, retrying", tempDir)
+				continue
+			}
 			return errors.Wrap(err, "lock tempdir")
 		}
 
+		// A concurrent Clean() could also have removed the directory after
+		// we created it but before we locked it (in which case we would be
+		// holding a lock on a deleted directory), so we have to make sure
+		// that the directory we locked is still there.
+		if ok, err := sameFile(tempFile, tempDir); err != nil || !ok {
+			system.Unflock(tempFile.Fd())
+			tempFile.Close()
+			if err != nil {
+				return errors.Wrap(err, "check locked tempdir")
+			}
+			event.Default().Debugf("dir: tempdir %s was removed before it was locked, retrying", tempDir)
+			continue
+		}
+
 		e.temp = tempDir
+		e.tempFile = tempFile
+
+		// We are about to write to the image, so this is a good time to
+		// get rid of any temporary directories left behind by crashed
+		// engines.
+		e.startClean()
 	}
 	return nil
 }
 
+// sameFile returns whether the given path still refers to the open file.
+func sameFile(fh *os.File, path string) (bool, error) {
+	fhInfo, err := fh.Stat()
+	if err != nil {
+		return false, err
+	}
+	pathInfo, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return os.SameFile(fhInfo, pathInfo), nil
+}
+
+// syncFile flushes the contents of the given file to stable storage, unless
+// the engine was opened with Options.NoSync.
+func (e *dirEngine) syncFile(fh *os.File) error {
+	if e.options.NoSync {
+		return nil
+	}
+	return fh.Sync()
+}
+
+// syncDir flushes the entries of the given directory to stable storage (so
+// that a file renamed into it survives a crash), unless the engine was opened
+// with Options.NoSync.
+func (e *dirEngine) syncDir(path string) error {
+	if e.options.NoSync {
+		return nil
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	return fh.Sync()
+}
+
 // verify ensures that the image is valid.
 func (e *dirEngine) validate() error {
 	content, err := ioutil.ReadFile(filepath.Join(e.path, layoutFile))
@@ -154,8 +297,16 @@ func (e *dirEngine) validate() error {
 // PutBlob adds a new blob to the image. This is idempotent; a nil error
 // means that "the content is stored at DIGEST" without implying "because
 // of this PutBlob() call".
-func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
-	if err := e.ensureTempDir(); err != nil {
+func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (blobDigest digest.Digest, blobSize int64, err error) {
+	ctx, span := event.StartSpan(ctx, "dir.PutBlob")
+	defer func() { span.End(err) }()
+	blob := event.StartBlob(ctx, event.OpPut, "", -1)
+	defer func() { blob.Done(blobDigest, err) }()
+
+	if err := e.checkWritable(); err != nil {
+		return "", -1, err
+	}
+	if err := e.ensureTempDir(ctx); err != nil {
 		return "", -1, errors.Wrap(err, "ensure tempdir")
 	}
 
@@ -169,12 +320,24 @@ func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Diges
 	}
 	tempPath := fh.Name()
 	defer fh.Close()
+	defer func() {
+		// Don't leave the temporary blob behind if we were cancelled (or
+		// failed for any other reason).
+		if err != nil {
+			os.Remove(tempPath)
+		}
+	}()
+
+	progressReader := blob.Reader(ctxio.NewReader(ctx, reader))
 
 	writer := io.MultiWriter(fh, digester.Hash())
-	size, err := io.Copy(writer, reader)
+	size, err := io.Copy(writer, progressReader)
 	if err != nil {
 		return "", -1, errors.Wrap(err, "copy to temporary blob")
 	}
+	if err := e.syncFile(fh); err != nil {
+		return "", -1, errors.Wrap(err, "sync temporary blob")
+	}
 	fh.Close()
 
 	// Get the digest.
@@ -183,12 +346,30 @@ func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Diges
 		return "", -1, errors.Wrap(err, "compute blob name")
 	}
 
-	// Move the blob to its correct path.
+	// Move the blob to its correct path (compressing it first, if it should
+	// be stored compressed).
 	path = filepath.Join(e.path, path)
-	if err := os.Rename(tempPath, path); err != nil {
+	if compress, err := e.shouldCompress(tempPath, path); err != nil {
+		return "", -1, errors.Wrap(err, "check blob compression")
+	} else if compress {
+		tempPath, err = e.compressFile(tempPath)
+		if err != nil {
+			return "", -1, errors.Wrap(err, "compress temporary blob")
+		}
+		path += compressedSuffix
+	}
+	if err := renameFile(tempPath, path, e.options.NoSync); err != nil {
 		return "", -1, errors.Wrap(err, "rename temporary blob")
 	}
+	if err := e.syncDir(filepath.Dir(path)); err != nil {
+		return "", -1, errors.Wrap(err, "sync blobdir")
+	}
+	if err := e.addToPool(digester.Digest(), path); err != nil {
+		return "", -1, errors.Wrap(err, "add blob to pool")
+	}
 
+	span.SetAttribute("digest", digester.Digest())
+	span.SetAttribute("size", size)
 	return digester.Digest(), int64(size), nil
 }
 
@@ -205,29 +386,21 @@ func (e *dirEngine) PutBlobJSON(ctx context.Context, data interface{}) (digest.D
 	return e.PutBlob(ctx, &buffer)
 }
 
-// PutReference adds a new reference descriptor blob to the image. This is
-// idempotent; a nil error means that "the descriptor is stored at NAME"
-// without implying "because of this PutReference() call". ErrClobber is
-// returned if there is already a descriptor stored at NAME, but does not
-// match the descriptor requested to be stored.
-func (e *dirEngine) PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
-	if err := e.ensureTempDir(); err != nil {
+// writeReference stores the descriptor at the given reference, replacing any
+// existing descriptor. The caller must hold the reference lock.
+func (e *dirEngine) writeReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	if err := e.ensureTempDir(ctx); err != nil {
 		return errors.Wrap(err, "ensure tempdir")
 	}
 
-	if oldDescriptor, err := e.GetReference(ctx, name); err == nil {
-		// We should not return an error if the two descriptors are identical.
-		if !reflect.DeepEqual(oldDescriptor, descriptor) {
-			return cas.ErrClobber
-		}
-		return nil
-	} else if !os.IsNotExist(errors.Cause(err)) {
-		return errors.Wrap(err, "get old reference")
+	file, err := refFile(name)
+	if err != nil {
+		return errors.Wrap(err, "compute ref file")
 	}
 
 	// We copy this into a temporary file to avoid half-writing an invalid
 	// reference.
-	fh, err := ioutil.TempFile(e.temp, "ref."+name+"-")
+	fh, err := ioutil.TempFile(e.temp, "ref."+file+"-")
 	if err != nil {
 		return errors.Wrap(err, "create temporary ref")
 	}
@@ -238,6 +411,9 @@ func (e *dirEngine) PutReference(ctx context.Context, name string, descriptor is
 	if err := json.NewEncoder(fh).Encode(descriptor); err != nil {
 		return errors.Wrap(err, "encode temporary ref")
 	}
+	if err := e.syncFile(fh); err != nil {
+		return errors.Wrap(err, "sync temporary ref")
+	}
 	fh.Close()
 
 	path, err := refPath(name)
@@ -247,10 +423,97 @@ func (e *dirEngine) PutReference(ctx context.Context, name string, descriptor is
 
 	// Move the ref to its correct path.
 	path = filepath.Join(e.path, path)
-	if err := os.Rename(tempPath, path); err != nil {
+	if err := renameFile(tempPath, path, e.options.NoSync); err != nil {
 		return errors.Wrap(err, "rename temporary ref")
 	}
+	if err := e.syncDir(filepath.Dir(path)); err != nil {
+		return errors.Wrap(err, "sync refdir")
+	}
+
+	return nil
+}
+
+// PutReference adds a new reference descriptor blob to the image. This is
+// idempotent; a nil error means that "the descriptor is stored at NAME"
+// without implying "because of this PutReference() call". ErrClobber is
+// returned if there is already a descriptor stored at NAME, but does not
+// match the descriptor requested to be stored (or ErrFrozen if NAME is
+// frozen).
+func (e *dirEngine) PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+	unlock, err := e.lockReference(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if oldDescriptor, err := e.GetReference(ctx, name); err == nil {
+		// We should not return an error if the two descriptors are identical.
+		if !reflect.DeepEqual(oldDescriptor, descriptor) {
+			if err := e.checkFrozen(name); err != nil {
+				return err
+			}
+			return &cas.ClobberError{
+				Name: name,
+				Old:  oldDescriptor,
+				New:  descriptor,
+			}
+		}
+		return nil
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		return errors.Wrap(err, "get old reference")
+	}
+
+	if err := e.writeReference(ctx, name, descriptor); err != nil {
+		return err
+	}
+	event.Emit(ctx, event.Event{Type: event.RefUpdated, Reference: name, Descriptor: &descriptor})
+	return nil
+}
+
+// UpdateReference replaces the descriptor stored at NAME with newDescriptor,
+// but only if the descriptor currently stored at NAME is oldDescriptor (if
+// oldDescriptor is nil, NAME must not exist). The reference is locked for the
+// duration of the update, so concurrent updates (even from other processes)
+// cannot overwrite each other.
+func (e *dirEngine) UpdateReference(ctx context.Context, name string, oldDescriptor *ispec.Descriptor, newDescriptor ispec.Descriptor) error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+	unlock, err := e.lockReference(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
+	current, err := e.GetReference(ctx, name)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return errors.Wrap(err, "get old reference")
+	}
+	exists := err == nil
+	if exists && reflect.DeepEqual(current, newDescriptor) {
+		return nil
+	}
+	if err := e.checkFrozen(name); err != nil {
+		return err
+	}
+	if oldDescriptor != nil && !exists {
+		return errors.Wrap(os.ErrNotExist, "get old reference")
+	}
+	if exists && (oldDescriptor == nil || !reflect.DeepEqual(current, *oldDescriptor)) {
+		return &cas.ClobberError{
+			Name: name,
+			Old:  current,
+			New:  newDescriptor,
+		}
+	}
+
+	if err := e.writeReference(ctx, name, newDescriptor); err != nil {
+		return err
+	}
+	event.Emit(ctx, event.Event{Type: event.RefUpdated, Reference: name, Descriptor: &newDescriptor})
 	return nil
 }
 
@@ -261,8 +524,90 @@ func (e *dirEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadC
 	if err != nil {
 		return nil, errors.Wrap(err, "compute blob path")
 	}
-	fh, err := os.Open(filepath.Join(e.path, path))
-	return fh, errors.Wrap(err, "open blob")
+	path = filepath.Join(e.path, path)
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// The blob might be stored compressed.
+		if compressedFh, compressedErr := os.Open(path + compressedSuffix); compressedErr == nil {
+			var size int64 = -1
+			if contentSize, err := zstdContentSize(compressedFh); err == nil {
+				size = contentSize
+			}
+			reader, err := newZstdReader(compressedFh)
+			if err != nil {
+				compressedFh.Close()
+				return nil, errors.Wrap(err, "open compressed blob")
+			}
+			return event.NewBlobReader(ctx, digest, size, ctxio.NewReadCloser(ctx, reader)), nil
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "open blob")
+	}
+	var size int64 = -1
+	if fi, err := fh.Stat(); err == nil {
+		size = fi.Size()
+	}
+	return event.NewBlobReader(ctx, digest, size, ctxio.NewReadCloser(ctx, fh)), nil
+}
+
+// GetBlobAt opens a blob for random access, returning the *os.File of the
+// blob (which the caller must Close()) and its size. Returns os.ErrNotExist if
+// the digest is not found, and cas.ErrNotImplemented if the blob is stored
+// compressed (in which case it can only be read with GetBlob).
+func (e *dirEngine) GetBlobAt(ctx context.Context, digest digest.Digest) (cas.BlobReaderAt, int64, error) {
+	path, err := blobPath(digest)
+	if err != nil {
+		return nil, -1, errors.Wrap(err, "compute blob path")
+	}
+	path = filepath.Join(e.path, path)
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Compressed blobs cannot be read at arbitrary offsets.
+		if _, compressedErr := os.Lstat(path + compressedSuffix); compressedErr == nil {
+			return nil, -1, cas.ErrNotImplemented
+		}
+	}
+	if err != nil {
+		return nil, -1, errors.Wrap(err, "open blob")
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, -1, errors.Wrap(err, "stat blob")
+	}
+	return fh, fi.Size(), nil
+}
+
+// StatBlob returns the size and modification time of a blob. Returns
+// os.ErrNotExist if the digest is not found.
+func (e *dirEngine) StatBlob(ctx context.Context, digest digest.Digest) (cas.BlobInfo, error) {
+	path, err := blobPath(digest)
+	if err != nil {
+		return cas.BlobInfo{}, errors.Wrap(err, "compute blob path")
+	}
+	path = filepath.Join(e.path, path)
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		// The blob might be stored compressed.
+		if compressedFi, compressedErr := os.Stat(path + compressedSuffix); compressedErr == nil {
+			size, err := compressedSize(path + compressedSuffix)
+			if err != nil {
+				return cas.BlobInfo{}, errors.Wrap(err, "get size of compressed blob")
+			}
+			return cas.BlobInfo{
+				Size:    size,
+				ModTime: compressedFi.ModTime(),
+			}, nil
+		}
+	}
+	if err != nil {
+		return cas.BlobInfo{}, errors.Wrap(err, "stat blob")
+	}
+	return cas.BlobInfo{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
 }
 
 // GetReference returns a reference from the image. Returns os.ErrNotExist
@@ -291,14 +636,20 @@ func (e *dirEngine) GetReference(ctx context.Context, name string) (ispec.Descri
 // error means "the content is not in the store" without implying "because
 // of this DeleteBlob() call".
 func (e *dirEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
 	path, err := blobPath(digest)
 	if err != nil {
 		return errors.Wrap(err, "compute blob path")
 	}
 
-	err = os.Remove(filepath.Join(e.path, path))
-	if err != nil && !os.IsNotExist(err) {
-		return errors.Wrap(err, "remove blob")
+	path = filepath.Join(e.path, path)
+	for _, blobPath := range []string{path, path + compressedSuffix} {
+		err = os.Remove(blobPath)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove blob")
+		}
 	}
 	return nil
 }
@@ -307,15 +658,33 @@ func (e *dirEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error
 // a nil error means "the content is not in the store" without implying
 // "because of this DeleteReference() call".
 func (e *dirEngine) DeleteReference(ctx context.Context, name string) error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+	unlock, err := e.lockReference(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := e.checkFrozen(name); err != nil {
+		return err
+	}
+
 	path, err := refPath(name)
 	if err != nil {
 		return errors.Wrap(err, "compute ref path")
 	}
 
-	err = os.Remove(filepath.Join(e.path, path))
+	path = filepath.Join(e.path, path)
+	err = os.Remove(path)
 	if err != nil && !os.IsNotExist(err) {
 		return errors.Wrap(err, "remove ref")
 	}
+	if err := e.syncDir(filepath.Dir(path)); err != nil {
+		return errors.Wrap(err, "sync refdir")
+	}
+	event.Emit(ctx, event.Event{Type: event.RefUpdated, Reference: name})
 	return nil
 }
 
@@ -325,13 +694,21 @@ func (e *dirEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
 	blobDir := filepath.Join(e.path, blobDirectory, cas.BlobAlgorithm.String())
 
 	if err := filepath.Walk(blobDir, func(path string, _ os.FileInfo, _ error) error {
-		// Skip the actual directory.
-		if path == blobDir {
+		// Skip the actual directory (and any temporary copies).
+		if path == blobDir || isCopyTemp(filepath.Base(path)) {
 			return nil
 		}
 
 		// XXX: Do we need to handle multiple-directory-deep cases?
-		digest := digest.NewDigestFromHex(cas.BlobAlgorithm.String(), filepath.Base(path))
+		name := filepath.Base(path)
+		if strings.HasSuffix(name, compressedSuffix) {
+			name = strings.TrimSuffix(name, compressedSuffix)
+			// Skip blobs which are also stored as-is.
+			if _, err := os.Lstat(filepath.Join(blobDir, name)); err == nil {
+				return nil
+			}
+		}
+		digest := digest.NewDigestFromHex(cas.BlobAlgorithm.String(), name)
 		digests = append(digests, digest)
 		return nil
 	}); err != nil {
@@ -346,17 +723,26 @@ func (e *dirEngine) ListReferences(ctx context.Context) ([]string, error) {
 	refs := []string{}
 	refDir := filepath.Join(e.path, refDirectory)
 
-	if err := filepath.Walk(refDir, func(path string, _ os.FileInfo, _ error) error {
-		// Skip the actual directory.
-		if path == refDir {
-			return nil
-		}
+	fh, err := os.Open(refDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "open refdir")
+	}
+	files, err := fh.Readdirnames(-1)
+	fh.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "read refdir")
+	}
 
-		// XXX: Do we need to handle multiple-directory-deep cases?
-		refs = append(refs, filepath.Base(path))
-		return nil
-	}); err != nil {
-		return nil, errors.Wrap(err, "walk refdir")
+	for _, file := range files {
+		// Skip any temporary copies.
+		if isCopyTemp(file) {
+			continue
+		}
+		name, err := refName(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid reference file %q", file)
+		}
+		refs = append(refs, name)
 	}
 
 	return refs, nil
@@ -366,53 +752,55 @@ func (e *dirEngine) ListReferences(ctx context.Context) ([]string, error) {
 // (this includes temporary files and directories not reachable from the CAS
 // interface). This MUST NOT remove any blobs or references in the store.
 func (e *dirEngine) Clean(ctx context.Context) error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
 	// Effectively we are going to remove every directory except the standard
 	// directories, unless they have a lock already.
-	fh, err := os.Open(e.path)
-	if err != nil {
-		return errors.Wrap(err, "open imagedir")
+	if err := cleanDir(e.path, func(name string) bool {
+		// Skip any children that are expected to exist. Partial blobs are
+		// kept so that they can still be resumed.
+		switch name {
+		case blobDirectory, refDirectory, layoutFile, uploadDirectory, frozenDirectory, lockDirectory, IndexCacheDirectory, HistoryLogFile:
+			return false
+		}
+		return true
+	}); err != nil {
+		return errors.Wrap(err, "clean imagedir")
 	}
-	defer fh.Close()
 
-	children, err := fh.Readdir(-1)
-	if err != nil {
-		return errors.Wrap(err, "readdir imagedir")
+	// Cached data derived from blobs which have since been removed.
+	if err := e.cleanIndexCache(); err != nil {
+		return errors.Wrap(err, "clean index cache")
 	}
 
-	for _, child := range children {
-		// Skip any children that are expected to exist.
-		switch child.Name() {
-		case blobDirectory, refDirectory, layoutFile:
-			continue
-		}
-
-		// Try to get a lock on the directory.
-		path := filepath.Join(e.path, child.Name())
-		cfh, err := os.Open(path)
-		if err != nil {
-			// Ignore errors because it might've been deleted underneath us.
-			continue
-		}
-		defer cfh.Close()
+	// Temporary copies left behind by a crashed copyRename.
+	if err := cleanDir(filepath.Join(e.path, blobDirectory, cas.BlobAlgorithm.String()), isCopyTemp); err != nil {
+		return errors.Wrap(err, "clean blobdir")
+	}
+	if err := cleanDir(filepath.Join(e.path, refDirectory), isCopyTemp); err != nil {
+		return errors.Wrap(err, "clean refdir")
+	}
 
-		if err := system.Flock(cfh.Fd(), true); err != nil {
-			// If we fail to get a flock(2) then it's probably already locked,
-			// so we shouldn't touch it.
-			continue
-		}
-		defer system.Unflock(cfh.Fd())
+	// Lock files of references which are not being modified.
+	if err := cleanDir(e.lockPath(refLockDirectory), func(string) bool { return true }); err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return errors.Wrap(err, "clean reference locks")
+	}
 
-		if err := os.RemoveAll(path); err != nil {
-			return errors.Wrap(err, "remove garbage path")
+	if e.options.TempDir != "" {
+		if err := cleanDir(e.options.TempDir, func(name string) bool {
+			return strings.HasPrefix(name, tempPrefix)
+		}); err != nil {
+			return errors.Wrap(err, "clean tempdir")
 		}
 	}
-
 	return nil
 }
 
 // Close releases all references held by the e. Subsequent operations may
 // fail.
 func (e *dirEngine) Close() error {
+	e.waitClean()
 	if e.temp != "" {
 		if err := system.Unflock(e.tempFile.Fd()); err != nil {
 			return errors.Wrap(err, "unlock tempdir")
@@ -424,15 +812,53 @@ func (e *dirEngine) Close() error {
 			return errors.Wrap(err, "remove tempdir")
 		}
 	}
+	if e.writersFile != nil {
+		if err := e.writersFile.Close(); err != nil {
+			return errors.Wrap(err, "unlock writers")
+		}
+		e.writersFile = nil
+	}
 	return nil
 }
 
 // Open opens a new reference to the directory-backed OCI image referenced by
 // the provided path.
 func Open(path string) (cas.Engine, error) {
+	return OpenWithOptions(path, Options{})
+}
+
+// OpenReadOnly is like Open, except that the returned engine never writes to
+// the image (see Options.ReadOnly), so it can be used with images on
+// read-only storage.
+func OpenReadOnly(path string) (cas.Engine, error) {
+	return OpenWithOptions(path, Options{ReadOnly: true})
+}
+
+// OpenWithOptions is like Open, except that the returned engine uses the
+// given options.
+func OpenWithOptions(path string, options Options) (cas.Engine, error) {
+	switch options.LinkMode {
+	case "", LinkHardlink, LinkReflink:
+	default:
+		return nil, errors.Errorf("unknown link mode: %s", options.LinkMode)
+	}
+	if options.CompressBlobs {
+		if options.BlobPool != "" {
+			return nil, errors.Errorf("blob pools cannot be used with compressed blobs")
+		}
+	}
+	if options.TempDir != "" {
+		if fi, err := os.Stat(options.TempDir); err != nil {
+			return nil, errors.Wrap(err, "check tempdir")
+		} else if !fi.IsDir() {
+			return nil, errors.Errorf("tempdir is not a directory: %s", options.TempDir)
+		}
+	}
+
 	engine := &dirEngine{
-		path: path,
-		temp: "",
+		path:    path,
+		temp:    "",
+		options: options,
 	}
 
 	if err := engine.validate(); err != nil {
@@ -20,15 +20,20 @@ package dir
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/system"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
@@ -340,6 +345,96 @@ func TestEngineReferenceReadonly(t *testing.T) {
 	}
 }
 
+func TestEngineOpenReadOnly(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineOpenReadOnly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	digest, _, err := engine.PutBlob(ctx, bytes.NewBufferString("some blob"))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	descriptor := ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: digest, Size: 9}
+	if err := engine.PutReference(ctx, "ref", descriptor); err != nil {
+		t.Fatalf("PutReference: unexpected error: %+v", err)
+	}
+	if err := engine.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %+v", err)
+	}
+
+	before, err := ioutil.ReadDir(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roEngine, err := OpenReadOnly(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image read-only: %+v", err)
+	}
+
+	// Reading must work.
+	if gotDescriptor, err := roEngine.GetReference(ctx, "ref"); err != nil {
+		t.Errorf("GetReference: unexpected error: %+v", err)
+	} else if !reflect.DeepEqual(descriptor, gotDescriptor) {
+		t.Errorf("GetReference: got different descriptor: expected=%v got=%v", descriptor, gotDescriptor)
+	}
+	if blob, err := roEngine.GetBlob(ctx, digest); err != nil {
+		t.Errorf("GetBlob: unexpected error: %+v", err)
+	} else {
+		blob.Close()
+	}
+
+	// Every modification must fail with ErrReadOnly.
+	for _, test := range []struct {
+		name string
+		fn   func() error
+	}{
+		{"PutBlob", func() error { _, _, err := roEngine.PutBlob(ctx, bytes.NewBufferString("other blob")); return err }},
+		{"PutBlobJSON", func() error { _, _, err := roEngine.PutBlobJSON(ctx, descriptor); return err }},
+		{"PutReference", func() error { return roEngine.PutReference(ctx, "new", descriptor) }},
+		{"UpdateReference", func() error {
+			return roEngine.(cas.UpdatingEngine).UpdateReference(ctx, "ref", &descriptor, ispec.Descriptor{})
+		}},
+		{"DeleteBlob", func() error { return roEngine.DeleteBlob(ctx, digest) }},
+		{"DeleteReference", func() error { return roEngine.DeleteReference(ctx, "ref") }},
+		{"FreezeReference", func() error { return roEngine.(cas.FreezingEngine).FreezeReference(ctx, "ref") }},
+		{"Clean", func() error { return roEngine.Clean(ctx) }},
+	} {
+		if err := test.fn(); errors.Cause(err) != cas.ErrReadOnly {
+			t.Errorf("%s: expected ErrReadOnly, got: %+v", test.name, err)
+		}
+	}
+
+	if err := roEngine.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %+v", err)
+	}
+
+	// Nothing (not even a temporary directory) may have been created.
+	after, err := ioutil.ReadDir(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != len(after) {
+		t.Errorf("read-only engine modified the image: before=%d entries after=%d entries", len(before), len(after))
+	}
+	if _, err := os.Stat(filepath.Join(image, "refs", "ref")); err != nil {
+		t.Errorf("read-only engine removed reference: %+v", err)
+	}
+}
+
 // Make sure that openSUSE/umoci#63 doesn't have a regression where we start
 // deleting files and directories that other people are using.
 func TestEngineGCLocking(t *testing.T) {
@@ -415,3 +510,380 @@ func TestEngineGCLocking(t *testing.T) {
 		t.Errorf("expected IsNotExist for temporary dir after GC: %+v", err)
 	}
 }
+
+func TestEngineCleanStale(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineCleanStale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	old := time.Now().Add(-2 * DefaultCleanAge)
+	mkdir := func(name string, mtime time.Time) string {
+		path := filepath.Join(image, name)
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(path, "file"), []byte("garbage"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// Stale and fresh temporary directories, as well as a stale directory
+	// which is still locked by another engine and one which isn't a
+	// temporary directory.
+	stale := mkdir("tmp-stale", old)
+	fresh := mkdir("tmp-fresh", time.Now())
+	locked := mkdir("tmp-locked", old)
+	other := mkdir("other", old)
+
+	fh, err := os.Open(locked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if err := system.Flock(fh.Fd(), true); err != nil {
+		t.Fatal(err)
+	}
+	defer system.Unflock(fh.Fd())
+
+	// Opening the image and only reading must not clean anything.
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	if _, err := engine.ListReferences(ctx); err != nil {
+		t.Fatalf("unexpected error listing references: %+v", err)
+	}
+	if err := engine.Close(); err != nil {
+		t.Fatalf("unexpected error closing engine: %+v", err)
+	}
+	if _, err := os.Lstat(stale); err != nil {
+		t.Errorf("stale tempdir removed without writing to the image: %+v", err)
+	}
+
+	// With the background clean disabled, writing doesn't clean anything.
+	engine, err = OpenWithOptions(image, Options{CleanAge: -1})
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	if _, _, err := engine.PutBlob(ctx, bytes.NewReader([]byte("some content"))); err != nil {
+		t.Fatalf("unexpected error putting blob: %+v", err)
+	}
+	if err := engine.Close(); err != nil {
+		t.Fatalf("unexpected error closing engine: %+v", err)
+	}
+	if _, err := os.Lstat(stale); err != nil {
+		t.Errorf("stale tempdir removed with background clean disabled: %+v", err)
+	}
+
+	// Writing to the image removes the stale tempdir (Close waits for the
+	// background clean).
+	engine, err = Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	if _, _, err := engine.PutBlob(ctx, bytes.NewReader([]byte("some content"))); err != nil {
+		t.Fatalf("unexpected error putting blob: %+v", err)
+	}
+	if err := engine.Close(); err != nil {
+		t.Fatalf("unexpected error closing engine: %+v", err)
+	}
+
+	if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected stale tempdir to be removed: %+v", err)
+	}
+	for _, path := range []string{fresh, locked, other} {
+		if _, err := os.Lstat(path); err != nil {
+			t.Errorf("expected %s to still exist: %+v", path, err)
+		}
+	}
+}
+
+func TestEngineCleanIndexCache(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineCleanIndexCache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	kept, _, err := engine.PutBlob(ctx, bytes.NewReader([]byte("kept blob")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, _, err := engine.PutBlob(ctx, bytes.NewReader([]byte("removed blob")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cacheDir := filepath.Join(image, IndexCacheDirectory, cas.BlobAlgorithm.String())
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, name := range []string{kept.Hex() + ".json", removed.Hex() + ".json", ".index-temp"} {
+		path := filepath.Join(cacheDir, name)
+		if err := ioutil.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	if err := engine.DeleteBlob(ctx, removed); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.Clean(ctx); err != nil {
+		t.Fatalf("unexpected error cleaning image: %+v", err)
+	}
+
+	for idx, exists := range []bool{true, false, true} {
+		if _, err := os.Lstat(paths[idx]); exists && err != nil {
+			t.Errorf("expected %s to still exist: %+v", paths[idx], err)
+		} else if !exists && !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed: %+v", paths[idx], err)
+		}
+	}
+}
+
+func TestEngineConcurrentClean(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineConcurrentClean")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	// Continuously clean the image while other engines are creating their
+	// temporary directories, which must never be removed from under them.
+	stop := make(chan struct{})
+	cleanErr := make(chan error, 1)
+	go func() {
+		defer close(cleanErr)
+		engine, err := Open(image)
+		if err != nil {
+			cleanErr <- err
+			return
+		}
+		defer engine.Close()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := engine.Clean(ctx); err != nil {
+				cleanErr <- err
+				return
+			}
+		}
+	}()
+
+	const workers = 8
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			for j := 0; j < 50; j++ {
+				engine, err := Open(image)
+				if err != nil {
+					errs <- errors.Wrap(err, "open")
+					return
+				}
+				content := fmt.Sprintf("worker %d blob %d", i, j)
+				digest, _, err := engine.PutBlob(ctx, strings.NewReader(content))
+				if err != nil {
+					engine.Close()
+					errs <- errors.Wrap(err, "put blob")
+					return
+				}
+				reader, err := engine.GetBlob(ctx, digest)
+				if err != nil {
+					engine.Close()
+					errs <- errors.Wrap(err, "get blob")
+					return
+				}
+				reader.Close()
+				if err := engine.Close(); err != nil {
+					errs <- errors.Wrap(err, "close")
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < workers; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("unexpected error: %+v", err)
+		}
+	}
+	close(stop)
+	if err := <-cleanErr; err != nil {
+		t.Errorf("unexpected error cleaning image: %+v", err)
+	}
+}
+
+// cancellingReader cancels its context once it has been read from.
+type cancellingReader struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (r cancellingReader) Read(p []byte) (int, error) {
+	r.cancel()
+	return r.Reader.Read(p)
+}
+
+func TestEngineCancel(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestEngineCancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	tempDir := filepath.Join(root, "tmp")
+	if err := os.Mkdir(tempDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := OpenWithOptions(image, Options{TempDir: tempDir})
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	// Cancel the copy part of the way through the blob.
+	ctx, cancel := context.WithCancel(context.Background())
+	content := bytes.Repeat([]byte("blob data "), 64*1024)
+	if _, _, err := engine.PutBlob(ctx, cancellingReader{bytes.NewReader(content), cancel}); errors.Cause(err) != context.Canceled {
+		t.Errorf("PutBlob: expected context.Canceled: %+v", err)
+	}
+
+	// The partial blob must have been removed.
+	if err := filepath.Walk(tempDir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			t.Errorf("PutBlob: left behind temporary file: %s", path)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if digests, err := engine.ListBlobs(context.Background()); err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	} else if len(digests) != 0 {
+		t.Errorf("ListBlobs: unexpected blobs after cancelled PutBlob: %v", digests)
+	}
+
+	digest, _, err := engine.PutBlob(context.Background(), bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+
+	// Reading a blob stops once the context is cancelled.
+	ctx, cancel = context.WithCancel(context.Background())
+	reader, err := engine.GetBlob(ctx, digest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	defer reader.Close()
+	if _, err := io.CopyN(ioutil.Discard, reader, 1024); err != nil {
+		t.Fatalf("GetBlob: unexpected error reading: %+v", err)
+	}
+	cancel()
+	if _, err := ioutil.ReadAll(reader); errors.Cause(err) != context.Canceled {
+		t.Errorf("GetBlob: expected context.Canceled: %+v", err)
+	}
+}
+
+func TestEngineReferenceNames(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineReferenceNames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	descriptor := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", Size: 1}
+
+	for _, test := range []struct {
+		name, file string
+	}{
+		{"latest", "latest"},
+		{"sha256-abcd.sig", "sha256-abcd.sig"},
+		{"library/ubuntu:latest", "library%2Fubuntu:latest"},
+		{"example.com/foo/bar@v1+build", "example.com%2Ffoo%2Fbar@v1+build"},
+		{"../escape", "..%2Fescape"},
+	} {
+		if err := engine.PutReference(ctx, test.name, descriptor); err != nil {
+			t.Errorf("PutReference(%q): unexpected error: %+v", test.name, err)
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(image, refDirectory, test.file)); err != nil {
+			t.Errorf("PutReference(%q): expected reference to be stored as %q: %+v", test.name, test.file, err)
+		}
+		if got, err := engine.GetReference(ctx, test.name); err != nil || !reflect.DeepEqual(got, descriptor) {
+			t.Errorf("GetReference(%q): got %v: %+v", test.name, got, err)
+		}
+		if err := engine.(cas.FreezingEngine).FreezeReference(ctx, test.name); err != nil {
+			t.Errorf("FreezeReference(%q): unexpected error: %+v", test.name, err)
+		}
+	}
+
+	names, err := engine.ListReferences(ctx)
+	if err != nil {
+		t.Fatalf("ListReferences: unexpected error: %+v", err)
+	}
+	sort.Strings(names)
+	expected := []string{"../escape", "example.com/foo/bar@v1+build", "latest", "library/ubuntu:latest", "sha256-abcd.sig"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("ListReferences: expected %v, got %v", expected, names)
+	}
+
+	for _, name := range []string{"", ".", ".."} {
+		if err := engine.PutReference(ctx, name, descriptor); err == nil {
+			t.Errorf("PutReference(%q): expected invalid name to be rejected", name)
+		}
+	}
+}
@@ -19,6 +19,7 @@ package dir
 
 import (
 	"os"
+	"strings"
 
 	"github.com/openSUSE/umoci/oci/cas"
 )
@@ -36,6 +37,11 @@ type dirDriver struct{}
 // Note that this is _not_ a validation of the URI -- if the URI refers to an
 // invalid or non-existent resource it is expected that the URI is "supported".
 func (d dirDriver) Supported(uri string) bool {
+	// URIs with an explicit scheme are handled by other drivers.
+	if strings.Contains(uri, "://") {
+		return false
+	}
+
 	fi, err := os.Stat(uri)
 	if err != nil {
 		// If we got an error, we only support it if the error is that the
@@ -52,6 +58,11 @@ func (d dirDriver) Open(uri string) (cas.Engine, error) {
 	return Open(uri)
 }
 
+// OpenReadOnly "opens" a new read-only CAS engine accessor for the given URI.
+func (d dirDriver) OpenReadOnly(uri string) (cas.Engine, error) {
+	return OpenReadOnly(uri)
+}
+
 // Create creates a new image at the provided URI.
 func (d dirDriver) Create(uri string) error {
 	return Create(uri)
@@ -0,0 +1,133 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// frozenDirectory is the directory inside an OCI image that contains the
+// markers for frozen references. Like the reference directory, it is not
+// removed by Clean.
+const frozenDirectory = "frozen"
+
+// frozenPath returns the path to the frozen marker of a reference given its
+// name, relative to the root of the OCI image.
+func frozenPath(name string) (string, error) {
+	file, err := refFile(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(frozenDirectory, file), nil
+}
+
+// isFrozen returns whether the given reference is frozen. The caller must
+// hold the reference lock if the answer is used to decide whether to modify
+// the reference.
+func (e *dirEngine) isFrozen(name string) (bool, error) {
+	path, err := frozenPath(name)
+	if err != nil {
+		return false, errors.Wrap(err, "compute frozen path")
+	}
+	if _, err := os.Lstat(filepath.Join(e.path, path)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "stat frozen marker")
+	}
+	return true, nil
+}
+
+// checkFrozen returns an error wrapping cas.ErrFrozen if the given reference
+// is frozen. The caller must hold the reference lock.
+func (e *dirEngine) checkFrozen(name string) error {
+	frozen, err := e.isFrozen(name)
+	if err != nil {
+		return err
+	}
+	if frozen {
+		return errors.Wrapf(cas.ErrFrozen, "reference %q", name)
+	}
+	return nil
+}
+
+// FreezeReference marks a reference as frozen, so that it cannot be changed
+// or removed until UnfreezeReference is called. Returns os.ErrNotExist if the
+// reference doesn't exist. This is idempotent.
+func (e *dirEngine) FreezeReference(ctx context.Context, name string) error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+	unlock, err := e.lockReference(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := e.GetReference(ctx, name); err != nil {
+		return errors.Wrap(err, "get reference")
+	}
+
+	path, err := frozenPath(name)
+	if err != nil {
+		return errors.Wrap(err, "compute frozen path")
+	}
+	path = filepath.Join(e.path, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "mkdir frozen marker parent")
+	}
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		return errors.Wrap(err, "write frozen marker")
+	}
+	return nil
+}
+
+// UnfreezeReference removes the frozen marker of a reference. This is
+// idempotent; a nil error means "the reference is not frozen" without
+// implying "because of this UnfreezeReference() call".
+func (e *dirEngine) UnfreezeReference(ctx context.Context, name string) error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+	unlock, err := e.lockReference(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	path, err := frozenPath(name)
+	if err != nil {
+		return errors.Wrap(err, "compute frozen path")
+	}
+	err = os.Remove(filepath.Join(e.path, path))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove frozen marker")
+	}
+	return nil
+}
+
+// ReferenceFrozen returns whether a reference is frozen.
+func (e *dirEngine) ReferenceFrozen(ctx context.Context, name string) (bool, error) {
+	return e.isFrozen(name)
+}
@@ -0,0 +1,120 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestEngineFreezeReference(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineFreezeReference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+	freezer, ok := engine.(cas.FreezingEngine)
+	if !ok {
+		t.Fatalf("dir engine is not a cas.FreezingEngine")
+	}
+	updater := engine.(cas.UpdatingEngine)
+
+	descriptorA := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", Size: 1}
+	descriptorB := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", Size: 2}
+
+	if err := freezer.FreezeReference(ctx, "ref"); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("FreezeReference: expected os.ErrNotExist for missing reference, got %+v", err)
+	}
+	if err := engine.PutReference(ctx, "ref", descriptorA); err != nil {
+		t.Fatalf("PutReference: unexpected error: %+v", err)
+	}
+	if err := freezer.FreezeReference(ctx, "ref"); err != nil {
+		t.Fatalf("FreezeReference: unexpected error: %+v", err)
+	}
+	if err := freezer.FreezeReference(ctx, "ref"); err != nil {
+		t.Errorf("FreezeReference: unexpected error freezing twice: %+v", err)
+	}
+	if frozen, err := freezer.ReferenceFrozen(ctx, "ref"); err != nil || !frozen {
+		t.Errorf("ReferenceFrozen: expected reference to be frozen: frozen=%v err=%+v", frozen, err)
+	}
+
+	// Operations which don't change the reference are still permitted.
+	if err := engine.PutReference(ctx, "ref", descriptorA); err != nil {
+		t.Errorf("PutReference: unexpected error with identical descriptor: %+v", err)
+	}
+	if err := updater.UpdateReference(ctx, "ref", &descriptorB, descriptorA); err != nil {
+		t.Errorf("UpdateReference: unexpected error with identical descriptor: %+v", err)
+	}
+
+	// ... but anything else must fail.
+	if err := engine.PutReference(ctx, "ref", descriptorB); errors.Cause(err) != cas.ErrFrozen {
+		t.Errorf("PutReference: expected ErrFrozen, got %+v", err)
+	}
+	if err := updater.UpdateReference(ctx, "ref", &descriptorA, descriptorB); errors.Cause(err) != cas.ErrFrozen {
+		t.Errorf("UpdateReference: expected ErrFrozen, got %+v", err)
+	}
+	if err := engine.DeleteReference(ctx, "ref"); errors.Cause(err) != cas.ErrFrozen {
+		t.Errorf("DeleteReference: expected ErrFrozen, got %+v", err)
+	}
+	if got, err := engine.GetReference(ctx, "ref"); err != nil {
+		t.Errorf("GetReference: unexpected error: %+v", err)
+	} else if !reflect.DeepEqual(got, descriptorA) {
+		t.Errorf("GetReference: frozen reference was modified: expected=%+v got=%+v", descriptorA, got)
+	}
+
+	// The markers must survive a clean.
+	if err := engine.Clean(ctx); err != nil {
+		t.Fatalf("Clean: unexpected error: %+v", err)
+	}
+	if frozen, err := freezer.ReferenceFrozen(ctx, "ref"); err != nil || !frozen {
+		t.Errorf("ReferenceFrozen: expected reference to be frozen after clean: frozen=%v err=%+v", frozen, err)
+	}
+
+	if err := freezer.UnfreezeReference(ctx, "ref"); err != nil {
+		t.Fatalf("UnfreezeReference: unexpected error: %+v", err)
+	}
+	if err := freezer.UnfreezeReference(ctx, "ref"); err != nil {
+		t.Errorf("UnfreezeReference: unexpected error unfreezing twice: %+v", err)
+	}
+	if frozen, err := freezer.ReferenceFrozen(ctx, "ref"); err != nil || frozen {
+		t.Errorf("ReferenceFrozen: expected reference to not be frozen: frozen=%v err=%+v", frozen, err)
+	}
+	if err := engine.DeleteReference(ctx, "ref"); err != nil {
+		t.Errorf("DeleteReference: unexpected error: %+v", err)
+	}
+}
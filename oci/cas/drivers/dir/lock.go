@@ -0,0 +1,264 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// The locking scheme of an image is as follows. Readers never take any locks,
+// so there can be any number of them. Engines which write to the image hold a
+// shared lock on the writers lock file from their first write until they are
+// closed, and modifications of a reference are serialised by an exclusive
+// lock on a per-reference lock file (so writers of different references
+// don't contend). An engine which needs to exclude all writers (such as a
+// garbage collection, which would otherwise remove the blobs written by a
+// concurrent writer before they are referenced) takes an exclusive lock on
+// the gate lock file and then on the writers lock file. New writers take a
+// shared lock on the gate lock file before taking their lock on the writers
+// lock file, so they queue up behind a waiting garbage collection rather than
+// starving it.
+const (
+	// lockDirectory is the directory inside an OCI image that contains the
+	// lock files.
+	lockDirectory = "locks"
+
+	// gateLockFile is the lock file which queues new writers behind an
+	// engine waiting for an exclusive lock (see LockExclusive).
+	gateLockFile = "gate"
+
+	// writersLockFile is the lock file which is locked (shared) by every
+	// engine which has written to the image.
+	writersLockFile = "writers"
+
+	// refLockDirectory is the directory inside lockDirectory that contains
+	// the per-reference lock files.
+	refLockDirectory = "refs"
+
+	// lockInterval is how often an engine retries taking a lock while another
+	// engine holds it.
+	lockInterval = 10 * time.Millisecond
+)
+
+// lockPath returns the path to the lock file with the given name.
+func (e *dirEngine) lockPath(name ...string) string {
+	return filepath.Join(append([]string{e.path, lockDirectory}, name...)...)
+}
+
+// refLockPath returns the path to the lock file for the given reference.
+func (e *dirEngine) refLockPath(name string) (string, error) {
+	file, err := refFile(name)
+	if err != nil {
+		return "", err
+	}
+	return e.lockPath(refLockDirectory, file), nil
+}
+
+// retryLock calls lock until it doesn't return EWOULDBLOCK, waiting
+// lockInterval between attempts. It gives up once ctx is done.
+func retryLock(ctx context.Context, lock func() error) error {
+	for {
+		err := lock()
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockInterval):
+		}
+	}
+}
+
+// lockFile takes a lock on the lock file at the given path (creating it if
+// necessary), waiting until the lock is available or ctx is done. The
+// returned file holds the lock until it is closed.
+func lockFile(ctx context.Context, path string, exclusive bool) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Wrap(err, "mkdir lock parent")
+	}
+	for {
+		fh, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "open lock file")
+		}
+		if err := retryLock(ctx, func() error { return system.Flock(fh.Fd(), exclusive) }); err != nil {
+			fh.Close()
+			return nil, errors.Wrap(err, "lock")
+		}
+
+		// Clean removes unlocked per-reference lock files, which it could
+		// have done after we opened the file but before we locked it.
+		if ok, err := sameFile(fh, path); err != nil || !ok {
+			fh.Close()
+			if err != nil {
+				return nil, errors.Wrap(err, "check locked file")
+			}
+			continue
+		}
+		return fh, nil
+	}
+}
+
+// lockReference takes an exclusive lock on the given reference, which
+// serialises all modifications of the reference (including those made by
+// other processes). It waits until the lock is available or ctx is
+// cancelled. The returned function releases the lock.
+func (e *dirEngine) lockReference(ctx context.Context, name string) (func(), error) {
+	path, err := e.refLockPath(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute reference lock path")
+	}
+	fh, err := lockFile(ctx, path, true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lock reference %s", name)
+	}
+	return func() { fh.Close() }, nil
+}
+
+// acquireWriters takes a shared lock on the writers lock file, which is held
+// until the engine is closed. It must be called before the engine writes
+// anything to the image which could be removed by a garbage collection. If
+// another engine is waiting for an exclusive lock, this waits until that
+// engine has released it (or ctx is cancelled).
+func (e *dirEngine) acquireWriters(ctx context.Context) error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+	if e.writersFile != nil {
+		return nil
+	}
+	// We already exclude every other writer, and the lock is converted into
+	// a shared one when it is released.
+	if e.exclusiveFile != nil {
+		e.writersFile = e.exclusiveFile
+		return nil
+	}
+
+	gate, err := lockFile(ctx, e.lockPath(gateLockFile), false)
+	if err != nil {
+		return errors.Wrap(err, "lock gate")
+	}
+	defer gate.Close()
+
+	writers, err := lockFile(ctx, e.lockPath(writersLockFile), false)
+	if err != nil {
+		return errors.Wrap(err, "lock writers")
+	}
+	e.writersFile = writers
+	return nil
+}
+
+// LockExclusive waits until no other engine is writing to the image, and
+// then prevents other engines from starting to write to the image until the
+// returned function is called. Readers are not affected. If other engines
+// are still writing after timeout (or immediately, if timeout is zero),
+// cas.ErrBusy is returned. While the engine is waiting, new writers are
+// queued behind it.
+func (e *dirEngine) LockExclusive(ctx context.Context, timeout time.Duration) (func() error, error) {
+	if err := e.checkWritable(); err != nil {
+		return nil, err
+	}
+	if e.exclusiveFile != nil {
+		return nil, errors.Errorf("image is already locked exclusively by this engine")
+	}
+
+	lockCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		lockCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	busy := func(err error) error {
+		if ctx.Err() == nil && errors.Cause(err) == context.DeadlineExceeded {
+			return errors.Wrapf(cas.ErrBusy, "image is being written to by other engines after %s", timeout)
+		}
+		return err
+	}
+	tryLock := func(fh *os.File) error {
+		if timeout <= 0 {
+			return system.Flock(fh.Fd(), true)
+		}
+		return retryLock(lockCtx, func() error { return system.Flock(fh.Fd(), true) })
+	}
+
+	// Unlike the per-reference lock files, the gate and writers lock files
+	// are never removed by Clean.
+	if err := os.MkdirAll(e.lockPath(), 0755); err != nil {
+		return nil, errors.Wrap(err, "mkdir lockdir")
+	}
+	gate, err := os.OpenFile(e.lockPath(gateLockFile), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open gate")
+	}
+	if err := tryLock(gate); err != nil {
+		gate.Close()
+		if err == syscall.EWOULDBLOCK {
+			err = errors.Wrap(cas.ErrBusy, "image is being locked by another engine")
+		}
+		return nil, errors.Wrap(busy(err), "lock gate")
+	}
+
+	// If we are a writer ourselves, our shared lock is converted into an
+	// exclusive one. Note that a failed conversion drops the shared lock,
+	// so it has to be taken again.
+	writers := e.writersFile
+	converted := writers != nil
+	if !converted {
+		writers, err = os.OpenFile(e.lockPath(writersLockFile), os.O_RDONLY|os.O_CREATE, 0644)
+		if err != nil {
+			gate.Close()
+			return nil, errors.Wrap(err, "open writers")
+		}
+	}
+	if err := tryLock(writers); err != nil {
+		if converted {
+			system.Flock(writers.Fd(), false)
+		} else {
+			writers.Close()
+		}
+		gate.Close()
+		if err == syscall.EWOULDBLOCK {
+			err = errors.Wrap(cas.ErrBusy, "image is being written to by other engines")
+		}
+		return nil, errors.Wrap(busy(err), "lock writers")
+	}
+	event.Log(ctx).Debugf("dir: locked %s exclusively", e.path)
+
+	e.exclusiveFile = writers
+	return func() error {
+		e.exclusiveFile = nil
+		defer gate.Close()
+		// If we started writing while holding the lock, we are still a
+		// writer and must keep a shared lock.
+		if e.writersFile == writers {
+			// Converting an exclusive lock to a shared lock cannot block.
+			return errors.Wrap(system.Flock(writers.Fd(), false), "unlock writers")
+		}
+		return errors.Wrap(writers.Close(), "unlock writers")
+	}, nil
+}
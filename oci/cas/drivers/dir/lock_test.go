@@ -0,0 +1,321 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func createLockTestImage(t *testing.T, name string) (string, func()) {
+	root, err := ioutil.TempDir("", "umoci-"+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		os.RemoveAll(root)
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	return image, func() { os.RemoveAll(root) }
+}
+
+// counterDescriptor is a descriptor which encodes a counter in its size. The
+// digest depends on the writer, as UpdateReference succeeds without doing
+// anything if the reference already has the new descriptor (so two writers
+// incrementing to the same value would otherwise both succeed).
+func counterDescriptor(n int64, writer string) ispec.Descriptor {
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    cas.BlobAlgorithm.FromString(fmt.Sprintf("counter %d by %s", n, writer)),
+		Size:      n,
+	}
+}
+
+// increment atomically increments the counter stored in the given reference
+// using UpdateReference.
+func increment(ctx context.Context, engine cas.Engine, name, writer string) error {
+	for {
+		var old *ispec.Descriptor
+		var n int64
+		current, err := engine.GetReference(ctx, name)
+		if err == nil {
+			old, n = &current, current.Size
+		} else if !os.IsNotExist(errors.Cause(err)) {
+			return err
+		}
+		err = engine.(cas.UpdatingEngine).UpdateReference(ctx, name, old, counterDescriptor(n+1, writer))
+		if errors.Cause(err) == cas.ErrClobber || os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+		return err
+	}
+}
+
+func TestEngineConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	image, cleanup := createLockTestImage(t, "TestEngineConcurrentUpdates")
+	defer cleanup()
+
+	const (
+		workers    = 8
+		increments = 25
+	)
+
+	// Readers never take any locks, and must never see a missing or partial
+	// reference once it has been created.
+	stop := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(readErr)
+		engine, err := OpenReadOnly(image)
+		if err != nil {
+			readErr <- err
+			return
+		}
+		defer engine.Close()
+		seen := false
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, err := engine.GetReference(ctx, "shared")
+			if err == nil {
+				seen = true
+			} else if seen || !os.IsNotExist(errors.Cause(err)) {
+				readErr <- errors.Wrap(err, "read shared reference")
+				return
+			}
+		}
+	}()
+
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			engine, err := Open(image)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer engine.Close()
+			writer := fmt.Sprintf("worker-%d", i)
+			for j := 0; j < increments; j++ {
+				// Every worker increments the shared counter and its own
+				// counter, which must not contend with the other workers.
+				if err := increment(ctx, engine, "shared", writer); err != nil {
+					errs <- errors.Wrap(err, "increment shared")
+					return
+				}
+				if err := increment(ctx, engine, writer, writer); err != nil {
+					errs <- errors.Wrap(err, "increment own")
+					return
+				}
+				if _, _, err := engine.PutBlob(ctx, strings.NewReader(fmt.Sprintf("worker %d blob %d", i, j))); err != nil {
+					errs <- errors.Wrap(err, "put blob")
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < workers; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("unexpected error: %+v", err)
+		}
+	}
+	close(stop)
+	if err := <-readErr; err != nil {
+		t.Errorf("unexpected error reading: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	if got, err := engine.GetReference(ctx, "shared"); err != nil || got.Size != workers*increments {
+		t.Errorf("expected shared counter to be %d, got %d: %+v", workers*increments, got.Size, err)
+	}
+	for i := 0; i < workers; i++ {
+		if got, err := engine.GetReference(ctx, fmt.Sprintf("worker-%d", i)); err != nil || got.Size != increments {
+			t.Errorf("expected worker %d counter to be %d, got %d: %+v", i, increments, got.Size, err)
+		}
+	}
+
+	// Clean removes the lock files of the references.
+	if err := engine.Clean(ctx); err != nil {
+		t.Fatalf("unexpected error cleaning: %+v", err)
+	}
+	if names, err := ioutil.ReadDir(filepath.Join(image, lockDirectory, refLockDirectory)); err != nil || len(names) != 0 {
+		t.Errorf("expected reference locks to be cleaned: %v %+v", names, err)
+	}
+}
+
+func TestEngineLockExclusive(t *testing.T) {
+	ctx := context.Background()
+	image, cleanup := createLockTestImage(t, "TestEngineLockExclusive")
+	defer cleanup()
+
+	writer, err := Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _, err := writer.PutBlob(ctx, strings.NewReader("some blob"))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+
+	// An active writer causes LockExclusive to time out.
+	gc, err := Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gc.Close()
+	locker := gc.(cas.ExclusiveEngine)
+	if _, err := locker.LockExclusive(ctx, 50*time.Millisecond); errors.Cause(err) != cas.ErrBusy {
+		t.Errorf("LockExclusive: expected ErrBusy with an active writer: %+v", err)
+	}
+	if _, err := locker.LockExclusive(ctx, 0); errors.Cause(err) != cas.ErrBusy {
+		t.Errorf("LockExclusive: expected ErrBusy without waiting: %+v", err)
+	}
+
+	// ... but once the writer is closed, it succeeds.
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := locker.LockExclusive(ctx, time.Second)
+	if err != nil {
+		t.Fatalf("LockExclusive: unexpected error: %+v", err)
+	}
+
+	// New writers are excluded, but readers are not.
+	other, err := Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	if _, _, err := other.PutBlob(timeoutCtx, strings.NewReader("other blob")); errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("PutBlob: expected writer to be excluded: %+v", err)
+	}
+	cancel()
+	if reader, err := other.GetBlob(ctx, digest); err != nil {
+		t.Errorf("GetBlob: expected reader not to be excluded: %+v", err)
+	} else {
+		reader.Close()
+	}
+
+	// The engine holding the lock can still write.
+	if _, _, err := gc.PutBlob(ctx, strings.NewReader("gc blob")); err != nil {
+		t.Errorf("PutBlob: unexpected error writing with exclusive lock: %+v", err)
+	}
+	if _, err := locker.LockExclusive(ctx, 0); err == nil {
+		t.Errorf("LockExclusive: expected error locking twice")
+	}
+
+	if err := unlock(); err != nil {
+		t.Fatalf("unlock: unexpected error: %+v", err)
+	}
+	if _, _, err := other.PutBlob(ctx, strings.NewReader("other blob")); err != nil {
+		t.Errorf("PutBlob: unexpected error after unlock: %+v", err)
+	}
+
+	// The engine which held the lock is still a writer (it wrote a blob while
+	// holding the lock), so the other engine cannot lock the image.
+	if _, err := other.(cas.ExclusiveEngine).LockExclusive(ctx, 0); errors.Cause(err) != cas.ErrBusy {
+		t.Errorf("LockExclusive: expected ErrBusy with an active writer: %+v", err)
+	}
+}
+
+func TestEngineLockExclusiveFairness(t *testing.T) {
+	ctx := context.Background()
+	image, cleanup := createLockTestImage(t, "TestEngineLockExclusiveFairness")
+	defer cleanup()
+
+	// Short-lived writers which overlap constantly, so that there is never a
+	// moment without an active writer unless new writers are held back.
+	const workers = 8
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				engine, err := Open(image)
+				if err != nil {
+					errs <- err
+					return
+				}
+				_, _, err = engine.PutBlob(ctx, strings.NewReader(fmt.Sprintf("worker %d blob %d", i, j)))
+				time.Sleep(5 * time.Millisecond)
+				engine.Close()
+				if err != nil {
+					errs <- errors.Wrap(err, "put blob")
+					return
+				}
+			}
+		}(i)
+	}
+
+	gc, err := Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gc.Close()
+	for i := 0; i < 5; i++ {
+		unlock, err := gc.(cas.ExclusiveEngine).LockExclusive(ctx, 5*time.Second)
+		if err != nil {
+			t.Errorf("LockExclusive: starved by writers: %+v", err)
+			break
+		}
+		if err := gc.Clean(ctx); err != nil {
+			t.Errorf("Clean: unexpected error: %+v", err)
+		}
+		if err := unlock(); err != nil {
+			t.Errorf("unlock: unexpected error: %+v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
@@ -0,0 +1,336 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// LinkMode specifies how blobs are shared between an image and a blob pool.
+type LinkMode string
+
+const (
+	// LinkHardlink shares blobs using hardlinks.
+	LinkHardlink LinkMode = "hardlink"
+
+	// LinkReflink shares blobs using copy-on-write clones (reflinks), which
+	// is only supported by some filesystems (such as btrfs and XFS). Unlike
+	// hardlinks, each image has its own inode for the blob.
+	LinkReflink LinkMode = "reflink"
+)
+
+// Options specifies optional behaviour of a directory-backed image.
+type Options struct {
+	// BlobPool is the path to a directory of blobs shared between images,
+	// which must be on the same filesystem as the image. If set, blobs in the
+	// pool can be added to the image with LinkBlob, and blobs added to the
+	// image are also added to the pool. Blobs in the pool are trusted to
+	// match their digest, so the pool must only be written to by umoci.
+	BlobPool string
+
+	// LinkMode is how blobs are shared with the BlobPool. The default is
+	// LinkHardlink.
+	LinkMode LinkMode
+
+	// CleanAge is how long an unlocked temporary directory must have been
+	// left unmodified before it is removed by the background clean, which
+	// is started the first time the engine writes to the image. If zero,
+	// DefaultCleanAge is used. If negative, there is no background clean and
+	// stale temporary directories are only removed by Clean.
+	CleanAge time.Duration
+
+	// ReadOnly guarantees that the engine never writes to the image: no
+	// temporary directory is created, no lock requiring write access is
+	// taken and every operation which would modify the image (or the
+	// BlobPool) fails with cas.ErrReadOnly. This allows images on read-only
+	// storage to be inspected.
+	ReadOnly bool
+
+	// NoSync disables flushing blobs, references and the directories
+	// containing them to stable storage when they are written. This makes
+	// writing faster, but a crash (or power loss) can then leave the image
+	// with truncated blobs or missing references. Writes are atomic either
+	// way.
+	NoSync bool
+
+	// TempDir is the directory in which the engine creates its temporary
+	// directory (the image itself if empty). Blobs and references are
+	// written to the temporary directory and then renamed into place, so it
+	// should be on the same filesystem as the blobs and refs directories of
+	// the image (such as when they are bind-mounts) -- otherwise every blob
+	// and reference has to be copied. It must not be inside the blobs or
+	// refs directories of the image.
+	TempDir string
+
+	// CompressBlobs stores blobs which are uncompressed tar archives (such
+	// as uncompressed layers) compressed with zstd on disk, which saves disk
+	// space at the cost of CPU time when reading them. The compressed blob is
+	// stored next to where the blob would be stored, with a ".zst" suffix,
+	// and GetBlob transparently decompresses it (so the blob still matches
+	// its digest). Compressed blobs can be read by every engine.
+	// CompressBlobs cannot be used together with BlobPool. Note that
+	// other tools cannot read the compressed blobs of an image.
+	CompressBlobs bool
+}
+
+// poolPath returns the path to a blob in the given blob pool.
+func poolPath(pool string, digest digest.Digest) (string, error) {
+	if _, err := blobPath(digest); err != nil {
+		return "", err
+	}
+	return filepath.Join(pool, digest.Algorithm().String(), digest.Hex()), nil
+}
+
+// linkFile atomically replaces dst with a link (of the given mode) to src,
+// using a temporary file in tempDir (which must be on the same filesystem as
+// dst).
+func linkFile(src, dst string, mode LinkMode, tempDir string) (err error) {
+	fh, err := ioutil.TempFile(tempDir, "link-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary link")
+	}
+	tempPath := fh.Name()
+	defer fh.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(tempPath)
+		}
+	}()
+
+	switch mode {
+	case LinkHardlink, "":
+		fh.Close()
+		if err := os.Remove(tempPath); err != nil {
+			return errors.Wrap(err, "remove temporary link")
+		}
+		if err := os.Link(src, tempPath); err != nil {
+			return errors.Wrap(err, "hardlink blob")
+		}
+	case LinkReflink:
+		srcFh, err := os.Open(src)
+		if err != nil {
+			return errors.Wrap(err, "open blob")
+		}
+		defer srcFh.Close()
+		if err := system.Clone(fh, srcFh); err != nil {
+			return errors.Wrap(err, "reflink blob")
+		}
+	default:
+		return errors.Errorf("unknown link mode: %s", mode)
+	}
+
+	if err := os.Rename(tempPath, dst); err != nil {
+		return errors.Wrap(err, "rename temporary link")
+	}
+	return nil
+}
+
+// addToPool adds the blob with the given digest (stored at path, and which
+// must match the digest) to the blob pool, if it isn't already in the pool.
+func (e *dirEngine) addToPool(digest digest.Digest, path string) error {
+	if e.options.BlobPool == "" {
+		return nil
+	}
+
+	pooled, err := poolPath(e.options.BlobPool, digest)
+	if err != nil {
+		return errors.Wrap(err, "compute pool path")
+	}
+	if _, err := os.Lstat(pooled); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return errors.Wrap(err, "stat pool blob")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(pooled), 0755); err != nil {
+		return errors.Wrap(err, "mkdir pool")
+	}
+	return errors.Wrap(linkFile(path, pooled, e.options.LinkMode, filepath.Dir(pooled)), "link blob into pool")
+}
+
+// LinkBlob adds the blob with the given digest to the image by linking it
+// from the blob pool, rather than copying it. Returns os.ErrNotExist if the
+// blob is not in the pool, and cas.ErrNotImplemented if there is no pool.
+func (e *dirEngine) LinkBlob(ctx context.Context, digest digest.Digest) (int64, error) {
+	if e.options.BlobPool == "" {
+		return -1, cas.ErrNotImplemented
+	}
+	if err := e.checkWritable(); err != nil {
+		return -1, err
+	}
+
+	path, err := blobPath(digest)
+	if err != nil {
+		return -1, errors.Wrap(err, "compute blob path")
+	}
+	pooled, err := poolPath(e.options.BlobPool, digest)
+	if err != nil {
+		return -1, errors.Wrap(err, "compute pool path")
+	}
+	fi, err := os.Stat(pooled)
+	if err != nil {
+		return -1, errors.Wrap(err, "stat pool blob")
+	}
+
+	if err := e.ensureTempDir(ctx); err != nil {
+		return -1, errors.Wrap(err, "ensure tempdir")
+	}
+	path = filepath.Join(e.path, path)
+	if err := linkFile(pooled, path, e.options.LinkMode, e.temp); err != nil {
+		return -1, errors.Wrap(err, "link blob from pool")
+	}
+	if err := e.syncDir(filepath.Dir(path)); err != nil {
+		return -1, errors.Wrap(err, "sync blobdir")
+	}
+	return fi.Size(), nil
+}
+
+// DedupStats describes the result of Dedup.
+type DedupStats struct {
+	// Blobs is the number of blobs in the image.
+	Blobs int
+
+	// Linked is the number of blobs which were replaced with a link to the
+	// blob pool.
+	Linked int
+
+	// Size is the total size of the blobs which were replaced.
+	Size int64
+}
+
+// Dedup replaces every blob in the directory-backed image at the given path
+// which is also in the blob pool (options.BlobPool) with a link to the blob
+// in the pool, and adds the other blobs to the pool. Blobs which don't match
+// their digest are skipped (and never added to the pool). Deduplicating a set
+// of images against the same pool leaves a single copy of each blob.
+func Dedup(ctx context.Context, path string, options Options) (_ DedupStats, err error) {
+	var stats DedupStats
+	if options.BlobPool == "" {
+		return stats, errors.Errorf("dedup requires a blob pool")
+	}
+	if options.ReadOnly {
+		return stats, cas.ErrReadOnly
+	}
+
+	engine, err := OpenWithOptions(path, options)
+	if err != nil {
+		return stats, errors.Wrap(err, "open image")
+	}
+	defer func() {
+		if closeErr := engine.Close(); closeErr != nil && err == nil {
+			err = errors.Wrap(closeErr, "close image")
+		}
+	}()
+	e := engine.(*dirEngine)
+
+	digests, err := e.ListBlobs(ctx)
+	if err != nil {
+		return stats, errors.Wrap(err, "list blobs")
+	}
+	for _, digest := range digests {
+		stats.Blobs++
+		size, err := e.dedupBlob(ctx, digest)
+		if err != nil {
+			return stats, errors.Wrapf(err, "dedup blob %s", digest)
+		}
+		if size >= 0 {
+			stats.Linked++
+			stats.Size += size
+		}
+	}
+	return stats, nil
+}
+
+// dedupBlob replaces the blob with a link to the blob pool (returning the
+// size of the blob), or adds it to the pool if the pool doesn't have it
+// (returning -1).
+func (e *dirEngine) dedupBlob(ctx context.Context, digest digest.Digest) (int64, error) {
+	path, err := blobPath(digest)
+	if err != nil {
+		return -1, errors.Wrap(err, "compute blob path")
+	}
+	path = filepath.Join(e.path, path)
+	pooled, err := poolPath(e.options.BlobPool, digest)
+	if err != nil {
+		return -1, errors.Wrap(err, "compute pool path")
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return -1, errors.Wrap(err, "stat blob")
+	}
+	pfi, err := os.Stat(pooled)
+	if os.IsNotExist(err) {
+		// Other images will trust the pool, so only verified blobs may be
+		// added to it.
+		if ok, err := verifyBlob(path, digest); err != nil {
+			return -1, errors.Wrap(err, "verify blob")
+		} else if !ok {
+			event.Default().Warnf("dedup: blob %s does not match its digest, skipping", digest)
+			return -1, nil
+		}
+		return -1, e.addToPool(digest, path)
+	} else if err != nil {
+		return -1, errors.Wrap(err, "stat pool blob")
+	}
+
+	if os.SameFile(fi, pfi) {
+		return -1, nil
+	}
+	if fi.Size() != pfi.Size() {
+		event.Default().Warnf("dedup: blob %s has a different size to the pool, skipping", digest)
+		return -1, nil
+	}
+
+	if err := e.ensureTempDir(ctx); err != nil {
+		return -1, errors.Wrap(err, "ensure tempdir")
+	}
+	if err := linkFile(pooled, path, e.options.LinkMode, e.temp); err != nil {
+		return -1, errors.Wrap(err, "link blob from pool")
+	}
+	if err := e.syncDir(filepath.Dir(path)); err != nil {
+		return -1, errors.Wrap(err, "sync blobdir")
+	}
+	return fi.Size(), nil
+}
+
+// verifyBlob returns whether the contents of the file at path match digest.
+func verifyBlob(path string, digest digest.Digest) (bool, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fh.Close()
+
+	verifier := digest.Verifier()
+	if _, err := io.Copy(verifier, fh); err != nil {
+		return false, err
+	}
+	return verifier.Verified(), nil
+}
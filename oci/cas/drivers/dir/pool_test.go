@@ -0,0 +1,207 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// sameBlob returns whether the blob with the given digest is the same file in
+// both the image and the pool.
+func sameBlob(t *testing.T, image, pool string, digest digest.Digest) bool {
+	fi, err := os.Stat(filepath.Join(image, blobDirectory, digest.Algorithm().String(), digest.Hex()))
+	if err != nil {
+		t.Fatalf("stat image blob: %+v", err)
+	}
+	pfi, err := os.Stat(filepath.Join(pool, digest.Algorithm().String(), digest.Hex()))
+	if err != nil {
+		t.Fatalf("stat pool blob: %+v", err)
+	}
+	return os.SameFile(fi, pfi)
+}
+
+func TestEngineBlobPool(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobPool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	pool := filepath.Join(root, "pool")
+	imageA := filepath.Join(root, "imageA")
+	imageB := filepath.Join(root, "imageB")
+	for _, image := range []string{imageA, imageB} {
+		if err := Create(image); err != nil {
+			t.Fatalf("unexpected error creating image: %+v", err)
+		}
+	}
+
+	engineA, err := OpenWithOptions(imageA, Options{BlobPool: pool})
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engineA.Close()
+	engineB, err := OpenWithOptions(imageB, Options{BlobPool: pool})
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engineB.Close()
+
+	blob := []byte("some shared blob")
+	blobDigest, _, err := engineA.PutBlob(ctx, bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	if !sameBlob(t, imageA, pool, blobDigest) {
+		t.Errorf("PutBlob: blob was not added to the pool")
+	}
+
+	// Linking a blob which isn't in the pool must fail.
+	if _, err := engineB.(cas.LinkingEngine).LinkBlob(ctx, digest.FromBytes([]byte("missing"))); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("LinkBlob: expected os.ErrNotExist for missing blob, got %+v", err)
+	}
+
+	size, err := engineB.(cas.LinkingEngine).LinkBlob(ctx, blobDigest)
+	if err != nil {
+		t.Fatalf("LinkBlob: unexpected error: %+v", err)
+	}
+	if size != int64(len(blob)) {
+		t.Errorf("LinkBlob: length doesn't match: expected=%d got=%d", len(blob), size)
+	}
+	if !sameBlob(t, imageB, pool, blobDigest) {
+		t.Errorf("LinkBlob: blob was not linked from the pool")
+	}
+
+	// Without a pool, LinkBlob is not implemented.
+	engineC, err := Open(imageB)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engineC.Close()
+	if _, err := engineC.(cas.LinkingEngine).LinkBlob(ctx, blobDigest); errors.Cause(err) != cas.ErrNotImplemented {
+		t.Errorf("LinkBlob: expected cas.ErrNotImplemented without pool, got %+v", err)
+	}
+
+	if _, err := OpenWithOptions(imageA, Options{BlobPool: pool, LinkMode: "copy"}); err == nil {
+		t.Errorf("OpenWithOptions: expected error with invalid link mode")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestDedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	pool := filepath.Join(root, "pool")
+	imageA := filepath.Join(root, "imageA")
+	imageB := filepath.Join(root, "imageB")
+
+	blobs := [][]byte{[]byte("shared blob"), []byte("another shared blob")}
+	var digests []digest.Digest
+	for _, image := range []string{imageA, imageB} {
+		if err := Create(image); err != nil {
+			t.Fatalf("unexpected error creating image: %+v", err)
+		}
+		engine, err := Open(image)
+		if err != nil {
+			t.Fatalf("unexpected error opening image: %+v", err)
+		}
+		digests = nil
+		for _, blob := range blobs {
+			blobDigest, _, err := engine.PutBlob(ctx, bytes.NewReader(blob))
+			if err != nil {
+				t.Fatalf("PutBlob: unexpected error: %+v", err)
+			}
+			digests = append(digests, blobDigest)
+		}
+		engine.Close()
+	}
+
+	// Corrupt blobs must never be added to the pool.
+	corrupt := digest.FromBytes([]byte("corrupt blob"))
+	if err := ioutil.WriteFile(filepath.Join(imageA, blobDirectory, corrupt.Algorithm().String(), corrupt.Hex()), []byte("not the corrupt blob"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := Dedup(ctx, imageA, Options{BlobPool: pool})
+	if err != nil {
+		t.Fatalf("Dedup: unexpected error: %+v", err)
+	}
+	if stats.Blobs != 3 || stats.Linked != 0 {
+		t.Errorf("Dedup: unexpected stats for first image: %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(pool, corrupt.Algorithm().String(), corrupt.Hex())); !os.IsNotExist(err) {
+		t.Errorf("Dedup: corrupt blob was added to the pool: %+v", err)
+	}
+
+	stats, err = Dedup(ctx, imageB, Options{BlobPool: pool})
+	if err != nil {
+		t.Fatalf("Dedup: unexpected error: %+v", err)
+	}
+	if stats.Blobs != 2 || stats.Linked != 2 || stats.Size != int64(len(blobs[0])+len(blobs[1])) {
+		t.Errorf("Dedup: unexpected stats for second image: %+v", stats)
+	}
+	for _, blobDigest := range digests {
+		if !sameBlob(t, imageA, pool, blobDigest) || !sameBlob(t, imageB, pool, blobDigest) {
+			t.Errorf("Dedup: blob %s was not deduplicated", blobDigest)
+		}
+	}
+
+	// Deduplicating again is a no-op.
+	stats, err = Dedup(ctx, imageB, Options{BlobPool: pool})
+	if err != nil {
+		t.Fatalf("Dedup: unexpected error: %+v", err)
+	}
+	if stats.Linked != 0 {
+		t.Errorf("Dedup: expected no blobs to be linked again: %+v", stats)
+	}
+
+	// The images are still usable.
+	engine, err := Open(imageB)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+	reader, err := engine.GetBlob(ctx, digests[0])
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	gotBytes, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Errorf("GetBlob: failed to ReadAll: %+v", err)
+	}
+	if !bytes.Equal(blobs[0], gotBytes) {
+		t.Errorf("GetBlob: bytes did not match: expected=%s got=%s", string(blobs[0]), string(gotBytes))
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/pkg/errors"
+)
+
+// copyPrefix is the prefix of the temporary files created next to their
+// destination by copyRename. They are ignored by ListBlobs and
+// ListReferences, and removed by Clean if they have been left behind.
+const copyPrefix = ".tmp-"
+
+// isCopyTemp returns whether the given name is that of a temporary file
+// created by copyRename.
+func isCopyTemp(name string) bool {
+	return strings.HasPrefix(name, copyPrefix)
+}
+
+// renameFile atomically moves the file at src to dst, like os.Rename. If src
+// and dst are on different filesystems (such as when part of the image is a
+// bind-mount), rename(2) fails with EXDEV and so copyRename is used instead.
+func renameFile(src, dst string, noSync bool) error {
+	err := os.Rename(src, dst)
+	if linkErr, ok := err.(*os.LinkError); ok && linkErr.Err == syscall.EXDEV {
+		event.Default().Debugf("dir: %s and %s are on different filesystems, copying", src, dst)
+		return copyRename(src, dst, noSync)
+	}
+	return err
+}
+
+// copyRename atomically moves the file at src to dst by copying it to a
+// temporary file next to dst (which is flushed to stable storage unless
+// noSync is set), renaming the copy to dst and then removing src. The copy is
+// locked while it is written, so that a concurrent Clean doesn't remove it.
+func copyRename(src, dst string, noSync bool) (err error) {
+	srcFh, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "open source")
+	}
+	defer srcFh.Close()
+
+	fh, err := ioutil.TempFile(filepath.Dir(dst), copyPrefix+filepath.Base(dst)+"-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary copy")
+	}
+	tempPath := fh.Name()
+	defer fh.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(tempPath)
+		}
+	}()
+	if err := system.Flock(fh.Fd(), true); err != nil {
+		return errors.Wrap(err, "lock temporary copy")
+	}
+	defer system.Unflock(fh.Fd())
+
+	if _, err := io.Copy(fh, srcFh); err != nil {
+		return errors.Wrap(err, "copy to temporary copy")
+	}
+	if fi, err := srcFh.Stat(); err != nil {
+		return errors.Wrap(err, "stat source")
+	} else if err := fh.Chmod(fi.Mode()); err != nil {
+		return errors.Wrap(err, "chmod temporary copy")
+	}
+	if !noSync {
+		if err := fh.Sync(); err != nil {
+			return errors.Wrap(err, "sync temporary copy")
+		}
+	}
+
+	if err := os.Rename(tempPath, dst); err != nil {
+		return errors.Wrap(err, "rename temporary copy")
+	}
+	return errors.Wrap(os.Remove(src), "remove source")
+}
@@ -0,0 +1,180 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestCopyRename(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestCopyRename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst", "file")
+	if err := os.Mkdir(filepath.Dir(dst), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(src, []byte("some contents"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dst, []byte("old contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyRename(src, dst, false); err != nil {
+		t.Fatalf("copyRename: unexpected error: %+v", err)
+	}
+
+	if _, err := os.Lstat(src); !os.IsNotExist(err) {
+		t.Errorf("copyRename: source was not removed: %v", err)
+	}
+	content, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "some contents" {
+		t.Errorf("copyRename: unexpected contents: %q", content)
+	}
+	if fi, err := os.Stat(dst); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("copyRename: unexpected mode: %v", fi.Mode())
+	}
+
+	// No temporary copies may be left behind.
+	names, err := ioutil.ReadDir(filepath.Dir(dst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Errorf("copyRename: left behind temporary copies: %v", names)
+	}
+}
+
+func TestEngineCrossFilesystem(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineCrossFilesystem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Place the temporary directory on a different filesystem, so that every
+	// rename into the image fails with EXDEV.
+	tempDir, err := ioutil.TempDir("/dev/shm", "umoci-TestEngineCrossFilesystem")
+	if err != nil {
+		t.Skipf("cannot create tempdir in /dev/shm: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var rootStat, tempStat syscall.Stat_t
+	if err := syscall.Stat(root, &rootStat); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Stat(tempDir, &tempStat); err != nil {
+		t.Fatal(err)
+	}
+	if rootStat.Dev == tempStat.Dev {
+		t.Skip("/dev/shm is on the same filesystem as the image")
+	}
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := OpenWithOptions(image, Options{TempDir: tempDir})
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	digest, size, err := engine.PutBlob(ctx, bytes.NewBufferString("some blob"))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	descriptor := ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: digest, Size: size}
+	if err := engine.PutReference(ctx, "ref", descriptor); err != nil {
+		t.Fatalf("PutReference: unexpected error: %+v", err)
+	}
+
+	// The temporary directory must not be in the image.
+	names, err := ioutil.ReadDir(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range names {
+		switch fi.Name() {
+		case blobDirectory, refDirectory, layoutFile, lockDirectory:
+		default:
+			t.Errorf("unexpected file in image: %s", fi.Name())
+		}
+	}
+
+	if gotDescriptor, err := engine.GetReference(ctx, "ref"); err != nil {
+		t.Errorf("GetReference: unexpected error: %+v", err)
+	} else if !reflect.DeepEqual(descriptor, gotDescriptor) {
+		t.Errorf("GetReference: got different descriptor: expected=%v got=%v", descriptor, gotDescriptor)
+	}
+	blob, err := engine.GetBlob(ctx, digest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	content, err := ioutil.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "some blob" {
+		t.Errorf("GetBlob: unexpected contents: %q", content)
+	}
+
+	// Left-over temporary copies are neither blobs nor references, and are
+	// removed by Clean.
+	leftover := filepath.Join(image, blobDirectory, digest.Algorithm().String(), copyPrefix+"leftover")
+	if err := ioutil.WriteFile(leftover, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	digests, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	}
+	if len(digests) != 1 || digests[0] != digest {
+		t.Errorf("ListBlobs: unexpected blobs: %v", digests)
+	}
+	if err := engine.Clean(ctx); err != nil {
+		t.Fatalf("Clean: unexpected error: %+v", err)
+	}
+	if _, err := os.Lstat(leftover); !os.IsNotExist(err) {
+		t.Errorf("Clean: temporary copy was not removed: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/ctxio"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// uploadDirectory is the directory inside an OCI image that contains partial
+// blobs written with PutBlobResumable. Unlike the temporary directories, it
+// is not removed by Clean.
+const uploadDirectory = "uploads"
+
+// sessionRegexp matches valid upload session IDs.
+var sessionRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
+// uploadPath returns the path to a partial blob given its session ID,
+// relative to the root of the OCI image.
+func uploadPath(session string) (string, error) {
+	if !sessionRegexp.MatchString(session) {
+		return "", errors.Errorf("invalid upload session: %q", session)
+	}
+	return filepath.Join(uploadDirectory, session), nil
+}
+
+// BlobUploadOffset returns the number of bytes already written to the blob
+// with the given session ID, which is zero if no such session exists.
+func (e *dirEngine) BlobUploadOffset(ctx context.Context, session string) (int64, error) {
+	path, err := uploadPath(session)
+	if err != nil {
+		return -1, errors.Wrap(err, "compute upload path")
+	}
+	fi, err := os.Stat(filepath.Join(e.path, path))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return -1, errors.Wrap(err, "stat partial blob")
+	}
+	return fi.Size(), nil
+}
+
+// PutBlobResumable appends the contents of reader to the blob with the given
+// session ID, and adds the blob to the image once reader is exhausted if its
+// digest matches the expected digest.
+func (e *dirEngine) PutBlobResumable(ctx context.Context, session string, expected digest.Digest, reader io.Reader) (blobDigest digest.Digest, blobSize int64, err error) {
+	ctx, span := event.StartSpan(ctx, "dir.PutBlobResumable")
+	defer func() { span.End(err) }()
+	blob := event.StartBlob(ctx, event.OpPut, expected, -1)
+	defer func() { blob.Done(blobDigest, err) }()
+	span.SetAttribute("session", session)
+
+	// The completed blob is renamed into the image, so a garbage collection
+	// must not run until we are done.
+	if err := e.acquireWriters(ctx); err != nil {
+		return "", -1, errors.Wrap(err, "acquire writers lock")
+	}
+
+	blobPath, err := blobPath(expected)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "compute blob name")
+	}
+	path, err := uploadPath(session)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "compute upload path")
+	}
+	path = filepath.Join(e.path, path)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", -1, errors.Wrap(err, "mkdir uploaddir")
+	}
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "open partial blob")
+	}
+	defer fh.Close()
+
+	// Two writers appending to the same session would corrupt it. The lock
+	// is released when fh is closed.
+	if err := system.Flock(fh.Fd(), true); err != nil {
+		return "", -1, errors.Wrapf(err, "lock partial blob (session %s in use?)", session)
+	}
+
+	// The digest has to cover the data written by previous calls, which also
+	// leaves the offset of fh at the end of the partial blob.
+	digester := cas.BlobAlgorithm.Digester()
+	offset, err := io.Copy(digester.Hash(), fh)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "hash partial blob")
+	}
+	span.SetAttribute("offset", offset)
+
+	progressReader := blob.Reader(ctxio.NewReader(ctx, reader))
+
+	n, err := io.Copy(io.MultiWriter(fh, digester.Hash()), progressReader)
+	if err != nil {
+		// Make sure that what we have written survives until the write is
+		// resumed.
+		fh.Sync()
+		return "", -1, errors.Wrap(err, "copy to partial blob")
+	}
+	size := offset + n
+
+	if digester.Digest() != expected {
+		// The partial blob is useless, so don't let it be resumed.
+		os.Remove(path)
+		return "", -1, &cas.DigestMismatchError{Expected: expected, Actual: digester.Digest()}
+	}
+
+	if err := e.syncFile(fh); err != nil {
+		return "", -1, errors.Wrap(err, "sync partial blob")
+	}
+
+	// Move the blob to its correct path (compressing it first, if it should
+	// be stored compressed).
+	blobPath = filepath.Join(e.path, blobPath)
+	if compress, err := e.shouldCompress(path, blobPath); err != nil {
+		return "", -1, errors.Wrap(err, "check blob compression")
+	} else if compress {
+		if err := e.ensureTempDir(ctx); err != nil {
+			return "", -1, errors.Wrap(err, "ensure tempdir")
+		}
+		path, err = e.compressFile(path)
+		if err != nil {
+			return "", -1, errors.Wrap(err, "compress partial blob")
+		}
+		blobPath += compressedSuffix
+	}
+	if err := renameFile(path, blobPath, e.options.NoSync); err != nil {
+		return "", -1, errors.Wrap(err, "rename partial blob")
+	}
+	if err := e.syncDir(filepath.Dir(blobPath)); err != nil {
+		return "", -1, errors.Wrap(err, "sync blobdir")
+	}
+	if err := e.addToPool(expected, blobPath); err != nil {
+		return "", -1, errors.Wrap(err, "add blob to pool")
+	}
+
+	span.SetAttribute("digest", expected)
+	span.SetAttribute("size", size)
+	return expected, size, nil
+}
+
+// AbortBlobUpload discards the blob with the given session ID. This is
+// idempotent; a nil error means "the session does not exist".
+func (e *dirEngine) AbortBlobUpload(ctx context.Context, session string) error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+	path, err := uploadPath(session)
+	if err != nil {
+		return errors.Wrap(err, "compute upload path")
+	}
+
+	err = os.Remove(filepath.Join(e.path, path))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove partial blob")
+	}
+	return nil
+}
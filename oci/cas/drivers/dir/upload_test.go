@@ -0,0 +1,207 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// failingReader returns the contents of the reader, followed by an error
+// rather than io.EOF.
+type failingReader struct {
+	reader io.Reader
+}
+
+func (r failingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF {
+		err = fmt.Errorf("connection reset")
+	}
+	return n, err
+}
+
+func TestEngineBlobResumable(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobResumable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	resumable, ok := engine.(cas.ResumableEngine)
+	if !ok {
+		t.Fatalf("dir engine is not a cas.ResumableEngine")
+	}
+
+	blob := []byte("some blob which is written in several parts")
+	expectedDigest := digest.FromBytes(blob)
+	session := "session-1"
+
+	if offset, err := resumable.BlobUploadOffset(ctx, session); err != nil {
+		t.Fatalf("BlobUploadOffset: unexpected error: %+v", err)
+	} else if offset != 0 {
+		t.Errorf("BlobUploadOffset: expected offset 0 for new session, got %d", offset)
+	}
+
+	// Interrupt the write part-way through.
+	if _, _, err := resumable.PutBlobResumable(ctx, session, expectedDigest, failingReader{bytes.NewReader(blob[:10])}); err == nil {
+		t.Errorf("PutBlobResumable: expected error with failing reader")
+	}
+	if _, _, err := resumable.PutBlobResumable(ctx, session, expectedDigest, failingReader{bytes.NewReader(blob[10:20])}); err == nil {
+		t.Errorf("PutBlobResumable: expected error with failing reader")
+	}
+	if br, err := engine.GetBlob(ctx, expectedDigest); err == nil {
+		br.Close()
+		t.Errorf("GetBlob: got blob contents for interrupted write")
+	}
+
+	// Partial blobs must survive a GC.
+	if err := engine.Clean(ctx); err != nil {
+		t.Fatalf("Clean: unexpected error: %+v", err)
+	}
+
+	offset, err := resumable.BlobUploadOffset(ctx, session)
+	if err != nil {
+		t.Fatalf("BlobUploadOffset: unexpected error: %+v", err)
+	}
+	if offset != 20 {
+		t.Fatalf("BlobUploadOffset: expected offset 20, got %d", offset)
+	}
+
+	gotDigest, size, err := resumable.PutBlobResumable(ctx, session, expectedDigest, bytes.NewReader(blob[offset:]))
+	if err != nil {
+		t.Fatalf("PutBlobResumable: unexpected error: %+v", err)
+	}
+	if gotDigest != expectedDigest {
+		t.Errorf("PutBlobResumable: digest doesn't match: expected=%s got=%s", expectedDigest, gotDigest)
+	}
+	if size != int64(len(blob)) {
+		t.Errorf("PutBlobResumable: length doesn't match: expected=%d got=%d", len(blob), size)
+	}
+
+	blobReader, err := engine.GetBlob(ctx, expectedDigest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	gotBytes, err := ioutil.ReadAll(blobReader)
+	blobReader.Close()
+	if err != nil {
+		t.Errorf("GetBlob: failed to ReadAll: %+v", err)
+	}
+	if !bytes.Equal(blob, gotBytes) {
+		t.Errorf("GetBlob: bytes did not match: expected=%s got=%s", string(blob), string(gotBytes))
+	}
+
+	// The session is gone once the blob has been added.
+	if offset, err := resumable.BlobUploadOffset(ctx, session); err != nil {
+		t.Errorf("BlobUploadOffset: unexpected error: %+v", err)
+	} else if offset != 0 {
+		t.Errorf("BlobUploadOffset: expected offset 0 for finished session, got %d", offset)
+	}
+}
+
+func TestEngineBlobResumableMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobResumableMismatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+	resumable := engine.(cas.ResumableEngine)
+
+	blob := []byte("some blob")
+	session := "session-2"
+
+	// A blob with the wrong digest is discarded.
+	if _, _, err := resumable.PutBlobResumable(ctx, session, digest.FromBytes([]byte("another blob")), bytes.NewReader(blob)); !errors.Is(err, cas.ErrDigestMismatch) {
+		t.Errorf("PutBlobResumable: expected ErrDigestMismatch with mismatched digest, got %+v", err)
+	} else if mismatchErr := (*cas.DigestMismatchError)(nil); !errors.As(err, &mismatchErr) || mismatchErr.Actual != digest.FromBytes(blob) {
+		t.Errorf("PutBlobResumable: expected *cas.DigestMismatchError with actual digest %s, got %+v", digest.FromBytes(blob), err)
+	}
+	if offset, err := resumable.BlobUploadOffset(ctx, session); err != nil {
+		t.Errorf("BlobUploadOffset: unexpected error: %+v", err)
+	} else if offset != 0 {
+		t.Errorf("BlobUploadOffset: expected mismatched session to be discarded, got offset %d", offset)
+	}
+	if blobs, err := engine.ListBlobs(ctx); err != nil {
+		t.Errorf("unexpected error getting list of blobs: %+v", err)
+	} else if len(blobs) > 0 {
+		t.Errorf("got blobs after mismatched write: %v", blobs)
+	}
+
+	// Aborted sessions start from scratch.
+	if _, _, err := resumable.PutBlobResumable(ctx, session, digest.FromBytes(blob), failingReader{bytes.NewReader(blob)}); err == nil {
+		t.Errorf("PutBlobResumable: expected error with failing reader")
+	}
+	if err := resumable.AbortBlobUpload(ctx, session); err != nil {
+		t.Errorf("AbortBlobUpload: unexpected error: %+v", err)
+	}
+	if err := resumable.AbortBlobUpload(ctx, session); err != nil {
+		t.Errorf("AbortBlobUpload: unexpected error on double-abort: %+v", err)
+	}
+	if offset, err := resumable.BlobUploadOffset(ctx, session); err != nil {
+		t.Errorf("BlobUploadOffset: unexpected error: %+v", err)
+	} else if offset != 0 {
+		t.Errorf("BlobUploadOffset: expected aborted session to be discarded, got offset %d", offset)
+	}
+
+	// Session IDs must not escape the upload directory.
+	for _, session := range []string{"", ".", "..", "../blobs", "a/b", "-a"} {
+		if _, err := resumable.BlobUploadOffset(ctx, session); err == nil {
+			t.Errorf("BlobUploadOffset: expected error with invalid session %q", session)
+		}
+		if _, _, err := resumable.PutBlobResumable(ctx, session, digest.FromBytes(blob), bytes.NewReader(blob)); err == nil {
+			t.Errorf("PutBlobResumable: expected error with invalid session %q", session)
+		}
+	}
+}
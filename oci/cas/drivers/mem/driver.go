@@ -0,0 +1,88 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mem
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/pkg/errors"
+)
+
+// URIPrefix is the prefix of all URIs handled by the in-memory driver. The
+// rest of the URI is the name of the in-memory image, which is shared by all
+// users of the driver within the same process.
+const URIPrefix = "mem://"
+
+// Driver is an implementation of drivers.Driver for in-memory OCI images.
+var Driver cas.Driver = memDriver{}
+
+var (
+	im     sync.Mutex
+	images = map[string]*store{}
+)
+
+type memDriver struct{}
+
+// Supported returns whether the resource at the given URI is supported by the
+// driver (used for auto-detection). Only URIs starting with URIPrefix are
+// supported.
+func (d memDriver) Supported(uri string) bool {
+	return strings.HasPrefix(uri, URIPrefix)
+}
+
+// Open "opens" a new CAS engine accessor for the given URI. The image must
+// have been created with Create.
+func (d memDriver) Open(uri string) (cas.Engine, error) {
+	im.Lock()
+	defer im.Unlock()
+
+	store, ok := images[uri]
+	if !ok {
+		return nil, errors.Wrap(os.ErrNotExist, "open in-memory image")
+	}
+	return &memEngine{store: store}, nil
+}
+
+// Create creates a new image at the provided URI. If an image already exists
+// with the given URI, os.ErrExist is returned.
+func (d memDriver) Create(uri string) error {
+	im.Lock()
+	defer im.Unlock()
+
+	if _, ok := images[uri]; ok {
+		return errors.Wrap(os.ErrExist, "create in-memory image")
+	}
+	images[uri] = newStore()
+	return nil
+}
+
+// Remove frees the in-memory image with the given URI. Engines which are
+// still open will continue to work, but subsequent calls to Open will fail.
+func Remove(uri string) {
+	im.Lock()
+	defer im.Unlock()
+
+	delete(images, uri)
+}
+
+func init() {
+	cas.Register(Driver)
+}
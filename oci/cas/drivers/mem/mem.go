@@ -0,0 +1,293 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package mem implements a cas.Engine which stores all of its blobs and
+// references in memory. It is intended for testing and for building ephemeral
+// images, where touching the disk is either unnecessary or undesirable.
+package mem
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/ctxio"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// store is the backing storage of an in-memory image. It is shared between
+// all engines that have been opened for the same image, and is safe for
+// concurrent use.
+type store struct {
+	lock     sync.RWMutex
+	blobs    map[digest.Digest][]byte
+	modTimes map[digest.Digest]time.Time
+	refs     map[string]ispec.Descriptor
+}
+
+func newStore() *store {
+	return &store{
+		blobs:    map[digest.Digest][]byte{},
+		modTimes: map[digest.Digest]time.Time{},
+		refs:     map[string]ispec.Descriptor{},
+	}
+}
+
+type memEngine struct {
+	store *store
+}
+
+// PutBlob adds a new blob to the image. This is idempotent; a nil error
+// means that "the content is stored at DIGEST" without implying "because
+// of this PutBlob() call".
+func (e *memEngine) PutBlob(ctx context.Context, reader io.Reader) (blobDigest digest.Digest, blobSize int64, err error) {
+	blob := event.StartBlob(ctx, event.OpPut, "", -1)
+	defer func() { blob.Done(blobDigest, err) }()
+
+	digester := cas.BlobAlgorithm.Digester()
+
+	// We have to read the entire blob before we can store it, because we need
+	// to know the digest before we insert it into the store.
+	progressReader := blob.Reader(ctxio.NewReader(ctx, reader))
+
+	var buffer bytes.Buffer
+	size, err := io.Copy(io.MultiWriter(&buffer, digester.Hash()), progressReader)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "copy to blob buffer")
+	}
+	blobDigest = digester.Digest()
+
+	e.store.lock.Lock()
+	defer e.store.lock.Unlock()
+
+	e.store.blobs[blobDigest] = buffer.Bytes()
+	e.store.modTimes[blobDigest] = time.Now()
+	return blobDigest, size, nil
+}
+
+// PutBlobJSON adds a new JSON blob to the image (marshalled from the given
+// interface). This is equivalent to calling PutBlob() with a JSON payload
+// as the reader.
+func (e *memEngine) PutBlobJSON(ctx context.Context, data interface{}) (digest.Digest, int64, error) {
+	var buffer bytes.Buffer
+	if err := json.NewEncoder(&buffer).Encode(data); err != nil {
+		return "", -1, errors.Wrap(err, "encode JSON")
+	}
+	return e.PutBlob(ctx, &buffer)
+}
+
+// PutReference adds a new reference descriptor to the image. This is
+// idempotent; a nil error means that "the descriptor is stored at NAME"
+// without implying "because of this PutReference() call". ErrClobber is
+// returned if there is already a descriptor stored at NAME, but does not
+// match the descriptor requested to be stored.
+func (e *memEngine) PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	e.store.lock.Lock()
+	defer e.store.lock.Unlock()
+
+	if oldDescriptor, ok := e.store.refs[name]; ok {
+		// We should not return an error if the two descriptors are identical.
+		if !reflect.DeepEqual(oldDescriptor, descriptor) {
+			return &cas.ClobberError{
+				Name: name,
+				Old:  oldDescriptor,
+				New:  descriptor,
+			}
+		}
+		return nil
+	}
+
+	e.store.refs[name] = descriptor
+	event.Emit(ctx, event.Event{Type: event.RefUpdated, Reference: name, Descriptor: &descriptor})
+	return nil
+}
+
+// UpdateReference replaces the descriptor stored at NAME with newDescriptor,
+// but only if the descriptor currently stored at NAME is oldDescriptor (if
+// oldDescriptor is nil, NAME must not exist). A *cas.ClobberError is returned
+// if NAME doesn't match oldDescriptor.
+func (e *memEngine) UpdateReference(ctx context.Context, name string, oldDescriptor *ispec.Descriptor, newDescriptor ispec.Descriptor) error {
+	e.store.lock.Lock()
+	defer e.store.lock.Unlock()
+
+	current, exists := e.store.refs[name]
+	if exists && reflect.DeepEqual(current, newDescriptor) {
+		return nil
+	}
+	if oldDescriptor != nil && !exists {
+		return errors.Wrap(os.ErrNotExist, "get old reference")
+	}
+	if exists && (oldDescriptor == nil || !reflect.DeepEqual(current, *oldDescriptor)) {
+		return &cas.ClobberError{
+			Name: name,
+			Old:  current,
+			New:  newDescriptor,
+		}
+	}
+
+	e.store.refs[name] = newDescriptor
+	event.Emit(ctx, event.Event{Type: event.RefUpdated, Reference: name, Descriptor: &newDescriptor})
+	return nil
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). Returns os.ErrNotExist if the digest is not found.
+func (e *memEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	e.store.lock.RLock()
+	defer e.store.lock.RUnlock()
+
+	data, ok := e.store.blobs[digest]
+	if !ok {
+		return nil, errors.Wrap(os.ErrNotExist, "get blob")
+	}
+	// The slice is never modified after it is inserted, so we don't need to
+	// make a copy here.
+	return event.NewBlobReader(ctx, digest, int64(len(data)), ioutil.NopCloser(ctxio.NewReader(ctx, bytes.NewReader(data)))), nil
+}
+
+// blobReaderAt is a cas.BlobReaderAt for an in-memory blob.
+type blobReaderAt struct {
+	*bytes.Reader
+}
+
+// Close is a no-op.
+func (blobReaderAt) Close() error { return nil }
+
+// GetBlobAt opens a blob for random access, returning a reader (which the
+// caller must Close()) and its size. Returns os.ErrNotExist if the digest is
+// not found.
+func (e *memEngine) GetBlobAt(ctx context.Context, digest digest.Digest) (cas.BlobReaderAt, int64, error) {
+	e.store.lock.RLock()
+	defer e.store.lock.RUnlock()
+
+	data, ok := e.store.blobs[digest]
+	if !ok {
+		return nil, -1, errors.Wrap(os.ErrNotExist, "get blob")
+	}
+	return blobReaderAt{bytes.NewReader(data)}, int64(len(data)), nil
+}
+
+// StatBlob returns the size of a blob and the time it was last added to the
+// image. Returns os.ErrNotExist if the digest is not found.
+func (e *memEngine) StatBlob(ctx context.Context, digest digest.Digest) (cas.BlobInfo, error) {
+	e.store.lock.RLock()
+	defer e.store.lock.RUnlock()
+
+	data, ok := e.store.blobs[digest]
+	if !ok {
+		return cas.BlobInfo{}, errors.Wrap(os.ErrNotExist, "stat blob")
+	}
+	return cas.BlobInfo{
+		Size:    int64(len(data)),
+		ModTime: e.store.modTimes[digest],
+	}, nil
+}
+
+// GetReference returns a reference from the image. Returns os.ErrNotExist
+// if the name was not found.
+func (e *memEngine) GetReference(ctx context.Context, name string) (ispec.Descriptor, error) {
+	e.store.lock.RLock()
+	defer e.store.lock.RUnlock()
+
+	descriptor, ok := e.store.refs[name]
+	if !ok {
+		return ispec.Descriptor{}, errors.Wrap(os.ErrNotExist, "get reference")
+	}
+	return descriptor, nil
+}
+
+// DeleteBlob removes a blob from the image. This is idempotent; a nil
+// error means "the content is not in the store" without implying "because
+// of this DeleteBlob() call".
+func (e *memEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	e.store.lock.Lock()
+	defer e.store.lock.Unlock()
+
+	delete(e.store.blobs, digest)
+	delete(e.store.modTimes, digest)
+	return nil
+}
+
+// DeleteReference removes a reference from the image. This is idempotent;
+// a nil error means "the content is not in the store" without implying
+// "because of this DeleteReference() call".
+func (e *memEngine) DeleteReference(ctx context.Context, name string) error {
+	e.store.lock.Lock()
+	defer e.store.lock.Unlock()
+
+	delete(e.store.refs, name)
+	event.Emit(ctx, event.Event{Type: event.RefUpdated, Reference: name})
+	return nil
+}
+
+// ListBlobs returns the set of blob digests stored in the image.
+func (e *memEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	e.store.lock.RLock()
+	defer e.store.lock.RUnlock()
+
+	digests := []digest.Digest{}
+	for digest := range e.store.blobs {
+		digests = append(digests, digest)
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i] < digests[j] })
+	return digests, nil
+}
+
+// ListReferences returns the set of reference names stored in the image.
+func (e *memEngine) ListReferences(ctx context.Context) ([]string, error) {
+	e.store.lock.RLock()
+	defer e.store.lock.RUnlock()
+
+	refs := []string{}
+	for name := range e.store.refs {
+		refs = append(refs, name)
+	}
+	sort.Strings(refs)
+	return refs, nil
+}
+
+// Clean executes a garbage collection of any non-blob garbage in the store.
+// An in-memory image never has any such garbage (there are no temporary
+// files), so this is a no-op.
+func (e *memEngine) Clean(ctx context.Context) error {
+	return nil
+}
+
+// Close releases all references held by the engine. The underlying image is
+// not freed, as other engines may still be using it.
+func (e *memEngine) Close() error {
+	return nil
+}
+
+// New creates a new anonymous in-memory image, and returns an engine for it.
+// The image is freed once all references to the returned engine are dropped.
+func New() cas.Engine {
+	return &memEngine{
+		store: newStore(),
+	}
+}
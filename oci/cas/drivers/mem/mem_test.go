@@ -0,0 +1,300 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/event"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestEngineBlob(t *testing.T) {
+	ctx := context.Background()
+
+	engine := New()
+	defer engine.Close()
+
+	for _, data := range [][]byte{
+		[]byte(""),
+		[]byte("some blob"),
+		[]byte("another blob"),
+	} {
+		digest, size, err := engine.PutBlob(ctx, bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("PutBlob: unexpected error: %+v", err)
+		}
+		if size != int64(len(data)) {
+			t.Errorf("PutBlob: length doesn't match: expected=%d got=%d", len(data), size)
+		}
+
+		blobReader, err := engine.GetBlob(ctx, digest)
+		if err != nil {
+			t.Fatalf("GetBlob: unexpected error: %+v", err)
+		}
+		gotBytes, err := ioutil.ReadAll(blobReader)
+		blobReader.Close()
+		if err != nil {
+			t.Errorf("GetBlob: failed to ReadAll: %+v", err)
+		}
+		if !bytes.Equal(data, gotBytes) {
+			t.Errorf("GetBlob: bytes did not match: expected=%s got=%s", string(data), string(gotBytes))
+		}
+
+		info, err := engine.(cas.StatingEngine).StatBlob(ctx, digest)
+		if err != nil {
+			t.Errorf("StatBlob: unexpected error: %+v", err)
+		}
+		if info.Size != int64(len(data)) || info.ModTime.IsZero() {
+			t.Errorf("StatBlob: unexpected info: %+v", info)
+		}
+
+		blobAt, blobSize, err := engine.(cas.RandomAccessEngine).GetBlobAt(ctx, digest)
+		if err != nil {
+			t.Fatalf("GetBlobAt: unexpected error: %+v", err)
+		}
+		gotBytes, err = ioutil.ReadAll(io.NewSectionReader(blobAt, 0, blobSize))
+		if err != nil {
+			t.Errorf("GetBlobAt: failed to ReadAll: %+v", err)
+		}
+		blobAt.Close()
+		if !bytes.Equal(data, gotBytes) {
+			t.Errorf("GetBlobAt: bytes did not match: expected=%s got=%s", string(data), string(gotBytes))
+		}
+
+		if err := engine.DeleteBlob(ctx, digest); err != nil {
+			t.Errorf("DeleteBlob: unexpected error: %+v", err)
+		}
+		if _, err := engine.GetBlob(ctx, digest); !os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("GetBlob: expected ErrNotExist after DeleteBlob: %+v", err)
+		} else if !errors.Is(err, cas.ErrNotExist) {
+			t.Errorf("GetBlob: expected errors.Is(err, cas.ErrNotExist) after DeleteBlob: %+v", err)
+		}
+		if _, err := engine.(cas.StatingEngine).StatBlob(ctx, digest); !os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("StatBlob: expected ErrNotExist after DeleteBlob: %+v", err)
+		}
+		if _, _, err := engine.(cas.RandomAccessEngine).GetBlobAt(ctx, digest); !os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("GetBlobAt: expected ErrNotExist after DeleteBlob: %+v", err)
+		}
+		if err := engine.DeleteBlob(ctx, digest); err != nil {
+			t.Errorf("DeleteBlob: unexpected error on double-delete: %+v", err)
+		}
+	}
+
+	if blobs, err := engine.ListBlobs(ctx); err != nil {
+		t.Errorf("unexpected error getting list of blobs: %+v", err)
+	} else if len(blobs) > 0 {
+		t.Errorf("got blobs in a clean image: %v", blobs)
+	}
+}
+
+func TestEngineReference(t *testing.T) {
+	ctx := context.Background()
+
+	engine := New()
+	defer engine.Close()
+
+	descriptor := ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: "sha256:032581de4629652b8653e4dbb2762d0733028003f1fc8f9edd61ae8181393a15", Size: 100}
+	if err := engine.PutReference(ctx, "ref", descriptor); err != nil {
+		t.Errorf("PutReference: unexpected error: %+v", err)
+	}
+	// Idempotent.
+	if err := engine.PutReference(ctx, "ref", descriptor); err != nil {
+		t.Errorf("PutReference: unexpected error on identical put: %+v", err)
+	}
+	// Clobber.
+	if err := engine.PutReference(ctx, "ref", ispec.Descriptor{}); errors.Cause(err) != cas.ErrClobber {
+		t.Errorf("PutReference: expected ErrClobber: %+v", err)
+	} else if clobberErr := (*cas.ClobberError)(nil); !errors.As(err, &clobberErr) || clobberErr.Name != "ref" {
+		t.Errorf("PutReference: expected *cas.ClobberError for ref: %+v", err)
+	} else if !errors.Is(err, cas.ErrClobber) {
+		t.Errorf("PutReference: expected errors.Is(err, cas.ErrClobber): %+v", err)
+	}
+
+	gotDescriptor, err := engine.GetReference(ctx, "ref")
+	if err != nil {
+		t.Errorf("GetReference: unexpected error: %+v", err)
+	}
+	if !reflect.DeepEqual(descriptor, gotDescriptor) {
+		t.Errorf("GetReference: got different descriptor to original: expected=%v got=%v", descriptor, gotDescriptor)
+	}
+
+	if err := engine.DeleteReference(ctx, "ref"); err != nil {
+		t.Errorf("DeleteReference: unexpected error: %+v", err)
+	}
+	if _, err := engine.GetReference(ctx, "ref"); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("GetReference: expected ErrNotExist after DeleteReference: %+v", err)
+	}
+}
+
+func TestDriverShared(t *testing.T) {
+	ctx := context.Background()
+	uri := URIPrefix + "TestDriverShared"
+
+	if err := cas.Create(uri); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	defer Remove(uri)
+
+	if err := cas.Create(uri); !os.IsExist(errors.Cause(err)) {
+		t.Errorf("expected ErrExist creating duplicate image: %+v", err)
+	}
+
+	engine1, err := cas.Open(uri)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine1.Close()
+	engine2, err := cas.Open(uri)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine2.Close()
+
+	digest, _, err := engine1.PutBlob(ctx, bytes.NewBufferString("shared"))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	if blobs, err := engine2.ListBlobs(ctx); err != nil {
+		t.Errorf("unexpected error getting list of blobs: %+v", err)
+	} else if len(blobs) != 1 || blobs[0] != digest {
+		t.Errorf("blob not visible through second engine: %v", blobs)
+	}
+}
+
+func TestEngineConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	engine := New()
+	defer engine.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("ref%d", i)
+			digest, size, err := engine.PutBlob(ctx, bytes.NewBufferString(name))
+			if err != nil {
+				t.Errorf("PutBlob: unexpected error: %+v", err)
+				return
+			}
+			if err := engine.PutReference(ctx, name, ispec.Descriptor{Digest: digest, Size: size}); err != nil {
+				t.Errorf("PutReference: unexpected error: %+v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if refs, err := engine.ListReferences(ctx); err != nil {
+		t.Errorf("unexpected error getting list of references: %+v", err)
+	} else if len(refs) != 16 {
+		t.Errorf("expected 16 references, got %d: %v", len(refs), refs)
+	}
+}
+
+func TestEngineUpdateReference(t *testing.T) {
+	ctx := context.Background()
+
+	engine := New()
+	defer engine.Close()
+	updater := engine.(cas.UpdatingEngine)
+
+	descriptorA := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", Size: 1}
+	descriptorB := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", Size: 2}
+
+	if err := updater.UpdateReference(ctx, "ref", &descriptorA, descriptorB); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("UpdateReference: expected os.ErrNotExist for missing reference, got %+v", err)
+	}
+	if err := updater.UpdateReference(ctx, "ref", nil, descriptorA); err != nil {
+		t.Fatalf("UpdateReference: unexpected error creating reference: %+v", err)
+	}
+	if err := updater.UpdateReference(ctx, "ref", &descriptorB, ispec.Descriptor{}); errors.Cause(err) != cas.ErrClobber {
+		t.Errorf("UpdateReference: expected ErrClobber with stale old descriptor, got %+v", err)
+	}
+	if err := updater.UpdateReference(ctx, "ref", &descriptorA, descriptorB); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if got, err := engine.GetReference(ctx, "ref"); err != nil {
+		t.Errorf("GetReference: unexpected error: %+v", err)
+	} else if !reflect.DeepEqual(got, descriptorB) {
+		t.Errorf("GetReference: reference was not updated: expected=%+v got=%+v", descriptorB, got)
+	}
+}
+
+func TestEngineEvents(t *testing.T) {
+	var events []event.Event
+	ctx := event.WithHook(context.Background(), func(ev event.Event) {
+		events = append(events, ev)
+	})
+	// The progress events are tested in pkg/event.
+	ctx = event.WithoutProgress(ctx)
+
+	engine := New()
+	defer engine.Close()
+
+	data := []byte("some blob")
+	digest, size, err := engine.PutBlob(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	blobReader, err := engine.GetBlob(ctx, digest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	ioutil.ReadAll(blobReader)
+	blobReader.Close()
+
+	descriptor := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: digest, Size: size}
+	if err := engine.PutReference(ctx, "ref", descriptor); err != nil {
+		t.Fatalf("PutReference: unexpected error: %+v", err)
+	}
+	// Putting an identical reference doesn't change anything.
+	if err := engine.PutReference(ctx, "ref", descriptor); err != nil {
+		t.Fatalf("PutReference: unexpected error: %+v", err)
+	}
+	if err := engine.DeleteReference(ctx, "ref"); err != nil {
+		t.Fatalf("DeleteReference: unexpected error: %+v", err)
+	}
+
+	expected := []event.Event{
+		{Type: event.BlobStart, Op: event.OpPut},
+		{Type: event.BlobDone, Op: event.OpPut, Digest: digest, Size: size},
+		{Type: event.BlobStart, Op: event.OpGet, Digest: digest},
+		{Type: event.BlobDone, Op: event.OpGet, Digest: digest, Size: size},
+		{Type: event.RefUpdated, Reference: "ref", Descriptor: &descriptor},
+		{Type: event.RefUpdated, Reference: "ref"},
+	}
+	for idx := range events {
+		events[idx].Time = time.Time{}
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("unexpected events: expected=%+v got=%+v", expected, events)
+	}
+}
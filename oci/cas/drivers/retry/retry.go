@@ -0,0 +1,550 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package retry implements a cas.Engine which wraps another engine, and
+// retries operations which fail with a transient error (such as ESTALE from
+// an NFS server, or EINTR). This allows long-running operations on network
+// storage to survive momentary failures, at the cost of delaying the
+// reporting of persistent errors.
+//
+// Unlike the other packages in drivers, this package does not register a
+// cas.Driver because it only makes sense to wrap an existing engine.
+package retry
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultAttempts is the default maximum number of attempts made for
+	// each operation.
+	DefaultAttempts = 5
+
+	// DefaultDelay is the default delay before the first retry.
+	DefaultDelay = 100 * time.Millisecond
+
+	// DefaultMaxDelay is the default maximum delay between two attempts.
+	DefaultMaxDelay = 5 * time.Second
+)
+
+// Options specifies how operations should be retried.
+type Options struct {
+	// Attempts is the maximum number of attempts made for each operation
+	// (including the first). If zero, DefaultAttempts is used.
+	Attempts int
+
+	// Delay is the delay before the first retry, which is doubled for every
+	// subsequent retry (up to MaxDelay). The actual delay is chosen at random
+	// from [delay/2, delay), so that several processes which failed at the
+	// same time don't retry in lockstep. If zero, DefaultDelay and
+	// DefaultMaxDelay are used.
+	Delay    time.Duration
+	MaxDelay time.Duration
+
+	// Transient returns whether an error is transient, and thus whether the
+	// operation should be retried. If nil, IsTransient is used.
+	Transient func(err error) bool
+}
+
+// Error is returned by a retrying engine when an operation failed with a
+// transient error on every attempt. The underlying error can be retrieved
+// with errors.Cause.
+type Error struct {
+	// Op is a description of the operation which failed.
+	Op string
+
+	// Attempts is the number of attempts that were made.
+	Attempts int
+
+	// Err is the error returned by the last attempt.
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: giving up after %d attempts: %v", e.Op, e.Attempts, e.Err)
+}
+
+// Cause returns the error returned by the last attempt.
+func (e *Error) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns the error returned by the last attempt, so that errors.Is
+// and errors.As work on Error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient returns whether the given error is one of the errors that can
+// be caused by a momentary failure of the underlying storage: EINTR, EAGAIN,
+// ESTALE (usually returned by NFS after a server failover) or EIO. Note that
+// EIO can also indicate a permanent failure, in which case retrying will only
+// delay the error being reported.
+func IsTransient(err error) bool {
+	err = errors.Cause(err)
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	switch err {
+	case syscall.EINTR, syscall.EAGAIN, syscall.ESTALE, syscall.EIO:
+		return true
+	}
+	return false
+}
+
+type retryEngine struct {
+	engine  cas.Engine
+	options Options
+}
+
+// New returns a new cas.Engine that passes every operation through to the
+// given engine, retrying any operation that fails with a transient error
+// (with an exponential backoff between attempts). Blobs can only be retried
+// by PutBlob if the reader is also an io.Seeker, and reads from a blob
+// returned by GetBlob are retried by re-opening the blob. The returned engine
+// takes ownership of engine, and will close it when it is closed.
+func New(engine cas.Engine, opt *Options) cas.Engine {
+	var options Options
+	if opt != nil {
+		options = *opt
+	}
+	if options.Attempts <= 0 {
+		options.Attempts = DefaultAttempts
+	}
+	if options.Delay <= 0 {
+		options.Delay = DefaultDelay
+	}
+	if options.MaxDelay <= 0 {
+		options.MaxDelay = DefaultMaxDelay
+	}
+	if options.MaxDelay < options.Delay {
+		options.MaxDelay = options.Delay
+	}
+	if options.Transient == nil {
+		options.Transient = IsTransient
+	}
+	return &retryEngine{
+		engine:  engine,
+		options: options,
+	}
+}
+
+// jitter returns a random duration in [delay/2, delay).
+func jitter(delay time.Duration) time.Duration {
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+// do runs fn until it succeeds, fails with a non-transient error or the
+// maximum number of attempts has been made (in which case an *Error is
+// returned).
+func (e *retryEngine) do(ctx context.Context, op string, fn func() error) error {
+	delay := e.options.Delay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !e.options.Transient(err) {
+			return err
+		}
+		if attempt >= e.options.Attempts {
+			return &Error{
+				Op:       op,
+				Attempts: attempt,
+				Err:      err,
+			}
+		}
+
+		wait := jitter(delay)
+		event.Log(ctx).WithFields(event.Fields{
+			"attempt": attempt,
+			"delay":   wait,
+			"error":   err,
+		}).Debugf("retry: %s failed, retrying", op)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "%s: waiting to retry", op)
+		}
+
+		delay *= 2
+		if delay > e.options.MaxDelay {
+			delay = e.options.MaxDelay
+		}
+	}
+}
+
+// PutBlob adds a new blob to the image. The operation is only retried if
+// reader is an io.Seeker (so that it can be rewound).
+func (e *retryEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	seeker, ok := reader.(io.Seeker)
+	if !ok {
+		return e.engine.PutBlob(ctx, reader)
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return e.engine.PutBlob(ctx, reader)
+	}
+
+	var (
+		blobDigest digest.Digest
+		size       int64
+	)
+	err = e.do(ctx, "put blob", func() error {
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return errors.Wrap(err, "rewind blob")
+		}
+		var err error
+		blobDigest, size, err = e.engine.PutBlob(ctx, reader)
+		return err
+	})
+	return blobDigest, size, err
+}
+
+// PutBlobJSON adds a new JSON blob to the image.
+func (e *retryEngine) PutBlobJSON(ctx context.Context, data interface{}) (digest.Digest, int64, error) {
+	var (
+		blobDigest digest.Digest
+		size       int64
+	)
+	err := e.do(ctx, "put json blob", func() error {
+		var err error
+		blobDigest, size, err = e.engine.PutBlobJSON(ctx, data)
+		return err
+	})
+	return blobDigest, size, err
+}
+
+// PutReference adds a new reference descriptor blob to the image.
+func (e *retryEngine) PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	return e.do(ctx, "put reference "+name, func() error {
+		return e.engine.PutReference(ctx, name, descriptor)
+	})
+}
+
+// UpdateReference atomically updates a reference, if the wrapped engine is a
+// cas.UpdatingEngine.
+func (e *retryEngine) UpdateReference(ctx context.Context, name string, oldDescriptor *ispec.Descriptor, newDescriptor ispec.Descriptor) error {
+	engine, ok := e.engine.(cas.UpdatingEngine)
+	if !ok {
+		return cas.ErrNotImplemented
+	}
+	return e.do(ctx, "update reference "+name, func() error {
+		return engine.UpdateReference(ctx, name, oldDescriptor, newDescriptor)
+	})
+}
+
+// FreezeReference marks a reference as frozen, if the wrapped engine is a
+// cas.FreezingEngine.
+func (e *retryEngine) FreezeReference(ctx context.Context, name string) error {
+	engine, ok := e.engine.(cas.FreezingEngine)
+	if !ok {
+		return cas.ErrNotImplemented
+	}
+	return e.do(ctx, "freeze reference "+name, func() error {
+		return engine.FreezeReference(ctx, name)
+	})
+}
+
+// UnfreezeReference removes the frozen mark from a reference, if the wrapped
+// engine is a cas.FreezingEngine.
+func (e *retryEngine) UnfreezeReference(ctx context.Context, name string) error {
+	engine, ok := e.engine.(cas.FreezingEngine)
+	if !ok {
+		return cas.ErrNotImplemented
+	}
+	return e.do(ctx, "unfreeze reference "+name, func() error {
+		return engine.UnfreezeReference(ctx, name)
+	})
+}
+
+// ReferenceFrozen returns whether a reference is frozen, if the wrapped
+// engine is a cas.FreezingEngine.
+func (e *retryEngine) ReferenceFrozen(ctx context.Context, name string) (bool, error) {
+	engine, ok := e.engine.(cas.FreezingEngine)
+	if !ok {
+		return false, cas.ErrNotImplemented
+	}
+	var frozen bool
+	err := e.do(ctx, "check frozen reference "+name, func() error {
+		var err error
+		frozen, err = engine.ReferenceFrozen(ctx, name)
+		return err
+	})
+	return frozen, err
+}
+
+// BlobUploadOffset returns the offset of a partial upload, if the wrapped
+// engine is a cas.ResumableEngine.
+func (e *retryEngine) BlobUploadOffset(ctx context.Context, session string) (int64, error) {
+	engine, ok := e.engine.(cas.ResumableEngine)
+	if !ok {
+		return -1, cas.ErrNotImplemented
+	}
+	var offset int64
+	err := e.do(ctx, "get upload offset "+session, func() error {
+		var err error
+		offset, err = engine.BlobUploadOffset(ctx, session)
+		return err
+	})
+	return offset, err
+}
+
+// PutBlobResumable continues a partial upload, if the wrapped engine is a
+// cas.ResumableEngine. It is not retried, because the caller is expected to
+// resume the upload from BlobUploadOffset if it fails.
+func (e *retryEngine) PutBlobResumable(ctx context.Context, session string, expected digest.Digest, reader io.Reader) (digest.Digest, int64, error) {
+	engine, ok := e.engine.(cas.ResumableEngine)
+	if !ok {
+		return "", -1, cas.ErrNotImplemented
+	}
+	return engine.PutBlobResumable(ctx, session, expected, reader)
+}
+
+// AbortBlobUpload removes a partial upload, if the wrapped engine is a
+// cas.ResumableEngine.
+func (e *retryEngine) AbortBlobUpload(ctx context.Context, session string) error {
+	engine, ok := e.engine.(cas.ResumableEngine)
+	if !ok {
+		return cas.ErrNotImplemented
+	}
+	return e.do(ctx, "abort upload "+session, func() error {
+		return engine.AbortBlobUpload(ctx, session)
+	})
+}
+
+// failedReader is an io.ReadCloser which always returns an error, used when a
+// blob could not be re-opened.
+type failedReader struct {
+	err error
+}
+
+func (r failedReader) Read([]byte) (int, error) { return 0, r.err }
+func (r failedReader) Close() error             { return nil }
+
+// retryReader is an io.ReadCloser for a blob which re-opens the blob (and
+// skips to the current offset) if reading fails with a transient error.
+type retryReader struct {
+	ctx    context.Context
+	engine *retryEngine
+	digest digest.Digest
+	reader io.ReadCloser
+	offset int64
+}
+
+// reopen replaces the reader with a newly opened reader for the blob,
+// positioned at the current offset.
+func (r *retryReader) reopen() error {
+	r.reader.Close()
+	r.reader = failedReader{errors.New("blob could not be re-opened")}
+
+	reader, err := r.engine.engine.GetBlob(r.ctx, r.digest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(ioutil.Discard, reader, r.offset); err != nil {
+		reader.Close()
+		return errors.Wrap(err, "skip to offset")
+	}
+	r.reader = reader
+	return nil
+}
+
+func (r *retryReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.offset += int64(n)
+	if err == nil || err == io.EOF || !r.engine.options.Transient(err) {
+		return n, err
+	}
+	if n > 0 {
+		// Return what we have, the next Read will retry.
+		return n, nil
+	}
+
+	err = r.engine.do(r.ctx, fmt.Sprintf("read blob %s", r.digest), func() error {
+		if err := r.reopen(); err != nil {
+			return err
+		}
+		var err error
+		n, err = r.reader.Read(p)
+		r.offset += int64(n)
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	})
+	if err == nil && n == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *retryReader) Close() error {
+	return r.reader.Close()
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). Reads which fail with a transient error are retried by
+// re-opening the blob.
+func (e *retryEngine) GetBlob(ctx context.Context, blobDigest digest.Digest) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	err := e.do(ctx, fmt.Sprintf("get blob %s", blobDigest), func() error {
+		var err error
+		reader, err = e.engine.GetBlob(ctx, blobDigest)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &retryReader{
+		ctx:    ctx,
+		engine: e,
+		digest: blobDigest,
+		reader: reader,
+	}, nil
+}
+
+// StatBlob returns information about a blob, if the wrapped engine is a
+// cas.StatingEngine.
+func (e *retryEngine) StatBlob(ctx context.Context, blobDigest digest.Digest) (cas.BlobInfo, error) {
+	engine, ok := e.engine.(cas.StatingEngine)
+	if !ok {
+		return cas.BlobInfo{}, cas.ErrNotImplemented
+	}
+	var info cas.BlobInfo
+	err := e.do(ctx, fmt.Sprintf("stat blob %s", blobDigest), func() error {
+		var err error
+		info, err = engine.StatBlob(ctx, blobDigest)
+		return err
+	})
+	return info, err
+}
+
+// GetBlobAt opens a blob for random access, if the wrapped engine is a
+// cas.RandomAccessEngine.
+func (e *retryEngine) GetBlobAt(ctx context.Context, blobDigest digest.Digest) (cas.BlobReaderAt, int64, error) {
+	engine, ok := e.engine.(cas.RandomAccessEngine)
+	if !ok {
+		return nil, -1, cas.ErrNotImplemented
+	}
+	var (
+		reader cas.BlobReaderAt
+		size   int64
+	)
+	err := e.do(ctx, fmt.Sprintf("get blob %s", blobDigest), func() error {
+		var err error
+		reader, size, err = engine.GetBlobAt(ctx, blobDigest)
+		return err
+	})
+	return reader, size, err
+}
+
+// LinkBlob adds a blob from a shared store, if the wrapped engine is a
+// cas.LinkingEngine.
+func (e *retryEngine) LinkBlob(ctx context.Context, blobDigest digest.Digest) (int64, error) {
+	engine, ok := e.engine.(cas.LinkingEngine)
+	if !ok {
+		return -1, cas.ErrNotImplemented
+	}
+	var size int64
+	err := e.do(ctx, fmt.Sprintf("link blob %s", blobDigest), func() error {
+		var err error
+		size, err = engine.LinkBlob(ctx, blobDigest)
+		return err
+	})
+	return size, err
+}
+
+// GetReference returns a reference from the image.
+func (e *retryEngine) GetReference(ctx context.Context, name string) (ispec.Descriptor, error) {
+	var descriptor ispec.Descriptor
+	err := e.do(ctx, "get reference "+name, func() error {
+		var err error
+		descriptor, err = e.engine.GetReference(ctx, name)
+		return err
+	})
+	return descriptor, err
+}
+
+// DeleteBlob removes a blob from the image.
+func (e *retryEngine) DeleteBlob(ctx context.Context, blobDigest digest.Digest) error {
+	return e.do(ctx, fmt.Sprintf("delete blob %s", blobDigest), func() error {
+		return e.engine.DeleteBlob(ctx, blobDigest)
+	})
+}
+
+// DeleteReference removes a reference from the image.
+func (e *retryEngine) DeleteReference(ctx context.Context, name string) error {
+	return e.do(ctx, "delete reference "+name, func() error {
+		return e.engine.DeleteReference(ctx, name)
+	})
+}
+
+// ListBlobs returns the set of blob digests stored in the image.
+func (e *retryEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	var digests []digest.Digest
+	err := e.do(ctx, "list blobs", func() error {
+		var err error
+		digests, err = e.engine.ListBlobs(ctx)
+		return err
+	})
+	return digests, err
+}
+
+// ListReferences returns the set of reference names stored in the image.
+func (e *retryEngine) ListReferences(ctx context.Context) ([]string, error) {
+	var names []string
+	err := e.do(ctx, "list references", func() error {
+		var err error
+		names, err = e.engine.ListReferences(ctx)
+		return err
+	})
+	return names, err
+}
+
+// Clean executes a garbage collection of any non-blob garbage in the image.
+func (e *retryEngine) Clean(ctx context.Context) error {
+	return e.do(ctx, "clean", func() error {
+		return e.engine.Clean(ctx)
+	})
+}
+
+// Close releases all references held by the engine, and closes the wrapped
+// engine.
+func (e *retryEngine) Close() error {
+	return e.engine.Close()
+}
@@ -0,0 +1,299 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package retry
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// flakyEngine is a cas.Engine which fails the first failures calls to
+// GetBlob, PutBlob and ListBlobs with err.
+type flakyEngine struct {
+	cas.Engine
+	failures int
+	calls    int
+	err      error
+}
+
+func (e *flakyEngine) fail() error {
+	e.calls++
+	if e.calls <= e.failures {
+		return e.err
+	}
+	return nil
+}
+
+func (e *flakyEngine) GetBlob(ctx context.Context, blobDigest digest.Digest) (io.ReadCloser, error) {
+	if err := e.fail(); err != nil {
+		return nil, err
+	}
+	return e.Engine.GetBlob(ctx, blobDigest)
+}
+
+func (e *flakyEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	if err := e.fail(); err != nil {
+		// Consume part of the reader, to make sure it is rewound.
+		io.CopyN(ioutil.Discard, reader, 1)
+		return "", -1, err
+	}
+	return e.Engine.PutBlob(ctx, reader)
+}
+
+func (e *flakyEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	if err := e.fail(); err != nil {
+		return nil, err
+	}
+	return e.Engine.ListBlobs(ctx)
+}
+
+func transientError() error {
+	return &os.PathError{Op: "open", Path: "blobs", Err: syscall.ESTALE}
+}
+
+var testOptions = &Options{
+	Attempts: 3,
+	Delay:    time.Millisecond,
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		transient bool
+	}{
+		{syscall.EINTR, true},
+		{syscall.EAGAIN, true},
+		{&os.PathError{Op: "open", Path: "x", Err: syscall.ESTALE}, true},
+		{errors.Wrap(&os.SyscallError{Syscall: "read", Err: syscall.EIO}, "read"), true},
+		{&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.EINTR}, true},
+		{&os.PathError{Op: "open", Path: "x", Err: syscall.ENOENT}, false},
+		{syscall.EACCES, false},
+		{io.EOF, false},
+		{cas.ErrNotImplemented, false},
+	} {
+		if got := IsTransient(test.err); got != test.transient {
+			t.Errorf("IsTransient(%v): expected %v got %v", test.err, test.transient, got)
+		}
+	}
+}
+
+func TestRetrySuccess(t *testing.T) {
+	ctx := context.Background()
+
+	flaky := &flakyEngine{Engine: mem.New(), failures: 2, err: transientError()}
+	engine := New(flaky, testOptions)
+	defer engine.Close()
+
+	data := []byte("some blob")
+	blobDigest, size, err := engine.PutBlob(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	if blobDigest != digest.FromBytes(data) || size != int64(len(data)) {
+		t.Errorf("PutBlob: blob was not rewound: got %s (%d bytes)", blobDigest, size)
+	}
+	if flaky.calls != 3 {
+		t.Errorf("PutBlob: expected 3 attempts, got %d", flaky.calls)
+	}
+
+	flaky.calls = 0
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	}
+	if len(blobs) != 1 || blobs[0] != blobDigest {
+		t.Errorf("ListBlobs: unexpected blobs: %v", blobs)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	ctx := context.Background()
+
+	flaky := &flakyEngine{Engine: mem.New(), failures: 10, err: transientError()}
+	engine := New(flaky, testOptions)
+	defer engine.Close()
+
+	_, err := engine.ListBlobs(ctx)
+	if err == nil {
+		t.Fatalf("ListBlobs: expected an error")
+	}
+	retryErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("ListBlobs: expected *Error, got %T: %v", err, err)
+	}
+	if retryErr.Attempts != 3 || flaky.calls != 3 {
+		t.Errorf("ListBlobs: expected 3 attempts, got %d (%d calls)", retryErr.Attempts, flaky.calls)
+	}
+	if !IsTransient(errors.Cause(err)) {
+		t.Errorf("ListBlobs: cause of error is not the transient error: %v", errors.Cause(err))
+	}
+}
+
+func TestRetryPermanent(t *testing.T) {
+	ctx := context.Background()
+
+	flaky := &flakyEngine{Engine: mem.New(), failures: 10, err: &os.PathError{Op: "open", Path: "blobs", Err: syscall.EACCES}}
+	engine := New(flaky, testOptions)
+	defer engine.Close()
+
+	_, err := engine.ListBlobs(ctx)
+	if err == nil {
+		t.Fatalf("ListBlobs: expected an error")
+	}
+	if _, ok := err.(*Error); ok {
+		t.Errorf("ListBlobs: permanent error was retried: %v", err)
+	}
+	if flaky.calls != 1 {
+		t.Errorf("ListBlobs: expected 1 attempt, got %d", flaky.calls)
+	}
+}
+
+func TestRetryPutBlobNoSeek(t *testing.T) {
+	ctx := context.Background()
+
+	flaky := &flakyEngine{Engine: mem.New(), failures: 1, err: transientError()}
+	engine := New(flaky, testOptions)
+	defer engine.Close()
+
+	// A reader which can't be rewound can't be retried.
+	reader := ioutil.NopCloser(bytes.NewReader([]byte("some blob")))
+	if _, _, err := engine.PutBlob(ctx, reader); !IsTransient(err) {
+		t.Errorf("PutBlob: expected transient error, got %v", err)
+	}
+	if flaky.calls != 1 {
+		t.Errorf("PutBlob: expected 1 attempt, got %d", flaky.calls)
+	}
+}
+
+// flakyReader is an io.ReadCloser which fails with err after reading limit
+// bytes.
+type flakyReader struct {
+	io.ReadCloser
+	limit int64
+	err   error
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	if r.limit <= 0 {
+		return 0, r.err
+	}
+	if int64(len(p)) > r.limit {
+		p = p[:r.limit]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.limit -= int64(n)
+	return n, err
+}
+
+// flakyReadEngine is a cas.Engine whose blob readers fail with a transient
+// error after reading limit bytes, the first failures times they are opened.
+type flakyReadEngine struct {
+	cas.Engine
+	failures int
+	limit    int64
+}
+
+func (e *flakyReadEngine) GetBlob(ctx context.Context, blobDigest digest.Digest) (io.ReadCloser, error) {
+	reader, err := e.Engine.GetBlob(ctx, blobDigest)
+	if err != nil || e.failures <= 0 {
+		return reader, err
+	}
+	e.failures--
+	return &flakyReader{ReadCloser: reader, limit: e.limit, err: transientError()}, nil
+}
+
+func TestRetryRead(t *testing.T) {
+	ctx := context.Background()
+
+	flaky := &flakyReadEngine{Engine: mem.New(), failures: 2, limit: 4}
+	engine := New(flaky, testOptions)
+	defer engine.Close()
+
+	data := []byte("some longer blob which will be read in parts")
+	blobDigest, _, err := flaky.Engine.PutBlob(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+
+	reader, err := engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	defer reader.Close()
+
+	gotBytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("GetBlob: failed to ReadAll: %+v", err)
+	}
+	if !bytes.Equal(data, gotBytes) {
+		t.Errorf("GetBlob: bytes did not match: expected=%q got=%q", string(data), string(gotBytes))
+	}
+}
+
+func TestRetryReadExhausted(t *testing.T) {
+	ctx := context.Background()
+
+	flaky := &flakyReadEngine{Engine: mem.New(), failures: 10, limit: 0}
+	engine := New(flaky, testOptions)
+	defer engine.Close()
+
+	blobDigest, _, err := flaky.Engine.PutBlob(ctx, bytes.NewReader([]byte("some blob")))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+
+	reader, err := engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	defer reader.Close()
+
+	// The error must not be mistaken for the end of the blob.
+	if _, err := ioutil.ReadAll(reader); err == nil {
+		t.Fatalf("GetBlob: expected read to fail")
+	} else if _, ok := err.(*Error); !ok {
+		t.Errorf("GetBlob: expected *Error, got %T: %v", err, err)
+	}
+}
+
+func TestRetryCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	flaky := &flakyEngine{Engine: mem.New(), failures: 10, err: transientError()}
+	engine := New(flaky, &Options{Attempts: 3, Delay: time.Hour})
+	defer engine.Close()
+
+	if _, err := engine.ListBlobs(ctx); errors.Cause(err) != context.Canceled {
+		t.Errorf("ListBlobs: expected context.Canceled, got %v", err)
+	}
+	if flaky.calls != 1 {
+		t.Errorf("ListBlobs: expected 1 attempt, got %d", flaky.calls)
+	}
+}
@@ -0,0 +1,426 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// maxErrorBody is the maximum size of an error response body which is read
+// to produce an error message.
+const maxErrorBody = 64 * 1024
+
+// ResponseError is returned when an S3 request fails with an unexpected
+// status code. Code and Message are taken from the body of the response if
+// the server provided one.
+type ResponseError struct {
+	Method     string
+	Key        string
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+// Error returns a description of the failed request.
+func (e *ResponseError) Error() string {
+	msg := fmt.Sprintf("s3 %s %q: %s", e.Method, e.Key, http.StatusText(e.StatusCode))
+	if e.Code != "" {
+		msg += fmt.Sprintf(": %s: %s", e.Code, e.Message)
+	}
+	return msg
+}
+
+// client is a minimal S3 client, which only supports path-style requests
+// against a single bucket. Only the small subset of the S3 API needed to
+// implement a cas.Engine is implemented.
+type client struct {
+	endpoint *url.URL
+	bucket   string
+	options  Options
+	http     *http.Client
+}
+
+func newClient(bucket string, options Options) (*client, error) {
+	endpoint, err := url.Parse(options.Endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse endpoint")
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, errors.Errorf("unsupported endpoint scheme: %q", endpoint.Scheme)
+	}
+	httpClient := options.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &client{
+		endpoint: endpoint,
+		bucket:   bucket,
+		options:  options,
+		http:     httpClient,
+	}, nil
+}
+
+// url returns the URL of the given key in the bucket. An empty key refers to
+// the bucket itself.
+func (c *client) url(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	// Make sure the path is sent exactly as it was signed.
+	u.RawPath = uriEncode(u.Path, true)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// request describes a single S3 request.
+type request struct {
+	method string
+	key    string
+	query  url.Values
+	header http.Header
+
+	// body is the payload of the request, of length size and with the
+	// (hex-encoded) SHA256 payloadHash.
+	body        io.Reader
+	size        int64
+	payloadHash string
+}
+
+// do makes the given request, and returns the response if the status code is
+// one of the expected codes (the caller must close the body). Otherwise a
+// *ResponseError is returned, with os.ErrNotExist being returned for 404s.
+func (c *client) do(ctx context.Context, r request, expected ...int) (*http.Response, error) {
+	body := r.body
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(r.method, c.url(r.key, r.query).String(), ioutil.NopCloser(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "create request")
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = r.size
+	if r.size == 0 {
+		// Don't send "Transfer-Encoding: chunked" for an empty body.
+		req.Body = nil
+	}
+	for name, values := range r.header {
+		req.Header[name] = values
+	}
+	payloadHash := r.payloadHash
+	if payloadHash == "" {
+		payloadHash = emptyPayloadHash
+	}
+	c.sign(req, payloadHash, time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "s3 %s %q", r.method, r.key)
+	}
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && r.key != "" {
+		return nil, errors.Wrapf(os.ErrNotExist, "s3 %s %q", r.method, r.key)
+	}
+	respErr := &ResponseError{
+		Method:     r.method,
+		Key:        r.key,
+		StatusCode: resp.StatusCode,
+	}
+	var xmlErr struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxErrorBody)).Decode(&xmlErr); err == nil {
+		respErr.Code = xmlErr.Code
+		respErr.Message = xmlErr.Message
+	}
+	return nil, respErr
+}
+
+// doXML makes the given request and decodes the XML response into v.
+func (c *client) doXML(ctx context.Context, r request, v interface{}) error {
+	resp, err := c.do(ctx, r, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return errors.Wrap(xml.NewDecoder(resp.Body).Decode(v), "decode response")
+}
+
+// bytesRequest returns a request with the given in-memory payload.
+func bytesRequest(method, key string, data []byte) request {
+	hash := sha256.Sum256(data)
+	return request{
+		method:      method,
+		key:         key,
+		header:      http.Header{},
+		body:        bytes.NewReader(data),
+		size:        int64(len(data)),
+		payloadHash: hex.EncodeToString(hash[:]),
+	}
+}
+
+// getObject returns the contents and size of the given object.
+func (c *client) getObject(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	resp, err := c.do(ctx, request{method: "GET", key: key}, http.StatusOK)
+	if err != nil {
+		return nil, -1, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// headObject returns whether the given object exists.
+func (c *client) headObject(ctx context.Context, key string) (bool, error) {
+	resp, err := c.do(ctx, request{method: "HEAD", key: key}, http.StatusOK)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// statObject returns the size and modification time of the given object.
+// Returns os.ErrNotExist if the object doesn't exist.
+func (c *client) statObject(ctx context.Context, key string) (int64, time.Time, error) {
+	resp, err := c.do(ctx, request{method: "HEAD", key: key}, http.StatusOK)
+	if err != nil {
+		return -1, time.Time{}, err
+	}
+	resp.Body.Close()
+
+	// A missing or invalid Last-Modified is treated as an unknown time, rather
+	// than failing the request.
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, modTime, nil
+}
+
+// deleteObject removes the given object. Removing an object which doesn't
+// exist is not an error.
+func (c *client) deleteObject(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, request{method: "DELETE", key: key}, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listObjects returns the keys of all objects with the given prefix,
+// following continuation tokens until the listing is complete.
+func (c *client) listObjects(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	var token string
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := c.doXML(ctx, request{method: "GET", query: query}, &result); err != nil {
+			return nil, errors.Wrap(err, "list objects")
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		if result.NextContinuationToken == "" {
+			return nil, errors.Errorf("list objects: truncated listing without continuation token")
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// multipartUpload is an in-progress multipart upload.
+type multipartUpload struct {
+	Key       string    `xml:"Key"`
+	UploadID  string    `xml:"UploadId"`
+	Initiated time.Time `xml:"Initiated"`
+}
+
+// completedPart is a part of a multipart upload which has been uploaded.
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// createMultipartUpload starts a new multipart upload for the given key.
+func (c *client) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := c.doXML(ctx, request{method: "POST", key: key, query: url.Values{"uploads": {""}}}, &result); err != nil {
+		return "", errors.Wrap(err, "create multipart upload")
+	}
+	if result.UploadID == "" {
+		return "", errors.Errorf("create multipart upload: no upload id returned")
+	}
+	return result.UploadID, nil
+}
+
+// uploadPart uploads a single part of a multipart upload, and returns the
+// ETag of the part.
+func (c *client) uploadPart(ctx context.Context, key, uploadID string, partNumber int, body io.ReadSeeker, size int64) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", errors.Wrap(err, "hash part")
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", errors.Wrap(err, "rewind part")
+	}
+	resp, err := c.do(ctx, request{
+		method: "PUT",
+		key:    key,
+		query: url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {uploadID},
+		},
+		body:        body,
+		size:        size,
+		payloadHash: hex.EncodeToString(hash.Sum(nil)),
+	}, http.StatusOK)
+	if err != nil {
+		return "", errors.Wrapf(err, "upload part %d", partNumber)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", errors.Errorf("upload part %d: no etag returned", partNumber)
+	}
+	return etag, nil
+}
+
+// completeMultipartUpload assembles the uploaded parts into the final object.
+func (c *client) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []completedPart) error {
+	data, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return errors.Wrap(err, "marshal parts")
+	}
+	r := bytesRequest("POST", key, data)
+	r.query = url.Values{"uploadId": {uploadID}}
+
+	// The upload can fail even if the status code is 200, in which case an
+	// error is returned in the body.
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := c.doXML(ctx, r, &result); err != nil {
+		return errors.Wrap(err, "complete multipart upload")
+	}
+	if result.XMLName.Local == "Error" {
+		return &ResponseError{
+			Method:     "POST",
+			Key:        key,
+			StatusCode: http.StatusOK,
+			Code:       result.Code,
+			Message:    result.Message,
+		}
+	}
+	return nil
+}
+
+// abortMultipartUpload discards a multipart upload and all of its parts.
+func (c *client) abortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	resp, err := c.do(ctx, request{method: "DELETE", key: key, query: url.Values{"uploadId": {uploadID}}}, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil
+		}
+		return errors.Wrap(err, "abort multipart upload")
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listMultipartUploads returns all in-progress multipart uploads for keys
+// with the given prefix.
+func (c *client) listMultipartUploads(ctx context.Context, prefix string) ([]multipartUpload, error) {
+	var uploads []multipartUpload
+	var keyMarker, uploadIDMarker string
+	for {
+		query := url.Values{
+			"uploads": {""},
+			"prefix":  {prefix},
+		}
+		if keyMarker != "" {
+			query.Set("key-marker", keyMarker)
+			query.Set("upload-id-marker", uploadIDMarker)
+		}
+		var result struct {
+			Uploads            []multipartUpload `xml:"Upload"`
+			IsTruncated        bool              `xml:"IsTruncated"`
+			NextKeyMarker      string            `xml:"NextKeyMarker"`
+			NextUploadIDMarker string            `xml:"NextUploadIdMarker"`
+		}
+		if err := c.doXML(ctx, request{method: "GET", query: query}, &result); err != nil {
+			return nil, errors.Wrap(err, "list multipart uploads")
+		}
+		uploads = append(uploads, result.Uploads...)
+		if !result.IsTruncated {
+			return uploads, nil
+		}
+		if result.NextKeyMarker == "" {
+			return nil, errors.Errorf("list multipart uploads: truncated listing without marker")
+		}
+		keyMarker, uploadIDMarker = result.NextKeyMarker, result.NextUploadIDMarker
+	}
+}
@@ -0,0 +1,227 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// URIPrefix is the prefix of all URIs handled by the S3 driver. URIs are of
+// the form "s3://<bucket>[/<prefix>]", where the image is stored under the
+// given key prefix in the bucket.
+const URIPrefix = "s3://"
+
+// DefaultPartSize is the default size of each part of a multipart upload.
+// Blobs no larger than the part size are uploaded with a single request.
+const DefaultPartSize = 16 * 1024 * 1024
+
+// Driver is an implementation of drivers.Driver for images stored in an
+// S3-compatible bucket. It is configured using OptionsFromEnv.
+var Driver cas.Driver = s3Driver{}
+
+// Options specifies how to access the S3-compatible server.
+type Options struct {
+	// Endpoint is the base URL of the server. Requests are made using
+	// path-style addressing (<endpoint>/<bucket>/<key>). If empty, the AWS
+	// endpoint for Region is used.
+	Endpoint string
+
+	// Region is the region used when signing requests. If empty,
+	// "us-east-1" is used.
+	Region string
+
+	// AccessKeyID, SecretAccessKey and SessionToken are the credentials used
+	// to sign requests. If AccessKeyID is empty, requests are not signed
+	// (which only works for public buckets).
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// PartSize is the size of each part of multipart uploads. If zero,
+	// DefaultPartSize is used. AWS requires every part but the last to be
+	// at least 5MiB.
+	PartSize int64
+
+	// TempDir is the directory in which blobs are spooled before being
+	// uploaded (blobs must be hashed before they can be uploaded). If empty,
+	// the default temporary directory is used.
+	TempDir string
+
+	// Client is the HTTP client used for requests. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+}
+
+// OptionsFromEnv returns the options specified by the standard AWS
+// environment variables (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// AWS_SESSION_TOKEN, AWS_REGION or AWS_DEFAULT_REGION, and
+// AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL).
+func OptionsFromEnv() Options {
+	options := Options{
+		Endpoint:        os.Getenv("AWS_ENDPOINT_URL_S3"),
+		Region:          os.Getenv("AWS_REGION"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if options.Endpoint == "" {
+		options.Endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if options.Region == "" {
+		options.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	return options
+}
+
+// parseURI splits an S3 URI into the bucket and key prefix of the image. The
+// prefix is either empty or ends with a '/'.
+func parseURI(uri string) (string, string, error) {
+	if !strings.HasPrefix(uri, URIPrefix) {
+		return "", "", errors.Errorf("not an s3 uri: %q", uri)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(uri, URIPrefix), "/", 2)
+	bucket, prefix := parts[0], ""
+	if len(parts) == 2 {
+		prefix = strings.Trim(parts[1], "/")
+	}
+	if bucket == "" {
+		return "", "", errors.Errorf("s3 uri has no bucket: %q", uri)
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	return bucket, prefix, nil
+}
+
+// newEngine returns an engine for the image at the given URI, without
+// validating it.
+func newEngine(uri string, options Options) (*s3Engine, error) {
+	bucket, prefix, err := parseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	if options.Region == "" {
+		options.Region = "us-east-1"
+	}
+	if options.Endpoint == "" {
+		options.Endpoint = "https://s3." + options.Region + ".amazonaws.com"
+	}
+	if options.PartSize == 0 {
+		options.PartSize = DefaultPartSize
+	}
+	if options.PartSize < 0 {
+		return nil, errors.Errorf("invalid part size: %d", options.PartSize)
+	}
+	client, err := newClient(bucket, options)
+	if err != nil {
+		return nil, errors.Wrap(err, "create client")
+	}
+	return &s3Engine{
+		client: client,
+		prefix: prefix,
+	}, nil
+}
+
+type s3Driver struct{}
+
+// Supported returns whether the resource at the given URI is supported by the
+// driver (used for auto-detection). Only URIs starting with URIPrefix are
+// supported.
+func (d s3Driver) Supported(uri string) bool {
+	return strings.HasPrefix(uri, URIPrefix)
+}
+
+// Open "opens" a new CAS engine accessor for the given URI, using the
+// options from OptionsFromEnv.
+func (d s3Driver) Open(uri string) (cas.Engine, error) {
+	return OpenWithOptions(uri, OptionsFromEnv())
+}
+
+// Create creates a new image at the given URI, using the options from
+// OptionsFromEnv.
+func (d s3Driver) Create(uri string) error {
+	return CreateWithOptions(uri, OptionsFromEnv())
+}
+
+// Open opens a new reference to the image stored at the given "s3://" URI,
+// using the options from OptionsFromEnv.
+func Open(uri string) (cas.Engine, error) {
+	return OpenWithOptions(uri, OptionsFromEnv())
+}
+
+// OpenWithOptions is like Open, except that the returned engine uses the
+// given options.
+func OpenWithOptions(uri string, options Options) (cas.Engine, error) {
+	engine, err := newEngine(uri, options)
+	if err != nil {
+		return nil, err
+	}
+	if err := engine.validate(context.Background()); err != nil {
+		return nil, errors.Wrap(err, "validate")
+	}
+	return engine, nil
+}
+
+// Create creates a new image at the given "s3://" URI (the bucket must
+// already exist), using the options from OptionsFromEnv. If an image already
+// exists at the URI, os.ErrExist is returned.
+func Create(uri string) error {
+	return CreateWithOptions(uri, OptionsFromEnv())
+}
+
+// CreateWithOptions is like Create, except that the given options are used.
+func CreateWithOptions(uri string, options Options) error {
+	engine, err := newEngine(uri, options)
+	if err != nil {
+		return err
+	}
+
+	var buffer bytes.Buffer
+	if err := json.NewEncoder(&buffer).Encode(ispec.ImageLayout{
+		Version: imageLayoutVersion,
+	}); err != nil {
+		return errors.Wrap(err, "encode oci-layout")
+	}
+
+	// There are no directories in S3, so the image only consists of the
+	// "oci-layout" object until blobs and references are added.
+	r := bytesRequest("PUT", engine.key(layoutFile), buffer.Bytes())
+	r.header.Set("If-None-Match", "*")
+	resp, err := engine.client.do(context.Background(), r, http.StatusOK)
+	if err != nil {
+		if respErr, ok := errors.Cause(err).(*ResponseError); ok && respErr.StatusCode == http.StatusPreconditionFailed {
+			err = os.ErrExist
+		}
+		return errors.Wrap(err, "create oci-layout")
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func init() {
+	cas.Register(Driver)
+}
@@ -0,0 +1,559 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package s3 implements a cas.Engine which stores its blobs and references
+// as objects in an S3-compatible bucket, using the same layout as a
+// directory-backed image (relative to a key prefix in the bucket). This
+// allows CI systems to use object storage as the image store directly,
+// without having to copy an image layout to and from local disk.
+//
+// Large blobs are uploaded using multipart uploads, and references are
+// created using conditional PUTs (If-None-Match) so that concurrent writers
+// cannot silently clobber each other's references. Note that conditional
+// PUTs are not supported by every S3-compatible server.
+//
+// The driver trusts whoever controls its environment and the bucket. When
+// used through Driver, the credentials, region and endpoint are taken from
+// the standard AWS_* environment variables (see OptionsFromEnv), and the
+// credentials are sent (as request signatures) to whichever endpoint is
+// configured, including plain "http" endpoints. Anyone with write access to
+// the bucket can replace objects, so GetBlob verifies each blob against its
+// digest once it has been read in full (failing with a
+// *cas.DigestMismatchError), while references are only as trustworthy as the
+// bucket's access policy. Without credentials, requests are unsigned and only
+// public buckets can be used.
+package s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/ctxio"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// imageLayoutVersion is the version of the image layout we support. This
+	// is the same as dir.ImageLayoutVersion.
+	imageLayoutVersion = "1.0.0"
+
+	// refDirectory is the key prefix inside an image that contains
+	// references.
+	refDirectory = "refs"
+
+	// blobDirectory is the key prefix inside an image that contains blobs.
+	blobDirectory = "blobs"
+
+	// layoutFile is the key inside an image that indicates what version of
+	// the OCI spec the image is.
+	layoutFile = "oci-layout"
+
+	// maxParts is the maximum number of parts in a multipart upload.
+	maxParts = 10000
+
+	// staleUploadAge is the age after which an incomplete multipart upload
+	// is considered to have been abandoned, and is removed by Clean.
+	staleUploadAge = 24 * time.Hour
+)
+
+// blobKey returns the key of a blob given its digest, relative to the prefix
+// of the image. The digest must be of the form algorithm:hex.
+func blobKey(digest digest.Digest) (string, error) {
+	if err := digest.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+	if digest.Algorithm() != cas.BlobAlgorithm {
+		return "", errors.Errorf("unsupported algorithm: %q", digest.Algorithm())
+	}
+	return path.Join(blobDirectory, digest.Algorithm().String(), digest.Hex()), nil
+}
+
+// refKey returns the key of a reference given its name, relative to the
+// prefix of the image. The name is escaped (in the same way as the dir
+// driver), so that names containing slashes are stored as a single key.
+func refKey(name string) (string, error) {
+	switch name {
+	case "", ".", "..":
+		return "", errors.Errorf("invalid reference name: %q", name)
+	}
+	return path.Join(refDirectory, url.PathEscape(name)), nil
+}
+
+type s3Engine struct {
+	client *client
+	prefix string
+}
+
+// key returns the full key in the bucket of the given key in the image.
+func (e *s3Engine) key(key string) string {
+	return e.prefix + key
+}
+
+// validate ensures that the image is valid.
+func (e *s3Engine) validate(ctx context.Context) error {
+	reader, _, err := e.client.getObject(ctx, e.key(layoutFile))
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			err = cas.ErrInvalid
+		}
+		return errors.Wrap(err, "read oci-layout")
+	}
+	defer reader.Close()
+
+	var ociLayout ispec.ImageLayout
+	if err := json.NewDecoder(reader).Decode(&ociLayout); err != nil {
+		return errors.Wrap(err, "parse oci-layout")
+	}
+	if ociLayout.Version != imageLayoutVersion {
+		return errors.Wrap(cas.ErrInvalid, "layout version is supported")
+	}
+	return nil
+}
+
+// putObject uploads the contents of fh (of the given size and SHA256 digest)
+// to key. Objects larger than the configured part size are uploaded using a
+// multipart upload.
+func (e *s3Engine) putObject(ctx context.Context, key string, fh *os.File, size int64, hash string) error {
+	partSize := e.client.options.PartSize
+	if size <= partSize {
+		resp, err := e.client.do(ctx, request{
+			method:      "PUT",
+			key:         key,
+			body:        fh,
+			size:        size,
+			payloadHash: hash,
+		}, http.StatusOK)
+		if err != nil {
+			return errors.Wrap(err, "put object")
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	// There is an upper limit on the number of parts, so very large blobs
+	// need larger parts.
+	if minPartSize := (size + maxParts - 1) / maxParts; partSize < minPartSize {
+		partSize = minPartSize
+	}
+	uploadID, err := e.client.createMultipartUpload(ctx, key)
+	if err != nil {
+		return err
+	}
+	var parts []completedPart
+	for offset := int64(0); offset < size; offset += partSize {
+		length := size - offset
+		if length > partSize {
+			length = partSize
+		}
+		partNumber := len(parts) + 1
+		etag, err := e.client.uploadPart(ctx, key, uploadID, partNumber, io.NewSectionReader(fh, offset, length), length)
+		if err != nil {
+			e.client.abortMultipartUpload(ctx, key, uploadID)
+			return err
+		}
+		parts = append(parts, completedPart{PartNumber: partNumber, ETag: etag})
+	}
+	if err := e.client.completeMultipartUpload(ctx, key, uploadID, parts); err != nil {
+		e.client.abortMultipartUpload(ctx, key, uploadID)
+		return err
+	}
+	return nil
+}
+
+// PutBlob adds a new blob to the image. This is idempotent; a nil error
+// means that "the content is stored at DIGEST" without implying "because
+// of this PutBlob() call".
+func (e *s3Engine) PutBlob(ctx context.Context, reader io.Reader) (blobDigest digest.Digest, blobSize int64, err error) {
+	ctx, span := event.StartSpan(ctx, "s3.PutBlob")
+	defer func() { span.End(err) }()
+	blob := event.StartBlob(ctx, event.OpPut, "", -1)
+	defer func() { blob.Done(blobDigest, err) }()
+
+	digester := cas.BlobAlgorithm.Digester()
+
+	// We copy this into a temporary file because we need to get the blob hash
+	// (which is also needed to sign the upload) before uploading it.
+	fh, err := ioutil.TempFile(e.client.options.TempDir, "umoci-s3-blob-")
+	if err != nil {
+		return "", -1, errors.Wrap(err, "create temporary blob")
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	progressReader := blob.Reader(ctxio.NewReader(ctx, reader))
+
+	size, err := io.Copy(io.MultiWriter(fh, digester.Hash()), progressReader)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "copy to temporary blob")
+	}
+	blobDigest = digester.Digest()
+
+	key, err := blobKey(blobDigest)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "compute blob key")
+	}
+	key = e.key(key)
+
+	// Blobs are content-addressed, so there's no need to upload a blob that
+	// already exists.
+	exists, err := e.client.headObject(ctx, key)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "check for existing blob")
+	}
+	if exists {
+		event.Log(ctx).Debugf("s3: blob %s already exists", blobDigest)
+	} else {
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
+			return "", -1, errors.Wrap(err, "rewind temporary blob")
+		}
+		// cas.BlobAlgorithm is SHA256, so the blob digest is also the payload
+		// hash used when signing the request.
+		if err := e.putObject(ctx, key, fh, size, blobDigest.Hex()); err != nil {
+			return "", -1, errors.Wrap(err, "upload blob")
+		}
+	}
+
+	span.SetAttribute("digest", blobDigest)
+	span.SetAttribute("size", size)
+	return blobDigest, size, nil
+}
+
+// PutBlobJSON adds a new JSON blob to the image (marshalled from the given
+// interface). This is equivalent to calling PutBlob() with a JSON payload
+// as the reader.
+func (e *s3Engine) PutBlobJSON(ctx context.Context, data interface{}) (digest.Digest, int64, error) {
+	var buffer bytes.Buffer
+	if err := json.NewEncoder(&buffer).Encode(data); err != nil {
+		return "", -1, errors.Wrap(err, "encode JSON")
+	}
+	return e.PutBlob(ctx, &buffer)
+}
+
+// PutReference adds a new reference descriptor to the image. This is
+// idempotent; a nil error means that "the descriptor is stored at NAME"
+// without implying "because of this PutReference() call". ErrClobber is
+// returned if there is already a descriptor stored at NAME, but does not
+// match the descriptor requested to be stored.
+func (e *s3Engine) PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	key, err := refKey(name)
+	if err != nil {
+		return errors.Wrap(err, "compute ref key")
+	}
+
+	if err := e.checkReference(ctx, name, descriptor); err == nil {
+		return nil
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+
+	var buffer bytes.Buffer
+	if err := json.NewEncoder(&buffer).Encode(descriptor); err != nil {
+		return errors.Wrap(err, "encode ref")
+	}
+
+	// The reference is only created if it still doesn't exist, so that
+	// concurrent writers can't clobber each other.
+	r := bytesRequest("PUT", e.key(key), buffer.Bytes())
+	r.header.Set("If-None-Match", "*")
+	resp, err := e.client.do(ctx, r, http.StatusOK)
+	if err != nil {
+		if respErr, ok := errors.Cause(err).(*ResponseError); ok && (respErr.StatusCode == http.StatusPreconditionFailed || respErr.StatusCode == http.StatusConflict) {
+			// Someone else created the reference after we checked.
+			return e.checkReference(ctx, name, descriptor)
+		}
+		return errors.Wrap(err, "put ref")
+	}
+	resp.Body.Close()
+	event.Emit(ctx, event.Event{Type: event.RefUpdated, Reference: name, Descriptor: &descriptor})
+	return nil
+}
+
+// UpdateReference replaces the descriptor stored at NAME with newDescriptor,
+// but only if the descriptor currently stored at NAME is oldDescriptor (if
+// oldDescriptor is nil, NAME must not exist). The reference is replaced using
+// a conditional PUT on the ETag of the current reference, so concurrent
+// updates cannot overwrite each other.
+func (e *s3Engine) UpdateReference(ctx context.Context, name string, oldDescriptor *ispec.Descriptor, newDescriptor ispec.Descriptor) error {
+	key, err := refKey(name)
+	if err != nil {
+		return errors.Wrap(err, "compute ref key")
+	}
+	key = e.key(key)
+
+	var current ispec.Descriptor
+	var etag string
+	resp, err := e.client.do(ctx, request{method: "GET", key: key}, http.StatusOK)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return errors.Wrap(err, "get old reference")
+	}
+	exists := err == nil
+	if exists {
+		etag = resp.Header.Get("ETag")
+		err := json.NewDecoder(resp.Body).Decode(&current)
+		resp.Body.Close()
+		if err != nil {
+			return errors.Wrap(err, "parse old reference")
+		}
+		if etag == "" {
+			return errors.Errorf("get old reference: no etag returned")
+		}
+	}
+	if exists && reflect.DeepEqual(current, newDescriptor) {
+		return nil
+	}
+	if oldDescriptor != nil && !exists {
+		return errors.Wrap(os.ErrNotExist, "get old reference")
+	}
+	if exists && (oldDescriptor == nil || !reflect.DeepEqual(current, *oldDescriptor)) {
+		return &cas.ClobberError{
+			Name: name,
+			Old:  current,
+			New:  newDescriptor,
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := json.NewEncoder(&buffer).Encode(newDescriptor); err != nil {
+		return errors.Wrap(err, "encode ref")
+	}
+	r := bytesRequest("PUT", key, buffer.Bytes())
+	if exists {
+		r.header.Set("If-Match", etag)
+	} else {
+		r.header.Set("If-None-Match", "*")
+	}
+	resp, err = e.client.do(ctx, r, http.StatusOK)
+	if err != nil {
+		if respErr, ok := errors.Cause(err).(*ResponseError); ok && (respErr.StatusCode == http.StatusPreconditionFailed || respErr.StatusCode == http.StatusConflict) {
+			// Someone else modified the reference after we checked.
+			return e.checkReference(ctx, name, newDescriptor)
+		}
+		return errors.Wrap(err, "put ref")
+	}
+	resp.Body.Close()
+	event.Emit(ctx, event.Event{Type: event.RefUpdated, Reference: name, Descriptor: &newDescriptor})
+	return nil
+}
+
+// checkReference returns nil if the reference NAME already refers to the
+// given descriptor, and a *cas.ClobberError if it refers to a different
+// descriptor. Returns os.ErrNotExist if the reference doesn't exist.
+func (e *s3Engine) checkReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	oldDescriptor, err := e.GetReference(ctx, name)
+	if err != nil {
+		return errors.Wrap(err, "get old reference")
+	}
+	// We should not return an error if the two descriptors are identical.
+	if !reflect.DeepEqual(oldDescriptor, descriptor) {
+		return &cas.ClobberError{
+			Name: name,
+			Old:  oldDescriptor,
+			New:  descriptor,
+		}
+	}
+	return nil
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). Returns os.ErrNotExist if the digest is not found.
+func (e *s3Engine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	key, err := blobKey(digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute blob key")
+	}
+	reader, size, err := e.client.getObject(ctx, e.key(key))
+	if err != nil {
+		return nil, errors.Wrap(err, "get blob")
+	}
+	reader = &verifiedReader{
+		ReadCloser: reader,
+		digest:     digest,
+		digester:   digest.Algorithm().Digester(),
+	}
+	return event.NewBlobReader(ctx, digest, size, ctxio.NewReadCloser(ctx, reader)), nil
+}
+
+// verifiedReader is an io.ReadCloser which verifies that the blob read from it
+// matches its digest, as the object may have been replaced by anyone with
+// write access to the bucket. The mismatch is only detected once the blob
+// has been read in full, so callers must not trust the contents before
+// reaching io.EOF.
+type verifiedReader struct {
+	io.ReadCloser
+	digest   digest.Digest
+	digester digest.Digester
+}
+
+func (r *verifiedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.digester.Hash().Write(p[:n])
+	if err == io.EOF {
+		if actual := r.digester.Digest(); actual != r.digest {
+			return n, &cas.DigestMismatchError{Expected: r.digest, Actual: actual}
+		}
+	}
+	return n, err
+}
+
+// StatBlob returns the size and modification time of a blob. Returns
+// os.ErrNotExist if the digest is not found.
+func (e *s3Engine) StatBlob(ctx context.Context, digest digest.Digest) (cas.BlobInfo, error) {
+	key, err := blobKey(digest)
+	if err != nil {
+		return cas.BlobInfo{}, errors.Wrap(err, "compute blob key")
+	}
+	size, modTime, err := e.client.statObject(ctx, e.key(key))
+	if err != nil {
+		return cas.BlobInfo{}, errors.Wrap(err, "stat blob")
+	}
+	return cas.BlobInfo{
+		Size:    size,
+		ModTime: modTime,
+	}, nil
+}
+
+// GetReference returns a reference from the image. Returns os.ErrNotExist
+// if the name was not found.
+func (e *s3Engine) GetReference(ctx context.Context, name string) (ispec.Descriptor, error) {
+	key, err := refKey(name)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "compute ref key")
+	}
+	reader, _, err := e.client.getObject(ctx, e.key(key))
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get ref")
+	}
+	defer reader.Close()
+
+	var descriptor ispec.Descriptor
+	if err := json.NewDecoder(reader).Decode(&descriptor); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "parse ref")
+	}
+	return descriptor, nil
+}
+
+// DeleteBlob removes a blob from the image. This is idempotent; a nil
+// error means "the content is not in the store" without implying "because
+// of this DeleteBlob() call".
+func (e *s3Engine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	key, err := blobKey(digest)
+	if err != nil {
+		return errors.Wrap(err, "compute blob key")
+	}
+	return errors.Wrap(e.client.deleteObject(ctx, e.key(key)), "remove blob")
+}
+
+// DeleteReference removes a reference from the image. This is idempotent;
+// a nil error means "the content is not in the store" without implying
+// "because of this DeleteReference() call".
+func (e *s3Engine) DeleteReference(ctx context.Context, name string) error {
+	key, err := refKey(name)
+	if err != nil {
+		return errors.Wrap(err, "compute ref key")
+	}
+	if err := e.client.deleteObject(ctx, e.key(key)); err != nil {
+		return errors.Wrap(err, "remove ref")
+	}
+	event.Emit(ctx, event.Event{Type: event.RefUpdated, Reference: name})
+	return nil
+}
+
+// ListBlobs returns the set of blob digests stored in the image.
+func (e *s3Engine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	prefix := e.key(path.Join(blobDirectory, cas.BlobAlgorithm.String()) + "/")
+	keys, err := e.client.listObjects(ctx, prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "list blobs")
+	}
+
+	digests := []digest.Digest{}
+	for _, key := range keys {
+		hex := strings.TrimPrefix(key, prefix)
+		if strings.Contains(hex, "/") {
+			continue
+		}
+		digests = append(digests, digest.NewDigestFromHex(cas.BlobAlgorithm.String(), hex))
+	}
+	return digests, nil
+}
+
+// ListReferences returns the set of reference names stored in the image.
+func (e *s3Engine) ListReferences(ctx context.Context) ([]string, error) {
+	prefix := e.key(refDirectory + "/")
+	keys, err := e.client.listObjects(ctx, prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "list refs")
+	}
+
+	refs := []string{}
+	for _, key := range keys {
+		file := strings.TrimPrefix(key, prefix)
+		if file == "" || strings.Contains(file, "/") {
+			continue
+		}
+		name, err := url.PathUnescape(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid reference key %q", key)
+		}
+		refs = append(refs, name)
+	}
+	sort.Strings(refs)
+	return refs, nil
+}
+
+// Clean executes a garbage collection of any non-blob garbage in the store.
+// For an S3 image this is any incomplete multipart upload which was started
+// more than a day ago (and has presumably been abandoned). Parts of
+// incomplete uploads are not visible as objects, but are still stored (and
+// billed for) until the upload is aborted.
+func (e *s3Engine) Clean(ctx context.Context) error {
+	uploads, err := e.client.listMultipartUploads(ctx, e.prefix)
+	if err != nil {
+		return errors.Wrap(err, "list uploads")
+	}
+	for _, upload := range uploads {
+		if time.Since(upload.Initiated) < staleUploadAge {
+			continue
+		}
+		event.Log(ctx).Debugf("s3: aborting stale upload of %s started at %s", upload.Key, upload.Initiated)
+		if err := e.client.abortMultipartUpload(ctx, upload.Key, upload.UploadID); err != nil {
+			return errors.Wrapf(err, "abort upload of %s", upload.Key)
+		}
+	}
+	return nil
+}
+
+// Close releases all references held by the engine. Subsequent operations
+// may fail.
+func (e *s3Engine) Close() error {
+	return nil
+}
@@ -0,0 +1,519 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// MediaTypeEmptyJSON is the media type of the empty JSON blob ("{}"),
+	// which is used as the configuration of artifact manifests.
+	MediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
+
+	// AnnotationTitle is the annotation of the blobs of an artifact which
+	// contains their (file) name.
+	AnnotationTitle = "org.opencontainers.image.title"
+
+	// AnnotationReferrersSubject is the annotation of the referrers indexes
+	// created by Attach, which contains the digest of their subject. Only
+	// references with this annotation (and named with the ReferrersTag of the
+	// subject) are treated as referrers indexes by GC and BlobPool, so a
+	// reference created by a user is never removed along with a subject that
+	// happens to match its name.
+	AnnotationReferrersSubject = "org.opensuse.umoci.referrers.subject"
+)
+
+// ArtifactManifest is an image manifest which describes an artifact (such as
+// an SBOM, signature or attestation) attached to another blob (its subject).
+// The version of the image-spec we use predates the artifactType and subject
+// fields, so they are defined here. Artifact manifests are stored with a
+// media type of ispec.MediaTypeImageManifest, and so are loaded as an
+// ispec.Manifest by FromDescriptor (without these fields).
+type ArtifactManifest struct {
+	ispec.Manifest
+
+	// ArtifactType is the media type of the artifact.
+	ArtifactType string `json:"artifactType,omitempty"`
+
+	// Subject is the descriptor of the blob that the artifact is attached to.
+	Subject *ispec.Descriptor `json:"subject,omitempty"`
+}
+
+// ArtifactBlob is the descriptor of a blob of an artifact manifest, along with
+// its annotations (which are not part of the ispec.Descriptor of the version
+// of the image-spec we use). The name of a blob is usually stored in its
+// AnnotationTitle annotation.
+type ArtifactBlob struct {
+	ispec.Descriptor
+
+	// Annotations are the annotations of the blob descriptor.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// artifactManifestBlobs is used to encode and decode artifact manifests along
+// with the annotations of their blobs, which are dropped by ispec.Manifest.
+type artifactManifestBlobs struct {
+	ArtifactManifest
+
+	// Layers shadows ArtifactManifest.Layers.
+	Layers []ArtifactBlob `json:"layers"`
+}
+
+// manifest returns the ArtifactManifest, with its layers filled in.
+func (m artifactManifestBlobs) manifest() ArtifactManifest {
+	manifest := m.ArtifactManifest
+	manifest.Layers = nil
+	for _, blob := range m.Layers {
+		manifest.Layers = append(manifest.Layers, blob.Descriptor)
+	}
+	return manifest
+}
+
+// Artifact describes an artifact attached to a subject.
+type Artifact struct {
+	// Descriptor is the descriptor of the artifact manifest.
+	Descriptor ispec.Descriptor `json:"descriptor"`
+
+	// ArtifactType is the media type of the artifact.
+	ArtifactType string `json:"artifactType"`
+
+	// Annotations are the annotations of the artifact manifest.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ReferrersTag returns the name of the reference used to store the referrers
+// index of the given subject. This follows the referrers tag schema of the
+// OCI distribution-spec ("<alg>-<encoded>"). A referrers index is a manifest
+// list of the artifact manifests attached to the subject.
+func ReferrersTag(subject digest.Digest) string {
+	return subject.Algorithm().String() + "-" + subject.Hex()
+}
+
+// referrersSubject returns the subject digest of the referrers index stored
+// in the reference with the given name and descriptor, or false if the
+// reference is not a referrers index created by Attach (see
+// AnnotationReferrersSubject).
+func (e Engine) referrersSubject(ctx context.Context, name string, descriptor ispec.Descriptor) (digest.Digest, bool, error) {
+	if descriptor.MediaType != ispec.MediaTypeImageManifestList {
+		return "", false, nil
+	}
+	blob, err := e.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return "", false, errors.Wrapf(err, "get reference %s", name)
+	}
+	defer blob.Close()
+
+	list, ok := blob.Data.(ispec.ManifestList)
+	if !ok {
+		// Should _never_ be reached.
+		return "", false, errors.Errorf("[internal error] unknown manifest list blob type: %s", blob.MediaType)
+	}
+	subject, err := digest.Parse(list.Annotations[AnnotationReferrersSubject])
+	if err != nil || ReferrersTag(subject) != name {
+		return "", false, nil
+	}
+	return subject, true, nil
+}
+
+// artifactBlobsKey is the context key for the set of digests of the blobs of
+// the artifact manifest being walked, see childContext.
+type artifactBlobsKey struct{}
+
+// artifactBlobs returns the digests of the configuration and layers of the
+// given blob if it is an artifact manifest (a manifest whose configuration is
+// not an image configuration), and nil otherwise.
+func artifactBlobs(blob *Blob) map[digest.Digest]struct{} {
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok || ConvertMediaType(manifest.Config.MediaType) == ispec.MediaTypeImageConfig {
+		return nil
+	}
+	blobs := map[digest.Digest]struct{}{
+		manifest.Config.Digest: {},
+	}
+	for _, layer := range manifest.Layers {
+		blobs[layer.Digest] = struct{}{}
+	}
+	return blobs
+}
+
+// withArtifactBlobs returns a copy of ctx with which FromDescriptor will treat
+// the blobs with the given digests as artifact blobs, which are returned
+// unparsed regardless of their media type.
+func withArtifactBlobs(ctx context.Context, blobs map[digest.Digest]struct{}) context.Context {
+	if len(blobs) == 0 && len(artifactBlobsFromContext(ctx)) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, artifactBlobsKey{}, blobs)
+}
+
+// childContext returns the context with which the children of the given
+// (parsed) blob should be passed to FromDescriptor. The blobs of artifacts can
+// have arbitrary media types, so they are only treated as opaque when they are
+// reached through an artifact manifest -- blobs of unknown media types are
+// otherwise rejected.
+func childContext(ctx context.Context, blob *Blob) context.Context {
+	return withArtifactBlobs(ctx, artifactBlobs(blob))
+}
+
+// isArtifactBlob returns whether the blob with the given digest is a blob of
+// the artifact manifest whose children are being walked with ctx.
+func isArtifactBlob(ctx context.Context, blobDigest digest.Digest) bool {
+	_, ok := artifactBlobsFromContext(ctx)[blobDigest]
+	return ok
+}
+
+// artifactBlobsFromContext returns the artifact blobs attached to ctx.
+func artifactBlobsFromContext(ctx context.Context) map[digest.Digest]struct{} {
+	blobs, _ := ctx.Value(artifactBlobsKey{}).(map[digest.Digest]struct{})
+	return blobs
+}
+
+// Attach creates an artifact manifest of the given artifactType, whose layers
+// are the given blobs (which must already be stored in the image), and adds
+// it to the referrers index of subject. The descriptor of the new artifact
+// manifest is returned. If blobs is empty, the artifact consists only of its
+// annotations. Concurrent calls to Attach for the same subject don't lose each
+// other's artifacts if the engine implements cas.UpdatingEngine.
+func (e Engine) Attach(ctx context.Context, subject ispec.Descriptor, artifactType string, blobs []ispec.Descriptor, annotations map[string]string) (ispec.Descriptor, error) {
+	if artifactType == "" {
+		return ispec.Descriptor{}, errors.Errorf("attach: artifact type must be specified")
+	}
+
+	// Make sure that the subject actually exists.
+	reader, err := e.GetBlob(ctx, subject.Digest)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get subject")
+	}
+	reader.Close()
+
+	empty, err := e.putEmptyJSON(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	// Manifests must have at least one layer, so artifacts without any blobs
+	// use the empty blob.
+	layers := append([]ispec.Descriptor{}, blobs...)
+	if len(layers) == 0 {
+		layers = append(layers, empty)
+	}
+
+	manifest := ArtifactManifest{
+		Manifest: ispec.Manifest{
+			Versioned: imeta.Versioned{
+				SchemaVersion: 2,
+			},
+			Config:      empty,
+			Layers:      layers,
+			Annotations: annotations,
+		},
+		ArtifactType: artifactType,
+		Subject:      &subject,
+	}
+	manifestDigest, manifestSize, err := e.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put artifact manifest")
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+
+	// Add the artifact to the referrers index. If the index is modified
+	// concurrently (by another Attach for instance), we start again with the
+	// new index rather than dropping the other artifacts.
+	name := ReferrersTag(subject.Digest)
+	for attempt := 1; ; attempt++ {
+		err := e.attachReferrer(ctx, name, subject.Digest, descriptor)
+		if !isReferenceConflict(err) || attempt >= maxAttachAttempts {
+			return descriptor, err
+		}
+		event.Log(ctx).WithFields(event.Fields{
+			"name":    name,
+			"attempt": attempt,
+		}).Debugf("attach: referrers index was modified concurrently, retrying")
+	}
+}
+
+// maxAttachAttempts is the number of times Attach tries to update a referrers
+// index which is being modified concurrently.
+const maxAttachAttempts = 10
+
+// isReferenceConflict returns whether err is the result of the reference
+// being modified (or removed) after it was read.
+func isReferenceConflict(err error) bool {
+	cause := errors.Cause(err)
+	return cause == cas.ErrClobber || os.IsNotExist(cause)
+}
+
+// attachReferrer adds the given artifact manifest to the referrers index
+// stored in the reference with the given name. If the reference is modified
+// after it was read, an error for which isReferenceConflict is true is
+// returned and the reference is left alone.
+func (e Engine) attachReferrer(ctx context.Context, name string, subject digest.Digest, artifact ispec.Descriptor) error {
+	index, old, err := e.referrersIndex(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, entry := range index.Manifests {
+		if entry.Digest == artifact.Digest {
+			// Already attached.
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, ispec.ManifestDescriptor{
+		Descriptor: artifact,
+	})
+	if index.Annotations == nil {
+		index.Annotations = map[string]string{}
+	}
+	index.Annotations[AnnotationReferrersSubject] = subject.String()
+
+	indexDigest, indexSize, err := e.PutBlobJSON(ctx, index)
+	if err != nil {
+		return errors.Wrap(err, "put referrers index")
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifestList,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}
+
+	if updater, ok := e.Engine.(cas.UpdatingEngine); ok {
+		err := updater.UpdateReference(ctx, name, old, descriptor)
+		if errors.Cause(err) != cas.ErrNotImplemented {
+			return errors.Wrap(err, "update referrers index")
+		}
+	}
+
+	// Fall back to checking the reference ourselves, which is racy but still
+	// catches most concurrent modifications. PutReference refuses to
+	// overwrite a reference which was created after we read it.
+	if old != nil {
+		current, err := e.GetReference(ctx, name)
+		if err != nil {
+			return errors.Wrap(err, "get referrers index")
+		}
+		if !reflect.DeepEqual(current, *old) {
+			return errors.Wrap(&cas.ClobberError{Name: name, Old: current, New: descriptor}, "update referrers index")
+		}
+		if err := e.DeleteReference(ctx, name); err != nil {
+			return errors.Wrap(err, "delete old referrers index")
+		}
+	}
+	return errors.Wrap(e.PutReference(ctx, name, descriptor), "put referrers index")
+}
+
+// putEmptyJSON stores the empty JSON blob, returning its descriptor.
+func (e Engine) putEmptyJSON(ctx context.Context) (ispec.Descriptor, error) {
+	emptyDigest, emptySize, err := e.PutBlob(ctx, bytes.NewReader([]byte("{}")))
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put empty config")
+	}
+	return ispec.Descriptor{
+		MediaType: MediaTypeEmptyJSON,
+		Digest:    emptyDigest,
+		Size:      emptySize,
+	}, nil
+}
+
+// PutArtifact creates a standalone artifact manifest (which is not attached
+// to a subject, unlike with Attach), so that arbitrary content (such as Helm
+// charts, WASM modules or policy bundles) can be stored in an image. The
+// blobs and config (which must already be stored in the image) can have any
+// media type. If config is nil, the empty JSON blob is used as the
+// configuration and artifactType must be specified. If blobs is empty, the
+// artifact consists only of its configuration and annotations. The descriptor
+// of the new artifact manifest is returned, it is the caller's responsibility
+// to create a reference to it.
+func (e Engine) PutArtifact(ctx context.Context, artifactType string, config *ispec.Descriptor, blobs []ArtifactBlob, annotations map[string]string) (ispec.Descriptor, error) {
+	if config == nil && artifactType == "" {
+		return ispec.Descriptor{}, errors.Errorf("put artifact: artifact type must be specified without a config")
+	}
+	for _, blob := range blobs {
+		if blob.MediaType == "" {
+			return ispec.Descriptor{}, errors.Errorf("put artifact: blob %s has no media type", blob.Digest)
+		}
+	}
+
+	empty, err := e.putEmptyJSON(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	if config == nil {
+		config = &empty
+	}
+	if config.MediaType == "" {
+		return ispec.Descriptor{}, errors.Errorf("put artifact: config %s has no media type", config.Digest)
+	}
+
+	// Manifests must have at least one layer, so artifacts without any blobs
+	// use the empty blob.
+	layers := append([]ArtifactBlob{}, blobs...)
+	if len(layers) == 0 {
+		layers = append(layers, ArtifactBlob{Descriptor: empty})
+	}
+
+	manifest := artifactManifestBlobs{
+		ArtifactManifest: ArtifactManifest{
+			Manifest: ispec.Manifest{
+				Versioned: imeta.Versioned{
+					SchemaVersion: 2,
+				},
+				Config:      *config,
+				Annotations: annotations,
+			},
+			ArtifactType: artifactType,
+		},
+		Layers: layers,
+	}
+	manifestDigest, manifestSize, err := e.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put artifact manifest")
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}, nil
+}
+
+// GetArtifact returns the artifact manifest referenced by the given
+// descriptor, along with the descriptors (and annotations) of its blobs. The
+// empty JSON blob used by artifacts without any blobs is not returned. Any
+// image manifest can be read as an artifact (image manifests simply have no
+// artifact type).
+func (e Engine) GetArtifact(ctx context.Context, descriptor ispec.Descriptor) (ArtifactManifest, []ArtifactBlob, error) {
+	manifest, err := e.artifactManifestBlobs(ctx, descriptor)
+	if err != nil {
+		return ArtifactManifest{}, nil, err
+	}
+
+	var blobs []ArtifactBlob
+	for _, blob := range manifest.Layers {
+		if blob.MediaType == MediaTypeEmptyJSON && len(manifest.Layers) == 1 {
+			continue
+		}
+		blobs = append(blobs, blob)
+	}
+	return manifest.manifest(), blobs, nil
+}
+
+// referrersIndex returns the referrers index stored in the reference with the
+// given name and the descriptor stored in the reference, or a new (empty)
+// index and a nil descriptor if the reference doesn't exist.
+func (e Engine) referrersIndex(ctx context.Context, name string) (ispec.ManifestList, *ispec.Descriptor, error) {
+	index := ispec.ManifestList{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []ispec.ManifestDescriptor{},
+	}
+
+	descriptor, err := e.GetReference(ctx, name)
+	if os.IsNotExist(errors.Cause(err)) {
+		return index, nil, nil
+	} else if err != nil {
+		return index, nil, errors.Wrap(err, "get referrers index")
+	}
+
+	blob, err := e.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return index, nil, errors.Wrap(err, "get referrers index")
+	}
+	defer blob.Close()
+
+	list, ok := blob.Data.(ispec.ManifestList)
+	if !ok {
+		return index, nil, errors.Errorf("reference %s is not a referrers index: %s", name, descriptor.MediaType)
+	}
+	index.Manifests = append(index.Manifests, list.Manifests...)
+	index.Annotations = list.Annotations
+	return index, &descriptor, nil
+}
+
+// Artifacts returns the artifacts attached to the given subject (in other
+// words, its referrers), in the order they were attached. If artifactType is
+// non-empty, only artifacts of that type are returned.
+func (e Engine) Artifacts(ctx context.Context, subject digest.Digest, artifactType string) ([]Artifact, error) {
+	index, _, err := e.referrersIndex(ctx, ReferrersTag(subject))
+	if err != nil {
+		return nil, err
+	}
+
+	var artifacts []Artifact
+	for _, entry := range index.Manifests {
+		manifest, err := e.artifactManifest(ctx, entry.Descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get artifact %s", entry.Digest)
+		}
+		if manifest.Subject == nil || manifest.Subject.Digest != subject {
+			return nil, errors.Errorf("artifact %s in referrers index of %s has a different subject", entry.Digest, subject)
+		}
+		if artifactType != "" && manifest.ArtifactType != artifactType {
+			continue
+		}
+		artifacts = append(artifacts, Artifact{
+			Descriptor:   entry.Descriptor,
+			ArtifactType: manifest.ArtifactType,
+			Annotations:  manifest.Annotations,
+		})
+	}
+	return artifacts, nil
+}
+
+// artifactManifest parses the artifact manifest referenced by the given
+// descriptor. FromDescriptor cannot be used, as it would drop the fields
+// which are not part of ispec.Manifest.
+func (e Engine) artifactManifest(ctx context.Context, descriptor ispec.Descriptor) (ArtifactManifest, error) {
+	manifest, err := e.artifactManifestBlobs(ctx, descriptor)
+	if err != nil {
+		return ArtifactManifest{}, err
+	}
+	return manifest.manifest(), nil
+}
+
+// artifactManifestBlobs is the same as artifactManifest, except that the
+// annotations of the blobs of the manifest are also returned.
+func (e Engine) artifactManifestBlobs(ctx context.Context, descriptor ispec.Descriptor) (artifactManifestBlobs, error) {
+	var manifest artifactManifestBlobs
+
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return manifest, errors.Errorf("unsupported artifact manifest type: %s", descriptor.MediaType)
+	}
+
+	data, err := e.ReadMetadataBlob(ctx, descriptor)
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(data, &manifest)
+	return manifest, errors.Wrap(err, "parse artifact manifest")
+}
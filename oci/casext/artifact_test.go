@@ -0,0 +1,244 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestPutArtifact(t *testing.T) {
+	ctx := context.Background()
+	engine := Engine{mem.New()}
+	defer engine.Close()
+
+	putBlob := func(data, mediaType string) ispec.Descriptor {
+		blobDigest, blobSize, err := engine.PutBlob(ctx, bytes.NewBufferString(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ispec.Descriptor{MediaType: mediaType, Digest: blobDigest, Size: blobSize}
+	}
+
+	// An artifact without a config must have a type.
+	if _, err := engine.PutArtifact(ctx, "", nil, nil, nil); err == nil {
+		t.Errorf("expected error putting artifact without type or config")
+	}
+
+	blobs := []ArtifactBlob{
+		{
+			Descriptor:  putBlob("wasm module", "application/wasm"),
+			Annotations: map[string]string{AnnotationTitle: "module.wasm"},
+		},
+		{
+			Descriptor: putBlob("policy", "application/vnd.example.policy"),
+		},
+	}
+	descriptor, err := engine.PutArtifact(ctx, "application/vnd.example.module", nil, blobs, map[string]string{"version": "1"})
+	if err != nil {
+		t.Fatalf("unexpected error putting artifact: %+v", err)
+	}
+
+	manifest, gotBlobs, err := engine.GetArtifact(ctx, descriptor)
+	if err != nil {
+		t.Fatalf("unexpected error getting artifact: %+v", err)
+	}
+	if manifest.ArtifactType != "application/vnd.example.module" {
+		t.Errorf("unexpected artifact type: %s", manifest.ArtifactType)
+	}
+	if manifest.Subject != nil {
+		t.Errorf("unexpected subject: %v", manifest.Subject)
+	}
+	if manifest.Config.MediaType != MediaTypeEmptyJSON {
+		t.Errorf("unexpected config media type: %s", manifest.Config.MediaType)
+	}
+	if manifest.Annotations["version"] != "1" {
+		t.Errorf("unexpected annotations: %v", manifest.Annotations)
+	}
+	if !reflect.DeepEqual(gotBlobs, blobs) {
+		t.Errorf("unexpected blobs: expected %v got %v", blobs, gotBlobs)
+	}
+	if len(manifest.Layers) != 2 || !reflect.DeepEqual(manifest.Layers[0], blobs[0].Descriptor) {
+		t.Errorf("unexpected layers: %v", manifest.Layers)
+	}
+
+	// Artifacts are reachable like any other manifest.
+	paths, err := engine.Paths(ctx, descriptor)
+	if err != nil {
+		t.Fatalf("unexpected error walking artifact: %+v", err)
+	}
+	if len(paths) != 4 {
+		t.Errorf("expected artifact to have 4 blobs, got %d: %v", len(paths), paths)
+	}
+
+	// A custom config doesn't need an artifact type, and an artifact without
+	// blobs doesn't return the empty blob.
+	config := putBlob(`{"name":"chart"}`, "application/vnd.example.chart.config.v1+json")
+	descriptor, err = engine.PutArtifact(ctx, "", &config, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error putting artifact: %+v", err)
+	}
+	manifest, gotBlobs, err = engine.GetArtifact(ctx, descriptor)
+	if err != nil {
+		t.Fatalf("unexpected error getting artifact: %+v", err)
+	}
+	if !reflect.DeepEqual(manifest.Config, config) {
+		t.Errorf("unexpected config: expected %v got %v", config, manifest.Config)
+	}
+	if len(gotBlobs) != 0 {
+		t.Errorf("unexpected blobs: %v", gotBlobs)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != MediaTypeEmptyJSON {
+		t.Errorf("expected the empty blob as the only layer: %v", manifest.Layers)
+	}
+}
+
+func TestArtifactBlobsOpaque(t *testing.T) {
+	ctx := context.Background()
+	engine := Engine{mem.New()}
+	defer engine.Close()
+
+	putBlob := func(data, mediaType string) ispec.Descriptor {
+		blobDigest, blobSize, err := engine.PutBlob(ctx, bytes.NewBufferString(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ispec.Descriptor{MediaType: mediaType, Digest: blobDigest, Size: blobSize}
+	}
+
+	// Blobs of unknown media types are rejected outside of an artifact.
+	unknown := putBlob(`{"unknown":true}`, "application/vnd.example.unknown.v1+json")
+	if blob, err := engine.FromDescriptor(ctx, unknown); err == nil {
+		blob.Close()
+		t.Errorf("expected error getting blob of unknown media type")
+	}
+
+	// ... but the blobs of artifacts can have any media type.
+	config := putBlob(`{"name":"chart"}`, "application/vnd.example.chart.config.v1+json")
+	descriptor, err := engine.PutArtifact(ctx, "", &config, []ArtifactBlob{{Descriptor: unknown}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error putting artifact: %+v", err)
+	}
+	reachable, err := engine.Reachable(ctx, descriptor)
+	if err != nil {
+		t.Fatalf("unexpected error walking artifact: %+v", err)
+	}
+	if len(reachable) != 3 {
+		t.Errorf("expected artifact to have 3 blobs, got %d: %v", len(reachable), reachable)
+	}
+	dst := Engine{mem.New()}
+	defer dst.Close()
+	if n, err := engine.CopyTo(ctx, dst, descriptor); err != nil {
+		t.Fatalf("unexpected error copying artifact: %+v", err)
+	} else if n != 3 {
+		t.Errorf("expected 3 blobs to be copied, got %d", n)
+	}
+
+	// An image manifest doesn't make its layers artifact blobs.
+	imageConfig := putBlob(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`, ispec.MediaTypeImageConfig)
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: imageConfig,
+		Layers: []ispec.Descriptor{unknown},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+	if _, err := engine.Paths(ctx, manifest); err == nil {
+		t.Errorf("expected error walking image with a layer of unknown media type")
+	}
+}
+
+// nonUpdatingEngine hides the cas.UpdatingEngine implementation of the
+// wrapped engine.
+type nonUpdatingEngine struct {
+	cas.Engine
+}
+
+func TestAttachConcurrent(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		engine     cas.Engine
+		concurrent bool
+	}{
+		{"UpdatingEngine", mem.New(), true},
+		// The fallback for engines without atomic updates is racy, so the
+		// artifacts are attached one at a time.
+		{"Engine", nonUpdatingEngine{mem.New()}, false},
+	} {
+		ctx := context.Background()
+		engine := Engine{test.engine}
+
+		subjectDigest, subjectSize, err := engine.PutBlob(ctx, bytes.NewBufferString("subject"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject := ispec.Descriptor{MediaType: ispec.MediaTypeImageLayer, Digest: subjectDigest, Size: subjectSize}
+
+		// Every artifact must end up in the referrers index, even if they
+		// are all attached at the same time.
+		n := 8
+		var wg sync.WaitGroup
+		errs := make(chan error, n)
+		for idx := 0; idx < n; idx++ {
+			wg.Add(1)
+			attach := func(idx int) {
+				defer wg.Done()
+				_, err := engine.Attach(ctx, subject, fmt.Sprintf("application/vnd.example.%d", idx), nil, nil)
+				errs <- err
+			}
+			if test.concurrent {
+				go attach(idx)
+			} else {
+				attach(idx)
+			}
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Errorf("%s: unexpected error attaching artifact: %+v", test.name, err)
+			}
+		}
+
+		artifacts, err := engine.Artifacts(ctx, subjectDigest, "")
+		if err != nil {
+			t.Fatalf("%s: unexpected error listing artifacts: %+v", test.name, err)
+		}
+		if len(artifacts) != n {
+			t.Errorf("%s: expected %d artifacts, got %d: %v", test.name, n, len(artifacts), artifacts)
+		}
+		engine.Close()
+	}
+}
@@ -18,9 +18,13 @@
 package casext
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"strings"
 
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/opencontainers/go-digest"
@@ -32,7 +36,8 @@ import (
 // Blob represents a "parsed" blob in an OCI image's blob store. MediaType
 // offers a type-safe way of checking what the type of Data is.
 type Blob struct {
-	// MediaType is the OCI media type of Data.
+	// MediaType is the OCI media type of Data. Foreign media types with a
+	// registered MediaTypeConverter are translated to their OCI equivalent.
 	MediaType string
 
 	// Digest is the digest of the parsed image. Note that this does not update
@@ -51,24 +56,94 @@ type Blob struct {
 	// ispec.MediaTypeImageLayerNonDistributable => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributableGzip => io.ReadCloser
 	// ispec.MediaTypeImageConfig => ispec.Image
+	// *+encrypted (encrypted layers) => io.ReadCloser
+	// MediaTypeLayerChunk => io.ReadCloser
+	// artifact blobs (of any other media type) => io.ReadCloser
 	Data interface{}
+
+	// Raw is the original JSON representation of Data, for the media types
+	// which are parsed (it is nil for opaque blobs). It can be used (with
+	// pkg/jsonmerge) to preserve any fields of the blob which are unknown to
+	// the parsed type.
+	Raw []byte
+
+	// opaque is whether Data is an io.ReadCloser.
+	opaque bool
+}
+
+// isOpaqueType returns whether blobs of the given media type are returned
+// unparsed (as an io.ReadCloser) by FromDescriptor.
+func isOpaqueType(mediaType string) bool {
+	switch mediaType {
+	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable,
+		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip,
+		MediaTypeLayerChunk:
+		return true
+	}
+	// Encrypted layers (such as those created by ocicrypt) are opaque as well,
+	// so that they can still be walked, copied and garbage collected.
+	return strings.HasSuffix(mediaType, "+encrypted")
 }
 
-func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
+// isParsedType returns whether blobs of the given media type are parsed by
+// FromDescriptor.
+func isParsedType(mediaType string) bool {
+	switch mediaType {
+	case ispec.MediaTypeDescriptor, ispec.MediaTypeImageManifest,
+		ispec.MediaTypeImageManifestList, ispec.MediaTypeImageConfig:
+		return true
+	}
+	return false
+}
+
+// isOpaqueBlob returns whether the blob with the given descriptor would be
+// returned unparsed by FromDescriptor with the given context. In addition to
+// the opaque media types, the blobs of artifacts are opaque regardless of
+// their media type (unless it is one that we parse), see childContext.
+func isOpaqueBlob(ctx context.Context, descriptor ispec.Descriptor) bool {
+	mediaType := ConvertMediaType(descriptor.MediaType)
+	if isOpaqueType(mediaType) {
+		return true
+	}
+	return !isParsedType(mediaType) && isArtifactBlob(ctx, descriptor.Digest)
+}
+
+// IsForeignLayerType returns whether the given media type is that of a
+// non-distributable ("foreign") layer, such as a Windows base layer. The blobs
+// of foreign layers are often not included in images (they are downloaded
+// from the URLs in their descriptors instead), so Walk, Visit and CopyTo skip
+// foreign layers whose blobs are missing rather than failing.
+func IsForeignLayerType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "application/vnd.oci.image.layer.nondistributable.")
+}
+
+// isMissingForeignLayer returns whether err is the result of reading the blob
+// of a foreign layer which is not present in the image.
+func isMissingForeignLayer(descriptor ispec.Descriptor, err error) bool {
+	return IsForeignLayerType(descriptor.MediaType) && os.IsNotExist(errors.Cause(err))
+}
+
+// load reads and parses the blob, whose size is given by its descriptor (or
+// is -1 if unknown). Metadata blobs larger than the maximum metadata size of
+// engine are rejected (see NewLimitingEngine).
+func (b *Blob) load(ctx context.Context, engine cas.Engine, size int64) error {
+	// Blobs of foreign media types (such as Docker manifests) are translated
+	// to their OCI equivalents, see RegisterMediaTypeConverter.
+	foreignType := b.MediaType
+	b.MediaType = ConvertMediaType(b.MediaType)
+
+	if !b.opaque && !isParsedType(b.MediaType) {
+		return fmt.Errorf("cas blob: unsupported mediatype: %s", b.MediaType)
+	}
+
 	reader, err := engine.GetBlob(ctx, b.Digest)
 	if err != nil {
 		return errors.Wrap(err, "get blob")
 	}
 
-	// The layer media types are special, we don't want to do any parsing (or
-	// close the blob reference).
-	switch b.MediaType {
-	// ispec.MediaTypeImageLayer => io.ReadCloser
-	// ispec.MediaTypeImageLayerGzip => io.ReadCloser
-	// ispec.MediaTypeImageLayerNonDistributable => io.ReadCloser
-	// ispec.MediaTypeImageLayerNonDistributableGzip => io.ReadCloser
-	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable,
-		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+	// The layer (and other opaque) media types are special, we don't want to
+	// do any parsing (or close the blob reference).
+	if b.opaque {
 		// There isn't anything else we can practically do here.
 		b.Data = reader
 		return nil
@@ -76,6 +151,16 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 
 	defer reader.Close()
 
+	raw, err := readMetadata(reader, b.Digest, size, maxMetadataSize(engine))
+	if err != nil {
+		return errors.Wrap(err, "read blob")
+	}
+	raw, err = convertBlob(foreignType, raw)
+	if err != nil {
+		return err
+	}
+	b.Raw = raw
+
 	// It would be great if this code didn't require tying the JSON decoding to
 	// the type decisions -- but because of Go's lack of generics we can't
 	// return regular structs as an interface without some ugly code.
@@ -83,7 +168,7 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 	// ispec.MediaTypeDescriptor => ispec.Descriptor
 	case ispec.MediaTypeDescriptor:
 		parsed := ispec.Descriptor{}
-		if err := json.NewDecoder(reader).Decode(&parsed); err != nil {
+		if err := json.NewDecoder(bytes.NewReader(raw)).Decode(&parsed); err != nil {
 			return errors.Wrap(err, "parse MediaTypeDescriptor")
 		}
 		b.Data = parsed
@@ -91,7 +176,7 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 	// ispec.MediaTypeImageManifest => ispec.Manifest
 	case ispec.MediaTypeImageManifest:
 		parsed := ispec.Manifest{}
-		if err := json.NewDecoder(reader).Decode(&parsed); err != nil {
+		if err := json.NewDecoder(bytes.NewReader(raw)).Decode(&parsed); err != nil {
 			return errors.Wrap(err, "parse MediaTypeImageManifest")
 		}
 		b.Data = parsed
@@ -99,7 +184,7 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 	// ispec.MediaTypeImageManifestList => ispec.ManifestList
 	case ispec.MediaTypeImageManifestList:
 		parsed := ispec.ManifestList{}
-		if err := json.NewDecoder(reader).Decode(&parsed); err != nil {
+		if err := json.NewDecoder(bytes.NewReader(raw)).Decode(&parsed); err != nil {
 			return errors.Wrap(err, "parse MediaTypeImageManifestList")
 		}
 		b.Data = parsed
@@ -107,13 +192,14 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 	// ispec.MediaTypeImageConfig => ispec.Image
 	case ispec.MediaTypeImageConfig:
 		parsed := ispec.Image{}
-		if err := json.NewDecoder(reader).Decode(&parsed); err != nil {
+		if err := json.NewDecoder(bytes.NewReader(raw)).Decode(&parsed); err != nil {
 			return errors.Wrap(err, "parse MediaTypeImageConfig")
 		}
 		b.Data = parsed
 
 	default:
-		return fmt.Errorf("cas blob: unsupported mediatype: %s", b.MediaType)
+		// Should _never_ be reached.
+		return fmt.Errorf("[internal error] cas blob: unsupported mediatype: %s", b.MediaType)
 	}
 
 	if b.Data == nil {
@@ -125,12 +211,8 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 
 // Close cleans up all of the resources for the opened blob.
 func (b *Blob) Close() {
-	switch b.MediaType {
-	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable,
-		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
-		if b.Data != nil {
-			b.Data.(io.Closer).Close()
-		}
+	if b.opaque && b.Data != nil {
+		b.Data.(io.Closer).Close()
 	}
 }
 
@@ -140,11 +222,82 @@ func (e Engine) FromDescriptor(ctx context.Context, descriptor ispec.Descriptor)
 		MediaType: descriptor.MediaType,
 		Digest:    descriptor.Digest,
 		Data:      nil,
+		opaque:    isOpaqueBlob(ctx, descriptor),
 	}
 
-	if err := blob.load(ctx, e); err != nil {
+	// The blobs of chunked layers are not stored, so we have to reassemble
+	// them from their chunks.
+	if chunks, ok := layerChunksFromContext(ctx)[descriptor.Digest]; ok && blob.opaque {
+		blob.MediaType = ConvertMediaType(blob.MediaType)
+		blob.Data = e.openChunks(ctx, descriptor, chunks)
+	} else if err := blob.load(ctx, e, descriptorSize(descriptor)); err != nil {
 		return nil, errors.Wrap(err, "load")
 	}
+	if isStrict(e.Engine) {
+		if err := blob.validate(); err != nil {
+			blob.Close()
+			return nil, err
+		}
+	}
 
 	return blob, nil
 }
+
+// GetBlobAt opens the blob with the given digest for random access, returning
+// the opened blob (which the caller must Close()) and its size. If the engine
+// is a cas.RandomAccessEngine the blob is opened directly (and is not
+// verified), otherwise the blob is copied into an unlinked temporary file
+// (verifying its digest) which is returned instead.
+func (e Engine) GetBlobAt(ctx context.Context, blobDigest digest.Digest) (cas.BlobReaderAt, int64, error) {
+	if engine, ok := e.Engine.(cas.RandomAccessEngine); ok {
+		reader, size, err := engine.GetBlobAt(ctx, blobDigest)
+		if errors.Cause(err) != cas.ErrNotImplemented {
+			return reader, size, errors.Wrap(err, "get blob")
+		}
+	}
+
+	reader, err := e.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return nil, -1, errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	fh, err := ioutil.TempFile("", "umoci-blob-")
+	if err != nil {
+		return nil, -1, errors.Wrap(err, "create temporary blob")
+	}
+	// The file only needs to exist for as long as it is open.
+	os.Remove(fh.Name())
+
+	verifier := blobDigest.Verifier()
+	size, err := io.Copy(io.MultiWriter(fh, verifier), reader)
+	if err != nil {
+		fh.Close()
+		return nil, -1, errors.Wrap(err, "copy blob")
+	}
+	if !verifier.Verified() {
+		fh.Close()
+		return nil, -1, errors.Wrapf(cas.ErrDigestMismatch, "blob %s", blobDigest)
+	}
+	return fh, size, nil
+}
+
+// ManifestLayerAnnotations returns the annotations of the layer descriptors of
+// the given manifest blob (such as Blob.Raw), in the same order as its layers.
+// They are not part of the ispec.Descriptor of the version of the image-spec
+// we use, but are needed for (among other things) encrypted layers.
+func ManifestLayerAnnotations(raw []byte) ([]map[string]string, error) {
+	var manifest struct {
+		Layers []struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, errors.Wrap(err, "parse manifest layer annotations")
+	}
+	annotations := make([]map[string]string, len(manifest.Layers))
+	for idx, layer := range manifest.Layers {
+		annotations[idx] = layer.Annotations
+	}
+	return annotations, nil
+}
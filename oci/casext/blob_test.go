@@ -0,0 +1,78 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// plainEngine hides the optional interfaces of the engine it wraps.
+type plainEngine struct {
+	cas.Engine
+}
+
+func TestGetBlobAt(t *testing.T) {
+	ctx := context.Background()
+	memEngine := mem.New()
+	defer memEngine.Close()
+
+	data := []byte("header|some large blob contents|footer")
+	blobDigest, _, err := memEngine.PutBlob(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		engine Engine
+	}{
+		{"RandomAccess", Engine{memEngine}},
+		{"Fallback", Engine{plainEngine{memEngine}}},
+	} {
+		reader, size, err := test.engine.GetBlobAt(ctx, blobDigest)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %+v", test.name, err)
+		}
+		if size != int64(len(data)) {
+			t.Errorf("%s: unexpected size: expected %d got %d", test.name, len(data), size)
+		}
+		footer := make([]byte, len("footer"))
+		if _, err := reader.ReadAt(footer, size-int64(len(footer))); err != nil {
+			t.Errorf("%s: unexpected error reading: %+v", test.name, err)
+		}
+		if string(footer) != "footer" {
+			t.Errorf("%s: unexpected contents: %q", test.name, footer)
+		}
+		if err := reader.Close(); err != nil {
+			t.Errorf("%s: unexpected error closing: %+v", test.name, err)
+		}
+
+		missing := digest.FromString("missing")
+		if _, _, err := test.engine.GetBlobAt(ctx, missing); !os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("%s: expected os.ErrNotExist for missing blob, got %v", test.name, err)
+		}
+	}
+}
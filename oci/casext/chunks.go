@@ -0,0 +1,293 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// LayerChunksAnnotation is the manifest annotation describing the layers
+	// of the image whose blobs are stored as several smaller "chunk" blobs
+	// (for storage with a limit on the size of blobs). Its value is a JSON
+	// object mapping the digest of each chunked layer to the list of
+	// descriptors of its chunks, whose concatenation is the layer blob. The
+	// blobs of chunked layers are not present in the image.
+	LayerChunksAnnotation = "org.opensuse.umoci.layer.chunks"
+
+	// MediaTypeLayerChunk is the media type of the descriptors of the chunks
+	// of a chunked layer.
+	MediaTypeLayerChunk = "application/vnd.opensuse.umoci.layer.chunk.v1"
+)
+
+// LayerChunks maps the digest of each chunked layer to the descriptors of its
+// chunks (in order).
+type LayerChunks map[digest.Digest][]ispec.Descriptor
+
+// ManifestLayerChunks returns the chunked layers of the given manifest, as
+// described by its LayerChunksAnnotation. If the manifest has no chunked
+// layers, nil is returned. Chunks of layers which are no longer in the
+// manifest are ignored, but it is an error for the chunks of a layer not to
+// add up to the size of the layer.
+func ManifestLayerChunks(manifest ispec.Manifest) (LayerChunks, error) {
+	value, ok := manifest.Annotations[LayerChunksAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var chunks LayerChunks
+	if err := json.Unmarshal([]byte(value), &chunks); err != nil {
+		return nil, errors.Wrapf(err, "parse %s annotation", LayerChunksAnnotation)
+	}
+
+	sizes := map[digest.Digest]int64{}
+	for _, layer := range manifest.Layers {
+		sizes[layer.Digest] = layer.Size
+	}
+	for layerDigest, layerChunks := range chunks {
+		layerSize, ok := sizes[layerDigest]
+		if !ok {
+			delete(chunks, layerDigest)
+			continue
+		}
+		var size int64
+		for _, chunk := range layerChunks {
+			size += chunk.Size
+		}
+		if len(layerChunks) == 0 || size != layerSize {
+			return nil, errors.Errorf("chunks of layer %s have size %d rather than %d", layerDigest, size, layerSize)
+		}
+	}
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+	return chunks, nil
+}
+
+// SetManifestLayerChunks sets the LayerChunksAnnotation of the given manifest
+// to describe the given chunks of its layers. The chunks of layers which are
+// not in the manifest are ignored, and the annotation is removed if none of
+// its layers are chunked.
+func SetManifestLayerChunks(manifest *ispec.Manifest, chunks LayerChunks) error {
+	used := LayerChunks{}
+	for _, layer := range manifest.Layers {
+		if layerChunks, ok := chunks[layer.Digest]; ok {
+			used[layer.Digest] = layerChunks
+		}
+	}
+	if len(used) == 0 {
+		delete(manifest.Annotations, LayerChunksAnnotation)
+		return nil
+	}
+
+	value, err := json.Marshal(used)
+	if err != nil {
+		return errors.Wrapf(err, "encode %s annotation", LayerChunksAnnotation)
+	}
+	if manifest.Annotations == nil {
+		manifest.Annotations = map[string]string{}
+	}
+	manifest.Annotations[LayerChunksAnnotation] = string(value)
+	return nil
+}
+
+// layerChunksKey is the context key for the LayerChunks of WithLayerChunks.
+type layerChunksKey struct{}
+
+// WithLayerChunks returns a copy of ctx with which FromDescriptor will
+// transparently read the blobs of the given chunked layers by concatenating
+// their chunks. Any chunked layers already attached to ctx are retained.
+func WithLayerChunks(ctx context.Context, chunks LayerChunks) context.Context {
+	if len(chunks) == 0 {
+		return ctx
+	}
+	merged := LayerChunks{}
+	for layerDigest, layerChunks := range layerChunksFromContext(ctx) {
+		merged[layerDigest] = layerChunks
+	}
+	for layerDigest, layerChunks := range chunks {
+		merged[layerDigest] = layerChunks
+	}
+	return context.WithValue(ctx, layerChunksKey{}, merged)
+}
+
+// WithManifestLayerChunks is WithLayerChunks for the chunked layers of the
+// given manifest (see ManifestLayerChunks).
+func WithManifestLayerChunks(ctx context.Context, manifest ispec.Manifest) (context.Context, error) {
+	chunks, err := ManifestLayerChunks(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return WithLayerChunks(ctx, chunks), nil
+}
+
+// layerChunksFromContext returns the LayerChunks attached to ctx.
+func layerChunksFromContext(ctx context.Context) LayerChunks {
+	chunks, _ := ctx.Value(layerChunksKey{}).(LayerChunks)
+	return chunks
+}
+
+// blobChildren returns the child descriptors of the given blob, with the
+// descriptors of chunked layers replaced by the descriptors of their chunks
+// (since the blobs of chunked layers are not stored).
+func blobChildren(blob *Blob) ([]ispec.Descriptor, error) {
+	children := childDescriptors(blob.Data)
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok {
+		return children, nil
+	}
+	chunks, err := ManifestLayerChunks(manifest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get chunked layers of %s", blob.Digest)
+	}
+	if len(chunks) == 0 {
+		return children, nil
+	}
+
+	var expanded []ispec.Descriptor
+	for _, child := range children {
+		if layerChunks, ok := chunks[child.Digest]; ok {
+			expanded = append(expanded, layerChunks...)
+		} else {
+			expanded = append(expanded, child)
+		}
+	}
+	return expanded, nil
+}
+
+// PutBlobChunks is like PutBlob, except that a blob larger than maxSize is
+// stored as a series of chunks of (at most) maxSize bytes. The returned
+// digest and size are of the whole blob. If the blob was split, the
+// descriptors of its chunks are returned and the blob itself is not stored.
+// Otherwise, the blob is stored as usual and no chunks are returned.
+func (e Engine) PutBlobChunks(ctx context.Context, reader io.Reader, maxSize int64) (digest.Digest, int64, []ispec.Descriptor, error) {
+	if maxSize <= 0 {
+		return "", -1, nil, errors.Errorf("invalid maximum blob size: %d", maxSize)
+	}
+
+	digester := cas.BlobAlgorithm.Digester()
+	buffered := bufio.NewReader(io.TeeReader(reader, digester.Hash()))
+
+	var chunks []ispec.Descriptor
+	var size int64
+	for {
+		// Don't write an empty chunk once we've reached the end.
+		if _, err := buffered.Peek(1); err == io.EOF && len(chunks) > 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return "", -1, nil, errors.Wrap(err, "read blob")
+		}
+
+		chunkDigest, chunkSize, err := e.PutBlob(ctx, io.LimitReader(buffered, maxSize))
+		if err != nil {
+			return "", -1, nil, errors.Wrapf(err, "put chunk %d", len(chunks))
+		}
+		chunks = append(chunks, ispec.Descriptor{
+			MediaType: MediaTypeLayerChunk,
+			Digest:    chunkDigest,
+			Size:      chunkSize,
+		})
+		size += chunkSize
+	}
+
+	// A blob which fits in a single chunk is an ordinary blob.
+	if len(chunks) == 1 {
+		return chunks[0].Digest, size, nil, nil
+	}
+	return digester.Digest(), size, chunks, nil
+}
+
+// openChunks returns a reader for the blob of the given chunked layer, which
+// reads each of its chunks in turn. The blob is verified against the
+// descriptor as it is read, and a mismatch is reported (instead of io.EOF)
+// once the end of the blob is reached.
+func (e Engine) openChunks(ctx context.Context, descriptor ispec.Descriptor, chunks []ispec.Descriptor) io.ReadCloser {
+	return &chunkReader{
+		ctx:        ctx,
+		engine:     e,
+		descriptor: descriptor,
+		chunks:     chunks,
+		verifier:   descriptor.Digest.Verifier(),
+	}
+}
+
+// chunkReader is the io.ReadCloser returned by openChunks.
+type chunkReader struct {
+	ctx        context.Context
+	engine     Engine
+	descriptor ispec.Descriptor
+
+	// chunks are the chunks which haven't been opened yet, and current is the
+	// chunk being read (if any).
+	chunks  []ispec.Descriptor
+	current io.ReadCloser
+
+	verifier digest.Verifier
+	size     int64
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for r.current == nil {
+		if len(r.chunks) == 0 {
+			return 0, r.verify()
+		}
+		chunk := r.chunks[0]
+		r.chunks = r.chunks[1:]
+		reader, err := r.engine.GetBlob(r.ctx, chunk.Digest)
+		if err != nil {
+			return 0, errors.Wrapf(err, "get chunk %s of layer %s", chunk.Digest, r.descriptor.Digest)
+		}
+		r.current = reader
+	}
+
+	n, err := r.current.Read(p)
+	r.verifier.Write(p[:n])
+	r.size += int64(n)
+	if err == io.EOF {
+		r.current.Close()
+		r.current = nil
+		err = nil
+	}
+	return n, err
+}
+
+// verify returns io.EOF if the blob read matched its descriptor, otherwise an
+// error describing the mismatch.
+func (r *chunkReader) verify() error {
+	if r.size != r.descriptor.Size {
+		return errors.Errorf("chunks of layer %s have size %d rather than %d", r.descriptor.Digest, r.size, r.descriptor.Size)
+	}
+	if !r.verifier.Verified() {
+		return errors.Wrapf(cas.ErrDigestMismatch, "chunks of layer %s", r.descriptor.Digest)
+	}
+	return io.EOF
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestPutBlobChunks(t *testing.T) {
+	ctx := context.Background()
+	engine := Engine{mem.New()}
+	defer engine.Close()
+
+	for _, test := range []struct {
+		size, maxSize int64
+		chunks        []int64
+	}{
+		{0, 10, nil},
+		{10, 10, nil},
+		{11, 10, []int64{10, 1}},
+		{30, 10, []int64{10, 10, 10}},
+		{25, 10, []int64{10, 10, 5}},
+	} {
+		data := bytes.Repeat([]byte("x"), int(test.size))
+		blobDigest, size, chunks, err := engine.PutBlobChunks(ctx, bytes.NewReader(data), test.maxSize)
+		if err != nil {
+			t.Fatalf("unexpected error putting %d bytes: %+v", test.size, err)
+		}
+		if expected := cas.BlobAlgorithm.FromBytes(data); blobDigest != expected || size != test.size {
+			t.Errorf("%d bytes: got blob %s (%d bytes), expected %s", test.size, blobDigest, size, expected)
+		}
+		if len(chunks) != len(test.chunks) {
+			t.Fatalf("%d bytes: got %d chunks, expected %d", test.size, len(chunks), len(test.chunks))
+		}
+
+		// Only unchunked blobs are stored in their entirety.
+		reader, err := engine.GetBlob(ctx, blobDigest)
+		if chunks == nil && err != nil {
+			t.Errorf("%d bytes: unexpected error getting blob: %+v", test.size, err)
+		} else if chunks != nil && !os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("%d bytes: expected chunked blob to be missing: %+v", test.size, err)
+		}
+		if reader != nil {
+			reader.Close()
+		}
+		for idx, chunk := range chunks {
+			if chunk.MediaType != MediaTypeLayerChunk || chunk.Size != test.chunks[idx] {
+				t.Errorf("%d bytes: unexpected chunk %d: %+v", test.size, idx, chunk)
+			}
+		}
+	}
+
+	if _, _, _, err := engine.PutBlobChunks(ctx, bytes.NewReader(nil), 0); err == nil {
+		t.Errorf("expected an error with a maximum size of 0")
+	}
+}
+
+// putChunkedImage creates an image with a single layer which is split into
+// chunks, returning the descriptors of its manifest and layer and the layer
+// contents.
+func putChunkedImage(t *testing.T, engine Engine) (ispec.Descriptor, ispec.Descriptor, []byte) {
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("chunked layer "), 100)
+	layerDigest, layerSize, chunks, err := engine.PutBlobChunks(ctx, bytes.NewReader(data), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := ispec.Descriptor{MediaType: ispec.MediaTypeImageLayer, Digest: layerDigest, Size: layerSize}
+
+	config := putJSON(t, engine, ispec.MediaTypeImageConfig, ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		RootFS:       ispec.RootFS{Type: "layers"},
+	})
+	manifest := ispec.Manifest{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		Config:    config,
+		Layers:    []ispec.Descriptor{layer},
+	}
+	if err := SetManifestLayerChunks(&manifest, LayerChunks{layerDigest: chunks}); err != nil {
+		t.Fatal(err)
+	}
+	return putJSON(t, engine, ispec.MediaTypeImageManifest, manifest), layer, data
+}
+
+func TestLayerChunks(t *testing.T) {
+	ctx := context.Background()
+	engine := Engine{mem.New()}
+	defer engine.Close()
+
+	root, layer, data := putChunkedImage(t, engine)
+	blob, err := engine.FromDescriptor(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := blob.Data.(ispec.Manifest)
+	blob.Close()
+
+	chunks, err := ManifestLayerChunks(manifest)
+	if err != nil {
+		t.Fatalf("unexpected error getting chunks: %+v", err)
+	}
+	if len(chunks[layer.Digest]) != 3 {
+		t.Fatalf("expected 3 chunks of layer, got %+v", chunks)
+	}
+
+	// Walking the image visits the chunks rather than the (missing) layer.
+	var digests []digest.Digest
+	if err := engine.Walk(ctx, root, func(descriptor ispec.Descriptor) error {
+		digests = append(digests, descriptor.Digest)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error walking image: %+v", err)
+	}
+	if len(digests) != 5 {
+		t.Errorf("expected to walk manifest, config and 3 chunks: got %v", digests)
+	}
+	for _, walked := range digests {
+		if walked == layer.Digest {
+			t.Errorf("walked chunked layer %s", layer.Digest)
+		}
+	}
+
+	// The layer can only be read with the chunks attached to the context.
+	if _, err := engine.FromDescriptor(ctx, layer); err == nil {
+		t.Errorf("expected an error reading chunked layer without its chunks")
+	}
+	chunkCtx, err := WithManifestLayerChunks(ctx, manifest)
+	if err != nil {
+		t.Fatalf("unexpected error attaching chunks: %+v", err)
+	}
+	layerBlob, err := engine.FromDescriptor(chunkCtx, layer)
+	if err != nil {
+		t.Fatalf("unexpected error reading chunked layer: %+v", err)
+	}
+	got, err := ioutil.ReadAll(layerBlob.Data.(io.Reader))
+	layerBlob.Close()
+	if err != nil {
+		t.Fatalf("unexpected error reading chunked layer: %+v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("chunked layer has unexpected contents")
+	}
+
+	// Chunks which don't match the layer are detected.
+	badChunks := LayerChunks{layer.Digest: append([]ispec.Descriptor{}, chunks[layer.Digest][1:]...)}
+	badChunks[layer.Digest] = append(badChunks[layer.Digest], chunks[layer.Digest][0])
+	layerBlob, err = engine.FromDescriptor(WithLayerChunks(ctx, badChunks), layer)
+	if err != nil {
+		t.Fatalf("unexpected error opening chunked layer: %+v", err)
+	}
+	_, err = ioutil.ReadAll(layerBlob.Data.(io.Reader))
+	layerBlob.Close()
+	if err == nil {
+		t.Errorf("expected an error reading reordered chunks")
+	}
+
+	// Removing the layer from the manifest removes its chunks.
+	manifest.Layers = nil
+	if err := SetManifestLayerChunks(&manifest, chunks); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := manifest.Annotations[LayerChunksAnnotation]; ok {
+		t.Errorf("expected chunks of removed layer to be dropped")
+	}
+}
@@ -0,0 +1,357 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/openSUSE/umoci/pkg/jsonmerge"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// uploadSession returns the session ID used when copying the given blob to a
+// cas.ResumableEngine. It only depends on the digest, so that an interrupted
+// copy of the blob is resumed by the next copy of the same blob.
+func uploadSession(blobDigest digest.Digest) string {
+	return "copy-" + blobDigest.Algorithm().String() + "-" + blobDigest.Hex()
+}
+
+// copyBlobResumable copies a single blob from src to dst, resuming any
+// previously interrupted copy of the blob.
+func copyBlobResumable(ctx context.Context, dst cas.ResumableEngine, src cas.Engine, blobDigest digest.Digest) (int64, error) {
+	session := uploadSession(blobDigest)
+	offset, err := dst.BlobUploadOffset(ctx, session)
+	if err != nil {
+		return -1, errors.Wrap(err, "get destination upload offset")
+	}
+
+	reader, err := src.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return -1, errors.Wrap(err, "get source blob")
+	}
+	defer reader.Close()
+
+	if offset > 0 {
+		event.Log(ctx).WithFields(event.Fields{
+			"digest": blobDigest,
+			"offset": offset,
+		}).Infof("resuming interrupted copy of blob")
+		// Skip the part of the blob that has already been copied.
+		if _, err := io.CopyN(ioutil.Discard, reader, offset); err != nil {
+			// If we were cancelled, the partial blob can still be resumed.
+			if ctx.Err() != nil {
+				return -1, errors.Wrap(ctx.Err(), "skip copied part of source blob")
+			}
+			// The partial blob can't be a prefix of the source blob.
+			dst.AbortBlobUpload(ctx, session)
+			return -1, errors.Wrap(err, "skip copied part of source blob")
+		}
+	}
+
+	_, size, err := dst.PutBlobResumable(ctx, session, blobDigest, reader)
+	if err != nil {
+		return -1, errors.Wrap(err, "put destination blob")
+	}
+	return size, nil
+}
+
+// copyBlob copies a single blob from src to dst, verifying that the digest of
+// the copied blob matches the expected digest. If dst is a cas.LinkingEngine
+// which has the blob in its shared store, the blob is linked rather than
+// copied. If dst is a cas.ResumableEngine, an interrupted copy of the blob is
+// resumed.
+func copyBlob(ctx context.Context, dst, src cas.Engine, blobDigest digest.Digest) (int64, error) {
+	if linking, ok := dst.(cas.LinkingEngine); ok {
+		size, err := linking.LinkBlob(ctx, blobDigest)
+		if err == nil {
+			return size, nil
+		}
+		if cause := errors.Cause(err); cause != cas.ErrNotImplemented && !os.IsNotExist(cause) {
+			return -1, errors.Wrap(err, "link destination blob")
+		}
+	}
+	if resumable, ok := dst.(cas.ResumableEngine); ok {
+		size, err := copyBlobResumable(ctx, resumable, src, blobDigest)
+		if errors.Cause(err) != cas.ErrNotImplemented {
+			return size, err
+		}
+	}
+
+	reader, err := src.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return -1, errors.Wrap(err, "get source blob")
+	}
+	defer reader.Close()
+
+	gotDigest, size, err := dst.PutBlob(ctx, reader)
+	if err != nil {
+		return -1, errors.Wrap(err, "put destination blob")
+	}
+	if gotDigest != blobDigest {
+		// Don't leave a bogus blob in the destination.
+		dst.DeleteBlob(ctx, gotDigest)
+		return -1, errors.Wrap(&cas.DigestMismatchError{Expected: blobDigest, Actual: gotDigest}, "copy blob")
+	}
+	return size, nil
+}
+
+// CopyTo copies all blobs reachable from the given root descriptor into the
+// destination engine. Blobs which are already present in the destination are
+// not copied. Blobs are copied such that a blob is only added to the
+// destination after all of its children have been added, so an interrupted
+// copy will never leave a blob with dangling descriptors in the destination.
+// No references are created in the destination, that is left to the caller.
+// Foreign layers (see IsForeignLayerType) whose blobs are not present in the
+// source are not copied. The number of blobs copied is returned.
+func (e Engine) CopyTo(ctx context.Context, dst cas.Engine, root ispec.Descriptor) (_ int, err error) {
+	ctx, span := event.StartSpan(ctx, "casext.CopyTo")
+	defer func() { span.End(err) }()
+	span.SetAttribute("root", root.Digest)
+
+	seen, err := destinationBlobs(ctx, dst)
+	if err != nil {
+		return 0, err
+	}
+	n, err := e.copyTo(ctx, dst, root, seen)
+	span.SetAttribute("blobs", n)
+	return n, err
+}
+
+// destinationBlobs returns the set of blobs present in the destination of a
+// copy. Listing the blobs of an engine can be expensive, so this is done once
+// per copy and the set is then kept up to date as blobs are copied.
+func destinationBlobs(ctx context.Context, dst cas.Engine) (map[digest.Digest]struct{}, error) {
+	existing, err := dst.ListBlobs(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list destination blobs")
+	}
+	seen := map[digest.Digest]struct{}{}
+	for _, digest := range existing {
+		seen[digest] = struct{}{}
+	}
+	return seen, nil
+}
+
+// copyTo implements CopyTo. Blobs in seen are not copied, and every blob which
+// is copied is added to seen.
+func (e Engine) copyTo(ctx context.Context, dst cas.Engine, root ispec.Descriptor, seen map[digest.Digest]struct{}) (int, error) {
+	paths, err := e.Paths(ctx, root)
+	if err != nil {
+		return 0, errors.Wrap(err, "get source paths")
+	}
+
+	// Paths returns a pre-order traversal, so we walk it backwards to copy
+	// children before their parents.
+	n := 0
+	for idx := len(paths) - 1; idx >= 0; idx-- {
+		if err := ctx.Err(); err != nil {
+			return n, errors.Wrap(err, "copy blobs")
+		}
+		descriptor := paths[idx]
+		if _, ok := seen[descriptor.Digest]; ok {
+			continue
+		}
+		seen[descriptor.Digest] = struct{}{}
+
+		size, err := copyBlob(ctx, dst, e, descriptor.Digest)
+		if isMissingForeignLayer(descriptor, err) {
+			// The destination can fetch the layer the same way we would.
+			event.Log(ctx).Debugf("copy: skipping missing foreign layer %s", descriptor.Digest)
+			continue
+		} else if err != nil {
+			return n, errors.Wrapf(err, "copy blob %s", descriptor.Digest)
+		}
+		event.Log(ctx).WithFields(event.Fields{
+			"digest": descriptor.Digest,
+			"size":   size,
+		}).Debugf("copied blob")
+		n++
+	}
+	return n, nil
+}
+
+// AnnotationFilter is used to rewrite the annotations of an image while it is
+// being copied. It is called for every annotation, and returns the (possibly
+// modified) value of the annotation and whether the annotation should be kept.
+type AnnotationFilter func(key, value string) (string, bool)
+
+// filterAnnotations applies the given filter to a set of annotations, and
+// returns the new set of annotations as well as whether any annotation was
+// modified.
+func filterAnnotations(annotations map[string]string, filter AnnotationFilter) (map[string]string, bool) {
+	if len(annotations) == 0 {
+		return annotations, false
+	}
+
+	changed := false
+	filtered := map[string]string{}
+	for key, value := range annotations {
+		newValue, keep := filter(key, value)
+		if !keep {
+			changed = true
+			continue
+		}
+		if newValue != value {
+			changed = true
+		}
+		filtered[key] = newValue
+	}
+	return filtered, changed
+}
+
+// CopyToFiltered is like CopyTo, except that the annotations of every
+// manifest and manifest list reachable from the root descriptor are
+// rewritten using the given filter. Any blob which is modified (or which
+// refers to a modified blob) is re-serialised into the destination, and so
+// will have a different digest to the corresponding blob in the source. The
+// (possibly new) root descriptor is returned, along with the number of blobs
+// added to the destination. If filter is nil, this is equivalent to CopyTo.
+func (e Engine) CopyToFiltered(ctx context.Context, dst cas.Engine, root ispec.Descriptor, filter AnnotationFilter) (ispec.Descriptor, int, error) {
+	if filter == nil {
+		n, err := e.CopyTo(ctx, dst, root)
+		return root, n, err
+	}
+	seen, err := destinationBlobs(ctx, dst)
+	if err != nil {
+		return ispec.Descriptor{}, 0, err
+	}
+	return e.copyFiltered(ctx, dst, root, filter, seen)
+}
+
+// copyFiltered is the recursive implementation of CopyToFiltered. seen is the
+// set of blobs present in the destination (see copyTo).
+func (e Engine) copyFiltered(ctx context.Context, dst cas.Engine, descriptor ispec.Descriptor, filter AnnotationFilter, seen map[digest.Digest]struct{}) (ispec.Descriptor, int, error) {
+	var (
+		n       int
+		changed bool
+		newData interface{}
+		raw     []byte
+	)
+
+	switch descriptor.MediaType {
+	case ispec.MediaTypeDescriptor:
+		blob, err := e.FromDescriptor(ctx, descriptor)
+		if err != nil {
+			return ispec.Descriptor{}, n, errors.Wrap(err, "get descriptor blob")
+		}
+		blob.Close()
+		raw = blob.Raw
+		child, ok := blob.Data.(ispec.Descriptor)
+		if !ok {
+			// Should _never_ be reached.
+			return ispec.Descriptor{}, n, errors.Errorf("[internal error] unknown blob type: %s", blob.MediaType)
+		}
+
+		newChild, c, err := e.copyFiltered(ctx, dst, child, filter, seen)
+		n += c
+		if err != nil {
+			return ispec.Descriptor{}, n, errors.Wrap(err, "copy descriptor target")
+		}
+		changed = newChild.Digest != child.Digest
+		newData = newChild
+
+	case ispec.MediaTypeImageManifest:
+		blob, err := e.FromDescriptor(ctx, descriptor)
+		if err != nil {
+			return ispec.Descriptor{}, n, errors.Wrap(err, "get manifest blob")
+		}
+		blob.Close()
+		raw = blob.Raw
+		manifest, ok := blob.Data.(ispec.Manifest)
+		if !ok {
+			// Should _never_ be reached.
+			return ispec.Descriptor{}, n, errors.Errorf("[internal error] unknown blob type: %s", blob.MediaType)
+		}
+
+		// The config and layers have no annotations, so they are copied
+		// verbatim.
+		childCtx := childContext(ctx, blob)
+		for _, child := range append([]ispec.Descriptor{manifest.Config}, manifest.Layers...) {
+			c, err := e.copyTo(childCtx, dst, child, seen)
+			n += c
+			if err != nil {
+				return ispec.Descriptor{}, n, errors.Wrapf(err, "copy manifest child %s", child.Digest)
+			}
+		}
+		manifest.Annotations, changed = filterAnnotations(manifest.Annotations, filter)
+		newData = manifest
+
+	case ispec.MediaTypeImageManifestList:
+		blob, err := e.FromDescriptor(ctx, descriptor)
+		if err != nil {
+			return ispec.Descriptor{}, n, errors.Wrap(err, "get manifest list blob")
+		}
+		blob.Close()
+		raw = blob.Raw
+		manifestList, ok := blob.Data.(ispec.ManifestList)
+		if !ok {
+			// Should _never_ be reached.
+			return ispec.Descriptor{}, n, errors.Errorf("[internal error] unknown blob type: %s", blob.MediaType)
+		}
+
+		for idx, child := range manifestList.Manifests {
+			newChild, c, err := e.copyFiltered(ctx, dst, child.Descriptor, filter, seen)
+			n += c
+			if err != nil {
+				return ispec.Descriptor{}, n, errors.Wrapf(err, "copy manifest list child %s", child.Digest)
+			}
+			if newChild.Digest != child.Digest {
+				changed = true
+				manifestList.Manifests[idx].Descriptor = newChild
+			}
+		}
+		var annotationsChanged bool
+		manifestList.Annotations, annotationsChanged = filterAnnotations(manifestList.Annotations, filter)
+		changed = changed || annotationsChanged
+		newData = manifestList
+	}
+
+	// If nothing was modified, we can just copy the original blob (which
+	// preserves its digest).
+	if !changed {
+		c, err := e.copyTo(ctx, dst, descriptor, seen)
+		return descriptor, n + c, err
+	}
+
+	// Make sure that we don't drop any fields unknown to ispec.
+	newData, err := jsonmerge.Preserve(raw, newData)
+	if err != nil {
+		return ispec.Descriptor{}, n, errors.Wrap(err, "preserve unknown fields")
+	}
+	newDigest, newSize, err := dst.PutBlobJSON(ctx, newData)
+	if err != nil {
+		return ispec.Descriptor{}, n, errors.Wrap(err, "put filtered blob")
+	}
+	seen[newDigest] = struct{}{}
+	event.Log(ctx).WithFields(event.Fields{
+		"digest":     descriptor.Digest,
+		"new_digest": newDigest,
+	}).Debugf("rewrote blob annotations")
+
+	newDescriptor := descriptor
+	newDescriptor.Digest = newDigest
+	newDescriptor.Size = newSize
+	return newDescriptor, n + 1, nil
+}
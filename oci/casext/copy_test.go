@@ -0,0 +1,77 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package casext
+
+import (
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/net/context"
+)
+
+// listCountingEngine counts the calls to ListBlobs of the wrapped engine.
+type listCountingEngine struct {
+	cas.Engine
+	lists int
+}
+
+func (e *listCountingEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	e.lists++
+	return e.Engine.ListBlobs(ctx)
+}
+
+func TestCopyToListsOnce(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		filter AnnotationFilter
+	}{
+		{"CopyTo", nil},
+		{"CopyToFiltered", func(key, value string) (string, bool) { return value, true }},
+	} {
+		ctx := context.Background()
+		engine := Engine{mem.New()}
+		root, _ := putVisitImage(t, engine)
+
+		dst := &listCountingEngine{Engine: mem.New()}
+		newRoot, n, err := engine.CopyToFiltered(ctx, dst, root, test.filter)
+		if err != nil {
+			t.Fatalf("%s: unexpected error copying image: %+v", test.name, err)
+		}
+		if newRoot.Digest != root.Digest {
+			t.Errorf("%s: unmodified root was rewritten: %s != %s", test.name, newRoot.Digest, root.Digest)
+		}
+		// Manifest list, 2 manifests, 2 configs and a single (shared) layer.
+		if n != 6 {
+			t.Errorf("%s: expected 6 blobs to be copied, got %d", test.name, n)
+		}
+		if dst.lists != 1 {
+			t.Errorf("%s: expected destination blobs to be listed once, got %d", test.name, dst.lists)
+		}
+
+		// Nothing is copied again.
+		if _, n, err := engine.CopyToFiltered(ctx, dst, root, test.filter); err != nil {
+			t.Fatalf("%s: unexpected error copying image again: %+v", test.name, err)
+		} else if n != 0 {
+			t.Errorf("%s: expected no blobs to be copied again, got %d", test.name, n)
+		}
+
+		engine.Close()
+		dst.Close()
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// MinDigestPrefix is the minimum number of hex characters that an abbreviated
+// digest must contain.
+const MinDigestPrefix = 4
+
+// digestPrefixRegexp matches an abbreviated digest, with an optional algorithm.
+var digestPrefixRegexp = regexp.MustCompile(`^(?:([a-z0-9]+(?:[.+_-][a-z0-9]+)*):)?([a-f0-9]+)$`)
+
+// ResolveDigest resolves a (possibly abbreviated) digest of a blob in the
+// image, similar to how git(1) resolves abbreviated object names. A complete
+// digest is returned as-is (without checking whether the blob exists). An
+// abbreviated digest is of the form "[<algorithm>:]<prefix>", and must be the
+// prefix of the digest of exactly one blob in the image (if no algorithm is
+// given, blobs with any algorithm are considered).
+func (e Engine) ResolveDigest(ctx context.Context, short string) (digest.Digest, error) {
+	if dgst, err := digest.Parse(short); err == nil {
+		return dgst, nil
+	}
+
+	match := digestPrefixRegexp.FindStringSubmatch(short)
+	if match == nil {
+		return "", errors.Errorf("invalid digest: %q", short)
+	}
+	algorithm, prefix := match[1], match[2]
+	if len(prefix) < MinDigestPrefix {
+		return "", errors.Errorf("digest prefix %q is too short: must contain at least %d characters", short, MinDigestPrefix)
+	}
+
+	blobs, err := e.ListBlobs(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "list blobs")
+	}
+
+	var candidates []string
+	for _, blob := range blobs {
+		if algorithm != "" && string(blob.Algorithm()) != algorithm {
+			continue
+		}
+		if strings.HasPrefix(blob.Hex(), prefix) {
+			candidates = append(candidates, blob.String())
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return "", errors.Errorf("no blob matches digest prefix %q", short)
+	case 1:
+		return digest.Digest(candidates[0]), nil
+	default:
+		sort.Strings(candidates)
+		return "", errors.Errorf("digest prefix %q is ambiguous: matches %s", short, strings.Join(candidates, ", "))
+	}
+}
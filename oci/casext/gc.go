@@ -18,85 +18,893 @@
 package casext
 
 import (
-	"github.com/apex/log"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/event"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
+// GCOptions modifies the behaviour of GCWithOptions.
+type GCOptions struct {
+	// StatePath, if non-empty, is the path of a file to which the GC state
+	// (the set of references used as the root set, and the set of blobs that
+	// will be removed and why) is written before any blobs are removed. The
+	// file is updated once the garbage collection has completed. It must not
+	// be inside the image being collected, as it would otherwise be removed by
+	// the engine's Clean.
+	StatePath string
+
+	// Resume causes the garbage collection described by the state file at
+	// StatePath to be completed, rather than starting a new one. This is
+	// only permitted if the references in the image are unchanged since the
+	// state file was written. The policies used by the interrupted garbage
+	// collection are not re-evaluated, so Policies is ignored.
+	Resume bool
+
+	// Policies is the set of policies which may retain blobs and referrers
+	// indexes that would otherwise be removed. A candidate is retained if any
+	// of the policies retains it.
+	Policies []GCPolicy
+
+	// DryRun causes the set of blobs which would be removed to be computed
+	// and returned, without removing anything. It cannot be combined with
+	// StatePath.
+	DryRun bool
+
+	// LockTimeout is how long to wait for the other engines writing to the
+	// image to finish, if the engine is a cas.ExclusiveEngine. If they are
+	// still writing after LockTimeout, cas.ErrBusy is returned. If zero,
+	// DefaultGCLockTimeout is used. If negative, cas.ErrBusy is returned
+	// immediately if any other engine is writing to the image.
+	LockTimeout time.Duration
+}
+
+// DefaultGCLockTimeout is the default GCOptions.LockTimeout.
+const DefaultGCLockTimeout = 30 * time.Second
+
+// GCDeletion is a single blob removed by a garbage collection.
+type GCDeletion struct {
+	// Digest is the digest of the removed blob.
+	Digest digest.Digest `json:"digest"`
+
+	// Size is the size of the removed blob.
+	Size int64 `json:"size"`
+
+	// Reason is a human-readable explanation of why the blob was removed.
+	Reason string `json:"reason"`
+
+	// MediaType is the media type of the removed blob, if it is known. It is
+	// taken from the descriptors of the removed references and blobs which
+	// referred to the blob, or guessed from the contents of manifests and
+	// manifest lists.
+	MediaType string `json:"media_type,omitempty"`
+
+	// ReferencedBy is the set of removed referrers indexes (see ReferrersTag)
+	// and the digests of the other removed blobs which referred to the blob.
+	// It is empty if nothing referred to the blob.
+	ReferencedBy []string `json:"referenced_by,omitempty"`
+}
+
+// GCRetention is a single blob or referrers index which would have been
+// removed by a garbage collection, but was retained by a GCPolicy.
+type GCRetention struct {
+	// Reference is the name of the retained referrers index, or empty if a
+	// blob was retained.
+	Reference string `json:"reference,omitempty"`
+
+	// Digest is the digest of the retained blob (or of the blob referenced by
+	// Reference).
+	Digest digest.Digest `json:"digest"`
+
+	// Size is the size of the retained blob.
+	Size int64 `json:"size"`
+
+	// Reason is a human-readable explanation of why the blob was retained.
+	Reason string `json:"reason"`
+}
+
+// GCState is the on-disk state of a garbage collection, written to
+// GCOptions.StatePath.
+type GCState struct {
+	// References is the root set of the garbage collection.
+	References map[string]ispec.Descriptor `json:"references"`
+
+	// Deletions is the set of blobs to be removed, in the order they are
+	// removed.
+	Deletions []GCDeletion `json:"deletions"`
+
+	// OrphanReferences is the set of referrers indexes (see ReferrersTag) to
+	// be removed because their subject is not reachable. They are removed
+	// after Deletions.
+	OrphanReferences []string `json:"orphan_references,omitempty"`
+
+	// Retained is the set of blobs and referrers indexes which were retained
+	// by a GCPolicy (not including the blobs reachable from them).
+	Retained []GCRetention `json:"retained,omitempty"`
+
+	// Size is the total size of Deletions, which is the amount of space
+	// reclaimed by the garbage collection.
+	Size int64 `json:"size"`
+
+	// Complete is true if all of Deletions have been removed.
+	Complete bool `json:"complete"`
+}
+
 // GC will perform a mark-and-sweep garbage collection of the OCI image
 // referenced by the given CAS engine. The root set is taken to be the set of
 // references stored in the image, and all blobs not reachable by following a
-// descriptor path from the root set will be removed.
+// descriptor path from the root set will be removed. Referrers indexes (see
+// Attach) are the exception: the artifacts they refer to are only retained
+// while their subject is reachable, otherwise the referrers index is removed
+// along with the artifacts. Artifact manifests which are not in a referrers
+// index are treated the same way, based on their subject.
 //
 // GC will only call ListBlobs and ListReferences once, and assumes that there
 // is no change in the set of references or blobs after calling those
-// functions. In other words, it assumes it is the only user of the image that
-// is making modifications. Things will not go well if this assumption is
-// challenged.
+// functions. If the engine is a cas.ExclusiveEngine, other engines are
+// prevented from writing to the image for the duration of the garbage
+// collection (waiting for the current writers to finish, see
+// GCOptions.LockTimeout). Otherwise, it assumes it is the only user of the
+// image that is making modifications. Things will not go well if this
+// assumption is challenged.
 func (e Engine) GC(ctx context.Context) error {
-	// Generate the root set of descriptors.
-	var root []ispec.Descriptor
+	_, err := e.GCWithOptions(ctx, GCOptions{})
+	return err
+}
+
+// GCWithOptions is equivalent to GC, except that it allows the caller to
+// retain some unreachable blobs using policies, to only compute what would be
+// removed (a dry run), and to record the progress of the garbage collection
+// in a state file (and resume an interrupted garbage collection from such a
+// file). Blobs are always removed in a deterministic order (sorted by
+// digest). The returned GCState describes what was (or, for a dry run, would
+// be) removed and retained.
+func (e Engine) GCWithOptions(ctx context.Context, opt GCOptions) (_ GCState, err error) {
+	ctx, span := event.StartSpan(ctx, "casext.GC")
+	defer func() { span.End(err) }()
+
+	if opt.Resume && opt.StatePath == "" {
+		return GCState{}, errors.Errorf("resuming gc requires a state path")
+	}
+	if opt.DryRun && opt.StatePath != "" {
+		return GCState{}, errors.Errorf("dry run gc cannot use a state path")
+	}
+
+	// A dry run doesn't remove anything, so it doesn't need to exclude
+	// concurrent writers.
+	if !opt.DryRun {
+		unlock, err := e.lockExclusive(ctx, opt.LockTimeout)
+		if err != nil {
+			return GCState{}, errors.Wrap(err, "lock image")
+		}
+		defer unlock()
+	}
+
+	references, err := e.gcReferences(ctx)
+	if err != nil {
+		return GCState{}, errors.Wrap(err, "get roots")
+	}
+
+	var state GCState
+	if opt.Resume {
+		state, err = readGCState(opt.StatePath)
+		if err != nil {
+			return GCState{}, errors.Wrap(err, "read gc state")
+		}
+		if !reflect.DeepEqual(state.References, references) {
+			return GCState{}, errors.Errorf("cannot resume gc: references have changed since %s was written", opt.StatePath)
+		}
+		if state.Complete {
+			event.Log(ctx).Infof("gc described by %s has already completed", opt.StatePath)
+			return state, nil
+		}
+	} else {
+		state, err = e.gcMark(ctx, references, opt.Policies)
+		if err != nil {
+			return GCState{}, err
+		}
+	}
+	span.SetAttribute("blobs", len(state.Deletions))
+
+	if opt.DryRun {
+		for _, deletion := range state.Deletions {
+			event.Log(ctx).Debugf("would garbage collect blob: %s", deletion.Digest)
+		}
+		for _, name := range state.OrphanReferences {
+			event.Log(ctx).Debugf("would garbage collect referrers index: %s", name)
+		}
+		return state, nil
+	}
+
+	if opt.StatePath != "" {
+		if err := writeGCState(opt.StatePath, state); err != nil {
+			return GCState{}, errors.Wrap(err, "write gc state")
+		}
+	}
+
+	// Sweep all blobs in the white set. DeleteBlob is idempotent, so blobs
+	// removed by an interrupted run are not a problem when resuming.
+	for _, deletion := range state.Deletions {
+		event.Log(ctx).Infof("garbage collecting blob: %s", deletion.Digest)
+
+		if err := e.DeleteBlob(ctx, deletion.Digest); err != nil {
+			return GCState{}, errors.Wrapf(err, "remove unmarked blob %s", deletion.Digest)
+		}
+	}
+
+	// Remove the referrers indexes of removed subjects. They are removed
+	// after the blobs, so that an interrupted run can still be resumed.
+	for _, name := range state.OrphanReferences {
+		event.Log(ctx).Infof("garbage collecting referrers index: %s", name)
+
+		if err := e.DeleteReference(ctx, name); err != nil {
+			return GCState{}, errors.Wrapf(err, "remove referrers index %s", name)
+		}
+	}
+
+	// Finally, tell CAS to GC it.
+	if err := e.Clean(ctx); err != nil {
+		return GCState{}, errors.Wrapf(err, "clean engine")
+	}
+
+	if opt.StatePath != "" {
+		state.Complete = true
+		if err := writeGCState(opt.StatePath, state); err != nil {
+			return GCState{}, errors.Wrap(err, "write gc state")
+		}
+	}
 
+	event.Log(ctx).Debugf("garbage collected %d blobs", len(state.Deletions))
+	return state, nil
+}
+
+// lockExclusive excludes the other writers of the image (see
+// cas.ExclusiveEngine) with the given GCOptions.LockTimeout, if the engine
+// supports it. The returned function releases the lock.
+func (e Engine) lockExclusive(ctx context.Context, timeout time.Duration) (func(), error) {
+	engine, ok := e.Engine.(cas.ExclusiveEngine)
+	if !ok {
+		return func() {}, nil
+	}
+	switch {
+	case timeout == 0:
+		timeout = DefaultGCLockTimeout
+	case timeout < 0:
+		timeout = 0
+	}
+	unlock, err := engine.LockExclusive(ctx, timeout)
+	if errors.Cause(err) == cas.ErrNotImplemented {
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := unlock(); err != nil {
+			event.Log(ctx).Warnf("failed to unlock image: %v", err)
+		}
+	}, nil
+}
+
+// gcReferences returns the root set of references in the image.
+func (e Engine) gcReferences(ctx context.Context) (map[string]ispec.Descriptor, error) {
 	names, err := e.ListReferences(ctx)
 	if err != nil {
-		return errors.Wrap(err, "get roots")
+		return nil, errors.Wrap(err, "list references")
 	}
 
+	references := map[string]ispec.Descriptor{}
 	for _, name := range names {
 		descriptor, err := e.GetReference(ctx, name)
 		if err != nil {
-			return errors.Wrapf(err, "get root %s", name)
+			return nil, errors.Wrapf(err, "get root %s", name)
 		}
-		log.WithFields(log.Fields{
+		event.Log(ctx).WithFields(event.Fields{
 			"name":   name,
 			"digest": descriptor.Digest,
 		}).Debugf("GC: got reference")
-		root = append(root, descriptor)
+		references[name] = descriptor
 	}
+	return references, nil
+}
 
-	// Mark from the root sets.
-	black := map[digest.Digest]struct{}{}
-	for idx, descriptor := range root {
-		log.WithFields(log.Fields{
-			"digest": descriptor.Digest,
-		}).Debugf("GC: marking from root")
+// gcMark computes the set of blobs not reachable from the given references,
+// and not retained by any of the given policies.
+func (e Engine) gcMark(ctx context.Context, references map[string]ispec.Descriptor, policies []GCPolicy) (GCState, error) {
+	state := GCState{
+		References: references,
+		Deletions:  []GCDeletion{},
+	}
 
-		reachables, err := e.Reachable(ctx, descriptor)
+	// Mark from the root set, in a deterministic order. Referrers indexes
+	// (see ReferrersTag) are not part of the root set, and are only marked
+	// if their subject is reachable.
+	var names []string
+	referrers := map[string]digest.Digest{}
+	for name, descriptor := range references {
+		subject, ok, err := e.referrersSubject(ctx, name, descriptor)
 		if err != nil {
-			return errors.Wrapf(err, "getting reachables from root %d", idx)
+			return state, err
 		}
-		for _, reachable := range reachables {
-			black[reachable] = struct{}{}
+		if ok {
+			referrers[name] = subject
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	black := map[digest.Digest]struct{}{}
+	for _, name := range names {
+		if err := e.gcMarkFrom(ctx, name, references[name], black); err != nil {
+			return state, err
 		}
 	}
 
-	// Sweep all blobs in the white set.
 	blobs, err := e.ListBlobs(ctx)
 	if err != nil {
-		return errors.Wrap(err, "get blob list")
+		return state, errors.Wrap(err, "get blob list")
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i] < blobs[j] })
+
+	// Artifact manifests are usually only reachable through a referrers
+	// index, but they can also be missing from it (if the index was removed,
+	// or the artifacts were added by another tool). Those are found by their
+	// subject instead.
+	artifacts, err := e.gcArtifacts(ctx, blobs, black)
+	if err != nil {
+		return state, errors.Wrap(err, "find artifacts")
+	}
+
+	// Artifacts can themselves have referrers, so keep marking until no more
+	// referrers indexes or artifacts have a reachable subject. Anything
+	// retained by a policy can also be the subject of referrers, so the
+	// policies are applied until they no longer retain anything new.
+	retainer := gcRetainer{
+		policies: policies,
+		infos:    map[digest.Digest]cas.BlobInfo{},
+		refs:     map[string]struct{}{},
+		blobs:    map[digest.Digest]struct{}{},
+	}
+	for retained := true; retained; {
+		if err := e.gcMarkReferrers(ctx, references, referrers, artifacts, black); err != nil {
+			return state, err
+		}
+		retained, err = e.gcRetain(ctx, &retainer, &state, references, referrers, blobs, black)
+		if err != nil {
+			return state, errors.Wrap(err, "apply gc policies")
+		}
+	}
+
+	// Any remaining referrers indexes refer to subjects that will be removed,
+	// so they must be removed as well.
+	for name := range referrers {
+		state.OrphanReferences = append(state.OrphanReferences, name)
 	}
+	sort.Strings(state.OrphanReferences)
 
-	n := 0
+	subjects := map[digest.Digest]digest.Digest{}
+	for _, artifact := range artifacts {
+		subjects[artifact.descriptor.Digest] = artifact.subject
+	}
 	for _, digest := range blobs {
 		if _, ok := black[digest]; ok {
 			// Digest is in the black set.
 			continue
 		}
-		log.Infof("garbage collecting blob: %s", digest)
+		info, err := e.gcStat(ctx, digest, retainer.infos)
+		if err != nil {
+			return state, err
+		}
+		reason := fmt.Sprintf("not reachable from any of %d references", len(references)-len(state.OrphanReferences))
+		if subject, ok := subjects[digest]; ok {
+			reason = fmt.Sprintf("artifact whose subject %s is not reachable", subject)
+		}
+		state.Deletions = append(state.Deletions, GCDeletion{
+			Digest: digest,
+			Size:   info.Size,
+			Reason: reason,
+		})
+		state.Size += info.Size
+	}
+	if err := e.gcDescribe(ctx, &state, artifacts); err != nil {
+		return state, errors.Wrap(err, "describe unreachable blobs")
+	}
+	return state, nil
+}
+
+// gcDescribe fills in the MediaType and ReferencedBy of the deletions, by
+// following the descriptors in the removed referrers indexes, manifests and
+// manifest lists. Since the removed blobs are not reachable, they may be
+// incomplete or invalid, in which case they are only described as far as
+// possible.
+func (e Engine) gcDescribe(ctx context.Context, state *GCState, artifacts []gcArtifact) error {
+	deletions := map[digest.Digest]*GCDeletion{}
+	for idx := range state.Deletions {
+		deletions[state.Deletions[idx].Digest] = &state.Deletions[idx]
+	}
 
-		if err := e.DeleteBlob(ctx, digest); err != nil {
-			return errors.Wrapf(err, "remove unmarked blob %s", digest)
+	// describe records that the blob of the descriptor was referred to by
+	// parent, returning false if it is not being removed.
+	describe := func(parent string, descriptor ispec.Descriptor) bool {
+		deletion, ok := deletions[descriptor.Digest]
+		if !ok {
+			return false
 		}
-		n++
+		if deletion.MediaType == "" {
+			deletion.MediaType = descriptor.MediaType
+		}
+		for _, name := range deletion.ReferencedBy {
+			if name == parent {
+				return true
+			}
+		}
+		deletion.ReferencedBy = append(deletion.ReferencedBy, parent)
+		return true
 	}
 
-	// Finally, tell CAS to GC it.
-	if err := e.Clean(ctx); err != nil {
-		return errors.Wrapf(err, "clean engine")
+	// The removed referrers indexes have known descriptors, while the
+	// removed manifests and manifest lists which nothing refers to have to
+	// be found by guessing.
+	var parents []ispec.Descriptor
+	for _, name := range state.OrphanReferences {
+		if descriptor := state.References[name]; describe(name, descriptor) {
+			parents = append(parents, descriptor)
+		}
+	}
+	guessed := map[digest.Digest]string{}
+	for _, artifact := range artifacts {
+		guessed[artifact.descriptor.Digest] = artifact.descriptor.MediaType
+	}
+	for _, deletion := range state.Deletions {
+		if _, ok := guessed[deletion.Digest]; ok {
+			continue
+		}
+		reader, err := e.GetBlob(ctx, deletion.Digest)
+		if err != nil {
+			return errors.Wrapf(err, "get blob %s", deletion.Digest)
+		}
+		data, err := readJSONBlob(reader, maxArtifactManifestSize)
+		reader.Close()
+		if err != nil {
+			return errors.Wrapf(err, "read blob %s", deletion.Digest)
+		}
+		if mediaType := guessManifestType(data); mediaType != "" {
+			guessed[deletion.Digest] = mediaType
+		}
+	}
+	for _, deletion := range state.Deletions {
+		if mediaType, ok := guessed[deletion.Digest]; ok {
+			parents = append(parents, ispec.Descriptor{
+				MediaType: mediaType,
+				Digest:    deletion.Digest,
+				Size:      deletion.Size,
+			})
+		}
+	}
+
+	visited := map[digest.Digest]struct{}{}
+	artifactBlobDigests := map[digest.Digest]struct{}{}
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+		if _, ok := visited[parent.Digest]; ok {
+			continue
+		}
+		visited[parent.Digest] = struct{}{}
+
+		blob, err := e.FromDescriptor(withArtifactBlobs(ctx, artifactBlobDigests), parent)
+		if err != nil {
+			event.Log(ctx).Debugf("gc: cannot describe children of unreachable blob %s: %v", parent.Digest, err)
+			continue
+		}
+		for blobDigest := range artifactBlobs(blob) {
+			artifactBlobDigests[blobDigest] = struct{}{}
+		}
+		children, err := blobChildren(blob)
+		blob.Close()
+		if err != nil {
+			event.Log(ctx).Debugf("gc: cannot describe children of unreachable blob %s: %v", parent.Digest, err)
+			continue
+		}
+		for _, child := range children {
+			if describe(parent.Digest.String(), child) {
+				parents = append(parents, child)
+			}
+		}
+	}
+
+	for idx := range state.Deletions {
+		deletion := &state.Deletions[idx]
+		if deletion.MediaType == "" {
+			deletion.MediaType = guessed[deletion.Digest]
+		}
+		sort.Strings(deletion.ReferencedBy)
+	}
+	return nil
+}
+
+// guessManifestType returns the media type of the given JSON blob if it looks
+// like a manifest or manifest list, and an empty string otherwise.
+func guessManifestType(data []byte) string {
+	if data == nil {
+		return ""
+	}
+	var fields struct {
+		Manifests json.RawMessage `json:"manifests"`
+		Config    json.RawMessage `json:"config"`
+		Layers    json.RawMessage `json:"layers"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return ""
+	}
+	switch {
+	case fields.Manifests != nil:
+		return ispec.MediaTypeImageManifestList
+	case fields.Config != nil && fields.Layers != nil:
+		return ispec.MediaTypeImageManifest
+	}
+	return ""
+}
+
+// gcMarkReferrers marks the referrers indexes and artifacts whose subject is
+// in the black set, until no more can be marked. Marked referrers indexes are
+// removed from referrers.
+func (e Engine) gcMarkReferrers(ctx context.Context, references map[string]ispec.Descriptor, referrers map[string]digest.Digest, artifacts []gcArtifact, black map[digest.Digest]struct{}) error {
+	for marked := true; marked; {
+		marked = false
+		var pending []string
+		for name := range referrers {
+			pending = append(pending, name)
+		}
+		sort.Strings(pending)
+
+		for _, name := range pending {
+			if _, ok := black[referrers[name]]; !ok {
+				continue
+			}
+			if err := e.gcMarkFrom(ctx, name, references[name], black); err != nil {
+				return err
+			}
+			delete(referrers, name)
+			marked = true
+		}
+
+		for _, artifact := range artifacts {
+			if _, ok := black[artifact.descriptor.Digest]; ok {
+				continue
+			}
+			if _, ok := black[artifact.subject]; !ok {
+				continue
+			}
+			if err := e.gcMarkFrom(ctx, "artifact of "+artifact.subject.String(), artifact.descriptor, black); err != nil {
+				return err
+			}
+			marked = true
+		}
+	}
+	return nil
+}
+
+// gcRetainer is the state of the policies applied during a garbage
+// collection.
+type gcRetainer struct {
+	// policies is the set of policies to apply.
+	policies []GCPolicy
+
+	// infos caches the information about each blob that has been stat-ed.
+	infos map[digest.Digest]cas.BlobInfo
+
+	// refs and blobs are the candidates that the policies have already been
+	// applied to, so that they are only considered once.
+	refs  map[string]struct{}
+	blobs map[digest.Digest]struct{}
+}
+
+// retain applies the policies to the candidate, returning the reason for
+// retaining it (or an empty string if it should not be retained).
+func (r *gcRetainer) retain(ctx context.Context, candidate GCCandidate) (string, error) {
+	for _, policy := range r.policies {
+		retain, err := policy.Retain(ctx, candidate)
+		if err != nil {
+			return "", errors.Wrapf(err, "policy %s", policy)
+		}
+		if retain {
+			return "retained by policy: " + policy.String(), nil
+		}
+	}
+	return "", nil
+}
+
+// gcRetain applies the policies to every referrers index and blob which has
+// not been marked, marking everything reachable from the ones that are
+// retained. Returns whether anything was retained.
+func (e Engine) gcRetain(ctx context.Context, r *gcRetainer, state *GCState, references map[string]ispec.Descriptor, referrers map[string]digest.Digest, blobs []digest.Digest, black map[digest.Digest]struct{}) (bool, error) {
+	if len(r.policies) == 0 {
+		return false, nil
+	}
+
+	var pending []string
+	for name := range referrers {
+		if _, ok := r.refs[name]; !ok {
+			pending = append(pending, name)
+		}
+	}
+	sort.Strings(pending)
+
+	retained := false
+	for _, name := range pending {
+		r.refs[name] = struct{}{}
+
+		descriptor := references[name]
+		info, err := e.gcStat(ctx, descriptor.Digest, r.infos)
+		if err != nil {
+			return false, err
+		}
+		reason, err := r.retain(ctx, GCCandidate{
+			Reference: name,
+			Digest:    descriptor.Digest,
+			Info:      info,
+		})
+		if err != nil {
+			return false, err
+		}
+		if reason == "" {
+			continue
+		}
+
+		event.Log(ctx).Infof("retaining referrers index %s: %s", name, reason)
+		if err := e.gcMarkFrom(ctx, name, descriptor, black); err != nil {
+			return false, err
+		}
+		delete(referrers, name)
+		state.Retained = append(state.Retained, GCRetention{
+			Reference: name,
+			Digest:    descriptor.Digest,
+			Size:      info.Size,
+			Reason:    reason,
+		})
+		retained = true
+	}
+
+	for _, blobDigest := range blobs {
+		if _, ok := black[blobDigest]; ok {
+			continue
+		}
+		if _, ok := r.blobs[blobDigest]; ok {
+			continue
+		}
+		r.blobs[blobDigest] = struct{}{}
+
+		info, err := e.gcStat(ctx, blobDigest, r.infos)
+		if err != nil {
+			return false, err
+		}
+		reason, err := r.retain(ctx, GCCandidate{
+			Digest: blobDigest,
+			Info:   info,
+		})
+		if err != nil {
+			return false, err
+		}
+		if reason == "" {
+			continue
+		}
+
+		event.Log(ctx).Infof("retaining blob %s: %s", blobDigest, reason)
+		if err := e.gcMarkBlob(ctx, blobDigest, info.Size, black); err != nil {
+			return false, err
+		}
+		state.Retained = append(state.Retained, GCRetention{
+			Digest: blobDigest,
+			Size:   info.Size,
+			Reason: reason,
+		})
+		retained = true
 	}
+	return retained, nil
+}
+
+// gcMarkBlob adds the given blob to the black set, along with all of the
+// blobs reachable from it if it is a manifest or manifest list. Since the
+// blob is not reachable from any reference, its media type is guessed from
+// its contents.
+func (e Engine) gcMarkBlob(ctx context.Context, blobDigest digest.Digest, size int64, black map[digest.Digest]struct{}) error {
+	black[blobDigest] = struct{}{}
 
-	log.Debugf("garbage collected %d blobs", n)
+	reader, err := e.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return errors.Wrapf(err, "get blob %s", blobDigest)
+	}
+	data, err := readJSONBlob(reader, maxArtifactManifestSize)
+	reader.Close()
+	if err != nil {
+		return errors.Wrapf(err, "read blob %s", blobDigest)
+	}
+	mediaType := guessManifestType(data)
+	if mediaType == "" {
+		return nil
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    blobDigest,
+		Size:      size,
+	}
+	return e.gcMarkFrom(ctx, "retained "+blobDigest.String(), descriptor, black)
+}
+
+// gcStat returns information about the given blob, caching it in infos. If the
+// engine isn't a cas.StatingEngine, the blob is read in order to compute its
+// size and its modification time is left unknown.
+func (e Engine) gcStat(ctx context.Context, blobDigest digest.Digest, infos map[digest.Digest]cas.BlobInfo) (cas.BlobInfo, error) {
+	if info, ok := infos[blobDigest]; ok {
+		return info, nil
+	}
+
+	var info cas.BlobInfo
+	err := cas.ErrNotImplemented
+	if engine, ok := e.Engine.(cas.StatingEngine); ok {
+		info, err = engine.StatBlob(ctx, blobDigest)
+	}
+	if errors.Cause(err) == cas.ErrNotImplemented {
+		reader, err := e.GetBlob(ctx, blobDigest)
+		if err != nil {
+			return info, errors.Wrapf(err, "get blob %s", blobDigest)
+		}
+		defer reader.Close()
+
+		info = cas.BlobInfo{}
+		info.Size, err = io.Copy(ioutil.Discard, reader)
+		if err != nil {
+			return info, errors.Wrapf(err, "read blob %s", blobDigest)
+		}
+	} else if err != nil {
+		return info, errors.Wrapf(err, "stat blob %s", blobDigest)
+	}
+	infos[blobDigest] = info
+	return info, nil
+}
+
+// gcMarkFrom adds all of the blobs reachable from the given reference to the
+// black set.
+func (e Engine) gcMarkFrom(ctx context.Context, name string, descriptor ispec.Descriptor, black map[digest.Digest]struct{}) error {
+	event.Log(ctx).WithFields(event.Fields{
+		"name":   name,
+		"digest": descriptor.Digest,
+	}).Debugf("GC: marking from root")
+
+	reachables, err := e.Reachable(ctx, descriptor)
+	if err != nil {
+		return errors.Wrapf(err, "getting reachables from root %s", name)
+	}
+	for _, reachable := range reachables {
+		black[reachable] = struct{}{}
+	}
 	return nil
 }
+
+// maxArtifactManifestSize is the largest blob which gcArtifacts will parse
+// when looking for artifact manifests.
+const maxArtifactManifestSize = 4 * 1024 * 1024
+
+// gcArtifact is an artifact manifest found by gcArtifacts.
+type gcArtifact struct {
+	descriptor ispec.Descriptor
+	subject    digest.Digest
+}
+
+// gcArtifacts returns the artifact manifests (manifests with a subject) among
+// the given blobs which are not in the black set. Only blobs which look like
+// JSON are parsed, so layers are not read in their entirety.
+func (e Engine) gcArtifacts(ctx context.Context, blobs []digest.Digest, black map[digest.Digest]struct{}) ([]gcArtifact, error) {
+	var artifacts []gcArtifact
+	for _, blobDigest := range blobs {
+		if _, ok := black[blobDigest]; ok {
+			continue
+		}
+
+		reader, err := e.GetBlob(ctx, blobDigest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get blob %s", blobDigest)
+		}
+		data, err := readJSONBlob(reader, maxArtifactManifestSize)
+		reader.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "read blob %s", blobDigest)
+		}
+		if data == nil {
+			continue
+		}
+
+		var manifest ArtifactManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			continue
+		}
+		if manifest.SchemaVersion != 2 || manifest.Config.Digest == "" || manifest.Subject == nil || manifest.Subject.Digest == "" {
+			continue
+		}
+		event.Log(ctx).WithFields(event.Fields{
+			"digest":  blobDigest,
+			"subject": manifest.Subject.Digest,
+		}).Debugf("GC: found artifact")
+		artifacts = append(artifacts, gcArtifact{
+			descriptor: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageManifest,
+				Digest:    blobDigest,
+				Size:      int64(len(data)),
+			},
+			subject: manifest.Subject.Digest,
+		})
+	}
+	return artifacts, nil
+}
+
+// readJSONBlob returns the contents of the blob if it looks like a JSON
+// object no larger than maxSize, and nil otherwise.
+func readJSONBlob(reader io.Reader, maxSize int64) ([]byte, error) {
+	br := bufio.NewReader(io.LimitReader(reader, maxSize+1))
+	start, err := br.Peek(1)
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if start[0] != '{' {
+		return nil, nil
+	}
+	data, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, nil
+	}
+	return data, nil
+}
+
+func readGCState(path string) (GCState, error) {
+	var state GCState
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return state, errors.Wrap(err, "open state")
+	}
+	defer fh.Close()
+
+	err = json.NewDecoder(fh).Decode(&state)
+	return state, errors.Wrap(err, "decode state")
+}
+
+// writeGCState atomically replaces the state file at path.
+func writeGCState(path string, state GCState) error {
+	fh, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return errors.Wrap(err, "create temporary state")
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if err := json.NewEncoder(fh).Encode(state); err != nil {
+		return errors.Wrap(err, "encode state")
+	}
+	if err := fh.Sync(); err != nil {
+		return errors.Wrap(err, "sync state")
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close state")
+	}
+	return errors.Wrap(os.Rename(fh.Name(), path), "rename state")
+}
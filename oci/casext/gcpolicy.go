@@ -0,0 +1,99 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/net/context"
+)
+
+// GCCandidate is something which a garbage collection would remove, and which
+// a GCPolicy may decide to retain instead.
+type GCCandidate struct {
+	// Reference is the name of the referrers index (see ReferrersTag) being
+	// considered, or empty if an unreachable blob is being considered.
+	Reference string
+
+	// Digest is the digest of the blob being considered (or of the blob
+	// referenced by Reference).
+	Digest digest.Digest
+
+	// Info is the size and modification time of the blob. If the engine
+	// isn't a cas.StatingEngine, the modification time is unknown (zero).
+	Info cas.BlobInfo
+}
+
+// GCPolicy decides whether blobs and referrers indexes which would otherwise
+// be removed by a garbage collection should be retained. Retaining a blob or
+// referrers index also retains everything reachable from it, so that the
+// retained blobs are never left dangling.
+type GCPolicy interface {
+	// Retain returns whether the candidate should be retained.
+	Retain(ctx context.Context, candidate GCCandidate) (bool, error)
+
+	// String returns a short description of the policy, which is used as the
+	// reason for retaining a candidate.
+	String() string
+}
+
+// GCKeepTagged is a GCPolicy which retains every reference in the image. By
+// default, referrers indexes whose subject is not reachable are removed along
+// with their artifacts; with this policy no reference is ever removed.
+type GCKeepTagged struct{}
+
+// Retain returns whether the candidate is a reference.
+func (GCKeepTagged) Retain(ctx context.Context, candidate GCCandidate) (bool, error) {
+	return candidate.Reference != "", nil
+}
+
+func (GCKeepTagged) String() string {
+	return "keep tagged"
+}
+
+// GCKeepYoungerThan is a GCPolicy which retains blobs that were modified less
+// than Age ago. This allows a garbage collection to run alongside other users
+// of the image, which may have written blobs that they have not yet
+// referenced. Blobs whose modification time is unknown are always retained.
+type GCKeepYoungerThan struct {
+	// Age is the minimum age of blobs which may be removed.
+	Age time.Duration
+
+	// Now is the time against which the age of blobs is computed. If zero,
+	// the current time is used.
+	Now time.Time
+}
+
+// Retain returns whether the candidate was modified less than Age ago.
+func (p GCKeepYoungerThan) Retain(ctx context.Context, candidate GCCandidate) (bool, error) {
+	if candidate.Info.ModTime.IsZero() {
+		return true, nil
+	}
+	now := p.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	return now.Sub(candidate.Info.ModTime) < p.Age, nil
+}
+
+func (p GCKeepYoungerThan) String() string {
+	return fmt.Sprintf("keep younger than %s", p.Age)
+}
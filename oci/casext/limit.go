@@ -0,0 +1,198 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// DefaultMaxMetadataSize is the maximum size of the metadata blobs (manifests,
+// manifest lists, descriptors and image configurations) which are read into
+// memory, unless a different limit is set with NewLimitingEngine. It is large
+// enough for any reasonable image, while preventing malicious images from
+// exhausting the memory of the host.
+const DefaultMaxMetadataSize = 4 * 1024 * 1024
+
+// ErrMetadataTooLarge is the cause of a *MetadataTooLargeError.
+var ErrMetadataTooLarge = errors.New("metadata blob too large")
+
+// MetadataTooLargeError is returned when a metadata blob is larger than the
+// maximum metadata size of the engine (see NewLimitingEngine), so it was not
+// read. errors.Cause() of a MetadataTooLargeError is ErrMetadataTooLarge.
+type MetadataTooLargeError struct {
+	// Digest is the digest of the metadata blob.
+	Digest digest.Digest
+
+	// Size is the size of the blob, or -1 if it is unknown (only the first
+	// Limit+1 bytes of the blob are read).
+	Size int64
+
+	// Limit is the maximum metadata size that was exceeded.
+	Limit int64
+}
+
+// Error returns a human-readable description of the error.
+func (e *MetadataTooLargeError) Error() string {
+	if e.Size < 0 {
+		return fmt.Sprintf("%s: %s is larger than %d bytes", ErrMetadataTooLarge, e.Digest, e.Limit)
+	}
+	return fmt.Sprintf("%s: %s is %d bytes (larger than %d bytes)", ErrMetadataTooLarge, e.Digest, e.Size, e.Limit)
+}
+
+// Cause returns ErrMetadataTooLarge, so that errors.Cause() works on
+// MetadataTooLargeError.
+func (e *MetadataTooLargeError) Cause() error {
+	return ErrMetadataTooLarge
+}
+
+// Unwrap returns ErrMetadataTooLarge, so that errors.Is(err,
+// ErrMetadataTooLarge) works on MetadataTooLargeError.
+func (e *MetadataTooLargeError) Unwrap() error {
+	return ErrMetadataTooLarge
+}
+
+// limitingEngine is a cas.Engine with a maximum metadata size. It embeds
+// validatingEngine for its pass-through methods, but has its own PutReference
+// and UpdateReference (and so has no ReferenceValidator).
+type limitingEngine struct {
+	validatingEngine
+	maxSize int64
+}
+
+// NewLimitingEngine wraps the given cas.Engine such that metadata blobs read
+// with FromDescriptor (or ReadMetadataBlob) which are larger than maxSize
+// bytes are rejected with a *MetadataTooLargeError, rather than the default
+// of DefaultMaxMetadataSize. If maxSize is zero, metadata blobs of any size
+// are read. All operations are passed through to engine unmodified.
+//
+// In order for the limit to be used, the returned engine must not be wrapped
+// by any other engine (other than by NewValidatingEngine, NewStrictEngine,
+// NewRecordingEngine or Engine).
+func NewLimitingEngine(engine cas.Engine, maxSize int64) cas.Engine {
+	return &limitingEngine{
+		validatingEngine: validatingEngine{
+			Engine: engine,
+		},
+		maxSize: maxSize,
+	}
+}
+
+// PutReference passes through to the underlying engine.
+func (e *limitingEngine) PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	return e.Engine.PutReference(ctx, name, descriptor)
+}
+
+// UpdateReference passes through to the underlying engine, if it is a
+// cas.UpdatingEngine.
+func (e *limitingEngine) UpdateReference(ctx context.Context, name string, oldDescriptor *ispec.Descriptor, newDescriptor ispec.Descriptor) error {
+	engine, ok := e.Engine.(cas.UpdatingEngine)
+	if !ok {
+		return cas.ErrNotImplemented
+	}
+	return engine.UpdateReference(ctx, name, oldDescriptor, newDescriptor)
+}
+
+// metadataLimiter is implemented by the engine wrappers in this package, so
+// that the maximum metadata size set with NewLimitingEngine can be found.
+type metadataLimiter interface {
+	maxMetadataSize() int64
+}
+
+// maxMetadataSize returns the maximum metadata size of the given engine.
+func maxMetadataSize(engine cas.Engine) int64 {
+	if limiter, ok := engine.(metadataLimiter); ok {
+		return limiter.maxMetadataSize()
+	}
+	return DefaultMaxMetadataSize
+}
+
+func (e *limitingEngine) maxMetadataSize() int64 {
+	return e.maxSize
+}
+
+func (e *validatingEngine) maxMetadataSize() int64 {
+	return maxMetadataSize(e.Engine)
+}
+
+// maxMetadataSize is implemented by Engine as well, because it is often
+// passed as a cas.Engine (and then wrapped in another Engine).
+func (e Engine) maxMetadataSize() int64 {
+	return maxMetadataSize(e.Engine)
+}
+
+// MaxMetadataSize returns the maximum size of the metadata blobs read by the
+// engine, or zero if they are not limited (see NewLimitingEngine).
+func (e Engine) MaxMetadataSize() int64 {
+	return e.maxMetadataSize()
+}
+
+// descriptorSize returns the size of the blob with the given descriptor, or -1
+// if it is unknown. Descriptors constructed from only a digest have a zero
+// size, so it is treated as unknown.
+func descriptorSize(descriptor ispec.Descriptor) int64 {
+	if descriptor.Size <= 0 {
+		return -1
+	}
+	return descriptor.Size
+}
+
+// readMetadata reads the contents of the metadata blob with the given digest
+// and size (which is -1 if unknown) from reader, failing with a
+// *MetadataTooLargeError if it is larger than limit (unless limit is zero).
+// At most limit+1 bytes are read, so that a blob larger than its descriptor
+// claims cannot exhaust memory.
+func readMetadata(reader io.Reader, blobDigest digest.Digest, size, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return ioutil.ReadAll(reader)
+	}
+	if size > limit {
+		return nil, &MetadataTooLargeError{Digest: blobDigest, Size: size, Limit: limit}
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, &MetadataTooLargeError{Digest: blobDigest, Size: -1, Limit: limit}
+	}
+	return data, nil
+}
+
+// ReadMetadataBlob reads the contents of the metadata blob (such as a
+// manifest or configuration) with the given descriptor into memory, without
+// parsing it. If the blob is larger than MaxMetadataSize (according to the
+// descriptor or its actual contents), a *MetadataTooLargeError is returned
+// instead.
+func (e Engine) ReadMetadataBlob(ctx context.Context, descriptor ispec.Descriptor) ([]byte, error) {
+	reader, err := e.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	data, err := readMetadata(reader, descriptor.Digest, descriptorSize(descriptor), e.MaxMetadataSize())
+	return data, errors.Wrap(err, "read blob")
+}
@@ -0,0 +1,117 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestMaxMetadataSize(t *testing.T) {
+	engine := mem.New()
+	defer engine.Close()
+
+	if got := (Engine{engine}).MaxMetadataSize(); got != DefaultMaxMetadataSize {
+		t.Errorf("expected default limit %d, got %d", DefaultMaxMetadataSize, got)
+	}
+	limited := NewLimitingEngine(engine, 1234)
+	if got := (Engine{limited}).MaxMetadataSize(); got != 1234 {
+		t.Errorf("expected limit 1234, got %d", got)
+	}
+	// The limit is still found through the other wrappers.
+	wrapped := NewStrictEngine(NewRecordingEngine(Engine{limited}, nil))
+	if got := (Engine{wrapped}).MaxMetadataSize(); got != 1234 {
+		t.Errorf("expected wrapped limit 1234, got %d", got)
+	}
+	if got := (Engine{NewLimitingEngine(engine, 0)}).MaxMetadataSize(); got != 0 {
+		t.Errorf("expected no limit, got %d", got)
+	}
+}
+
+func TestLimitingEngine(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+
+	config := ispec.Image{
+		Author: strings.Repeat("a", 4096),
+	}
+	configDigest, configSize, err := Engine{engine}.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+
+	for _, test := range []struct {
+		name       string
+		limit      int64
+		descriptor ispec.Descriptor
+		tooLarge   bool
+	}{
+		{"Default", -1, descriptor, false},
+		{"Unlimited", 0, descriptor, false},
+		{"Exact", configSize, descriptor, false},
+		{"TooLarge", configSize - 1, descriptor, true},
+		// A descriptor which claims that the blob is smaller than it is
+		// doesn't allow reading more than the limit.
+		{"Lying", 1024, ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: configDigest, Size: 10}, true},
+		{"UnknownSize", 1024, ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: configDigest}, true},
+	} {
+		engineExt := Engine{engine}
+		if test.limit >= 0 {
+			engineExt = Engine{NewLimitingEngine(engine, test.limit)}
+		}
+
+		blob, err := engineExt.FromDescriptor(ctx, test.descriptor)
+		if test.tooLarge {
+			if errors.Cause(err) != ErrMetadataTooLarge {
+				t.Errorf("%s: expected FromDescriptor to fail with ErrMetadataTooLarge, got %v", test.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error from FromDescriptor: %+v", test.name, err)
+		} else {
+			if got := blob.Data.(ispec.Image).Author; got != config.Author {
+				t.Errorf("%s: unexpected config contents", test.name)
+			}
+			blob.Close()
+		}
+
+		data, err := engineExt.ReadMetadataBlob(ctx, test.descriptor)
+		if test.tooLarge {
+			if errors.Cause(err) != ErrMetadataTooLarge {
+				t.Errorf("%s: expected ReadMetadataBlob to fail with ErrMetadataTooLarge, got %v", test.name, err)
+			}
+			if _, ok := errors.Cause(err).(*MetadataTooLargeError); ok {
+				t.Errorf("%s: errors.Cause should not return the MetadataTooLargeError itself", test.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error from ReadMetadataBlob: %+v", test.name, err)
+		} else if int64(len(data)) != configSize {
+			t.Errorf("%s: expected %d bytes, got %d", test.name, configSize, len(data))
+		}
+	}
+}
@@ -0,0 +1,345 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io"
+	"os"
+	"reflect"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ImageLockVersion is the version of the ImageLock format generated by Lock.
+const ImageLockVersion = 1
+
+// ImageLock records the exact composition of an image manifest, so that an
+// identical manifest can be assembled (and verified) later with Assemble.
+type ImageLock struct {
+	// Version is the version of the lock format (ImageLockVersion).
+	Version int `json:"lockVersion"`
+
+	// Manifest is the descriptor of the locked manifest.
+	Manifest ispec.Descriptor `json:"manifest"`
+
+	// Base is the image that the locked image was built on top of, if any.
+	Base *ImageLockBase `json:"base,omitempty"`
+
+	// Config is the descriptor of the configuration of the locked manifest.
+	Config ispec.Descriptor `json:"config"`
+
+	// Layers are the layers of the locked manifest, in order.
+	Layers []ImageLockLayer `json:"layers"`
+
+	// Annotations are the annotations of the locked manifest.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ImageLockBase describes the base image of a locked image. The first Layers
+// layers of the locked image are the layers of the base image.
+type ImageLockBase struct {
+	// Manifest is the descriptor of the manifest of the base image.
+	Manifest ispec.Descriptor `json:"manifest"`
+
+	// Layers is the number of layers in the base image.
+	Layers int `json:"layers"`
+}
+
+// ImageLockLayer is a single locked layer, along with the digest of its
+// uncompressed contents (taken from the configuration).
+type ImageLockLayer struct {
+	ispec.Descriptor
+
+	// DiffID is the digest of the uncompressed layer.
+	DiffID digest.Digest `json:"diffID"`
+}
+
+// manifest returns the manifest described by the lock.
+func (lock ImageLock) manifest() ispec.Manifest {
+	manifest := ispec.Manifest{
+		Config:      lock.Config,
+		Layers:      []ispec.Descriptor{},
+		Annotations: lock.Annotations,
+	}
+	manifest.SchemaVersion = 2
+	for _, layer := range lock.Layers {
+		manifest.Layers = append(manifest.Layers, layer.Descriptor)
+	}
+	return manifest
+}
+
+// matches returns whether the given manifest has the composition described
+// by the lock.
+func (lock ImageLock) matches(manifest ispec.Manifest) bool {
+	if !reflect.DeepEqual(manifest.Config, lock.Config) || len(manifest.Layers) != len(lock.Layers) {
+		return false
+	}
+	for idx, layer := range manifest.Layers {
+		if !reflect.DeepEqual(layer, lock.Layers[idx].Descriptor) {
+			return false
+		}
+	}
+	// A missing set of annotations is the same as an empty one.
+	if len(manifest.Annotations) == 0 && len(lock.Annotations) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(manifest.Annotations, lock.Annotations)
+}
+
+// parseManifest returns the manifest referenced by the given descriptor.
+func (e Engine) parseManifest(ctx context.Context, descriptor ispec.Descriptor) (ispec.Manifest, error) {
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return ispec.Manifest{}, errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: %s", descriptor.MediaType)
+	}
+	blob, err := e.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return ispec.Manifest{}, errors.Wrap(err, "get manifest")
+	}
+	defer blob.Close()
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return ispec.Manifest{}, errors.Errorf("[internal error] unknown manifest blob type: %s", blob.MediaType)
+	}
+	return manifest, nil
+}
+
+// lockDiffIDs returns the DiffIDs listed in the configuration referenced by
+// the given descriptor.
+func (e Engine) lockDiffIDs(ctx context.Context, descriptor ispec.Descriptor) ([]digest.Digest, error) {
+	if descriptor.MediaType != ispec.MediaTypeImageConfig {
+		return nil, errors.Errorf("descriptor does not point to ispec.MediaTypeImageConfig: %s", descriptor.MediaType)
+	}
+	blob, err := e.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return nil, errors.Wrap(err, "get config")
+	}
+	defer blob.Close()
+	config, ok := blob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return nil, errors.Errorf("[internal error] unknown config blob type: %s", blob.MediaType)
+	}
+
+	var diffIDs []digest.Digest
+	for _, diffID := range config.RootFS.DiffIDs {
+		diffIDs = append(diffIDs, digest.Digest(diffID))
+	}
+	return diffIDs, nil
+}
+
+// lockBase verifies that the layers of the base manifest are a prefix of the
+// given layers, and returns the description of the base.
+func (e Engine) lockBase(ctx context.Context, layers []ispec.Descriptor, base ispec.Descriptor) (*ImageLockBase, error) {
+	manifest, err := e.parseManifest(ctx, base)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse base manifest")
+	}
+	if len(manifest.Layers) > len(layers) {
+		return nil, errors.Errorf("base has more layers (%d) than the image (%d)", len(manifest.Layers), len(layers))
+	}
+	for idx, layer := range manifest.Layers {
+		if layer.Digest != layers[idx].Digest {
+			return nil, errors.Errorf("image is not based on base: layer %d is %s rather than %s", idx, layers[idx].Digest, layer.Digest)
+		}
+	}
+	return &ImageLockBase{
+		Manifest: base,
+		Layers:   len(manifest.Layers),
+	}, nil
+}
+
+// Lock returns an ImageLock describing the manifest referenced by the given
+// descriptor. If base is not nil, it must reference the manifest of the image
+// the manifest was built on top of (the layers of the base must be a prefix
+// of the layers of the manifest), and it is recorded in the lock.
+func (e Engine) Lock(ctx context.Context, descriptor ispec.Descriptor, base *ispec.Descriptor) (ImageLock, error) {
+	lock := ImageLock{
+		Version:  ImageLockVersion,
+		Manifest: descriptor,
+		Layers:   []ImageLockLayer{},
+	}
+
+	manifest, err := e.parseManifest(ctx, descriptor)
+	if err != nil {
+		return lock, errors.Wrap(err, "parse manifest")
+	}
+	diffIDs, err := e.lockDiffIDs(ctx, manifest.Config)
+	if err != nil {
+		return lock, errors.Wrap(err, "get diffids")
+	}
+	if len(diffIDs) != len(manifest.Layers) {
+		return lock, errors.Errorf("config has %d diffids but manifest has %d layers", len(diffIDs), len(manifest.Layers))
+	}
+
+	lock.Config = manifest.Config
+	lock.Annotations = manifest.Annotations
+	for idx, layer := range manifest.Layers {
+		lock.Layers = append(lock.Layers, ImageLockLayer{
+			Descriptor: layer,
+			DiffID:     diffIDs[idx],
+		})
+	}
+
+	if base != nil {
+		lock.Base, err = e.lockBase(ctx, manifest.Layers, *base)
+		if err != nil {
+			return lock, errors.Wrap(err, "lock base")
+		}
+	}
+	return lock, nil
+}
+
+// AssembleOptions specifies how Assemble gets the blobs of the locked image.
+type AssembleOptions struct {
+	// Source is an engine from which blobs which are missing from the image
+	// are copied. If nil, all of the locked blobs must already be present.
+	Source cas.Engine
+}
+
+// verifyBlob checks that the blob referenced by the given descriptor is
+// present, and has the expected size and digest. If the blob is missing and
+// source is not nil, it is first copied from source.
+func (e Engine) verifyBlob(ctx context.Context, descriptor ispec.Descriptor, source cas.Engine) error {
+	reader, err := e.GetBlob(ctx, descriptor.Digest)
+	if os.IsNotExist(errors.Cause(err)) && source != nil {
+		event.Log(ctx).Debugf("assemble: copying missing blob %s", descriptor.Digest)
+		if _, err := copyBlob(ctx, e, source, descriptor.Digest); err != nil {
+			return errors.Wrapf(err, "copy blob %s", descriptor.Digest)
+		}
+		reader, err = e.GetBlob(ctx, descriptor.Digest)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "get blob %s", descriptor.Digest)
+	}
+	defer reader.Close()
+
+	verifier := descriptor.Digest.Verifier()
+	size, err := io.Copy(verifier, reader)
+	if err != nil {
+		return errors.Wrapf(err, "read blob %s", descriptor.Digest)
+	}
+	if size != descriptor.Size {
+		return errors.Errorf("blob %s has size %d rather than %d", descriptor.Digest, size, descriptor.Size)
+	}
+	if !verifier.Verified() {
+		return errors.Wrapf(cas.ErrDigestMismatch, "blob %s", descriptor.Digest)
+	}
+	return nil
+}
+
+// Assemble is equivalent to AssembleWithOptions with the default options.
+func (e Engine) Assemble(ctx context.Context, lock ImageLock) (ispec.Descriptor, error) {
+	return e.AssembleWithOptions(ctx, lock, AssembleOptions{})
+}
+
+// AssembleWithOptions assembles the manifest described by the given lock and
+// returns its descriptor. Every blob in the lock is verified, and the
+// configuration must list the locked DiffIDs. If the locked manifest is
+// already present, it must match the lock. Otherwise it is rebuilt from the
+// lock, and it is an error if the rebuilt manifest doesn't have the locked
+// digest. No references are created, that is left to the caller.
+func (e Engine) AssembleWithOptions(ctx context.Context, lock ImageLock, opt AssembleOptions) (ispec.Descriptor, error) {
+	if lock.Version != ImageLockVersion {
+		return ispec.Descriptor{}, errors.Errorf("unsupported lock version: %d", lock.Version)
+	}
+	if lock.Manifest.MediaType != ispec.MediaTypeImageManifest {
+		return ispec.Descriptor{}, errors.Errorf("unsupported locked manifest type: %s", lock.Manifest.MediaType)
+	}
+
+	// Verify the blobs that make up the image.
+	if err := e.verifyBlob(ctx, lock.Config, opt.Source); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "verify config")
+	}
+	chunks, err := ManifestLayerChunks(lock.manifest())
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get chunked layers")
+	}
+	var layers []ispec.Descriptor
+	for idx, layer := range lock.Layers {
+		// Chunked layers only have the blobs of their chunks.
+		blobs := []ispec.Descriptor{layer.Descriptor}
+		if layerChunks, ok := chunks[layer.Digest]; ok {
+			blobs = layerChunks
+		}
+		for _, blob := range blobs {
+			if err := e.verifyBlob(ctx, blob, opt.Source); err != nil {
+				return ispec.Descriptor{}, errors.Wrapf(err, "verify layer %d", idx)
+			}
+		}
+		layers = append(layers, layer.Descriptor)
+	}
+
+	diffIDs, err := e.lockDiffIDs(ctx, lock.Config)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get diffids")
+	}
+	if len(diffIDs) != len(lock.Layers) {
+		return ispec.Descriptor{}, errors.Errorf("config has %d diffids but lock has %d layers", len(diffIDs), len(lock.Layers))
+	}
+	for idx, layer := range lock.Layers {
+		if diffIDs[idx] != layer.DiffID {
+			return ispec.Descriptor{}, errors.Errorf("layer %d has diffid %s in config rather than %s", idx, diffIDs[idx], layer.DiffID)
+		}
+	}
+
+	if lock.Base != nil {
+		if err := e.verifyBlob(ctx, lock.Base.Manifest, opt.Source); err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "verify base manifest")
+		}
+		base, err := e.lockBase(ctx, layers, lock.Base.Manifest)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "verify base")
+		}
+		if base.Layers != lock.Base.Layers {
+			return ispec.Descriptor{}, errors.Errorf("base has %d layers rather than %d", base.Layers, lock.Base.Layers)
+		}
+	}
+
+	// If the manifest is already present (or can be copied from the source),
+	// just make sure it is the manifest we expect. Otherwise, rebuild it.
+	expected := lock.manifest()
+	if err := e.verifyBlob(ctx, lock.Manifest, opt.Source); err == nil {
+		manifest, err := e.parseManifest(ctx, lock.Manifest)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "parse manifest")
+		}
+		if !lock.matches(manifest) {
+			return ispec.Descriptor{}, errors.Errorf("existing manifest %s does not match lock", lock.Manifest.Digest)
+		}
+		return lock.Manifest, nil
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		return ispec.Descriptor{}, errors.Wrap(err, "verify manifest")
+	}
+
+	manifestDigest, manifestSize, err := e.PutBlobJSON(ctx, expected)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put manifest")
+	}
+	if manifestDigest != lock.Manifest.Digest || manifestSize != lock.Manifest.Size {
+		// Don't leave a bogus manifest around.
+		e.DeleteBlob(ctx, manifestDigest)
+		return ispec.Descriptor{}, errors.Errorf("assembled manifest %s does not match locked manifest %s", manifestDigest, lock.Manifest.Digest)
+	}
+	return lock.Manifest, nil
+}
@@ -0,0 +1,226 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+	"sync"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// The Docker image manifest (version 2, schema 2) media types, which are
+// converted to their OCI equivalents by default. These are used by layouts
+// created with "skopeo copy --format v2s2" (among others).
+const (
+	// MediaTypeDockerManifest is the media type of a Docker image manifest.
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+
+	// MediaTypeDockerManifestList is the media type of a Docker manifest list.
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// MediaTypeDockerConfig is the media type of a Docker image configuration.
+	MediaTypeDockerConfig = "application/vnd.docker.container.image.v1+json"
+
+	// MediaTypeDockerLayer is the media type of an uncompressed Docker layer.
+	MediaTypeDockerLayer = "application/vnd.docker.image.rootfs.diff.tar"
+
+	// MediaTypeDockerLayerGzip is the media type of a gzip-compressed Docker
+	// layer.
+	MediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// MediaTypeDockerForeignLayerGzip is the media type of a gzip-compressed
+	// Docker foreign layer (such as a Windows base layer).
+	MediaTypeDockerForeignLayerGzip = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// MediaTypeConverter describes how blobs (and descriptors) of a media type
+// unknown to umoci are translated to an OCI media type, so that images using
+// such media types can be used as though they were OCI images.
+type MediaTypeConverter struct {
+	// MediaType is the OCI media type the foreign media type is translated
+	// to. It must be one of the media types supported by FromDescriptor.
+	MediaType string
+
+	// Convert translates the raw JSON of a blob of the foreign media type to
+	// the JSON of the OCI media type. It is only used for blobs of the JSON
+	// media types parsed by FromDescriptor, and may be nil if no translation
+	// is necessary.
+	Convert func(raw []byte) ([]byte, error)
+}
+
+var (
+	cm         sync.RWMutex
+	converters = map[string]MediaTypeConverter{}
+)
+
+// RegisterMediaTypeConverter registers the converter for the given foreign
+// media type, replacing any existing converter for it. Blobs of registered
+// media types are translated by FromDescriptor, so that the rest of umoci
+// only has to deal with OCI media types. Note that only the parsed blobs are
+// translated, the stored blobs (and their digests) are never modified. The
+// Docker media types are registered by default.
+func RegisterMediaTypeConverter(mediaType string, converter MediaTypeConverter) {
+	cm.Lock()
+	converters[mediaType] = converter
+	cm.Unlock()
+}
+
+func lookupConverter(mediaType string) (MediaTypeConverter, bool) {
+	cm.RLock()
+	defer cm.RUnlock()
+
+	converter, ok := converters[mediaType]
+	return converter, ok
+}
+
+// ConvertMediaType returns the OCI media type the given media type is
+// translated to, or the media type itself if there is no converter for it.
+func ConvertMediaType(mediaType string) string {
+	if converter, ok := lookupConverter(mediaType); ok {
+		return converter.MediaType
+	}
+	return mediaType
+}
+
+// ConvertDescriptor returns the given descriptor with its media type
+// translated by ConvertMediaType.
+func ConvertDescriptor(descriptor ispec.Descriptor) ispec.Descriptor {
+	descriptor.MediaType = ConvertMediaType(descriptor.MediaType)
+	return descriptor
+}
+
+// convertBlob translates the raw JSON of a blob using the converter for its
+// media type. If the blob was described with an OCI media type (for instance,
+// because the descriptor was itself translated by ConvertDescriptor) the
+// converter is chosen based on the mediaType field of the JSON. The raw JSON
+// is returned unmodified if there is no converter.
+func convertBlob(mediaType string, raw []byte) ([]byte, error) {
+	converter, ok := lookupConverter(mediaType)
+	if !ok {
+		var header struct {
+			MediaType string `json:"mediaType"`
+		}
+		// Invalid JSON is reported when the blob is parsed.
+		if err := json.Unmarshal(raw, &header); err != nil || header.MediaType == "" {
+			return raw, nil
+		}
+		converter, ok = lookupConverter(header.MediaType)
+		if !ok || converter.MediaType != mediaType {
+			return raw, nil
+		}
+	}
+	if converter.Convert == nil {
+		return raw, nil
+	}
+	converted, err := converter.Convert(raw)
+	return converted, errors.Wrapf(err, "convert %s", mediaType)
+}
+
+// convertDescriptors returns a Convert function for manifests and manifest
+// lists, which sets their mediaType field to the given OCI media type and
+// translates the media types of the descriptors they contain. All other
+// fields are left untouched.
+func convertDescriptors(mediaType string) func([]byte) ([]byte, error) {
+	return func(raw []byte) ([]byte, error) {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, errors.Wrap(err, "parse blob")
+		}
+
+		var err error
+		fields["mediaType"], err = json.Marshal(mediaType)
+		if err != nil {
+			return nil, err
+		}
+		if config, ok := fields["config"]; ok {
+			if fields["config"], err = convertDescriptorJSON(config); err != nil {
+				return nil, errors.Wrap(err, "convert config descriptor")
+			}
+		}
+		for _, key := range []string{"layers", "manifests"} {
+			list, ok := fields[key]
+			if !ok {
+				continue
+			}
+			var descriptors []json.RawMessage
+			if err := json.Unmarshal(list, &descriptors); err != nil {
+				return nil, errors.Wrapf(err, "parse %s", key)
+			}
+			for idx, descriptor := range descriptors {
+				if descriptors[idx], err = convertDescriptorJSON(descriptor); err != nil {
+					return nil, errors.Wrapf(err, "convert %s descriptor", key)
+				}
+			}
+			if fields[key], err = json.Marshal(descriptors); err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(fields)
+	}
+}
+
+// convertDescriptorJSON translates the mediaType field of the JSON of a
+// descriptor, leaving all other fields untouched.
+func convertDescriptorJSON(raw json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["mediaType"]; !ok {
+		return raw, nil
+	}
+	var mediaType string
+	if err := json.Unmarshal(fields["mediaType"], &mediaType); err != nil {
+		return nil, errors.Wrap(err, "parse mediaType")
+	}
+	converted := ConvertMediaType(mediaType)
+	if converted == mediaType {
+		return raw, nil
+	}
+	var err error
+	if fields["mediaType"], err = json.Marshal(converted); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+func init() {
+	RegisterMediaTypeConverter(MediaTypeDockerManifest, MediaTypeConverter{
+		MediaType: ispec.MediaTypeImageManifest,
+		Convert:   convertDescriptors(ispec.MediaTypeImageManifest),
+	})
+	RegisterMediaTypeConverter(MediaTypeDockerManifestList, MediaTypeConverter{
+		MediaType: ispec.MediaTypeImageManifestList,
+		Convert:   convertDescriptors(ispec.MediaTypeImageManifestList),
+	})
+	// Docker image configurations are a superset of OCI image configurations.
+	RegisterMediaTypeConverter(MediaTypeDockerConfig, MediaTypeConverter{
+		MediaType: ispec.MediaTypeImageConfig,
+	})
+	RegisterMediaTypeConverter(MediaTypeDockerLayer, MediaTypeConverter{
+		MediaType: ispec.MediaTypeImageLayer,
+	})
+	RegisterMediaTypeConverter(MediaTypeDockerLayerGzip, MediaTypeConverter{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+	})
+	RegisterMediaTypeConverter(MediaTypeDockerForeignLayerGzip, MediaTypeConverter{
+		MediaType: ispec.MediaTypeImageLayerNonDistributableGzip,
+	})
+}
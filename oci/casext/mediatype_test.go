@@ -0,0 +1,101 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestDockerMediaTypes(t *testing.T) {
+	ctx := context.Background()
+	engine := Engine{mem.New()}
+
+	// A Docker image as produced by "skopeo copy --format v2s2".
+	layer := putRaw(t, engine, MediaTypeDockerLayerGzip, []byte("layer"))
+	config := putRaw(t, engine, MediaTypeDockerConfig, []byte(`{"architecture":"amd64","os":"linux","config":{"User":"docker"},"rootfs":{"type":"layers","diff_ids":[]},"container":"abc"}`))
+	manifest := putRaw(t, engine, MediaTypeDockerManifest, []byte(fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": %q,
+		"config": {"mediaType": %q, "size": %d, "digest": %q},
+		"layers": [{"mediaType": %q, "size": %d, "digest": %q}]
+	}`, MediaTypeDockerManifest, MediaTypeDockerConfig, config.Size, config.Digest, MediaTypeDockerLayerGzip, layer.Size, layer.Digest)))
+	list := putRaw(t, engine, MediaTypeDockerManifestList, []byte(fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": %q,
+		"manifests": [{"mediaType": %q, "size": %d, "digest": %q, "platform": {"architecture": "amd64", "os": "linux"}}]
+	}`, MediaTypeDockerManifestList, MediaTypeDockerManifest, manifest.Size, manifest.Digest)))
+
+	resolved, err := engine.ResolveManifest(ctx, list, ispec.Platform{OS: "linux", Architecture: "amd64"})
+	if err != nil {
+		t.Fatalf("unexpected error resolving docker manifest list: %+v", err)
+	}
+	if resolved.MediaType != ispec.MediaTypeImageManifest || resolved.Digest != manifest.Digest {
+		t.Errorf("unexpected resolved descriptor: %v", resolved)
+	}
+
+	// Both the original and the translated descriptors can be used.
+	for _, descriptor := range []ispec.Descriptor{manifest, resolved} {
+		blob, err := engine.FromDescriptor(ctx, descriptor)
+		if err != nil {
+			t.Fatalf("unexpected error getting docker manifest: %+v", err)
+		}
+		if blob.MediaType != ispec.MediaTypeImageManifest {
+			t.Errorf("unexpected manifest blob type: %s", blob.MediaType)
+		}
+		parsed, ok := blob.Data.(ispec.Manifest)
+		if !ok {
+			t.Fatalf("docker manifest was not parsed: %T", blob.Data)
+		}
+		if parsed.Config.MediaType != ispec.MediaTypeImageConfig {
+			t.Errorf("config media type not translated: %s", parsed.Config.MediaType)
+		}
+		if len(parsed.Layers) != 1 || parsed.Layers[0].MediaType != ispec.MediaTypeImageLayerGzip {
+			t.Errorf("layer media types not translated: %v", parsed.Layers)
+		}
+		var header struct {
+			MediaType string `json:"mediaType"`
+		}
+		if err := json.Unmarshal(blob.Raw, &header); err != nil {
+			t.Fatal(err)
+		}
+		if header.MediaType != ispec.MediaTypeImageManifest {
+			t.Errorf("raw manifest media type not translated: %s", header.MediaType)
+		}
+		blob.Close()
+
+		configBlob, err := engine.FromDescriptor(ctx, parsed.Config)
+		if err != nil {
+			t.Fatalf("unexpected error getting docker config: %+v", err)
+		}
+		if image, ok := configBlob.Data.(ispec.Image); !ok || image.Config.User != "docker" {
+			t.Errorf("docker config was not parsed: %v", configBlob.Data)
+		}
+		configBlob.Close()
+	}
+
+	// Unregistered media types are still opaque.
+	if converted := ConvertMediaType("application/vnd.example.unknown"); converted != "application/vnd.example.unknown" {
+		t.Errorf("unknown media type was translated to %s", converted)
+	}
+}
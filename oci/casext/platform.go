@@ -0,0 +1,371 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/openSUSE/umoci/pkg/jsonmerge"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// PlatformMatches returns whether a manifest list entry with the platform have
+// satisfies the requested platform want. Only the operating system,
+// architecture and (if requested) variant, operating system version and
+// operating system features are compared. This allows the entries for
+// different versions of Windows (which differ only in os.version) to be
+// selected.
+func PlatformMatches(want, have ispec.Platform) bool {
+	if want.OS != have.OS || want.Architecture != have.Architecture {
+		return false
+	}
+	if want.Variant != "" && want.Variant != have.Variant {
+		return false
+	}
+	if want.OSVersion != "" && want.OSVersion != have.OSVersion {
+		return false
+	}
+	for _, feature := range want.OSFeatures {
+		found := false
+		for _, other := range have.OSFeatures {
+			found = found || feature == other
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// configPlatform contains the platform fields of an image configuration which
+// are not part of ispec.Image.
+type configPlatform struct {
+	OSVersion  string   `json:"os.version,omitempty"`
+	OSFeatures []string `json:"os.features,omitempty"`
+	Variant    string   `json:"variant,omitempty"`
+}
+
+// ManifestPlatform returns the platform of the image manifest referred to by
+// the given descriptor, as described by its image configuration (see
+// ConfigPlatform).
+func (e Engine) ManifestPlatform(ctx context.Context, manifest ispec.Descriptor) (ispec.Platform, error) {
+	manifestBlob, err := e.FromDescriptor(ctx, manifest)
+	if err != nil {
+		return ispec.Platform{}, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	manifestData, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		return ispec.Platform{}, errors.Errorf("manifest platform: descriptor is not a manifest: %s", manifestBlob.MediaType)
+	}
+
+	configBlob, err := e.FromDescriptor(ctx, manifestData.Config)
+	if err != nil {
+		return ispec.Platform{}, errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+
+	return ConfigPlatform(configBlob)
+}
+
+// ConfigPlatform returns the platform described by the given image
+// configuration blob. Unlike ispec.Image, this includes the os.version and
+// os.features fields used by Windows images.
+func ConfigPlatform(configBlob *Blob) (ispec.Platform, error) {
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return ispec.Platform{}, errors.Errorf("config platform: blob is not an image configuration: %s", configBlob.MediaType)
+	}
+	var extra configPlatform
+	if err := json.Unmarshal(configBlob.Raw, &extra); err != nil {
+		return ispec.Platform{}, errors.Wrap(err, "parse config platform")
+	}
+	return ispec.Platform{
+		OS:           config.OS,
+		Architecture: config.Architecture,
+		OSVersion:    extra.OSVersion,
+		OSFeatures:   extra.OSFeatures,
+		Variant:      extra.Variant,
+	}, nil
+}
+
+// PlatformMatcher decides which entries of a manifest list are acceptable for
+// a requested platform, and which of the acceptable entries is preferred.
+type PlatformMatcher interface {
+	// Match returns whether a manifest list entry with the given platform is
+	// acceptable and, if so, its rank. Entries with a lower rank are
+	// preferred over entries with a higher rank.
+	Match(platform ispec.Platform) (rank int, ok bool)
+}
+
+// variantDefaults are the variants implied by an empty variant, for the
+// architectures with numbered variants ("v1", "v2", ...) where each variant
+// can run the binaries of all lower variants.
+var variantDefaults = map[string]string{
+	"amd64": "v1",
+	"arm":   "v7",
+	"arm64": "v8",
+}
+
+// parseVariant returns the number of a numbered variant ("v7" is 7).
+func parseVariant(variant string) (int, bool) {
+	if !strings.HasPrefix(variant, "v") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(variant, "v"))
+	return n, err == nil && n > 0
+}
+
+// variantRank returns whether a binary for the variant have of the given
+// architecture can run on the variant want and, if so, how many variants
+// lower than want it is.
+func variantRank(arch, want, have string) (int, bool) {
+	if want == have {
+		return 0, true
+	}
+	def, ok := variantDefaults[arch]
+	if !ok {
+		return 0, false
+	}
+	if have == "" {
+		have = def
+	}
+	wantN, wantOk := parseVariant(want)
+	haveN, haveOk := parseVariant(have)
+	if !wantOk || !haveOk || haveN > wantN {
+		return 0, false
+	}
+	return wantN - haveN, true
+}
+
+// platformMatcher is the PlatformMatcher returned by NewPlatformMatcher.
+type platformMatcher struct {
+	want ispec.Platform
+}
+
+// NewPlatformMatcher returns a PlatformMatcher for the requested platform
+// want. Entries must satisfy want as defined by PlatformMatches, except that
+// if want has a variant, entries for lower variants of the same architecture
+// are also acceptable (so "linux/arm/v7" accepts "linux/arm/v6" and
+// "linux/arm/v5") and the closest variant is preferred. Entries without a
+// variant are treated as having the default variant of their architecture
+// (for instance "v7" for arm, and "v8" for arm64).
+func NewPlatformMatcher(want ispec.Platform) PlatformMatcher {
+	return platformMatcher{want: want}
+}
+
+// Match implements PlatformMatcher.
+func (m platformMatcher) Match(have ispec.Platform) (int, bool) {
+	want := m.want
+	wantVariant, haveVariant := want.Variant, have.Variant
+	want.Variant, have.Variant = "", ""
+	if !PlatformMatches(want, have) {
+		return 0, false
+	}
+	if wantVariant == "" {
+		return 0, true
+	}
+	return variantRank(want.Architecture, wantVariant, haveVariant)
+}
+
+// maxIndexDepth is the maximum number of nested manifest lists that
+// ResolvePlatform will descend through.
+const maxIndexDepth = 16
+
+// platformCandidate is an entry of a (possibly nested) manifest list which
+// was accepted by a PlatformMatcher.
+type platformCandidate struct {
+	entry ispec.ManifestDescriptor
+	rank  int
+	depth int
+}
+
+// better returns whether the candidate is preferred over other, which may be
+// nil. Entries of outer manifest lists are preferred over equally ranked
+// entries of nested manifest lists.
+func (c platformCandidate) better(other *platformCandidate) bool {
+	if other == nil {
+		return true
+	}
+	if c.rank != other.rank {
+		return c.rank < other.rank
+	}
+	return c.depth < other.depth
+}
+
+// ResolvePlatform resolves the given descriptor to an image manifest
+// descriptor. If the descriptor refers to a manifest list, the entries of the
+// manifest list (and of any manifest lists nested within it) are ranked using
+// the given PlatformMatcher, and the descriptor of the best matching manifest
+// is returned. If several manifests match equally well, the first one is
+// chosen. Nested manifest lists are only descended into if their entry has no
+// platform or a platform accepted by the PlatformMatcher. Image manifest
+// descriptors are returned unmodified. An error is returned if there is no
+// matching manifest, or if the descriptor refers to any other type of blob.
+// Foreign media types are translated (see ConvertDescriptor).
+func (e Engine) ResolvePlatform(ctx context.Context, descriptor ispec.Descriptor, matcher PlatformMatcher) (ispec.Descriptor, error) {
+	descriptor = ConvertDescriptor(descriptor)
+	switch descriptor.MediaType {
+	case ispec.MediaTypeImageManifest:
+		return descriptor, nil
+	case ispec.MediaTypeImageManifestList:
+		// Handled below.
+	default:
+		return ispec.Descriptor{}, errors.Errorf("resolve platform: unsupported descriptor type: %s", descriptor.MediaType)
+	}
+
+	best, err := e.bestPlatform(ctx, descriptor, matcher, nil, 0)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	if best == nil {
+		return ispec.Descriptor{}, errors.Errorf("resolve platform: no matching manifest in manifest list %s", descriptor.Digest)
+	}
+	event.Log(ctx).WithFields(event.Fields{
+		"os":      best.entry.Platform.OS,
+		"arch":    best.entry.Platform.Architecture,
+		"variant": best.entry.Platform.Variant,
+		"digest":  best.entry.Digest,
+	}).Debugf("resolved manifest list entry")
+	return best.entry.Descriptor, nil
+}
+
+// bestPlatform returns the best candidate for the PlatformMatcher among best
+// and the entries of the manifest list referred to by the given descriptor
+// (which is at the given nesting depth).
+func (e Engine) bestPlatform(ctx context.Context, list ispec.Descriptor, matcher PlatformMatcher, best *platformCandidate, depth int) (*platformCandidate, error) {
+	if depth >= maxIndexDepth {
+		return nil, errors.Errorf("resolve platform: manifest lists nested more than %d deep", maxIndexDepth)
+	}
+
+	blob, err := e.FromDescriptor(ctx, list)
+	if err != nil {
+		return nil, errors.Wrap(err, "get manifest list blob")
+	}
+	defer blob.Close()
+
+	manifestList, ok := blob.Data.(ispec.ManifestList)
+	if !ok {
+		// Should _never_ be reached.
+		return nil, errors.Errorf("[internal error] unknown manifest list blob type: %s", blob.MediaType)
+	}
+
+	for _, entry := range manifestList.Manifests {
+		entry.Descriptor = ConvertDescriptor(entry.Descriptor)
+		rank, ok := matcher.Match(entry.Platform)
+		switch entry.MediaType {
+		case ispec.MediaTypeImageManifest:
+			if !ok {
+				continue
+			}
+			candidate := platformCandidate{entry: entry, rank: rank, depth: depth}
+			if candidate.better(best) {
+				best = &candidate
+			}
+		case ispec.MediaTypeImageManifestList:
+			if !ok && (entry.Platform.OS != "" || entry.Platform.Architecture != "") {
+				continue
+			}
+			best, err = e.bestPlatform(ctx, entry.Descriptor, matcher, best, depth+1)
+			if err != nil {
+				return nil, errors.Wrapf(err, "resolve nested manifest list %s", entry.Digest)
+			}
+		default:
+			if ok {
+				event.Log(ctx).WithFields(event.Fields{
+					"mediatype": entry.MediaType,
+					"digest":    entry.Digest,
+				}).Debugf("skipping manifest list entry with unsupported type")
+			}
+		}
+	}
+	return best, nil
+}
+
+// ResolveManifest resolves the given descriptor to an image manifest
+// descriptor for the requested platform. It is equivalent to ResolvePlatform
+// with NewPlatformMatcher(platform).
+func (e Engine) ResolveManifest(ctx context.Context, descriptor ispec.Descriptor, platform ispec.Platform) (ispec.Descriptor, error) {
+	descriptor, err := e.ResolvePlatform(ctx, descriptor, NewPlatformMatcher(platform))
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "resolve manifest for %s/%s", platform.OS, platform.Architecture)
+	}
+	return descriptor, nil
+}
+
+// UpdateManifestList creates a new manifest list based on the manifest list
+// referred to by the given descriptor, in which the entry for the given
+// platform refers to the given manifest. If the manifest list has no entry
+// for the platform, a new entry is appended. The original manifest list is
+// not modified, and the descriptor of the new manifest list is returned.
+func (e Engine) UpdateManifestList(ctx context.Context, list ispec.Descriptor, manifest ispec.Descriptor, platform ispec.Platform) (ispec.Descriptor, error) {
+	list, manifest = ConvertDescriptor(list), ConvertDescriptor(manifest)
+	if list.MediaType != ispec.MediaTypeImageManifestList {
+		return ispec.Descriptor{}, errors.Errorf("update manifest list: descriptor is not a manifest list: %s", list.MediaType)
+	}
+	if manifest.MediaType != ispec.MediaTypeImageManifest {
+		return ispec.Descriptor{}, errors.Errorf("update manifest list: descriptor is not a manifest: %s", manifest.MediaType)
+	}
+
+	blob, err := e.FromDescriptor(ctx, list)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get manifest list blob")
+	}
+	defer blob.Close()
+
+	manifestList, ok := blob.Data.(ispec.ManifestList)
+	if !ok {
+		// Should _never_ be reached.
+		return ispec.Descriptor{}, errors.Errorf("[internal error] unknown manifest list blob type: %s", blob.MediaType)
+	}
+
+	found := false
+	for idx, entry := range manifestList.Manifests {
+		if PlatformMatches(platform, entry.Platform) {
+			manifestList.Manifests[idx].Descriptor = manifest
+			found = true
+			break
+		}
+	}
+	if !found {
+		manifestList.Manifests = append(manifestList.Manifests, ispec.ManifestDescriptor{
+			Descriptor: manifest,
+			Platform:   platform,
+		})
+	}
+
+	data, err := jsonmerge.Preserve(blob.Raw, manifestList)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "preserve unknown manifest list fields")
+	}
+	digest, size, err := e.PutBlobJSON(ctx, data)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put manifest list blob")
+	}
+	return ispec.Descriptor{
+		MediaType: list.MediaType,
+		Digest:    digest,
+		Size:      size,
+	}, nil
+}
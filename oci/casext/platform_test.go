@@ -0,0 +1,151 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestPlatformMatches(t *testing.T) {
+	have := ispec.Platform{
+		OS:           "windows",
+		Architecture: "amd64",
+		OSVersion:    "10.0.20348.1",
+		OSFeatures:   []string{"win32k"},
+		Variant:      "v2",
+	}
+	for _, test := range []struct {
+		name    string
+		want    ispec.Platform
+		matches bool
+	}{
+		{"OSArch", ispec.Platform{OS: "windows", Architecture: "amd64"}, true},
+		{"OtherOS", ispec.Platform{OS: "linux", Architecture: "amd64"}, false},
+		{"OtherArch", ispec.Platform{OS: "windows", Architecture: "arm64"}, false},
+		{"Variant", ispec.Platform{OS: "windows", Architecture: "amd64", Variant: "v2"}, true},
+		{"OtherVariant", ispec.Platform{OS: "windows", Architecture: "amd64", Variant: "v3"}, false},
+		{"OSVersion", ispec.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.1"}, true},
+		{"OtherOSVersion", ispec.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1"}, false},
+		{"OSFeatures", ispec.Platform{OS: "windows", Architecture: "amd64", OSFeatures: []string{"win32k"}}, true},
+		{"MissingOSFeatures", ispec.Platform{OS: "windows", Architecture: "amd64", OSFeatures: []string{"win32k", "other"}}, false},
+	} {
+		if got := PlatformMatches(test.want, have); got != test.matches {
+			t.Errorf("%s: expected PlatformMatches to return %v, got %v", test.name, test.matches, got)
+		}
+	}
+}
+
+func TestPlatformMatcher(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want ispec.Platform
+		have ispec.Platform
+		rank int
+		ok   bool
+	}{
+		{"NoVariant", ispec.Platform{OS: "linux", Architecture: "arm"}, ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, 0, true},
+		{"ExactVariant", ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, 0, true},
+		{"LowerVariant", ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, 1, true},
+		{"LowestVariant", ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v5"}, 2, true},
+		{"HigherVariant", ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, 0, false},
+		{"DefaultVariant", ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v8"}, ispec.Platform{OS: "linux", Architecture: "arm"}, 1, true},
+		{"HigherDefaultVariant", ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, ispec.Platform{OS: "linux", Architecture: "arm"}, 0, false},
+		{"Arm64DefaultVariant", ispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, ispec.Platform{OS: "linux", Architecture: "arm64"}, 0, true},
+		{"Amd64Variant", ispec.Platform{OS: "linux", Architecture: "amd64", Variant: "v3"}, ispec.Platform{OS: "linux", Architecture: "amd64", Variant: "v2"}, 1, true},
+		{"OtherArchVariant", ispec.Platform{OS: "linux", Architecture: "ppc64le", Variant: "v2"}, ispec.Platform{OS: "linux", Architecture: "ppc64le", Variant: "v1"}, 0, false},
+		{"OtherArch", ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, ispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v7"}, 0, false},
+	} {
+		rank, ok := NewPlatformMatcher(test.want).Match(test.have)
+		if ok != test.ok || (ok && rank != test.rank) {
+			t.Errorf("%s: expected Match to return (%d, %v), got (%d, %v)", test.name, test.rank, test.ok, rank, ok)
+		}
+	}
+}
+
+func TestResolvePlatform(t *testing.T) {
+	ctx := context.Background()
+	engine := Engine{mem.New()}
+	defer engine.Close()
+
+	putList := func(entries ...ispec.ManifestDescriptor) ispec.Descriptor {
+		data, err := json.Marshal(ispec.ManifestList{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Manifests: entries,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return putRaw(t, engine, ispec.MediaTypeImageManifestList, data)
+	}
+	manifest := func(name string, platform ispec.Platform) ispec.ManifestDescriptor {
+		return ispec.ManifestDescriptor{
+			Descriptor: putRaw(t, engine, ispec.MediaTypeImageManifest, []byte(`{"schemaVersion":2,"name":"`+name+`"}`)),
+			Platform:   platform,
+		}
+	}
+
+	armV5 := manifest("arm-v5", ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v5"})
+	armV6 := manifest("arm-v6", ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v6"})
+	arm64 := manifest("arm64", ispec.Platform{OS: "linux", Architecture: "arm64"})
+	amd64 := manifest("amd64", ispec.Platform{OS: "linux", Architecture: "amd64"})
+	amd64Nested := manifest("amd64-nested", ispec.Platform{OS: "linux", Architecture: "amd64"})
+
+	nested := putList(armV6, arm64, amd64Nested)
+	list := putList(
+		armV5,
+		ispec.ManifestDescriptor{Descriptor: nested},
+		amd64,
+	)
+
+	for _, test := range []struct {
+		name     string
+		platform ispec.Platform
+		expected ispec.Descriptor
+	}{
+		{"ClosestVariant", ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, armV6.Descriptor},
+		{"ExactVariant", ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v5"}, armV5.Descriptor},
+		{"FirstMatch", ispec.Platform{OS: "linux", Architecture: "arm"}, armV5.Descriptor},
+		{"Nested", ispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, arm64.Descriptor},
+		{"OuterPreferred", ispec.Platform{OS: "linux", Architecture: "amd64"}, amd64.Descriptor},
+	} {
+		got, err := engine.ResolveManifest(ctx, list, test.platform)
+		if err != nil {
+			t.Errorf("%s: unexpected error resolving manifest: %+v", test.name, err)
+			continue
+		}
+		if got.Digest != test.expected.Digest {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected.Digest, got.Digest)
+		}
+	}
+
+	for _, platform := range []ispec.Platform{
+		{OS: "linux", Architecture: "arm", Variant: "v4"},
+		{OS: "linux", Architecture: "s390x"},
+		{OS: "windows", Architecture: "amd64"},
+	} {
+		if got, err := engine.ResolveManifest(ctx, list, platform); err == nil {
+			t.Errorf("%s/%s/%s: expected error resolving manifest, got %s", platform.OS, platform.Architecture, platform.Variant, got.Digest)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"os"
+	"reflect"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ReferenceRecorder is called after a reference has been changed, with the
+// reference name and the descriptors it referred to before and after the
+// change. oldDescriptor is nil if the reference was created, and
+// newDescriptor is nil if it was removed. Returning a non-nil error causes
+// the operation to fail, but the change has already been made.
+type ReferenceRecorder func(ctx context.Context, name string, oldDescriptor, newDescriptor *ispec.Descriptor) error
+
+// recordingEngine is a cas.Engine which calls a ReferenceRecorder after every
+// change to a reference. It embeds validatingEngine for its pass-through
+// methods, but has its own PutReference and UpdateReference (and so has no
+// ReferenceValidator).
+type recordingEngine struct {
+	validatingEngine
+	recorder ReferenceRecorder
+}
+
+// NewRecordingEngine wraps the given cas.Engine such that recorder is called
+// after every reference that is written with PutReference (or
+// UpdateReference) or removed with DeleteReference. Operations which do not
+// change the reference (such as writing the descriptor it already refers to,
+// or removing a reference that doesn't exist) are not recorded. All other
+// operations are passed through to engine unmodified.
+func NewRecordingEngine(engine cas.Engine, recorder ReferenceRecorder) cas.Engine {
+	return &recordingEngine{
+		validatingEngine: validatingEngine{
+			Engine: engine,
+		},
+		recorder: recorder,
+	}
+}
+
+// currentReference returns the descriptor currently stored at the given
+// reference, or nil if it doesn't exist.
+func (e *recordingEngine) currentReference(ctx context.Context, name string) (*ispec.Descriptor, error) {
+	descriptor, err := e.Engine.GetReference(ctx, name)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "get old reference %s", name)
+	}
+	return &descriptor, nil
+}
+
+// record calls the recorder if the reference was changed.
+func (e *recordingEngine) record(ctx context.Context, name string, oldDescriptor, newDescriptor *ispec.Descriptor) error {
+	if oldDescriptor == nil && newDescriptor == nil {
+		return nil
+	}
+	if oldDescriptor != nil && newDescriptor != nil && reflect.DeepEqual(*oldDescriptor, *newDescriptor) {
+		return nil
+	}
+	return errors.Wrapf(e.recorder(ctx, name, oldDescriptor, newDescriptor), "record reference %s", name)
+}
+
+// PutReference passes through to the underlying engine, and then records the
+// change.
+func (e *recordingEngine) PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	oldDescriptor, err := e.currentReference(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := e.Engine.PutReference(ctx, name, descriptor); err != nil {
+		return err
+	}
+	return e.record(ctx, name, oldDescriptor, &descriptor)
+}
+
+// UpdateReference passes through to the underlying engine, if it is a
+// cas.UpdatingEngine, and then records the change.
+func (e *recordingEngine) UpdateReference(ctx context.Context, name string, oldDescriptor *ispec.Descriptor, newDescriptor ispec.Descriptor) error {
+	engine, ok := e.Engine.(cas.UpdatingEngine)
+	if !ok {
+		return cas.ErrNotImplemented
+	}
+	// The update is a no-op if the reference already refers to
+	// newDescriptor, even if it doesn't match oldDescriptor.
+	current, err := e.currentReference(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := engine.UpdateReference(ctx, name, oldDescriptor, newDescriptor); err != nil {
+		return err
+	}
+	return e.record(ctx, name, current, &newDescriptor)
+}
+
+// DeleteReference passes through to the underlying engine, and then records
+// the change.
+func (e *recordingEngine) DeleteReference(ctx context.Context, name string) error {
+	oldDescriptor, err := e.currentReference(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := e.Engine.DeleteReference(ctx, name); err != nil {
+		return err
+	}
+	return e.record(ctx, name, oldDescriptor, nil)
+}
@@ -0,0 +1,107 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestRecordingEngine(t *testing.T) {
+	ctx := context.Background()
+
+	type change struct {
+		name     string
+		old, new digest.Digest
+	}
+	var changes []change
+	engine := NewRecordingEngine(mem.New(), func(ctx context.Context, name string, oldDescriptor, newDescriptor *ispec.Descriptor) error {
+		c := change{name: name}
+		if oldDescriptor != nil {
+			c.old = oldDescriptor.Digest
+		}
+		if newDescriptor != nil {
+			c.new = newDescriptor.Digest
+		}
+		changes = append(changes, c)
+		return nil
+	})
+	defer engine.Close()
+
+	a := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: digest.FromString("a"), Size: 1}
+	b := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: digest.FromString("b"), Size: 1}
+
+	if err := engine.PutReference(ctx, "tag", a); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	// Writing the same descriptor again doesn't change anything.
+	if err := engine.PutReference(ctx, "tag", a); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	// Failed writes are not recorded.
+	if err := engine.PutReference(ctx, "tag", b); errors.Cause(err) == nil {
+		t.Fatalf("expected clobbering PutReference to fail")
+	}
+	if err := engine.(cas.UpdatingEngine).UpdateReference(ctx, "tag", &a, b); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := engine.(cas.UpdatingEngine).UpdateReference(ctx, "tag", &a, b); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := engine.DeleteReference(ctx, "tag"); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := engine.DeleteReference(ctx, "tag"); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	expected := []change{
+		{name: "tag", new: a.Digest},
+		{name: "tag", old: a.Digest, new: b.Digest},
+		{name: "tag", old: b.Digest},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("unexpected changes recorded: expected %v got %v", expected, changes)
+	}
+}
+
+func TestRecordingEngineError(t *testing.T) {
+	ctx := context.Background()
+
+	recordErr := errors.New("recording failed")
+	engine := NewRecordingEngine(mem.New(), func(ctx context.Context, name string, oldDescriptor, newDescriptor *ispec.Descriptor) error {
+		return recordErr
+	})
+	defer engine.Close()
+
+	descriptor := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: digest.FromString("a"), Size: 1}
+	if err := engine.PutReference(ctx, "tag", descriptor); errors.Cause(err) != recordErr {
+		t.Errorf("expected recording error, got %v", err)
+	}
+	// The change has still been made.
+	if _, err := engine.GetReference(ctx, "tag"); err != nil {
+		t.Errorf("unexpected error getting reference: %+v", err)
+	}
+}
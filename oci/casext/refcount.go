@@ -0,0 +1,196 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// BlobPool is the set of blobs shared by all of the references in an image,
+// along with the number of references from which each blob is reachable. It
+// allows a reference to be removed along with the blobs which no other
+// reference uses, without the full mark-and-sweep of GC.
+//
+// The reference counts are computed from the references in the image when the
+// BlobPool is created (rather than being stored in the image), so they cannot
+// be invalidated by other tools modifying the image. Like GC, a BlobPool
+// assumes that it is the only user of the image which is making
+// modifications while it is being used.
+type BlobPool struct {
+	engine Engine
+
+	// reachable is the set of blobs reachable from each reference, and
+	// counts is the number of references from which each blob is reachable.
+	reachable map[string]map[digest.Digest]struct{}
+	counts    map[digest.Digest]int
+
+	// referrers maps the name of each referrers index created by Attach to
+	// its subject.
+	referrers map[string]digest.Digest
+}
+
+// BlobPool computes the reference counts of the blobs in the image. Every
+// reference counts, including referrers indexes (see ReferrersTag).
+func (e Engine) BlobPool(ctx context.Context) (*BlobPool, error) {
+	references, err := e.gcReferences(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get references")
+	}
+
+	pool := &BlobPool{
+		engine:    e,
+		reachable: map[string]map[digest.Digest]struct{}{},
+		counts:    map[digest.Digest]int{},
+		referrers: map[string]digest.Digest{},
+	}
+	for name, descriptor := range references {
+		subject, ok, err := e.referrersSubject(ctx, name, descriptor)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			pool.referrers[name] = subject
+		}
+
+		reachables, err := e.Reachable(ctx, descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get blobs reachable from %s", name)
+		}
+		blobs := map[digest.Digest]struct{}{}
+		for _, reachable := range reachables {
+			blobs[reachable] = struct{}{}
+		}
+		for blob := range blobs {
+			pool.counts[blob]++
+		}
+		pool.reachable[name] = blobs
+	}
+	return pool, nil
+}
+
+// RefCount returns the number of references from which the given blob is
+// reachable.
+func (p *BlobPool) RefCount(blobDigest digest.Digest) int {
+	return p.counts[blobDigest]
+}
+
+// release removes the given reference from the pool, returning the blobs
+// which are no longer reachable from any reference.
+func (p *BlobPool) release(name string) []digest.Digest {
+	var unused []digest.Digest
+	for blob := range p.reachable[name] {
+		p.counts[blob]--
+		if p.counts[blob] <= 0 {
+			delete(p.counts, blob)
+			unused = append(unused, blob)
+		}
+	}
+	delete(p.reachable, name)
+	return unused
+}
+
+// DeleteReference removes the given reference from the image, and then
+// removes every blob which is no longer reachable from any other reference.
+// The referrers indexes of removed subjects (and the blobs only reachable
+// from them) are removed as well. Unlike GC, blobs which were already
+// unreachable before the reference was removed are left alone. The returned
+// GCDeletions describe the removed blobs.
+func (p *BlobPool) DeleteReference(ctx context.Context, name string) ([]GCDeletion, error) {
+	// Remove the reference first, so that we never remove the blobs of a
+	// reference which is still present (such as a frozen reference).
+	if err := p.engine.DeleteReference(ctx, name); err != nil {
+		return nil, errors.Wrapf(err, "delete reference %s", name)
+	}
+	event.Log(ctx).WithFields(event.Fields{
+		"name": name,
+	}).Debugf("pool: removed reference")
+
+	reasons := map[digest.Digest]string{}
+	for _, blob := range p.release(name) {
+		reasons[blob] = fmt.Sprintf("only reachable from removed reference %s", name)
+	}
+
+	// Removing subjects orphans their referrers indexes, whose artifacts
+	// might have their own referrers.
+	for orphaned := true; orphaned; {
+		orphaned = false
+		var names []string
+		for other := range p.reachable {
+			names = append(names, other)
+		}
+		sort.Strings(names)
+
+		for _, other := range names {
+			subject, ok := p.referrers[other]
+			if !ok {
+				continue
+			}
+			if _, removed := reasons[subject]; !removed {
+				continue
+			}
+			if err := p.engine.DeleteReference(ctx, other); err != nil {
+				return nil, errors.Wrapf(err, "delete referrers index %s", other)
+			}
+			event.Log(ctx).WithFields(event.Fields{
+				"name": other,
+			}).Debugf("pool: removed orphaned referrers index")
+			for _, blob := range p.release(other) {
+				reasons[blob] = fmt.Sprintf("artifact whose subject %s was removed", subject)
+			}
+			orphaned = true
+		}
+	}
+
+	var blobs []digest.Digest
+	for blob := range reasons {
+		blobs = append(blobs, blob)
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i] < blobs[j] })
+
+	deletions := []GCDeletion{}
+	infos := map[digest.Digest]cas.BlobInfo{}
+	for _, blob := range blobs {
+		info, err := p.engine.gcStat(ctx, blob, infos)
+		if os.IsNotExist(errors.Cause(err)) {
+			// Foreign layers and chunked layers are reachable even though
+			// their blobs aren't in the image.
+			continue
+		} else if err != nil {
+			return deletions, err
+		}
+
+		event.Log(ctx).Infof("pruning blob: %s", blob)
+		if err := p.engine.DeleteBlob(ctx, blob); err != nil {
+			return deletions, errors.Wrapf(err, "remove blob %s", blob)
+		}
+		deletions = append(deletions, GCDeletion{
+			Digest: blob,
+			Size:   info.Size,
+			Reason: reasons[blob],
+		})
+	}
+	return deletions, nil
+}
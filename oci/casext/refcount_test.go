@@ -0,0 +1,121 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestBlobPool(t *testing.T) {
+	ctx := context.Background()
+	engine := Engine{mem.New()}
+	defer engine.Close()
+
+	_, manifests := putVisitImage(t, engine)
+	for idx, name := range []string{"amd64", "arm64"} {
+		if err := engine.PutReference(ctx, name, manifests[idx]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	artifact, err := engine.Attach(ctx, manifests[0], "application/vnd.example.sbom", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error attaching artifact: %+v", err)
+	}
+
+	// A user reference which is named like the referrers index of the
+	// artifact is not a referrers index.
+	userTag := ReferrersTag(artifact.Digest)
+	userList := putJSON(t, engine, ispec.MediaTypeImageManifestList, ispec.ManifestList{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		Manifests: []ispec.ManifestDescriptor{},
+	})
+	if err := engine.PutReference(ctx, userTag, userList); err != nil {
+		t.Fatal(err)
+	}
+
+	// Garbage which was already unreachable is not touched.
+	garbage, _, err := engine.PutBlob(ctx, bytes.NewBufferString("garbage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := engine.BlobPool(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error creating pool: %+v", err)
+	}
+	layer := digest.FromString("layer")
+	if count := pool.RefCount(layer); count != 2 {
+		t.Errorf("expected shared layer to have 2 references, got %d", count)
+	}
+	if count := pool.RefCount(garbage); count != 0 {
+		t.Errorf("expected garbage to have no references, got %d", count)
+	}
+
+	deletions, err := pool.DeleteReference(ctx, "amd64")
+	if err != nil {
+		t.Fatalf("unexpected error deleting reference: %+v", err)
+	}
+	removed := map[digest.Digest]struct{}{}
+	for _, deletion := range deletions {
+		removed[deletion.Digest] = struct{}{}
+	}
+	for _, expected := range []digest.Digest{manifests[0].Digest, artifact.Digest} {
+		if _, ok := removed[expected]; !ok {
+			t.Errorf("expected %s to be removed: got %+v", expected, deletions)
+		}
+		if _, err := engine.GetBlob(ctx, expected); !os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("expected %s to be missing: %+v", expected, err)
+		}
+	}
+	for _, kept := range []digest.Digest{layer, manifests[1].Digest, garbage} {
+		if _, ok := removed[kept]; ok {
+			t.Errorf("unexpected removal of %s", kept)
+		}
+		reader, err := engine.GetBlob(ctx, kept)
+		if err != nil {
+			t.Errorf("unexpected error getting %s: %+v", kept, err)
+			continue
+		}
+		reader.Close()
+	}
+	if count := pool.RefCount(layer); count != 1 {
+		t.Errorf("expected shared layer to have 1 reference, got %d", count)
+	}
+
+	// The orphaned referrers index is removed along with its subject, but
+	// the user reference is kept.
+	names, err := engine.ListReferences(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if expected := []string{"arm64", userTag}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected references after removal: expected %v got %v", expected, names)
+	}
+}
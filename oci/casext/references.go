@@ -0,0 +1,120 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io"
+	"os"
+	"sort"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/event"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ReferencesVersion is the version of the References format generated by
+// ExportReferences.
+const ReferencesVersion = 1
+
+// References is a snapshot of every reference in an image, without any of
+// the blobs. It allows the references of an image to be backed up (and kept
+// in version control) separately from the blobs.
+type References struct {
+	// Version is the version of the format (ReferencesVersion).
+	Version int `json:"version"`
+
+	// References maps the name of each reference to its descriptor.
+	References map[string]ispec.Descriptor `json:"references"`
+}
+
+// ExportReferences returns a snapshot of every reference in the image.
+func (e Engine) ExportReferences(ctx context.Context) (References, error) {
+	refs := References{
+		Version:    ReferencesVersion,
+		References: map[string]ispec.Descriptor{},
+	}
+
+	names, err := e.ListReferences(ctx)
+	if err != nil {
+		return refs, errors.Wrap(err, "list references")
+	}
+	for _, name := range names {
+		descriptor, err := e.GetReference(ctx, name)
+		if err != nil {
+			return refs, errors.Wrapf(err, "get reference %s", name)
+		}
+		refs.References[name] = descriptor
+	}
+	return refs, nil
+}
+
+// ImportReferences calls putFunc for each reference in the snapshot (in
+// order of name), which is expected to store the reference in the image. The
+// caller decides what to do with existing references (see cas.ErrClobber).
+// References to blobs which are missing from the image are still imported
+// (the blobs may be restored separately), but a warning is logged.
+func (e Engine) ImportReferences(ctx context.Context, refs References, putFunc func(name string, descriptor ispec.Descriptor) error) error {
+	if refs.Version != ReferencesVersion {
+		return errors.Errorf("unsupported references version: %d", refs.Version)
+	}
+
+	var names []string
+	for name := range refs.References {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		descriptor := refs.References[name]
+		if err := descriptor.Digest.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid descriptor for reference %s", name)
+		}
+		if exists, err := e.blobExists(ctx, descriptor); err != nil {
+			return errors.Wrapf(err, "check blob for reference %s", name)
+		} else if !exists {
+			event.Log(ctx).Warnf("reference %s refers to missing blob %s", name, descriptor.Digest)
+		}
+		if err := putFunc(name, descriptor); err != nil {
+			return errors.Wrapf(err, "put reference %s", name)
+		}
+	}
+	return nil
+}
+
+// blobExists returns whether the blob referenced by the descriptor is present
+// in the image. If the engine isn't a cas.StatingEngine, the blob is opened
+// (but not read) instead.
+func (e Engine) blobExists(ctx context.Context, descriptor ispec.Descriptor) (bool, error) {
+	err := cas.ErrNotImplemented
+	if engine, ok := e.Engine.(cas.StatingEngine); ok {
+		_, err = engine.StatBlob(ctx, descriptor.Digest)
+	}
+	if errors.Cause(err) == cas.ErrNotImplemented {
+		var reader io.ReadCloser
+		reader, err = e.GetBlob(ctx, descriptor.Digest)
+		if err == nil {
+			reader.Close()
+		}
+	}
+	if os.IsNotExist(errors.Cause(err)) {
+		return false, nil
+	}
+	return err == nil, err
+}
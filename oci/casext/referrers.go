@@ -0,0 +1,113 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Referrer is a descriptor path through which a blob can be reached from a
+// reference.
+type Referrer struct {
+	// Name is the name of the reference.
+	Name string `json:"name"`
+
+	// Path is the descriptor path from the reference to the blob. The first
+	// entry is the descriptor stored in the reference, and the last entry is
+	// the descriptor of the blob.
+	Path []ispec.Descriptor `json:"path"`
+}
+
+// Referrers returns every descriptor path (from every reference in the image)
+// through which the blob with the given digest can be reached. Referrers are
+// ordered by reference name. If the returned slice is empty, the blob is not
+// referenced and would be removed by GC.
+func (e Engine) Referrers(ctx context.Context, target digest.Digest) ([]Referrer, error) {
+	names, err := e.ListReferences(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list references")
+	}
+	sort.Strings(names)
+
+	// Subtrees which are known not to contain the target. Since blobs are
+	// often shared between images, this avoids re-walking them.
+	unreachable := map[digest.Digest]struct{}{}
+
+	var referrers []Referrer
+	for _, name := range names {
+		descriptor, err := e.GetReference(ctx, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get reference %s", name)
+		}
+
+		paths, err := e.referrerPaths(ctx, descriptor, target, unreachable)
+		if err != nil {
+			return nil, errors.Wrapf(err, "walk reference %s", name)
+		}
+		for _, path := range paths {
+			referrers = append(referrers, Referrer{
+				Name: name,
+				Path: path,
+			})
+		}
+	}
+	return referrers, nil
+}
+
+// referrerPaths returns all of the descriptor paths from descriptor to the
+// target blob.
+func (e Engine) referrerPaths(ctx context.Context, descriptor ispec.Descriptor, target digest.Digest, unreachable map[digest.Digest]struct{}) ([][]ispec.Descriptor, error) {
+	if descriptor.Digest == target {
+		return [][]ispec.Descriptor{{descriptor}}, nil
+	}
+	if _, ok := unreachable[descriptor.Digest]; ok {
+		return nil, nil
+	}
+	// Opaque blobs (layers) cannot refer to other blobs, so there's no need
+	// to open them.
+	if isOpaqueBlob(ctx, descriptor) {
+		return nil, nil
+	}
+
+	blob, err := e.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get blob %s", descriptor.Digest)
+	}
+	defer blob.Close()
+
+	var paths [][]ispec.Descriptor
+	childCtx := childContext(ctx, blob)
+	for _, child := range childDescriptors(blob.Data) {
+		childPaths, err := e.referrerPaths(childCtx, child, target, unreachable)
+		if err != nil {
+			return nil, err
+		}
+		for _, childPath := range childPaths {
+			paths = append(paths, append([]ispec.Descriptor{descriptor}, childPath...))
+		}
+	}
+	if len(paths) == 0 {
+		unreachable[descriptor.Digest] = struct{}{}
+	}
+	return paths, nil
+}
@@ -0,0 +1,299 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ErrInvalidBlob is returned (as the cause) by a strict engine (see
+// NewStrictEngine) if the contents of a blob don't match its media type.
+var ErrInvalidBlob = errors.New("blob contents do not match media type")
+
+// strictEngine is a cas.Engine which makes sure that the contents of every
+// blob read with FromDescriptor (or reachable from a reference that is
+// written) match the media type of its descriptor. It embeds validatingEngine
+// for its pass-through methods, but has its own PutReference and
+// UpdateReference (and so has no ReferenceValidator).
+type strictEngine struct {
+	validatingEngine
+}
+
+// strictChecker is implemented by the engine wrappers in this package, so
+// that FromDescriptor can tell whether it is operating on a strict engine.
+type strictChecker interface {
+	isStrict() bool
+}
+
+// isStrict returns whether the given engine is a strict engine (or wraps one
+// using NewValidatingEngine, NewRecordingEngine, NewLimitingEngine or Engine).
+func isStrict(engine cas.Engine) bool {
+	checker, ok := engine.(strictChecker)
+	return ok && checker.isStrict()
+}
+
+func (e *strictEngine) isStrict() bool {
+	return true
+}
+
+func (e *validatingEngine) isStrict() bool {
+	return isStrict(e.Engine)
+}
+
+// isStrict is implemented by Engine as well, because it is often passed as a
+// cas.Engine (and then wrapped in another Engine).
+func (e Engine) isStrict() bool {
+	return isStrict(e.Engine)
+}
+
+// NewStrictEngine wraps the given cas.Engine such that the contents of blobs
+// are validated against the media type of their descriptors, so that
+// malformed images are rejected early rather than causing confusing errors
+// later on. Blobs are validated when they are read with FromDescriptor, and
+// every blob reachable from a reference is validated before the reference is
+// written with PutReference (or UpdateReference). JSON blobs must have the
+// fields required by the image-spec, and layers must start with the magic
+// number of their format. Blobs of unknown media types are not validated.
+//
+// In order for FromDescriptor to validate blobs, the returned engine must not
+// be wrapped by any other engine (other than by NewValidatingEngine,
+// NewRecordingEngine, NewLimitingEngine or Engine).
+func NewStrictEngine(engine cas.Engine) cas.Engine {
+	return &strictEngine{
+		validatingEngine: validatingEngine{
+			Engine: engine,
+		},
+	}
+}
+
+// PutReference validates every blob reachable from the descriptor before
+// passing it to the underlying engine.
+func (e *strictEngine) PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	if err := e.validateReachable(ctx, descriptor); err != nil {
+		return errors.Wrapf(err, "validate reference %s", name)
+	}
+	return e.Engine.PutReference(ctx, name, descriptor)
+}
+
+// UpdateReference validates every blob reachable from the new descriptor
+// before passing it to the underlying engine, if it is a cas.UpdatingEngine.
+func (e *strictEngine) UpdateReference(ctx context.Context, name string, oldDescriptor *ispec.Descriptor, newDescriptor ispec.Descriptor) error {
+	engine, ok := e.Engine.(cas.UpdatingEngine)
+	if !ok {
+		return cas.ErrNotImplemented
+	}
+	if err := e.validateReachable(ctx, newDescriptor); err != nil {
+		return errors.Wrapf(err, "validate reference %s", name)
+	}
+	return engine.UpdateReference(ctx, name, oldDescriptor, newDescriptor)
+}
+
+// validateReachable validates every blob reachable from the given descriptor
+// (including its referrers). FromDescriptor does the actual validation.
+func (e *strictEngine) validateReachable(ctx context.Context, descriptor ispec.Descriptor) error {
+	return Engine{e}.Visit(ctx, descriptor, Visitor{Referrers: true})
+}
+
+// validateDescriptor returns an error if the given descriptor is missing any
+// of its required fields.
+func validateDescriptor(descriptor ispec.Descriptor) error {
+	if descriptor.MediaType == "" {
+		return errors.Errorf("descriptor %s has no media type", descriptor.Digest)
+	}
+	if err := descriptor.Digest.Validate(); err != nil {
+		return errors.Wrapf(err, "descriptor has invalid digest %q", descriptor.Digest)
+	}
+	if descriptor.Size < 0 {
+		return errors.Errorf("descriptor %s has negative size %d", descriptor.Digest, descriptor.Size)
+	}
+	return nil
+}
+
+// validateJSON returns an error if the given JSON blob (of the given media
+// type) is missing any of the fields required by the image-spec. The blob
+// must have already been parsed by Blob.load.
+func validateJSON(mediaType string, raw []byte) error {
+	// The "mediaType" field is optional, but must match if it is present
+	// (except in descriptors, where it is the media type of the target).
+	var header struct {
+		MediaType     string `json:"mediaType"`
+		SchemaVersion *int   `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return errors.Wrap(err, "parse blob")
+	}
+	if mediaType != ispec.MediaTypeDescriptor && header.MediaType != "" && header.MediaType != mediaType {
+		return errors.Errorf("blob has mediaType %s", header.MediaType)
+	}
+
+	switch mediaType {
+	case ispec.MediaTypeDescriptor:
+		var descriptor ispec.Descriptor
+		if err := json.Unmarshal(raw, &descriptor); err != nil {
+			return errors.Wrap(err, "parse descriptor")
+		}
+		return validateDescriptor(descriptor)
+
+	case ispec.MediaTypeImageManifest:
+		if header.SchemaVersion == nil || *header.SchemaVersion != 2 {
+			return errors.Errorf("manifest must have schemaVersion 2")
+		}
+		var manifest ispec.Manifest
+		if err := json.Unmarshal(raw, &manifest); err != nil {
+			return errors.Wrap(err, "parse manifest")
+		}
+		if err := validateDescriptor(manifest.Config); err != nil {
+			return errors.Wrap(err, "manifest config")
+		}
+		if manifest.Layers == nil {
+			return errors.Errorf("manifest has no layers field")
+		}
+		for idx, layer := range manifest.Layers {
+			if err := validateDescriptor(layer); err != nil {
+				return errors.Wrapf(err, "manifest layer %d", idx)
+			}
+		}
+
+	case ispec.MediaTypeImageManifestList:
+		if header.SchemaVersion == nil || *header.SchemaVersion != 2 {
+			return errors.Errorf("manifest list must have schemaVersion 2")
+		}
+		var list ispec.ManifestList
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return errors.Wrap(err, "parse manifest list")
+		}
+		if list.Manifests == nil {
+			return errors.Errorf("manifest list has no manifests field")
+		}
+		for idx, manifest := range list.Manifests {
+			if err := validateDescriptor(manifest.Descriptor); err != nil {
+				return errors.Wrapf(err, "manifest list entry %d", idx)
+			}
+		}
+
+	case ispec.MediaTypeImageConfig:
+		var config ispec.Image
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return errors.Wrap(err, "parse config")
+		}
+		if config.OS == "" || config.Architecture == "" {
+			return errors.Errorf("config must have os and architecture")
+		}
+		if config.RootFS.Type != "layers" {
+			return errors.Errorf("config has unsupported rootfs type %q", config.RootFS.Type)
+		}
+		for idx, diffID := range config.RootFS.DiffIDs {
+			if err := digest.Digest(diffID).Validate(); err != nil {
+				return errors.Wrapf(err, "config has invalid diff_id %d", idx)
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	// gzipMagic is the magic number at the start of a gzip stream.
+	gzipMagic = []byte{0x1f, 0x8b}
+
+	// tarMagic is the magic at offset 257 of the first header of a POSIX
+	// (or GNU) tar archive.
+	tarMagic       = []byte("ustar")
+	tarMagicOffset = 257
+
+	// tarBlockSize is the size of a tar header (and of the two zero blocks
+	// which end an archive, and which make up an empty archive).
+	tarBlockSize = 512
+)
+
+// layerMagic returns a function which checks the magic number of a layer of
+// the given media type, or nil if the media type is not a known layer type.
+func layerMagic(mediaType string) func(header []byte) error {
+	switch mediaType {
+	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable:
+		return func(header []byte) error {
+			if len(header) < tarBlockSize {
+				return errors.Errorf("layer is too small to be a tar archive")
+			}
+			if bytes.Equal(header[:tarBlockSize], make([]byte, tarBlockSize)) {
+				// An empty archive.
+				return nil
+			}
+			if !bytes.Equal(header[tarMagicOffset:tarMagicOffset+len(tarMagic)], tarMagic) {
+				return errors.Errorf("layer is not a tar archive")
+			}
+			return nil
+		}
+	case ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+		return func(header []byte) error {
+			if !bytes.HasPrefix(header, gzipMagic) {
+				return errors.Errorf("layer is not gzip-compressed")
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// strictReader is the io.ReadCloser of an opaque blob which has been checked
+// by validateOpaque. The peeked header is still returned by Read.
+type strictReader struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// validateOpaque checks the magic number of the opaque blob in b, replacing
+// b.Data so that the checked header can still be read.
+func (b *Blob) validateOpaque() error {
+	check := layerMagic(b.MediaType)
+	if check == nil {
+		return nil
+	}
+	reader := b.Data.(io.ReadCloser)
+	buffered := bufio.NewReaderSize(reader, tarBlockSize)
+	b.Data = &strictReader{Reader: buffered, Closer: reader}
+
+	header, err := buffered.Peek(tarBlockSize)
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "read layer header")
+	}
+	return check(header)
+}
+
+// validate checks that the contents of the (loaded) blob match its media
+// type.
+func (b *Blob) validate() error {
+	var err error
+	if b.opaque {
+		err = b.validateOpaque()
+	} else {
+		err = validateJSON(b.MediaType, b.Raw)
+	}
+	if err != nil {
+		return errors.Wrapf(ErrInvalidBlob, "%s %s: %v", b.MediaType, b.Digest, err)
+	}
+	return nil
+}
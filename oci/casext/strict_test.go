@@ -0,0 +1,153 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// putRaw stores the given content as a blob of the given media type.
+func putRaw(t *testing.T, engine Engine, mediaType string, content []byte) ispec.Descriptor {
+	digest, size, err := engine.PutBlob(context.Background(), bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{MediaType: mediaType, Digest: digest, Size: size}
+}
+
+func TestStrictEngineBlobs(t *testing.T) {
+	ctx := context.Background()
+	engine := Engine{NewStrictEngine(mem.New())}
+	defer engine.Close()
+
+	var tarBuffer bytes.Buffer
+	tw := tar.NewWriter(&tarBuffer)
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var gzipBuffer bytes.Buffer
+	gzw := gzip.NewWriter(&gzipBuffer)
+	gzw.Write(tarBuffer.Bytes())
+	gzw.Close()
+
+	for _, test := range []struct {
+		name      string
+		mediaType string
+		content   string
+		valid     bool
+	}{
+		{"tar", ispec.MediaTypeImageLayer, tarBuffer.String(), true},
+		{"tar-empty", ispec.MediaTypeImageLayer, string(make([]byte, 1024)), true},
+		{"tar-gzip", ispec.MediaTypeImageLayerGzip, gzipBuffer.String(), true},
+		{"tar-not-tar", ispec.MediaTypeImageLayer, gzipBuffer.String(), false},
+		{"gzip-not-gzip", ispec.MediaTypeImageLayerGzip, tarBuffer.String(), false},
+		{"encrypted", "application/vnd.oci.image.layer.v1.tar+encrypted", "anything", true},
+		{"unknown", "application/vnd.example.unknown", "anything", false},
+		{"config", ispec.MediaTypeImageConfig, `{"os": "linux", "architecture": "amd64", "rootfs": {"type": "layers", "diff_ids": []}}`, true},
+		{"config-no-os", ispec.MediaTypeImageConfig, `{"architecture": "amd64", "rootfs": {"type": "layers"}}`, false},
+		{"config-bad-diffid", ispec.MediaTypeImageConfig, `{"os": "linux", "architecture": "amd64", "rootfs": {"type": "layers", "diff_ids": ["nope"]}}`, false},
+		{"manifest-no-schema", ispec.MediaTypeImageManifest, `{"config": {"mediaType": "a/b", "digest": "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "size": 0}, "layers": []}`, false},
+		{"manifest-wrong-type", ispec.MediaTypeImageManifest, `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.list.v1+json", "config": {"mediaType": "a/b", "digest": "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "size": 0}, "layers": []}`, false},
+		{"manifest-bad-layer", ispec.MediaTypeImageManifest, `{"schemaVersion": 2, "config": {"mediaType": "a/b", "digest": "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "size": 0}, "layers": [{"digest": "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "size": 0}]}`, false},
+		{"manifest-list", ispec.MediaTypeImageManifestList, `{"schemaVersion": 2, "manifests": []}`, true},
+		{"manifest-list-no-manifests", ispec.MediaTypeImageManifestList, `{"schemaVersion": 2}`, false},
+		{"not-json", ispec.MediaTypeImageConfig, `not json`, false},
+	} {
+		descriptor := putRaw(t, engine, test.mediaType, []byte(test.content))
+
+		blob, err := engine.FromDescriptor(ctx, descriptor)
+		if !test.valid {
+			if err == nil {
+				blob.Close()
+				t.Errorf("%s: expected invalid blob to be rejected", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+			continue
+		}
+		// The contents of opaque blobs must be unchanged by validation.
+		if reader, ok := blob.Data.(io.Reader); ok {
+			got, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Errorf("%s: unexpected error reading blob: %+v", test.name, err)
+			} else if string(got) != test.content {
+				t.Errorf("%s: blob contents changed by validation", test.name)
+			}
+		}
+		blob.Close()
+	}
+}
+
+func TestStrictEnginePutReference(t *testing.T) {
+	ctx := context.Background()
+	engine := Engine{NewStrictEngine(mem.New())}
+	defer engine.Close()
+
+	config := putJSON(t, engine, ispec.MediaTypeImageConfig, ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		RootFS:       ispec.RootFS{Type: "layers"},
+	})
+	goodLayer := putRaw(t, engine, ispec.MediaTypeImageLayer, make([]byte, 1024))
+	badLayer := putRaw(t, engine, ispec.MediaTypeImageLayerGzip, []byte("not gzip"))
+
+	for _, test := range []struct {
+		name  string
+		layer ispec.Descriptor
+		valid bool
+	}{
+		{"valid", goodLayer, true},
+		{"invalid-layer", badLayer, false},
+	} {
+		manifest := putJSON(t, engine, ispec.MediaTypeImageManifest, ispec.Manifest{
+			Versioned: imeta.Versioned{SchemaVersion: 2},
+			Config:    config,
+			Layers:    []ispec.Descriptor{test.layer},
+		})
+
+		err := engine.PutReference(ctx, test.name, manifest)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %+v", test.name, err)
+			}
+			continue
+		}
+		if errors.Cause(err) != ErrInvalidBlob {
+			t.Errorf("%s: expected ErrInvalidBlob, got %+v", test.name, err)
+		}
+		if _, err := engine.GetReference(ctx, test.name); err == nil {
+			t.Errorf("%s: invalid reference was written", test.name)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ReferenceValidator is called before a reference is written, with the
+// reference name and the resolved manifest (and image configuration) that the
+// reference will refer to. If the reference refers to a manifest list, the
+// validator is called once for each manifest in the list. Returning a non-nil
+// error causes the reference write to be rejected.
+type ReferenceValidator func(ctx context.Context, name string, descriptor ispec.Descriptor, manifest ispec.Manifest, config ispec.Image) error
+
+// validatingEngine is a cas.Engine which calls a ReferenceValidator before
+// every PutReference.
+type validatingEngine struct {
+	cas.Engine
+	validator ReferenceValidator
+}
+
+// NewValidatingEngine wraps the given cas.Engine such that validator is
+// called (and must succeed) before any reference is written with
+// PutReference. References to blobs other than image manifests and manifest
+// lists are always rejected, as they cannot be validated. Artifact manifests
+// (see Attach) are not images, and so are not passed to validator. All other
+// operations are passed through to engine unmodified.
+func NewValidatingEngine(engine cas.Engine, validator ReferenceValidator) cas.Engine {
+	return &validatingEngine{
+		Engine:    engine,
+		validator: validator,
+	}
+}
+
+// PutReference validates the descriptor before passing it to the underlying
+// engine.
+func (e *validatingEngine) PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	if err := e.validate(ctx, name, descriptor); err != nil {
+		return errors.Wrapf(err, "validate reference %s", name)
+	}
+	return e.Engine.PutReference(ctx, name, descriptor)
+}
+
+// UpdateReference validates the new descriptor before passing it to the
+// underlying engine, if it is a cas.UpdatingEngine.
+func (e *validatingEngine) UpdateReference(ctx context.Context, name string, oldDescriptor *ispec.Descriptor, newDescriptor ispec.Descriptor) error {
+	engine, ok := e.Engine.(cas.UpdatingEngine)
+	if !ok {
+		return cas.ErrNotImplemented
+	}
+	if err := e.validate(ctx, name, newDescriptor); err != nil {
+		return errors.Wrapf(err, "validate reference %s", name)
+	}
+	return engine.UpdateReference(ctx, name, oldDescriptor, newDescriptor)
+}
+
+func (e *validatingEngine) validate(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	engineExt := Engine{e.Engine}
+
+	blob, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor blob")
+	}
+	defer blob.Close()
+
+	switch data := blob.Data.(type) {
+	case ispec.ManifestList:
+		for _, manifest := range data.Manifests {
+			if err := e.validate(ctx, name, manifest.Descriptor); err != nil {
+				return errors.Wrapf(err, "manifest list entry %s", manifest.Digest)
+			}
+		}
+		return nil
+	case ispec.Manifest:
+		if data.Config.MediaType == MediaTypeEmptyJSON {
+			// Artifacts don't have an image configuration to validate.
+			return nil
+		}
+		configBlob, err := engineExt.FromDescriptor(ctx, data.Config)
+		if err != nil {
+			return errors.Wrap(err, "get config blob")
+		}
+		defer configBlob.Close()
+
+		config, ok := configBlob.Data.(ispec.Image)
+		if !ok {
+			return errors.Errorf("config blob is not an image configuration: %s", configBlob.MediaType)
+		}
+		return e.validator(ctx, name, descriptor, data, config)
+	default:
+		return errors.Errorf("cannot validate reference to %s", descriptor.MediaType)
+	}
+}
+
+// BlobUploadOffset passes through to the underlying engine, if it is a
+// cas.ResumableEngine. Blobs don't need to be validated.
+func (e *validatingEngine) BlobUploadOffset(ctx context.Context, session string) (int64, error) {
+	engine, ok := e.Engine.(cas.ResumableEngine)
+	if !ok {
+		return -1, cas.ErrNotImplemented
+	}
+	return engine.BlobUploadOffset(ctx, session)
+}
+
+// PutBlobResumable passes through to the underlying engine, if it is a
+// cas.ResumableEngine.
+func (e *validatingEngine) PutBlobResumable(ctx context.Context, session string, expected digest.Digest, reader io.Reader) (digest.Digest, int64, error) {
+	engine, ok := e.Engine.(cas.ResumableEngine)
+	if !ok {
+		return "", -1, cas.ErrNotImplemented
+	}
+	return engine.PutBlobResumable(ctx, session, expected, reader)
+}
+
+// AbortBlobUpload passes through to the underlying engine, if it is a
+// cas.ResumableEngine.
+func (e *validatingEngine) AbortBlobUpload(ctx context.Context, session string) error {
+	engine, ok := e.Engine.(cas.ResumableEngine)
+	if !ok {
+		return cas.ErrNotImplemented
+	}
+	return engine.AbortBlobUpload(ctx, session)
+}
+
+// LinkBlob passes through to the underlying engine, if it is a
+// cas.LinkingEngine.
+func (e *validatingEngine) LinkBlob(ctx context.Context, digest digest.Digest) (int64, error) {
+	engine, ok := e.Engine.(cas.LinkingEngine)
+	if !ok {
+		return -1, cas.ErrNotImplemented
+	}
+	return engine.LinkBlob(ctx, digest)
+}
+
+// StatBlob passes through to the underlying engine, if it is a
+// cas.StatingEngine.
+func (e *validatingEngine) StatBlob(ctx context.Context, digest digest.Digest) (cas.BlobInfo, error) {
+	engine, ok := e.Engine.(cas.StatingEngine)
+	if !ok {
+		return cas.BlobInfo{}, cas.ErrNotImplemented
+	}
+	return engine.StatBlob(ctx, digest)
+}
+
+// GetBlobAt passes through to the underlying engine, if it is a
+// cas.RandomAccessEngine.
+func (e *validatingEngine) GetBlobAt(ctx context.Context, digest digest.Digest) (cas.BlobReaderAt, int64, error) {
+	engine, ok := e.Engine.(cas.RandomAccessEngine)
+	if !ok {
+		return nil, -1, cas.ErrNotImplemented
+	}
+	return engine.GetBlobAt(ctx, digest)
+}
+
+// FreezeReference passes through to the underlying engine, if it is a
+// cas.FreezingEngine.
+func (e *validatingEngine) FreezeReference(ctx context.Context, name string) error {
+	engine, ok := e.Engine.(cas.FreezingEngine)
+	if !ok {
+		return cas.ErrNotImplemented
+	}
+	return engine.FreezeReference(ctx, name)
+}
+
+// UnfreezeReference passes through to the underlying engine, if it is a
+// cas.FreezingEngine.
+func (e *validatingEngine) UnfreezeReference(ctx context.Context, name string) error {
+	engine, ok := e.Engine.(cas.FreezingEngine)
+	if !ok {
+		return cas.ErrNotImplemented
+	}
+	return engine.UnfreezeReference(ctx, name)
+}
+
+// ReferenceFrozen passes through to the underlying engine, if it is a
+// cas.FreezingEngine.
+func (e *validatingEngine) ReferenceFrozen(ctx context.Context, name string) (bool, error) {
+	engine, ok := e.Engine.(cas.FreezingEngine)
+	if !ok {
+		return false, cas.ErrNotImplemented
+	}
+	return engine.ReferenceFrozen(ctx, name)
+}
+
+// LockExclusive passes through to the underlying engine, if it is a
+// cas.ExclusiveEngine.
+func (e *validatingEngine) LockExclusive(ctx context.Context, timeout time.Duration) (func() error, error) {
+	engine, ok := e.Engine.(cas.ExclusiveEngine)
+	if !ok {
+		return nil, cas.ErrNotImplemented
+	}
+	return engine.LockExclusive(ctx, timeout)
+}
@@ -20,12 +20,18 @@ package casext
 import (
 	"reflect"
 
-	"github.com/apex/log"
+	"github.com/openSUSE/umoci/pkg/event"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
+// ErrSkipDescendants can be returned by a WalkFunc or VisitFunc to indicate
+// that the children of the current descriptor should not be walked. It is
+// never returned to the caller of Walk or Visit.
+var ErrSkipDescendants = errors.New("skip descendants")
+
 // Used by walkState.mark() to determine which struct members are descriptors to
 // recurse into them. We aren't interested in struct members which are not
 // either a slice of ispec.Descriptor or ispec.Descriptor themselves.
@@ -42,7 +48,7 @@ func isDescriptor(T reflect.Type) bool {
 // FIXME: Should we implement this in a way that avoids cycle issues?
 func childDescriptors(i interface{}) []ispec.Descriptor {
 	V := reflect.ValueOf(i)
-	log.WithFields(log.Fields{
+	event.Default().WithFields(event.Fields{
 		"V": V,
 	}).Debugf("childDescriptors")
 	if !V.IsValid() {
@@ -59,7 +65,7 @@ func childDescriptors(i interface{}) []ispec.Descriptor {
 	switch V.Kind() {
 	case reflect.Ptr:
 		// Just deref the pointer.
-		log.WithFields(log.Fields{
+		event.Default().WithFields(event.Fields{
 			"name": V.Type().PkgPath() + "::" + V.Type().Name(),
 		}).Debugf("recursing into ptr")
 		if V.IsNil() {
@@ -69,7 +75,7 @@ func childDescriptors(i interface{}) []ispec.Descriptor {
 
 	case reflect.Array:
 		// Convert to a slice.
-		log.WithFields(log.Fields{
+		event.Default().WithFields(event.Fields{
 			"name": V.Type().PkgPath() + "::" + V.Type().Name(),
 		}).Debugf("recursing into array")
 		return childDescriptors(V.Slice(0, V.Len()).Interface())
@@ -78,7 +84,7 @@ func childDescriptors(i interface{}) []ispec.Descriptor {
 		// Iterate over each element and append them to childDescriptors.
 		children := []ispec.Descriptor{}
 		for idx := 0; idx < V.Len(); idx++ {
-			log.WithFields(log.Fields{
+			event.Default().WithFields(event.Fields{
 				"name": V.Type().PkgPath() + "::" + V.Type().Name(),
 				"idx":  idx,
 			}).Debugf("recursing into slice")
@@ -89,7 +95,7 @@ func childDescriptors(i interface{}) []ispec.Descriptor {
 	case reflect.Struct:
 		// We are only ever going to be interested in ispec.* types.
 		if V.Type().PkgPath() != descriptorType.PkgPath() {
-			log.WithFields(log.Fields{
+			event.Default().WithFields(event.Fields{
 				"name":   V.Type().PkgPath() + "::" + V.Type().Name(),
 				"v1path": descriptorType.PkgPath(),
 			}).Debugf("detected escape to outside ispec.* namespace")
@@ -99,7 +105,7 @@ func childDescriptors(i interface{}) []ispec.Descriptor {
 		// We can now actually iterate through a struct to find all descriptors.
 		children := []ispec.Descriptor{}
 		for idx := 0; idx < V.NumField(); idx++ {
-			log.WithFields(log.Fields{
+			event.Default().WithFields(event.Fields{
 				"name":  V.Type().PkgPath() + "::" + V.Type().Name(),
 				"field": V.Type().Field(idx).Name,
 			}).Debugf("recursing into struct")
@@ -133,41 +139,54 @@ type walkState struct {
 
 // TODO: Move this and blob.go to a separate package.
 
-// TODO: Implement an equivalent to filepath.SkipDir.
-
 // WalkFunc is the type of function passed to Walk. It will be a called on each
 // descriptor encountered, recursively -- which may involve the function being
 // called on the same descriptor multiple times (though because an OCI image is
 // a Merkle tree there will never be any loops). If an error is returned by
 // WalkFunc, the recursion will halt and the error will bubble up to the
-// caller.
+// caller, unless it is ErrSkipDescendants in which case only the children of
+// the descriptor are skipped.
 type WalkFunc func(descriptor ispec.Descriptor) error
 
 func (ws *walkState) recurse(ctx context.Context, descriptor ispec.Descriptor) error {
-	log.WithFields(log.Fields{
+	event.Log(ctx).WithFields(event.Fields{
 		"digest": descriptor.Digest,
 	}).Debugf("-> ws.recurse")
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// Run walkFunc.
-	if err := ws.walkFunc(descriptor); err != nil {
+	if err := ws.walkFunc(descriptor); err == ErrSkipDescendants {
+		return nil
+	} else if err != nil {
 		return err
 	}
 
 	// Get blob to recurse into.
 	blob, err := ws.engine.FromDescriptor(ctx, descriptor)
-	if err != nil {
+	if isMissingForeignLayer(descriptor, err) {
+		event.Log(ctx).Debugf("walk: skipping missing foreign layer %s", descriptor.Digest)
+		return nil
+	} else if err != nil {
 		return err
 	}
 	defer blob.Close()
 
 	// Recurse into children.
-	for _, child := range childDescriptors(blob.Data) {
-		if err := ws.recurse(ctx, child); err != nil {
+	children, err := blobChildren(blob)
+	if err != nil {
+		return err
+	}
+	childCtx := childContext(ctx, blob)
+	for _, child := range children {
+		if err := ws.recurse(childCtx, child); err != nil {
 			return err
 		}
 	}
 
-	log.WithFields(log.Fields{
+	event.Log(ctx).WithFields(event.Fields{
 		"digest": descriptor.Digest,
 	}).Debugf("<- ws.recurse")
 	return nil
@@ -176,7 +195,8 @@ func (ws *walkState) recurse(ctx context.Context, descriptor ispec.Descriptor) e
 // Walk preforms a depth-first walk from a given root descriptor, using the
 // provided CAS engine to fetch all other necessary descriptors. If an error is
 // returned by the provided WalkFunc, walking is terminated and the error is
-// returned to the caller.
+// returned to the caller. WalkFunc is called for foreign layers (see
+// IsForeignLayerType) even if their blobs are not present in the image.
 func (e Engine) Walk(ctx context.Context, root ispec.Descriptor, walkFunc WalkFunc) error {
 	ws := &walkState{
 		engine:   e,
@@ -205,18 +225,146 @@ func (e Engine) Paths(ctx context.Context, root ispec.Descriptor) ([]ispec.Descr
 // entries. Note that without descriptors, a digest is not particularly
 // meaninful (OCI blobs are not self-descriptive).
 func (e Engine) Reachable(ctx context.Context, root ispec.Descriptor) ([]digest.Digest, error) {
-	seen := map[digest.Digest]struct{}{}
+	var reachable []digest.Digest
 
-	if err := e.Walk(ctx, root, func(descriptor ispec.Descriptor) error {
-		seen[descriptor.Digest] = struct{}{}
+	err := e.Visit(ctx, root, Visitor{
+		Default: func(path []ispec.Descriptor, blob *Blob) error {
+			reachable = append(reachable, blob.Digest)
+			return nil
+		},
+	})
+	return reachable, err
+}
+
+// VisitFunc is the type of function called by Visit for each blob in the
+// graph. path is the sequence of descriptors leading from the root to the
+// blob (the last element being the descriptor of the blob itself), and blob
+// is the parsed blob (which is closed once the VisitFunc returns). If an error
+// is returned, the walk is halted and the error is returned to the caller of
+// Visit -- unless it is ErrSkipDescendants, in which case only the children
+// of the blob are skipped.
+type VisitFunc func(path []ispec.Descriptor, blob *Blob) error
+
+// Visitor describes how Visit should treat the blobs it encounters.
+type Visitor struct {
+	// MediaTypes maps a media type to the VisitFunc that is called for blobs
+	// of that type.
+	MediaTypes map[string]VisitFunc
+
+	// Default is called for blobs whose media type has no entry in
+	// MediaTypes. If it is nil, such blobs are walked without calling
+	// anything.
+	Default VisitFunc
+
+	// Referrers indicates that the artifacts attached to each blob (as
+	// recorded in its referrers index, see Attach) should be treated as
+	// children of the blob.
+	Referrers bool
+}
+
+// visitState stores state information about a walk started by Visit.
+type visitState struct {
+	// engine is the CAS engine we are operating on.
+	engine Engine
+
+	// visitor is the Visitor provided by the user.
+	visitor Visitor
+
+	// seen is the set of digests which have already been visited.
+	seen map[digest.Digest]struct{}
+}
+
+// children returns the child descriptors of the given (already visited) blob.
+func (vs *visitState) children(ctx context.Context, blob *Blob) ([]ispec.Descriptor, error) {
+	var children []ispec.Descriptor
+	if !blob.opaque {
+		var err error
+		children, err = blobChildren(blob)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if vs.visitor.Referrers {
+		index, _, err := vs.engine.referrersIndex(ctx, ReferrersTag(blob.Digest))
+		if err != nil {
+			return nil, errors.Wrapf(err, "get referrers of %s", blob.Digest)
+		}
+		for _, entry := range index.Manifests {
+			children = append(children, entry.Descriptor)
+		}
+	}
+	return children, nil
+}
+
+func (vs *visitState) visit(ctx context.Context, path []ispec.Descriptor) error {
+	descriptor := path[len(path)-1]
+	if _, ok := vs.seen[descriptor.Digest]; ok {
 		return nil
-	}); err != nil {
-		return nil, err
 	}
+	vs.seen[descriptor.Digest] = struct{}{}
 
-	var reachable []digest.Digest
-	for node := range seen {
-		reachable = append(reachable, node)
+	event.Log(ctx).WithFields(event.Fields{
+		"digest": descriptor.Digest,
+	}).Debugf("-> vs.visit")
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	blob, err := vs.engine.FromDescriptor(ctx, descriptor)
+	if isMissingForeignLayer(descriptor, err) {
+		event.Log(ctx).Debugf("visit: skipping missing foreign layer %s", descriptor.Digest)
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "get blob %s", descriptor.Digest)
+	}
+	defer blob.Close()
+
+	visitFunc, ok := vs.visitor.MediaTypes[descriptor.MediaType]
+	if !ok {
+		visitFunc = vs.visitor.Default
+	}
+	if visitFunc != nil {
+		if err := visitFunc(path, blob); err == ErrSkipDescendants {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	children, err := vs.children(ctx, blob)
+	if err != nil {
+		return err
+	}
+	childCtx := childContext(ctx, blob)
+	for _, child := range children {
+		// Make sure that callers can't modify the path of other blobs.
+		childPath := append(append([]ispec.Descriptor{}, path...), child)
+		if err := vs.visit(childCtx, childPath); err != nil {
+			return err
+		}
+	}
+
+	event.Log(ctx).WithFields(event.Fields{
+		"digest": descriptor.Digest,
+	}).Debugf("<- vs.visit")
+	return nil
+}
+
+// Visit preforms a depth-first walk of the graph of blobs reachable from the
+// given root descriptor (manifest lists, manifests, configurations, layers
+// and, if requested, referrers). Unlike Walk, every blob is only visited once
+// (even if it is referenced by several descriptors), which also protects
+// against cycles. The VisitFunc called for each blob is chosen by its media
+// type, as described by Visitor. Blobs which are not parsed by FromDescriptor
+// (such as layers and the blobs of artifacts) have no children other than
+// their referrers. Foreign layers (see IsForeignLayerType) whose blobs are not
+// present in the image are not visited.
+func (e Engine) Visit(ctx context.Context, root ispec.Descriptor, visitor Visitor) error {
+	vs := &visitState{
+		engine:  e,
+		visitor: visitor,
+		seen:    map[digest.Digest]struct{}{},
 	}
-	return reachable, nil
+	return vs.visit(ctx, []ispec.Descriptor{root})
 }
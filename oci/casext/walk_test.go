@@ -0,0 +1,199 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// putJSON stores the given data as a blob of the given media type.
+func putJSON(t *testing.T, engine Engine, mediaType string, data interface{}) ispec.Descriptor {
+	digest, size, err := engine.PutBlobJSON(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{MediaType: mediaType, Digest: digest, Size: size}
+}
+
+// putVisitImage creates a manifest list of two manifests which share a
+// layer, returning the descriptors of the manifest list and its manifests.
+func putVisitImage(t *testing.T, engine Engine) (ispec.Descriptor, []ispec.Descriptor) {
+	layerDigest, layerSize, err := engine.PutBlob(context.Background(), bytes.NewBufferString("layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := ispec.Descriptor{MediaType: ispec.MediaTypeImageLayerGzip, Digest: layerDigest, Size: layerSize}
+
+	var manifests []ispec.Descriptor
+	for _, arch := range []string{"amd64", "arm64"} {
+		config := putJSON(t, engine, ispec.MediaTypeImageConfig, ispec.Image{
+			OS:           "linux",
+			Architecture: arch,
+			RootFS:       ispec.RootFS{Type: "layers"},
+		})
+		manifests = append(manifests, putJSON(t, engine, ispec.MediaTypeImageManifest, ispec.Manifest{
+			Versioned: imeta.Versioned{SchemaVersion: 2},
+			Config:    config,
+			Layers:    []ispec.Descriptor{layer},
+		}))
+	}
+
+	list := ispec.ManifestList{Versioned: imeta.Versioned{SchemaVersion: 2}}
+	for _, manifest := range manifests {
+		list.Manifests = append(list.Manifests, ispec.ManifestDescriptor{Descriptor: manifest})
+	}
+	return putJSON(t, engine, ispec.MediaTypeImageManifestList, list), manifests
+}
+
+func TestVisit(t *testing.T) {
+	ctx := context.Background()
+	engine := Engine{mem.New()}
+	defer engine.Close()
+
+	root, manifests := putVisitImage(t, engine)
+	artifact, err := engine.Attach(ctx, manifests[0], "application/vnd.example.sbom", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error attaching artifact: %+v", err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		referrers bool
+		blobs     int
+	}{
+		// Manifest list, 2 manifests, 2 configs and a single (shared) layer.
+		{"image", false, 6},
+		// The artifact manifest and its (empty) configuration and layer.
+		{"referrers", true, 8},
+	} {
+		seen := map[digest.Digest]int{}
+		var manifestPaths [][]ispec.Descriptor
+		err := engine.Visit(ctx, root, Visitor{
+			MediaTypes: map[string]VisitFunc{
+				ispec.MediaTypeImageManifest: func(path []ispec.Descriptor, blob *Blob) error {
+					if _, ok := blob.Data.(ispec.Manifest); !ok {
+						t.Errorf("%s: manifest was not parsed: %T", test.name, blob.Data)
+					}
+					manifestPaths = append(manifestPaths, path)
+					seen[blob.Digest]++
+					return nil
+				},
+			},
+			Default: func(path []ispec.Descriptor, blob *Blob) error {
+				if path[len(path)-1].Digest != blob.Digest {
+					t.Errorf("%s: path does not end with the visited blob: %v", test.name, path)
+				}
+				seen[blob.Digest]++
+				return nil
+			},
+			Referrers: test.referrers,
+		})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %+v", test.name, err)
+		}
+
+		if len(seen) != test.blobs {
+			t.Errorf("%s: expected %d blobs to be visited, got %d: %v", test.name, test.blobs, len(seen), seen)
+		}
+		for digest, count := range seen {
+			if count != 1 {
+				t.Errorf("%s: blob %s visited %d times", test.name, digest, count)
+			}
+		}
+		if _, ok := seen[artifact.Digest]; ok != test.referrers {
+			t.Errorf("%s: artifact visited: expected %v got %v", test.name, test.referrers, ok)
+		}
+		for _, path := range manifestPaths {
+			if path[0].Digest != root.Digest {
+				t.Errorf("%s: path does not start at the root: %v", test.name, path)
+			}
+		}
+	}
+}
+
+func TestVisitSkipDescendants(t *testing.T) {
+	ctx := context.Background()
+	engine := Engine{mem.New()}
+	defer engine.Close()
+
+	root, manifests := putVisitImage(t, engine)
+
+	var visited []ispec.Descriptor
+	err := engine.Visit(ctx, root, Visitor{
+		Default: func(path []ispec.Descriptor, blob *Blob) error {
+			visited = append(visited, path[len(path)-1])
+			if blob.MediaType == ispec.MediaTypeImageManifest {
+				return ErrSkipDescendants
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if len(visited) != 1+len(manifests) {
+		t.Fatalf("expected only the manifest list and manifests to be visited, got %v", visited)
+	}
+	for idx, manifest := range manifests {
+		if visited[idx+1].Digest != manifest.Digest {
+			t.Errorf("unexpected blob visited: expected %s got %s", manifest.Digest, visited[idx+1].Digest)
+		}
+	}
+}
+
+func TestWalkCancel(t *testing.T) {
+	engine := Engine{mem.New()}
+	defer engine.Close()
+
+	root, _ := putVisitImage(t, engine)
+
+	// Cancel the walk once the first blob has been visited.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	visited := 0
+	err := engine.Walk(ctx, root, func(descriptor ispec.Descriptor) error {
+		visited++
+		cancel()
+		return nil
+	})
+	if errors.Cause(err) != context.Canceled {
+		t.Errorf("Walk: expected context.Canceled: %+v", err)
+	}
+	if visited != 1 {
+		t.Errorf("Walk: expected only one blob to be visited after cancellation, got %d", visited)
+	}
+
+	err = engine.Visit(ctx, root, Visitor{
+		Default: func(path []ispec.Descriptor, blob *Blob) error {
+			t.Errorf("Visit: unexpected blob visited after cancellation: %s", blob.Digest)
+			return nil
+		},
+	})
+	if errors.Cause(err) != context.Canceled {
+		t.Errorf("Visit: expected context.Canceled: %+v", err)
+	}
+}
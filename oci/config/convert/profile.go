@@ -0,0 +1,235 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package convert
+
+import (
+	"path/filepath"
+	"strings"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	rgen "github.com/opencontainers/runtime-tools/generate"
+	"github.com/pkg/errors"
+)
+
+// RuntimeProfile is a named set of modifications of a generated runtime
+// configuration, which make it suitable for a particular use case.
+type RuntimeProfile string
+
+const (
+	// ProfileDefault doesn't modify the runtime configuration. The empty
+	// profile is the same as ProfileDefault.
+	ProfileDefault RuntimeProfile = "default"
+
+	// ProfileMinimal reduces the runtime configuration to what is needed to
+	// run a simple non-interactive process: all capabilities are dropped, no
+	// new privileges can be gained, no terminal is allocated and only the
+	// /proc, /dev, /dev/pts and /sys mounts are kept.
+	ProfileMinimal RuntimeProfile = "minimal"
+
+	// ProfileSystemd makes the runtime configuration suitable for running
+	// systemd as the container process: a cgroup namespace and a writable
+	// /sys/fs/cgroup mount are added, /run, /run/lock and /tmp are tmpfs
+	// mounts, and container=oci is set in the environment.
+	ProfileSystemd RuntimeProfile = "systemd"
+
+	// ProfileRootlessPodman makes the runtime configuration suitable for
+	// running as an unprivileged user with podman(1) (or another runtime
+	// which provides networking for rootless containers). It is the same as
+	// ToRootless, except that the network namespace is kept and the cgroup
+	// path is left to the runtime.
+	ProfileRootlessPodman RuntimeProfile = "rootless-podman"
+)
+
+// Validate returns an error if the RuntimeProfile is unknown.
+func (p RuntimeProfile) Validate() error {
+	switch p {
+	case "", ProfileDefault, ProfileMinimal, ProfileSystemd, ProfileRootlessPodman:
+		return nil
+	}
+	return errors.Errorf("unknown runtime profile: %s", p)
+}
+
+// RuntimeOptions are additional modifications of a generated runtime
+// configuration (see ApplyRuntimeOptions).
+type RuntimeOptions struct {
+	// Profile is applied before any of the other options.
+	Profile RuntimeProfile
+
+	// Hooks are appended to the hooks of the runtime configuration.
+	Hooks rspec.Hooks
+
+	// Seccomp, if non-nil, replaces the seccomp configuration.
+	Seccomp *rspec.Seccomp
+
+	// SeccompUnconfined removes the seccomp configuration. It cannot be used
+	// together with Seccomp.
+	SeccompUnconfined bool
+
+	// Mounts are added to the runtime configuration, replacing any existing
+	// mount with the same destination.
+	Mounts []rspec.Mount
+}
+
+// ToRootless converts a specification to a version that works with rootless
+// containers. This is done by removing options and other settings that clash
+// with unprivileged user namespaces.
+func ToRootless(spec *rspec.Spec) {
+	var namespaces []rspec.Namespace
+
+	// Remove networkns from the spec.
+	for _, ns := range spec.Linux.Namespaces {
+		switch ns.Type {
+		case rspec.NetworkNamespace, rspec.UserNamespace:
+			// Do nothing.
+		default:
+			namespaces = append(namespaces, ns)
+		}
+	}
+	// Add userns to the spec.
+	namespaces = append(namespaces, rspec.Namespace{
+		Type: rspec.UserNamespace,
+	})
+	spec.Linux.Namespaces = namespaces
+
+	// Fix up mounts.
+	var mounts []rspec.Mount
+	for _, mount := range spec.Mounts {
+		// Ignore all mounts that are under /sys.
+		if strings.HasPrefix(mount.Destination, "/sys") {
+			continue
+		}
+
+		// Remove all gid= and uid= mappings.
+		var options []string
+		for _, option := range mount.Options {
+			if !strings.HasPrefix(option, "gid=") && !strings.HasPrefix(option, "uid=") {
+				options = append(options, option)
+			}
+		}
+
+		mount.Options = options
+		mounts = append(mounts, mount)
+	}
+	// Add the sysfs mount as an rbind.
+	mounts = append(mounts, rspec.Mount{
+		Source:      "/sys",
+		Destination: "/sys",
+		Type:        "none",
+		Options:     []string{"rbind", "nosuid", "noexec", "nodev", "ro"},
+	})
+	spec.Mounts = mounts
+
+	// Remove cgroup settings.
+	spec.Linux.Resources = nil
+}
+
+// addMount adds the given mount to the specification, replacing any existing
+// mount with the same destination.
+func addMount(spec *rspec.Spec, mount rspec.Mount) {
+	for idx, old := range spec.Mounts {
+		if filepath.Clean(old.Destination) == filepath.Clean(mount.Destination) {
+			spec.Mounts[idx] = mount
+			return
+		}
+	}
+	spec.Mounts = append(spec.Mounts, mount)
+}
+
+// applyProfile modifies the given runtime configuration generator according
+// to the given profile.
+func applyProfile(g rgen.Generator, profile RuntimeProfile) error {
+	spec := g.Spec()
+
+	switch profile {
+	case "", ProfileDefault:
+		// Nothing to do.
+	case ProfileMinimal:
+		g.ClearProcessCapabilities()
+		g.SetProcessNoNewPrivileges(true)
+		g.SetProcessTerminal(false)
+
+		var mounts []rspec.Mount
+		for _, mount := range spec.Mounts {
+			switch filepath.Clean(mount.Destination) {
+			case "/proc", "/dev", "/dev/pts", "/sys":
+				mounts = append(mounts, mount)
+			}
+		}
+		spec.Mounts = mounts
+	case ProfileSystemd:
+		if err := g.AddOrReplaceLinuxNamespace(string(rspec.CgroupNamespace), ""); err != nil {
+			return errors.Wrap(err, "add cgroup namespace")
+		}
+		addMount(spec, rspec.Mount{
+			Destination: "/sys/fs/cgroup",
+			Type:        "cgroup",
+			Source:      "cgroup",
+			Options:     []string{"nosuid", "noexec", "nodev", "relatime", "rw"},
+		})
+		for _, dest := range []string{"/run", "/run/lock", "/tmp"} {
+			addMount(spec, rspec.Mount{
+				Destination: dest,
+				Type:        "tmpfs",
+				Source:      "tmpfs",
+				Options:     []string{"nosuid", "nodev", "mode=1777"},
+			})
+		}
+		g.AddProcessEnv("container", "oci")
+	case ProfileRootlessPodman:
+		ToRootless(spec)
+		if err := g.AddOrReplaceLinuxNamespace(string(rspec.NetworkNamespace), ""); err != nil {
+			return errors.Wrap(err, "add network namespace")
+		}
+		g.SetLinuxCgroupsPath("")
+	default:
+		return errors.Errorf("unknown runtime profile: %s", profile)
+	}
+	return nil
+}
+
+// ApplyRuntimeOptions modifies a given runtime specification generator with
+// the options provided. It should be called after MutateRuntimeSpec (and any
+// other modifications), so that the options take precedence.
+func ApplyRuntimeOptions(g rgen.Generator, opt RuntimeOptions) error {
+	if opt.Seccomp != nil && opt.SeccompUnconfined {
+		return errors.Errorf("seccomp configuration cannot be both replaced and removed")
+	}
+	if err := applyProfile(g, opt.Profile); err != nil {
+		return errors.Wrap(err, "apply runtime profile")
+	}
+
+	spec := g.Spec()
+	for _, mount := range opt.Mounts {
+		if !filepath.IsAbs(mount.Destination) {
+			return errors.Errorf("mount destination must be an absolute path: %s", mount.Destination)
+		}
+		addMount(spec, mount)
+	}
+
+	spec.Hooks.Prestart = append(spec.Hooks.Prestart, opt.Hooks.Prestart...)
+	spec.Hooks.Poststart = append(spec.Hooks.Poststart, opt.Hooks.Poststart...)
+	spec.Hooks.Poststop = append(spec.Hooks.Poststop, opt.Hooks.Poststop...)
+
+	if opt.Seccomp != nil || opt.SeccompUnconfined {
+		if spec.Linux == nil {
+			spec.Linux = &rspec.Linux{}
+		}
+		spec.Linux.Seccomp = opt.Seccomp
+	}
+	return nil
+}
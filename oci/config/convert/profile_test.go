@@ -0,0 +1,169 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package convert
+
+import (
+	"testing"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	rgen "github.com/opencontainers/runtime-tools/generate"
+)
+
+func hasMount(spec *rspec.Spec, dest string) bool {
+	for _, mount := range spec.Mounts {
+		if mount.Destination == dest {
+			return true
+		}
+	}
+	return false
+}
+
+func hasNamespace(spec *rspec.Spec, ns rspec.NamespaceType) bool {
+	for _, namespace := range spec.Linux.Namespaces {
+		if namespace.Type == ns {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRuntimeProfileValidate(t *testing.T) {
+	for _, test := range []struct {
+		profile RuntimeProfile
+		valid   bool
+	}{
+		{"", true},
+		{ProfileDefault, true},
+		{ProfileMinimal, true},
+		{ProfileSystemd, true},
+		{ProfileRootlessPodman, true},
+		{"rootless", false},
+		{"Minimal", false},
+	} {
+		err := test.profile.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("Validate(%q): expected valid=%v, got error %v", test.profile, test.valid, err)
+		}
+	}
+}
+
+func TestApplyRuntimeProfiles(t *testing.T) {
+	g := rgen.New()
+	if err := ApplyRuntimeOptions(g, RuntimeOptions{Profile: ProfileMinimal}); err != nil {
+		t.Fatalf("unexpected error applying minimal profile: %+v", err)
+	}
+	spec := g.Spec()
+	if len(spec.Process.Capabilities) != 0 {
+		t.Errorf("minimal profile: expected no capabilities, got %v", spec.Process.Capabilities)
+	}
+	if !spec.Process.NoNewPrivileges {
+		t.Errorf("minimal profile: expected noNewPrivileges to be set")
+	}
+	if hasMount(spec, "/dev/shm") || !hasMount(spec, "/proc") {
+		t.Errorf("minimal profile: unexpected mounts %v", spec.Mounts)
+	}
+
+	g = rgen.New()
+	if err := ApplyRuntimeOptions(g, RuntimeOptions{Profile: ProfileSystemd}); err != nil {
+		t.Fatalf("unexpected error applying systemd profile: %+v", err)
+	}
+	spec = g.Spec()
+	for _, dest := range []string{"/sys/fs/cgroup", "/run", "/run/lock", "/tmp"} {
+		if !hasMount(spec, dest) {
+			t.Errorf("systemd profile: missing mount %s", dest)
+		}
+	}
+	if !hasNamespace(spec, rspec.CgroupNamespace) {
+		t.Errorf("systemd profile: missing cgroup namespace")
+	}
+
+	g = rgen.New()
+	if err := ApplyRuntimeOptions(g, RuntimeOptions{Profile: ProfileRootlessPodman}); err != nil {
+		t.Fatalf("unexpected error applying rootless-podman profile: %+v", err)
+	}
+	spec = g.Spec()
+	if !hasNamespace(spec, rspec.UserNamespace) || !hasNamespace(spec, rspec.NetworkNamespace) {
+		t.Errorf("rootless-podman profile: unexpected namespaces %v", spec.Linux.Namespaces)
+	}
+	if spec.Linux.Resources != nil {
+		t.Errorf("rootless-podman profile: expected no resources, got %v", spec.Linux.Resources)
+	}
+
+	if err := ApplyRuntimeOptions(rgen.New(), RuntimeOptions{Profile: "unknown"}); err == nil {
+		t.Errorf("expected error applying unknown profile")
+	}
+}
+
+func TestApplyRuntimeOptions(t *testing.T) {
+	g := rgen.New()
+	seccomp := &rspec.Seccomp{DefaultAction: rspec.ActAllow}
+	if err := ApplyRuntimeOptions(g, RuntimeOptions{
+		Hooks: rspec.Hooks{
+			Prestart: []rspec.Hook{{Path: "/bin/hook", Args: []string{"/bin/hook", "prestart"}}},
+			Poststop: []rspec.Hook{{Path: "/bin/hook", Args: []string{"/bin/hook", "poststop"}}},
+		},
+		Seccomp: seccomp,
+		Mounts: []rspec.Mount{
+			{Source: "/srv", Destination: "/srv", Type: "bind", Options: []string{"rbind"}},
+			{Source: "/host/proc", Destination: "/proc/", Type: "bind", Options: []string{"rbind"}},
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error applying options: %+v", err)
+	}
+	spec := g.Spec()
+
+	if len(spec.Hooks.Prestart) != 1 || len(spec.Hooks.Poststop) != 1 || len(spec.Hooks.Poststart) != 0 {
+		t.Errorf("unexpected hooks: %#v", spec.Hooks)
+	}
+	if spec.Linux.Seccomp != seccomp {
+		t.Errorf("seccomp configuration not replaced: %#v", spec.Linux.Seccomp)
+	}
+	if !hasMount(spec, "/srv") {
+		t.Errorf("missing mount /srv")
+	}
+	// Mounts with the same destination are replaced.
+	nproc := 0
+	for _, mount := range spec.Mounts {
+		if mount.Destination == "/proc" || mount.Destination == "/proc/" {
+			nproc++
+			if mount.Source != "/host/proc" {
+				t.Errorf("/proc mount not replaced: %#v", mount)
+			}
+		}
+	}
+	if nproc != 1 {
+		t.Errorf("expected one /proc mount, got %d", nproc)
+	}
+
+	g = rgen.New()
+	if err := ApplyRuntimeOptions(g, RuntimeOptions{SeccompUnconfined: true}); err != nil {
+		t.Fatalf("unexpected error applying options: %+v", err)
+	}
+	if g.Spec().Linux.Seccomp != nil {
+		t.Errorf("seccomp configuration not removed: %#v", g.Spec().Linux.Seccomp)
+	}
+
+	for _, opt := range []RuntimeOptions{
+		{Seccomp: seccomp, SeccompUnconfined: true},
+		{Mounts: []rspec.Mount{{Source: "/srv", Destination: "srv", Type: "bind"}}},
+	} {
+		if err := ApplyRuntimeOptions(rgen.New(), opt); err == nil {
+			t.Errorf("expected error applying invalid options %#v", opt)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package generate
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openSUSE/umoci/pkg/jsonpatch"
+	"github.com/pkg/errors"
+)
+
+// Healthcheck describes the command used to check whether a container running
+// the image is still working. This is not part of the image-spec, but is a
+// widely used extension (originating from Docker) which is stored in the
+// "Healthcheck" field of the image configuration.
+type Healthcheck struct {
+	// Test is the command to run. The first element is either "NONE"
+	// (disabling any inherited healthcheck), "CMD" (followed by the command
+	// and its arguments) or "CMD-SHELL" (followed by a command run with the
+	// default shell).
+	Test []string `json:"Test,omitempty"`
+
+	// Interval is the time to wait between checks.
+	Interval time.Duration `json:"Interval,omitempty"`
+
+	// Timeout is the time to wait before considering a check to have hung.
+	Timeout time.Duration `json:"Timeout,omitempty"`
+
+	// StartPeriod is the time to wait for the container to start before
+	// failed checks are counted.
+	StartPeriod time.Duration `json:"StartPeriod,omitempty"`
+
+	// Retries is the number of consecutive failures needed to consider the
+	// container to be unhealthy.
+	Retries int `json:"Retries,omitempty"`
+}
+
+// Validate returns an error if the healthcheck is not valid.
+func (h Healthcheck) Validate() error {
+	if len(h.Test) == 0 {
+		return errors.Errorf("healthcheck test must not be empty")
+	}
+	switch h.Test[0] {
+	case "NONE":
+		if len(h.Test) != 1 {
+			return errors.Errorf("healthcheck test NONE takes no arguments")
+		}
+	case "CMD", "CMD-SHELL":
+		if len(h.Test) < 2 {
+			return errors.Errorf("healthcheck test %s requires a command", h.Test[0])
+		}
+	default:
+		return errors.Errorf("healthcheck test must start with NONE, CMD or CMD-SHELL: %q", h.Test[0])
+	}
+	if h.Interval < 0 || h.Timeout < 0 || h.StartPeriod < 0 || h.Retries < 0 {
+		return errors.Errorf("healthcheck durations and retries must not be negative")
+	}
+	return nil
+}
+
+// extension is a modification of a field of the image configuration which
+// isn't part of ispec.Image. A nil value removes the field.
+type extension struct {
+	path  string
+	value interface{}
+}
+
+// setExtension records a modification of an extension field, replacing any
+// earlier modification of the same field.
+func (g *Generator) setExtension(path string, value interface{}) {
+	for idx, ext := range g.extensions {
+		if ext.path == path {
+			g.extensions[idx].value = value
+			return
+		}
+	}
+	g.extensions = append(g.extensions, extension{path: path, value: value})
+}
+
+// SetConfigHealthcheck sets the healthcheck of the image.
+func (g *Generator) SetConfigHealthcheck(healthcheck Healthcheck) {
+	g.setExtension("/config/Healthcheck", healthcheck)
+}
+
+// ClearConfigHealthcheck removes the healthcheck of the image.
+func (g *Generator) ClearConfigHealthcheck() {
+	g.setExtension("/config/Healthcheck", nil)
+}
+
+// SetConfigStopSignal sets the signal which is sent to a container running
+// this image in order to stop it (such as "SIGTERM" or "15").
+func (g *Generator) SetConfigStopSignal(signal string) {
+	g.setExtension("/config/StopSignal", signal)
+}
+
+// ClearConfigStopSignal removes the stop signal of the image, so that the
+// default signal is used.
+func (g *Generator) ClearConfigStopSignal() {
+	g.setExtension("/config/StopSignal", nil)
+}
+
+// ExtensionPatch returns a JSON patch which applies the modifications of the
+// fields of the image configuration which are not part of ispec.Image (such
+// as SetConfigHealthcheck). These modifications are not included in Image or
+// WriteTo, and must be applied to the configuration separately (see
+// mutate.PatchConfig).
+func (g *Generator) ExtensionPatch() (jsonpatch.Patch, error) {
+	patch := jsonpatch.Patch{}
+	for _, ext := range g.extensions {
+		value, err := json.Marshal(ext.value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "encode %s", ext.path)
+		}
+		// "add" replaces existing values, and so adding a value before
+		// removing it ensures the removal succeeds even if it didn't exist.
+		patch = append(patch, jsonpatch.Operation{
+			Op:    "add",
+			Path:  ext.path,
+			Value: value,
+		})
+		if ext.value == nil {
+			patch = append(patch, jsonpatch.Operation{
+				Op:   "remove",
+				Path: ext.path,
+			})
+		}
+	}
+	return patch, nil
+}
+
+// ValidateExposedPort returns an error if the given port is not a valid entry
+// for the set of ports to expose, which must be of the form "port/tcp",
+// "port/udp" or "port" (which is interpreted as "port/tcp").
+func ValidateExposedPort(port string) error {
+	parts := strings.SplitN(port, "/", 2)
+	number, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil || number == 0 {
+		return errors.Errorf("invalid port number in exposed port %q", port)
+	}
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "tcp", "udp", "sctp":
+		default:
+			return errors.Errorf("invalid protocol in exposed port %q", port)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package generate
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExtensionPatch(t *testing.T) {
+	g := New()
+	healthcheck := Healthcheck{
+		Test:     []string{"CMD", "/bin/check", "--quick"},
+		Interval: 30 * time.Second,
+		Retries:  3,
+	}
+
+	g.SetConfigStopSignal("SIGINT")
+	g.ClearConfigHealthcheck()
+	g.SetConfigHealthcheck(healthcheck)
+
+	patch, err := g.ExtensionPatch()
+	if err != nil {
+		t.Fatalf("unexpected error generating patch: %+v", err)
+	}
+
+	original := []byte(`{"config": {"User": "user", "StopSignal": "SIGKILL"}, "rootfs": {"type": "layers", "diff_ids": []}}`)
+	patched, err := patch.Apply(original)
+	if err != nil {
+		t.Fatalf("unexpected error applying patch: %+v", err)
+	}
+
+	var got struct {
+		Config struct {
+			User        string
+			StopSignal  string
+			Healthcheck Healthcheck
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(patched, &got); err != nil {
+		t.Fatalf("unexpected error parsing patched config: %+v", err)
+	}
+	if got.Config.User != "user" {
+		t.Errorf("patch modified unrelated field: got User=%q", got.Config.User)
+	}
+	if got.Config.StopSignal != "SIGINT" {
+		t.Errorf("StopSignal not set: expected %q, got %q", "SIGINT", got.Config.StopSignal)
+	}
+	if !reflect.DeepEqual(got.Config.Healthcheck, healthcheck) {
+		t.Errorf("Healthcheck not set: expected %#v, got %#v", healthcheck, got.Config.Healthcheck)
+	}
+}
+
+func TestExtensionPatchClear(t *testing.T) {
+	g := New()
+
+	g.SetConfigStopSignal("SIGINT")
+	g.ClearConfigStopSignal()
+	g.ClearConfigHealthcheck()
+
+	patch, err := g.ExtensionPatch()
+	if err != nil {
+		t.Fatalf("unexpected error generating patch: %+v", err)
+	}
+
+	// Clearing must succeed whether or not the fields exist.
+	for _, original := range []string{
+		`{"config": {}}`,
+		`{"config": {"StopSignal": "SIGKILL", "Healthcheck": {"Test": ["NONE"]}}}`,
+	} {
+		patched, err := patch.Apply([]byte(original))
+		if err != nil {
+			t.Errorf("unexpected error applying patch to %s: %+v", original, err)
+			continue
+		}
+
+		var got struct {
+			Config map[string]interface{} `json:"config"`
+		}
+		if err := json.Unmarshal(patched, &got); err != nil {
+			t.Fatalf("unexpected error parsing patched config: %+v", err)
+		}
+		if len(got.Config) != 0 {
+			t.Errorf("fields not cleared from %s: got %v", original, got.Config)
+		}
+	}
+}
+
+func TestHealthcheckValidate(t *testing.T) {
+	for _, test := range []struct {
+		healthcheck Healthcheck
+		valid       bool
+	}{
+		{Healthcheck{Test: []string{"NONE"}}, true},
+		{Healthcheck{Test: []string{"CMD", "/bin/check"}}, true},
+		{Healthcheck{Test: []string{"CMD-SHELL", "check || exit 1"}, Timeout: time.Second}, true},
+		{Healthcheck{}, false},
+		{Healthcheck{Test: []string{"NONE", "/bin/check"}}, false},
+		{Healthcheck{Test: []string{"CMD"}}, false},
+		{Healthcheck{Test: []string{"/bin/check"}}, false},
+		{Healthcheck{Test: []string{"CMD", "/bin/check"}, Retries: -1}, false},
+	} {
+		err := test.healthcheck.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("Validate(%#v): expected valid=%v, got error %v", test.healthcheck, test.valid, err)
+		}
+	}
+}
+
+func TestValidateExposedPort(t *testing.T) {
+	for _, test := range []struct {
+		port  string
+		valid bool
+	}{
+		{"80", true},
+		{"8080/tcp", true},
+		{"53/udp", true},
+		{"9000/sctp", true},
+		{"", false},
+		{"0", false},
+		{"65536", false},
+		{"http", false},
+		{"80/icmp", false},
+		{"80-90/tcp", false},
+	} {
+		err := ValidateExposedPort(test.port)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateExposedPort(%q): expected valid=%v, got error %v", test.port, test.valid, err)
+		}
+	}
+}
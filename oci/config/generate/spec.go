@@ -35,6 +35,10 @@ import (
 // configuration blobs.
 type Generator struct {
 	image ispec.Image
+
+	// extensions are the modifications of fields not in ispec.Image, in the
+	// order they were made (see ExtensionPatch).
+	extensions []extension
 }
 
 // init makes sure everything has a "proper" zero value.
@@ -147,6 +151,17 @@ func (g *Generator) AddConfigEnv(name, value string) {
 	g.image.Config.Env = append(g.image.Config.Env, env)
 }
 
+// RemoveConfigEnv removes an environment variable from the list of environment variables to be used in a container.
+func (g *Generator) RemoveConfigEnv(name string) {
+	env := []string{}
+	for _, v := range g.image.Config.Env {
+		if !strings.HasPrefix(v, name+"=") {
+			env = append(env, v)
+		}
+	}
+	g.image.Config.Env = env
+}
+
 // ConfigEnv returns the list of environment variables to be used in a container.
 func (g *Generator) ConfigEnv() []string {
 	copy := []string{}
@@ -243,6 +243,15 @@ func TestConfigEnv(t *testing.T) {
 	if !reflect.DeepEqual(env, got) {
 		t.Errorf("ConfigEnv doesn't match: expected %v, got %v", env, got)
 	}
+
+	env = []string{env[0], env[2]}
+	g.RemoveConfigEnv("TEST")
+	g.RemoveConfigEnv("nonexist")
+
+	got = g.ConfigEnv()
+	if !reflect.DeepEqual(env, got) {
+		t.Errorf("ConfigEnv doesn't match: expected %v, got %v", env, got)
+	}
 }
 
 func TestConfigLabels(t *testing.T) {
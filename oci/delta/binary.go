@@ -0,0 +1,310 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// The binary delta format is a sequence of operations which reconstruct the
+// target from the base, in the style of rsync. It starts with deltaMagic, and
+// each operation is a single byte followed by its arguments (as uvarints):
+//
+//	opCopy   <offset> <length>  copy length bytes of the base from offset
+//	opData   <length> <bytes>   write the given literal bytes
+//	opEnd                       the end of the delta
+const (
+	deltaMagic = "umoci-delta-v1\x00"
+
+	opCopy = 'c'
+	opData = 'd'
+	opEnd  = 'e'
+)
+
+const (
+	// blockSize is the size of the blocks of the base which are matched in
+	// the target. Tar archives are made of 512-byte blocks, so this should be
+	// a multiple of 512.
+	blockSize = 4096
+
+	// bufferSize is the amount of the target which is kept in memory, and
+	// thus the largest data operation generated.
+	bufferSize = 1 << 20
+)
+
+// rollsum is the rolling (weak) checksum used by rsync, which can be updated
+// cheaply as the window of blockSize bytes it covers slides through the
+// target.
+type rollsum struct {
+	a, b uint32
+}
+
+func newRollsum(p []byte) rollsum {
+	var r rollsum
+	for idx, c := range p {
+		r.a += uint32(c)
+		r.b += uint32(len(p)-idx) * uint32(c)
+	}
+	return r
+}
+
+// roll slides the window by one byte, removing out and adding in.
+func (r *rollsum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - blockSize*uint32(out)
+}
+
+func (r rollsum) sum() uint32 {
+	return r.b<<16 | r.a&0xffff
+}
+
+// baseBlock is a block of the base, identified by its strong checksum.
+type baseBlock struct {
+	offset int64
+	strong [sha256.Size]byte
+}
+
+// encoder writes the operations of a delta, merging adjacent operations.
+type encoder struct {
+	w   *bufio.Writer
+	buf [2 * binary.MaxVarintLen64]byte
+
+	// copyOffset and copyLength describe the pending copy operation.
+	copyOffset, copyLength int64
+}
+
+func (e *encoder) op(op byte, args ...int64) error {
+	if err := e.w.WriteByte(op); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		n := binary.PutUvarint(e.buf[:], uint64(arg))
+		if _, err := e.w.Write(e.buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) flushCopy() error {
+	if e.copyLength == 0 {
+		return nil
+	}
+	err := e.op(opCopy, e.copyOffset, e.copyLength)
+	e.copyLength = 0
+	return err
+}
+
+func (e *encoder) copy(offset, length int64) error {
+	if e.copyLength > 0 && e.copyOffset+e.copyLength == offset {
+		e.copyLength += length
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.copyOffset, e.copyLength = offset, length
+	return nil
+}
+
+func (e *encoder) data(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	if err := e.op(opData, int64(len(p))); err != nil {
+		return err
+	}
+	_, err := e.w.Write(p)
+	return err
+}
+
+func (e *encoder) end() error {
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	if err := e.op(opEnd); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+// indexBase computes the checksums of every (complete) block of the base,
+// keyed by their weak checksum.
+func indexBase(base io.Reader) (map[uint32][]baseBlock, error) {
+	index := map[uint32][]baseBlock{}
+	block := make([]byte, blockSize)
+	for offset := int64(0); ; offset += blockSize {
+		if _, err := io.ReadFull(base, block); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		weak := newRollsum(block).sum()
+		index[weak] = append(index[weak], baseBlock{
+			offset: offset,
+			strong: sha256.Sum256(block),
+		})
+	}
+	return index, nil
+}
+
+// Diff writes a binary delta to w, which can be used by Patch to reconstruct
+// target given base. Only the blocks of base are kept in memory (as
+// checksums), and target is streamed.
+func Diff(base, target io.Reader, w io.Writer) error {
+	index, err := indexBase(base)
+	if err != nil {
+		return errors.Wrap(err, "index base")
+	}
+
+	enc := &encoder{w: bufio.NewWriter(w)}
+	if _, err := io.WriteString(enc.w, deltaMagic); err != nil {
+		return errors.Wrap(err, "write delta")
+	}
+
+	var (
+		// buf[start:pos] are the literal bytes which haven't been written
+		// yet, and buf[pos:pos+blockSize] is the current window.
+		buf        = make([]byte, 0, bufferSize+blockSize)
+		start, pos int
+		eof        bool
+		sum        rollsum
+		rolling    bool
+	)
+	for {
+		// Make sure that we have a full window (and the byte after it) in
+		// the buffer, making room by writing out the pending literals.
+		if len(buf)-pos <= blockSize && !eof {
+			if err := enc.data(buf[start:pos]); err != nil {
+				return errors.Wrap(err, "write delta")
+			}
+			buf = buf[:copy(buf, buf[pos:])]
+			start, pos = 0, 0
+
+			n, err := io.ReadFull(target, buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return errors.Wrap(err, "read target")
+			}
+		}
+		if len(buf)-pos < blockSize {
+			break
+		}
+
+		window := buf[pos : pos+blockSize]
+		if !rolling {
+			sum = newRollsum(window)
+			rolling = true
+		}
+		if blocks, ok := index[sum.sum()]; ok {
+			strong := sha256.Sum256(window)
+			matched := false
+			for _, block := range blocks {
+				if block.strong == strong {
+					if err := enc.data(buf[start:pos]); err != nil {
+						return errors.Wrap(err, "write delta")
+					}
+					if err := enc.copy(block.offset, blockSize); err != nil {
+						return errors.Wrap(err, "write delta")
+					}
+					pos += blockSize
+					start = pos
+					rolling = false
+					matched = true
+					break
+				}
+			}
+			if matched {
+				continue
+			}
+		}
+
+		// No match, so the first byte of the window is a literal.
+		if pos+blockSize == len(buf) {
+			// Only happens at the end of the target.
+			break
+		}
+		sum.roll(buf[pos], buf[pos+blockSize])
+		pos++
+	}
+	if err := enc.data(buf[start:]); err != nil {
+		return errors.Wrap(err, "write delta")
+	}
+	return errors.Wrap(enc.end(), "write delta")
+}
+
+// Patch reconstructs the target of the given binary delta (generated by Diff)
+// from base, writing it to w.
+func Patch(base io.ReaderAt, delta io.Reader, w io.Writer) error {
+	r := bufio.NewReader(delta)
+
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return errors.Wrap(err, "read delta header")
+	}
+	if string(magic) != deltaMagic {
+		return errors.Errorf("invalid delta header %q", magic)
+	}
+
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return errors.Wrap(err, "read delta operation")
+		}
+		switch op {
+		case opCopy:
+			offset, err := binary.ReadUvarint(r)
+			if err != nil {
+				return errors.Wrap(err, "read copy offset")
+			}
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return errors.Wrap(err, "read copy length")
+			}
+			n, err := io.Copy(w, io.NewSectionReader(base, int64(offset), int64(length)))
+			if err != nil {
+				return errors.Wrap(err, "copy from base")
+			}
+			if n != int64(length) {
+				return errors.Errorf("copy of %d bytes at %d is beyond the end of the base", length, offset)
+			}
+		case opData:
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return errors.Wrap(err, "read data length")
+			}
+			if _, err := io.CopyN(w, r, int64(length)); err != nil {
+				return errors.Wrap(err, "copy data")
+			}
+		case opEnd:
+			return nil
+		default:
+			return errors.Errorf("invalid delta operation %q", op)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(rng *rand.Rand, n int) []byte {
+	p := make([]byte, n)
+	rng.Read(p)
+	return p
+}
+
+func TestDiffPatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(1337))
+	base := randomBytes(rng, 5*bufferSize/2)
+
+	// The target shares most of its contents with the base, but shifted and
+	// with some changes.
+	var target []byte
+	target = append(target, randomBytes(rng, 123)...)
+	target = append(target, base[:bufferSize]...)
+	target = append(target, randomBytes(rng, 7*blockSize+17)...)
+	target = append(target, base[bufferSize+3*blockSize:2*bufferSize]...)
+	target = append(target, base[:10*blockSize]...)
+	target = append(target, randomBytes(rng, blockSize-1)...)
+
+	for _, test := range []struct {
+		name         string
+		base, target []byte
+		similar      bool
+	}{
+		{"Empty", nil, nil, false},
+		{"EmptyBase", nil, target, false},
+		{"EmptyTarget", base, nil, false},
+		{"Small", []byte("hello"), []byte("hello world"), false},
+		{"Identical", base, base, true},
+		{"Similar", base, target, true},
+		{"Unrelated", base, randomBytes(rng, 3*blockSize+5), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var delta bytes.Buffer
+			if err := Diff(bytes.NewReader(test.base), bytes.NewReader(test.target), &delta); err != nil {
+				t.Fatalf("unexpected error in diff: %+v", err)
+			}
+			if test.similar && delta.Len() > len(test.target)/10 {
+				t.Errorf("delta is too large: %d bytes for %d byte target", delta.Len(), len(test.target))
+			}
+
+			var patched bytes.Buffer
+			if err := Patch(bytes.NewReader(test.base), &delta, &patched); err != nil {
+				t.Fatalf("unexpected error in patch: %+v", err)
+			}
+			if !bytes.Equal(patched.Bytes(), test.target) {
+				t.Errorf("patched target doesn't match: got %d bytes, expected %d bytes", patched.Len(), len(test.target))
+			}
+		})
+	}
+}
+
+func TestPatchInvalid(t *testing.T) {
+	base := []byte("base")
+	for _, delta := range []string{
+		"",
+		"not-a-delta",
+		deltaMagic,
+		deltaMagic + "x",
+		deltaMagic + "c\x00\x10e",
+		deltaMagic + "d\x10abc",
+	} {
+		var patched bytes.Buffer
+		if err := Patch(bytes.NewReader(base), bytes.NewBufferString(delta), &patched); err == nil {
+			t.Errorf("expected error patching with invalid delta %q", delta)
+		}
+	}
+}
@@ -0,0 +1,577 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package delta implements delta artifacts, which describe how to reconstruct
+// an image from another image, so that updating an image only requires
+// transferring the differences between the two images (rather than all of
+// the new layers). New layers are stored as binary deltas (see Diff) of their
+// uncompressed contents against the uncompressed layers of the old image.
+package delta
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// ArtifactType is the artifact type of delta artifacts, which are
+	// attached to the manifest they reconstruct (see casext.Attach).
+	ArtifactType = "application/vnd.opensuse.umoci.delta.v1"
+
+	// MediaTypeIndex is the media type of the Index of a delta artifact.
+	MediaTypeIndex = "application/vnd.opensuse.umoci.delta.index.v1+json"
+
+	// MediaTypeLayerDelta is the media type of the gzip-compressed binary
+	// deltas of the layers of a delta artifact.
+	MediaTypeLayerDelta = "application/vnd.opensuse.umoci.delta.layer.v1+gzip"
+
+	// MediaTypeBlob is the media type of the blobs which are included in a
+	// delta artifact as-is. The original media type is not used, so that the
+	// blobs are opaque when walking the artifact (otherwise copying the
+	// artifact would require the whole image it describes).
+	MediaTypeBlob = "application/vnd.opensuse.umoci.delta.blob.v1"
+
+	// AnnotationFrom and AnnotationTo are the annotations of a delta artifact
+	// containing the digests of the manifests it updates from and to.
+	AnnotationFrom = "org.opensuse.umoci.delta.from"
+	AnnotationTo   = "org.opensuse.umoci.delta.to"
+)
+
+// Encodings of the blobs in an Index.
+const (
+	// EncodingFull blobs are included in the artifact as-is.
+	EncodingFull = "full"
+
+	// EncodingLayerDelta blobs are gzip-compressed layers, which are
+	// reconstructed by applying the binary delta in the artifact to the
+	// uncompressed layers of the old image (concatenated in order), and then
+	// compressing the result with gzip at the given CompressionLevel.
+	EncodingLayerDelta = "layer-delta"
+)
+
+// Index describes the blobs of a delta artifact. It is stored in the
+// artifact with a media type of MediaTypeIndex.
+type Index struct {
+	// From and To are the descriptors of the manifests the delta updates
+	// from and to.
+	From ispec.Descriptor `json:"from"`
+	To   ispec.Descriptor `json:"to"`
+
+	// Blobs are the blobs reachable from To which are not reachable from
+	// From, and how to reconstruct them.
+	Blobs []Blob `json:"blobs"`
+}
+
+// Blob describes how a blob is reconstructed from a delta artifact.
+type Blob struct {
+	// Target is the descriptor of the reconstructed blob.
+	Target ispec.Descriptor `json:"target"`
+
+	// Encoding is how the blob is stored in the artifact (EncodingFull or
+	// EncodingLayerDelta).
+	Encoding string `json:"encoding"`
+
+	// Data is the digest of the blob in the artifact from which the blob is
+	// reconstructed. For EncodingFull, it is the digest of the Target.
+	Data digest.Digest `json:"data"`
+
+	// CompressionLevel is the gzip compression level used to compress an
+	// EncodingLayerDelta blob.
+	CompressionLevel int `json:"compressionLevel,omitempty"`
+}
+
+// Options modifies the behaviour of Create and Apply.
+type Options struct {
+	// TempDir is the directory in which the uncompressed layers of the old
+	// image are stored while a delta is being created or applied. If empty,
+	// the default directory for temporary files is used.
+	TempDir string
+}
+
+// Create generates a delta artifact describing how to reconstruct the image
+// with the manifest to from the image with the manifest from, and attaches it
+// to to (see casext.Attach). The descriptor of the artifact manifest is
+// returned. The artifact includes every blob reachable from to which isn't
+// reachable from from -- new gzip-compressed layers are stored as binary
+// deltas, if the layer can be reproduced by compressing its contents with
+// gzip (which is the case for layers generated by umoci).
+func Create(ctx context.Context, engine casext.Engine, from, to ispec.Descriptor, opt *Options) (_ ispec.Descriptor, err error) {
+	var options Options
+	if opt != nil {
+		options = *opt
+	}
+
+	fromManifest, err := getManifest(ctx, engine, from)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get old manifest")
+	}
+	toManifest, err := getManifest(ctx, engine, to)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get new manifest")
+	}
+
+	present, err := engine.Reachable(ctx, from)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get old blobs")
+	}
+	skip := map[digest.Digest]struct{}{}
+	for _, blob := range present {
+		skip[blob] = struct{}{}
+	}
+	paths, err := engine.Paths(ctx, to)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get new blobs")
+	}
+
+	layers := map[digest.Digest]ispec.Descriptor{}
+	for _, descriptor := range toManifest.Layers {
+		layers[descriptor.Digest] = descriptor
+	}
+
+	// The uncompressed layers of the old image are only needed if there are
+	// new layers to diff.
+	var base *baseFile
+	defer func() {
+		if base != nil {
+			base.Close()
+		}
+	}()
+
+	index := Index{From: from, To: to, Blobs: []Blob{}}
+	var blobs []ispec.Descriptor
+	for _, descriptor := range paths {
+		if _, ok := skip[descriptor.Digest]; ok {
+			continue
+		}
+		skip[descriptor.Digest] = struct{}{}
+
+		// Blobs of foreign layers might not be in the image.
+		reader, err := engine.GetBlob(ctx, descriptor.Digest)
+		if casext.IsForeignLayerType(descriptor.MediaType) && os.IsNotExist(errors.Cause(err)) {
+			continue
+		} else if err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "get blob %s", descriptor.Digest)
+		}
+		reader.Close()
+
+		entry := Blob{
+			Target:   descriptor,
+			Encoding: EncodingFull,
+			Data:     descriptor.Digest,
+		}
+		data := ispec.Descriptor{
+			MediaType: MediaTypeBlob,
+			Digest:    descriptor.Digest,
+			Size:      descriptor.Size,
+		}
+		if layerDescriptor, ok := layers[descriptor.Digest]; ok && layerDescriptor.MediaType == ispec.MediaTypeImageLayerGzip {
+			level, ok, err := compressionLevel(ctx, engine, layerDescriptor)
+			if err != nil {
+				return ispec.Descriptor{}, errors.Wrapf(err, "check compression of layer %s", descriptor.Digest)
+			}
+			if ok {
+				if base == nil {
+					base, err = newBaseFile(ctx, engine, fromManifest, options.TempDir)
+					if err != nil {
+						return ispec.Descriptor{}, errors.Wrap(err, "get old layers")
+					}
+				}
+				deltaDescriptor, err := diffLayer(ctx, engine, base, layerDescriptor)
+				if err != nil {
+					return ispec.Descriptor{}, errors.Wrapf(err, "diff layer %s", descriptor.Digest)
+				}
+				// Only use the delta if it's actually smaller.
+				if deltaDescriptor.Size < descriptor.Size {
+					entry = Blob{
+						Target:           descriptor,
+						Encoding:         EncodingLayerDelta,
+						Data:             deltaDescriptor.Digest,
+						CompressionLevel: level,
+					}
+					data = deltaDescriptor
+				}
+			}
+		}
+		event.Log(ctx).WithFields(event.Fields{
+			"digest":   entry.Target.Digest,
+			"encoding": entry.Encoding,
+			"size":     data.Size,
+		}).Debugf("delta: adding blob")
+
+		index.Blobs = append(index.Blobs, entry)
+		blobs = append(blobs, data)
+	}
+
+	indexDigest, indexSize, err := engine.PutBlobJSON(ctx, index)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put delta index")
+	}
+	blobs = append([]ispec.Descriptor{{
+		MediaType: MediaTypeIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}}, blobs...)
+
+	return engine.Attach(ctx, to, ArtifactType, blobs, map[string]string{
+		AnnotationFrom: from.Digest.String(),
+		AnnotationTo:   to.Digest.String(),
+	})
+}
+
+// Apply reconstructs the blobs of the image described by the given delta
+// artifact (created by Create), which must be in the same image as the blobs
+// of the image the delta updates from. The descriptor of the reconstructed
+// manifest is returned.
+func Apply(ctx context.Context, engine casext.Engine, artifact ispec.Descriptor, opt *Options) (_ ispec.Descriptor, err error) {
+	var options Options
+	if opt != nil {
+		options = *opt
+	}
+
+	index, err := ReadIndex(ctx, engine, artifact)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	fromManifest, err := getManifest(ctx, engine, index.From)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "get old manifest %s", index.From.Digest)
+	}
+
+	var base *baseFile
+	defer func() {
+		if base != nil {
+			base.Close()
+		}
+	}()
+
+	for _, entry := range index.Blobs {
+		switch entry.Encoding {
+		case EncodingFull:
+			if entry.Data != entry.Target.Digest {
+				return ispec.Descriptor{}, errors.Errorf("full blob %s has data %s", entry.Target.Digest, entry.Data)
+			}
+			if err := checkBlob(ctx, engine, entry.Target); err != nil {
+				return ispec.Descriptor{}, err
+			}
+		case EncodingLayerDelta:
+			if base == nil {
+				base, err = newBaseFile(ctx, engine, fromManifest, options.TempDir)
+				if err != nil {
+					return ispec.Descriptor{}, errors.Wrap(err, "get old layers")
+				}
+			}
+			if err := patchLayer(ctx, engine, base, entry); err != nil {
+				return ispec.Descriptor{}, errors.Wrapf(err, "reconstruct layer %s", entry.Target.Digest)
+			}
+		default:
+			return ispec.Descriptor{}, errors.Errorf("blob %s has unknown encoding %q", entry.Target.Digest, entry.Encoding)
+		}
+		event.Log(ctx).WithFields(event.Fields{
+			"digest":   entry.Target.Digest,
+			"encoding": entry.Encoding,
+		}).Debugf("delta: reconstructed blob")
+	}
+
+	// Make sure the new image is complete.
+	if _, err := engine.Reachable(ctx, index.To); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "verify new image")
+	}
+	return index.To, nil
+}
+
+// ReadIndex returns the Index of the given delta artifact.
+func ReadIndex(ctx context.Context, engine casext.Engine, artifact ispec.Descriptor) (Index, error) {
+	manifest, err := getManifest(ctx, engine, artifact)
+	if err != nil {
+		return Index{}, errors.Wrap(err, "get delta artifact")
+	}
+	var indexDescriptor *ispec.Descriptor
+	for idx := range manifest.Layers {
+		if manifest.Layers[idx].MediaType == MediaTypeIndex {
+			indexDescriptor = &manifest.Layers[idx]
+			break
+		}
+	}
+	if indexDescriptor == nil {
+		return Index{}, errors.Errorf("%s is not a delta artifact: no %s blob", artifact.Digest, MediaTypeIndex)
+	}
+
+	data, err := engine.ReadMetadataBlob(ctx, *indexDescriptor)
+	if err != nil {
+		return Index{}, errors.Wrap(err, "get delta index")
+	}
+
+	var index Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return Index{}, errors.Wrap(err, "parse delta index")
+	}
+	return index, nil
+}
+
+// getManifest returns the manifest with the given descriptor.
+func getManifest(ctx context.Context, engine casext.Engine, descriptor ispec.Descriptor) (ispec.Manifest, error) {
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return ispec.Manifest{}, errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", descriptor.MediaType)
+	}
+	blob, err := engine.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return ispec.Manifest{}, err
+	}
+	defer blob.Close()
+
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return ispec.Manifest{}, errors.Errorf("[internal error] unknown manifest blob type: %s", blob.MediaType)
+	}
+	return manifest, nil
+}
+
+// checkBlob returns an error if the given blob is not in the image.
+func checkBlob(ctx context.Context, engine casext.Engine, descriptor ispec.Descriptor) error {
+	reader, err := engine.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		return errors.Wrapf(err, "get blob %s", descriptor.Digest)
+	}
+	return reader.Close()
+}
+
+// baseFile is a temporary file containing the uncompressed layers of an
+// image, which is the base of the binary deltas of layers.
+type baseFile struct {
+	*os.File
+}
+
+// newBaseFile writes the uncompressed layers of the given manifest to a new
+// temporary file in tempDir.
+func newBaseFile(ctx context.Context, engine casext.Engine, manifest ispec.Manifest, tempDir string) (*baseFile, error) {
+	file, err := ioutil.TempFile(tempDir, "umoci-delta-base")
+	if err != nil {
+		return nil, errors.Wrap(err, "create temporary file")
+	}
+	base := &baseFile{file}
+
+	ctx, err = casext.WithManifestLayerChunks(ctx, manifest)
+	if err != nil {
+		base.Close()
+		return nil, errors.Wrap(err, "get chunked layers")
+	}
+	for _, descriptor := range manifest.Layers {
+		reader, err := layer.OpenLayer(ctx, engine, descriptor)
+		if errors.Cause(err) == layer.ErrEncryptedLayer || errors.Cause(err) == layer.ErrForeignLayer {
+			// These layers cannot be used as a base, but that only makes
+			// the deltas less effective.
+			event.Log(ctx).Debugf("delta: skipping layer %s in base: %v", descriptor.Digest, err)
+			continue
+		} else if err != nil {
+			base.Close()
+			return nil, errors.Wrapf(err, "open layer %s", descriptor.Digest)
+		}
+		_, err = io.Copy(file, reader)
+		reader.Close()
+		if err != nil {
+			base.Close()
+			return nil, errors.Wrapf(err, "read layer %s", descriptor.Digest)
+		}
+	}
+	return base, nil
+}
+
+// Close removes the temporary file.
+func (b *baseFile) Close() error {
+	err := b.File.Close()
+	os.Remove(b.Name())
+	return err
+}
+
+// rewind returns a reader for the whole base.
+func (b *baseFile) rewind() (io.Reader, error) {
+	if _, err := b.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "seek base")
+	}
+	return b.File, nil
+}
+
+// compressionLevel returns the gzip compression level with which the
+// uncompressed contents of the given layer compress to the same blob, or
+// false if there is no such level.
+func compressionLevel(ctx context.Context, engine casext.Engine, descriptor ispec.Descriptor) (int, bool, error) {
+	reader, err := engine.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		return 0, false, errors.Wrap(err, "get layer blob")
+	}
+	header := make([]byte, 10)
+	_, err = io.ReadFull(reader, header)
+	reader.Close()
+	if err != nil {
+		return 0, false, errors.Wrap(err, "read gzip header")
+	}
+
+	// Only gzip streams written by compress/gzip (with no name, comment or
+	// modification time) can be reproduced. The extra flags tell us which
+	// levels are worth trying.
+	if !bytes.Equal(header[:9], []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, header[8]}) || header[9] != 0xff {
+		return 0, false, nil
+	}
+	var levels []int
+	switch header[8] {
+	case 2:
+		levels = []int{gzip.BestCompression}
+	case 4:
+		levels = []int{gzip.BestSpeed}
+	default:
+		levels = []int{6, 2, 3, 4, 5, 7, 8}
+	}
+
+	for _, level := range levels {
+		blob, err := engine.GetBlob(ctx, descriptor.Digest)
+		if err != nil {
+			return 0, false, errors.Wrap(err, "get layer blob")
+		}
+		ok, err := recompresses(blob, descriptor, level)
+		blob.Close()
+		if err != nil {
+			return 0, false, err
+		}
+		if ok {
+			return level, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// recompresses returns whether the given gzip-compressed blob is reproduced
+// by compressing its contents with the given level.
+func recompresses(blob io.Reader, descriptor ispec.Descriptor, level int) (bool, error) {
+	gzr, err := gzip.NewReader(blob)
+	if err != nil {
+		return false, errors.Wrap(err, "create gzip reader")
+	}
+	defer gzr.Close()
+
+	digester := cas.BlobAlgorithm.Digester()
+	counter := &countWriter{w: digester.Hash()}
+	gzw, err := gzip.NewWriterLevel(counter, level)
+	if err != nil {
+		return false, errors.Wrap(err, "create gzip writer")
+	}
+	if _, err := io.Copy(gzw, gzr); err != nil {
+		return false, errors.Wrap(err, "recompress layer")
+	}
+	if err := gzw.Close(); err != nil {
+		return false, errors.Wrap(err, "recompress layer")
+	}
+	return counter.n == descriptor.Size && digester.Digest() == descriptor.Digest, nil
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// diffLayer stores the gzip-compressed binary delta of the uncompressed
+// contents of the given layer against base, returning its descriptor.
+func diffLayer(ctx context.Context, engine casext.Engine, base *baseFile, descriptor ispec.Descriptor) (ispec.Descriptor, error) {
+	reader, err := layer.OpenLayer(ctx, engine, descriptor)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "open layer")
+	}
+	defer reader.Close()
+	baseReader, err := base.rewind()
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	defer pipeReader.Close()
+	go func() {
+		gzw := gzip.NewWriter(pipeWriter)
+		err := Diff(baseReader, reader, gzw)
+		if closeErr := gzw.Close(); err == nil {
+			err = closeErr
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+
+	deltaDigest, deltaSize, err := engine.PutBlob(ctx, pipeReader)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put layer delta")
+	}
+	return ispec.Descriptor{
+		MediaType: MediaTypeLayerDelta,
+		Digest:    deltaDigest,
+		Size:      deltaSize,
+	}, nil
+}
+
+// patchLayer reconstructs the given EncodingLayerDelta blob from base.
+func patchLayer(ctx context.Context, engine casext.Engine, base *baseFile, entry Blob) error {
+	deltaBlob, err := engine.GetBlob(ctx, entry.Data)
+	if err != nil {
+		return errors.Wrap(err, "get layer delta")
+	}
+	defer deltaBlob.Close()
+	delta, err := gzip.NewReader(deltaBlob)
+	if err != nil {
+		return errors.Wrap(err, "decompress layer delta")
+	}
+	defer delta.Close()
+
+	pipeReader, pipeWriter := io.Pipe()
+	defer pipeReader.Close()
+	go func() {
+		gzw, err := gzip.NewWriterLevel(pipeWriter, entry.CompressionLevel)
+		if err == nil {
+			err = Patch(base, delta, gzw)
+			if closeErr := gzw.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+
+	layerDigest, layerSize, err := engine.PutBlob(ctx, pipeReader)
+	if err != nil {
+		return errors.Wrap(err, "put layer")
+	}
+	if layerDigest != entry.Target.Digest || layerSize != entry.Target.Size {
+		// The bad blob might be shared with another image, so leave it to
+		// GC to clean it up.
+		return errors.Errorf("reconstructed layer is %s (%d bytes) rather than %s (%d bytes)", layerDigest, layerSize, entry.Target.Digest, entry.Target.Size)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package delta
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func putJSON(t *testing.T, engine casext.Engine, mediaType string, data interface{}) ispec.Descriptor {
+	blobDigest, blobSize, err := engine.PutBlobJSON(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{MediaType: mediaType, Digest: blobDigest, Size: blobSize}
+}
+
+func putLayer(t *testing.T, engine casext.Engine, data []byte, level int) ispec.Descriptor {
+	var buf bytes.Buffer
+	gzw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gzw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerDigest, layerSize, err := engine.PutBlob(context.Background(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{MediaType: ispec.MediaTypeImageLayerGzip, Digest: layerDigest, Size: layerSize}
+}
+
+func putImage(t *testing.T, engine casext.Engine, layers ...ispec.Descriptor) ispec.Descriptor {
+	config := putJSON(t, engine, ispec.MediaTypeImageConfig, ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		RootFS:       ispec.RootFS{Type: "layers"},
+	})
+	return putJSON(t, engine, ispec.MediaTypeImageManifest, ispec.Manifest{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		Config:    config,
+		Layers:    layers,
+	})
+}
+
+func TestCreateApply(t *testing.T) {
+	ctx := context.Background()
+	src := casext.Engine{mem.New()}
+	defer src.Close()
+	dst := casext.Engine{mem.New()}
+	defer dst.Close()
+
+	rng := rand.New(rand.NewSource(1337))
+	base := randomBytes(rng, 64*blockSize)
+	changed := append(append([]byte{}, base[:32*blockSize]...), randomBytes(rng, 100)...)
+	changed = append(changed, base[40*blockSize:]...)
+
+	shared := putLayer(t, src, randomBytes(rng, 1000), gzip.DefaultCompression)
+	from := putImage(t, src, shared, putLayer(t, src, base, gzip.DefaultCompression))
+	diffed := putLayer(t, src, changed, gzip.BestCompression)
+	// This layer cannot be reproduced, because it has a file name.
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	gzw.Name = "layer.tar"
+	gzw.Write(changed)
+	gzw.Close()
+	fullDigest, fullSize, err := src.PutBlob(ctx, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := ispec.Descriptor{MediaType: ispec.MediaTypeImageLayerGzip, Digest: fullDigest, Size: fullSize}
+	to := putImage(t, src, shared, diffed, full)
+
+	artifact, err := Create(ctx, src, from, to, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating delta: %+v", err)
+	}
+	index, err := ReadIndex(ctx, src, artifact)
+	if err != nil {
+		t.Fatalf("unexpected error reading delta: %+v", err)
+	}
+	encodings := map[string]Blob{}
+	for _, blob := range index.Blobs {
+		if blob.Target.Digest == shared.Digest {
+			t.Errorf("shared layer unexpectedly included in delta")
+		}
+		encodings[blob.Target.Digest.String()] = blob
+	}
+	if blob := encodings[diffed.Digest.String()]; blob.Encoding != EncodingLayerDelta || blob.CompressionLevel != gzip.BestCompression {
+		t.Errorf("expected changed layer to be a level %d delta: got %+v", gzip.BestCompression, blob)
+	}
+	if blob := encodings[full.Digest.String()]; blob.Encoding != EncodingFull {
+		t.Errorf("expected irreproducible layer to be included in full: got %+v", blob)
+	}
+	if _, ok := encodings[to.Digest.String()]; !ok {
+		t.Errorf("expected new manifest to be included in delta")
+	}
+
+	// Only the old image and the artifact are available in the destination.
+	if _, err := src.CopyTo(ctx, dst, from); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Apply(ctx, dst, artifact, nil); err == nil {
+		t.Errorf("expected error applying missing delta")
+	}
+	if _, err := src.CopyTo(ctx, dst, artifact); err != nil {
+		t.Fatalf("unexpected error copying delta: %+v", err)
+	}
+	if _, err := dst.GetBlob(ctx, diffed.Digest); err == nil {
+		t.Fatalf("changed layer unexpectedly copied with delta")
+	}
+
+	descriptor, err := Apply(ctx, dst, artifact, nil)
+	if err != nil {
+		t.Fatalf("unexpected error applying delta: %+v", err)
+	}
+	if descriptor.Digest != to.Digest {
+		t.Errorf("expected delta to reconstruct %s, got %s", to.Digest, descriptor.Digest)
+	}
+	if _, err := dst.Reachable(ctx, to); err != nil {
+		t.Errorf("reconstructed image is incomplete: %+v", err)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package dockerarchive converts between images in an OCI image layout and
+// the tarball format used by docker-save(1) and docker-load(1) (known as a
+// "docker-archive"). A docker-archive contains a manifest.json listing the
+// images in the archive (each with a configuration blob, a set of tags and an
+// ordered list of uncompressed layer tarballs), as well as a legacy
+// "repositories" file mapping tags to the top layer of each image.
+package dockerarchive
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// manifestPath is the path of the manifest.json in a docker-archive.
+	manifestPath = "manifest.json"
+
+	// repositoriesPath is the path of the legacy repositories file in a
+	// docker-archive.
+	repositoriesPath = "repositories"
+)
+
+// manifestEntry is a single image in the manifest.json of a docker-archive.
+type manifestEntry struct {
+	// Config is the path of the image configuration in the archive.
+	Config string `json:"Config"`
+
+	// RepoTags is the set of tags (of the form "name:tag") of the image.
+	RepoTags []string `json:"RepoTags"`
+
+	// Layers is the ordered list of paths of the (uncompressed) layer
+	// tarballs of the image in the archive.
+	Layers []string `json:"Layers"`
+}
+
+// archivePath returns the cleaned form of a path inside an archive.
+func archivePath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// splitRepoTag splits a docker reference of the form "name[:tag]" into its
+// name and tag (which defaults to "latest").
+func splitRepoTag(repoTag string) (string, string, error) {
+	name, tag := repoTag, "latest"
+	// The name can contain a registry port, so the tag is only the part
+	// after the last ':' if there is no '/' after it.
+	if sep := strings.LastIndex(repoTag, ":"); sep >= 0 && !strings.Contains(repoTag[sep:], "/") {
+		name, tag = repoTag[:sep], repoTag[sep+1:]
+	}
+	if name == "" || tag == "" {
+		return "", "", errors.Errorf("invalid docker reference: %q", repoTag)
+	}
+	return name, tag, nil
+}
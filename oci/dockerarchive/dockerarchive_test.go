@@ -0,0 +1,227 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerarchive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// makeLayer returns a layer tarball containing a single file.
+func makeLayer(t *testing.T, name, contents string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// makeArchive returns a docker-archive in the format written by
+// docker-save(1), where the layers are stored out of order and the duplicate
+// top layer is a symlink to the base layer.
+func makeArchive(t *testing.T, layers [][]byte) []byte {
+	config := map[string]interface{}{
+		"architecture":   "amd64",
+		"os":             "linux",
+		"docker_version": "17.03.0-ce",
+		"config": map[string]interface{}{
+			"Cmd":    []string{"/bin/sh"},
+			"Labels": map[string]string{"key": "value"},
+		},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []string{},
+		},
+	}
+	var diffIDs []string
+	for _, layer := range layers {
+		diffIDs = append(diffIDs, digest.FromBytes(layer).String())
+	}
+	config["rootfs"].(map[string]interface{})["diff_ids"] = diffIDs
+	configData, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := []manifestEntry{{
+		Config:   "config.json",
+		RepoTags: []string{"localhost:5000/test:1.0"},
+		Layers:   []string{"base/layer.tar", "top/layer.tar", "same/layer.tar"},
+	}}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	write := func(name string, data []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("top/layer.tar", layers[1])
+	if err := tw.WriteHeader(&tar.Header{Name: "same/layer.tar", Typeflag: tar.TypeSymlink, Linkname: "../base/layer.tar"}); err != nil {
+		t.Fatal(err)
+	}
+	write("base/layer.tar", layers[0])
+	write("config.json", configData)
+	write(manifestPath, manifestData)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportExport(t *testing.T) {
+	ctx := context.Background()
+	engine := casext.Engine{mem.New()}
+	defer engine.Close()
+
+	layers := [][]byte{makeLayer(t, "base", "base layer"), makeLayer(t, "top", "top layer")}
+	layers = append(layers, layers[0])
+	archive := makeArchive(t, layers)
+
+	if _, err := Import(ctx, engine, bytes.NewReader(archive), "localhost:5000/test:2.0"); err == nil {
+		t.Errorf("Import: expected error with missing tag")
+	}
+	if _, err := Import(ctx, engine, bytes.NewReader(archive), "localhost:5000/test"); err == nil {
+		t.Errorf("Import: expected error with missing latest tag")
+	}
+
+	descriptor, err := Import(ctx, engine, bytes.NewReader(archive), "localhost:5000/test:1.0")
+	if err != nil {
+		t.Fatalf("Import: unexpected error: %+v", err)
+	}
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		t.Errorf("Import: unexpected media type: %s", descriptor.MediaType)
+	}
+
+	manifestBlob, err := engine.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		t.Fatalf("get manifest: %+v", err)
+	}
+	manifest := manifestBlob.Data.(ispec.Manifest)
+	manifestBlob.Close()
+	if len(manifest.Layers) != len(layers) {
+		t.Fatalf("Import: expected %d layers got %d", len(layers), len(manifest.Layers))
+	}
+	if manifest.Layers[0].Digest != manifest.Layers[2].Digest {
+		t.Errorf("Import: identical layers have different digests: %s != %s", manifest.Layers[0].Digest, manifest.Layers[2].Digest)
+	}
+
+	configBlob, err := engine.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		t.Fatalf("get config: %+v", err)
+	}
+	config := configBlob.Data.(ispec.Image)
+	configBlob.Close()
+	if config.Config.Labels["key"] != "value" || len(config.Config.Cmd) != 1 {
+		t.Errorf("Import: config was not translated: %+v", config.Config)
+	}
+	for i, layer := range layers {
+		if config.RootFS.DiffIDs[i] != digest.FromBytes(layer).String() {
+			t.Errorf("Import: diff_id %d doesn't match: expected %s got %s", i, digest.FromBytes(layer), config.RootFS.DiffIDs[i])
+		}
+	}
+
+	var exported bytes.Buffer
+	if err := Export(ctx, engine, descriptor, []string{"localhost:5000/test"}, &exported); err != nil {
+		t.Fatalf("Export: unexpected error: %+v", err)
+	}
+
+	// Every layer is only stored once, and the layers are uncompressed.
+	entries := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(exported.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		var buf bytes.Buffer
+		buf.ReadFrom(tr)
+		entries[hdr.Name] = buf.Bytes()
+	}
+	var exportedManifest []manifestEntry
+	if err := json.Unmarshal(entries[manifestPath], &exportedManifest); err != nil {
+		t.Fatalf("Export: invalid manifest.json: %+v", err)
+	}
+	if len(exportedManifest) != 1 || len(exportedManifest[0].RepoTags) != 1 || exportedManifest[0].RepoTags[0] != "localhost:5000/test:latest" {
+		t.Errorf("Export: unexpected manifest.json: %s", entries[manifestPath])
+	}
+	if digest.FromBytes(entries[exportedManifest[0].Config]) != manifest.Config.Digest {
+		t.Errorf("Export: config was modified")
+	}
+	if exportedManifest[0].Layers[0] != exportedManifest[0].Layers[2] {
+		t.Errorf("Export: identical layers were stored twice: %v", exportedManifest[0].Layers)
+	}
+	for i, layer := range layers {
+		if !bytes.Equal(entries[exportedManifest[0].Layers[i]], layer) {
+			t.Errorf("Export: layer %d doesn't match", i)
+		}
+	}
+	var repositories map[string]map[string]string
+	if err := json.Unmarshal(entries[repositoriesPath], &repositories); err != nil {
+		t.Fatalf("Export: invalid repositories: %+v", err)
+	}
+	if repositories["localhost:5000/test"]["latest"] != digest.FromBytes(layers[2]).Hex() {
+		t.Errorf("Export: unexpected repositories: %s", entries[repositoriesPath])
+	}
+
+	// Importing the exported image results in the same image.
+	reimported, err := Import(ctx, engine, bytes.NewReader(exported.Bytes()), "")
+	if err != nil {
+		t.Fatalf("Import: unexpected error re-importing: %+v", err)
+	}
+	if reimported.Digest != descriptor.Digest {
+		t.Errorf("Import: re-imported image doesn't match: expected %s got %s", descriptor.Digest, reimported.Digest)
+	}
+}
+
+func TestImportDiffIDMismatch(t *testing.T) {
+	ctx := context.Background()
+	engine := casext.Engine{mem.New()}
+	defer engine.Close()
+
+	layers := [][]byte{makeLayer(t, "base", "base layer"), makeLayer(t, "top", "top layer")}
+	layers = append(layers, layers[0])
+	archive := makeArchive(t, layers)
+
+	// Modify the top layer, so it no longer matches the config.
+	corrupt := bytes.Replace(archive, []byte("top layer"), []byte("TOP LAYER"), 1)
+	if _, err := Import(ctx, engine, bytes.NewReader(corrupt), ""); err == nil {
+		t.Errorf("Import: expected error with mismatched diff_id")
+	}
+}
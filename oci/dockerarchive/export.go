@@ -0,0 +1,224 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerarchive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"path"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// archiveWriter writes entries to a docker-archive. All entries have the same
+// modification time, so that exporting the same image twice results in the
+// same archive.
+type archiveWriter struct {
+	tw *tar.Writer
+}
+
+func (aw archiveWriter) writeDir(name string) error {
+	return errors.Wrapf(aw.tw.WriteHeader(&tar.Header{
+		Name:     name + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+		ModTime:  time.Unix(0, 0),
+	}), "write %s header", name)
+}
+
+func (aw archiveWriter) writeFile(name string, size int64, r io.Reader) error {
+	if err := aw.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Unix(0, 0),
+	}); err != nil {
+		return errors.Wrapf(err, "write %s header", name)
+	}
+	n, err := io.Copy(aw.tw, r)
+	if err != nil {
+		return errors.Wrapf(err, "write %s", name)
+	}
+	if n != size {
+		return errors.Errorf("write %s: size changed: expected %d got %d", name, size, n)
+	}
+	return nil
+}
+
+func (aw archiveWriter) writeJSON(name string, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrapf(err, "marshal %s", name)
+	}
+	return aw.writeFile(name, int64(len(buf)), bytes.NewReader(buf))
+}
+
+// writeLayer writes the uncompressed form of the given layer blob to the
+// archive, verifying that it matches the expected DiffID. The layer is read
+// twice (because the size of the uncompressed layer is needed for the tar
+// header), so no temporary files are needed.
+func (aw archiveWriter) writeLayer(ctx context.Context, engine casext.Engine, name string, descriptor ispec.Descriptor, diffID digest.Digest) error {
+	reader, err := layer.OpenLayer(ctx, engine, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "open layer")
+	}
+	diffIDDigester := cas.BlobAlgorithm.Digester()
+	size, err := io.Copy(diffIDDigester.Hash(), reader)
+	reader.Close()
+	if err != nil {
+		return errors.Wrap(err, "hash layer")
+	}
+	if diffIDDigester.Digest() != diffID {
+		return errors.Errorf("layer %s does not match diff_id: expected %s got %s", descriptor.Digest, diffID, diffIDDigester.Digest())
+	}
+
+	reader, err = layer.OpenLayer(ctx, engine, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "open layer")
+	}
+	defer reader.Close()
+	return aw.writeFile(name, size, reader)
+}
+
+// Export writes the image with the given manifest descriptor as a
+// docker-archive to w, which can be loaded with docker-load(1). repoTags is
+// the set of tags (of the form "name[:tag]") to give the image when it is
+// loaded, and can be empty. The image configuration is included unmodified
+// (OCI image configurations are a subset of docker image configurations), so
+// the docker image ID of the loaded image is the digest of the configuration
+// blob.
+func Export(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.Descriptor, repoTags []string, w io.Writer) error {
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType)
+	}
+
+	// The legacy repositories file requires a name and tag for every image.
+	repositories := map[string]map[string]string{}
+	entry := manifestEntry{
+		RepoTags: []string{},
+		Layers:   []string{},
+	}
+	for _, repoTag := range repoTags {
+		name, tag, err := splitRepoTag(repoTag)
+		if err != nil {
+			return errors.Wrap(err, "parse repo tag")
+		}
+		if repositories[name] == nil {
+			repositories[name] = map[string]string{}
+		}
+		repositories[name][tag] = ""
+		entry.RepoTags = append(entry.RepoTags, name+":"+tag)
+	}
+
+	manifestBlob, err := engine.FromDescriptor(ctx, manifestDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+
+	if manifest.Config.MediaType != ispec.MediaTypeImageConfig {
+		return errors.Errorf("config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, manifest.Config.MediaType)
+	}
+	configData, err := engine.ReadMetadataBlob(ctx, manifest.Config)
+	if err != nil {
+		return errors.Wrap(err, "get config blob")
+	}
+	// The image ID in docker is the digest of the config, so make sure it
+	// hasn't been modified.
+	if configDigest := manifest.Config.Digest.Algorithm().FromBytes(configData); configDigest != manifest.Config.Digest {
+		return errors.Wrap(&cas.DigestMismatchError{Expected: manifest.Config.Digest, Actual: configDigest}, "config blob")
+	}
+
+	var config ispec.Image
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return errors.Wrap(err, "parse config")
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return errors.Errorf("config has %d diff_ids but image has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	ctx, err = casext.WithManifestLayerChunks(ctx, manifest)
+	if err != nil {
+		return errors.Wrap(err, "get chunked layers")
+	}
+
+	aw := archiveWriter{tw: tar.NewWriter(w)}
+
+	entry.Config = manifest.Config.Digest.Hex() + ".json"
+	if err := aw.writeFile(entry.Config, int64(len(configData)), bytes.NewReader(configData)); err != nil {
+		return errors.Wrap(err, "write config")
+	}
+
+	// Layers are stored by their DiffID, so identical layers are only
+	// written once.
+	var topLayer string
+	written := map[string]struct{}{}
+	for i, layerDescriptor := range manifest.Layers {
+		diffID, err := digest.Parse(config.RootFS.DiffIDs[i])
+		if err != nil {
+			return errors.Wrapf(err, "parse diff_id %d", i)
+		}
+		topLayer = diffID.Hex()
+		layerPath := path.Join(topLayer, "layer.tar")
+		entry.Layers = append(entry.Layers, layerPath)
+
+		if _, ok := written[layerPath]; ok {
+			continue
+		}
+		written[layerPath] = struct{}{}
+
+		log.Debugf("docker-archive: exporting layer %s", layerDescriptor.Digest)
+		if err := aw.writeDir(topLayer); err != nil {
+			return errors.Wrap(err, "write layer directory")
+		}
+		if err := aw.writeLayer(ctx, engine, layerPath, layerDescriptor, diffID); err != nil {
+			return errors.Wrapf(err, "write layer %s", layerDescriptor.Digest)
+		}
+	}
+
+	if err := aw.writeJSON(manifestPath, []manifestEntry{entry}); err != nil {
+		return errors.Wrap(err, "write manifest.json")
+	}
+	if len(repositories) > 0 && topLayer != "" {
+		for name := range repositories {
+			for tag := range repositories[name] {
+				repositories[name][tag] = topLayer
+			}
+		}
+		if err := aw.writeJSON(repositoriesPath, repositories); err != nil {
+			return errors.Wrap(err, "write repositories")
+		}
+	}
+	return errors.Wrap(aw.tw.Close(), "close archive")
+}
@@ -0,0 +1,330 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerarchive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// maxLinkDepth is the maximum number of links followed when resolving a path
+// in an archive.
+const maxLinkDepth = 16
+
+// archiveIndex is the result of the first pass over a docker-archive.
+type archiveIndex struct {
+	// manifest is the parsed manifest.json.
+	manifest []manifestEntry
+
+	// links maps the paths of symlinks and hardlinks in the archive to their
+	// targets (docker-save(1) uses symlinks for layers shared between
+	// images).
+	links map[string]string
+}
+
+// resolve follows any links in the archive for the given path.
+func (idx archiveIndex) resolve(name string) (string, error) {
+	name = archivePath(name)
+	for i := 0; i < maxLinkDepth; i++ {
+		target, ok := idx.links[name]
+		if !ok {
+			return name, nil
+		}
+		name = target
+	}
+	return "", errors.Errorf("too many levels of links: %s", name)
+}
+
+// checkMetadataSize returns an error (whose cause is
+// casext.ErrMetadataTooLarge) if the given metadata entry of the archive is
+// larger than maxSize (unless maxSize is zero), so that it is not read into
+// memory.
+func checkMetadataSize(hdr *tar.Header, maxSize int64) error {
+	if maxSize > 0 && hdr.Size > maxSize {
+		return errors.Wrapf(casext.ErrMetadataTooLarge, "%s is %d bytes (larger than %d bytes)", hdr.Name, hdr.Size, maxSize)
+	}
+	return nil
+}
+
+// readIndex reads the manifest.json and the set of links in the archive.
+// manifest.json must not be larger than maxSize (see checkMetadataSize).
+func readIndex(archive io.Reader, maxSize int64) (archiveIndex, error) {
+	idx := archiveIndex{links: map[string]string{}}
+
+	found := false
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return idx, errors.Wrap(err, "read next entry")
+		}
+
+		name := archivePath(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			idx.links[name] = archivePath(path.Join(path.Dir(name), hdr.Linkname))
+		case tar.TypeLink:
+			idx.links[name] = archivePath(hdr.Linkname)
+		case tar.TypeReg, tar.TypeRegA:
+			if name != manifestPath {
+				continue
+			}
+			if err := checkMetadataSize(hdr, maxSize); err != nil {
+				return idx, err
+			}
+			if err := json.NewDecoder(tr).Decode(&idx.manifest); err != nil {
+				return idx, errors.Wrap(err, "parse manifest.json")
+			}
+			found = true
+		}
+	}
+	if !found {
+		return idx, errors.Errorf("archive has no manifest.json (not a docker-archive?)")
+	}
+	return idx, nil
+}
+
+// selectEntry returns the image in the manifest with the given tag. If ref is
+// empty, the manifest must only contain one image.
+func selectEntry(manifest []manifestEntry, ref string) (manifestEntry, error) {
+	if ref == "" {
+		if len(manifest) != 1 {
+			return manifestEntry{}, errors.Errorf("archive contains %d images: a reference must be specified", len(manifest))
+		}
+		return manifest[0], nil
+	}
+
+	name, tag, err := splitRepoTag(ref)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	for _, entry := range manifest {
+		for _, repoTag := range entry.RepoTags {
+			if entryName, entryTag, err := splitRepoTag(repoTag); err == nil && entryName == name && entryTag == tag {
+				return entry, nil
+			}
+		}
+	}
+	return manifestEntry{}, errors.Errorf("archive does not contain image %s", ref)
+}
+
+// importLayer adds a layer tarball from the archive as a gzip-compressed
+// layer blob, returning the descriptor and the DiffID of the layer.
+func importLayer(ctx context.Context, engine cas.Engine, r io.Reader) (ispec.Descriptor, digest.Digest, error) {
+	// docker-save(1) writes uncompressed layers, but the layers of images
+	// pulled by some versions of docker are stored compressed.
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+	var reader io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return ispec.Descriptor{}, "", errors.Wrap(err, "create gzip reader")
+		}
+		defer gzr.Close()
+		reader = gzr
+	case bytes.HasPrefix(magic, zstdMagic):
+		return ispec.Descriptor{}, "", errors.Errorf("zstd-compressed layers are not supported")
+	}
+
+	diffIDDigester := cas.BlobAlgorithm.Digester()
+	hashReader := io.TeeReader(reader, diffIDDigester.Hash())
+
+	pipeReader, pipeWriter := io.Pipe()
+	defer pipeReader.Close()
+
+	gzw := gzip.NewWriter(pipeWriter)
+	defer gzw.Close()
+	go func() {
+		_, err := io.Copy(gzw, hashReader)
+		if err != nil {
+			pipeWriter.CloseWithError(errors.Wrap(err, "compressing layer"))
+			return
+		}
+		gzw.Close()
+		pipeWriter.Close()
+	}()
+
+	layerDigest, layerSize, err := engine.PutBlob(ctx, pipeReader)
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "put layer blob")
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}, diffIDDigester.Digest(), nil
+}
+
+// importedLayer is a layer which has been added to the engine.
+type importedLayer struct {
+	descriptor ispec.Descriptor
+	diffID     digest.Digest
+}
+
+// Import adds the image with the given tag (of the form "name[:tag]") in the
+// docker-archive to the engine, and returns the descriptor of the new image
+// manifest (no references are created). If ref is empty, the archive must
+// only contain one image. The layers are stored gzip-compressed, and the
+// configuration is converted to an OCI image configuration (which drops any
+// docker-specific fields, so the configuration digest will usually differ
+// from the docker image ID).
+//
+// The archive is read twice, so it must be seekable. The manifest.json and
+// configuration of the archive must not be larger than the maximum metadata
+// size of engine (see casext.NewLimitingEngine).
+func Import(ctx context.Context, engine cas.Engine, archive io.ReadSeeker, ref string) (ispec.Descriptor, error) {
+	maxSize := casext.Engine{engine}.MaxMetadataSize()
+	idx, err := readIndex(archive, maxSize)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "read archive index")
+	}
+	entry, err := selectEntry(idx.manifest, ref)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "select image")
+	}
+
+	configPath, err := idx.resolve(entry.Config)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "resolve config path")
+	}
+	layerPaths := map[string]struct{}{}
+	for _, layerPath := range entry.Layers {
+		resolved, err := idx.resolve(layerPath)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "resolve layer path")
+		}
+		layerPaths[resolved] = struct{}{}
+	}
+
+	// Layers can be in any order in the archive, so they are added as they
+	// are found and the manifest is ordered afterwards.
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "rewind archive")
+	}
+	var configData []byte
+	layers := map[string]importedLayer{}
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "read next entry")
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		name := archivePath(hdr.Name)
+		if name == configPath {
+			if err := checkMetadataSize(hdr, maxSize); err != nil {
+				return ispec.Descriptor{}, err
+			}
+			configData, err = ioutil.ReadAll(tr)
+			if err != nil {
+				return ispec.Descriptor{}, errors.Wrap(err, "read config")
+			}
+		}
+		if _, ok := layerPaths[name]; ok {
+			if _, ok := layers[name]; ok {
+				continue
+			}
+			log.Debugf("docker-archive: importing layer %s", name)
+			descriptor, diffID, err := importLayer(ctx, engine, tr)
+			if err != nil {
+				return ispec.Descriptor{}, errors.Wrapf(err, "import layer %s", name)
+			}
+			layers[name] = importedLayer{descriptor: descriptor, diffID: diffID}
+		}
+	}
+	if configData == nil {
+		return ispec.Descriptor{}, errors.Errorf("archive is missing config %s", entry.Config)
+	}
+
+	var config ispec.Image
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "parse config")
+	}
+	if len(config.RootFS.DiffIDs) != len(entry.Layers) {
+		return ispec.Descriptor{}, errors.Errorf("config has %d diff_ids but image has %d layers", len(config.RootFS.DiffIDs), len(entry.Layers))
+	}
+
+	manifest := ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Layers: []ispec.Descriptor{},
+	}
+	for i, layerPath := range entry.Layers {
+		resolved, _ := idx.resolve(layerPath)
+		layer, ok := layers[resolved]
+		if !ok {
+			return ispec.Descriptor{}, errors.Errorf("archive is missing layer %s", layerPath)
+		}
+		if layer.diffID.String() != config.RootFS.DiffIDs[i] {
+			return ispec.Descriptor{}, errors.Errorf("layer %s does not match diff_id: expected %s got %s", layerPath, config.RootFS.DiffIDs[i], layer.diffID)
+		}
+		manifest.Layers = append(manifest.Layers, layer.descriptor)
+	}
+
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, config)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put config blob")
+	}
+	manifest.Config = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put manifest blob")
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}, nil
+}
@@ -0,0 +1,362 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"github.com/vbatts/go-mtree/pkg/govis"
+)
+
+// CheckPaths is like mtree.Check, except that only the given paths (relative
+// to root) are compared against the spec rather than the whole tree, which is
+// much faster for large trees with few changes. If the value of a path is
+// true, everything inside the path is compared as well. The paths must
+// include every path that was changed (as well as the parent directory of
+// every created or removed path), otherwise changes will be missed.
+//
+// Since the other links of a hardlinked file are not necessarily in the given
+// paths, CheckPaths falls back to comparing the whole tree if any of the
+// paths are hardlinked files.
+func CheckPaths(root string, spec *mtree.DirectoryHierarchy, paths map[string]bool, keywords []mtree.Keyword, fsEval mtree.FsEval) ([]mtree.InodeDelta, error) {
+	if fsEval == nil {
+		fsEval = mtree.DefaultFsEval{}
+	}
+
+	// Everything that used to be inside a removed path has been removed as
+	// well, so those paths have to be checked recursively in the spec.
+	oldPaths := map[string]bool{}
+	for path, recursive := range paths {
+		path = filepath.Clean(path)
+		if _, err := fsEval.Lstat(filepath.Join(root, path)); os.IsNotExist(err) {
+			recursive = true
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "lstat %s", path)
+		}
+		oldPaths[path] = oldPaths[path] || recursive
+	}
+	selected := func(path string) bool {
+		if _, ok := oldPaths[path]; ok {
+			return true
+		}
+		for parent := path; parent != "." && parent != "/"; {
+			parent = filepath.Dir(parent)
+			if oldPaths[parent] {
+				return true
+			}
+		}
+		return false
+	}
+
+	oldDh := &mtree.DirectoryHierarchy{}
+	for _, entry := range spec.Entries {
+		if entry.Type != mtree.RelativeType && entry.Type != mtree.FullType {
+			continue
+		}
+		path, err := entry.Path()
+		if err != nil {
+			return nil, errors.Wrap(err, "get spec entry path")
+		}
+		if !selected(path) {
+			continue
+		}
+		if nlink := mtree.HasKeyword(entry.AllKeys(), "nlink"); nlink != "" && nlink.Value() != "1" && !isDirEntry(entry) {
+			event.Default().Infof("check paths: %s is a hardlink, checking the whole tree", path)
+			return mtree.Check(root, spec, keywords, fsEval)
+		}
+		oldDh.Entries = append(oldDh.Entries, entry)
+	}
+
+	var sorted []string
+	for path := range paths {
+		sorted = append(sorted, filepath.Clean(path))
+	}
+	sort.Strings(sorted)
+
+	newDh := &mtree.DirectoryHierarchy{}
+	added := map[string]struct{}{}
+	var addPath func(path string, recursive bool) error
+	addPath = func(path string, recursive bool) error {
+		if _, ok := added[path]; ok && !recursive {
+			return nil
+		}
+		fullPath := filepath.Join(root, path)
+		info, err := fsEval.Lstat(fullPath)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "lstat %s", path)
+		}
+
+		if _, ok := added[path]; !ok {
+			if info.Mode().IsRegular() {
+				nlink, err := getNlink(info)
+				if err != nil {
+					return errors.Wrapf(err, "get nlink %s", path)
+				}
+				if nlink != 1 {
+					return errHardlink{path}
+				}
+			}
+			entry, err := newMtreeEntry(path, fullPath, info, keywords, fsEval)
+			if err != nil {
+				return errors.Wrapf(err, "compute entry %s", path)
+			}
+			entry.Pos = len(newDh.Entries)
+			newDh.Entries = append(newDh.Entries, *entry)
+			added[path] = struct{}{}
+		}
+
+		if !recursive || !info.IsDir() {
+			return nil
+		}
+		children, err := fsEval.Readdir(fullPath)
+		if err != nil {
+			return errors.Wrapf(err, "readdir %s", path)
+		}
+		for _, child := range children {
+			if err := addPath(filepath.Join(path, child.Name()), true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, path := range sorted {
+		if err := addPath(path, paths[path]); err != nil {
+			if hardlink, ok := errors.Cause(err).(errHardlink); ok {
+				event.Default().Infof("check paths: %s is a hardlink, checking the whole tree", hardlink.path)
+				return mtree.Check(root, spec, keywords, fsEval)
+			}
+			return nil, err
+		}
+	}
+
+	return mtree.Compare(oldDh, newDh, keywords)
+}
+
+// errHardlink is returned internally by CheckPaths if a hardlinked file was
+// found.
+type errHardlink struct {
+	path string
+}
+
+func (err errHardlink) Error() string {
+	return "hardlinked file: " + err.path
+}
+
+// isDirEntry returns whether the mtree entry is a directory.
+func isDirEntry(entry mtree.Entry) bool {
+	return mtree.HasKeyword(entry.AllKeys(), "type").Value() == "dir"
+}
+
+// newMtreeEntry computes the mtree entry (with the given keywords) of a single
+// inode, in the same way as mtree.Walk.
+func newMtreeEntry(path, fullPath string, info os.FileInfo, keywords []mtree.Keyword, fsEval mtree.FsEval) (*mtree.Entry, error) {
+	// The entry uses the full (encoded) path, so it can be compared against
+	// the relative entries of a walked spec.
+	var encoded []string
+	for _, component := range strings.Split(path, "/") {
+		name, err := govis.Vis(component, mtree.DefaultVisFlags)
+		if err != nil {
+			return nil, errors.Wrapf(err, "encode %s", strconv.Quote(path))
+		}
+		encoded = append(encoded, name)
+	}
+
+	entry := &mtree.Entry{
+		Name: strings.Join(encoded, "/"),
+		Type: mtree.FullType,
+	}
+	for _, keyword := range keywords {
+		keywordFunc, ok := mtree.KeywordFuncs[keyword]
+		if !ok {
+			return nil, errors.Errorf("unknown keyword %q", keyword)
+		}
+		value, err := func() (mtree.KeyVal, error) {
+			var r io.Reader
+			if info.Mode().IsRegular() {
+				fh, err := fsEval.Open(fullPath)
+				if err != nil {
+					return "", err
+				}
+				defer fh.Close()
+				r = fh
+			}
+			return fsEval.KeywordFunc(keywordFunc)(fullPath, info, r)
+		}()
+		if err != nil {
+			return nil, errors.Wrapf(err, "keyword %s", keyword)
+		}
+		if value != "" {
+			entry.Keywords = append(entry.Keywords, value)
+		}
+	}
+	return entry, nil
+}
+
+// CheckParallel is like mtree.Check, except that the keywords which require
+// reading the contents of files (such as sha256digest, see StatKeywords) are
+// computed by the given number of concurrent workers rather than serially
+// during the walk, which is much faster for large trees. In addition, the
+// contents of files whose size or modification time differ from the spec are
+// never read, as they are known to have been modified. If jobs is not
+// positive, runtime.NumCPU() workers are used.
+func CheckParallel(root string, spec *mtree.DirectoryHierarchy, keywords []mtree.Keyword, fsEval mtree.FsEval, jobs int) ([]mtree.InodeDelta, error) {
+	return CheckParallelTolerant(root, spec, keywords, nil, fsEval, jobs)
+}
+
+// CheckParallelTolerant is like CheckParallel, except that modified inodes
+// whose differences are all tolerated by the given tolerances are not
+// returned (see FilterTolerated). The contents of files whose modification
+// time only differs by a tolerated amount are still read, so that
+// modifications to their contents are not missed.
+func CheckParallelTolerant(root string, spec *mtree.DirectoryHierarchy, keywords []mtree.Keyword, tolerances []KeywordTolerance, fsEval mtree.FsEval, jobs int) ([]mtree.InodeDelta, error) {
+	if fsEval == nil {
+		fsEval = mtree.DefaultFsEval{}
+	}
+	if keywords == nil {
+		keywords = spec.UsedKeywords()
+	}
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	statKeywords := StatKeywords(keywords)
+	var digestKeywords []mtree.Keyword
+	for _, keyword := range keywords {
+		if !mtree.InKeywordSlice(keyword, statKeywords) {
+			digestKeywords = append(digestKeywords, keyword)
+		}
+	}
+	if len(digestKeywords) == 0 {
+		diffs, err := mtree.Check(root, spec, keywords, fsEval)
+		return FilterTolerated(diffs, tolerances), err
+	}
+
+	dh, err := mtree.Walk(root, nil, statKeywords, fsEval)
+	if err != nil {
+		return nil, errors.Wrap(err, "walk rootfs")
+	}
+
+	specEntries := map[string]mtree.Entry{}
+	for _, entry := range spec.Entries {
+		if entry.Type != mtree.RelativeType && entry.Type != mtree.FullType {
+			continue
+		}
+		path, err := entry.Path()
+		if err != nil {
+			return nil, errors.Wrap(err, "get spec entry path")
+		}
+		specEntries[path] = entry
+	}
+
+	// Only files which still match the spec need to be read. Files which are
+	// not in the spec have been added, and so are not compared at all.
+	type digestJob struct {
+		idx  int
+		path string
+		keys []mtree.KeyVal
+		err  error
+	}
+	var pending []*digestJob
+	for idx, entry := range dh.Entries {
+		if entry.Type != mtree.RelativeType && entry.Type != mtree.FullType {
+			continue
+		}
+		path, err := entry.Path()
+		if err != nil {
+			return nil, errors.Wrap(err, "get entry path")
+		}
+		specEntry, ok := specEntries[path]
+		if !ok || isDirEntry(entry) || !sameSizeAndTime(specEntry, entry, tolerances) {
+			continue
+		}
+		pending = append(pending, &digestJob{idx: idx, path: path})
+	}
+
+	var wg sync.WaitGroup
+	queue := make(chan *digestJob)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				fullPath := filepath.Join(root, job.path)
+				info, err := fsEval.Lstat(fullPath)
+				if err != nil {
+					job.err = errors.Wrapf(err, "lstat %s", job.path)
+					continue
+				}
+				if !info.Mode().IsRegular() {
+					continue
+				}
+				entry, err := newMtreeEntry(job.path, fullPath, info, digestKeywords, fsEval)
+				if err != nil {
+					job.err = errors.Wrapf(err, "compute digest %s", job.path)
+					continue
+				}
+				job.keys = entry.Keywords
+			}
+		}()
+	}
+	for _, job := range pending {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	for _, job := range pending {
+		if job.err != nil {
+			return nil, job.err
+		}
+		dh.Entries[job.idx].Keywords = append(dh.Entries[job.idx].Keywords, job.keys...)
+	}
+	// Keywords which are missing from the new entries are ignored by
+	// mtree.Compare, so files which weren't read are only reported as
+	// modified because of their size or modification time.
+	diffs, err := mtree.Compare(spec, dh, keywords)
+	return FilterTolerated(diffs, tolerances), err
+}
+
+// sameSizeAndTime returns whether the size and modification time of two
+// mtree entries (if they have them) are the same, or only differ by the given
+// tolerances.
+func sameSizeAndTime(oldEntry, newEntry mtree.Entry, tolerances []KeywordTolerance) bool {
+	oldKeys, newKeys := oldEntry.AllKeys(), newEntry.AllKeys()
+	for _, keyword := range []mtree.Keyword{"size", "tar_time", "time"} {
+		oldValue, newValue := mtree.HasKeyword(oldKeys, keyword), mtree.HasKeyword(newKeys, keyword)
+		if oldValue == "" || newValue == "" || oldValue == newValue {
+			continue
+		}
+		oldRaw, newRaw := oldValue.Value(), newValue.Value()
+		if !tolerated(tolerances, keyword, &oldRaw, &newRaw) {
+			return false
+		}
+	}
+	return true
+}
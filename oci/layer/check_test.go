@@ -0,0 +1,212 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/vbatts/go-mtree"
+)
+
+// deltaStrings returns a sorted list describing the given deltas.
+func deltaStrings(deltas []mtree.InodeDelta) []string {
+	var strs []string
+	for _, delta := range deltas {
+		strs = append(strs, string(delta.Type())+" "+delta.Path())
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+func TestCheckPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestCheckPaths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, path := range []string{"some dir/unchanged", "some dir/changed", "removed/inner"} {
+		if err := os.MkdirAll(filepath.Join(dir, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, path, "file"), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keywords := []mtree.Keyword{"size", "type", "uid", "gid", "mode", "link", "nlink", "sha256digest"}
+	spec, err := mtree.Walk(dir, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "some dir", "changed", "file"), []byte("new contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "some dir", "changed"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "removed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "new", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "new", "dir", "file"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := mtree.Check(dir, spec, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the recorded paths are checked (but everything inside removed
+	// paths is noticed as well).
+	deltas, err := CheckPaths(dir, spec, map[string]bool{
+		".":                     false,
+		"some dir/changed":      false,
+		"some dir/changed/file": false,
+		"removed":               false,
+		"new":                   true,
+	}, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(deltaStrings(deltas), deltaStrings(expected)) {
+		t.Errorf("unexpected deltas: expected %v, got %v", deltaStrings(expected), deltaStrings(deltas))
+	}
+
+	// Changes to paths that weren't recorded are not noticed.
+	deltas, err = CheckPaths(dir, spec, map[string]bool{
+		"some dir/changed/file": false,
+	}, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := deltaStrings(deltas); !reflect.DeepEqual(got, []string{"modified some dir/changed/file"}) {
+		t.Errorf("unexpected deltas: %v", got)
+	}
+}
+
+func TestCheckPathsHardlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestCheckPathsHardlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	keywords := []mtree.Keyword{"size", "type", "nlink", "sha256digest"}
+	spec, err := mtree.Walk(dir, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("new contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes to the other links of a hardlinked file are still noticed.
+	deltas, err := CheckPaths(dir, spec, map[string]bool{"a": false}, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := deltaStrings(deltas); !reflect.DeepEqual(got, []string{"modified a", "modified b"}) {
+		t.Errorf("unexpected deltas: %v", got)
+	}
+}
+
+func TestCheckParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestCheckParallel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 64; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("dir%d", i%4), fmt.Sprintf("file%d", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("file0", filepath.Join(dir, "dir0", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	keywords := []mtree.Keyword{"size", "type", "uid", "gid", "mode", "link", "nlink", "tar_time", "sha256digest"}
+	spec, err := mtree.Walk(dir, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Modify the contents of a file without changing its size or mtime.
+	sameSize := filepath.Join(dir, "dir1", "file1")
+	fi, err := os.Stat(sameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(sameSize, []byte(strings.ToUpper(sameSize)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(sameSize, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "dir2", "file2"), []byte("resized"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "dir3", "file3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "dir3", "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := mtree.Check(dir, spec, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) == 0 {
+		t.Fatalf("expected mtree.Check to find changes")
+	}
+	for _, jobs := range []int{0, 1, 8} {
+		deltas, err := CheckParallel(dir, spec, keywords, nil, jobs)
+		if err != nil {
+			t.Fatalf("unexpected error checking with %d jobs: %+v", jobs, err)
+		}
+		if !reflect.DeepEqual(deltaStrings(deltas), deltaStrings(expected)) {
+			t.Errorf("unexpected deltas with %d jobs: expected %v, got %v", jobs, deltaStrings(expected), deltaStrings(deltas))
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// UnpackCheckpointName is the name of the file inside a bundle which records
+// the progress of UnpackManifestWithOptions, so that an interrupted unpack can
+// be resumed (see UnpackOptions.Resume). It is removed once the bundle has
+// been completely unpacked.
+const UnpackCheckpointName = "umoci-unpack.json"
+
+// UnpackCheckpoint describes the progress of an unpack. It is written to
+// <bundle>/<layer.UnpackCheckpointName> before the first layer is extracted,
+// and is updated as each layer is completely extracted.
+type UnpackCheckpoint struct {
+	// Config is the digest of the configuration of the image being unpacked.
+	// Since the configuration contains the DiffIDs of the layers, it
+	// identifies the contents of the bundle.
+	Config digest.Digest `json:"config"`
+
+	// Overlay and PathFilters are the UnpackOptions which affect what has
+	// been extracted. An unpack can only be resumed with the same options.
+	Overlay     bool     `json:"overlay,omitempty"`
+	PathFilters []string `json:"path_filters,omitempty"`
+
+	// Layers is the number of layers of the image which have been completely
+	// extracted.
+	Layers int `json:"layers"`
+
+	// LowerDirs are the layer directories extracted so far, as in
+	// OverlayMeta. It is only used for overlay unpacks.
+	LowerDirs []string `json:"lower_dirs,omitempty"`
+
+	// DroppedXattrs are the xattrs dropped while extracting the completed
+	// layers (see UnpackOptions.DroppedXattrs).
+	DroppedXattrs DroppedXattrs `json:"dropped_xattrs,omitempty"`
+}
+
+// matches returns an error if the checkpoint was not written by an unpack of
+// the same image with the same options.
+func (c UnpackCheckpoint) matches(config digest.Digest, opt UnpackOptions) error {
+	if c.Config != config {
+		return errors.Errorf("bundle is an unpack of image with config %s rather than %s", c.Config, config)
+	}
+	if c.Overlay != opt.Overlay {
+		if c.Overlay {
+			return errors.Errorf("bundle was unpacked as an overlay")
+		}
+		return errors.Errorf("bundle was not unpacked as an overlay")
+	}
+	if len(c.PathFilters) != 0 || len(opt.PathFilters) != 0 {
+		if len(c.PathFilters) == 0 {
+			return errors.Errorf("bundle was unpacked without path filters")
+		}
+		if !reflect.DeepEqual(c.PathFilters, opt.PathFilters) {
+			return errors.Errorf("bundle was unpacked with path filters %v", c.PathFilters)
+		}
+	}
+	return nil
+}
+
+// ReadUnpackCheckpoint returns the checkpoint of the interrupted unpack of
+// the given bundle. If the bundle has no checkpoint (because it has not been
+// unpacked, or has been completely unpacked) an error satisfying
+// os.IsNotExist is returned.
+func ReadUnpackCheckpoint(bundle string) (UnpackCheckpoint, error) {
+	var checkpoint UnpackCheckpoint
+
+	fh, err := os.Open(filepath.Join(bundle, UnpackCheckpointName))
+	if err != nil {
+		return checkpoint, err
+	}
+	defer fh.Close()
+
+	err = json.NewDecoder(fh).Decode(&checkpoint)
+	return checkpoint, errors.Wrap(err, "decode checkpoint")
+}
+
+// writeUnpackCheckpoint atomically replaces the checkpoint of the bundle.
+func writeUnpackCheckpoint(bundle string, checkpoint UnpackCheckpoint) error {
+	fh, err := ioutil.TempFile(bundle, "."+UnpackCheckpointName)
+	if err != nil {
+		return errors.Wrap(err, "create temporary checkpoint")
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if err := json.NewEncoder(fh).Encode(checkpoint); err != nil {
+		return errors.Wrap(err, "encode checkpoint")
+	}
+	if err := fh.Sync(); err != nil {
+		return errors.Wrap(err, "sync checkpoint")
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close checkpoint")
+	}
+	return errors.Wrap(os.Rename(fh.Name(), filepath.Join(bundle, UnpackCheckpointName)), "rename checkpoint")
+}
@@ -0,0 +1,164 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestUnpackManifestResume(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackManifestResume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reg := func(name, data string) testEntry {
+		return testEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeReg}, data: data}
+	}
+
+	var layers []ispec.Descriptor
+	var diffIDs []string
+	for _, entries := range [][]testEntry{
+		{reg("a", "base"), reg("b", "base")},
+		{reg("b", "middle"), reg("c", "middle")},
+		{reg("c", "top"), reg(".wh.a", "")},
+	} {
+		layer := putUncompressedLayer(t, engine, entries)
+		layers = append(layers, layer)
+		diffIDs = append(diffIDs, layer.Digest.String())
+	}
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layers,
+	}
+
+	// Interrupt the unpack by making the last layer unavailable.
+	top := layers[2]
+	topReader, err := engine.GetBlob(ctx, top.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topData, err := ioutil.ReadAll(topReader)
+	topReader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.DeleteBlob(ctx, top.Digest); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := filepath.Join(dir, "bundle")
+	opt := UnpackOptions{
+		MapOptions: MapOptions{Rootless: os.Geteuid() != 0},
+	}
+	if err := UnpackManifestWithOptions(ctx, engine, bundle, manifest, opt); err == nil {
+		t.Fatalf("expected unpack with missing layer to fail")
+	}
+
+	checkpoint, err := ReadUnpackCheckpoint(bundle)
+	if err != nil {
+		t.Fatalf("unexpected error reading checkpoint: %+v", err)
+	}
+	if checkpoint.Layers != 2 {
+		t.Errorf("expected checkpoint after 2 layers, got %d", checkpoint.Layers)
+	}
+	if checkpoint.Config != configDigest {
+		t.Errorf("unexpected checkpoint config: %s", checkpoint.Config)
+	}
+
+	// The partial bundle cannot be unpacked over without resuming.
+	if _, _, err := engine.PutBlob(ctx, bytes.NewReader(topData)); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackManifestWithOptions(ctx, engine, bundle, manifest, opt); err == nil {
+		t.Errorf("expected unpack over partial bundle to fail without resume")
+	}
+
+	// Nor can it be resumed with different options.
+	badOpt := opt
+	badOpt.Resume = true
+	badOpt.PathFilters = []string{"/a"}
+	if err := UnpackManifestWithOptions(ctx, engine, bundle, manifest, badOpt); err == nil {
+		t.Errorf("expected resume with different path filters to fail")
+	}
+
+	// Make sure the completed layers are not extracted again.
+	if err := os.Remove(filepath.Join(bundle, RootfsName, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	opt.Resume = true
+	if err := UnpackManifestWithOptions(ctx, engine, bundle, manifest, opt); err != nil {
+		t.Fatalf("unexpected error resuming unpack: %+v", err)
+	}
+
+	rootfs := filepath.Join(bundle, RootfsName)
+	if _, err := os.Lstat(filepath.Join(rootfs, "a")); !os.IsNotExist(err) {
+		t.Errorf("expected a to have been removed by the top layer: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(rootfs, "b")); !os.IsNotExist(err) {
+		t.Errorf("expected b to not have been extracted again: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(rootfs, "c")); err != nil || string(data) != "top" {
+		t.Errorf("unexpected contents of c: %q (%v)", data, err)
+	}
+	if _, err := os.Lstat(filepath.Join(bundle, "config.json")); err != nil {
+		t.Errorf("expected config.json to have been generated: %v", err)
+	}
+	if _, err := ReadUnpackCheckpoint(bundle); !os.IsNotExist(err) {
+		t.Errorf("expected checkpoint to be removed after completion: %v", err)
+	}
+
+	// Resuming a bundle without a checkpoint is a normal unpack.
+	fresh := filepath.Join(dir, "fresh")
+	if err := UnpackManifestWithOptions(ctx, engine, fresh, manifest, opt); err != nil {
+		t.Fatalf("unexpected error unpacking with resume: %+v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(fresh, RootfsName, "b")); err != nil || string(data) != "middle" {
+		t.Errorf("unexpected contents of b: %q (%v)", data, err)
+	}
+}
@@ -0,0 +1,230 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// compressBlockSize is the size of the blocks compressed independently by
+// the parallel gzip writer.
+const compressBlockSize = 1024 * 1024
+
+// compressDictSize is the size of the dictionary (the end of the previous
+// block) used to compress each block, which is the deflate window size.
+const compressDictSize = 32 * 1024
+
+// NewGzipWriter returns a writer which writes the gzip-compressed data
+// written to it to w, using the given compression level (as defined by
+// compress/gzip). If jobs is greater than one, the data is split into blocks
+// which are compressed concurrently by up to jobs goroutines (in the same
+// manner as pigz(1)). Otherwise, the output is identical to gzip.Writer.
+//
+// The output of the parallel writer is a single gzip member which is
+// readable by any gzip implementation, and only depends on the data and
+// compression level (not on the number of jobs). However, it differs from the
+// output of gzip.Writer, so switching between the two changes the digests of
+// generated layers.
+func NewGzipWriter(w io.Writer, level, jobs int) (io.WriteCloser, error) {
+	if jobs <= 1 {
+		return gzip.NewWriterLevel(w, level)
+	}
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, errors.Errorf("gzip: invalid compression level: %d", level)
+	}
+
+	pw := &parallelGzipWriter{
+		w:      w,
+		level:  level,
+		buffer: make([]byte, 0, compressBlockSize),
+		queue:  make(chan chan compressedBlock, jobs),
+		done:   make(chan struct{}),
+	}
+	go pw.output()
+
+	// The header matches the one written by gzip.Writer.
+	var xfl byte
+	switch level {
+	case gzip.BestCompression:
+		xfl = 2
+	case gzip.BestSpeed:
+		xfl = 4
+	}
+	pw.queue <- pw.result(compressedBlock{
+		data: []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, xfl, 255},
+	})
+	return pw, nil
+}
+
+// compressedBlock is a block of compressed output.
+type compressedBlock struct {
+	data []byte
+	err  error
+}
+
+// parallelGzipWriter is a gzip writer which compresses blocks concurrently.
+// Each block is compressed as a separate (non-final) deflate block using the
+// end of the previous block as a dictionary, and the compressed blocks are
+// written in order by the output goroutine.
+type parallelGzipWriter struct {
+	w     io.Writer
+	level int
+
+	// buffer is the current (uncompressed) block, and dict is the end of the
+	// previous block.
+	buffer []byte
+	dict   []byte
+
+	// crc and size are the checksum and size (modulo 2^32) of the
+	// uncompressed data, for the gzip trailer.
+	crc  uint32
+	size uint32
+
+	// queue contains the pending blocks, in order. Its capacity limits the
+	// number of blocks being compressed concurrently.
+	queue chan chan compressedBlock
+	done  chan struct{}
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+// result returns an already-completed pending block.
+func (pw *parallelGzipWriter) result(block compressedBlock) chan compressedBlock {
+	result := make(chan compressedBlock, 1)
+	result <- block
+	return result
+}
+
+// output writes the pending blocks to the underlying writer, in order. After
+// an error, the remaining blocks are discarded.
+func (pw *parallelGzipWriter) output() {
+	defer close(pw.done)
+	for result := range pw.queue {
+		block := <-result
+		if pw.error() != nil {
+			continue
+		}
+		err := block.err
+		if err == nil {
+			_, err = pw.w.Write(block.data)
+		}
+		if err != nil {
+			pw.mu.Lock()
+			pw.err = err
+			pw.mu.Unlock()
+		}
+	}
+}
+
+func (pw *parallelGzipWriter) error() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.err
+}
+
+// compress queues the current block to be compressed.
+func (pw *parallelGzipWriter) compress(last bool) {
+	data, dict := pw.buffer, pw.dict
+	if len(data) >= compressDictSize {
+		pw.dict = data[len(data)-compressDictSize:]
+	} else {
+		pw.dict = append(append([]byte(nil), dict...), data...)
+		if len(pw.dict) > compressDictSize {
+			pw.dict = pw.dict[len(pw.dict)-compressDictSize:]
+		}
+	}
+	pw.buffer = make([]byte, 0, compressBlockSize)
+
+	result := make(chan compressedBlock, 1)
+	pw.queue <- result
+	go func() {
+		var buffer bytes.Buffer
+		fw, err := flate.NewWriterDict(&buffer, pw.level, dict)
+		if err == nil {
+			_, err = fw.Write(data)
+		}
+		if err == nil {
+			// Only the last block is a final deflate block, the others end
+			// with a sync flush so that the blocks can be concatenated.
+			if last {
+				err = fw.Close()
+			} else {
+				err = fw.Flush()
+			}
+		}
+		result <- compressedBlock{data: buffer.Bytes(), err: errors.Wrap(err, "compress block")}
+	}()
+}
+
+// Write compresses the given data.
+func (pw *parallelGzipWriter) Write(p []byte) (int, error) {
+	if pw.closed {
+		return 0, errors.Errorf("gzip: write to closed writer")
+	}
+	if err := pw.error(); err != nil {
+		return 0, err
+	}
+
+	pw.crc = crc32.Update(pw.crc, crc32.IEEETable, p)
+	pw.size += uint32(len(p))
+
+	n := 0
+	for len(p) > 0 {
+		if len(pw.buffer) == compressBlockSize {
+			pw.compress(false)
+		}
+		chunk := compressBlockSize - len(pw.buffer)
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		pw.buffer = append(pw.buffer, p[:chunk]...)
+		p = p[chunk:]
+		n += chunk
+	}
+	return n, nil
+}
+
+// Close compresses the remaining data and writes the gzip trailer, waiting
+// for all of the blocks to be written. It does not close the underlying
+// writer.
+func (pw *parallelGzipWriter) Close() error {
+	if pw.closed {
+		return pw.error()
+	}
+	pw.closed = true
+
+	pw.compress(true)
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(trailer[0:4], pw.crc)
+	binary.LittleEndian.PutUint32(trailer[4:8], pw.size)
+	pw.queue <- pw.result(compressedBlock{data: trailer})
+
+	close(pw.queue)
+	<-pw.done
+	return pw.error()
+}
@@ -0,0 +1,99 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func compressTestData(t *testing.T, data []byte, level, jobs int) []byte {
+	var buffer bytes.Buffer
+	gzw, err := NewGzipWriter(&buffer, level, jobs)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %+v", err)
+	}
+	// Write in uneven chunks to exercise the block boundaries.
+	for len(data) > 0 {
+		n := 12345
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := gzw.Write(data[:n]); err != nil {
+			t.Fatalf("unexpected error writing: %+v", err)
+		}
+		data = data[n:]
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatalf("unexpected error closing writer: %+v", err)
+	}
+	return buffer.Bytes()
+}
+
+func TestNewGzipWriter(t *testing.T) {
+	// Partially compressible data spanning several blocks.
+	data := make([]byte, 3*compressBlockSize+compressDictSize/2)
+	rand.New(rand.NewSource(1)).Read(data[:len(data)/2])
+
+	for _, test := range []struct {
+		data  []byte
+		level int
+	}{
+		{data, gzip.DefaultCompression},
+		{data, gzip.BestSpeed},
+		{data, gzip.BestCompression},
+		{data, gzip.NoCompression},
+		{data[:100], gzip.DefaultCompression},
+		{nil, gzip.DefaultCompression},
+	} {
+		var parallel []byte
+		for _, jobs := range []int{1, 2, 8} {
+			compressed := compressTestData(t, test.data, test.level, jobs)
+
+			gzr, err := gzip.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatalf("level=%d jobs=%d: unexpected error reading header: %+v", test.level, jobs, err)
+			}
+			got, err := ioutil.ReadAll(gzr)
+			if err != nil {
+				t.Fatalf("level=%d jobs=%d: unexpected error decompressing: %+v", test.level, jobs, err)
+			}
+			if !bytes.Equal(got, test.data) {
+				t.Errorf("level=%d jobs=%d: decompressed data doesn't match", test.level, jobs)
+			}
+
+			// The parallel output must not depend on the number of jobs.
+			if jobs > 1 {
+				if parallel != nil && !bytes.Equal(parallel, compressed) {
+					t.Errorf("level=%d jobs=%d: output depends on the number of jobs", test.level, jobs)
+				}
+				parallel = compressed
+			}
+		}
+	}
+
+	// Invalid levels are rejected.
+	for _, jobs := range []int{1, 4} {
+		if _, err := NewGzipWriter(ioutil.Discard, 42, jobs); err == nil {
+			t.Errorf("jobs=%d: expected error for invalid level", jobs)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// cpioEntry is an entry in the flattened root filesystem of an image, as
+// computed by flattenManifest.
+type cpioEntry struct {
+	// layer and index identify the tar entry (the index-th entry of the
+	// layer-th layer) this entry comes from. They are -1 for directories
+	// that had to be created because no layer contained them.
+	layer, index int
+
+	// hdr is the header of the tar entry, with the name cleaned.
+	hdr tar.Header
+}
+
+// UnpackManifestCpio writes the root filesystem of the given image manifest to
+// w as a "newc" cpio archive (the format used for Linux initramfs images),
+// without extracting the image. The layers are applied in order (including
+// whiteouts), so the archive has the same contents as the rootfs produced by
+// UnpackManifest. The ownership of the files is the ownership inside the
+// image, and no mappings are applied.
+//
+// The layers are read twice: once to compute the contents of the flattened
+// root filesystem, and once to write the contents of its regular files. All
+// other entries (including any missing parent directories) are written first,
+// so that every parent directory precedes its children in the archive.
+func UnpackManifestCpio(ctx context.Context, engine cas.Engine, w io.Writer, manifest ispec.Manifest) error {
+	engineExt := casext.Engine{engine}
+
+	entries, links, err := flattenManifest(ctx, engineExt, manifest)
+	if err != nil {
+		return errors.Wrap(err, "unpack manifest cpio")
+	}
+
+	cw := newCpioWriter(w)
+
+	// Write everything that has no contents, with parents before children.
+	var paths []string
+	for path, entry := range entries {
+		if !isRegular(entry.hdr.Typeflag) && entry.hdr.Typeflag != tar.TypeLink {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := cw.writeHeader(&entries[path].hdr, cw.nextIno(), 1); err != nil {
+			return errors.Wrapf(err, "unpack manifest cpio: write %s", path)
+		}
+	}
+
+	// Write the regular files (and their hardlinks).
+	for idx, layerDescriptor := range manifest.Layers {
+		event.Log(ctx).Infof("unpack layer: %s", layerDescriptor.Digest)
+		if err := writeCpioLayer(ctx, engineExt, idx, layerDescriptor, entries, links, cw); err != nil {
+			return errors.Wrapf(err, "unpack manifest cpio: layer %s", layerDescriptor.Digest)
+		}
+	}
+	return errors.Wrap(cw.close(), "unpack manifest cpio: write trailer")
+}
+
+// flattenManifest computes the flattened root filesystem of the given image
+// manifest, by applying the entries (including whiteouts) of each layer in
+// order, and verifies the DiffIDs of the layers. Any parent directories
+// missing from the layers are added. It returns the entries of the root
+// filesystem (keyed by their cleaned path) and the hardlinks in it, grouped by
+// their target.
+func flattenManifest(ctx context.Context, engineExt casext.Engine, manifest ispec.Manifest) (map[string]*cpioEntry, map[string][]string, error) {
+	ctx, err := casext.WithManifestLayerChunks(ctx, manifest)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "get chunked layers")
+	}
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "get config blob")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return nil, nil, errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
+	}
+	if len(manifest.Layers) != len(config.RootFS.DiffIDs) {
+		return nil, nil, errors.Errorf("manifest has %d layers but config has %d diff_ids", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	// Compute the flattened root filesystem.
+	entries := map[string]*cpioEntry{}
+	for idx, layerDescriptor := range manifest.Layers {
+		event.Log(ctx).Debugf("flatten manifest: scanning layer %s", layerDescriptor.Digest)
+		if err := scanCpioLayer(ctx, engineExt, idx, layerDescriptor, config.RootFS.DiffIDs[idx], entries); err != nil {
+			return nil, nil, errors.Wrapf(err, "layer %s", layerDescriptor.Digest)
+		}
+	}
+
+	// Add any parent directories missing from the layers.
+	for path := range entries {
+		for dir := filepath.Dir(path); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+			if _, ok := entries[dir]; ok {
+				break
+			}
+			entries[dir] = &cpioEntry{
+				layer: -1,
+				index: -1,
+				hdr: tar.Header{
+					Name:     dir,
+					Typeflag: tar.TypeDir,
+					Mode:     0755,
+					ModTime:  config.Created,
+				},
+			}
+		}
+	}
+
+	// Hardlinks are grouped by their target, and written along with it.
+	links := map[string][]string{}
+	for path, entry := range entries {
+		if entry.hdr.Typeflag != tar.TypeLink {
+			continue
+		}
+		target := entry.hdr.Linkname
+		if targetEntry, ok := entries[target]; !ok || !isRegular(targetEntry.hdr.Typeflag) {
+			event.Log(ctx).Warnf("flatten manifest: skipping hardlink %s: target %s is not a regular file", path, target)
+			continue
+		}
+		links[target] = append(links[target], path)
+	}
+	return entries, links, nil
+}
+
+// isRegular returns whether the given tar.Header.Typeflag is a regular file.
+func isRegular(typeflag byte) bool {
+	return typeflag == tar.TypeReg || typeflag == tar.TypeRegA
+}
+
+// cpioPath returns the cleaned path (relative to the root) of a layer entry.
+func cpioPath(name string) string {
+	path := strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	if path == "" {
+		path = "."
+	}
+	return path
+}
+
+// removeEntries removes every entry under the given directory from entries,
+// as well as the path itself if self is true.
+func removeEntries(entries map[string]*cpioEntry, path string, self bool) {
+	if self {
+		delete(entries, path)
+	}
+	prefix := path + "/"
+	if path == "." {
+		prefix = ""
+	}
+	for name := range entries {
+		if name != "." && strings.HasPrefix(name, prefix) {
+			delete(entries, name)
+		}
+	}
+}
+
+// scanCpioLayer applies the entries of the given layer to entries, and
+// verifies the DiffID of the layer.
+func scanCpioLayer(ctx context.Context, engine casext.Engine, layerIdx int, layerDescriptor ispec.Descriptor, diffID string, entries map[string]*cpioEntry) error {
+	layer, err := OpenLayer(ctx, engine, layerDescriptor)
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+
+	layerHash := sha256.New()
+	tr := newEntryReader(io.TeeReader(layer, layerHash))
+
+	// Whiteouts only apply to the lower layers, so the entries in this layer
+	// are only merged once the whole layer has been read.
+	upper := map[string]*cpioEntry{}
+	for idx := 0; ; idx++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+
+		path := cpioPath(hdr.Name)
+		dir, file := filepath.Split(path)
+		dir = strings.TrimSuffix(dir, "/")
+		if dir == "" {
+			dir = "."
+		}
+
+		// Whiteouts remove entries from the lower layers.
+		if file == whOpaque {
+			removeEntries(entries, dir, false)
+			continue
+		}
+		if strings.HasPrefix(file, whPrefix) {
+			removeEntries(entries, filepath.Join(dir, strings.TrimPrefix(file, whPrefix)), true)
+			continue
+		}
+
+		// A directory replaces only the directory itself, anything else
+		// replaces the whole tree (as with UnpackManifest).
+		self := hdr.Typeflag == tar.TypeDir
+		for _, m := range []map[string]*cpioEntry{entries, upper} {
+			if self {
+				delete(m, path)
+			} else {
+				removeEntries(m, path, true)
+			}
+		}
+
+		if hdr.Uid < 0 || int64(hdr.Uid) > maxID || hdr.Gid < 0 || int64(hdr.Gid) > maxID {
+			return errors.Errorf("%s: owner %d:%d is out of range", path, hdr.Uid, hdr.Gid)
+		}
+		entry := &cpioEntry{layer: layerIdx, index: idx, hdr: *hdr}
+		entry.hdr.Name = path
+		if hdr.Typeflag == tar.TypeLink {
+			entry.hdr.Linkname = cpioPath(hdr.Linkname)
+		}
+		upper[path] = entry
+	}
+
+	// Make sure the whole layer was hashed.
+	if _, err := io.Copy(layerHash, layer); err != nil {
+		return errors.Wrap(err, "read layer")
+	}
+	layerDigest := fmt.Sprintf("%s:%x", cas.BlobAlgorithm, layerHash.Sum(nil))
+	if layerDigest != diffID {
+		return errors.Wrap(&cas.DigestMismatchError{Expected: digest.Digest(diffID), Actual: digest.Digest(layerDigest)}, "diffid")
+	}
+
+	for path, entry := range upper {
+		entries[path] = entry
+	}
+	return nil
+}
+
+// writeCpioLayer writes the regular files in the given layer which are part
+// of the flattened root filesystem (along with their hardlinks).
+func writeCpioLayer(ctx context.Context, engine casext.Engine, layerIdx int, layerDescriptor ispec.Descriptor, entries map[string]*cpioEntry, links map[string][]string, cw *cpioWriter) error {
+	layer, err := OpenLayer(ctx, engine, layerDescriptor)
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+
+	tr := newEntryReader(layer)
+	for idx := 0; ; idx++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+		if !isRegular(hdr.Typeflag) {
+			continue
+		}
+
+		path := cpioPath(hdr.Name)
+		entry, ok := entries[path]
+		if !ok || entry.layer != layerIdx || entry.index != idx {
+			continue
+		}
+
+		// Hardlinks share the inode of their target, and (by convention)
+		// the contents are stored with the last link.
+		ino, nlink := cw.nextIno(), 1+len(links[path])
+		for _, link := range links[path] {
+			linkHdr := entry.hdr
+			linkHdr.Name = link
+			linkHdr.Size = 0
+			if err := cw.writeHeader(&linkHdr, ino, nlink); err != nil {
+				return errors.Wrapf(err, "write %s", link)
+			}
+		}
+		if err := cw.writeHeader(&entry.hdr, ino, nlink); err != nil {
+			return errors.Wrapf(err, "write %s", path)
+		}
+		if err := cw.writeData(tr, entry.hdr.Size); err != nil {
+			return errors.Wrapf(err, "write %s", path)
+		}
+	}
+	return nil
+}
+
+// cpioWriter writes a "newc" cpio archive.
+type cpioWriter struct {
+	w       io.Writer
+	lastIno int64
+}
+
+func newCpioWriter(w io.Writer) *cpioWriter {
+	return &cpioWriter{w: w}
+}
+
+// nextIno returns a new inode number.
+func (cw *cpioWriter) nextIno() int64 {
+	cw.lastIno++
+	return cw.lastIno
+}
+
+// cpioMode returns the st_mode of the given header.
+func cpioMode(hdr *tar.Header) (int64, error) {
+	mode := hdr.Mode & 07777
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		mode |= 0100000
+	case tar.TypeDir:
+		mode |= 040000
+	case tar.TypeSymlink:
+		mode |= 0120000
+	case tar.TypeChar:
+		mode |= 020000
+	case tar.TypeBlock:
+		mode |= 060000
+	case tar.TypeFifo:
+		mode |= 010000
+	default:
+		return 0, errors.Errorf("unsupported entry type %q", hdr.Typeflag)
+	}
+	return mode, nil
+}
+
+// pad writes the padding needed to align the end of a record of the given
+// size to 4 bytes.
+func (cw *cpioWriter) pad(size int64) error {
+	if rem := size % 4; rem != 0 {
+		_, err := cw.w.Write(make([]byte, 4-rem))
+		return err
+	}
+	return nil
+}
+
+// writeRecord writes a single cpio header (and name). The fields are in the
+// order of the "newc" header.
+func (cw *cpioWriter) writeRecord(name string, ino, mode, uid, gid, nlink, mtime, size, devMajor, devMinor int64) error {
+	header := fmt.Sprintf("070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+		ino, mode, uid, gid, nlink, mtime, size, 0, 0, devMajor, devMinor, len(name)+1, 0)
+	if _, err := io.WriteString(cw.w, header+name+"\x00"); err != nil {
+		return err
+	}
+	return cw.pad(int64(len(header) + len(name) + 1))
+}
+
+// writeHeader writes the header of the entry described by hdr, with the given
+// inode number and link count. For regular files, the contents must be
+// written with writeData. For symlinks, the target is written as the contents
+// of the entry.
+func (cw *cpioWriter) writeHeader(hdr *tar.Header, ino int64, nlink int) error {
+	mode, err := cpioMode(hdr)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	size := hdr.Size
+	switch {
+	case hdr.Typeflag == tar.TypeSymlink:
+		data = []byte(hdr.Linkname)
+		size = int64(len(data))
+	case hdr.Typeflag == tar.TypeDir:
+		nlink = 2
+		size = 0
+	case !isRegular(hdr.Typeflag):
+		size = 0
+	}
+
+	mtime := hdr.ModTime.Unix()
+	if mtime < 0 {
+		mtime = 0
+	}
+	if err := cw.writeRecord(hdr.Name, ino, mode, int64(hdr.Uid), int64(hdr.Gid), int64(nlink), mtime, size, hdr.Devmajor, hdr.Devminor); err != nil {
+		return err
+	}
+	if data != nil {
+		if _, err := cw.w.Write(data); err != nil {
+			return err
+		}
+		return cw.pad(int64(len(data)))
+	}
+	return nil
+}
+
+// writeData writes the contents of a regular file.
+func (cw *cpioWriter) writeData(r io.Reader, size int64) error {
+	n, err := io.CopyN(cw.w, r, size)
+	if err != nil {
+		return errors.Wrapf(err, "copy contents (%d of %d bytes)", n, size)
+	}
+	return cw.pad(size)
+}
+
+// close writes the trailer of the archive.
+func (cw *cpioWriter) close() error {
+	return cw.writeRecord("TRAILER!!!", 0, 0, 0, 0, 1, 0, 0, 0, 0)
+}
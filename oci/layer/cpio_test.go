@@ -0,0 +1,185 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// cpioTestEntry is an entry read from a "newc" cpio archive.
+type cpioTestEntry struct {
+	name                     string
+	ino, mode, uid, gid, nlk int64
+	data                     string
+}
+
+// readCpio parses a "newc" cpio archive, returning its entries (excluding the
+// trailer).
+func readCpio(t *testing.T, archive []byte) []cpioTestEntry {
+	var entries []cpioTestEntry
+	align := func(n int) int { return (n + 3) &^ 3 }
+	for off := 0; ; {
+		if len(archive)-off < 110 || string(archive[off:off+6]) != "070701" {
+			t.Fatalf("invalid cpio header at offset %d", off)
+		}
+		field := func(idx int) int64 {
+			start := off + 6 + idx*8
+			value, err := strconv.ParseInt(string(archive[start:start+8]), 16, 64)
+			if err != nil {
+				t.Fatalf("invalid cpio header field %d at offset %d: %v", idx, off, err)
+			}
+			return value
+		}
+		nameSize := int(field(11))
+		name := string(archive[off+110 : off+110+nameSize-1])
+		dataStart := align(off + 110 + nameSize)
+		size := int(field(6))
+		if name == "TRAILER!!!" {
+			break
+		}
+		entries = append(entries, cpioTestEntry{
+			name: name,
+			ino:  field(0),
+			mode: field(1),
+			uid:  field(2),
+			gid:  field(3),
+			nlk:  field(4),
+			data: string(archive[dataStart : dataStart+size]),
+		})
+		off = align(dataStart + size)
+	}
+	return entries
+}
+
+func TestUnpackManifestCpio(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+
+	reg := func(name, data string) testEntry {
+		return testEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeReg, Uid: 1000, Gid: 100}, data: data}
+	}
+
+	base := putUncompressedLayer(t, engine, []testEntry{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir}},
+		reg("etc/passwd", "root"),
+		reg("etc/hostname", "old"),
+		reg("var/lib/db/a", "a"),
+		reg("var/lib/other/b", "b"),
+		{hdr: tar.Header{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin"}},
+	})
+	upper := putUncompressedLayer(t, engine, []testEntry{
+		reg("etc/hostname", "new"),
+		reg("var/lib/db/c", "c"),
+		reg("var/lib/db/.wh..wh..opq", ""),
+		reg("var/lib/.wh.other", ""),
+		{hdr: tar.Header{Name: "etc/hostname-link", Typeflag: tar.TypeLink, Linkname: "etc/hostname"}},
+		{hdr: tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}},
+	})
+
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, ispec.Image{
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []string{base.Digest.String(), upper.Digest.String()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{base, upper},
+	}
+
+	var archive bytes.Buffer
+	if err := UnpackManifestCpio(ctx, engine, &archive, manifest); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	entries := readCpio(t, archive.Bytes())
+
+	byName := map[string]cpioTestEntry{}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if seen[entry.name] {
+			t.Errorf("duplicate entry %s", entry.name)
+		}
+		seen[entry.name] = true
+		byName[entry.name] = entry
+	}
+
+	// Every parent must precede its children.
+	for idx, entry := range entries {
+		for _, later := range entries[idx+1:] {
+			if strings.HasPrefix(entry.name, later.name+"/") {
+				t.Errorf("parent %s comes after %s", later.name, entry.name)
+			}
+		}
+	}
+
+	expected := map[string]struct {
+		mode int64
+		data string
+	}{
+		"etc":               {040644, ""},
+		"etc/passwd":        {0100644, "root"},
+		"etc/hostname":      {0100644, "new"},
+		"etc/hostname-link": {0100644, ""},
+		"var":               {040755, ""},
+		"var/lib":           {040755, ""},
+		"var/lib/db":        {040755, ""},
+		"var/lib/db/c":      {0100644, "c"},
+		"bin":               {0120644, "usr/bin"},
+		"dev":               {040755, ""},
+		"dev/null":          {020644, ""},
+	}
+	if len(byName) != len(expected) {
+		t.Errorf("unexpected entries: got %v", entries)
+	}
+	for name, want := range expected {
+		entry, ok := byName[name]
+		if !ok {
+			t.Errorf("missing entry %s", name)
+			continue
+		}
+		if entry.mode != want.mode || entry.data != want.data {
+			t.Errorf("unexpected entry %s: got mode=%o data=%q, expected mode=%o data=%q", name, entry.mode, entry.data, want.mode, want.data)
+		}
+	}
+
+	// Hardlinks share an inode, and the contents are stored with the last
+	// link.
+	link, target := byName["etc/hostname-link"], byName["etc/hostname"]
+	if link.ino != target.ino || link.nlk != 2 || target.nlk != 2 {
+		t.Errorf("hardlink not preserved: link=%+v target=%+v", link, target)
+	}
+	if target.uid != 1000 || target.gid != 100 {
+		t.Errorf("ownership not preserved: %+v", target)
+	}
+}
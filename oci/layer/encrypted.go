@@ -0,0 +1,425 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Media types used by ocicrypt for encrypted layers. These are not part of
+// the vendored image-spec.
+const (
+	// MediaTypeImageLayerEncrypted is the media type of an encrypted,
+	// uncompressed layer.
+	MediaTypeImageLayerEncrypted = "application/vnd.oci.image.layer.v1.tar+encrypted"
+
+	// MediaTypeImageLayerGzipEncrypted is the media type of an encrypted,
+	// gzip-compressed layer.
+	MediaTypeImageLayerGzipEncrypted = "application/vnd.oci.image.layer.v1.tar+gzip+encrypted"
+)
+
+// Annotations of the descriptors of encrypted layers, as used by ocicrypt. The
+// values of the key annotations are a comma-separated list of base64-encoded
+// wrapped keys, any of which can be used to decrypt the layer.
+const (
+	// AnnotationEncryptionKeysJWE contains the layer keys wrapped as JWEs.
+	AnnotationEncryptionKeysJWE = "org.opencontainers.image.enc.keys.jwe"
+
+	// AnnotationEncryptionKeysPKCS7 contains the layer keys wrapped as PKCS#7
+	// enveloped data.
+	AnnotationEncryptionKeysPKCS7 = "org.opencontainers.image.enc.keys.pkcs7"
+
+	// AnnotationEncryptionPublicOptions contains the (base64-encoded) public
+	// parameters of the cipher used to encrypt the layer.
+	AnnotationEncryptionPublicOptions = "org.opencontainers.image.enc.pubopts"
+)
+
+// annotationEncryptionPrefix is the prefix of all of the annotations set by
+// ocicrypt on the descriptors of encrypted layers.
+const annotationEncryptionPrefix = "org.opencontainers.image.enc."
+
+// layerCipherAES256CTR is the only layer cipher defined by ocicrypt. Layers
+// are encrypted with AES-256-CTR, and the encrypted blob is authenticated with
+// an HMAC-SHA256 (using the same key).
+const layerCipherAES256CTR = "AES_256_CTR_HMAC_SHA256"
+
+var (
+	// ErrEncryptedLayer is returned when an operation requires the contents of
+	// an encrypted layer, and no keys were provided to decrypt it (or the
+	// operation does not support decrypting layers).
+	ErrEncryptedLayer = errors.New("layer is encrypted")
+
+	// ErrNoDecryptionKey is returned by DecryptLayer when none of the provided
+	// keys can unwrap the key of the layer.
+	ErrNoDecryptionKey = errors.New("no key can decrypt the layer")
+
+	// ErrLayerAuthentication is returned when reading a decrypted layer if
+	// the encrypted layer blob (or its wrapped key) has been modified.
+	ErrLayerAuthentication = errors.New("encrypted layer failed authentication")
+)
+
+// IsEncryptedLayerType returns whether the given MediaType is the media type
+// of an encrypted layer blob.
+func IsEncryptedLayerType(mediaType string) bool {
+	return strings.HasSuffix(mediaType, "+encrypted")
+}
+
+// EncryptedLayerType returns the media type of the encrypted form of a layer
+// with the given media type.
+func EncryptedLayerType(mediaType string) string {
+	return mediaType + "+encrypted"
+}
+
+// DecryptedLayerType returns the media type of the decrypted form of an
+// encrypted layer with the given media type.
+func DecryptedLayerType(mediaType string) string {
+	return strings.TrimSuffix(mediaType, "+encrypted")
+}
+
+// DecryptedLayerAnnotations returns a copy of the given annotations of an
+// encrypted layer descriptor, without the annotations that describe how the
+// layer was encrypted.
+func DecryptedLayerAnnotations(annotations map[string]string) map[string]string {
+	decrypted := map[string]string{}
+	for key, value := range annotations {
+		if !strings.HasPrefix(key, annotationEncryptionPrefix) {
+			decrypted[key] = value
+		}
+	}
+	return decrypted
+}
+
+// publicLayerOptions are the parameters of the layer cipher which are stored
+// (unencrypted) in the AnnotationEncryptionPublicOptions annotation. The
+// format matches the PublicLayerBlockCipherOptions of ocicrypt.
+type publicLayerOptions struct {
+	Cipher        string            `json:"cipher"`
+	HMAC          []byte            `json:"hmac"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// privateLayerOptions are the parameters of the layer cipher which are
+// wrapped for each recipient. The format matches the
+// PrivateLayerBlockCipherOptions of ocicrypt, and Digest is the digest of the
+// unencrypted layer blob.
+type privateLayerOptions struct {
+	SymmetricKey  []byte            `json:"symkey"`
+	Digest        digest.Digest     `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// layerCipherReader encrypts (or decrypts) the layer blob read from reader
+// with AES-256-CTR, computing the HMAC of the encrypted blob.
+type layerCipherReader struct {
+	reader  io.Reader
+	stream  cipher.Stream
+	hmac    hash.Hash
+	encrypt bool
+
+	// done is set once reader has been read to EOF.
+	done bool
+
+	// expectedHMAC and verifier are used to authenticate the encrypted blob
+	// and the decrypted blob, once reader has been read to EOF. They are only
+	// set when decrypting.
+	expectedHMAC []byte
+	verifier     digest.Verifier
+}
+
+func newLayerCipherReader(reader io.Reader, opts privateLayerOptions, encrypt bool) (*layerCipherReader, error) {
+	if len(opts.SymmetricKey) != 32 {
+		return nil, errors.Errorf("invalid layer key length %d: must be 32 bytes", len(opts.SymmetricKey))
+	}
+	nonce := opts.CipherOptions["nonce"]
+	if len(nonce) != aes.BlockSize {
+		return nil, errors.Errorf("invalid layer nonce length %d: must be %d bytes", len(nonce), aes.BlockSize)
+	}
+	block, err := aes.NewCipher(opts.SymmetricKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "create layer cipher")
+	}
+	return &layerCipherReader{
+		reader:  reader,
+		stream:  cipher.NewCTR(block, nonce),
+		hmac:    hmac.New(sha256.New, opts.SymmetricKey),
+		encrypt: encrypt,
+	}, nil
+}
+
+func (r *layerCipherReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if r.encrypt {
+		r.stream.XORKeyStream(p[:n], p[:n])
+		r.hmac.Write(p[:n])
+	} else {
+		r.hmac.Write(p[:n])
+		r.stream.XORKeyStream(p[:n], p[:n])
+		if r.verifier != nil {
+			r.verifier.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		r.done = true
+		if !r.encrypt {
+			if !hmac.Equal(r.hmac.Sum(nil), r.expectedHMAC) {
+				return n, errors.Wrap(ErrLayerAuthentication, "hmac mismatch")
+			}
+			if r.verifier != nil && !r.verifier.Verified() {
+				return n, errors.Wrap(ErrLayerAuthentication, "decrypted blob digest mismatch")
+			}
+		}
+	}
+	return n, err
+}
+
+// EncryptConfig describes the recipients of encrypted layers, for whom the
+// key of each layer is wrapped.
+type EncryptConfig struct {
+	// PublicKeys are the public keys (*rsa.PublicKey or *ecdsa.PublicKey)
+	// for which the layer key is wrapped as a JWE.
+	PublicKeys []crypto.PublicKey
+
+	// Certificates are the x509 certificates (with RSA public keys) for
+	// which the layer key is wrapped as PKCS#7 enveloped data.
+	Certificates []*x509.Certificate
+}
+
+// DecryptConfig contains the keys used to decrypt encrypted layers.
+type DecryptConfig struct {
+	// PrivateKeys are the private keys (*rsa.PrivateKey or
+	// *ecdsa.PrivateKey) used to unwrap layer keys.
+	PrivateKeys []crypto.PrivateKey
+
+	// Certificates are the x509 certificates of PrivateKeys, which are
+	// required to unwrap layer keys wrapped as PKCS#7 enveloped data.
+	Certificates []*x509.Certificate
+}
+
+// EncryptLayer returns a reader of the encrypted form of the layer with the
+// given descriptor, whose blob is read from blob. The layer is encrypted in
+// the format used by ocicrypt, with a random key which is wrapped for each of
+// the recipients in config. Once the returned reader has been read to EOF, the
+// returned function returns the annotations of the encrypted layer descriptor
+// (whose media type is EncryptedLayerType of the layer's media type).
+func EncryptLayer(blob io.Reader, descriptor ispec.Descriptor, config EncryptConfig) (io.Reader, func() (map[string]string, error), error) {
+	if !isLayerType(descriptor.MediaType) {
+		return nil, nil, errors.Wrapf(ErrInvalidMediaType, "encrypt layer: blob has mediatype %s", descriptor.MediaType)
+	}
+	if len(config.PublicKeys) == 0 && len(config.Certificates) == 0 {
+		return nil, nil, errors.New("encrypt layer: no recipients")
+	}
+
+	opts := privateLayerOptions{
+		SymmetricKey: make([]byte, 32),
+		Digest:       descriptor.Digest,
+		CipherOptions: map[string][]byte{
+			"nonce": make([]byte, aes.BlockSize),
+		},
+	}
+	if _, err := io.ReadFull(rand.Reader, opts.SymmetricKey); err != nil {
+		return nil, nil, errors.Wrap(err, "generate layer key")
+	}
+	if _, err := io.ReadFull(rand.Reader, opts.CipherOptions["nonce"]); err != nil {
+		return nil, nil, errors.Wrap(err, "generate layer nonce")
+	}
+
+	reader, err := newLayerCipherReader(blob, opts, true)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "encrypt layer")
+	}
+
+	finalize := func() (map[string]string, error) {
+		if !reader.done {
+			return nil, errors.New("encrypt layer: layer has not been read to EOF")
+		}
+		privateOpts, err := json.Marshal(opts)
+		if err != nil {
+			return nil, errors.Wrap(err, "encode private layer options")
+		}
+		publicOpts, err := json.Marshal(publicLayerOptions{
+			Cipher:        layerCipherAES256CTR,
+			HMAC:          reader.hmac.Sum(nil),
+			CipherOptions: map[string][]byte{},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "encode public layer options")
+		}
+
+		annotations := map[string]string{
+			AnnotationEncryptionPublicOptions: base64.StdEncoding.EncodeToString(publicOpts),
+		}
+		if len(config.PublicKeys) > 0 {
+			wrapped, err := wrapKeyJWE(privateOpts, config.PublicKeys)
+			if err != nil {
+				return nil, errors.Wrap(err, "wrap layer key (jwe)")
+			}
+			annotations[AnnotationEncryptionKeysJWE] = base64.StdEncoding.EncodeToString(wrapped)
+		}
+		if len(config.Certificates) > 0 {
+			wrapped, err := wrapKeyPKCS7(privateOpts, config.Certificates)
+			if err != nil {
+				return nil, errors.Wrap(err, "wrap layer key (pkcs7)")
+			}
+			annotations[AnnotationEncryptionKeysPKCS7] = base64.StdEncoding.EncodeToString(wrapped)
+		}
+		return annotations, nil
+	}
+	return reader, finalize, nil
+}
+
+// unwrapLayerKey returns the private options of an encrypted layer, unwrapped
+// from the key annotations of its descriptor with the keys in config.
+func unwrapLayerKey(annotations map[string]string, config DecryptConfig) (privateLayerOptions, error) {
+	unwrappers := []struct {
+		annotation string
+		unwrap     func([]byte, DecryptConfig) ([]byte, error)
+	}{
+		{AnnotationEncryptionKeysJWE, unwrapKeyJWE},
+		{AnnotationEncryptionKeysPKCS7, unwrapKeyPKCS7},
+	}
+
+	found := false
+	for _, unwrapper := range unwrappers {
+		value := annotations[unwrapper.annotation]
+		if value == "" {
+			continue
+		}
+		found = true
+		for _, encoded := range strings.Split(value, ",") {
+			wrapped, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return privateLayerOptions{}, errors.Wrapf(err, "decode %s annotation", unwrapper.annotation)
+			}
+			data, err := unwrapper.unwrap(wrapped, config)
+			if err != nil {
+				// Each wrapped key may be for a different set of recipients.
+				continue
+			}
+			var opts privateLayerOptions
+			if err := json.Unmarshal(data, &opts); err != nil {
+				return privateLayerOptions{}, errors.Wrap(err, "parse private layer options")
+			}
+			return opts, nil
+		}
+	}
+	if !found {
+		return privateLayerOptions{}, errors.New("encrypted layer has no wrapped keys")
+	}
+	return privateLayerOptions{}, ErrNoDecryptionKey
+}
+
+// DecryptLayer returns a reader of the decrypted form of an encrypted layer,
+// whose blob is read from blob and whose descriptor has the given annotations
+// (see casext.ManifestLayerAnnotations). The key of the layer is unwrapped
+// with the keys in config, returning ErrNoDecryptionKey if none of them can be
+// used. Once the whole blob has been read, the reader returns an error (with
+// a cause of ErrLayerAuthentication) if the layer has been modified. The
+// media type of the decrypted layer is DecryptedLayerType of the encrypted
+// layer's media type.
+func DecryptLayer(blob io.Reader, annotations map[string]string, config DecryptConfig) (io.Reader, error) {
+	var publicOpts publicLayerOptions
+	encoded, ok := annotations[AnnotationEncryptionPublicOptions]
+	if !ok {
+		return nil, errors.Errorf("decrypt layer: missing %s annotation", AnnotationEncryptionPublicOptions)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decrypt layer: decode %s annotation", AnnotationEncryptionPublicOptions)
+	}
+	if err := json.Unmarshal(data, &publicOpts); err != nil {
+		return nil, errors.Wrap(err, "decrypt layer: parse public layer options")
+	}
+	if publicOpts.Cipher != layerCipherAES256CTR {
+		return nil, errors.Errorf("decrypt layer: unsupported layer cipher %q", publicOpts.Cipher)
+	}
+
+	opts, err := unwrapLayerKey(annotations, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "decrypt layer")
+	}
+	// The nonce is usually private, but may be public.
+	if _, ok := opts.CipherOptions["nonce"]; !ok {
+		if opts.CipherOptions == nil {
+			opts.CipherOptions = map[string][]byte{}
+		}
+		opts.CipherOptions["nonce"] = publicOpts.CipherOptions["nonce"]
+	}
+
+	reader, err := newLayerCipherReader(blob, opts, false)
+	if err != nil {
+		return nil, errors.Wrap(err, "decrypt layer")
+	}
+	reader.expectedHMAC = publicOpts.HMAC
+	if opts.Digest != "" {
+		if err := opts.Digest.Validate(); err != nil {
+			return nil, errors.Wrap(err, "decrypt layer: invalid layer digest")
+		}
+		if opts.Digest.Algorithm() != cas.BlobAlgorithm {
+			return nil, errors.Errorf("decrypt layer: unsupported layer digest algorithm %s", opts.Digest.Algorithm())
+		}
+		reader.verifier = opts.Digest.Verifier()
+	}
+	return reader, nil
+}
+
+// decryptLayerBlob returns a reader of the decrypted blob of the given layer
+// (read from blob) along with its decrypted media type, using the given
+// annotations of its descriptor. Unencrypted layers are returned unmodified,
+// and ErrEncryptedLayer is returned if config is nil.
+func decryptLayerBlob(blob io.Reader, descriptor ispec.Descriptor, annotations map[string]string, config *DecryptConfig) (io.Reader, string, error) {
+	if !IsEncryptedLayerType(descriptor.MediaType) {
+		return blob, descriptor.MediaType, nil
+	}
+	if config == nil {
+		return nil, "", errors.Wrapf(ErrEncryptedLayer, "layer %s", descriptor.Digest)
+	}
+	mediaType := DecryptedLayerType(descriptor.MediaType)
+	if !isLayerType(mediaType) {
+		return nil, "", errors.Wrapf(ErrInvalidMediaType, "layer %s: blob has mediatype %s", descriptor.Digest, descriptor.MediaType)
+	}
+	reader, err := DecryptLayer(blob, annotations, *config)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "layer %s", descriptor.Digest)
+	}
+	return reader, mediaType, nil
+}
+
+// layerAnnotations returns the annotations of the layer with the given index,
+// if any.
+func layerAnnotations(annotations []map[string]string, idx int) map[string]string {
+	if idx < len(annotations) {
+		return annotations[idx]
+	}
+	return nil
+}
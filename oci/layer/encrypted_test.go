@@ -0,0 +1,366 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// testEncryptionKeys are the keys used by the encryption tests, generated
+// once because RSA key generation is slow.
+type testEncryptionKeys struct {
+	rsaKey      *rsa.PrivateKey
+	ecKey       *ecdsa.PrivateKey
+	certificate *x509.Certificate
+}
+
+func generateTestEncryptionKeys(t *testing.T) testEncryptionKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "umoci test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &rsaKey.PublicKey, rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testEncryptionKeys{rsaKey: rsaKey, ecKey: ecKey, certificate: certificate}
+}
+
+// encryptTestLayer encrypts the given layer blob, returning the encrypted
+// blob and the annotations of its descriptor.
+func encryptTestLayer(t *testing.T, blob []byte, config EncryptConfig) ([]byte, map[string]string) {
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    cas.BlobAlgorithm.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+	reader, finalize, err := EncryptLayer(bytes.NewReader(blob), descriptor, config)
+	if err != nil {
+		t.Fatalf("encrypt layer: %v", err)
+	}
+	encrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read encrypted layer: %v", err)
+	}
+	annotations, err := finalize()
+	if err != nil {
+		t.Fatalf("finalize encrypted layer: %v", err)
+	}
+	return encrypted, annotations
+}
+
+func TestEncryptLayerRoundTrip(t *testing.T) {
+	keys := generateTestEncryptionKeys(t)
+	blob := bytes.Repeat([]byte("umoci layer contents "), 4096)
+
+	encrypted, annotations := encryptTestLayer(t, blob, EncryptConfig{
+		PublicKeys:   []crypto.PublicKey{&keys.rsaKey.PublicKey, &keys.ecKey.PublicKey},
+		Certificates: []*x509.Certificate{keys.certificate},
+	})
+	if bytes.Contains(encrypted, []byte("umoci layer contents")) {
+		t.Errorf("encrypted layer contains the plaintext")
+	}
+	for _, annotation := range []string{AnnotationEncryptionKeysJWE, AnnotationEncryptionKeysPKCS7, AnnotationEncryptionPublicOptions} {
+		if annotations[annotation] == "" {
+			t.Errorf("encrypted layer is missing the %s annotation", annotation)
+		}
+	}
+
+	for _, test := range []struct {
+		name   string
+		config DecryptConfig
+	}{
+		{"JWE-RSA", DecryptConfig{PrivateKeys: []crypto.PrivateKey{keys.rsaKey}}},
+		{"JWE-ECDSA", DecryptConfig{PrivateKeys: []crypto.PrivateKey{keys.ecKey}}},
+		{"PKCS7", DecryptConfig{PrivateKeys: []crypto.PrivateKey{keys.rsaKey}, Certificates: []*x509.Certificate{keys.certificate}}},
+	} {
+		reader, err := DecryptLayer(bytes.NewReader(encrypted), annotations, test.config)
+		if err != nil {
+			t.Errorf("%s: decrypt layer: %v", test.name, err)
+			continue
+		}
+		decrypted, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Errorf("%s: read decrypted layer: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(decrypted, blob) {
+			t.Errorf("%s: decrypted layer does not match the original layer", test.name)
+		}
+	}
+}
+
+func TestEncryptLayerPKCS7(t *testing.T) {
+	keys := generateTestEncryptionKeys(t)
+	blob := []byte("umoci layer contents")
+
+	encrypted, annotations := encryptTestLayer(t, blob, EncryptConfig{
+		Certificates: []*x509.Certificate{keys.certificate},
+	})
+	if _, ok := annotations[AnnotationEncryptionKeysJWE]; ok {
+		t.Errorf("layer encrypted only for a certificate has the %s annotation", AnnotationEncryptionKeysJWE)
+	}
+
+	// The certificate is required to unwrap PKCS#7 wrapped keys.
+	if _, err := DecryptLayer(bytes.NewReader(encrypted), annotations, DecryptConfig{
+		PrivateKeys: []crypto.PrivateKey{keys.rsaKey},
+	}); errors.Cause(err) != ErrNoDecryptionKey {
+		t.Errorf("decrypt layer without certificate: expected ErrNoDecryptionKey, got %v", err)
+	}
+
+	reader, err := DecryptLayer(bytes.NewReader(encrypted), annotations, DecryptConfig{
+		PrivateKeys:  []crypto.PrivateKey{keys.rsaKey},
+		Certificates: []*x509.Certificate{keys.certificate},
+	})
+	if err != nil {
+		t.Fatalf("decrypt layer: %v", err)
+	}
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read decrypted layer: %v", err)
+	}
+	if !bytes.Equal(decrypted, blob) {
+		t.Errorf("decrypted layer does not match the original layer")
+	}
+}
+
+func TestDecryptLayerWrongKey(t *testing.T) {
+	keys := generateTestEncryptionKeys(t)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, annotations := encryptTestLayer(t, []byte("umoci layer contents"), EncryptConfig{
+		PublicKeys: []crypto.PublicKey{&keys.ecKey.PublicKey},
+	})
+	if _, err := DecryptLayer(bytes.NewReader(encrypted), annotations, DecryptConfig{
+		PrivateKeys: []crypto.PrivateKey{otherKey, keys.rsaKey},
+	}); errors.Cause(err) != ErrNoDecryptionKey {
+		t.Errorf("expected ErrNoDecryptionKey, got %v", err)
+	}
+}
+
+func TestDecryptLayerTampered(t *testing.T) {
+	keys := generateTestEncryptionKeys(t)
+	blob := []byte("umoci layer contents")
+	config := DecryptConfig{PrivateKeys: []crypto.PrivateKey{keys.ecKey}}
+
+	encrypted, annotations := encryptTestLayer(t, blob, EncryptConfig{
+		PublicKeys: []crypto.PublicKey{&keys.ecKey.PublicKey},
+	})
+
+	// Modifying the encrypted blob must be detected.
+	tampered := append([]byte{}, encrypted...)
+	tampered[len(tampered)/2] ^= 0x01
+	reader, err := DecryptLayer(bytes.NewReader(tampered), annotations, config)
+	if err != nil {
+		t.Fatalf("decrypt layer: %v", err)
+	}
+	if _, err := ioutil.ReadAll(reader); errors.Cause(err) != ErrLayerAuthentication {
+		t.Errorf("tampered blob: expected ErrLayerAuthentication, got %v", err)
+	}
+
+	// As must truncating it.
+	reader, err = DecryptLayer(bytes.NewReader(encrypted[:len(encrypted)-1]), annotations, config)
+	if err != nil {
+		t.Fatalf("decrypt layer: %v", err)
+	}
+	if _, err := ioutil.ReadAll(reader); errors.Cause(err) != ErrLayerAuthentication {
+		t.Errorf("truncated blob: expected ErrLayerAuthentication, got %v", err)
+	}
+}
+
+func TestEncryptLayerInvalid(t *testing.T) {
+	keys := generateTestEncryptionKeys(t)
+	blob := []byte("umoci layer contents")
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    cas.BlobAlgorithm.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+
+	if _, _, err := EncryptLayer(bytes.NewReader(blob), descriptor, EncryptConfig{}); err == nil {
+		t.Errorf("expected an error encrypting a layer without recipients")
+	}
+
+	encryptedDescriptor := descriptor
+	encryptedDescriptor.MediaType = MediaTypeImageLayerGzipEncrypted
+	if _, _, err := EncryptLayer(bytes.NewReader(blob), encryptedDescriptor, EncryptConfig{
+		PublicKeys: []crypto.PublicKey{&keys.ecKey.PublicKey},
+	}); errors.Cause(err) != ErrInvalidMediaType {
+		t.Errorf("expected ErrInvalidMediaType encrypting an encrypted layer, got %v", err)
+	}
+
+	_, finalize, err := EncryptLayer(bytes.NewReader(blob), descriptor, EncryptConfig{
+		PublicKeys: []crypto.PublicKey{&keys.ecKey.PublicKey},
+	})
+	if err != nil {
+		t.Fatalf("encrypt layer: %v", err)
+	}
+	if _, err := finalize(); err == nil {
+		t.Errorf("expected an error finalizing a layer which has not been read")
+	}
+}
+
+func TestVerifyDiffIDsEncrypted(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+	keys := generateTestEncryptionKeys(t)
+
+	layer, diffID := putTestLayer(t, engine, "a")
+	reader, err := engine.GetBlob(ctx, layer.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, annotations := encryptTestLayer(t, blob, EncryptConfig{
+		PublicKeys: []crypto.PublicKey{&keys.rsaKey.PublicKey},
+	})
+	encryptedDigest, encryptedSize, err := engine.PutBlob(ctx, bytes.NewReader(encrypted))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, ispec.Image{
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []string{diffID},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{{
+			MediaType: MediaTypeImageLayerGzipEncrypted,
+			Digest:    encryptedDigest,
+			Size:      encryptedSize,
+		}},
+	}
+	layerAnnotations := []map[string]string{annotations}
+
+	if err := VerifyDiffIDsWithOptions(ctx, engine, manifest, VerifyOptions{
+		LayerAnnotations: layerAnnotations,
+	}); errors.Cause(err) != ErrEncryptedLayer {
+		t.Errorf("verify without keys: expected ErrEncryptedLayer, got %v", err)
+	}
+	if err := VerifyDiffIDsWithOptions(ctx, engine, manifest, VerifyOptions{
+		Decryption:       &DecryptConfig{PrivateKeys: []crypto.PrivateKey{keys.rsaKey}},
+		LayerAnnotations: layerAnnotations,
+	}); err != nil {
+		t.Errorf("verify with keys: unexpected error: %v", err)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys := generateTestEncryptionKeys(t)
+
+	ecDER, err := x509.MarshalECPrivateKey(keys.ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8DER, err := x509.MarshalPKCS8PrivateKey(keys.rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"PKCS1-PEM", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(keys.rsaKey)})},
+		{"PKCS8-DER", pkcs8DER},
+		{"SEC1-PEM", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})},
+	} {
+		if _, err := ParsePrivateKey(test.data); err != nil {
+			t.Errorf("%s: parse private key: %v", test.name, err)
+		}
+	}
+	encryptedPEM := pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: pkcs8DER})
+	if _, err := ParsePrivateKey(encryptedPEM); err == nil {
+		t.Errorf("expected an error parsing an encrypted private key")
+	}
+
+	publicDER, err := x509.MarshalPKIXPublicKey(&keys.ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"PKIX-PEM", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})},
+		{"PKCS1-DER", x509.MarshalPKCS1PublicKey(&keys.rsaKey.PublicKey)},
+	} {
+		if _, err := ParsePublicKey(test.data); err != nil {
+			t.Errorf("%s: parse public key: %v", test.name, err)
+		}
+	}
+	if _, err := ParsePublicKey(pkcs8DER); err == nil {
+		t.Errorf("expected an error parsing a private key as a public key")
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: keys.certificate.Raw})
+	if _, err := ParseCertificate(certPEM); err != nil {
+		t.Errorf("parse certificate: %v", err)
+	}
+}
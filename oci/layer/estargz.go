@@ -0,0 +1,539 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// LayerFormat is the format of the (compressed) layer blobs produced by
+// RepackOptions.NewCompressor.
+type LayerFormat string
+
+const (
+	// LayerFormatGzip is a gzip-compressed tar archive. This is the default.
+	LayerFormatGzip LayerFormat = "gzip"
+
+	// LayerFormatEstargz is an eStargz layer, which is a gzip-compressed tar
+	// archive made up of separately compressed gzip members (one for each
+	// entry, with large files split into chunks) and a table of contents
+	// describing where each entry can be found. This allows runtimes which
+	// support eStargz (such as stargz-snapshotter) to fetch the contents of a
+	// layer lazily, while other consumers can still use it as an ordinary
+	// gzip layer.
+	LayerFormatEstargz LayerFormat = "estargz"
+)
+
+// Validate returns an error if the LayerFormat is not known.
+func (f LayerFormat) Validate() error {
+	switch f {
+	case "", LayerFormatGzip, LayerFormatEstargz:
+		return nil
+	}
+	return errors.Errorf("unknown layer format: %s", f)
+}
+
+const (
+	// EstargzTOCDigestAnnotation is the layer descriptor annotation containing
+	// the digest of the table of contents of an eStargz layer.
+	EstargzTOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+
+	// EstargzUncompressedSizeAnnotation is the layer descriptor annotation
+	// containing the size of an uncompressed eStargz layer.
+	EstargzUncompressedSizeAnnotation = "io.containers.estargz.uncompressed-size"
+)
+
+const (
+	// estargzTOCName is the name of the entry containing the table of
+	// contents, which is the last entry in an eStargz layer.
+	estargzTOCName = "stargz.index.json"
+
+	// estargzPrefetchLandmark and estargzNoPrefetchLandmark are the names of
+	// the landmark entries which separate the entries to be prefetched from
+	// the rest of the layer. We don't prioritise any entries, so we only
+	// write estargzNoPrefetchLandmark (as the first entry).
+	estargzPrefetchLandmark   = ".prefetch.landmark"
+	estargzNoPrefetchLandmark = ".no.prefetch.landmark"
+
+	// estargzLandmarkContents is the contents of the landmark entries.
+	estargzLandmarkContents = 0xf
+
+	// estargzChunkSize is the size of the chunks that the contents of regular
+	// files are split into (with each chunk in a separate gzip member).
+	estargzChunkSize = 4 << 20
+
+	// estargzFooterSize is the size of the footer of an eStargz layer.
+	estargzFooterSize = 51
+)
+
+// estargzEntryName returns the name of the given entry in the table of
+// contents, which is relative to the root and has no trailing slash.
+func estargzEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// estargzTOC is the table of contents of an eStargz layer.
+type estargzTOC struct {
+	Version int            `json:"version"`
+	Entries []estargzEntry `json:"entries"`
+}
+
+// estargzEntry is an entry in the table of contents of an eStargz layer. The
+// contents of each regular file are described by the entry of the file
+// followed by a "chunk" entry for every chunk after the first.
+type estargzEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime     string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	DevMajor    int64             `json:"devMajor,omitempty"`
+	DevMinor    int64             `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+}
+
+// estargzTypes maps tar typeflags to the entry types used in the table of
+// contents.
+var estargzTypes = map[byte]string{
+	tar.TypeReg:     "reg",
+	tar.TypeRegA:    "reg",
+	tar.TypeDir:     "dir",
+	tar.TypeSymlink: "symlink",
+	tar.TypeLink:    "hardlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeFifo:    "fifo",
+}
+
+// newEstargzEntry returns the table of contents entry for the given header.
+func newEstargzEntry(hdr *tar.Header) (estargzEntry, error) {
+	typ, ok := estargzTypes[hdr.Typeflag]
+	if !ok {
+		return estargzEntry{}, errors.Errorf("unsupported entry type %q: %s", hdr.Typeflag, hdr.Name)
+	}
+	entry := estargzEntry{
+		Name:     estargzEntryName(hdr.Name),
+		Type:     typ,
+		LinkName: hdr.Linkname,
+		Mode:     hdr.Mode,
+		UID:      hdr.Uid,
+		GID:      hdr.Gid,
+		Uname:    hdr.Uname,
+		Gname:    hdr.Gname,
+	}
+	// Unset modification times are omitted.
+	if !hdr.ModTime.IsZero() && hdr.ModTime.Unix() != 0 {
+		entry.ModTime = hdr.ModTime.UTC().Round(time.Second).Format(time.RFC3339)
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		entry.Size = hdr.Size
+	case tar.TypeChar, tar.TypeBlock:
+		entry.DevMajor = hdr.Devmajor
+		entry.DevMinor = hdr.Devminor
+	}
+	for key, value := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "SCHILY.xattr.") {
+			if entry.Xattrs == nil {
+				entry.Xattrs = map[string][]byte{}
+			}
+			entry.Xattrs[strings.TrimPrefix(key, "SCHILY.xattr.")] = []byte(value)
+		}
+	}
+	return entry, nil
+}
+
+// estargzWriter is an io.WriteCloser which converts the tar archive written
+// to it into an eStargz layer. It implements mutate.LayerWriter, as the
+// uncompressed eStargz layer differs from the archive written to it.
+type estargzWriter struct {
+	pipe *io.PipeWriter
+	done chan error
+
+	// Set once the layer has been converted.
+	diffID      digest.Digest
+	annotations map[string]string
+}
+
+// newEstargzWriter returns an estargzWriter which writes an eStargz layer
+// (compressed with the given gzip level) to w.
+func newEstargzWriter(w io.Writer, level int) *estargzWriter {
+	pipeReader, pipeWriter := io.Pipe()
+	ew := &estargzWriter{
+		pipe: pipeWriter,
+		done: make(chan error, 1),
+	}
+	go func() {
+		err := ew.convert(w, pipeReader, level)
+		// Make sure that any further writes fail rather than blocking.
+		pipeReader.CloseWithError(errors.Wrap(err, "convert to estargz"))
+		ew.done <- err
+	}()
+	return ew
+}
+
+// Write implements io.Writer.
+func (ew *estargzWriter) Write(p []byte) (int, error) {
+	return ew.pipe.Write(p)
+}
+
+// Close implements io.Closer, and waits for the layer to be written. It must
+// only be called once.
+func (ew *estargzWriter) Close() error {
+	ew.pipe.Close()
+	return errors.Wrap(<-ew.done, "convert to estargz")
+}
+
+// DiffID returns the digest of the uncompressed eStargz layer.
+func (ew *estargzWriter) DiffID() digest.Digest {
+	return ew.diffID
+}
+
+// Annotations returns the annotations of the descriptor of the eStargz layer.
+func (ew *estargzWriter) Annotations() map[string]string {
+	return ew.annotations
+}
+
+// convert writes the tar archive read from r to w as an eStargz layer.
+func (ew *estargzWriter) convert(w io.Writer, r io.Reader, level int) error {
+	b := &estargzBuilder{
+		out:    w,
+		level:  level,
+		diffID: cas.BlobAlgorithm.Digester(),
+	}
+	b.tw = tar.NewWriter(b)
+
+	landmark := &tar.Header{
+		Name:     estargzNoPrefetchLandmark,
+		Typeflag: tar.TypeReg,
+		Mode:     0444,
+		Size:     1,
+		Format:   tar.FormatPAX,
+	}
+	if err := b.addEntry(landmark, bytes.NewReader([]byte{estargzLandmarkContents})); err != nil {
+		return errors.Wrap(err, "write landmark")
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+		if err := b.addEntry(hdr, tr); err != nil {
+			return errors.Wrapf(err, "write entry %s", hdr.Name)
+		}
+	}
+	// Consume the rest of the archive (the end-of-archive marker).
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return errors.Wrap(err, "read archive")
+	}
+
+	tocDigest, err := b.finish()
+	if err != nil {
+		return err
+	}
+	ew.diffID = b.diffID.Digest()
+	ew.annotations = map[string]string{
+		EstargzTOCDigestAnnotation:        tocDigest.String(),
+		EstargzUncompressedSizeAnnotation: strconv.FormatInt(b.size, 10),
+	}
+	return nil
+}
+
+// estargzBuilder writes the entries of an eStargz layer. It is the io.Writer
+// of its tar.Writer, and compresses everything written to it into the current
+// gzip member (starting a new member if there is none).
+type estargzBuilder struct {
+	out   io.Writer
+	level int
+	tw    *tar.Writer
+	gzw   *gzip.Writer
+
+	// offset is the number of compressed bytes written, and size is the
+	// number of uncompressed bytes written (which are hashed by diffID).
+	offset int64
+	size   int64
+	diffID digest.Digester
+
+	entries []estargzEntry
+}
+
+// Write implements io.Writer.
+func (b *estargzBuilder) Write(p []byte) (int, error) {
+	if b.gzw == nil {
+		gzw, err := gzip.NewWriterLevel((*estargzOutput)(b), b.level)
+		if err != nil {
+			return 0, err
+		}
+		b.gzw = gzw
+	}
+	n, err := b.gzw.Write(p)
+	b.diffID.Hash().Write(p[:n])
+	b.size += int64(n)
+	return n, err
+}
+
+// estargzOutput writes to the output of an estargzBuilder, and keeps track of
+// the offset of the next gzip member.
+type estargzOutput estargzBuilder
+
+func (o *estargzOutput) Write(p []byte) (int, error) {
+	n, err := o.out.Write(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+// endMember finishes the current gzip member, so that the next write starts a
+// new member at b.offset.
+func (b *estargzBuilder) endMember() error {
+	if b.gzw == nil {
+		return nil
+	}
+	err := b.gzw.Close()
+	b.gzw = nil
+	return errors.Wrap(err, "finish gzip member")
+}
+
+// addEntry writes the given entry (and its contents, read from r) to the
+// layer, with the contents of regular files split into chunks.
+func (b *estargzBuilder) addEntry(hdr *tar.Header, r io.Reader) error {
+	entry, err := newEstargzEntry(hdr)
+	if err != nil {
+		return err
+	}
+
+	if err := b.endMember(); err != nil {
+		return err
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+	if entry.Type != "reg" || hdr.Size == 0 {
+		b.entries = append(b.entries, entry)
+		return nil
+	}
+
+	fileDigester := digest.Canonical.Digester()
+	var chunks []estargzEntry
+	for chunkOffset := int64(0); chunkOffset < hdr.Size; chunkOffset += estargzChunkSize {
+		chunkSize := hdr.Size - chunkOffset
+		if chunkSize > estargzChunkSize {
+			chunkSize = estargzChunkSize
+		}
+
+		if err := b.endMember(); err != nil {
+			return err
+		}
+		chunk := estargzEntry{
+			Name:        entry.Name,
+			Type:        "chunk",
+			Offset:      b.offset,
+			ChunkOffset: chunkOffset,
+			ChunkSize:   chunkSize,
+		}
+		chunkDigester := digest.Canonical.Digester()
+		if _, err := io.CopyN(io.MultiWriter(b.tw, fileDigester.Hash(), chunkDigester.Hash()), r, chunkSize); err != nil {
+			return errors.Wrap(err, "copy contents")
+		}
+		chunk.ChunkDigest = chunkDigester.Digest().String()
+		chunks = append(chunks, chunk)
+	}
+	// The padding of the contents belongs in the member of the last chunk.
+	if err := b.tw.Flush(); err != nil {
+		return errors.Wrap(err, "pad contents")
+	}
+
+	// The first chunk is described by the entry of the file itself.
+	entry.Digest = fileDigester.Digest().String()
+	entry.Offset = chunks[0].Offset
+	entry.ChunkSize = chunks[0].ChunkSize
+	entry.ChunkDigest = chunks[0].ChunkDigest
+	b.entries = append(b.entries, entry)
+	b.entries = append(b.entries, chunks[1:]...)
+	return nil
+}
+
+// finish writes the table of contents (in its own gzip member, along with the
+// end-of-archive marker) and the footer, and returns the digest of the table
+// of contents.
+func (b *estargzBuilder) finish() (digest.Digest, error) {
+	toc, err := json.Marshal(estargzTOC{Version: 1, Entries: b.entries})
+	if err != nil {
+		return "", errors.Wrap(err, "encode toc")
+	}
+
+	if err := b.endMember(); err != nil {
+		return "", err
+	}
+	tocOffset := b.offset
+	if err := b.tw.WriteHeader(&tar.Header{
+		Name:     estargzTOCName,
+		Typeflag: tar.TypeReg,
+		Mode:     0444,
+		Size:     int64(len(toc)),
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		return "", errors.Wrap(err, "write toc header")
+	}
+	if _, err := b.tw.Write(toc); err != nil {
+		return "", errors.Wrap(err, "write toc")
+	}
+	if err := b.tw.Close(); err != nil {
+		return "", errors.Wrap(err, "close archive")
+	}
+	if err := b.endMember(); err != nil {
+		return "", err
+	}
+
+	if _, err := (*estargzOutput)(b).Write(estargzFooter(tocOffset)); err != nil {
+		return "", errors.Wrap(err, "write footer")
+	}
+	return digest.FromBytes(toc), nil
+}
+
+// estargzFooter returns the footer of an eStargz layer, which is an empty
+// gzip member containing the offset of the table of contents in the extra
+// field of its header. It is written by hand because readers require the
+// footer to be exactly estargzFooterSize bytes, which depends on the empty
+// deflate stream being a stored block (compress/flate doesn't guarantee this).
+func estargzFooter(tocOffset int64) []byte {
+	payload := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	extra := append([]byte{'S', 'G', byte(len(payload)), 0}, payload...)
+
+	footer := []byte{
+		0x1f, 0x8b, // magic
+		8,          // CM: deflate
+		1 << 2,     // FLG: FEXTRA
+		0, 0, 0, 0, // MTIME
+		0,    // XFL
+		0xff, // OS: unknown
+		byte(len(extra)), 0,
+	}
+	footer = append(footer, extra...)
+	// A final stored block with no data.
+	footer = append(footer, 0x01, 0x00, 0x00, 0xff, 0xff)
+	// The CRC-32 and size of the (empty) uncompressed data.
+	return append(footer, 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+// entryReader reads the entries of a layer like a tar.Reader, except that the
+// entries added to eStargz layers (the table of contents and landmarks) are
+// skipped, as they are not part of the filesystem of the layer. Since the
+// annotations of layer descriptors are not available, eStargz layers are not
+// identified by their descriptor. Instead, landmarks are only skipped if they
+// have the contents written by eStargz writers and the table of contents is
+// only skipped if it is the last entry of the layer (so these entries are
+// only ever skipped from the root of an eStargz layer).
+type entryReader struct {
+	tr *tar.Reader
+
+	// contents is the reader for the contents of the current entry, which
+	// differs from tr if they had to be read to check the entry.
+	contents io.Reader
+
+	// pending is the next entry (and error), if it was read to check whether
+	// the previous entry was the last one. Its contents have not been read.
+	pending    *tar.Header
+	pendingErr error
+}
+
+// newEntryReader returns a new entryReader reading the layer archive from r.
+func newEntryReader(r io.Reader) *entryReader {
+	tr := tar.NewReader(r)
+	return &entryReader{tr: tr, contents: tr}
+}
+
+// next returns the next entry read from tr (or the pending entry).
+func (lr *entryReader) next() (*tar.Header, error) {
+	lr.contents = lr.tr
+	if lr.pending != nil || lr.pendingErr != nil {
+		hdr, err := lr.pending, lr.pendingErr
+		lr.pending, lr.pendingErr = nil, nil
+		return hdr, err
+	}
+	return lr.tr.Next()
+}
+
+// Next advances to the next entry of the layer, like tar.Reader.Next.
+func (lr *entryReader) Next() (*tar.Header, error) {
+	for {
+		hdr, err := lr.next()
+		if err != nil || hdr.Typeflag != tar.TypeReg {
+			return hdr, err
+		}
+
+		switch estargzEntryName(hdr.Name) {
+		case estargzPrefetchLandmark, estargzNoPrefetchLandmark:
+			if hdr.Size != 1 {
+				return hdr, nil
+			}
+			contents, err := ioutil.ReadAll(lr.tr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "read %s", hdr.Name)
+			}
+			if contents[0] == estargzLandmarkContents {
+				continue
+			}
+			lr.contents = bytes.NewReader(contents)
+		case estargzTOCName:
+			contents, err := ioutil.ReadAll(lr.tr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "read %s", hdr.Name)
+			}
+			lr.pending, lr.pendingErr = lr.tr.Next()
+			if lr.pendingErr == io.EOF {
+				continue
+			}
+			lr.contents = bytes.NewReader(contents)
+		}
+		return hdr, nil
+	}
+}
+
+// Read reads from the contents of the current entry, like tar.Reader.Read.
+func (lr *entryReader) Read(p []byte) (int, error) {
+	return lr.contents.Read(p)
+}
@@ -0,0 +1,287 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+type estargzTestEntry struct {
+	hdr      tar.Header
+	contents []byte
+}
+
+func makeEstargzTestArchive(t *testing.T, entries []estargzTestEntry) []byte {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, entry := range entries {
+		hdr := entry.hdr
+		hdr.Size = int64(len(entry.contents))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("unexpected error writing header: %+v", err)
+		}
+		if _, err := tw.Write(entry.contents); err != nil {
+			t.Fatalf("unexpected error writing contents: %+v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected error closing archive: %+v", err)
+	}
+	return buffer.Bytes()
+}
+
+// readEstargzMember decompresses size bytes from the gzip member at the given
+// offset of the layer.
+func readEstargzMember(t *testing.T, blob []byte, offset, size int64) []byte {
+	gzr, err := gzip.NewReader(bytes.NewReader(blob[offset:]))
+	if err != nil {
+		t.Fatalf("unexpected error reading member at %d: %+v", offset, err)
+	}
+	gzr.Multistream(false)
+	data := make([]byte, size)
+	if _, err := io.ReadFull(gzr, data); err != nil {
+		t.Fatalf("unexpected error decompressing member at %d: %+v", offset, err)
+	}
+	return data
+}
+
+func TestEstargzWriter(t *testing.T) {
+	big := make([]byte, 2*estargzChunkSize+12345)
+	rand.New(rand.NewSource(1)).Read(big)
+	mtime := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	entries := []estargzTestEntry{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime}},
+		{hdr: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime, PAXRecords: map[string]string{"SCHILY.xattr.user.key": "value"}}, contents: []byte("umoci\n")},
+		{hdr: tar.Header{Name: "etc/empty", Typeflag: tar.TypeReg, Mode: 0600, ModTime: mtime}},
+		{hdr: tar.Header{Name: "big", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 100, ModTime: mtime}, contents: big},
+		{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "etc/hostname", ModTime: mtime}},
+		{hdr: tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "big", ModTime: mtime}},
+		{hdr: tar.Header{Name: "null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3, ModTime: mtime}},
+	}
+	archive := makeEstargzTestArchive(t, entries)
+
+	var buffer bytes.Buffer
+	ew := newEstargzWriter(&buffer, gzip.BestSpeed)
+	if _, err := io.Copy(ew, bytes.NewReader(archive)); err != nil {
+		t.Fatalf("unexpected error writing: %+v", err)
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %+v", err)
+	}
+	blob := buffer.Bytes()
+
+	// The layer is an ordinary gzip layer with the right DiffID.
+	gzr, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("unexpected error reading layer: %+v", err)
+	}
+	uncompressed, err := ioutil.ReadAll(gzr)
+	if err != nil {
+		t.Fatalf("unexpected error decompressing layer: %+v", err)
+	}
+	if diffID := digest.FromBytes(uncompressed); ew.DiffID() != diffID {
+		t.Errorf("unexpected diffid: got %s, expected %s", ew.DiffID(), diffID)
+	}
+	if size := ew.Annotations()[EstargzUncompressedSizeAnnotation]; size != strconv.Itoa(len(uncompressed)) {
+		t.Errorf("unexpected uncompressed size annotation: got %s, expected %d", size, len(uncompressed))
+	}
+
+	// The layer has the same entries (without the eStargz entries).
+	tr := newEntryReader(bytes.NewReader(uncompressed))
+	for idx := 0; ; idx++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if idx != len(entries) {
+				t.Errorf("expected %d entries, got %d", len(entries), idx)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading entry: %+v", err)
+		}
+		if idx >= len(entries) {
+			t.Fatalf("unexpected extra entry %s", hdr.Name)
+		}
+		if hdr.Name != entries[idx].hdr.Name {
+			t.Errorf("entry %d: got %s, expected %s", idx, hdr.Name, entries[idx].hdr.Name)
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("unexpected error reading %s: %+v", hdr.Name, err)
+		}
+		if !bytes.Equal(contents, entries[idx].contents) {
+			t.Errorf("entry %s: contents don't match", hdr.Name)
+		}
+	}
+
+	// The footer contains the offset of the table of contents.
+	if len(blob) < estargzFooterSize {
+		t.Fatalf("layer is too small: %d bytes", len(blob))
+	}
+	footer, err := gzip.NewReader(bytes.NewReader(blob[len(blob)-estargzFooterSize:]))
+	if err != nil {
+		t.Fatalf("unexpected error reading footer: %+v", err)
+	}
+	extra := footer.Header.Extra
+	if len(extra) != 26 || string(extra[:4]) != "SG\x16\x00" || string(extra[20:]) != "STARGZ" {
+		t.Fatalf("unexpected footer extra field: %q", extra)
+	}
+	tocOffset, err := strconv.ParseInt(string(extra[4:20]), 16, 64)
+	if err != nil {
+		t.Fatalf("unexpected error parsing toc offset: %+v", err)
+	}
+
+	gzr, err = gzip.NewReader(bytes.NewReader(blob[tocOffset:]))
+	if err != nil {
+		t.Fatalf("unexpected error reading toc: %+v", err)
+	}
+	gzr.Multistream(false)
+	tocReader := tar.NewReader(gzr)
+	hdr, err := tocReader.Next()
+	if err != nil {
+		t.Fatalf("unexpected error reading toc entry: %+v", err)
+	}
+	if hdr.Name != estargzTOCName {
+		t.Fatalf("unexpected toc entry: %s", hdr.Name)
+	}
+	tocData, err := ioutil.ReadAll(tocReader)
+	if err != nil {
+		t.Fatalf("unexpected error reading toc: %+v", err)
+	}
+	if _, err := tocReader.Next(); err != io.EOF {
+		t.Errorf("expected toc to be the last entry, got %v", err)
+	}
+	if tocDigest := digest.FromBytes(tocData); ew.Annotations()[EstargzTOCDigestAnnotation] != tocDigest.String() {
+		t.Errorf("unexpected toc digest annotation: got %s, expected %s", ew.Annotations()[EstargzTOCDigestAnnotation], tocDigest)
+	}
+
+	var toc estargzTOC
+	if err := json.Unmarshal(tocData, &toc); err != nil {
+		t.Fatalf("unexpected error parsing toc: %+v", err)
+	}
+	if toc.Version != 1 {
+		t.Errorf("unexpected toc version: %d", toc.Version)
+	}
+
+	// Every chunk can be read from its own gzip member.
+	var summary []string
+	contents := map[string][]byte{}
+	for _, entry := range toc.Entries {
+		summary = append(summary, fmt.Sprintf("%s:%s", entry.Type, entry.Name))
+		if entry.Offset == 0 {
+			continue
+		}
+		chunk := readEstargzMember(t, blob, entry.Offset, entry.ChunkSize)
+		if chunkDigest := digest.FromBytes(chunk); entry.ChunkDigest != chunkDigest.String() {
+			t.Errorf("%s: chunk at %d: unexpected digest %s", entry.Name, entry.ChunkOffset, chunkDigest)
+		}
+		if int64(len(contents[entry.Name])) != entry.ChunkOffset {
+			t.Errorf("%s: chunk at unexpected offset %d", entry.Name, entry.ChunkOffset)
+		}
+		contents[entry.Name] = append(contents[entry.Name], chunk...)
+	}
+	expected := []string{
+		"reg:" + estargzNoPrefetchLandmark,
+		"dir:etc",
+		"reg:etc/hostname",
+		"reg:etc/empty",
+		"reg:big",
+		"chunk:big",
+		"chunk:big",
+		"symlink:link",
+		"hardlink:hardlink",
+		"char:null",
+	}
+	if fmt.Sprint(summary) != fmt.Sprint(expected) {
+		t.Errorf("unexpected toc entries: got %v, expected %v", summary, expected)
+	}
+	if !bytes.Equal(contents["big"], big) {
+		t.Errorf("chunks of big don't match its contents")
+	}
+	if !bytes.Equal(contents[estargzNoPrefetchLandmark], []byte{estargzLandmarkContents}) {
+		t.Errorf("unexpected landmark contents: %v", contents[estargzNoPrefetchLandmark])
+	}
+
+	for _, entry := range toc.Entries {
+		switch entry.Name {
+		case "big":
+			if entry.Type == "reg" && (entry.Size != int64(len(big)) || entry.UID != 1000 || entry.GID != 100 || entry.Digest != digest.FromBytes(big).String()) {
+				t.Errorf("unexpected entry for big: %#v", entry)
+			}
+		case "etc/hostname":
+			if string(entry.Xattrs["user.key"]) != "value" || entry.ModTime != "2017-10-01T12:00:00Z" {
+				t.Errorf("unexpected entry for etc/hostname: %#v", entry)
+			}
+		case "null":
+			if entry.DevMajor != 1 || entry.DevMinor != 3 {
+				t.Errorf("unexpected entry for null: %#v", entry)
+			}
+		}
+	}
+}
+
+func TestEntryReader(t *testing.T) {
+	archive := makeEstargzTestArchive(t, []estargzTestEntry{
+		// Not a landmark written by an eStargz writer.
+		{hdr: tar.Header{Name: estargzPrefetchLandmark, Typeflag: tar.TypeReg}, contents: []byte("x")},
+		{hdr: tar.Header{Name: estargzNoPrefetchLandmark, Typeflag: tar.TypeReg}, contents: []byte{estargzLandmarkContents}},
+		// Not the last entry, so it isn't a table of contents.
+		{hdr: tar.Header{Name: estargzTOCName, Typeflag: tar.TypeReg}, contents: []byte("{}")},
+		{hdr: tar.Header{Name: "dir/" + estargzTOCName, Typeflag: tar.TypeReg}, contents: []byte("data")},
+		{hdr: tar.Header{Name: "./" + estargzTOCName, Typeflag: tar.TypeReg}, contents: []byte("{}")},
+	})
+
+	var got []string
+	tr := newEntryReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading entry: %+v", err)
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("unexpected error reading %s: %+v", hdr.Name, err)
+		}
+		got = append(got, fmt.Sprintf("%s=%s", hdr.Name, contents))
+	}
+
+	expected := []string{
+		estargzPrefetchLandmark + "=x",
+		estargzTOCName + "={}",
+		"dir/" + estargzTOCName + "=data",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("unexpected entries: got %q, expected %q", got, expected)
+	}
+}
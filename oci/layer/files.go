@@ -0,0 +1,386 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/event"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ReadFiles returns the contents of every regular file in the root filesystem
+// of the given image manifest whose path (relative to the root, such as
+// "etc/os-release") is accepted by match. The layers are read in order
+// (applying whiteouts) without being extracted, so the result is the same as
+// if the image was unpacked and the files were read from the rootfs. This is
+// intended for reading small metadata files (such as package databases).
+func ReadFiles(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, match func(path string) bool) (map[string][]byte, error) {
+	engineExt := casext.Engine{engine}
+	ctx, err := casext.WithManifestLayerChunks(ctx, manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "read files: get chunked layers")
+	}
+
+	files := map[string][]byte{}
+	for _, layerDescriptor := range manifest.Layers {
+		event.Log(ctx).Debugf("read files: reading layer %s", layerDescriptor.Digest)
+		if err := readLayerFiles(ctx, engineExt, layerDescriptor, files, match); err != nil {
+			return nil, errors.Wrapf(err, "read files: layer %s", layerDescriptor.Digest)
+		}
+	}
+	return files, nil
+}
+
+// layerReader is the uncompressed tar archive of a layer blob.
+type layerReader struct {
+	io.Reader
+	blob io.Closer
+	gz   *gzip.Reader
+}
+
+func (lr *layerReader) Close() error {
+	var err error
+	if lr.gz != nil {
+		err = lr.gz.Close()
+	}
+	lr.blob.Close()
+	return err
+}
+
+// OpenLayer returns a reader for the uncompressed tar archive of the given
+// layer blob, which the caller must Close(). ErrEncryptedLayer is returned
+// for encrypted layers, and ErrForeignLayer for foreign layers whose blobs
+// are not present in the image.
+func OpenLayer(ctx context.Context, engine casext.Engine, layerDescriptor ispec.Descriptor) (io.ReadCloser, error) {
+	if IsEncryptedLayerType(layerDescriptor.MediaType) {
+		return nil, ErrEncryptedLayer
+	}
+	if !isLayerType(layerDescriptor.MediaType) {
+		return nil, errors.Wrapf(ErrInvalidMediaType, "blob has mediatype %s", layerDescriptor.MediaType)
+	}
+
+	reader, err := openLayerBlob(ctx, engine, layerDescriptor, ForeignLayerError)
+	if err != nil {
+		return nil, err
+	}
+
+	lr := &layerReader{Reader: reader, blob: reader}
+	if layerDescriptor.MediaType == ispec.MediaTypeImageLayerGzip || layerDescriptor.MediaType == ispec.MediaTypeImageLayerNonDistributableGzip {
+		gzReader, err := gzip.NewReader(reader)
+		if err != nil {
+			lr.Close()
+			return nil, errors.Wrap(err, "create gzip reader")
+		}
+		lr.Reader = gzReader
+		lr.gz = gzReader
+	}
+	return lr, nil
+}
+
+// readLayerFiles applies the given layer to files.
+func readLayerFiles(ctx context.Context, engine casext.Engine, layerDescriptor ispec.Descriptor, files map[string][]byte, match func(path string) bool) error {
+	layer, err := OpenLayer(ctx, engine, layerDescriptor)
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+
+	// Whiteouts only apply to the lower layers, so the files in this layer
+	// are only merged once the whole layer has been read.
+	upper := map[string][]byte{}
+	tr := tar.NewReader(layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+
+		path := strings.TrimPrefix(filepath.Clean("/"+hdr.Name), "/")
+		dir, file := filepath.Split(path)
+
+		// Whiteouts remove files from the lower layers.
+		if file == whOpaque {
+			removeFiles(files, strings.TrimSuffix(dir, "/"), false)
+			continue
+		}
+		if strings.HasPrefix(file, whPrefix) {
+			removeFiles(files, filepath.Join(dir, strings.TrimPrefix(file, whPrefix)), true)
+			continue
+		}
+
+		// Any other entry replaces the file at the same path.
+		delete(files, path)
+		delete(upper, path)
+		if !match(path) {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return errors.Wrapf(err, "read %s", path)
+			}
+			upper[path] = data
+		case tar.TypeLink:
+			target := strings.TrimPrefix(filepath.Clean("/"+hdr.Linkname), "/")
+			if data, ok := upper[target]; ok {
+				upper[path] = data
+			} else if data, ok := files[target]; ok {
+				upper[path] = data
+			}
+		}
+	}
+
+	for path, data := range upper {
+		files[path] = data
+	}
+	return nil
+}
+
+// removeFiles removes every file under the given directory from files, as
+// well as the path itself if self is true.
+func removeFiles(files map[string][]byte, path string, self bool) {
+	if self {
+		delete(files, path)
+	}
+	prefix := path + "/"
+	if path == "" {
+		prefix = ""
+	}
+	for name := range files {
+		if strings.HasPrefix(name, prefix) {
+			delete(files, name)
+		}
+	}
+}
+
+// maxSymlinks is the maximum number of links (symlinks and hardlinks) followed
+// by OpenFile, which is the same as MAXSYMLINKS on Linux.
+const maxSymlinks = 40
+
+// fileReader is the contents of a file in a layer, which keeps the layer open
+// until it is closed.
+type fileReader struct {
+	io.Reader
+	layer io.Closer
+}
+
+func (fr *fileReader) Close() error {
+	return fr.layer.Close()
+}
+
+// OpenFile returns a reader for the contents of the regular file at the given
+// path in the root filesystem of the given image manifest, which the caller
+// must Close(). The layers are searched from the topmost layer down
+// (respecting whiteouts), and the contents are streamed directly from the
+// layer containing the file without anything being extracted. Symlinks
+// (including symlinked parent directories) are resolved within the root
+// filesystem. If the file doesn't exist, an error wrapping os.ErrNotExist is
+// returned.
+func OpenFile(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, path string) (io.ReadCloser, error) {
+	engineExt := casext.Engine{engine}
+	ctx, err := casext.WithManifestLayerChunks(ctx, manifest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open file %s: get chunked layers", path)
+	}
+
+	path = strings.TrimPrefix(filepath.Clean("/"+path), "/")
+	top, links := len(manifest.Layers)-1, 0
+	for {
+		result, err := openLayerFile(ctx, engineExt, manifest.Layers[:top+1], path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open file %s", path)
+		}
+		if result.reader != nil {
+			return result.reader, nil
+		}
+		links++
+		if links > maxSymlinks {
+			return nil, errors.Errorf("open file %s: too many levels of links", path)
+		}
+		top = len(manifest.Layers) - 1
+		if result.link {
+			// Hardlinks refer to a file in the same layer or a lower layer.
+			top = result.layer
+		}
+		event.Log(ctx).Debugf("open file: following link %s -> %s", path, result.target)
+		path = result.target
+	}
+}
+
+// layerFile is the result of looking up a path in a set of layers. Either the
+// file was found (reader is set), or the path refers to a link which has to
+// be looked up instead (target is set).
+type layerFile struct {
+	reader io.ReadCloser
+
+	// target is the path which must be looked up next. If link is true, the
+	// path is a hardlink in the layer with the given index (otherwise it is a
+	// symlink which must be looked up in all of the layers).
+	target string
+	link   bool
+	layer  int
+}
+
+// openLayerFile looks up the given path in the layers, starting with the
+// topmost layer.
+func openLayerFile(ctx context.Context, engine casext.Engine, layers []ispec.Descriptor, path string) (layerFile, error) {
+	for idx := len(layers) - 1; idx >= 0; idx-- {
+		event.Log(ctx).Debugf("open file: searching layer %s", layers[idx].Digest)
+		result, hidden, err := searchLayer(ctx, engine, layers[idx], path)
+		if err != nil {
+			return result, errors.Wrapf(err, "layer %s", layers[idx].Digest)
+		}
+		if result.reader != nil || result.target != "" {
+			result.layer = idx
+			return result, nil
+		}
+		if hidden {
+			break
+		}
+	}
+	return layerFile{}, os.ErrNotExist
+}
+
+// searchLayer looks for the given path in a single layer. If the path isn't
+// in the layer, hidden indicates whether the layer hides the path in any
+// lower layers (with a whiteout, or by replacing a parent directory). If an
+// IndexCache is attached to ctx, the index of the layer is searched instead.
+func searchLayer(ctx context.Context, engine casext.Engine, layerDescriptor ispec.Descriptor, path string) (layerFile, bool, error) {
+	if cache := indexCacheFromContext(ctx); cache != nil {
+		index, err := cache.LayerIndex(ctx, engine, layerDescriptor)
+		if err != nil {
+			return layerFile{}, false, err
+		}
+		entry, result, hidden, err := searchIndex(index, path)
+		if err != nil || entry == nil {
+			return result, hidden, err
+		}
+		if entry.Offset >= 0 {
+			reader, err := openIndexedFile(ctx, engine, layerDescriptor, entry)
+			return layerFile{reader: reader}, false, err
+		}
+		// The contents of the file have to be read from the archive.
+	}
+
+	layer, err := OpenLayer(ctx, engine, layerDescriptor)
+	if err != nil {
+		return layerFile{}, false, err
+	}
+	// The layer is closed along with the returned reader if the file is found.
+	found := false
+	defer func() {
+		if !found {
+			layer.Close()
+		}
+	}()
+
+	hidden := false
+
+	tr := tar.NewReader(layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return layerFile{}, false, errors.Wrap(err, "read next entry")
+		}
+
+		result, ok, hide, err := lookupEntry(newLayerEntry(hdr), path)
+		if err != nil || result.target != "" {
+			return result, false, err
+		}
+		if ok {
+			found = true
+			return layerFile{reader: &fileReader{Reader: tr, layer: layer}}, false, nil
+		}
+		hidden = hidden || hide
+	}
+	return layerFile{}, hidden, nil
+}
+
+// lookupEntry checks whether the given entry of a layer is the given path.
+// If it is a regular file, found is set. If the path has to be looked up
+// again (because the entry is a link, or a symlink replacing a parent
+// directory of the path) the result has the target to look up. Otherwise,
+// hidden indicates whether the entry hides the path in any lower layers.
+func lookupEntry(entry LayerEntry, path string) (result layerFile, found, hidden bool, err error) {
+	name := strings.TrimPrefix(entry.Path, "/")
+
+	// Whiteouts only hide the path in lower layers, so the rest of the layer
+	// still has to be searched.
+	if entry.Whiteout {
+		if entry.Opaque {
+			return layerFile{}, false, isUnder(path, name), nil
+		}
+		return layerFile{}, false, path == name || isUnder(path, name), nil
+	}
+
+	if name == path {
+		switch entry.Type {
+		case "file":
+			return layerFile{}, true, false, nil
+		case "hardlink":
+			return layerFile{target: strings.TrimPrefix(entry.Linkname, "/"), link: true}, false, false, nil
+		case "symlink":
+			return layerFile{target: resolveSymlink(name, entry.Linkname, "")}, false, false, nil
+		case "dir":
+			return layerFile{}, false, false, errors.Errorf("%s is a directory", path)
+		default:
+			return layerFile{}, false, false, errors.Errorf("%s is not a regular file", path)
+		}
+	}
+
+	// A parent directory of the path has been replaced by something other
+	// than a directory.
+	if name != "" && isUnder(path, name) && entry.Type != "dir" {
+		if entry.Type == "symlink" {
+			rest, _ := filepath.Rel(name, path)
+			return layerFile{target: resolveSymlink(name, entry.Linkname, rest)}, false, false, nil
+		}
+		return layerFile{}, false, true, nil
+	}
+	return layerFile{}, false, false, nil
+}
+
+// resolveSymlink returns the path (relative to the root filesystem) referred
+// to by the symlink at the given path, with rest appended to it. Symlinks
+// cannot refer to paths outside of the root filesystem.
+func resolveSymlink(path, linkname, rest string) string {
+	target := linkname
+	if !filepath.IsAbs(target) {
+		target = filepath.Join("/", filepath.Dir(path), target)
+	}
+	return strings.TrimPrefix(filepath.Clean(filepath.Join("/", target, rest)), "/")
+}
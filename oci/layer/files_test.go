@@ -0,0 +1,219 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+type testEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+// putUncompressedLayer adds an uncompressed layer with the given entries to
+// the engine, returning its descriptor.
+func putUncompressedLayer(t *testing.T, engine cas.Engine, entries []testEntry) ispec.Descriptor {
+	var raw bytes.Buffer
+	tw := tar.NewWriter(&raw)
+	for _, entry := range entries {
+		hdr := entry.hdr
+		hdr.Mode = 0644
+		hdr.Size = int64(len(entry.data))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, size, err := engine.PutBlob(context.Background(), &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    digest,
+		Size:      size,
+	}
+}
+
+func TestReadFiles(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+
+	reg := func(name, data string) testEntry {
+		return testEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeReg}, data: data}
+	}
+
+	base := putUncompressedLayer(t, engine, []testEntry{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir}},
+		reg("etc/os-release", "ID=old"),
+		reg("etc/passwd", "root"),
+		reg("var/lib/db/a", "a"),
+		reg("var/lib/db/b", "b"),
+		reg("var/lib/other/c", "c"),
+	})
+	upper := putUncompressedLayer(t, engine, []testEntry{
+		reg("./etc/os-release", "ID=new"),
+		// Whiteouts don't apply to files in the same layer.
+		reg("var/lib/db/d", "d"),
+		reg("var/lib/db/.wh..wh..opq", ""),
+		reg("var/lib/.wh.other", ""),
+		{hdr: tar.Header{Name: "etc/os-release-link", Typeflag: tar.TypeLink, Linkname: "etc/os-release"}},
+	})
+	gzipped, _ := putTestLayer(t, engine, "var/lib/db/e")
+
+	manifest := ispec.Manifest{
+		Layers: []ispec.Descriptor{base, upper, gzipped},
+	}
+	files, err := ReadFiles(ctx, engine, manifest, func(path string) bool {
+		return strings.HasPrefix(path, "etc/os-release") || strings.HasPrefix(path, "var/lib/")
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	expected := map[string][]byte{
+		"etc/os-release":      []byte("ID=new"),
+		"etc/os-release-link": []byte("ID=new"),
+		"var/lib/db/d":        []byte("d"),
+		"var/lib/db/e":        []byte{},
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("unexpected files: got %q, expected %q", files, expected)
+	}
+
+	// Encrypted layers cannot be read.
+	encrypted := base
+	encrypted.MediaType = MediaTypeImageLayerEncrypted
+	manifest.Layers = []ispec.Descriptor{encrypted}
+	if _, err := ReadFiles(ctx, engine, manifest, func(string) bool { return true }); err == nil {
+		t.Errorf("expected error reading encrypted layer")
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+
+	reg := func(name, data string) testEntry {
+		return testEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeReg}, data: data}
+	}
+	symlink := func(name, target string) testEntry {
+		return testEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target}}
+	}
+
+	base := putUncompressedLayer(t, engine, []testEntry{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir}},
+		reg("etc/passwd", "root"),
+		reg("usr/lib/os-release", "ID=old"),
+		reg("var/lib/db/a", "a"),
+		reg("var/lib/other/b", "b"),
+		reg("opt/c", "c"),
+		reg("lib/d", "d"),
+	})
+	upper := putUncompressedLayer(t, engine, []testEntry{
+		reg("./usr/lib/os-release", "ID=new"),
+		symlink("etc/os-release", "../usr/lib/os-release"),
+		{hdr: tar.Header{Name: "etc/passwd-link", Typeflag: tar.TypeLink, Linkname: "etc/passwd"}},
+		reg("var/lib/db/.wh..wh..opq", ""),
+		reg("var/lib/db/e", "e"),
+		reg("var/lib/.wh.other", ""),
+		reg("opt", "not a directory"),
+		symlink("lib", "/usr/lib"),
+		symlink("loop", "loop"),
+	})
+	gzipped, _ := putTestLayer(t, engine, "var/lib/db/f")
+
+	manifest := ispec.Manifest{
+		Layers: []ispec.Descriptor{base, upper, gzipped},
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestOpenFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files are opened the same way using the index of each layer (the second
+	// indexed pass uses the indexes cached by the first).
+	cache := NewIndexCache(dir)
+	for _, ctx := range []context.Context{ctx, WithIndexCache(ctx, cache), WithIndexCache(ctx, cache)} {
+		for _, test := range []struct {
+			path     string
+			expected string
+		}{
+			{"etc/passwd", "root"},
+			{"/etc/passwd", "root"},
+			{"etc/passwd-link", "root"},
+			{"etc/os-release", "ID=new"},
+			{"lib/os-release", "ID=new"},
+			{"var/lib/db/e", "e"},
+			{"var/lib/db/f", ""},
+			{"opt", "not a directory"},
+		} {
+			reader, err := OpenFile(ctx, engine, manifest, test.path)
+			if err != nil {
+				t.Errorf("open %s: unexpected error: %+v", test.path, err)
+				continue
+			}
+			data, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Errorf("read %s: unexpected error: %+v", test.path, err)
+				continue
+			}
+			if string(data) != test.expected {
+				t.Errorf("read %s: got %q, expected %q", test.path, data, test.expected)
+			}
+		}
+
+		// Whited out and replaced files don't exist.
+		for _, path := range []string{"var/lib/db/a", "var/lib/other/b", "opt/c", "lib/d", "nonexistent"} {
+			if _, err := OpenFile(ctx, engine, manifest, path); !os.IsNotExist(errors.Cause(err)) {
+				t.Errorf("open %s: expected os.ErrNotExist, got %v", path, err)
+			}
+		}
+
+		// Only regular files can be opened.
+		for _, path := range []string{"etc", "loop"} {
+			if _, err := OpenFile(ctx, engine, manifest, path); err == nil || os.IsNotExist(errors.Cause(err)) {
+				t.Errorf("open %s: expected error, got %v", path, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"path/filepath"
+	"strings"
+
+	"github.com/openSUSE/umoci/pkg/event"
+)
+
+// pathFilter restricts which entries of a layer are unpacked. It is a set of
+// paths relative to the root (such as "etc" or "usr/bin/foo"), with "" being
+// the root itself. A nil pathFilter includes every entry.
+type pathFilter []string
+
+// newPathFilter returns the pathFilter for the given set of paths (which may
+// be absolute or relative to the root). If paths is empty, nil is returned.
+func newPathFilter(paths []string) pathFilter {
+	var filter pathFilter
+	for _, path := range paths {
+		filter = append(filter, filterPath(path))
+	}
+	return filter
+}
+
+// filterPath converts a path into the form used by pathFilter.
+func filterPath(path string) string {
+	return strings.TrimPrefix(filepath.Clean("/"+path), "/")
+}
+
+// isUnder returns whether path is inside the directory dir (but is not dir
+// itself). Both paths must be in the form used by pathFilter.
+func isUnder(path, dir string) bool {
+	if dir == "" {
+		return path != ""
+	}
+	return strings.HasPrefix(path, dir+"/")
+}
+
+// includes returns whether the given path should be unpacked. This is the
+// case if the path is one of the filtered paths, inside one of them, or one of
+// their parent directories (so that the parent directories are unpacked with
+// the correct metadata).
+func (f pathFilter) includes(path string) bool {
+	if f == nil {
+		return true
+	}
+	path = filterPath(path)
+	for _, filter := range f {
+		if path == filter || isUnder(path, filter) || isUnder(filter, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// includesEntry returns whether the given layer entry should be unpacked.
+// Whiteouts are included if the path they remove is included (an opaque
+// whiteout removes the contents of its directory). Hardlinks to paths which
+// are not included cannot be unpacked, and are skipped with a warning.
+func (f pathFilter) includesEntry(hdr *tar.Header) bool {
+	if f == nil {
+		return true
+	}
+	dir, file := filepath.Split(filterPath(hdr.Name))
+	switch {
+	case file == whOpaque:
+		return f.includes(dir)
+	case strings.HasPrefix(file, whPrefix):
+		return f.includes(filepath.Join(dir, strings.TrimPrefix(file, whPrefix)))
+	case !f.includes(hdr.Name):
+		return false
+	case hdr.Typeflag == tar.TypeLink && !f.includes(hdr.Linkname):
+		event.Default().Warnf("unpack: skipping hardlink %s: target %s is not included by the path filters", hdr.Name, hdr.Linkname)
+		return false
+	}
+	return true
+}
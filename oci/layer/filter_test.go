@@ -0,0 +1,203 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestPathFilterIncludes(t *testing.T) {
+	filter := newPathFilter([]string{"/etc", "usr/bin/foo", "/var/../opt/"})
+
+	for _, test := range []struct {
+		path     string
+		expected bool
+	}{
+		// The filtered paths, and everything inside them.
+		{"etc", true},
+		{"/etc/", true},
+		{"etc/passwd", true},
+		{"etc/ssl/certs/ca.pem", true},
+		{"usr/bin/foo", true},
+		{"opt/app", true},
+		// Their parent directories.
+		{"", true},
+		{"/", true},
+		{"usr", true},
+		{"usr/bin", true},
+		// Everything else.
+		{"etcetera", false},
+		{"usr/bin/foobar", false},
+		{"usr/bin/bar", false},
+		{"usr/lib", false},
+		{"var", false},
+		{"../../var", false},
+	} {
+		if got := filter.includes(test.path); got != test.expected {
+			t.Errorf("includes(%q): expected %v got %v", test.path, test.expected, got)
+		}
+	}
+
+	// A nil filter includes everything.
+	var nilFilter pathFilter
+	if !nilFilter.includes("usr/lib") {
+		t.Errorf("nil filter should include everything")
+	}
+	if newPathFilter(nil) != nil {
+		t.Errorf("filter without paths should be nil")
+	}
+}
+
+func TestPathFilterIncludesEntry(t *testing.T) {
+	filter := newPathFilter([]string{"/etc", "/usr/bin/foo"})
+
+	for _, test := range []struct {
+		hdr      tar.Header
+		expected bool
+	}{
+		{tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg}, true},
+		{tar.Header{Name: "var/log/", Typeflag: tar.TypeDir}, false},
+		// Whiteouts depend on the path they remove.
+		{tar.Header{Name: "etc/" + whPrefix + "hosts", Typeflag: tar.TypeReg}, true},
+		{tar.Header{Name: whPrefix + "usr", Typeflag: tar.TypeReg}, true},
+		{tar.Header{Name: "usr/bin/" + whPrefix + "bar", Typeflag: tar.TypeReg}, false},
+		{tar.Header{Name: "usr/" + whOpaque, Typeflag: tar.TypeReg}, true},
+		{tar.Header{Name: "var/" + whOpaque, Typeflag: tar.TypeReg}, false},
+		// Hardlinks are skipped if their target is not included.
+		{tar.Header{Name: "etc/link", Linkname: "etc/hosts", Typeflag: tar.TypeLink}, true},
+		{tar.Header{Name: "etc/link", Linkname: "var/log/file", Typeflag: tar.TypeLink}, false},
+		{tar.Header{Name: "var/link", Linkname: "etc/hosts", Typeflag: tar.TypeLink}, false},
+		// Symlinks are included regardless of their target.
+		{tar.Header{Name: "etc/symlink", Linkname: "/var/log/file", Typeflag: tar.TypeSymlink}, true},
+	} {
+		hdr := test.hdr
+		if got := filter.includesEntry(&hdr); got != test.expected {
+			t.Errorf("includesEntry(%s -> %s): expected %v got %v", test.hdr.Name, test.hdr.Linkname, test.expected, got)
+		}
+	}
+}
+
+// writeTestLayer writes a layer with the given entries (regular files contain
+// their own path).
+func writeTestLayer(t *testing.T, hdrs []*tar.Header) *bytes.Buffer {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, hdr := range hdrs {
+		var data []byte
+		if hdr.Typeflag == tar.TypeReg {
+			data = []byte(hdr.Name)
+			hdr.Size = int64(len(data))
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		hdr.ModTime = time.Now()
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buffer
+}
+
+func TestUnpackLayerFiltered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerFiltered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lower := writeTestLayer(t, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg},
+		{Name: "etc/hosts", Typeflag: tar.TypeReg},
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0711},
+		{Name: "usr/bin/foo", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "usr/bin/bar", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "usr/lib/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/lib/libfoo.so", Typeflag: tar.TypeReg},
+		{Name: "var/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "var/data", Typeflag: tar.TypeReg},
+	})
+	upper := writeTestLayer(t, []*tar.Header{
+		{Name: "etc/" + whPrefix + "hosts", Typeflag: tar.TypeReg},
+		{Name: "etc/group", Typeflag: tar.TypeReg},
+		{Name: "etc/data", Linkname: "var/data", Typeflag: tar.TypeLink},
+		{Name: "usr/bin/baz", Typeflag: tar.TypeReg},
+	})
+
+	for _, layer := range []*bytes.Buffer{lower, upper} {
+		te := newTarExtractor(MapOptions{Rootless: os.Geteuid() != 0})
+		te.filter = newPathFilter([]string{"/etc", "/usr/bin/foo"})
+		if err := unpackLayer(context.Background(), te, dir, layer); err != nil {
+			t.Fatalf("unexpected error in unpackLayer: %s", err)
+		}
+	}
+
+	for _, path := range []string{"etc/passwd", "etc/group", "usr/bin/foo"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Errorf("included path %s was not unpacked: %s", path, err)
+			continue
+		}
+		if string(data) != path {
+			t.Errorf("included path %s has unexpected contents: %q", path, data)
+		}
+	}
+	for _, path := range []string{"etc/hosts", "etc/data", "usr/bin/bar", "usr/bin/baz", "usr/lib", "var"} {
+		if _, err := os.Lstat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Errorf("path %s should not exist: %v", path, err)
+		}
+	}
+
+	// The parent directories of the included paths must have the metadata
+	// from the layer.
+	fi, err := os.Stat(filepath.Join(dir, "usr", "bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0711 {
+		t.Errorf("parent directory has unexpected mode: %o", fi.Mode().Perm())
+	}
+
+	// A whiteout of a parent directory removes the included paths inside it.
+	te := newTarExtractor(MapOptions{Rootless: os.Geteuid() != 0})
+	te.filter = newPathFilter([]string{"/etc", "/usr/bin/foo"})
+	if err := unpackLayer(context.Background(), te, dir, writeTestLayer(t, []*tar.Header{
+		{Name: whPrefix + "usr", Typeflag: tar.TypeReg},
+	})); err != nil {
+		t.Fatalf("unexpected error in unpackLayer: %s", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "usr")); !os.IsNotExist(err) {
+		t.Errorf("whiteout of parent directory was not applied: %v", err)
+	}
+}
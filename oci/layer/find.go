@@ -0,0 +1,263 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// The kinds of change to a path reported by FindChanges.
+const (
+	// ChangeAdded means the path was added by the layer.
+	ChangeAdded = "added"
+
+	// ChangeModified means the path was replaced by the layer, having been
+	// added by a lower layer.
+	ChangeModified = "modified"
+
+	// ChangeDeleted means the path (added by a lower layer) was removed by
+	// the layer, either by a whiteout of the path (or one of its parent
+	// directories) or by its parent directory being replaced with a
+	// non-directory.
+	ChangeDeleted = "deleted"
+
+	// ChangeOpaque means the layer contains an opaque whiteout for the path,
+	// hiding the contents of the directory from lower layers.
+	ChangeOpaque = "opaque"
+)
+
+// FindResult describes a change to a path, as reported by FindChanges and
+// FindEffective.
+type FindResult struct {
+	// Path is the (cleaned, absolute) path which was changed.
+	Path string `json:"path"`
+
+	// Change is the kind of change (one of the Change* constants).
+	Change string `json:"change"`
+
+	// Layer is the index of the layer in the manifest (with 0 being the
+	// bottom layer), and LayerDigest is its digest.
+	Layer       int           `json:"layer"`
+	LayerDigest digest.Digest `json:"layer_digest"`
+
+	// Entry is the entry of the layer which added or modified the path. It
+	// is nil for deleted paths.
+	Entry *LayerEntry `json:"entry,omitempty"`
+}
+
+// finder tracks the paths matching a predicate as the layers of an image are
+// applied on top of each other.
+type finder struct {
+	match func(path string) bool
+
+	// effective maps the matching paths present in the root filesystem (as of
+	// the last applied layer) to the change which last added them, and
+	// parents counts the paths in effective under each directory.
+	effective map[string]FindResult
+	parents   map[string]int
+}
+
+func newFinder(match func(path string) bool) *finder {
+	return &finder{
+		match:     match,
+		effective: map[string]FindResult{},
+		parents:   map[string]int{},
+	}
+}
+
+// ancestors returns the parent directories of the given path.
+func ancestors(path string) []string {
+	var dirs []string
+	for path != "/" {
+		path = filepath.Dir(path)
+		dirs = append(dirs, path)
+	}
+	return dirs
+}
+
+// add tracks the path changed by the given result.
+func (f *finder) add(result FindResult) {
+	if _, ok := f.effective[result.Path]; !ok {
+		for _, dir := range ancestors(result.Path) {
+			f.parents[dir]++
+		}
+	}
+	f.effective[result.Path] = result
+}
+
+// isUnderPath is isUnder for (cleaned, absolute) LayerEntry paths.
+func isUnderPath(path, dir string) bool {
+	return isUnder(filterPath(path), filterPath(dir))
+}
+
+// remove removes the tracked paths for which fn returns true, returning the
+// removed paths in sorted order.
+func (f *finder) remove(fn func(path string) bool) []string {
+	var removed []string
+	for path := range f.effective {
+		if fn(path) {
+			removed = append(removed, path)
+			delete(f.effective, path)
+			for _, dir := range ancestors(path) {
+				if f.parents[dir]--; f.parents[dir] == 0 {
+					delete(f.parents, dir)
+				}
+			}
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// apply applies the given layer, returning the changes it made to matching
+// paths. Whiteouts only apply to lower layers, so they are applied before any
+// of the other entries of the layer (regardless of where they are in the
+// layer).
+func (f *finder) apply(ctx context.Context, engine casext.Engine, idx int, layerDescriptor ispec.Descriptor) ([]FindResult, error) {
+	var whiteouts, entries []LayerEntry
+	if err := ListLayer(ctx, engine, layerDescriptor, func(entry LayerEntry) error {
+		switch {
+		case entry.Whiteout:
+			// Whiteouts have to be kept even if they don't match, since they
+			// may remove matching paths inside a directory.
+			whiteouts = append(whiteouts, entry)
+		case f.match(entry.Path):
+			entries = append(entries, entry)
+		case entry.Type != "dir" && f.parents[entry.Path] > 0:
+			// Replacing a directory with a non-directory also removes its
+			// contents, so we need to know about those too.
+			entries = append(entries, entry)
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "list layer %s", layerDescriptor.Digest)
+	}
+
+	var changes []FindResult
+	change := func(path, kind string, entry *LayerEntry) {
+		changes = append(changes, FindResult{
+			Path:        path,
+			Change:      kind,
+			Layer:       idx,
+			LayerDigest: layerDescriptor.Digest,
+			Entry:       entry,
+		})
+	}
+
+	for _, whiteout := range whiteouts {
+		dir := whiteout.Path
+		if whiteout.Opaque {
+			if f.match(dir) {
+				change(dir, ChangeOpaque, nil)
+			}
+		} else if _, ok := f.effective[dir]; !ok && f.match(dir) {
+			// Report the whiteout even if it doesn't remove anything we know
+			// about, since it is still part of the layer.
+			change(dir, ChangeDeleted, nil)
+		}
+		if _, ok := f.effective[dir]; !ok && f.parents[dir] == 0 {
+			continue
+		}
+		for _, path := range f.remove(func(path string) bool {
+			return isUnderPath(path, dir) || (!whiteout.Opaque && path == dir)
+		}) {
+			change(path, ChangeDeleted, nil)
+		}
+	}
+
+	for i := range entries {
+		entry := entries[i]
+		if entry.Type != "dir" && f.parents[entry.Path] > 0 {
+			for _, path := range f.remove(func(path string) bool { return isUnderPath(path, entry.Path) }) {
+				change(path, ChangeDeleted, nil)
+			}
+		}
+		if !f.match(entry.Path) {
+			continue
+		}
+		kind := ChangeAdded
+		if _, ok := f.effective[entry.Path]; ok {
+			kind = ChangeModified
+		}
+		change(entry.Path, kind, &entry)
+		f.add(changes[len(changes)-1])
+	}
+	return changes, nil
+}
+
+// findLayers applies each of the layers of the given manifest (from the
+// bottom layer up), calling fn with the changes made by each layer.
+func (f *finder) findLayers(ctx context.Context, engine casext.Engine, manifest ispec.Manifest, fn func([]FindResult) error) error {
+	ctx, err := casext.WithManifestLayerChunks(ctx, manifest)
+	if err != nil {
+		return errors.Wrap(err, "get chunked layers")
+	}
+	for idx, layerDescriptor := range manifest.Layers {
+		changes, err := f.apply(ctx, engine, idx, layerDescriptor)
+		if err != nil {
+			return err
+		}
+		if err := fn(changes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindChanges searches the layers of the given manifest for paths for which
+// match returns true, and calls fn for each change made to such a path by a
+// layer (from the bottom layer up, with the deletions made by a layer being
+// reported before its other changes). This makes it possible to find which
+// layer introduced (or deleted) a path. If fn returns an error, the search
+// stops and the error is returned.
+func FindChanges(ctx context.Context, engine casext.Engine, manifest ispec.Manifest, match func(path string) bool, fn func(FindResult) error) error {
+	f := newFinder(match)
+	return f.findLayers(ctx, engine, manifest, func(changes []FindResult) error {
+		for _, change := range changes {
+			if err := fn(change); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FindEffective searches the root filesystem of the given manifest (as it
+// would be unpacked) for paths for which match returns true, returning the
+// change made by the layer which last added (or modified) each path. The
+// results are sorted by path.
+func FindEffective(ctx context.Context, engine casext.Engine, manifest ispec.Manifest, match func(path string) bool) ([]FindResult, error) {
+	f := newFinder(match)
+	if err := f.findLayers(ctx, engine, manifest, func([]FindResult) error { return nil }); err != nil {
+		return nil, err
+	}
+
+	results := []FindResult{}
+	for _, result := range f.effective {
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
+	return results, nil
+}
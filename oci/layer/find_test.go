@@ -0,0 +1,134 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// putTarLayer adds an uncompressed layer containing the given (empty) entries
+// to the engine. Names ending in "/" are directories, and "name->target" is a
+// symlink.
+func putTarLayer(t *testing.T, engine cas.Engine, names ...string) ispec.Descriptor {
+	var raw bytes.Buffer
+	tw := tar.NewWriter(&raw)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg}
+		if parts := strings.SplitN(name, "->", 2); len(parts) == 2 {
+			hdr.Name, hdr.Linkname, hdr.Typeflag = parts[0], parts[1], tar.TypeSymlink
+		} else if strings.HasSuffix(name, "/") {
+			hdr.Mode, hdr.Typeflag = 0755, tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, size, err := engine.PutBlob(context.Background(), &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    digest,
+		Size:      size,
+	}
+}
+
+func TestFind(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+
+	manifest := ispec.Manifest{
+		Layers: []ispec.Descriptor{
+			putTarLayer(t, engine, "usr/", "usr/lib/", "usr/lib/a.so", "usr/lib/b.so", "etc/", "etc/c.so", "opt/", "opt/d.so"),
+			// Whiteouts only apply to lower layers, wherever they are in the
+			// layer. Replacing /opt with a file removes /opt/d.so.
+			putTarLayer(t, engine, "usr/lib/b.so", "etc/e.so", "usr/lib/.wh.a.so", "etc/.wh..wh..opq", "opt"),
+			putTarLayer(t, engine, ".wh.usr", ".wh.ghost.so", "x.so->etc/e.so"),
+		},
+	}
+	match := func(path string) bool {
+		matched, _ := filepath.Match("*.so", filepath.Base(path))
+		return matched
+	}
+
+	var changes []string
+	if err := FindChanges(ctx, casext.Engine{engine}, manifest, match, func(result FindResult) error {
+		if result.LayerDigest != manifest.Layers[result.Layer].Digest {
+			t.Errorf("unexpected layer digest for %s: expected %s got %s", result.Path, manifest.Layers[result.Layer].Digest, result.LayerDigest)
+		}
+		if (result.Entry == nil) != (result.Change == ChangeDeleted) {
+			t.Errorf("unexpected entry for %s %s: %+v", result.Change, result.Path, result.Entry)
+		}
+		changes = append(changes, fmt.Sprintf("%d %s %s", result.Layer, result.Change, result.Path))
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error finding changes: %+v", err)
+	}
+
+	expected := []string{
+		"0 added /usr/lib/a.so",
+		"0 added /usr/lib/b.so",
+		"0 added /etc/c.so",
+		"0 added /opt/d.so",
+		"1 deleted /usr/lib/a.so",
+		"1 deleted /etc/c.so",
+		"1 modified /usr/lib/b.so",
+		"1 added /etc/e.so",
+		"1 deleted /opt/d.so",
+		"2 deleted /usr/lib/b.so",
+		"2 deleted /ghost.so",
+		"2 added /x.so",
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("unexpected changes:\nexpected: %q\n     got: %q", expected, changes)
+	}
+
+	results, err := FindEffective(ctx, casext.Engine{engine}, manifest, match)
+	if err != nil {
+		t.Fatalf("unexpected error finding effective paths: %+v", err)
+	}
+	var effective []string
+	for _, result := range results {
+		effective = append(effective, fmt.Sprintf("%d %s %s", result.Layer, result.Change, result.Path))
+	}
+	expected = []string{
+		"1 added /etc/e.so",
+		"2 added /x.so",
+	}
+	if !reflect.DeepEqual(effective, expected) {
+		t.Errorf("unexpected effective paths:\nexpected: %q\n     got: %q", expected, effective)
+	}
+}
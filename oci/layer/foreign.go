@@ -0,0 +1,177 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ForeignLayerPolicy specifies how non-distributable ("foreign") layers (see
+// casext.IsForeignLayerType) are handled if their blobs are not present in
+// the image. Foreign layers whose blobs are present are always used as-is.
+type ForeignLayerPolicy string
+
+const (
+	// ForeignLayerError causes ErrForeignLayer to be returned. This is the
+	// default.
+	ForeignLayerError ForeignLayerPolicy = "error"
+
+	// ForeignLayerSkip causes the layer to be skipped, as though it wasn't
+	// part of the image. The DiffID of the layer is not verified.
+	ForeignLayerSkip ForeignLayerPolicy = "skip"
+
+	// ForeignLayerFetch causes the blob to be downloaded from the URLs in the
+	// layer's descriptor (which must be http or https URLs), trying each URL
+	// in order. The downloaded blob is verified against the descriptor, but
+	// is not stored in the image.
+	ForeignLayerFetch ForeignLayerPolicy = "fetch"
+)
+
+// Validate returns an error if the ForeignLayerPolicy is unknown. The empty
+// policy is the same as ForeignLayerError.
+func (p ForeignLayerPolicy) Validate() error {
+	switch p {
+	case "", ForeignLayerError, ForeignLayerSkip, ForeignLayerFetch:
+		return nil
+	}
+	return errors.Errorf("unknown foreign layer policy: %s", p)
+}
+
+// ErrForeignLayer is returned when the contents of a foreign layer are
+// required, but its blob is not present in the image (and the
+// ForeignLayerPolicy doesn't allow it to be downloaded).
+var ErrForeignLayer = errors.New("foreign layer blob is not present in the image")
+
+// foreignLayerClient is the client used to download foreign layers.
+var foreignLayerClient = http.DefaultClient
+
+// openLayerBlob returns a reader for the (possibly compressed) blob of the
+// given layer. If the layer is a foreign layer whose blob is not present in
+// the image, it is handled according to policy -- if it is to be skipped, a
+// nil reader is returned.
+func openLayerBlob(ctx context.Context, engine casext.Engine, descriptor ispec.Descriptor, policy ForeignLayerPolicy) (io.ReadCloser, error) {
+	layerBlob, err := engine.FromDescriptor(ctx, descriptor)
+	if err == nil {
+		reader, ok := layerBlob.Data.(io.ReadCloser)
+		if !ok {
+			layerBlob.Close()
+			// Should _never_ be reached.
+			return nil, errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+		}
+		return reader, nil
+	}
+	if !casext.IsForeignLayerType(descriptor.MediaType) || !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Wrap(err, "get layer blob")
+	}
+
+	switch policy {
+	case ForeignLayerSkip:
+		event.Log(ctx).Warnf("skipping foreign layer %s: blob is not present in the image", descriptor.Digest)
+		return nil, nil
+	case ForeignLayerFetch:
+		return fetchForeignLayer(ctx, descriptor)
+	}
+	return nil, errors.Wrapf(ErrForeignLayer, "layer %s", descriptor.Digest)
+}
+
+// fetchForeignLayer downloads the blob of the given foreign layer from the
+// first of its URLs that works. The blob is verified against the descriptor
+// as it is read, and a mismatch is reported (instead of io.EOF) once the end
+// of the blob is reached.
+func fetchForeignLayer(ctx context.Context, descriptor ispec.Descriptor) (io.ReadCloser, error) {
+	if len(descriptor.URLs) == 0 {
+		return nil, errors.Wrapf(ErrForeignLayer, "layer %s has no urls to fetch it from", descriptor.Digest)
+	}
+
+	var lastErr error
+	for _, rawURL := range descriptor.URLs {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			lastErr = errors.Wrapf(err, "parse url %q", rawURL)
+			continue
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			lastErr = errors.Errorf("unsupported url scheme %q: %s", u.Scheme, rawURL)
+			continue
+		}
+
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			lastErr = errors.Wrapf(err, "create request for %s", rawURL)
+			continue
+		}
+		event.Log(ctx).Infof("fetching foreign layer %s from %s", descriptor.Digest, rawURL)
+		resp, err := foreignLayerClient.Do(req.WithContext(ctx))
+		if err != nil {
+			lastErr = errors.Wrapf(err, "fetch %s", rawURL)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			lastErr = errors.Errorf("fetch %s: unexpected status: %s", rawURL, resp.Status)
+			continue
+		}
+		return &verifiedReader{
+			ReadCloser: resp.Body,
+			descriptor: descriptor,
+			verifier:   descriptor.Digest.Verifier(),
+		}, nil
+	}
+	return nil, errors.Wrapf(lastErr, "fetch foreign layer %s", descriptor.Digest)
+}
+
+// verifiedReader is an io.ReadCloser which verifies that the blob read from
+// it matches the given descriptor.
+type verifiedReader struct {
+	io.ReadCloser
+	descriptor ispec.Descriptor
+	verifier   digest.Verifier
+	size       int64
+}
+
+func (r *verifiedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if excess := r.size + int64(n) - r.descriptor.Size; excess > 0 {
+		// Never return data beyond the end of the blob, so that the caller
+		// sees our error rather than trying to make sense of the excess.
+		n -= int(excess)
+		err = errors.Errorf("blob %s is larger than %d bytes", r.descriptor.Digest, r.descriptor.Size)
+	}
+	r.verifier.Write(p[:n])
+	r.size += int64(n)
+	if err == io.EOF {
+		if r.size != r.descriptor.Size {
+			return n, errors.Errorf("blob %s has size %d rather than %d", r.descriptor.Digest, r.size, r.descriptor.Size)
+		}
+		if !r.verifier.Verified() {
+			return n, errors.Wrapf(cas.ErrDigestMismatch, "blob %s", r.descriptor.Digest)
+		}
+	}
+	return n, err
+}
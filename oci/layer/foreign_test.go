@@ -0,0 +1,112 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestForeignLayers(t *testing.T) {
+	ctx := context.Background()
+
+	// The blob of the foreign layer is only available from the server.
+	remote := mem.New()
+	defer remote.Close()
+	foreign, diffID := putTestLayer(t, remote, "foreign")
+	foreign.MediaType = ispec.MediaTypeImageLayerNonDistributableGzip
+	reader, err := remote.GetBlob(ctx, foreign.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layer":
+			w.Write(blob)
+		case "/corrupt":
+			w.Write(blob)
+			w.Write([]byte("trailing garbage"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	engine := mem.New()
+	defer engine.Close()
+	layer, layerDiffID := putTestLayer(t, engine, "local")
+	config := ispec.Image{
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []string{layerDiffID, diffID},
+		},
+	}
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		urls   []string
+		policy ForeignLayerPolicy
+		err    string
+	}{
+		{"Default", []string{server.URL + "/layer"}, "", "foreign layer blob is not present"},
+		{"Error", []string{server.URL + "/layer"}, ForeignLayerError, "foreign layer blob is not present"},
+		{"Skip", nil, ForeignLayerSkip, ""},
+		{"Fetch", []string{server.URL + "/layer"}, ForeignLayerFetch, ""},
+		{"FetchFallback", []string{"ftp://example.com/layer", server.URL + "/missing", server.URL + "/layer"}, ForeignLayerFetch, ""},
+		{"FetchNoURLs", nil, ForeignLayerFetch, "no urls"},
+		{"FetchMissing", []string{server.URL + "/missing"}, ForeignLayerFetch, "unexpected status"},
+		{"FetchCorrupt", []string{server.URL + "/corrupt"}, ForeignLayerFetch, "is larger than"},
+		{"Invalid", nil, "bogus", "unknown foreign layer policy"},
+	} {
+		descriptor := foreign
+		descriptor.URLs = test.urls
+		manifest := ispec.Manifest{
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+			Layers: []ispec.Descriptor{layer, descriptor},
+		}
+
+		err := VerifyDiffIDsWithOptions(ctx, engine, manifest, VerifyOptions{ForeignLayers: test.policy})
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+}
@@ -18,13 +18,21 @@
 package layer
 
 import (
+	"compress/gzip"
 	"io"
+	"os"
 	"path/filepath"
 	"sort"
+	"time"
 
-	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
 )
 
 // NOTE: This currently requires a version of go-mtree which has my Compare()
@@ -40,29 +48,205 @@ func (ids inodeDeltas) Len() int           { return len(ids) }
 func (ids inodeDeltas) Less(i, j int) bool { return ids[i].Path() < ids[j].Path() }
 func (ids inodeDeltas) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
 
+// insideRemoved returns whether any of the parent directories of name are in
+// the set of removed paths.
+func insideRemoved(removed map[string]struct{}, name string) bool {
+	for parent := filepath.Dir(CleanPath(name)); parent != "." && parent != "/"; parent = filepath.Dir(parent) {
+		if _, ok := removed[parent]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WhiteoutMode specifies how paths which have been removed from the rootfs
+// are represented in a generated layer.
+type WhiteoutMode string
+
+const (
+	// WhiteoutAUFS represents removed paths with AUFS-style ".wh.<name>"
+	// entries, as described by the OCI image-spec. This is the default.
+	WhiteoutAUFS WhiteoutMode = "aufs"
+
+	// WhiteoutOverlay represents removed paths with overlayfs-style
+	// whiteouts (0:0 character devices with the name of the removed path).
+	// Such layers are not OCI-compliant, but are understood by consumers
+	// which extract layers directly into overlayfs lower directories.
+	WhiteoutOverlay WhiteoutMode = "overlayfs"
+
+	// WhiteoutReject causes layer generation to fail if any paths have been
+	// removed, for consumers which don't understand any whiteouts.
+	WhiteoutReject WhiteoutMode = "reject"
+)
+
+// RepackOptions specifies how GenerateLayer generates a layer.
+type RepackOptions struct {
+	// MapOptions is the set of mapping options used when generating the layer.
+	MapOptions
+
+	// Reproducible specifies that the generated layer must only depend on the
+	// contents of the filesystem. Timestamps are truncated to seconds (with
+	// atime and ctime removed), owner names are dropped and whiteouts are
+	// given a fixed timestamp, so that the same rootfs always yields the same
+	// layer.
+	Reproducible bool
+
+	// SourceDateEpoch, if non-nil, is the maximum timestamp of any entry in
+	// a reproducible layer. Later timestamps are clamped to SourceDateEpoch,
+	// and it is used as the timestamp of whiteouts. It is ignored unless
+	// Reproducible is set.
+	SourceDateEpoch *time.Time
+
+	// ClampMtime, if non-nil, is the maximum modification time of any entry
+	// in the layer (including whiteouts). Unlike SourceDateEpoch it does not
+	// require Reproducible, and no other part of the entries is modified.
+	ClampMtime *time.Time
+
+	// WhiteoutMode is how paths which have been removed are represented in
+	// the layer. The default is WhiteoutAUFS.
+	WhiteoutMode WhiteoutMode
+
+	// XattrPolicies specifies how the security xattrs in the rootfs are
+	// included in the layer. By default security.selinux is stripped and the
+	// other xattrs are preserved.
+	XattrPolicies XattrPolicies
+
+	// NoSparse causes regular files with holes to be written as regular
+	// entries (with the holes filled with zeroes), rather than as sparse files
+	// using the PAX 1.0 sparse format of GNU tar. It is implied by
+	// LayerFormatEstargz, as the table of contents of an eStargz layer cannot
+	// describe sparse files.
+	NoSparse bool
+
+	// LayerFormat is the format of the layer blobs produced by NewCompressor.
+	// The default is LayerFormatGzip.
+	LayerFormat LayerFormat
+
+	// CompressionLevel is the gzip compression level (as defined by
+	// compress/gzip) used by NewCompressor. If zero, gzip.DefaultCompression
+	// is used.
+	CompressionLevel int
+
+	// CompressionJobs is the number of blocks compressed concurrently by
+	// NewCompressor (see NewGzipWriter). If less than two, the layer is
+	// compressed by a single goroutine. It is ignored for eStargz layers.
+	CompressionJobs int
+
+	// DroppedXattrs are the xattrs which were dropped when the rootfs was
+	// unpacked in rootless mode (see UnpackOptions.DroppedXattrs). They are
+	// included in the entries generated for the corresponding paths, unless
+	// the path has the xattr set.
+	DroppedXattrs DroppedXattrs
+
+	// OwnerNames, if non-nil, is used to set the user and group names of
+	// every entry in the layer from its (container) owner, rather than
+	// looking them up on the host. Owners without a name are given an empty
+	// name. Since the names don't depend on the host, they are kept even if
+	// Reproducible is set.
+	OwnerNames *OwnerNames
+
+	// Filters are applied (in order) to every entry of the layer other than
+	// whiteouts, so that image policies (such as not including caches or
+	// host-specific xattrs) can be enforced as the layer is generated. See
+	// TarFilter and ParseTarFilter.
+	Filters []TarFilter
+}
+
+// NewCompressor returns a writer which compresses the generated layer (with
+// the compression options in RepackOptions) and writes it to w, in the format
+// given by LayerFormat. It is intended to be used with
+// mutate.Mutator.SetCompressor.
+func (opt RepackOptions) NewCompressor(w io.Writer) (io.WriteCloser, error) {
+	if err := opt.LayerFormat.Validate(); err != nil {
+		return nil, err
+	}
+	level := opt.CompressionLevel
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	if opt.LayerFormat == LayerFormatEstargz {
+		return newEstargzWriter(w, level), nil
+	}
+	return NewGzipWriter(w, level, opt.CompressionJobs)
+}
+
 // GenerateLayer creates a new OCI diff layer based on the mtree diff provided.
 // All of the mtree.Modified and mtree.Extra blobs are read relative to the
 // provided path (which should be the rootfs of the layer that was diffed). The
 // returned reader is for the *raw* tar data, it is the caller's responsibility
-// to gzip it.
-func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.ReadCloser, error) {
-	var mapOptions MapOptions
+// to gzip it. If ctx is done before the layer has been generated, reading from
+// the returned reader fails with the error of the context.
+func GenerateLayer(ctx context.Context, path string, deltas []mtree.InodeDelta, opt *RepackOptions) (io.ReadCloser, error) {
+	return generateLayer(ctx, path, deltas, opt, nil)
+}
+
+// GenerateMetadataLayer is like GenerateLayer, except that the contents of
+// regular files which only had their metadata modified (according to the
+// mtree diff) are copied from the layers of the given image manifest, rather
+// than being read from path. The deltas should have been generated with
+// StatKeywords, so that the contents of the rootfs are not read at all unless
+// files were added or resized. This is much faster for metadata-only changes
+// (such as chown or chmod) to large files. Files which cannot be found in the
+// layers are read from path as usual.
+func GenerateMetadataLayer(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, path string, deltas []mtree.InodeDelta, opt *RepackOptions) (io.ReadCloser, error) {
+	ctx, err := casext.WithManifestLayerChunks(ctx, manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "get chunked layers")
+	}
+	contents := &layerContents{
+		ctx:    ctx,
+		engine: casext.Engine{engine},
+		layers: manifest.Layers,
+	}
+	return generateLayer(ctx, path, deltas, opt, contents)
+}
+
+// generateLayer implements GenerateLayer and GenerateMetadataLayer. If
+// contents is nil, the contents of every file are read from path.
+func generateLayer(ctx context.Context, path string, deltas []mtree.InodeDelta, opt *RepackOptions, contents *layerContents) (io.ReadCloser, error) {
+	var repackOptions RepackOptions
 	if opt != nil {
-		mapOptions = *opt
+		repackOptions = *opt
+	}
+
+	switch repackOptions.WhiteoutMode {
+	case "", WhiteoutAUFS, WhiteoutOverlay, WhiteoutReject:
+	default:
+		return nil, errors.Errorf("unknown whiteout mode: %s", repackOptions.WhiteoutMode)
 	}
+	if err := repackOptions.XattrPolicies.Validate(); err != nil {
+		return nil, errors.Wrap(err, "generate layer")
+	}
+
+	// The layer is generated in the background, so the span only ends once
+	// the whole layer has been written to the pipe.
+	ctx, span := event.StartSpan(ctx, "layer.GenerateLayer")
+	span.SetAttribute("ndelta", len(deltas))
+	span.SetAttribute("metadata_only", contents != nil)
 
 	reader, writer := io.Pipe()
 
 	go func() (Err error) {
 		// Close with the returned error.
 		defer func() {
+			span.End(Err)
 			writer.CloseWithError(errors.Wrap(Err, "generate layer"))
 		}()
 
 		// We can't just dump all of the file contents into a tar file. We need
 		// to emulate a proper tar generator. Luckily there aren't that many
 		// things to emulate (and we can do them all in tar.go).
-		tg := newTarGenerator(writer, mapOptions)
+		tg := newTarGenerator(writer, repackOptions.MapOptions)
+		tg.reproducible = repackOptions.Reproducible
+		tg.sourceDateEpoch = repackOptions.SourceDateEpoch
+		tg.clampMtime = repackOptions.ClampMtime
+		tg.whiteoutMode = repackOptions.WhiteoutMode
+		tg.xattrPolicies = repackOptions.XattrPolicies
+		tg.noSparse = repackOptions.NoSparse || repackOptions.LayerFormat == LayerFormatEstargz
+		tg.droppedXattrs = repackOptions.DroppedXattrs
+		tg.ownerNames = repackOptions.OwnerNames
+		tg.filters = repackOptions.Filters
+		tg.ctx = ctx
 
 		// Sort the delta paths.
 		// FIXME: We need to add whiteouts first, otherwise we might end up
@@ -70,7 +254,20 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 		//        meant to modify.
 		sort.Sort(inodeDeltas(deltas))
 
+		// A whiteout of a directory already hides everything inside it (and an
+		// entry inside a whited-out directory would implicitly re-create the
+		// directory), so the whiteouts of paths inside a removed directory are
+		// skipped.
+		removed := map[string]struct{}{}
+
+		// Files whose contents will be copied from the image's layers, once
+		// all of the other deltas have been added.
+		var unchanged []string
+
 		for _, delta := range deltas {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			name := delta.Path()
 			fullPath := filepath.Join(path, name)
 
@@ -80,20 +277,35 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 
 			switch delta.Type() {
 			case mtree.Modified, mtree.Extra:
+				if contents != nil && delta.Type() == mtree.Modified && isMetadataDelta(delta) {
+					unchanged = append(unchanged, name)
+					continue
+				}
 				if err := tg.AddFile(name, fullPath); err != nil {
-					log.Warnf("generate layer: could not add file '%s': %s", name, err)
+					event.Log(ctx).Warnf("generate layer: could not add file '%s': %s", name, err)
 					return errors.Wrap(err, "generate layer file")
 				}
 			case mtree.Missing:
+				if insideRemoved(removed, name) {
+					continue
+				}
+				removed[CleanPath(name)] = struct{}{}
 				if err := tg.AddWhiteout(name); err != nil {
-					log.Warnf("generate layer: could not add whiteout '%s': %s", name, err)
+					event.Log(ctx).Warnf("generate layer: could not add whiteout '%s': %s", name, err)
 					return errors.Wrap(err, "generate whiteout layer file")
 				}
 			}
 		}
 
+		if len(unchanged) > 0 {
+			if err := contents.addFiles(tg, path, unchanged); err != nil {
+				event.Log(ctx).Warnf("generate layer: could not add unchanged files: %s", err)
+				return errors.Wrap(err, "generate layer unchanged files")
+			}
+		}
+
 		if err := tg.tw.Close(); err != nil {
-			log.Warnf("generate layer: could not close tar.Writer: %s", err)
+			event.Log(ctx).Warnf("generate layer: could not close tar.Writer: %s", err)
 			return errors.Wrap(err, "close tar writer")
 		}
 
@@ -102,3 +314,164 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 
 	return reader, nil
 }
+
+// GenerateFullLayer creates a new OCI layer that contains the entire
+// filesystem tree at the provided path (which should be a rootfs), as though
+// every inode had been added. This is used to create a layer which does not
+// depend on any other layers (such as when squashing an image). The returned
+// reader is for the *raw* tar data, it is the caller's responsibility to gzip
+// it.
+func GenerateFullLayer(ctx context.Context, path string, opt *RepackOptions) (io.ReadCloser, error) {
+	var repackOptions RepackOptions
+	if opt != nil {
+		repackOptions = *opt
+	}
+
+	var fsEval fseval.FsEval = fseval.DefaultFsEval
+	if repackOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+
+	deltas, err := fullDeltas(ctx, path, fsEval)
+	if err != nil {
+		return nil, err
+	}
+	return GenerateLayer(ctx, path, deltas, &repackOptions)
+}
+
+// GenerateInsertLayer is like GenerateFullLayer, except that the directory at
+// the provided path is itself not included in the layer (only its contents
+// are). This is used to add a directory tree to an existing image without
+// changing the metadata of the root directory of the image.
+func GenerateInsertLayer(ctx context.Context, path string, opt *RepackOptions) (io.ReadCloser, error) {
+	var repackOptions RepackOptions
+	if opt != nil {
+		repackOptions = *opt
+	}
+
+	var fsEval fseval.FsEval = fseval.DefaultFsEval
+	if repackOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+
+	deltas, err := fullDeltas(ctx, path, fsEval)
+	if err != nil {
+		return nil, err
+	}
+	var contents []mtree.InodeDelta
+	for _, delta := range deltas {
+		if filepath.Clean(delta.Path()) != "." {
+			contents = append(contents, delta)
+		}
+	}
+	return GenerateLayer(ctx, path, contents, &repackOptions)
+}
+
+// contextFsEval is an mtree.FsEval which fails with the error of its context
+// once the context is done, so that mtree walks can be cancelled.
+type contextFsEval struct {
+	mtree.FsEval
+	ctx context.Context
+}
+
+func (fs contextFsEval) Open(path string) (*os.File, error) {
+	if err := fs.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return fs.FsEval.Open(path)
+}
+
+func (fs contextFsEval) Lstat(path string) (os.FileInfo, error) {
+	if err := fs.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return fs.FsEval.Lstat(path)
+}
+
+func (fs contextFsEval) Readdir(path string) ([]os.FileInfo, error) {
+	if err := fs.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return fs.FsEval.Readdir(path)
+}
+
+// WalkContext is mtree.Walk, except that the walk stops (with the error of the
+// context) once ctx is done.
+func WalkContext(ctx context.Context, root string, excludes []mtree.ExcludeFunc, keywords []mtree.Keyword, fsEval mtree.FsEval) (*mtree.DirectoryHierarchy, error) {
+	if fsEval == nil {
+		fsEval = mtree.DefaultFsEval{}
+	}
+	dh, err := mtree.Walk(root, excludes, keywords, contextFsEval{FsEval: fsEval, ctx: ctx})
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return nil, ctxErr
+	}
+	return dh, err
+}
+
+// fullDeltas returns the set of mtree deltas for the filesystem tree at the
+// provided path, as though every inode had been added.
+func fullDeltas(ctx context.Context, path string, fsEval fseval.FsEval) ([]mtree.InodeDelta, error) {
+	// Compare the rootfs against an empty hierarchy, so that every inode is
+	// treated as an addition.
+	keywords := []mtree.Keyword{"type"}
+	dh, err := WalkContext(ctx, path, nil, keywords, fsEval)
+	if err != nil {
+		return nil, errors.Wrap(err, "walk rootfs")
+	}
+	deltas, err := mtree.Compare(&mtree.DirectoryHierarchy{}, dh, keywords)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute rootfs deltas")
+	}
+	return deltas, nil
+}
+
+// diffKeywords is the set of mtree keywords used by GenerateDiff to detect
+// modified inodes. It matches the set of keywords used by umoci-unpack(1) and
+// umoci-repack(1).
+var diffKeywords = []mtree.Keyword{
+	"size",
+	"type",
+	"uid",
+	"gid",
+	"mode",
+	"link",
+	"nlink",
+	"tar_time",
+	"sha256digest",
+	"xattr",
+}
+
+// GenerateDiff creates a new OCI diff layer which contains the changes made
+// to the filesystem tree at oldRoot in order to produce the filesystem tree
+// at newRoot (including whiteouts for removed inodes). Unlike GenerateLayer,
+// this does not require an mtree manifest of the original tree, and so can be
+// used to build layers from arbitrary directories. Note that because all
+// metadata is compared (including modification times), the two trees should
+// be related (for instance, newRoot should have been created by copying
+// oldRoot while preserving metadata). The returned reader is for the *raw*
+// tar data, it is the caller's responsibility to gzip it.
+func GenerateDiff(ctx context.Context, oldRoot, newRoot string, opt *RepackOptions) (io.ReadCloser, error) {
+	var repackOptions RepackOptions
+	if opt != nil {
+		repackOptions = *opt
+	}
+
+	var fsEval fseval.FsEval = fseval.DefaultFsEval
+	if repackOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+
+	oldDh, err := WalkContext(ctx, oldRoot, nil, diffKeywords, fsEval)
+	if err != nil {
+		return nil, errors.Wrap(err, "walk old root")
+	}
+	newDh, err := WalkContext(ctx, newRoot, nil, diffKeywords, fsEval)
+	if err != nil {
+		return nil, errors.Wrap(err, "walk new root")
+	}
+	deltas, err := mtree.Compare(oldDh, newDh, diffKeywords)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute deltas")
+	}
+	return GenerateLayer(ctx, newRoot, deltas, &repackOptions)
+}
@@ -24,9 +24,13 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
 )
 
 func TestGenerate(t *testing.T) {
@@ -74,7 +78,7 @@ func TestGenerate(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	reader, err := GenerateLayer(dir, diffs, &MapOptions{})
+	reader, err := GenerateLayer(context.Background(), dir, diffs, &RepackOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -188,7 +192,7 @@ func TestGenerateMissingFileError(t *testing.T) {
 	}
 
 	// Generate a layer where the changed file is missing after the diff.
-	reader, err := GenerateLayer(dir, diffs, &MapOptions{})
+	reader, err := GenerateLayer(context.Background(), dir, diffs, &RepackOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -253,7 +257,7 @@ func TestGenerateWrongRootError(t *testing.T) {
 	}
 
 	// Generate a layer with the wrong root directory.
-	reader, err := GenerateLayer(filepath.Join(dir, "some"), diffs, &MapOptions{})
+	reader, err := GenerateLayer(context.Background(), filepath.Join(dir, "some"), diffs, &RepackOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -270,3 +274,501 @@ func TestGenerateWrongRootError(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerateDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateDiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create two identical trees.
+	oldRoot := filepath.Join(dir, "old")
+	newRoot := filepath.Join(dir, "new")
+	for _, root := range []string{oldRoot, newRoot} {
+		if err := os.MkdirAll(filepath.Join(root, "some", "parents"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "some", "fileunchanged"), []byte("unchanged"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "some", "parents", "filechanged"), []byte("changed"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "some", "parents", "deleted"), []byte("deleted"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Modify the new tree.
+	if err := ioutil.WriteFile(filepath.Join(newRoot, "some", "parents", "filechanged"), []byte("new contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(newRoot, "some", "parents", "deleted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(newRoot, "some", "added"), []byte("added"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make all of the timestamps match, so that only the real changes show
+	// up in the diff.
+	mtime := time.Unix(1000, 0)
+	for _, root := range []string{oldRoot, newRoot} {
+		if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Chtimes(path, mtime, mtime)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader, err := GenerateDiff(context.Background(), oldRoot, newRoot, &RepackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var (
+		gotDeleted bool
+		gotChanged bool
+		gotAdded   bool
+	)
+
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+			break
+		}
+		switch hdr.Name {
+		case filepath.Join("some", "parents", ".wh.deleted"):
+			gotDeleted = true
+		case filepath.Join("some", "parents", "filechanged"):
+			contents, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Errorf("unexpected error reading changed file: %s", err)
+			}
+			if string(contents) != "new contents" {
+				t.Errorf("did not get expected contents: %s", contents)
+			}
+			gotChanged = true
+		case filepath.Join("some", "added"):
+			gotAdded = true
+		case filepath.Join("some", "fileunchanged"):
+			t.Errorf("got unchanged file in diff layer")
+		}
+	}
+
+	if !gotDeleted {
+		t.Errorf("did not get deleted file!")
+	}
+	if !gotChanged {
+		t.Errorf("did not get changed file!")
+	}
+	if !gotAdded {
+		t.Errorf("did not get added file!")
+	}
+}
+
+// generateReproducibleHelper creates a rootfs with the given modification
+// time, and returns the reproducible layer generated from it.
+func generateReproducibleHelper(t *testing.T, mtime time.Time, epoch time.Time) []byte {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateReproducible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "deleted"), []byte("deleted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "deleted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "some", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "some", "dir", "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"some/dir/file", "some/dir", "some", "."} {
+		if err := os.Chtimes(filepath.Join(dir, path), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayer(context.Background(), dir, diffs, &RepackOptions{
+		Reproducible:    true,
+		SourceDateEpoch: &epoch,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGenerateReproducible(t *testing.T) {
+	epoch := time.Unix(1000, 0)
+
+	// Both sets of timestamps are after the epoch, so the layers should be
+	// identical.
+	layerA := generateReproducibleHelper(t, time.Unix(2000, 123), epoch)
+	layerB := generateReproducibleHelper(t, time.Unix(3000, 456), epoch)
+	if !bytes.Equal(layerA, layerB) {
+		t.Errorf("reproducible layers are not identical")
+	}
+
+	tr := tar.NewReader(bytes.NewReader(layerA))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !hdr.ModTime.Equal(epoch) {
+			t.Errorf("%s: mtime was not clamped: %s", hdr.Name, hdr.ModTime)
+		}
+		if hdr.Uname != "" || hdr.Gname != "" {
+			t.Errorf("%s: owner names were not cleared: %q %q", hdr.Name, hdr.Uname, hdr.Gname)
+		}
+	}
+}
+
+func TestGenerateClampMtime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateClampMtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "deleted"), []byte("deleted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "deleted")); err != nil {
+		t.Fatal(err)
+	}
+
+	clamp := time.Unix(1000, 0)
+	oldTime := time.Unix(500, 0)
+	newTime := time.Unix(2000, 0)
+	if err := ioutil.WriteFile(filepath.Join(dir, "old"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "old"), newTime, oldTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "new"), newTime, newTime); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayer(context.Background(), dir, diffs, &RepackOptions{
+		ClampMtime: &clamp,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	seen := map[string]bool{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		seen[hdr.Name] = true
+
+		switch hdr.Name {
+		case "old":
+			// Earlier timestamps are left alone.
+			if !hdr.ModTime.Equal(oldTime) {
+				t.Errorf("%s: mtime was modified: expected %s got %s", hdr.Name, oldTime, hdr.ModTime)
+			}
+		default:
+			if !hdr.ModTime.Equal(clamp) {
+				t.Errorf("%s: mtime was not clamped: %s", hdr.Name, hdr.ModTime)
+			}
+		}
+	}
+	for _, name := range []string{"old", "new", whPrefix + "deleted"} {
+		if !seen[name] {
+			t.Errorf("missing entry %s in layer", name)
+		}
+	}
+}
+
+func TestGenerateDiffWhiteoutMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateDiffWhiteoutMode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldRoot := filepath.Join(dir, "old")
+	newRoot := filepath.Join(dir, "new")
+	for _, root := range []string{oldRoot, newRoot} {
+		if err := os.MkdirAll(filepath.Join(root, "gone", "sub"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"kept", "gone-file", filepath.Join("gone", "file"), filepath.Join("gone", "sub", "file")} {
+			if err := ioutil.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(newRoot, "gone")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(newRoot, "gone-file")); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1000, 0)
+	for _, root := range []string{oldRoot, newRoot} {
+		if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Chtimes(path, mtime, mtime)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		mode     WhiteoutMode
+		expected map[string]byte
+	}{
+		{"", map[string]byte{".wh.gone": tar.TypeReg, ".wh.gone-file": tar.TypeReg}},
+		{WhiteoutAUFS, map[string]byte{".wh.gone": tar.TypeReg, ".wh.gone-file": tar.TypeReg}},
+		{WhiteoutOverlay, map[string]byte{"gone": tar.TypeChar, "gone-file": tar.TypeChar}},
+	} {
+		reader, err := GenerateDiff(context.Background(), oldRoot, newRoot, &RepackOptions{WhiteoutMode: test.mode})
+		if err != nil {
+			t.Fatalf("GenerateDiff(context.Background(), %q): unexpected error: %+v", test.mode, err)
+		}
+		entries := map[string]byte{}
+		tr := tar.NewReader(reader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("GenerateDiff(context.Background(), %q): unexpected error: %+v", test.mode, err)
+			}
+			entries[hdr.Name] = hdr.Typeflag
+			if hdr.Typeflag == tar.TypeChar && (hdr.Devmajor != 0 || hdr.Devminor != 0) {
+				t.Errorf("GenerateDiff(context.Background(), %q): whiteout %s is not a 0:0 device", test.mode, hdr.Name)
+			}
+		}
+		reader.Close()
+
+		for name, typeflag := range test.expected {
+			if got, ok := entries[name]; !ok || got != typeflag {
+				t.Errorf("GenerateDiff(context.Background(), %q): expected %s with type %c, got %v", test.mode, name, typeflag, entries)
+			}
+		}
+		for name := range entries {
+			if filepath.Dir(name) == "gone" || filepath.Dir(name) == filepath.Join("gone", "sub") {
+				t.Errorf("GenerateDiff(context.Background(), %q): unexpected entry inside removed directory: %s", test.mode, name)
+			}
+		}
+	}
+
+	reader, err := GenerateDiff(context.Background(), oldRoot, newRoot, &RepackOptions{WhiteoutMode: WhiteoutReject})
+	if err != nil {
+		t.Fatalf("GenerateDiff(context.Background(), reject): unexpected error: %+v", err)
+	}
+	if _, err := ioutil.ReadAll(reader); err == nil {
+		t.Errorf("GenerateDiff(context.Background(), reject): expected error with removed paths")
+	}
+	reader.Close()
+
+	if _, err := GenerateDiff(context.Background(), oldRoot, newRoot, &RepackOptions{WhiteoutMode: "whiteout"}); err == nil {
+		t.Errorf("GenerateDiff: expected error with unknown whiteout mode")
+	}
+}
+
+func TestGenerateLongPathRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateLongPathRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create a node_modules-style tree, with paths far longer than can be
+	// stored in a USTAR header.
+	src := filepath.Join(dir, "src")
+	deepest := src
+	for i := 0; i < 20; i++ {
+		deepest = filepath.Join(deepest, "node_modules", strings.Repeat("x", 80))
+		if err := os.MkdirAll(deepest, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(deepest, "package.json"), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	long := filepath.Join(deepest, strings.Repeat("f", 255))
+	if err := ioutil.WriteFile(long, []byte("long file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(long, filepath.Join(src, "hardlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(strings.Repeat("../", 40)+strings.Repeat("t", 200), filepath.Join(deepest, "symlink")); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateFullLayer(context.Background(), src, &RepackOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error generating layer: %+v", err)
+	}
+	layer, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(bytes.NewReader(layer))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading generated layer: %s", err)
+		}
+		if hdr.Format&tar.FormatGNU != 0 && hdr.Format&(tar.FormatUSTAR|tar.FormatPAX) == 0 {
+			t.Errorf("%s: entry uses GNU extensions", hdr.Name)
+		}
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackLayer(dst, bytes.NewReader(layer), &MapOptions{}); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+
+	// Modification times are only stored with a precision of a second, so
+	// they can't be compared.
+	var keywords []mtree.Keyword
+	for _, keyword := range append(mtree.DefaultKeywords, "sha256digest") {
+		if keyword != "time" {
+			keywords = append(keywords, keyword)
+		}
+	}
+	srcDh, err := mtree.Walk(src, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstDh, err := mtree.Walk(dst, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(srcDh, dstDh, keywords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, diff := range diffs {
+		t.Errorf("round-trip changed %s: %s", diff.Path(), diff.Type())
+	}
+}
+
+func TestGenerateCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateCancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "some", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "some/b", "some/dir/c"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte("contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Walking the tree fails straight away.
+	if _, err := WalkContext(ctx, src, nil, diffKeywords, nil); errors.Cause(err) != context.Canceled {
+		t.Errorf("WalkContext: expected context.Canceled: %+v", err)
+	}
+	if _, err := GenerateFullLayer(ctx, src, &RepackOptions{}); errors.Cause(err) != context.Canceled {
+		t.Errorf("GenerateFullLayer: expected context.Canceled: %+v", err)
+	}
+
+	// As does generating a layer from existing deltas.
+	dh, err := WalkContext(context.Background(), src, nil, diffKeywords, nil)
+	if err != nil {
+		t.Fatalf("WalkContext: unexpected error: %+v", err)
+	}
+	deltas, err := mtree.Compare(&mtree.DirectoryHierarchy{}, dh, diffKeywords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := GenerateLayer(ctx, src, deltas, &RepackOptions{})
+	if err != nil {
+		t.Fatalf("GenerateLayer: unexpected error: %+v", err)
+	}
+	defer reader.Close()
+	if _, err := ioutil.ReadAll(reader); errors.Cause(err) != context.Canceled {
+		t.Errorf("GenerateLayer: expected context.Canceled: %+v", err)
+	}
+}
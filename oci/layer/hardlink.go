@@ -0,0 +1,218 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/openSUSE/umoci/third_party/symlink"
+	"github.com/pkg/errors"
+)
+
+// HardlinkMode specifies how hardlink entries whose target is in a lower layer
+// (rather than in the layer containing the hardlink) are extracted.
+type HardlinkMode string
+
+const (
+	// HardlinkFollow links to the target in the merged view of the layers
+	// extracted so far. This is the default. In overlay mode, the target is
+	// looked up in the directories of the lower layers (taking whiteouts into
+	// account) and the hardlink is made to the file in that directory.
+	HardlinkFollow HardlinkMode = "follow"
+
+	// HardlinkCopy creates a copy of the target (with the same contents and
+	// metadata) rather than a hardlink to it, so that paths in different
+	// layers never share an inode. Further hardlinks in the same layer to the
+	// same target are linked to the copy.
+	HardlinkCopy HardlinkMode = "copy"
+
+	// HardlinkReject causes extraction to fail.
+	HardlinkReject HardlinkMode = "reject"
+)
+
+// Validate returns an error if the HardlinkMode is unknown. The empty mode is
+// the same as HardlinkFollow.
+func (m HardlinkMode) Validate() error {
+	switch m {
+	case "", HardlinkFollow, HardlinkCopy, HardlinkReject:
+		return nil
+	}
+	return errors.Errorf("unknown hardlink mode: %s", m)
+}
+
+// layerKey returns the key of the given tar entry path in the paths recorded
+// by the tarExtractor.
+func layerKey(name string) string {
+	return filepath.Join("/", CleanPath(name))
+}
+
+// scopedHardlink returns the path of the given hardlink target inside root.
+// As with unpackEntry, we need to be careful that we don't resolve the last
+// part of the link path (in case the user actually wanted to hardlink to a
+// symlink).
+func (te *tarExtractor) scopedHardlink(root, target string) (string, error) {
+	linkname := filepath.Join(root, target)
+	linkdir, file := filepath.Split(linkname)
+	dir, err := symlink.FollowSymlinkInScope(linkdir, root, te.fsEval)
+	if err != nil {
+		return "", errors.Wrap(err, "sanitise hardlink target in root")
+	}
+	linkname = filepath.Join(dir, file)
+	if err := te.verifyBeneath(root, linkname); err != nil {
+		return "", errors.Wrap(err, "verify hardlink target")
+	}
+	return linkname, nil
+}
+
+// hardlinkTarget returns the path that the given hardlink entry should be
+// linked to, and whether the path should be copied rather than linked to
+// (according to te.hardlinkMode).
+func (te *tarExtractor) hardlinkTarget(root string, hdr *tar.Header) (string, bool, error) {
+	target := layerKey(hdr.Linkname)
+
+	// Hardlinks to paths in the same layer are always linked. The same goes
+	// for the default mode in a flat rootfs, where the rootfs already is the
+	// merged view of the layers.
+	if _, ok := te.layerPaths[target]; ok || (te.hardlinkMode != HardlinkCopy && te.hardlinkMode != HardlinkReject && !te.overlay) {
+		linkname, err := te.scopedHardlink(root, target)
+		return linkname, false, err
+	}
+	if copyPath, ok := te.hardlinkCopies[target]; ok {
+		linkname, err := te.scopedHardlink(root, copyPath)
+		return linkname, false, err
+	}
+	if te.hardlinkMode == HardlinkReject {
+		return "", false, errors.Errorf("hardlink target %s is in a lower layer", hdr.Linkname)
+	}
+
+	lowerRoot := root
+	if te.overlay {
+		var err error
+		lowerRoot, err = te.lowerLayer(root, target)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	linkname, err := te.scopedHardlink(lowerRoot, target)
+	return linkname, te.hardlinkMode == HardlinkCopy, err
+}
+
+// isOverlayWhiteout returns whether the given file is an overlayfs whiteout
+// (a 0:0 character device).
+func isOverlayWhiteout(fi os.FileInfo) bool {
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && fi.Mode()&os.ModeCharDevice == os.ModeCharDevice && s.Rdev == 0
+}
+
+// lowerLayer returns the directory of the topmost lower layer (in
+// te.lowerRoots) containing the given path, taking overlayfs whiteouts and
+// opaque directories into account. It is only used in overlay mode.
+func (te *tarExtractor) lowerLayer(root, target string) (string, error) {
+	// Opaque directories in the current layer hide all of the lower layers.
+	for _, dir := range te.opaques {
+		if strings.HasPrefix(filepath.Join(root, target), dir+"/") {
+			return "", errors.Errorf("hardlink target %s is hidden by an opaque directory", target)
+		}
+	}
+
+	for _, lowerRoot := range te.lowerRoots {
+		path, err := te.scopedHardlink(lowerRoot, target)
+		if err != nil {
+			return "", err
+		}
+		if fi, err := te.fsEval.Lstat(path); err == nil {
+			if isOverlayWhiteout(fi) {
+				break
+			}
+			return lowerRoot, nil
+		}
+
+		// Opaque parent directories hide the layers below this one.
+		opaque := false
+		for dir := filepath.Dir(target); dir != "/"; dir = filepath.Dir(dir) {
+			if value, err := te.fsEval.Lgetxattr(filepath.Join(lowerRoot, dir), overlayOpaqueXattr); err == nil && string(value) == "y" {
+				opaque = true
+				break
+			}
+		}
+		if opaque {
+			break
+		}
+	}
+	return "", errors.Errorf("hardlink target %s not found in lower layers", target)
+}
+
+// copyHardlinkTarget creates a copy of the file at src (which must be a
+// regular file or a symlink) at path, including its metadata. The metadata is
+// copied from the filesystem as-is, so no mapping is done.
+func (te *tarExtractor) copyHardlinkTarget(src, path string) error {
+	fi, err := te.fsEval.Lstat(src)
+	if err != nil {
+		return errors.Wrap(err, "lstat hardlink target")
+	}
+
+	// Unlink the old path, and ignore it if the path didn't exist.
+	if err := te.fsEval.RemoveAll(path); err != nil {
+		return errors.Wrap(err, "remove copy old")
+	}
+
+	var linkname string
+	switch {
+	case fi.Mode().IsRegular():
+		srcFh, err := te.fsEval.Open(src)
+		if err != nil {
+			return errors.Wrap(err, "open hardlink target")
+		}
+		defer srcFh.Close()
+		fh, err := te.fsEval.Create(path)
+		if err != nil {
+			return errors.Wrap(err, "create copy")
+		}
+		defer fh.Close()
+		if _, err := io.Copy(fh, srcFh); err != nil {
+			return errors.Wrap(err, "copy hardlink target")
+		}
+		// Force close here so that we don't affect the metadata.
+		fh.Close()
+	case fi.Mode()&os.ModeSymlink == os.ModeSymlink:
+		linkname, err = te.fsEval.Readlink(src)
+		if err != nil {
+			return errors.Wrap(err, "readlink hardlink target")
+		}
+		if err := te.fsEval.Symlink(linkname, path); err != nil {
+			return errors.Wrap(err, "symlink copy")
+		}
+	default:
+		return errors.Errorf("cannot copy hardlink target %s: unsupported file type %s", src, fi.Mode().String())
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, linkname)
+	if err != nil {
+		return errors.Wrap(err, "convert hardlink target to hdr")
+	}
+	hdr.Xattrs, err = te.getXattrs(src)
+	if err != nil {
+		return errors.Wrap(err, "get hardlink target xattrs")
+	}
+	return te.restoreMetadata(path, hdr)
+}
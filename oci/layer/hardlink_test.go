@@ -0,0 +1,194 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testHardlinkLayer returns a layer containing the given entries. Regular
+// files have their name as their contents.
+func testHardlinkLayer(t *testing.T, hdrs ...*tar.Header) *bytes.Buffer {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, hdr := range hdrs {
+		var contents []byte
+		if hdr.Typeflag == tar.TypeReg {
+			contents = []byte(hdr.Name)
+			hdr.Size = int64(len(contents))
+		}
+		hdr.ModTime = time.Now()
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buffer
+}
+
+// testInode returns the inode of the given path.
+func testInode(t *testing.T, path string) uint64 {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		t.Fatalf("lstat %s: %s", path, err)
+	}
+	return st.Ino
+}
+
+func TestHardlinkMode(t *testing.T) {
+	mapOptions := MapOptions{Rootless: os.Geteuid() != 0}
+
+	for _, mode := range []HardlinkMode{"", HardlinkFollow, HardlinkCopy, HardlinkReject} {
+		t.Run(string(mode), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestHardlinkMode")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			lower := testHardlinkLayer(t, &tar.Header{Name: "target", Typeflag: tar.TypeReg, Mode: 0640})
+			if err := unpackLayer(context.Background(), newTarExtractor(mapOptions), dir, lower); err != nil {
+				t.Fatalf("unexpected error unpacking lower layer: %s", err)
+			}
+
+			upper := testHardlinkLayer(t,
+				&tar.Header{Name: "local", Typeflag: tar.TypeReg, Mode: 0644},
+				&tar.Header{Name: "local-link", Typeflag: tar.TypeLink, Linkname: "local"},
+				&tar.Header{Name: "link1", Typeflag: tar.TypeLink, Linkname: "target"},
+				&tar.Header{Name: "link2", Typeflag: tar.TypeLink, Linkname: "/target"},
+			)
+			te := newTarExtractor(mapOptions)
+			te.hardlinkMode = mode
+			err = unpackLayer(context.Background(), te, dir, upper)
+			if mode == HardlinkReject {
+				if err == nil {
+					t.Fatalf("expected error unpacking hardlink to lower layer")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error unpacking upper layer: %s", err)
+			}
+
+			// Hardlinks within the layer are always links.
+			if testInode(t, filepath.Join(dir, "local")) != testInode(t, filepath.Join(dir, "local-link")) {
+				t.Errorf("hardlink within the layer was not linked")
+			}
+
+			target := testInode(t, filepath.Join(dir, "target"))
+			link1 := testInode(t, filepath.Join(dir, "link1"))
+			link2 := testInode(t, filepath.Join(dir, "link2"))
+			if link1 != link2 {
+				t.Errorf("hardlinks to the same target were not linked")
+			}
+			if copied := link1 != target; copied != (mode == HardlinkCopy) {
+				t.Errorf("hardlink to lower layer: copied=%v", copied)
+			}
+
+			contents, err := ioutil.ReadFile(filepath.Join(dir, "link1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(contents) != "target" {
+				t.Errorf("unexpected hardlink contents: %q", contents)
+			}
+			fi, err := os.Lstat(filepath.Join(dir, "link1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0640 {
+				t.Errorf("unexpected hardlink mode: %o", fi.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestHardlinkModeOverlay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Log("overlay whiteouts require root privileges")
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestHardlinkModeOverlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var roots []string
+	for idx, layer := range []*bytes.Buffer{
+		testHardlinkLayer(t,
+			&tar.Header{Name: "target", Typeflag: tar.TypeReg, Mode: 0644},
+			&tar.Header{Name: "removed", Typeflag: tar.TypeReg, Mode: 0644},
+		),
+		testHardlinkLayer(t, &tar.Header{Name: whPrefix + "removed", Typeflag: tar.TypeReg}),
+	} {
+		root := filepath.Join(dir, strconv.Itoa(idx))
+		if err := os.Mkdir(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+		te := newTarExtractor(MapOptions{})
+		te.overlay = true
+		te.lowerRoots = roots
+		if err := unpackLayer(context.Background(), te, root, layer); err != nil {
+			t.Fatalf("unexpected error unpacking layer %d: %s", idx, err)
+		}
+		roots = append([]string{root}, roots...)
+	}
+
+	root := filepath.Join(dir, "2")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The target is found in the first layer.
+	te := newTarExtractor(MapOptions{})
+	te.overlay = true
+	te.lowerRoots = roots
+	layer := testHardlinkLayer(t, &tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "target"})
+	if err := unpackLayer(context.Background(), te, root, layer); err != nil {
+		t.Fatalf("unexpected error unpacking hardlink: %s", err)
+	}
+	if testInode(t, filepath.Join(root, "link")) != testInode(t, filepath.Join(dir, "0", "target")) {
+		t.Errorf("hardlink was not linked to the lower layer")
+	}
+
+	// But whited-out targets are not.
+	te = newTarExtractor(MapOptions{})
+	te.overlay = true
+	te.lowerRoots = roots
+	layer = testHardlinkLayer(t, &tar.Header{Name: "removed-link", Typeflag: tar.TypeLink, Linkname: "removed"})
+	if err := unpackLayer(context.Background(), te, root, layer); err == nil {
+		t.Errorf("expected error unpacking hardlink to whited-out path")
+	}
+}
@@ -0,0 +1,289 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// layerIndexVersion is the version of the LayerIndex format. Cached indexes
+// with a different version are rebuilt.
+const layerIndexVersion = 1
+
+// IndexEntry is an entry of a LayerIndex.
+type IndexEntry struct {
+	LayerEntry
+
+	// Offset is the offset of the contents of the entry in the uncompressed
+	// tar archive of the layer, or -1 if the contents cannot be read directly
+	// from the archive (because the entry is not a regular file, or is a
+	// sparse file).
+	Offset int64 `json:"offset"`
+}
+
+// LayerIndex lists the entries of a layer (in the order in which they appear
+// in the layer) along with where their contents are in the layer, so that
+// the layer doesn't have to be read again to list its entries or to find a
+// particular file. Since layers are content-addressed, the index of a layer
+// never changes once it has been built.
+type LayerIndex struct {
+	Version int           `json:"version"`
+	Layer   digest.Digest `json:"layer"`
+	Entries []IndexEntry  `json:"entries"`
+}
+
+// countingReader counts the number of bytes read from a reader.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// isSparse returns whether the given header is for a sparse file, whose
+// contents are not stored contiguously in the archive.
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildLayerIndex reads the given layer blob and returns its index.
+func BuildLayerIndex(ctx context.Context, engine casext.Engine, layerDescriptor ispec.Descriptor) (LayerIndex, error) {
+	index := LayerIndex{
+		Version: layerIndexVersion,
+		Layer:   layerDescriptor.Digest,
+		Entries: []IndexEntry{},
+	}
+
+	layer, err := OpenLayer(ctx, engine, layerDescriptor)
+	if err != nil {
+		return index, errors.Wrap(err, "open layer")
+	}
+	defer layer.Close()
+
+	// tar.Reader reads the archive a block at a time without buffering, so
+	// after Next returns the archive has been read up to the start of the
+	// contents of the entry.
+	counter := &countingReader{Reader: layer}
+	tr := newEntryReader(counter)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return index, nil
+		}
+		if err != nil {
+			return index, errors.Wrap(err, "read next entry")
+		}
+		entry := IndexEntry{
+			LayerEntry: newLayerEntry(hdr),
+			Offset:     -1,
+		}
+		if entry.Type == "file" && tr.contents == tr.tr && !isSparse(hdr) {
+			entry.Offset = counter.n
+		}
+		index.Entries = append(index.Entries, entry)
+	}
+}
+
+// IndexCache is a directory containing the LayerIndex of layers, so that
+// repeated operations on the same layers (such as ListLayer and OpenFile) can
+// use the index rather than reading the layers again. The index of a layer is
+// built (and stored in the cache) the first time it is needed. Since indexes
+// never change, the cache can be shared between images and removed at any
+// time.
+type IndexCache struct {
+	path string
+}
+
+// NewIndexCache returns an IndexCache which stores indexes in the given
+// directory (which is created if necessary).
+func NewIndexCache(path string) *IndexCache {
+	return &IndexCache{path: path}
+}
+
+// indexPath returns the path of the index of the given layer.
+func (c *IndexCache) indexPath(layerDigest digest.Digest) (string, error) {
+	if err := layerDigest.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid layer digest %q", layerDigest)
+	}
+	return filepath.Join(c.path, layerDigest.Algorithm().String(), layerDigest.Hex()+".json"), nil
+}
+
+// load returns the cached index of the given layer, if it is in the cache.
+func (c *IndexCache) load(ctx context.Context, path string, layerDigest digest.Digest) (LayerIndex, bool) {
+	var index LayerIndex
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return index, false
+	}
+	defer fh.Close()
+
+	if err := json.NewDecoder(fh).Decode(&index); err != nil {
+		event.Log(ctx).Debugf("index cache: ignoring invalid index %s: %v", path, err)
+		return index, false
+	}
+	if index.Version != layerIndexVersion || index.Layer != layerDigest {
+		event.Log(ctx).Debugf("index cache: ignoring outdated index %s", path)
+		return index, false
+	}
+	return index, true
+}
+
+// store atomically writes the index to the cache.
+func (c *IndexCache) store(path string, index LayerIndex) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "create index cache")
+	}
+	fh, err := ioutil.TempFile(filepath.Dir(path), ".index-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary index")
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if err := json.NewEncoder(fh).Encode(index); err != nil {
+		return errors.Wrap(err, "encode index")
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close index")
+	}
+	return errors.Wrap(os.Rename(fh.Name(), path), "rename index")
+}
+
+// LayerIndex returns the index of the given layer blob, building it (and
+// storing it in the cache) if it is not already cached. Failing to store the
+// index (such as if the cache is on read-only storage) is not an error.
+func (c *IndexCache) LayerIndex(ctx context.Context, engine casext.Engine, layerDescriptor ispec.Descriptor) (LayerIndex, error) {
+	path, err := c.indexPath(layerDescriptor.Digest)
+	if err != nil {
+		return LayerIndex{}, err
+	}
+	if index, ok := c.load(ctx, path, layerDescriptor.Digest); ok {
+		event.Log(ctx).Debugf("index cache: hit for layer %s", layerDescriptor.Digest)
+		return index, nil
+	}
+
+	event.Log(ctx).Debugf("index cache: building index of layer %s", layerDescriptor.Digest)
+	index, err := BuildLayerIndex(ctx, engine, layerDescriptor)
+	if err != nil {
+		return index, errors.Wrapf(err, "build index of layer %s", layerDescriptor.Digest)
+	}
+	if err := c.store(path, index); err != nil {
+		event.Log(ctx).Debugf("index cache: could not store index of layer %s: %v", layerDescriptor.Digest, err)
+	}
+	return index, nil
+}
+
+// indexCacheKey is the context key for the IndexCache attached by
+// WithIndexCache.
+type indexCacheKey struct{}
+
+// WithIndexCache returns a copy of ctx with the given IndexCache attached, so
+// that ListLayer, OpenFile (and the functions using them, such as
+// FindChanges) use the cached layer indexes.
+func WithIndexCache(ctx context.Context, cache *IndexCache) context.Context {
+	return context.WithValue(ctx, indexCacheKey{}, cache)
+}
+
+// indexCacheFromContext returns the IndexCache attached to ctx, or nil.
+func indexCacheFromContext(ctx context.Context) *IndexCache {
+	cache, _ := ctx.Value(indexCacheKey{}).(*IndexCache)
+	return cache
+}
+
+// searchIndex is searchLayer for an indexed layer. If the file is found, its
+// entry is returned rather than a reader for its contents.
+func searchIndex(index LayerIndex, path string) (*IndexEntry, layerFile, bool, error) {
+	hidden := false
+	for idx := range index.Entries {
+		entry := &index.Entries[idx]
+		result, found, hide, err := lookupEntry(entry.LayerEntry, path)
+		if err != nil || result.target != "" {
+			return nil, result, false, err
+		}
+		if found {
+			return entry, layerFile{}, false, nil
+		}
+		hidden = hidden || hide
+	}
+	return nil, layerFile{}, hidden, nil
+}
+
+// isUncompressedLayerType returns whether layer blobs of the given media type
+// are uncompressed tar archives.
+func isUncompressedLayerType(mediaType string) bool {
+	return mediaType == ispec.MediaTypeImageLayer || mediaType == ispec.MediaTypeImageLayerNonDistributable
+}
+
+// openIndexedFile returns a reader for the contents of the given (indexed)
+// entry of the layer. The contents of uncompressed layers are read directly
+// from the blob if the engine is a cas.RandomAccessEngine, otherwise the
+// layer is read (without parsing it) up to the contents of the entry.
+func openIndexedFile(ctx context.Context, engine casext.Engine, layerDescriptor ispec.Descriptor, entry *IndexEntry) (io.ReadCloser, error) {
+	if randomAccess, ok := engine.Engine.(cas.RandomAccessEngine); ok && isUncompressedLayerType(layerDescriptor.MediaType) {
+		blob, size, err := randomAccess.GetBlobAt(ctx, layerDescriptor.Digest)
+		switch {
+		case err == nil:
+			if entry.Offset+entry.Size > size {
+				blob.Close()
+				return nil, errors.Errorf("index of layer %s refers to contents beyond the end of the layer", layerDescriptor.Digest)
+			}
+			return &fileReader{Reader: io.NewSectionReader(blob, entry.Offset, entry.Size), layer: blob}, nil
+		case errors.Cause(err) == cas.ErrNotImplemented || os.IsNotExist(errors.Cause(err)):
+			// The blob might be stored compressed (or as chunks).
+		default:
+			return nil, errors.Wrap(err, "get layer blob")
+		}
+	}
+
+	layer, err := OpenLayer(ctx, engine, layerDescriptor)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, layer, entry.Offset); err != nil {
+		layer.Close()
+		return nil, errors.Wrap(err, "seek to file contents")
+	}
+	return &fileReader{Reader: io.LimitReader(layer, entry.Size), layer: layer}, nil
+}
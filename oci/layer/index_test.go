@@ -0,0 +1,136 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	"golang.org/x/net/context"
+)
+
+func TestBuildLayerIndex(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+	engineExt := casext.Engine{engine}
+
+	layer := putUncompressedLayer(t, engine, []testEntry{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir}},
+		{hdr: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg}, data: "hostname"},
+		{hdr: tar.Header{Name: "etc/" + strings.Repeat("long", 50), Typeflag: tar.TypeReg}, data: "long name"},
+		{hdr: tar.Header{Name: "etc/.wh.old", Typeflag: tar.TypeReg}},
+		{hdr: tar.Header{Name: "etc/motd", Typeflag: tar.TypeSymlink, Linkname: "hostname"}},
+	})
+
+	index, err := BuildLayerIndex(ctx, engineExt, layer)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if index.Layer != layer.Digest || len(index.Entries) != 5 {
+		t.Fatalf("unexpected index: %+v", index)
+	}
+
+	blob, err := engine.GetBlob(ctx, layer.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for idx, expected := range []string{"", "hostname", "long name", "", ""} {
+		entry := index.Entries[idx]
+		if expected == "" {
+			if entry.Offset != -1 {
+				t.Errorf("%s: expected no offset, got %d", entry.Path, entry.Offset)
+			}
+			continue
+		}
+		if got := string(raw[entry.Offset : entry.Offset+entry.Size]); got != expected {
+			t.Errorf("%s: contents at offset %d: got %q, expected %q", entry.Path, entry.Offset, got, expected)
+		}
+	}
+	if entry := index.Entries[3]; !entry.Whiteout || entry.Path != "/etc/old" {
+		t.Errorf("unexpected whiteout entry: %+v", entry)
+	}
+}
+
+func TestIndexCache(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+	engineExt := casext.Engine{engine}
+
+	dir, err := ioutil.TempDir("", "umoci-TestIndexCache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gzipped, _ := putTestLayer(t, engine, "etc/file")
+	cache := NewIndexCache(filepath.Join(dir, "cache"))
+	ctx = WithIndexCache(ctx, cache)
+
+	var paths []string
+	listPaths := func() error {
+		paths = nil
+		return ListLayer(ctx, engineExt, gzipped, func(entry LayerEntry) error {
+			paths = append(paths, entry.Path)
+			return nil
+		})
+	}
+	if err := listPaths(); err != nil {
+		t.Fatalf("unexpected error listing layer: %+v", err)
+	}
+	if len(paths) != 1 || paths[0] != "/etc/file" {
+		t.Errorf("unexpected entries: %v", paths)
+	}
+
+	indexPath := filepath.Join(dir, "cache", gzipped.Digest.Algorithm().String(), gzipped.Digest.Hex()+".json")
+	if _, err := os.Stat(indexPath); err != nil {
+		t.Fatalf("expected index to be cached: %v", err)
+	}
+
+	// The cached index is used without reading the layer.
+	if err := engine.DeleteBlob(ctx, gzipped.Digest); err != nil {
+		t.Fatal(err)
+	}
+	if err := listPaths(); err != nil {
+		t.Fatalf("unexpected error listing layer from cache: %+v", err)
+	}
+	if len(paths) != 1 || paths[0] != "/etc/file" {
+		t.Errorf("unexpected cached entries: %v", paths)
+	}
+
+	// Invalid indexes are rebuilt (which fails without the layer).
+	if err := ioutil.WriteFile(indexPath, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := listPaths(); err == nil {
+		t.Errorf("expected invalid index to be rebuilt")
+	}
+}
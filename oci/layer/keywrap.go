@@ -0,0 +1,214 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/pkg/errors"
+	"github.com/smallstep/pkcs7"
+)
+
+func init() {
+	// ocicrypt wraps keys with AES-128-GCM rather than the (insecure) default
+	// of DES-CBC. pkcs7 only allows this to be configured globally.
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES128GCM
+}
+
+// jweKeyAlgorithms are the JWE key management algorithms accepted when
+// unwrapping layer keys, which are those used by ocicrypt.
+var jweKeyAlgorithms = []jose.KeyAlgorithm{
+	jose.RSA_OAEP, jose.RSA_OAEP_256,
+	jose.ECDH_ES_A128KW, jose.ECDH_ES_A192KW, jose.ECDH_ES_A256KW,
+}
+
+// jweContentEncryptions are the JWE content encryption algorithms accepted
+// when unwrapping layer keys (all of those defined by RFC 7518).
+var jweContentEncryptions = []jose.ContentEncryption{
+	jose.A128CBC_HS256, jose.A192CBC_HS384, jose.A256CBC_HS512,
+	jose.A128GCM, jose.A192GCM, jose.A256GCM,
+}
+
+// wrapKeyJWE encrypts the given private layer options as a JWE (in the JSON
+// serialisation) for each of the given public keys.
+func wrapKeyJWE(data []byte, publicKeys []crypto.PublicKey) ([]byte, error) {
+	var recipients []jose.Recipient
+	for _, key := range publicKeys {
+		var algorithm jose.KeyAlgorithm
+		switch key.(type) {
+		case *rsa.PublicKey:
+			algorithm = jose.RSA_OAEP
+		case *ecdsa.PublicKey:
+			algorithm = jose.ECDH_ES_A256KW
+		default:
+			return nil, errors.Errorf("unsupported public key type %T", key)
+		}
+		recipients = append(recipients, jose.Recipient{Algorithm: algorithm, Key: key})
+	}
+
+	encrypter, err := jose.NewMultiEncrypter(jose.A256GCM, recipients, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create jwe encrypter")
+	}
+	jwe, err := encrypter.Encrypt(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "encrypt jwe")
+	}
+	return []byte(jwe.FullSerialize()), nil
+}
+
+// unwrapKeyJWE decrypts the private layer options in the given JWE with the
+// first of the private keys in config that is a recipient.
+func unwrapKeyJWE(wrapped []byte, config DecryptConfig) ([]byte, error) {
+	jwe, err := jose.ParseEncrypted(string(wrapped), jweKeyAlgorithms, jweContentEncryptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse jwe")
+	}
+	for _, key := range config.PrivateKeys {
+		if _, _, data, err := jwe.DecryptMulti(key); err == nil {
+			return data, nil
+		}
+	}
+	return nil, ErrNoDecryptionKey
+}
+
+// wrapKeyPKCS7 encrypts the given private layer options as PKCS#7 enveloped
+// data for each of the given certificates.
+func wrapKeyPKCS7(data []byte, certificates []*x509.Certificate) ([]byte, error) {
+	wrapped, err := pkcs7.Encrypt(data, certificates)
+	return wrapped, errors.Wrap(err, "encrypt pkcs7")
+}
+
+// unwrapKeyPKCS7 decrypts the private layer options in the given PKCS#7
+// enveloped data with the first of the private keys (and certificates) in
+// config that is a recipient.
+func unwrapKeyPKCS7(wrapped []byte, config DecryptConfig) ([]byte, error) {
+	p7, err := pkcs7.Parse(wrapped)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse pkcs7")
+	}
+	for _, key := range config.PrivateKeys {
+		for _, certificate := range config.Certificates {
+			if data, err := p7.Decrypt(certificate, key); err == nil {
+				return data, nil
+			}
+		}
+	}
+	return nil, ErrNoDecryptionKey
+}
+
+// parseKeyData returns the DER contents of the given key (or certificate)
+// data, which may be either PEM or DER encoded, or the parsed key if it is a
+// JSON Web Key.
+func parseKeyData(data []byte) ([]byte, *jose.JSONWebKey, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var jwk jose.JSONWebKey
+		if err := jwk.UnmarshalJSON(trimmed); err != nil {
+			return nil, nil, errors.Wrap(err, "parse jwk")
+		}
+		return nil, &jwk, nil
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		if len(block.Headers) > 0 || block.Type == "ENCRYPTED PRIVATE KEY" {
+			return nil, nil, errors.New("encrypted pem keys are not supported")
+		}
+		return block.Bytes, nil, nil
+	}
+	return data, nil, nil
+}
+
+// ParsePublicKey parses a public key (to be used as the recipient of
+// encrypted layers) which is either PEM or DER encoded (in PKIX or PKCS#1
+// form), or a JSON Web Key. RSA and ECDSA keys are supported.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	der, jwk, err := parseKeyData(data)
+	if err != nil {
+		return nil, err
+	}
+	var key crypto.PublicKey
+	switch {
+	case jwk != nil:
+		if !jwk.IsPublic() {
+			return nil, errors.New("jwk is not a public key")
+		}
+		key = jwk.Key
+	default:
+		if key, err = x509.ParsePKIXPublicKey(der); err != nil {
+			if key, err = x509.ParsePKCS1PublicKey(der); err != nil {
+				return nil, errors.New("unknown public key format")
+			}
+		}
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, errors.Errorf("unsupported public key type %T", key)
+}
+
+// ParsePrivateKey parses a private key (used to decrypt encrypted layers)
+// which is either PEM or DER encoded (in PKCS#8, PKCS#1 or SEC 1 form), or a
+// JSON Web Key. RSA and ECDSA keys are supported, but encrypted keys are not.
+func ParsePrivateKey(data []byte) (crypto.PrivateKey, error) {
+	der, jwk, err := parseKeyData(data)
+	if err != nil {
+		return nil, err
+	}
+	var key crypto.PrivateKey
+	switch {
+	case jwk != nil:
+		if jwk.IsPublic() {
+			return nil, errors.New("jwk is not a private key")
+		}
+		key = jwk.Key
+	default:
+		if key, err = x509.ParsePKCS8PrivateKey(der); err != nil {
+			if key, err = x509.ParsePKCS1PrivateKey(der); err != nil {
+				if key, err = x509.ParseECPrivateKey(der); err != nil {
+					return nil, errors.New("unknown private key format")
+				}
+			}
+		}
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		return key, nil
+	}
+	return nil, errors.Errorf("unsupported private key type %T", key)
+}
+
+// ParseCertificate parses a PEM or DER encoded x509 certificate (used as the
+// recipient of encrypted layers, or to decrypt them along with its private
+// key).
+func ParseCertificate(data []byte) (*x509.Certificate, error) {
+	der, jwk, err := parseKeyData(data)
+	if err != nil {
+		return nil, err
+	}
+	if jwk != nil {
+		return nil, errors.New("jwk is not a certificate")
+	}
+	certificate, err := x509.ParseCertificate(der)
+	return certificate, errors.Wrap(err, "parse certificate")
+}
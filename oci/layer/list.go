@@ -0,0 +1,157 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// LayerEntry describes an entry of the tar archive of a layer, as listed by
+// ListLayer.
+type LayerEntry struct {
+	// Path is the (cleaned, absolute) path of the entry in the root
+	// filesystem. For whiteouts, this is the path which is removed (or for
+	// opaque whiteouts, the directory whose lower contents are hidden).
+	Path string `json:"path"`
+
+	// Type is the type of the entry: one of "file", "dir", "symlink",
+	// "hardlink", "char", "block", "fifo" or "whiteout".
+	Type string `json:"type"`
+
+	// Size is the size of the contents of the entry (zero unless the entry is
+	// a regular file).
+	Size int64 `json:"size"`
+
+	// Mode is the permission bits of the entry (including the setuid, setgid
+	// and sticky bits).
+	Mode int64 `json:"mode"`
+
+	// UID and GID are the owner of the entry, with Uname and Gname being the
+	// names of the owner (if they are included in the layer).
+	UID   int    `json:"uid"`
+	GID   int    `json:"gid"`
+	Uname string `json:"uname,omitempty"`
+	Gname string `json:"gname,omitempty"`
+
+	// Linkname is the target of symlinks and hardlinks.
+	Linkname string `json:"linkname,omitempty"`
+
+	// Whiteout is set if the entry is a whiteout, with Opaque being set for
+	// opaque whiteouts.
+	Whiteout bool `json:"whiteout"`
+	Opaque   bool `json:"opaque,omitempty"`
+}
+
+// entryTypes maps tar entry types to the names used by LayerEntry.
+var entryTypes = map[byte]string{
+	tar.TypeReg:     "file",
+	tar.TypeRegA:    "file",
+	tar.TypeDir:     "dir",
+	tar.TypeSymlink: "symlink",
+	tar.TypeLink:    "hardlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeFifo:    "fifo",
+}
+
+// newLayerEntry converts the given tar header into a LayerEntry.
+func newLayerEntry(hdr *tar.Header) LayerEntry {
+	entry := LayerEntry{
+		Path:     filepath.Clean("/" + hdr.Name),
+		Type:     entryTypes[hdr.Typeflag],
+		Mode:     hdr.Mode & 07777,
+		UID:      hdr.Uid,
+		GID:      hdr.Gid,
+		Uname:    hdr.Uname,
+		Gname:    hdr.Gname,
+		Linkname: hdr.Linkname,
+	}
+	if entry.Type == "" {
+		entry.Type = string(hdr.Typeflag)
+	}
+	if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+		entry.Size = hdr.Size
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		entry.Linkname = filepath.Clean("/" + hdr.Linkname)
+	}
+
+	dir, file := filepath.Split(entry.Path)
+	switch {
+	case file == whOpaque:
+		entry.Path = filepath.Clean(dir)
+		entry.Whiteout = true
+		entry.Opaque = true
+	case strings.HasPrefix(file, whPrefix):
+		entry.Path = filepath.Join(dir, strings.TrimPrefix(file, whPrefix))
+		entry.Whiteout = true
+	}
+	if entry.Whiteout {
+		entry.Type = "whiteout"
+		entry.Size = 0
+	}
+	return entry
+}
+
+// ListLayer calls fn for each entry of the given layer blob, in the order in
+// which they appear in the layer. Only the tar headers are read, so this is
+// much cheaper than extracting the layer. If an IndexCache is attached to ctx,
+// the entries are listed from the index of the layer instead. If fn returns an
+// error, listing stops and the error is returned.
+func ListLayer(ctx context.Context, engine casext.Engine, layerDescriptor ispec.Descriptor, fn func(LayerEntry) error) error {
+	if cache := indexCacheFromContext(ctx); cache != nil {
+		index, err := cache.LayerIndex(ctx, engine, layerDescriptor)
+		if err != nil {
+			return err
+		}
+		for _, entry := range index.Entries {
+			if err := fn(entry.LayerEntry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	layer, err := OpenLayer(ctx, engine, layerDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "open layer")
+	}
+	defer layer.Close()
+
+	tr := newEntryReader(layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+		if err := fn(newLayerEntry(hdr)); err != nil {
+			return err
+		}
+	}
+}
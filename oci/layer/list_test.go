@@ -0,0 +1,94 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestListLayer(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	tw := tar.NewWriter(gzw)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "etc/file", Mode: 0644, Uid: 1000, Gid: 100, Uname: "user", Gname: "users", Size: 5, Typeflag: tar.TypeReg},
+		{Name: "etc/link", Mode: 0777, Linkname: "file", Typeflag: tar.TypeSymlink},
+		{Name: "etc/hard", Mode: 0644, Linkname: "etc/file", Typeflag: tar.TypeLink},
+		{Name: "etc/.wh.passwd", Typeflag: tar.TypeReg},
+		{Name: "var/.wh..wh..opq", Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, size, err := engine.PutBlob(ctx, &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    digest,
+		Size:      size,
+	}
+
+	var entries []LayerEntry
+	if err := ListLayer(ctx, casext.Engine{engine}, descriptor, func(entry LayerEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error listing layer: %+v", err)
+	}
+
+	expected := []LayerEntry{
+		{Path: "/etc", Type: "dir", Mode: 0755},
+		{Path: "/etc/file", Type: "file", Size: 5, Mode: 0644, UID: 1000, GID: 100, Uname: "user", Gname: "users"},
+		{Path: "/etc/link", Type: "symlink", Mode: 0777, Linkname: "file"},
+		{Path: "/etc/hard", Type: "hardlink", Mode: 0644, Linkname: "/etc/file"},
+		{Path: "/etc/passwd", Type: "whiteout", Whiteout: true},
+		{Path: "/var", Type: "whiteout", Whiteout: true, Opaque: true},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected entries:\nexpected: %+v\n     got: %+v", expected, entries)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/event"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// contentKeywords are the mtree keywords whose values depend on the contents
+// of a file, and so require the whole file to be read.
+var contentKeywords = map[mtree.Keyword]struct{}{
+	"cksum":           {},
+	"md5":             {},
+	"md5digest":       {},
+	"rmd160":          {},
+	"rmd160digest":    {},
+	"ripemd160digest": {},
+	"sha1":            {},
+	"sha1digest":      {},
+	"sha256":          {},
+	"sha256digest":    {},
+	"sha384":          {},
+	"sha384digest":    {},
+	"sha512":          {},
+	"sha512digest":    {},
+}
+
+// metadataKeywords are the mtree keywords which can be modified without
+// modifying the contents of a file.
+var metadataKeywords = map[mtree.Keyword]struct{}{
+	"uid":      {},
+	"gid":      {},
+	"uname":    {},
+	"gname":    {},
+	"mode":     {},
+	"nlink":    {},
+	"time":     {},
+	"tar_time": {},
+	"xattr":    {},
+	"flags":    {},
+}
+
+// StatKeywords returns the subset of the given mtree keywords which can be
+// computed without reading the contents of files (that is, the keywords
+// other than checksums and digests). Checking a rootfs with these keywords
+// is much faster, but modifications to the contents of a file which don't
+// change its size (or modification time) cannot be detected.
+func StatKeywords(keywords []mtree.Keyword) []mtree.Keyword {
+	var statKeywords []mtree.Keyword
+	for _, keyword := range keywords {
+		if _, ok := contentKeywords[keyword.Synonym()]; !ok {
+			statKeywords = append(statKeywords, keyword)
+		}
+	}
+	return statKeywords
+}
+
+// isMetadataDelta returns whether a modified inode only had its metadata
+// modified, so that its contents are unchanged.
+func isMetadataDelta(delta mtree.InodeDelta) bool {
+	for _, keyDelta := range delta.Diff() {
+		if _, ok := metadataKeywords[keyDelta.Name()]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// layerContents is the source of the contents of unchanged files used by
+// GenerateMetadataLayer.
+type layerContents struct {
+	ctx    context.Context
+	engine casext.Engine
+	layers []ispec.Descriptor
+}
+
+// unchangedFile is a regular file which is looked for in the layers.
+type unchangedFile struct {
+	name string
+	size int64
+}
+
+// addFiles adds the given files (relative to root) to the tar archive, with
+// the contents of regular files copied from the layers. The layers are only
+// read once (starting with the topmost layer), so the order in which the
+// files are added is the order in which they are found. Files which are not
+// found in the layers, or which don't match the file in the layers, are added
+// from root.
+func (lc *layerContents) addFiles(tg *tarGenerator, root string, names []string) error {
+	pending := map[string]unchangedFile{}
+	for _, name := range names {
+		fullPath := filepath.Join(root, name)
+		fi, err := tg.fsEval.Lstat(fullPath)
+		if err != nil {
+			return errors.Wrap(err, "lstat unchanged file")
+		}
+		// Only non-empty regular files have any contents to copy.
+		if !fi.Mode().IsRegular() || fi.Size() == 0 {
+			if err := tg.AddFile(name, fullPath); err != nil {
+				return errors.Wrap(err, "add file")
+			}
+			continue
+		}
+		path := strings.TrimPrefix(filepath.Clean("/"+name), "/")
+		pending[path] = unchangedFile{name: name, size: fi.Size()}
+	}
+
+	for idx := len(lc.layers) - 1; idx >= 0 && len(pending) > 0; idx-- {
+		layerDescriptor := lc.layers[idx]
+		event.Log(lc.ctx).Debugf("generate layer: searching layer %s for %d unchanged files", layerDescriptor.Digest, len(pending))
+		if err := lc.searchLayer(tg, root, layerDescriptor, pending); err != nil {
+			if errors.Cause(err) != ErrEncryptedLayer {
+				return errors.Wrapf(err, "layer %s", layerDescriptor.Digest)
+			}
+			// The files might be in the encrypted layer, so we can't
+			// search any lower layers.
+			event.Log(lc.ctx).Debugf("generate layer: cannot search encrypted layer %s", layerDescriptor.Digest)
+			break
+		}
+	}
+
+	// Anything left over has to be read from the rootfs.
+	var paths []string
+	for path := range pending {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		name := pending[path].name
+		event.Log(lc.ctx).Debugf("generate layer: %s not found in layers, reading from rootfs", name)
+		if err := tg.AddFile(name, filepath.Join(root, name)); err != nil {
+			return errors.Wrap(err, "add file")
+		}
+	}
+	return nil
+}
+
+// searchLayer adds any of the pending files which are in the given layer to
+// the tar archive (removing them from pending). Files which are hidden by the
+// layer (with a whiteout, or by replacing a parent directory) are added from
+// root, because they can't be in any lower layer.
+func (lc *layerContents) searchLayer(tg *tarGenerator, root string, layerDescriptor ispec.Descriptor, pending map[string]unchangedFile) error {
+	layer, err := OpenLayer(lc.ctx, lc.engine, layerDescriptor)
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+
+	// hidden returns whether the given path is hidden in lower layers.
+	var hiddenDirs, hiddenPaths []string
+	hidden := func(path string) bool {
+		for _, dir := range hiddenDirs {
+			if isUnder(path, dir) {
+				return true
+			}
+		}
+		for _, hiddenPath := range hiddenPaths {
+			if path == hiddenPath || isUnder(path, hiddenPath) {
+				return true
+			}
+		}
+		return false
+	}
+
+	tr := tar.NewReader(layer)
+	for len(pending) > 0 {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+
+		path := strings.TrimPrefix(filepath.Clean("/"+hdr.Name), "/")
+		dir, file := filepath.Split(path)
+
+		if file == whOpaque {
+			hiddenDirs = append(hiddenDirs, strings.TrimSuffix(dir, "/"))
+			continue
+		}
+		if strings.HasPrefix(file, whPrefix) {
+			hiddenPaths = append(hiddenPaths, filepath.Join(dir, strings.TrimPrefix(file, whPrefix)))
+			continue
+		}
+
+		unchanged, ok := pending[path]
+		if !ok {
+			// Anything other than a directory hides the paths inside it.
+			if path != "" && hdr.Typeflag != tar.TypeDir {
+				hiddenDirs = append(hiddenDirs, path)
+			}
+			continue
+		}
+		delete(pending, path)
+
+		fullPath := filepath.Join(root, unchanged.name)
+		if (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA) || hdr.Size != unchanged.size {
+			// The file isn't the same file as in the layer (or is a
+			// hardlink, which we don't bother resolving).
+			event.Log(lc.ctx).Debugf("generate layer: %s does not match layer entry, reading from rootfs", unchanged.name)
+			if err := tg.AddFile(unchanged.name, fullPath); err != nil {
+				return errors.Wrap(err, "add file")
+			}
+			continue
+		}
+		if err := tg.addFile(unchanged.name, fullPath, tr); err != nil {
+			return errors.Wrap(err, "add file from layer")
+		}
+	}
+
+	for path, unchanged := range pending {
+		if !hidden(path) {
+			continue
+		}
+		delete(pending, path)
+		event.Log(lc.ctx).Debugf("generate layer: %s is hidden by layer, reading from rootfs", unchanged.name)
+		if err := tg.AddFile(unchanged.name, filepath.Join(root, unchanged.name)); err != nil {
+			return errors.Wrap(err, "add file")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+func TestStatKeywords(t *testing.T) {
+	keywords := []mtree.Keyword{"size", "type", "uid", "sha256digest", "sha1", "xattr", "md5digest"}
+	expected := []mtree.Keyword{"size", "type", "uid", "xattr"}
+	if got := StatKeywords(keywords); !reflect.DeepEqual(got, expected) {
+		t.Errorf("StatKeywords: expected %v got %v", expected, got)
+	}
+}
+
+func TestGenerateMetadataLayer(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateMetadataLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reg := func(name, data string) testEntry {
+		return testEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeReg}, data: data}
+	}
+	base := putUncompressedLayer(t, engine, []testEntry{
+		reg("chmod", "layer contents"),
+		reg("changed", "old contents"),
+		reg("hidden/file", "layer contents"),
+	})
+	upper := putUncompressedLayer(t, engine, []testEntry{
+		reg(".wh.hidden", ""),
+		reg("link", "layer contents"),
+		{hdr: tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "link"}},
+	})
+	manifest := ispec.Manifest{
+		Layers: []ispec.Descriptor{base, upper},
+	}
+
+	// The rootfs as it was unpacked (except for hidden/file, which couldn't
+	// have been unpacked from these layers).
+	files := map[string]string{
+		"chmod":       "layer contents",
+		"changed":     "old contents",
+		"hidden/file": "layer contents",
+		"link":        "layer contents",
+		"hardlink":    "layer contents",
+		"notinlayer":  "rootfs contents",
+	}
+	if err := os.Mkdir(filepath.Join(dir, "hidden"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keywords := []mtree.Keyword{"size", "type", "mode", "tar_time", "sha256digest"}
+	spec, err := mtree.Walk(dir, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the mode of every file. The contents of all but "changed" are
+	// replaced with contents of the same size and modification time, which
+	// can only be noticed by reading the contents, so that we can tell where
+	// the contents came from.
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newData := make([]byte, len(data))
+		for i := range newData {
+			newData[i] = 'x'
+		}
+		if name == "changed" {
+			newData = []byte("new and longer contents")
+		}
+		if err := ioutil.WriteFile(path, newData, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name != "changed" {
+			if err := os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	diffs, err := mtree.Check(dir, spec, StatKeywords(keywords), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateMetadataLayer(ctx, engine, manifest, dir, diffs, &RepackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	got := map[string]string{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if hdr.Mode&0777 != 0600 {
+			t.Errorf("%s: metadata not taken from rootfs: mode %o", hdr.Name, hdr.Mode)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("unexpected error reading %s: %+v", hdr.Name, err)
+		}
+		got[hdr.Name] = string(data)
+	}
+
+	expected := map[string]string{
+		// Only metadata was changed, so the contents come from the layers.
+		"chmod": "layer contents",
+		"link":  "layer contents",
+		// Files which were resized, are hidden in the layers, aren't in
+		// the layers at all or are hardlinks are read from the rootfs.
+		"changed":     "new and longer contents",
+		"hidden/file": "xxxxxxxxxxxxxx",
+		"notinlayer":  "xxxxxxxxxxxxxxx",
+		"hardlink":    "xxxxxxxxxxxxxx",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected layer contents: got %q, expected %q", got, expected)
+	}
+}
@@ -0,0 +1,169 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/openSUSE/umoci/third_party/user"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// OwnerNames maps user and group names to (container) IDs, usually taken from
+// the /etc/passwd and /etc/group of an image. It is used to set the owner
+// names of the entries of generated layers (see RepackOptions.OwnerNames),
+// and to resolve the owner of layer entries by name when unpacking (see
+// MapOptions.PreferNames).
+type OwnerNames struct {
+	Users  map[string]int `json:"users,omitempty"`
+	Groups map[string]int `json:"groups,omitempty"`
+}
+
+// ParseOwnerNames returns the names in the given /etc/passwd and /etc/group
+// formatted data. Either reader may be nil, in which case there are no names
+// of that kind.
+func ParseOwnerNames(passwd, group io.Reader) (OwnerNames, error) {
+	names := OwnerNames{
+		Users:  map[string]int{},
+		Groups: map[string]int{},
+	}
+	if passwd != nil {
+		users, err := user.ParsePasswd(passwd)
+		if err != nil {
+			return OwnerNames{}, errors.Wrap(err, "parse passwd")
+		}
+		for _, u := range users {
+			// The first entry for a name wins, as with getpwnam(3).
+			if _, ok := names.Users[u.Name]; !ok && u.Name != "" {
+				names.Users[u.Name] = u.Uid
+			}
+		}
+	}
+	if group != nil {
+		groups, err := user.ParseGroup(group)
+		if err != nil {
+			return OwnerNames{}, errors.Wrap(err, "parse group")
+		}
+		for _, g := range groups {
+			if _, ok := names.Groups[g.Name]; !ok && g.Name != "" {
+				names.Groups[g.Name] = g.Gid
+			}
+		}
+	}
+	return names, nil
+}
+
+// ReadOwnerNames returns the names in the etc/passwd and etc/group of the
+// given root filesystem. Files which are missing (or are not regular files)
+// are treated as being empty.
+func ReadOwnerNames(root string) (OwnerNames, error) {
+	var readers []io.Reader
+	for _, name := range []string{"passwd", "group"} {
+		path := filepath.Join(root, "etc", name)
+		if fi, err := os.Lstat(path); err != nil || !fi.Mode().IsRegular() {
+			event.Default().Debugf("read owner names: ignoring %s: not a regular file", path)
+			readers = append(readers, nil)
+			continue
+		}
+		fh, err := os.Open(path)
+		if err != nil {
+			return OwnerNames{}, errors.Wrapf(err, "open %s", name)
+		}
+		defer fh.Close()
+		readers = append(readers, fh)
+	}
+	return ParseOwnerNames(readers[0], readers[1])
+}
+
+// ReadImageOwnerNames returns the names in the etc/passwd and etc/group of the
+// root filesystem of the given image manifest, without extracting it (see
+// ReadFiles).
+func ReadImageOwnerNames(ctx context.Context, engine cas.Engine, manifest ispec.Manifest) (OwnerNames, error) {
+	files, err := ReadFiles(ctx, engine, manifest, func(path string) bool {
+		return path == "etc/passwd" || path == "etc/group"
+	})
+	if err != nil {
+		return OwnerNames{}, errors.Wrap(err, "read owner names")
+	}
+	var passwd, group io.Reader
+	if data, ok := files["etc/passwd"]; ok {
+		passwd = bytes.NewReader(data)
+	}
+	if data, ok := files["etc/group"]; ok {
+		group = bytes.NewReader(data)
+	}
+	return ParseOwnerNames(passwd, group)
+}
+
+// LoadOwnerNames returns the names in the given JSON file, which is in the
+// same format as the JSON encoding of OwnerNames.
+func LoadOwnerNames(path string) (OwnerNames, error) {
+	var names OwnerNames
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return names, errors.Wrap(err, "open owner names")
+	}
+	defer fh.Close()
+
+	if err := json.NewDecoder(fh).Decode(&names); err != nil {
+		return names, errors.Wrap(err, "decode owner names")
+	}
+	for name, id := range names.Users {
+		if name == "" || id < 0 || int64(id) > maxID {
+			return names, errors.Errorf("invalid user %q with uid %d", name, id)
+		}
+	}
+	for name, id := range names.Groups {
+		if name == "" || id < 0 || int64(id) > maxID {
+			return names, errors.Errorf("invalid group %q with gid %d", name, id)
+		}
+	}
+	return names, nil
+}
+
+// lookupName returns the name of the given ID. If several names have the
+// same ID, the first in sorted order is used so that the result is
+// deterministic.
+func lookupName(names map[string]int, id int) (string, bool) {
+	var found string
+	for name, nameID := range names {
+		if nameID == id && (found == "" || name < found) {
+			found = name
+		}
+	}
+	return found, found != ""
+}
+
+// UserName returns the name of the given uid, if it has one.
+func (n OwnerNames) UserName(uid int) (string, bool) {
+	return lookupName(n.Users, uid)
+}
+
+// GroupName returns the name of the given gid, if it has one.
+func (n OwnerNames) GroupName(gid int) (string, bool) {
+	return lookupName(n.Groups, gid)
+}
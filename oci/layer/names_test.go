@@ -0,0 +1,197 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOwnerNames(t *testing.T) {
+	passwd := "root:x:0:0:root:/root:/bin/sh\nuser:x:1000:100::/home/user:/bin/sh\ntoor:x:0:0::/root:/bin/sh\nuser:x:2000:100::/:/bin/sh\n"
+	group := "root:x:0:\nusers:x:100:user\n"
+
+	names, err := ParseOwnerNames(strings.NewReader(passwd), strings.NewReader(group))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if expected := map[string]int{"root": 0, "user": 1000, "toor": 0}; !reflect.DeepEqual(names.Users, expected) {
+		t.Errorf("unexpected users: expected %v got %v", expected, names.Users)
+	}
+	if expected := map[string]int{"root": 0, "users": 100}; !reflect.DeepEqual(names.Groups, expected) {
+		t.Errorf("unexpected groups: expected %v got %v", expected, names.Groups)
+	}
+
+	for _, test := range []struct {
+		uid  int
+		name string
+		ok   bool
+	}{
+		{0, "root", true},
+		{1000, "user", true},
+		{2000, "", false},
+	} {
+		name, ok := names.UserName(test.uid)
+		if name != test.name || ok != test.ok {
+			t.Errorf("UserName(%d): expected %q (%v) got %q (%v)", test.uid, test.name, test.ok, name, ok)
+		}
+	}
+	if name, _ := names.GroupName(100); name != "users" {
+		t.Errorf("GroupName(100): expected users got %q", name)
+	}
+
+	// Missing files have no names.
+	dir, err := ioutil.TempDir("", "umoci-TestParseOwnerNames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "etc", "passwd"), []byte(passwd), 0644); err != nil {
+		t.Fatal(err)
+	}
+	names, err = ReadOwnerNames(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if names.Users["user"] != 1000 || len(names.Groups) != 0 {
+		t.Errorf("unexpected names: %v", names)
+	}
+}
+
+func TestLoadOwnerNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestLoadOwnerNames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		data    string
+		failure bool
+	}{
+		{`{"users": {"user": 1000}, "groups": {"users": 100}}`, false},
+		{`{"users": {"user": -1}}`, true},
+		{`{"groups": {"": 100}}`, true},
+		{`not json`, true},
+	} {
+		path := filepath.Join(dir, "names.json")
+		if err := ioutil.WriteFile(path, []byte(test.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names, err := LoadOwnerNames(path)
+		if test.failure {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.data, err)
+			continue
+		}
+		if names.Users["user"] != 1000 || names.Groups["users"] != 100 {
+			t.Errorf("%s: unexpected names: %v", test.data, names)
+		}
+	}
+}
+
+func TestUnmapHeaderPreferNames(t *testing.T) {
+	mapOptions := MapOptions{
+		UserNames:   map[string]int{"user": 1000},
+		GroupNames:  map[string]int{"group": 100},
+		PreferNames: true,
+	}
+
+	for _, test := range []struct {
+		name     string
+		hdr      tar.Header
+		uid, gid int
+	}{
+		{"Names", tar.Header{Uid: 10, Gid: 20, Uname: "user", Gname: "group"}, 1000, 100},
+		{"UnknownNames", tar.Header{Uid: 10, Gid: 20, Uname: "nobody", Gname: "wheel"}, 10, 20},
+		{"NoNames", tar.Header{Uid: 10, Gid: 20}, 10, 20},
+	} {
+		hdr := test.hdr
+		if err := unmapHeader(&hdr, mapOptions); err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+			continue
+		}
+		if hdr.Uid != test.uid || hdr.Gid != test.gid {
+			t.Errorf("%s: got %d:%d, expected %d:%d", test.name, hdr.Uid, hdr.Gid, test.uid, test.gid)
+		}
+	}
+}
+
+func TestTarGenerateOwnerNames(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateOwnerNames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tg := newTarGenerator(writer, MapOptions{})
+	tg.reproducible = true
+	tg.ownerNames = &OwnerNames{
+		Users:  map[string]int{"owner": os.Getuid()},
+		Groups: map[string]int{},
+	}
+	tr := tar.NewReader(reader)
+
+	go func() {
+		if err := tg.AddFile("file", path); err != nil {
+			t.Errorf("AddFile: %s: unexpected error: %s", path, err)
+		}
+		if err := tg.tw.Close(); err != nil {
+			t.Errorf("tw.Close: unexpected error: %s", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Errorf("writer.Close: unexpected error: %s", err)
+		}
+	}()
+
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("reading tar archive: %s", err)
+	}
+	if hdr.Uname != "owner" {
+		t.Errorf("expected uname owner, got %q", hdr.Uname)
+	}
+	if hdr.Gname != "" {
+		t.Errorf("expected empty gname, got %q", hdr.Gname)
+	}
+	if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+		t.Fatal(err)
+	}
+}
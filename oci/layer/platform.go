@@ -0,0 +1,40 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ErrWindowsLayers is returned when the layers of a Windows image would have
+// to be extracted or generated. Windows layers store their files under
+// "Files/" (with registry hives under "Hives/") and carry Windows security
+// descriptors, none of which can be represented in a root filesystem on
+// Linux. Windows images can still be copied, inspected, tagged and have their
+// configuration modified, since none of these touch the layers.
+var ErrWindowsLayers = errors.New("windows layers cannot be extracted or generated")
+
+// CheckPlatform returns ErrWindowsLayers if the layers of images for the
+// given platform cannot be extracted or generated.
+func CheckPlatform(platform ispec.Platform) error {
+	if platform.OS == "windows" {
+		return errors.Wrapf(ErrWindowsLayers, "image is for %s/%s", platform.OS, platform.Architecture)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+
+	"github.com/pkg/errors"
+)
+
+// ExtractAction specifies how a kind of layer entry covered by an
+// ExtractPolicy is extracted.
+type ExtractAction string
+
+const (
+	// ExtractPreserve extracts the entry as faithfully as possible. This is
+	// the default.
+	ExtractPreserve ExtractAction = "preserve"
+
+	// ExtractSkip leaves the entry out of the rootfs. Any path it would have
+	// replaced is removed, as though the entry were a whiteout. For setuid
+	// and setgid bits, only the bits are left out.
+	ExtractSkip ExtractAction = "skip"
+
+	// ExtractError causes extraction to fail.
+	ExtractError ExtractAction = "error"
+)
+
+// Validate returns an error if the ExtractAction is unknown. The empty action
+// is the same as ExtractPreserve.
+func (a ExtractAction) Validate() error {
+	switch a {
+	case "", ExtractPreserve, ExtractSkip, ExtractError:
+		return nil
+	}
+	return errors.Errorf("unknown extract action: %s", a)
+}
+
+// ExtractPolicy specifies how the entries of a layer which cannot always be
+// extracted faithfully (or which are dangerous to extract) are handled, so
+// that users of the layer package can choose how much fidelity they need.
+// The zero value preserves everything, which matches the behaviour of earlier
+// versions of umoci.
+//
+// With MapOptions.Rootless, device nodes cannot be created and so
+// ExtractPreserve emulates them with empty regular files (recording the real
+// device numbers in the user.rootlesscontainers xattr), and setuid and setgid
+// bits apply to the unprivileged user rather than the owner in the image.
+type ExtractPolicy struct {
+	// CrossLayerHardlinks is how hardlink entries whose target is in a lower
+	// layer are handled. With ExtractPreserve they are extracted according
+	// to UnpackOptions.HardlinkMode.
+	CrossLayerHardlinks ExtractAction
+
+	// DeviceNodes is how character and block device entries are handled.
+	DeviceNodes ExtractAction
+
+	// SetuidBits is how the setuid and setgid bits of entries (other than
+	// directories, where the setgid bit only affects the group of new files)
+	// are handled.
+	SetuidBits ExtractAction
+
+	// WhiteoutConflicts is how whiteouts of a path (or a parent of a path)
+	// which was already extracted from the same layer are handled. Such a
+	// layer is ambiguous, as whiteouts only apply to the lower layers. With
+	// ExtractPreserve the whiteout is applied (removing the path), as other
+	// tools do. With ExtractSkip the whiteout is ignored, and with
+	// ExtractError extraction fails with ErrWhiteoutConflict.
+	WhiteoutConflicts ExtractAction
+}
+
+// Validate returns an error if any of the actions in the ExtractPolicy are
+// unknown.
+func (p ExtractPolicy) Validate() error {
+	if err := p.CrossLayerHardlinks.Validate(); err != nil {
+		return errors.Wrap(err, "cross-layer hardlinks")
+	}
+	if err := p.DeviceNodes.Validate(); err != nil {
+		return errors.Wrap(err, "device nodes")
+	}
+	if err := p.SetuidBits.Validate(); err != nil {
+		return errors.Wrap(err, "setuid bits")
+	}
+	if err := p.WhiteoutConflicts.Validate(); err != nil {
+		return errors.Wrap(err, "whiteout conflicts")
+	}
+	return nil
+}
+
+// Mode bits of tar.Header.Mode.
+const (
+	tarModeSetuid = 04000
+	tarModeSetgid = 02000
+)
+
+// applyExtractPolicy applies te.extractPolicy to the given entry, returning
+// whether the entry should be skipped. The setuid and setgid bits are removed
+// from hdr if they are being skipped.
+func (te *tarExtractor) applyExtractPolicy(hdr *tar.Header) (bool, error) {
+	var action ExtractAction
+	var what string
+	switch hdr.Typeflag {
+	case tar.TypeLink:
+		target := layerKey(hdr.Linkname)
+		_, sameLayer := te.layerPaths[target]
+		_, copied := te.hardlinkCopies[target]
+		if !sameLayer && !copied {
+			action, what = te.extractPolicy.CrossLayerHardlinks, "hardlink to lower layer path "+hdr.Linkname
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		action, what = te.extractPolicy.DeviceNodes, "device node"
+	}
+	switch action {
+	case ExtractSkip:
+		return true, nil
+	case ExtractError:
+		return false, errors.Errorf("%s: %s not permitted by extract policy", hdr.Name, what)
+	}
+
+	if hdr.Typeflag == tar.TypeDir || hdr.Typeflag == tar.TypeLink || hdr.Mode&(tarModeSetuid|tarModeSetgid) == 0 {
+		return false, nil
+	}
+	switch te.extractPolicy.SetuidBits {
+	case ExtractSkip:
+		hdr.Mode &^= tarModeSetuid | tarModeSetgid
+	case ExtractError:
+		return false, errors.Errorf("%s: setuid or setgid bit not permitted by extract policy", hdr.Name)
+	}
+	return false, nil
+}
+
+// applyWhiteoutPolicy applies te.extractPolicy to the given whiteout entry of
+// the path with the given key, returning whether the whiteout should be
+// skipped. Only whiteouts which conflict with the current layer are affected.
+func (te *tarExtractor) applyWhiteoutPolicy(hdr *tar.Header, key string) (bool, error) {
+	if !te.inLayer(key) {
+		return false, nil
+	}
+	switch te.extractPolicy.WhiteoutConflicts {
+	case ExtractSkip:
+		return true, nil
+	case ExtractError:
+		return false, errors.Wrapf(ErrWhiteoutConflict, "whiteout %s", hdr.Name)
+	}
+	return false, nil
+}
@@ -0,0 +1,132 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestExtractPolicy(t *testing.T) {
+	mapOptions := MapOptions{Rootless: os.Geteuid() != 0}
+
+	for _, action := range []ExtractAction{"", ExtractPreserve, ExtractSkip, ExtractError} {
+		for _, test := range []struct {
+			name   string
+			policy ExtractPolicy
+			entry  *tar.Header
+			check  func(t *testing.T, dir string)
+		}{
+			{
+				name:   "CrossLayerHardlinks",
+				policy: ExtractPolicy{CrossLayerHardlinks: action},
+				entry:  &tar.Header{Name: "lower", Typeflag: tar.TypeLink, Linkname: "target"},
+				check: func(t *testing.T, dir string) {
+					// Hardlinks within the layer are not affected.
+					if testInode(t, filepath.Join(dir, "upper")) != testInode(t, filepath.Join(dir, "upper-link")) {
+						t.Errorf("hardlink within the layer was not linked")
+					}
+				},
+			},
+			{
+				name:   "DeviceNodes",
+				policy: ExtractPolicy{DeviceNodes: action},
+				entry:  &tar.Header{Name: "lower", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+			},
+			{
+				name:   "SetuidBits",
+				policy: ExtractPolicy{SetuidBits: action},
+				entry:  &tar.Header{Name: "lower", Typeflag: tar.TypeReg, Mode: 04755},
+				check: func(t *testing.T, dir string) {
+					fi, err := os.Lstat(filepath.Join(dir, "lower"))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if setuid := fi.Mode()&os.ModeSetuid != 0; setuid == (action == ExtractSkip) {
+						t.Errorf("unexpected setuid bit: %v", fi.Mode())
+					}
+					// The setgid bit of directories is always extracted.
+					fi, err = os.Lstat(filepath.Join(dir, "upper-dir"))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if fi.Mode()&os.ModeSetgid == 0 {
+						t.Errorf("directory lost setgid bit: %v", fi.Mode())
+					}
+				},
+			},
+		} {
+			t.Run(test.name+"="+string(action), func(t *testing.T) {
+				if err := test.policy.Validate(); err != nil {
+					t.Fatalf("unexpected error validating policy: %+v", err)
+				}
+
+				dir, err := ioutil.TempDir("", "umoci-TestExtractPolicy")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+
+				lower := testHardlinkLayer(t,
+					&tar.Header{Name: "target", Typeflag: tar.TypeReg, Mode: 0644},
+					&tar.Header{Name: "lower", Typeflag: tar.TypeReg, Mode: 0644},
+				)
+				if err := unpackLayer(context.Background(), newTarExtractor(mapOptions), dir, lower); err != nil {
+					t.Fatalf("unexpected error unpacking lower layer: %+v", err)
+				}
+
+				upper := testHardlinkLayer(t,
+					&tar.Header{Name: "upper", Typeflag: tar.TypeReg, Mode: 0644},
+					&tar.Header{Name: "upper-link", Typeflag: tar.TypeLink, Linkname: "upper"},
+					&tar.Header{Name: "upper-dir", Typeflag: tar.TypeDir, Mode: 02755},
+					test.entry,
+				)
+				te := newTarExtractor(mapOptions)
+				te.extractPolicy = test.policy
+				err = unpackLayer(context.Background(), te, dir, upper)
+				if action == ExtractError {
+					if err == nil {
+						t.Fatalf("expected error unpacking layer")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error unpacking layer: %+v", err)
+				}
+
+				// Skipped entries remove the path they replace.
+				_, err = os.Lstat(filepath.Join(dir, "lower"))
+				if skipped := os.IsNotExist(err); skipped != (action == ExtractSkip && test.name != "SetuidBits") {
+					t.Errorf("unexpected state of replaced path: skipped=%v", skipped)
+				}
+				if test.check != nil {
+					test.check(t, dir)
+				}
+			})
+		}
+	}
+
+	if err := (ExtractPolicy{DeviceNodes: "ignore"}).Validate(); err == nil {
+		t.Errorf("expected error validating unknown extract action")
+	}
+}
@@ -0,0 +1,201 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+// RefreshMode specifies which differences between a rootfs and its mtree
+// manifest are treated as changes when finding the inodes that were modified
+// since the rootfs was unpacked.
+type RefreshMode string
+
+const (
+	// RefreshFull treats a difference in any of the keywords of the manifest
+	// as a change. This is the default.
+	RefreshFull RefreshMode = "full"
+
+	// RefreshContent only treats differences in the type, size, symlink
+	// target and digests of inodes as changes. Ownership, permissions,
+	// timestamps, link counts and xattrs are ignored, as they are not stable
+	// on some network and overlay filesystems (such as NFS with root
+	// squashing, or overlayfs with copy-up). Note that this means that inodes
+	// whose metadata (but not contents) was deliberately modified are not
+	// included in the generated layer.
+	RefreshContent RefreshMode = "content"
+)
+
+// Keywords returns the subset of the given mtree keywords which are compared
+// in this mode.
+func (mode RefreshMode) Keywords(keywords []mtree.Keyword) []mtree.Keyword {
+	if mode != RefreshContent {
+		return keywords
+	}
+	var refreshKeywords []mtree.Keyword
+	for _, keyword := range keywords {
+		if _, ok := metadataKeywords[keyword.Synonym()]; !ok {
+			refreshKeywords = append(refreshKeywords, keyword)
+		}
+	}
+	return refreshKeywords
+}
+
+// KeywordTolerance is a difference in the value of an mtree keyword which is
+// not treated as a change (see FilterTolerated).
+type KeywordTolerance struct {
+	// Keyword is the keyword whose differences are tolerated. The "time"
+	// keyword also applies to "tar_time" (and vice versa).
+	Keyword mtree.Keyword
+
+	// Skew, if non-zero, is the largest difference between the old and new
+	// values of a time keyword which is tolerated, for filesystems whose
+	// timestamps are skewed or truncated. If it is zero, every difference
+	// is tolerated.
+	Skew time.Duration
+}
+
+// isTimeKeyword returns whether the keyword is a modification time.
+func isTimeKeyword(keyword mtree.Keyword) bool {
+	return keyword == "time" || keyword == "tar_time"
+}
+
+// ParseKeywordTolerance parses a KeywordTolerance of the form <keyword> (to
+// tolerate every difference) or <keyword>=<skew> (where <skew> is a duration
+// in the format accepted by time.ParseDuration, which is only valid for the
+// "time" and "tar_time" keywords).
+func ParseKeywordTolerance(value string) (KeywordTolerance, error) {
+	parts := strings.SplitN(value, "=", 2)
+	keyword := mtree.KeywordSynonym(parts[0])
+	if _, ok := mtree.KeywordFuncs[keyword]; !ok || parts[0] == "" {
+		return KeywordTolerance{}, errors.Errorf("unknown keyword %q", parts[0])
+	}
+	if keyword == "type" {
+		return KeywordTolerance{}, errors.Errorf("differences in keyword %q cannot be tolerated", parts[0])
+	}
+
+	tolerance := KeywordTolerance{Keyword: keyword}
+	if len(parts) == 2 {
+		if !isTimeKeyword(keyword) {
+			return KeywordTolerance{}, errors.Errorf("keyword %q does not support a skew", parts[0])
+		}
+		skew, err := time.ParseDuration(parts[1])
+		if err != nil || skew <= 0 {
+			return KeywordTolerance{}, errors.Errorf("invalid skew %q: must be a positive duration", parts[1])
+		}
+		tolerance.Skew = skew
+	}
+	return tolerance, nil
+}
+
+func (t KeywordTolerance) String() string {
+	if t.Skew != 0 {
+		return string(t.Keyword) + "=" + t.Skew.String()
+	}
+	return string(t.Keyword)
+}
+
+// parseTimeValue parses the value of a time or tar_time keyword (seconds
+// since the epoch, with an optional fractional part).
+func parseTimeValue(value string) (float64, bool) {
+	seconds, err := strconv.ParseFloat(value, 64)
+	return seconds, err == nil
+}
+
+// tolerates returns whether a difference in the given keyword, between the
+// old and new values (either of which is nil if the keyword was missing), is
+// tolerated.
+func (t KeywordTolerance) tolerates(name mtree.Keyword, oldValue, newValue *string) bool {
+	if name != t.Keyword && !(isTimeKeyword(name) && isTimeKeyword(t.Keyword)) {
+		return false
+	}
+	if t.Skew == 0 {
+		return true
+	}
+
+	// A skew only applies to modified values.
+	if oldValue == nil || newValue == nil {
+		return false
+	}
+	oldTime, ok1 := parseTimeValue(*oldValue)
+	newTime, ok2 := parseTimeValue(*newValue)
+	if !ok1 || !ok2 {
+		return false
+	}
+	return math.Abs(newTime-oldTime) <= t.Skew.Seconds()
+}
+
+// tolerated returns whether a difference in the given keyword is tolerated by
+// one of the tolerances.
+func tolerated(tolerances []KeywordTolerance, name mtree.Keyword, oldValue, newValue *string) bool {
+	for _, tolerance := range tolerances {
+		if tolerance.tolerates(name, oldValue, newValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterTolerated returns the given deltas, excluding the modified inodes
+// whose differences are all tolerated by one of the given tolerances. Added
+// and removed inodes are never excluded.
+func FilterTolerated(diffs []mtree.InodeDelta, tolerances []KeywordTolerance) []mtree.InodeDelta {
+	if len(tolerances) == 0 {
+		return diffs
+	}
+
+	var filtered []mtree.InodeDelta
+	for _, diff := range diffs {
+		if diff.Type() != mtree.Modified || !allTolerated(diff, tolerances) {
+			filtered = append(filtered, diff)
+		}
+	}
+	return filtered
+}
+
+// keywordValue returns the value of the keyword in the given keys, or nil if
+// the keyword is missing.
+func keywordValue(keys []mtree.KeyVal, keyword mtree.Keyword) *string {
+	kv := mtree.HasKeyword(keys, keyword)
+	if kv == "" {
+		return nil
+	}
+	value := kv.Value()
+	return &value
+}
+
+// allTolerated returns whether each of the differences of the modified inode
+// is tolerated by one of the tolerances.
+func allTolerated(diff mtree.InodeDelta, tolerances []KeywordTolerance) bool {
+	// The values are taken from the entries, as mtree.KeyDelta.New returns
+	// the old value in the version of go-mtree we use.
+	oldKeys, newKeys := diff.Old().AllKeys(), diff.New().AllKeys()
+	for _, delta := range diff.Diff() {
+		oldValue, newValue := keywordValue(oldKeys, delta.Name()), keywordValue(newKeys, delta.Name())
+		if !tolerated(tolerances, delta.Name(), oldValue, newValue) {
+			return false
+		}
+	}
+	return true
+}
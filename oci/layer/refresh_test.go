@@ -0,0 +1,142 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vbatts/go-mtree"
+)
+
+func TestRefreshModeKeywords(t *testing.T) {
+	keywords := []mtree.Keyword{"size", "type", "uid", "gid", "mode", "link", "nlink", "tar_time", "sha256digest", "xattr"}
+
+	if got := RefreshFull.Keywords(keywords); !reflect.DeepEqual(got, keywords) {
+		t.Errorf("unexpected full keywords: %v", got)
+	}
+	expected := []mtree.Keyword{"size", "type", "link", "sha256digest"}
+	if got := RefreshContent.Keywords(keywords); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected content keywords: expected %v got %v", expected, got)
+	}
+}
+
+func TestParseKeywordTolerance(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected KeywordTolerance
+		failure  bool
+	}{
+		{"uid", KeywordTolerance{Keyword: "uid"}, false},
+		{"sha256", KeywordTolerance{Keyword: "sha256digest"}, false},
+		{"tar_time=2s", KeywordTolerance{Keyword: "tar_time", Skew: 2 * time.Second}, false},
+		{"time=1h", KeywordTolerance{Keyword: "time", Skew: time.Hour}, false},
+		{"uid=1s", KeywordTolerance{}, true},
+		{"time=-1s", KeywordTolerance{}, true},
+		{"time=forever", KeywordTolerance{}, true},
+		{"type", KeywordTolerance{}, true},
+		{"nonexistent", KeywordTolerance{}, true},
+		{"", KeywordTolerance{}, true},
+	} {
+		tolerance, err := ParseKeywordTolerance(test.value)
+		if test.failure {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.value, tolerance)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %+v", test.value, err)
+			continue
+		}
+		if tolerance != test.expected {
+			t.Errorf("%q: expected %v got %v", test.value, test.expected, tolerance)
+		}
+	}
+}
+
+func TestCheckParallelTolerant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestCheckParallelTolerant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"skewed", "modified", "moved", "chmod"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keywords := []mtree.Keyword{"size", "type", "uid", "gid", "mode", "link", "nlink", "tar_time", "sha256digest"}
+	spec, err := mtree.Walk(dir, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The mtime of "skewed" moves slightly, the contents of "modified" are
+	// changed (with the same size) along with a slightly different mtime,
+	// and the mtime of "moved" changes by much more than the skew.
+	fi, err := os.Stat(filepath.Join(dir, "skewed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	skewed := fi.ModTime().Add(time.Second)
+	if err := os.Chtimes(filepath.Join(dir, "skewed"), skewed, skewed); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "modified"), []byte(strings.ToUpper("modified")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "modified"), skewed, skewed); err != nil {
+		t.Fatal(err)
+	}
+	moved := fi.ModTime().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "moved"), moved, moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "chmod"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		mode       RefreshMode
+		tolerances []KeywordTolerance
+		expected   []string
+	}{
+		{"Full", RefreshFull, nil, []string{"modified chmod", "modified modified", "modified moved", "modified skewed"}},
+		{"Skew", RefreshFull, []KeywordTolerance{{Keyword: "time", Skew: 2 * time.Second}}, []string{"modified chmod", "modified modified", "modified moved"}},
+		{"Mode", RefreshFull, []KeywordTolerance{{Keyword: "tar_time"}, {Keyword: "mode"}}, []string{"modified modified"}},
+		{"Content", RefreshContent, nil, []string{"modified modified"}},
+	} {
+		deltas, err := CheckParallelTolerant(dir, spec, test.mode.Keywords(keywords), test.tolerances, nil, 0)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+			continue
+		}
+		if got := deltaStrings(deltas); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: unexpected deltas: expected %v got %v", test.name, test.expected, got)
+		}
+	}
+}
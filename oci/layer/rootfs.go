@@ -0,0 +1,143 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/openSUSE/umoci/pkg/ctxio"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// gzipMagic is the magic number at the start of gzip-compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// PackRootfs creates a new OCI layer that contains the entire root filesystem
+// at the provided path, which is either a directory (as with
+// GenerateFullLayer) or a tar archive of a root filesystem (optionally
+// gzip-compressed). The entries of a tar archive are copied with their paths
+// normalised (so that no entry can escape the root filesystem) and with their
+// headers normalised according to the reproducibility options, but their
+// ownership is not mapped. Tar archives must not contain whiteouts. The
+// returned reader is for the *raw* tar data, it is the caller's
+// responsibility to gzip it.
+func PackRootfs(ctx context.Context, path string, opt *RepackOptions) (io.ReadCloser, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "stat rootfs")
+	}
+	if fi.IsDir() {
+		return GenerateFullLayer(ctx, path, opt)
+	}
+
+	var repackOptions RepackOptions
+	if opt != nil {
+		repackOptions = *opt
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open rootfs archive")
+	}
+
+	reader, writer := io.Pipe()
+	go func() (err error) {
+		defer fh.Close()
+		// Close with the returned error.
+		defer func() {
+			writer.CloseWithError(errors.Wrap(err, "generate layer"))
+		}()
+
+		var archive io.Reader = bufio.NewReader(ctxio.NewReader(ctx, fh))
+		if magic, err := archive.(*bufio.Reader).Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+			gzReader, err := gzip.NewReader(archive)
+			if err != nil {
+				return errors.Wrap(err, "create gzip reader")
+			}
+			defer gzReader.Close()
+			archive = gzReader
+		}
+
+		tg := newTarGenerator(writer, repackOptions.MapOptions)
+		tg.reproducible = repackOptions.Reproducible
+		tg.sourceDateEpoch = repackOptions.SourceDateEpoch
+		tg.clampMtime = repackOptions.ClampMtime
+		tg.ctx = ctx
+
+		tr := tar.NewReader(archive)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return errors.Wrap(err, "read next entry")
+			}
+			if err := tg.addEntry(hdr, tr); err != nil {
+				return errors.Wrapf(err, "copy entry %s", hdr.Name)
+			}
+		}
+		return tg.tw.Close()
+	}()
+	return reader, nil
+}
+
+// addEntry copies an entry from another tar archive (with the given content
+// for regular files) to the tar archive, normalising its path and header.
+func (tg *tarGenerator) addEntry(hdr *tar.Header, content io.Reader) error {
+	if strings.HasPrefix(filepath.Base(filepath.Clean("/"+hdr.Name)), whPrefix) {
+		return errors.Errorf("root filesystem archives cannot contain whiteouts")
+	}
+
+	name, err := normalise(hdr.Name, hdr.Typeflag == tar.TypeDir)
+	if err != nil {
+		return errors.Wrap(err, "normalise path")
+	}
+	hdr.Name = name
+	if hdr.Typeflag == tar.TypeLink {
+		if hdr.Linkname, err = normalise(hdr.Linkname, false); err != nil {
+			return errors.Wrap(err, "normalise hardlink target")
+		}
+	}
+
+	tg.normaliseHeader(hdr)
+	hdr.Format = tar.FormatUnknown
+	setHeaderFormat(hdr)
+
+	if err := tg.tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		n, err := io.Copy(tg.tw, ctxio.NewReader(tg.ctx, content))
+		if err != nil {
+			return errors.Wrap(err, "copy to layer")
+		}
+		if n != hdr.Size {
+			return errors.Wrap(io.ErrShortWrite, "copy to layer")
+		}
+	}
+	return nil
+}
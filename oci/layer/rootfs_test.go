@@ -0,0 +1,152 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type rootfsEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+func writeRootfsArchive(t *testing.T, path string, compress bool, entries []rootfsEntry) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		hdr := entry.hdr
+		hdr.Size = int64(len(entry.data))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	if compress {
+		var gzBuf bytes.Buffer
+		gzw := gzip.NewWriter(&gzBuf)
+		gzw.Write(data)
+		gzw.Close()
+		data = gzBuf.Bytes()
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readRootfsLayer(reader io.Reader) (map[string]string, error) {
+	entries := map[string]string{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		entries[hdr.Name] = string(data)
+	}
+}
+
+func TestPackRootfsArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestPackRootfsArchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modTime := time.Unix(12345, 0)
+	entries := []rootfsEntry{
+		{hdr: tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime}},
+		{hdr: tar.Header{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime}},
+		{hdr: tar.Header{Name: "./etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, ModTime: modTime}, data: "root:x:0:0::/root:/bin/sh\n"},
+		{hdr: tar.Header{Name: "../../escape", Typeflag: tar.TypeReg, Mode: 0644, ModTime: modTime}, data: "escaped"},
+		{hdr: tar.Header{Name: "etc/hardlink", Typeflag: tar.TypeLink, Linkname: "./../etc/passwd", ModTime: modTime}},
+	}
+	expected := map[string]string{
+		".":            "",
+		"etc/":         "",
+		"etc/passwd":   "root:x:0:0::/root:/bin/sh\n",
+		"escape":       "escaped",
+		"etc/hardlink": "",
+	}
+
+	for _, compress := range []bool{false, true} {
+		path := filepath.Join(dir, "rootfs.tar")
+		writeRootfsArchive(t, path, compress, entries)
+
+		reader, err := PackRootfs(context.Background(), path, nil)
+		if err != nil {
+			t.Fatalf("PackRootfs (compress=%v): unexpected error: %+v", compress, err)
+		}
+		got, err := readRootfsLayer(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("PackRootfs (compress=%v): unexpected error reading layer: %+v", compress, err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("PackRootfs (compress=%v): unexpected entries: expected %v, got %v", compress, expected, got)
+		}
+	}
+}
+
+func TestPackRootfsWhiteout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestPackRootfsWhiteout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rootfs.tar")
+	writeRootfsArchive(t, path, false, []rootfsEntry{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "etc/" + whPrefix + "passwd", Typeflag: tar.TypeReg, Mode: 0644}},
+	})
+
+	reader, err := PackRootfs(context.Background(), path, nil)
+	if err != nil {
+		t.Fatalf("PackRootfs: unexpected error: %+v", err)
+	}
+	defer reader.Close()
+	if _, err := readRootfsLayer(reader); err == nil {
+		t.Errorf("PackRootfs: expected error for archive containing whiteouts")
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/ctxio"
+	"github.com/openSUSE/umoci/pkg/event"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// scrubber decides which entries of a layer are removed by ScrubLayer.
+type scrubber struct {
+	// match is the function given to ScrubLayer.
+	match func(path string) bool
+
+	// removed is the set of (cleaned, absolute) paths which have been
+	// removed from the layer so far. The contents of removed directories and
+	// hardlinks to removed files are also removed.
+	removed map[string]bool
+}
+
+// scrubs returns whether the given entry is removed.
+func (s *scrubber) scrubs(entry LayerEntry) bool {
+	// Whiteouts don't contain anything, and removing them would make the
+	// paths they remove reappear.
+	if entry.Whiteout {
+		return false
+	}
+	remove := s.match(entry.Path)
+	if !remove && entry.Type == "hardlink" {
+		remove = s.removed[entry.Linkname]
+	}
+	for dir := filepath.Dir(entry.Path); !remove && dir != "/"; dir = filepath.Dir(dir) {
+		remove = s.removed[dir]
+	}
+	if remove {
+		s.removed[entry.Path] = true
+	}
+	return remove
+}
+
+// ScrubLayer returns a reader for the uncompressed tar archive of the given
+// layer blob, with every entry whose (cleaned, absolute) path is accepted by
+// match removed. The contents of removed directories are also removed, as are
+// hardlinks to removed files (as they have the same contents). Whiteouts are
+// never removed. All other entries are copied unmodified. The returned
+// reader is for the *raw* tar data, it is the caller's responsibility to gzip
+// it. Use ScrubsLayer to check whether anything would be removed.
+func ScrubLayer(ctx context.Context, engine casext.Engine, layerDescriptor ispec.Descriptor, match func(path string) bool) (io.ReadCloser, error) {
+	layer, err := OpenLayer(ctx, engine, layerDescriptor)
+	if err != nil {
+		return nil, errors.Wrap(err, "open layer")
+	}
+
+	reader, writer := io.Pipe()
+	go func() (err error) {
+		defer layer.Close()
+		// Close with the returned error.
+		defer func() {
+			writer.CloseWithError(errors.Wrap(err, "scrub layer"))
+		}()
+
+		s := &scrubber{match: match, removed: map[string]bool{}}
+		tr := newEntryReader(ctxio.NewReader(ctx, layer))
+		tw := tar.NewWriter(writer)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return errors.Wrap(err, "read next entry")
+			}
+			if entry := newLayerEntry(hdr); s.scrubs(entry) {
+				event.Log(ctx).Debugf("scrub: removing %s from layer %s", entry.Path, layerDescriptor.Digest)
+				continue
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return errors.Wrapf(err, "write header %s", hdr.Name)
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return errors.Wrapf(err, "copy %s", hdr.Name)
+			}
+		}
+		return tw.Close()
+	}()
+	return reader, nil
+}
+
+// ScrubsLayer returns the (cleaned, absolute) paths of the entries which
+// ScrubLayer would remove from the given layer blob, without reading the
+// contents of the layer. If nothing would be removed, the layer doesn't need
+// to be regenerated.
+func ScrubsLayer(ctx context.Context, engine casext.Engine, layerDescriptor ispec.Descriptor, match func(path string) bool) ([]string, error) {
+	var paths []string
+	s := &scrubber{match: match, removed: map[string]bool{}}
+	if err := ListLayer(ctx, engine, layerDescriptor, func(entry LayerEntry) error {
+		if s.scrubs(entry) {
+			paths = append(paths, entry.Path)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// ScrubPattern returns a match function for ScrubLayer which accepts paths
+// matching any of the given shell patterns (as with filepath.Match). Patterns
+// containing a '/' are matched against the whole path (and are relative to
+// the root, so "etc/shadow" and "/etc/shadow" are the same), while other
+// patterns are matched against the final component of the path (so "*.pem"
+// matches every file ending in ".pem"). An error is returned if any of the
+// patterns are malformed.
+func ScrubPattern(patterns []string) (func(path string) bool, error) {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %q", pattern)
+		}
+	}
+	return func(path string) bool {
+		path = filepath.Clean("/" + path)
+		for _, pattern := range patterns {
+			subject := filepath.Base(path)
+			if strings.Contains(pattern, "/") {
+				pattern = filepath.Clean("/" + pattern)
+				subject = path
+			}
+			if matched, _ := filepath.Match(pattern, subject); matched {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
@@ -0,0 +1,149 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestScrubPattern(t *testing.T) {
+	match, err := ScrubPattern([]string{"*.pem", "etc/shadow", "/root/.ssh/id_*"})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	for path, expected := range map[string]bool{
+		"/etc/ssl/key.pem":      true,
+		"/key.pem":              true,
+		"/etc/shadow":           true,
+		"etc/shadow":            true,
+		"/etc/shadow-":          false,
+		"/usr/etc/shadow":       false,
+		"/root/.ssh/id_rsa":     true,
+		"/root/.ssh/id_rsa.pub": true,
+		"/root/.ssh/known":      false,
+		"/etc/passwd":           false,
+	} {
+		if got := match(path); got != expected {
+			t.Errorf("match(%q): expected %v, got %v", path, expected, got)
+		}
+	}
+
+	if _, err := ScrubPattern([]string{"[invalid"}); err == nil {
+		t.Errorf("expected error with malformed pattern")
+	}
+}
+
+func TestScrubLayer(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	tw := tar.NewWriter(gzw)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "etc/passwd", Mode: 0644, Size: 5, Typeflag: tar.TypeReg},
+		{Name: "etc/shadow", Mode: 0600, Size: 5, Typeflag: tar.TypeReg},
+		{Name: "etc/shadow-backup", Mode: 0600, Linkname: "etc/shadow", Typeflag: tar.TypeLink},
+		{Name: "etc/.wh.shadow-", Typeflag: tar.TypeReg},
+		{Name: "secrets/", Mode: 0700, Typeflag: tar.TypeDir},
+		{Name: "secrets/token", Mode: 0600, Size: 5, Typeflag: tar.TypeReg},
+		{Name: "usr/", Mode: 0755, Typeflag: tar.TypeDir},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, size, err := engine.PutBlob(ctx, &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    digest,
+		Size:      size,
+	}
+
+	match, err := ScrubPattern([]string{"shadow", "/secrets"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The whiteout of etc/shadow- is kept, while the hardlink to etc/shadow
+	// and the contents of secrets are removed.
+	expectedRemoved := []string{"/etc/shadow", "/etc/shadow-backup", "/secrets", "/secrets/token"}
+	removed, err := ScrubsLayer(ctx, casext.Engine{engine}, descriptor, match)
+	if err != nil {
+		t.Fatalf("unexpected error checking layer: %+v", err)
+	}
+	if !reflect.DeepEqual(removed, expectedRemoved) {
+		t.Errorf("ScrubsLayer: expected %v, got %v", expectedRemoved, removed)
+	}
+
+	reader, err := ScrubLayer(ctx, casext.Engine{engine}, descriptor, match)
+	if err != nil {
+		t.Fatalf("unexpected error scrubbing layer: %+v", err)
+	}
+	defer reader.Close()
+
+	var names []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading scrubbed layer: %+v", err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name == "etc/passwd" {
+			if data, err := ioutil.ReadAll(tr); err != nil || string(data) != "hello" {
+				t.Errorf("etc/passwd has the wrong contents: %q %+v", data, err)
+			}
+		}
+	}
+	expected := []string{"etc/", "etc/passwd", "etc/.wh.shadow-", "usr/"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("scrubbed layer: expected %v, got %v", expected, names)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ExtractionMode specifies how the paths of the entries in a layer are
+// checked for containment within the root they are extracted into.
+//
+// Layers from untrusted images can contain entries which try to write outside
+// of the root, either directly (with ".." components or absolute paths) or
+// through symlinks and hardlinks created by earlier entries (or earlier
+// layers), such as a symlink "/etc -> /host/etc" followed by an entry for
+// "/etc/passwd". In every mode, entry paths and hardlink targets are resolved
+// within the root (as though the root was chroot(2)-ed into), so the symlinks
+// in the rootfs are never followed outside of it.
+type ExtractionMode string
+
+const (
+	// SecureExtraction additionally has the kernel verify, before every entry
+	// is written, that the (resolved) parent directory of the entry and the
+	// target of each hardlink are beneath the root and can be reached without
+	// following any symlinks. This uses openat2(2) with RESOLVE_BENEATH and
+	// RESOLVE_NO_SYMLINKS, or an equivalent lstat(2) walk if openat2(2) is
+	// not available (Linux 5.6 or later is required). Entries which fail the
+	// check cause extraction to fail with an error whose cause is
+	// ErrPathEscape. This is the default.
+	//
+	// This guards against bugs in the resolution of paths within the root
+	// (which is done in userspace), so that no combination of entries can
+	// cause a path outside of the root to be written. When openat2(2) is
+	// used (and not in rootless mode), entries are created relative to the
+	// handle of their checked parent directory, so that it cannot be swapped
+	// for a symlink between the check and the write. It does not fully guard
+	// against other processes concurrently modifying the root while it is
+	// being extracted (metadata is applied by path, and extraction is not
+	// atomic), so the root must not be writable by untrusted users.
+	SecureExtraction ExtractionMode = "secure"
+
+	// InsecureExtraction disables the checks of SecureExtraction, relying
+	// only on the resolution of paths within the root. It should only be
+	// used for trusted images, if the cost of the checks matters.
+	InsecureExtraction ExtractionMode = "insecure"
+)
+
+// Validate returns an error if the ExtractionMode is unknown. The empty mode
+// is the same as SecureExtraction.
+func (m ExtractionMode) Validate() error {
+	switch m {
+	case "", SecureExtraction, InsecureExtraction:
+		return nil
+	}
+	return errors.Errorf("unknown extraction mode: %s", m)
+}
+
+// ErrPathEscape is the cause of the errors returned when SecureExtraction
+// finds that an entry would be written outside of the root.
+var ErrPathEscape = errors.New("path escapes root")
+
+// openRoot returns an O_PATH handle to root, which verifyBeneath and
+// openParent resolve paths relative to. The handle is only opened once for
+// every entry of a layer, and is closed by closeRoot.
+func (te *tarExtractor) openRoot(root string) (int, error) {
+	if te.rootFd >= 0 && te.rootPath == root {
+		return te.rootFd, nil
+	}
+	te.closeRoot()
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, errors.Wrapf(err, "open root %s", root)
+	}
+	te.rootFd, te.rootPath = rootFd, root
+	return rootFd, nil
+}
+
+// closeRoot closes the handle opened by openRoot, if there is one.
+func (te *tarExtractor) closeRoot() {
+	if te.rootFd >= 0 {
+		unix.Close(te.rootFd)
+	}
+	te.rootFd, te.rootPath = -1, ""
+}
+
+// relBeneath returns the absolute root and the path of path relative to it,
+// or an error whose cause is ErrPathEscape if path is not inside root.
+func relBeneath(root, path string) (string, string, error) {
+	// The root may be relative, but symlinks are resolved to absolute paths.
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", "", errors.Wrap(err, "get absolute root")
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", "", errors.Wrap(err, "get absolute path")
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", "", errors.Wrapf(ErrPathEscape, "%s is not inside %s", path, root)
+	}
+	return root, rel, nil
+}
+
+// openBeneath opens the path rel relative to the handle of root with
+// openat2(2), O_PATH and RESOLVE_BENEATH|RESOLVE_NO_SYMLINKS (so the last
+// component is only allowed to be a symlink with O_NOFOLLOW). If openat2(2) cannot be
+// used (in which case te.noOpenat2 may be set), -1 is returned without an
+// error and the caller has to fall back to walkBeneath.
+func (te *tarExtractor) openBeneath(root, rel string, flags int) (int, error) {
+	if te.noOpenat2 {
+		return -1, nil
+	}
+	rootFd, err := te.openRoot(root)
+	if err != nil {
+		return -1, err
+	}
+	fd, err := system.Openat2(rootFd, rel, flags|system.OPath|unix.O_CLOEXEC, 0, system.ResolveBeneath|system.ResolveNoSymlinks)
+	if err == nil {
+		return fd, nil
+	}
+	if err, ok := err.(*os.PathError); ok {
+		switch err.Err {
+		case unix.ENOSYS, unix.EPERM:
+			// openat2(2) isn't available, so always use the fallback.
+			te.noOpenat2 = true
+			return -1, nil
+		case unix.EACCES:
+			// In rootless mode we may not be able to search the directories
+			// of the root, but te.fsEval can.
+			return -1, nil
+		case unix.ELOOP, unix.EXDEV:
+			return -1, errors.Wrapf(ErrPathEscape, "%s is not reachable from %s without following symlinks", rel, root)
+		}
+		return -1, errors.Wrapf(err.Err, "openat2 %s", rel)
+	}
+	return -1, err
+}
+
+// verifyBeneath checks that the given path is beneath root and can be reached
+// from it without following any symlinks (the last component of path may be
+// a symlink, but it is not followed), unless te.extractionMode is
+// InsecureExtraction. Paths which don't exist (yet) pass the check, as they
+// cannot be used to escape root.
+func (te *tarExtractor) verifyBeneath(root, path string) error {
+	if te.extractionMode == InsecureExtraction {
+		return nil
+	}
+	root, rel, err := relBeneath(root, path)
+	if err != nil {
+		return err
+	}
+	fd, err := te.openBeneath(root, rel, unix.O_NOFOLLOW)
+	switch cause := errors.Cause(err); {
+	case cause == unix.ENOENT || cause == unix.ENOTDIR:
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "verify path")
+	case fd >= 0:
+		return unix.Close(fd)
+	}
+	return te.walkBeneath(root, rel)
+}
+
+// openParent opens the directory containing path (which must already exist)
+// with openat2(2), so that the kernel guarantees that it is beneath root and
+// was reached without following any symlinks. path must then be created
+// relative to the returned handle (see createAt and friends), so that the
+// directory cannot be swapped for a symlink between it being checked and
+// path being created. If te.extractionMode is InsecureExtraction, path is
+// root itself, te is rootless (where te.fsEval has to be used to create
+// paths) or openat2(2) cannot be used, -1 is returned (after checking path
+// with verifyBeneath) and path should be created with te.fsEval instead.
+func (te *tarExtractor) openParent(root, path string) (int, error) {
+	if te.extractionMode == InsecureExtraction {
+		return -1, nil
+	}
+	absRoot, rel, err := relBeneath(root, path)
+	if err != nil {
+		return -1, err
+	}
+	if rel == "." || te.mapOptions.Rootless {
+		return -1, te.verifyBeneath(root, path)
+	}
+	fd, err := te.openBeneath(absRoot, filepath.Dir(rel), unix.O_DIRECTORY)
+	if err != nil {
+		return -1, errors.Wrap(err, "open parent")
+	}
+	if fd < 0 {
+		return -1, te.walkBeneath(absRoot, rel)
+	}
+	return fd, nil
+}
+
+// createAt creates (or truncates) the regular file at path, relative to the
+// handle returned by openParent if it is not -1.
+func (te *tarExtractor) createAt(dirFd int, path string) (*os.File, error) {
+	if dirFd < 0 {
+		return te.fsEval.Create(path)
+	}
+	fd, err := unix.Openat(dirFd, filepath.Base(path), unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0666)
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// mkdirAt creates the directory at path (which may already exist), relative
+// to the handle returned by openParent if it is not -1.
+func (te *tarExtractor) mkdirAt(dirFd int, path string) error {
+	if dirFd < 0 {
+		return te.fsEval.MkdirAll(path, 0777)
+	}
+	if err := unix.Mkdirat(dirFd, filepath.Base(path), 0777); err != nil && err != unix.EEXIST {
+		return &os.PathError{Op: "mkdirat", Path: path, Err: err}
+	}
+	return nil
+}
+
+// symlinkAt creates a symlink to linkname at path, relative to the handle
+// returned by openParent if it is not -1.
+func (te *tarExtractor) symlinkAt(dirFd int, linkname, path string) error {
+	if dirFd < 0 {
+		return te.fsEval.Symlink(linkname, path)
+	}
+	if err := unix.Symlinkat(linkname, dirFd, filepath.Base(path)); err != nil {
+		return &os.LinkError{Op: "symlinkat", Old: linkname, New: path, Err: err}
+	}
+	return nil
+}
+
+// linkAt creates a hardlink to target (which has already been verified) at
+// path, relative to the handle returned by openParent if it is not -1.
+func (te *tarExtractor) linkAt(dirFd int, target, path string) error {
+	if dirFd < 0 {
+		return te.fsEval.Link(target, path)
+	}
+	if err := unix.Linkat(unix.AT_FDCWD, target, dirFd, filepath.Base(path), 0); err != nil {
+		return &os.LinkError{Op: "linkat", Old: target, New: path, Err: err}
+	}
+	return nil
+}
+
+// mknodAt creates a device or FIFO at path, relative to the handle returned
+// by openParent if it is not -1.
+func (te *tarExtractor) mknodAt(dirFd int, path string, mode os.FileMode, dev system.Dev_t) error {
+	if dirFd < 0 {
+		return te.fsEval.Mknod(path, mode, dev)
+	}
+	if err := unix.Mknodat(dirFd, filepath.Base(path), uint32(mode), int(dev)); err != nil {
+		return &os.PathError{Op: "mknodat", Path: path, Err: err}
+	}
+	return nil
+}
+
+// walkBeneath is the fallback of verifyBeneath when openat2(2) cannot be
+// used. Each component of rel is checked with lstat(2) in turn, so it must
+// only be used once rel has already been resolved within root.
+func (te *tarExtractor) walkBeneath(root, rel string) error {
+	if rel == "." {
+		return nil
+	}
+	components := strings.Split(rel, "/")
+	current := root
+	for idx, component := range components[:len(components)-1] {
+		current = filepath.Join(current, component)
+		fi, err := te.fsEval.Lstat(current)
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "verify path")
+		}
+		if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+			return errors.Wrapf(ErrPathEscape, "%s is a symlink", filepath.Join(components[:idx+1]...))
+		}
+		if !fi.IsDir() {
+			// Resolution through a non-directory fails anyway.
+			return nil
+		}
+	}
+	return nil
+}
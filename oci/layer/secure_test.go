@@ -0,0 +1,329 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+func TestExtractionModeValidate(t *testing.T) {
+	for _, mode := range []ExtractionMode{"", SecureExtraction, InsecureExtraction} {
+		if err := mode.Validate(); err != nil {
+			t.Errorf("unexpected error validating %q: %+v", mode, err)
+		}
+	}
+	if err := ExtractionMode("paranoid").Validate(); err == nil {
+		t.Errorf("expected error validating unknown mode")
+	}
+}
+
+func TestVerifyBeneath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestVerifyBeneath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", filepath.Join(root, "a", "b", "inner")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path   string
+		escape bool
+	}{
+		{".", false},
+		{"a", false},
+		{"a/b/file", false},
+		{"nonexistent/file", false},
+		// The last component is never followed.
+		{"link", false},
+		{"a/b/inner", false},
+		{"link/file", true},
+		{"a/b/inner/file", true},
+		{"../file", true},
+		{"..", true},
+	} {
+		for _, noOpenat2 := range []bool{false, true} {
+			te := newTarExtractor(MapOptions{})
+			te.noOpenat2 = noOpenat2
+
+			err := te.verifyBeneath(root, filepath.Join(root, test.path))
+			if test.escape && errors.Cause(err) != ErrPathEscape {
+				t.Errorf("%s (noOpenat2=%v): expected ErrPathEscape, got %v", test.path, noOpenat2, err)
+			} else if !test.escape && err != nil {
+				t.Errorf("%s (noOpenat2=%v): unexpected error: %+v", test.path, noOpenat2, err)
+			}
+
+			te.extractionMode = InsecureExtraction
+			if err := te.verifyBeneath(root, filepath.Join(root, test.path)); err != nil {
+				t.Errorf("%s: unexpected error with InsecureExtraction: %+v", test.path, err)
+			}
+		}
+	}
+	// Relative roots are compared to the (absolute) resolved paths.
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relRoot, err := filepath.Rel(cwd, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	te := newTarExtractor(MapOptions{})
+	if err := te.verifyBeneath(relRoot, filepath.Join(root, "a")); err != nil {
+		t.Errorf("unexpected error with relative root: %+v", err)
+	}
+}
+
+func TestOpenParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestOpenParent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "rootfs")
+	outside := filepath.Join(dir, "outside")
+	for _, path := range []string{filepath.Join(root, "a"), outside} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("/", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	te := newTarExtractor(MapOptions{})
+	defer te.closeRoot()
+
+	if _, err := te.openParent(root, filepath.Join(root, "link", "file")); errors.Cause(err) != ErrPathEscape {
+		t.Errorf("expected ErrPathEscape, got %v", err)
+	}
+
+	path := filepath.Join(root, "a", "file")
+	dirFd, err := te.openParent(root, path)
+	if err != nil {
+		t.Fatalf("unexpected error in openParent: %+v", err)
+	}
+	if dirFd < 0 {
+		t.Skip("openat2(2) is not available")
+	}
+	defer unix.Close(dirFd)
+	rootFd := te.rootFd
+	if err := te.verifyBeneath(root, path); err != nil {
+		t.Fatalf("unexpected error in verifyBeneath: %+v", err)
+	}
+	if te.rootFd != rootFd {
+		t.Errorf("root was opened again for the same layer")
+	}
+
+	// Swap the parent for a symlink to outside of the root after it has been
+	// checked. The file must still be created in the original directory.
+	if err := os.Rename(filepath.Join(root, "a"), filepath.Join(root, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "a")); err != nil {
+		t.Fatal(err)
+	}
+	fh, err := te.createAt(dirFd, path)
+	if err != nil {
+		t.Fatalf("unexpected error in createAt: %+v", err)
+	}
+	fh.Close()
+	if _, err := os.Lstat(filepath.Join(outside, "file")); !os.IsNotExist(err) {
+		t.Errorf("file was created outside of the root: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "moved", "file")); err != nil {
+		t.Errorf("file was not created in the checked directory: %v", err)
+	}
+
+	te.closeRoot()
+	if te.rootFd != -1 {
+		t.Errorf("expected closeRoot to close the root")
+	}
+}
+
+// hostileEntry is an entry of a hostile layer generated by makeHostileLayer.
+type hostileEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+}
+
+// makeHostileLayer returns a layer containing the given entries (regular
+// files contain "hostile").
+func makeHostileLayer(t testing.TB, entries []hostileEntry) []byte {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0755,
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+		}
+		var data []byte
+		if entry.typeflag == tar.TypeReg {
+			data = []byte("hostile")
+			hdr.Mode = 0644
+			hdr.Size = int64(len(data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// hostileLayers are layers which try to write outside of the rootfs, in
+// which "host" is a sibling directory of the rootfs.
+var hostileLayers = map[string][]hostileEntry{
+	"DotDot": {
+		{"../host/file", tar.TypeReg, ""},
+		{"/../../host/file", tar.TypeReg, ""},
+	},
+	"SymlinkDir": {
+		{"link", tar.TypeSymlink, "../host"},
+		{"link/file", tar.TypeReg, ""},
+	},
+	"AbsoluteSymlinkDir": {
+		{"link", tar.TypeSymlink, "/../../host"},
+		{"link/file", tar.TypeReg, ""},
+	},
+	"SymlinkChain": {
+		{"a", tar.TypeSymlink, "b"},
+		{"b", tar.TypeSymlink, "c/../.."},
+		{"c/", tar.TypeDir, ""},
+		{"a/host/file", tar.TypeReg, ""},
+	},
+	"ReplaceDirWithSymlink": {
+		{"dir/", tar.TypeDir, ""},
+		{"dir", tar.TypeSymlink, "../host"},
+		{"dir/file", tar.TypeReg, ""},
+	},
+	"SymlinkFile": {
+		{"file", tar.TypeSymlink, "../host/file"},
+		{"file", tar.TypeReg, ""},
+	},
+	"Hardlink": {
+		{"link", tar.TypeLink, "../host/file"},
+		{"link", tar.TypeReg, ""},
+	},
+	"HardlinkThroughSymlink": {
+		{"link", tar.TypeSymlink, "../host"},
+		{"hardlink", tar.TypeLink, "link/file"},
+		{"hardlink", tar.TypeReg, ""},
+	},
+	"SymlinkWhiteout": {
+		{"link", tar.TypeSymlink, "../host"},
+		{"link/" + whPrefix + "file", tar.TypeReg, ""},
+	},
+}
+
+// checkContained unpacks the given layer into <dir>/rootfs, and makes sure
+// that <dir>/host/file was neither modified nor removed (whether or not the
+// unpack failed), and that nothing was created in dir other than the rootfs.
+func checkContained(t *testing.T, layer []byte, mode ExtractionMode) {
+	dir, err := ioutil.TempDir("", "umoci-checkContained")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "rootfs")
+	hostFile := filepath.Join(dir, "host", "file")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(hostFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(hostFile, []byte("host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	te := newTarExtractor(MapOptions{})
+	te.extractionMode = mode
+	// Errors are fine, as long as nothing escaped.
+	_ = unpackLayer(context.Background(), te, root, bytes.NewReader(layer))
+
+	if data, err := ioutil.ReadFile(hostFile); err != nil || string(data) != "host" {
+		t.Errorf("HOST FILE WAS CHANGED! THIS IS A PATH ESCAPE! got %q (%v)", data, err)
+	}
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range names {
+		if fi.Name() != "rootfs" && fi.Name() != "host" {
+			t.Errorf("PATH %s WAS CREATED! THIS IS A PATH ESCAPE!", fi.Name())
+		}
+	}
+	hostNames, err := ioutil.ReadDir(filepath.Dir(hostFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hostNames) != 1 {
+		t.Errorf("HOST DIRECTORY WAS CHANGED! THIS IS A PATH ESCAPE! got %d entries", len(hostNames))
+	}
+}
+
+func TestUnpackLayerHostile(t *testing.T) {
+	for name, entries := range hostileLayers {
+		layer := makeHostileLayer(t, entries)
+		for _, mode := range []ExtractionMode{SecureExtraction, InsecureExtraction} {
+			t.Run(name+"/"+string(mode), func(t *testing.T) {
+				checkContained(t, layer, mode)
+			})
+		}
+	}
+}
+
+func FuzzUnpackLayer(f *testing.F) {
+	for _, entries := range hostileLayers {
+		f.Add(makeHostileLayer(f, entries))
+	}
+	f.Fuzz(func(t *testing.T, layer []byte) {
+		checkContained(t, layer, SecureExtraction)
+	})
+}
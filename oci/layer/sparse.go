@@ -0,0 +1,269 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/pkg/errors"
+)
+
+// Sparse files are written using the PAX 1.0 sparse format used by GNU tar,
+// because archive/tar can read but not write sparse files. The entry's
+// contents are the sparse map (the number of data regions followed by the
+// offset and length of each region, as decimal lines padded to a block)
+// followed by the data regions, and the PAX records describe the real file.
+const (
+	paxSparsePrefix   = "GNU.sparse."
+	paxSparseMajor    = "GNU.sparse.major"
+	paxSparseMinor    = "GNU.sparse.minor"
+	paxSparseName     = "GNU.sparse.name"
+	paxSparseRealSize = "GNU.sparse.realsize"
+
+	tarBlockSize = 512
+
+	// maxUSTARSize is the largest size that can be stored in a USTAR header.
+	maxUSTARSize = 1<<33 - 1
+)
+
+// isSparseHeader returns whether the given header (read by archive/tar) is
+// for a sparse file.
+func isSparseHeader(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, paxSparsePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sparseBlockSize is the granularity with which holes are created by
+// copySparse.
+const sparseBlockSize = 4096
+
+// copySparse copies size bytes from r to fh (which must be empty), creating
+// holes in place of blocks of zeroes rather than writing them. It returns the
+// number of bytes copied.
+func copySparse(fh *os.File, r io.Reader, size int64) (int64, error) {
+	var (
+		buf  = make([]byte, 32*sparseBlockSize)
+		zero = make([]byte, sparseBlockSize)
+		n    int64
+	)
+	for n < size {
+		nr, err := io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return n, err
+		}
+		if nr == 0 {
+			break
+		}
+		for off := 0; off < nr; off += sparseBlockSize {
+			end := off + sparseBlockSize
+			if end > nr {
+				end = nr
+			}
+			block := buf[off:end]
+			if bytes.Equal(block, zero[:len(block)]) {
+				if _, err := fh.Seek(int64(len(block)), io.SeekCurrent); err != nil {
+					return n, errors.Wrap(err, "seek past hole")
+				}
+			} else if _, err := fh.Write(block); err != nil {
+				return n, err
+			}
+			n += int64(len(block))
+		}
+	}
+	// Make sure that trailing holes are included in the file.
+	if err := fh.Truncate(n); err != nil {
+		return n, errors.Wrap(err, "truncate sparse file")
+	}
+	return n, nil
+}
+
+// formatPAXRecord formats a PAX record, which is prefixed with its own length.
+func formatPAXRecord(key, value string) string {
+	const padding = 3 // ' ', '=' and '\n'
+	size := len(key) + len(value) + padding
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + key + "=" + value + "\n"
+	// The length of the size may have changed the size.
+	if len(record) != size {
+		size = len(record)
+		record = strconv.Itoa(size) + " " + key + "=" + value + "\n"
+	}
+	return record
+}
+
+// paxHeaderBlock returns the USTAR header block of a PAX extended header
+// with the given size.
+func paxHeaderBlock(size int) []byte {
+	block := make([]byte, tarBlockSize)
+	copy(block[0:100], "././@PaxHeader")
+	copy(block[100:108], "0000644\x00")
+	copy(block[108:116], "0000000\x00")
+	copy(block[116:124], "0000000\x00")
+	copy(block[124:136], fmt.Sprintf("%011o\x00", size))
+	copy(block[136:148], "00000000000\x00")
+	block[156] = tar.TypeXHeader
+	copy(block[257:263], "ustar\x00")
+	copy(block[263:265], "00")
+
+	// The checksum is calculated with the checksum field set to spaces.
+	copy(block[148:156], "        ")
+	var chksum int64
+	for _, c := range block {
+		chksum += int64(c)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", chksum))
+	return block
+}
+
+// sparseName returns the name of the USTAR header of a sparse file, which is
+// only used by tar implementations that don't understand sparse files.
+func sparseName(name string) string {
+	dir, file := path.Split(name)
+	sparse := path.Join(dir, "GNUSparseFile.0", file)
+	if !fitsUSTAR(sparse) {
+		sparse = "GNUSparseFile.0/sparse"
+	}
+	return sparse
+}
+
+// addSparseFile writes the given header (for the regular file fh) to the
+// archive as a sparse file, with the given data regions. The header must
+// already have been mapped and normalised.
+func (tg *tarGenerator) addSparseFile(hdr *tar.Header, fh *os.File, regions []system.Region) error {
+	// As with GNU tar, a trailing hole is represented by an empty region at
+	// the end of the file (otherwise some implementations drop it).
+	if len(regions) == 0 || regions[len(regions)-1].Offset+regions[len(regions)-1].Length < hdr.Size {
+		regions = append(regions, system.Region{Offset: hdr.Size, Length: 0})
+	}
+
+	// Encode the sparse map.
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(regions))
+	dataSize := int64(0)
+	for _, region := range regions {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", region.Offset, region.Length)
+		dataSize += region.Length
+	}
+	if pad := sparseMap.Len() % tarBlockSize; pad != 0 {
+		sparseMap.Write(make([]byte, tarBlockSize-pad))
+	}
+
+	// Everything that cannot be stored in the USTAR header is stored in PAX
+	// records, including the real name and size of the file.
+	records := map[string]string{
+		paxSparseMajor:    "1",
+		paxSparseMinor:    "0",
+		paxSparseName:     hdr.Name,
+		paxSparseRealSize: strconv.FormatInt(hdr.Size, 10),
+	}
+	for name, value := range hdr.Xattrs {
+		records["SCHILY.xattr."+name] = value
+	}
+	// As with other entries, sub-second timestamps are not included.
+	ustarHdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     sparseName(hdr.Name),
+		Size:     int64(sparseMap.Len()) + dataSize,
+		Mode:     hdr.Mode,
+		Uid:      hdr.Uid,
+		Gid:      hdr.Gid,
+		Uname:    hdr.Uname,
+		Gname:    hdr.Gname,
+		ModTime:  hdr.ModTime.Truncate(time.Second),
+		Format:   tar.FormatUSTAR,
+	}
+	if ustarHdr.Size > maxUSTARSize {
+		return errors.Errorf("sparse file data too large: %d bytes", ustarHdr.Size)
+	}
+	if hdr.Uid > 07777777 {
+		records["uid"] = strconv.Itoa(hdr.Uid)
+		ustarHdr.Uid = 0
+	}
+	if hdr.Gid > 07777777 {
+		records["gid"] = strconv.Itoa(hdr.Gid)
+		ustarHdr.Gid = 0
+	}
+	if len(hdr.Uname) > 32 || !isASCII(hdr.Uname) {
+		records["uname"] = hdr.Uname
+		ustarHdr.Uname = ""
+	}
+	if len(hdr.Gname) > 32 || !isASCII(hdr.Gname) {
+		records["gname"] = hdr.Gname
+		ustarHdr.Gname = ""
+	}
+
+	// Records are sorted so that the layer is reproducible.
+	var keys []string
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pax bytes.Buffer
+	for _, key := range keys {
+		pax.WriteString(formatPAXRecord(key, records[key]))
+	}
+	paxSize := pax.Len()
+	if pad := paxSize % tarBlockSize; pad != 0 {
+		pax.Write(make([]byte, tarBlockSize-pad))
+	}
+
+	// archive/tar refuses to write PAX headers itself, so we write it
+	// directly after the end of the previous entry.
+	if err := tg.tw.Flush(); err != nil {
+		return errors.Wrap(err, "flush previous entry")
+	}
+	if _, err := tg.w.Write(paxHeaderBlock(paxSize)); err != nil {
+		return errors.Wrap(err, "write pax header")
+	}
+	if _, err := tg.w.Write(pax.Bytes()); err != nil {
+		return errors.Wrap(err, "write pax records")
+	}
+	if err := tg.tw.WriteHeader(ustarHdr); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+	if _, err := tg.tw.Write(sparseMap.Bytes()); err != nil {
+		return errors.Wrap(err, "write sparse map")
+	}
+	for _, region := range regions {
+		n, err := io.Copy(tg.tw, io.NewSectionReader(fh, region.Offset, region.Length))
+		if err != nil {
+			return errors.Wrap(err, "copy to layer")
+		}
+		if n != region.Length {
+			return errors.Wrap(io.ErrShortWrite, "copy to layer")
+		}
+	}
+	return nil
+}
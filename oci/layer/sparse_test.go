@@ -0,0 +1,196 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/pkg/system"
+	"golang.org/x/net/context"
+)
+
+// testSparseFile creates a 4MiB file at path containing two small blocks of
+// data surrounded by holes, and returns its contents.
+func testSparseFile(t *testing.T, path string) []byte {
+	const size = 4 << 20
+	contents := make([]byte, size)
+	copy(contents[1<<20:], "first block of data")
+	copy(contents[3<<20:], "second block of data")
+
+	fh, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	for _, offset := range []int64{1 << 20, 3 << 20} {
+		if _, err := fh.WriteAt(contents[offset:offset+sparseBlockSize], offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fh.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	regions, err := system.DataRegions(fh, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(regions) == 1 && regions[0].Length == size {
+		t.Skip("filesystem does not support SEEK_DATA")
+	}
+	return contents
+}
+
+// testAllocated returns the number of bytes allocated to the file at path.
+func testAllocated(t *testing.T, path string) int64 {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Blocks * 512
+}
+
+func TestSparseRoundTrip(t *testing.T) {
+	for _, noSparse := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "umoci-TestSparseRoundTrip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		// Use a long name and an xattr, which both
+		// have to be stored in the PAX records.
+		name := "sparse-file-with-a-name-which-is-long-enough-that-it-does-not-fit-in-a-ustar-header-by-itself.img"
+		path := filepath.Join(dir, name)
+		contents := testSparseFile(t, path)
+		if err := system.Lsetxattr(path, "user.foo", []byte("bar"), 0); err != nil {
+			t.Skipf("user xattrs are not supported: %v", err)
+		}
+		mtime := time.Unix(1234567890, 0)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+
+		var buffer bytes.Buffer
+		tg := newTarGenerator(&buffer, MapOptions{})
+		tg.noSparse = noSparse
+		if err := tg.AddFile(name, path); err != nil {
+			t.Fatalf("unexpected error adding file: %s", err)
+		}
+		if err := tg.AddFile("normal", filepath.Join(dir, name)); err != nil {
+			t.Fatalf("unexpected error adding hardlink: %s", err)
+		}
+		if err := tg.tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Sparse files only store their data.
+		if layerSize := int64(buffer.Len()); (layerSize < int64(len(contents))) != !noSparse {
+			t.Errorf("unexpected layer size with noSparse=%v: %d", noSparse, layerSize)
+		}
+
+		// archive/tar must read the original file.
+		layer := buffer.Bytes()
+		tr := tar.NewReader(bytes.NewReader(layer))
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %s", err)
+		}
+		if hdr.Name != name || hdr.Size != int64(len(contents)) || !hdr.ModTime.Equal(mtime) || hdr.Xattrs["user.foo"] != "bar" {
+			t.Errorf("unexpected header: name=%s size=%d mtime=%s xattrs=%v", hdr.Name, hdr.Size, hdr.ModTime, hdr.Xattrs)
+		}
+		if isSparseHeader(hdr) == noSparse {
+			t.Errorf("unexpected sparse header with noSparse=%v", noSparse)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("unexpected error reading file: %s", err)
+		}
+		if !bytes.Equal(data, contents) {
+			t.Errorf("file contents changed")
+		}
+		hdr, err = tr.Next()
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %s", err)
+		}
+		if hdr.Typeflag != tar.TypeLink || hdr.Linkname != name {
+			t.Errorf("unexpected hardlink header: %#v", hdr)
+		}
+		if _, err := tr.Next(); err != io.EOF {
+			t.Errorf("expected end of layer: %v", err)
+		}
+
+		// Extracting the layer must recreate the holes.
+		root := filepath.Join(dir, "root")
+		if err := os.Mkdir(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := unpackLayer(context.Background(), newTarExtractor(MapOptions{}), root, bytes.NewReader(layer)); err != nil {
+			t.Fatalf("unexpected error unpacking layer: %s", err)
+		}
+		data, err = ioutil.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, contents) {
+			t.Errorf("extracted file contents changed")
+		}
+		if allocated := testAllocated(t, filepath.Join(root, name)); (allocated < int64(len(contents))) != !noSparse {
+			t.Errorf("unexpected allocated size of extracted file with noSparse=%v: %d", noSparse, allocated)
+		}
+	}
+}
+
+func TestCopySparse(t *testing.T) {
+	fh, err := ioutil.TempFile("", "umoci-TestCopySparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	// Data, a hole and a trailing hole which isn't block-aligned.
+	contents := make([]byte, 1<<20+100)
+	copy(contents, "some data")
+	copy(contents[1<<19:], "more data")
+
+	n, err := copySparse(fh, bytes.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		t.Fatalf("unexpected error copying: %s", err)
+	}
+	if n != int64(len(contents)) {
+		t.Errorf("unexpected number of bytes copied: %d", n)
+	}
+	data, err := ioutil.ReadFile(fh.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, contents) {
+		t.Errorf("file contents changed")
+	}
+	if allocated := testAllocated(t, fh.Name()); allocated >= int64(len(contents)) {
+		t.Errorf("holes were not created: %d bytes allocated", allocated)
+	}
+}
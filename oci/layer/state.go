@@ -0,0 +1,127 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+// StateVersion is the version of the State format written by this version of
+// umoci. States with a different version cannot be read.
+const StateVersion = 1
+
+// State is a JSON-based alternative to an mtree manifest of a root
+// filesystem. It contains the same information as the manifest (so it can be
+// used to compute the changes to the root filesystem with mtree.Compare), but
+// is much faster to parse. In addition, it records the keywords and the
+// mapping options that were used to generate it (the mapping options affect
+// the ownership recorded for each entry).
+type State struct {
+	// Version is the version of the State format, which must be StateVersion.
+	Version int `json:"version"`
+
+	// Keywords is the set of mtree keywords recorded for each entry.
+	Keywords []mtree.Keyword `json:"keywords"`
+
+	// MapOptions are the mapping options used when the root filesystem was
+	// created.
+	MapOptions MapOptions `json:"map_options"`
+
+	// Entries are the inodes in the root filesystem.
+	Entries []StateEntry `json:"entries"`
+}
+
+// StateEntry is the state of a single inode in a State.
+type StateEntry struct {
+	// Path is the path of the inode relative to the root filesystem, encoded
+	// in the same way as in mtree manifests.
+	Path string `json:"path"`
+
+	// Keywords are the keyword values of the inode.
+	Keywords []mtree.KeyVal `json:"keywords"`
+}
+
+// NewState creates a new State from the given mtree hierarchy, which must have
+// been generated with the given keywords and mapping options.
+func NewState(dh *mtree.DirectoryHierarchy, keywords []mtree.Keyword, opt MapOptions) *State {
+	state := &State{
+		Version:    StateVersion,
+		Keywords:   keywords,
+		MapOptions: opt,
+		Entries:    []StateEntry{},
+	}
+	for _, entry := range dh.Entries {
+		if entry.Type != mtree.RelativeType && entry.Type != mtree.FullType {
+			continue
+		}
+		state.Entries = append(state.Entries, StateEntry{
+			Path:     entryPath(&entry),
+			Keywords: entry.AllKeys(),
+		})
+	}
+	return state
+}
+
+// entryPath returns the full (still encoded) path of an mtree entry.
+func entryPath(entry *mtree.Entry) string {
+	if entry.Parent == nil || entry.Type == mtree.FullType {
+		return filepath.Clean(entry.Name)
+	}
+	return filepath.Join(entryPath(entry.Parent), entry.Name)
+}
+
+// Hierarchy returns the mtree hierarchy described by the State, which can be
+// used with mtree.Compare (or mtree.Check) like a parsed mtree manifest.
+func (s State) Hierarchy() *mtree.DirectoryHierarchy {
+	dh := &mtree.DirectoryHierarchy{}
+	for idx, entry := range s.Entries {
+		dh.Entries = append(dh.Entries, mtree.Entry{
+			Pos:      idx,
+			Name:     entry.Path,
+			Keywords: entry.Keywords,
+			Type:     mtree.FullType,
+		})
+	}
+	return dh
+}
+
+// WriteTo writes a JSON-serialised version of the State to the given
+// io.Writer.
+func (s State) WriteTo(w io.Writer) (int64, error) {
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(io.MultiWriter(buf, w)).Encode(s)
+	return int64(buf.Len()), err
+}
+
+// ReadState parses a JSON-serialised State from the given io.Reader.
+func ReadState(r io.Reader) (*State, error) {
+	var state State
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return nil, errors.Wrap(err, "decode state")
+	}
+	if state.Version != StateVersion {
+		return nil, errors.Errorf("unsupported state version: %d", state.Version)
+	}
+	return &state, nil
+}
@@ -0,0 +1,120 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/vbatts/go-mtree"
+)
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestState")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Names that have to be encoded are stored in their encoded form.
+	if err := os.MkdirAll(filepath.Join(dir, "some dir", "parents"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"unchanged", "changed", "deleted"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "some dir", "parents", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The size of directories depends on the filesystem, so it isn't used.
+	keywords := []mtree.Keyword{"type", "uid", "mode", "sha256digest"}
+	initDh, err := mtree.Walk(dir, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Round-trip the state.
+	var buffer bytes.Buffer
+	if _, err := NewState(initDh, keywords, MapOptions{Rootless: true}).WriteTo(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	state, err := ReadState(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.MapOptions.Rootless {
+		t.Errorf("state did not record the map options")
+	}
+	if len(state.Keywords) != len(keywords) {
+		t.Errorf("state recorded the wrong keywords: %v", state.Keywords)
+	}
+
+	// The state must have no differences to the original hierarchy, and must
+	// have the same differences as the original hierarchy after changes.
+	diffs, err := mtree.Compare(initDh, state.Hierarchy(), keywords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("unexpected differences to the original hierarchy: %v", diffs)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "some dir", "parents", "changed"), []byte("new contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "some dir", "parents", "deleted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "some dir", "extra"), []byte("extra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err = mtree.Check(dir, state.Hierarchy(), keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, diff := range diffs {
+		got = append(got, string(diff.Type())+" "+diff.Path())
+	}
+	sort.Strings(got)
+	expected := []string{
+		"extra some dir/extra",
+		"missing some dir/parents/deleted",
+		"modified some dir/parents/changed",
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("unexpected differences: expected %v, got %v", expected, got)
+	}
+	for idx := range got {
+		if got[idx] != expected[idx] {
+			t.Errorf("unexpected differences: expected %v, got %v", expected, got)
+			break
+		}
+	}
+}
+
+func TestStateVersion(t *testing.T) {
+	if _, err := ReadState(bytes.NewBufferString(`{"version": 2, "entries": []}`)); err == nil {
+		t.Errorf("expected an error with an unknown state version")
+	}
+}
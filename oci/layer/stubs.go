@@ -0,0 +1,130 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/pkg/errors"
+)
+
+// runtimeStub is a path that is usually created (or mounted over) by a
+// runtime, but which some minimal runtimes expect to already exist.
+type runtimeStub struct {
+	path string
+	dir  bool
+	mode os.FileMode
+}
+
+// runtimeStubs is the set of stubs created by CreateRuntimeStubs. Parents must
+// come before their children.
+var runtimeStubs = []runtimeStub{
+	// Standard mount-points.
+	{path: "/proc", dir: true, mode: 0555},
+	{path: "/sys", dir: true, mode: 0555},
+	{path: "/dev", dir: true, mode: 0755},
+	// Runtime-managed files.
+	{path: "/etc", dir: true, mode: 0755},
+	{path: "/etc/resolv.conf", mode: 0644},
+	{path: "/etc/hostname", mode: 0644},
+	{path: "/etc/hosts", mode: 0644},
+}
+
+// CreateRuntimeStubs creates empty stub files and directories inside the
+// given rootfs for the paths that are usually managed by a container runtime
+// (such as /etc/resolv.conf and /proc). Paths which already exist (including
+// dangling symlinks) are left untouched. The stubs are owned by the root user
+// of the given mapping. The set of paths created is returned (as absolute
+// paths inside the rootfs), so that callers can ignore them when computing a
+// filesystem diff.
+func CreateRuntimeStubs(rootfs string, opt *MapOptions) ([]string, error) {
+	var mapOptions MapOptions
+	if opt != nil {
+		mapOptions = *opt
+	}
+
+	var fsEval fseval.FsEval = fseval.DefaultFsEval
+	if mapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+
+	uidMappings, gidMappings := mapOptions.fileMappings()
+	rootUID, err := idtools.ToHost(0, uidMappings)
+	if err != nil {
+		return nil, errors.Wrap(err, "ensure rootuid has mapping")
+	}
+	rootGID, err := idtools.ToHost(0, gidMappings)
+	if err != nil {
+		return nil, errors.Wrap(err, "ensure rootgid has mapping")
+	}
+
+	epoch := time.Unix(0, 0)
+	created := []string{}
+	for _, stub := range runtimeStubs {
+		path := filepath.Join(rootfs, stub.path)
+		if _, err := fsEval.Lstat(path); !os.IsNotExist(err) {
+			if err != nil {
+				return nil, errors.Wrapf(err, "check stub %s", stub.path)
+			}
+			continue
+		}
+
+		// Creating the stub will modify the parent directory, which we
+		// restore afterwards to reduce noise when computing diffs.
+		parent := filepath.Dir(path)
+		parentFi, err := fsEval.Lstat(parent)
+		if err != nil {
+			return nil, errors.Wrapf(err, "stat stub parent %s", stub.path)
+		}
+
+		if stub.dir {
+			if err := fsEval.Mkdir(path, stub.mode); err != nil {
+				return nil, errors.Wrapf(err, "create stub %s", stub.path)
+			}
+		} else {
+			fh, err := fsEval.Create(path)
+			if err != nil {
+				return nil, errors.Wrapf(err, "create stub %s", stub.path)
+			}
+			fh.Close()
+		}
+		if err := fsEval.Chmod(path, stub.mode); err != nil {
+			return nil, errors.Wrapf(err, "chmod stub %s", stub.path)
+		}
+		if !mapOptions.Rootless {
+			if err := os.Lchown(path, rootUID, rootGID); err != nil {
+				return nil, errors.Wrapf(err, "chown stub %s", stub.path)
+			}
+		}
+		if err := fsEval.Lutimes(path, epoch, epoch); err != nil {
+			return nil, errors.Wrapf(err, "set stub times %s", stub.path)
+		}
+		if err := fsEval.Lutimes(parent, parentFi.ModTime(), parentFi.ModTime()); err != nil {
+			return nil, errors.Wrapf(err, "restore stub parent times %s", stub.path)
+		}
+
+		event.Default().Debugf("created runtime stub: %s", stub.path)
+		created = append(created, stub.path)
+	}
+	return created, nil
+}
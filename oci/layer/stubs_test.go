@@ -0,0 +1,79 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCreateRuntimeStubs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestCreateRuntimeStubs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An existing file must not be touched.
+	if err := os.Mkdir(filepath.Join(dir, "etc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "etc", "hosts"), []byte("127.0.0.1 localhost"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Nor a dangling symlink.
+	if err := os.Symlink("../run/resolv.conf", filepath.Join(dir, "etc", "resolv.conf")); err != nil {
+		t.Fatal(err)
+	}
+
+	opt := &MapOptions{Rootless: os.Geteuid() != 0}
+	created, err := CreateRuntimeStubs(dir, opt)
+	if err != nil {
+		t.Fatalf("unexpected error creating stubs: %s", err)
+	}
+
+	expected := []string{"/proc", "/sys", "/dev", "/etc/hostname"}
+	if !reflect.DeepEqual(created, expected) {
+		t.Errorf("unexpected set of stubs created: expected %v got %v", expected, created)
+	}
+
+	if fi, err := os.Lstat(filepath.Join(dir, "proc")); err != nil {
+		t.Errorf("stub was not created: %s", err)
+	} else if !fi.IsDir() || fi.Mode().Perm() != 0555 {
+		t.Errorf("stub has unexpected mode: %s", fi.Mode())
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "etc", "hostname")); err != nil {
+		t.Errorf("stub was not created: %s", err)
+	} else if !fi.Mode().IsRegular() || fi.Size() != 0 {
+		t.Errorf("stub is not an empty regular file: %s size=%d", fi.Mode(), fi.Size())
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "etc", "hosts")); err != nil {
+		t.Errorf("unexpected error reading existing file: %s", err)
+	} else if string(data) != "127.0.0.1 localhost" {
+		t.Errorf("existing file was modified: %q", data)
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "etc", "resolv.conf")); err != nil {
+		t.Errorf("unexpected error checking existing symlink: %s", err)
+	} else if fi.Mode()&os.ModeSymlink != os.ModeSymlink {
+		t.Errorf("existing symlink was replaced: %s", fi.Mode())
+	}
+}
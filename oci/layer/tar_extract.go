@@ -26,34 +26,123 @@ import (
 	"strings"
 	"time"
 
-	"github.com/apex/log"
-	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/openSUSE/umoci/pkg/fseval"
 	"github.com/openSUSE/umoci/pkg/system"
 	"github.com/openSUSE/umoci/third_party/symlink"
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
+// ErrWhiteoutConflict is returned when a layer contains a whiteout for a path
+// which was already extracted from the same layer, if
+// ExtractPolicy.WhiteoutConflicts is ExtractError. Whiteouts only apply to the
+// lower layers, so such a layer is ambiguous (and would be extracted
+// differently depending on whether whiteouts are applied or converted to
+// overlayfs whiteouts).
+var ErrWhiteoutConflict = errors.New("whiteout conflicts with path in the same layer")
+
 type tarExtractor struct {
 	// mapOptions is the set of mapping options to use when extracting filesystem layers.
 	mapOptions MapOptions
 
-	// fsEval is an umoci.FsEval used for extraction.
-	fsEval umoci.FsEval
+	// fsEval is an fseval.FsEval used for extraction.
+	fsEval fseval.FsEval
+
+	// overlay specifies whether whiteouts should be converted to overlayfs
+	// whiteouts (rather than being applied by removing the path), for use
+	// when each layer is extracted into a separate directory.
+	overlay bool
+
+	// opaques is the set of directories which have been marked as opaque in
+	// the current layer (only used if overlay is set).
+	opaques []string
+
+	// filter restricts which entries are unpacked. If nil, every entry is
+	// unpacked.
+	filter pathFilter
+
+	// xattrPolicies specifies how security xattrs in the layer are applied.
+	xattrPolicies XattrPolicies
+
+	// selinuxLabel, if non-empty, is the SELinux label applied to every
+	// extracted path (overriding any security.selinux xattr in the layer).
+	selinuxLabel string
+
+	// droppedXattrs, if non-nil, records the xattrs which could not be set in
+	// rootless mode (see UnpackOptions.DroppedXattrs).
+	droppedXattrs DroppedXattrs
+
+	// hardlinkMode specifies how hardlinks to paths in lower layers are
+	// extracted.
+	hardlinkMode HardlinkMode
+
+	// extractPolicy specifies how cross-layer hardlinks, device nodes,
+	// setuid bits and conflicting whiteouts are extracted.
+	extractPolicy ExtractPolicy
+
+	// lowerRoots is the set of directories of the lower layers (topmost
+	// first) in which hardlink targets are looked up (only used if overlay
+	// is set).
+	lowerRoots []string
+
+	// layerPaths is the set of paths extracted from the current layer,
+	// layerParents is the set of their parent directories, and
+	// hardlinkCopies maps the hardlink targets copied in the current layer
+	// (with HardlinkCopy) to the path of the copy.
+	layerPaths     map[string]struct{}
+	layerParents   map[string]struct{}
+	hardlinkCopies map[string]string
+
+	// noSparse specifies whether holes in sparse files should be filled with
+	// zeroes rather than recreated.
+	noSparse bool
+
+	// extractionMode specifies whether paths are verified to be inside the
+	// root before they are written, and noOpenat2 is set once openat2(2) has
+	// been found to be unavailable (so that verifyBeneath falls back to
+	// lstat(2)). rootFd is the handle of rootPath which paths are resolved
+	// relative to (see openRoot), or -1 if it hasn't been opened.
+	extractionMode ExtractionMode
+	noOpenat2      bool
+	rootFd         int
+	rootPath       string
 }
 
 // newTarExtractor creates a new tarExtractor.
 func newTarExtractor(opt MapOptions) *tarExtractor {
-	var fsEval umoci.FsEval = umoci.DefaultFsEval
+	var fsEval fseval.FsEval = fseval.DefaultFsEval
 	if opt.Rootless {
-		fsEval = umoci.RootlessFsEval
+		fsEval = fseval.RootlessFsEval
 	}
 
 	return &tarExtractor{
-		mapOptions: opt,
-		fsEval:     fsEval,
+		mapOptions:     opt,
+		fsEval:         fsEval,
+		layerPaths:     map[string]struct{}{},
+		layerParents:   map[string]struct{}{},
+		hardlinkCopies: map[string]string{},
+		rootFd:         -1,
+	}
+}
+
+// recordLayerPath records that the path with the given key was extracted from
+// the current layer.
+func (te *tarExtractor) recordLayerPath(key string) {
+	te.layerPaths[key] = struct{}{}
+	for parent := filepath.Dir(key); parent != key; key, parent = parent, filepath.Dir(parent) {
+		te.layerParents[parent] = struct{}{}
 	}
 }
 
+// inLayer returns whether the path with the given key (or any path inside it)
+// was extracted from the current layer.
+func (te *tarExtractor) inLayer(key string) bool {
+	_, isPath := te.layerPaths[key]
+	_, isParent := te.layerParents[key]
+	return isPath || isParent
+}
+
 // restoreMetadata applies the state described in tar.Header to the filesystem
 // at the given path. No sanity checking is done of the tar.Header's pathname
 // or other information. In addition, no mapping is done of the header.
@@ -67,15 +156,8 @@ func (te *tarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 		isSymlink = realFi.Mode()&os.ModeSymlink == os.ModeSymlink
 	}
 
-	// We cannot apply hdr.Mode to symlinks, because symlinks don't have a mode
-	// of their own (they're special in that way).
-	if !isSymlink {
-		if err := te.fsEval.Chmod(path, fi.Mode()); err != nil {
-			return errors.Wrapf(err, "restore chmod metadata: %s", path)
-		}
-	}
-
-	// Apply owner (only used in rootless case).
+	// Apply owner (only used in rootless case). This has to be done before
+	// the chmod, because chown(2) clears the setuid and setgid bits.
 	if !te.mapOptions.Rootless {
 		// XXX: While unpriv.Lchown doesn't make a whole lot of sense this
 		//      should _probably_ be put inside FsEval.
@@ -84,6 +166,14 @@ func (te *tarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 		}
 	}
 
+	// We cannot apply hdr.Mode to symlinks, because symlinks don't have a mode
+	// of their own (they're special in that way).
+	if !isSymlink {
+		if err := te.fsEval.Chmod(path, fi.Mode()); err != nil {
+			return errors.Wrapf(err, "restore chmod metadata: %s", path)
+		}
+	}
+
 	// Apply access and modified time. Note that some archives won't fill the
 	// atime and mtime fields, so we have to set them to a more sane value.
 	// Otherwise Linux will start screaming at us, and nobody wants that.
@@ -110,12 +200,17 @@ func (te *tarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 			// This is _fine_ as long as we're not running as root (in which
 			// case we shouldn't be ignoring xattrs that we were told to set).
 			if te.mapOptions.Rootless && os.IsPermission(errors.Cause(err)) {
-				log.Warnf("restoreMetadata: ignoring EPERM on setxattr: %s: %v", name, err)
+				event.Default().Warnf("restoreMetadata: ignoring EPERM on setxattr: %s: %v", name, err)
 				continue
 			}
 			return errors.Wrapf(err, "restore xattr metadata: %s", path)
 		}
 	}
+	if te.selinuxLabel != "" {
+		if err := te.fsEval.Lsetxattr(path, xattrSELinux, []byte(te.selinuxLabel), 0); err != nil {
+			return errors.Wrapf(err, "apply selinux label: %s", path)
+		}
+	}
 
 	if err := te.fsEval.Lutimes(path, atime, mtime); err != nil {
 		return errors.Wrapf(err, "restore lutimes metadata: %s", path)
@@ -124,6 +219,53 @@ func (te *tarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 	return nil
 }
 
+// getXattrs returns the xattrs currently set on the given path, other than
+// security.selinux (which is host-specific).
+func (te *tarExtractor) getXattrs(path string) (map[string]string, error) {
+	names, err := te.fsEval.Llistxattr(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "list xattrs")
+	}
+	xattrs := map[string]string{}
+	for _, name := range names {
+		if name == xattrSELinux {
+			continue
+		}
+		value, err := te.fsEval.Lgetxattr(path, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get xattr: %s", name)
+		}
+		xattrs[name] = string(value)
+	}
+	return xattrs, nil
+}
+
+// recordDroppedXattrs records the xattrs of the given (already applied)
+// header which are not actually set on the filesystem, because restoreMetadata
+// ignored the EPERM from setting them in rootless mode.
+func (te *tarExtractor) recordDroppedXattrs(key, path string, hdr *tar.Header) error {
+	if te.droppedXattrs == nil || !te.mapOptions.Rootless || len(hdr.Xattrs) == 0 {
+		return nil
+	}
+	xattrs, err := te.getXattrs(path)
+	if err != nil {
+		return err
+	}
+	for name, value := range hdr.Xattrs {
+		if name == xattrSELinux {
+			continue
+		}
+		if _, ok := xattrs[name]; ok {
+			continue
+		}
+		if te.droppedXattrs[key] == nil {
+			te.droppedXattrs[key] = map[string]string{}
+		}
+		te.droppedXattrs[key][name] = value
+	}
+	return nil
+}
+
 // applyMetadata applies the state described in tar.Header to the filesystem at
 // the given path, using the state of the tarExtractor to remap information
 // within the header. This should only be used with headers from a tar layer
@@ -134,6 +276,11 @@ func (te *tarExtractor) applyMetadata(path string, hdr *tar.Header) error {
 	if err := unmapHeader(hdr, te.mapOptions); err != nil {
 		return errors.Wrap(err, "unmap header")
 	}
+	xattrs, err := te.xattrPolicies.apply(hdr.Xattrs, false, rootIDToHost(te.mapOptions))
+	if err != nil {
+		return errors.Wrap(err, "apply xattr policies")
+	}
+	hdr.Xattrs = xattrs
 
 	// Restore it on the filesystme.
 	return te.restoreMetadata(path, hdr)
@@ -146,9 +293,16 @@ func (te *tarExtractor) applyMetadata(path string, hdr *tar.Header) error {
 func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (Err error) {
 	// Make the paths safe.
 	hdr.Name = CleanPath(hdr.Name)
+
+	// archive/tar reads old GNU sparse files as TypeGNUSparse entries, but
+	// they are otherwise regular files.
+	sparse := isSparseHeader(hdr)
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		hdr.Typeflag = tar.TypeReg
+	}
 	root = filepath.Clean(root)
 
-	log.WithFields(log.Fields{
+	event.Default().WithFields(event.Fields{
 		"root": root,
 		"path": hdr.Name,
 		"type": hdr.Typeflag,
@@ -169,6 +323,9 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		return errors.Wrap(err, "sanitise symlinks in root")
 	}
 	path := filepath.Join(dir, file)
+	if err := te.verifyBeneath(root, path); err != nil {
+		return errors.Wrap(err, "verify path")
+	}
 
 	// Before we do anything, get the state of dir. Because we might be adding
 	// or removing files, our parent directory might be modified in the
@@ -188,6 +345,13 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		dirHdr.Typeflag = tar.TypeDir
 		dirHdr.Linkname = ""
 
+		// restoreMetadata clears any xattrs not in the header, so we have to
+		// fill them in (otherwise the directory's xattrs would be lost).
+		dirHdr.Xattrs, err = te.getXattrs(dir)
+		if err != nil {
+			return errors.Wrap(err, "get parent directory xattrs")
+		}
+
 		// Ensure that after everything we correctly re-apply the old metadata.
 		// We don't map this header because we're restoring files that already
 		// existed on the filesystem, not from a tar layer.
@@ -201,11 +365,28 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		}()
 	}
 
+	// A whiteout of a path (or a parent of a path) extracted from the current
+	// layer would remove it, which is not what the layer means.
+	if strings.HasPrefix(file, whPrefix) && file != whOpaque {
+		target := layerKey(filepath.Join(filepath.Dir(hdr.Name), strings.TrimPrefix(file, whPrefix)))
+		skip, err := te.applyWhiteoutPolicy(hdr, target)
+		if err != nil {
+			return errors.Wrap(err, "apply extract policy")
+		}
+		if skip {
+			event.Default().Infof("unpack entry: skipping %s due to extract policy", hdr.Name)
+			return nil
+		}
+	}
+
 	// Currently the spec doesn't specify what the hdr.Typeflag of whiteout
 	// files is meant to be. We specifically only produce regular files
 	// ('\x00') but it could be possible that someone produces a different
 	// Typeflag, expecting that the path is the only thing that matters in a
 	// whiteout entry.
+	if te.overlay && strings.HasPrefix(file, whPrefix) {
+		return te.overlayWhiteout(dir, file)
+	}
 	if strings.HasPrefix(file, whPrefix) {
 		file = strings.TrimPrefix(file, whPrefix)
 		path = filepath.Join(dir, file)
@@ -221,9 +402,33 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		if err := te.fsEval.RemoveAll(path); err != nil {
 			return errors.Wrap(err, "whiteout remove all")
 		}
+		te.droppedXattrs.remove(layerKey(filepath.Join(filepath.Dir(hdr.Name), file)), true)
 		return nil
 	}
 
+	// Any xattrs dropped from an older version of the path no longer apply.
+	key := layerKey(hdr.Name)
+	te.droppedXattrs.remove(key, false)
+
+	// Skipped entries still replace whatever was at the path before.
+	skip, err := te.applyExtractPolicy(hdr)
+	if err != nil {
+		return errors.Wrap(err, "apply extract policy")
+	}
+	if skip {
+		event.Default().Infof("unpack entry: skipping %s due to extract policy", hdr.Name)
+		if err := te.fsEval.RemoveAll(path); err != nil {
+			return errors.Wrap(err, "skip remove all")
+		}
+		te.droppedXattrs.remove(key, true)
+		return nil
+	}
+
+	// Record the path as being part of the current layer, so that hardlinks
+	// to it are not treated as crossing layers (and whiteouts of it are
+	// detected as conflicts).
+	te.recordLayerPath(key)
+
 	// Get information about the path. This has to be done after we've dealt
 	// with whiteouts because it turns out that lstat(2) will return EPERM if
 	// you try to stat a whiteout on AUFS.
@@ -243,6 +448,7 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		if err := te.fsEval.RemoveAll(path); err != nil {
 			return errors.Wrap(err, "replace removeall")
 		}
+		te.droppedXattrs.remove(key, true)
 	}
 
 	// Attempt to create the parent directory of the path we're unpacking.
@@ -256,6 +462,13 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	if err := te.fsEval.MkdirAll(dir, 0777); err != nil {
 		return errors.Wrap(err, "mkdir parent")
 	}
+	dirFd, err := te.openParent(root, path)
+	if err != nil {
+		return errors.Wrap(err, "verify path")
+	}
+	if dirFd >= 0 {
+		defer unix.Close(dirFd)
+	}
 
 	// Now create or otherwise modify the state of the path. Right now, either
 	// the type of path matches hdr or the path doesn't exist. Note that we
@@ -265,16 +478,23 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// regular file
 	case tar.TypeReg, tar.TypeRegA:
 		// Truncate file, then just copy the data.
-		fh, err := te.fsEval.Create(path)
+		fh, err := te.createAt(dirFd, path)
 		if err != nil {
 			return errors.Wrap(err, "create regular")
 		}
 		defer fh.Close()
 
-		// We need to make sure that we copy all of the bytes.
-		if n, err := io.Copy(fh, r); err != nil {
+		// We need to make sure that we copy all of the bytes. Holes in sparse
+		// files are recreated rather than filled with zeroes.
+		var n int64
+		if sparse && !te.noSparse {
+			n, err = copySparse(fh, r, hdr.Size)
+		} else {
+			n, err = io.Copy(fh, r)
+		}
+		if err != nil {
 			return err
-		} else if int64(n) != hdr.Size {
+		} else if n != hdr.Size {
 			return errors.Wrap(io.ErrShortWrite, "unpack to regular file")
 		}
 
@@ -286,7 +506,7 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		// Attempt to create the directory. We do a MkdirAll here because even
 		// though you need to have a tar entry for every component of a new
 		// path, applyMetadata will correct any inconsistencies.
-		if err := te.fsEval.MkdirAll(path, 0777); err != nil {
+		if err := te.mkdirAt(dirFd, path); err != nil {
 			return errors.Wrap(err, "mkdirall")
 		}
 
@@ -297,23 +517,26 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 
 		// In both cases, we have to just unlinkg and then re-link the given
 		// path. The only difference is the function we're using.
-		var linkFn func(string, string) error
+		var linkFn func(int, string, string) error
 		switch hdr.Typeflag {
 		case tar.TypeLink:
-			linkFn = te.fsEval.Link
+			linkFn = te.linkAt
 			// Because hardlinks are inode-based we need to scope the link to
-			// the rootfs using FollowSymlinkInScope. As before, we need to be
-			// careful that we don't resolve the last part of the link path (in
-			// case the user actually wanted to hardlink to a symlink).
-			linkname = filepath.Join(root, CleanPath(linkname))
-			linkdir, file := filepath.Split(linkname)
-			dir, err := symlink.FollowSymlinkInScope(linkdir, root, te.fsEval)
+			// the rootfs (or the lower layer containing the target).
+			target, copyTarget, err := te.hardlinkTarget(root, hdr)
 			if err != nil {
-				return errors.Wrap(err, "sanitise hardlink target in root")
+				return errors.Wrap(err, "resolve hardlink target")
 			}
-			linkname = filepath.Join(dir, file)
+			if copyTarget {
+				if err := te.copyHardlinkTarget(target, path); err != nil {
+					return errors.Wrap(err, "copy hardlink target")
+				}
+				te.hardlinkCopies[layerKey(hdr.Linkname)] = layerKey(hdr.Name)
+				return nil
+			}
+			linkname = target
 		case tar.TypeSymlink:
-			linkFn = te.fsEval.Symlink
+			linkFn = te.symlinkAt
 		}
 
 		// Unlink the old path, and ignore it if the path didn't exist.
@@ -322,7 +545,7 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		}
 
 		// Link the new one.
-		if err := linkFn(linkname, path); err != nil {
+		if err := linkFn(dirFd, linkname, path); err != nil {
 			// FIXME: Currently this can break if tar hardlink entries occur
 			//        before we hit the entry those hardlinks link to. I have a
 			//        feeling that such archives are invalid, but the correct
@@ -336,7 +559,7 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	case tar.TypeChar, tar.TypeBlock:
 		// In rootless mode we have to fake this.
 		if te.mapOptions.Rootless {
-			fh, err := te.fsEval.Create(path)
+			fh, err := te.createAt(dirFd, path)
 			if err != nil {
 				return errors.Wrap(err, "create rootless block")
 			}
@@ -364,7 +587,7 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		}
 
 		// Create the node.
-		if err := te.fsEval.Mknod(path, os.FileMode(int64(mode)|hdr.Mode), dev); err != nil {
+		if err := te.mknodAt(dirFd, path, os.FileMode(int64(mode)|hdr.Mode), dev); err != nil {
 			return errors.Wrap(err, "mknod")
 		}
 
@@ -382,7 +605,61 @@ out:
 		if err := te.applyMetadata(path, hdr); err != nil {
 			return errors.Wrap(err, "apply hdr metadata")
 		}
+		if err := te.recordDroppedXattrs(key, path, hdr); err != nil {
+			return errors.Wrap(err, "record dropped xattrs")
+		}
+	}
+
+	return nil
+}
+
+// whOpaque is the name of an opaque whiteout, which indicates that the lower
+// layers' contents of the directory containing it should be hidden.
+const whOpaque = whPrefix + whPrefix + ".opq"
+
+// overlayOpaqueXattr is the xattr used by overlayfs to mark a directory as
+// opaque.
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+// overlayWhiteout converts an OCI whiteout entry (with the given file name in
+// the directory dir) into the equivalent overlayfs whiteout. Regular whiteouts
+// become 0:0 character devices, while opaque whiteouts are recorded so that
+// the directory can be marked with overlayOpaqueXattr once the layer has been
+// extracted (applying metadata to the directory would otherwise clear it).
+//
+// As with unpackEntry, the directory is created if it doesn't exist yet. Its
+// metadata is applied by the directory's own entry in the layer, whether it
+// has already been extracted or comes later in the archive. Until then it is
+// given 0755 permissions, so that it is never writable by other users.
+func (te *tarExtractor) overlayWhiteout(dir, file string) error {
+	if err := te.fsEval.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "overlay whiteout mkdir parent")
+	}
+	if file == whOpaque {
+		te.opaques = append(te.opaques, dir)
+		return nil
 	}
 
+	path := filepath.Join(dir, strings.TrimPrefix(file, whPrefix))
+	if err := te.fsEval.RemoveAll(path); err != nil {
+		return errors.Wrap(err, "overlay whiteout remove old")
+	}
+	mode := os.FileMode(system.Tarmode(tar.TypeChar))
+	if err := te.fsEval.Mknod(path, mode, system.Makedev(0, 0)); err != nil {
+		return errors.Wrap(err, "overlay whiteout mknod")
+	}
+	return nil
+}
+
+// markOpaques sets overlayOpaqueXattr on all of the directories marked as
+// opaque in the current layer. It must be called after the layer has been
+// completely extracted.
+func (te *tarExtractor) markOpaques() error {
+	for _, dir := range te.opaques {
+		if err := te.fsEval.Lsetxattr(dir, overlayOpaqueXattr, []byte("y"), 0); err != nil {
+			return errors.Wrapf(err, "mark opaque: %s", dir)
+		}
+	}
+	te.opaques = nil
 	return nil
 }
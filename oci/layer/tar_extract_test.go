@@ -27,7 +27,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/openSUSE/umoci/pkg/rootlesscontainers"
+	"github.com/openSUSE/umoci/pkg/system"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
 )
 
 // TODO: Test the parent directory metadata is kept the same when unpacking.
@@ -618,3 +622,426 @@ func TestUnpackEntryMap(t *testing.T) {
 		}
 	}(t)
 }
+
+// TestUnpackLayerOverlay makes sure that whiteouts are converted to overlayfs
+// whiteouts when unpacking in overlay mode.
+func TestUnmapHeaderOwnership(t *testing.T) {
+	fallback := 65534
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.IDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+		GIDMappings: []rspec.IDMapping{{HostID: 200000, ContainerID: 0, Size: 65536}},
+		UserNames:   map[string]int{"user": 1000},
+		GroupNames:  map[string]int{"group": 100},
+	}
+
+	for _, test := range []struct {
+		name             string
+		hdr              tar.Header
+		fallback         bool
+		failure          bool
+		hostUID, hostGID int
+	}{
+		{"Plain", tar.Header{Uid: 10, Gid: 20, Uname: "user", Gname: "group"}, false, false, 100010, 200020},
+		{"Root", tar.Header{Uname: "root", Gname: "root"}, false, false, 100000, 200000},
+		{"NamesOnly", tar.Header{Uname: "user", Gname: "group"}, false, false, 101000, 200100},
+		{"UnknownNames", tar.Header{Uname: "nobody", Gname: "wheel"}, false, false, 100000, 200000},
+		{"NegativeID", tar.Header{Uid: -1, Gid: 20}, false, true, 0, 0},
+		{"NegativeIDFallback", tar.Header{Uid: -1, Gid: 20}, true, false, 165534, 200020},
+	} {
+		hdr := test.hdr
+		options := mapOptions
+		if test.fallback {
+			options.FallbackUID = &fallback
+			options.FallbackGID = &fallback
+		}
+
+		err := unmapHeader(&hdr, options)
+		if test.failure {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+			continue
+		}
+		if hdr.Uid != test.hostUID || hdr.Gid != test.hostGID {
+			t.Errorf("%s: got %d:%d, expected %d:%d", test.name, hdr.Uid, hdr.Gid, test.hostUID, test.hostGID)
+		}
+	}
+}
+
+func TestUnmapHeaderUserNamespace(t *testing.T) {
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.IDMapping{
+			{HostID: 1000, ContainerID: 0, Size: 1},
+			{HostID: 100000, ContainerID: 1, Size: 65536},
+		},
+		GIDMappings: []rspec.IDMapping{
+			{HostID: 1000, ContainerID: 0, Size: 1},
+			{HostID: 100000, ContainerID: 1, Size: 65536},
+		},
+		UserNamespace: true,
+	}
+
+	// Inside the user namespace the kernel maps the IDs, so they are used
+	// as-is (but must still have a mapping).
+	for _, test := range []struct {
+		name     string
+		hdr      tar.Header
+		failure  bool
+		uid, gid int
+	}{
+		{"Root", tar.Header{Uid: 0, Gid: 0}, false, 0, 0},
+		{"User", tar.Header{Uid: 1000, Gid: 100}, false, 1000, 100},
+		{"LastID", tar.Header{Uid: 65536, Gid: 65536}, false, 65536, 65536},
+		{"UnmappedUID", tar.Header{Uid: 65537, Gid: 0}, true, 0, 0},
+		{"UnmappedGID", tar.Header{Uid: 0, Gid: 70000}, true, 0, 0},
+	} {
+		hdr := test.hdr
+		err := unmapHeader(&hdr, mapOptions)
+		if test.failure {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+			continue
+		}
+		if hdr.Uid != test.uid || hdr.Gid != test.gid {
+			t.Errorf("%s: got %d:%d, expected %d:%d", test.name, hdr.Uid, hdr.Gid, test.uid, test.gid)
+		}
+
+		// Mapping the header back must give the same IDs.
+		if err := mapHeader(&hdr, mapOptions); err != nil {
+			t.Errorf("%s: unexpected error mapping header: %+v", test.name, err)
+			continue
+		}
+		if hdr.Uid != test.hdr.Uid || hdr.Gid != test.hdr.Gid {
+			t.Errorf("%s: mapped header got %d:%d, expected %d:%d", test.name, hdr.Uid, hdr.Gid, test.hdr.Uid, test.hdr.Gid)
+		}
+	}
+}
+
+func TestRootlessOwnerRoundTrip(t *testing.T) {
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.IDMapping{{HostID: 1000, ContainerID: 0, Size: 1}},
+		GIDMappings: []rspec.IDMapping{{HostID: 1000, ContainerID: 0, Size: 1}},
+		Rootless:    true,
+	}
+
+	for _, test := range []struct {
+		name  string
+		hdr   tar.Header
+		xattr bool
+	}{
+		{"Root", tar.Header{Typeflag: tar.TypeReg, Uid: 0, Gid: 0}, false},
+		{"User", tar.Header{Typeflag: tar.TypeReg, Uid: 1000, Gid: 100}, true},
+		{"Group", tar.Header{Typeflag: tar.TypeDir, Uid: 0, Gid: 5}, true},
+		{"Symlink", tar.Header{Typeflag: tar.TypeSymlink, Uid: 0, Gid: 0}, false},
+		{"CharDevice", tar.Header{Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}, true},
+		{"BlockDevice", tar.Header{Typeflag: tar.TypeBlock, Uid: 6, Gid: 6, Devmajor: 8, Devminor: 1}, true},
+		{"ExistingXattr", tar.Header{Typeflag: tar.TypeReg, Uid: 2, Gid: 2, Xattrs: map[string]string{
+			rootlesscontainers.Keyname: string(rootlesscontainers.Resource{UID: 7, GID: 7}.Marshal()),
+			"user.other":               "value",
+		}}, true},
+	} {
+		hdr := test.hdr
+		hdr.Xattrs = map[string]string{}
+		for name, value := range test.hdr.Xattrs {
+			hdr.Xattrs[name] = value
+		}
+
+		if err := unmapHeader(&hdr, mapOptions); err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+			continue
+		}
+		// Everything is owned by the unprivileged user.
+		if hdr.Uid != 1000 || hdr.Gid != 1000 {
+			t.Errorf("%s: got %d:%d, expected 1000:1000", test.name, hdr.Uid, hdr.Gid)
+		}
+		if _, ok := hdr.Xattrs[rootlesscontainers.Keyname]; ok != test.xattr {
+			t.Errorf("%s: expected xattr to be set: %v", test.name, test.xattr)
+		}
+
+		// Emulate the file that would be found on the filesystem, where
+		// device nodes are empty regular files.
+		if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+			hdr.Typeflag = tar.TypeReg
+			hdr.Devmajor, hdr.Devminor = 0, 0
+		}
+
+		if err := mapHeader(&hdr, mapOptions); err != nil {
+			t.Errorf("%s: unexpected error mapping header: %+v", test.name, err)
+			continue
+		}
+		if hdr.Uid != test.hdr.Uid || hdr.Gid != test.hdr.Gid {
+			t.Errorf("%s: mapped header got %d:%d, expected %d:%d", test.name, hdr.Uid, hdr.Gid, test.hdr.Uid, test.hdr.Gid)
+		}
+		if hdr.Typeflag != test.hdr.Typeflag || hdr.Devmajor != test.hdr.Devmajor || hdr.Devminor != test.hdr.Devminor {
+			t.Errorf("%s: mapped header got type %q (%d:%d), expected %q (%d:%d)", test.name, hdr.Typeflag, hdr.Devmajor, hdr.Devminor, test.hdr.Typeflag, test.hdr.Devmajor, test.hdr.Devminor)
+		}
+		if _, ok := hdr.Xattrs[rootlesscontainers.Keyname]; ok {
+			t.Errorf("%s: xattr was not removed from mapped header", test.name)
+		}
+		if test.hdr.Xattrs["user.other"] != hdr.Xattrs["user.other"] {
+			t.Errorf("%s: other xattrs were modified: %v", test.name, hdr.Xattrs)
+		}
+	}
+}
+
+func TestMapHeaderRootlessInvalidXattr(t *testing.T) {
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.IDMapping{{HostID: 1000, ContainerID: 0, Size: 1}},
+		GIDMappings: []rspec.IDMapping{{HostID: 1000, ContainerID: 0, Size: 1}},
+		Rootless:    true,
+	}
+
+	for _, test := range []struct {
+		name  string
+		hdr   tar.Header
+		value []byte
+	}{
+		{"Garbage", tar.Header{Typeflag: tar.TypeReg}, []byte{0x08}},
+		{"BadTypeflag", tar.Header{Typeflag: tar.TypeReg}, rootlesscontainers.Resource{Typeflag: tar.TypeFifo}.Marshal()},
+		{"NonEmptyDevice", tar.Header{Typeflag: tar.TypeReg, Size: 10}, rootlesscontainers.Resource{Typeflag: tar.TypeChar}.Marshal()},
+	} {
+		hdr := test.hdr
+		hdr.Uid, hdr.Gid = 1000, 1000
+		hdr.Xattrs = map[string]string{rootlesscontainers.Keyname: string(test.value)}
+		if err := mapHeader(&hdr, mapOptions); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestUnpackEntryParentXattrs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryParentXattrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := system.Lsetxattr(dir, "user.umoci-test", []byte("test"), 0); err != nil {
+		t.Skipf("user xattrs are not supported: %v", err)
+	}
+
+	te := newTarExtractor(MapOptions{Rootless: os.Geteuid() != 0})
+	for _, hdr := range []*tar.Header{
+		{
+			Name:     "dir",
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+			Mode:     0755,
+			Typeflag: tar.TypeDir,
+			ModTime:  time.Now(),
+			Xattrs:   map[string]string{"user.some-xattr": "some value"},
+		},
+		{
+			Name:     "dir/file",
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+			Mode:     0644,
+			Typeflag: tar.TypeReg,
+			ModTime:  time.Now(),
+		},
+	} {
+		if err := te.unpackEntry(dir, hdr, bytes.NewBuffer(nil)); err != nil {
+			t.Fatalf("unexpected unpackEntry error: %s", err)
+		}
+	}
+
+	// Unpacking the file must not have cleared the xattrs of its parent.
+	value, err := system.Lgetxattr(filepath.Join(dir, "dir"), "user.some-xattr")
+	if err != nil {
+		t.Fatalf("parent directory xattr was lost: %v", err)
+	}
+	if string(value) != "some value" {
+		t.Errorf("parent directory xattr was modified: got %q", string(value))
+	}
+}
+
+func TestUnpackLayerOverlay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Log("overlay whiteouts require root privileges")
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerOverlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, hdr := range []*tar.Header{
+		{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "opaque/" + whOpaque, Typeflag: tar.TypeReg},
+		{Name: "opaque/file", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: whPrefix + "removed", Typeflag: tar.TypeReg},
+		{Name: "implicit/" + whPrefix + "removed", Typeflag: tar.TypeReg},
+		{Name: "later/" + whPrefix + "removed", Typeflag: tar.TypeReg},
+		{Name: "later/", Typeflag: tar.TypeDir, Mode: 0700},
+	} {
+		hdr.ModTime = time.Now()
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure the modes of created directories aren't hidden by the umask.
+	oldUmask := syscall.Umask(0)
+	defer syscall.Umask(oldUmask)
+
+	te := newTarExtractor(MapOptions{})
+	te.overlay = true
+	if err := unpackLayer(context.Background(), te, dir, &buffer); err != nil {
+		t.Fatalf("unexpected error in unpackLayer: %s", err)
+	}
+
+	// The whiteout should be a 0:0 character device.
+	var st syscall.Stat_t
+	if err := syscall.Lstat(filepath.Join(dir, "removed"), &st); err != nil {
+		t.Fatalf("whiteout was not created: %s", err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR || st.Rdev != 0 {
+		t.Errorf("whiteout is not a 0:0 character device: mode=%o rdev=%d", st.Mode, st.Rdev)
+	}
+
+	// Parent directories without an entry must not be world-writable, while
+	// those with an entry get the mode from the entry.
+	for path, mode := range map[string]os.FileMode{
+		"implicit": 0755,
+		"later":    0700,
+	} {
+		fi, err := os.Lstat(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatalf("whiteout parent %s was not created: %s", path, err)
+		}
+		if fi.Mode().Perm() != mode {
+			t.Errorf("whiteout parent %s has unexpected mode: expected %o, got %o", path, mode, fi.Mode().Perm())
+		}
+	}
+
+	// The opaque whiteout should not exist, and the directory should be marked
+	// as opaque.
+	if _, err := os.Lstat(filepath.Join(dir, "opaque", whOpaque)); !os.IsNotExist(err) {
+		t.Errorf("opaque whiteout was extracted: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "opaque", "file")); err != nil {
+		t.Errorf("file in opaque directory was not extracted: %s", err)
+	}
+	value, err := system.Lgetxattr(filepath.Join(dir, "opaque"), overlayOpaqueXattr)
+	if err != nil {
+		t.Fatalf("unexpected error getting opaque xattr: %s", err)
+	}
+	if string(value) != "y" {
+		t.Errorf("opaque xattr has unexpected value: %q", value)
+	}
+}
+
+func TestUnpackLayerCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerCancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, ModTime: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := unpackLayer(ctx, newTarExtractor(MapOptions{}), dir, &buffer); errors.Cause(err) != context.Canceled {
+		t.Errorf("expected context.Canceled: %+v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Errorf("entries were unpacked after cancellation: %v", err)
+	}
+}
+
+func TestUnpackLayerWhiteoutConflict(t *testing.T) {
+	for _, action := range []ExtractAction{"", ExtractPreserve, ExtractSkip, ExtractError} {
+		for _, test := range []struct {
+			name    string
+			entries []string
+			target  string
+		}{
+			{"WhiteoutFile", []string{"file", whPrefix + "file"}, "file"},
+			{"WhiteoutParent", []string{"dir/", "dir/file", whPrefix + "dir"}, "dir"},
+			{"WhiteoutImplicitParent", []string{"dir/sub/file", whPrefix + "dir"}, "dir"},
+			{"WhiteoutBefore", []string{whPrefix + "file", "file"}, ""},
+			{"WhiteoutSibling", []string{"dir/", "dir/file", "dir/" + whPrefix + "other"}, ""},
+			{"WhiteoutPrefix", []string{"file", whPrefix + "fil"}, ""},
+			{"Opaque", []string{"dir/", "dir/file", "dir/" + whOpaque}, ""},
+		} {
+			t.Run(test.name+"="+string(action), func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerWhiteoutConflict")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+
+				var buffer bytes.Buffer
+				tw := tar.NewWriter(&buffer)
+				for _, name := range test.entries {
+					hdr := &tar.Header{
+						Name:     name,
+						Typeflag: tar.TypeReg,
+						Mode:     0644,
+						Uid:      os.Getuid(),
+						Gid:      os.Getgid(),
+						ModTime:  time.Now(),
+					}
+					if name[len(name)-1] == '/' {
+						hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+					}
+					if err := tw.WriteHeader(hdr); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := tw.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				te := newTarExtractor(MapOptions{})
+				te.extractPolicy = ExtractPolicy{WhiteoutConflicts: action}
+				err = unpackLayer(context.Background(), te, dir, &buffer)
+				conflict := test.target != ""
+				if conflict && action == ExtractError {
+					if !errors.Is(err, ErrWhiteoutConflict) {
+						t.Errorf("expected ErrWhiteoutConflict: %+v", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error in unpackLayer: %+v", err)
+				}
+				if !conflict {
+					return
+				}
+
+				// By default the whiteout is applied, as other tools do.
+				_, err = os.Lstat(filepath.Join(dir, test.target))
+				if removed := os.IsNotExist(err); removed == (action == ExtractSkip) {
+					t.Errorf("unexpected state of %s: removed=%v", test.target, removed)
+				}
+			})
+		}
+	}
+}
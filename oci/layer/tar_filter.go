@@ -0,0 +1,201 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TarFilter is called with the header of every entry of a generated layer
+// (other than whiteouts) before it is written, after all of the other
+// RepackOptions have been applied. It may modify the header (such as its
+// owner, mode, timestamps or xattrs), but must not change its name, type or
+// size. If it returns false, the entry is left out of the layer. If it
+// returns an error, generating the layer fails.
+type TarFilter func(hdr *tar.Header) (bool, error)
+
+// tarFilters is a list of TarFilters which are applied in order.
+type tarFilters []TarFilter
+
+// apply applies each of the filters to hdr, returning false as soon as one of
+// them excludes the entry.
+func (filters tarFilters) apply(hdr *tar.Header) (bool, error) {
+	for _, filter := range filters {
+		keep, err := filter(hdr)
+		if err != nil {
+			return false, errors.Wrapf(err, "filter %s", hdr.Name)
+		}
+		if !keep {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// validatePattern returns an error if the given shell pattern is malformed.
+func validatePattern(pattern string) error {
+	_, err := filepath.Match(pattern, "")
+	return err
+}
+
+// matchPathComponents returns whether the path components match the pattern
+// components. A "**" component matches any number of path components, except
+// at the end of the pattern where it matches at least one (so that "dir/**"
+// matches everything inside dir, but not dir itself).
+func matchPathComponents(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			return len(path) > 0
+		}
+		for idx := 0; idx <= len(path); idx++ {
+			if matchPathComponents(pattern[1:], path[idx:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	if matched, _ := filepath.Match(pattern[0], path[0]); !matched {
+		return false
+	}
+	return matchPathComponents(pattern[1:], path[1:])
+}
+
+// splitPath splits an absolute path into its components.
+func splitPath(path string) []string {
+	path = strings.TrimPrefix(CleanPath("/"+path), "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// MatchPath returns whether the path of a layer entry (which may be absolute
+// or relative to the root) matches the given pattern. Each component of the
+// pattern is a shell pattern (as with filepath.Match) matched against one
+// component of the path, and a "**" component matches any number of
+// components (or, at the end of the pattern, any number of components other
+// than zero). For instance, "/var/cache/**" matches every path inside
+// /var/cache but not /var/cache itself, and "/**/*.pyc" matches every path
+// whose name ends with ".pyc".
+func MatchPath(pattern, path string) bool {
+	return matchPathComponents(splitPath(pattern), splitPath(path))
+}
+
+// ExcludeFilter returns a TarFilter which leaves out the entries whose path
+// matches the given pattern (see MatchPath).
+func ExcludeFilter(pattern string) (TarFilter, error) {
+	for _, component := range splitPath(pattern) {
+		if err := validatePattern(component); err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %q", pattern)
+		}
+	}
+	return func(hdr *tar.Header) (bool, error) {
+		return !MatchPath(pattern, hdr.Name), nil
+	}, nil
+}
+
+// xattrPAXPrefix is the prefix of the PAX records used to store xattrs.
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// StripXattrFilter returns a TarFilter which removes the xattrs whose name
+// matches the given shell pattern (such as "user.*") from every entry.
+func StripXattrFilter(pattern string) (TarFilter, error) {
+	if err := validatePattern(pattern); err != nil {
+		return nil, errors.Wrapf(err, "invalid pattern %q", pattern)
+	}
+	return func(hdr *tar.Header) (bool, error) {
+		for name := range hdr.Xattrs {
+			if matched, _ := filepath.Match(pattern, name); matched {
+				delete(hdr.Xattrs, name)
+			}
+		}
+		for key := range hdr.PAXRecords {
+			if !strings.HasPrefix(key, xattrPAXPrefix) {
+				continue
+			}
+			if matched, _ := filepath.Match(pattern, strings.TrimPrefix(key, xattrPAXPrefix)); matched {
+				delete(hdr.PAXRecords, key)
+			}
+		}
+		return true, nil
+	}, nil
+}
+
+// ResetOwnerFilter returns a TarFilter which changes the owner of every entry
+// to the given uid and gid, and removes the user and group names.
+func ResetOwnerFilter(uid, gid int) TarFilter {
+	return func(hdr *tar.Header) (bool, error) {
+		hdr.Uid, hdr.Gid = uid, gid
+		hdr.Uname, hdr.Gname = "", ""
+		return true, nil
+	}
+}
+
+// ParseTarFilter parses one of the common TarFilters from a string of the
+// form <name>[:<argument>]. The supported filters are "exclude:<pattern>"
+// (see ExcludeFilter), "strip-xattr:<pattern>" (see StripXattrFilter) and
+// "reset-owner[:<uid>:<gid>]" (see ResetOwnerFilter), where the owner defaults
+// to root (0:0).
+func ParseTarFilter(value string) (TarFilter, error) {
+	parts := strings.SplitN(value, ":", 2)
+	name, hasArg := parts[0], len(parts) == 2
+	var arg string
+	if hasArg {
+		arg = parts[1]
+	}
+
+	switch name {
+	case "exclude", "strip-xattr":
+		if arg == "" {
+			return nil, errors.Errorf("filter %s requires a pattern", name)
+		}
+		if name == "exclude" {
+			return ExcludeFilter(arg)
+		}
+		return StripXattrFilter(arg)
+	case "reset-owner":
+		if !hasArg {
+			return ResetOwnerFilter(0, 0), nil
+		}
+		ids := strings.Split(arg, ":")
+		if len(ids) != 2 {
+			return nil, errors.Errorf("filter reset-owner must be of the form reset-owner[:<uid>:<gid>]")
+		}
+		uid, err := strconv.ParseUint(ids[0], 10, 31)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid uid")
+		}
+		gid, err := strconv.ParseUint(ids[1], 10, 31)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid gid")
+		}
+		return ResetOwnerFilter(int(uid), int(gid)), nil
+	}
+	return nil, errors.Errorf("unknown filter: %s", name)
+}
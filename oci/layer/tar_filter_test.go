@@ -0,0 +1,241 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+func TestMatchPath(t *testing.T) {
+	for _, test := range []struct {
+		pattern, path string
+		expected      bool
+	}{
+		{"/etc/passwd", "etc/passwd", true},
+		{"/etc/passwd", "/etc/passwd", true},
+		{"etc/passwd", "etc/passwd/", true},
+		{"/etc/passwd", "etc/shadow", false},
+		{"/etc/*", "etc/passwd", true},
+		{"/etc/*", "etc", false},
+		{"/etc/*", "etc/ssl/certs", false},
+		{"/var/cache/**", "var/cache", false},
+		{"/var/cache/**", "var/cache/apt", true},
+		{"/var/cache/**", "var/cache/apt/archives/foo.deb", true},
+		{"/var/cache/**", "var/cached", false},
+		{"/**/*.pyc", "foo.pyc", true},
+		{"/**/*.pyc", "usr/lib/python/foo.pyc", true},
+		{"/**/*.pyc", "usr/lib/python/foo.py", false},
+		{"/usr/**/bin", "usr/bin", true},
+		{"/usr/**/bin", "usr/local/bin", true},
+		{"/usr/**/bin", "usr/local/bin/foo", false},
+	} {
+		if got := MatchPath(test.pattern, test.path); got != test.expected {
+			t.Errorf("MatchPath(%q, %q): expected %v got %v", test.pattern, test.path, test.expected, got)
+		}
+	}
+}
+
+func TestParseTarFilter(t *testing.T) {
+	for _, value := range []string{
+		"exclude:/var/cache/**",
+		"strip-xattr:user.*",
+		"reset-owner",
+		"reset-owner:1000:100",
+	} {
+		if _, err := ParseTarFilter(value); err != nil {
+			t.Errorf("unexpected error parsing %q: %+v", value, err)
+		}
+	}
+
+	for _, value := range []string{
+		"",
+		"unknown",
+		"exclude",
+		"exclude:",
+		"exclude:/foo/[",
+		"strip-xattr:",
+		"strip-xattr:user.[",
+		"reset-owner:1000",
+		"reset-owner:1000:100:10",
+		"reset-owner:-1:0",
+		"reset-owner:0:foo",
+	} {
+		if _, err := ParseTarFilter(value); err == nil {
+			t.Errorf("expected error parsing %q", value)
+		}
+	}
+}
+
+func TestTarFilterApply(t *testing.T) {
+	exclude, err := ExcludeFilter("/var/cache/**")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripXattr, err := StripXattrFilter("user.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters := tarFilters{exclude, stripXattr, ResetOwnerFilter(0, 0)}
+
+	hdr := &tar.Header{
+		Name:  "var/cache/apt/pkgcache.bin",
+		Uid:   1000,
+		Gid:   100,
+		Uname: "user",
+	}
+	if keep, err := filters.apply(hdr); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	} else if keep {
+		t.Errorf("expected %s to be excluded", hdr.Name)
+	}
+
+	hdr = &tar.Header{
+		Name:  "etc/passwd",
+		Uid:   1000,
+		Gid:   100,
+		Uname: "user",
+		Gname: "users",
+		Xattrs: map[string]string{
+			"user.foo":         "bar",
+			"security.selinux": "label",
+		},
+		PAXRecords: map[string]string{
+			xattrPAXPrefix + "user.foo":         "bar",
+			xattrPAXPrefix + "security.selinux": "label",
+		},
+	}
+	if keep, err := filters.apply(hdr); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	} else if !keep {
+		t.Errorf("expected %s to be kept", hdr.Name)
+	}
+	if hdr.Uid != 0 || hdr.Gid != 0 || hdr.Uname != "" || hdr.Gname != "" {
+		t.Errorf("owner was not reset: %d:%d (%s:%s)", hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname)
+	}
+	if _, ok := hdr.Xattrs["user.foo"]; ok {
+		t.Errorf("user.foo xattr was not stripped")
+	}
+	if _, ok := hdr.PAXRecords[xattrPAXPrefix+"user.foo"]; ok {
+		t.Errorf("user.foo PAX record was not stripped")
+	}
+	if hdr.Xattrs["security.selinux"] != "label" || hdr.PAXRecords[xattrPAXPrefix+"security.selinux"] != "label" {
+		t.Errorf("security.selinux xattr was unexpectedly stripped")
+	}
+}
+
+func TestGenerateFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateFilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "var", "cache", "apt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "var", "cache", "apt", "pkgcache.bin"), []byte("cache"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "var", "cache", "apt", "linked"), []byte("linked"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A hardlink outside of the excluded directory must still be written as a
+	// regular file, since the entry it would link to is left out.
+	if err := os.Link(filepath.Join(dir, "var", "cache", "apt", "linked"), filepath.Join(dir, "zlinked")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(&mtree.DirectoryHierarchy{}, dh, dh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exclude, err := ParseTarFilter("exclude:/var/cache/**")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetOwner, err := ParseTarFilter("reset-owner:1234:5678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := GenerateLayer(context.Background(), dir, diffs, &RepackOptions{
+		Filters: []TarFilter{exclude, resetOwner},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var (
+		gotCache  bool
+		gotFile   bool
+		gotLinked bool
+	)
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if MatchPath("/var/cache/**", hdr.Name) {
+			t.Errorf("got excluded entry: %s", hdr.Name)
+		}
+		if hdr.Uid != 1234 || hdr.Gid != 5678 {
+			t.Errorf("%s: owner was not reset: %d:%d", hdr.Name, hdr.Uid, hdr.Gid)
+		}
+		switch CleanPath(hdr.Name) {
+		case "var/cache":
+			gotCache = true
+		case "file":
+			gotFile = true
+		case "zlinked":
+			if hdr.Typeflag != tar.TypeReg {
+				t.Errorf("zlinked: expected regular file, got type %q (linkname %q)", hdr.Typeflag, hdr.Linkname)
+			}
+			gotLinked = true
+		}
+	}
+
+	if !gotCache {
+		t.Errorf("did not get var/cache (which is not excluded)")
+	}
+	if !gotFile {
+		t.Errorf("did not get file")
+	}
+	if !gotLinked {
+		t.Errorf("did not get zlinked")
+	}
+}
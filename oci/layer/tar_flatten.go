@@ -0,0 +1,169 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/event"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// UnpackToTar writes the root filesystem of the given image manifest to w as
+// a single tar archive, without extracting the image. The layers are applied
+// in order (including whiteouts), so the archive has the same contents as the
+// rootfs produced by UnpackManifest and contains no whiteouts. As with
+// UnpackManifestCpio, the ownership of the files is the ownership inside the
+// image (no mappings are applied), the layers are read twice and every parent
+// directory precedes its children in the archive. Hardlinks are written
+// immediately after their target.
+func UnpackToTar(ctx context.Context, engine cas.Engine, w io.Writer, manifest ispec.Manifest) error {
+	engineExt := casext.Engine{engine}
+
+	entries, links, err := flattenManifest(ctx, engineExt, manifest)
+	if err != nil {
+		return errors.Wrap(err, "unpack to tar")
+	}
+
+	tw := tar.NewWriter(w)
+
+	// Write everything that has no contents, with parents before children.
+	var paths []string
+	for path, entry := range entries {
+		if !hasContents(&entry.hdr) && entry.hdr.Typeflag != tar.TypeLink {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := tw.WriteHeader(flatTarHeader(entries[path].hdr)); err != nil {
+			return errors.Wrapf(err, "unpack to tar: write %s", path)
+		}
+	}
+
+	// Write the regular files (and their hardlinks).
+	for idx, layerDescriptor := range manifest.Layers {
+		event.Log(ctx).Infof("unpack layer: %s", layerDescriptor.Digest)
+		if err := writeFlatTarLayer(ctx, engineExt, idx, layerDescriptor, entries, links, tw); err != nil {
+			return errors.Wrapf(err, "unpack to tar: layer %s", layerDescriptor.Digest)
+		}
+	}
+	return errors.Wrap(tw.Close(), "unpack to tar: write trailer")
+}
+
+// hasContents returns whether the entry described by hdr has contents (that
+// is, whether it is a regular or sparse file).
+func hasContents(hdr *tar.Header) bool {
+	return isRegular(hdr.Typeflag) || isSparseHeader(hdr)
+}
+
+// flatTarHeader returns the header to write to a flattened tar archive for the
+// given entry of the flattened root filesystem. Sparse files are written as
+// regular files (archive/tar has already expanded their contents), and the
+// format of the original layer is not kept.
+func flatTarHeader(hdr tar.Header) *tar.Header {
+	if hdr.Name == "." {
+		hdr.Name = "./"
+	} else if hdr.Typeflag == tar.TypeDir {
+		hdr.Name += "/"
+	}
+	if hdr.Typeflag == tar.TypeRegA {
+		hdr.Typeflag = tar.TypeReg
+	}
+	if isSparseHeader(&hdr) {
+		hdr.Typeflag = tar.TypeReg
+		records := map[string]string{}
+		for key, value := range hdr.PAXRecords {
+			if !strings.HasPrefix(key, paxSparsePrefix) {
+				records[key] = value
+			}
+		}
+		hdr.PAXRecords = records
+	}
+	if !hasContents(&hdr) {
+		hdr.Size = 0
+	}
+	hdr.Format = tar.FormatUnknown
+	setHeaderFormat(&hdr)
+	return &hdr
+}
+
+// writeFlatTarLayer writes the regular files in the given layer which are part
+// of the flattened root filesystem (along with their hardlinks).
+func writeFlatTarLayer(ctx context.Context, engine casext.Engine, layerIdx int, layerDescriptor ispec.Descriptor, entries map[string]*cpioEntry, links map[string][]string, tw *tar.Writer) error {
+	layer, err := OpenLayer(ctx, engine, layerDescriptor)
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+
+	tr := newEntryReader(layer)
+	for idx := 0; ; idx++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+		if !hasContents(hdr) {
+			continue
+		}
+
+		path := cpioPath(hdr.Name)
+		entry, ok := entries[path]
+		if !ok || entry.layer != layerIdx || entry.index != idx {
+			continue
+		}
+
+		if err := tw.WriteHeader(flatTarHeader(entry.hdr)); err != nil {
+			return errors.Wrapf(err, "write %s", path)
+		}
+		if n, err := io.Copy(tw, tr); err != nil {
+			return errors.Wrapf(err, "write %s (%d of %d bytes)", path, n, entry.hdr.Size)
+		}
+
+		// Hardlinks must come after their target.
+		sort.Strings(links[path])
+		for _, link := range links[path] {
+			linkHdr := tar.Header{
+				Name:     link,
+				Typeflag: tar.TypeLink,
+				Linkname: path,
+				Mode:     entry.hdr.Mode,
+				Uid:      entry.hdr.Uid,
+				Gid:      entry.hdr.Gid,
+				Uname:    entry.hdr.Uname,
+				Gname:    entry.hdr.Gname,
+				ModTime:  entry.hdr.ModTime,
+			}
+			setHeaderFormat(&linkHdr)
+			if err := tw.WriteHeader(&linkHdr); err != nil {
+				return errors.Wrapf(err, "write %s", link)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestUnpackToTar(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+
+	reg := func(name, data string) testEntry {
+		return testEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 100}, data: data}
+	}
+
+	base := putUncompressedLayer(t, engine, []testEntry{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		reg("etc/passwd", "root"),
+		reg("etc/hostname", "old"),
+		reg("var/lib/db/a", "a"),
+		reg("var/lib/other/b", "b"),
+		{hdr: tar.Header{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin"}},
+	})
+	upper := putUncompressedLayer(t, engine, []testEntry{
+		reg("etc/hostname", "new"),
+		reg("var/lib/db/c", "c"),
+		reg("var/lib/db/.wh..wh..opq", ""),
+		reg("var/lib/.wh.other", ""),
+		{hdr: tar.Header{Name: "etc/hostname-link", Typeflag: tar.TypeLink, Linkname: "etc/hostname"}},
+		{hdr: tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}},
+	})
+
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, ispec.Image{
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []string{base.Digest.String(), upper.Digest.String()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{base, upper},
+	}
+
+	var archive bytes.Buffer
+	if err := UnpackToTar(ctx, engine, &archive, manifest); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	type tarTestEntry struct {
+		hdr  tar.Header
+		data string
+	}
+	var (
+		names  []string
+		byName = map[string]tarTestEntry{}
+	)
+	tr := tar.NewReader(&archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read flattened archive: %v", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("read %s: %v", hdr.Name, err)
+		}
+		name := strings.TrimSuffix(hdr.Name, "/")
+		if _, ok := byName[name]; ok {
+			t.Errorf("duplicate entry %s", name)
+		}
+		names = append(names, name)
+		byName[name] = tarTestEntry{hdr: *hdr, data: string(data)}
+	}
+
+	// Every parent (and hardlink target) must precede its children.
+	for idx, name := range names {
+		for _, later := range names[idx+1:] {
+			if strings.HasPrefix(name, later+"/") {
+				t.Errorf("parent %s comes after %s", later, name)
+			}
+			if byName[name].hdr.Typeflag == tar.TypeLink && byName[name].hdr.Linkname == later {
+				t.Errorf("hardlink target %s comes after %s", later, name)
+			}
+		}
+	}
+
+	expected := map[string]struct {
+		typeflag byte
+		data     string
+	}{
+		"etc":               {tar.TypeDir, ""},
+		"etc/passwd":        {tar.TypeReg, "root"},
+		"etc/hostname":      {tar.TypeReg, "new"},
+		"etc/hostname-link": {tar.TypeLink, ""},
+		"var":               {tar.TypeDir, ""},
+		"var/lib":           {tar.TypeDir, ""},
+		"var/lib/db":        {tar.TypeDir, ""},
+		"var/lib/db/c":      {tar.TypeReg, "c"},
+		"bin":               {tar.TypeSymlink, ""},
+		"dev":               {tar.TypeDir, ""},
+		"dev/null":          {tar.TypeChar, ""},
+	}
+	if len(byName) != len(expected) {
+		t.Errorf("unexpected entries: got %v", names)
+	}
+	for name, want := range expected {
+		entry, ok := byName[name]
+		if !ok {
+			t.Errorf("missing entry %s", name)
+			continue
+		}
+		if entry.hdr.Typeflag != want.typeflag || entry.data != want.data {
+			t.Errorf("unexpected entry %s: got type=%q data=%q, expected type=%q data=%q", name, entry.hdr.Typeflag, entry.data, want.typeflag, want.data)
+		}
+	}
+
+	if link := byName["etc/hostname-link"].hdr; link.Linkname != "etc/hostname" {
+		t.Errorf("hardlink not preserved: %+v", link)
+	}
+	if target := byName["etc/hostname"].hdr; target.Uid != 1000 || target.Gid != 100 {
+		t.Errorf("ownership not preserved: %+v", target)
+	}
+	if bin := byName["bin"].hdr; bin.Linkname != "usr/bin" {
+		t.Errorf("symlink not preserved: %+v", bin)
+	}
+}
@@ -22,30 +22,26 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
-	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/pkg/ctxio"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/system"
 	"github.com/pkg/errors"
+	"golang.org/x/net/context"
 )
 
-// ignoreXattrList is a list of xattr names that should be ignored when
-// creating a new image layer, because they are host-specific and/or would be a
-// bad idea to unpack.
-// XXX: Maybe we should make this configurable so users can manually blacklist
-//      (or even whitelist) xattrs that they actually want included? Like how
-//      GNU tar's xattr setup works.
-var ignoreXattrList = map[string]struct{}{
-	// SELinux doesn't allow you to set SELinux policies generically. They're
-	// also host-specific. So just ignore them during extraction.
-	"security.selinux": {},
-}
-
 // tarGenerator is a helper for generating layer diff tars. It should be noted
 // that when using tarGenerator.Add{Path,Whiteout} it is recommended to do it
 // in lexicographic order.
 type tarGenerator struct {
 	tw *tar.Writer
 
+	// w is the writer underlying tw, used to write headers which archive/tar
+	// doesn't support (see addSparseFile).
+	w io.Writer
+
 	// mapOptions is the set of mapping options for modifying entries before
 	// they're added to the layer.
 	mapOptions MapOptions
@@ -53,8 +49,43 @@ type tarGenerator struct {
 	// Hardlink mapping.
 	inodes map[uint64]string
 
-	// fsEval is an umoci.FsEval used for extraction.
-	fsEval umoci.FsEval
+	// fsEval is an fseval.FsEval used for extraction.
+	fsEval fseval.FsEval
+
+	// reproducible and sourceDateEpoch correspond to the RepackOptions fields
+	// of the same name, and are applied by normaliseHeader.
+	reproducible    bool
+	sourceDateEpoch *time.Time
+
+	// clampMtime corresponds to RepackOptions.ClampMtime, and is also applied
+	// by normaliseHeader.
+	clampMtime *time.Time
+
+	// whiteoutMode corresponds to RepackOptions.WhiteoutMode, and is used by
+	// AddWhiteout.
+	whiteoutMode WhiteoutMode
+
+	// xattrPolicies corresponds to RepackOptions.XattrPolicies, and is used
+	// by AddFile.
+	xattrPolicies XattrPolicies
+
+	// noSparse corresponds to RepackOptions.NoSparse, and is used by AddFile.
+	noSparse bool
+
+	// droppedXattrs corresponds to RepackOptions.DroppedXattrs, and is used
+	// by AddFile.
+	droppedXattrs DroppedXattrs
+
+	// ownerNames corresponds to RepackOptions.OwnerNames, and is used by
+	// AddFile.
+	ownerNames *OwnerNames
+
+	// filters corresponds to RepackOptions.Filters, and is used by AddFile.
+	filters tarFilters
+
+	// ctx is the context of the operation generating the layer. Copying the
+	// contents of files stops once it is done.
+	ctx context.Context
 
 	// XXX: Should we add a saftey check to make sure we don't generate two of
 	//      the same path in a tar archive? This is not permitted by the spec.
@@ -63,16 +94,18 @@ type tarGenerator struct {
 // newTarGenerator creates a new tarGenerator using the provided writer as the
 // output writer.
 func newTarGenerator(w io.Writer, opt MapOptions) *tarGenerator {
-	var fsEval umoci.FsEval = umoci.DefaultFsEval
+	var fsEval fseval.FsEval = fseval.DefaultFsEval
 	if opt.Rootless {
-		fsEval = umoci.RootlessFsEval
+		fsEval = fseval.RootlessFsEval
 	}
 
 	return &tarGenerator{
+		w:          w,
 		tw:         tar.NewWriter(w),
 		mapOptions: opt,
 		inodes:     map[uint64]string{},
 		fsEval:     fsEval,
+		ctx:        context.Background(),
 	}
 }
 
@@ -103,11 +136,113 @@ func normalise(rawPath string, isDir bool) (string, error) {
 	return path, nil
 }
 
+// epoch returns the timestamp used for entries which don't have one of their
+// own (such as whiteouts).
+func (tg *tarGenerator) epoch() time.Time {
+	if !tg.reproducible {
+		return time.Now()
+	}
+	if tg.sourceDateEpoch != nil {
+		return *tg.sourceDateEpoch
+	}
+	return time.Unix(0, 0)
+}
+
+// normaliseHeader modifies the given header so that it only contains
+// information which is reproducible, if the tarGenerator is in reproducible
+// mode. Note that archive/tar already writes xattrs in sorted order. The
+// mtime is clamped to clampMtime (if set) regardless of the mode.
+func (tg *tarGenerator) normaliseHeader(hdr *tar.Header) {
+	if tg.clampMtime != nil && hdr.ModTime.After(*tg.clampMtime) {
+		hdr.ModTime = *tg.clampMtime
+	}
+	if !tg.reproducible {
+		return
+	}
+
+	mtime := hdr.ModTime.Truncate(time.Second)
+	if tg.sourceDateEpoch != nil && mtime.After(*tg.sourceDateEpoch) {
+		mtime = *tg.sourceDateEpoch
+	}
+	hdr.ModTime = mtime
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+
+	// Owner names are looked up on the host, and so depend on the host's
+	// /etc/passwd rather than on the rootfs.
+	hdr.Uname = ""
+	hdr.Gname = ""
+}
+
+const (
+	// ustarNameSize and ustarPrefixSize are the sizes of the name and prefix
+	// fields of a USTAR header. A path can be stored across both fields by
+	// splitting it at a '/'.
+	ustarNameSize   = 100
+	ustarPrefixSize = 155
+)
+
+// isASCII returns whether the string only contains ASCII characters, which
+// is required for it to be stored in a USTAR header.
+func isASCII(s string) bool {
+	for _, c := range s {
+		if c >= 0x80 || c == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// fitsUSTAR returns whether the given path can be stored in the name and
+// prefix fields of a USTAR header.
+func fitsUSTAR(name string) bool {
+	if !isASCII(name) {
+		return false
+	}
+	if len(name) <= ustarNameSize {
+		return true
+	}
+
+	// Find the last '/' which leaves a prefix that fits in the prefix field.
+	// A trailing '/' (for directories) can't be used to split the path.
+	length := len(name)
+	if length > ustarPrefixSize+1 {
+		length = ustarPrefixSize + 1
+	} else if name[length-1] == '/' {
+		length--
+	}
+	i := strings.LastIndex(name[:length], "/")
+	return i > 0 && len(name)-i-1 > 0 && len(name)-i-1 <= ustarNameSize
+}
+
+// setHeaderFormat makes sure that entries whose path or link target can't be
+// stored in a USTAR header are written using PAX records, rather than leaving
+// the choice to archive/tar (which may use GNU extensions that other tools
+// cannot read). This is quite common in deeply nested trees, such as
+// node_modules. The timestamps are otherwise written in the same way as USTAR
+// entries, so that an entry doesn't change depending on its path.
+func setHeaderFormat(hdr *tar.Header) {
+	if fitsUSTAR(hdr.Name) && isASCII(hdr.Linkname) && len(hdr.Linkname) <= ustarNameSize {
+		return
+	}
+	hdr.Format = tar.FormatPAX
+	hdr.ModTime = hdr.ModTime.Round(time.Second)
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+}
+
 // AddFile adds a file from the filesystem to the tar archive. It copies all of
 // the relevant stat information about the file, and also attempts to track
 // hardlinks. This should be functionally equivalent to adding entries with GNU
 // tar.
 func (tg *tarGenerator) AddFile(name, path string) error {
+	return tg.addFile(name, path, nil)
+}
+
+// addFile is AddFile, except that if path is a regular file and content is
+// non-nil then the contents of the file are read from content rather than
+// from the filesystem. content must have the same size as the file.
+func (tg *tarGenerator) addFile(name, path string, content io.Reader) error {
 	fi, err := tg.fsEval.Lstat(path)
 	if err != nil {
 		return errors.Wrap(err, "add file lstat")
@@ -154,14 +289,8 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	if err != nil {
 		return errors.Wrap(err, "get xattr list")
 	}
+	xattrs := map[string]string{}
 	for _, name := range names {
-		// Some xattrs need to be skipped for sanity reasons, such as
-		// security.selinux, because they are very much host-specific and
-		// carrying them to other hosts would be a really bad idea.
-		if _, ignore := ignoreXattrList[name]; ignore {
-			continue
-		}
-
 		value, err := tg.fsEval.Lgetxattr(path, name)
 		if err != nil {
 			// XXX: I'm not sure if we're unprivileged whether Lgetxattr can
@@ -169,7 +298,19 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 			//      we try to clear xattrs).
 			return errors.Wrapf(err, "get xattr: %s", name)
 		}
-		hdr.Xattrs[name] = string(value)
+		xattrs[name] = string(value)
+	}
+	// Re-add any xattrs we couldn't set when the rootfs was unpacked.
+	tg.droppedXattrs.inject(layerKey(name), xattrs)
+	// Some xattrs are skipped by default for sanity reasons, such as
+	// security.selinux, because they are very much host-specific and carrying
+	// them to other hosts would be a really bad idea.
+	xattrs, err = tg.xattrPolicies.apply(xattrs, true, rootIDToContainer(tg.mapOptions))
+	if err != nil {
+		return errors.Wrap(err, "apply xattr policies")
+	}
+	for name, value := range xattrs {
+		hdr.Xattrs[name] = value
 	}
 
 	// Not all systems have the concept of an inode, but I'm not in the mood to
@@ -181,6 +322,7 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	}
 
 	// Handle hardlinks.
+	firstLink := false
 	if oldpath, ok := tg.inodes[ino]; ok {
 		// We just hit a hardlink, so we just have to change the header.
 		hdr.Typeflag = tar.TypeLink
@@ -188,6 +330,7 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 		hdr.Size = 0
 	} else {
 		tg.inodes[ino] = name
+		firstLink = true
 	}
 
 	// XXX: What about xattrs.
@@ -196,19 +339,59 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	if err := mapHeader(hdr, tg.mapOptions); err != nil {
 		return errors.Wrap(err, "map header")
 	}
-	if err := tg.tw.WriteHeader(hdr); err != nil {
-		return errors.Wrap(err, "write header")
+	tg.normaliseHeader(hdr)
+	if tg.ownerNames != nil {
+		hdr.Uname, _ = tg.ownerNames.UserName(hdr.Uid)
+		hdr.Gname, _ = tg.ownerNames.GroupName(hdr.Gid)
+	}
+	keep, err := tg.filters.apply(hdr)
+	if err != nil {
+		return err
+	}
+	if !keep {
+		// Other links to the same inode must not refer to an entry which
+		// isn't in the layer.
+		if firstLink {
+			delete(tg.inodes, ino)
+		}
+		return nil
 	}
+	setHeaderFormat(hdr)
 
-	// Write the contents of regular files.
-	if hdr.Typeflag == tar.TypeReg {
+	// Regular files with holes are written as sparse files.
+	if hdr.Typeflag == tar.TypeReg && content == nil {
 		fh, err := tg.fsEval.Open(path)
 		if err != nil {
 			return errors.Wrap(err, "open file")
 		}
 		defer fh.Close()
+		content = fh
+
+		if !tg.noSparse {
+			regions, err := system.DataRegions(fh, hdr.Size)
+			if err != nil {
+				return errors.Wrap(err, "find holes")
+			}
+			dataSize := int64(0)
+			for _, region := range regions {
+				dataSize += region.Length
+			}
+			if dataSize < hdr.Size {
+				return tg.addSparseFile(hdr, fh, regions)
+			}
+			if _, err := fh.Seek(0, io.SeekStart); err != nil {
+				return errors.Wrap(err, "rewind file")
+			}
+		}
+	}
+
+	if err := tg.tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "write header")
+	}
 
-		n, err := io.Copy(tg.tw, fh)
+	// Write the contents of regular files.
+	if hdr.Typeflag == tar.TypeReg {
+		n, err := io.Copy(tg.tw, ctxio.NewReader(tg.ctx, content))
 		if err != nil {
 			return errors.Wrap(err, "copy to layer")
 		}
@@ -222,27 +405,47 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 
 const whPrefix = ".wh."
 
-// AddWhiteout adds a whiteout file for the given name inside the tar archive.
-// It's not recommended to add a file with AddFile and then white it out.
+// AddWhiteout adds a whiteout file for the given name inside the tar archive,
+// in the format given by the whiteout mode of the tarGenerator. It's not
+// recommended to add a file with AddFile and then white it out.
 func (tg *tarGenerator) AddWhiteout(name string) error {
 	name, err := normalise(name, false)
 	if err != nil {
 		return errors.Wrap(err, "normalise path")
 	}
-
-	// Create the explicit whiteout for the file.
-	dir, file := filepath.Split(name)
-	whiteout := filepath.Join(dir, whPrefix+file)
-	timestamp := time.Now()
+	timestamp := tg.epoch()
+
+	var hdr *tar.Header
+	switch tg.whiteoutMode {
+	case "", WhiteoutAUFS:
+		// Create the explicit whiteout for the file.
+		dir, file := filepath.Split(name)
+		hdr = &tar.Header{
+			Name: filepath.Join(dir, whPrefix+file),
+			Size: 0,
+		}
+	case WhiteoutOverlay:
+		// overlayfs whiteouts are 0:0 character devices in place of the
+		// removed path.
+		hdr = &tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeChar,
+			Devmajor: 0,
+			Devminor: 0,
+		}
+	case WhiteoutReject:
+		return errors.Errorf("path was removed, but whiteouts are disabled: %s", name)
+	default:
+		return errors.Errorf("unknown whiteout mode: %s", tg.whiteoutMode)
+	}
+	hdr.ModTime = timestamp
+	hdr.AccessTime = timestamp
+	hdr.ChangeTime = timestamp
 
 	// Add a dummy header for the whiteout file.
-	if err := tg.tw.WriteHeader(&tar.Header{
-		Name:       whiteout,
-		Size:       0,
-		ModTime:    timestamp,
-		AccessTime: timestamp,
-		ChangeTime: timestamp,
-	}); err != nil {
+	tg.normaliseHeader(hdr)
+	setHeaderFormat(hdr)
+	if err := tg.tw.WriteHeader(hdr); err != nil {
 		return errors.Wrap(err, "write whiteout header")
 	}
 
@@ -377,3 +377,118 @@ func TestTarGenerateAddWhiteout(t *testing.T) {
 		t.Errorf("not all paths had a whiteout entry generated (only read %d, expected %d)!", idx, len(paths))
 	}
 }
+
+func TestFitsUSTAR(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		fits bool
+	}{
+		{"file", true},
+		{strings.Repeat("a", 100), true},
+		{strings.Repeat("a", 101), false},
+		{strings.Repeat("a", 155) + "/" + strings.Repeat("b", 100), true},
+		{strings.Repeat("a", 156) + "/" + strings.Repeat("b", 100), false},
+		{strings.Repeat("a", 155) + "/" + strings.Repeat("b", 101), false},
+		{strings.Repeat("a", 150) + "/" + strings.Repeat("b", 99) + "/", true},
+		{strings.Repeat("a/", 130), false},
+		{"/" + strings.Repeat("b", 100), false},
+		{"café", false},
+	} {
+		if got := fitsUSTAR(test.name); got != test.fits {
+			t.Errorf("fitsUSTAR(%q): expected %v, got %v", test.name, test.fits, got)
+		}
+	}
+}
+
+func TestTarGenerateLongPaths(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateLongPaths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The names in the archive are independent of the paths on the
+	// filesystem, so we don't need to create a deep tree here.
+	var parents []string
+	for i := 0; i < 10; i++ {
+		parents = append(parents, "node_modules", strings.Repeat("x", 40))
+	}
+	parent := strings.Join(parents, "/")
+	linkname := strings.Repeat("../", 50) + strings.Repeat("t", 120)
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("some data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(linkname, link); err != nil {
+		t.Fatal(err)
+	}
+	shortLink := filepath.Join(dir, "shortlink")
+	if err := os.Symlink(linkname, shortLink); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*tar.Header{
+		{Name: parent + "/" + strings.Repeat("f", 200), Typeflag: tar.TypeReg},
+		{Name: parent + "/link", Typeflag: tar.TypeSymlink, Linkname: linkname},
+		{Name: "short", Typeflag: tar.TypeSymlink, Linkname: linkname},
+		{Name: parent + "/" + whPrefix + "removed", Typeflag: tar.TypeReg},
+	}
+
+	tg := newTarGenerator(writer, MapOptions{})
+	tr := tar.NewReader(reader)
+
+	go func() {
+		if err := tg.AddFile(expected[0].Name, file); err != nil {
+			t.Errorf("AddFile: %s: unexpected error: %s", file, err)
+		}
+		if err := tg.AddFile(expected[1].Name, link); err != nil {
+			t.Errorf("AddFile: %s: unexpected error: %s", link, err)
+		}
+		if err := tg.AddFile(expected[2].Name, shortLink); err != nil {
+			t.Errorf("AddFile: %s: unexpected error: %s", shortLink, err)
+		}
+		if err := tg.AddWhiteout(parent + "/removed"); err != nil {
+			t.Errorf("AddWhiteout: unexpected error: %s", err)
+		}
+		if err := tg.tw.Close(); err != nil {
+			t.Errorf("tw.Close: unexpected error: %s", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Errorf("writer.Close: unexpected error: %s", err)
+		}
+	}()
+
+	for _, expectedHdr := range expected {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("reading tar archive: %s", err)
+		}
+		if hdr.Name != expectedHdr.Name {
+			t.Errorf("hdr.Name changed: expected %s, got %s", expectedHdr.Name, hdr.Name)
+		}
+		if hdr.Typeflag != expectedHdr.Typeflag {
+			t.Errorf("%s: hdr.Typeflag changed: expected %d, got %d", hdr.Name, expectedHdr.Typeflag, hdr.Typeflag)
+		}
+		if hdr.Linkname != expectedHdr.Linkname {
+			t.Errorf("%s: hdr.Linkname changed: expected %s, got %s", hdr.Name, expectedHdr.Linkname, hdr.Linkname)
+		}
+		// The entries must use PAX records, not GNU extensions.
+		if hdr.Format&tar.FormatPAX == 0 {
+			t.Errorf("%s: expected a PAX entry, got %s", hdr.Name, hdr.Format)
+		}
+		if !hdr.AccessTime.IsZero() || !hdr.ChangeTime.IsZero() {
+			t.Errorf("%s: unexpected atime or ctime in PAX entry", hdr.Name)
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			t.Errorf("%s: read contents: %s", hdr.Name, err)
+		}
+	}
+
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected only %d entries, err=%s", len(expected), err)
+	}
+}
@@ -59,3 +59,11 @@ func getInode(fi os.FileInfo) (uint64, error) {
 	}
 	return s.Ino, nil
 }
+
+func getNlink(fi os.FileInfo) (uint64, error) {
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("failed to cast fileinfo to *syscall.stat_t")
+	}
+	return uint64(s.Nlink), nil
+}
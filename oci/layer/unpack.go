@@ -18,22 +18,26 @@
 package layer
 
 import (
-	"archive/tar"
 	"compress/gzip"
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/apex/log"
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
 	iconv "github.com/openSUSE/umoci/oci/config/convert"
+	"github.com/openSUSE/umoci/pkg/ctxio"
+	"github.com/openSUSE/umoci/pkg/event"
 	"github.com/openSUSE/umoci/pkg/idtools"
 	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	rgen "github.com/opencontainers/runtime-tools/generate"
@@ -50,9 +54,20 @@ func UnpackLayer(root string, layer io.Reader, opt *MapOptions) error {
 	if opt != nil {
 		mapOptions = *opt
 	}
-	te := newTarExtractor(mapOptions)
-	tr := tar.NewReader(layer)
+	return unpackLayer(context.Background(), newTarExtractor(mapOptions), root, layer)
+}
+
+// unpackLayer is the implementation of UnpackLayer, using the provided
+// tarExtractor. Unpacking stops (with the error of the context) once ctx is
+// done.
+func unpackLayer(ctx context.Context, te *tarExtractor, root string, layer io.Reader) error {
+	defer te.closeRoot()
+
+	tr := newEntryReader(ctxio.NewReader(ctx, layer))
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			break
@@ -60,10 +75,18 @@ func UnpackLayer(root string, layer io.Reader, opt *MapOptions) error {
 		if err != nil {
 			return errors.Wrap(err, "read next entry")
 		}
+		if !te.filter.includesEntry(hdr) {
+			continue
+		}
 		if err := te.unpackEntry(root, hdr, tr); err != nil {
 			return errors.Wrapf(err, "unpack entry: %s", hdr.Name)
 		}
 	}
+	if te.overlay {
+		if err := te.markOpaques(); err != nil {
+			return errors.Wrap(err, "mark opaque directories")
+		}
+	}
 	return nil
 }
 
@@ -71,6 +94,11 @@ func UnpackLayer(root string, layer io.Reader, opt *MapOptions) error {
 // generated.
 const RootfsName = "rootfs"
 
+// ErrInvalidMediaType is the cause of the errors returned when a blob
+// referenced by a manifest (a layer or the image configuration) does not have
+// the media type required for it to be used.
+var ErrInvalidMediaType = errors.New("blob is not correct mediatype")
+
 // isLayerType returns if the given MediaType is the media type of an image
 // layer blob. This includes both distributable and non-distributable images.
 func isLayerType(mediaType string) bool {
@@ -78,59 +106,58 @@ func isLayerType(mediaType string) bool {
 		mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip
 }
 
-// UnpackManifest extracts all of the layers in the given manifest, as well as
-// generating a runtime bundle and configuration. The rootfs is extracted to
-// <bundle>/<layer.RootfsName>. Some verification is done during image
-// extraction.
-//
-// FIXME: This interface is ugly.
-func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *MapOptions) error {
-	engineExt := casext.Engine{engine}
-
-	var mapOptions MapOptions
-	if opt != nil {
-		mapOptions = *opt
-	}
-
-	// Create the bundle directory. We only error out if config.json or rootfs/
-	// already exists, because we cannot be sure that the user intended us to
-	// extract over an existing bundle.
-	if err := os.MkdirAll(bundle, 0755); err != nil {
-		return errors.Wrap(err, "mkdir bundle")
-	}
-
-	configPath := filepath.Join(bundle, "config.json")
-	rootfsPath := filepath.Join(bundle, RootfsName)
+// OverlayLayersName is the name of the directory inside the bundle path into
+// which each layer is extracted by UnpackManifestOverlay.
+const OverlayLayersName = "layers"
+
+// OverlayMetaName is the name of the file inside the bundle path in which
+// UnpackManifestOverlay stores the OverlayMeta for the bundle.
+const OverlayMetaName = "overlay.json"
+
+// OverlayMeta describes how the layers extracted by UnpackManifestOverlay
+// should be mounted with overlayfs to produce the image's root filesystem.
+type OverlayMeta struct {
+	// LowerDirs is the set of layer directories (relative to the bundle path)
+	// in the order expected by the overlayfs lowerdir option. That is, the
+	// topmost layer comes first.
+	LowerDirs []string `json:"lowerdirs"`
+}
 
-	if _, err := os.Lstat(configPath); !os.IsNotExist(err) {
-		if err == nil {
-			err = fmt.Errorf("config.json already exists")
-		}
-		return errors.Wrap(err, "bundle path empty")
+// MountOptions returns the overlayfs mount options required to mount the
+// layers of the bundle at the given path. Note that overlayfs requires at
+// least two lowerdirs if no upperdir is specified. If there are no layers
+// (such as for a scratch image) there is nothing to mount, and an empty string
+// is returned.
+func (m OverlayMeta) MountOptions(bundle string) string {
+	if len(m.LowerDirs) == 0 {
+		return ""
 	}
-
-	if _, err := os.Lstat(rootfsPath); !os.IsNotExist(err) {
-		if err == nil {
-			err = fmt.Errorf("%s already exists", RootfsName)
-		}
-		return errors.Wrap(err, "bundle path empty")
+	var dirs []string
+	for _, dir := range m.LowerDirs {
+		dirs = append(dirs, filepath.Join(bundle, dir))
 	}
+	return "lowerdir=" + strings.Join(dirs, ":")
+}
 
-	if err := os.Mkdir(rootfsPath, 0755); err != nil {
-		return errors.Wrap(err, "mkdir rootfs")
+// prepareRoot creates a new root directory at the given path, owned by the
+// root user of the given mapping.
+func prepareRoot(path string, mapOptions MapOptions) error {
+	if err := os.Mkdir(path, 0755); err != nil {
+		return errors.Wrap(err, "mkdir root")
 	}
 
 	// Make sure that the owner is correct.
-	rootUID, err := idtools.ToHost(0, opt.UIDMappings)
+	uidMappings, gidMappings := mapOptions.fileMappings()
+	rootUID, err := idtools.ToHost(0, uidMappings)
 	if err != nil {
 		return errors.Wrap(err, "ensure rootuid has mapping")
 	}
-	rootGID, err := idtools.ToHost(0, opt.GIDMappings)
+	rootGID, err := idtools.ToHost(0, gidMappings)
 	if err != nil {
 		return errors.Wrap(err, "ensure rootgid has mapping")
 	}
-	if err := os.Lchown(rootfsPath, rootUID, rootGID); err != nil {
-		return errors.Wrap(err, "chown rootfs")
+	if err := os.Lchown(path, rootUID, rootGID); err != nil {
+		return errors.Wrap(err, "chown root")
 	}
 
 	// Currently, many different images in the wild don't specify what the
@@ -139,9 +166,155 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 	// this, we first set the mtime of the root directory to the Unix epoch
 	// (which is as good of an arbitrary choice as any).
 	epoch := time.Unix(0, 0)
-	if err := system.Lutimes(rootfsPath, epoch, epoch); err != nil {
+	if err := system.Lutimes(path, epoch, epoch); err != nil {
 		return errors.Wrap(err, "set initial root time")
 	}
+	return nil
+}
+
+// UnpackOptions modifies the behaviour of UnpackManifestWithOptions.
+type UnpackOptions struct {
+	// MapOptions are the mapping options used when extracting the layers.
+	MapOptions MapOptions
+
+	// Overlay specifies whether each layer should be extracted into its own
+	// directory, as with UnpackManifestOverlay.
+	Overlay bool
+
+	// PathFilters restricts extraction to the given paths (such as "/etc" or
+	// "/usr/bin/foo") and everything inside them. The parent directories of
+	// each path are also extracted, and whiteouts are applied if they affect
+	// an extracted path. If empty, every path is extracted.
+	PathFilters []string
+
+	// XattrPolicies specifies how the security xattrs in the layers are
+	// applied to the rootfs.
+	XattrPolicies XattrPolicies
+
+	// SELinuxLabel, if non-empty, is the SELinux label applied to every
+	// extracted path.
+	SELinuxLabel string
+
+	// HardlinkMode specifies how hardlinks to paths in lower layers are
+	// extracted. The default is HardlinkFollow.
+	HardlinkMode HardlinkMode
+
+	// ExtractPolicy specifies how cross-layer hardlinks, device nodes, setuid
+	// bits and conflicting whiteouts are extracted. The default preserves all
+	// of them.
+	ExtractPolicy ExtractPolicy
+
+	// NoSparse causes holes in sparse files to be filled with zeroes, rather
+	// than being recreated in the rootfs.
+	NoSparse bool
+
+	// ExtractionMode specifies whether the paths of the entries are verified
+	// to be inside the rootfs before they are written. The default is
+	// SecureExtraction.
+	ExtractionMode ExtractionMode
+
+	// RuntimeOptions are applied to the generated runtime configuration,
+	// after all other modifications.
+	RuntimeOptions iconv.RuntimeOptions
+
+	// ForeignLayers specifies how foreign layers whose blobs are not present
+	// in the image are handled. The default is ForeignLayerError.
+	ForeignLayers ForeignLayerPolicy
+
+	// DroppedXattrs, if non-nil, is filled in with the xattrs (such as
+	// security.capability) which could not be set on the rootfs because
+	// MapOptions.Rootless is set, so that they can be passed to
+	// RepackOptions.DroppedXattrs. It is ignored for overlay unpacks.
+	DroppedXattrs DroppedXattrs
+
+	// Decryption contains the keys used to decrypt encrypted layers. If nil,
+	// ErrEncryptedLayer is returned for encrypted layers.
+	Decryption *DecryptConfig
+
+	// LayerAnnotations are the annotations of the layer descriptors of the
+	// manifest (see casext.ManifestLayerAnnotations), which are required to
+	// decrypt encrypted layers.
+	LayerAnnotations []map[string]string
+
+	// Resume causes an interrupted unpack of the same image (with the same
+	// Overlay and PathFilters) to be continued from the last layer which was
+	// completely extracted, as recorded in <bundle>/<layer.UnpackCheckpointName>
+	// (see UnpackCheckpoint). A partially extracted layer is extracted again.
+	// If the bundle has no checkpoint, it is unpacked as usual.
+	Resume bool
+}
+
+// UnpackManifest extracts all of the layers in the given manifest, as well as
+// generating a runtime bundle and configuration. The rootfs is extracted to
+// <bundle>/<layer.RootfsName>. Some verification is done during image
+// extraction.
+//
+// FIXME: This interface is ugly.
+func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *MapOptions) error {
+	var unpackOptions UnpackOptions
+	if opt != nil {
+		unpackOptions.MapOptions = *opt
+	}
+	return UnpackManifestWithOptions(ctx, engine, bundle, manifest, unpackOptions)
+}
+
+// UnpackManifestOverlay is like UnpackManifest, except that rather than
+// flattening the layers into a single rootfs each layer is extracted into its
+// own directory inside <bundle>/<layer.OverlayLayersName>. OCI whiteouts are
+// converted into overlayfs whiteouts, and the set of layer directories is
+// written to <bundle>/<layer.OverlayMetaName> (see OverlayMeta). The rootfs is
+// left empty, to be used as the mountpoint for the overlay.
+func UnpackManifestOverlay(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *MapOptions) error {
+	unpackOptions := UnpackOptions{Overlay: true}
+	if opt != nil {
+		unpackOptions.MapOptions = *opt
+	}
+	return UnpackManifestWithOptions(ctx, engine, bundle, manifest, unpackOptions)
+}
+
+// UnpackManifestWithOptions is like UnpackManifest (or UnpackManifestOverlay
+// if opt.Overlay is set), except that the given options are used.
+func UnpackManifestWithOptions(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt UnpackOptions) (err error) {
+	ctx, span := event.StartSpan(ctx, "layer.UnpackManifest")
+	defer func() { span.End(err) }()
+	span.SetAttribute("bundle", bundle)
+	span.SetAttribute("layers", len(manifest.Layers))
+	span.SetAttribute("overlay", opt.Overlay)
+	span.SetAttribute("path_filters", len(opt.PathFilters))
+
+	engineExt := casext.Engine{engine}
+	ctx, err = casext.WithManifestLayerChunks(ctx, manifest)
+	if err != nil {
+		return errors.Wrap(err, "get chunked layers")
+	}
+	mapOptions := opt.MapOptions
+	overlay := opt.Overlay
+	filter := newPathFilter(opt.PathFilters)
+
+	// overlayfs whiteouts are device nodes and opaque directories are marked
+	// with trusted.* xattrs, neither of which can be created without
+	// privileges.
+	if overlay && (mapOptions.Rootless || mapOptions.UserNamespace) {
+		return errors.Errorf("unpack manifest: overlay unpacking is not supported in rootless mode")
+	}
+	if err := opt.XattrPolicies.Validate(); err != nil {
+		return errors.Wrap(err, "unpack manifest")
+	}
+	if err := opt.HardlinkMode.Validate(); err != nil {
+		return errors.Wrap(err, "unpack manifest")
+	}
+	if err := opt.ExtractPolicy.Validate(); err != nil {
+		return errors.Wrap(err, "unpack manifest")
+	}
+	if err := opt.ExtractionMode.Validate(); err != nil {
+		return errors.Wrap(err, "unpack manifest")
+	}
+	if err := opt.RuntimeOptions.Profile.Validate(); err != nil {
+		return errors.Wrap(err, "unpack manifest")
+	}
+	if err := opt.ForeignLayers.Validate(); err != nil {
+		return errors.Wrap(err, "unpack manifest")
+	}
 
 	// In order to verify the DiffIDs as we extract layers, we have to get the
 	// .Config blob first. But we can't extract it (generate the runtime
@@ -152,7 +325,7 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 	}
 	defer configBlob.Close()
 	if configBlob.MediaType != ispec.MediaTypeImageConfig {
-		return errors.Errorf("unpack manifest: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
+		return errors.Wrapf(ErrInvalidMediaType, "unpack manifest: config blob has mediatype %s (expected %s)", configBlob.MediaType, ispec.MediaTypeImageConfig)
 	}
 	config, ok := configBlob.Data.(ispec.Image)
 	if !ok {
@@ -160,58 +333,247 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 		return errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
 	}
 
+	if err := CheckPlatform(ispec.Platform{OS: config.OS, Architecture: config.Architecture}); err != nil {
+		return errors.Wrap(err, "unpack manifest")
+	}
 	// We can't understand non-layer images.
 	if config.RootFS.Type != "layers" {
 		return errors.Errorf("unpack manifest: config: unsupported rootfs.type: %s", config.RootFS.Type)
 	}
+	if len(manifest.Layers) != len(config.RootFS.DiffIDs) {
+		return errors.Errorf("unpack manifest: manifest has %d layers but config has %d diff_ids", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	// Create the bundle directory. We only error out if config.json or rootfs/
+	// already exists (and we are not resuming an unpack of the bundle),
+	// because we cannot be sure that the user intended us to extract over an
+	// existing bundle.
+	if err := os.MkdirAll(bundle, 0755); err != nil {
+		return errors.Wrap(err, "mkdir bundle")
+	}
+
+	configPath := filepath.Join(bundle, "config.json")
+	rootfsPath := filepath.Join(bundle, RootfsName)
+	layersPath := filepath.Join(bundle, OverlayLayersName)
+
+	checkpoint := UnpackCheckpoint{
+		Config:      manifest.Config.Digest,
+		Overlay:     overlay,
+		PathFilters: opt.PathFilters,
+	}
+	resume := false
+	if opt.Resume {
+		previous, err := ReadUnpackCheckpoint(bundle)
+		if err == nil {
+			if err := previous.matches(manifest.Config.Digest, opt); err != nil {
+				return errors.Wrap(err, "cannot resume unpack")
+			}
+			if previous.Layers > len(manifest.Layers) {
+				return errors.Errorf("cannot resume unpack: checkpoint has %d layers but image has %d", previous.Layers, len(manifest.Layers))
+			}
+			checkpoint = previous
+			resume = true
+		} else if !os.IsNotExist(errors.Cause(err)) {
+			return errors.Wrap(err, "read unpack checkpoint")
+		}
+	}
+
+	if resume {
+		event.Log(ctx).Infof("resuming unpack after %d of %d layers", checkpoint.Layers, len(manifest.Layers))
+		if opt.DroppedXattrs != nil && !overlay {
+			for path, xattrs := range checkpoint.DroppedXattrs {
+				opt.DroppedXattrs[path] = xattrs
+			}
+		}
+	} else {
+		if _, err := os.Lstat(configPath); !os.IsNotExist(err) {
+			if err == nil {
+				err = fmt.Errorf("config.json already exists")
+			}
+			return errors.Wrap(err, "bundle path empty")
+		}
+
+		if _, err := os.Lstat(rootfsPath); !os.IsNotExist(err) {
+			if err == nil {
+				err = fmt.Errorf("%s already exists", RootfsName)
+				if _, err2 := os.Lstat(filepath.Join(bundle, UnpackCheckpointName)); err2 == nil {
+					err = fmt.Errorf("%s already exists (from an interrupted unpack which can be resumed)", RootfsName)
+				}
+			}
+			return errors.Wrap(err, "bundle path empty")
+		}
+
+		// The checkpoint is written before anything is extracted, so that
+		// even an unpack interrupted during the first layer can be resumed.
+		if err := writeUnpackCheckpoint(bundle, checkpoint); err != nil {
+			return errors.Wrap(err, "write unpack checkpoint")
+		}
+	}
+
+	// When resuming, the root directories may not have been created yet.
+	if _, err := os.Lstat(rootfsPath); os.IsNotExist(err) {
+		if err := prepareRoot(rootfsPath, mapOptions); err != nil {
+			return errors.Wrap(err, "prepare rootfs")
+		}
+	}
+	if overlay {
+		mkdir := os.Mkdir
+		if resume {
+			mkdir = os.MkdirAll
+		}
+		if err := mkdir(layersPath, 0755); err != nil {
+			return errors.Wrap(err, "mkdir layers")
+		}
+	}
+	overlayMeta := OverlayMeta{LowerDirs: append([]string{}, checkpoint.LowerDirs...)}
 
 	// Layer extraction.
 	for idx, layerDescriptor := range manifest.Layers {
+		if err := ctx.Err(); err != nil {
+			return errors.Wrap(err, "unpack manifest")
+		}
+		if idx < checkpoint.Layers {
+			event.Log(ctx).Debugf("skipping already extracted layer: %s", layerDescriptor.Digest)
+			continue
+		}
 		layerDiffID := config.RootFS.DiffIDs[idx]
-		log.Infof("unpack layer: %s", layerDescriptor.Digest)
+		event.Log(ctx).Infof("unpack layer: %s", layerDescriptor.Digest)
+		layerStart := time.Now()
 
-		layerBlob, err := engineExt.FromDescriptor(ctx, layerDescriptor)
-		if err != nil {
-			return errors.Wrap(err, "get layer blob")
+		if IsEncryptedLayerType(layerDescriptor.MediaType) && opt.Decryption == nil {
+			return errors.Wrapf(ErrEncryptedLayer, "unpack manifest: layer %s", layerDescriptor.Digest)
 		}
-		defer layerBlob.Close()
-		if !isLayerType(layerBlob.MediaType) {
-			return errors.Errorf("unpack manifest: layer %s: blob is not correct mediatype: %s", layerBlob.Digest, layerBlob.MediaType)
+
+		if !isLayerType(DecryptedLayerType(layerDescriptor.MediaType)) {
+			return errors.Wrapf(ErrInvalidMediaType, "unpack manifest: layer %s: blob has mediatype %s", layerDescriptor.Digest, layerDescriptor.MediaType)
 		}
-		layerGzip, ok := layerBlob.Data.(io.ReadCloser)
-		if !ok {
-			// Should _never_ be reached.
-			return errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+
+		// We report the progress of extracting the layer (rather than the
+		// progress of reading the blob).
+		layerBlob, err := openLayerBlob(event.WithoutProgress(ctx), engineExt, layerDescriptor, opt.ForeignLayers)
+		if err != nil {
+			return errors.Wrap(err, "unpack manifest")
 		}
+		if layerBlob == nil {
+			// Skipped foreign layer.
+			continue
+		}
+		defer layerBlob.Close()
+		tracker := event.StartLayer(ctx, event.OpUnpack, layerDescriptor.Digest, layerDescriptor.Size)
+		progressReader := tracker.Reader(layerBlob)
 
-		// We have to extract a gzip'd version of the above layer. Also note
-		// that we have to check the DiffID we're extracting (which is the
-		// sha256 sum of the *uncompressed* layer).
-		layerRaw, err := gzip.NewReader(layerGzip)
+		// We have to extract a decompressed version of the above layer. Also
+		// note that we have to check the DiffID we're extracting (which is
+		// the sha256 sum of the *uncompressed* layer).
+		blobReader, mediaType, err := decryptLayerBlob(progressReader, layerDescriptor, layerAnnotations(opt.LayerAnnotations, idx), opt.Decryption)
 		if err != nil {
-			return errors.Wrap(err, "create gzip reader")
+			return errors.Wrap(err, "unpack manifest")
+		}
+		var layerRaw io.Reader = blobReader
+		switch mediaType {
+		case ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+			gzReader, err := gzip.NewReader(blobReader)
+			if err != nil {
+				return errors.Wrap(err, "create gzip reader")
+			}
+			layerRaw = gzReader
 		}
 		layerHash := sha256.New()
-		layer := io.TeeReader(layerRaw, layerHash)
+		var layerSize countWriter
+		layer := io.TeeReader(layerRaw, io.MultiWriter(layerHash, &layerSize))
+
+		layerRoot := rootfsPath
+		var lowerRoots []string
+		if overlay {
+			for _, dir := range overlayMeta.LowerDirs {
+				lowerRoots = append(lowerRoots, filepath.Join(bundle, dir))
+			}
+			layerDir := filepath.Join(OverlayLayersName, strconv.Itoa(idx))
+			layerRoot = filepath.Join(bundle, layerDir)
+			// Remove anything left by an interrupted extraction of the layer.
+			if err := os.RemoveAll(layerRoot); err != nil {
+				return errors.Wrap(err, "remove partial layer root")
+			}
+			if err := prepareRoot(layerRoot, mapOptions); err != nil {
+				return errors.Wrap(err, "prepare layer root")
+			}
+			overlayMeta.LowerDirs = append([]string{layerDir}, overlayMeta.LowerDirs...)
+		}
 
-		if err := UnpackLayer(rootfsPath, layer, opt); err != nil {
+		te := newTarExtractor(mapOptions)
+		te.overlay = overlay
+		te.filter = filter
+		te.xattrPolicies = opt.XattrPolicies
+		te.selinuxLabel = opt.SELinuxLabel
+		te.hardlinkMode = opt.HardlinkMode
+		te.extractPolicy = opt.ExtractPolicy
+		te.lowerRoots = lowerRoots
+		te.noSparse = opt.NoSparse
+		te.extractionMode = opt.ExtractionMode
+		if !overlay {
+			te.droppedXattrs = opt.DroppedXattrs
+		}
+		if err := unpackLayer(ctx, te, layerRoot, layer); err != nil {
 			return errors.Wrap(err, "unpack layer")
 		}
-		layerGzip.Close()
+		// Make sure we hit the end of the underlying blob, so that a fetched
+		// foreign layer (or an encrypted layer) is verified.
+		if _, err := io.Copy(ioutil.Discard, blobReader); err != nil {
+			return errors.Wrap(err, "drain layer blob")
+		}
+		layerBlob.Close()
+		tracker.Done("", nil)
 
 		layerDigest := fmt.Sprintf("%s:%x", cas.BlobAlgorithm, layerHash.Sum(nil))
 		if layerDigest != layerDiffID {
-			return errors.Errorf("unpack manifest: layer %s: diffid mismatch: got %s expected %s", layerDescriptor.Digest, layerDigest, layerDiffID)
+			return errors.Wrapf(&cas.DigestMismatchError{Expected: digest.Digest(layerDiffID), Actual: digest.Digest(layerDigest)}, "unpack manifest: layer %s: diffid", layerDescriptor.Digest)
+		}
+		event.Emit(ctx, event.Event{
+			Type:             event.LayerApplied,
+			Digest:           layerDescriptor.Digest,
+			Size:             layerDescriptor.Size,
+			UncompressedSize: int64(layerSize),
+			Duration:         time.Since(layerStart),
+			Fields: event.Fields{
+				"index":   idx,
+				"diff_id": layerDiffID,
+			},
+		})
+
+		checkpoint.Layers = idx + 1
+		if overlay {
+			checkpoint.LowerDirs = overlayMeta.LowerDirs
+		} else {
+			checkpoint.DroppedXattrs = opt.DroppedXattrs
+		}
+		if err := writeUnpackCheckpoint(bundle, checkpoint); err != nil {
+			return errors.Wrap(err, "write unpack checkpoint")
 		}
 	}
 
 	// Generate a runtime configuration file from ispec.Image.
-	log.Infof("unpack configuration: %s", configBlob.Digest)
+	event.Log(ctx).Infof("unpack configuration: %s", configBlob.Digest)
+
+	// In overlay mode the rootfs is empty, so we have to look up users in the
+	// topmost layer containing an /etc/passwd. This isn't quite how the
+	// overlay will look (/etc/group may come from a different layer) but it's
+	// the best we can do without mounting the overlay.
+	lookupRoot := rootfsPath
+	if overlay {
+		lookupRoot = ""
+		for _, dir := range overlayMeta.LowerDirs {
+			if fi, err := os.Lstat(filepath.Join(bundle, dir, "etc", "passwd")); err == nil && fi.Mode().IsRegular() {
+				lookupRoot = filepath.Join(bundle, dir)
+				break
+			}
+		}
+	}
 
 	g := rgen.New()
-	if err := iconv.MutateRuntimeSpec(g, rootfsPath, config, manifest); err != nil {
+	if err := iconv.MutateRuntimeSpec(g, lookupRoot, config, manifest); err != nil {
 		return errors.Wrap(err, "generate config.json")
 	}
+	g.SetRootPath(filepath.Base(rootfsPath))
 
 	// Add UIDMapping / GIDMapping options.
 	if len(mapOptions.UIDMappings) > 0 || len(mapOptions.GIDMappings) > 0 {
@@ -225,67 +587,40 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 	for _, m := range mapOptions.GIDMappings {
 		g.AddLinuxGIDMapping(m.HostID, m.ContainerID, m.Size)
 	}
-	if mapOptions.Rootless {
+	if mapOptions.Rootless || mapOptions.UserNamespace {
 		ToRootless(g.Spec())
 		g.AddBindMount("/etc/resolv.conf", "/etc/resolv.conf", []string{"bind", "ro"})
 	}
+	if err := iconv.ApplyRuntimeOptions(g, opt.RuntimeOptions); err != nil {
+		return errors.Wrap(err, "generate config.json")
+	}
 
 	// Save the config.json.
 	if err := g.SaveToFile(configPath, rgen.ExportOptions{}); err != nil {
 		return errors.Wrap(err, "write config.json")
 	}
-	return nil
-}
 
-// ToRootless converts a specification to a version that works with rootless
-// containers. This is done by removing options and other settings that clash
-// with unprivileged user namespaces.
-func ToRootless(spec *rspec.Spec) {
-	var namespaces []rspec.Namespace
-
-	// Remove networkns from the spec.
-	for _, ns := range spec.Linux.Namespaces {
-		switch ns.Type {
-		case rspec.NetworkNamespace, rspec.UserNamespace:
-			// Do nothing.
-		default:
-			namespaces = append(namespaces, ns)
-		}
-	}
-	// Add userns to the spec.
-	namespaces = append(namespaces, rspec.Namespace{
-		Type: rspec.UserNamespace,
-	})
-	spec.Linux.Namespaces = namespaces
-
-	// Fix up mounts.
-	var mounts []rspec.Mount
-	for _, mount := range spec.Mounts {
-		// Ignore all mounts that are under /sys.
-		if strings.HasPrefix(mount.Destination, "/sys") {
-			continue
+	if overlay {
+		fh, err := os.Create(filepath.Join(bundle, OverlayMetaName))
+		if err != nil {
+			return errors.Wrap(err, "create overlay metadata")
 		}
+		defer fh.Close()
 
-		// Remove all gid= and uid= mappings.
-		var options []string
-		for _, option := range mount.Options {
-			if !strings.HasPrefix(option, "gid=") && !strings.HasPrefix(option, "uid=") {
-				options = append(options, option)
-			}
+		if err := json.NewEncoder(fh).Encode(overlayMeta); err != nil {
+			return errors.Wrap(err, "write overlay metadata")
 		}
+	}
 
-		mount.Options = options
-		mounts = append(mounts, mount)
+	// The bundle is complete, so there is nothing left to resume.
+	if err := os.Remove(filepath.Join(bundle, UnpackCheckpointName)); err != nil {
+		return errors.Wrap(err, "remove unpack checkpoint")
 	}
-	// Add the sysfs mount as an rbind.
-	mounts = append(mounts, rspec.Mount{
-		Source:      "/sys",
-		Destination: "/sys",
-		Type:        "none",
-		Options:     []string{"rbind", "nosuid", "noexec", "nodev", "ro"},
-	})
-	spec.Mounts = mounts
+	return nil
+}
 
-	// Remove cgroup settings.
-	spec.Linux.Resources = nil
+// ToRootless converts a specification to a version that works with rootless
+// containers. It is equivalent to "oci/config/convert".ToRootless.
+func ToRootless(spec *rspec.Spec) {
+	iconv.ToRootless(spec)
 }
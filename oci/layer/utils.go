@@ -22,7 +22,9 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/openSUSE/umoci/pkg/event"
 	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/openSUSE/umoci/pkg/rootlesscontainers"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 )
@@ -37,6 +39,72 @@ type MapOptions struct {
 
 	// Rootless specifies whether any to error out if chown fails.
 	Rootless bool `json:"rootless"`
+
+	// UserNamespace specifies that UIDMappings and GIDMappings are the
+	// mappings of the user namespace umoci is running in (see pkg/userns),
+	// rather than mappings that umoci has to apply itself. Inside such a
+	// namespace container IDs are used as-is, because the kernel maps them
+	// to host IDs. The mappings are still included in the generated
+	// runtime configuration.
+	UserNamespace bool `json:"user_namespace,omitempty"`
+
+	// UserNames and GroupNames map user and group names to the (container)
+	// IDs used for layer entries which only specify their owner by name --
+	// that is, entries with a zero UID or GID but with a user or group name
+	// other than "root". Entries with names that are not in the map are
+	// unpacked with the zero ID, as before.
+	UserNames  map[string]int `json:"user_names,omitempty"`
+	GroupNames map[string]int `json:"group_names,omitempty"`
+
+	// PreferNames causes UserNames and GroupNames to be used for every layer
+	// entry with a known user or group name, even if the entry also has a
+	// non-zero ID, for layers whose symbolic ownership is authoritative.
+	PreferNames bool `json:"prefer_names,omitempty"`
+
+	// FallbackUID and FallbackGID are the (container) IDs used for layer
+	// entries with an owner that cannot be represented on the host (an ID
+	// outside of the 32-bit range). If unset, unpacking such entries fails.
+	FallbackUID *int `json:"fallback_uid,omitempty"`
+	FallbackGID *int `json:"fallback_gid,omitempty"`
+}
+
+// fileMappings returns the UID and GID mappings that have to be applied to
+// the ownership of files on the host filesystem.
+func (opt MapOptions) fileMappings() ([]rspec.IDMapping, []rspec.IDMapping) {
+	if opt.UserNamespace {
+		return nil, nil
+	}
+	return opt.UIDMappings, opt.GIDMappings
+}
+
+// maxID is the largest UID or GID that can be used on the host. (uid_t)-1 is
+// reserved by chown(2) and so cannot be used.
+const maxID int64 = 1<<32 - 2
+
+// resolveID returns the ID of the owner of a layer entry, given the numeric ID
+// and name from the tar.Header. kind ("uid" or "gid") is only used for errors.
+// If prefer is set, a known name is used even if id is non-zero.
+func resolveID(kind string, id int, name string, names map[string]int, prefer bool, fallback *int) (int, error) {
+	if prefer && name != "" {
+		if namedID, ok := names[name]; ok {
+			return namedID, nil
+		}
+	}
+	if id == 0 && name != "" && name != "root" {
+		if namedID, ok := names[name]; ok {
+			id = namedID
+		} else {
+			event.Default().Debugf("unmap header: %s for %q is not known, using %d", kind, name, id)
+		}
+	}
+	if id < 0 || int64(id) > maxID {
+		if fallback == nil {
+			return -1, errors.Errorf("%s %d is out of range", kind, id)
+		}
+		event.Default().Debugf("unmap header: %s %d is out of range, using %d", kind, id, *fallback)
+		id = *fallback
+	}
+	return id, nil
 }
 
 // mapHeader maps a tar.Header generated from the filesystem so that it
@@ -45,27 +113,116 @@ type MapOptions struct {
 // container mappings. Returns an error if it's not possible to map the given
 // UID.
 func mapHeader(hdr *tar.Header, mapOptions MapOptions) error {
+	uidMappings, gidMappings := mapOptions.fileMappings()
+
 	// If we're in rootless mode, we assume all of the files are owned by
 	// (0, 0) in the container -- since we cannot map any other users.
 	if mapOptions.Rootless {
-		hdr.Uid, _ = idtools.ToHost(0, mapOptions.UIDMappings)
-		hdr.Gid, _ = idtools.ToHost(0, mapOptions.GIDMappings)
+		hdr.Uid, _ = idtools.ToHost(0, uidMappings)
+		hdr.Gid, _ = idtools.ToHost(0, gidMappings)
 	}
 
-	newUID, err := idtools.ToContainer(hdr.Uid, mapOptions.UIDMappings)
+	newUID, err := idtools.ToContainer(hdr.Uid, uidMappings)
 	if err != nil {
 		return errors.Wrap(err, "map uid to container")
 	}
-	newGID, err := idtools.ToContainer(hdr.Gid, mapOptions.GIDMappings)
+	newGID, err := idtools.ToContainer(hdr.Gid, gidMappings)
 	if err != nil {
 		return errors.Wrap(err, "map gid to container")
 	}
 
 	hdr.Uid = newUID
 	hdr.Gid = newGID
+
+	if mapOptions.Rootless {
+		if err := restoreRootlessOwner(hdr); err != nil {
+			return errors.Wrap(err, "restore rootless owner")
+		}
+	}
 	return nil
 }
 
+// restoreRootlessOwner applies the ownership (and device information) that
+// was recorded in the user.rootlesscontainers xattr by emulateRootlessOwner
+// (or by another rootless tool) to a tar.Header generated from the
+// filesystem, and removes the xattr from the header.
+func restoreRootlessOwner(hdr *tar.Header) error {
+	value, ok := hdr.Xattrs[rootlesscontainers.Keyname]
+	if !ok {
+		return nil
+	}
+	delete(hdr.Xattrs, rootlesscontainers.Keyname)
+
+	resource, err := rootlesscontainers.Unmarshal([]byte(value))
+	if err != nil {
+		return errors.Wrapf(err, "parse %s xattr", rootlesscontainers.Keyname)
+	}
+	if resource.UID != rootlesscontainers.NoopID {
+		hdr.Uid = int(resource.UID)
+		hdr.Uname = ""
+	}
+	if resource.GID != rootlesscontainers.NoopID {
+		hdr.Gid = int(resource.GID)
+		hdr.Gname = ""
+	}
+
+	// Device nodes are unpacked as empty regular files. Hardlinks to them
+	// don't need to be changed.
+	if resource.Typeflag != 0 && hdr.Typeflag == tar.TypeReg {
+		if resource.Typeflag != tar.TypeChar && resource.Typeflag != tar.TypeBlock {
+			return errors.Errorf("invalid device typeflag '\\x%x'", resource.Typeflag)
+		}
+		if hdr.Size != 0 {
+			return errors.Errorf("emulated device node %s is not empty", hdr.Name)
+		}
+		hdr.Typeflag = resource.Typeflag
+		hdr.Devmajor = int64(resource.Devmajor)
+		hdr.Devminor = int64(resource.Devminor)
+	}
+	return nil
+}
+
+// emulateRootlessOwner records the ownership of a tar.Header from a tar layer
+// stream (and the device numbers, if it is a device node) in the
+// user.rootlesscontainers xattr of the header, because the owner of files
+// cannot be changed in rootless mode. Any existing value of the xattr in the
+// layer is replaced. If the entry is owned by (0, 0) and isn't a device node,
+// no xattr is needed. Linux doesn't permit user.* xattrs on symlinks or FIFOs,
+// so their owner cannot be recorded.
+func emulateRootlessOwner(hdr *tar.Header, mapOptions MapOptions) {
+	delete(hdr.Xattrs, rootlesscontainers.Keyname)
+	if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeFifo {
+		if hdr.Uid != 0 || hdr.Gid != 0 {
+			event.Default().Debugf("unmap header: cannot record owner of %s in rootless mode", hdr.Name)
+		}
+		return
+	}
+
+	var resource rootlesscontainers.Resource
+	if uid, err := resolveID("uid", hdr.Uid, hdr.Uname, mapOptions.UserNames, mapOptions.PreferNames, mapOptions.FallbackUID); err != nil {
+		event.Default().Debugf("unmap header: not recording owner of %s: %v", hdr.Name, err)
+	} else {
+		resource.UID = uint32(uid)
+	}
+	if gid, err := resolveID("gid", hdr.Gid, hdr.Gname, mapOptions.GroupNames, mapOptions.PreferNames, mapOptions.FallbackGID); err != nil {
+		event.Default().Debugf("unmap header: not recording group of %s: %v", hdr.Name, err)
+	} else {
+		resource.GID = uint32(gid)
+	}
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+		resource.Typeflag = hdr.Typeflag
+		resource.Devmajor = uint32(hdr.Devmajor)
+		resource.Devminor = uint32(hdr.Devminor)
+	}
+
+	if resource != (rootlesscontainers.Resource{}) {
+		if hdr.Xattrs == nil {
+			hdr.Xattrs = map[string]string{}
+		}
+		hdr.Xattrs[rootlesscontainers.Keyname] = string(resource.Marshal())
+	}
+}
+
 // unmapHeader maps a tar.Header from a tar layer stream so that it describes
 // the inode as it would be exist on the host filesystem. In particular this
 // involves applying an ID mapping from the container filesystem to the host
@@ -73,17 +230,44 @@ func mapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 func unmapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 	// If we're in rootless mode we assume that all of the files in the layer
 	// are owned by (0, 0) because we cannot map any other users in the
-	// container (and we cannot Lchown to any user other than ourselves).
+	// container (and we cannot Lchown to any user other than ourselves). The
+	// real owner is recorded in an xattr, so that it can be restored when
+	// repacking.
 	if mapOptions.Rootless {
+		emulateRootlessOwner(hdr, mapOptions)
 		hdr.Uid = 0
 		hdr.Gid = 0
+	} else {
+		// Resolve entries with uncommon ownership (names without IDs, or
+		// IDs that are out of range) before mapping, so that they aren't
+		// silently truncated.
+		uid, err := resolveID("uid", hdr.Uid, hdr.Uname, mapOptions.UserNames, mapOptions.PreferNames, mapOptions.FallbackUID)
+		if err != nil {
+			return errors.Wrap(err, "resolve owner")
+		}
+		gid, err := resolveID("gid", hdr.Gid, hdr.Gname, mapOptions.GroupNames, mapOptions.PreferNames, mapOptions.FallbackGID)
+		if err != nil {
+			return errors.Wrap(err, "resolve owner")
+		}
+		hdr.Uid = uid
+		hdr.Gid = gid
 	}
 
-	newUID, err := idtools.ToHost(hdr.Uid, mapOptions.UIDMappings)
+	// Make sure the IDs can be mapped, even if the kernel is doing the
+	// mapping for us (in which case chown would fail with EINVAL).
+	if _, err := idtools.ToHost(hdr.Uid, mapOptions.UIDMappings); err != nil {
+		return errors.Wrap(err, "map uid to host")
+	}
+	if _, err := idtools.ToHost(hdr.Gid, mapOptions.GIDMappings); err != nil {
+		return errors.Wrap(err, "map gid to host")
+	}
+
+	uidMappings, gidMappings := mapOptions.fileMappings()
+	newUID, err := idtools.ToHost(hdr.Uid, uidMappings)
 	if err != nil {
 		return errors.Wrap(err, "map uid to host")
 	}
-	newGID, err := idtools.ToHost(hdr.Gid, mapOptions.GIDMappings)
+	newGID, err := idtools.ToHost(hdr.Gid, gidMappings)
 	if err != nil {
 		return errors.Wrap(err, "map gid to host")
 	}
@@ -123,3 +307,11 @@ func CleanPath(path string) string {
 	// Clean the path again for good measure.
 	return filepath.Clean(path)
 }
+
+// countWriter is an io.Writer which counts the number of bytes written to it.
+type countWriter int64
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	*c += countWriter(len(p))
+	return len(p), nil
+}
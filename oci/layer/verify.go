@@ -0,0 +1,251 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// layerDiffID computes the DiffID (the digest of the uncompressed layer) of
+// the given layer blob, whose descriptor has the given annotations. If the
+// layer is a foreign layer which is skipped according to opt.ForeignLayers,
+// the empty digest is returned with skipped set.
+func layerDiffID(ctx context.Context, engine casext.Engine, descriptor ispec.Descriptor, annotations map[string]string, opt VerifyOptions) (_ digest.Digest, skipped bool, _ error) {
+	if IsEncryptedLayerType(descriptor.MediaType) && opt.Decryption == nil {
+		return "", false, errors.Wrapf(ErrEncryptedLayer, "layer %s", descriptor.Digest)
+	}
+	if !isLayerType(DecryptedLayerType(descriptor.MediaType)) {
+		return "", false, errors.Wrapf(ErrInvalidMediaType, "layer %s: blob has mediatype %s", descriptor.Digest, descriptor.MediaType)
+	}
+	blob, err := openLayerBlob(ctx, engine, descriptor, opt.ForeignLayers)
+	if err != nil {
+		return "", false, err
+	}
+	if blob == nil {
+		return "", true, nil
+	}
+	defer blob.Close()
+
+	reader, mediaType, err := decryptLayerBlob(blob, descriptor, annotations, opt.Decryption)
+	if err != nil {
+		return "", false, err
+	}
+	var layer io.Reader = reader
+	switch mediaType {
+	case ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+		gzReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return "", false, errors.Wrap(err, "create gzip reader")
+		}
+		defer gzReader.Close()
+		layer = gzReader
+	}
+
+	digester := cas.BlobAlgorithm.Digester()
+	if _, err := io.Copy(digester.Hash(), layer); err != nil {
+		return "", false, errors.Wrap(err, "hash layer")
+	}
+	// Make sure we hit the end of the underlying blob.
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		return "", false, errors.Wrap(err, "drain layer blob")
+	}
+	return digester.Digest(), false, nil
+}
+
+// VerifyOptions modifies the behaviour of VerifyDiffIDsWithOptions.
+type VerifyOptions struct {
+	// Jobs is the number of layers which are decompressed and hashed in
+	// parallel. If it is less than one, runtime.NumCPU() is used.
+	Jobs int
+
+	// ForeignLayers specifies how foreign layers whose blobs are not present
+	// in the image are handled. Skipped layers are not verified. The default
+	// is ForeignLayerError.
+	ForeignLayers ForeignLayerPolicy
+
+	// Decryption contains the keys used to decrypt encrypted layers, whose
+	// descriptor annotations must be given in LayerAnnotations (see
+	// UnpackOptions). If nil, ErrEncryptedLayer is returned for encrypted
+	// layers.
+	Decryption *DecryptConfig
+
+	// LayerAnnotations are the annotations of the layer descriptors of the
+	// manifest (see casext.ManifestLayerAnnotations).
+	LayerAnnotations []map[string]string
+}
+
+// VerifyDiffIDs checks that the layers of the given manifest match the
+// rootfs.diff_ids of the manifest's configuration, both in number and in
+// order. Every layer has to be decompressed in order to compute its DiffID,
+// so this is about as expensive as reading the entire image. It is intended
+// to be used before UnpackManifest, in order to catch images whose layers were
+// reordered (by a misbehaving build tool) before a broken rootfs is produced.
+func VerifyDiffIDs(ctx context.Context, engine cas.Engine, manifest ispec.Manifest) error {
+	return VerifyDiffIDsWithOptions(ctx, engine, manifest, VerifyOptions{})
+}
+
+// VerifyDiffIDsWithOptions is equivalent to VerifyDiffIDs, except that it
+// allows the caller to configure how many layers are hashed in parallel.
+// Errors are reported for the lowest-indexed bad layer, regardless of the
+// order in which the layers were hashed.
+func VerifyDiffIDsWithOptions(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, opt VerifyOptions) error {
+	engineExt := casext.Engine{engine}
+	ctx, err := casext.WithManifestLayerChunks(ctx, manifest)
+	if err != nil {
+		return errors.Wrap(err, "verify diffids: get chunked layers")
+	}
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return errors.Wrap(err, "get config blob")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return errors.Wrapf(ErrInvalidMediaType, "verify diffids: config blob has mediatype %s (expected %s)", configBlob.MediaType, ispec.MediaTypeImageConfig)
+	}
+
+	if len(manifest.Layers) != len(config.RootFS.DiffIDs) {
+		return errors.Errorf("verify diffids: manifest has %d layers but config has %d diff_ids", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	if err := opt.ForeignLayers.Validate(); err != nil {
+		return errors.Wrap(err, "verify diffids")
+	}
+
+	jobs := opt.Jobs
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+	if jobs > len(manifest.Layers) {
+		jobs = len(manifest.Layers)
+	}
+
+	start := time.Now()
+	results := make([]layerDiffIDResult, len(manifest.Layers))
+
+	// Once a layer has failed there's no point hashing the rest, but layers
+	// which are already being hashed are left to finish. As with errgroup,
+	// the first error is recorded so that it can be returned instead of the
+	// cancellation error of the layers which were never hashed.
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		errOnce  sync.Once
+		firstErr error
+	)
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indices {
+				diffID, skipped, err := layerDiffID(workerCtx, engineExt, manifest.Layers[idx], layerAnnotations(opt.LayerAnnotations, idx), opt)
+				results[idx] = layerDiffIDResult{diffID: diffID, skipped: skipped, err: err}
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = errors.Wrapf(err, "compute diffid of layer %d", idx)
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+feed:
+	for idx := range manifest.Layers {
+		select {
+		case indices <- idx:
+		case <-workerCtx.Done():
+			break feed
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	diffIDs := map[string]int{}
+	for idx, diffID := range config.RootFS.DiffIDs {
+		diffIDs[diffID] = idx
+	}
+
+	var size int64
+	for idx, layerDescriptor := range manifest.Layers {
+		result := results[idx]
+		if result.err != nil {
+			if errors.Cause(result.err) == context.Canceled && ctx.Err() == nil {
+				// The layer was interrupted because another layer failed.
+				return firstErr
+			}
+			return errors.Wrapf(result.err, "compute diffid of layer %d", idx)
+		}
+		if result.skipped {
+			continue
+		}
+		if result.diffID == "" {
+			// The layer was never hashed, either because another layer
+			// failed or because ctx was cancelled by the caller.
+			if firstErr != nil {
+				return firstErr
+			}
+			return errors.Wrapf(ctx.Err(), "compute diffid of layer %d", idx)
+		}
+		diffID := result.diffID
+		size += layerDescriptor.Size
+		event.Log(ctx).WithFields(event.Fields{
+			"layer":  layerDescriptor.Digest,
+			"diffid": diffID,
+		}).Debugf("verify diffids: computed diffid")
+
+		if diffID.String() == config.RootFS.DiffIDs[idx] {
+			continue
+		}
+		if other, ok := diffIDs[diffID.String()]; ok {
+			return errors.Errorf("verify diffids: layer %d (%s) matches diff_ids[%d]: layers are out of order", idx, layerDescriptor.Digest, other)
+		}
+		return errors.Wrapf(&cas.DigestMismatchError{Expected: digest.Digest(config.RootFS.DiffIDs[idx]), Actual: diffID}, "verify diffids: layer %d (%s): diffid", idx, layerDescriptor.Digest)
+	}
+
+	elapsed := time.Since(start)
+	event.Log(ctx).WithFields(event.Fields{
+		"layers": len(manifest.Layers),
+		"jobs":   jobs,
+	}).Infof("verify diffids: hashed %s in %s (%s/s)", units.HumanSize(float64(size)), elapsed, units.HumanSize(float64(size)/elapsed.Seconds()))
+	return nil
+}
+
+// layerDiffIDResult is the result of computing the DiffID of a layer.
+type layerDiffIDResult struct {
+	diffID  digest.Digest
+	skipped bool
+	err     error
+}
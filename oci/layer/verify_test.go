@@ -0,0 +1,235 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// putTestLayer adds a gzip'd layer containing a single file to the engine,
+// returning its descriptor and DiffID.
+func putTestLayer(t *testing.T, engine cas.Engine, name string) (ispec.Descriptor, string) {
+	var raw bytes.Buffer
+	tw := tar.NewWriter(&raw)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	diffID := cas.BlobAlgorithm.FromBytes(raw.Bytes())
+
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	if _, err := gzw.Write(raw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, size, err := engine.PutBlob(context.Background(), &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    digest,
+		Size:      size,
+	}, diffID.String()
+}
+
+func TestVerifyDiffIDs(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+
+	layerA, diffIDA := putTestLayer(t, engine, "a")
+	layerB, diffIDB := putTestLayer(t, engine, "b")
+	layerEncrypted := layerA
+	layerEncrypted.MediaType = MediaTypeImageLayerGzipEncrypted
+
+	for _, test := range []struct {
+		name    string
+		layers  []ispec.Descriptor
+		diffIDs []string
+		err     string
+	}{
+		{"Valid", []ispec.Descriptor{layerA, layerB}, []string{diffIDA, diffIDB}, ""},
+		{"OutOfOrder", []ispec.Descriptor{layerB, layerA}, []string{diffIDA, diffIDB}, "out of order"},
+		{"TooFewDiffIDs", []ispec.Descriptor{layerA, layerB}, []string{diffIDA}, "diff_ids"},
+		{"Mismatch", []ispec.Descriptor{layerA}, []string{diffIDB[:len(diffIDB)-1] + "0"}, "mismatch"},
+		{"Encrypted", []ispec.Descriptor{layerEncrypted}, []string{diffIDA}, "layer is encrypted"},
+	} {
+		config := ispec.Image{
+			RootFS: ispec.RootFS{
+				Type:    "layers",
+				DiffIDs: test.diffIDs,
+			},
+		}
+		configDigest, configSize, err := engine.PutBlobJSON(ctx, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest := ispec.Manifest{
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+			Layers: test.layers,
+		}
+
+		for _, jobs := range []int{0, 1, 4} {
+			err = VerifyDiffIDsWithOptions(ctx, engine, manifest, VerifyOptions{Jobs: jobs})
+			if test.err == "" && err != nil {
+				t.Errorf("%s (jobs=%d): unexpected error: %s", test.name, jobs, err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("%s (jobs=%d): expected error containing %q, got %v", test.name, jobs, test.err, err)
+			}
+			if test.name == "Mismatch" && !errors.Is(err, cas.ErrDigestMismatch) {
+				t.Errorf("%s (jobs=%d): expected cas.ErrDigestMismatch, got %v", test.name, jobs, err)
+			}
+		}
+	}
+}
+
+func TestVerifyDiffIDsParallel(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+
+	var (
+		layers  []ispec.Descriptor
+		diffIDs []string
+	)
+	for i := 0; i < 16; i++ {
+		layer, diffID := putTestLayer(t, engine, fmt.Sprintf("file%d", i))
+		layers = append(layers, layer)
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	// Break two of the layers. The error must always be for the first one,
+	// no matter which layer was hashed first.
+	badDiffIDs := append([]string{}, diffIDs...)
+	badDiffIDs[5], badDiffIDs[11] = diffIDs[11], diffIDs[5]
+
+	for _, test := range []struct {
+		name    string
+		diffIDs []string
+		err     string
+	}{
+		{"Valid", diffIDs, ""},
+		{"Invalid", badDiffIDs, "layer 5 "},
+	} {
+		configDigest, configSize, err := engine.PutBlobJSON(ctx, ispec.Image{
+			RootFS: ispec.RootFS{
+				Type:    "layers",
+				DiffIDs: test.diffIDs,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest := ispec.Manifest{
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+			Layers: layers,
+		}
+
+		for _, jobs := range []int{1, 3, 16, 64} {
+			err := VerifyDiffIDsWithOptions(ctx, engine, manifest, VerifyOptions{Jobs: jobs})
+			if test.err == "" && err != nil {
+				t.Errorf("%s (jobs=%d): unexpected error: %s", test.name, jobs, err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("%s (jobs=%d): expected error containing %q, got %v", test.name, jobs, test.err, err)
+			}
+		}
+	}
+}
+
+// blockingEngine is a cas.Engine in which reading the blob with the given
+// digest blocks until the context is cancelled.
+type blockingEngine struct {
+	cas.Engine
+	blocked digest.Digest
+}
+
+func (e blockingEngine) GetBlob(ctx context.Context, blob digest.Digest) (io.ReadCloser, error) {
+	if blob == e.blocked {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return e.Engine.GetBlob(ctx, blob)
+}
+
+func TestVerifyDiffIDsFirstError(t *testing.T) {
+	ctx := context.Background()
+	engine := mem.New()
+	defer engine.Close()
+
+	layerA, diffIDA := putTestLayer(t, engine, "a")
+	layerB, diffIDB := putTestLayer(t, engine, "b")
+	layerB.MediaType = MediaTypeImageLayerGzipEncrypted
+
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, ispec.Image{
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []string{diffIDA, diffIDB},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{layerA, layerB},
+	}
+
+	// Layer 0 is only interrupted by the failure of layer 1, so the error of
+	// layer 1 must be returned rather than the cancellation of layer 0.
+	err = VerifyDiffIDsWithOptions(ctx, blockingEngine{engine, layerA.Digest}, manifest, VerifyOptions{Jobs: 2})
+	if errors.Cause(err) != ErrEncryptedLayer {
+		t.Errorf("expected ErrEncryptedLayer, got %v", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "layer 1") {
+		t.Errorf("expected error for layer 1, got %v", err)
+	}
+}
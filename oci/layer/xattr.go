@@ -0,0 +1,243 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+
+	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/pkg/errors"
+)
+
+// XattrPolicy specifies how one of the security xattrs is handled when
+// unpacking and repacking layers.
+type XattrPolicy string
+
+const (
+	// XattrPreserve copies the xattr unmodified between the layer and the
+	// filesystem.
+	XattrPreserve XattrPolicy = "preserve"
+
+	// XattrStrip drops the xattr.
+	XattrStrip XattrPolicy = "strip"
+
+	// XattrRemap translates the xattr between the container and the host
+	// using the UID mappings. This is only supported for security.capability,
+	// where the owner of the user namespace in which namespaced (version 3)
+	// file capabilities apply is mapped. Capabilities which apply to the
+	// container's root user are stored in the layer as version 2 (non-namespaced)
+	// capabilities.
+	XattrRemap XattrPolicy = "remap"
+)
+
+// The security xattrs which can be given a policy.
+const (
+	xattrSELinux    = "security.selinux"
+	xattrIMA        = "security.ima"
+	xattrCapability = "security.capability"
+)
+
+// XattrPolicies maps the names of the security xattrs (security.selinux,
+// security.ima and security.capability) to how they are handled. Xattrs
+// without a policy are preserved, except that security.selinux is stripped
+// when repacking (because SELinux labels are specific to the host).
+type XattrPolicies map[string]XattrPolicy
+
+// Validate returns an error if any of the policies are unknown, or are not
+// supported by the xattr they are given for.
+func (p XattrPolicies) Validate() error {
+	for name, policy := range p {
+		switch name {
+		case xattrSELinux, xattrIMA, xattrCapability:
+		default:
+			return errors.Errorf("cannot set policy of xattr %s: only %s, %s and %s are supported", name, xattrSELinux, xattrIMA, xattrCapability)
+		}
+		switch policy {
+		case XattrPreserve, XattrStrip:
+		case XattrRemap:
+			if name != xattrCapability {
+				return errors.Errorf("xattr %s cannot be remapped", name)
+			}
+		default:
+			return errors.Errorf("unknown policy %q for xattr %s", policy, name)
+		}
+	}
+	return nil
+}
+
+// String returns the policies in the form accepted by ParseXattrPolicy,
+// sorted by name.
+func (p XattrPolicies) String() string {
+	var policies []string
+	for name, policy := range p {
+		policies = append(policies, name+"="+string(policy))
+	}
+	sort.Strings(policies)
+	return strings.Join(policies, ",")
+}
+
+// ParseXattrPolicy parses a policy of the form "<name>=<policy>" (such as
+// "security.capability=remap") and adds it to the policies.
+func (p XattrPolicies) ParseXattrPolicy(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return errors.Errorf("invalid xattr policy %q: must be of the form <name>=<policy>", value)
+	}
+	policies := XattrPolicies{parts[0]: XattrPolicy(parts[1])}
+	if err := policies.Validate(); err != nil {
+		return err
+	}
+	p[parts[0]] = XattrPolicy(parts[1])
+	return nil
+}
+
+// policy returns the policy for the given xattr when unpacking or repacking.
+func (p XattrPolicies) policy(name string, repack bool) XattrPolicy {
+	if policy, ok := p[name]; ok {
+		return policy
+	}
+	if repack && name == xattrSELinux {
+		return XattrStrip
+	}
+	return XattrPreserve
+}
+
+// apply returns the given xattrs of an entry after applying the policies.
+// mapRootID is used to translate the root ID of file capabilities.
+func (p XattrPolicies) apply(xattrs map[string]string, repack bool, mapRootID func(int) (int, error)) (map[string]string, error) {
+	newXattrs := map[string]string{}
+	for name, value := range xattrs {
+		switch p.policy(name, repack) {
+		case XattrStrip:
+			continue
+		case XattrRemap:
+			newValue, err := remapCapability([]byte(value), mapRootID)
+			if err != nil {
+				return nil, errors.Wrapf(err, "remap %s", name)
+			}
+			value = string(newValue)
+		}
+		newXattrs[name] = value
+	}
+	return newXattrs, nil
+}
+
+// DroppedXattrs is the set of xattrs which could not be set when unpacking
+// layers in rootless mode (such as security.capability and trusted.* xattrs,
+// which require privileges to set), keyed by the path of the entry in the
+// rootfs (such as "/usr/bin/ping") and then by the name of the xattr. Giving
+// them to GenerateLayer (see RepackOptions.DroppedXattrs) re-injects them into
+// the entries generated for those paths, so that repacking a rootless bundle
+// doesn't silently drop them (producing, for instance, a ping binary without
+// CAP_NET_RAW). The values are those which would have been set on the
+// filesystem (that is, after any XattrPolicies were applied).
+type DroppedXattrs map[string]map[string]string
+
+// remove forgets the dropped xattrs of the given path (and, if recursive is
+// set, of every path inside it), because it has been replaced or removed.
+func (d DroppedXattrs) remove(key string, recursive bool) {
+	delete(d, key)
+	if !recursive {
+		return
+	}
+	for path := range d {
+		if strings.HasPrefix(path, key+"/") {
+			delete(d, path)
+		}
+	}
+}
+
+// inject adds the dropped xattrs of the given path to xattrs, unless the
+// xattr is already set.
+func (d DroppedXattrs) inject(key string, xattrs map[string]string) {
+	for name, value := range d[key] {
+		if _, ok := xattrs[name]; !ok {
+			xattrs[name] = value
+		}
+	}
+}
+
+// Layout of the security.capability xattr (struct vfs_ns_cap_data).
+const (
+	vfsCapRevisionMask = 0xff000000
+	vfsCapRevision2    = 0x02000000
+	vfsCapRevision3    = 0x03000000
+	vfsCapSize2        = 20
+	vfsCapSize3        = 24
+)
+
+// remapCapability translates the root ID of a security.capability xattr with
+// mapRootID. Version 2 capabilities are treated as having a root ID of 0, and
+// if the translated root ID is 0 then version 2 capabilities are returned
+// (otherwise version 3 capabilities are returned). Version 1 capabilities are
+// returned unchanged.
+func remapCapability(value []byte, mapRootID func(int) (int, error)) ([]byte, error) {
+	if len(value) < 4 {
+		return nil, errors.Errorf("capabilities are too short (%d bytes)", len(value))
+	}
+	magic := binary.LittleEndian.Uint32(value)
+
+	rootID := 0
+	switch magic & vfsCapRevisionMask {
+	case vfsCapRevision2:
+		if len(value) != vfsCapSize2 {
+			return nil, errors.Errorf("version 2 capabilities have invalid size %d", len(value))
+		}
+	case vfsCapRevision3:
+		if len(value) != vfsCapSize3 {
+			return nil, errors.Errorf("version 3 capabilities have invalid size %d", len(value))
+		}
+		rootID = int(binary.LittleEndian.Uint32(value[vfsCapSize2:]))
+	default:
+		return value, nil
+	}
+
+	newRootID, err := mapRootID(rootID)
+	if err != nil {
+		return nil, errors.Wrap(err, "map capabilities root id")
+	}
+
+	flags := magic &^ vfsCapRevisionMask
+	newValue := make([]byte, vfsCapSize3)
+	copy(newValue, value[:vfsCapSize2])
+	if newRootID == 0 {
+		binary.LittleEndian.PutUint32(newValue, vfsCapRevision2|flags)
+		return newValue[:vfsCapSize2], nil
+	}
+	binary.LittleEndian.PutUint32(newValue, vfsCapRevision3|flags)
+	binary.LittleEndian.PutUint32(newValue[vfsCapSize2:], uint32(newRootID))
+	return newValue, nil
+}
+
+// rootIDToHost and rootIDToContainer translate capability root IDs with the
+// UID mappings applied to files by the given MapOptions.
+func rootIDToHost(mapOptions MapOptions) func(int) (int, error) {
+	uidMappings, _ := mapOptions.fileMappings()
+	return func(id int) (int, error) {
+		return idtools.ToHost(id, uidMappings)
+	}
+}
+
+func rootIDToContainer(mapOptions MapOptions) func(int) (int, error) {
+	uidMappings, _ := mapOptions.fileMappings()
+	return func(id int) (int, error) {
+		return idtools.ToContainer(id, uidMappings)
+	}
+}
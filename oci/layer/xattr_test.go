@@ -0,0 +1,238 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/context"
+)
+
+// capability returns a security.capability value with the given revision
+// and root ID (which is only included for version 3 capabilities).
+func capability(revision uint32, rootID uint32) []byte {
+	value := make([]byte, vfsCapSize3)
+	binary.LittleEndian.PutUint32(value, revision|0x1)
+	binary.LittleEndian.PutUint32(value[4:], 0x400) // CAP_NET_BIND_SERVICE
+	if revision == vfsCapRevision2 {
+		return value[:vfsCapSize2]
+	}
+	binary.LittleEndian.PutUint32(value[vfsCapSize2:], rootID)
+	return value
+}
+
+func TestRemapCapability(t *testing.T) {
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.IDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+		GIDMappings: []rspec.IDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+	}
+
+	for _, test := range []struct {
+		name     string
+		value    []byte
+		toHost   []byte
+		hostBack []byte
+	}{
+		{"v2", capability(vfsCapRevision2, 0), capability(vfsCapRevision3, 100000), capability(vfsCapRevision2, 0)},
+		{"v3Root", capability(vfsCapRevision3, 0), capability(vfsCapRevision3, 100000), capability(vfsCapRevision2, 0)},
+		{"v3User", capability(vfsCapRevision3, 1000), capability(vfsCapRevision3, 101000), capability(vfsCapRevision3, 1000)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := remapCapability(test.value, rootIDToHost(mapOptions))
+			if err != nil {
+				t.Fatalf("unexpected error remapping to host: %s", err)
+			}
+			if !bytes.Equal(got, test.toHost) {
+				t.Errorf("remapping to host: got %x expected %x", got, test.toHost)
+			}
+			got, err = remapCapability(got, rootIDToContainer(mapOptions))
+			if err != nil {
+				t.Fatalf("unexpected error remapping to container: %s", err)
+			}
+			if !bytes.Equal(got, test.hostBack) {
+				t.Errorf("remapping to container: got %x expected %x", got, test.hostBack)
+			}
+		})
+	}
+
+	// Root IDs outside of the mapping cannot be remapped.
+	if _, err := remapCapability(capability(vfsCapRevision3, 5), rootIDToContainer(mapOptions)); err == nil {
+		t.Errorf("expected error remapping unmapped root id")
+	}
+	// Nor can truncated capabilities.
+	if _, err := remapCapability(capability(vfsCapRevision3, 0)[:22], rootIDToHost(mapOptions)); err == nil {
+		t.Errorf("expected error remapping truncated capabilities")
+	}
+}
+
+func TestXattrPoliciesParse(t *testing.T) {
+	policies := XattrPolicies{}
+	for _, value := range []string{
+		"security.selinux=preserve",
+		"security.ima=strip",
+		"security.capability=remap",
+	} {
+		if err := policies.ParseXattrPolicy(value); err != nil {
+			t.Errorf("unexpected error parsing %q: %s", value, err)
+		}
+	}
+	if got, expected := policies.String(), "security.capability=remap,security.ima=strip,security.selinux=preserve"; got != expected {
+		t.Errorf("unexpected policies: got %q expected %q", got, expected)
+	}
+
+	for _, value := range []string{
+		"security.selinux",
+		"user.foo=strip",
+		"security.ima=remap",
+		"security.capability=drop",
+	} {
+		if err := policies.ParseXattrPolicy(value); err == nil {
+			t.Errorf("expected error parsing %q", value)
+		}
+	}
+}
+
+func TestXattrPoliciesApply(t *testing.T) {
+	xattrs := map[string]string{
+		"user.foo":         "bar",
+		"security.selinux": "system_u:object_r:bin_t:s0",
+		"security.ima":     "\x03\x02",
+	}
+	identity := func(id int) (int, error) { return id, nil }
+
+	// The default policies only strip security.selinux when repacking.
+	got, err := XattrPolicies(nil).apply(xattrs, false, identity)
+	if err != nil {
+		t.Fatalf("unexpected error applying policies: %s", err)
+	}
+	if !reflect.DeepEqual(got, xattrs) {
+		t.Errorf("unpack modified xattrs with default policies: %v", got)
+	}
+	got, err = XattrPolicies(nil).apply(xattrs, true, identity)
+	if err != nil {
+		t.Fatalf("unexpected error applying policies: %s", err)
+	}
+	if _, ok := got["security.selinux"]; ok || len(got) != 2 {
+		t.Errorf("repack did not strip security.selinux with default policies: %v", got)
+	}
+
+	policies := XattrPolicies{
+		xattrSELinux: XattrPreserve,
+		xattrIMA:     XattrStrip,
+	}
+	got, err = policies.apply(xattrs, true, identity)
+	if err != nil {
+		t.Fatalf("unexpected error applying policies: %s", err)
+	}
+	expected := map[string]string{
+		"user.foo":         "bar",
+		"security.selinux": "system_u:object_r:bin_t:s0",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected xattrs: got %v expected %v", got, expected)
+	}
+}
+
+func TestDroppedXattrs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestDroppedXattrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	value := string(capability(vfsCapRevision2, 0))
+	dropped := DroppedXattrs{
+		"/bin":       {"user.dir": "dir"},
+		"/bin/ping":  {xattrCapability: value},
+		"/bin/ls":    {"user.ls": "ls"},
+		"/binary":    {"user.binary": "binary"},
+		"/etc":       {"user.etc": "etc"},
+		"/etc/hosts": {"user.hosts": "hosts"},
+	}
+
+	// Paths which are replaced or removed by a later layer lose their
+	// dropped xattrs.
+	te := newTarExtractor(MapOptions{Rootless: os.Geteuid() != 0})
+	te.droppedXattrs = dropped
+	layer := testHardlinkLayer(t,
+		&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "bin/ping", Typeflag: tar.TypeReg, Mode: 0755},
+		&tar.Header{Name: "bin/ls", Typeflag: tar.TypeReg, Mode: 0755},
+		&tar.Header{Name: "binary", Typeflag: tar.TypeReg, Mode: 0644},
+		&tar.Header{Name: whPrefix + "etc", Typeflag: tar.TypeReg, Mode: 0644},
+	)
+	if err := unpackLayer(context.Background(), te, dir, layer); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+	if len(dropped) != 0 {
+		t.Errorf("expected replaced paths to be forgotten: got %v", dropped)
+	}
+
+	// The dropped xattrs are re-added when generating the layer, unless
+	// the file has the xattr set.
+	dropped["/bin/ping"] = map[string]string{xattrCapability: value}
+	dropped["/bin/ls"] = map[string]string{"user.ls": "dropped"}
+	if err := te.fsEval.Lsetxattr(filepath.Join(dir, "bin/ls"), "user.ls", []byte("ls"), 0); err != nil {
+		t.Skipf("user xattrs are not supported: %v", err)
+	}
+
+	var buffer bytes.Buffer
+	tg := newTarGenerator(&buffer, te.mapOptions)
+	tg.droppedXattrs = dropped
+	for _, name := range []string{"bin", "bin/ping", "bin/ls", "binary"} {
+		if err := tg.AddFile(name, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("unexpected error adding %s: %+v", name, err)
+		}
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]map[string]string{
+		"bin/":     {},
+		"bin/ping": {xattrCapability: value},
+		"bin/ls":   {"user.ls": "ls"},
+		"binary":   {},
+	}
+	tr := tar.NewReader(&buffer)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		xattrs := map[string]string{}
+		for name, value := range hdr.Xattrs {
+			xattrs[name] = value
+		}
+		if !reflect.DeepEqual(xattrs, expected[hdr.Name]) {
+			t.Errorf("unexpected xattrs for %s: expected %v, got %v", hdr.Name, expected[hdr.Name], xattrs)
+		}
+		delete(expected, hdr.Name)
+	}
+	if len(expected) != 0 {
+		t.Errorf("missing entries in generated layer: %v", expected)
+	}
+}
@@ -0,0 +1,384 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package registry serves an OCI image as a read-only registry, implementing
+// the pull subset of the OCI distribution-spec (manifests by tag or digest,
+// blobs with range requests and the tag list) so that container runtimes can
+// pull directly from an image managed by umoci. The image is served as a
+// single repository, and nothing can be pushed to it. Referrers are available
+// through the referrers tag schema (see casext.ReferrersTag). No
+// authentication is done, so the handler should only be exposed to trusted
+// clients.
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+var (
+	// nameRegexp matches valid repository names, as defined by the
+	// distribution-spec.
+	nameRegexp = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+
+	// tagRegexp matches valid tags, as defined by the distribution-spec.
+	// References which are not valid tags cannot be pulled, so they are not
+	// listed.
+	tagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+)
+
+// Error codes defined by the distribution-spec.
+const (
+	codeBlobUnknown     = "BLOB_UNKNOWN"
+	codeDigestInvalid   = "DIGEST_INVALID"
+	codeManifestInvalid = "MANIFEST_INVALID"
+	codeManifestUnknown = "MANIFEST_UNKNOWN"
+	codeNameInvalid     = "NAME_INVALID"
+	codeNameUnknown     = "NAME_UNKNOWN"
+	codeUnsupported     = "UNSUPPORTED"
+
+	// codeUnknown is used for internal errors, which the distribution-spec
+	// doesn't define a code for.
+	codeUnknown = "UNKNOWN"
+)
+
+// apiError is a single error returned by the registry.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidateName returns an error if name is not a valid repository name.
+func ValidateName(name string) error {
+	if !nameRegexp.MatchString(name) {
+		return errors.Errorf("invalid repository name: %q", name)
+	}
+	return nil
+}
+
+// handler is the http.Handler returned by NewHandler.
+type handler struct {
+	engine casext.Engine
+	name   string
+}
+
+// NewHandler returns an http.Handler which serves the image opened by engine
+// as a read-only registry, in the repository with the given name. Requests for
+// other repositories fail with NAME_UNKNOWN. The contents of blobs are not
+// verified (other than manifests), as clients verify the blobs they pull.
+func NewHandler(engine casext.Engine, name string) (http.Handler, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	return &handler{
+		engine: engine,
+		name:   name,
+	}, nil
+}
+
+// writeError writes an error response with the given status and code.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Errors []apiError `json:"errors"`
+	}{
+		Errors: []apiError{{Code: code, Message: message}},
+	})
+}
+
+// writeJSON writes a successful JSON response.
+func writeJSON(w http.ResponseWriter, r *http.Request, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeUnknown, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.WithFields(log.Fields{
+		"method": r.Method,
+		"path":   r.URL.Path,
+	}).Debugf("registry: handling request")
+
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, codeUnsupported, "registry is read-only")
+		return
+	}
+
+	path := r.URL.Path
+	switch {
+	case path == "/v2" || path == "/v2/":
+		writeJSON(w, r, struct{}{})
+		return
+	case path == "/v2/_catalog":
+		h.serveCatalog(w, r)
+		return
+	case !strings.HasPrefix(path, "/v2/"):
+		writeError(w, http.StatusNotFound, codeUnsupported, "unknown endpoint")
+		return
+	}
+	path = strings.TrimPrefix(path, "/v2/")
+
+	// Repository names may contain '/', so the endpoint is found from the
+	// end of the path.
+	var name, endpoint, arg string
+	if strings.HasSuffix(path, "/tags/list") {
+		name, endpoint = strings.TrimSuffix(path, "/tags/list"), "tags"
+	} else {
+		for _, candidate := range []string{"manifests", "blobs"} {
+			sep := strings.LastIndex(path, "/"+candidate+"/")
+			if sep == -1 {
+				continue
+			}
+			name, endpoint = path[:sep], candidate
+			arg = path[sep+len(candidate)+2:]
+			break
+		}
+	}
+	if endpoint == "" || (endpoint != "tags" && (arg == "" || strings.Contains(arg, "/"))) {
+		writeError(w, http.StatusNotFound, codeUnsupported, "unknown endpoint")
+		return
+	}
+	if ValidateName(name) != nil {
+		writeError(w, http.StatusNotFound, codeNameInvalid, fmt.Sprintf("invalid repository name: %s", name))
+		return
+	}
+	if name != h.name {
+		writeError(w, http.StatusNotFound, codeNameUnknown, fmt.Sprintf("unknown repository: %s", name))
+		return
+	}
+
+	switch endpoint {
+	case "tags":
+		h.serveTags(w, r)
+	case "manifests":
+		h.serveManifest(w, r, arg)
+	case "blobs":
+		h.serveBlob(w, r, arg)
+	}
+}
+
+// serveCatalog serves the list of repositories, which is only the repository
+// of the image.
+func (h *handler) serveCatalog(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, struct {
+		Repositories []string `json:"repositories"`
+	}{
+		Repositories: []string{h.name},
+	})
+}
+
+// tags returns the sorted list of references in the image which are valid
+// tags.
+func (h *handler) tags(r *http.Request) ([]string, error) {
+	names, err := h.engine.ListReferences(r.Context())
+	if err != nil {
+		return nil, errors.Wrap(err, "list references")
+	}
+	tags := []string{}
+	for _, name := range names {
+		if tagRegexp.MatchString(name) {
+			tags = append(tags, name)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// serveTags serves the list of tags, paginated with the "n" and "last" query
+// parameters.
+func (h *handler) serveTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := h.tags(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeUnknown, err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	if last := query.Get("last"); last != "" {
+		idx := sort.SearchStrings(tags, last)
+		if idx < len(tags) && tags[idx] == last {
+			idx++
+		}
+		tags = tags[idx:]
+	}
+	if value := query.Get("n"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, codeUnsupported, fmt.Sprintf("invalid n: %s", value))
+			return
+		}
+		if n < len(tags) {
+			tags = tags[:n]
+			if n > 0 {
+				next := url.Values{}
+				next.Set("n", value)
+				next.Set("last", tags[n-1])
+				w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?%s>; rel="next"`, h.name, next.Encode()))
+			}
+		}
+	}
+
+	writeJSON(w, r, struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{
+		Name: h.name,
+		Tags: tags,
+	})
+}
+
+// manifestMediaType returns the media type of a manifest blob which was
+// requested by digest (and so has no descriptor), from its mediaType field or
+// (if it doesn't have one) from its structure. An error is returned if the
+// blob isn't a manifest.
+func manifestMediaType(raw []byte) (string, error) {
+	var manifest struct {
+		MediaType string          `json:"mediaType"`
+		Config    json.RawMessage `json:"config"`
+		Layers    json.RawMessage `json:"layers"`
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return "", errors.Wrap(err, "parse manifest")
+	}
+	switch {
+	case manifest.MediaType != "":
+		return manifest.MediaType, nil
+	case manifest.Manifests != nil:
+		return ispec.MediaTypeImageManifestList, nil
+	case manifest.Config != nil && manifest.Layers != nil:
+		return ispec.MediaTypeImageManifest, nil
+	}
+	return "", errors.Errorf("blob is not a manifest")
+}
+
+// readManifest reads the manifest blob with the given descriptor, verifying
+// its contents. Manifests larger than the maximum metadata size of the engine
+// are not served (see casext.NewLimitingEngine).
+func (h *handler) readManifest(r *http.Request, descriptor ispec.Descriptor) ([]byte, error) {
+	manifestDigest := descriptor.Digest
+	raw, err := h.engine.ReadMetadataBlob(r.Context(), descriptor)
+	if err != nil {
+		return nil, errors.Wrap(err, "read manifest")
+	}
+	if manifestDigest.Algorithm().FromBytes(raw) != manifestDigest {
+		return nil, errors.Wrapf(cas.ErrDigestMismatch, "manifest %s", manifestDigest)
+	}
+	return raw, nil
+}
+
+// serveManifest serves the manifest with the given reference, which is
+// either a tag or a digest.
+func (h *handler) serveManifest(w http.ResponseWriter, r *http.Request, reference string) {
+	var descriptor ispec.Descriptor
+	if strings.Contains(reference, ":") {
+		manifestDigest, err := digest.Parse(reference)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeDigestInvalid, fmt.Sprintf("invalid digest: %s", reference))
+			return
+		}
+		descriptor.Digest = manifestDigest
+	} else {
+		var err error
+		descriptor, err = h.engine.GetReference(r.Context(), reference)
+		if os.IsNotExist(errors.Cause(err)) {
+			writeError(w, http.StatusNotFound, codeManifestUnknown, fmt.Sprintf("unknown tag: %s", reference))
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeUnknown, err.Error())
+			return
+		}
+	}
+	manifestDigest, mediaType := descriptor.Digest, descriptor.MediaType
+
+	raw, err := h.readManifest(r, descriptor)
+	if os.IsNotExist(errors.Cause(err)) {
+		writeError(w, http.StatusNotFound, codeManifestUnknown, fmt.Sprintf("unknown manifest: %s", manifestDigest))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeManifestInvalid, err.Error())
+		return
+	}
+	if mediaType == "" {
+		mediaType, err = manifestMediaType(raw)
+		if err != nil {
+			writeError(w, http.StatusNotFound, codeManifestUnknown, fmt.Sprintf("unknown manifest: %s: %v", manifestDigest, err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", manifestDigest.String())
+	w.Header().Set("Etag", fmt.Sprintf("%q", manifestDigest))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(raw))
+}
+
+// serveBlob serves the blob with the given digest, supporting range requests.
+func (h *handler) serveBlob(w http.ResponseWriter, r *http.Request, reference string) {
+	blobDigest, err := digest.Parse(reference)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeDigestInvalid, fmt.Sprintf("invalid digest: %s", reference))
+		return
+	}
+
+	reader, size, err := h.engine.GetBlobAt(r.Context(), blobDigest)
+	if os.IsNotExist(errors.Cause(err)) {
+		writeError(w, http.StatusNotFound, codeBlobUnknown, fmt.Sprintf("unknown blob: %s", blobDigest))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeUnknown, err.Error())
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", blobDigest.String())
+	w.Header().Set("Etag", fmt.Sprintf("%q", blobDigest))
+	http.ServeContent(w, r, "", time.Time{}, io.NewSectionReader(reader, 0, size))
+}
@@ -0,0 +1,302 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// setupImage creates an image with a single manifest (tagged with each of
+// the given tags), returning the engine, the manifest descriptor and the
+// contents of its layer.
+func setupImage(t *testing.T, tags ...string) (casext.Engine, ispec.Descriptor, []byte) {
+	ctx := context.Background()
+	engine := casext.Engine{Engine: mem.New()}
+
+	layer := []byte("the contents of the layer blob")
+	layerDigest, layerSize, err := engine.PutBlob(ctx, bytes.NewReader(layer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, ispec.Image{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{{
+			MediaType: ispec.MediaTypeImageLayer,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		}},
+	}
+	manifest.SchemaVersion = 2
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+	for _, tag := range tags {
+		if err := engine.PutReference(ctx, tag, descriptor); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return engine, descriptor, layer
+}
+
+func newServer(t *testing.T, engine casext.Engine, name string) *httptest.Server {
+	handler, err := NewHandler(engine, name)
+	if err != nil {
+		t.Fatalf("unexpected error creating handler: %+v", err)
+	}
+	return httptest.NewServer(handler)
+}
+
+func doRequest(t *testing.T, method, url string, header map[string]string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error doing request: %+v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+// errorCode returns the code of the first error in an error response.
+func errorCode(t *testing.T, body []byte) string {
+	var response struct {
+		Errors []apiError `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || len(response.Errors) == 0 {
+		t.Fatalf("invalid error response: %s", body)
+	}
+	return response.Errors[0].Code
+}
+
+func TestNewHandlerName(t *testing.T) {
+	engine, _, _ := setupImage(t)
+	defer engine.Close()
+
+	for _, name := range []string{"image", "library/image", "my-image.v2", "a/b/c"} {
+		if _, err := NewHandler(engine, name); err != nil {
+			t.Errorf("unexpected error with name %q: %+v", name, err)
+		}
+	}
+	for _, name := range []string{"", "Image", "/image", "image/", "image:latest", "-image"} {
+		if _, err := NewHandler(engine, name); err == nil {
+			t.Errorf("expected error with name %q", name)
+		}
+	}
+}
+
+func TestServeManifest(t *testing.T) {
+	engine, descriptor, _ := setupImage(t, "latest")
+	defer engine.Close()
+	server := newServer(t, engine, "library/image")
+	defer server.Close()
+
+	for _, reference := range []string{"latest", descriptor.Digest.String()} {
+		resp, body := doRequest(t, "GET", server.URL+"/v2/library/image/manifests/"+reference, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: unexpected status %d: %s", reference, resp.StatusCode, body)
+			continue
+		}
+		if got := resp.Header.Get("Content-Type"); got != ispec.MediaTypeImageManifest {
+			t.Errorf("%s: unexpected content type %s", reference, got)
+		}
+		if got := resp.Header.Get("Docker-Content-Digest"); got != descriptor.Digest.String() {
+			t.Errorf("%s: unexpected digest header %s", reference, got)
+		}
+		if digest.FromBytes(body) != descriptor.Digest {
+			t.Errorf("%s: body doesn't match manifest digest", reference)
+		}
+
+		resp, body = doRequest(t, "HEAD", server.URL+"/v2/library/image/manifests/"+reference, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: unexpected HEAD status %d", reference, resp.StatusCode)
+		}
+		if len(body) != 0 {
+			t.Errorf("%s: unexpected HEAD body", reference)
+		}
+		if resp.ContentLength != descriptor.Size {
+			t.Errorf("%s: unexpected HEAD content length %d", reference, resp.ContentLength)
+		}
+	}
+
+	for _, test := range []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/v2/library/image/manifests/nonexistent", http.StatusNotFound, codeManifestUnknown},
+		{"/v2/library/image/manifests/" + digest.FromString("missing").String(), http.StatusNotFound, codeManifestUnknown},
+		{"/v2/library/image/manifests/sha256:invalid", http.StatusBadRequest, codeDigestInvalid},
+		{"/v2/other/manifests/latest", http.StatusNotFound, codeNameUnknown},
+		{"/v2/Other/manifests/latest", http.StatusNotFound, codeNameInvalid},
+	} {
+		resp, body := doRequest(t, "GET", server.URL+test.path, nil)
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.path, test.status, resp.StatusCode)
+		}
+		if code := errorCode(t, body); code != test.code {
+			t.Errorf("%s: expected error code %s, got %s", test.path, test.code, code)
+		}
+	}
+}
+
+func TestServeBlob(t *testing.T) {
+	engine, _, layer := setupImage(t, "latest")
+	defer engine.Close()
+	server := newServer(t, engine, "image")
+	defer server.Close()
+
+	layerURL := server.URL + "/v2/image/blobs/" + digest.FromBytes(layer).String()
+
+	resp, body := doRequest(t, "GET", layerURL, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+	if !bytes.Equal(body, layer) {
+		t.Errorf("unexpected blob contents: %q", body)
+	}
+	if got := resp.Header.Get("Docker-Content-Digest"); got != digest.FromBytes(layer).String() {
+		t.Errorf("unexpected digest header %s", got)
+	}
+
+	resp, body = doRequest(t, "GET", layerURL, map[string]string{"Range": "bytes=4-11"})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("unexpected range status %d: %s", resp.StatusCode, body)
+	}
+	if !bytes.Equal(body, layer[4:12]) {
+		t.Errorf("unexpected range contents: %q", body)
+	}
+
+	resp, body = doRequest(t, "HEAD", layerURL, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected HEAD status %d", resp.StatusCode)
+	}
+	if len(body) != 0 || resp.ContentLength != int64(len(layer)) {
+		t.Errorf("unexpected HEAD response: content length %d, body %q", resp.ContentLength, body)
+	}
+
+	resp, body = doRequest(t, "GET", server.URL+"/v2/image/blobs/"+digest.FromString("missing").String(), nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status for missing blob %d", resp.StatusCode)
+	}
+	if code := errorCode(t, body); code != codeBlobUnknown {
+		t.Errorf("unexpected error code for missing blob %s", code)
+	}
+}
+
+func TestServeTags(t *testing.T) {
+	engine, _, _ := setupImage(t, "v1", "v2", "latest", "v3", "not:a-tag")
+	defer engine.Close()
+	server := newServer(t, engine, "image")
+	defer server.Close()
+
+	type tagList struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	for _, test := range []struct {
+		query    string
+		expected []string
+		next     bool
+	}{
+		{"", []string{"latest", "v1", "v2", "v3"}, false},
+		{"?n=2", []string{"latest", "v1"}, true},
+		{"?n=2&last=v1", []string{"v2", "v3"}, false},
+		{"?last=v2", []string{"v3"}, false},
+		{"?n=10&last=v3", []string{}, false},
+	} {
+		resp, body := doRequest(t, "GET", server.URL+"/v2/image/tags/list"+test.query, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: unexpected status %d: %s", test.query, resp.StatusCode, body)
+			continue
+		}
+		var list tagList
+		if err := json.Unmarshal(body, &list); err != nil {
+			t.Errorf("%s: invalid tag list: %s", test.query, body)
+			continue
+		}
+		if list.Name != "image" || !reflect.DeepEqual(list.Tags, test.expected) {
+			t.Errorf("%s: expected tags %v, got %v", test.query, test.expected, list)
+		}
+		if next := resp.Header.Get("Link") != ""; next != test.next {
+			t.Errorf("%s: unexpected Link header %q", test.query, resp.Header.Get("Link"))
+		}
+	}
+}
+
+func TestServeReadOnly(t *testing.T) {
+	engine, _, _ := setupImage(t, "latest")
+	defer engine.Close()
+	server := newServer(t, engine, "image")
+	defer server.Close()
+
+	resp, body := doRequest(t, "GET", server.URL+"/v2/", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status for API version check %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Docker-Distribution-API-Version"); got != "registry/2.0" {
+		t.Errorf("unexpected API version header %q", got)
+	}
+
+	for _, method := range []string{"PUT", "POST", "DELETE", "PATCH"} {
+		resp, body = doRequest(t, method, server.URL+"/v2/image/manifests/latest", nil)
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("%s: unexpected status %d", method, resp.StatusCode)
+		}
+		if code := errorCode(t, body); code != codeUnsupported {
+			t.Errorf("%s: unexpected error code %s", method, code)
+		}
+	}
+	if _, err := engine.GetReference(context.Background(), "latest"); err != nil {
+		t.Errorf("reference was modified: %+v", err)
+	}
+}
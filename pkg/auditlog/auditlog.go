@@ -0,0 +1,232 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package auditlog implements an append-only log of the changes made to the
+// references of an image, so that the provenance of a reference can be
+// audited. Every entry contains the hash of the previous entry, so that
+// entries cannot be modified, removed or reordered without breaking the
+// chain. Entries can optionally be signed with a key (using HMAC-SHA256), so
+// that the whole log cannot be regenerated by someone without the key.
+package auditlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Entry is a single change to a reference, stored as one line of the log.
+type Entry struct {
+	// Sequence is the position of the entry in the log, starting at 1.
+	Sequence uint64 `json:"seq"`
+
+	// Time is when the change was made.
+	Time time.Time `json:"time"`
+
+	// User is the name of the user who made the change, and Command is the
+	// command line which made it.
+	User    string   `json:"user,omitempty"`
+	Command []string `json:"command,omitempty"`
+
+	// Reference is the name of the changed reference, and Old and New are
+	// the digests it referred to before and after the change. Old is empty
+	// if the reference was created, and New is empty if it was removed.
+	Reference string        `json:"reference"`
+	Old       digest.Digest `json:"old,omitempty"`
+	New       digest.Digest `json:"new,omitempty"`
+
+	// Previous is the Hash of the previous entry (empty for the first
+	// entry), and Hash is the digest of this entry (with Hash and Signature
+	// unset). Signature is the hex-encoded HMAC-SHA256 of Hash, if the log is
+	// signed.
+	Previous  digest.Digest `json:"previous,omitempty"`
+	Hash      digest.Digest `json:"hash"`
+	Signature string        `json:"signature,omitempty"`
+}
+
+// hash computes the Hash of the entry.
+func (entry Entry) hash() (digest.Digest, error) {
+	entry.Hash = ""
+	entry.Signature = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", errors.Wrap(err, "encode entry")
+	}
+	return digest.FromBytes(data), nil
+}
+
+// sign computes the Signature of an entry with the given Hash.
+func sign(hash digest.Digest, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Create creates a new empty log at the given path, which must not already
+// exist.
+func Create(path string) error {
+	fh, err := os.OpenFile(path, os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "create audit log")
+	}
+	return errors.Wrap(fh.Close(), "create audit log")
+}
+
+// lockFile takes an exclusive lock on the log, waiting for any other writers
+// to finish.
+func lockFile(fh *os.File) error {
+	for {
+		err := system.Flock(fh.Fd(), true)
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Append fills in the Sequence, Previous, Hash and Signature (if key is
+// non-empty) of the entry and appends it to the log at the given path, which
+// must already exist. If the Time of the entry is unset, the current time is
+// used. The log is locked while the entry is being appended, so concurrent
+// writers (even in other processes) cannot break the chain. The complete
+// entry is returned.
+func Append(path string, entry Entry, key []byte) (Entry, error) {
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return Entry{}, errors.Wrap(err, "open audit log")
+	}
+	defer fh.Close()
+
+	if err := lockFile(fh); err != nil {
+		return Entry{}, errors.Wrap(err, "lock audit log")
+	}
+	defer system.Unflock(fh.Fd())
+
+	entries, err := Read(fh)
+	if err != nil {
+		return Entry{}, err
+	}
+	entry.Sequence = 1
+	entry.Previous = ""
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		entry.Sequence = last.Sequence + 1
+		entry.Previous = last.Hash
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Time = entry.Time.UTC()
+
+	entry.Signature = ""
+	entry.Hash, err = entry.hash()
+	if err != nil {
+		return Entry{}, err
+	}
+	if len(key) > 0 {
+		entry.Signature = sign(entry.Hash, key)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return Entry{}, errors.Wrap(err, "encode entry")
+	}
+	if _, err := fh.Write(append(data, '\n')); err != nil {
+		return Entry{}, errors.Wrap(err, "write entry")
+	}
+	if err := fh.Sync(); err != nil {
+		return Entry{}, errors.Wrap(err, "sync audit log")
+	}
+	return entry, nil
+}
+
+// Read reads all of the entries of a log. The entries are not verified (see
+// Verify).
+func Read(reader io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, errors.Wrapf(err, "parse audit log: line %d", line)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read audit log")
+	}
+	return entries, nil
+}
+
+// ReadFile reads all of the entries of the log at the given path.
+func ReadFile(path string) ([]Entry, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open audit log")
+	}
+	defer fh.Close()
+	return Read(fh)
+}
+
+// Verify checks that the entries form an unbroken chain, that the Hash of
+// every entry matches its contents and (if key is non-empty) that every entry
+// is signed with key. The returned error refers to the first entry which
+// failed verification.
+func Verify(entries []Entry, key []byte) error {
+	var previous digest.Digest
+	for idx, entry := range entries {
+		if entry.Sequence != uint64(idx+1) {
+			return errors.Errorf("entry %d: unexpected sequence number %d", idx+1, entry.Sequence)
+		}
+		if entry.Previous != previous {
+			return errors.Errorf("entry %d: previous hash does not match entry %d", entry.Sequence, idx)
+		}
+		hash, err := entry.hash()
+		if err != nil {
+			return errors.Wrapf(err, "entry %d", entry.Sequence)
+		}
+		if entry.Hash != hash {
+			return errors.Errorf("entry %d: hash mismatch: expected %s got %s", entry.Sequence, entry.Hash, hash)
+		}
+		if len(key) > 0 {
+			if entry.Signature == "" {
+				return errors.Errorf("entry %d: entry is not signed", entry.Sequence)
+			}
+			if !hmac.Equal([]byte(entry.Signature), []byte(sign(entry.Hash, key))) {
+				return errors.Errorf("entry %d: invalid signature", entry.Sequence)
+			}
+		}
+		previous = entry.Hash
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auditlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func appendEntries(t *testing.T, path string, key []byte) []Entry {
+	var entries []Entry
+	for _, entry := range []Entry{
+		{User: "root", Command: []string{"umoci", "new"}, Reference: "latest", New: digest.FromString("a")},
+		{User: "root", Command: []string{"umoci", "repack"}, Reference: "latest", Old: digest.FromString("a"), New: digest.FromString("b")},
+		{User: "user", Command: []string{"umoci", "rm"}, Reference: "latest", Old: digest.FromString("b")},
+	} {
+		entry, err := Append(path, entry, key)
+		if err != nil {
+			t.Fatalf("unexpected error appending entry: %+v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestAuditLog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "history.log")
+	if _, err := Append(path, Entry{Reference: "latest"}, nil); err == nil {
+		t.Errorf("expected appending to a non-existent log to fail")
+	}
+	if err := Create(path); err != nil {
+		t.Fatalf("unexpected error creating log: %+v", err)
+	}
+	if err := Create(path); err == nil {
+		t.Errorf("expected creating an existing log to fail")
+	}
+
+	written := appendEntries(t, path, nil)
+	entries, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading log: %+v", err)
+	}
+	if len(entries) != len(written) {
+		t.Fatalf("expected %d entries, got %d", len(written), len(entries))
+	}
+	for idx, entry := range entries {
+		if entry.Sequence != uint64(idx+1) {
+			t.Errorf("entry %d: unexpected sequence %d", idx, entry.Sequence)
+		}
+		if entry.Hash != written[idx].Hash {
+			t.Errorf("entry %d: read hash %s doesn't match written hash %s", idx, entry.Hash, written[idx].Hash)
+		}
+		if idx > 0 && entry.Previous != entries[idx-1].Hash {
+			t.Errorf("entry %d: not chained to previous entry", idx)
+		}
+		if entry.Signature != "" {
+			t.Errorf("entry %d: unexpected signature", idx)
+		}
+	}
+	if err := Verify(entries, nil); err != nil {
+		t.Errorf("unexpected error verifying log: %+v", err)
+	}
+	if err := Verify(entries, []byte("key")); err == nil {
+		t.Errorf("expected unsigned log to fail verification with a key")
+	}
+}
+
+func TestAuditLogSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestAuditLogSigned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "history.log")
+	if err := Create(path); err != nil {
+		t.Fatalf("unexpected error creating log: %+v", err)
+	}
+	key := []byte("secret key")
+	appendEntries(t, path, key)
+
+	entries, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading log: %+v", err)
+	}
+	if err := Verify(entries, key); err != nil {
+		t.Errorf("unexpected error verifying log: %+v", err)
+	}
+	if err := Verify(entries, []byte("wrong key")); err == nil {
+		t.Errorf("expected verification with the wrong key to fail")
+	}
+	// The chain itself can still be verified without the key.
+	if err := Verify(entries, nil); err != nil {
+		t.Errorf("unexpected error verifying log without key: %+v", err)
+	}
+}
+
+func TestAuditLogTampered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestAuditLogTampered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "history.log")
+	if err := Create(path); err != nil {
+		t.Fatalf("unexpected error creating log: %+v", err)
+	}
+	key := []byte("secret key")
+	entries := appendEntries(t, path, key)
+
+	for _, test := range []struct {
+		name   string
+		tamper func([]Entry) []Entry
+	}{
+		{"Modified", func(entries []Entry) []Entry {
+			entries[1].New = digest.FromString("c")
+			return entries
+		}},
+		{"Rehashed", func(entries []Entry) []Entry {
+			// Without the key, a modified entry can be rehashed but not
+			// re-signed.
+			entries[2].User = "root"
+			entries[2].Hash, _ = entries[2].hash()
+			return entries
+		}},
+		{"Removed", func(entries []Entry) []Entry {
+			return append(entries[:1], entries[2:]...)
+		}},
+		{"Reordered", func(entries []Entry) []Entry {
+			entries[1], entries[2] = entries[2], entries[1]
+			return entries
+		}},
+		{"Truncated", func(entries []Entry) []Entry {
+			return entries[1:]
+		}},
+	} {
+		tampered := append([]Entry(nil), entries...)
+		tampered = test.tamper(tampered)
+
+		// Round-trip through the on-disk format.
+		var buffer bytes.Buffer
+		for _, entry := range tampered {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buffer.Write(append(data, '\n'))
+		}
+		read, err := Read(&buffer)
+		if err != nil {
+			t.Errorf("%s: unexpected error reading log: %+v", test.name, err)
+			continue
+		}
+		if err := Verify(read, key); err == nil {
+			t.Errorf("%s: expected tampered log to fail verification", test.name)
+		}
+	}
+
+	if _, err := Read(bytes.NewBufferString("{\"seq\": 1}\n{\"seq\":")); err == nil {
+		t.Errorf("expected a truncated entry to fail")
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ctxio provides io.Readers which stop reading once a context has
+// been cancelled (or its deadline has passed). This makes it possible to
+// abort long-running copies (such as of blobs and layers) which would
+// otherwise only check their context before they start.
+package ctxio
+
+import (
+	"io"
+
+	"golang.org/x/net/context"
+)
+
+// Reader is an io.Reader which returns the error of its context (such as
+// context.Canceled) instead of reading from the underlying io.Reader once the
+// context is done.
+type Reader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+// NewReader returns a Reader which reads from r until ctx is done.
+func NewReader(ctx context.Context, r io.Reader) *Reader {
+	return &Reader{ctx: ctx, reader: r}
+}
+
+// Read reads from the underlying io.Reader, unless the context is done.
+func (r *Reader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// readCloser is a Reader which closes the underlying io.ReadCloser.
+type readCloser struct {
+	*Reader
+	closer io.Closer
+}
+
+func (rc readCloser) Close() error {
+	return rc.closer.Close()
+}
+
+// NewReadCloser is like NewReader, except that closing the returned
+// io.ReadCloser closes rc.
+func NewReadCloser(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	return readCloser{
+		Reader: NewReader(ctx, rc),
+		closer: rc,
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ctxio
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reader := NewReader(ctx, bytes.NewReader(bytes.Repeat([]byte("x"), 1024)))
+	buf := make([]byte, 512)
+	if n, err := reader.Read(buf); err != nil || n != 512 {
+		t.Fatalf("unexpected read before cancel: n=%d err=%v", n, err)
+	}
+
+	cancel()
+	if n, err := reader.Read(buf); err != context.Canceled || n != 0 {
+		t.Errorf("expected context.Canceled after cancel: n=%d err=%v", n, err)
+	}
+}
+
+func TestReaderDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	if _, err := ioutil.ReadAll(NewReader(ctx, bytes.NewBufferString("data"))); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded: %v", err)
+	}
+}
+
+type closeRecorder struct {
+	*bytes.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestReadCloser(t *testing.T) {
+	inner := &closeRecorder{Reader: bytes.NewReader([]byte("data"))}
+	rc := NewReadCloser(context.Background(), inner)
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil || string(data) != "data" {
+		t.Errorf("unexpected read: %q %v", data, err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Errorf("unexpected error closing: %v", err)
+	}
+	if !inner.closed {
+		t.Errorf("underlying reader was not closed")
+	}
+}
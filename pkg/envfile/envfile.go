@@ -0,0 +1,149 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package envfile implements the parsing of files containing many key-value
+// pairs (such as environment variables or labels), so that they can be set
+// in bulk rather than one command-line flag at a time. Both "dotenv" files
+// (one KEY=VALUE per line) and JSON objects are supported.
+package envfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Entry is a single entry of a file. If Remove is set, the entry requests
+// that the key be removed (and Value is empty).
+type Entry struct {
+	Name   string
+	Value  string
+	Remove bool
+}
+
+// Parse parses the given data, which is either a JSON object or a dotenv
+// file. A JSON object maps each key to a string value, or to null to remove
+// the key. A dotenv file contains one entry per line:
+//
+//	# comments and empty lines are ignored.
+//	KEY=value
+//	export KEY=value
+//	KEY="value with \"escapes\""
+//	KEY='literal value'
+//	KEY-
+//
+// where "KEY-" removes the key. Entries are returned in the order they are
+// listed (JSON objects are returned sorted by key).
+func Parse(data []byte) ([]Entry, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJSON(trimmed)
+	}
+	return parseDotenv(bytes.NewReader(data))
+}
+
+// ReadFile parses the given file (see Parse).
+func ReadFile(path string) ([]Entry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read file")
+	}
+	entries, err := Parse(data)
+	return entries, errors.Wrapf(err, "parse %s", path)
+}
+
+func parseJSON(data []byte) ([]Entry, error) {
+	var object map[string]*string
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, errors.Wrap(err, "decode json object")
+	}
+
+	var entries []Entry
+	for name, value := range object {
+		if name == "" {
+			return nil, errors.Errorf("key must be non-empty")
+		}
+		entry := Entry{Name: name, Remove: value == nil}
+		if value != nil {
+			entry.Value = *value
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+func parseDotenv(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		entry, ok, err := parseLine(scanner.Text())
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineno)
+		}
+		if ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, errors.Wrap(scanner.Err(), "read dotenv")
+}
+
+// parseLine parses a single line of a dotenv file, returning false if the
+// line has no entry.
+func parseLine(line string) (Entry, bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return Entry{}, false, nil
+	}
+	line = strings.TrimPrefix(line, "export ")
+
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 {
+		name := strings.TrimSpace(line)
+		if !strings.HasSuffix(name, "-") || len(name) == 1 {
+			return Entry{}, false, errors.Errorf("entry must be of the form KEY=VALUE or KEY-: %s", line)
+		}
+		return Entry{Name: strings.TrimSuffix(name, "-"), Remove: true}, true, nil
+	}
+
+	name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if name == "" {
+		return Entry{}, false, errors.Errorf("entry must have non-empty key: %s", line)
+	}
+	if len(value) >= 2 {
+		switch {
+		case value[0] == '"' && value[len(value)-1] == '"':
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return Entry{}, false, errors.Wrapf(err, "unquote value of %s", name)
+			}
+			value = unquoted
+		case value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		}
+	}
+	return Entry{Name: name, Value: value}, true, nil
+}
@@ -0,0 +1,88 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package envfile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDotenv(t *testing.T) {
+	data := `# A comment.
+HOME=/root
+
+export PATH=/bin:/usr/bin
+  SPACED = value with spaces
+QUOTED="a \"quoted\"\tvalue"
+SINGLE='literal \t value'
+EMPTY=
+EQUALS=a=b=c
+OLD-
+`
+	expected := []Entry{
+		{Name: "HOME", Value: "/root"},
+		{Name: "PATH", Value: "/bin:/usr/bin"},
+		{Name: "SPACED", Value: "value with spaces"},
+		{Name: "QUOTED", Value: "a \"quoted\"\tvalue"},
+		{Name: "SINGLE", Value: `literal \t value`},
+		{Name: "EMPTY", Value: ""},
+		{Name: "EQUALS", Value: "a=b=c"},
+		{Name: "OLD", Remove: true},
+	}
+
+	entries, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected entries: expected %v got %v", expected, entries)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	data := ` {"b": "value", "a": "", "c": null}`
+	expected := []Entry{
+		{Name: "a", Value: ""},
+		{Name: "b", Value: "value"},
+		{Name: "c", Remove: true},
+	}
+
+	entries, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected entries: expected %v got %v", expected, entries)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, data := range []string{
+		"NOVALUE",
+		"-",
+		"=value",
+		`BAD="unterminated \"`,
+		`{"key": 1}`,
+		`{"": "value"}`,
+		`{"key": "value"`,
+	} {
+		if entries, err := Parse([]byte(data)); err == nil {
+			t.Errorf("%q: expected an error, got %v", data, entries)
+		}
+	}
+}
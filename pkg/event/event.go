@@ -0,0 +1,208 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package event provides the structured events and logging used by umoci's
+// library packages (oci/cas, oci/casext, oci/layer and mutate), so that users
+// embedding umoci can wire them into their own telemetry. Events (such as a
+// blob having been written, a layer having been unpacked, the progress of a
+// long-running operation or the start and end of a traced operation) are
+// delivered to a Hook, registered with SetHook or attached to the context of an
+// operation with WithHook. Progress reporting and the metrics collected by
+// pkg/stats are both built on these events. Log messages are written to a
+// Logger, registered with SetLogger or attached to a context with WithLogger.
+// By default no hook is registered, and messages are logged with apex/log.
+package event
+
+import (
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// Types of events.
+const (
+	// BlobStart is emitted when a blob starts being read from (or written
+	// to) a cas.Engine.
+	BlobStart = "blob-start"
+
+	// BlobDone is emitted once a blob has been read (the reader has been
+	// closed) or written. Err is set if the operation failed.
+	BlobDone = "blob-done"
+
+	// LayerApplied is emitted once a layer has been unpacked into a root
+	// filesystem (and its DiffID has been verified).
+	LayerApplied = "layer-applied"
+
+	// LayerAdded is emitted once a layer has been generated, compressed and
+	// written to a cas.Engine (such as when repacking a bundle).
+	LayerAdded = "layer-added"
+
+	// RefUpdated is emitted once a reference has been created, replaced or
+	// deleted. Descriptor is nil if the reference was deleted.
+	RefUpdated = "ref-updated"
+
+	// Progress is emitted as the data of a blob or layer operation is
+	// processed (see StartBlob and StartLayer).
+	Progress = "progress"
+
+	// CacheHit is emitted when a blob is read from a blob cache, and
+	// CacheMiss when it had to be fetched from the backend of the cache.
+	CacheHit  = "cache-hit"
+	CacheMiss = "cache-miss"
+
+	// SpanStart is emitted when a traced operation (see StartSpan) starts,
+	// and SpanEnd once it has completed. Err is set for SpanEnd events if
+	// the operation failed.
+	SpanStart = "span-start"
+	SpanEnd   = "span-end"
+)
+
+// Operations on blobs (used as the Op of BlobStart, BlobDone and Progress
+// events) and layers (used as the Op of Progress events).
+const (
+	// OpGet is reading a blob.
+	OpGet = "get"
+
+	// OpPut is writing a blob.
+	OpPut = "put"
+
+	// OpUnpack is extracting a layer (the progress is that of the compressed
+	// layer blob).
+	OpUnpack = "unpack"
+
+	// OpPack is generating a layer (the progress is that of the uncompressed
+	// layer archive, the size of which is not known in advance).
+	OpPack = "pack"
+)
+
+// Event is a structured event emitted by one of umoci's library packages.
+type Event struct {
+	// Type is the type of the event (such as BlobStart).
+	Type string `json:"type"`
+
+	// Time is when the event was emitted.
+	Time time.Time `json:"time"`
+
+	// Op is the operation for blob and Progress events (such as OpGet).
+	Op string `json:"op,omitempty"`
+
+	// Name is the name of the operation, for span events.
+	Name string `json:"name,omitempty"`
+
+	// SpanID identifies the traced operation, and ParentID the traced
+	// operation it is part of (or is empty if there is none), for span
+	// events.
+	SpanID   string `json:"span_id,omitempty"`
+	ParentID string `json:"parent_id,omitempty"`
+
+	// Digest is the digest of the blob (or layer) the event refers to. It is
+	// empty if it is not yet known (such as when a blob starts being
+	// written).
+	Digest digest.Digest `json:"digest,omitempty"`
+
+	// Size is the number of bytes read or written for BlobDone events, and
+	// the (compressed) size of the layer blob for layer events.
+	Size int64 `json:"size,omitempty"`
+
+	// UncompressedSize is the size of the uncompressed layer archive, for
+	// layer events. Duration is how long it took to unpack (or generate and
+	// compress) the layer, for layer events, or how long the operation took,
+	// for SpanEnd events.
+	UncompressedSize int64         `json:"uncompressed_size,omitempty"`
+	Duration         time.Duration `json:"duration,omitempty"`
+
+	// Current is the number of bytes processed so far and Total is the
+	// number of bytes that will be processed (or -1 if it is not known), for
+	// Progress events. Done is set for the final Progress event of an
+	// operation.
+	Current int64 `json:"current,omitempty"`
+	Total   int64 `json:"total,omitempty"`
+	Done    bool  `json:"done,omitempty"`
+
+	// Reference is the name of the reference, for RefUpdated events.
+	Reference string `json:"reference,omitempty"`
+
+	// Descriptor is the new descriptor of the reference, for RefUpdated
+	// events.
+	Descriptor *ispec.Descriptor `json:"descriptor,omitempty"`
+
+	// Fields contains any other information about the event (such as the
+	// index of an unpacked layer, or the attributes of a span).
+	Fields Fields `json:"fields,omitempty"`
+
+	// Err is the error the operation failed with (if any).
+	Err error `json:"-"`
+}
+
+// Hook is called with each event. A Hook must be safe for concurrent use, as
+// several operations may be in progress at once, and should return quickly
+// as it is called synchronously with the operation. A Hook must not use the
+// cas.Engine which emitted the event, as the engine may be locked.
+type Hook func(Event)
+
+var (
+	hookLock   sync.RWMutex
+	globalHook Hook
+)
+
+// SetHook registers the Hook used for operations whose context doesn't have a
+// Hook attached (see WithHook). If hook is nil, events are discarded (which is
+// the default).
+func SetHook(hook Hook) {
+	hookLock.Lock()
+	defer hookLock.Unlock()
+	globalHook = hook
+}
+
+type hookKey struct{}
+
+// WithHook returns a context whose events are delivered to hook (overriding
+// any Hook registered with SetHook). If hook is nil, events are discarded for
+// operations using the returned context.
+func WithHook(ctx context.Context, hook Hook) context.Context {
+	if hook == nil {
+		hook = func(Event) {}
+	}
+	return context.WithValue(ctx, hookKey{}, hook)
+}
+
+// hookFromContext returns the Hook used for the given context, or nil if
+// events are discarded.
+func hookFromContext(ctx context.Context) Hook {
+	if hook, ok := ctx.Value(hookKey{}).(Hook); ok {
+		return hook
+	}
+	hookLock.RLock()
+	defer hookLock.RUnlock()
+	return globalHook
+}
+
+// Emit delivers the given event to the Hook for the given context. If the
+// Time of the event is not set, it is set to the current time.
+func Emit(ctx context.Context, event Event) {
+	hook := hookFromContext(ctx)
+	if hook == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	hook(event)
+}
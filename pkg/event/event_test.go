@@ -0,0 +1,89 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package event
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestEmit(t *testing.T) {
+	// No Hook is registered by default.
+	Emit(context.Background(), Event{Type: RefUpdated})
+
+	var global, local []Event
+	SetHook(func(ev Event) { global = append(global, ev) })
+	defer SetHook(nil)
+
+	Emit(context.Background(), Event{Type: RefUpdated, Reference: "global"})
+	Emit(WithHook(context.Background(), func(ev Event) { local = append(local, ev) }), Event{Type: RefUpdated, Reference: "local"})
+	Emit(WithHook(context.Background(), nil), Event{Type: RefUpdated, Reference: "discarded"})
+
+	if len(global) != 1 || global[0].Reference != "global" {
+		t.Errorf("unexpected events for the global Hook: %#v", global)
+	}
+	if len(local) != 1 || local[0].Reference != "local" {
+		t.Errorf("unexpected events for the context Hook: %#v", local)
+	}
+	for _, ev := range append(global, local...) {
+		if ev.Time.IsZero() {
+			t.Errorf("event time was not set: %#v", ev)
+		}
+	}
+}
+
+type testLogger struct {
+	fields Fields
+	lines  *[]string
+}
+
+func (l testLogger) WithFields(fields Fields) Logger {
+	return testLogger{fields: fields, lines: l.lines}
+}
+
+func (l testLogger) logf(level, format string, args ...interface{}) {
+	*l.lines = append(*l.lines, fmt.Sprintf("%s %s %v", level, fmt.Sprintf(format, args...), l.fields))
+}
+
+func (l testLogger) Debugf(format string, args ...interface{}) { l.logf("debug", format, args...) }
+func (l testLogger) Infof(format string, args ...interface{})  { l.logf("info", format, args...) }
+func (l testLogger) Warnf(format string, args ...interface{})  { l.logf("warn", format, args...) }
+
+func TestLog(t *testing.T) {
+	if _, ok := Log(context.Background()).(apexLogger); !ok {
+		t.Errorf("expected apex/log to be used by default, got %#v", Log(context.Background()))
+	}
+
+	var global, local []string
+	defer SetLogger(Default())
+	SetLogger(testLogger{lines: &global})
+
+	Log(context.Background()).WithFields(Fields{"key": "value"}).Infof("global %d", 1)
+	Log(WithLogger(context.Background(), testLogger{lines: &local})).Warnf("local")
+	Log(WithLogger(context.Background(), nil)).Debugf("discarded")
+	Default().Debugf("default")
+
+	if expected := []string{"info global 1 map[key:value]", "debug default map[]"}; fmt.Sprint(global) != fmt.Sprint(expected) {
+		t.Errorf("unexpected global log: got %q, expected %q", global, expected)
+	}
+	if expected := []string{"warn local map[]"}; fmt.Sprint(local) != fmt.Sprint(expected) {
+		t.Errorf("unexpected context log: got %q, expected %q", local, expected)
+	}
+}
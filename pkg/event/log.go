@@ -0,0 +1,108 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package event
+
+import (
+	"sync"
+
+	"github.com/apex/log"
+	"golang.org/x/net/context"
+)
+
+// Fields are structured key-value pairs attached to a log message (or an
+// Event).
+type Fields map[string]interface{}
+
+// Logger is the interface used by umoci's library packages to log messages.
+type Logger interface {
+	// WithFields returns a Logger which attaches the given fields to every
+	// message it logs.
+	WithFields(fields Fields) Logger
+
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+}
+
+// apexLogger is the default Logger, which logs messages with apex/log.
+type apexLogger struct {
+	log.Interface
+}
+
+func (l apexLogger) WithFields(fields Fields) Logger {
+	return apexLogger{l.Interface.WithFields(log.Fields(fields))}
+}
+
+// NewApexLogger returns a Logger which logs messages to the given apex/log
+// logger (or entry).
+func NewApexLogger(logger log.Interface) Logger {
+	return apexLogger{logger}
+}
+
+// nopLogger discards all messages.
+type nopLogger struct{}
+
+func (nopLogger) WithFields(Fields) Logger      { return nopLogger{} }
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+
+var (
+	loggerLock   sync.RWMutex
+	globalLogger Logger = apexLogger{log.Log}
+)
+
+// SetLogger registers the Logger used by operations whose context doesn't
+// have a Logger attached (see WithLogger). If logger is nil, messages are
+// discarded. By default, messages are logged with the global apex/log logger.
+func SetLogger(logger Logger) {
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
+	globalLogger = logger
+}
+
+// Default returns the Logger registered with SetLogger. It should only be
+// used by code which doesn't have access to the context of the operation.
+func Default() Logger {
+	loggerLock.RLock()
+	defer loggerLock.RUnlock()
+	return globalLogger
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a context whose messages are logged to logger
+// (overriding any Logger registered with SetLogger). If logger is nil,
+// messages are discarded for operations using the returned context.
+func WithLogger(ctx context.Context, logger Logger) context.Context {
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Log returns the Logger for the given context.
+func Log(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return logger
+	}
+	return Default()
+}
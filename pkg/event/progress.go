@@ -0,0 +1,173 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package event
+
+import (
+	"io"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/net/context"
+)
+
+type noProgressKey struct{}
+
+// WithoutProgress returns a context for which no Progress events are emitted
+// (all other events still are). This is useful for operations that report
+// their own progress, and don't want the progress of the operations they are
+// built on to be reported as well.
+func WithoutProgress(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noProgressKey{}, true)
+}
+
+// Tracker reports the progress of a blob or layer operation as Progress
+// events. Done must be called once the operation has completed. A Tracker
+// is safe for concurrent use.
+type Tracker struct {
+	lock     sync.Mutex
+	ctx      context.Context
+	event    Event
+	blob     bool
+	progress bool
+	done     bool
+}
+
+func newTracker(ctx context.Context, op string, dgst digest.Digest, total int64, blob bool) *Tracker {
+	noProgress, _ := ctx.Value(noProgressKey{}).(bool)
+	t := &Tracker{
+		ctx:      ctx,
+		event:    Event{Type: Progress, Op: op, Digest: dgst, Total: total},
+		blob:     blob,
+		progress: !noProgress,
+	}
+	if blob {
+		Emit(ctx, Event{Type: BlobStart, Op: op, Digest: dgst})
+	}
+	t.emit()
+	return t
+}
+
+// StartBlob emits a BlobStart event for the given blob operation (OpGet or
+// OpPut) of the blob with the given digest (which may be empty if it is not
+// yet known) and total size (or -1 if it is not known), and returns a Tracker
+// for the operation. Done emits the corresponding BlobDone event.
+func StartBlob(ctx context.Context, op string, dgst digest.Digest, total int64) *Tracker {
+	return newTracker(ctx, op, dgst, total, true)
+}
+
+// StartLayer returns a Tracker for the given layer operation (OpUnpack or
+// OpPack), which only emits Progress events. The operation is expected to
+// emit its own event (such as LayerApplied) once it has completed.
+func StartLayer(ctx context.Context, op string, dgst digest.Digest, total int64) *Tracker {
+	return newTracker(ctx, op, dgst, total, false)
+}
+
+// emit emits the current Progress event. t.lock must be held, unless t is
+// not yet shared.
+func (t *Tracker) emit() {
+	if t.progress {
+		Emit(t.ctx, t.event)
+	}
+}
+
+// Add records that n more bytes of the operation have been processed.
+func (t *Tracker) Add(n int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.done || n <= 0 {
+		return
+	}
+	t.event.Current += n
+	t.emit()
+}
+
+// Reader returns an io.Reader which records the progress of the operation as
+// r is read.
+func (t *Tracker) Reader(r io.Reader) io.Reader {
+	return trackedReader{reader: r, tracker: t}
+}
+
+// Done emits the final Progress event of the operation (and the BlobDone
+// event, with the number of bytes processed as its Size, for blob
+// operations). If dgst is not empty, it is used as the digest of the events
+// (for operations where the digest is only known once they have completed).
+// If the operation failed, err is the error it failed with. Calling Done more
+// than once has no effect.
+func (t *Tracker) Done(dgst digest.Digest, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.done {
+		return
+	}
+	t.done = true
+	if dgst != "" {
+		t.event.Digest = dgst
+	}
+	t.event.Done = true
+	t.emit()
+	if t.blob {
+		Emit(t.ctx, Event{Type: BlobDone, Op: t.event.Op, Digest: t.event.Digest, Size: t.event.Current, Err: err})
+	}
+}
+
+// trackedReader is an io.Reader which records its progress with a Tracker.
+type trackedReader struct {
+	reader  io.Reader
+	tracker *Tracker
+}
+
+func (r trackedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.tracker.Add(int64(n))
+	return n, err
+}
+
+// blobReader is an io.ReadCloser which completes its Tracker when it is
+// closed.
+type blobReader struct {
+	io.Reader
+	closer  io.Closer
+	tracker *Tracker
+	err     error
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *blobReader) Close() error {
+	r.tracker.Done("", r.err)
+	return r.closer.Close()
+}
+
+// NewBlobReader starts tracking the reading of the blob with the given digest
+// and size (see StartBlob), and returns an io.ReadCloser wrapping rc which
+// records its progress. The BlobDone event (with the number of bytes read,
+// and the first error reading failed with) is emitted when it is closed.
+func NewBlobReader(ctx context.Context, dgst digest.Digest, size int64, rc io.ReadCloser) io.ReadCloser {
+	tracker := StartBlob(ctx, OpGet, dgst, size)
+	return &blobReader{
+		Reader:  tracker.Reader(rc),
+		closer:  rc,
+		tracker: tracker,
+	}
+}
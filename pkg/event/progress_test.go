@@ -0,0 +1,141 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package event
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// recordEvents returns a context whose events are appended to events, with
+// their times cleared.
+func recordEvents(events *[]Event) context.Context {
+	return WithHook(context.Background(), func(ev Event) {
+		ev.Time = time.Time{}
+		*events = append(*events, ev)
+	})
+}
+
+func TestTrackerLayer(t *testing.T) {
+	var events []Event
+	ctx := recordEvents(&events)
+
+	data := []byte("some data to read")
+	dgst := digest.FromBytes(data)
+	tracker := StartLayer(ctx, OpPack, "", -1)
+
+	if got, err := ioutil.ReadAll(tracker.Reader(bytes.NewReader(data))); err != nil {
+		t.Fatalf("unexpected error reading: %+v", err)
+	} else if !bytes.Equal(got, data) {
+		t.Errorf("unexpected data read: got %q, expected %q", got, data)
+	}
+	tracker.Done(dgst, nil)
+	tracker.Done("", nil)
+
+	if len(events) < 3 {
+		t.Fatalf("expected at least 3 events, got %#v", events)
+	}
+	if expected := (Event{Type: Progress, Op: OpPack, Total: -1}); !reflect.DeepEqual(events[0], expected) {
+		t.Errorf("unexpected initial event: got %#v, expected %#v", events[0], expected)
+	}
+	for idx, ev := range events[1 : len(events)-1] {
+		if ev.Type != Progress || ev.Done || ev.Current <= events[idx].Current {
+			t.Errorf("unexpected event %d: %#v", idx+1, ev)
+		}
+	}
+	expected := Event{Type: Progress, Op: OpPack, Digest: dgst, Current: int64(len(data)), Total: -1, Done: true}
+	if last := events[len(events)-1]; !reflect.DeepEqual(last, expected) {
+		t.Errorf("unexpected final event: got %#v, expected %#v", last, expected)
+	}
+}
+
+func TestTrackerBlob(t *testing.T) {
+	var events []Event
+	ctx := recordEvents(&events)
+
+	failed := errors.New("failed")
+	tracker := StartBlob(ctx, OpPut, "", -1)
+	tracker.Add(10)
+	tracker.Done("", failed)
+
+	expected := []Event{
+		{Type: BlobStart, Op: OpPut},
+		{Type: Progress, Op: OpPut, Total: -1},
+		{Type: Progress, Op: OpPut, Current: 10, Total: -1},
+		{Type: Progress, Op: OpPut, Current: 10, Total: -1, Done: true},
+		{Type: BlobDone, Op: OpPut, Size: 10, Err: failed},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("unexpected events: got %#v, expected %#v", events, expected)
+	}
+}
+
+func TestBlobReader(t *testing.T) {
+	var events []Event
+	ctx := recordEvents(&events)
+
+	data := []byte("some data to read")
+	dgst := digest.FromBytes(data)
+	rc := NewBlobReader(ctx, dgst, int64(len(data)), ioutil.NopCloser(bytes.NewReader(data)))
+
+	// Only read part of the blob.
+	if _, err := rc.Read(make([]byte, 4)); err != nil {
+		t.Fatalf("unexpected error reading: %+v", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %+v", err)
+	}
+	rc.Close()
+
+	size := int64(len(data))
+	expected := []Event{
+		{Type: BlobStart, Op: OpGet, Digest: dgst},
+		{Type: Progress, Op: OpGet, Digest: dgst, Current: 0, Total: size},
+		{Type: Progress, Op: OpGet, Digest: dgst, Current: 4, Total: size},
+		{Type: Progress, Op: OpGet, Digest: dgst, Current: 4, Total: size, Done: true},
+		{Type: BlobDone, Op: OpGet, Digest: dgst, Size: 4},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("unexpected events: got %#v, expected %#v", events, expected)
+	}
+}
+
+func TestWithoutProgress(t *testing.T) {
+	var events []Event
+	ctx := WithoutProgress(recordEvents(&events))
+
+	tracker := StartBlob(ctx, OpGet, "sha256:a", 10)
+	tracker.Add(10)
+	tracker.Done("", nil)
+
+	// Only the blob events are emitted.
+	expected := []Event{
+		{Type: BlobStart, Op: OpGet, Digest: "sha256:a"},
+		{Type: BlobDone, Op: OpGet, Digest: "sha256:a", Size: 10},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("unexpected events: got %#v, expected %#v", events, expected)
+	}
+}
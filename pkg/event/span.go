@@ -0,0 +1,115 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package event
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Span is a single traced operation. Attributes can be attached to a span
+// while it is in progress, and End must be called exactly once when the
+// operation has completed. A Span is safe for concurrent use.
+type Span struct {
+	lock     sync.Mutex
+	ctx      context.Context
+	name     string
+	id       string
+	parentID string
+	start    time.Time
+	fields   Fields
+}
+
+type spanKey struct{}
+
+// spanFromContext returns the span the given context is part of, or nil if it
+// isn't part of a traced operation.
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// newSpanID returns a random span ID, in the same format as the span IDs used
+// by OpenTelemetry (8 bytes encoded as hex).
+func newSpanID() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		// crypto/rand only fails if the system is very broken, and a span ID
+		// is not worth failing an operation over.
+		return ""
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// StartSpan starts tracing an operation with the given name (such as
+// "layer.UnpackManifest"), and emits its SpanStart event. The returned context
+// is part of the span, so any spans started with it are children of this span
+// (their ParentID is the SpanID of this span). The usual pattern is the
+// following (with a named error return value):
+//
+//	ctx, ctx, span := event.StartSpan(ctx, "package.Operation")
+//	defer func() { span.End(err) }()
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	span := &Span{
+		name:   name,
+		id:     newSpanID(),
+		start:  time.Now(),
+		fields: Fields{},
+	}
+	if parent := spanFromContext(ctx); parent != nil {
+		span.parentID = parent.id
+	}
+	span.ctx = context.WithValue(ctx, spanKey{}, span)
+
+	Emit(span.ctx, Event{
+		Type:     SpanStart,
+		Time:     span.start,
+		Name:     span.name,
+		SpanID:   span.id,
+		ParentID: span.parentID,
+	})
+	return span.ctx, span
+}
+
+// SetAttribute attaches a key-value attribute to the span, which is included
+// in the Fields of its SpanEnd event.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fields[key] = value
+}
+
+// End emits the SpanEnd event of the operation. If the operation failed, err
+// is the error returned by the operation.
+func (s *Span) End(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	Emit(s.ctx, Event{
+		Type:     SpanEnd,
+		Name:     s.name,
+		SpanID:   s.id,
+		ParentID: s.parentID,
+		Duration: time.Since(s.start),
+		Fields:   s.fields,
+		Err:      err,
+	})
+}
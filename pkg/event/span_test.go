@@ -0,0 +1,101 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package event
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func traced(ctx context.Context, fail bool) (err error) {
+	ctx, span := StartSpan(ctx, "test.Operation")
+	defer func() { span.End(err) }()
+	span.SetAttribute("fail", fail)
+
+	if fail {
+		return fmt.Errorf("failed")
+	}
+	return child(ctx)
+}
+
+func child(ctx context.Context) (err error) {
+	_, span := StartSpan(ctx, "test.Child")
+	defer func() { span.End(err) }()
+	return nil
+}
+
+func TestSpan(t *testing.T) {
+	var events []Event
+	ctx := recordEvents(&events)
+
+	traced(ctx, false)
+	traced(ctx, true)
+
+	if len(events) != 6 {
+		t.Fatalf("expected 6 events, got %#v", events)
+	}
+	for idx, expected := range []struct {
+		typ, name string
+		parent    int
+	}{
+		{SpanStart, "test.Operation", -1},
+		{SpanStart, "test.Child", 0},
+		{SpanEnd, "test.Child", 0},
+		{SpanEnd, "test.Operation", -1},
+		{SpanStart, "test.Operation", -1},
+		{SpanEnd, "test.Operation", -1},
+	} {
+		ev := events[idx]
+		if ev.Type != expected.typ || ev.Name != expected.name || ev.SpanID == "" {
+			t.Errorf("unexpected event %d: %#v", idx, ev)
+		}
+		var parentID string
+		if expected.parent >= 0 {
+			parentID = events[expected.parent].SpanID
+		}
+		if ev.ParentID != parentID {
+			t.Errorf("event %d has parent %q, expected %q", idx, ev.ParentID, parentID)
+		}
+	}
+
+	// Each span has its own ID, shared by its start and end events.
+	if events[0].SpanID != events[3].SpanID || events[1].SpanID != events[2].SpanID || events[4].SpanID != events[5].SpanID {
+		t.Errorf("start and end events have different span IDs: %#v", events)
+	}
+	if events[0].SpanID == events[1].SpanID || events[0].SpanID == events[4].SpanID {
+		t.Errorf("different spans have the same ID: %#v", events)
+	}
+
+	for idx, fail := range map[int]bool{3: false, 5: true} {
+		ev := events[idx]
+		if ev.Fields["fail"] != fail || (ev.Err != nil) != fail {
+			t.Errorf("unexpected event %d: %#v", idx, ev)
+		}
+		if ev.Duration <= 0 {
+			t.Errorf("event %d has no duration: %#v", idx, ev)
+		}
+	}
+
+	// Nothing is emitted if there is no Hook.
+	traced(WithHook(context.Background(), nil), false)
+	if len(events) != 6 {
+		t.Errorf("events emitted without a hook: %#v", events[6:])
+	}
+}
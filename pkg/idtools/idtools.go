@@ -18,6 +18,7 @@
 package idtools
 
 import (
+	"math"
 	"strconv"
 	"strings"
 
@@ -25,6 +26,19 @@ import (
 	"github.com/pkg/errors"
 )
 
+// maxInt is the largest value of an int, which is smaller than the largest ID
+// on 32-bit platforms.
+const maxInt = int(^uint(0) >> 1)
+
+// toInt converts a mapped ID to an int, returning an error if the ID does not
+// fit in a uint32 or an int rather than silently truncating it.
+func toInt(id uint64) (int, error) {
+	if id > math.MaxUint32 || id > uint64(maxInt) {
+		return -1, errors.Errorf("mapped id %d is out of range", id)
+	}
+	return int(id), nil
+}
+
 // ToHost translates a remapped container ID to an unmapped host ID using the
 // provided ID mapping. If no mapping is provided, then the mapping is a no-op.
 // If there is no mapping for the given ID an error is returned.
@@ -32,10 +46,13 @@ func ToHost(contID int, idMap []rspec.IDMapping) (int, error) {
 	if idMap == nil {
 		return contID, nil
 	}
+	if contID < 0 || int64(contID) > math.MaxUint32 {
+		return -1, errors.Errorf("container id %d is out of range", contID)
+	}
 
 	for _, m := range idMap {
 		if uint32(contID) >= m.ContainerID && uint32(contID) < m.ContainerID+m.Size {
-			return int(m.HostID + (uint32(contID) - m.ContainerID)), nil
+			return toInt(uint64(m.HostID) + uint64(uint32(contID)-m.ContainerID))
 		}
 	}
 
@@ -50,10 +67,13 @@ func ToContainer(hostID int, idMap []rspec.IDMapping) (int, error) {
 	if idMap == nil {
 		return hostID, nil
 	}
+	if hostID < 0 || int64(hostID) > math.MaxUint32 {
+		return -1, errors.Errorf("host id %d is out of range", hostID)
+	}
 
 	for _, m := range idMap {
 		if uint32(hostID) >= m.HostID && uint32(hostID) < m.HostID+m.Size {
-			return int(m.ContainerID + (uint32(hostID) - m.HostID)), nil
+			return toInt(uint64(m.ContainerID) + uint64(uint32(hostID)-m.HostID))
 		}
 	}
 
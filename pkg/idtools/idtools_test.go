@@ -18,6 +18,8 @@
 package idtools
 
 import (
+	"math"
+	"strconv"
 	"testing"
 
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
@@ -108,6 +110,47 @@ func TestToHostLarger(t *testing.T) {
 	}
 }
 
+func TestToHostOutOfRange(t *testing.T) {
+	if strconv.IntSize < 64 {
+		t.Skip("ids beyond 32 bits cannot be represented")
+	}
+
+	idMap := []rspec.IDMapping{
+		{
+			HostID:      8000,
+			ContainerID: 0,
+			Size:        1000,
+		},
+	}
+
+	// An id which would be truncated to a mapped id must not be mapped.
+	large := int64(1) << 32
+	if id, err := ToHost(int(large), idMap); err == nil {
+		t.Errorf("expected an error with container=%d, got %d", large, id)
+	}
+	if id, err := ToContainer(int(large)+8000, idMap); err == nil {
+		t.Errorf("expected an error with host=%d, got %d", large+8000, id)
+	}
+}
+
+func TestToHostMappedOutOfRange(t *testing.T) {
+	idMap := []rspec.IDMapping{
+		{
+			HostID:      math.MaxUint32 - 0x10,
+			ContainerID: 0,
+			Size:        0x100,
+		},
+	}
+
+	// A mapping which overflows must not wrap around to a small id.
+	if id, err := ToHost(0x20, idMap); err == nil {
+		t.Errorf("expected an error with container=%d, got %d", 0x20, id)
+	}
+	if id, err := ToContainer(0x20, []rspec.IDMapping{{HostID: 0, ContainerID: math.MaxUint32 - 0x10, Size: 0x100}}); err == nil {
+		t.Errorf("expected an error with host=%d, got %d", 0x20, id)
+	}
+}
+
 func TestToHostMultiple(t *testing.T) {
 	idMap := []rspec.IDMapping{
 		{
@@ -0,0 +1,112 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package idtools
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// SubIDRange is a range of subordinate IDs allocated to a user, as listed in
+// subuid(5) or subgid(5).
+type SubIDRange struct {
+	Start uint32
+	Count uint32
+}
+
+// ParseSubIDs parses a subuid(5) or subgid(5) file, and returns the ranges
+// allocated to the given user (which may be listed either by name or by
+// numeric ID) in the order they are listed.
+func ParseSubIDs(r io.Reader, name string, id int) ([]SubIDRange, error) {
+	idStr := strconv.Itoa(id)
+
+	var ranges []SubIDRange
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 {
+			return nil, errors.Errorf("invalid subid entry %q: must be of the form name:start:count", line)
+		}
+		if parts[0] != idStr && (name == "" || parts[0] != name) {
+			continue
+		}
+		start, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid start in subid entry %q", line)
+		}
+		count, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid count in subid entry %q", line)
+		}
+		if count == 0 {
+			continue
+		}
+		ranges = append(ranges, SubIDRange{
+			Start: uint32(start),
+			Count: uint32(count),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read subid entries")
+	}
+	return ranges, nil
+}
+
+// ReadSubIDs is a wrapper around ParseSubIDs which reads the given file.
+func ReadSubIDs(path, name string, id int) ([]SubIDRange, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open subid file")
+	}
+	defer fh.Close()
+	return ParseSubIDs(fh, name, id)
+}
+
+// SubIDMappings returns the ID mappings which map the container root user to
+// the given host ID and every other container ID (starting from 1) to the
+// given subordinate ID ranges, in order. This is the same layout used by
+// other rootless container tools.
+func SubIDMappings(hostID int, ranges []SubIDRange) []rspec.IDMapping {
+	mappings := []rspec.IDMapping{
+		{
+			HostID:      uint32(hostID),
+			ContainerID: 0,
+			Size:        1,
+		},
+	}
+	next := uint32(1)
+	for _, r := range ranges {
+		mappings = append(mappings, rspec.IDMapping{
+			HostID:      r.Start,
+			ContainerID: next,
+			Size:        r.Count,
+		})
+		next += r.Count
+	}
+	return mappings
+}
@@ -0,0 +1,82 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package idtools
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseSubIDs(t *testing.T) {
+	subids := `# comment
+alice:100000:65536
+bob:165536:65536
+
+1000:300000:1000
+alice:400000:0
+alice:500000:10
+`
+
+	for _, test := range []struct {
+		name     string
+		id       int
+		expected []SubIDRange
+	}{
+		{"alice", 1000, []SubIDRange{{100000, 65536}, {300000, 1000}, {500000, 10}}},
+		{"bob", 1001, []SubIDRange{{165536, 65536}}},
+		{"", 1000, []SubIDRange{{300000, 1000}}},
+		{"eve", 1002, nil},
+	} {
+		ranges, err := ParseSubIDs(strings.NewReader(subids), test.name, test.id)
+		if err != nil {
+			t.Errorf("unexpected error parsing subids for %s(%d): %+v", test.name, test.id, err)
+			continue
+		}
+		if !reflect.DeepEqual(ranges, test.expected) {
+			t.Errorf("unexpected subids for %s(%d): expected %v, got %v", test.name, test.id, test.expected, ranges)
+		}
+	}
+}
+
+func TestParseSubIDsInvalid(t *testing.T) {
+	for _, subids := range []string{
+		"alice:100000",
+		"alice:start:65536",
+		"alice:100000:-1",
+		"alice:100000:65536:1",
+	} {
+		if _, err := ParseSubIDs(strings.NewReader(subids), "alice", 1000); err == nil {
+			t.Errorf("expected an error parsing %q", subids)
+		}
+	}
+}
+
+func TestSubIDMappings(t *testing.T) {
+	mappings := SubIDMappings(1000, []SubIDRange{{100000, 65536}, {300000, 1000}})
+	expected := []rspec.IDMapping{
+		{HostID: 1000, ContainerID: 0, Size: 1},
+		{HostID: 100000, ContainerID: 1, Size: 65536},
+		{HostID: 300000, ContainerID: 65537, Size: 1000},
+	}
+	if !reflect.DeepEqual(mappings, expected) {
+		t.Errorf("unexpected mappings: expected %v, got %v", expected, mappings)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package journal records the changes made to a root filesystem (as reported
+// by the kernel) in a journal, so that the changes can be found without
+// walking the whole tree. It is used by umoci-repack(1) to generate layers
+// for large bundles more quickly.
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Version is the version of the journal format written by this version of
+// umoci. Journals with a different version cannot be read.
+const Version = 1
+
+// Record is a single line of a journal.
+type Record struct {
+	// Version and From are only set in the header of the journal (the first
+	// record). From is the digest of the manifest the root filesystem was
+	// unpacked from, to make sure the journal is used with the right bundle.
+	Version int           `json:"version,omitempty"`
+	From    digest.Digest `json:"from,omitempty"`
+
+	// Path is the path (relative to the root) of an inode that was changed.
+	// If Recursive is set, everything inside Path may have changed as well.
+	Path      string `json:"path,omitempty"`
+	Recursive bool   `json:"recursive,omitempty"`
+
+	// Overflow indicates that some changes could not be recorded, and so the
+	// journal cannot be used to find all of the changes.
+	Overflow bool `json:"overflow,omitempty"`
+}
+
+// Writer appends records to a journal. Every record is written to the file
+// immediately, so that the journal can be read while changes are still being
+// recorded.
+type Writer struct {
+	fh       *os.File
+	from     digest.Digest
+	recorded map[string]bool
+}
+
+// Create creates a new journal at the given path, which must not already
+// exist. The header is only written once Start is called.
+func Create(path string, from digest.Digest) (*Writer, error) {
+	fh, err := os.OpenFile(path, os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "create journal")
+	}
+	return &Writer{
+		fh:       fh,
+		from:     from,
+		recorded: map[string]bool{},
+	}, nil
+}
+
+func (w *Writer) write(record Record) error {
+	// Each record is written with a single write so that readers never see
+	// part of a record (unless it is still being written).
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "encode record")
+	}
+	_, err = w.fh.Write(append(data, '\n'))
+	return errors.Wrap(err, "write record")
+}
+
+// Start writes the header of the journal. A journal without a header is not
+// valid, so this must only be called once every change will be recorded.
+func (w *Writer) Start() error {
+	return w.write(Record{
+		Version: Version,
+		From:    w.from,
+	})
+}
+
+// Record records that the inode at the given path (relative to the root) was
+// changed. If recursive is set, everything inside the path may have changed
+// as well. Paths that have already been recorded are not written again.
+func (w *Writer) Record(path string, recursive bool) error {
+	path = filepath.Clean(path)
+	if seen, ok := w.recorded[path]; ok && (seen || !recursive) {
+		return nil
+	}
+	w.recorded[path] = recursive
+	return w.write(Record{
+		Path:      path,
+		Recursive: recursive,
+	})
+}
+
+// Overflow records that some changes could not be recorded.
+func (w *Writer) Overflow() error {
+	return w.write(Record{Overflow: true})
+}
+
+// Close closes the journal.
+func (w *Writer) Close() error {
+	return w.fh.Close()
+}
+
+// Journal is the set of changes recorded in a journal.
+type Journal struct {
+	// From is the digest of the manifest the root filesystem was unpacked
+	// from.
+	From digest.Digest
+
+	// Paths is the set of changed paths (relative to the root). If the value
+	// of a path is true, everything inside the path may have changed as well.
+	Paths map[string]bool
+
+	// Complete is whether every change was recorded. If it is false, Paths
+	// cannot be used to find all of the changes.
+	Complete bool
+}
+
+// Read parses a journal written by Writer.
+func Read(r io.Reader) (*Journal, error) {
+	journal := &Journal{
+		Paths:    map[string]bool{},
+		Complete: true,
+	}
+
+	reader := bufio.NewReader(r)
+	for idx := 0; ; idx++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) != 0 {
+				return nil, errors.Errorf("truncated record %d", idx)
+			}
+			if idx == 0 {
+				return nil, errors.Errorf("journal has no header")
+			}
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "read record")
+		}
+
+		var record Record
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		if err := decoder.Decode(&record); err != nil {
+			return nil, errors.Wrapf(err, "decode record %d", idx)
+		}
+
+		if idx == 0 {
+			if record.Version != Version {
+				return nil, errors.Errorf("unsupported journal version: %d", record.Version)
+			}
+			journal.From = record.From
+			continue
+		}
+		if record.Overflow {
+			journal.Complete = false
+		}
+		if record.Path != "" {
+			path := filepath.Clean(record.Path)
+			journal.Paths[path] = journal.Paths[path] || record.Recursive
+		}
+	}
+	return journal, nil
+}
@@ -0,0 +1,124 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package journal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestJournal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "journal")
+	from := digest.FromString("manifest")
+
+	w, err := Create(path, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []struct {
+		path      string
+		recursive bool
+	}{
+		{"a/b", false},
+		{"a/b/", false},
+		{"./c", false},
+		{"c", true},
+		{"c", false},
+	} {
+		if err := w.Record(record.path, record.recursive); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Already recorded paths are not written again.
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 4 {
+		t.Errorf("expected 4 records in journal, got %d:\n%s", lines, data)
+	}
+
+	journal, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if journal.From != from {
+		t.Errorf("expected from %s, got %s", from, journal.From)
+	}
+	if !journal.Complete {
+		t.Errorf("expected journal to be complete")
+	}
+	if len(journal.Paths) != 2 || journal.Paths["a/b"] || !journal.Paths["c"] {
+		t.Errorf("unexpected paths in journal: %v", journal.Paths)
+	}
+
+	// The journal cannot be created twice.
+	if _, err := Create(path, from); !os.IsExist(errors.Cause(err)) {
+		t.Errorf("expected creating existing journal to fail with EEXIST: %v", err)
+	}
+}
+
+func TestJournalOverflow(t *testing.T) {
+	data := `{"version":1,"from":"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}
+{"path":"a"}
+{"overflow":true}
+`
+	journal, err := Read(bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if journal.Complete {
+		t.Errorf("expected journal with overflow to be incomplete")
+	}
+}
+
+func TestJournalInvalid(t *testing.T) {
+	for _, data := range []string{
+		// No header.
+		``,
+		// Unknown version.
+		`{"version":2}` + "\n",
+		// Truncated record.
+		`{"version":1}` + "\n" + `{"path":"a"`,
+		// Invalid record.
+		`{"version":1}` + "\n" + `not json` + "\n",
+	} {
+		if _, err := Read(bytes.NewBufferString(data)); err == nil {
+			t.Errorf("expected error reading invalid journal %q", data)
+		}
+	}
+}
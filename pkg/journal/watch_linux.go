@@ -0,0 +1,241 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package journal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// watchMask is the set of inotify(7) events which indicate that an inode was
+// changed (or that the watched directory was removed).
+const watchMask = syscall.IN_ATTRIB | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF | syscall.IN_DONT_FOLLOW | syscall.IN_ONLYDIR
+
+// watcher records the changes reported by inotify(7) for a tree.
+type watcher struct {
+	root    string
+	fd      int
+	fh      *os.File
+	journal *Writer
+
+	// watches maps each watch descriptor to the directory (relative to
+	// root) it watches, and paths is the inverse mapping.
+	watches map[int32]string
+	paths   map[string]int32
+}
+
+// Watch records every change made to the tree at root in the journal, until
+// stop is closed. Every directory in the tree is watched with inotify(7), and
+// the header of the journal is only written once the whole tree is being
+// watched (changes made before then are not recorded). If changes could not
+// be recorded (because the kernel dropped events, or because watching new
+// directories failed) the journal is marked as incomplete.
+//
+// Note that inotify(7) only reports changes made through paths inside the
+// tree, so changes made through hardlinks from outside the tree are not
+// recorded.
+func Watch(root string, journal *Writer, stop <-chan struct{}) (err error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return errors.Wrap(err, "inotify init")
+	}
+	// Since the descriptor is non-blocking, reads can be interrupted by
+	// closing the file. Note that fh.Fd() must not be used, as it would
+	// make the descriptor blocking again.
+	w := &watcher{
+		root:    root,
+		fd:      fd,
+		fh:      os.NewFile(uintptr(fd), "inotify"),
+		journal: journal,
+		watches: map[int32]string{},
+		paths:   map[string]int32{},
+	}
+	defer w.fh.Close()
+
+	if err := w.watchTree("."); err != nil {
+		return errors.Wrap(err, "watch tree")
+	}
+	if err := journal.Start(); err != nil {
+		return errors.Wrap(err, "start journal")
+	}
+	// Don't let anyone use a journal that is missing changes.
+	defer func() {
+		if err != nil {
+			journal.Overflow()
+		}
+	}()
+	log.Infof("journal: watching %d directories in %s", len(w.watches), root)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			w.fh.Close()
+		case <-done:
+		}
+	}()
+
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.fh.Read(buffer)
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			return errors.Wrap(err, "read inotify events")
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			offset += syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buffer[offset:offset+int(event.Len)]), "\x00")
+			offset += int(event.Len)
+
+			if err := w.handle(event.Wd, event.Mask, name); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handle records the change described by an inotify(7) event.
+func (w *watcher) handle(wd int32, mask uint32, name string) error {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		log.Warnf("journal: inotify event queue overflowed, the journal is incomplete")
+		return w.journal.Overflow()
+	}
+	dir, ok := w.watches[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		w.unwatch(wd)
+		return nil
+	}
+	if !ok {
+		// An event from a directory that was moved (which has already been
+		// recorded as a whole in its new location).
+		return nil
+	}
+
+	if name == "" {
+		if mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0 {
+			if dir == "." {
+				return errors.Errorf("root %s was removed", w.root)
+			}
+			// Already recorded through the event of the parent directory.
+			return nil
+		}
+		return w.journal.Record(dir, false)
+	}
+
+	path := filepath.Join(dir, name)
+	isDir := mask&syscall.IN_ISDIR != 0
+	switch {
+	case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		// The contents of a new directory may have been changed before we
+		// could start watching it, so everything inside it is recorded.
+		if err := w.journal.Record(dir, false); err != nil {
+			return err
+		}
+		if err := w.journal.Record(path, isDir); err != nil {
+			return err
+		}
+		if isDir {
+			return w.watchTree(path)
+		}
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		if err := w.journal.Record(dir, false); err != nil {
+			return err
+		}
+		if err := w.journal.Record(path, false); err != nil {
+			return err
+		}
+		if isDir && mask&syscall.IN_MOVED_FROM != 0 {
+			w.unwatchTree(path)
+		}
+	default:
+		return w.journal.Record(path, false)
+	}
+	return nil
+}
+
+// watchTree adds a watch for every directory in the tree at path (relative to
+// the root).
+func (w *watcher) watchTree(path string) error {
+	return filepath.Walk(filepath.Join(w.root, path), func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The tree is being modified while we walk it.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(w.root, fullPath)
+		if err != nil {
+			return err
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, fullPath, watchMask)
+		if err != nil {
+			if err == syscall.ENOENT || err == syscall.ENOTDIR {
+				return nil
+			}
+			if err == syscall.ENOSPC {
+				return errors.Wrapf(err, "add watch for %s (is fs.inotify.max_user_watches too low?)", relPath)
+			}
+			return errors.Wrapf(err, "add watch for %s", relPath)
+		}
+		w.watches[int32(wd)] = relPath
+		w.paths[relPath] = int32(wd)
+		return nil
+	})
+}
+
+// unwatch forgets about a watch descriptor.
+func (w *watcher) unwatch(wd int32) {
+	path, ok := w.watches[wd]
+	if !ok {
+		return
+	}
+	delete(w.watches, wd)
+	if w.paths[path] == wd {
+		delete(w.paths, path)
+	}
+}
+
+// unwatchTree removes the watches of every directory in the tree at path
+// (relative to the root), which has been moved.
+func (w *watcher) unwatchTree(path string) {
+	for dir, wd := range w.paths {
+		if dir == path || strings.HasPrefix(dir, path+"/") {
+			// The watch may already have been removed by the kernel.
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			w.unwatch(wd)
+		}
+	}
+}
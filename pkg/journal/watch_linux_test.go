@@ -0,0 +1,141 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// waitForJournal waits until the journal contains the given paths, and returns
+// the parsed journal.
+func waitForJournal(t *testing.T, path string, paths ...string) *Journal {
+	var journal *Journal
+	for attempt := 0; attempt < 100; attempt++ {
+		fh, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		journal, err = Read(fh)
+		fh.Close()
+		if err == nil {
+			found := true
+			for _, path := range paths {
+				if _, ok := journal.Paths[path]; !ok {
+					found = false
+				}
+			}
+			if found {
+				return journal
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("journal never contained %v: %v", paths, journal)
+	return nil
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestWatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "rootfs")
+	for _, path := range []string{"unchanged", "a/b", "moved/inner"} {
+		if err := os.MkdirAll(filepath.Join(root, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "a", "b", "file"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "a", "removed"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	journalPath := filepath.Join(dir, "journal")
+	w, err := Create(journalPath, digest.FromString("manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	stop := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Watch(root, w, stop)
+	}()
+
+	// Wait for the watches to be set up.
+	waitForJournal(t, journalPath)
+
+	if err := ioutil.WriteFile(filepath.Join(root, "a", "b", "file"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "a", "removed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "new", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(root, "moved"), filepath.Join(root, "a", "moved")); err != nil {
+		t.Fatal(err)
+	}
+	waitForJournal(t, journalPath, "a/b/file", "a/removed", "new", "a/moved")
+
+	// Directories created later (and moved directories) are watched too.
+	if err := ioutil.WriteFile(filepath.Join(root, "new", "dir", "file"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "a", "moved", "inner", "file"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	journal := waitForJournal(t, journalPath, "new/dir/file", "a/moved/inner/file")
+
+	close(stop)
+	if err := <-errCh; err != nil {
+		t.Fatalf("unexpected watch error: %v", err)
+	}
+
+	if !journal.Complete {
+		t.Errorf("expected journal to be complete")
+	}
+	for path, recursive := range map[string]bool{
+		".":        false,
+		"a":        false,
+		"a/b/file": false,
+		"new":      true,
+		"a/moved":  true,
+	} {
+		if got, ok := journal.Paths[path]; !ok || got != recursive {
+			t.Errorf("expected %s to be recorded (recursive=%t): %v", path, recursive, journal.Paths)
+		}
+	}
+	for path := range journal.Paths {
+		if path == "unchanged" || filepath.Dir(path) == "unchanged" {
+			t.Errorf("unchanged path %s was recorded", path)
+		}
+	}
+}
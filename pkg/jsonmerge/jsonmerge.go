@@ -0,0 +1,305 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package jsonmerge implements the preservation of unknown fields when a JSON
+// document is parsed into a Go type, modified and then re-serialised. This is
+// necessary because the OCI specification allows for (and other tools make
+// use of) extension fields in manifests, configurations and indexes, which
+// would otherwise be silently dropped by umoci when modifying an image.
+package jsonmerge
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// object is a JSON object which retains the order of its keys, so that
+// re-serialising a document doesn't reorder its fields.
+type object struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newObject() *object {
+	return &object{values: map[string]interface{}{}}
+}
+
+func (o *object) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// MarshalJSON implements json.Marshaler.
+func (o *object) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for idx, key := range o.keys {
+		if idx > 0 {
+			buffer.WriteByte(',')
+		}
+		keyData, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		valueData, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(keyData)
+		buffer.WriteByte(':')
+		buffer.Write(valueData)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// decode parses the first JSON value in data into a generic tree made of
+// *object, []interface{}, string, json.Number, bool and nil.
+func decode(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decodeValue(decoder)
+}
+
+func decodeValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	delim, ok := token.(json.Delim)
+	if !ok {
+		return token, nil
+	}
+	switch delim {
+	case '{':
+		obj := newObject()
+		for decoder.More() {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := keyToken.(string)
+			if !ok {
+				return nil, errors.Errorf("unexpected object key %v", keyToken)
+			}
+			value, err := decodeValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(key, value)
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	case '[':
+		array := []interface{}{}
+		for decoder.More() {
+			value, err := decodeValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		return array, nil
+	}
+	return nil, errors.Errorf("unexpected delimiter %v", delim)
+}
+
+// unknownValue is a value (in an object) which is entirely unknown to the Go
+// type, as opposed to a nested set of unknown fields.
+type unknownValue struct {
+	value interface{}
+}
+
+// arrayEntry describes the unknown fields (ext) of an array element, along
+// with the known contents of that element (used to match it in the updated
+// array).
+type arrayEntry struct {
+	known interface{}
+	ext   interface{}
+}
+
+// unknownArray describes the unknown fields of the elements of an array.
+type unknownArray struct {
+	entries []arrayEntry
+}
+
+// unknown returns the parts of original which are not present in known (the
+// same document after being round-tripped through the Go type), or nil if
+// there are none.
+func unknown(original, known interface{}) interface{} {
+	switch orig := original.(type) {
+	case *object:
+		knownObj, ok := known.(*object)
+		if !ok {
+			return nil
+		}
+		ext := newObject()
+		for _, key := range orig.keys {
+			knownValue, ok := knownObj.values[key]
+			if !ok {
+				ext.set(key, unknownValue{orig.values[key]})
+				continue
+			}
+			if sub := unknown(orig.values[key], knownValue); sub != nil {
+				ext.set(key, sub)
+			}
+		}
+		if len(ext.keys) == 0 {
+			return nil
+		}
+		return ext
+
+	case []interface{}:
+		knownArray, ok := known.([]interface{})
+		if !ok || len(knownArray) != len(orig) {
+			return nil
+		}
+		ext := &unknownArray{}
+		for idx, elem := range orig {
+			if sub := unknown(elem, knownArray[idx]); sub != nil {
+				ext.entries = append(ext.entries, arrayEntry{
+					known: knownArray[idx],
+					ext:   sub,
+				})
+			}
+		}
+		if len(ext.entries) == 0 {
+			return nil
+		}
+		return ext
+	}
+	return nil
+}
+
+// apply adds the unknown fields in ext (as returned by unknown) to updated.
+// Unknown fields are only added to objects which are still present in
+// updated, and the unknown fields of an array element are only added to an
+// element whose known contents are unchanged (the array may have been
+// reordered or modified).
+func apply(updated, ext interface{}) interface{} {
+	switch e := ext.(type) {
+	case *object:
+		updatedObj, ok := updated.(*object)
+		if !ok {
+			return updated
+		}
+		for _, key := range e.keys {
+			updatedValue, present := updatedObj.values[key]
+			switch value := e.values[key].(type) {
+			case unknownValue:
+				if !present {
+					updatedObj.set(key, value.value)
+				}
+			default:
+				if present {
+					updatedObj.values[key] = apply(updatedValue, value)
+				}
+			}
+		}
+		return updatedObj
+
+	case *unknownArray:
+		updatedArray, ok := updated.([]interface{})
+		if !ok {
+			return updated
+		}
+		used := make([]bool, len(e.entries))
+		for idx, elem := range updatedArray {
+			for entryIdx, entry := range e.entries {
+				if !used[entryIdx] && reflect.DeepEqual(elem, entry.known) {
+					updatedArray[idx] = apply(elem, entry.ext)
+					used[entryIdx] = true
+					break
+				}
+			}
+		}
+		return updatedArray
+	}
+	return updated
+}
+
+// Preserve returns a value to be serialised in place of updated, which
+// includes all of the fields in the original JSON document that are unknown
+// to the type of updated (which must be the type original was parsed into,
+// or a pointer to it). If original has no unknown fields (or original is
+// nil), updated is returned unmodified so that its serialisation is
+// unchanged. Otherwise the returned value is a json.RawMessage, where the
+// unknown fields of each object are placed after its known fields.
+//
+// Note that a field present in original but omitted by the Go type when
+// serialised (such as an empty field tagged with omitempty) is treated as an
+// unknown field.
+func Preserve(original []byte, updated interface{}) (interface{}, error) {
+	if original == nil {
+		return updated, nil
+	}
+
+	originalValue, err := decode(original)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode original")
+	}
+
+	// Figure out which parts of the original are known to the Go type, by
+	// round-tripping the original through it.
+	typ := reflect.TypeOf(updated)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	parsed := reflect.New(typ).Interface()
+	if err := json.NewDecoder(bytes.NewReader(original)).Decode(parsed); err != nil {
+		return nil, errors.Wrap(err, "parse original")
+	}
+	knownData, err := json.Marshal(parsed)
+	if err != nil {
+		return nil, errors.Wrap(err, "encode original")
+	}
+	knownValue, err := decode(knownData)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode known original")
+	}
+
+	ext := unknown(originalValue, knownValue)
+	if ext == nil {
+		return updated, nil
+	}
+
+	updatedData, err := json.Marshal(updated)
+	if err != nil {
+		return nil, errors.Wrap(err, "encode updated")
+	}
+	updatedValue, err := decode(updatedData)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode updated")
+	}
+
+	merged, err := json.Marshal(apply(updatedValue, ext))
+	if err != nil {
+		return nil, errors.Wrap(err, "encode merged")
+	}
+	return json.RawMessage(merged), nil
+}
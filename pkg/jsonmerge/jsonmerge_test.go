@@ -0,0 +1,119 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jsonmerge
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type testInner struct {
+	Name string `json:"name"`
+}
+
+type testDoc struct {
+	Version int               `json:"version"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Inner   *testInner        `json:"inner,omitempty"`
+	Items   []testInner       `json:"items,omitempty"`
+}
+
+func TestPreserveNoUnknown(t *testing.T) {
+	for _, original := range [][]byte{
+		nil,
+		[]byte(`{"version":1,"labels":{"a":"b","vendor.x":"y"}}`),
+		[]byte(`{"items":[{"name":"a"}],"version":2}`),
+	} {
+		updated := &testDoc{Version: 3}
+		got, err := Preserve(original, updated)
+		if err != nil {
+			t.Fatalf("unexpected error preserving %s: %+v", original, err)
+		}
+		if got != updated {
+			t.Errorf("expected updated to be returned unmodified for %s: got %#v", original, got)
+		}
+	}
+}
+
+func TestPreserve(t *testing.T) {
+	for _, test := range []struct {
+		original string
+		updated  testDoc
+		expected string
+	}{
+		// Top-level unknown fields are placed after the known fields.
+		{
+			original: `{"x-vendor":{"a":[1,2.50]},"version":1}`,
+			updated:  testDoc{Version: 2},
+			expected: `{"version":2,"x-vendor":{"a":[1,2.50]}}`,
+		},
+		// Unknown fields in nested objects are preserved, unless the object
+		// was removed.
+		{
+			original: `{"version":1,"inner":{"name":"a","extra":true}}`,
+			updated:  testDoc{Version: 1, Inner: &testInner{Name: "b"}},
+			expected: `{"version":1,"inner":{"name":"b","extra":true}}`,
+		},
+		{
+			original: `{"version":1,"inner":{"name":"a","extra":true}}`,
+			updated:  testDoc{Version: 1},
+			expected: `{"version":1}`,
+		},
+		// Unknown fields of array elements follow the (unchanged) element.
+		{
+			original: `{"version":1,"items":[{"name":"a","x":1},{"name":"b"},{"name":"c","x":3}]}`,
+			updated:  testDoc{Version: 1, Items: []testInner{{Name: "c"}, {Name: "d"}, {Name: "a"}}},
+			expected: `{"version":1,"items":[{"name":"c","x":3},{"name":"d"},{"name":"a","x":1}]}`,
+		},
+		// Known fields which are changed are not overwritten.
+		{
+			original: `{"version":1,"labels":{"a":"b"},"unknown":null}`,
+			updated:  testDoc{Version: 1, Labels: map[string]string{"c": "d"}},
+			expected: `{"version":1,"labels":{"c":"d"},"unknown":null}`,
+		},
+	} {
+		got, err := Preserve([]byte(test.original), &test.updated)
+		if err != nil {
+			t.Fatalf("unexpected error preserving %s: %+v", test.original, err)
+		}
+		raw, ok := got.(json.RawMessage)
+		if !ok {
+			t.Errorf("expected json.RawMessage for %s: got %T", test.original, got)
+			continue
+		}
+		if string(raw) != test.expected {
+			t.Errorf("unexpected result for %s: expected %s, got %s", test.original, test.expected, raw)
+		}
+
+		// The result must still parse as the same Go value.
+		var parsed testDoc
+		if err := json.Unmarshal(raw, &parsed); err != nil {
+			t.Errorf("unexpected error parsing %s: %+v", raw, err)
+		}
+		if !reflect.DeepEqual(parsed, test.updated) {
+			t.Errorf("result %s doesn't parse as updated value: expected %#v, got %#v", raw, test.updated, parsed)
+		}
+	}
+}
+
+func TestPreserveInvalid(t *testing.T) {
+	if _, err := Preserve([]byte(`{"version":`), &testDoc{}); err == nil {
+		t.Errorf("expected an error with invalid original")
+	}
+}
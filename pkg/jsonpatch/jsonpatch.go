@@ -0,0 +1,459 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package jsonpatch implements JSON Patch (RFC 6902), which describes a set
+// of modifications to a JSON document (using JSON Pointers, as described in
+// RFC 6901, to refer to the parts of the document being modified). This is
+// used to allow arbitrary modifications of image configurations, including
+// of fields which umoci doesn't otherwise know about.
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrTestFailed is returned by Patch.Apply if a "test" operation failed.
+var ErrTestFailed = fmt.Errorf("test operation failed")
+
+// Operation is a single operation of a JSON Patch.
+type Operation struct {
+	// Op is the operation to perform ("add", "remove", "replace", "move",
+	// "copy" or "test").
+	Op string `json:"op"`
+
+	// Path is the JSON Pointer to the target of the operation.
+	Path string `json:"path"`
+
+	// From is the JSON Pointer to the source of a "move" or "copy" operation.
+	From string `json:"from,omitempty"`
+
+	// Value is the value used by "add", "replace" and "test" operations.
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Patch is a JSON Patch, which is applied by applying each of its operations
+// in order.
+type Patch []Operation
+
+// Parse parses a JSON Patch document.
+func Parse(data []byte) (Patch, error) {
+	var patch Patch
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, errors.Wrap(err, "parse json patch")
+	}
+	for idx, op := range patch {
+		if err := op.validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid operation %d", idx)
+		}
+	}
+	return patch, nil
+}
+
+func (op Operation) validate() error {
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return errors.Errorf("%s operation is missing a value", op.Op)
+		}
+	case "move", "copy":
+		if _, err := parsePointer(op.From); err != nil {
+			return errors.Wrap(err, "parse from")
+		}
+	case "remove":
+	default:
+		return errors.Errorf("unknown operation %q", op.Op)
+	}
+	if _, err := parsePointer(op.Path); err != nil {
+		return errors.Wrap(err, "parse path")
+	}
+	return nil
+}
+
+// Apply applies the patch to the given JSON document, and returns the
+// modified document. The patch is applied atomically, if any operation fails
+// then an error is returned (an error wrapping ErrTestFailed if a "test"
+// operation failed). Note that the keys of all objects in the returned
+// document are sorted.
+func (p Patch) Apply(data []byte) ([]byte, error) {
+	doc, err := decode(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse document")
+	}
+	for idx, op := range p {
+		doc, err = op.apply(doc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "apply operation %d (%s %s)", idx, op.Op, op.Path)
+		}
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, errors.Wrap(err, "encode document")
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+// decode parses a JSON value into a generic tree made of
+// map[string]interface{}, []interface{}, string, json.Number, bool and nil.
+func decode(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.Errorf("unexpected data after json value")
+	}
+	return value, nil
+}
+
+func (op Operation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse path")
+	}
+
+	switch op.Op {
+	case "add":
+		value, err := decode(op.Value)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse value")
+		}
+		return add(doc, path, value)
+
+	case "remove":
+		doc, _, err := remove(doc, path)
+		return doc, err
+
+	case "replace":
+		value, err := decode(op.Value)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse value")
+		}
+		if len(path) == 0 {
+			return value, nil
+		}
+		if _, err := get(doc, path); err != nil {
+			return nil, err
+		}
+		doc, _, err = remove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+
+	case "move":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse from")
+		}
+		if isPrefix(from, path) {
+			if len(from) == len(path) {
+				return doc, nil
+			}
+			return nil, errors.Errorf("cannot move %s into one of its children", op.From)
+		}
+		doc, value, err := remove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+
+	case "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse from")
+		}
+		value, err := get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, deepCopy(value))
+
+	case "test":
+		expected, err := decode(op.Value)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse value")
+		}
+		value, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(value, expected) {
+			return nil, errors.Wrapf(ErrTestFailed, "value at %s is %s", op.Path, mustMarshal(value))
+		}
+		return doc, nil
+	}
+	return nil, errors.Errorf("unknown operation %q", op.Op)
+}
+
+// parsePointer splits a JSON Pointer into its (unescaped) reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.Errorf("json pointer %q must start with '/'", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for idx, token := range tokens {
+		tokens[idx] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// isPrefix returns whether prefix is a (not necessarily proper) prefix of path.
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for idx := range prefix {
+		if prefix[idx] != path[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses a reference token used to index an array of the given
+// length. If end is set, the index may refer to the end of the array (either
+// with "-" or an index equal to the length).
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if end && token == "-" {
+		return length, nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') || strings.TrimLeft(token, "0123456789") != "" {
+		return -1, errors.Errorf("invalid array index %q", token)
+	}
+	idx, err := strconv.Atoi(token)
+	if err != nil {
+		return -1, errors.Wrapf(err, "invalid array index %q", token)
+	}
+	if idx > length || (idx == length && !end) {
+		return -1, errors.Errorf("array index %d out of range", idx)
+	}
+	return idx, nil
+}
+
+// get returns the value referenced by path.
+func get(doc interface{}, path []string) (interface{}, error) {
+	for idx, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, errors.Errorf("path %s does not exist", formatPointer(path[:idx+1]))
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, errors.Wrapf(err, "path %s", formatPointer(path[:idx+1]))
+			}
+			doc = node[i]
+		default:
+			return nil, errors.Errorf("path %s does not exist", formatPointer(path[:idx+1]))
+		}
+	}
+	return doc, nil
+}
+
+// modify calls fn with the container referenced by all but the last token of
+// path (and the last token), and replaces the container with the value
+// returned by fn. The modified document is returned.
+func modify(doc interface{}, path []string, fn func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[path[0]]
+		if !ok {
+			return nil, errors.Errorf("path component %q does not exist", path[0])
+		}
+		child, err := modify(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		node[path[0]] = child
+		return node, nil
+	case []interface{}:
+		idx, err := arrayIndex(path[0], len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := modify(node[idx], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		node[idx] = child
+		return node, nil
+	}
+	return nil, errors.Errorf("path component %q does not exist", path[0])
+}
+
+// add adds value at path (replacing the whole document if path is empty),
+// and returns the modified document.
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return modify(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			idx, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[idx+1:], node[idx:])
+			node[idx] = value
+			return node, nil
+		}
+		return nil, errors.Errorf("cannot add %q to a non-container value", token)
+	})
+}
+
+// remove removes the value at path, and returns the modified document and
+// the removed value.
+func remove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.Errorf("cannot remove the whole document")
+	}
+	var removed interface{}
+	doc, err := modify(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, errors.Errorf("path %s does not exist", formatPointer(path))
+			}
+			removed = value
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			idx, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[idx]
+			return append(node[:idx], node[idx+1:]...), nil
+		}
+		return nil, errors.Errorf("path %s does not exist", formatPointer(path))
+	})
+	return doc, removed, err
+}
+
+// Pointer returns the JSON Pointer (RFC 6901) referring to the value at the
+// given path of reference tokens, escaping each token as necessary.
+func Pointer(tokens ...string) string {
+	return formatPointer(tokens)
+}
+
+// formatPointer is the inverse of parsePointer.
+func formatPointer(path []string) string {
+	var pointer string
+	for _, token := range path {
+		pointer += "/" + strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+	}
+	return pointer
+}
+
+// deepCopy returns a copy of a generic JSON value (as returned by decode)
+// which shares no containers with the original.
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		obj := map[string]interface{}{}
+		for key, elem := range v {
+			obj[key] = deepCopy(elem)
+		}
+		return obj
+	case []interface{}:
+		array := make([]interface{}, len(v))
+		for idx, elem := range v {
+			array[idx] = deepCopy(elem)
+		}
+		return array
+	}
+	return value
+}
+
+// equal returns whether two generic JSON values (as returned by decode) are
+// equal. Numbers are compared by value, so 1 and 1.0 are equal.
+func equal(a, b interface{}) bool {
+	if numA, ok := a.(json.Number); ok {
+		numB, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if numA == numB {
+			return true
+		}
+		floatA, errA := numA.Float64()
+		floatB, errB := numB.Float64()
+		return errA == nil && errB == nil && floatA == floatB
+	}
+
+	switch v := a.(type) {
+	case map[string]interface{}:
+		obj, ok := b.(map[string]interface{})
+		if !ok || len(obj) != len(v) {
+			return false
+		}
+		for key, elem := range v {
+			other, ok := obj[key]
+			if !ok || !equal(elem, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		array, ok := b.([]interface{})
+		if !ok || len(array) != len(v) {
+			return false
+		}
+		for idx := range v {
+			if !equal(v[idx], array[idx]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func mustMarshal(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
@@ -0,0 +1,128 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jsonpatch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// jsonEqual returns whether two JSON documents are semantically equal.
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	var valueA, valueB interface{}
+	if err := json.Unmarshal(a, &valueA); err != nil {
+		t.Fatalf("invalid json %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &valueB); err != nil {
+		t.Fatalf("invalid json %s: %v", b, err)
+	}
+	return reflect.DeepEqual(valueA, valueB)
+}
+
+func TestApply(t *testing.T) {
+	for _, test := range []struct {
+		doc, patch, expected string
+	}{
+		// Examples from RFC 6902, Appendix A.
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10}]`, `{"/":9,"~1":10}`},
+		// Copies must not alias the original.
+		{`{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"add","path":"/c/d","value":2}]`, `{"a":{"b":1},"c":{"b":1,"d":2}}`},
+		// Replacing the whole document.
+		{`{"a":1}`, `[{"op":"replace","path":"","value":[1,2]}]`, `[1,2]`},
+		// Large numbers are not mangled.
+		{`{"size":12345678901234567890}`, `[{"op":"add","path":"/a","value":null}]`, `{"a":null,"size":12345678901234567890}`},
+		// Numbers are compared by value.
+		{`{"a":1}`, `[{"op":"test","path":"/a","value":1.0}]`, `{"a":1}`},
+	} {
+		patch, err := Parse([]byte(test.patch))
+		if err != nil {
+			t.Errorf("unexpected error parsing %s: %+v", test.patch, err)
+			continue
+		}
+		got, err := patch.Apply([]byte(test.doc))
+		if err != nil {
+			t.Errorf("unexpected error applying %s to %s: %+v", test.patch, test.doc, err)
+			continue
+		}
+		if !jsonEqual(t, got, []byte(test.expected)) {
+			t.Errorf("applying %s to %s: expected %s got %s", test.patch, test.doc, test.expected, got)
+		}
+	}
+}
+
+func TestApplyFailure(t *testing.T) {
+	for _, test := range []struct {
+		doc, patch string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":1}]`},
+		{`{"foo":["bar"]}`, `[{"op":"remove","path":"/foo/01"}]`},
+		{`{"foo":["bar"]}`, `[{"op":"remove","path":"/foo/-"}]`},
+		{`{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":""}]`},
+		{`{"foo":"bar"}`, `[{"op":"copy","from":"/baz","path":"/qux"}]`},
+	} {
+		patch, err := Parse([]byte(test.patch))
+		if err != nil {
+			t.Errorf("unexpected error parsing %s: %+v", test.patch, err)
+			continue
+		}
+		if got, err := patch.Apply([]byte(test.doc)); err == nil {
+			t.Errorf("expected error applying %s to %s: got %s", test.patch, test.doc, got)
+		}
+	}
+}
+
+func TestApplyTestFailed(t *testing.T) {
+	patch, err := Parse([]byte(`[{"op":"replace","path":"/a","value":2},{"op":"test","path":"/b","value":"x"}]`))
+	if err != nil {
+		t.Fatalf("unexpected error parsing patch: %+v", err)
+	}
+	if _, err := patch.Apply([]byte(`{"a":1,"b":"y"}`)); errors.Cause(err) != ErrTestFailed {
+		t.Errorf("expected ErrTestFailed, got %+v", err)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, patch := range []string{
+		`{"op":"add","path":"/a","value":1}`,
+		`[{"op":"frobnicate","path":"/a"}]`,
+		`[{"op":"add","path":"/a"}]`,
+		`[{"op":"remove","path":"a"}]`,
+		`[{"op":"move","from":"a","path":"/a"}]`,
+	} {
+		if _, err := Parse([]byte(patch)); err == nil {
+			t.Errorf("expected error parsing %s", patch)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package rootlesscontainers implements the user.rootlesscontainers xattr,
+// which is used by rootless container tools (such as PRoot and rootlesskit)
+// to record the ownership a file would have if the tool had been able to
+// chown it. The value of the xattr is a protobuf-encoded Resource message:
+//
+//	message Resource {
+//	  uint32 uid = 1;
+//	  uint32 gid = 2;
+//	}
+//
+// The message is simple enough that it is encoded by hand here, rather than
+// pulling in a protobuf library.
+package rootlesscontainers
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Keyname is the name of the xattr.
+const Keyname = "user.rootlesscontainers"
+
+// NoopID is the value of Resource.UID or Resource.GID which indicates that
+// the ID of the file itself should be used. Note that a missing field is
+// treated as 0, not as NoopID.
+const NoopID uint32 = math.MaxUint32
+
+// Field numbers of the Resource message. The device fields are umoci
+// extensions, used to emulate device nodes (which cannot be created without
+// privileges) with empty regular files. They are numbered well above the
+// standard fields, and other implementations will ignore them.
+const (
+	fieldUID      = 1
+	fieldGID      = 2
+	fieldTypeflag = 1000
+	fieldDevmajor = 1001
+	fieldDevminor = 1002
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Resource is the ownership (and device information) recorded in the xattr.
+type Resource struct {
+	// UID and GID are the owner of the file, as seen inside the container.
+	UID uint32
+	GID uint32
+
+	// Typeflag is the tar typeflag (tar.TypeChar or tar.TypeBlock) of the
+	// device node that the file is standing in for, or 0 if the file is not
+	// emulating a device node. Devmajor and Devminor are the device numbers.
+	Typeflag byte
+	Devmajor uint32
+	Devminor uint32
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendField(buf []byte, field int, v uint32) []byte {
+	// Zero is the default value, so it is not encoded (as with proto3).
+	if v == 0 {
+		return buf
+	}
+	buf = appendVarint(buf, uint64(field)<<3|wireVarint)
+	return appendVarint(buf, uint64(v))
+}
+
+// Marshal returns the protobuf encoding of the resource.
+func (r Resource) Marshal() []byte {
+	buf := []byte{}
+	buf = appendField(buf, fieldUID, r.UID)
+	buf = appendField(buf, fieldGID, r.GID)
+	buf = appendField(buf, fieldTypeflag, uint32(r.Typeflag))
+	buf = appendField(buf, fieldDevmajor, r.Devmajor)
+	buf = appendField(buf, fieldDevminor, r.Devminor)
+	return buf
+}
+
+// Unmarshal parses the protobuf encoding of a resource. Unknown fields are
+// ignored.
+func Unmarshal(data []byte) (Resource, error) {
+	var r Resource
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return Resource{}, errors.New("invalid field tag")
+		}
+		data = data[n:]
+
+		field, wire := tag>>3, tag&7
+		switch wire {
+		case wireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return Resource{}, errors.Errorf("invalid varint in field %d", field)
+			}
+			data = data[n:]
+			// Larger values are truncated, as by other protobuf decoders.
+			switch field {
+			case fieldUID:
+				r.UID = uint32(v)
+			case fieldGID:
+				r.GID = uint32(v)
+			case fieldTypeflag:
+				if v > math.MaxUint8 {
+					return Resource{}, errors.Errorf("invalid typeflag %d", v)
+				}
+				r.Typeflag = byte(v)
+			case fieldDevmajor:
+				r.Devmajor = uint32(v)
+			case fieldDevminor:
+				r.Devminor = uint32(v)
+			}
+		case wireFixed64:
+			if len(data) < 8 {
+				return Resource{}, errors.Errorf("truncated field %d", field)
+			}
+			data = data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return Resource{}, errors.Errorf("truncated field %d", field)
+			}
+			data = data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return Resource{}, errors.Errorf("truncated field %d", field)
+			}
+			data = data[n+int(size):]
+		default:
+			return Resource{}, errors.Errorf("unsupported wire type %d in field %d", wire, field)
+		}
+	}
+	return r, nil
+}
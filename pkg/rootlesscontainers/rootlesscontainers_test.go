@@ -0,0 +1,93 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rootlesscontainers
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	for _, test := range []struct {
+		resource Resource
+		encoded  []byte
+	}{
+		{Resource{}, []byte{}},
+		{Resource{UID: 1000}, []byte{0x08, 0xe8, 0x07}},
+		{Resource{GID: 5}, []byte{0x10, 0x05}},
+		{Resource{UID: 1, GID: NoopID}, []byte{0x08, 0x01, 0x10, 0xff, 0xff, 0xff, 0xff, 0x0f}},
+		{Resource{Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}, []byte{0xc0, 0x3e, 0x33, 0xc8, 0x3e, 0x01, 0xd0, 0x3e, 0x03}},
+	} {
+		encoded := test.resource.Marshal()
+		if !bytes.Equal(encoded, test.encoded) {
+			t.Errorf("Marshal(%+v): expected %x got %x", test.resource, test.encoded, encoded)
+		}
+		resource, err := Unmarshal(encoded)
+		if err != nil {
+			t.Errorf("Unmarshal(%x): unexpected error: %v", encoded, err)
+		} else if resource != test.resource {
+			t.Errorf("Unmarshal(%x): expected %+v got %+v", encoded, test.resource, resource)
+		}
+	}
+}
+
+func TestUnmarshalUnknownFields(t *testing.T) {
+	encoded := []byte{
+		0x08, 0x02, // uid = 2
+		0x1a, 0x03, 'a', 'b', 'c', // field 3 (bytes)
+		0x25, 0x01, 0x02, 0x03, 0x04, // field 4 (fixed32)
+		0x29, 1, 2, 3, 4, 5, 6, 7, 8, // field 5 (fixed64)
+		0x30, 0x07, // field 6 (varint)
+		0x10, 0x03, // gid = 3
+	}
+	resource, err := Unmarshal(encoded)
+	if err != nil {
+		t.Fatalf("Unmarshal: unexpected error: %v", err)
+	}
+	if expected := (Resource{UID: 2, GID: 3}); resource != expected {
+		t.Errorf("Unmarshal: expected %+v got %+v", expected, resource)
+	}
+}
+
+func TestUnmarshalSignExtended(t *testing.T) {
+	// Some encoders write (uint32)-1 as a sign-extended int64.
+	encoded := []byte{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+	resource, err := Unmarshal(encoded)
+	if err != nil {
+		t.Fatalf("Unmarshal: unexpected error: %v", err)
+	}
+	if resource.UID != NoopID {
+		t.Errorf("Unmarshal: expected uid %d got %d", NoopID, resource.UID)
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	for _, encoded := range [][]byte{
+		{0x08},
+		{0x08, 0xff},
+		{0x1a, 0x05, 'a'},
+		{0x25, 0x01},
+		{0x0b},
+		{0xc0, 0x3e, 0x80, 0x02},
+	} {
+		if resource, err := Unmarshal(encoded); err == nil {
+			t.Errorf("Unmarshal(%x): expected error, got %+v", encoded, resource)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Document formats, and the media types of documents in those formats.
+const (
+	FormatSPDX      = "spdx"
+	FormatCycloneDX = "cyclonedx"
+
+	MediaTypeSPDX      = "application/spdx+json"
+	MediaTypeCycloneDX = "application/vnd.cyclonedx+json"
+)
+
+// MediaType returns the media type of documents in the given format.
+func MediaType(format string) (string, error) {
+	switch format {
+	case FormatSPDX:
+		return MediaTypeSPDX, nil
+	case FormatCycloneDX:
+		return MediaTypeCycloneDX, nil
+	}
+	return "", errors.Errorf("unknown sbom format: %s", format)
+}
+
+// Metadata describes the image (and the tool) an SBOM document is generated
+// for.
+type Metadata struct {
+	// Name is the name of the image (such as "image:latest").
+	Name string
+
+	// Digest is the digest of the image manifest.
+	Digest digest.Digest
+
+	// Created is the time the document was created.
+	Created time.Time
+
+	// ToolVersion is the version of umoci used to create the document.
+	ToolVersion string
+}
+
+// Write writes a document describing the inventory in the given format.
+func Write(w io.Writer, format string, inventory Inventory, meta Metadata) error {
+	var doc interface{}
+	switch format {
+	case FormatSPDX:
+		doc = spdxDocument(inventory, meta)
+	case FormatCycloneDX:
+		doc = cyclonedxDocument(inventory, meta)
+	default:
+		return errors.Errorf("unknown sbom format: %s", format)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return errors.Wrap(enc.Encode(doc), "encode sbom")
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxDoc struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+// spdxDocument generates an SPDX 2.3 document. The document describes the
+// image (as a package), which contains each of the installed packages.
+func spdxDocument(inventory Inventory, meta Metadata) spdxDoc {
+	const imageID = "SPDXRef-Image"
+
+	doc := spdxDoc{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              meta.Name,
+		DocumentNamespace: fmt.Sprintf("urn:umoci:sbom:%s:%s", meta.Digest.Algorithm(), meta.Digest.Hex()),
+		CreationInfo: spdxCreationInfo{
+			Created:  meta.Created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: umoci-" + meta.ToolVersion},
+		},
+		Packages: []spdxPackage{{
+			SPDXID:           imageID,
+			Name:             meta.Name,
+			VersionInfo:      meta.Digest.String(),
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+		}},
+		Relationships: []spdxRelationship{{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: imageID,
+		}},
+	}
+
+	for idx, pkg := range inventory.Packages {
+		id := fmt.Sprintf("SPDXRef-Package-%d", idx)
+		license := "NOASSERTION"
+		if pkg.License != "" {
+			// Package databases don't use SPDX license expressions, so we
+			// can only record the license as declared.
+			license = "LicenseRef-" + spdxIDString(pkg.License)
+		}
+		doc.Packages = append(doc.Packages, spdxPackage{
+			SPDXID:           id,
+			Name:             pkg.Name,
+			VersionInfo:      pkg.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  license,
+			CopyrightText:    "NOASSERTION",
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  pkg.PURL(inventory.OS),
+			}},
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      imageID,
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: id,
+		})
+	}
+	return doc
+}
+
+// spdxIDString converts s into a string that can be used in an SPDX
+// identifier (which may only contain letters, numbers, "." and "-").
+func spdxIDString(s string) string {
+	id := []byte(s)
+	for idx, ch := range id {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '.' || ch == '-') {
+			id[idx] = '-'
+		}
+	}
+	return string(id)
+}
+
+type cyclonedxTool struct {
+	Vendor  string `json:"vendor"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type cyclonedxLicense struct {
+	License struct {
+		Name string `json:"name"`
+	} `json:"license"`
+}
+
+type cyclonedxComponent struct {
+	Type     string             `json:"type"`
+	Name     string             `json:"name"`
+	Version  string             `json:"version,omitempty"`
+	PURL     string             `json:"purl,omitempty"`
+	Licenses []cyclonedxLicense `json:"licenses,omitempty"`
+}
+
+type cyclonedxMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     []cyclonedxTool    `json:"tools"`
+	Component cyclonedxComponent `json:"component"`
+}
+
+type cyclonedxDoc struct {
+	BOMFormat   string               `json:"bomFormat"`
+	SpecVersion string               `json:"specVersion"`
+	Version     int                  `json:"version"`
+	Metadata    cyclonedxMetadata    `json:"metadata"`
+	Components  []cyclonedxComponent `json:"components"`
+}
+
+// cyclonedxDocument generates a CycloneDX 1.4 document.
+func cyclonedxDocument(inventory Inventory, meta Metadata) cyclonedxDoc {
+	doc := cyclonedxDoc{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.4",
+		Version:     1,
+		Metadata: cyclonedxMetadata{
+			Timestamp: meta.Created.UTC().Format(time.RFC3339),
+			Tools: []cyclonedxTool{{
+				Vendor:  "openSUSE",
+				Name:    "umoci",
+				Version: meta.ToolVersion,
+			}},
+			Component: cyclonedxComponent{
+				Type:    "container",
+				Name:    meta.Name,
+				Version: meta.Digest.String(),
+			},
+		},
+		Components: []cyclonedxComponent{},
+	}
+
+	for _, pkg := range inventory.Packages {
+		component := cyclonedxComponent{
+			Type:    "library",
+			Name:    pkg.Name,
+			Version: pkg.Version,
+			PURL:    pkg.PURL(inventory.OS),
+		}
+		if pkg.License != "" {
+			var license cyclonedxLicense
+			license.License.Name = pkg.License
+			component.Licenses = append(component.Licenses, license)
+		}
+		doc.Components = append(doc.Components, component)
+	}
+	return doc
+}
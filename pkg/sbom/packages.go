@@ -0,0 +1,215 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sbom
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRPMUnavailable is returned when an rpm database has to be read, but
+// rpm(8) is not installed.
+var ErrRPMUnavailable = errors.New("rpm(8) is required to read rpm databases")
+
+// parseStanzas parses a file made up of blank-line separated stanzas of
+// "Key: value" fields, where values can be continued on lines starting with
+// whitespace. This is the format used by dpkg, and (with single-letter keys
+// and no space after the colon) by apk.
+func parseStanzas(data []byte) ([]map[string]string, error) {
+	var (
+		stanzas []map[string]string
+		stanza  = map[string]string{}
+		lastKey string
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(stanza) > 0 {
+				stanzas = append(stanzas, stanza)
+				stanza = map[string]string{}
+			}
+			lastKey = ""
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// Continuation lines only matter for multi-line fields, which
+			// we don't use.
+			if lastKey == "" {
+				return nil, errors.Errorf("continuation line without field: %q", line)
+			}
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid field: %q", line)
+		}
+		lastKey = kv[0]
+		stanza[lastKey] = strings.TrimSpace(kv[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(stanza) > 0 {
+		stanzas = append(stanzas, stanza)
+	}
+	return stanzas, nil
+}
+
+// parseDpkgStatus parses a dpkg status file. If checkStatus is true, only
+// packages with a Status of "install ok installed" are returned.
+func parseDpkgStatus(data []byte, checkStatus bool) ([]Package, error) {
+	stanzas, err := parseStanzas(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var pkgs []Package
+	for _, stanza := range stanzas {
+		if stanza["Package"] == "" {
+			continue
+		}
+		if checkStatus {
+			status := strings.Fields(stanza["Status"])
+			if len(status) == 0 || status[len(status)-1] != "installed" {
+				continue
+			}
+		}
+		pkgs = append(pkgs, Package{
+			Type:    TypeDeb,
+			Name:    stanza["Package"],
+			Version: stanza["Version"],
+			Arch:    stanza["Architecture"],
+		})
+	}
+	return pkgs, nil
+}
+
+// parseAPKInstalled parses an apk installed database.
+func parseAPKInstalled(data []byte) ([]Package, error) {
+	stanzas, err := parseStanzas(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var pkgs []Package
+	for _, stanza := range stanzas {
+		if stanza["P"] == "" {
+			continue
+		}
+		pkgs = append(pkgs, Package{
+			Type:    TypeAPK,
+			Name:    stanza["P"],
+			Version: stanza["V"],
+			Arch:    stanza["A"],
+			License: stanza["L"],
+		})
+	}
+	return pkgs, nil
+}
+
+// rpmQueryFormat is the query format used to list packages with rpm(8).
+const rpmQueryFormat = `%{NAME}\t%{EPOCH}\t%{VERSION}\t%{RELEASE}\t%{ARCH}\t%{LICENSE}\n`
+
+// readRPMDB lists the packages in the given rpm database (which maps the
+// names of the files in the database directory to their contents). As the
+// database formats used by rpm are not trivial to parse, rpm(8) is used to
+// read the database.
+func readRPMDB(db map[string][]byte) ([]Package, error) {
+	rpm, err := exec.LookPath("rpm")
+	if err != nil {
+		return nil, ErrRPMUnavailable
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-sbom-rpmdb")
+	if err != nil {
+		return nil, errors.Wrap(err, "create temporary database")
+	}
+	defer os.RemoveAll(dir)
+
+	for name, data := range db {
+		path := filepath.Join(dir, filepath.Clean("/"+name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, errors.Wrap(err, "create temporary database")
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			return nil, errors.Wrap(err, "create temporary database")
+		}
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(rpm, "--dbpath", dir, "-qa", "--queryformat", rpmQueryFormat)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "rpm -qa: %s", strings.TrimSpace(stderr.String()))
+	}
+	return parseRPMQuery(output)
+}
+
+// parseRPMQuery parses the output of rpm(8) with rpmQueryFormat.
+func parseRPMQuery(output []byte) ([]Package, error) {
+	var pkgs []Package
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 6 {
+			return nil, errors.Errorf("invalid rpm query output: %q", line)
+		}
+		name, epoch, version, release, arch, license := fields[0], fields[1], fields[2], fields[3], fields[4], fields[5]
+
+		// gpg-pubkey "packages" are imported keys, not packages.
+		if name == "gpg-pubkey" {
+			continue
+		}
+		if release != "" && release != "(none)" {
+			version += "-" + release
+		}
+		if epoch != "" && epoch != "(none)" {
+			version = epoch + ":" + version
+		}
+		if arch == "(none)" {
+			arch = ""
+		}
+		if license == "(none)" {
+			license = ""
+		}
+		pkgs = append(pkgs, Package{
+			Type:    TypeRPM,
+			Name:    name,
+			Version: version,
+			Arch:    arch,
+			License: license,
+		})
+	}
+	return pkgs, scanner.Err()
+}
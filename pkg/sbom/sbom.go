@@ -0,0 +1,236 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sbom detects the packages installed in a root filesystem (from the
+// rpm, dpkg and apk package databases) and generates software bill of
+// materials documents (in the SPDX and CycloneDX formats) describing them.
+// The root filesystem is described by the contents of a small set of files
+// (see Match), so that images can be inventoried without being unpacked.
+package sbom
+
+import (
+	"bufio"
+	"bytes"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Package types, as used in package URLs.
+const (
+	TypeRPM = "rpm"
+	TypeDeb = "deb"
+	TypeAPK = "apk"
+)
+
+// Package is a single package installed in a root filesystem.
+type Package struct {
+	// Type is the type of the package (TypeRPM, TypeDeb or TypeAPK).
+	Type string
+
+	// Name is the name of the package.
+	Name string
+
+	// Version is the full version of the package (including any epoch and
+	// release).
+	Version string
+
+	// Arch is the architecture of the package. It is "" if unknown.
+	Arch string
+
+	// License is the license of the package, as recorded in the package
+	// database. It is "" if unknown.
+	License string
+}
+
+// OSRelease is the subset of os-release(5) used to describe the distribution
+// a root filesystem is based on.
+type OSRelease struct {
+	// ID is the identifier of the distribution (such as "opensuse-leap").
+	ID string
+
+	// VersionID is the version of the distribution (such as "42.2").
+	VersionID string
+
+	// PrettyName is the human-readable name of the distribution.
+	PrettyName string
+}
+
+// Inventory is the set of packages installed in a root filesystem.
+type Inventory struct {
+	// OS describes the distribution of the root filesystem. It is empty if
+	// there is no os-release(5) file.
+	OS OSRelease
+
+	// Packages is the set of installed packages, sorted by type, name,
+	// version and architecture.
+	Packages []Package
+}
+
+// PURL returns the package URL of the package, with the namespace and distro
+// qualifier taken from os.
+func (p Package) PURL(os OSRelease) string {
+	purl := "pkg:" + p.Type + "/"
+	if os.ID != "" {
+		purl += url.PathEscape(os.ID) + "/"
+	}
+	purl += url.PathEscape(p.Name)
+	if p.Version != "" {
+		purl += "@" + url.PathEscape(p.Version)
+	}
+
+	qualifiers := url.Values{}
+	if p.Arch != "" {
+		qualifiers.Set("arch", p.Arch)
+	}
+	if os.ID != "" && os.VersionID != "" {
+		qualifiers.Set("distro", os.ID+"-"+os.VersionID)
+	}
+	if len(qualifiers) > 0 {
+		purl += "?" + qualifiers.Encode()
+	}
+	return purl
+}
+
+// Paths of the files used to detect packages.
+var (
+	osReleasePaths   = []string{"etc/os-release", "usr/lib/os-release"}
+	dpkgStatusPath   = "var/lib/dpkg/status"
+	dpkgStatusDir    = "var/lib/dpkg/status.d/"
+	apkInstalledPath = "lib/apk/db/installed"
+	rpmDBDirs        = []string{"var/lib/rpm/", "usr/lib/sysimage/rpm/"}
+)
+
+// Match returns whether the file at the given path (relative to the root of
+// the root filesystem, such as "etc/os-release") is needed by Detect.
+func Match(path string) bool {
+	for _, osRelease := range osReleasePaths {
+		if path == osRelease {
+			return true
+		}
+	}
+	if path == dpkgStatusPath || path == apkInstalledPath || strings.HasPrefix(path, dpkgStatusDir) {
+		return true
+	}
+	for _, dir := range rpmDBDirs {
+		if strings.HasPrefix(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// Detect returns the inventory of the root filesystem containing the given
+// files, which maps paths (as accepted by Match) to their contents. Any
+// other files are ignored. Reading an rpm database requires rpm(8) to be
+// installed, and an error is returned if it is not.
+func Detect(files map[string][]byte) (Inventory, error) {
+	var inventory Inventory
+
+	for _, path := range osReleasePaths {
+		if data, ok := files[path]; ok {
+			inventory.OS = parseOSRelease(data)
+			break
+		}
+	}
+
+	if data, ok := files[dpkgStatusPath]; ok {
+		pkgs, err := parseDpkgStatus(data, true)
+		if err != nil {
+			return inventory, errors.Wrap(err, "parse dpkg status")
+		}
+		inventory.Packages = append(inventory.Packages, pkgs...)
+	}
+	for path, data := range files {
+		if !strings.HasPrefix(path, dpkgStatusDir) {
+			continue
+		}
+		// The status.d files (used by distroless images) don't have a
+		// Status field, every package in them is installed.
+		pkgs, err := parseDpkgStatus(data, false)
+		if err != nil {
+			return inventory, errors.Wrapf(err, "parse dpkg status %s", path)
+		}
+		inventory.Packages = append(inventory.Packages, pkgs...)
+	}
+
+	if data, ok := files[apkInstalledPath]; ok {
+		pkgs, err := parseAPKInstalled(data)
+		if err != nil {
+			return inventory, errors.Wrap(err, "parse apk database")
+		}
+		inventory.Packages = append(inventory.Packages, pkgs...)
+	}
+
+	for _, dir := range rpmDBDirs {
+		db := map[string][]byte{}
+		for path, data := range files {
+			if strings.HasPrefix(path, dir) {
+				db[strings.TrimPrefix(path, dir)] = data
+			}
+		}
+		if len(db) == 0 {
+			continue
+		}
+		pkgs, err := readRPMDB(db)
+		if err != nil {
+			return inventory, errors.Wrapf(err, "read rpm database %s", dir)
+		}
+		inventory.Packages = append(inventory.Packages, pkgs...)
+		break
+	}
+
+	sort.Slice(inventory.Packages, func(i, j int) bool {
+		a, b := inventory.Packages[i], inventory.Packages[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+		return a.Arch < b.Arch
+	})
+	return inventory, nil
+}
+
+// parseOSRelease parses an os-release(5) file.
+func parseOSRelease(data []byte) OSRelease {
+	var osRelease OSRelease
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.Trim(kv[1], `"'`)
+		switch kv[0] {
+		case "ID":
+			osRelease.ID = value
+		case "VERSION_ID":
+			osRelease.VersionID = value
+		case "PRETTY_NAME":
+			osRelease.PrettyName = value
+		}
+	}
+	return osRelease
+}
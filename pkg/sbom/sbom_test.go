@@ -0,0 +1,196 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sbom
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const dpkgStatus = `Package: libc6
+Status: install ok installed
+Architecture: amd64
+Version: 2.24-11+deb9u1
+Description: GNU C Library
+ Contains the standard libraries.
+
+Package: removed
+Status: deinstall ok config-files
+Architecture: amd64
+Version: 1.0
+
+Package: bash
+Status: install ok installed
+Architecture: amd64
+Version: 4.4-5
+`
+
+const apkInstalled = `C:Q1abc=
+P:musl
+V:1.1.16-r10
+A:x86_64
+L:MIT
+
+P:busybox
+V:1.26.2-r5
+A:x86_64
+L:GPL2
+`
+
+const osRelease = `NAME="openSUSE Leap"
+VERSION="42.2"
+ID=opensuse
+VERSION_ID="42.2"
+PRETTY_NAME="openSUSE Leap 42.2"
+`
+
+func TestDetect(t *testing.T) {
+	inventory, err := Detect(map[string][]byte{
+		"etc/os-release":       []byte(osRelease),
+		"var/lib/dpkg/status":  []byte(dpkgStatus),
+		"lib/apk/db/installed": []byte(apkInstalled),
+		"etc/passwd":           []byte("root:x:0:0::/root:/bin/sh"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	expectedOS := OSRelease{ID: "opensuse", VersionID: "42.2", PrettyName: "openSUSE Leap 42.2"}
+	if inventory.OS != expectedOS {
+		t.Errorf("unexpected os-release: got %#v, expected %#v", inventory.OS, expectedOS)
+	}
+
+	expected := []Package{
+		{Type: TypeAPK, Name: "busybox", Version: "1.26.2-r5", Arch: "x86_64", License: "GPL2"},
+		{Type: TypeAPK, Name: "musl", Version: "1.1.16-r10", Arch: "x86_64", License: "MIT"},
+		{Type: TypeDeb, Name: "bash", Version: "4.4-5", Arch: "amd64"},
+		{Type: TypeDeb, Name: "libc6", Version: "2.24-11+deb9u1", Arch: "amd64"},
+	}
+	if !reflect.DeepEqual(inventory.Packages, expected) {
+		t.Errorf("unexpected packages: got %#v, expected %#v", inventory.Packages, expected)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"etc/os-release":                   true,
+		"usr/lib/os-release":               true,
+		"var/lib/dpkg/status":              true,
+		"var/lib/dpkg/status.d/base":       true,
+		"var/lib/dpkg/status-old":          false,
+		"lib/apk/db/installed":             true,
+		"var/lib/rpm/Packages":             true,
+		"usr/lib/sysimage/rpm/Packages.db": true,
+		"etc/passwd":                       false,
+	} {
+		if got := Match(path); got != expected {
+			t.Errorf("Match(%q): got %v, expected %v", path, got, expected)
+		}
+	}
+}
+
+func TestParseRPMQuery(t *testing.T) {
+	pkgs, err := parseRPMQuery([]byte("bash\t(none)\t4.3\t83.3.1\tx86_64\tGPL-3.0+\ngpg-pubkey\t(none)\t3dbdc284\t53674dd4\t(none)\t(none)\nperl\t1\t5.18.2\t9.1\tx86_64\tArtistic-1.0 or GPL-1.0+\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	expected := []Package{
+		{Type: TypeRPM, Name: "bash", Version: "4.3-83.3.1", Arch: "x86_64", License: "GPL-3.0+"},
+		{Type: TypeRPM, Name: "perl", Version: "1:5.18.2-9.1", Arch: "x86_64", License: "Artistic-1.0 or GPL-1.0+"},
+	}
+	if !reflect.DeepEqual(pkgs, expected) {
+		t.Errorf("unexpected packages: got %#v, expected %#v", pkgs, expected)
+	}
+
+	if _, err := parseRPMQuery([]byte("bash\t4.3\n")); err == nil {
+		t.Errorf("expected error parsing invalid output")
+	}
+}
+
+func TestPURL(t *testing.T) {
+	os := OSRelease{ID: "opensuse", VersionID: "42.2"}
+	for _, test := range []struct {
+		pkg      Package
+		os       OSRelease
+		expected string
+	}{
+		{Package{Type: TypeRPM, Name: "perl", Version: "1:5.18.2-9.1", Arch: "x86_64"}, os, "pkg:rpm/opensuse/perl@1:5.18.2-9.1?arch=x86_64&distro=opensuse-42.2"},
+		{Package{Type: TypeDeb, Name: "libc6", Version: "2.24"}, OSRelease{}, "pkg:deb/libc6@2.24"},
+		{Package{Type: TypeAPK, Name: "a/b"}, OSRelease{ID: "alpine"}, "pkg:apk/alpine/a%2Fb"},
+	} {
+		if got := test.pkg.PURL(test.os); got != test.expected {
+			t.Errorf("unexpected purl: got %s, expected %s", got, test.expected)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	inventory := Inventory{
+		OS: OSRelease{ID: "alpine", VersionID: "3.6"},
+		Packages: []Package{
+			{Type: TypeAPK, Name: "musl", Version: "1.1.16-r10", Arch: "x86_64", License: "MIT"},
+		},
+	}
+	meta := Metadata{
+		Name:        "image:latest",
+		Digest:      "sha256:e800e72a0a88984bd1b47f4eca1c188d3d333dc8e799bfa0a02ea5c2697216d5",
+		Created:     time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC),
+		ToolVersion: "0.2.0",
+	}
+
+	var spdx bytes.Buffer
+	if err := Write(&spdx, FormatSPDX, inventory, meta); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	var spdxDoc spdxDoc
+	if err := json.Unmarshal(spdx.Bytes(), &spdxDoc); err != nil {
+		t.Fatalf("unexpected error decoding spdx: %+v", err)
+	}
+	if len(spdxDoc.Packages) != 2 || spdxDoc.Packages[1].Name != "musl" || spdxDoc.Packages[1].LicenseDeclared != "LicenseRef-MIT" {
+		t.Errorf("unexpected spdx packages: %#v", spdxDoc.Packages)
+	}
+	if spdxDoc.Packages[1].ExternalRefs[0].ReferenceLocator != "pkg:apk/alpine/musl@1.1.16-r10?arch=x86_64&distro=alpine-3.6" {
+		t.Errorf("unexpected spdx purl: %#v", spdxDoc.Packages[1].ExternalRefs)
+	}
+	if spdxDoc.CreationInfo.Created != "2017-03-01T00:00:00Z" {
+		t.Errorf("unexpected spdx creation time: %s", spdxDoc.CreationInfo.Created)
+	}
+
+	var cyclonedx bytes.Buffer
+	if err := Write(&cyclonedx, FormatCycloneDX, inventory, meta); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	var cyclonedxDoc cyclonedxDoc
+	if err := json.Unmarshal(cyclonedx.Bytes(), &cyclonedxDoc); err != nil {
+		t.Fatalf("unexpected error decoding cyclonedx: %+v", err)
+	}
+	if len(cyclonedxDoc.Components) != 1 || cyclonedxDoc.Components[0].Licenses[0].License.Name != "MIT" {
+		t.Errorf("unexpected cyclonedx components: %#v", cyclonedxDoc.Components)
+	}
+	if cyclonedxDoc.Metadata.Component.Version != meta.Digest.String() {
+		t.Errorf("unexpected cyclonedx metadata: %#v", cyclonedxDoc.Metadata)
+	}
+
+	if err := Write(&bytes.Buffer{}, "nope", inventory, meta); err == nil {
+		t.Errorf("expected error with unknown format")
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stats
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/opencontainers/go-digest"
+)
+
+// Operations recorded in LayerStats.
+const (
+	// OpUnpack is a layer being unpacked into a root filesystem.
+	OpUnpack = "unpack"
+
+	// OpPack is a layer being generated, compressed and written to an image.
+	OpPack = "pack"
+)
+
+// LayerStats describes a layer unpacked or packed by an operation.
+type LayerStats struct {
+	// Op is what was done with the layer (OpUnpack or OpPack).
+	Op string
+
+	// Digest is the digest of the (compressed) layer blob.
+	Digest digest.Digest
+
+	// Size is the size of the layer blob, and UncompressedSize is the size of
+	// the uncompressed layer archive.
+	Size             int64
+	UncompressedSize int64
+
+	// Duration is how long it took to unpack the layer (or to generate,
+	// compress and write it).
+	Duration time.Duration
+}
+
+// CompressionRatio returns the ratio of the uncompressed size of the layer to
+// its compressed size, or 0 if the compressed size is not known.
+func (l LayerStats) CompressionRatio() float64 {
+	if l.Size <= 0 {
+		return 0
+	}
+	return float64(l.UncompressedSize) / float64(l.Size)
+}
+
+// MarshalJSON encodes the layer with its duration in (fractional) seconds.
+func (l LayerStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Op               string        `json:"op"`
+		Digest           digest.Digest `json:"digest"`
+		Size             int64         `json:"size"`
+		UncompressedSize int64         `json:"uncompressed_size"`
+		CompressionRatio float64       `json:"compression_ratio"`
+		Duration         float64       `json:"duration"`
+	}{
+		Op:               l.Op,
+		Digest:           l.Digest,
+		Size:             l.Size,
+		UncompressedSize: l.UncompressedSize,
+		CompressionRatio: l.CompressionRatio(),
+		Duration:         l.Duration.Seconds(),
+	})
+}
+
+// Stats is a summary of the work done by the operations recorded by a
+// Recorder.
+type Stats struct {
+	// BlobsRead and BytesRead are the number of blobs read from images and
+	// the number of bytes read from them.
+	BlobsRead int64 `json:"blobs_read"`
+	BytesRead int64 `json:"bytes_read"`
+
+	// BlobsWritten and BytesWritten are the number of blobs written to images
+	// and their total size.
+	BlobsWritten int64 `json:"blobs_written"`
+	BytesWritten int64 `json:"bytes_written"`
+
+	// Layers are the layers unpacked or packed, in the order in which they
+	// were finished.
+	Layers []LayerStats `json:"layers"`
+
+	// Cache is the usage of blob caches, or nil if no blob cache was used.
+	Cache *CacheUsage `json:"cache,omitempty"`
+}
+
+// Recorder collects Stats from the events emitted by umoci's library
+// packages. Its Hook has to be registered (with event.SetHook, or attached
+// to the context of the operations with event.WithHook) for anything to be
+// recorded. A Recorder is safe for concurrent use.
+type Recorder struct {
+	lock  sync.Mutex
+	stats Stats
+
+	// cacheHits and cacheMisses count the event.CacheHit and event.CacheMiss
+	// events recorded.
+	cacheHits   int64
+	cacheMisses int64
+}
+
+// NewRecorder returns a new Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{
+		stats: Stats{Layers: []LayerStats{}},
+	}
+}
+
+// Hook records the given event, and is an event.Hook.
+func (r *Recorder) Hook(ev event.Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	switch ev.Type {
+	case event.BlobDone:
+		if ev.Err != nil {
+			return
+		}
+		switch ev.Op {
+		case event.OpGet:
+			r.stats.BlobsRead++
+			r.stats.BytesRead += ev.Size
+		case event.OpPut:
+			r.stats.BlobsWritten++
+			r.stats.BytesWritten += ev.Size
+		}
+	case event.LayerApplied, event.LayerAdded:
+		op := OpUnpack
+		if ev.Type == event.LayerAdded {
+			op = OpPack
+		}
+		r.stats.Layers = append(r.stats.Layers, LayerStats{
+			Op:               op,
+			Digest:           ev.Digest,
+			Size:             ev.Size,
+			UncompressedSize: ev.UncompressedSize,
+			Duration:         ev.Duration,
+		})
+	case event.CacheHit:
+		r.cacheHits++
+	case event.CacheMiss:
+		r.cacheMisses++
+	}
+}
+
+// cacheUsage returns the blob cache usage recorded so far, or nil if no blob
+// cache was used. r.lock must be held.
+func (r *Recorder) cacheUsage() *CacheUsage {
+	if r.cacheHits+r.cacheMisses == 0 {
+		return nil
+	}
+	return &CacheUsage{
+		Hits:    r.cacheHits,
+		Misses:  r.cacheMisses,
+		HitRate: float64(r.cacheHits) / float64(r.cacheHits+r.cacheMisses),
+	}
+}
+
+// Stats returns a summary of the events recorded so far.
+func (r *Recorder) Stats() Stats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	stats := r.stats
+	stats.Layers = append([]LayerStats{}, r.stats.Layers...)
+	stats.Cache = r.cacheUsage()
+	return stats
+}
+
+// Collect is equivalent to the package-level Collect, except that the blob
+// cache usage recorded so far is included in the returned Usage.
+func (r *Recorder) Collect() (Usage, error) {
+	usage, err := Collect()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	usage.Cache = r.cacheUsage()
+	return usage, err
+}
@@ -0,0 +1,87 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stats
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/pkg/event"
+	"github.com/pkg/errors"
+)
+
+func TestRecorder(t *testing.T) {
+	recorder := NewRecorder()
+	for _, ev := range []event.Event{
+		{Type: event.BlobStart, Op: event.OpGet, Digest: "sha256:a"},
+		{Type: event.BlobDone, Op: event.OpGet, Digest: "sha256:a", Size: 100},
+		{Type: event.BlobDone, Op: event.OpGet, Digest: "sha256:b", Size: 50},
+		{Type: event.BlobDone, Op: event.OpGet, Digest: "sha256:c", Size: 10, Err: errors.New("failed")},
+		{Type: event.BlobDone, Op: event.OpPut, Digest: "sha256:d", Size: 20},
+		{Type: event.LayerApplied, Digest: "sha256:a", Size: 100, UncompressedSize: 300, Duration: time.Second},
+		{Type: event.LayerAdded, Digest: "sha256:d", Size: 20, UncompressedSize: 30, Duration: time.Millisecond},
+		{Type: event.RefUpdated, Reference: "latest"},
+		{Type: event.CacheHit, Digest: "sha256:a"},
+		{Type: event.CacheHit, Digest: "sha256:a"},
+		{Type: event.CacheHit, Digest: "sha256:b"},
+		{Type: event.CacheMiss, Digest: "sha256:c"},
+		{Type: event.Progress, Op: event.OpGet, Digest: "sha256:a", Current: 100, Total: 100, Done: true},
+		{Type: event.SpanStart, Name: "test.Operation", SpanID: "1"},
+		{Type: event.SpanEnd, Name: "test.Operation", SpanID: "1", Duration: time.Second},
+	} {
+		recorder.Hook(ev)
+	}
+
+	expected := Stats{
+		BlobsRead:    2,
+		BytesRead:    150,
+		BlobsWritten: 1,
+		BytesWritten: 20,
+		Layers: []LayerStats{
+			{Op: OpUnpack, Digest: "sha256:a", Size: 100, UncompressedSize: 300, Duration: time.Second},
+			{Op: OpPack, Digest: "sha256:d", Size: 20, UncompressedSize: 30, Duration: time.Millisecond},
+		},
+		Cache: &CacheUsage{Hits: 3, Misses: 1, HitRate: 0.75},
+	}
+	got := recorder.Stats()
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected stats: got %+v, expected %+v", got, expected)
+	}
+	if ratio := got.Layers[0].CompressionRatio(); ratio != 3 {
+		t.Errorf("unexpected compression ratio: got %v, expected 3", ratio)
+	}
+	if ratio := (LayerStats{UncompressedSize: 10}).CompressionRatio(); ratio != 0 {
+		t.Errorf("unexpected compression ratio of unknown size: got %v, expected 0", ratio)
+	}
+
+	data, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	var fields struct {
+		Layers []map[string]interface{} `json:"layers"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(fields.Layers) != 2 || fields.Layers[0]["duration"] != 1.0 || fields.Layers[0]["compression_ratio"] != 3.0 {
+		t.Errorf("unexpected layers in %s", data)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package stats collects a summary of the resources used by umoci (wall and
+// CPU time, peak memory usage and I/O), so that users can tune parallelism
+// options and spot pathological images. The summary covers the whole process,
+// from the time this package was initialised. A Recorder collects more
+// detailed Stats about the work done by particular operations (the blobs read
+// and written, the layers unpacked and packed and blob cache usage) from the
+// events emitted by umoci's library packages (see pkg/event).
+package stats
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// start is the time from which the wall time is measured.
+var start = time.Now()
+
+// CacheUsage is a summary of the blobs read by blob caches.
+type CacheUsage struct {
+	// Hits is the number of blobs read from a cache.
+	Hits int64 `json:"hits"`
+
+	// Misses is the number of blobs fetched from the backend of a cache.
+	Misses int64 `json:"misses"`
+
+	// HitRate is the proportion of blobs read from a cache (from 0 to 1).
+	HitRate float64 `json:"hit_rate"`
+}
+
+// Usage is a summary of the resources used by the process.
+type Usage struct {
+	// WallTime is the real time elapsed.
+	WallTime time.Duration
+
+	// UserTime and SystemTime are the CPU time spent in user and kernel mode
+	// respectively (including any child processes which have exited).
+	UserTime   time.Duration
+	SystemTime time.Duration
+
+	// PeakRSS is the maximum resident set size (in bytes).
+	PeakRSS int64
+
+	// ReadBytes and WrittenBytes are the number of bytes read and written
+	// through system calls (including pipes and sockets), or -1 if unknown.
+	ReadBytes    int64
+	WrittenBytes int64
+
+	// Cache is the usage of blob caches, or nil if no blob cache was used.
+	// It is not set by Collect, as blob cache usage is only known to a
+	// Recorder (see Recorder.Collect).
+	Cache *CacheUsage
+}
+
+// CPUTime returns the total CPU time used.
+func (u Usage) CPUTime() time.Duration {
+	return u.UserTime + u.SystemTime
+}
+
+// MarshalJSON encodes the usage with all times in (fractional) seconds.
+func (u Usage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		WallTime     float64     `json:"wall_time"`
+		CPUTime      float64     `json:"cpu_time"`
+		UserTime     float64     `json:"user_time"`
+		SystemTime   float64     `json:"system_time"`
+		PeakRSS      int64       `json:"peak_rss"`
+		ReadBytes    int64       `json:"read_bytes"`
+		WrittenBytes int64       `json:"written_bytes"`
+		Cache        *CacheUsage `json:"cache,omitempty"`
+	}{
+		WallTime:     u.WallTime.Seconds(),
+		CPUTime:      u.CPUTime().Seconds(),
+		UserTime:     u.UserTime.Seconds(),
+		SystemTime:   u.SystemTime.Seconds(),
+		PeakRSS:      u.PeakRSS,
+		ReadBytes:    u.ReadBytes,
+		WrittenBytes: u.WrittenBytes,
+		Cache:        u.Cache,
+	})
+}
+
+// Collect returns a summary of the resources used by the process so far.
+func Collect() (Usage, error) {
+	usage := Usage{
+		WallTime:     time.Since(start),
+		ReadBytes:    -1,
+		WrittenBytes: -1,
+	}
+	if err := collectRusage(&usage); err != nil {
+		return usage, errors.Wrap(err, "get resource usage")
+	}
+	collectIO(&usage)
+	return usage, nil
+}
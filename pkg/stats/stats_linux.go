@@ -0,0 +1,71 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stats
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// collectRusage fills the CPU time and peak RSS of usage.
+func collectRusage(usage *Usage) error {
+	var self, children syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &self); err != nil {
+		return err
+	}
+	if err := syscall.Getrusage(syscall.RUSAGE_CHILDREN, &children); err != nil {
+		return err
+	}
+	usage.UserTime = time.Duration(self.Utime.Nano() + children.Utime.Nano())
+	usage.SystemTime = time.Duration(self.Stime.Nano() + children.Stime.Nano())
+	// ru_maxrss is in kilobytes on Linux.
+	usage.PeakRSS = int64(self.Maxrss) * 1024
+	return nil
+}
+
+// collectIO fills the I/O counters of usage from /proc/self/io. They are left
+// unchanged if /proc/self/io cannot be read (it requires CONFIG_TASK_IO_ACCOUNTING).
+func collectIO(usage *Usage) {
+	fh, err := os.Open("/proc/self/io")
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "rchar":
+			usage.ReadBytes = value
+		case "wchar":
+			usage.WrittenBytes = value
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stats
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/openSUSE/umoci/pkg/event"
+)
+
+func TestCollect(t *testing.T) {
+	// Do some I/O so that the counters are non-zero.
+	if _, err := ioutil.ReadFile("/proc/self/status"); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := Collect()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if usage.WallTime <= 0 {
+		t.Errorf("expected positive wall time, got %s", usage.WallTime)
+	}
+	if usage.PeakRSS <= 0 {
+		t.Errorf("expected positive peak rss, got %d", usage.PeakRSS)
+	}
+	if usage.CPUTime() != usage.UserTime+usage.SystemTime {
+		t.Errorf("cpu time %s is not the sum of user and system time", usage.CPUTime())
+	}
+	if usage.Cache != nil {
+		t.Errorf("expected no cache usage, got %+v", usage.Cache)
+	}
+
+	// Blob cache usage is only known to a Recorder.
+	recorder := NewRecorder()
+	for _, typ := range []string{event.CacheHit, event.CacheHit, event.CacheHit, event.CacheMiss} {
+		recorder.Hook(event.Event{Type: typ})
+	}
+
+	usage, err = recorder.Collect()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	expected := CacheUsage{Hits: 3, Misses: 1, HitRate: 0.75}
+	if usage.Cache == nil || *usage.Cache != expected {
+		t.Errorf("unexpected cache usage: got %+v, expected %+v", usage.Cache, expected)
+	}
+
+	data, err := json.Marshal(usage)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	for _, key := range []string{"wall_time", "cpu_time", "user_time", "system_time", "peak_rss", "read_bytes", "written_bytes", "cache"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("missing key %q in %s", key, data)
+		}
+	}
+}
@@ -17,9 +17,26 @@
 
 package system
 
-import "syscall"
+import (
+	"os"
+	"syscall"
+)
 
 // Unlink is a wrapper around unlink(2).
 func Unlink(path string) error {
 	return syscall.Unlink(path)
 }
+
+// From uapi/linux/fs.h.
+const _FICLONE = 0x40049409
+
+// Clone makes dst a copy-on-write clone (reflink) of src, using the FICLONE
+// ioctl(2). This is only supported by some filesystems (such as btrfs and
+// XFS), and both files must be on the same filesystem.
+func Clone(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), _FICLONE, src.Fd())
+	if errno != 0 {
+		return &os.PathError{Op: "ficlone", Path: dst.Name(), Err: errno}
+	}
+	return nil
+}
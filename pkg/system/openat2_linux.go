@@ -0,0 +1,73 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// From uapi/linux/openat2.h.
+const (
+	// ResolveNoXdev blocks the resolution from crossing mount points.
+	ResolveNoXdev = unix.RESOLVE_NO_XDEV
+
+	// ResolveNoMagiclinks blocks the resolution of magic-links (such as
+	// /proc/self/fd/*).
+	ResolveNoMagiclinks = unix.RESOLVE_NO_MAGICLINKS
+
+	// ResolveNoSymlinks blocks the resolution of all symlinks (and implies
+	// ResolveNoMagiclinks).
+	ResolveNoSymlinks = unix.RESOLVE_NO_SYMLINKS
+
+	// ResolveBeneath blocks the resolution from escaping the directory
+	// (through ".." components, absolute symlinks or absolute paths).
+	ResolveBeneath = unix.RESOLVE_BENEATH
+
+	// ResolveInRoot treats the directory as the root of the resolution, as
+	// though the process had chroot(2)-ed into it.
+	ResolveInRoot = unix.RESOLVE_IN_ROOT
+)
+
+// OPath is O_PATH, which the syscall package doesn't provide.
+const OPath = unix.O_PATH
+
+// Openat2 is a wrapper around openat2(2), which opens the given path relative
+// to the directory file descriptor dirfd with the given open(2) flags and
+// RESOLVE_* flags. If the resolution races with a rename or mount in the
+// same mount namespace (EAGAIN), it is retried. On kernels older than Linux
+// 5.6 (or if openat2(2) is blocked with seccomp) it fails with ENOSYS or
+// EPERM.
+func Openat2(dirfd int, path string, flags int, mode uint32, resolve uint64) (int, error) {
+	how := &unix.OpenHow{
+		Flags:   uint64(flags),
+		Mode:    uint64(mode),
+		Resolve: resolve,
+	}
+	for {
+		fd, err := unix.Openat2(dirfd, path, how)
+		switch err {
+		case nil:
+			return fd, nil
+		case unix.EAGAIN, unix.EINTR:
+			continue
+		}
+		return -1, &os.PathError{Op: "openat2", Path: path, Err: err}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// From uapi/linux/fs.h.
+const (
+	_SEEK_DATA = 3
+	_SEEK_HOLE = 4
+)
+
+// Region is a region of a file.
+type Region struct {
+	Offset int64
+	Length int64
+}
+
+// DataRegions returns the regions of the file (of the given size) which
+// contain data, as opposed to holes, using lseek(2) with SEEK_DATA and
+// SEEK_HOLE. If the filesystem doesn't support finding holes, the whole file
+// is returned as a single region. The offset of the file is left undefined.
+func DataRegions(fh *os.File, size int64) ([]Region, error) {
+	var regions []Region
+	for offset := int64(0); offset < size; {
+		start, err := fh.Seek(offset, _SEEK_DATA)
+		if err != nil {
+			if pathErr, ok := err.(*os.PathError); ok {
+				switch pathErr.Err {
+				case syscall.ENXIO:
+					// There is no more data after offset.
+					return regions, nil
+				case syscall.EINVAL:
+					// SEEK_DATA is not supported.
+					return []Region{{Offset: 0, Length: size}}, nil
+				}
+			}
+			return nil, errors.Wrap(err, "seek data")
+		}
+		end, err := fh.Seek(start, _SEEK_HOLE)
+		if err != nil {
+			return nil, errors.Wrap(err, "seek hole")
+		}
+		if end > size {
+			end = size
+		}
+		if start >= end {
+			break
+		}
+		regions = append(regions, Region{Offset: start, Length: end - start})
+		offset = end
+	}
+	return regions, nil
+}
@@ -0,0 +1,74 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDataRegions(t *testing.T) {
+	fh, err := ioutil.TempFile("", "umoci-system.TestDataRegions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	// A 1MiB hole, 64KiB of data, another 1MiB hole, 64KiB of data and a
+	// trailing 1MiB hole.
+	const hole, data = 1 << 20, 64 << 10
+	for _, offset := range []int64{hole, 2*hole + data} {
+		if _, err := fh.WriteAt(make([]byte, data), offset); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fh.WriteAt([]byte("data"), offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := int64(3*hole + 2*data)
+	if err := fh.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+
+	regions, err := DataRegions(fh, size)
+	if err != nil {
+		t.Fatalf("unexpected error getting data regions: %s", err)
+	}
+	if len(regions) == 1 && regions[0] == (Region{Offset: 0, Length: size}) {
+		t.Skip("filesystem does not support SEEK_DATA")
+	}
+	expected := []Region{
+		{Offset: hole, Length: data},
+		{Offset: 2*hole + data, Length: data},
+	}
+	if !reflect.DeepEqual(regions, expected) {
+		t.Errorf("unexpected data regions: got %v expected %v", regions, expected)
+	}
+
+	// Regions are only returned up to the given size.
+	regions, err = DataRegions(fh, hole)
+	if err != nil {
+		t.Fatalf("unexpected error getting data regions: %s", err)
+	}
+	if len(regions) != 0 {
+		t.Errorf("expected no data regions in hole: got %v", regions)
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package userns implements the re-execution of the current program inside a
+// new user namespace, with ID mappings set up by the setuid newuidmap(1) and
+// newgidmap(1) helpers. This allows an unprivileged user to make use of all
+// of the subordinate IDs allocated to them (in subuid(5) and subgid(5)),
+// rather than only being able to map their own user.
+package userns
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/apex/log"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	// envStage is the environment variable used to tell a re-executed
+	// process which stage of the user namespace setup it is in.
+	envStage = "_UMOCI_USERNS_STAGE"
+
+	// stageInit is the stage of a process which has been started in a new
+	// user namespace, but must wait for its mappings to be written.
+	stageInit = "init"
+
+	// stageChild is the stage of a process which is running inside a user
+	// namespace with its mappings set up.
+	stageChild = "child"
+
+	// syncFd is the file descriptor (in the stageInit process) of the pipe
+	// used to signal that the mappings have been written.
+	syncFd = 3
+)
+
+// Enabled returns whether the current process is running inside a user
+// namespace set up by Run.
+func Enabled() bool {
+	return os.Getenv(envStage) == stageChild
+}
+
+// readMappings parses a /proc/<pid>/{uid,gid}_map file.
+func readMappings(path string) ([]rspec.IDMapping, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read id map")
+	}
+
+	var mappings []rspec.IDMapping
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, errors.Errorf("invalid id map line %q", line)
+		}
+		var ids [3]uint32
+		for idx, field := range fields {
+			id, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid id map line %q", line)
+			}
+			ids[idx] = uint32(id)
+		}
+		mappings = append(mappings, rspec.IDMapping{
+			ContainerID: ids[0],
+			HostID:      ids[1],
+			Size:        ids[2],
+		})
+	}
+	return mappings, nil
+}
+
+// Mappings returns the UID and GID mappings of the user namespace the
+// current process is running in.
+func Mappings() ([]rspec.IDMapping, []rspec.IDMapping, error) {
+	uidMappings, err := readMappings("/proc/self/uid_map")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "get uid mappings")
+	}
+	gidMappings, err := readMappings("/proc/self/gid_map")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "get gid mappings")
+	}
+	return uidMappings, gidMappings, nil
+}
+
+// Init must be called at the start of main(), before any other work is done.
+// If the current process was started by Run, it waits until its mappings have
+// been written and then re-executes itself (this is necessary because the
+// process only gains capabilities in the user namespace when it is executed
+// as the root user of the namespace). Otherwise it does nothing.
+func Init() {
+	if os.Getenv(envStage) != stageInit {
+		return
+	}
+
+	sync := os.NewFile(syncFd, "userns-sync")
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(sync, buf); err != nil {
+		// The parent failed to set up the mappings, and has already reported
+		// the error.
+		os.Exit(1)
+	}
+	sync.Close()
+
+	if err := os.Setenv(envStage, stageChild); err != nil {
+		fmt.Fprintf(os.Stderr, "umoci: userns init: %v\n", err)
+		os.Exit(1)
+	}
+	err := syscall.Exec("/proc/self/exe", os.Args, os.Environ())
+	fmt.Fprintf(os.Stderr, "umoci: userns init: exec self: %v\n", err)
+	os.Exit(1)
+}
+
+// writeMappings uses the given helper (newuidmap(1) or newgidmap(1)) to write
+// the ID mappings of the process with the given pid.
+func writeMappings(helper string, pid int, mappings []rspec.IDMapping) error {
+	args := []string{strconv.Itoa(pid)}
+	for _, m := range mappings {
+		args = append(args,
+			strconv.FormatUint(uint64(m.ContainerID), 10),
+			strconv.FormatUint(uint64(m.HostID), 10),
+			strconv.FormatUint(uint64(m.Size), 10))
+	}
+
+	log.Debugf("userns: %s %s", helper, strings.Join(args, " "))
+	output, err := exec.Command(helper, args...).CombinedOutput()
+	if err != nil {
+		if output := strings.TrimSpace(string(output)); output != "" {
+			return errors.Wrapf(err, "%s: %s", helper, output)
+		}
+		return errors.Wrap(err, helper)
+	}
+	return nil
+}
+
+// Run re-executes the current program (with the same arguments and
+// environment) inside a new user namespace with the given mappings, and
+// waits for it to exit. If the program exits with a non-zero status, the
+// returned error is an *exec.ExitError. Inside the new user namespace,
+// Enabled will return true.
+func Run(uidMappings, gidMappings []rspec.IDMapping) error {
+	if Enabled() {
+		return errors.Errorf("already running in a user namespace")
+	}
+
+	syncRead, syncWrite, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "create sync pipe")
+	}
+	defer syncWrite.Close()
+
+	cmd := exec.Command("/proc/self/exe", os.Args[1:]...)
+	cmd.Args[0] = os.Args[0]
+	cmd.Env = append(os.Environ(), envStage+"="+stageInit)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{syncRead}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER,
+	}
+
+	err = cmd.Start()
+	syncRead.Close()
+	if err != nil {
+		return errors.Wrap(err, "start user namespace")
+	}
+
+	err = writeMappings("newuidmap", cmd.Process.Pid, uidMappings)
+	if err == nil {
+		err = writeMappings("newgidmap", cmd.Process.Pid, gidMappings)
+	}
+	if err != nil {
+		// Closing the pipe without writing to it makes the child exit.
+		syncWrite.Close()
+		cmd.Wait()
+		return errors.Wrap(err, "write user namespace mappings")
+	}
+
+	if _, err := syncWrite.Write([]byte{0}); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.Wrap(err, "signal user namespace")
+	}
+	syncWrite.Close()
+	return cmd.Wait()
+}
@@ -0,0 +1,143 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userns
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestMain(m *testing.M) {
+	Init()
+	os.Exit(m.Run())
+}
+
+// fakeHelper is a stand-in for newuidmap(1) and newgidmap(1), which writes
+// the mappings directly (this only works if we are privileged).
+const fakeHelper = `#!/bin/sh
+pid="$1"; shift
+mappings=""
+while [ "$#" -gt 0 ]; do
+	mappings="$mappings$1 $2 $3\n"
+	shift 3
+done
+# The mappings must be written with a single write(2).
+printf "$mappings" >"/proc/$pid/$MAPFILE"
+`
+
+// testMappings returns the mappings used by TestRun, with the root user
+// mapped to the given host ID.
+func testMappings(rootID int) []rspec.IDMapping {
+	return []rspec.IDMapping{
+		{HostID: uint32(rootID), ContainerID: 0, Size: 1},
+		{HostID: 100000, ContainerID: 1, Size: 65536},
+	}
+}
+
+func installFakeHelpers(t *testing.T, dir string) {
+	for helper, mapFile := range map[string]string{
+		"newuidmap": "uid_map",
+		"newgidmap": "gid_map",
+	} {
+		script := strings.Replace(fakeHelper, "$MAPFILE", mapFile, -1)
+		if err := ioutil.WriteFile(filepath.Join(dir, helper), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+}
+
+func TestRun(t *testing.T) {
+	if Enabled() {
+		// We are the re-executed process, so check that the mappings were
+		// set up.
+		if os.Geteuid() != 0 {
+			t.Fatalf("expected to be root in user namespace: got euid %d", os.Geteuid())
+		}
+		uidMappings, gidMappings, err := Mappings()
+		if err != nil {
+			t.Fatalf("unexpected error getting mappings: %+v", err)
+		}
+		expected := testMappings(0)
+		expected[0].HostID = uidMappings[0].HostID
+		if !reflect.DeepEqual(uidMappings, expected) {
+			t.Errorf("unexpected uid mappings: expected %v, got %v", expected, uidMappings)
+		}
+		if !reflect.DeepEqual(gidMappings, expected) {
+			t.Errorf("unexpected gid mappings: expected %v, got %v", expected, gidMappings)
+		}
+		return
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("fake newuidmap(1) requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestRun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	installFakeHelpers(t, dir)
+
+	mappings := testMappings(os.Geteuid())
+	if err := Run(mappings, mappings); err != nil {
+		t.Fatalf("unexpected error running in user namespace: %+v", err)
+	}
+	if Enabled() {
+		t.Errorf("Enabled() is true outside of the user namespace")
+	}
+}
+
+func TestRunHelperFailure(t *testing.T) {
+	if Enabled() {
+		t.Skip("only run outside of the user namespace")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestRunHelperFailure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, helper := range []string{"newuidmap", "newgidmap"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, helper), []byte("#!/bin/sh\necho 'no subuids' >&2\nexit 1\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+":"+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	err = Run([]rspec.IDMapping{{HostID: 1000, ContainerID: 0, Size: 1}}, nil)
+	if err == nil {
+		t.Fatalf("expected an error with a failing helper")
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		t.Errorf("expected a setup error rather than an exit error: %v", err)
+	}
+	if !strings.Contains(err.Error(), "no subuids") {
+		t.Errorf("expected helper output in error: got %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package vulnscan parses the JSON reports of container image vulnerability
+// scanners (trivy and grype), and summarises the vulnerabilities found in each
+// layer of the scanned image.
+package vulnscan
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// AnnotationSummary is the manifest annotation key used to store the
+	// Summary of all vulnerabilities found in an image.
+	AnnotationSummary = "org.opensuse.umoci.vulnerabilities"
+
+	// AnnotationLayerPrefix is the prefix of the manifest annotation keys used
+	// to store the Summary of the vulnerabilities introduced by each layer. The
+	// rest of the key is the DiffID of the layer.
+	AnnotationLayerPrefix = AnnotationSummary + "."
+
+	// summaryNone is the string form of a Summary without any
+	// vulnerabilities.
+	summaryNone = "NONE"
+)
+
+// LayerAnnotation returns the manifest annotation key used to store the Summary
+// for the layer with the given DiffID.
+func LayerAnnotation(diffID string) string {
+	return AnnotationLayerPrefix + diffID
+}
+
+// Severities is the set of severities that vulnerabilities are classified
+// into, in decreasing order of severity. Severities reported by scanners are
+// normalised to one of these values.
+var Severities = []string{"CRITICAL", "HIGH", "MEDIUM", "LOW", "UNKNOWN"}
+
+// normaliseSeverity converts a scanner-specific severity into one of
+// Severities.
+func normaliseSeverity(severity string) string {
+	severity = strings.ToUpper(severity)
+	switch severity {
+	case "NEGLIGIBLE":
+		return "LOW"
+	}
+	for _, known := range Severities {
+		if severity == known {
+			return severity
+		}
+	}
+	return "UNKNOWN"
+}
+
+// Summary is the number of (unique) vulnerabilities of each severity.
+type Summary map[string]int
+
+// String returns the summary in the form "CRITICAL=1,HIGH=2,...", which is
+// the form stored in annotations. Only non-zero severities are included, and a
+// summary without any vulnerabilities is returned as "NONE".
+func (s Summary) String() string {
+	var parts []string
+	for _, severity := range Severities {
+		if n := s[severity]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", severity, n))
+		}
+	}
+	if len(parts) == 0 {
+		return summaryNone
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseSummary parses a summary in the form returned by Summary.String.
+func ParseSummary(s string) (Summary, error) {
+	summary := Summary{}
+	if s == "" || s == summaryNone {
+		return summary, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid summary entry: %q", part)
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid summary count: %q", part)
+		}
+		summary[normaliseSeverity(kv[0])] += n
+	}
+	return summary, nil
+}
+
+// Report is the summary of a vulnerability scan of an image.
+type Report struct {
+	// Layers maps the digest of each layer (as reported by the scanner, which
+	// is usually the DiffID) to the vulnerabilities introduced by that layer.
+	// Layers without any vulnerabilities are not included.
+	Layers map[digest.Digest]Summary
+
+	// Total is the summary of all vulnerabilities in the image, including
+	// vulnerabilities which the scanner did not attribute to a layer.
+	Total Summary
+}
+
+// reportBuilder deduplicates vulnerabilities while building a Report.
+type reportBuilder struct {
+	report Report
+	seen   map[string]struct{}
+}
+
+func newReportBuilder() *reportBuilder {
+	return &reportBuilder{
+		report: Report{
+			Layers: map[digest.Digest]Summary{},
+			Total:  Summary{},
+		},
+		seen: map[string]struct{}{},
+	}
+}
+
+// add records a vulnerability. The same vulnerability in the same package and
+// layer is only counted once.
+func (b *reportBuilder) add(id, pkg, severity string, layer digest.Digest) {
+	key := strings.Join([]string{id, pkg, layer.String()}, "\x00")
+	if _, ok := b.seen[key]; ok {
+		return
+	}
+	b.seen[key] = struct{}{}
+
+	severity = normaliseSeverity(severity)
+	b.report.Total[severity]++
+	if layer != "" {
+		if b.report.Layers[layer] == nil {
+			b.report.Layers[layer] = Summary{}
+		}
+		b.report.Layers[layer][severity]++
+	}
+}
+
+// trivyReport is the subset of the trivy JSON report format that we use.
+type trivyReport struct {
+	Results []struct {
+		Vulnerabilities []struct {
+			VulnerabilityID string `json:"VulnerabilityID"`
+			PkgName         string `json:"PkgName"`
+			Severity        string `json:"Severity"`
+			Layer           struct {
+				Digest digest.Digest `json:"Digest"`
+				DiffID digest.Digest `json:"DiffID"`
+			} `json:"Layer"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+// ParseTrivy parses a trivy JSON report (as generated by "trivy image
+// --format json"). Vulnerabilities are attributed to layers by DiffID.
+func ParseTrivy(r io.Reader) (*Report, error) {
+	var raw trivyReport
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, errors.Wrap(err, "decode trivy report")
+	}
+
+	builder := newReportBuilder()
+	for _, result := range raw.Results {
+		for _, vuln := range result.Vulnerabilities {
+			layer := vuln.Layer.DiffID
+			if layer == "" {
+				layer = vuln.Layer.Digest
+			}
+			builder.add(vuln.VulnerabilityID, vuln.PkgName, vuln.Severity, layer)
+		}
+	}
+	return &builder.report, nil
+}
+
+// grypeReport is the subset of the grype JSON report format that we use.
+type grypeReport struct {
+	Matches []struct {
+		Vulnerability struct {
+			ID       string `json:"id"`
+			Severity string `json:"severity"`
+		} `json:"vulnerability"`
+		Artifact struct {
+			Name      string `json:"name"`
+			Locations []struct {
+				LayerID digest.Digest `json:"layerID"`
+			} `json:"locations"`
+		} `json:"artifact"`
+	} `json:"matches"`
+}
+
+// ParseGrype parses a grype JSON report (as generated by "grype -o json").
+// Vulnerabilities are attributed to every layer in which the vulnerable
+// package was found, by DiffID.
+func ParseGrype(r io.Reader) (*Report, error) {
+	var raw grypeReport
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, errors.Wrap(err, "decode grype report")
+	}
+
+	builder := newReportBuilder()
+	for _, match := range raw.Matches {
+		vuln := match.Vulnerability
+		if len(match.Artifact.Locations) == 0 {
+			builder.add(vuln.ID, match.Artifact.Name, vuln.Severity, "")
+		}
+		for _, location := range match.Artifact.Locations {
+			builder.add(vuln.ID, match.Artifact.Name, vuln.Severity, location.LayerID)
+		}
+	}
+
+	// The same vulnerability found in several layers should only be counted
+	// once in the total.
+	total := Summary{}
+	seen := map[string]struct{}{}
+	for _, match := range raw.Matches {
+		key := match.Vulnerability.ID + "\x00" + match.Artifact.Name
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		total[normaliseSeverity(match.Vulnerability.Severity)]++
+	}
+	builder.report.Total = total
+	return &builder.report, nil
+}
+
+// Parse parses a vulnerability report, automatically detecting whether it is
+// a trivy or grype report.
+func Parse(r io.Reader) (*Report, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "read report")
+	}
+
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, errors.Wrap(err, "decode report")
+	}
+	if _, ok := probe["matches"]; ok {
+		return ParseGrype(bytes.NewReader(data))
+	}
+	if _, ok := probe["Results"]; ok {
+		return ParseTrivy(bytes.NewReader(data))
+	}
+	return nil, errors.Errorf("unknown report format: expected a trivy or grype JSON report")
+}
+
+// SortedLayers returns the layer digests in r.Layers in sorted order.
+func (r *Report) SortedLayers() []digest.Digest {
+	var layers []digest.Digest
+	for layer := range r.Layers {
+		layers = append(layers, layer)
+	}
+	sort.Slice(layers, func(i, j int) bool { return layers[i] < layers[j] })
+	return layers
+}
@@ -0,0 +1,134 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vulnscan
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	layerA = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	layerB = "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+const trivyJSON = `{
+	"SchemaVersion": 2,
+	"Results": [
+		{
+			"Target": "image (opensuse 42.2)",
+			"Vulnerabilities": [
+				{"VulnerabilityID": "CVE-2017-0001", "PkgName": "bash", "Severity": "CRITICAL", "Layer": {"Digest": "sha256:1111111111111111111111111111111111111111111111111111111111111111", "DiffID": "` + layerA + `"}},
+				{"VulnerabilityID": "CVE-2017-0002", "PkgName": "bash", "Severity": "HIGH", "Layer": {"DiffID": "` + layerA + `"}},
+				{"VulnerabilityID": "CVE-2017-0002", "PkgName": "bash", "Severity": "HIGH", "Layer": {"DiffID": "` + layerA + `"}},
+				{"VulnerabilityID": "CVE-2017-0003", "PkgName": "curl", "Severity": "medium", "Layer": {"DiffID": "` + layerB + `"}}
+			]
+		},
+		{
+			"Target": "app.jar",
+			"Vulnerabilities": [
+				{"VulnerabilityID": "CVE-2017-0004", "PkgName": "log", "Severity": "WEIRD"}
+			]
+		}
+	]
+}`
+
+const grypeJSON = `{
+	"matches": [
+		{
+			"vulnerability": {"id": "CVE-2017-0001", "severity": "Critical"},
+			"artifact": {"name": "bash", "locations": [{"path": "/bin/bash", "layerID": "` + layerA + `"}, {"path": "/bin/bash", "layerID": "` + layerB + `"}]}
+		},
+		{
+			"vulnerability": {"id": "CVE-2017-0005", "severity": "Negligible"},
+			"artifact": {"name": "zlib", "locations": [{"path": "/lib/libz.so", "layerID": "` + layerB + `"}]}
+		}
+	]
+}`
+
+func TestParseTrivy(t *testing.T) {
+	report, err := Parse(strings.NewReader(trivyJSON))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	expectedTotal := Summary{"CRITICAL": 1, "HIGH": 1, "MEDIUM": 1, "UNKNOWN": 1}
+	if !reflect.DeepEqual(report.Total, expectedTotal) {
+		t.Errorf("unexpected total: got %v, expected %v", report.Total, expectedTotal)
+	}
+	if got := report.Layers[layerA].String(); got != "CRITICAL=1,HIGH=1" {
+		t.Errorf("unexpected summary for layer A: %s", got)
+	}
+	if got := report.Layers[layerB].String(); got != "MEDIUM=1" {
+		t.Errorf("unexpected summary for layer B: %s", got)
+	}
+	if len(report.Layers) != 2 {
+		t.Errorf("unexpected number of layers: %v", report.Layers)
+	}
+}
+
+func TestParseGrype(t *testing.T) {
+	report, err := Parse(strings.NewReader(grypeJSON))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	expectedTotal := Summary{"CRITICAL": 1, "LOW": 1}
+	if !reflect.DeepEqual(report.Total, expectedTotal) {
+		t.Errorf("unexpected total: got %v, expected %v", report.Total, expectedTotal)
+	}
+	if got := report.Layers[layerA].String(); got != "CRITICAL=1" {
+		t.Errorf("unexpected summary for layer A: %s", got)
+	}
+	if got := report.Layers[layerB].String(); got != "CRITICAL=1,LOW=1" {
+		t.Errorf("unexpected summary for layer B: %s", got)
+	}
+}
+
+func TestParseUnknown(t *testing.T) {
+	for _, input := range []string{`{"foo": 1}`, `[]`, `not json`} {
+		if _, err := Parse(strings.NewReader(input)); err == nil {
+			t.Errorf("expected error parsing %q", input)
+		}
+	}
+}
+
+func TestSummaryRoundTrip(t *testing.T) {
+	for _, summary := range []Summary{
+		{},
+		{"CRITICAL": 2},
+		{"HIGH": 1, "LOW": 3, "UNKNOWN": 4},
+	} {
+		parsed, err := ParseSummary(summary.String())
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %+v", summary.String(), err)
+			continue
+		}
+		if parsed.String() != summary.String() {
+			t.Errorf("round trip failed: %q != %q", parsed.String(), summary.String())
+		}
+	}
+
+	if _, err := ParseSummary("CRITICAL"); err == nil {
+		t.Errorf("expected error parsing invalid summary")
+	}
+	if _, err := ParseSummary("CRITICAL=x"); err == nil {
+		t.Errorf("expected error parsing invalid summary")
+	}
+}
@@ -0,0 +1,113 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# ref_blob <tag>
+# Outputs the path of the blob referred to by <tag>.
+function ref_blob() {
+	echo "${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/$1" | tr : /)"
+}
+
+@test "umoci annotate [missing args]" {
+	umoci annotate
+	[ "$status" -ne 0 ]
+
+	# Nothing to do.
+	umoci annotate --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Invalid annotations.
+	umoci annotate --image "${IMAGE}:${TAG}" --manifest "novalue"
+	[ "$status" -ne 0 ]
+	umoci annotate --image "${IMAGE}:${TAG}" --manifest "=value"
+	[ "$status" -ne 0 ]
+
+	# --descriptor requires a manifest list.
+	umoci annotate --image "${IMAGE}:${TAG}" --descriptor "key=value"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci annotate --manifest" {
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	HISTORY="$(echo "$output" | jq -SM '.history | length')"
+
+	umoci annotate --image "${IMAGE}:${TAG}" --tag "${TAG}-annotated" --manifest "org.example.a=1" --manifest "org.example.b=2=3"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	[[ "$(jq -SMr '.annotations["org.example.a"]' "$(ref_blob "${TAG}-annotated")")" == "1" ]]
+	[[ "$(jq -SMr '.annotations["org.example.b"]' "$(ref_blob "${TAG}-annotated")")" == "2=3" ]]
+
+	# The configuration (and history) are unchanged.
+	[[ "$(jq -SMc '.config' "$(ref_blob "${TAG}-annotated")")" == "$(jq -SMc '.config' "$(ref_blob "${TAG}")")" ]]
+	umoci stat --image "${IMAGE}:${TAG}-annotated" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '.history | length')" == "$HISTORY" ]]
+
+	# Remove an annotation.
+	umoci annotate --image "${IMAGE}:${TAG}-annotated" --remove-manifest "org.example.a" --remove-manifest "org.example.missing"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	[[ "$(jq -SMr '.annotations["org.example.a"]' "$(ref_blob "${TAG}-annotated")")" == "null" ]]
+	[[ "$(jq -SMr '.annotations["org.example.b"]' "$(ref_blob "${TAG}-annotated")")" == "2=3" ]]
+}
+
+@test "umoci annotate --descriptor" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-arm64" --architecture arm64
+	[ "$status" -eq 0 ]
+	umoci index create --image "${IMAGE}:${TAG}-multi" "${TAG}" "${TAG}-arm64"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci annotate --image "${IMAGE}:${TAG}-multi" --platform linux/arm64 --descriptor "org.example.flavour=minimal"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	[[ "$(jq -SMr '.manifests[1].annotations["org.example.flavour"]' "$(ref_blob "${TAG}-multi")")" == "minimal" ]]
+	[[ "$(jq -SMr '.manifests[0].annotations' "$(ref_blob "${TAG}-multi")")" == "null" ]]
+
+	# Modifying the manifest keeps the annotations of its descriptor.
+	umoci annotate --image "${IMAGE}:${TAG}-multi" --platform linux/arm64 --manifest "org.example.a=1"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	[[ "$(jq -SMr '.manifests[1].annotations["org.example.flavour"]' "$(ref_blob "${TAG}-multi")")" == "minimal" ]]
+	MANIFEST="${IMAGE}/blobs/$(jq -SMr '.manifests[1].digest' "$(ref_blob "${TAG}-multi")" | tr : /)"
+	[[ "$(jq -SMr '.annotations["org.example.a"]' "$MANIFEST")" == "1" ]]
+
+	# The original image is untouched.
+	[[ "$(jq -SMr '.annotations["org.example.a"]' "$(ref_blob "${TAG}-arm64")")" == "null" ]]
+
+	umoci annotate --image "${IMAGE}:${TAG}-multi" --platform linux/arm64 --remove-descriptor "org.example.flavour"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	[[ "$(jq -SMr '.manifests[1].annotations' "$(ref_blob "${TAG}-multi")")" == "null" ]]
+}
@@ -0,0 +1,99 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci artifact push+pull" {
+	INPUT="$(setup_tmpdir)"
+	OUTPUT="$(setup_tmpdir)"
+
+	echo "wasm module" > "$INPUT/module.wasm"
+	echo '{"policy": true}' > "$INPUT/policy.json"
+
+	umoci artifact push --image "${IMAGE}:module" --type "application/vnd.example+json" --annotation "version=1" "$INPUT/module.wasm" "$INPUT/policy.json"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci artifact pull --image "${IMAGE}:module" --type "application/vnd.example+json" --output "$OUTPUT"
+	[ "$status" -eq 0 ]
+	cmp "$INPUT/module.wasm" "$OUTPUT/module.wasm"
+	cmp "$INPUT/policy.json" "$OUTPUT/policy.json"
+
+	# The artifact type must match.
+	umoci artifact pull --image "${IMAGE}:module" --type "application/vnd.other" --output "$OUTPUT"
+	[ "$status" -ne 0 ]
+
+	# Artifacts are retained by gc as long as they are tagged.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	rm -rf "$OUTPUT"/*
+	umoci artifact pull --image "${IMAGE}:module" --output "$OUTPUT"
+	[ "$status" -eq 0 ]
+	cmp "$INPUT/module.wasm" "$OUTPUT/module.wasm"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci artifact push+pull [config]" {
+	INPUT="$(setup_tmpdir)"
+	OUTPUT="$(setup_tmpdir)"
+
+	echo '{"name": "chart"}' > "$INPUT/config.json"
+	echo "chart" > "$INPUT/chart.tgz"
+
+	# --config requires --config-type.
+	umoci artifact push --image "${IMAGE}:chart" --config "$INPUT/config.json" "$INPUT/chart.tgz"
+	[ "$status" -ne 0 ]
+
+	umoci artifact push --image "${IMAGE}:chart" --config "$INPUT/config.json" --config-type "application/vnd.cncf.helm.config.v1+json" "$INPUT/chart.tgz"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci artifact pull --image "${IMAGE}:chart" --output "$OUTPUT" --config "$OUTPUT/config.json"
+	[ "$status" -eq 0 ]
+	cmp "$INPUT/config.json" "$OUTPUT/config.json"
+	cmp "$INPUT/chart.tgz" "$OUTPUT/chart.tgz"
+}
+
+@test "umoci artifact push [invalid arguments]" {
+	INPUT="$(setup_tmpdir)"
+	mkdir "$INPUT/a" "$INPUT/b"
+	echo a > "$INPUT/a/file"
+	echo b > "$INPUT/b/file"
+
+	# Missing --type.
+	umoci artifact push --image "${IMAGE}:artifact" "$INPUT/a/file"
+	[ "$status" -ne 0 ]
+
+	# Files with the same name.
+	umoci artifact push --image "${IMAGE}:artifact" --type "application/vnd.example" "$INPUT/a/file" "$INPUT/b/file"
+	[ "$status" -ne 0 ]
+
+	# Existing tags are not overwritten without --force.
+	umoci artifact push --image "${IMAGE}:${TAG}" --type "application/vnd.example" "$INPUT/a/file"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,174 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci attach [missing args]" {
+	umoci attach --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci attach --image "${IMAGE}:${TAG}" --artifact-type application/vnd.example --annotation nokey
+	[ "$status" -ne 0 ]
+
+	umoci attach --image "${IMAGE}:${TAG}-nonexistent" --artifact-type application/vnd.example
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci attach" {
+	image-verify "${IMAGE}"
+
+	# Nothing is attached to a new image.
+	umoci referrers --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr 'length')" -eq 0 ]]
+
+	ARTIFACT="$(setup_tmpdir)/sbom.json"
+	echo '{"spdxVersion": "SPDX-2.3"}' >"$ARTIFACT"
+
+	umoci attach --image "${IMAGE}:${TAG}" --artifact-type application/spdx+json --media-type application/spdx+json --annotation foo=bar "$ARTIFACT"
+	[ "$status" -eq 0 ]
+	umoci attach --image "${IMAGE}:${TAG}" --artifact-type application/vnd.example.signature
+	[ "$status" -eq 0 ]
+
+	umoci referrers --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr 'length')" -eq 2 ]]
+	[[ "$(echo "$output" | jq -SMr '.[0].artifactType')" == "application/spdx+json" ]]
+	[[ "$(echo "$output" | jq -SMr '.[0].annotations.foo')" == "bar" ]]
+	[[ "$(echo "$output" | jq -SMr '.[1].artifactType')" == "application/vnd.example.signature" ]]
+	artifact="$(echo "$output" | jq -SMr '.[0].descriptor.digest')"
+
+	# The artifact manifest refers to the image and contains the file.
+	subject="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")"
+	[[ "$(jq -SMr '.subject.digest' "${IMAGE}/blobs/$(echo "$artifact" | tr : /)")" == "$subject" ]]
+	[[ "$(jq -SMr '.artifactType' "${IMAGE}/blobs/$(echo "$artifact" | tr : /)")" == "application/spdx+json" ]]
+	blob="$(jq -SMr '.layers[0].digest' "${IMAGE}/blobs/$(echo "$artifact" | tr : /)")"
+	[[ "$(sha256sum "$ARTIFACT" | cut -d' ' -f1)" == "${blob#sha256:}" ]]
+
+	# The artifacts are stored in the referrers index tag.
+	[ -f "${IMAGE}/refs/$(echo "$subject" | tr : -)" ]
+
+	umoci referrers --image "${IMAGE}:${TAG}" --artifact-type application/vnd.example.signature --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr 'length')" -eq 1 ]]
+
+	umoci referrers --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"$artifact"* ]]
+}
+
+@test "umoci attach [gc]" {
+	image-verify "${IMAGE}"
+
+	umoci attach --image "${IMAGE}:${TAG}" --artifact-type application/vnd.example.signature
+	[ "$status" -eq 0 ]
+	umoci referrers --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	artifact="$(echo "$output" | jq -SMr '.[0].descriptor.digest')"
+	subject="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")"
+
+	# Artifacts are kept while the image is referenced.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ -f "${IMAGE}/blobs/$(echo "$artifact" | tr : /)" ]
+
+	# ... and removed along with the referrers index once it isn't.
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	for tag in "${lines[@]}"; do
+		[[ "$tag" == "$(echo "$subject" | tr : -)" ]] && continue
+		umoci rm --image "${IMAGE}:${tag}"
+		[ "$status" -eq 0 ]
+	done
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	! [ -f "${IMAGE}/blobs/$(echo "$artifact" | tr : /)" ]
+	! [ -f "${IMAGE}/refs/$(echo "$subject" | tr : -)" ]
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci attach [gc without referrers index]" {
+	image-verify "${IMAGE}"
+
+	umoci attach --image "${IMAGE}:${TAG}" --artifact-type application/vnd.example.signature
+	[ "$status" -eq 0 ]
+	umoci referrers --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	artifact="$(echo "$output" | jq -SMr '.[0].descriptor.digest')"
+	subject="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")"
+
+	# Remove the referrers index, so the artifact can only be found through
+	# its subject.
+	umoci rm --image "${IMAGE}:$(echo "$subject" | tr : -)"
+	[ "$status" -eq 0 ]
+
+	# The artifact is kept while the image is referenced.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ -f "${IMAGE}/blobs/$(echo "$artifact" | tr : /)" ]
+
+	# ... and removed once it isn't.
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	for tag in "${lines[@]}"; do
+		umoci rm --image "${IMAGE}:${tag}"
+		[ "$status" -eq 0 ]
+	done
+	STATE="$(setup_tmpdir)/gc.json"
+	umoci gc --layout "${IMAGE}" --state "$STATE"
+	[ "$status" -eq 0 ]
+	! [ -f "${IMAGE}/blobs/$(echo "$artifact" | tr : /)" ]
+	sane_run jq -SMr --arg artifact "$artifact" '.deletions[] | select(.digest == $artifact) | .reason' "$STATE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"subject $subject is not reachable"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci attach [gc keeps user tags]" {
+	image-verify "${IMAGE}"
+
+	# A tag which is named like a referrers index (of a blob which doesn't
+	# exist) but wasn't created by umoci-attach(1) is part of the root set.
+	fake="sha256-$(printf '%064d' 0)"
+	umoci tag --image "${IMAGE}:${TAG}" "$fake"
+	[ "$status" -eq 0 ]
+	umoci rm --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ -f "${IMAGE}/refs/$fake" ]
+
+	umoci stat --image "${IMAGE}:$fake"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
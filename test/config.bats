@@ -317,6 +317,36 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci config --show" {
+	image-verify "${IMAGE}"
+	BLOBS_BEFORE="$(find "${IMAGE}/blobs" -type f | sort)"
+	INDEX_BEFORE="$(cat "${IMAGE}/index.json")"
+
+	umoci config --image "${IMAGE}:${TAG}" --show --config.user "show:user" --manifest.annotation "com.cyphar.umoci=show"
+	[ "$status" -eq 0 ]
+	PREVIEW="$output"
+
+	# Nothing should have been written.
+	[[ "$(find "${IMAGE}/blobs" -type f | sort)" == "$BLOBS_BEFORE" ]]
+	[[ "$(cat "${IMAGE}/index.json")" == "$INDEX_BEFORE" ]]
+
+	[[ "$(echo "$PREVIEW" | jq -SMr '.config.config.User')" == "show:user" ]]
+	[[ "$(echo "$PREVIEW" | jq -SMr '.config.history[-1].empty_layer')" == "true" ]]
+	[[ "$(echo "$PREVIEW" | jq -SMr '.manifest.annotations["com.cyphar.umoci"]')" == "show" ]]
+
+	# The preview must match the image that is actually created.
+	umoci config --image "${IMAGE}:${TAG}" --show --config.user "show:user" --history.created "2017-03-01T00:00:00Z"
+	[ "$status" -eq 0 ]
+	PREVIEW_DIGEST="$(echo "$output" | jq -SMr '.manifest.config.digest')"
+
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.user "show:user" --history.created "2017-03-01T00:00:00Z"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The previewed configuration was written.
+	[[ "$(cat "${IMAGE}/blobs/${PREVIEW_DIGEST/://}" | jq -SMr '.config.User')" == "show:user" ]]
+}
+
 @test "umoci config --config.workingdir" {
 	BUNDLE="$(setup_tmpdir)"
 
@@ -395,6 +425,46 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci config --env-file" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Set some variables to be overridden or removed by the file.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.env "VARIABLE1=unused" --config.env "VARIABLE2=removed"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	cat >"$BATS_TMPDIR/env-file" <<EOF
+# Comments are ignored.
+VARIABLE1=test
+export VARIABLE3="quoted value"
+VARIABLE2-
+VARIABLE4=overridden
+EOF
+	umoci config --image "${IMAGE}:${TAG}-new" --env-file "$BATS_TMPDIR/env-file" --config.env "VARIABLE4=flag"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Invalid files are rejected.
+	echo "NOVALUE" >"$BATS_TMPDIR/env-file"
+	umoci config --image "${IMAGE}:${TAG}-new" --env-file "$BATS_TMPDIR/env-file"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image again.
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	sane_run jq -SMr '.process.env[]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"VARIABLE1=test"* ]]
+	[[ "$output" != *"VARIABLE2="* ]]
+	[[ "$output" == *"VARIABLE3=quoted value"* ]]
+	[[ "$output" == *"VARIABLE4=flag"* ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci config --clear=config.{entrypoint or cmd}" {
 	BUNDLE_A="$(setup_tmpdir)"
 	BUNDLE_B="$(setup_tmpdir)"
@@ -672,6 +742,34 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci config --history.config" {
+	CONFIG="$(setup_tmpdir)/history.json"
+	cat >"$CONFIG" <<EOF
+{
+	"author": "Config Author <config@example.com>",
+	"comment": "comment from config",
+	"created_by": "umoci config {image}:{tag}"
+}
+EOF
+
+	# Flags should override the config file.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--history.config="$CONFIG" \
+		--history.comment="comment from flag" \
+		--config.user="1000:1000"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].author')" == "Config Author <config@example.com>" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].comment')" == "comment from flag" ]]
+	# The created_by template should be expanded.
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "umoci config ${IMAGE}:${TAG}-new" ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci config --config.label" {
 	BUNDLE="$(setup_tmpdir)"
 
@@ -698,6 +796,41 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci config --config.labels-file" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--clear=config.labels --config.label="com.cyphar.removed=1"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	cat >"$BATS_TMPDIR/labels.json" <<EOF
+{"com.cyphar.test": "1", "com.cyphar.empty": "", "com.cyphar.removed": null}
+EOF
+	umoci config --image "${IMAGE}:${TAG}-new" --config.labels-file "$BATS_TMPDIR/labels.json"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image again.
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	sane_run jq -SMr '.annotations["com.cyphar.test"]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "1" ]]
+
+	sane_run jq -SMr '.annotations["com.cyphar.empty"]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "" ]]
+
+	sane_run jq -SM '.annotations | has("com.cyphar.removed")' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "false" ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci config --manifest.annotation" {
 	BUNDLE="$(setup_tmpdir)"
 
@@ -792,3 +925,118 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci config --patch" {
+	PATCHDIR="$(setup_tmpdir)"
+
+	cat >"$PATCHDIR/patch.json" <<-EOF
+	[
+		{"op": "test", "path": "/config/User", "value": "flag:user"},
+		{"op": "replace", "path": "/config/User", "value": "patched:user"},
+		{"op": "add", "path": "/config/StopSignal", "value": "SIGUMOCI"}
+	]
+	EOF
+
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.user "flag:user" --patch "$PATCHDIR/patch.json"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The patch is applied after the flags.
+	umoci config --image "${IMAGE}:${TAG}-new" --show
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.config.config.User')" == "patched:user" ]]
+
+	# Fields unknown to umoci are written to the configuration.
+	sane_run grep -rl '"StopSignal":"SIGUMOCI"' "${IMAGE}/blobs"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+
+	# Failing tests, invalid patches and changes to the rootfs are rejected.
+	echo '[{"op": "test", "path": "/config/User", "value": "wrong:user"}]' >"$PATCHDIR/test.json"
+	umoci config --image "${IMAGE}:${TAG}-new" --patch "$PATCHDIR/test.json"
+	[ "$status" -ne 0 ]
+
+	echo '[{"op": "frobnicate", "path": "/config"}]' >"$PATCHDIR/invalid.json"
+	umoci config --image "${IMAGE}:${TAG}-new" --patch "$PATCHDIR/invalid.json"
+	[ "$status" -ne 0 ]
+
+	echo '[{"op": "remove", "path": "/rootfs/diff_ids/0"}]' >"$PATCHDIR/rootfs.json"
+	umoci config --image "${IMAGE}:${TAG}-new" --patch "$PATCHDIR/rootfs.json"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --config.{stopsignal,healthcheck.*}" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--config.stopsignal "SIGUMOCI" \
+		--config.healthcheck.test "/bin/check" --config.healthcheck.test "--quick" \
+		--config.healthcheck.interval "30s" --config.healthcheck.retries 3
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Find the new configuration blob.
+	sane_run grep -rl '"StopSignal":"SIGUMOCI"' "${IMAGE}/blobs"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	CONFIG="${lines[0]}"
+
+	# The test is prefixed with CMD, and durations are stored in nanoseconds.
+	[[ "$(jq -SMrc '.config.Healthcheck.Test' "$CONFIG")" == '["CMD","/bin/check","--quick"]' ]]
+	[[ "$(jq -SMr '.config.Healthcheck.Interval' "$CONFIG")" == "30000000000" ]]
+	[[ "$(jq -SMr '.config.Healthcheck.Retries' "$CONFIG")" == "3" ]]
+	[[ "$(jq -SMr '.config.Healthcheck.Timeout' "$CONFIG")" == "null" ]]
+
+	# Other modifications preserve the fields.
+	umoci config --image "${IMAGE}:${TAG}-new" --config.user "flag:user"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run grep -rl '"User":"flag:user"' "${IMAGE}/blobs"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	CONFIG="${lines[0]}"
+	[[ "$(jq -SMr '.config.StopSignal' "$CONFIG")" == "SIGUMOCI" ]]
+	[[ "$(jq -SMrc '.config.Healthcheck.Test' "$CONFIG")" == '["CMD","/bin/check","--quick"]' ]]
+
+	# Clear both fields.
+	umoci config --image "${IMAGE}:${TAG}-new" --clear=config.stopsignal --clear=config.healthcheck --config.user "clear:user"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run grep -rl '"User":"clear:user"' "${IMAGE}/blobs"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	CONFIG="${lines[0]}"
+	[[ "$(jq -SMr '.config.StopSignal' "$CONFIG")" == "null" ]]
+	[[ "$(jq -SMr '.config.Healthcheck' "$CONFIG")" == "null" ]]
+
+	# Healthcheck options require a test, and must be valid.
+	umoci config --image "${IMAGE}:${TAG}" --config.healthcheck.interval "30s"
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --config.healthcheck.test "/bin/check" --config.healthcheck.timeout "forever"
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --config.healthcheck.test "NONE" --config.healthcheck.test "/bin/check"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --config.exposedports" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--config.exposedports "80" --config.exposedports "53/udp" --config.exposedports "8080/tcp"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci config --image "${IMAGE}:${TAG}-new" --show
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMrc '.config.config.ExposedPorts | keys')" == '["53/udp","80","8080/tcp"]' ]]
+
+	# Invalid ports are rejected.
+	for port in "http" "0" "65536" "80/icmp"; do
+		umoci config --image "${IMAGE}:${TAG}" --config.exposedports "$port"
+		[ "$status" -ne 0 ]
+	done
+
+	image-verify "${IMAGE}"
+}
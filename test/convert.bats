@@ -0,0 +1,89 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci convert [missing args]" {
+	umoci convert
+	[ "$status" -ne 0 ]
+
+	umoci convert --from "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci convert --to "$(setup_tmpdir)/chunked"
+	[ "$status" -ne 0 ]
+
+	umoci convert --from "${IMAGE}" --to "$(setup_tmpdir)/chunked" --format invalid
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci convert [chunked]" {
+	CHUNKED="$(setup_tmpdir)/chunked"
+	NEWIMAGE="$(setup_tmpdir)/image"
+
+	# Convert the image to a chunked image.
+	umoci convert --from "${IMAGE}" --to "${CHUNKED}"
+	[ "$status" -eq 0 ]
+	[ -f "${CHUNKED}/chunked-layout" ]
+
+	# The chunked image can be used like any other image.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	umoci stat --image "${CHUNKED}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${CHUNKED}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	umoci repack --image "${CHUNKED}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# A gc only removes the blobs (and chunks) of the old tag.
+	umoci rm --image "${CHUNKED}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci gc --layout "${CHUNKED}"
+	[ "$status" -eq 0 ]
+
+	# Convert the chunked image back to an OCI image layout.
+	umoci convert --from "${CHUNKED}" --to "${NEWIMAGE}" --format dir
+	[ "$status" -eq 0 ]
+	image-verify "${NEWIMAGE}"
+
+	umoci ls --layout "${NEWIMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	[[ "$output" == "${TAG}-new" ]]
+
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${NEWIMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(cat "$BUNDLE/rootfs/newfile")" == "new file" ]]
+}
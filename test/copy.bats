@@ -0,0 +1,249 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci copy [missing args]" {
+	umoci copy
+	[ "$status" -ne 0 ]
+
+	umoci copy --from "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci copy --to "${IMAGE}:${TAG}-new"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci copy" {
+	NEWIMAGE="$(setup_tmpdir)/image"
+
+	umoci init --layout "${NEWIMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${NEWIMAGE}"
+
+	# Copy the image.
+	umoci copy --from "${IMAGE}:${TAG}" --to "${NEWIMAGE}:${TAG}-copy"
+	[ "$status" -eq 0 ]
+	image-verify "${NEWIMAGE}"
+
+	# The two tags should be identical.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	umoci stat --image "${NEWIMAGE}:${TAG}-copy" --json
+	[ "$status" -eq 0 ]
+	newOutput="$output"
+	[[ "$oldOutput" == "$newOutput" ]]
+
+	# A gc of the new image shouldn't remove anything.
+	sane_run find "$NEWIMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	nblobs="${#lines[@]}"
+	umoci gc --layout "${NEWIMAGE}"
+	[ "$status" -eq 0 ]
+	sane_run find "$NEWIMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nblobs" ]
+
+	# Copying again should not add any blobs.
+	umoci copy --from "${IMAGE}:${TAG}" --to "${NEWIMAGE}:${TAG}-copy2"
+	[ "$status" -eq 0 ]
+	sane_run find "$NEWIMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nblobs" ]
+
+	image-verify "${IMAGE}"
+	image-verify "${NEWIMAGE}"
+}
+
+@test "umoci copy [resume]" {
+	NEWIMAGE="$(setup_tmpdir)/image"
+
+	umoci init --layout "${NEWIMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${NEWIMAGE}"
+
+	# Fake an interrupted copy of the largest blob.
+	blob="$(ls -S "${IMAGE}/blobs/sha256" | head -n1)"
+	mkdir -p "${NEWIMAGE}/uploads"
+	head -c 512 "${IMAGE}/blobs/sha256/$blob" >"${NEWIMAGE}/uploads/copy-sha256-$blob"
+
+	# A gc must not remove the partial blob.
+	umoci gc --layout "${NEWIMAGE}"
+	[ "$status" -eq 0 ]
+	[ -f "${NEWIMAGE}/uploads/copy-sha256-$blob" ]
+
+	# The copy is resumed.
+	umoci --log=info copy --from "${IMAGE}:${TAG}" --to "${NEWIMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"resuming interrupted copy"* ]]
+	[ ! -e "${NEWIMAGE}/uploads/copy-sha256-$blob" ]
+	cmp "${IMAGE}/blobs/sha256/$blob" "${NEWIMAGE}/blobs/sha256/$blob"
+	image-verify "${NEWIMAGE}"
+
+	# A corrupted partial blob is discarded.
+	umoci init --layout "${NEWIMAGE}-2"
+	[ "$status" -eq 0 ]
+	mkdir -p "${NEWIMAGE}-2/uploads"
+	head -c 512 /dev/zero >"${NEWIMAGE}-2/uploads/copy-sha256-$blob"
+	umoci copy --from "${IMAGE}:${TAG}" --to "${NEWIMAGE}-2:${TAG}"
+	[ "$status" -ne 0 ]
+	[ ! -e "${NEWIMAGE}-2/uploads/copy-sha256-$blob" ]
+	umoci copy --from "${IMAGE}:${TAG}" --to "${NEWIMAGE}-2:${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${NEWIMAGE}-2"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci copy [clobber]" {
+	# Create a different tag.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --author="Someone"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Copying over a different tag requires --force.
+	umoci copy --from "${IMAGE}:${TAG}" --to "${IMAGE}:${TAG}-new"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	umoci copy --from "${IMAGE}:${TAG}" --to "${IMAGE}:${TAG}-new" --force
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci copy --{strip,replace}-annotation" {
+	NEWIMAGE="$(setup_tmpdir)/image"
+
+	umoci init --layout "${NEWIMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${NEWIMAGE}"
+
+	# Add some annotations.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-annotated" \
+		--manifest.annotation "com.example.build.url=https://internal.example.com/1" \
+		--manifest.annotation "com.example.build.host=builder" \
+		--manifest.annotation "com.example.vendor=internal" \
+		--manifest.annotation "com.example.keep=yes"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Copy the image while filtering the annotations.
+	umoci copy --from "${IMAGE}:${TAG}-annotated" --to "${NEWIMAGE}:${TAG}" \
+		--strip-annotation "com.example.build.*" \
+		--replace-annotation "com.example.vendor=public"
+	[ "$status" -eq 0 ]
+	image-verify "${NEWIMAGE}"
+
+	# Check the annotations of the new manifest.
+	manifest="$(jq -SMr '.digest' "${NEWIMAGE}/refs/${TAG}" | tr : /)"
+	sane_run jq -SMr '.annotations | keys | join(",")' "${NEWIMAGE}/blobs/$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "com.example.keep,com.example.vendor" ]]
+	sane_run jq -SMr '.annotations["com.example.vendor"]' "${NEWIMAGE}/blobs/$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "public" ]]
+
+	# The original manifest must not have been copied.
+	! grep -r "internal.example.com" "${NEWIMAGE}/blobs"
+
+	# The image configuration is unchanged.
+	umoci stat --image "${IMAGE}:${TAG}-annotated" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	umoci stat --image "${NEWIMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+
+	# Invalid arguments.
+	umoci copy --from "${IMAGE}:${TAG}" --to "${NEWIMAGE}:${TAG}-bad" --replace-annotation "novalue"
+	[ "$status" -ne 0 ]
+	umoci copy --from "${IMAGE}:${TAG}" --to "${NEWIMAGE}:${TAG}-bad" --strip-annotation "[invalid"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+	image-verify "${NEWIMAGE}"
+}
+
+@test "umoci --compress-blobs" {
+	SRCIMAGE="$(setup_tmpdir)/image"
+	NEWIMAGE="$(setup_tmpdir)/image"
+	WORKDIR="$(setup_tmpdir)"
+
+	umoci init --layout "${SRCIMAGE}"
+	[ "$status" -eq 0 ]
+	umoci init --layout "${NEWIMAGE}"
+	[ "$status" -eq 0 ]
+
+	# umoci only generates compressed layers, so create an image with an
+	# uncompressed layer by hand.
+	ROOTFS="$(setup_tmpdir)"
+	echo "compressed layer" > "$ROOTFS/file"
+	sane_run tar cf "$WORKDIR/layer.tar" -C "$ROOTFS" .
+	[ "$status" -eq 0 ]
+	LAYER="$(sha256sum "$WORKDIR/layer.tar" | cut -d' ' -f1)"
+	LAYER_SIZE="$(stat -c %s "$WORKDIR/layer.tar")"
+	mv "$WORKDIR/layer.tar" "$SRCIMAGE/blobs/sha256/$LAYER"
+
+	echo '{"architecture": "amd64", "os": "linux", "config": {}, "rootfs": {"type": "layers", "diff_ids": ["sha256:'"$LAYER"'"]}}' > "$WORKDIR/config.json"
+	CONFIG="$(sha256sum "$WORKDIR/config.json" | cut -d' ' -f1)"
+	CONFIG_SIZE="$(stat -c %s "$WORKDIR/config.json")"
+	mv "$WORKDIR/config.json" "$SRCIMAGE/blobs/sha256/$CONFIG"
+
+	echo '{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:'"$CONFIG"'", "size": '"$CONFIG_SIZE"'}, "layers": [{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": "sha256:'"$LAYER"'", "size": '"$LAYER_SIZE"'}]}' > "$WORKDIR/manifest.json"
+	MANIFEST="$(sha256sum "$WORKDIR/manifest.json" | cut -d' ' -f1)"
+	MANIFEST_SIZE="$(stat -c %s "$WORKDIR/manifest.json")"
+	mv "$WORKDIR/manifest.json" "$SRCIMAGE/blobs/sha256/$MANIFEST"
+
+	echo '{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:'"$MANIFEST"'", "size": '"$MANIFEST_SIZE"'}' > "$SRCIMAGE/refs/${TAG}"
+	image-verify "${SRCIMAGE}"
+
+	# Only the uncompressed layer is stored compressed.
+	umoci --compress-blobs copy --from "${SRCIMAGE}:${TAG}" --to "${NEWIMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[ -f "$NEWIMAGE/blobs/sha256/$LAYER.zst" ]
+	[ ! -e "$NEWIMAGE/blobs/sha256/$LAYER" ]
+	[ -f "$NEWIMAGE/blobs/sha256/$CONFIG" ]
+	[ -f "$NEWIMAGE/blobs/sha256/$MANIFEST" ]
+
+	# The compressed layer is read transparently, so copying the image to
+	# another image restores the uncompressed layer.
+	umoci stat --image "${NEWIMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	COPYIMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "${COPYIMAGE}"
+	[ "$status" -eq 0 ]
+	umoci copy --from "${NEWIMAGE}:${TAG}" --to "${COPYIMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${COPYIMAGE}"
+	cmp "$SRCIMAGE/blobs/sha256/$LAYER" "$COPYIMAGE/blobs/sha256/$LAYER"
+
+	# Removing the image removes the compressed layer.
+	umoci rm --image "${NEWIMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci gc --layout "${NEWIMAGE}"
+	[ "$status" -eq 0 ]
+	[ ! -e "$NEWIMAGE/blobs/sha256/$LAYER.zst" ]
+}
@@ -125,3 +125,94 @@ function teardown() {
 	# XXX: oci-image-validate doesn't like empty images (without layers)
 	#image-verify "$NEWIMAGE"
 }
+
+@test "umoci new --scratch" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Setup up $NEWIMAGE.
+	NEWIMAGE="$(setup_tmpdir)"
+	rm -rf "$NEWIMAGE"
+
+	umoci init --layout "$NEWIMAGE"
+	[ "$status" -eq 0 ]
+	image-verify "$NEWIMAGE"
+
+	# Scratch images are reproducible.
+	umoci new --scratch --image "${NEWIMAGE}:a"
+	[ "$status" -eq 0 ]
+	umoci new --scratch --image "${NEWIMAGE}:b"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SM '.digest' "$NEWIMAGE/refs/a")" == "$(jq -SM '.digest' "$NEWIMAGE/refs/b")" ]]
+
+	# The config only contains the platform and rootfs.
+	umoci stat --image "${NEWIMAGE}:a" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '.history | length')" == "0" ]]
+
+	# Unpacking gives an empty rootfs and a valid config.json.
+	umoci unpack --image "${NEWIMAGE}:a" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	sane_run find "$BUNDLE/rootfs"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+
+	# Layers and configuration can be added on top of a scratch image.
+	echo "hello" > "$BUNDLE/rootfs/hello"
+	umoci repack --image "${NEWIMAGE}:a" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci config --image "${NEWIMAGE}:a" --config.cmd "/hello"
+	[ "$status" -eq 0 ]
+	image-verify "$NEWIMAGE"
+
+	umoci stat --image "${NEWIMAGE}:a" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '[.history[] | select(.layer != null)] | length')" == "1" ]]
+
+	# ... without modifying the other scratch image.
+	[[ "$(jq -SM '.digest' "$NEWIMAGE/refs/a")" != "$(jq -SM '.digest' "$NEWIMAGE/refs/b")" ]]
+}
+
+@test "umoci new --from" {
+	# Invalid --from values.
+	umoci new --image "${IMAGE}:child" --from "nonexistent"
+	[ "$status" -ne 0 ]
+	umoci new --image "${IMAGE}:child" --from "${TAG}" --scratch
+	[ "$status" -ne 0 ]
+	[ ! -e "$IMAGE/refs/child" ]
+
+	# Derive a child from a tag.
+	umoci new --image "${IMAGE}:child" --from "${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	PARENT="$(jq -r '.digest' "$IMAGE/refs/${TAG}")"
+	CHILD="$(jq -r '.digest' "$IMAGE/refs/child")"
+	[[ "$PARENT" != "$CHILD" ]]
+
+	# The child has the same configuration and layers, and records its parent.
+	PARENT_BLOB="$IMAGE/blobs/${PARENT/://}"
+	CHILD_BLOB="$IMAGE/blobs/${CHILD/://}"
+	[[ "$(jq -SMc '.config' "$CHILD_BLOB")" == "$(jq -SMc '.config' "$PARENT_BLOB")" ]]
+	[[ "$(jq -SMc '.layers' "$CHILD_BLOB")" == "$(jq -SMc '.layers' "$PARENT_BLOB")" ]]
+	[[ "$(jq -r '.annotations["org.opencontainers.image.base.digest"]' "$CHILD_BLOB")" == "$PARENT" ]]
+	[[ "$(jq -r '.annotations["org.opencontainers.image.base.name"]' "$CHILD_BLOB")" == "${TAG}" ]]
+
+	# Modifying the child doesn't modify the parent.
+	umoci config --image "${IMAGE}:child" --config.user "1234:1332"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -r '.digest' "$IMAGE/refs/${TAG}")" == "$PARENT" ]]
+
+	# Derive a grandchild from an abbreviated digest.
+	CHILD="$(jq -r '.digest' "$IMAGE/refs/child")"
+	umoci new --image "${IMAGE}:grandchild" --from "${CHILD:7:12}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	GRANDCHILD_BLOB="$IMAGE/blobs/$(jq -r '.digest' "$IMAGE/refs/grandchild" | tr : /)"
+	[[ "$(jq -r '.annotations["org.opencontainers.image.base.digest"]' "$GRANDCHILD_BLOB")" == "$CHILD" ]]
+	[[ "$(jq -r '.annotations["org.opencontainers.image.base.name"]' "$GRANDCHILD_BLOB")" == "null" ]]
+
+	umoci stat --image "${IMAGE}:grandchild" --json
+	[ "$status" -eq 0 ]
+}
@@ -0,0 +1,91 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci dedup [missing args]" {
+	POOL="$(setup_tmpdir)/pool"
+
+	umoci dedup "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci dedup --blob-pool "$POOL"
+	[ "$status" -ne 0 ]
+
+	umoci dedup --blob-pool "$POOL" --link-mode invalid "${IMAGE}"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci dedup" {
+	DIR="$(setup_tmpdir)"
+	POOL="$DIR/pool"
+
+	# Create a copy of the image.
+	cp -a "${IMAGE}" "$DIR/image"
+	image-verify "$DIR/image"
+
+	umoci dedup --blob-pool "$POOL" "${IMAGE}" "$DIR/image"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	image-verify "$DIR/image"
+
+	# Every blob is now shared with the pool.
+	for blob in "${IMAGE}/blobs/sha256/"*; do
+		hex="$(basename "$blob")"
+		[ "$blob" -ef "$POOL/sha256/$hex" ]
+		[ "$DIR/image/blobs/sha256/$hex" -ef "$POOL/sha256/$hex" ]
+	done
+
+	# The images are still usable.
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "$DIR/image:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+}
+
+@test "umoci copy --blob-pool" {
+	DIR="$(setup_tmpdir)"
+	POOL="$DIR/pool"
+
+	# --link-mode requires --blob-pool.
+	umoci init --layout "$DIR/image"
+	[ "$status" -eq 0 ]
+	umoci copy --link-mode hardlink --from "${IMAGE}:${TAG}" --to "$DIR/image:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci dedup --blob-pool "$POOL" "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	# Blobs are linked from the pool.
+	umoci copy --blob-pool "$POOL" --from "${IMAGE}:${TAG}" --to "$DIR/image:${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "$DIR/image"
+	for blob in "$DIR/image/blobs/sha256/"*; do
+		[ "$blob" -ef "$POOL/sha256/$(basename "$blob")" ]
+	done
+
+	image-verify "${IMAGE}"
+}
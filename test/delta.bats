@@ -0,0 +1,123 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci delta [missing args]" {
+	umoci delta
+	[ "$status" -ne 0 ]
+
+	umoci delta --layout "${IMAGE}" --from "${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci delta --layout "${IMAGE}" --to "${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci delta apply --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci delta" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	EDGE="$(setup_tmpdir)/image"
+	TRANSFER="$(setup_tmpdir)/image"
+
+	image-verify "${IMAGE}"
+
+	# Create an image with a large layer, and an update of it.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	dd if=/dev/urandom of="$BUNDLE_A/rootfs/bigfile" bs=1M count=2
+	umoci repack --image "${IMAGE}:${TAG}-v1" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	echo "updated" >> "$BUNDLE_A/rootfs/bigfile"
+	echo "new file" > "$BUNDLE_A/rootfs/newfile"
+	umoci repack --image "${IMAGE}:${TAG}-v2" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The edge image only has the old image.
+	umoci init --layout "${EDGE}"
+	[ "$status" -eq 0 ]
+	umoci copy --from "${IMAGE}:${TAG}-v1" --to "${EDGE}:${TAG}-v1"
+	[ "$status" -eq 0 ]
+	image-verify "${EDGE}"
+
+	# Create the delta.
+	umoci delta --layout "${IMAGE}" --from "${TAG}-v1" --to "${TAG}-v2"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci referrers --image "${IMAGE}:${TAG}-v2" --artifact-type application/vnd.opensuse.umoci.delta.v1
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+
+	# Only the delta should need to be transferred, which is much smaller
+	# than the layer.
+	umoci init --layout "${TRANSFER}"
+	[ "$status" -eq 0 ]
+	umoci copy --from "${IMAGE}:delta-${TAG}-v1-${TAG}-v2" --to "${TRANSFER}:delta"
+	[ "$status" -eq 0 ]
+	sane_run du -sk "${TRANSFER}/blobs"
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | cut -f1)" -lt 512 ]
+
+	# Apply the delta on the edge.
+	umoci copy --from "${TRANSFER}:delta" --to "${EDGE}:delta"
+	[ "$status" -eq 0 ]
+	umoci delta apply --image "${EDGE}:delta" "${TAG}-v2"
+	[ "$status" -eq 0 ]
+	image-verify "${EDGE}"
+
+	# The reconstructed image must be identical.
+	umoci stat --image "${IMAGE}:${TAG}-v2" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	umoci stat --image "${EDGE}:${TAG}-v2" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+	[[ "$(cat "${IMAGE}/refs/${TAG}-v2")" == "$(cat "${EDGE}/refs/${TAG}-v2")" ]]
+
+	umoci unpack --image "${EDGE}:${TAG}-v2" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	cmp "$BUNDLE_A/rootfs/bigfile" "$BUNDLE_B/rootfs/bigfile"
+	[ -f "$BUNDLE_B/rootfs/newfile" ]
+
+	# Applying the delta without the old image must fail.
+	umoci rm --image "${EDGE}:${TAG}-v1"
+	[ "$status" -eq 0 ]
+	umoci rm --image "${EDGE}:${TAG}-v2"
+	[ "$status" -eq 0 ]
+	umoci gc --layout "${EDGE}"
+	[ "$status" -eq 0 ]
+	umoci delta apply --image "${EDGE}:delta" "${TAG}-v2"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,119 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci diff [missing args]" {
+	umoci diff
+	[ "$status" -ne 0 ]
+
+	umoci diff "$(setup_tmpdir)"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci diff" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	LAYER="$(setup_tmpdir)/layer.tar"
+
+	# Unpack the image to get a starting rootfs.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Make a modified copy of the rootfs.
+	sane_run cp -a "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -eq 0 ]
+	echo "new file" > "$BUNDLE_B/rootfs/newfile"
+	rm -rf "$BUNDLE_B/rootfs/etc"
+
+	umoci diff --output "$LAYER" "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -eq 0 ]
+
+	# The layer should contain the new file and a whiteout.
+	sane_run tar tf "$LAYER"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"newfile"* ]]
+	[[ "$output" == *".wh.etc"* ]]
+	# And nothing under the removed directory.
+	! [[ "$output" == *"etc/"* ]]
+
+	# Compressed output should have the same contents.
+	umoci diff --compress --output "$LAYER.gz" "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -eq 0 ]
+	sane_run tar tzf "$LAYER.gz"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"newfile"* ]]
+	[[ "$output" == *".wh.etc"* ]]
+
+	# A diff of identical trees should be empty.
+	umoci diff --output "$LAYER" "$BUNDLE_A/rootfs" "$BUNDLE_A/rootfs"
+	[ "$status" -eq 0 ]
+	sane_run tar tf "$LAYER"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+}
+
+@test "umoci diff --whiteout-format" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	LAYER="$(setup_tmpdir)/layer.tar"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	sane_run cp -a "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -eq 0 ]
+	rm -rf "$BUNDLE_B/rootfs/etc"
+
+	# aufs whiteouts are the default.
+	umoci diff --whiteout-format=aufs --output "$LAYER" "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -eq 0 ]
+	sane_run tar tf "$LAYER"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *".wh.etc"* ]]
+
+	# overlayfs whiteouts are 0:0 character devices.
+	umoci diff --whiteout-format=overlayfs --output "$LAYER" "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -eq 0 ]
+	sane_run tar tvf "$LAYER"
+	[ "$status" -eq 0 ]
+	! [[ "$output" == *".wh."* ]]
+	! [[ "$output" == *"etc/"* ]]
+	[[ "$(echo "$output" | grep ' etc$')" == c* ]]
+
+	# Removing paths fails with reject.
+	umoci diff --whiteout-format=reject --output "$LAYER" "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -ne 0 ]
+
+	# But it's fine if nothing was removed.
+	umoci diff --whiteout-format=reject --output "$LAYER" "$BUNDLE_B/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -eq 0 ]
+
+	# Unknown formats are rejected.
+	umoci diff --whiteout-format=bogus --output "$LAYER" "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -ne 0 ]
+}
@@ -0,0 +1,126 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci import/export [invalid arguments]" {
+	ARCHIVE="$(setup_tmpdir)/image.tar"
+
+	umoci export --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci export --image "${IMAGE}:${TAG}" --format oci "$ARCHIVE"
+	[ "$status" -ne 0 ]
+	! [ -e "$ARCHIVE" ]
+
+	umoci export --image "${IMAGE}:${TAG}-nonexistent" "$ARCHIVE"
+	[ "$status" -ne 0 ]
+	! [ -e "$ARCHIVE" ]
+
+	umoci import --image "${IMAGE}:${TAG}-import"
+	[ "$status" -ne 0 ]
+
+	umoci import --image "${IMAGE}:${TAG}-import" "oci:$ARCHIVE"
+	[ "$status" -ne 0 ]
+
+	umoci import --image "${IMAGE}:${TAG}-import" "docker-archive:$ARCHIVE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export --format=docker-archive" {
+	ARCHIVE="$(setup_tmpdir)/image.tar"
+
+	umoci export --image "${IMAGE}:${TAG}" --repo-tag "localhost:5000/umoci:test" "$ARCHIVE"
+	[ "$status" -eq 0 ]
+
+	# The output must not be overwritten.
+	umoci export --image "${IMAGE}:${TAG}" "$ARCHIVE"
+	[ "$status" -ne 0 ]
+
+	sane_run tar -xOf "$ARCHIVE" manifest.json
+	[ "$status" -eq 0 ]
+	manifest="$output"
+	sane_run jq -r '.[0].RepoTags[0]' <<<"$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "localhost:5000/umoci:test" ]]
+
+	# Every layer must be in the archive.
+	sane_run jq -r '.[0].Layers[]' <<<"$manifest"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -gt 0 ]
+	layers=("${lines[@]}")
+	sane_run tar -tf "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	for layer in "${layers[@]}"; do
+		[[ "$output" == *"$layer"* ]]
+	done
+
+	sane_run tar -xOf "$ARCHIVE" repositories
+	[ "$status" -eq 0 ]
+	sane_run jq -r '."localhost:5000/umoci".test' <<<"$output"
+	[ "$status" -eq 0 ]
+	[[ "${layers[-1]}" == "$output/layer.tar" ]]
+}
+
+@test "umoci import docker-archive:" {
+	ARCHIVE="$(setup_tmpdir)/image.tar"
+
+	umoci export --image "${IMAGE}:${TAG}" --repo-tag "umoci:a" --repo-tag "umoci:b" "$ARCHIVE"
+	[ "$status" -eq 0 ]
+
+	# The archive has more than one tag, but only one image.
+	umoci import --image "${IMAGE}:${TAG}-import" "docker-archive:$ARCHIVE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci import --image "${IMAGE}:${TAG}-import-b" "docker-archive:$ARCHIVE:umoci:b"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci import --image "${IMAGE}:${TAG}-import-c" "docker-archive:$ARCHIVE:umoci:c"
+	[ "$status" -ne 0 ]
+
+	# Existing tags are not clobbered without --force.
+	umoci new --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	umoci import --image "${IMAGE}:${TAG}-new" "docker-archive:$ARCHIVE"
+	[ "$status" -ne 0 ]
+	umoci import --image "${IMAGE}:${TAG}-new" --force "docker-archive:$ARCHIVE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The imported image has the same configuration and layers.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '[.history[] | .diff_id]' <<<"$output"
+	[ "$status" -eq 0 ]
+	oldDiffIDs="$output"
+	umoci stat --image "${IMAGE}:${TAG}-import" --json
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '[.history[] | .diff_id]' <<<"$output"
+	[ "$status" -eq 0 ]
+	[[ "$oldDiffIDs" == "$output" ]]
+}
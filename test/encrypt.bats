@@ -0,0 +1,160 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# setup_keys generates an RSA key pair (with a certificate) and an ECDSA key
+# pair in the given directory.
+function setup_keys() {
+	openssl genrsa -out "$1/rsa.pem" 2048
+	openssl rsa -in "$1/rsa.pem" -pubout -out "$1/rsa.pub"
+	openssl req -x509 -new -key "$1/rsa.pem" -subj "/CN=umoci" -days 1 -out "$1/rsa.crt"
+	openssl ecparam -name prime256v1 -genkey -noout -out "$1/ec.pem"
+	openssl ec -in "$1/ec.pem" -pubout -out "$1/ec.pub"
+}
+
+# manifest_layers prints the layer descriptors of the manifest of the given tag.
+function manifest_layers() {
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/$1" | cut -d: -f2)"
+	jq -SMc '.layers[]' "${IMAGE}/blobs/sha256/$manifest"
+}
+
+@test "umoci encrypt [missing args]" {
+	umoci encrypt --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci encrypt --image "${IMAGE}:${TAG}" --recipient "$(setup_tmpdir)/key.pub"
+	[ "$status" -ne 0 ]
+
+	umoci decrypt --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci encrypt" {
+	KEYS="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+	setup_keys "$KEYS"
+
+	image-verify "${IMAGE}"
+
+	umoci encrypt --image "${IMAGE}:${TAG}" --tag "${TAG}-enc" \
+		--recipient "jwe:$KEYS/rsa.pub" --recipient "jwe:$KEYS/ec.pub" --recipient "pkcs7:$KEYS/rsa.crt"
+	[ "$status" -eq 0 ]
+
+	# Every layer is encrypted, and its keys are in the annotations.
+	sane_run manifest_layers "${TAG}-enc"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -gt 0 ]
+	for layer in "${lines[@]}"; do
+		[[ "$(echo "$layer" | jq -SMr '.mediaType')" == *"+encrypted" ]]
+		[[ "$(echo "$layer" | jq -SMr '.annotations["org.opencontainers.image.enc.keys.jwe"]')" != "null" ]]
+		[[ "$(echo "$layer" | jq -SMr '.annotations["org.opencontainers.image.enc.keys.pkcs7"]')" != "null" ]]
+		[[ "$(echo "$layer" | jq -SMr '.annotations["org.opencontainers.image.enc.pubopts"]')" != "null" ]]
+	done
+
+	# The original image is unmodified.
+	sane_run manifest_layers "${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"+encrypted"* ]]
+
+	# The image cannot be unpacked without a key.
+	umoci unpack --image "${IMAGE}:${TAG}-enc" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"layer is encrypted"* ]]
+	rm -rf "$BUNDLE"
+
+	# ... or with the wrong key.
+	openssl genrsa -out "$KEYS/other.pem" 2048
+	umoci unpack --image "${IMAGE}:${TAG}-enc" --decryption-key "$KEYS/other.pem" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"no key can decrypt the layer"* ]]
+	rm -rf "$BUNDLE"
+
+	# But any of the recipients can unpack it.
+	for key in "$KEYS/ec.pem" "$KEYS/rsa.pem"; do
+		umoci unpack --image "${IMAGE}:${TAG}-enc" --decryption-key "$key" --verify-layers "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+		[ -f "$BUNDLE/rootfs/etc/os-release" ]
+		rm -rf "$BUNDLE"
+	done
+}
+
+@test "umoci encrypt --layer" {
+	KEYS="$(setup_tmpdir)"
+	setup_keys "$KEYS"
+
+	sane_run manifest_layers "${TAG}"
+	[ "$status" -eq 0 ]
+	top="$((${#lines[@]} - 1))"
+
+	# Only the top layer is encrypted.
+	umoci encrypt --image "${IMAGE}:${TAG}" --tag "${TAG}-enc" --recipient "jwe:$KEYS/ec.pub" --layer "$top"
+	[ "$status" -eq 0 ]
+
+	sane_run manifest_layers "${TAG}-enc"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "${lines[$top]}" | jq -SMr '.mediaType')" == *"+encrypted" ]]
+	for layer in "${lines[@]:0:$top}"; do
+		[[ "$(echo "$layer" | jq -SMr '.mediaType')" != *"+encrypted" ]]
+	done
+
+	# Encrypted layers cannot be encrypted again.
+	umoci encrypt --image "${IMAGE}:${TAG}-enc" --recipient "jwe:$KEYS/ec.pub" --layer "$top"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci decrypt" {
+	KEYS="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+	setup_keys "$KEYS"
+
+	sane_run manifest_layers "${TAG}"
+	[ "$status" -eq 0 ]
+	original="$output"
+
+	umoci encrypt --image "${IMAGE}:${TAG}" --tag "${TAG}-enc" --recipient "pkcs7:$KEYS/rsa.crt"
+	[ "$status" -eq 0 ]
+
+	# PKCS#7 wrapped keys also require the certificate.
+	umoci decrypt --image "${IMAGE}:${TAG}-enc" --tag "${TAG}-dec" --key "$KEYS/rsa.pem"
+	[ "$status" -ne 0 ]
+
+	umoci decrypt --image "${IMAGE}:${TAG}-enc" --tag "${TAG}-dec" --key "$KEYS/rsa.pem" --cert "$KEYS/rsa.crt"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The decrypted layers are the original layers.
+	sane_run manifest_layers "${TAG}-dec"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$original" ]]
+
+	umoci unpack --image "${IMAGE}:${TAG}-dec" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -f "$BUNDLE/rootfs/etc/os-release" ]
+
+	image-verify "${IMAGE}"
+}
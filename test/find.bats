@@ -0,0 +1,113 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci find [missing args]" {
+	umoci find --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci find --image "${IMAGE}:${TAG}" --name '*.conf' extra
+	[ "$status" -ne 0 ]
+
+	umoci find --image "${IMAGE}:${TAG}" --name '[*.conf'
+	[ "$status" -ne 0 ]
+
+	umoci find --image "${IMAGE}:${TAG}" --regex '(conf'
+	[ "$status" -ne 0 ]
+
+	umoci find --image "${IMAGE}:${TAG}" --name '*.conf' --layer top
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci find" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Add some files in one layer ...
+	mkdir -p "$BUNDLE/rootfs/opt/find-me"
+	echo "some data" > "$BUNDLE/rootfs/opt/find-me/find-me.conf"
+	echo "other data" > "$BUNDLE/rootfs/etc/find-me.conf"
+	umoci repack --image "${IMAGE}:${TAG}-a" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# ... and delete some of them in the next one.
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}-a" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	rm -rf "$BUNDLE/rootfs/opt/find-me" "$BUNDLE/rootfs/etc/passwd"
+	umoci repack --image "${IMAGE}:${TAG}-b" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.layers | length' "${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-b" | tr : /)"
+	[ "$status" -eq 0 ]
+	NLAYERS="$output"
+
+	umoci find --image "${IMAGE}:${TAG}-b" --name 'find-me*'
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"added "*" /opt/find-me/"* ]]
+	[[ "$output" == *"added "*" /opt/find-me/find-me.conf"* ]]
+	[[ "$output" == *"added "*" /etc/find-me.conf"* ]]
+	[[ "$output" == *"deleted "*" /opt/find-me/find-me.conf"* ]]
+	[[ "$output" == *"deleted "*" /opt/find-me"* ]]
+
+	umoci find --image "${IMAGE}:${TAG}-b" --name 'find-me*' --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '[.[] | select(.path == "/etc/find-me.conf")][0].change' <<<"$output")" == "added" ]]
+	[[ "$(jq -SMr '.[] | select(.path == "/etc/find-me.conf" and .change == "added") | .layer' <<<"$output")" -eq "$(($NLAYERS - 2))" ]]
+	[[ "$(jq -SMr '.[] | select(.path == "/etc/find-me.conf" and .change == "added") | .entry.size' <<<"$output")" -eq 11 ]]
+	[[ "$(jq -SMr '[.[] | select(.path == "/opt/find-me/find-me.conf")] | map(.change) | join(",")' <<<"$output")" == "added,deleted" ]]
+	[[ "$(jq -SMr '.[] | select(.change == "deleted" and .path == "/opt/find-me") | .layer' <<<"$output")" -eq "$(($NLAYERS - 1))" ]]
+
+	# Only the remaining paths are effective.
+	umoci find --image "${IMAGE}:${TAG}-b" --name 'find-me*' --layer effective --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr 'map(.path) | join(",")' <<<"$output")" == "/etc/find-me.conf" ]]
+
+	umoci find --image "${IMAGE}:${TAG}-b" --regex '^/etc/passw' --layer effective --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr 'length' <<<"$output")" -eq 0 ]]
+
+	# Deletions of paths are reported with the layer that deleted them.
+	umoci find --image "${IMAGE}:${TAG}-b" --regex '^/etc/passwd$' --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.[-1].change' <<<"$output")" == "deleted" ]]
+	[[ "$(jq -SMr '.[-1].layer' <<<"$output")" -eq "$(($NLAYERS - 1))" ]]
+
+	# Both --name and --regex have to match.
+	umoci find --image "${IMAGE}:${TAG}-b" --name 'find-me*' --regex '^/etc/' --layer effective --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr 'map(.path) | join(",")' <<<"$output")" == "/etc/find-me.conf" ]]
+	umoci find --image "${IMAGE}:${TAG}-b" --name 'find-me*' --regex '^/var/' --layer effective --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr 'length' <<<"$output")" -eq 0 ]]
+}
@@ -184,3 +184,262 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci gc --state" {
+	STATEDIR="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Create some garbage by removing every tag.
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	for tag in "${lines[@]}"; do
+		umoci rm --image "${IMAGE}:${tag}"
+		[ "$status" -eq 0 ]
+	done
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	nblobs="${#lines[@]}"
+
+	umoci gc --layout "${IMAGE}" --state "$STATEDIR/gc.json"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The state file records every removed blob, in sorted order.
+	[[ "$(jq -SMr '.complete' "$STATEDIR/gc.json")" == "true" ]]
+	[[ "$(jq -SMr '.deletions | length' "$STATEDIR/gc.json")" -eq "$nblobs" ]]
+	[[ "$(jq -SMr '.deletions | map(.digest) == (map(.digest) | sort)' "$STATEDIR/gc.json")" == "true" ]]
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+
+	# Resuming a completed gc is a no-op.
+	umoci gc --layout "${IMAGE}" --state "$STATEDIR/gc.json" --resume
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci gc --resume" {
+	STATEDIR="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# --resume requires --state.
+	umoci gc --layout "${IMAGE}" --resume
+	[ "$status" -ne 0 ]
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	for tag in "${lines[@]}"; do
+		umoci rm --image "${IMAGE}:${tag}"
+		[ "$status" -eq 0 ]
+	done
+	image-verify "${IMAGE}"
+
+	umoci gc --layout "${IMAGE}" --state "$STATEDIR/gc.json"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Pretend the gc was interrupted, and re-add one of the removed blobs.
+	jq -SMc '.complete = false' "$STATEDIR/gc.json" > "$STATEDIR/gc.json.new"
+	mv "$STATEDIR/gc.json.new" "$STATEDIR/gc.json"
+	echo -n "garbage" > "$IMAGE/blobs/$(jq -SMr '.deletions[0].digest' "$STATEDIR/gc.json" | tr : /)"
+
+	umoci gc --layout "${IMAGE}" --state "$STATEDIR/gc.json" --resume
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.complete' "$STATEDIR/gc.json")" == "true" ]]
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+
+	# Resuming is refused if the references have changed.
+	jq -SMc '.complete = false | .references = {"other": .deletions[0]}' "$STATEDIR/gc.json" > "$STATEDIR/gc.json.new"
+	mv "$STATEDIR/gc.json.new" "$STATEDIR/gc.json"
+	umoci gc --layout "${IMAGE}" --state "$STATEDIR/gc.json" --resume
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci gc --dry-run" {
+	STATEDIR="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# --dry-run can't be combined with --state.
+	umoci gc --layout "${IMAGE}" --dry-run --state "$STATEDIR/gc.json"
+	[ "$status" -ne 0 ]
+
+	umoci rm --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	nblobs="${#lines[@]}"
+
+	# A dry run reports what would be removed, but removes nothing.
+	umoci gc --layout "${IMAGE}" --dry-run
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"would garbage collect"* ]]
+	[[ "$(echo "$output" | grep -c '^remove')" -gt 0 ]]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nblobs" ]
+
+	# The real gc reports how much space was reclaimed.
+	umoci --log=info gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"reclaimed"* ]]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -lt "$nblobs" ]
+}
+
+@test "umoci gc --dry-run --json" {
+	image-verify "${IMAGE}"
+
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")"
+	config="$(jq -SMr '.config.digest' "$IMAGE/blobs/$(tr : / <<<"$manifest")")"
+
+	umoci rm --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci gc --layout "${IMAGE}" --dry-run --json
+	[ "$status" -eq 0 ]
+	report="$output"
+	[[ "$(jq -r '.dry_run' <<<"$report")" == "true" ]]
+	[ "$(jq -r '.size' <<<"$report")" -gt 0 ]
+
+	# The removed manifest is described, as is the configuration it refers to.
+	sane_run jq -r --arg digest "$manifest" '.deletions[] | select(.digest == $digest) | .media_type' <<<"$report"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "application/vnd.oci.image.manifest.v1+json" ]]
+
+	sane_run jq -r --arg digest "$config" '.deletions[] | select(.digest == $digest) | .referenced_by[]' <<<"$report"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$manifest" ]]
+
+	# Nothing was removed by the dry run, and the real gc prints a report of
+	# what it removed.
+	[ -f "$IMAGE/blobs/$(tr : / <<<"$manifest")" ]
+	umoci gc --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -r '.dry_run' <<<"$output")" == "false" ]]
+	[[ "$(jq -r '.deletions[].digest' <<<"$output")" == *"$manifest"* ]]
+	image-verify "${IMAGE}"
+
+	[ ! -e "$IMAGE/blobs/$(tr : / <<<"$manifest")" ]
+}
+
+@test "umoci gc --keep-younger-than" {
+	STATEDIR="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Invalid durations are rejected.
+	umoci gc --layout "${IMAGE}" --keep-younger-than=7x
+	[ "$status" -ne 0 ]
+	umoci gc --layout "${IMAGE}" --keep-younger-than=-1h
+	[ "$status" -ne 0 ]
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	for tag in "${lines[@]}"; do
+		umoci rm --image "${IMAGE}:${tag}"
+		[ "$status" -eq 0 ]
+	done
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	nblobs="${#lines[@]}"
+
+	# Every blob was just written, so they are all retained.
+	umoci gc --layout "${IMAGE}" --keep-younger-than=7d --state "$STATEDIR/gc.json"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(jq -SMr '.deletions | length' "$STATEDIR/gc.json")" -eq 0 ]]
+	[[ "$(jq -SMr '.retained | length' "$STATEDIR/gc.json")" -gt 0 ]]
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nblobs" ]
+
+	# Once they are old enough, they are removed.
+	find "$IMAGE/blobs" -type f -exec touch -d "10 days ago" {} \;
+	umoci gc --layout "${IMAGE}" --keep-younger-than=7d --state "$STATEDIR/gc.json"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(jq -SMr '.deletions | length' "$STATEDIR/gc.json")" -eq "$nblobs" ]]
+	[[ "$(jq -SMr '.size > 0' "$STATEDIR/gc.json")" == "true" ]]
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+}
+
+@test "umoci gc --keep-tagged" {
+	STATEDIR="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	echo "some artifact" > "$STATEDIR/artifact"
+	umoci attach --image "${IMAGE}:${TAG}" --artifact-type "application/x-umoci-test" "$STATEDIR/artifact"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci rm --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	nrefs="${#lines[@]}"
+
+	# The referrers index of the removed image is retained.
+	umoci gc --layout "${IMAGE}" --keep-tagged
+	[ "$status" -eq 0 ]
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nrefs" ]
+
+	# Without --keep-tagged, it is removed.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -lt "$nrefs" ]
+}
+
+@test "umoci gc --lock-timeout" {
+	image-verify "${IMAGE}"
+
+	# Pretend that another process is writing to the image.
+	mkdir -p "${IMAGE}/locks"
+	flock --shared "${IMAGE}/locks/writers" sleep 5 &
+	writer=$!
+	sleep 0.5
+
+	umoci gc --layout "${IMAGE}" --lock-timeout 100ms
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"image is busy"* ]]
+
+	# A dry run doesn't need to exclude writers.
+	umoci gc --layout "${IMAGE}" --dry-run --lock-timeout 100ms
+	[ "$status" -eq 0 ]
+
+	# Once the writer has finished, the gc succeeds.
+	wait "$writer"
+	umoci gc --layout "${IMAGE}" --lock-timeout 100ms
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
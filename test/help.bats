@@ -58,6 +58,14 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci config"+ ]]
 
+	umoci annotate --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci annotate"+ ]]
+
+	umoci annotate -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci annotate"+ ]]
+
 	umoci unpack --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci unpack"+ ]]
@@ -66,6 +74,14 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci unpack"+ ]]
 
+	umoci run --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci run"+ ]]
+
+	umoci run -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci run"+ ]]
+
 	umoci repack --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci repack"+ ]]
@@ -74,6 +90,22 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci repack"+ ]]
 
+	umoci verify-bundle --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci verify-bundle"+ ]]
+
+	umoci verify-bundle -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci verify-bundle"+ ]]
+
+	umoci watch --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci watch"+ ]]
+
+	umoci watch -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci watch"+ ]]
+
 	umoci new --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci new"+ ]]
@@ -90,6 +122,10 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci tag"+ ]]
 
+	umoci tag mv --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci tag mv"+ ]]
+
 	umoci remove --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci remove"+ ]]
@@ -114,6 +150,22 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci stat"+ ]]
 
+	umoci lock --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci lock"+ ]]
+
+	umoci lock -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci lock"+ ]]
+
+	umoci assemble --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci assemble"+ ]]
+
+	umoci assemble -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci assemble"+ ]]
+
 	umoci gc --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci gc"+ ]]
@@ -122,6 +174,270 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci gc"+ ]]
 
+	umoci copy --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci copy"+ ]]
+
+	umoci copy -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci copy"+ ]]
+
+	umoci cp --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci copy"+ ]]
+
+	umoci convert --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci convert"+ ]]
+
+	umoci convert -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci convert"+ ]]
+
+	umoci squash --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci squash"+ ]]
+
+	umoci squash -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci squash"+ ]]
+
+	umoci freeze --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci freeze"+ ]]
+
+	umoci freeze -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci freeze"+ ]]
+
+	umoci insert --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci insert"+ ]]
+
+	umoci insert -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci insert"+ ]]
+
+	umoci remove-layer --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci remove-layer"+ ]]
+
+	umoci remove-layer -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci remove-layer"+ ]]
+
+	umoci encrypt --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci encrypt"+ ]]
+
+	umoci encrypt -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci encrypt"+ ]]
+
+	umoci decrypt --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci decrypt"+ ]]
+
+	umoci decrypt -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci decrypt"+ ]]
+
+	umoci scrub --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci scrub"+ ]]
+
+	umoci scrub -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci scrub"+ ]]
+
+	umoci rebase --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci rebase"+ ]]
+
+	umoci rebase -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci rebase"+ ]]
+
+	umoci diff --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci diff"+ ]]
+
+	umoci diff -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci diff"+ ]]
+
+	umoci index --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci index"+ ]]
+
+	umoci index -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci index"+ ]]
+
+	umoci index add --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci index add"+ ]]
+
+	umoci history --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci history"+ ]]
+
+	umoci history -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci history"+ ]]
+
+	umoci history edit --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci history edit"+ ]]
+
+	umoci log --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci log"+ ]]
+
+	umoci log -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci log"+ ]]
+
+	umoci serve --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci serve"+ ]]
+
+	umoci serve -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci serve"+ ]]
+
+	umoci refs --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci refs"+ ]]
+
+	umoci refs -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci refs"+ ]]
+
+	umoci refs export --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci refs export"+ ]]
+
+	umoci raw --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci raw"+ ]]
+
+	umoci raw -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci raw"+ ]]
+
+	umoci raw extract-file --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci raw extract-file"+ ]]
+
+	umoci raw list-layer --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci raw list-layer"+ ]]
+
+	umoci find --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci find"+ ]]
+
+	umoci find -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci find"+ ]]
+
+	umoci which --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci which"+ ]]
+
+	umoci which -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci which"+ ]]
+
+	umoci scan-import --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci scan-import"+ ]]
+
+	umoci scan-import -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci scan-import"+ ]]
+
+	umoci attach --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci attach"+ ]]
+
+	umoci attach -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci attach"+ ]]
+
+	umoci referrers --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci referrers"+ ]]
+
+	umoci referrers -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci referrers"+ ]]
+
+	umoci artifact --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci artifact"+ ]]
+
+	umoci artifact push --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci artifact push"+ ]]
+
+	umoci artifact pull -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci artifact pull"+ ]]
+
+	umoci sbom --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci sbom"+ ]]
+
+	umoci sbom -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci sbom"+ ]]
+
+	umoci dedup --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci dedup"+ ]]
+
+	umoci dedup -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci dedup"+ ]]
+
+	umoci import --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci import"+ ]]
+
+	umoci import -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci import"+ ]]
+
+	umoci import-rootfs --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci import-rootfs"+ ]]
+
+	umoci import-rootfs -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci import-rootfs"+ ]]
+
+	umoci export --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci export"+ ]]
+
+	umoci export -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci export"+ ]]
+
+	umoci delta --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci delta"+ ]]
+
+	umoci delta -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci delta"+ ]]
+
+	umoci delta apply --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci delta apply"+ ]]
+
 	umoci init --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci init"+ ]]
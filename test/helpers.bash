@@ -43,6 +43,17 @@ function requires() {
 					skip "test requires ${var}"
 				fi
 				;;
+			userns)
+				# We need the setuid helpers, and subordinate ids to map.
+				if ! command -v newuidmap >/dev/null || ! command -v newgidmap >/dev/null; then
+					skip "test requires ${var} (newuidmap and newgidmap)"
+				fi
+				for subids in /etc/subuid /etc/subgid; do
+					if ! grep -qE "^($(id -un)|$(id -u)):" "$subids"; then
+						skip "test requires ${var} (subordinate ids in $subids)"
+					fi
+				done
+				;;
 			*)
 				fail "BUG: Invalid requires ${var}."
 				;;
@@ -78,8 +89,9 @@ function umoci() {
 	# Set the first argument (the subcommand).
 	args+=("$1")
 
-	# We're rootless if we're asked to unpack something.
-	if [[ "$ROOTLESS" != 0 && "$1" == "unpack" ]]; then
+	# We're rootless if we're asked to unpack something (unless we're using a
+	# user namespace instead, or aren't unpacking to the filesystem).
+	if [[ "$ROOTLESS" != 0 && ( "$1" == "unpack" || "$1" == "run" || "$1" == "squash" || "$1" == "diff" ) && ! " $* " =~ " --userns " && ! " $* " =~ " --to-tar " ]]; then
 		args+=("--rootless")
 	fi
 
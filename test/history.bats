@@ -0,0 +1,137 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci history [missing args]" {
+	umoci history
+	[ "$status" -ne 0 ]
+
+	umoci history edit --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci history edit --image "${IMAGE}:${TAG}" --index 0
+	[ "$status" -ne 0 ]
+
+	umoci history edit --image "${IMAGE}:${TAG}" --comment "no index"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci history" {
+	# Add an empty history entry.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --history.comment "empty entry" --config.user "1000"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci history --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	HISTORY="$output"
+
+	# The history must match the history in umoci-stat(1).
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$HISTORY" | jq -SMc .)" == "$(echo "$output" | jq -SMc .history)" ]]
+
+	# The new entry has no layer.
+	[[ "$(echo "$HISTORY" | jq -SMr '.[-1].comment')" == "empty entry" ]]
+	[[ "$(echo "$HISTORY" | jq -SMr '.[-1].layer')" == "null" ]]
+
+	# The default output has a header and a line for each entry.
+	umoci history --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$(($(echo "$HISTORY" | jq -SMr 'length') + 1))" ]
+	[[ "${lines[-1]}" == *"empty entry"* ]]
+}
+
+@test "umoci history edit" {
+	umoci history --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	HISTORY="$output"
+	nentries="$(echo "$HISTORY" | jq -SMr 'length')"
+	[ "$nentries" -gt 0 ]
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	diffids="$(echo "$output" | jq -SMc '.config.rootfs.diff_ids')"
+
+	umoci history edit --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --index 0 \
+		--comment "new comment" --created-by "redacted" --author "Umoci" --created "2010-01-01T00:00:00Z"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci history --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr 'length')" -eq "$nentries" ]]
+	[[ "$(echo "$output" | jq -SMr '.[0].comment')" == "new comment" ]]
+	[[ "$(echo "$output" | jq -SMr '.[0].created_by')" == "redacted" ]]
+	[[ "$(echo "$output" | jq -SMr '.[0].author')" == "Umoci" ]]
+	[[ "$(echo "$output" | jq -SMr '.[0].created')" == "2010-01-01T00:00:00Z" ]]
+
+	# No other entries were modified.
+	[[ "$(echo "$output" | jq -SMc '.[1:]')" == "$(echo "$HISTORY" | jq -SMc '.[1:]')" ]]
+
+	# The layers were not modified.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMc '.config.rootfs.diff_ids')" == "$diffids" ]]
+
+	# Out of range indices are rejected.
+	umoci history edit --image "${IMAGE}:${TAG}" --index "$nentries" --comment "invalid"
+	[ "$status" -ne 0 ]
+	umoci history edit --image "${IMAGE}:${TAG}" --index -1 --comment "invalid"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci history edit --drop-empty" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --history.comment "empty entry" --config.user "1000"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}-new" --history.comment "empty entry" --config.workingdir "/tmp"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci history --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	nlayers="$(echo "$output" | jq -SMr '[.[] | select(.layer != null)] | length')"
+	[[ "$(echo "$output" | jq -SMr '[.[] | select(.empty_layer)] | length')" -ge 2 ]]
+
+	umoci history edit --image "${IMAGE}:${TAG}-new" --drop-empty
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Only the entries with layers remain.
+	umoci history --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr 'length')" -eq "$nlayers" ]]
+	[[ "$(echo "$output" | jq -SMr '[.[] | select(.empty_layer)] | length')" -eq 0 ]]
+
+	# The configuration was not otherwise modified.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.config.config.WorkingDir')" == "/tmp" ]]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,108 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci import-rootfs [directory]" {
+	ROOTFS="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+
+	mkdir -p "$ROOTFS/etc" "$ROOTFS/bin"
+	echo "imported file" > "$ROOTFS/etc/imported"
+	ln -s ../etc/imported "$ROOTFS/bin/link"
+
+	umoci import-rootfs --image "${IMAGE}:imported" --rootless "$ROOTFS"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The image has a single layer and a default configuration.
+	umoci stat --image "${IMAGE}:imported" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')" -eq 1 ]]
+	[[ "$(echo "$output" | jq -SMr '.history[0].created_by')" == "umoci import-rootfs" ]]
+
+	umoci unpack --image "${IMAGE}:imported" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	jq -SMr '.process.env[]' "$BUNDLE/config.json" | grep -Fx "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	[[ "$(cat "$BUNDLE/rootfs/etc/imported")" == "imported file" ]]
+	[ -L "$BUNDLE/rootfs/bin/link" ]
+	[[ "$(readlink "$BUNDLE/rootfs/bin/link")" == "../etc/imported" ]]
+
+	# Importing again refuses to clobber the tag.
+	echo "changed" > "$ROOTFS/etc/imported"
+	umoci import-rootfs --image "${IMAGE}:imported" --rootless "$ROOTFS"
+	[ "$status" -ne 0 ]
+	umoci import-rootfs --image "${IMAGE}:imported" --rootless --force "$ROOTFS"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci import-rootfs [tarball]" {
+	ROOTFS="$(setup_tmpdir)"
+	ARCHIVES="$(setup_tmpdir)"
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	mkdir -p "$ROOTFS/usr/share"
+	echo "imported file" > "$ROOTFS/usr/share/imported"
+	tar -C "$ROOTFS" -cf "$ARCHIVES/rootfs.tar" .
+	gzip -c "$ARCHIVES/rootfs.tar" > "$ARCHIVES/rootfs.tar.gz"
+
+	# Plain and gzip-compressed tarballs produce the same image.
+	umoci import-rootfs --image "${IMAGE}:tar" --source-date-epoch 1000 "$ARCHIVES/rootfs.tar"
+	[ "$status" -eq 0 ]
+	umoci import-rootfs --image "${IMAGE}:targz" --source-date-epoch 1000 "$ARCHIVES/rootfs.tar.gz"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:tar" --json
+	[ "$status" -eq 0 ]
+	tarDigest="$(echo "$output" | jq -SMr '.history[0].layer.digest')"
+	umoci stat --image "${IMAGE}:targz" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[0].layer.digest')" == "$tarDigest" ]]
+
+	umoci unpack --image "${IMAGE}:tar" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	umoci unpack --image "${IMAGE}:targz" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	[[ "$(cat "$BUNDLE_A/rootfs/usr/share/imported")" == "imported file" ]]
+	diff -r "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+
+	# Tarballs containing whiteouts are layers, not root filesystems.
+	touch "$ROOTFS/usr/.wh.share"
+	tar -C "$ROOTFS" -cf "$ARCHIVES/whiteout.tar" .
+	umoci import-rootfs --image "${IMAGE}:whiteout" "$ARCHIVES/whiteout.tar"
+	[ "$status" -ne 0 ]
+
+	# --rootless only makes sense for directories.
+	umoci import-rootfs --image "${IMAGE}:rootless" --rootless "$ARCHIVES/rootfs.tar"
+	[ "$status" -ne 0 ]
+}
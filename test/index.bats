@@ -0,0 +1,202 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# index_blob <tag>
+# Outputs the path of the blob referred to by <tag>.
+function index_blob() {
+	echo "${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/$1" | tr : /)"
+}
+
+@test "umoci index create" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-arm64" --architecture arm64
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci index create --image "${IMAGE}:${TAG}-multi" "${TAG}" "${TAG}-arm64"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	[[ "$(jq -SMr '.mediaType' "${IMAGE}/refs/${TAG}-multi")" == "application/vnd.oci.image.manifest.list.v1+json" ]]
+	[[ "$(jq -SMr '.manifests | length' "$(index_blob "${TAG}-multi")")" -eq 2 ]]
+	[[ "$(jq -SMr '.manifests[1].platform.architecture' "$(index_blob "${TAG}-multi")")" == "arm64" ]]
+	[[ "$(jq -SMr '.manifests[1].digest' "$(index_blob "${TAG}-multi")")" == "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-arm64")" ]]
+
+	# The index can be used by other commands.
+	umoci stat --image "${IMAGE}:${TAG}-multi" --platform linux/arm64
+	[ "$status" -eq 0 ]
+
+	# Existing tags are not clobbered without --force.
+	umoci index create --image "${IMAGE}:${TAG}-multi" "${TAG}"
+	[ "$status" -ne 0 ]
+	umoci index create --image "${IMAGE}:${TAG}-multi" --force "${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(jq -SMr '.manifests | length' "$(index_blob "${TAG}-multi")")" -eq 1 ]]
+
+	# Only image manifests can be added.
+	umoci index create --image "${IMAGE}:${TAG}-nested" "${TAG}-multi"
+	[ "$status" -ne 0 ]
+	umoci index create --image "${IMAGE}:${TAG}-missing" "${TAG}-doesnotexist"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci index add" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-arm64" --architecture arm64
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}-arm64" --tag "${TAG}-arm64-new" --config.user "1000"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci index create --image "${IMAGE}:${TAG}-multi" "${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci index add --image "${IMAGE}:${TAG}-multi" "${TAG}-arm64"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(jq -SMr '.manifests | length' "$(index_blob "${TAG}-multi")")" -eq 2 ]]
+
+	# Adding the same platform replaces the entry.
+	umoci index add --image "${IMAGE}:${TAG}-multi" "${TAG}-arm64-new"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(jq -SMr '.manifests | length' "$(index_blob "${TAG}-multi")")" -eq 2 ]]
+	[[ "$(jq -SMr '.manifests[1].digest' "$(index_blob "${TAG}-multi")")" == "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-arm64-new")" ]]
+
+	# An explicit platform takes precedence.
+	umoci index add --image "${IMAGE}:${TAG}-multi" --platform linux/arm/v7 "${TAG}-arm64"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(jq -SMr '.manifests | length' "$(index_blob "${TAG}-multi")")" -eq 3 ]]
+	[[ "$(jq -SMr '.manifests[2].platform.variant' "$(index_blob "${TAG}-multi")")" == "v7" ]]
+
+	# Invalid platforms and non-indexes are rejected.
+	umoci index add --image "${IMAGE}:${TAG}-multi" --platform linux "${TAG}-arm64"
+	[ "$status" -ne 0 ]
+	umoci index add --image "${IMAGE}:${TAG}" "${TAG}-arm64"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci index remove" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-arm64" --architecture arm64
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci index create --image "${IMAGE}:${TAG}-multi" "${TAG}" "${TAG}-arm64"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# --platform is mandatory.
+	umoci index remove --image "${IMAGE}:${TAG}-multi"
+	[ "$status" -ne 0 ]
+
+	umoci index remove --image "${IMAGE}:${TAG}-multi" --platform linux/arm64
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(jq -SMr '.manifests | length' "$(index_blob "${TAG}-multi")")" -eq 1 ]]
+	[[ "$(jq -SMr '.manifests[0].platform.architecture' "$(index_blob "${TAG}-multi")")" == "amd64" ]]
+
+	# Removing a missing platform fails.
+	umoci index remove --image "${IMAGE}:${TAG}-multi" --platform linux/arm64
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci index annotate" {
+	umoci index create --image "${IMAGE}:${TAG}-multi" "${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci index annotate --image "${IMAGE}:${TAG}-multi" --annotation "com.example.a=1" --annotation "com.example.b=2=3"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(jq -SMr '.annotations["com.example.a"]' "$(index_blob "${TAG}-multi")")" == "1" ]]
+	[[ "$(jq -SMr '.annotations["com.example.b"]' "$(index_blob "${TAG}-multi")")" == "2=3" ]]
+
+	umoci index annotate --image "${IMAGE}:${TAG}-multi" --remove-annotation "com.example.a"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(jq -SMr '.annotations | keys | length' "$(index_blob "${TAG}-multi")")" -eq 1 ]]
+
+	# Annotations must be key=value.
+	umoci index annotate --image "${IMAGE}:${TAG}-multi" --annotation "com.example.c"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci index [windows]" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-ltsc2019" --os windows --architecture amd64
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}-ltsc2019" --tag "${TAG}-ltsc2022" --config.label "version=ltsc2022"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Entries which only differ in their os.version are kept apart.
+	umoci index create --image "${IMAGE}:${TAG}-multi" "${TAG}"
+	[ "$status" -eq 0 ]
+	umoci index add --image "${IMAGE}:${TAG}-multi" --platform "windows(10.0.17763.1)/amd64" "${TAG}-ltsc2019"
+	[ "$status" -eq 0 ]
+	umoci index add --image "${IMAGE}:${TAG}-multi" --platform "windows(10.0.20348.1)/amd64" "${TAG}-ltsc2022"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(jq -SMr '.manifests | length' "$(index_blob "${TAG}-multi")")" -eq 3 ]]
+	[[ "$(jq -SMr '.manifests[2].platform["os.version"]' "$(index_blob "${TAG}-multi")")" == "10.0.20348.1" ]]
+
+	# Modifying the configuration only updates the selected entry.
+	umoci config --image "${IMAGE}:${TAG}-multi" --platform "windows(10.0.20348.1)/amd64" --config.user "1000"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(jq -SMr '.manifests[1].digest' "$(index_blob "${TAG}-multi")")" == "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-ltsc2019")" ]]
+	[[ "$(jq -SMr '.manifests[2].digest' "$(index_blob "${TAG}-multi")")" != "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-ltsc2022")" ]]
+	[[ "$(jq -SMr '.manifests[2].platform["os.version"]' "$(index_blob "${TAG}-multi")")" == "10.0.20348.1" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}-multi" --platform "windows(10.0.20348.1)/amd64" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.config.config.User' <<<"$output")" == "1000" ]]
+
+	# Windows layers are never extracted.
+	umoci unpack --image "${IMAGE}:${TAG}-multi" --platform "windows(10.0.17763.1)/amd64" "$(setup_tmpdir)/bundle"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"windows layers cannot be extracted"* ]]
+
+	umoci index remove --image "${IMAGE}:${TAG}-multi" --platform "windows(10.0.17763.1)/amd64"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(jq -SMr '.manifests | length' "$(index_blob "${TAG}-multi")")" -eq 2 ]]
+
+	# Invalid versions are rejected.
+	umoci index remove --image "${IMAGE}:${TAG}-multi" --platform "windows()/amd64"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,188 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci insert" {
+	SOURCE="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	nlayers="$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')"
+	firstLayer="$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)][0].layer.digest')"
+
+	mkdir -p "$SOURCE/opt/inserted"
+	echo "inserted file" > "$SOURCE/opt/inserted/file"
+
+	# Insert the layer below all of the existing layers.
+	umoci insert --image "${IMAGE}:${TAG}" --tag "${TAG}-at" --at 0 --history.comment "inserted" "$SOURCE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-at" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')" -eq "$((nlayers + 1))" ]]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)][0].comment')" == "inserted" ]]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)][1].layer.digest')" == "$firstLayer" ]]
+
+	# --before-digest of the lowest layer is the same as --at 0.
+	umoci insert --image "${IMAGE}:${TAG}" --tag "${TAG}-before" --before-digest "$firstLayer" --history.comment "inserted" "$SOURCE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-before" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)][0].comment')" == "inserted" ]]
+
+	# The inserted files must be present in the image.
+	umoci unpack --image "${IMAGE}:${TAG}-at" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(cat "$BUNDLE/rootfs/opt/inserted/file")" == "inserted file" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci insert [invalid arguments]" {
+	SOURCE="$(setup_tmpdir)"
+
+	# Missing source.
+	umoci insert --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# --at and --before-digest are mutually exclusive.
+	umoci insert --image "${IMAGE}:${TAG}" --at 0 --before-digest "sha256:$(printf '%064d' 0)" "$SOURCE"
+	[ "$status" -ne 0 ]
+
+	# Out of range index.
+	umoci insert --image "${IMAGE}:${TAG}" --at 1000 "$SOURCE"
+	[ "$status" -ne 0 ]
+
+	# Unknown digest.
+	umoci insert --image "${IMAGE}:${TAG}" --before-digest "sha256:$(printf '%064d' 0)" "$SOURCE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci remove-layer" {
+	SOURCE="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	nlayers="$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')"
+
+	# Add a layer containing a "secret", and remove it again.
+	mkdir -p "$SOURCE/etc"
+	echo "hunter2" > "$SOURCE/etc/secret"
+	umoci insert --image "${IMAGE}:${TAG}" --tag "${TAG}-secret" --history.comment "secret" "$SOURCE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-secret" --json
+	[ "$status" -eq 0 ]
+	secretLayer="$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)][-1].layer.digest')"
+
+	umoci remove-layer --image "${IMAGE}:${TAG}-secret" --layer "$secretLayer"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-secret" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')" -eq "$nlayers" ]]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.comment == "secret")] | length')" -eq 0 ]]
+
+	umoci unpack --image "${IMAGE}:${TAG}-secret" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ ! -e "$BUNDLE/rootfs/etc/secret" ]
+
+	# Remove the lowest layer by index.
+	umoci remove-layer --image "${IMAGE}:${TAG}" --tag "${TAG}-index" --layer 0
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-index" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')" -eq "$((nlayers - 1))" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci remove-layer [invalid arguments]" {
+	# Missing --layer.
+	umoci remove-layer --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Out of range index.
+	umoci remove-layer --image "${IMAGE}:${TAG}" --layer 1000
+	[ "$status" -ne 0 ]
+
+	# Invalid layer.
+	umoci remove-layer --image "${IMAGE}:${TAG}" --layer "not-a-layer"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci {config,insert} --source-date-epoch" {
+	SOURCE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	mkdir -p "$SOURCE/opt/inserted"
+	echo "inserted file" > "$SOURCE/opt/inserted/file"
+
+	# Make the same changes twice, at different times.
+	for suffix in a b; do
+		SOURCE_DATE_EPOCH=1000 umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-config-$suffix" --config.user "1234:1234"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+
+		umoci insert --image "${IMAGE}:${TAG}-config-$suffix" --tag "${TAG}-$suffix" --source-date-epoch 1000 "$SOURCE"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+
+		touch "$SOURCE/opt/inserted/file"
+		sleep 1s
+	done
+
+	# The two images should be identical.
+	diff "${IMAGE}/refs/${TAG}-a" "${IMAGE}/refs/${TAG}-b"
+
+	umoci stat --image "${IMAGE}:${TAG}-a" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.config.created')" == "1970-01-01T00:16:40Z" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-2].created')" == "1970-01-01T00:16:40Z" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created')" == "1970-01-01T00:16:40Z" ]]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,153 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+@test "umoci lock [missing args]" {
+	umoci lock
+	[ "$status" -ne 0 ]
+
+	umoci lock --image "${IMAGE}:${TAG}" extra
+	[ "$status" -ne 0 ]
+
+	umoci assemble --image "${IMAGE}:${TAG}-new"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci lock" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci lock --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	lock="$output"
+
+	# The lock must describe the tagged manifest.
+	[[ "$(echo "$lock" | jq -SMr '.lockVersion')" -eq 1 ]]
+	[[ "$(echo "$lock" | jq -SMr '.manifest.digest')" == "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")" ]]
+	[[ "$(echo "$lock" | jq -SMr '.base')" == "null" ]]
+
+	# Create a new image on top of the tag, and lock it against its base.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	echo "locked" > "$BUNDLE/rootfs/locked"
+	umoci repack --image "${IMAGE}:${TAG}-locked" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci lock --image "${IMAGE}:${TAG}-locked" --base "${TAG}"
+	[ "$status" -eq 0 ]
+	lock="$output"
+	nlayers="$(echo "$lock" | jq -SMr '.layers | length')"
+	[[ "$(echo "$lock" | jq -SMr '.base.layers')" -eq "$((nlayers - 1))" ]]
+	[[ "$(echo "$lock" | jq -SMr '.layers[-1].diffID')" == sha256:* ]]
+
+	# The new image isn't the base of the original tag.
+	umoci lock --image "${IMAGE}:${TAG}" --base "${TAG}-locked"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci assemble" {
+	BUNDLE="$(setup_tmpdir)"
+	LOCKFILE="$(setup_tmpdir)/umoci.lock"
+	NEWIMAGE="$(setup_tmpdir)/image"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	echo "assembled" > "$BUNDLE/rootfs/assembled"
+	umoci repack --image "${IMAGE}:${TAG}-locked" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci lock --image "${IMAGE}:${TAG}-locked" --base "${TAG}"
+	[ "$status" -eq 0 ]
+	echo "$output" > "$LOCKFILE"
+
+	# Assembling in the same image gives an identical tag.
+	umoci assemble --image "${IMAGE}:${TAG}-assembled" "$LOCKFILE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci stat --image "${IMAGE}:${TAG}-locked" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	umoci stat --image "${IMAGE}:${TAG}-assembled" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+
+	# An empty image is missing all of the blobs.
+	umoci init --layout "${NEWIMAGE}"
+	[ "$status" -eq 0 ]
+	umoci assemble --image "${NEWIMAGE}:${TAG}" "$LOCKFILE"
+	[ "$status" -ne 0 ]
+
+	# ... unless they can be copied from another image.
+	umoci assemble --image "${NEWIMAGE}:${TAG}" --from "${IMAGE}" "$LOCKFILE"
+	[ "$status" -eq 0 ]
+	image-verify "${NEWIMAGE}"
+	umoci stat --image "${NEWIMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+
+	# The lock can also be read from stdin.
+	sane_run sh -c "'$UMOCI' assemble --image '${NEWIMAGE}:${TAG}-stdin' - < '$LOCKFILE'"
+	[ "$status" -eq 0 ]
+
+	# The assembled image must be usable.
+	umoci unpack --image "${NEWIMAGE}:${TAG}" "$BUNDLE/new"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/new"
+	[[ "$(cat "$BUNDLE/new/rootfs/assembled")" == "assembled" ]]
+}
+
+@test "umoci assemble [mismatch]" {
+	LOCKFILE="$(setup_tmpdir)/umoci.lock"
+
+	umoci lock --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	lock="$output"
+
+	# Changing the composition changes the manifest digest.
+	echo "$lock" | jq -SM '.annotations = {"org.opensuse.umoci.test": "changed"}' > "$LOCKFILE"
+	umoci assemble --image "${IMAGE}:${TAG}-bad" "$LOCKFILE"
+	[ "$status" -ne 0 ]
+
+	# Blobs with the wrong size are rejected.
+	echo "$lock" | jq -SM '.config.size += 1' > "$LOCKFILE"
+	umoci assemble --image "${IMAGE}:${TAG}-bad" "$LOCKFILE"
+	[ "$status" -ne 0 ]
+
+	# As are unknown lock versions.
+	echo "$lock" | jq -SM '.lockVersion = 1337' > "$LOCKFILE"
+	umoci assemble --image "${IMAGE}:${TAG}-bad" "$LOCKFILE"
+	[ "$status" -ne 0 ]
+
+	# None of the failed attempts should have created a tag.
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"${TAG}-bad"* ]]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,158 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci log [missing args]" {
+	umoci log
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci log [no history log]" {
+	umoci log --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	# Nothing is recorded without a history log.
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-new"
+	[ "$status" -eq 0 ]
+	! [ -e "${IMAGE}/history.log" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci log" {
+	NEWIMAGE="$(setup_tmpdir)/image"
+
+	umoci init --layout "${NEWIMAGE}" --history-log
+	[ "$status" -eq 0 ]
+	image-verify "${NEWIMAGE}"
+
+	umoci log --layout "${NEWIMAGE}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr 'length')" == "0" ]]
+
+	# Make some changes.
+	umoci new --image "${NEWIMAGE}:a"
+	[ "$status" -eq 0 ]
+	first="$(jq -SMr '.digest' "${NEWIMAGE}/refs/a")"
+	umoci config --image "${NEWIMAGE}:a" --config.user "nobody"
+	[ "$status" -eq 0 ]
+	second="$(jq -SMr '.digest' "${NEWIMAGE}/refs/a")"
+	umoci tag --image "${NEWIMAGE}:a" b
+	[ "$status" -eq 0 ]
+	umoci rm --image "${NEWIMAGE}:b"
+	[ "$status" -eq 0 ]
+
+	# The history log survives garbage collection.
+	umoci gc --layout "${NEWIMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${NEWIMAGE}"
+
+	umoci log --layout "${NEWIMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 5 ]
+
+	umoci log --layout "${NEWIMAGE}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr 'length')" == "4" ]]
+	[[ "$(echo "$output" | jq -SMr '.[0].reference')" == "a" ]]
+	[[ "$(echo "$output" | jq -SMr '.[0].old')" == "null" ]]
+	[[ "$(echo "$output" | jq -SMr '.[0].new')" == "$first" ]]
+	[[ "$(echo "$output" | jq -SMr '.[1].old')" == "$first" ]]
+	[[ "$(echo "$output" | jq -SMr '.[1].new')" == "$second" ]]
+	[[ "$(echo "$output" | jq -SMr '.[1].command | index("config")')" != "null" ]]
+	[[ "$(echo "$output" | jq -SMr '.[1].previous')" == "$(echo "$output" | jq -SMr '.[0].hash')" ]]
+	[[ "$(echo "$output" | jq -SMr '.[3].reference')" == "b" ]]
+	[[ "$(echo "$output" | jq -SMr '.[3].old')" == "$second" ]]
+	[[ "$(echo "$output" | jq -SMr '.[3].new')" == "null" ]]
+
+	umoci log --layout "${NEWIMAGE}" --ref b --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr 'length')" == "2" ]]
+	[[ "$(echo "$output" | jq -SMr '.[0].seq')" == "3" ]]
+
+	# Tampering with the log is detected.
+	sed -i '2s/"user":"[^"]*"/"user":"someone-else"/' "${NEWIMAGE}/history.log"
+	umoci log --layout "${NEWIMAGE}"
+	[ "$status" -ne 0 ]
+	sed -i '2d' "${NEWIMAGE}/history.log"
+	umoci log --layout "${NEWIMAGE}"
+	[ "$status" -ne 0 ]
+
+	image-verify "${NEWIMAGE}"
+}
+
+@test "umoci log --init" {
+	umoci log --layout "${IMAGE}" --init
+	[ "$status" -eq 0 ]
+	[ -f "${IMAGE}/history.log" ]
+
+	# It can't be initialised twice.
+	umoci log --layout "${IMAGE}" --init
+	[ "$status" -ne 0 ]
+
+	umoci config --image "${IMAGE}:${TAG}" --config.user "nobody"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci log --layout "${IMAGE}" --ref "${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr 'length')" == "1" ]]
+	[[ "$(echo "$output" | jq -SMr '.[0].new')" == "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")" ]]
+}
+
+@test "umoci log [signed]" {
+	KEY="$(setup_tmpdir)/key"
+	echo "a secret key" > "$KEY"
+	OTHERKEY="$(setup_tmpdir)/key"
+	echo "another key" > "$OTHERKEY"
+
+	umoci log --layout "${IMAGE}" --init
+	[ "$status" -eq 0 ]
+
+	UMOCI_AUDIT_KEY="$KEY" umoci config --image "${IMAGE}:${TAG}" --config.user "nobody"
+	[ "$status" -eq 0 ]
+	UMOCI_AUDIT_KEY="$KEY" umoci tag --image "${IMAGE}:${TAG}" "${TAG}-new"
+	[ "$status" -eq 0 ]
+
+	UMOCI_AUDIT_KEY="$KEY" umoci log --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr 'length')" == "2" ]]
+	[[ "$(echo "$output" | jq -SMr '.[0].signature')" != "null" ]]
+
+	# The wrong key (or a missing signature) is detected.
+	UMOCI_AUDIT_KEY="$OTHERKEY" umoci log --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-unsigned"
+	[ "$status" -eq 0 ]
+	UMOCI_AUDIT_KEY="$KEY" umoci log --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	# The chain can still be verified without the key.
+	umoci log --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
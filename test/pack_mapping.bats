@@ -122,3 +122,242 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci unpack --userns" {
+	requires userns
+
+	image-verify "${IMAGE}"
+
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	# Unpack the image inside a user namespace.
+	umoci unpack --userns --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# The mappings must be recorded in the bundle and runtime configuration.
+	[[ "$(jq -SMr '.map_options.user_namespace' "$BUNDLE_A/umoci.json")" == "true" ]]
+	[[ "$(jq -SMr '.map_options.rootless' "$BUNDLE_A/umoci.json")" == "false" ]]
+	[[ "$(jq -SMr '.linux.uidMappings[0].hostID' "$BUNDLE_A/config.json")" == "$(id -u)" ]]
+	[[ "$(jq -SMr '.linux.gidMappings[0].hostID' "$BUNDLE_A/config.json")" == "$(id -g)" ]]
+	[ "$(jq -SMr '.linux.uidMappings | length' "$BUNDLE_A/config.json")" -gt 1 ]
+
+	# Files owned by the container root user are owned by us.
+	sane_run stat -c '%u:%g' "$BUNDLE_A/rootfs"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$(id -u):$(id -g)" ]]
+
+	# Repacking (which happens in the user namespace) must not change anything.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	# The new layer must be an empty tar archive.
+	[[ "$(echo "$output" | jq -SMr '.history[-1].diff_id')" == "sha256:5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef" ]]
+
+	# Unpacking the repacked image gives the same ownership.
+	umoci unpack --userns --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	diff <(cd "$BUNDLE_A/rootfs" && find . -printf '%U:%G %p\n' | sort) <(cd "$BUNDLE_B/rootfs" && find . -printf '%U:%G %p\n' | sort)
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --userns --rootless" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# --userns replaces --rootless.
+	sane_run "$UMOCI" unpack --userns --rootless --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --rootless [ownership]" {
+	requires root
+
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+
+	# Create an image with files that aren't owned by root.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	mkdir "$BUNDLE_A/rootfs/owned"
+	echo "some contents" > "$BUNDLE_A/rootfs/owned/file"
+	chown -R 1000:100 "$BUNDLE_A/rootfs/owned"
+	mknod "$BUNDLE_A/rootfs/owned/device" c 1 3
+	chown 0:5 "$BUNDLE_A/rootfs/owned/device"
+
+	umoci repack --image "${IMAGE}:${TAG}-owned" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack it in rootless mode, where everything is owned by us.
+	umoci unpack --rootless --image "${IMAGE}:${TAG}-owned" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	sane_run stat -c '%u:%g %F' "$BUNDLE_B/rootfs/owned/device"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "0:0 regular empty file" ]]
+
+	# Modify the files, so that they are included in the new layer.
+	touch "$BUNDLE_B/rootfs/owned" "$BUNDLE_B/rootfs/owned/file" "$BUNDLE_B/rootfs/owned/device"
+	echo "new file" > "$BUNDLE_B/rootfs/owned/new"
+
+	umoci repack --image "${IMAGE}:${TAG}-rootless" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The original ownership (and device) must have been restored.
+	umoci unpack --image "${IMAGE}:${TAG}-rootless" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
+	sane_run stat -c '%u:%g %F' "$BUNDLE_C/rootfs/owned" "$BUNDLE_C/rootfs/owned/file" "$BUNDLE_C/rootfs/owned/device" "$BUNDLE_C/rootfs/owned/new"
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == "1000:100 directory" ]]
+	[[ "${lines[1]}" == "1000:100 regular file" ]]
+	[[ "${lines[2]}" == "0:5 character special file" ]]
+	[[ "${lines[3]}" == "0:0 regular file" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --xattr-policy security.capability=remap" {
+	# Setting security.capability requires root.
+	requires root
+
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Add a file with (non-namespaced) CAP_NET_BIND_SERVICE file capabilities.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	echo "capable" > "$BUNDLE_A/rootfs/capable"
+	python3 -c 'import os, sys; os.setxattr(sys.argv[1], "security.capability", bytes.fromhex("0100000200040000000000000000000000000000"))' "$BUNDLE_A/rootfs/capable"
+
+	umoci repack --image "${IMAGE}:${TAG}-caps" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# With remap, the file capabilities apply to the container's root user.
+	umoci unpack --image "${IMAGE}:${TAG}-caps" --uid-map "100000:0:65536" --gid-map "100000:0:65536" --xattr-policy "security.capability=remap" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	sane_run python3 -c 'import os, sys; print(os.getxattr(sys.argv[1], "security.capability").hex())' "$BUNDLE_B/rootfs/capable"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "0100000300040000000000000000000000000000a0860100" ]]
+
+	# Repacking maps the capabilities back.
+	touch "$BUNDLE_B/rootfs/capable"
+	umoci repack --image "${IMAGE}:${TAG}-caps-remapped" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-caps-remapped" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
+	sane_run python3 -c 'import os, sys; print(os.getxattr(sys.argv[1], "security.capability").hex())' "$BUNDLE_C/rootfs/capable"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "0100000200040000000000000000000000000000" ]]
+
+	# Other xattrs cannot be remapped.
+	umoci unpack --image "${IMAGE}:${TAG}-caps" --xattr-policy "security.selinux=remap" "$(setup_tmpdir)"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --owner-names" {
+	image-verify "${IMAGE}"
+
+	BUNDLE="$(setup_tmpdir)"
+	NAMES="$(setup_tmpdir)/names.json"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "named" > "$BUNDLE/rootfs/named"
+	echo '{"users": {"admin": 0}, "groups": {"wheel": 0}}' > "$NAMES"
+
+	# The names come from the mapping, even for reproducible layers.
+	umoci repack --image "${IMAGE}:${TAG}-names" --reproducible --owner-names "$NAMES" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifest="${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-names" | tr : /)"
+	layer="${IMAGE}/blobs/$(jq -SMr '.layers[-1].digest' "$manifest" | tr : /)"
+	sane_run tar -tvzf "$layer" named
+	[ "$status" -eq 0 ]
+	[[ "$output" == *" admin/wheel "* ]]
+
+	# With "image" the names come from the rootfs.
+	echo "named again" > "$BUNDLE/rootfs/named"
+	umoci repack --image "${IMAGE}:${TAG}-image-names" --owner-names image "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifest="${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-image-names" | tr : /)"
+	layer="${IMAGE}/blobs/$(jq -SMr '.layers[-1].digest' "$manifest" | tr : /)"
+	sane_run tar -tvzf "$layer" named
+	[ "$status" -eq 0 ]
+	[[ "$output" == *" $(awk -F: '$3 == 0 { print $1 }' "$BUNDLE/rootfs/etc/passwd" | sort | head -n1)/"* ]]
+
+	# Invalid mappings are rejected.
+	echo '{"users": {"admin": -1}}' > "$NAMES"
+	umoci repack --image "${IMAGE}:${TAG}-bad" --owner-names "$NAMES" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-bad" --owner-names "" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --owner-names" {
+	# We need to check the owner of the extracted files.
+	requires root
+
+	image-verify "${IMAGE}"
+
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	NAMES="$(setup_tmpdir)/names.json"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Create a layer with an entry owned by 0:0 named admin:wheel.
+	echo "named" > "$BUNDLE_A/rootfs/named"
+	echo '{"users": {"admin": 0}, "groups": {"wheel": 0}}' > "$NAMES"
+	umoci repack --image "${IMAGE}:${TAG}-names" --owner-names "$NAMES" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The names take precedence over the numeric owner.
+	echo '{"users": {"admin": 1234}, "groups": {"wheel": 5678}}' > "$NAMES"
+	umoci unpack --image "${IMAGE}:${TAG}-names" --owner-names "$NAMES" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[[ "$(stat -c '%u:%g' "$BUNDLE_B/rootfs/named")" == "1234:5678" ]]
+	[[ "$(jq -SMr '.map_options.prefer_names' "$BUNDLE_B/umoci.json")" == "true" ]]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,126 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# make_manifest_list <tag> <ref>=<os>/<arch>...
+# Creates a manifest list in ${IMAGE} containing the manifests referred to by
+# the given references, and tags it as <tag>.
+function make_manifest_list() {
+	local tag="$1"
+	shift
+
+	local manifests="[]"
+	for arg in "$@"; do
+		local ref="${arg%%=*}" platform="${arg#*=}"
+		manifests="$(jq -c --arg os "${platform%%/*}" --arg arch "${platform#*/}" \
+			--argjson manifests "$manifests" \
+			'$manifests + [. + {platform: {os: $os, architecture: $arch}}]' "${IMAGE}/refs/$ref")"
+	done
+
+	local list="$(jq -cn --argjson manifests "$manifests" '{schemaVersion: 2, manifests: $manifests}')"
+	local digest="$(echo -n "$list" | sha256sum | cut -d' ' -f1)"
+	echo -n "$list" > "${IMAGE}/blobs/sha256/$digest"
+	jq -cn --arg digest "sha256:$digest" --argjson size "${#list}" \
+		'{mediaType: "application/vnd.oci.image.manifest.list.v1+json", digest: $digest, size: $size}' > "${IMAGE}/refs/$tag"
+}
+
+@test "umoci unpack --platform" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Create a second image with a different architecture.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-arm64" --architecture arm64
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	make_manifest_list "${TAG}-multi" "${TAG}=linux/amd64" "${TAG}-arm64=linux/arm64"
+
+	# Select the arm64 manifest.
+	umoci unpack --image "${IMAGE}:${TAG}-multi" --platform linux/arm64 "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(jq -SMr '.from_descriptor.digest' "$BUNDLE/umoci.json")" == "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-arm64")" ]]
+
+	# Platforms not in the manifest list are rejected.
+	umoci stat --image "${IMAGE}:${TAG}-multi" --platform linux/s390x
+	[ "$status" -ne 0 ]
+
+	# Invalid platforms are rejected.
+	umoci stat --image "${IMAGE}:${TAG}-multi" --platform linux
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config [manifest list]" {
+	# Create a second image with a different architecture.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-arm64" --architecture arm64
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	make_manifest_list "${TAG}-multi" "${TAG}=linux/amd64" "${TAG}-arm64=linux/arm64"
+	amd64Digest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")"
+
+	# Modifying the arm64 image should only update its manifest list entry.
+	umoci config --image "${IMAGE}:${TAG}-multi" --platform linux/arm64 --config.user "1000:1000"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	[[ "$(jq -SMr '.mediaType' "${IMAGE}/refs/${TAG}-multi")" == "application/vnd.oci.image.manifest.list.v1+json" ]]
+	list="${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-multi" | tr : /)"
+	[[ "$(jq -SMr '.manifests | length' "$list")" -eq 2 ]]
+	[[ "$(jq -SMr '.manifests[] | select(.platform.architecture == "amd64") | .digest' "$list")" == "$amd64Digest" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}-multi" --platform linux/arm64 --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "umoci config" ]]
+
+	# Changing the architecture adds a new entry.
+	umoci config --image "${IMAGE}:${TAG}-multi" --platform linux/arm64 --architecture ppc64le
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	list="${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-multi" | tr : /)"
+	[[ "$(jq -SMr '.manifests | length' "$list")" -eq 3 ]]
+
+	umoci stat --image "${IMAGE}:${TAG}-multi" --platform linux/ppc64le --json
+	[ "$status" -eq 0 ]
+
+	# Replacing an entry with an image which isn't based on it requires --force.
+	oldList="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-multi")"
+	umoci config --image "${IMAGE}:${TAG}-arm64" --tag "${TAG}-multi" --architecture amd64
+	[ "$status" -ne 0 ]
+	[[ "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-multi")" == "$oldList" ]]
+
+	umoci config --image "${IMAGE}:${TAG}-arm64" --tag "${TAG}-multi" --architecture amd64 --force
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	list="${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-multi" | tr : /)"
+	[[ "$(jq -SMr '.manifests | length' "$list")" -eq 3 ]]
+	[[ "$(jq -SMr '.manifests[] | select(.platform.architecture == "amd64") | .digest' "$list")" != "$amd64Digest" ]]
+
+	image-verify "${IMAGE}"
+}
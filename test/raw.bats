@@ -0,0 +1,163 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci raw extract-file [missing args]" {
+	umoci raw extract-file --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci raw extract-file --image "${IMAGE}:${TAG}" /etc/os-release extra
+	[ "$status" -ne 0 ]
+
+	umoci raw extract-file --image "${IMAGE}:${TAG}" ""
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci raw extract-file" {
+	BUNDLE="$(setup_tmpdir)"
+	OUTPUT="$(setup_tmpdir)/output"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Modify and remove some files in a new layer.
+	echo "extracted" > "$BUNDLE/rootfs/etc/extracted"
+	ln -s extracted "$BUNDLE/rootfs/etc/extracted-link"
+	rm -f "$BUNDLE/rootfs/etc/passwd"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The topmost version of the file must be read.
+	umoci raw extract-file --image "${IMAGE}:${TAG}" /etc/extracted
+	[ "$status" -eq 0 ]
+	[[ "$output" == "extracted" ]]
+
+	umoci raw extract-file --image "${IMAGE}:${TAG}" -o "$OUTPUT" /etc/extracted-link
+	[ "$status" -eq 0 ]
+	[[ "$(cat "$OUTPUT")" == "extracted" ]]
+
+	# Files from lower layers must match the unpacked rootfs.
+	umoci raw extract-file --image "${IMAGE}:${TAG}" -o "$OUTPUT" /etc/group
+	[ "$status" -eq 0 ]
+	cmp "$OUTPUT" "$BUNDLE/rootfs/etc/group"
+
+	# Whited-out files don't exist.
+	umoci raw extract-file --image "${IMAGE}:${TAG}" /etc/passwd
+	[ "$status" -ne 0 ]
+
+	# Only regular files can be extracted.
+	umoci raw extract-file --image "${IMAGE}:${TAG}" /etc
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci raw list-layer [missing args]" {
+	umoci raw list-layer --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci raw list-layer --image "${IMAGE}:${TAG}" --layer "not-a-digest"
+	[ "$status" -ne 0 ]
+
+	umoci raw list-layer --image "${IMAGE}:${TAG}" --layer "sha256:$(printf '%064d' 0)" extra
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci raw list-layer" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Add and remove some files in a new layer.
+	dd if=/dev/zero of="$BUNDLE/rootfs/etc/large" bs=1024 count=512
+	ln -s large "$BUNDLE/rootfs/etc/large-link"
+	rm -f "$BUNDLE/rootfs/etc/passwd"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.layers[-1].digest' "${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}" | tr : /)"
+	[ "$status" -eq 0 ]
+	LAYER="$output"
+
+	umoci raw list-layer --image "${IMAGE}:${TAG}" --layer "$LAYER"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"file "*" 524288 /etc/large"* ]]
+	[[ "$output" == *"symlink "*" /etc/large-link -> large"* ]]
+	[[ "$output" == *"whiteout "*" /etc/passwd"* ]]
+
+	umoci raw list-layer --image "${IMAGE}:${TAG}" --layer "$LAYER" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.[] | select(.path == "/etc/large") | .size' <<<"$output")" -eq 524288 ]]
+	[[ "$(jq -SMr '.[] | select(.path == "/etc/passwd") | .whiteout' <<<"$output")" == "true" ]]
+	[[ "$(jq -SMr '.[] | select(.path == "/etc/large-link") | .linkname' <<<"$output")" == "large" ]]
+
+	# Only layers of the image can be listed.
+	umoci raw list-layer --image "${IMAGE}:${TAG}" --layer "sha256:$(printf '%064d' 0)"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci raw extract-file --index-cache" {
+	BUNDLE="$(setup_tmpdir)"
+	CACHE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "indexed" > "$BUNDLE/rootfs/etc/indexed"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The first read builds the index of every layer searched.
+	umoci raw extract-file --image "${IMAGE}:${TAG}" --index-cache "$CACHE" /etc/indexed
+	[ "$status" -eq 0 ]
+	[[ "$output" == "indexed" ]]
+	[ "$(find "$CACHE" -name '*.json' | wc -l)" -ge 1 ]
+
+	# Later reads use the cached indexes.
+	umoci raw extract-file --image "${IMAGE}:${TAG}" --index-cache "$CACHE" -o "$BUNDLE/group" /etc/group
+	[ "$status" -eq 0 ]
+	cmp "$BUNDLE/group" "$BUNDLE/rootfs/etc/group"
+
+	# By default, the cache is inside the image.
+	umoci raw extract-file --image "${IMAGE}:${TAG}" /etc/indexed
+	[ "$status" -eq 0 ]
+	[[ "$output" == "indexed" ]]
+	[ -d "${IMAGE}/.umoci-index" ]
+
+	# ... and is kept by gc (which only removes the indexes of removed layers).
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ -d "${IMAGE}/.umoci-index" ]
+
+	umoci raw extract-file --image "${IMAGE}:${TAG}" --index-cache "$CACHE" --no-index-cache /etc/indexed
+	[ "$status" -ne 0 ]
+}
@@ -0,0 +1,127 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci rebase" {
+	BUNDLE_BASE="$(setup_tmpdir)"
+	BUNDLE_APP="$(setup_tmpdir)"
+	BUNDLE_OUT="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Create an updated version of the base image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_BASE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_BASE"
+
+	echo "security fix" > "$BUNDLE_BASE/rootfs/base-update"
+
+	umoci repack --image "${IMAGE}:${TAG}-v2" --history.comment "base update" "$BUNDLE_BASE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Create an application image based on the old base image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_APP"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_APP"
+
+	echo "application" > "$BUNDLE_APP/rootfs/app"
+
+	umoci repack --image "${IMAGE}:app" --history.comment "app layer" "$BUNDLE_APP"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:app" --json
+	[ "$status" -eq 0 ]
+	nlayers="$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')"
+
+	# Rebase the application onto the new base image.
+	umoci rebase --image "${IMAGE}:app" --tag "app-rebased" --old-base "${IMAGE}:${TAG}" --new-base "${IMAGE}:${TAG}-v2"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The rebased image has one more layer, and the history is in order.
+	umoci stat --image "${IMAGE}:app-rebased" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')" -eq "$((nlayers + 1))" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].comment')" == "app layer" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-2].comment')" == "base update" ]]
+
+	# The rebased image contains both the update and the application.
+	umoci unpack --image "${IMAGE}:app-rebased" "$BUNDLE_OUT"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_OUT"
+
+	[[ "$(cat "$BUNDLE_OUT/rootfs/base-update")" == "security fix" ]]
+	[[ "$(cat "$BUNDLE_OUT/rootfs/app")" == "application" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci rebase [separate base image]" {
+	BASE="$(setup_tmpdir)/base"
+
+	umoci init --layout "$BASE"
+	[ "$status" -eq 0 ]
+	umoci copy --from "${IMAGE}:${TAG}" --to "$BASE:v1"
+	[ "$status" -eq 0 ]
+	umoci config --image "$BASE:v1" --tag v2 --author "new base"
+	[ "$status" -eq 0 ]
+
+	umoci config --image "${IMAGE}:${TAG}" --tag app --config.cmd "app"
+	[ "$status" -eq 0 ]
+
+	umoci rebase --image "${IMAGE}:app" --old-base "$BASE:v1" --new-base "$BASE:v2"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The application configuration is kept.
+	umoci stat --image "${IMAGE}:app" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.config.config.Cmd[0]')" == "app" ]]
+}
+
+@test "umoci rebase [wrong base]" {
+	umoci config --image "${IMAGE}:${TAG}" --tag other --config.cmd "other"
+	[ "$status" -eq 0 ]
+
+	# An image isn't based on a newer version of itself.
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "new" > "$BUNDLE/rootfs/new"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	umoci rebase --image "${IMAGE}:${TAG}" --old-base "${IMAGE}:${TAG}-new" --new-base "${IMAGE}:other"
+	[ "$status" -ne 0 ]
+
+	# Missing arguments.
+	umoci rebase --image "${IMAGE}:${TAG}" --old-base "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,107 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci refs export [missing args]" {
+	umoci refs export --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci refs import --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci refs export" {
+	REFS="$(setup_tmpdir)/refs.json"
+
+	umoci refs export --layout "${IMAGE}" "$REFS"
+	[ "$status" -eq 0 ]
+
+	# Every reference must be exported exactly as it is stored.
+	[[ "$(jq -SMr '.version' "$REFS")" -eq 1 ]]
+	[[ "$(jq -SMr ".references[\"${TAG}\"].digest" "$REFS")" == "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")" ]]
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$(jq -SMr '.references | length' "$REFS")" ]
+
+	# Exporting to stdout must produce the same file.
+	umoci refs export --layout "${IMAGE}" -
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMc .)" == "$(jq -SMc . "$REFS")" ]]
+}
+
+@test "umoci refs import" {
+	REFS="$(setup_tmpdir)/refs.json"
+	NEWIMAGE="$(setup_tmpdir)/image"
+
+	umoci refs export --layout "${IMAGE}" "$REFS"
+	[ "$status" -eq 0 ]
+
+	# Restore the blobs and then the references into a new image.
+	umoci init --layout "${NEWIMAGE}"
+	[ "$status" -eq 0 ]
+	cp -a "${IMAGE}/blobs/." "${NEWIMAGE}/blobs/"
+
+	umoci refs import --layout "${NEWIMAGE}" "$REFS"
+	[ "$status" -eq 0 ]
+	image-verify "${NEWIMAGE}"
+
+	[[ "$(jq -SMr '.digest' "${NEWIMAGE}/refs/${TAG}")" == "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")" ]]
+
+	# Importing the same references again is a no-op.
+	umoci refs import --layout "${NEWIMAGE}" "$REFS"
+	[ "$status" -eq 0 ]
+
+	# Changed references are only replaced with --force.
+	umoci new --image "${NEWIMAGE}:${TAG}" --force
+	[ "$status" -eq 0 ]
+	umoci refs import --layout "${NEWIMAGE}" "$REFS"
+	[ "$status" -ne 0 ]
+	umoci refs import --layout "${NEWIMAGE}" --force "$REFS"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.digest' "${NEWIMAGE}/refs/${TAG}")" == "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")" ]]
+}
+
+@test "umoci refs import [missing blobs]" {
+	REFS="$(setup_tmpdir)/refs.json"
+	NEWIMAGE="$(setup_tmpdir)/image"
+
+	umoci refs export --layout "${IMAGE}" "$REFS"
+	[ "$status" -eq 0 ]
+
+	# References are imported even if the blobs haven't been restored yet.
+	umoci init --layout "${NEWIMAGE}"
+	[ "$status" -eq 0 ]
+	umoci refs import --layout "${NEWIMAGE}" - < "$REFS"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.digest' "${NEWIMAGE}/refs/${TAG}")" == "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")" ]]
+
+	# Invalid reference names are rejected.
+	echo '{"version": 1, "references": {"../bad": {}}}' > "$REFS"
+	umoci refs import --layout "${NEWIMAGE}" "$REFS"
+	[ "$status" -ne 0 ]
+}
@@ -264,6 +264,86 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci repack --no-history" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some small change.
+	touch "$BUNDLE/a_small_change"
+
+	# --no-history conflicts with the --history.* flags.
+	umoci repack --image "${IMAGE}:${TAG}-new" --no-history --history.comment="comment" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Repack the image without a history entry.
+	umoci repack --image "${IMAGE}:${TAG}-new" --no-history "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	historyA="$(echo "$output" | jq -SMc '.history')"
+	numLayersA="$(echo "$output" | jq -SMr '.config.rootfs.diff_ids | length')"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	historyB="$(echo "$output" | jq -SMc '.history')"
+	numLayersB="$(echo "$output" | jq -SMr '.config.rootfs.diff_ids | length')"
+
+	# The layer was added, but the history is unchanged.
+	[ "$numLayersB" -eq "$((numLayersA + 1))" ]
+	[[ "$historyA" == "$historyB" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --reproducible" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Make the same change in two separate bundles, at different times.
+	for bundle in "$BUNDLE_A" "$BUNDLE_B"; do
+		umoci unpack --image "${IMAGE}:${TAG}" "$bundle"
+		[ "$status" -eq 0 ]
+		bundle-verify "$bundle"
+
+		mkdir "$bundle/rootfs/newdir"
+		echo "subfile" > "$bundle/rootfs/newdir/anotherfile"
+		sleep 1s
+	done
+
+	umoci repack --image "${IMAGE}:${TAG}-a" --reproducible --source-date-epoch 1000 "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci repack --image "${IMAGE}:${TAG}-b" --reproducible --source-date-epoch 1000 "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The two images should be identical.
+	umoci stat --image "${IMAGE}:${TAG}-a" --json
+	[ "$status" -eq 0 ]
+	statA="$output"
+	umoci stat --image "${IMAGE}:${TAG}-b" --json
+	[ "$status" -eq 0 ]
+	statB="$output"
+	[[ "$statA" == "$statB" ]]
+	[[ "$(echo "$statA" | jq -SMr '.history[-1].created')" == "1970-01-01T00:16:40Z" ]]
+
+	# Including the manifest descriptors.
+	diff "${IMAGE}/refs/${TAG}-a" "${IMAGE}/refs/${TAG}-b"
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci {un,re}pack [hardlink]" {
 	BUNDLE_A="$(setup_tmpdir)"
 	BUNDLE_B="$(setup_tmpdir)"
@@ -499,3 +579,647 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci {un,re}pack [long paths]" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Create a node_modules-style tree, with paths much longer than the 255
+	# bytes that can be stored in a plain tar header.
+	deep="rootfs"
+	for _ in $(seq 20); do
+		deep="$deep/node_modules/$(printf 'x%.0s' $(seq 60))"
+	done
+	longname="$(printf 'f%.0s' $(seq 200))"
+	mkdir -p "$BUNDLE_A/$deep"
+	echo "long file" > "$BUNDLE_A/$deep/$longname"
+	echo "removed" > "$BUNDLE_A/$deep/removed"
+	ln -s "$(printf '../%.0s' $(seq 40))target" "$BUNDLE_A/$deep/symlink"
+
+	# Repack the image.
+	umoci repack --image "${IMAGE}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image again.
+	umoci unpack --image "${IMAGE}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# Make sure the tree was preserved.
+	[[ "$(cat "$BUNDLE_B/$deep/$longname")" == "long file" ]]
+	[ -f "$BUNDLE_B/$deep/removed" ]
+	[[ "$(readlink "$BUNDLE_B/$deep/symlink")" == "$(printf '../%.0s' $(seq 40))target" ]]
+
+	# Now remove a file deep in the tree, which requires a long whiteout.
+	rm "$BUNDLE_B/$deep/removed"
+
+	# Repack the image.
+	umoci repack --image "${IMAGE}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image again.
+	umoci unpack --image "${IMAGE}" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
+	[[ "$(cat "$BUNDLE_C/$deep/$longname")" == "long file" ]]
+	! [ -e "$BUNDLE_C/$deep/removed" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack [compressed mtree]" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --compress-mtree --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Only the compressed mtree should exist.
+	! [ -e "$BUNDLE_A"/sha256_*.mtree ]
+	[ -f "$BUNDLE_A"/sha256_*.mtree.zst ]
+
+	echo "first file" > "$BUNDLE_A/rootfs/newfile"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new layer must only contain the new file.
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[ -f "$BUNDLE_B/rootfs/newfile" ]
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLayers="$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer | not)] | length')"
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer | not)] | length')" -eq "$((numLayers + 1))" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --clamp-mtime" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	echo "new file" > "$BUNDLE_A/rootfs/newfile"
+	touch -d "@500" "$BUNDLE_A/rootfs/oldfile"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --clamp-mtime invalid "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --clamp-mtime 1000 "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# Only later timestamps are clamped.
+	[[ "$(stat -c '%Y' "$BUNDLE_B/rootfs/newfile")" -eq 1000 ]]
+	[[ "$(stat -c '%Y' "$BUNDLE_B/rootfs/oldfile")" -eq 500 ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --compression-{level,jobs}" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Generate a file large enough to be split into several blocks.
+	head -c 4M /dev/urandom | base64 > "$BUNDLE_A/rootfs/large"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --compression-level 0 "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-new" --compression-jobs -1 "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --compression-level 9 --compression-jobs 4 "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	cmp "$BUNDLE_A/rootfs/large" "$BUNDLE_B/rootfs/large"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack [json state]" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Invalid options.
+	umoci unpack --state-format=invalid --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci unpack --state-format=json --compress-mtree --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci unpack --mtree-keyword=invalid --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci unpack --mtree-keyword=-type --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	umoci unpack --state-format=json --mtree-keyword=-time --mtree-keyword=sha512 --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Only the JSON state should exist, and it records the keywords.
+	! [ -e "$BUNDLE_A"/sha256_*.mtree ]
+	[ -f "$BUNDLE_A"/sha256_*.state.json ]
+	[[ "$(jq -SMr '.keywords | index("sha512digest")' "$BUNDLE_A"/sha256_*.state.json)" != "null" ]]
+	[[ "$(jq -SMr '.keywords | index("tar_time")' "$BUNDLE_A"/sha256_*.state.json)" == "null" ]]
+	[[ "$(jq -SMr '.map_options.rootless' "$BUNDLE_A"/sha256_*.state.json)" == "$([[ "$ROOTLESS" != 0 ]] && echo true || echo false)" ]]
+
+	# Changing only the modification time is not a change.
+	touch -d "2001-01-01" "$BUNDLE_A/rootfs/etc"
+	echo "first file" > "$BUNDLE_A/rootfs/newfile"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new layer must only contain the new file.
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[ -f "$BUNDLE_B/rootfs/newfile" ]
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLayers="$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer | not)] | length')"
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer | not)] | length')" -eq "$((numLayers + 1))" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --watch-state" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+	JOURNAL="$(setup_tmpdir)/journal"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# The journal cannot be inside the rootfs.
+	umoci watch --watch-state "$BUNDLE_A/rootfs/journal" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	# Start recording changes, and wait for the whole rootfs to be watched.
+	"$UMOCI" watch --watch-state "$JOURNAL" "$BUNDLE_A" &
+	watchPid="$!"
+	for _ in {1..50}; do
+		[ -s "$JOURNAL" ] && break
+		sleep 0.1
+	done
+	[ -s "$JOURNAL" ]
+
+	echo "new file" > "$BUNDLE_A/rootfs/newfile"
+	mkdir -p "$BUNDLE_A/rootfs/newdir/subdir"
+	echo "nested file" > "$BUNDLE_A/rootfs/newdir/subdir/file"
+	chmod 0700 "$BUNDLE_A/rootfs/etc"
+	rm -rf "$BUNDLE_A/rootfs/usr/share"
+
+	kill -INT "$watchPid"
+	wait "$watchPid"
+
+	# Repacking with the journal gives the same layer as a full repack.
+	umoci repack --watch-state "$JOURNAL" --image "${IMAGE}:${TAG}-journal" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci repack --image "${IMAGE}:${TAG}-full" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-journal" --json
+	[ "$status" -eq 0 ]
+	journalLayers="$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer | not)] | length')"
+	umoci stat --image "${IMAGE}:${TAG}-full" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer | not)] | length')" -eq "$journalLayers" ]]
+
+	umoci unpack --image "${IMAGE}:${TAG}-journal" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	umoci unpack --image "${IMAGE}:${TAG}-full" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+	diff -r "$BUNDLE_B/rootfs" "$BUNDLE_C/rootfs"
+	[ -f "$BUNDLE_B/rootfs/newdir/subdir/file" ]
+	! [ -e "$BUNDLE_B/rootfs/usr/share" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --metadata-only" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Only change metadata (and add a file, which is read from the rootfs).
+	chmod -R go-rwx "$BUNDLE_A/rootfs/etc"
+	echo "new file" > "$BUNDLE_A/rootfs/newfile"
+
+	umoci repack --metadata-only --image "${IMAGE}:${TAG}-metadata" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci repack --image "${IMAGE}:${TAG}-full" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Both layers must give the same rootfs.
+	umoci unpack --image "${IMAGE}:${TAG}-metadata" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	umoci unpack --image "${IMAGE}:${TAG}-full" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+	diff -r "$BUNDLE_B/rootfs" "$BUNDLE_C/rootfs"
+	[[ "$(stat -c '%a' "$BUNDLE_B/rootfs/etc")" == "$(stat -c '%a' "$BUNDLE_C/rootfs/etc")" ]]
+	[ -f "$BUNDLE_B/rootfs/newfile" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --no-sparse" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Create a 256MiB file which is almost entirely a hole.
+	truncate -s 256M "$BUNDLE_A/rootfs/disk.img"
+	echo "some data" | dd of="$BUNDLE_A/rootfs/disk.img" bs=1 seek=100000000 conv=notrunc
+
+	umoci repack --image "${IMAGE}:${TAG}-sparse" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci repack --no-sparse --image "${IMAGE}:${TAG}-no-sparse" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The holes must be recreated when unpacking (unless --no-sparse is used).
+	umoci unpack --image "${IMAGE}:${TAG}-sparse" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	cmp "$BUNDLE_A/rootfs/disk.img" "$BUNDLE_B/rootfs/disk.img"
+	[ "$(stat -c '%b' "$BUNDLE_B/rootfs/disk.img")" -lt 1024 ]
+
+	umoci unpack --no-sparse --image "${IMAGE}:${TAG}-sparse" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+	cmp "$BUNDLE_A/rootfs/disk.img" "$BUNDLE_C/rootfs/disk.img"
+	[ "$(stat -c '%b' "$BUNDLE_C/rootfs/disk.img")" -ge 1024 ]
+
+	# GNU tar must be able to extract the sparse file from the layer.
+	umoci stat --image "${IMAGE}:${TAG}-sparse" --json
+	[ "$status" -eq 0 ]
+	sparseLayer="$(jq -r '.history[-1].layer.digest' <<<"$output" | tr : /)"
+	umoci stat --image "${IMAGE}:${TAG}-no-sparse" --json
+	[ "$status" -eq 0 ]
+	fullLayer="$(jq -r '.history[-1].layer.digest' <<<"$output" | tr : /)"
+	[ "$(stat -c '%s' "$IMAGE/blobs/$sparseLayer")" -lt "$(stat -c '%s' "$IMAGE/blobs/$fullLayer")" ]
+
+	EXTRACT="$(setup_tmpdir)"
+	tar -xzf "$IMAGE/blobs/$sparseLayer" -C "$EXTRACT"
+	cmp "$BUNDLE_A/rootfs/disk.img" "$EXTRACT/disk.img"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --metrics" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	umoci --metrics --stats-format=json unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	[[ "$(echo "${lines[-1]}" | jq -SMr '.blobs_read')" -gt 0 ]]
+	[[ "$(echo "${lines[-1]}" | jq -SMr '[.layers[] | select(.op == "unpack")] | length')" -gt 0 ]]
+
+	echo "metrics" > "$BUNDLE_A/rootfs/metrics"
+	umoci --metrics repack --image "${IMAGE}:${TAG}-metrics" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"blobs written:"*"pack layer:"* ]]
+	image-verify "${IMAGE}"
+
+	umoci --metrics --stats-format=json unpack --image "${IMAGE}:${TAG}-metrics" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[[ "$(echo "${lines[-1]}" | jq -SMr '.layers[-1].uncompressed_size')" -gt 0 ]]
+
+	# No summary is printed by default.
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"blobs written:"* ]]
+}
+
+@test "umoci repack --format=estargz" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	echo "estargz" > "$BUNDLE_A/rootfs/estargz"
+	sane_run dd if=/dev/urandom of="$BUNDLE_A/rootfs/big" bs=1M count=9
+	[ "$status" -eq 0 ]
+
+	umoci repack --format=estargz --image "${IMAGE}:${TAG}-estargz" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new layer has the eStargz annotations, and its TOC is the last entry.
+	manifest="${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-estargz" | tr : /)"
+	layer="${IMAGE}/blobs/$(jq -SMr '.layers[-1].digest' "$manifest" | tr : /)"
+	toc_digest="$(jq -SMr '.layers[-1].annotations["containerd.io/snapshot/stargz/toc.digest"]' "$manifest")"
+	[[ "$toc_digest" == "sha256:$(tar -xzOf "$layer" stargz.index.json | sha256sum | cut -d' ' -f1)" ]]
+	[[ "$(jq -SMr '.layers[-1].annotations["io.containers.estargz.uncompressed-size"]' "$manifest")" -eq "$(gzip -dc "$layer" | wc -c)" ]]
+	sane_run tar -tzf "$layer"
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == ".no.prefetch.landmark" ]]
+	[[ "${lines[-1]}" == "stargz.index.json" ]]
+	[[ "$(tar -xzOf "$layer" stargz.index.json | jq -SMr '[.entries[] | select(.name == "big" and .type == "chunk")] | length')" -eq 2 ]]
+
+	# The TOC and landmark are not extracted.
+	umoci unpack --image "${IMAGE}:${TAG}-estargz" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[ ! -e "$BUNDLE_B/rootfs/stargz.index.json" ]
+	[ ! -e "$BUNDLE_B/rootfs/.no.prefetch.landmark" ]
+	cmp "$BUNDLE_A/rootfs/big" "$BUNDLE_B/rootfs/big"
+	[[ "$(cat "$BUNDLE_B/rootfs/estargz")" == "estargz" ]]
+
+	# Unknown formats are rejected.
+	umoci repack --format=zstd --image "${IMAGE}:${TAG}-bad" "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack --max-blob-size" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	sane_run dd if=/dev/urandom of="$BUNDLE_A/rootfs/big" bs=1M count=3
+	[ "$status" -eq 0 ]
+
+	# NOTE: We can't use image-verify on the chunked image, because the blob
+	#       of the chunked layer is (deliberately) not in the image.
+	umoci repack --max-blob-size=1M --image "${IMAGE}:${TAG}-chunked" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+
+	# The new layer is split into chunks of at most 1MiB, and its own blob is
+	# not stored.
+	manifest="${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-chunked" | tr : /)"
+	layer="$(jq -SMr '.layers[-1].digest' "$manifest")"
+	chunks="$(jq -SMr '.annotations["org.opensuse.umoci.layer.chunks"]' "$manifest")"
+	[[ "$(jq -SMr --arg layer "$layer" '.[$layer] | length' <<<"$chunks")" -ge 3 ]]
+	[[ "$(jq -SMr '[.[][] | select(.size > 1048576)] | length' <<<"$chunks")" -eq 0 ]]
+	[[ "$(jq -SMr --arg layer "$layer" '[.[$layer][].size] | add' <<<"$chunks")" -eq "$(jq -SMr '.layers[-1].size' "$manifest")" ]]
+	[ ! -e "${IMAGE}/blobs/$(tr : / <<<"$layer")" ]
+
+	# The chunks are kept by gc, and the layer is reassembled when unpacking.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	for chunk in $(jq -SMr '.[][].digest' <<<"$chunks"); do
+		[ -f "${IMAGE}/blobs/$(tr : / <<<"$chunk")" ]
+	done
+
+	umoci unpack --image "${IMAGE}:${TAG}-chunked" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	cmp "$BUNDLE_A/rootfs/big" "$BUNDLE_B/rootfs/big"
+
+	# Invalid sizes are rejected.
+	umoci repack --max-blob-size=0 --image "${IMAGE}:${TAG}-bad" "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+	umoci repack --max-blob-size=huge --image "${IMAGE}:${TAG}-bad" "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack --jobs" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Change the contents of a file without changing its size or mtime, so
+	# that only its digest differs.
+	echo "original" > "$BUNDLE_A/rootfs/same-size"
+	umoci repack --image "${IMAGE}:${TAG}-base" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	cp -p "$BUNDLE_A/rootfs/same-size" "$BUNDLE_A/timestamp"
+	echo "modified" > "$BUNDLE_A/rootfs/same-size"
+	touch -r "$BUNDLE_A/timestamp" "$BUNDLE_A/rootfs/same-size"
+	rm -f "$BUNDLE_A/timestamp"
+	echo "resized file" > "$BUNDLE_A/rootfs/etc/resized"
+
+	# A negative number of jobs is rejected.
+	umoci repack --image "${IMAGE}:${TAG}-new" --jobs=-1 "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --jobs=4 "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Both changes were noticed.
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[[ "$(cat "$BUNDLE_B/rootfs/same-size")" == "modified" ]]
+	[[ "$(cat "$BUNDLE_B/rootfs/etc/resized")" == "resized file" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci verify-bundle" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# A freshly unpacked bundle is unmodified.
+	umoci verify-bundle --bundle "$BUNDLE" --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+
+	umoci verify-bundle --bundle "$BUNDLE" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.modified')" == "false" ]]
+	[[ "$(echo "$output" | jq -SMr '.changes | length')" == "0" ]]
+
+	# Modify the rootfs.
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	rm -rf "$BUNDLE/rootfs/etc"
+	chmod 0700 "$BUNDLE/rootfs/usr"
+
+	umoci verify-bundle --bundle "$BUNDLE" --json
+	[ "$status" -ne 0 ]
+	[[ "$(echo "$output" | jq -SMr '.modified')" == "true" ]]
+	[[ "$(echo "$output" | jq -SMr '.changes[] | select(.path == "/newfile") | .type')" == "added" ]]
+	[[ "$(echo "$output" | jq -SMr '.changes[] | select(.path == "/etc") | .type')" == "removed" ]]
+	[[ "$(echo "$output" | jq -SMr '.changes[] | select(.path == "/usr") | .type')" == "modified" ]]
+
+	# Nothing was written to the bundle.
+	umoci verify-bundle --bundle "$BUNDLE" --json
+	[ "$status" -ne 0 ]
+
+	# The bundle is stale once the tag has been modified.
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --config.user "nobody"
+	[ "$status" -eq 0 ]
+	umoci verify-bundle --bundle "$BUNDLE" --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	umoci verify-bundle --bundle "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci verify-bundle --refresh-mode=content" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Only change metadata.
+	chmod 0700 "$BUNDLE/rootfs/usr"
+	touch -d "@1234567890" "$BUNDLE/rootfs/etc"
+
+	umoci verify-bundle --bundle "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	umoci verify-bundle --bundle "$BUNDLE" --refresh-mode content
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+
+	umoci verify-bundle --bundle "$BUNDLE" --refresh-tolerance mode --refresh-tolerance time
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+
+	# Only tolerating some of the differences isn't enough.
+	umoci verify-bundle --bundle "$BUNDLE" --refresh-tolerance mode
+	[ "$status" -ne 0 ]
+
+	# Content changes are still noticed.
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	umoci verify-bundle --bundle "$BUNDLE" --refresh-mode content --json
+	[ "$status" -ne 0 ]
+	[[ "$(echo "$output" | jq -SMr '.changes | length')" == "1" ]]
+	[[ "$(echo "$output" | jq -SMr '.changes[0].path')" == "/newfile" ]]
+
+	# Invalid options.
+	umoci verify-bundle --bundle "$BUNDLE" --refresh-mode nonexistent
+	[ "$status" -ne 0 ]
+	umoci verify-bundle --bundle "$BUNDLE" --refresh-mode content --metadata-only
+	[ "$status" -ne 0 ]
+	umoci verify-bundle --bundle "$BUNDLE" --refresh-tolerance mode=2s
+	[ "$status" -ne 0 ]
+	umoci verify-bundle --bundle "$BUNDLE" --refresh-tolerance type
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --filter" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	mkdir -p "$BUNDLE_A/rootfs/var/cache/filter"
+	echo "cache" > "$BUNDLE_A/rootfs/var/cache/filter/cached"
+	echo "kept" > "$BUNDLE_A/rootfs/kept"
+
+	umoci repack --filter "exclude:/var/cache/**" --filter "reset-owner:1234:5678" --image "${IMAGE}:${TAG}-filter" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The excluded paths are not in the new layer, and all of its entries have
+	# the new owner.
+	manifest="${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-filter" | tr : /)"
+	layer="${IMAGE}/blobs/$(jq -SMr '.layers[-1].digest' "$manifest" | tr : /)"
+	sane_run tar -tzf "$layer"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"kept"* ]]
+	[[ "$output" != *"var/cache/filter"* ]]
+	sane_run tar --numeric-owner -tvzf "$layer"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | awk '{ print $2 }' | sort -u)" == "1234/5678" ]]
+
+	umoci unpack --image "${IMAGE}:${TAG}-filter" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[[ "$(cat "$BUNDLE_B/rootfs/kept")" == "kept" ]]
+	[ ! -e "$BUNDLE_B/rootfs/var/cache/filter" ]
+
+	# Invalid filters are rejected.
+	umoci repack --filter "nonexistent" --image "${IMAGE}:${TAG}-bad" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci repack --filter "reset-owner:1234" --image "${IMAGE}:${TAG}-bad" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+}
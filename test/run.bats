@@ -0,0 +1,98 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+
+	# A fake runtime, which records the bundle it was asked to run and exits
+	# with the status given in the container's arguments.
+	RUNTIME_DIR="$(setup_tmpdir)"
+	RUNTIME="$RUNTIME_DIR/runtime"
+	cat >"$RUNTIME" <<-'EOF'
+	#!/bin/bash
+	set -e
+	[ "$1" == "--root" ] && [ -d "$2" ]
+	[ "$3" == "run" ] && [ "$4" == "--bundle" ]
+	bundle="$5"
+	[ -d "$bundle/rootfs" ]
+	cp "$bundle/config.json" "$(dirname "$0")/config.json"
+	echo "$bundle" >"$(dirname "$0")/bundle"
+	exit "$(jq -r '.process.args[-1]' "$bundle/config.json")"
+	EOF
+	chmod +x "$RUNTIME"
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci run [missing args]" {
+	umoci run --runtime "$RUNTIME"
+	[ "$status" -ne 0 ]
+
+	umoci run --image "${IMAGE}:${TAG}" --runtime "$RUNTIME" --mode invalid -- /bin/true 0
+	[ "$status" -ne 0 ]
+
+	umoci run --image "${IMAGE}:${TAG}" --runtime "$RUNTIME_DIR/nonexistent" -- /bin/true 0
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci run" {
+	umoci run --image "${IMAGE}:${TAG}" --runtime "$RUNTIME" -- /bin/sh -c "exit" 0
+	[ "$status" -eq 0 ]
+
+	# The command is used as the container process, without a terminal.
+	[[ "$(jq -SMrc '.process.args' "$RUNTIME_DIR/config.json")" == '["/bin/sh","-c","exit","0"]' ]]
+	[[ "$(jq -SMr '.process.terminal' "$RUNTIME_DIR/config.json")" != "true" ]]
+
+	# The bundle was removed.
+	! [ -e "$(cat "$RUNTIME_DIR/bundle")" ]
+
+	# The exit status of the container is used.
+	umoci run --image "${IMAGE}:${TAG}" --runtime "$RUNTIME" -- /bin/sh -c "exit" 42
+	[ "$status" -eq 42 ]
+	! [ -e "$(cat "$RUNTIME_DIR/bundle")" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci run --keep" {
+	umoci run --image "${IMAGE}:${TAG}" --runtime "$RUNTIME" --keep --runtime-profile minimal -- /bin/true 0
+	[ "$status" -eq 0 ]
+
+	BUNDLE="$(cat "$RUNTIME_DIR/bundle")"
+	[ -d "$BUNDLE/rootfs" ]
+	[ -f "$BUNDLE/config.json" ]
+	[[ "$(jq -SMr '.process.noNewPrivileges' "$BUNDLE/config.json")" == "true" ]]
+
+	chmod -R u+rwX "$(dirname "$BUNDLE")"
+	rm -rf "$(dirname "$BUNDLE")"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci run --mode=overlay" {
+	requires root
+
+	umoci run --image "${IMAGE}:${TAG}" --runtime "$RUNTIME" --mode overlay --tmpfs -- /bin/true 0
+	[ "$status" -eq 0 ]
+	! [ -e "$(cat "$RUNTIME_DIR/bundle")" ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,112 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci sbom [invalid arguments]" {
+	umoci sbom --image "${IMAGE}:${TAG}" --format nope
+	[ "$status" -ne 0 ]
+
+	umoci sbom --image "${IMAGE}:${TAG}" extra
+	[ "$status" -ne 0 ]
+
+	umoci sbom --image "${IMAGE}:${TAG}-nonexistent"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci sbom" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# Replace the package databases with ones we know the contents of. The rpm
+	# database is removed so that rpm(8) is not needed to run the test.
+	rm -rf "$BUNDLE/rootfs/var/lib/rpm" "$BUNDLE/rootfs/usr/lib/sysimage/rpm"
+	mkdir -p "$BUNDLE/rootfs/var/lib/dpkg" "$BUNDLE/rootfs/lib/apk/db" "$BUNDLE/rootfs/etc"
+	rm -f "$BUNDLE/rootfs/etc/os-release"
+	cat >"$BUNDLE/rootfs/etc/os-release" <<EOF2
+ID=umoci
+VERSION_ID="1.0"
+EOF2
+	cat >"$BUNDLE/rootfs/var/lib/dpkg/status" <<EOF2
+Package: bash
+Status: install ok installed
+Architecture: amd64
+Version: 4.4-5
+
+Package: removed
+Status: deinstall ok config-files
+Version: 1.0
+EOF2
+	cat >"$BUNDLE/rootfs/lib/apk/db/installed" <<EOF2
+P:musl
+V:1.1.16-r10
+A:x86_64
+L:MIT
+EOF2
+
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# SPDX.
+	umoci sbom --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.spdxVersion')" == "SPDX-2.3" ]]
+	[[ "$(echo "$output" | jq -SMr '.packages | length')" -eq 3 ]]
+	[[ "$(echo "$output" | jq -SMr '.packages[1].name')" == "musl" ]]
+	[[ "$(echo "$output" | jq -SMr '.packages[1].externalRefs[0].referenceLocator')" == "pkg:apk/umoci/musl@1.1.16-r10?arch=x86_64&distro=umoci-1.0" ]]
+	[[ "$(echo "$output" | jq -SMr '.packages[2].name')" == "bash" ]]
+
+	# CycloneDX.
+	umoci sbom --image "${IMAGE}:${TAG}" --format cyclonedx
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.bomFormat')" == "CycloneDX" ]]
+	[[ "$(echo "$output" | jq -SMr '.components | length')" -eq 2 ]]
+	[[ "$(echo "$output" | jq -SMr '.components[0].purl')" == "pkg:apk/umoci/musl@1.1.16-r10?arch=x86_64&distro=umoci-1.0" ]]
+	[[ "$(echo "$output" | jq -SMr '.components[1].purl')" == "pkg:deb/umoci/bash@4.4-5?arch=amd64&distro=umoci-1.0" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci sbom --attach" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	rm -rf "$BUNDLE/rootfs/var/lib/rpm" "$BUNDLE/rootfs/usr/lib/sysimage/rpm"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	OUTPUT="$(setup_tmpdir)/sbom.json"
+	umoci sbom --image "${IMAGE}:${TAG}" --format cyclonedx --attach --output "$OUTPUT"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.bomFormat' "$OUTPUT")" == "CycloneDX" ]]
+
+	umoci referrers --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr 'length')" -eq 1 ]]
+	[[ "$(echo "$output" | jq -SMr '.[0].artifactType')" == "application/vnd.cyclonedx+json" ]]
+}
@@ -0,0 +1,127 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci scan-import [missing args]" {
+	umoci scan-import --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci scan-import --image "${IMAGE}:${TAG}" --format nope /dev/null
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci scan-import [trivy]" {
+	image-verify "${IMAGE}"
+
+	# Get the DiffIDs of the image.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	diffid="$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer != true)][0].diff_id')"
+	numlayers="$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer != true)] | length')"
+
+	REPORT="$(setup_tmpdir)/report.json"
+	cat >"$REPORT" <<-EOF
+	{
+		"Results": [
+			{
+				"Vulnerabilities": [
+					{"VulnerabilityID": "CVE-0000-0001", "PkgName": "a", "Severity": "CRITICAL", "Layer": {"DiffID": "$diffid"}},
+					{"VulnerabilityID": "CVE-0000-0002", "PkgName": "a", "Severity": "LOW", "Layer": {"DiffID": "$diffid"}},
+					{"VulnerabilityID": "CVE-0000-0002", "PkgName": "a", "Severity": "LOW", "Layer": {"DiffID": "$diffid"}}
+				]
+			}
+		]
+	}
+	EOF
+
+	umoci scan-import --image "${IMAGE}:${TAG}" --tag "${TAG}-scanned" "$REPORT"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The summaries are stored as manifest annotations.
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-scanned" | tr : /)"
+	[[ "$(jq -SMr '.annotations["org.opensuse.umoci.vulnerabilities"]' "${IMAGE}/blobs/$manifest")" == "CRITICAL=1,LOW=1" ]]
+	[[ "$(jq -SMr ".annotations[\"org.opensuse.umoci.vulnerabilities.$diffid\"]" "${IMAGE}/blobs/$manifest")" == "CRITICAL=1,LOW=1" ]]
+
+	# ... and displayed by stat.
+	umoci stat --image "${IMAGE}:${TAG}-scanned" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.vulnerabilities')" == "CRITICAL=1,LOW=1" ]]
+	[[ "$(echo "$output" | jq -SMr "[.history[] | select(.diff_id == \"$diffid\")][0].vulnerabilities")" == "CRITICAL=1,LOW=1" ]]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.vulnerabilities != null)] | length')" -eq "$numlayers" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}-scanned"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"VULNERABILITIES: CRITICAL=1,LOW=1"* ]]
+
+	# The original image is unmodified.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.vulnerabilities')" == "null" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci scan-import [grype]" {
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	diffid="$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer != true)][0].diff_id')"
+
+	REPORT="$(setup_tmpdir)/report.json"
+	cat >"$REPORT" <<-EOF
+	{
+		"matches": [
+			{
+				"vulnerability": {"id": "CVE-0000-0001", "severity": "High"},
+				"artifact": {"name": "a", "locations": [{"path": "/a", "layerID": "$diffid"}]}
+			}
+		]
+	}
+	EOF
+
+	umoci scan-import --image "${IMAGE}:${TAG}" "$REPORT"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.vulnerabilities')" == "HIGH=1" ]]
+
+	# Importing an empty report replaces the previous summaries.
+	echo '{"matches": []}' >"$REPORT"
+	umoci scan-import --image "${IMAGE}:${TAG}" "$REPORT"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.vulnerabilities')" == "NONE" ]]
+	[[ "$(echo "$output" | jq -SMr "[.history[] | select(.diff_id == \"$diffid\")][0].vulnerabilities")" == "NONE" ]]
+
+	image-verify "${IMAGE}"
+}
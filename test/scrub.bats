@@ -0,0 +1,122 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci scrub" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Add a layer containing some secrets.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	mkdir -p "$BUNDLE_A/rootfs/etc/app" "$BUNDLE_A/rootfs/secrets"
+	echo "token=hunter2" > "$BUNDLE_A/rootfs/etc/app/credentials"
+	echo "not a secret" > "$BUNDLE_A/rootfs/etc/app/config"
+	echo "private key" > "$BUNDLE_A/rootfs/secrets/key.pem"
+
+	umoci repack --image "${IMAGE}:${TAG}-secret" --history.created_by "build --token hunter2" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci config --image "${IMAGE}:${TAG}-secret" --config.env "API_TOKEN=hunter2" --config.env "HOME=/root" --config.label "token=hunter2" --config.label "version=1"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-secret" --json
+	[ "$status" -eq 0 ]
+	nlayers="$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')"
+
+	# Scrub the image.
+	umoci scrub --image "${IMAGE}:${TAG}-secret" --tag "${TAG}-scrubbed" \
+		--env "API_*" --label "token" --history "hunter[0-9]" \
+		--path "/etc/app/credentials" --path "secrets"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The original image is unmodified.
+	umoci stat --image "${IMAGE}:${TAG}-secret" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"hunter2"* ]]
+
+	# The configuration and history no longer contain the secret.
+	umoci stat --image "${IMAGE}:${TAG}-scrubbed" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')" -eq "$nlayers" ]]
+	[[ "$output" != *"hunter2"* ]]
+	[[ "$output" == *"[scrubbed]"* ]]
+
+	umoci unpack --image "${IMAGE}:${TAG}-scrubbed" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# Only the matching files were removed.
+	[ -f "$BUNDLE_B/rootfs/etc/app/config" ]
+	! [ -e "$BUNDLE_B/rootfs/etc/app/credentials" ]
+	! [ -e "$BUNDLE_B/rootfs/secrets" ]
+
+	[[ "$(jq -SMr '.process.env[]' "$BUNDLE_B/config.json" | grep -c API_TOKEN)" -eq 0 ]]
+	jq -SMr '.process.env[]' "$BUNDLE_B/config.json" | grep HOME=/root
+	[[ "$(jq -SMr '.annotations.token' "$BUNDLE_B/config.json")" == "null" ]]
+	[[ "$(jq -SMr '.annotations.version' "$BUNDLE_B/config.json")" == "1" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci scrub [nothing matched]" {
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	before="$output"
+
+	umoci scrub --image "${IMAGE}:${TAG}" --env "DOES_NOT_EXIST" --path "does-not-exist"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$before" ]]
+}
+
+@test "umoci scrub [invalid arguments]" {
+	# Nothing to do.
+	umoci scrub --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Malformed patterns.
+	umoci scrub --image "${IMAGE}:${TAG}" --path "[invalid"
+	[ "$status" -ne 0 ]
+	umoci scrub --image "${IMAGE}:${TAG}" --history "(invalid"
+	[ "$status" -ne 0 ]
+
+	# Positional arguments.
+	umoci scrub --image "${IMAGE}:${TAG}" --env "FOO" extra
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,104 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	if [ -n "$SERVE_PID" ]; then
+		kill "$SERVE_PID" || true
+		wait "$SERVE_PID" || true
+	fi
+	teardown_tmpdirs
+	teardown_image
+}
+
+# start_serve starts umoci-serve(1) in the background with the given
+# arguments, and waits until it is serving requests on $SERVE_URL.
+function start_serve() {
+	SERVE_URL="http://127.0.0.1:${SERVE_PORT:-5042}"
+	"$UMOCI" serve --layout "${IMAGE}" --listen "127.0.0.1:${SERVE_PORT:-5042}" "$@" 3>&- &
+	SERVE_PID=$!
+	for _ in $(seq 50); do
+		curl -sf "$SERVE_URL/v2/" >/dev/null && return 0
+		sleep 0.1
+	done
+	fail "umoci serve did not start"
+}
+
+@test "umoci serve [missing args]" {
+	umoci serve
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci serve [invalid arguments]" {
+	umoci serve --layout "${IMAGE}" --name "Invalid:Name"
+	[ "$status" -ne 0 ]
+	umoci serve --layout "${IMAGE}" --listen ""
+	[ "$status" -ne 0 ]
+	umoci serve --layout "${IMAGE}" extra
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci serve" {
+	command -v curl >/dev/null || skip "test requires curl"
+
+	start_serve --name "library/image"
+
+	# The repository and its tags are listed.
+	sane_run curl -sf "$SERVE_URL/v2/_catalog"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.repositories[0]')" == "library/image" ]]
+	sane_run curl -sf "$SERVE_URL/v2/library/image/tags/list"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.tags | index("'"${TAG}"'")')" != "null" ]]
+
+	# Manifests can be fetched by tag and by digest.
+	digest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")"
+	sane_run curl -sf "$SERVE_URL/v2/library/image/manifests/${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "sha256:$(echo -n "$output" | sha256sum | cut -d' ' -f1)" == "$digest" ]]
+	sane_run curl -sf -o /dev/null -w '%{http_code}' "$SERVE_URL/v2/library/image/manifests/$digest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "200" ]]
+
+	# Blobs can be fetched, including ranges.
+	layer="$(jq -SMr '.layers[0].digest' "${IMAGE}/blobs/$(echo "$digest" | tr : /)")"
+	sane_run bash -c "curl -sf '$SERVE_URL/v2/library/image/blobs/$layer' | sha256sum"
+	[ "$status" -eq 0 ]
+	[[ "sha256:$(echo "$output" | cut -d' ' -f1)" == "$layer" ]]
+	sane_run bash -c "curl -sf -r 0-9 '$SERVE_URL/v2/library/image/blobs/$layer' | wc -c"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 10 ]
+
+	# Unknown tags, blobs and repositories are not found.
+	sane_run curl -s -o /dev/null -w '%{http_code}' "$SERVE_URL/v2/library/image/manifests/nonexistent"
+	[[ "$output" == "404" ]]
+	sane_run curl -s -o /dev/null -w '%{http_code}' "$SERVE_URL/v2/library/image/blobs/sha256:$(echo -n missing | sha256sum | cut -d' ' -f1)"
+	[[ "$output" == "404" ]]
+	sane_run curl -s -o /dev/null -w '%{http_code}' "$SERVE_URL/v2/other/manifests/${TAG}"
+	[[ "$output" == "404" ]]
+
+	# Nothing can be modified.
+	sane_run curl -s -o /dev/null -w '%{http_code}' -X DELETE "$SERVE_URL/v2/library/image/manifests/${TAG}"
+	[[ "$output" == "405" ]]
+	[ -e "${IMAGE}/refs/${TAG}" ]
+
+	image-verify "${IMAGE}"
+}
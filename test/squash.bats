@@ -0,0 +1,99 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci squash" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+	BUNDLE_D="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Add a layer which creates some files.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	mkdir "$BUNDLE_A/rootfs/newdir"
+	echo "first file" > "$BUNDLE_A/rootfs/newdir/file"
+	echo "deleted file" > "$BUNDLE_A/rootfs/deleted"
+
+	umoci repack --image "${IMAGE}:${TAG}-a" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Add another layer which deletes one of them.
+	umoci unpack --image "${IMAGE}:${TAG}-a" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	rm "$BUNDLE_B/rootfs/deleted"
+	echo "second file" > "$BUNDLE_B/rootfs/newdir/another"
+
+	umoci repack --image "${IMAGE}:${TAG}-b" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Add a configuration-only history entry.
+	umoci config --image "${IMAGE}:${TAG}-b" --config.user="1000:1000"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Squash the image.
+	umoci squash --image "${IMAGE}:${TAG}-b" --tag "${TAG}-squashed" --history.comment "squashed"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# There should only be a single layer.
+	umoci stat --image "${IMAGE}:${TAG}-squashed" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')" -eq 1 ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].comment')" == "squashed" ]]
+	# The configuration history should be retained.
+	[[ "$(echo "$output" | jq -SMr '.history[-2].empty_layer')" == "true" ]]
+
+	# The squashed image should have the same rootfs as the original.
+	umoci unpack --image "${IMAGE}:${TAG}-b" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
+	umoci unpack --image "${IMAGE}:${TAG}-squashed" "$BUNDLE_D"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_D"
+
+	[ -f "$BUNDLE_D/rootfs/newdir/file" ]
+	[ -f "$BUNDLE_D/rootfs/newdir/another" ]
+	! [ -e "$BUNDLE_D/rootfs/deleted" ]
+
+	sane_run diff -r "$BUNDLE_C/rootfs" "$BUNDLE_D/rootfs"
+	[ "$status" -eq 0 ]
+
+	# The configuration should be unchanged.
+	[[ "$(jq -SM '.process.user' "$BUNDLE_C/config.json")" == "$(jq -SM '.process.user' "$BUNDLE_D/config.json")" ]]
+
+	image-verify "${IMAGE}"
+}
@@ -48,6 +48,94 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci stat --json [schema]" {
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+
+	statFile="$(setup_tmpdir)/stat"
+	echo "$output" > "$statFile"
+
+	# The manifest descriptor must match the tag.
+	sane_run jq -SMr '.manifest.digest' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")" ]]
+
+	# The annotations are always an object.
+	sane_run jq -SMr '.annotations | type' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "object" ]]
+
+	# The configuration is included, along with its descriptor.
+	sane_run jq -SMr '.config.descriptor.mediaType' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "application/vnd.oci.image.config.v1+json" ]]
+	sane_run jq -SMr '.config.architecture' "$statFile"
+	[ "$status" -eq 0 ]
+	[ -n "$output" ]
+
+	# Every layer has a compressed and uncompressed size, which add up to the
+	# totals.
+	sane_run jq -SMr '.layers | length' "$statFile"
+	[ "$status" -eq 0 ]
+	[ "$output" -ge 1 ]
+	sane_run jq -SMr '[.layers[] | .uncompressed_size >= .size and .diff_id != ""] | all' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+	sane_run jq -SMr '([.layers[].size] | add) == .size' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+	sane_run jq -SMr '([.layers[].uncompressed_size] | add) == .uncompressed_size' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci stat --format" {
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	statFile="$(setup_tmpdir)/stat"
+	echo "$output" > "$statFile"
+
+	# Simple fields.
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{ .Config.Architecture }}'
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$(jq -SMr '.config.architecture' "$statFile")" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{ .Manifest.Digest }}'
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$(jq -SMr '.manifest.digest' "$statFile")" ]]
+
+	# Ranges and the extra functions.
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{ range .Layers }}{{ .DiffID }} {{ end }}'
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$(jq -SMr '[.layers[].diff_id] | join(" ")' "$statFile") " ]]
+
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{ json .Config.RootFS }}'
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMc '.')" == "$(jq -SMc '.config.rootfs' "$statFile")" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{ humanSize .Size }}'
+	[ "$status" -eq 0 ]
+	[ -n "$output" ]
+
+	# Invalid templates and fields are errors.
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{ .Config.Architecture'
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{ .DoesNotExist }}'
+	[ "$status" -ne 0 ]
+
+	# --format and --json can't be combined.
+	umoci stat --image "${IMAGE}:${TAG}" --json --format '{{ .Size }}'
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 # We can't really test the output for non-JSON output, but we can smoke test it.
 @test "umoci stat [smoke]" {
 	image-verify "${IMAGE}"
@@ -66,6 +154,92 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci stat --resolve-digest" {
+	digest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")"
+
+	umoci stat --image "${IMAGE}:${TAG}" --resolve-digest
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	[[ "$output" == "${TAG}@${digest}" ]]
+	pinned="$output"
+
+	umoci stat --image "${IMAGE}:${TAG}" --resolve-digest --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.reference')" == "$pinned" ]]
+	[[ "$(echo "$output" | jq -SMr '.descriptor')" == "$(jq -SMr '.' "${IMAGE}/refs/${TAG}")" ]]
+
+	# The pinned reference can be used to create a tag.
+	umoci tag --image "${IMAGE}" --digest "$pinned" "${TAG}-pinned"
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-pinned" --resolve-digest
+	[ "$status" -eq 0 ]
+	[[ "$output" == "${TAG}-pinned@${digest}" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}" --resolve-digest --format "{{ .Manifest }}"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci stat --size-breakdown" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Add a layer with a large file on top of the image, as a new tag.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	dd if=/dev/urandom of="$BUNDLE/rootfs/large-file" bs=1M count=2
+	umoci repack --image "${IMAGE}:${TAG}-large" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	umoci stat --image "${IMAGE}:${TAG}-large" --size-breakdown --top-files 1 --json
+	[ "$status" -eq 0 ]
+	breakdown="$(echo "$output" | jq -SMc '.size_breakdown')"
+	nlayers="$(echo "$output" | jq -SMr '.layers | length')"
+
+	# Only the new layer is unique to the image, and it contains the file.
+	[[ "$(echo "$breakdown" | jq -SMr ".layers[$nlayers-1].shared_with | length")" == 0 ]]
+	[[ "$(echo "$breakdown" | jq -SMr ".layers[$nlayers-1].largest_files[0].path")" == "/large-file" ]]
+	[[ "$(echo "$breakdown" | jq -SMr ".layers[$nlayers-1].largest_files[0].size")" == 2097152 ]]
+	[[ "$(echo "$breakdown" | jq -SMr --arg tag "$TAG" '.layers[0].shared_with | index($tag) != null')" == true ]]
+	[ "$(echo "$breakdown" | jq -SMr '.unique_size')" -gt 2000000 ]
+	[[ "$(echo "$breakdown" | jq -SMr '[.layers[].largest_files | length] | max')" == 1 ]]
+
+	# The uncompressed sizes are also filled.
+	[[ "$(echo "$output" | jq -SMr '.uncompressed_size')" != null ]]
+
+	# The default output includes the breakdown.
+	umoci stat --image "${IMAGE}:${TAG}-large" --size-breakdown
+	[ "$status" -eq 0 ]
+	echo "$output" | grep 'SHARED WITH'
+	echo "$output" | grep 'MEDIA TYPE'
+	echo "$output" | grep '/large-file'
+
+	# --top-files requires --size-breakdown.
+	umoci stat --image "${IMAGE}:${TAG}" --top-files 1
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}" --size-breakdown --resolve-digest
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci stat [max metadata size]" {
+	# The image's manifest and configuration are larger than 100 bytes.
+	UMOCI_MAX_METADATA_SIZE=100 umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"metadata blob too large"* ]]
+
+	# But they fit within the default limit.
+	umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	# And a limit of zero disables the limit.
+	UMOCI_MAX_METADATA_SIZE=0 umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci stat [missing args]" {
 	umoci stat
 	[ "$status" -ne 0 ]
@@ -73,3 +247,31 @@ function teardown() {
 
 # TODO: Add a test to make sure that empty_layer and layer are mutually
 #       exclusive. Unfortunately, jq doesn't provide an XOR operator...
+
+@test "umoci stat [read-only image]" {
+	requires root
+
+	image-verify "${IMAGE}"
+
+	# Make the image read-only.
+	mount --bind -o ro "${IMAGE}" "${IMAGE}"
+	mount -o remount,bind,ro "${IMAGE}"
+
+	# Inspecting the image must work.
+	umoci stat --image "${IMAGE}:${TAG}"
+	statStatus="$status"
+	umoci unpack --image "${IMAGE}:${TAG}" "$(setup_tmpdir)/bundle"
+	unpackStatus="$status"
+
+	# But modifying it must not.
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-new"
+	tagStatus="$status"
+
+	umount "${IMAGE}"
+
+	[ "$statStatus" -eq 0 ]
+	[ "$unpackStatus" -eq 0 ]
+	[ "$tagStatus" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
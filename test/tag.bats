@@ -57,6 +57,44 @@ function teardown() {
 	[ "$status" -ne 0 ]
 }
 
+@test "umoci list [long]" {
+	umoci tag --image "${IMAGE}:${TAG}" "release-1"
+	[ "$status" -eq 0 ]
+	umoci tag --image "${IMAGE}:${TAG}" "release-2"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Only the matching tags are listed.
+	umoci ls --layout "${IMAGE}" 'release-*'
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	[[ "${lines[*]}" == *"release-1"* ]]
+	[[ "${lines[*]}" == *"release-2"* ]]
+
+	umoci ls --layout "${IMAGE}" 'release-1' 'release-2' 'does-not-exist'
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+
+	# Invalid patterns are rejected.
+	umoci ls --layout "${IMAGE}" '['
+	[ "$status" -ne 0 ]
+
+	# --long includes the digest of each tag.
+	umoci ls --long --layout "${IMAGE}" 'release-1'
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	[[ "${lines[1]}" == "release-1 "*"$(jq -SMr '.digest' "${IMAGE}/refs/release-1")"* ]]
+
+	umoci ls --json --layout "${IMAGE}" 'release-*'
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr 'length' <<<"$output")" == 2 ]]
+	[[ "$(jq -SMr '.[0].descriptor.digest' <<<"$output")" == "$(jq -SMr '.digest' "${IMAGE}/refs/release-1")" ]]
+	[[ "$(jq -SMr '.[0].platforms | length' <<<"$output")" -gt 0 ]]
+	[[ "$(jq -SMr '.[0].size' <<<"$output")" -gt "$(jq -SMr '.size' "${IMAGE}/refs/release-1")" ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci tag" {
 	# Get blob and mediatype that a tag references.
 	umoci list --layout "${IMAGE}"
@@ -110,8 +148,13 @@ function teardown() {
 	[ "$status" -eq 0 ]
 	image-verify "${IMAGE}"
 
-	# Clobber the tag.
+	# Clobbering the tag requires --force.
 	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-newtag"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Clobber the tag.
+	umoci tag --image "${IMAGE}:${TAG}" --force "${TAG}-newtag"
 	[ "$status" -eq 0 ]
 	image-verify "${IMAGE}"
 
@@ -128,6 +171,138 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci tag mv" {
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-old"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	digest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-old")"
+
+	umoci tag mv --image "${IMAGE}:${TAG}-old" "${TAG}-new"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The old tag is gone, and the new tag refers to the same image.
+	umoci stat --image "${IMAGE}:${TAG}-old"
+	[ "$status" -ne 0 ]
+	[[ "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-new")" == "$digest" ]]
+
+	# Frozen tags cannot be moved, and no copy is left behind.
+	umoci freeze --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	umoci tag mv --image "${IMAGE}:${TAG}-new" "${TAG}-newer"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-newer"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci tag cp/rm" {
+	umoci tag cp --image "${IMAGE}:${TAG}" "${TAG}-copy"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-copy")" == "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")" ]]
+
+	umoci tag rm --image "${IMAGE}:${TAG}-copy"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-copy"
+	[ "$status" -ne 0 ]
+
+	# The subcommands require --image.
+	umoci tag rm
+	[ "$status" -ne 0 ]
+	umoci tag mv new-tag
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci tag --digest" {
+	digest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")"
+
+	# Tag the manifest by its digest.
+	umoci tag --image "${IMAGE}" --digest "$digest" "${TAG}-pinned"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(jq -SMr '.' "${IMAGE}/refs/${TAG}-pinned")" == "$(jq -SMr '.' "${IMAGE}/refs/${TAG}")" ]]
+
+	# Abbreviated digests and pinned references also work.
+	umoci tag cp --image "${IMAGE}" --digest "${digest:7:12}" "${TAG}-short"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-short")" == "$digest" ]]
+	umoci tag --image "${IMAGE}" --digest "${TAG}@${digest}" "${TAG}-ref"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-ref")" == "$digest" ]]
+
+	# The pinned tag is unaffected by changes to the original tag, and can be
+	# restored even once the original tag is gone.
+	umoci config --image "${IMAGE}:${TAG}" --config.user "nobody"
+	[ "$status" -eq 0 ]
+	umoci rm --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-pinned")" == "$digest" ]]
+	umoci tag --image "${IMAGE}" --digest "$digest" "${TAG}"
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	# The source tag cannot be given along with --digest.
+	umoci tag --image "${IMAGE}:${TAG}" --digest "$digest" "${TAG}-both"
+	[ "$status" -ne 0 ]
+	# Only manifests and manifest lists can be tagged.
+	config="$(jq -SMr '.config.digest' "${IMAGE}/blobs/$(echo "$digest" | tr : /)")"
+	umoci tag --image "${IMAGE}" --digest "$config" "${TAG}-config"
+	[ "$status" -ne 0 ]
+	# The blob must exist.
+	umoci tag --image "${IMAGE}" --digest "sha256:0000000000000000000000000000000000000000000000000000000000000000" "${TAG}-missing"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci tag [registry-style names]" {
+	# Names with slashes are stored as a single (escaped) file.
+	umoci tag --image "${IMAGE}:${TAG}" "library/ubuntu:${TAG}"
+	[ "$status" -eq 0 ]
+	[ -f "${IMAGE}/refs/library%2Fubuntu:${TAG}" ]
+	! [ -e "${IMAGE}/refs/library" ]
+
+	# ... and are listed with their original names.
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"library/ubuntu:${TAG}"* ]]
+
+	umoci stat --image "${IMAGE}:library/ubuntu:${TAG}" --json
+	[ "$status" -eq 0 ]
+	newOutput="$output"
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$newOutput" ]]
+
+	umoci tag mv --image "${IMAGE}:library/ubuntu:${TAG}" "example.com/foo/bar@v1+build"
+	[ "$status" -eq 0 ]
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"example.com/foo/bar@v1+build"* ]]
+	[[ "$output" != *"library/ubuntu"* ]]
+
+	umoci tag rm --image "${IMAGE}:example.com/foo/bar@v1+build"
+	[ "$status" -eq 0 ]
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"example.com"* ]]
+
+	# Names which cannot be stored are rejected.
+	for name in ".." "foo//bar" "/foo" "foo%2Fbar"; do
+		umoci tag --image "${IMAGE}:${TAG}" "$name"
+		[ "$status" -ne 0 ]
+	done
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci remove" {
 	# How many tags?
 	umoci list --layout "${IMAGE}"
@@ -163,6 +338,43 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci remove --prune" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Create a new image with an extra layer, sharing the rest of its blobs
+	# with the original tag.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "pruned" > "$BUNDLE/rootfs/pruned"
+	umoci repack --image "${IMAGE}:${TAG}-prune" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifest="${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-prune" | tr : /)"
+	newlayer="${IMAGE}/blobs/$(jq -SMr '.layers[-1].digest' "$manifest" | tr : /)"
+	oldlayer="${IMAGE}/blobs/$(jq -SMr '.layers[0].digest' "$manifest" | tr : /)"
+	[ -f "$newlayer" ]
+
+	# Add some garbage, which --prune must not touch.
+	echo "garbage" > "$BATS_TMPDIR/garbage"
+	garbage="${IMAGE}/blobs/sha256/$(sha256sum "$BATS_TMPDIR/garbage" | cut -d' ' -f1)"
+	cp "$BATS_TMPDIR/garbage" "$garbage"
+
+	umoci rm --prune --image "${IMAGE}:${TAG}-prune"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Only the blobs unique to the removed tag are gone.
+	[ ! -e "$manifest" ]
+	[ ! -e "$newlayer" ]
+	[ -f "$oldlayer" ]
+	[ -f "$garbage" ]
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE/other"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/other"
+}
+
 @test "umoci remove [missing args]" {
 	umoci remove
 	[ "$status" -ne 0 ]
@@ -170,3 +382,94 @@ function teardown() {
 	umoci rm
 	[ "$status" -ne 0 ]
 }
+
+@test "umoci freeze" {
+	# Make a copy of the tag and freeze it.
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-frozen"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci freeze --image "${IMAGE}:${TAG}-frozen"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Freezing a missing tag fails.
+	umoci freeze --image "${IMAGE}:${TAG}-missing"
+	[ "$status" -ne 0 ]
+
+	# Modify the original tag.
+	umoci config --author="Someone" --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Re-tagging the same descriptor is still permitted.
+	umoci tag --image "${IMAGE}:${TAG}-frozen" "${TAG}-frozen"
+	[ "$status" -eq 0 ]
+
+	# The frozen tag cannot be clobbered (even with --force) or removed.
+	umoci tag --image "${IMAGE}:${TAG}" --force "${TAG}-frozen"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"frozen"* ]]
+	umoci config --author="Someone Else" --image "${IMAGE}:${TAG}-frozen"
+	[ "$status" -ne 0 ]
+	umoci rm --image "${IMAGE}:${TAG}-frozen"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Cleaning the image doesn't remove the freeze.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	umoci rm --image "${IMAGE}:${TAG}-frozen"
+	[ "$status" -ne 0 ]
+
+	# Unfreeze the tag, after which it can be modified and removed.
+	umoci freeze --image "${IMAGE}:${TAG}-frozen" --unfreeze
+	[ "$status" -eq 0 ]
+	umoci freeze --image "${IMAGE}:${TAG}-frozen" --unfreeze
+	[ "$status" -eq 0 ]
+	umoci tag --image "${IMAGE}:${TAG}" --force "${TAG}-frozen"
+	[ "$status" -eq 0 ]
+	umoci rm --image "${IMAGE}:${TAG}-frozen"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --reference-hook" {
+	HOOKDIR="$(setup_tmpdir)"
+
+	# The hook only allows tags starting with "allowed-", and records its input.
+	cat >"$HOOKDIR/hook" <<-EOF_HOOK
+	#!/bin/sh
+	cat >"$HOOKDIR/input.json"
+	case "\$1" in
+		allowed-*) exit 0 ;;
+	esac
+	echo "tag \$1 is not allowed" >&2
+	exit 1
+	EOF_HOOK
+	chmod +x "$HOOKDIR/hook"
+
+	# Rejected writes must not create the tag.
+	umoci --reference-hook "$HOOKDIR/hook" tag --image "${IMAGE}:${TAG}" "rejected"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"is not allowed"* ]]
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"rejected"* ]]
+	image-verify "${IMAGE}"
+
+	umoci --reference-hook "$HOOKDIR/hook" tag --image "${IMAGE}:${TAG}" "allowed-tag"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The hook is passed the resolved manifest and configuration.
+	[[ "$(jq -SMr '.name' "$HOOKDIR/input.json")" == "allowed-tag" ]]
+	[[ "$(jq -SMr '.descriptor.digest' "$HOOKDIR/input.json")" == "$(jq -SMr '.digest' "${IMAGE}/refs/allowed-tag")" ]]
+	[[ "$(jq -SMr '.config.rootfs.type' "$HOOKDIR/input.json")" == "layers" ]]
+
+	# The environment variable works as well, and applies to other commands.
+	UMOCI_REFERENCE_HOOK="$HOOKDIR/hook" umoci config --image "${IMAGE}:${TAG}" --tag "rejected-config" --config.user "1000"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"is not allowed"* ]]
+	image-verify "${IMAGE}"
+}
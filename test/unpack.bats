@@ -64,6 +64,76 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci unpack --mode=overlay" {
+	requires root
+
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --mode=overlay "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The rootfs should be empty, with the layers extracted separately.
+	[ -f "$BUNDLE/config.json" ]
+	[ -f "$BUNDLE/overlay.json" ]
+	[ -d "$BUNDLE/rootfs" ]
+	[ -z "$(ls -A "$BUNDLE/rootfs")" ]
+	[ -d "$BUNDLE/layers/0" ]
+
+	# There should be one lowerdir for each layer.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	nlayers="$(echo "$output" | jq -SM '[.history[] | select(.empty_layer | not)] | length')"
+	sane_run jq -SM '.lowerdirs | length' "$BUNDLE/overlay.json"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq "$nlayers" ]
+
+	# Overlay bundles cannot be repacked.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Invalid modes should be rejected.
+	umoci unpack --image "${IMAGE}:${TAG}" --mode=invalid "$(setup_tmpdir)"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --runtime-stubs" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --runtime-stubs "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The stubs (or the image's versions) should exist.
+	[ -d "$BUNDLE/rootfs/proc" ]
+	[ -d "$BUNDLE/rootfs/sys" ]
+	[ -d "$BUNDLE/rootfs/dev" ]
+	[ -e "$BUNDLE/rootfs/etc/hostname" ] || [ -L "$BUNDLE/rootfs/etc/hostname" ]
+	[ -e "$BUNDLE/rootfs/etc/resolv.conf" ] || [ -L "$BUNDLE/rootfs/etc/resolv.conf" ]
+
+	# Repacking should not include any of the stubs.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	NEWBUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$NEWBUNDLE"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.runtime_stubs[]?' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	for stub in "${lines[@]}"; do
+		! [ -e "$NEWBUNDLE/rootfs/$stub" ]
+	done
+
+	# --runtime-stubs is not supported in overlay mode.
+	umoci unpack --image "${IMAGE}:${TAG}" --runtime-stubs --mode=overlay "$(setup_tmpdir)"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci unpack [missing args]" {
 	BUNDLE="$(setup_tmpdir)"
 
@@ -72,6 +142,15 @@ function teardown() {
 
 	umoci unpack "$BUNDLE"
 	[ "$status" -ne 0 ]
+
+	umoci unpack --image="${IMAGE}:${TAG}" --uname-map=nobody "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	umoci unpack --image="${IMAGE}:${TAG}" --gname-map=nobody:-1 "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	umoci unpack --image="${IMAGE}:${TAG}" --fallback-owner=65534 "$BUNDLE"
+	[ "$status" -ne 0 ]
 }
 
 @test "umoci unpack [config.json contains mount namespace]" {
@@ -120,3 +199,638 @@ function teardown() {
 }
 
 # TODO: Add a test using OCI extraction and verify it with go-mtree.
+
+@test "umoci unpack --progress" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	umoci --progress=invalid unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	# Progress is reported for each layer.
+	umoci --progress=plain unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	[[ "$output" == *"unpack sha256:"*"done"* ]]
+
+	# No progress is reported if stderr is not a terminal.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[[ "$output" != *"unpack sha256:"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --stats" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	umoci --stats-format=invalid unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	# A summary is printed when exiting.
+	umoci --stats unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	[[ "$output" == *"wall time:"*"cpu time:"*"peak rss:"* ]]
+
+	umoci --stats --stats-format=json unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[[ "$(echo "${lines[-1]}" | jq -SMr '.peak_rss')" -gt 0 ]]
+
+	# No summary is printed by default.
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"wall time:"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --log-format=json" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci --log-format=invalid unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	umoci --log=debug --log-format=json unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Every line is a JSON object, and the layers are logged as they are
+	# applied.
+	for line in "${lines[@]}"; do
+		echo "$line" | jq -e '.time and .level and .msg' >/dev/null
+	done
+	nlayers="$(printf '%s\n' "${lines[@]}" | jq -sr '[.[] | select(.fields.event == "layer-applied")] | length')"
+	[ "$nlayers" -gt 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --retries" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	umoci --retries=-1 unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci --retries=3 --retry-delay=-1s unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	# Retrying must not change the result of a successful operation.
+	umoci --retries=3 --retry-delay=10ms unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	UMOCI_RETRIES=3 umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --no-sync" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Writing without syncing must not change the result.
+	umoci --no-sync config --image "${IMAGE}:${TAG}" --tag "${TAG}-nosync" --config.user "1234:1332"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	UMOCI_NO_SYNC=1 umoci unpack --image "${IMAGE}:${TAG}-nosync" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	sane_run jq -SMr '.process.user.uid' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "1234" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --temp-dir" {
+	TEMPDIR="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci --temp-dir "$TEMPDIR" config --image "${IMAGE}:${TAG}" --tag "${TAG}-tempdir" --config.user "1234:1332"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The temporary directory must be removed once umoci is done.
+	[ -z "$(ls -A "$TEMPDIR")" ]
+
+	UMOCI_TEMP_DIR="$TEMPDIR" umoci unpack --image "${IMAGE}:${TAG}-tempdir" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The temporary directory must exist.
+	umoci --temp-dir "$TEMPDIR/non-existent" config --image "${IMAGE}:${TAG}" --config.user "1234:1332"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --strict" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Valid images are unaffected.
+	umoci --strict config --image "${IMAGE}:${TAG}" --tag "${TAG}-strict" --config.user "1234:1332"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	UMOCI_STRICT=1 umoci unpack --image "${IMAGE}:${TAG}-strict" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create a manifest which claims its (compressed) layer is uncompressed.
+	MANIFEST="$(setup_tmpdir)/manifest.json"
+	sane_run jq -cM '.layers[0].mediaType = "application/vnd.oci.image.layer.v1.tar"' "${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}" | tr : /)"
+	[ "$status" -eq 0 ]
+	echo "$output" >"$MANIFEST"
+	digest="$(sha256sum "$MANIFEST" | cut -d' ' -f1)"
+	cp "$MANIFEST" "${IMAGE}/blobs/sha256/$digest"
+	jq -cM --arg digest "sha256:$digest" --argjson size "$(stat -c %s "$MANIFEST")" '.digest = $digest | .size = $size' "${IMAGE}/refs/${TAG}" >"${IMAGE}/refs/${TAG}-invalid"
+
+	# Without --strict the layer isn't checked until it is unpacked.
+	umoci tag --image "${IMAGE}:${TAG}-invalid" "${TAG}-invalid-copy"
+	[ "$status" -eq 0 ]
+
+	# With --strict the invalid layer is rejected on read and write.
+	umoci --strict tag --image "${IMAGE}:${TAG}-invalid" "${TAG}-invalid-strict"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"blob contents do not match media type"* ]]
+	umoci stat --image "${IMAGE}:${TAG}-invalid-strict"
+	[ "$status" -ne 0 ]
+
+	umoci --strict unpack --image "${IMAGE}:${TAG}-invalid" "$BUNDLE/invalid"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"blob contents do not match media type"* ]]
+}
+
+@test "umoci unpack --foreign-layers" {
+	BUNDLE="$(setup_tmpdir)"
+	FOREIGN="$(setup_tmpdir)/image"
+
+	umoci init --layout "$FOREIGN"
+	[ "$status" -eq 0 ]
+	umoci copy --from "${IMAGE}:${TAG}" --to "${FOREIGN}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	# Mark the top layer as non-distributable, and remove its blob.
+	MANIFEST="$(setup_tmpdir)/manifest.json"
+	sane_run jq -cM '.layers[-1].mediaType = "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip" | .layers[-1].urls = ["http://127.0.0.1:1/layer"]' "${FOREIGN}/blobs/$(jq -SMr '.digest' "${FOREIGN}/refs/${TAG}" | tr : /)"
+	[ "$status" -eq 0 ]
+	echo "$output" >"$MANIFEST"
+	rm -f "${FOREIGN}/blobs/$(jq -SMr '.layers[-1].digest' "$MANIFEST" | tr : /)"
+	digest="$(sha256sum "$MANIFEST" | cut -d' ' -f1)"
+	cp "$MANIFEST" "${FOREIGN}/blobs/sha256/$digest"
+	jq -cM --arg digest "sha256:$digest" --argjson size "$(stat -c %s "$MANIFEST")" '.digest = $digest | .size = $size' "${FOREIGN}/refs/${TAG}" >"${FOREIGN}/refs/${TAG}-foreign"
+	rm -f "${FOREIGN}/refs/${TAG}"
+
+	# The layer is preserved by modifications, copies and gc.
+	umoci config --image "${FOREIGN}:${TAG}-foreign" --config.user "1234:1332"
+	[ "$status" -eq 0 ]
+	umoci gc --layout "$FOREIGN"
+	[ "$status" -eq 0 ]
+	umoci copy --from "${FOREIGN}:${TAG}-foreign" --to "${FOREIGN}:${TAG}-copy"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.layers[-1].urls[0]' "${FOREIGN}/blobs/$(jq -SMr '.digest' "${FOREIGN}/refs/${TAG}-copy" | tr : /)"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "http://127.0.0.1:1/layer" ]]
+
+	# By default, unpacking fails.
+	umoci unpack --image "${FOREIGN}:${TAG}-foreign" "$BUNDLE/default"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"foreign layer blob is not present in the image"* ]]
+
+	# Nothing can be fetched from the URL.
+	umoci unpack --image "${FOREIGN}:${TAG}-foreign" --foreign-layers=fetch "$BUNDLE/fetch"
+	[ "$status" -ne 0 ]
+
+	umoci unpack --image "${FOREIGN}:${TAG}-foreign" --foreign-layers=bogus "$BUNDLE/bogus"
+	[ "$status" -ne 0 ]
+
+	# The layer can be skipped.
+	umoci unpack --image "${FOREIGN}:${TAG}-foreign" --foreign-layers=skip "$BUNDLE/skip"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"skipping foreign layer"* ]]
+	bundle-verify "$BUNDLE/skip"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --verify-layers" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --verify-layers --verify-jobs=-1 "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	# --verify-jobs is only used by --verify-layers.
+	umoci unpack --image "${IMAGE}:${TAG}" --verify-jobs=1 "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	# The layers are only verified up-front with --verify-layers.
+	umoci --log=info unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	[[ "$output" != *"verify diffids: hashed"* ]]
+
+	# The throughput of the verification is logged.
+	umoci --log=info unpack --image "${IMAGE}:${TAG}" --verify-layers --verify-jobs=1 "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[[ "$output" == *"verify diffids: hashed"*"/s)"* ]]
+
+	umoci unpack --image "${IMAGE}:${TAG}" --verify-layers --verify-jobs=8 "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
+	# --verify-layers is not supported with --format=cpio.
+	umoci unpack --image "${IMAGE}:${TAG}" --format=cpio --verify-layers "$(setup_tmpdir)/image.cpio"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --hardlink-mode" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --hardlink-mode=invalid "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	umoci unpack --image "${IMAGE}:${TAG}" --hardlink-mode=follow "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Copying hardlink targets must produce the same rootfs contents.
+	umoci unpack --image "${IMAGE}:${TAG}" --hardlink-mode=copy "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	diff -r "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+
+	# --hardlink-mode is not supported with --format=cpio.
+	umoci unpack --image "${IMAGE}:${TAG}" --format=cpio --hardlink-mode=copy "$(setup_tmpdir)/image.cpio"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --insecure-extraction" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Skipping the checks must produce the same rootfs contents.
+	umoci unpack --image "${IMAGE}:${TAG}" --insecure-extraction "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	diff -r "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+
+	# --insecure-extraction is not supported with --format=cpio.
+	umoci unpack --image "${IMAGE}:${TAG}" --format=cpio --insecure-extraction "$(setup_tmpdir)/image.cpio"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --runtime-profile" {
+	for profile in default minimal systemd rootless-podman; do
+		BUNDLE="$(setup_tmpdir)"
+		umoci unpack --image "${IMAGE}:${TAG}" --runtime-profile "$profile" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+	done
+
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}" --runtime-profile minimal "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.process.noNewPrivileges' "$BUNDLE/config.json")" == "true" ]]
+	[[ "$(jq -SMr '[.mounts[].destination] | sort | join(",")' "$BUNDLE/config.json")" == "/dev,/dev/pts,/proc,/sys" ]]
+
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}" --runtime-profile systemd "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.mounts[] | select(.destination == "/sys/fs/cgroup") | .type' "$BUNDLE/config.json")" == "cgroup" ]]
+	[[ "$(jq -SMr '.linux.namespaces[] | select(.type == "cgroup") | .type' "$BUNDLE/config.json")" == "cgroup" ]]
+	[[ "$(jq -SMr '.process.env[]' "$BUNDLE/config.json")" == *"container=oci"* ]]
+
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}" --runtime-profile rootless-podman "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.linux.namespaces[] | select(.type == "user") | .type' "$BUNDLE/config.json")" == "user" ]]
+	[[ "$(jq -SMr '.linux.namespaces[] | select(.type == "network") | .type' "$BUNDLE/config.json")" == "network" ]]
+
+	# Unknown profiles are rejected.
+	umoci unpack --image "${IMAGE}:${TAG}" --runtime-profile unknown "$(setup_tmpdir)"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --runtime-{hook,seccomp,mount}" {
+	BUNDLE="$(setup_tmpdir)"
+	SECCOMP="$(setup_tmpdir)/seccomp.json"
+	echo '{"defaultAction": "SCMP_ACT_ALLOW"}' >"$SECCOMP"
+
+	umoci unpack --image "${IMAGE}:${TAG}" \
+		--runtime-hook prestart=/bin/hook,--first --runtime-hook prestart=/bin/hook,--second \
+		--runtime-hook poststop=/bin/cleanup \
+		--runtime-seccomp "$SECCOMP" \
+		--runtime-mount /srv:/data:ro,nosuid "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	[[ "$(jq -SMrc '.hooks.prestart | map(.args)' "$BUNDLE/config.json")" == '[["/bin/hook","--first"],["/bin/hook","--second"]]' ]]
+	[[ "$(jq -SMr '.hooks.poststop[0].path' "$BUNDLE/config.json")" == "/bin/cleanup" ]]
+	[[ "$(jq -SMr '.linux.seccomp.defaultAction' "$BUNDLE/config.json")" == "SCMP_ACT_ALLOW" ]]
+	[[ "$(jq -SMrc '.mounts[] | select(.destination == "/data") | [.source, .type, .options]' "$BUNDLE/config.json")" == '["/srv","bind",["rbind","ro","nosuid"]]' ]]
+
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}" --runtime-seccomp unconfined "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.linux.seccomp' "$BUNDLE/config.json")" == "null" ]]
+
+	# Invalid options are rejected.
+	umoci unpack --image "${IMAGE}:${TAG}" --runtime-hook prerun=/bin/hook "$(setup_tmpdir)"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --runtime-hook prestart=hook "$(setup_tmpdir)"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --runtime-mount /srv "$(setup_tmpdir)"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --runtime-mount /srv:data "$(setup_tmpdir)"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --runtime-seccomp "$(setup_tmpdir)/nonexistent.json" "$(setup_tmpdir)"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --include" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --include "" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --format=cpio --include /etc "$(setup_tmpdir)/image.cpio"
+	[ "$status" -ne 0 ]
+
+	# Unpack the full image for comparison.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --include /etc --include /bin/sh "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# The included paths must be identical to the full unpack.
+	diff -r --no-dereference "$BUNDLE_A/rootfs/etc" "$BUNDLE_B/rootfs/etc"
+	[ -e "$BUNDLE_B/rootfs/bin/sh" ] || [ -L "$BUNDLE_B/rootfs/bin/sh" ]
+
+	# Nothing else should have been unpacked.
+	sane_run find "$BUNDLE_B/rootfs" -mindepth 1 -maxdepth 1
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	sane_run find "$BUNDLE_B/rootfs/bin" -mindepth 1
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+
+	# The included paths are recorded in the bundle metadata.
+	sane_run jq -SMr '.includes | join(",")' "$BUNDLE_B/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "/etc,/bin/sh" ]]
+
+	# Whiteouts in later layers are honoured.
+	rm -rf "$BUNDLE_A/rootfs/etc/passwd"
+	umoci repack --image "${IMAGE}:${TAG}-whiteout" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	BUNDLE_C="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}-whiteout" --include /etc "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+	[ -d "$BUNDLE_C/rootfs/etc" ]
+	! [ -e "$BUNDLE_C/rootfs/etc/passwd" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --format=cpio" {
+	ARCHIVE_DIR="$(setup_tmpdir)"
+
+	# Unsupported options.
+	umoci unpack --image "${IMAGE}:${TAG}" --format=invalid "$ARCHIVE_DIR/invalid"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --compress=gzip "$ARCHIVE_DIR/invalid"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --format=cpio --compress=invalid "$ARCHIVE_DIR/invalid"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --format=cpio --mode=overlay "$ARCHIVE_DIR/invalid"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --format=cpio --runtime-stubs "$ARCHIVE_DIR/invalid"
+	[ "$status" -ne 0 ]
+	[ ! -e "$ARCHIVE_DIR/invalid" ]
+
+	# An uncompressed "newc" archive.
+	umoci unpack --image "${IMAGE}:${TAG}" --format=cpio "$ARCHIVE_DIR/rootfs.cpio"
+	[ "$status" -eq 0 ]
+	[[ "$(head -c6 "$ARCHIVE_DIR/rootfs.cpio")" == "070701" ]]
+
+	# The archive is never overwritten.
+	umoci unpack --image "${IMAGE}:${TAG}" --format=cpio "$ARCHIVE_DIR/rootfs.cpio"
+	[ "$status" -ne 0 ]
+
+	# The compressed archive has the same contents.
+	umoci unpack --image "${IMAGE}:${TAG}" --format=cpio --compress=gzip "$ARCHIVE_DIR/rootfs.cpio.gz"
+	[ "$status" -eq 0 ]
+	gzip -dc "$ARCHIVE_DIR/rootfs.cpio.gz" | cmp - "$ARCHIVE_DIR/rootfs.cpio"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --format=squashfs" {
+	IMAGE_DIR="$(setup_tmpdir)"
+
+	# Unsupported options.
+	umoci unpack --image "${IMAGE}:${TAG}" --format=squashfs --compress=gzip "$IMAGE_DIR/invalid"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --format=squashfs --rootless "$IMAGE_DIR/invalid"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --format=squashfs -
+	[ "$status" -ne 0 ]
+	[ ! -e "$IMAGE_DIR/invalid" ]
+
+	command -v mksquashfs >/dev/null || skip "test requires mksquashfs"
+	command -v unsquashfs >/dev/null || skip "test requires unsquashfs"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --format=squashfs "$IMAGE_DIR/rootfs.sqfs"
+	[ "$status" -eq 0 ]
+
+	# The image is never overwritten.
+	umoci unpack --image "${IMAGE}:${TAG}" --format=squashfs "$IMAGE_DIR/rootfs.sqfs"
+	[ "$status" -ne 0 ]
+	[ -s "$IMAGE_DIR/rootfs.sqfs" ]
+
+	# The image has the same contents as an unpacked bundle.
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	sane_run find "$BUNDLE/rootfs" -mindepth 1 -printf '%P\n'
+	[ "$status" -eq 0 ]
+	diff <(unsquashfs -l -d "" "$IMAGE_DIR/rootfs.sqfs" | sed -n -e 's|^/||p' | sort) <(echo "$output" | sort)
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --format=erofs" {
+	IMAGE_DIR="$(setup_tmpdir)"
+
+	# Unsupported options.
+	umoci unpack --image "${IMAGE}:${TAG}" --format=erofs --compress=zstd "$IMAGE_DIR/invalid"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --format=erofs --mode=overlay "$IMAGE_DIR/invalid"
+	[ "$status" -ne 0 ]
+	[ ! -e "$IMAGE_DIR/invalid" ]
+
+	command -v mkfs.erofs >/dev/null || skip "test requires mkfs.erofs"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --format=erofs "$IMAGE_DIR/rootfs.erofs"
+	[ "$status" -eq 0 ]
+	[ -s "$IMAGE_DIR/rootfs.erofs" ]
+
+	# The erofs superblock magic is at offset 1024.
+	[[ "$(od -An -tx1 -j1024 -N4 "$IMAGE_DIR/rootfs.erofs" | tr -d ' ')" == "e2e1f5e0" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --to-tar" {
+	ARCHIVE_DIR="$(setup_tmpdir)"
+
+	# Unsupported options.
+	umoci unpack --image "${IMAGE}:${TAG}" --to-tar "$ARCHIVE_DIR/invalid" "$ARCHIVE_DIR/bundle"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --to-tar "$ARCHIVE_DIR/invalid" --format=cpio
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --to-tar "$ARCHIVE_DIR/invalid" --mode=overlay
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --to-tar "$ARCHIVE_DIR/invalid" --compress=invalid
+	[ "$status" -ne 0 ]
+	[ ! -e "$ARCHIVE_DIR/invalid" ]
+
+	# Stream the flattened root filesystem to stdout.
+	"$UMOCI" --log=error unpack --image "${IMAGE}:${TAG}" --to-tar - > "$ARCHIVE_DIR/rootfs.tar"
+	tar -tf "$ARCHIVE_DIR/rootfs.tar" > "$ARCHIVE_DIR/list"
+	[ -s "$ARCHIVE_DIR/list" ]
+
+	# There are no whiteouts in the archive.
+	! grep -E '(^|/)\.wh\.' "$ARCHIVE_DIR/list"
+
+	# The archive has the same contents as an unpacked bundle.
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	sane_run find "$BUNDLE/rootfs" -mindepth 1 -printf '%P\n'
+	[ "$status" -eq 0 ]
+	diff <(sed -e 's|/$||' -e '/^\.$/d' "$ARCHIVE_DIR/list" | sort) <(echo "$output" | sort)
+
+	# The compressed archive has the same contents.
+	umoci unpack --image "${IMAGE}:${TAG}" --to-tar "$ARCHIVE_DIR/rootfs.tar.gz" --compress=gzip
+	[ "$status" -eq 0 ]
+	gzip -dc "$ARCHIVE_DIR/rootfs.tar.gz" | cmp - "$ARCHIVE_DIR/rootfs.tar"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [concurrent]" {
+	args=()
+	if [[ "$ROOTLESS" != 0 ]]; then
+		args+=("--rootless")
+	fi
+
+	# Unpack the same image into several bundles at once, while garbage
+	# collecting the image (which cleans up stale temporary directories).
+	BUNDLES=()
+	pids=()
+	for i in {1..8}; do
+		BUNDLE="$(setup_tmpdir)/bundle"
+		BUNDLES+=("$BUNDLE")
+		"$UMOCI" unpack "${args[@]}" --image "${IMAGE}:${TAG}" "$BUNDLE" &
+		pids+=("$!")
+		"$UMOCI" gc --layout "${IMAGE}" &
+		pids+=("$!")
+	done
+	for pid in "${pids[@]}"; do
+		wait "$pid"
+	done
+
+	# All of the bundles must be complete and identical.
+	for BUNDLE in "${BUNDLES[@]}"; do
+		bundle-verify "$BUNDLE"
+		diff -r "${BUNDLES[0]}/rootfs" "$BUNDLE/rootfs"
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --resume" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Add a layer to the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "resumed" > "$BUNDLE/rootfs/etc/resumed"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	MANIFEST="${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}" | tr : /)"
+	sane_run jq -SMr '.layers | length' "$MANIFEST"
+	[ "$status" -eq 0 ]
+	NUM_LAYERS="$output"
+
+	# Simulate an unpack which was interrupted while extracting the top layer.
+	NEWBUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}" "$NEWBUNDLE"
+	[ "$status" -eq 0 ]
+	! [ -e "$NEWBUNDLE/umoci-unpack.json" ]
+	rm -f "$NEWBUNDLE/config.json" "$NEWBUNDLE/umoci.json" "$NEWBUNDLE"/sha256_*.mtree "$NEWBUNDLE/rootfs/etc/resumed"
+	jq -SMn --arg config "$(jq -SMr '.config.digest' "$MANIFEST")" --argjson layers "$((NUM_LAYERS - 1))" \
+		'{"config": $config, "layers": $layers}' > "$NEWBUNDLE/umoci-unpack.json"
+
+	# The partial bundle can't be unpacked over without --resume.
+	umoci unpack --image "${IMAGE}:${TAG}" "$NEWBUNDLE"
+	[ "$status" -ne 0 ]
+
+	# ... or resumed with different options.
+	umoci unpack --image "${IMAGE}:${TAG}" --include /etc --resume "$NEWBUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Only the top layer is extracted again.
+	umoci unpack --image "${IMAGE}:${TAG}" --resume "$NEWBUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$NEWBUNDLE"
+	! [ -e "$NEWBUNDLE/umoci-unpack.json" ]
+	[[ "$(cat "$NEWBUNDLE/rootfs/etc/resumed")" == "resumed" ]]
+	gomtree -p "$NEWBUNDLE/rootfs" -f "$NEWBUNDLE"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# A complete bundle can't be resumed.
+	umoci unpack --image "${IMAGE}:${TAG}" --resume "$NEWBUNDLE"
+	[ "$status" -ne 0 ]
+
+	# --resume is not supported with archives.
+	umoci unpack --image "${IMAGE}:${TAG}" --format=cpio --resume "$(setup_tmpdir)/archive.cpio"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,104 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci which [missing args]" {
+	umoci which --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci which --layout "${IMAGE}" "not-a-digest"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci which" {
+	image-verify "${IMAGE}"
+
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")"
+	layer="$(jq -SMr '.layers[0].digest' "${IMAGE}/blobs/$(echo "$manifest" | tr : /)")"
+
+	umoci which --layout "${IMAGE}" --json "$layer"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr "map(select(.name == \"${TAG}\")) | length")" -eq 1 ]]
+	[[ "$(echo "$output" | jq -SMr "map(select(.name == \"${TAG}\"))[0].path[0].digest")" == "$manifest" ]]
+	[[ "$(echo "$output" | jq -SMr "map(select(.name == \"${TAG}\"))[0].path[-1].digest")" == "$layer" ]]
+
+	# A new tag for the same image is listed too.
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-copy"
+	[ "$status" -eq 0 ]
+	umoci which --layout "${IMAGE}" --json "$layer"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr "map(select(.name == \"${TAG}-copy\")) | length")" -eq 1 ]]
+
+	# Once all tags are removed, the layer is no longer referenced.
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	for tag in "${lines[@]}"; do
+		umoci rm --image "${IMAGE}:${tag}"
+		[ "$status" -eq 0 ]
+	done
+	umoci which --layout "${IMAGE}" --json "$layer"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr 'length')" -eq 0 ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci which [abbreviated digest]" {
+	image-verify "${IMAGE}"
+
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}")"
+	layer="$(jq -SMr '.layers[0].digest' "${IMAGE}/blobs/$(echo "$manifest" | tr : /)")"
+	layerHex="${layer#sha256:}"
+
+	# Abbreviated digests (with and without the algorithm) are resolved.
+	umoci which --layout "${IMAGE}" --json "$layer"
+	[ "$status" -eq 0 ]
+	expected="$output"
+	umoci which --layout "${IMAGE}" --json "${layerHex:0:8}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$expected" ]]
+	umoci which --layout "${IMAGE}" --json "sha256:${layerHex:0:8}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$expected" ]]
+
+	# Prefixes that are too short, or match no blobs, are rejected.
+	umoci which --layout "${IMAGE}" --json "${layerHex:0:3}"
+	[ "$status" -ne 0 ]
+	umoci which --layout "${IMAGE}" --json "sha512:${layerHex:0:8}"
+	[ "$status" -ne 0 ]
+
+	# Ambiguous prefixes are rejected, listing the matching digests.
+	fake="${layerHex:0:8}$(printf '0%.0s' {1..56})"
+	cp "${IMAGE}/blobs/sha256/$layerHex" "${IMAGE}/blobs/sha256/$fake"
+	umoci which --layout "${IMAGE}" --json "${layerHex:0:8}"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"ambiguous"* ]]
+	[[ "$output" == *"sha256:$fake"* ]]
+	[[ "$output" == *"$layer"* ]]
+	rm "${IMAGE}/blobs/sha256/$fake"
+
+	image-verify "${IMAGE}"
+}